@@ -24,6 +24,20 @@ gdt0_ds_seg:  dw 0           ; Limit (low)
               db 10010010b   ; Access (read/write)
               db 00000000b   ; Granularity
               db 0           ; Base (high)
+gdt0_user_ds_seg: dw 0       ; Limit (low)
+              dw 0           ; Base (low)
+              db 0           ; Base (middle)
+              db 11110010b   ; Access (read/write, DPL 3)
+              db 00000000b   ; Granularity
+              db 0           ; Base (high)
+gdt0_user_cs_seg: dw 0       ; Limit (low)
+              dw 0           ; Base (low)
+              db 0           ; Base (middle)
+              db 11111010b   ; Access (exec/read, DPL 3)
+              db 00100000b   ; Granularity
+              db 0           ; Base (high)
+gdt0_tss_seg: dq 0           ; 16-byte TSS descriptor; populated by the
+              dq 0           ; kernel once it sets up the TSS.
 
 gdt0_desc:
 	dw $ - gdt0 - 1  ; gdt size should be 1 byte less than actual length
@@ -297,11 +311,19 @@ _rt0_enter_long_mode:
 	or eax, 1 << 5
 	mov cr4, eax
 
-	; Now enable long mode (bit 8) and the no-execute support (bit 11) by 
-	; modifying the EFER MSR
+	; Now enable long mode (bit 8) and, if the processor supports it, the
+	; no-execute support (bit 11) by modifying the EFER MSR. Setting the
+	; NXE bit on processors without NX support triggers a #GP.
+	mov esi, 1 << 8
+	mov eax, 0x80000001
+	cpuid
+	test edx, 1 << 20      ; Test if the NX-bit, which is bit 20, is set in the D-register.
+	jz _rt0_enter_long_mode.no_nx
+	or esi, 1 << 11
+.no_nx:
 	mov ecx, 0xc0000080
 	rdmsr	; read msr value to eax
-	or eax, (1 << 8) | (1<<11)
+	or eax, esi
 	wrmsr
 
 	; Finally enable paging (bit 31) and user/kernel page write protection (bit 16)
@@ -197,4 +197,14 @@ _rt0_redirect_table:
 	dq 0  ; dst: address of the symbol where calls to src are redirected to
 	%endrep
 
+;------------------------------------------------------------------------------
+; The kernel symbol table is also placed in a dedicated section. Its contents
+; are generated after the kernel image is linked so we reserve KSYMTAB_SIZE
+; bytes (passed to nasm by the Makefile) which are populated by the ksyms tool.
+;------------------------------------------------------------------------------
+section .ksymtab progbits alloc noexec nowrite align=16
+
+_rt0_ksymtab:
+	times KSYMTAB_SIZE db 0
+
 
@@ -2,28 +2,45 @@ package acpi
 
 import (
 	"gopheros/device"
+	"gopheros/device/acpi/aml"
 	"gopheros/device/acpi/table"
 	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
 	"gopheros/kernel/kfmt"
 	"gopheros/kernel/mm"
 	"gopheros/kernel/mm/vmm"
+	"gopheros/multiboot"
 	"io"
+	"reflect"
+	"sort"
 	"unsafe"
 )
 
 const (
 	acpiRev1     uint8 = 0
 	acpiRev2Plus uint8 = 2
+
+	// maxAMLTables is the maximum number of DSDT/SSDT tables that can be
+	// loaded into the AML namespace. Handle 0 is reserved for the default
+	// scopes.
+	maxAMLTables = 255
 )
 
 var (
 	errMissingRSDP           = &kernel.Error{Module: "acpi", Message: "could not locate ACPI RSDP"}
 	errTableChecksumMismatch = &kernel.Error{Module: "acpi", Message: "detected checksum mismatch while parsing ACPI table header"}
+	errTableMapFailed        = &kernel.Error{Module: "acpi", Message: "unable to map ACPI table"}
 
 	mapFn         = vmm.Map
 	identityMapFn = vmm.IdentityMapRegion
 	unmapFn       = vmm.Unmap
 
+	// bootloaderRSDPFn is used by tests to mock calls to multiboot.ACPIRSDP.
+	bootloaderRSDPFn = multiboot.ACPIRSDP
+
+	// cmdlineBoolFn is used by tests to mock calls to cmdline.Bool.
+	cmdlineBoolFn = cmdline.Bool
+
 	// RDSP must be located in the physical memory region 0xe0000 to 0xfffff
 	rsdpLocationLow uintptr = 0xe0000
 	rsdpLocationHi  uintptr = 0xfffff
@@ -31,6 +48,12 @@ var (
 
 	rsdpSignature = [8]byte{'R', 'S', 'D', ' ', 'P', 'T', 'R', ' '}
 	fadtSignature = "FACP"
+	dsdtSignature = "DSDT"
+	ssdtSignature = "SSDT"
+
+	// activeDriver points to the ACPI driver instance that has been
+	// successfully initialized.
+	activeDriver *acpiDriver
 )
 
 type acpiDriver struct {
@@ -44,6 +67,30 @@ type acpiDriver struct {
 	// by the table name. All tables included in this map are mapped into
 	// memory.
 	tableMap map[string]*table.SDTHeader
+
+	// amlTables lists the DSDT followed by the SSDTs in the order they
+	// appear in the RSDT/XSDT. Each entry is tagged with the handle that
+	// the parser assigns to the objects defined by the table.
+	amlTables []amlTable
+
+	// namespace contains the AML object tree that is defined by the
+	// DSDT and SSDT tables.
+	namespace *aml.ObjectTree
+
+	// devices contains the devices defined in the AML namespace.
+	devices []Device
+}
+
+// amlTable describes an ACPI table that contains AML bytecode.
+type amlTable struct {
+	// name is the key for the table in the driver's table map.
+	name string
+
+	// handle tags the objects that the table defines in the AML
+	// namespace. Handles are assigned in load order starting at 1.
+	handle uint8
+
+	header *table.SDTHeader
 }
 
 // DriverInit initializes this driver.
@@ -53,10 +100,64 @@ func (drv *acpiDriver) DriverInit(w io.Writer) *kernel.Error {
 	}
 
 	drv.printTableInfo(w)
+	drv.loadNamespace(w)
+	activeDriver = drv
 
 	return nil
 }
 
+// LookupTable implements table.Resolver. It returns a pointer to the header
+// of the table with the specified signature or nil if no such table exists.
+func (drv *acpiDriver) LookupTable(name string) *table.SDTHeader {
+	return drv.tableMap[name]
+}
+
+// LookupTable searches the tables discovered by the ACPI driver for a table
+// with the specified signature. It returns nil if the ACPI driver has not been
+// initialized or if no matching table exists.
+func LookupTable(name string) *table.SDTHeader {
+	if activeDriver == nil {
+		return nil
+	}
+
+	return activeDriver.LookupTable(name)
+}
+
+// Namespace returns the AML object tree that was loaded by the ACPI driver. It
+// returns nil if the ACPI driver has not been initialized or if the AML
+// bytecode could not be parsed.
+func Namespace() *aml.ObjectTree {
+	if activeDriver == nil {
+		return nil
+	}
+
+	return activeDriver.namespace
+}
+
+// VisitTables invokes visitor with the signature and the raw contents of each
+// table discovered by the ACPI driver in ascending signature order. It is a
+// no-op if the ACPI driver has not been initialized.
+func VisitTables(visitor func(name string, data []byte)) {
+	if activeDriver == nil {
+		return
+	}
+
+	names := make([]string, 0, len(activeDriver.tableMap))
+	for name := range activeDriver.tableMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		header := activeDriver.tableMap[name]
+		visitor(name, *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+			Data: uintptr(unsafe.Pointer(header)),
+			Len:  int(header.Length),
+			Cap:  int(header.Length),
+		})))
+	}
+}
+
 // DriverName returns the name of this driver.
 func (*acpiDriver) DriverName() string {
 	return "ACPI"
@@ -79,9 +180,65 @@ func (drv *acpiDriver) printTableInfo(w io.Writer) {
 	}
 }
 
+// loadNamespace parses the AML bytecode in the DSDT and every SSDT in firmware
+// order, caches the identification objects of each device in the resulting
+// object tree and populates the device registry. Each table is assigned its own
+// handle so the objects it defines can be traced back to it. If the
+// "acpi.fold" flag is present on the boot command line, constant expressions
+// are folded after parsing. Since the AML namespace is not required for booting
+// the kernel, parse errors are reported to w and leave the namespace unset.
+func (drv *acpiDriver) loadNamespace(w io.Writer) {
+	if drv.tableMap[dsdtSignature] == nil {
+		return
+	}
+
+	drv.amlTables = drv.amlTables[:0]
+	for name := dsdtSignature; drv.tableMap[name] != nil && len(drv.amlTables) < maxAMLTables; name = SSDTName(len(drv.amlTables)) {
+		drv.amlTables = append(drv.amlTables, amlTable{
+			name:   name,
+			handle: uint8(len(drv.amlTables) + 1),
+			header: drv.tableMap[name],
+		})
+	}
+
+	tree := aml.NewObjectTree()
+	tree.CreateDefaultScopes(0)
+	parser := aml.NewParser(w, tree)
+
+	for _, amlTable := range drv.amlTables {
+		if err := parser.ParseAML(amlTable.handle, amlTable.name, amlTable.header); err != nil {
+			kfmt.Fprintf(w, "unable to load AML namespace from %s: %s\n", amlTable.name, err.Message)
+			return
+		}
+	}
+
+	// Folding runs before device identification so that identification
+	// methods which return a constant expression can also be cached.
+	if cmdlineBoolFn("acpi.fold") {
+		kfmt.Fprintf(w, "AML namespace: folded %d constant expressions\n", tree.FoldConstants())
+	}
+
+	drv.namespace = tree
+	kfmt.Fprintf(w, "AML namespace: identified %d devices\n", tree.IdentifyDevices())
+	drv.registerDevices(w)
+}
+
+// SSDTName returns the name that can be passed to LookupTable to retrieve the
+// SSDT with the specified 1-based index in firmware order. Since the XSDT may list several SSDTs, the first
+// SSDT is named "SSDT" and any subsequent SSDTs are named by appending their
+// index to the signature (e.g. "SSDT2").
+func SSDTName(index int) string {
+	if index <= 1 {
+		return ssdtSignature
+	}
+
+	return ssdtSignature + kfmt.Itoa(index)
+}
+
 // enumerateTables detects and maps all ACPI tables that are present. Besides
 // the table list defined by the RSDP, this method will also peek into the
-// FADT (if found) looking for the address of DSDT.
+// FADT (if found) looking for the address of DSDT. SSDTs are added to the table
+// map in firmware order using the names returned by SSDTName.
 func (drv *acpiDriver) enumerateTables(w io.Writer) *kernel.Error {
 	header, sizeofHeader, err := mapACPITable(drv.rsdtAddr)
 	if err != nil {
@@ -94,6 +251,7 @@ func (drv *acpiDriver) enumerateTables(w io.Writer) *kernel.Error {
 		acpiRev      = header.Revision
 		payloadLen   = header.Length - uint32(sizeofHeader)
 		sdtAddresses []uintptr
+		ssdtCount    int
 	)
 
 	// RSDT uses 4-byte long pointers whereas the XSDT uses 8-byte long.
@@ -126,6 +284,11 @@ func (drv *acpiDriver) enumerateTables(w io.Writer) *kernel.Error {
 		}
 
 		signature := string(header.Signature[:])
+		if signature == ssdtSignature {
+			ssdtCount++
+			drv.tableMap[SSDTName(ssdtCount)] = header
+			continue
+		}
 		drv.tableMap[signature] = header
 
 		// The FADT allows us to lookup the DSDT table address
@@ -168,15 +331,15 @@ func mapACPITable(tableAddr uintptr) (header *table.SDTHeader, sizeofHeader uint
 
 	// Identity-map the table header so we can access its length field
 	sizeofHeader = unsafe.Sizeof(table.SDTHeader{})
-	if headerPage, err = identityMapFn(mm.FrameFromAddress(tableAddr), sizeofHeader, vmm.FlagPresent); err != nil {
-		return nil, sizeofHeader, err
+	if headerPage, err = identityMapFn(mm.FrameFromAddress(tableAddr), sizeofHeader, vmm.FlagPresent|vmm.FlagNoExecute); err != nil {
+		return nil, sizeofHeader, errTableMapFailed.CausedBy(err)
 	}
 
 	// Expand mapping to cover the table contents
 	headerPageAddr := headerPage.Address() + vmm.PageOffset(tableAddr)
 	header = (*table.SDTHeader)(unsafe.Pointer(headerPageAddr))
-	if _, err = identityMapFn(mm.FrameFromAddress(tableAddr), uintptr(header.Length), vmm.FlagPresent); err != nil {
-		return nil, sizeofHeader, err
+	if _, err = identityMapFn(mm.FrameFromAddress(tableAddr), uintptr(header.Length), vmm.FlagPresent|vmm.FlagNoExecute); err != nil {
+		return nil, sizeofHeader, errTableMapFailed.CausedBy(err)
 	}
 
 	if !validTable(headerPageAddr, header.Length) {
@@ -186,16 +349,19 @@ func mapACPITable(tableAddr uintptr) (header *table.SDTHeader, sizeofHeader uint
 	return header, sizeofHeader, err
 }
 
-// locateRSDT scans the memory region [rsdpLocationLow, rsdpLocationHi] looking
-// for the signature of the root system descriptor pointer (RSDP). If the RSDP
-// is found and is valid, locateRSDT returns the physical address of the root
-// system descriptor table (RSDT) or the extended system descriptor table (XSDT)
-// if the system supports ACPI 2.0+.
+// locateRSDT returns the physical address of the root system descriptor table
+// (RSDT) or the extended system descriptor table (XSDT) if the system supports
+// ACPI 2.0+. The address is obtained from the root system descriptor pointer
+// (RSDP). If the bootloader supplied a valid copy of the RSDP, it is used as
+// is; this is always the case when booting via UEFI. Otherwise, locateRSDT
+// scans the memory region [rsdpLocationLow, rsdpLocationHi] looking for the
+// signature of a valid RSDP.
 func locateRSDT() (uintptr, bool, *kernel.Error) {
-	var (
-		rsdp  *table.RSDPDescriptor
-		rsdp2 *table.ExtRSDPDescriptor
-	)
+	if rsdpPtr := bootloaderRSDPFn(); rsdpPtr != 0 {
+		if tableAddr, useXSDT, ok := parseRSDP(rsdpPtr); ok {
+			return tableAddr, useXSDT, nil
+		}
+	}
 
 	// Cleanup temporary identity mappings when the function returns
 	defer func() {
@@ -206,40 +372,45 @@ func locateRSDT() (uintptr, bool, *kernel.Error) {
 
 	// Setup temporary identity mapping so we can scan for the header
 	for curPage := mm.PageFromAddress(rsdpLocationLow); curPage <= mm.PageFromAddress(rsdpLocationHi); curPage++ {
-		if err := mapFn(curPage, mm.Frame(curPage), vmm.FlagPresent); err != nil {
+		if err := mapFn(curPage, mm.Frame(curPage), vmm.FlagPresent|vmm.FlagNoExecute); err != nil {
 			return 0, false, err
 		}
 	}
 
 	// The RSDP should be aligned on a 16-byte boundary
-checkNextBlock:
 	for curPtr := rsdpLocationLow; curPtr < rsdpLocationHi; curPtr += rsdpAlignment {
-		rsdp = (*table.RSDPDescriptor)(unsafe.Pointer(curPtr))
-		for i, b := range rsdpSignature {
-			if rsdp.Signature[i] != b {
-				continue checkNextBlock
-			}
+		if tableAddr, useXSDT, ok := parseRSDP(curPtr); ok {
+			return tableAddr, useXSDT, nil
 		}
+	}
 
-		if rsdp.Revision == acpiRev1 {
-			if !validTable(curPtr, uint32(unsafe.Sizeof(*rsdp))) {
-				continue
-			}
+	return 0, false, errMissingRSDP
+}
 
-			return uintptr(rsdp.RSDTAddr), false, nil
-		}
+// parseRSDP checks whether rsdpPtr points to a valid RSDP and returns the
+// address of the RSDT or, if the system supports ACPI 2.0+, the XSDT.
+func parseRSDP(rsdpPtr uintptr) (uintptr, bool, bool) {
+	rsdp := (*table.RSDPDescriptor)(unsafe.Pointer(rsdpPtr))
+	if rsdp.Signature != rsdpSignature {
+		return 0, false, false
+	}
 
-		// System uses ACPI revision > 1 and provides an extended RSDP
-		// which can be accessed at the same place.
-		rsdp2 = (*table.ExtRSDPDescriptor)(unsafe.Pointer(curPtr))
-		if !validTable(curPtr, uint32(unsafe.Sizeof(*rsdp2))) {
-			continue
+	if rsdp.Revision == acpiRev1 {
+		if !validTable(rsdpPtr, uint32(unsafe.Sizeof(*rsdp))) {
+			return 0, false, false
 		}
 
-		return uintptr(rsdp2.XSDTAddr), true, nil
+		return uintptr(rsdp.RSDTAddr), false, true
 	}
 
-	return 0, false, errMissingRSDP
+	// System uses ACPI revision > 1 and provides an extended RSDP
+	// which can be accessed at the same place.
+	rsdp2 := (*table.ExtRSDPDescriptor)(unsafe.Pointer(rsdpPtr))
+	if !validTable(rsdpPtr, uint32(unsafe.Sizeof(*rsdp2))) {
+		return 0, false, false
+	}
+
+	return uintptr(rsdp2.XSDTAddr), true, true
 }
 
 // validTable calculates the checksum for an ACPI table of length tableLength
@@ -270,7 +441,10 @@ func probeForACPI() device.Driver {
 
 func init() {
 	device.RegisterDriver(&device.DriverInfo{
+		Name:  "ACPI",
 		Order: device.DetectOrderBeforeACPI,
 		Probe: probeForACPI,
 	})
+
+	device.SetPresenceFn(DevicesPresent)
 }
@@ -1,10 +1,14 @@
 package acpi
 
 import (
+	"bytes"
+	"gopheros/device/acpi/aml"
 	"gopheros/device/acpi/table"
 	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
 	"gopheros/kernel/mm"
 	"gopheros/kernel/mm/vmm"
+	"gopheros/multiboot"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -13,19 +17,18 @@ import (
 	"unsafe"
 )
 
-var (
-	dsdtSignature = "DSDT"
-)
-
 func TestProbe(t *testing.T) {
 	defer func(rsdpLow, rsdpHi, rsdpAlign uintptr) {
 		mapFn = vmm.Map
 		unmapFn = vmm.Unmap
+		bootloaderRSDPFn = multiboot.ACPIRSDP
 		rsdpLocationLow = rsdpLow
 		rsdpLocationHi = rsdpHi
 		rsdpAlignment = rsdpAlign
 	}(rsdpLocationLow, rsdpLocationHi, rsdpAlignment)
 
+	bootloaderRSDPFn = func() uintptr { return 0 }
+
 	t.Run("ACPI1", func(t *testing.T) {
 		mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return nil }
 		unmapFn = func(_ mm.Page) *kernel.Error { return nil }
@@ -157,6 +160,78 @@ func TestProbe(t *testing.T) {
 		}
 	})
 
+	t.Run("RSDP supplied by bootloader", func(t *testing.T) {
+		defer func() { bootloaderRSDPFn = func() uintptr { return 0 } }()
+
+		// The memory region scan should not be used
+		mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error {
+			t.Fatal("unexpected call to vmm.Map")
+			return nil
+		}
+
+		sizeofRSDP := unsafe.Sizeof(table.RSDPDescriptor{})
+		sizeofExtRSDP := unsafe.Sizeof(table.ExtRSDPDescriptor{})
+		buf := make([]byte, sizeofExtRSDP)
+		rsdpHeader := (*table.ExtRSDPDescriptor)(unsafe.Pointer(&buf[0]))
+		rsdpHeader.Signature = rsdpSignature
+		rsdpHeader.Revision = acpiRev2Plus
+		rsdpHeader.Checksum = -calcChecksum(uintptr(unsafe.Pointer(rsdpHeader)), uintptr(sizeofRSDP))
+		rsdpHeader.XSDTAddr = 0xc0ffee
+		rsdpHeader.ExtendedChecksum = -calcChecksum(uintptr(unsafe.Pointer(rsdpHeader)), uintptr(sizeofExtRSDP))
+
+		bootloaderRSDPFn = func() uintptr { return uintptr(unsafe.Pointer(&buf[0])) }
+
+		drv := probeForACPI()
+		if drv == nil {
+			t.Fatal("ACPI probe failed")
+		}
+
+		acpiDrv := drv.(*acpiDriver)
+		if acpiDrv.rsdtAddr != uintptr(rsdpHeader.XSDTAddr) || !acpiDrv.useXSDT {
+			t.Fatalf("expected probe to locate the XSDT at 0x%x; got 0x%x (XSDT: %t)", uintptr(rsdpHeader.XSDTAddr), acpiDrv.rsdtAddr, acpiDrv.useXSDT)
+		}
+	})
+
+	t.Run("invalid RSDP supplied by bootloader", func(t *testing.T) {
+		defer func() { bootloaderRSDPFn = func() uintptr { return 0 } }()
+
+		// The probe should fall back to scanning the memory region
+		var scanned bool
+		mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error {
+			scanned = true
+			return nil
+		}
+		unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+
+		sizeofRSDP := unsafe.Sizeof(table.RSDPDescriptor{})
+		bootloaderCopy := make([]byte, sizeofRSDP)
+		bootloaderRSDPFn = func() uintptr { return uintptr(unsafe.Pointer(&bootloaderCopy[0])) }
+
+		buf := make([]byte, sizeofRSDP)
+		rsdpHeader := (*table.RSDPDescriptor)(unsafe.Pointer(&buf[0]))
+		rsdpHeader.Signature = rsdpSignature
+		rsdpHeader.Revision = acpiRev1
+		rsdpHeader.RSDTAddr = 0xbadf00
+		rsdpHeader.Checksum = -calcChecksum(uintptr(unsafe.Pointer(rsdpHeader)), uintptr(sizeofRSDP))
+
+		rsdpLocationLow = uintptr(unsafe.Pointer(&buf[0]))
+		rsdpLocationHi = uintptr(unsafe.Pointer(&buf[sizeofRSDP-1]))
+		rsdpAlignment = 1
+
+		drv := probeForACPI()
+		if drv == nil {
+			t.Fatal("ACPI probe failed")
+		}
+
+		if !scanned {
+			t.Fatal("expected probe to scan the memory region for the RSDP")
+		}
+
+		if acpiDrv := drv.(*acpiDriver); acpiDrv.rsdtAddr != uintptr(rsdpHeader.RSDTAddr) || acpiDrv.useXSDT {
+			t.Fatalf("expected probe to locate the RSDT at 0x%x; got 0x%x", uintptr(rsdpHeader.RSDTAddr), acpiDrv.rsdtAddr)
+		}
+	})
+
 	t.Run("error mapping rsdp memory block", func(t *testing.T) {
 		expErr := &kernel.Error{Module: "test", Message: "vmm.Map failed"}
 		mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return expErr }
@@ -172,8 +247,20 @@ func TestProbe(t *testing.T) {
 func TestDriverInit(t *testing.T) {
 	defer func() {
 		identityMapFn = vmm.IdentityMapRegion
+		cmdlineBoolFn = cmdline.Bool
+		activeDriver = nil
 	}()
 
+	cmdlineBoolFn = func(_ string) bool { return false }
+
+	if header := LookupTable("APIC"); header != nil {
+		t.Fatal("expected LookupTable to return nil before the driver is initialized")
+	}
+
+	if Namespace() != nil {
+		t.Fatal("expected Namespace to return nil before the driver is initialized")
+	}
+
 	t.Run("success", func(t *testing.T) {
 		rsdtAddr, _ := genTestRDST(t, acpiRev2Plus)
 		identityMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
@@ -188,6 +275,20 @@ func TestDriverInit(t *testing.T) {
 		if err := drv.DriverInit(os.Stderr); err != nil {
 			t.Fatal(err)
 		}
+
+		for _, name := range []string{"APIC", dsdtSignature} {
+			if header := LookupTable(name); header == nil || string(header.Signature[:]) != name {
+				t.Errorf("expected LookupTable to return the %q table", name)
+			}
+		}
+
+		if header := LookupTable("FOO!"); header != nil {
+			t.Error("expected LookupTable to return nil for a missing table")
+		}
+
+		if Namespace() == nil {
+			t.Error("expected the AML namespace to be loaded")
+		}
 	})
 
 	t.Run("map errors in enumerateTables", func(t *testing.T) {
@@ -230,7 +331,7 @@ func TestDriverInit(t *testing.T) {
 		// Test map errors for all map calls in enumerateTables
 		for specIndex, spec := range specs {
 			identityMapFn = spec
-			if err := drv.DriverInit(os.Stderr); err != expErr {
+			if err := drv.DriverInit(os.Stderr); !err.Has(expErr) {
 				t.Errorf("[spec %d]; expected to get an error\n", specIndex)
 			}
 		}
@@ -345,6 +446,112 @@ func TestEnumerateTables(t *testing.T) {
 	})
 }
 
+func TestEnumerateTablesMultipleSSDTs(t *testing.T) {
+	defer func() {
+		identityMapFn = vmm.IdentityMapRegion
+		cmdlineBoolFn = cmdline.Bool
+	}()
+
+	cmdlineBoolFn = func(_ string) bool { return false }
+
+	identityMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		return mm.Page(frame), nil
+	}
+
+	_, tableList := genTestRDST(t, acpiRev2Plus)
+
+	var fadt *table.SDTHeader
+	for _, header := range tableList {
+		if string(header.Signature[:]) == fadtSignature {
+			fadt = header
+		}
+	}
+
+	// Assemble an XSDT that lists 3 SSDTs and the FADT. The second SSDT
+	// has a bad checksum and should be skipped.
+	ssdts := []*table.SDTHeader{
+		genTestSSDT("SSDTONE", []byte{0x08, 'O', 'N', 'E', '_', 0x01}),
+		genTestSSDT("SSDTBAD", []byte{0x08, 'B', 'A', 'D', '_', 0x01}),
+		genTestSSDT("SSDTTWO", []byte{0x08, 'T', 'W', 'O', '_', 0x01}),
+	}
+	ssdts[1].Checksum++
+
+	sizeofSDTHeader := unsafe.Sizeof(table.SDTHeader{})
+	buf := make([]byte, int(sizeofSDTHeader)+8*(len(ssdts)+1))
+	xsdt := (*table.SDTHeader)(unsafe.Pointer(&buf[0]))
+	xsdt.Signature = [4]byte{'X', 'S', 'D', 'T'}
+	xsdt.Revision = acpiRev2Plus
+	xsdt.Length = uint32(sizeofSDTHeader)
+	for _, header := range append(ssdts[:2:2], fadt, ssdts[2]) {
+		*(*uint64)(unsafe.Pointer(&buf[xsdt.Length])) = uint64(uintptr(unsafe.Pointer(header)))
+		xsdt.Length += 8
+	}
+	updateChecksum(xsdt)
+
+	drv := &acpiDriver{
+		rsdtAddr: uintptr(unsafe.Pointer(xsdt)),
+		useXSDT:  true,
+	}
+
+	if err := drv.enumerateTables(os.Stderr); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, exp := range map[string]*table.SDTHeader{"SSDT": ssdts[0], "SSDT2": ssdts[2]} {
+		if got := drv.tableMap[name]; got != exp {
+			t.Errorf("expected table %q to point to %v; got %v", name, exp, got)
+		}
+	}
+
+	if drv.tableMap["SSDT3"] != nil {
+		t.Error("expected SSDT with bad checksum to be skipped")
+	}
+
+	var output bytes.Buffer
+	drv.loadNamespace(&output)
+	if drv.namespace == nil {
+		t.Fatalf("expected namespace to be loaded; got:\n%s", output.String())
+	}
+
+	expTables := []string{dsdtSignature, "SSDT", "SSDT2"}
+	if exp, got := len(expTables), len(drv.amlTables); got != exp {
+		t.Fatalf("expected %d AML tables to be loaded; got %d", exp, got)
+	}
+
+	for i, exp := range expTables {
+		if got := drv.amlTables[i].name; got != exp {
+			t.Errorf("expected AML table %d to be %q; got %q", i, exp, got)
+		}
+
+		if got := drv.amlTables[i].handle; got != uint8(i+1) {
+			t.Errorf("expected AML table %q to have handle %d; got %d", exp, i+1, got)
+		}
+	}
+
+	for _, name := range []string{"ONE_", "TWO_"} {
+		if drv.namespace.Find(0, append([]byte{'\\'}, name...)) == aml.InvalidIndex {
+			t.Errorf("expected object %q to be defined in the AML namespace", name)
+		}
+	}
+}
+
+func TestSSDTName(t *testing.T) {
+	specs := []struct {
+		index int
+		exp   string
+	}{
+		{1, "SSDT"},
+		{2, "SSDT2"},
+		{12, "SSDT12"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := SSDTName(spec.index); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
 func TestMapACPITableErrors(t *testing.T) {
 	defer func() {
 		identityMapFn = vmm.IdentityMapRegion
@@ -367,7 +574,7 @@ func TestMapACPITableErrors(t *testing.T) {
 
 	// Test errors while mapping the table contents and the table header
 	for i := 0; i < 2; i++ {
-		if _, _, err := mapACPITable(0xf00); err != expErr {
+		if _, _, err := mapACPITable(0xf00); !err.Has(errTableMapFailed) || err.Cause != expErr {
 			t.Errorf("[spec %d]; expected to get an error\n", i)
 		}
 	}
@@ -467,6 +674,23 @@ func genTestRDST(t *testing.T, acpiVersion uint8) (rsdtAddr uintptr, tableList [
 	return uintptr(unsafe.Pointer(rsdtHeader)), tableList
 }
 
+// genTestSSDT returns a valid SSDT with the specified OEM table ID that
+// contains the supplied AML bytecode.
+func genTestSSDT(oemTableID string, bytecode []byte) *table.SDTHeader {
+	sizeofSDTHeader := unsafe.Sizeof(table.SDTHeader{})
+	buf := make([]byte, int(sizeofSDTHeader)+len(bytecode))
+	copy(buf[sizeofSDTHeader:], bytecode)
+
+	header := (*table.SDTHeader)(unsafe.Pointer(&buf[0]))
+	header.Signature = [4]byte{'S', 'S', 'D', 'T'}
+	header.Revision = 2
+	header.Length = uint32(len(buf))
+	copy(header.OEMTableID[:], oemTableID)
+	updateChecksum(header)
+
+	return header
+}
+
 func updateChecksum(header *table.SDTHeader) {
 	header.Checksum = -calcChecksum(uintptr(unsafe.Pointer(header)), uintptr(header.Length))
 }
@@ -484,3 +708,100 @@ func pkgDir() string {
 	_, f, _, _ := runtime.Caller(1)
 	return filepath.Dir(f)
 }
+
+func TestVisitTables(t *testing.T) {
+	defer func() { activeDriver = nil }()
+
+	visited := 0
+	VisitTables(func(_ string, _ []byte) { visited++ })
+	if visited != 0 {
+		t.Fatal("expected no tables to be visited if the driver is not initialized")
+	}
+
+	var (
+		buf   [2][64]byte
+		drv   = &acpiDriver{tableMap: make(map[string]*table.SDTHeader)}
+		exp   = []string{"APIC", "FACP"}
+		sizes = []uint32{48, 64}
+	)
+
+	for i, name := range []string{"FACP", "APIC"} {
+		header := (*table.SDTHeader)(unsafe.Pointer(&buf[i][0]))
+		copy(header.Signature[:], name)
+		header.Length = sizes[1-i]
+		drv.tableMap[name] = header
+	}
+	activeDriver = drv
+
+	var names []string
+	VisitTables(func(name string, data []byte) {
+		if string(data[:4]) != name {
+			t.Errorf("expected data for table %s to start with its signature; got %q", name, data[:4])
+		}
+		if exp := sizes[len(names)]; uint32(len(data)) != exp {
+			t.Errorf("expected table %s to be %d bytes long; got %d", name, exp, len(data))
+		}
+		names = append(names, name)
+	})
+
+	if len(names) != len(exp) || names[0] != exp[0] || names[1] != exp[1] {
+		t.Fatalf("expected tables to be visited in order %v; got %v", exp, names)
+	}
+}
+
+func TestLoadNamespace(t *testing.T) {
+	var buf bytes.Buffer
+
+	t.Run("missing DSDT", func(t *testing.T) {
+		drv := &acpiDriver{tableMap: make(map[string]*table.SDTHeader)}
+		drv.loadNamespace(&buf)
+
+		if drv.namespace != nil {
+			t.Fatal("expected namespace not to be loaded")
+		}
+	})
+
+	t.Run("parse error", func(t *testing.T) {
+		// Corrupt the DSDT bytecode
+		data := make([]byte, unsafe.Sizeof(table.SDTHeader{})+4)
+		header := (*table.SDTHeader)(unsafe.Pointer(&data[0]))
+		header.Length = uint32(len(data))
+		copy(data[unsafe.Sizeof(*header):], []byte{0x10, 0xff, 0xff, 0xff})
+
+		drv := &acpiDriver{tableMap: map[string]*table.SDTHeader{dsdtSignature: header}}
+		drv.loadNamespace(&buf)
+
+		if drv.namespace != nil {
+			t.Fatal("expected namespace not to be loaded")
+		}
+
+		if exp := "unable to load AML namespace"; !bytes.Contains(buf.Bytes(), []byte(exp)) {
+			t.Fatalf("expected output to contain %q; got:\n%s", exp, buf.String())
+		}
+	})
+
+	t.Run("constant folding", func(t *testing.T) {
+		defer func() { cmdlineBoolFn = cmdline.Bool }()
+
+		data, err := ioutil.ReadFile(pkgDir() + "/table/tabletest/DSDT.aml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		drv := &acpiDriver{tableMap: map[string]*table.SDTHeader{dsdtSignature: (*table.SDTHeader)(unsafe.Pointer(&data[0]))}}
+
+		for _, fold := range []bool{false, true} {
+			cmdlineBoolFn = func(name string) bool { return name == "acpi.fold" && fold }
+
+			buf.Reset()
+			drv.loadNamespace(&buf)
+
+			if drv.namespace == nil {
+				t.Fatal("expected namespace to be loaded")
+			}
+
+			if got := bytes.Contains(buf.Bytes(), []byte("constant expressions")); got != fold {
+				t.Errorf("[fold: %t] unexpected output:\n%s", fold, buf.String())
+			}
+		}
+	})
+}
@@ -0,0 +1,362 @@
+package aml
+
+// DeviceIDField is a bitmask that describes the identification objects that
+// can be defined for an AML Device.
+type DeviceIDField uint8
+
+// The list of supported device identification objects.
+const (
+	DeviceHID DeviceIDField = 1 << iota
+	DeviceCID
+	DeviceUID
+	DeviceADR
+	DeviceSTA
+)
+
+// The bits of the device status value returned by _STA.
+const (
+	StatusPresent uint64 = 1 << iota
+	StatusEnabled
+	StatusVisible
+	StatusFunctioning
+
+	// StatusDefault is the status of devices that do not define _STA.
+	StatusDefault = StatusPresent | StatusEnabled | StatusVisible | StatusFunctioning
+)
+
+// DeviceID caches the values of the identification objects (_HID, _CID, _UID
+// and _ADR) and the status (_STA) of an AML Device so that drivers can be
+// matched against a device without evaluating any AML.
+type DeviceID struct {
+	// HID contains the hardware ID of the device. Compressed EISA IDs are
+	// decoded into their string form (e.g. "PNP0A03").
+	HID string
+
+	// CIDs contains the compatible IDs of the device in the order that
+	// they are defined. Compressed EISA IDs are decoded like HID.
+	CIDs []string
+
+	// UID contains the unique ID of the device. Integer UIDs are stored
+	// using their decimal representation.
+	UID string
+
+	// ADR contains the address of the device on its parent bus.
+	ADR uint64
+
+	// STA contains the device status bits. It is set to StatusDefault if
+	// the device does not define _STA or if its value can only be obtained
+	// by evaluating AML.
+	STA uint64
+
+	// Defined is a bitmask of the identification objects that are
+	// defined for the device.
+	Defined DeviceIDField
+
+	// NeedsEval is a bitmask of the identification objects that are
+	// defined via a control method or a non-constant expression. As their
+	// value can only be obtained by evaluating AML, the respective
+	// DeviceID fields are left empty. Methods whose body consists of a
+	// single statement that returns a constant are treated as constants.
+	NeedsEval DeviceIDField
+}
+
+var (
+	nameHID = [amlNameLen]byte{'_', 'H', 'I', 'D'}
+	nameCID = [amlNameLen]byte{'_', 'C', 'I', 'D'}
+	nameUID = [amlNameLen]byte{'_', 'U', 'I', 'D'}
+	nameADR = [amlNameLen]byte{'_', 'A', 'D', 'R'}
+	nameSTA = [amlNameLen]byte{'_', 'S', 'T', 'A'}
+)
+
+// IdentifyDevices scans the tree for Device objects and caches the values of
+// their identification objects. The cached values can then be retrieved via a
+// call to DeviceIDOf. IdentifyDevices should be invoked after all AML tables
+// have been parsed and returns the number of identified devices.
+func (tree *ObjectTree) IdentifyDevices() int {
+	var count int
+	for _, obj := range tree.objPool {
+		if obj.opcode != pOpDevice {
+			continue
+		}
+
+		obj.value = tree.identifyDevice(obj)
+		count++
+	}
+
+	return count
+}
+
+// DeviceIDOf returns the cached identification for the Device at the specified
+// index. It returns nil if index does not point to a Device or if the tree has
+// not been scanned via a call to IdentifyDevices.
+func (tree *ObjectTree) DeviceIDOf(index uint32) *DeviceID {
+	obj := tree.ObjectAt(index)
+	if obj == nil || obj.opcode != pOpDevice {
+		return nil
+	}
+
+	id, _ := obj.value.(*DeviceID)
+	return id
+}
+
+// VisitDevices invokes visitor with the index and cached identification of
+// each Device in the tree. The cached identification is nil if the tree has
+// not been scanned via a call to IdentifyDevices.
+func (tree *ObjectTree) VisitDevices(visitor func(index uint32, id *DeviceID)) {
+	for _, obj := range tree.objPool {
+		if obj.opcode != pOpDevice {
+			continue
+		}
+
+		id, _ := obj.value.(*DeviceID)
+		visitor(obj.index, id)
+	}
+}
+
+// identifyDevice extracts the identification objects that are defined in the
+// scope of the specified Device object.
+func (tree *ObjectTree) identifyDevice(devObj *Object) *DeviceID {
+	id := &DeviceID{STA: StatusDefault}
+
+	scopeObj := tree.deviceScope(devObj)
+	if scopeObj == nil {
+		return id
+	}
+
+	for childIndex := scopeObj.firstArgIndex; childIndex != InvalidIndex; childIndex = tree.ObjectAt(childIndex).nextSiblingIndex {
+		child := tree.ObjectAt(childIndex)
+
+		var field DeviceIDField
+		switch child.name {
+		case nameHID:
+			field = DeviceHID
+		case nameCID:
+			field = DeviceCID
+		case nameUID:
+			field = DeviceUID
+		case nameADR:
+			field = DeviceADR
+		case nameSTA:
+			field = DeviceSTA
+		default:
+			continue
+		}
+
+		id.Defined |= field
+		if !tree.setDeviceIDField(id, field, tree.constValueOf(child)) {
+			id.NeedsEval |= field
+		}
+	}
+
+	return id
+}
+
+// DeviceIntValue returns the value of the integer object with the specified
+// name (e.g. "_BBN") that is defined in the scope of the Device at devIndex.
+// Like the cached identification objects, only Name-defined constants and
+// methods that return a constant are supported.
+func (tree *ObjectTree) DeviceIntValue(devIndex uint32, name string) (uint64, bool) {
+	return tree.constIntValue(tree.deviceValue(devIndex, name))
+}
+
+// DeviceBufferValue returns a copy of the contents of the buffer object with
+// the specified name (e.g. "_CRS") that is defined in the scope of the Device
+// at devIndex. Like DeviceIntValue, only constant buffers are supported.
+func (tree *ObjectTree) DeviceBufferValue(devIndex uint32, name string) ([]byte, bool) {
+	obj := tree.deviceValue(devIndex, name)
+	if obj == nil || obj.opcode != pOpBuffer {
+		return nil, false
+	}
+
+	size, ok := tree.constIntValue(tree.ArgAt(obj, 0))
+	byteList := tree.ArgAt(obj, 1)
+	if !ok || byteList == nil || byteList.opcode != pOpIntByteList {
+		return nil, false
+	}
+
+	// If the buffer size is larger than its initializer, the remaining
+	// bytes are set to zero.
+	data := byteList.value.([]byte)
+	if size < uint64(len(data)) {
+		size = uint64(len(data))
+	}
+
+	buf := make([]byte, size)
+	copy(buf, data)
+	return buf, true
+}
+
+// deviceValue looks up the object with the specified name in the scope of
+// the Device at devIndex and returns the object that holds its value. If
+// the value is a reference to another named object, the value of the
+// referenced object is returned instead.
+func (tree *ObjectTree) deviceValue(devIndex uint32, name string) *Object {
+	devObj := tree.ObjectAt(devIndex)
+	if devObj == nil || devObj.opcode != pOpDevice {
+		return nil
+	}
+
+	scopeObj := tree.deviceScope(devObj)
+	if scopeObj == nil {
+		return nil
+	}
+
+	var objName [amlNameLen]byte
+	copy(objName[:], name)
+
+	for childIndex := scopeObj.firstArgIndex; childIndex != InvalidIndex; childIndex = tree.ObjectAt(childIndex).nextSiblingIndex {
+		child := tree.ObjectAt(childIndex)
+		if child.name != objName {
+			continue
+		}
+
+		valueObj := tree.constValueOf(child)
+		if valueObj != nil && valueObj.opcode == pOpIntResolvedNamePath {
+			valueObj = tree.constValueOf(tree.ObjectAt(valueObj.value.(uint32)))
+		}
+
+		return valueObj
+	}
+
+	return nil
+}
+
+// deviceScope returns the ScopeBlock that contains the objects defined by a
+// Device object.
+func (tree *ObjectTree) deviceScope(devObj *Object) *Object {
+	if scopeObj := tree.ArgAt(devObj, 1); scopeObj != nil && scopeObj.opcode == pOpIntScopeBlock {
+		return scopeObj
+	}
+
+	return nil
+}
+
+// constValueOf returns the object that holds the value of a Name object or,
+// for methods whose body consists of a single Return statement, the returned
+// object (e.g. a _STA method that always returns 0x0F). Aliases are resolved
+// to the object they refer to. Any other object type
+// requires AML evaluation and causes constValueOf to return nil.
+func (tree *ObjectTree) constValueOf(obj *Object) *Object {
+	if obj == nil {
+		return nil
+	}
+
+	switch obj.opcode {
+	case pOpAlias:
+		return tree.constValueOf(tree.ObjectAt(tree.ResolveAlias(obj.index)))
+	case pOpName:
+		return tree.ArgAt(obj, 1)
+	case pOpMethod:
+		body := tree.ArgAt(obj, 2)
+		if body == nil || body.firstArgIndex == InvalidIndex || body.firstArgIndex != body.lastArgIndex {
+			return nil
+		}
+
+		if stmt := tree.ObjectAt(body.firstArgIndex); stmt.opcode == pOpReturn {
+			return tree.ArgAt(stmt, 0)
+		}
+	}
+
+	return nil
+}
+
+// setDeviceIDField populates the DeviceID field that corresponds to the
+// supplied value object. It returns false if the value is not a constant.
+func (tree *ObjectTree) setDeviceIDField(id *DeviceID, field DeviceIDField, valueObj *Object) bool {
+	// _CID may also contain a package with a list of IDs
+	if field == DeviceCID && valueObj != nil && valueObj.opcode == pOpPackage {
+		elements := tree.ArgAt(valueObj, 1)
+		if elements == nil {
+			return false
+		}
+
+		for elemIndex := elements.firstArgIndex; elemIndex != InvalidIndex; elemIndex = tree.ObjectAt(elemIndex).nextSiblingIndex {
+			cid, ok := tree.deviceIDString(tree.ObjectAt(elemIndex), true)
+			if !ok {
+				return false
+			}
+			id.CIDs = append(id.CIDs, cid)
+		}
+
+		return true
+	}
+
+	switch field {
+	case DeviceHID:
+		hid, ok := tree.deviceIDString(valueObj, true)
+		id.HID = hid
+		return ok
+	case DeviceCID:
+		cid, ok := tree.deviceIDString(valueObj, true)
+		if ok {
+			id.CIDs = append(id.CIDs, cid)
+		}
+		return ok
+	case DeviceUID:
+		uid, ok := tree.deviceIDString(valueObj, false)
+		id.UID = uid
+		return ok
+	case DeviceSTA:
+		sta, ok := tree.constIntValue(valueObj)
+		if ok {
+			id.STA = sta
+		}
+		return ok
+	default:
+		adr, ok := tree.constIntValue(valueObj)
+		id.ADR = adr
+		return ok
+	}
+}
+
+// deviceIDString returns the string representation of an identification
+// object value. Integer values are decoded as compressed EISA IDs if isEISA is
+// true or converted to decimal otherwise.
+func (tree *ObjectTree) deviceIDString(obj *Object, isEISA bool) (string, bool) {
+	if obj != nil && obj.opcode == pOpStringPrefix {
+		return string(obj.value.([]byte)), true
+	}
+
+	v, ok := tree.constIntValue(obj)
+	switch {
+	case !ok:
+		return "", false
+	case isEISA:
+		return DecodeEISAID(uint32(v)), true
+	}
+
+	var (
+		buf [20]byte
+		pos = len(buf)
+	)
+	for {
+		pos--
+		buf[pos] = '0' + byte(v%10)
+		if v /= 10; v == 0 {
+			break
+		}
+	}
+
+	return string(buf[pos:]), true
+}
+
+// constIntValue returns the value of an integer constant object truncated to
+// the integer width of the namespace.
+func (tree *ObjectTree) constIntValue(obj *Object) (uint64, bool) {
+	if obj == nil {
+		return 0, false
+	}
+
+	switch obj.opcode {
+	case pOpZero:
+		return 0, true
+	case pOpOne:
+		return 1, true
+	case pOpOnes:
+		return tree.intMask, true
+	case pOpBytePrefix, pOpWordPrefix, pOpDwordPrefix, pOpQwordPrefix:
+		return tree.truncateInt(obj.value.(uint64)), true
+	}
+
+	return 0, false
+}
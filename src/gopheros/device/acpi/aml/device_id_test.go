@@ -0,0 +1,304 @@
+package aml
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIdentifyDevices(t *testing.T) {
+	var resolver = mockResolver{
+		pathToDumps: pkgDir() + "/../table/tabletest/",
+		tableFiles:  []string{"DSDT.aml", "SSDT.aml"},
+	}
+
+	tree := NewObjectTree()
+	tree.CreateDefaultScopes(0)
+
+	p := NewParser(&testWriter{t: t}, tree)
+	for tableIndex, tableName := range []string{"DSDT", "SSDT"} {
+		if err := p.ParseAML(uint8(tableIndex), tableName, resolver.LookupTable(tableName)); err != nil {
+			t.Fatalf("[%s]: %v", tableName, err)
+		}
+	}
+
+	if id := tree.DeviceIDOf(findDevice(tree, "PCI0")); id != nil {
+		t.Fatal("expected DeviceIDOf to return nil before IdentifyDevices is invoked")
+	}
+
+	if got := tree.IdentifyDevices(); got != 28 {
+		t.Fatalf("expected 28 devices to be identified; got %d", got)
+	}
+
+	specs := []struct {
+		name    string
+		expPath string
+		expID   DeviceID
+	}{
+		{
+			"PCI0",
+			`\_SB_.PCI0`,
+			DeviceID{HID: "PNP0A03", UID: "0", STA: StatusDefault, Defined: DeviceHID | DeviceUID | DeviceADR, NeedsEval: DeviceADR},
+		},
+		{
+			// _HID defined as a WordPrefix
+			"PIC_",
+			`\_SB_.PCI0.SBRG.PIC_`,
+			DeviceID{HID: "PNP0000", STA: StatusDefault, Defined: DeviceHID},
+		},
+		{
+			"HPET",
+			`\_SB_.PCI0.SBRG.HPET`,
+			DeviceID{HID: "PNP0103", CIDs: []string{"PNP0C01"}, UID: "0", STA: StatusDefault, Defined: DeviceHID | DeviceCID | DeviceUID | DeviceSTA, NeedsEval: DeviceSTA},
+		},
+		{
+			"SMC_",
+			`\_SB_.PCI0.SBRG.SMC_`,
+			DeviceID{HID: "APP0001", CIDs: []string{"smc-napa"}, STA: StatusDefault, Defined: DeviceHID | DeviceCID | DeviceSTA, NeedsEval: DeviceSTA},
+		},
+		{
+			// _STA defined as a method that returns a constant
+			"PS2K",
+			`\_SB_.PCI0.SBRG.PS2K`,
+			DeviceID{HID: "PNP0303", STA: 0x0f, Defined: DeviceHID | DeviceSTA},
+		},
+		{
+			"SRL0",
+			`\_SB_.PCI0.SBRG.SRL0`,
+			DeviceID{HID: "PNP0501", UID: "1", STA: StatusDefault, Defined: DeviceHID | DeviceUID | DeviceSTA, NeedsEval: DeviceSTA},
+		},
+	}
+
+	for specIndex, spec := range specs {
+		index := findDevice(tree, spec.name)
+		if got := tree.Path(index); got != spec.expPath {
+			t.Errorf("[spec %d] expected path for %s to be %q; got %q", specIndex, spec.name, spec.expPath, got)
+		}
+
+		id := tree.DeviceIDOf(index)
+		if id == nil {
+			t.Errorf("[spec %d] expected a cached identification for %s", specIndex, spec.name)
+			continue
+		}
+
+		if !reflect.DeepEqual(*id, spec.expID) {
+			t.Errorf("[spec %d] expected identification for %s to be:\n%+v\ngot:\n%+v", specIndex, spec.name, spec.expID, *id)
+		}
+	}
+
+	if id := tree.DeviceIDOf(0); id != nil {
+		t.Error("expected DeviceIDOf to return nil for a non-Device object")
+	}
+
+	t.Run("device values", func(t *testing.T) {
+		if v, ok := tree.DeviceIntValue(findDevice(tree, "PCI0"), "_BBN"); !ok || v != 0 {
+			t.Errorf("expected PCI0._BBN to be 0; got %d, %t", v, ok)
+		}
+
+		// Name-defined buffer
+		expCRS := []byte{0x47, 0x1, 0x60, 0x0, 0x60, 0x0, 0x0, 0x1, 0x47, 0x1, 0x64, 0x0, 0x64, 0x0, 0x0, 0x1, 0x22, 0x2, 0x0, 0x79, 0x0}
+		if crs, ok := tree.DeviceBufferValue(findDevice(tree, "PS2K"), "_CRS"); !ok || !reflect.DeepEqual(crs, expCRS) {
+			t.Errorf("expected PS2K._CRS to be %x; got %x, %t", expCRS, crs, ok)
+		}
+
+		// Method that returns a reference to a Name-defined buffer
+		expCRS = []byte{0x22, 0x1, 0x0, 0x22, 0x0, 0x1, 0x86, 0x9, 0x0, 0x1, 0x0, 0x0, 0xd0, 0xfe, 0x0, 0x4, 0x0, 0x0, 0x79, 0x0}
+		if crs, ok := tree.DeviceBufferValue(findDevice(tree, "HPET"), "_CRS"); !ok || !reflect.DeepEqual(crs, expCRS) {
+			t.Errorf("expected HPET._CRS to be %x; got %x, %t", expCRS, crs, ok)
+		}
+
+		// Method that needs to be evaluated
+		if _, ok := tree.DeviceBufferValue(findDevice(tree, "LPT0"), "_CRS"); ok {
+			t.Error("expected lookup of LPT0._CRS to fail")
+		}
+
+		// Type mismatch, missing object and invalid device
+		if _, ok := tree.DeviceBufferValue(findDevice(tree, "PCI0"), "_BBN"); ok {
+			t.Error("expected lookup of PCI0._BBN as a buffer to fail")
+		}
+
+		if _, ok := tree.DeviceIntValue(findDevice(tree, "PCI0"), "_SEG"); ok {
+			t.Error("expected lookup of missing PCI0._SEG to fail")
+		}
+
+		if _, ok := tree.DeviceIntValue(0, "_BBN"); ok {
+			t.Error("expected lookup on a non-Device object to fail")
+		}
+	})
+
+	var visited int
+	tree.VisitDevices(func(index uint32, id *DeviceID) {
+		if id == nil || id != tree.DeviceIDOf(index) {
+			t.Errorf("expected VisitDevices to supply the cached identification for device %s", tree.Path(index))
+		}
+		visited++
+	})
+
+	if visited != 28 {
+		t.Errorf("expected VisitDevices to visit 28 devices; got %d", visited)
+	}
+}
+
+// findDevice returns the index of the first Device object with the specified
+// name or InvalidIndex if no such device exists.
+func findDevice(tree *ObjectTree, name string) uint32 {
+	for _, obj := range tree.objPool {
+		if obj.opcode == pOpDevice && string(obj.name[:]) == name {
+			return obj.index
+		}
+	}
+
+	return InvalidIndex
+}
+
+func TestConstValueOf(t *testing.T) {
+	tree := NewObjectTree()
+
+	newObj := func(opcode uint16, args ...*Object) *Object {
+		obj := tree.newObject(opcode, 0)
+		for _, arg := range args {
+			tree.append(obj, arg)
+		}
+		return obj
+	}
+
+	retVal := newObj(pOpOne)
+	nameVal := newObj(pOpZero)
+
+	specs := []struct {
+		obj *Object
+		exp *Object
+	}{
+		{newObj(pOpName, newObj(pOpIntNamePath), nameVal), nameVal},
+		{
+			newObj(pOpMethod, newObj(pOpIntNamePath), newObj(pOpBytePrefix), newObj(pOpIntScopeBlock, newObj(pOpReturn, retVal))),
+			retVal,
+		},
+		// method with an empty body
+		{newObj(pOpMethod, newObj(pOpIntNamePath), newObj(pOpBytePrefix), newObj(pOpIntScopeBlock)), nil},
+		// method with multiple statements
+		{
+			newObj(pOpMethod, newObj(pOpIntNamePath), newObj(pOpBytePrefix), newObj(pOpIntScopeBlock, newObj(pOpNoop), newObj(pOpReturn, newObj(pOpOne)))),
+			nil,
+		},
+		// method whose body is not a return statement
+		{newObj(pOpMethod, newObj(pOpIntNamePath), newObj(pOpBytePrefix), newObj(pOpIntScopeBlock, newObj(pOpNoop))), nil},
+		{newObj(pOpMethod, newObj(pOpIntNamePath)), nil},
+		{newObj(pOpDevice), nil},
+		{nil, nil},
+	}
+
+	for specIndex, spec := range specs {
+		if got := tree.constValueOf(spec.obj); got != spec.exp {
+			t.Errorf("[spec %d] expected constValueOf to return %v; got %v", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestDeviceBufferValue(t *testing.T) {
+	tree := NewObjectTree()
+
+	newObj := func(opcode uint16, value interface{}, args ...*Object) *Object {
+		obj := tree.newObject(opcode, 0)
+		obj.value = value
+		for _, arg := range args {
+			tree.append(obj, arg)
+		}
+		return obj
+	}
+
+	newDevice := func(bufObj *Object) uint32 {
+		nameObj := tree.newNamedObject(pOpName, 0, [amlNameLen]byte{'_', 'C', 'R', 'S'})
+		tree.append(nameObj, newObj(pOpIntNamePath, []byte("_CRS")))
+		tree.append(nameObj, bufObj)
+		return newObj(pOpDevice, nil, newObj(pOpIntNamePath, []byte("DEV0")), newObj(pOpIntScopeBlock, nil, nameObj)).index
+	}
+
+	specs := []struct {
+		devIndex uint32
+		exp      []byte
+		expOK    bool
+	}{
+		// Buffer size larger than the initializer
+		{newDevice(newObj(pOpBuffer, nil, newObj(pOpBytePrefix, uint64(4)), newObj(pOpIntByteList, []byte{1, 2}))), []byte{1, 2, 0, 0}, true},
+		// Buffer size smaller than the initializer
+		{newDevice(newObj(pOpBuffer, nil, newObj(pOpZero, nil), newObj(pOpIntByteList, []byte{1, 2}))), []byte{1, 2}, true},
+		// Non-constant buffer size
+		{newDevice(newObj(pOpBuffer, nil, newObj(pOpAdd, nil), newObj(pOpIntByteList, []byte{1, 2}))), nil, false},
+		// Missing initializer
+		{newDevice(newObj(pOpBuffer, nil, newObj(pOpBytePrefix, uint64(4)))), nil, false},
+	}
+
+	for specIndex, spec := range specs {
+		got, ok := tree.DeviceBufferValue(spec.devIndex, "_CRS")
+		if ok != spec.expOK || !reflect.DeepEqual(got, spec.exp) {
+			t.Errorf("[spec %d] expected DeviceBufferValue to return %x, %t; got %x, %t", specIndex, spec.exp, spec.expOK, got, ok)
+		}
+	}
+
+	// Device without a scope
+	if _, ok := tree.DeviceBufferValue(newObj(pOpDevice, nil).index, "_CRS"); ok {
+		t.Error("expected lookup on a Device without a scope to fail")
+	}
+}
+
+func TestSetDeviceIDField(t *testing.T) {
+	tree := NewObjectTree()
+
+	newConst := func(opcode uint16, value interface{}) *Object {
+		obj := tree.newObject(opcode, 0)
+		obj.value = value
+		return obj
+	}
+
+	newPackage := func(elements ...*Object) *Object {
+		pkg := tree.newObject(pOpPackage, 0)
+		tree.append(pkg, newConst(pOpBytePrefix, uint64(len(elements))))
+		scope := tree.newObject(pOpIntScopeBlock, 0)
+		tree.append(pkg, scope)
+		for _, elem := range elements {
+			tree.append(scope, elem)
+		}
+		return pkg
+	}
+
+	specs := []struct {
+		field    DeviceIDField
+		valueObj *Object
+		expID    DeviceID
+		expOK    bool
+	}{
+		{DeviceHID, newConst(pOpDwordPrefix, uint64(0x030ad041)), DeviceID{HID: "PNP0A03"}, true},
+		{DeviceHID, newConst(pOpStringPrefix, []byte("ACPI0003")), DeviceID{HID: "ACPI0003"}, true},
+		{DeviceHID, newConst(pOpAdd, nil), DeviceID{}, false},
+		{DeviceHID, nil, DeviceID{}, false},
+		{
+			DeviceCID,
+			newPackage(newConst(pOpDwordPrefix, uint64(0x030ad041)), newConst(pOpStringPrefix, []byte("PNP0A08"))),
+			DeviceID{CIDs: []string{"PNP0A03", "PNP0A08"}},
+			true,
+		},
+		{DeviceCID, newPackage(newConst(pOpAdd, nil)), DeviceID{}, false},
+		{DeviceCID, newConst(pOpAdd, nil), DeviceID{}, false},
+		{DeviceUID, newConst(pOpQwordPrefix, uint64(1234567890)), DeviceID{UID: "1234567890"}, true},
+		{DeviceUID, newConst(pOpOnes, nil), DeviceID{UID: "18446744073709551615"}, true},
+		{DeviceUID, newConst(pOpStringPrefix, []byte("COM1")), DeviceID{UID: "COM1"}, true},
+		{DeviceADR, newConst(pOpDwordPrefix, uint64(0x1f0003)), DeviceID{ADR: 0x1f0003}, true},
+		{DeviceADR, newConst(pOpOne, nil), DeviceID{ADR: 1}, true},
+		{DeviceADR, newConst(pOpStringPrefix, []byte("foo")), DeviceID{}, false},
+		{DeviceSTA, newConst(pOpBytePrefix, uint64(0x0b)), DeviceID{STA: 0x0b}, true},
+		{DeviceSTA, newConst(pOpZero, nil), DeviceID{}, true},
+		{DeviceSTA, newConst(pOpAdd, nil), DeviceID{}, false},
+	}
+
+	for specIndex, spec := range specs {
+		var id DeviceID
+		if got := tree.setDeviceIDField(&id, spec.field, spec.valueObj); got != spec.expOK {
+			t.Errorf("[spec %d] expected setDeviceIDField to return %t; got %t", specIndex, spec.expOK, got)
+			continue
+		}
+
+		if spec.expOK && !reflect.DeepEqual(id, spec.expID) {
+			t.Errorf("[spec %d] expected identification to be:\n%+v\ngot:\n%+v", specIndex, spec.expID, id)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package aml
+
+// constFolder implements an optimization pass that replaces expressions whose
+// operands are constants with the result of the expression.
+type constFolder struct {
+	tree *ObjectTree
+
+	// readOnly caches the result of isReadOnlyName for each Name object
+	// index that is referenced by a folded DerefOf(Index()) expression.
+	readOnly map[uint32]bool
+
+	folded int
+}
+
+// FoldConstants scans the tree for integer arithmetic and logical expressions
+// whose operands are constants and replaces each one with its result. In
+// addition, DerefOf(Index()) expressions that access a constant element of a
+// package which is never modified are replaced by the element value.
+//
+// Expressions that store their result to a target, as well as divisions by
+// zero, are never folded. All results are truncated to the integer width of
+// the namespace so FoldConstants should be invoked after all AML tables have
+// been parsed. It returns the number of folded expressions.
+func (tree *ObjectTree) FoldConstants() int {
+	if len(tree.objPool) == 0 {
+		return 0
+	}
+
+	folder := constFolder{tree: tree, readOnly: make(map[uint32]bool)}
+	folder.visit(0)
+	return folder.folded
+}
+
+// visit folds the args of the object at index before attempting to fold the
+// object itself so that nested expressions are folded bottom-up.
+func (f *constFolder) visit(index uint32) {
+	obj := f.tree.ObjectAt(index)
+	for argIndex := obj.firstArgIndex; argIndex != InvalidIndex; {
+		// Folding only mutates the visited arg in place and frees its own
+		// args so the link to the next sibling remains valid.
+		nextIndex := f.tree.ObjectAt(argIndex).nextSiblingIndex
+		f.visit(argIndex)
+		argIndex = nextIndex
+	}
+
+	if f.fold(obj) {
+		f.folded++
+	}
+}
+
+// fold attempts to replace obj with a constant and returns true if it
+// succeeded.
+func (f *constFolder) fold(obj *Object) bool {
+	tree := f.tree
+
+	switch obj.opcode {
+	case pOpAdd, pOpSubtract, pOpMultiply, pOpDivide, pOpMod, pOpShiftLeft, pOpShiftRight,
+		pOpAnd, pOpNand, pOpOr, pOpNor, pOpXor,
+		pOpLand, pOpLor, pOpLEqual, pOpLGreater, pOpLLess:
+		// Operators with a non-null target (or, for Divide, a non-null
+		// remainder or quotient target) are not folded.
+		if tree.NumArgs(obj) != 2 {
+			return false
+		}
+
+		a, okA := tree.constIntValue(tree.ArgAt(obj, 0))
+		b, okB := tree.constIntValue(tree.ArgAt(obj, 1))
+		if !okA || !okB {
+			return false
+		}
+
+		res, ok := tree.evalBinaryOp(obj.opcode, a, b)
+		if !ok {
+			return false
+		}
+
+		f.replaceWithInt(obj, res)
+		return true
+	case pOpNot, pOpFindSetLeftBit, pOpFindSetRightBit, pOpLnot:
+		if tree.NumArgs(obj) != 1 {
+			return false
+		}
+
+		a, ok := tree.constIntValue(tree.ArgAt(obj, 0))
+		if !ok {
+			return false
+		}
+
+		f.replaceWithInt(obj, tree.evalUnaryOp(obj.opcode, a))
+		return true
+	case pOpDerefOf:
+		return f.foldPackageIndex(obj)
+	}
+
+	return false
+}
+
+// evalBinaryOp applies a binary integer operator to a and b. It returns false
+// if the operation cannot be evaluated (e.g. division by zero).
+func (tree *ObjectTree) evalBinaryOp(opcode uint16, a, b uint64) (uint64, bool) {
+	var res uint64
+
+	switch opcode {
+	case pOpAdd:
+		res = a + b
+	case pOpSubtract:
+		res = a - b
+	case pOpMultiply:
+		res = a * b
+	case pOpDivide, pOpMod:
+		if b == 0 {
+			return 0, false
+		}
+
+		if res = a / b; opcode == pOpMod {
+			res = a % b
+		}
+	case pOpShiftLeft:
+		res = a << b
+	case pOpShiftRight:
+		res = a >> b
+	case pOpAnd:
+		res = a & b
+	case pOpNand:
+		res = ^(a & b)
+	case pOpOr:
+		res = a | b
+	case pOpNor:
+		res = ^(a | b)
+	case pOpXor:
+		res = a ^ b
+	case pOpLand:
+		res = tree.logicalValue(a != 0 && b != 0)
+	case pOpLor:
+		res = tree.logicalValue(a != 0 || b != 0)
+	case pOpLEqual:
+		res = tree.logicalValue(a == b)
+	case pOpLGreater:
+		res = tree.logicalValue(a > b)
+	case pOpLLess:
+		res = tree.logicalValue(a < b)
+	default:
+		return 0, false
+	}
+
+	return tree.truncateInt(res), true
+}
+
+// evalUnaryOp applies a unary integer operator to a.
+func (tree *ObjectTree) evalUnaryOp(opcode uint16, a uint64) uint64 {
+	var res uint64
+
+	switch opcode {
+	case pOpNot:
+		res = ^a
+	case pOpLnot:
+		res = tree.logicalValue(a == 0)
+	case pOpFindSetLeftBit:
+		// One-based index of the most significant set bit or 0 if no
+		// bits are set.
+		for ; a != 0; a >>= 1 {
+			res++
+		}
+	case pOpFindSetRightBit:
+		// One-based index of the least significant set bit or 0 if no
+		// bits are set.
+		if a != 0 {
+			for res = 1; a&1 == 0; a >>= 1 {
+				res++
+			}
+		}
+	}
+
+	return tree.truncateInt(res)
+}
+
+// logicalValue returns the integer representation of a logical value. True is
+// represented by Ones and false by Zero.
+func (tree *ObjectTree) logicalValue(v bool) uint64 {
+	if v {
+		return tree.intMask
+	}
+
+	return 0
+}
+
+// foldPackageIndex replaces a DerefOf(Index(pkg, index)) expression with a
+// copy of the package element if the element is an integer or string constant
+// and the package is either a literal or the value of a Name object that is
+// never modified.
+func (f *constFolder) foldPackageIndex(derefObj *Object) bool {
+	tree := f.tree
+
+	indexObj := tree.ArgAt(derefObj, 0)
+	if tree.NumArgs(derefObj) != 1 || indexObj.opcode != pOpIndex || tree.NumArgs(indexObj) != 2 {
+		return false
+	}
+
+	elemIndex, ok := tree.constIntValue(tree.ArgAt(indexObj, 1))
+	if !ok || elemIndex >= uint64(InvalidIndex) {
+		return false
+	}
+
+	pkgObj := f.staticPackage(tree.ArgAt(indexObj, 0))
+	if pkgObj == nil {
+		return false
+	}
+
+	// Elements beyond the initializer list are uninitialized
+	elem := tree.ArgAt(tree.ArgAt(pkgObj, 1), uint32(elemIndex))
+	if elem == nil {
+		return false
+	}
+
+	if elem.opcode == pOpStringPrefix {
+		str := elem.value.([]byte)
+		f.replaceWith(derefObj, pOpStringPrefix, append(make([]byte, 0, len(str)), str...))
+		return true
+	}
+
+	v, ok := tree.constIntValue(elem)
+	if !ok {
+		return false
+	}
+
+	f.replaceWithInt(derefObj, v)
+	return true
+}
+
+// staticPackage returns the Package object that is referenced by ref if its
+// contents cannot be modified at run-time.
+func (f *constFolder) staticPackage(ref *Object) *Object {
+	tree := f.tree
+
+	switch ref.opcode {
+	case pOpPackage:
+		return ref
+	case pOpIntResolvedNamePath:
+		nameObj := tree.ObjectAt(ref.value.(uint32))
+		if nameObj == nil || nameObj.opcode != pOpName {
+			return nil
+		}
+
+		if pkgObj := tree.ArgAt(nameObj, 1); pkgObj != nil && pkgObj.opcode == pOpPackage && f.isReadOnlyName(nameObj) {
+			return pkgObj
+		}
+	}
+
+	return nil
+}
+
+// isReadOnlyName returns true if all references to nameObj only read its
+// value via DerefOf(Index()) or SizeOf. As targets and super names are not
+// resolved by the parser, any unresolved name path that ends with the name of
+// nameObj is treated as a potential write.
+func (f *constFolder) isReadOnlyName(nameObj *Object) bool {
+	if readOnly, cached := f.readOnly[nameObj.index]; cached {
+		return readOnly
+	}
+
+	tree := f.tree
+	readOnly := true
+
+checkRefs:
+	for _, obj := range tree.objPool {
+		switch obj.opcode {
+		case pOpIntResolvedNamePath:
+			if obj.value.(uint32) != nameObj.index {
+				continue
+			}
+
+			parent := tree.ObjectAt(obj.parentIndex)
+			switch {
+			case parent == nil:
+			case parent.opcode == pOpSizeOf:
+				continue
+			case parent.opcode == pOpIndex && parent.firstArgIndex == obj.index && tree.NumArgs(parent) == 2:
+				if grandParent := tree.ObjectAt(parent.parentIndex); grandParent != nil && grandParent.opcode == pOpDerefOf {
+					continue
+				}
+			}
+
+			readOnly = false
+			break checkRefs
+		case pOpIntNamePath, pOpIntNamePathOrMethodCall:
+			// Skip the name path that defines nameObj
+			if obj.parentIndex == nameObj.index {
+				continue
+			}
+
+			if path := obj.value.([]byte); len(path) >= amlNameLen && string(path[len(path)-amlNameLen:]) == string(nameObj.name[:]) {
+				readOnly = false
+				break checkRefs
+			}
+		}
+	}
+
+	f.readOnly[nameObj.index] = readOnly
+	return readOnly
+}
+
+// replaceWithInt replaces obj with the most compact integer constant object
+// that can represent v.
+func (f *constFolder) replaceWithInt(obj *Object, v uint64) {
+	switch {
+	case v == 0:
+		f.replaceWith(obj, pOpZero, nil)
+	case v == 1:
+		f.replaceWith(obj, pOpOne, nil)
+	case v == f.tree.intMask:
+		f.replaceWith(obj, pOpOnes, nil)
+	case v <= 0xff:
+		f.replaceWith(obj, pOpBytePrefix, v)
+	case v <= 0xffff:
+		f.replaceWith(obj, pOpWordPrefix, v)
+	case v <= 0xffffffff:
+		f.replaceWith(obj, pOpDwordPrefix, v)
+	default:
+		f.replaceWith(obj, pOpQwordPrefix, v)
+	}
+}
+
+// replaceWith frees the args of obj and mutates it into an object with the
+// specified opcode and value.
+func (f *constFolder) replaceWith(obj *Object, opcode uint16, value interface{}) {
+	for obj.firstArgIndex != InvalidIndex {
+		f.tree.freeSubtree(f.tree.ObjectAt(obj.firstArgIndex))
+	}
+
+	obj.opcode = opcode
+	obj.infoIndex = pOpcodeTableIndex(opcode, true)
+	obj.value = value
+}
+
+// freeSubtree frees obj and all of its args.
+func (tree *ObjectTree) freeSubtree(obj *Object) {
+	for obj.firstArgIndex != InvalidIndex {
+		tree.freeSubtree(tree.ObjectAt(obj.firstArgIndex))
+	}
+
+	tree.free(obj)
+}
@@ -0,0 +1,286 @@
+package aml
+
+import (
+	"bytes"
+	"testing"
+)
+
+// exprBuilder simplifies the construction of AML expression trees for tests.
+type exprBuilder struct {
+	tree *ObjectTree
+}
+
+func (b exprBuilder) obj(opcode uint16, value interface{}, args ...*Object) *Object {
+	obj := b.tree.newObject(opcode, 0)
+	obj.value = value
+	for _, arg := range args {
+		b.tree.append(obj, arg)
+	}
+	return obj
+}
+
+func (b exprBuilder) op(opcode uint16, args ...*Object) *Object {
+	return b.obj(opcode, nil, args...)
+}
+
+func (b exprBuilder) num(v uint64) *Object {
+	return b.obj(pOpQwordPrefix, v)
+}
+
+func TestFoldConstants(t *testing.T) {
+	specs := []struct {
+		dsdtRevision uint8
+		build        func(b exprBuilder) *Object
+		expFolded    int
+		expOpcode    uint16
+		expValue     uint64
+	}{
+		{2, func(b exprBuilder) *Object { return b.op(pOpAdd, b.num(2), b.num(3)) }, 1, pOpBytePrefix, 5},
+		{2, func(b exprBuilder) *Object { return b.op(pOpSubtract, b.op(pOpZero), b.op(pOpOne)) }, 1, pOpOnes, 0xffffffffffffffff},
+		{1, func(b exprBuilder) *Object { return b.op(pOpSubtract, b.op(pOpZero), b.op(pOpOne)) }, 1, pOpOnes, 0xffffffff},
+		{2, func(b exprBuilder) *Object { return b.op(pOpMultiply, b.num(0x10000), b.num(0x10000)) }, 1, pOpQwordPrefix, 0x100000000},
+		{1, func(b exprBuilder) *Object { return b.op(pOpMultiply, b.num(0x10000), b.num(0x10000)) }, 1, pOpZero, 0},
+		{2, func(b exprBuilder) *Object { return b.op(pOpDivide, b.num(7), b.num(2)) }, 1, pOpBytePrefix, 3},
+		{2, func(b exprBuilder) *Object { return b.op(pOpMod, b.num(7), b.num(2)) }, 1, pOpOne, 1},
+		{2, func(b exprBuilder) *Object { return b.op(pOpShiftLeft, b.num(1), b.num(12)) }, 1, pOpWordPrefix, 0x1000},
+		{1, func(b exprBuilder) *Object { return b.op(pOpShiftLeft, b.num(1), b.num(32)) }, 1, pOpZero, 0},
+		{2, func(b exprBuilder) *Object { return b.op(pOpShiftRight, b.num(0x100), b.num(8)) }, 1, pOpOne, 1},
+		{2, func(b exprBuilder) *Object { return b.op(pOpAnd, b.num(0xff0), b.num(0x0ff)) }, 1, pOpBytePrefix, 0xf0},
+		{1, func(b exprBuilder) *Object { return b.op(pOpNand, b.num(0xff0), b.num(0x0ff)) }, 1, pOpDwordPrefix, 0xffffff0f},
+		{2, func(b exprBuilder) *Object { return b.op(pOpOr, b.num(0xf0), b.num(0x0f)) }, 1, pOpBytePrefix, 0xff},
+		{1, func(b exprBuilder) *Object { return b.op(pOpNor, b.num(0xf0), b.num(0x0f)) }, 1, pOpDwordPrefix, 0xffffff00},
+		{2, func(b exprBuilder) *Object { return b.op(pOpXor, b.num(0xff), b.num(0x0f)) }, 1, pOpBytePrefix, 0xf0},
+		{1, func(b exprBuilder) *Object { return b.op(pOpNot, b.op(pOpZero)) }, 1, pOpOnes, 0xffffffff},
+		{2, func(b exprBuilder) *Object { return b.op(pOpFindSetLeftBit, b.num(0x18)) }, 1, pOpBytePrefix, 5},
+		{2, func(b exprBuilder) *Object { return b.op(pOpFindSetLeftBit, b.op(pOpZero)) }, 1, pOpZero, 0},
+		{2, func(b exprBuilder) *Object { return b.op(pOpFindSetRightBit, b.num(0x18)) }, 1, pOpBytePrefix, 4},
+		{2, func(b exprBuilder) *Object { return b.op(pOpFindSetRightBit, b.op(pOpZero)) }, 1, pOpZero, 0},
+		{2, func(b exprBuilder) *Object { return b.op(pOpLand, b.op(pOpOne), b.op(pOpZero)) }, 1, pOpZero, 0},
+		{2, func(b exprBuilder) *Object { return b.op(pOpLor, b.op(pOpOne), b.op(pOpZero)) }, 1, pOpOnes, 0xffffffffffffffff},
+		{1, func(b exprBuilder) *Object { return b.op(pOpLnot, b.op(pOpZero)) }, 1, pOpOnes, 0xffffffff},
+		{2, func(b exprBuilder) *Object { return b.op(pOpLEqual, b.num(2), b.num(2)) }, 1, pOpOnes, 0xffffffffffffffff},
+		{2, func(b exprBuilder) *Object { return b.op(pOpLGreater, b.num(3), b.num(2)) }, 1, pOpOnes, 0xffffffffffffffff},
+		{2, func(b exprBuilder) *Object { return b.op(pOpLLess, b.num(3), b.num(2)) }, 1, pOpZero, 0},
+		// Qword constants are truncated in 32-bit mode
+		{1, func(b exprBuilder) *Object { return b.op(pOpAdd, b.num(0x100000001), b.num(1)) }, 1, pOpBytePrefix, 2},
+		// Nested expressions: LNotEqual(Add(Multiply(2, 3), Or(1, 8)), 15)
+		{
+			2,
+			func(b exprBuilder) *Object {
+				return b.op(pOpLnot, b.op(pOpLEqual, b.op(pOpAdd, b.op(pOpMultiply, b.num(2), b.num(3)), b.op(pOpOr, b.num(1), b.num(8))), b.num(15)))
+			},
+			5, pOpZero, 0,
+		},
+		// Expressions with a target are not folded
+		{2, func(b exprBuilder) *Object { return b.op(pOpAdd, b.num(1), b.num(2), b.op(pOpLocal0)) }, 0, pOpAdd, 0},
+		{2, func(b exprBuilder) *Object { return b.op(pOpDivide, b.num(4), b.num(2), b.op(pOpLocal0)) }, 0, pOpDivide, 0},
+		// Division by zero
+		{2, func(b exprBuilder) *Object { return b.op(pOpDivide, b.num(1), b.op(pOpZero)) }, 0, pOpDivide, 0},
+		{2, func(b exprBuilder) *Object { return b.op(pOpMod, b.num(1), b.op(pOpZero)) }, 0, pOpMod, 0},
+		// Non-constant operands
+		{2, func(b exprBuilder) *Object { return b.op(pOpAdd, b.op(pOpLocal0), b.num(1)) }, 0, pOpAdd, 0},
+		{2, func(b exprBuilder) *Object { return b.op(pOpNot, b.op(pOpArg0)) }, 0, pOpNot, 0},
+		// Only the inner expression can be folded
+		{2, func(b exprBuilder) *Object { return b.op(pOpAdd, b.op(pOpArg0), b.op(pOpAdd, b.num(1), b.num(2))) }, 1, pOpAdd, 0},
+	}
+
+	for specIndex, spec := range specs {
+		tree := NewObjectTree()
+		tree.SetIntegerWidth(spec.dsdtRevision)
+
+		root := tree.newObject(pOpIntScopeBlock, 0)
+		expr := spec.build(exprBuilder{tree})
+		tree.append(root, expr)
+
+		if got := tree.FoldConstants(); got != spec.expFolded {
+			t.Errorf("[spec %d] expected %d expressions to be folded; got %d", specIndex, spec.expFolded, got)
+			continue
+		}
+
+		if expr.opcode != spec.expOpcode {
+			t.Errorf("[spec %d] expected folded expression opcode to be %s; got %s", specIndex, pOpcodeName(spec.expOpcode), pOpcodeName(expr.opcode))
+			continue
+		}
+
+		if spec.expFolded == 0 {
+			continue
+		}
+
+		if got, _ := tree.constIntValue(expr); got != spec.expValue {
+			t.Errorf("[spec %d] expected folded expression value to be 0x%x; got 0x%x", specIndex, spec.expValue, got)
+		}
+
+		if root.firstArgIndex != expr.index || root.lastArgIndex != expr.index {
+			t.Errorf("[spec %d] expected folded expression to remain attached to its parent", specIndex)
+		}
+
+		if expr.opcode != pOpAdd && expr.firstArgIndex != InvalidIndex {
+			t.Errorf("[spec %d] expected the args of the folded expression to be freed", specIndex)
+		}
+	}
+
+	if got := NewObjectTree().FoldConstants(); got != 0 {
+		t.Errorf("expected folding an empty tree to be a no-op; got %d", got)
+	}
+}
+
+func TestFoldPackageIndex(t *testing.T) {
+	type pkgTree struct {
+		tree    *ObjectTree
+		b       exprBuilder
+		scope   *Object
+		nameObj *Object
+	}
+
+	newPkgTree := func() pkgTree {
+		tree := NewObjectTree()
+		b := exprBuilder{tree}
+		scope := b.op(pOpIntScopeBlock)
+
+		// Name(PKG_, Package(4) { 0x10, "foo", Package() {} })
+		nameObj := tree.newNamedObject(pOpName, 0, [amlNameLen]byte{'P', 'K', 'G', '_'})
+		tree.append(nameObj, b.obj(pOpIntNamePath, []byte("PKG_")))
+		tree.append(nameObj, b.op(pOpPackage,
+			b.obj(pOpBytePrefix, uint64(4)),
+			b.op(pOpIntScopeBlock,
+				b.obj(pOpBytePrefix, uint64(0x10)),
+				b.obj(pOpStringPrefix, []byte("foo")),
+				b.op(pOpPackage, b.op(pOpZero), b.op(pOpIntScopeBlock)),
+			),
+		))
+		tree.append(scope, nameObj)
+
+		return pkgTree{tree, b, scope, nameObj}
+	}
+
+	derefPkg := func(pt pkgTree, index *Object) *Object {
+		expr := pt.b.op(pOpDerefOf, pt.b.op(pOpIndex, pt.b.obj(pOpIntResolvedNamePath, pt.nameObj.index), index))
+		pt.tree.append(pt.scope, expr)
+		return expr
+	}
+
+	t.Run("static package", func(t *testing.T) {
+		pt := newPkgTree()
+		b := pt.b
+
+		intElem := derefPkg(pt, b.op(pOpZero))
+		strElem := derefPkg(pt, b.op(pOpAdd, b.op(pOpOne), b.op(pOpZero)))
+		pkgElem := derefPkg(pt, b.obj(pOpBytePrefix, uint64(2)))
+		uninitElem := derefPkg(pt, b.obj(pOpBytePrefix, uint64(3)))
+		dynamicIndex := derefPkg(pt, b.op(pOpLocal0))
+
+		// Package literal
+		literal := b.op(pOpDerefOf, b.op(pOpIndex,
+			b.op(pOpPackage, b.obj(pOpBytePrefix, uint64(1)), b.op(pOpIntScopeBlock, b.obj(pOpWordPrefix, uint64(0x1234)))),
+			b.op(pOpZero),
+		))
+		pt.tree.append(pt.scope, literal)
+
+		// SizeOf does not modify the package
+		pt.tree.append(pt.scope, b.op(pOpSizeOf, b.obj(pOpIntResolvedNamePath, pt.nameObj.index)))
+
+		// Index(PKG_, 0) folds to 1 and the two DerefOf expressions to
+		// their element values.
+		if got := pt.tree.FoldConstants(); got != 4 {
+			t.Fatalf("expected 4 expressions to be folded; got %d", got)
+		}
+
+		if v, ok := pt.tree.constIntValue(intElem); !ok || v != 0x10 {
+			t.Errorf("expected DerefOf(Index(PKG_, 0)) to be folded to 0x10; got %d, %t", v, ok)
+		}
+
+		if strElem.opcode != pOpStringPrefix || string(strElem.value.([]byte)) != "foo" {
+			t.Errorf("expected DerefOf(Index(PKG_, 1)) to be folded to \"foo\"; got %s", pOpcodeName(strElem.opcode))
+		}
+
+		for _, expr := range []*Object{pkgElem, uninitElem, dynamicIndex} {
+			if expr.opcode != pOpDerefOf {
+				t.Errorf("expected expression at index %d not to be folded; got %s", expr.index, pOpcodeName(expr.opcode))
+			}
+		}
+
+		if v, ok := pt.tree.constIntValue(literal); !ok || v != 0x1234 {
+			t.Errorf("expected DerefOf(Index(Package(){0x1234}, 0)) to be folded to 0x1234; got %d, %t", v, ok)
+		}
+	})
+
+	mutators := []struct {
+		name  string
+		build func(pt pkgTree) *Object
+	}{
+		{
+			"Store target",
+			func(pt pkgTree) *Object {
+				return pt.b.op(pOpStore, pt.b.op(pOpZero), pt.b.obj(pOpIntNamePath, []byte("\\PKG_")))
+			},
+		},
+		{
+			"Index with target",
+			func(pt pkgTree) *Object {
+				return pt.b.op(pOpIndex, pt.b.obj(pOpIntResolvedNamePath, pt.nameObj.index), pt.b.op(pOpZero), pt.b.op(pOpLocal0))
+			},
+		},
+		{
+			"Index without DerefOf",
+			func(pt pkgTree) *Object {
+				return pt.b.op(pOpStore, pt.b.op(pOpIndex, pt.b.obj(pOpIntResolvedNamePath, pt.nameObj.index), pt.b.op(pOpZero)), pt.b.op(pOpLocal0))
+			},
+		},
+		{
+			"method arg",
+			func(pt pkgTree) *Object {
+				return pt.b.obj(pOpIntMethodCall, uint32(0), pt.b.obj(pOpIntResolvedNamePath, pt.nameObj.index))
+			},
+		},
+	}
+
+	for _, spec := range mutators {
+		t.Run(spec.name, func(t *testing.T) {
+			pt := newPkgTree()
+			expr := derefPkg(pt, pt.b.op(pOpZero))
+			pt.tree.append(pt.scope, spec.build(pt))
+
+			if got := pt.tree.FoldConstants(); got != 0 {
+				t.Fatalf("expected no expressions to be folded; got %d", got)
+			}
+
+			if expr.opcode != pOpDerefOf {
+				t.Fatalf("expected expression not to be folded; got %s", pOpcodeName(expr.opcode))
+			}
+		})
+	}
+}
+
+func TestFoldConstantsOnParsedTables(t *testing.T) {
+	var resolver = mockResolver{
+		pathToDumps: pkgDir() + "/../table/tabletest/",
+		tableFiles:  []string{"parser-testsuite-DSDT.aml", "DSDT.aml", "SSDT.aml"},
+	}
+
+	specs := [][]string{
+		{"DSDT", "SSDT"},
+		{"parser-testsuite-DSDT"},
+	}
+
+	for specIndex, tables := range specs {
+		tree := NewObjectTree()
+		tree.CreateDefaultScopes(0)
+
+		p := NewParser(&testWriter{t: t}, tree)
+		for tableIndex, tableName := range tables {
+			if err := p.ParseAML(uint8(tableIndex), tableName, resolver.LookupTable(tableName)); err != nil {
+				t.Fatalf("[spec %d] [%s]: %v", specIndex, tableName, err)
+			}
+		}
+
+		expDevices := tree.IdentifyDevices()
+		tree.FoldConstants()
+
+		// Folding must leave the tree in a consistent state
+		var buf bytes.Buffer
+		tree.PrettyPrint(&buf)
+		if got := tree.IdentifyDevices(); got != expDevices {
+			t.Errorf("[spec %d] expected %d devices to be identified after folding; got %d", specIndex, expDevices, got)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package aml
+
+// DecodeEISAID converts a compressed EISA ID, as returned by _HID or _CID,
+// into its canonical 7-character string form (e.g. "PNP0C0A").
+func DecodeEISAID(id uint32) string {
+	eisaID := decodeEISAID(uint64(id))
+	return string(eisaID[:])
+}
+
+// ValidHID returns true if hid is a well-formed string hardware ID. The ACPI
+// spec defines two valid formats: a PNP ID consisting of a 3-letter uppercase
+// vendor prefix followed by 4 hex digits (e.g. "PNP0A03") and an ACPI ID
+// consisting of a 4-character uppercase vendor prefix that may also contain
+// digits followed by 4 hex digits (e.g. "ACPI0003").
+func ValidHID(hid string) bool {
+	var prefixLen int
+	switch len(hid) {
+	case 7:
+		prefixLen = 3
+	case 8:
+		prefixLen = 4
+	default:
+		return false
+	}
+
+	for i := 0; i < len(hid); i++ {
+		ch := hid[i]
+		isUpper, isDigit := ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9'
+
+		switch {
+		case i >= prefixLen:
+			if !isDigit && (ch < 'A' || ch > 'F') {
+				return false
+			}
+		case prefixLen == 3:
+			if !isUpper {
+				return false
+			}
+		default:
+			if !isUpper && !isDigit {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// decodeEISAID converts a compressed EISA ID into its 7-character string
+// representation without allocating any memory. Compressed EISA IDs are stored
+// in little-endian order and consist of a 3-letter manufacturer code (5 bits
+// per letter) followed by a 4-digit hex product number.
+func decodeEISAID(v uint64) [7]byte {
+	// Poor-man's ntohl
+	id := uint32((v>>24)&0xff) |
+		uint32((v>>16)&0xff)<<8 |
+		uint32((v>>8)&0xff)<<16 |
+		uint32(v&0xff)<<24
+
+	return [7]byte{
+		'@' + (byte)((id>>26)&0x1f),
+		'@' + (byte)((id>>21)&0x1f),
+		'@' + (byte)((id>>16)&0x1f),
+		hexToASCII(id >> 12),
+		hexToASCII(id >> 8),
+		hexToASCII(id >> 4),
+		hexToASCII(id),
+	}
+}
@@ -0,0 +1,51 @@
+package aml
+
+import "testing"
+
+func TestDecodeEISAID(t *testing.T) {
+	specs := []struct {
+		id  uint32
+		exp string
+	}{
+		{0x030ad041, "PNP0A03"},
+		{0x080ad041, "PNP0A08"},
+		{0x0a0cd041, "PNP0C0A"},
+		{0x0000d041, "PNP0000"},
+		{0x01001006, "APP0001"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := DecodeEISAID(spec.id); got != spec.exp {
+			t.Errorf("[spec %d] expected DecodeEISAID(0x%x) to return %q; got %q", specIndex, spec.id, spec.exp, got)
+		}
+	}
+}
+
+func TestValidHID(t *testing.T) {
+	specs := []struct {
+		hid string
+		exp bool
+	}{
+		{"PNP0A03", true},
+		{"PNP0C0A", true},
+		{"ACPI0003", true},
+		{"QEMU0002", true},
+		{"VMW0001", true},
+		{"80860F14", true},
+		{"", false},
+		{"PNP0A0", false},
+		{"PNP0A0G", false},
+		{"pnp0a03", false},
+		{"PN10A03", false},
+		{"ACPI000g", false},
+		{"acpi0003", false},
+		{"smc-napa", false},
+		{"ACPI00031", false},
+	}
+
+	for specIndex, spec := range specs {
+		if got := ValidHID(spec.hid); got != spec.exp {
+			t.Errorf("[spec %d] expected ValidHID(%q) to return %t; got %t", specIndex, spec.hid, spec.exp, got)
+		}
+	}
+}
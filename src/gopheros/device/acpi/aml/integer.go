@@ -0,0 +1,37 @@
+package aml
+
+const (
+	intMask32 = uint64(0xffffffff)
+	intMask64 = ^uint64(0)
+
+	// minRevisionFor64BitInts is the minimum DSDT revision (also known
+	// as the ComplianceRevision) that enables 64-bit integer support.
+	minRevisionFor64BitInts = 2
+)
+
+// SetIntegerWidth configures the width of AML integers based on the revision
+// of the DSDT. Tables with a revision lower than 2 use 32-bit integers: the
+// value of Ones becomes 0xFFFFFFFF and the results of integer operations are
+// truncated to 32 bits. The parser invokes SetIntegerWidth when it processes
+// the DSDT.
+func (tree *ObjectTree) SetIntegerWidth(dsdtRevision uint8) {
+	tree.intMask = intMask64
+	if dsdtRevision < minRevisionFor64BitInts {
+		tree.intMask = intMask32
+	}
+}
+
+// IntegerWidth returns the width of AML integers in bits.
+func (tree *ObjectTree) IntegerWidth() uint8 {
+	if tree.intMask == intMask32 {
+		return 32
+	}
+
+	return 64
+}
+
+// truncateInt truncates v to the integer width of the namespace. It must be
+// applied to integer constants and to the results of all integer operations.
+func (tree *ObjectTree) truncateInt(v uint64) uint64 {
+	return v & tree.intMask
+}
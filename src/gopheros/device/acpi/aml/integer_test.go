@@ -0,0 +1,66 @@
+package aml
+
+import (
+	"gopheros/device/acpi/table"
+	"testing"
+	"unsafe"
+)
+
+func TestIntegerWidth(t *testing.T) {
+	specs := []struct {
+		dsdtRevision uint8
+		expWidth     uint8
+		expOnes      uint64
+		expQword     uint64
+	}{
+		{0, 32, 0xffffffff, 0x89abcdef},
+		{1, 32, 0xffffffff, 0x89abcdef},
+		{2, 64, 0xffffffffffffffff, 0x0123456789abcdef},
+		{6, 64, 0xffffffffffffffff, 0x0123456789abcdef},
+	}
+
+	for specIndex, spec := range specs {
+		tree := NewObjectTree()
+		tree.SetIntegerWidth(spec.dsdtRevision)
+
+		if got := tree.IntegerWidth(); got != spec.expWidth {
+			t.Errorf("[spec %d] expected integer width to be %d; got %d", specIndex, spec.expWidth, got)
+		}
+
+		if got, _ := tree.constIntValue(tree.newObject(pOpOnes, 0)); got != spec.expOnes {
+			t.Errorf("[spec %d] expected Ones to evaluate to 0x%x; got 0x%x", specIndex, spec.expOnes, got)
+		}
+
+		qword := tree.newObject(pOpQwordPrefix, 0)
+		qword.value = uint64(0x0123456789abcdef)
+		if got, _ := tree.constIntValue(qword); got != spec.expQword {
+			t.Errorf("[spec %d] expected Qword constant to evaluate to 0x%x; got 0x%x", specIndex, spec.expQword, got)
+		}
+	}
+}
+
+func TestParserSetsIntegerWidth(t *testing.T) {
+	// An empty table that only contains a header
+	header := &table.SDTHeader{Length: uint32(unsafe.Sizeof(table.SDTHeader{})), Revision: 1}
+
+	specs := []struct {
+		tableName string
+		expWidth  uint8
+	}{
+		{"SSDT", 64},
+		{"DSDT", 32},
+	}
+
+	for specIndex, spec := range specs {
+		tree := NewObjectTree()
+		tree.CreateDefaultScopes(0)
+
+		if err := NewParser(&testWriter{t: t}, tree).ParseAML(0, spec.tableName, header); err != nil {
+			t.Fatalf("[spec %d] %v", specIndex, err)
+		}
+
+		if got := tree.IntegerWidth(); got != spec.expWidth {
+			t.Errorf("[spec %d] expected integer width after parsing %s to be %d; got %d", specIndex, spec.tableName, spec.expWidth, got)
+		}
+	}
+}
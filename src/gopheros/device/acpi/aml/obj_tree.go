@@ -13,6 +13,11 @@ const (
 
 	// The size of AML name identifiers in bytes.
 	amlNameLen = 4
+
+	// maxAliasDepth is the maximum number of nested alias lookups that
+	// are performed while resolving an Alias. It prevents alias cycles
+	// from causing infinite recursion.
+	maxAliasDepth = 16
 )
 
 // fieldElement groups together information about a field element. This
@@ -71,7 +76,8 @@ type Object struct {
 	amlOffset uint32
 
 	// A non-zero value for pkgEnd indicates that this opcode requires deferred
-	// parsing due to its potentially ambiguous contents.
+	// parsing due to its potentially ambiguous contents. For If blocks, it
+	// marks the end of the block body.
 	pkgEnd uint32
 
 	// A value placeholder for entites that contain values (e.g. int
@@ -85,12 +91,20 @@ type Object struct {
 type ObjectTree struct {
 	objPool           []*Object
 	freeListHeadIndex uint32
+
+	// intMask is applied to the results of integer operations. Its value
+	// depends on the revision of the DSDT (see SetIntegerWidth).
+	intMask uint64
+
+	// aliasDepth tracks the number of nested ResolveAlias calls.
+	aliasDepth int
 }
 
 // NewObjectTree returns a new ObjectTree instance.
 func NewObjectTree() *ObjectTree {
 	return &ObjectTree{
 		freeListHeadIndex: InvalidIndex,
+		intMask:           intMask64,
 	}
 }
 
@@ -300,7 +314,7 @@ func (tree *ObjectTree) Find(scopeIndex uint32, expr []byte) uint32 {
 				}
 
 				// Found match
-				return obj.index
+				return tree.ResolveAlias(obj.index)
 			}
 		}
 	}
@@ -309,6 +323,50 @@ func (tree *ObjectTree) Find(scopeIndex uint32, expr []byte) uint32 {
 	return InvalidIndex
 }
 
+// ResolveAlias returns the index of the object referenced by the Alias object
+// at the specified index, following chains of aliases. If index does not point
+// to an Alias object, it is returned unchanged. The alias source is resolved
+// relative to the scope that contains the Alias object unless the parser has
+// already resolved it. ResolveAlias returns InvalidIndex if the source object
+// cannot be found or if the aliases form a cycle.
+func (tree *ObjectTree) ResolveAlias(index uint32) uint32 {
+	obj := tree.ObjectAt(index)
+	if obj == nil || obj.opcode != pOpAlias {
+		return index
+	}
+
+	if targetIndex, resolved := obj.value.(uint32); resolved {
+		return targetIndex
+	}
+
+	srcObj := tree.ArgAt(obj, 0)
+	if srcObj == nil || tree.aliasDepth >= maxAliasDepth {
+		return InvalidIndex
+	}
+
+	srcPath, ok := srcObj.value.([]byte)
+	if !ok {
+		return InvalidIndex
+	}
+
+	tree.aliasDepth++
+	targetIndex := tree.Find(tree.ClosestNamedAncestor(obj), srcPath)
+	tree.aliasDepth--
+
+	return targetIndex
+}
+
+// nameArgOf returns the arg of a named object that holds its namepath. Alias
+// objects are named by their second arg; all other named objects are named by
+// their first arg.
+func (tree *ObjectTree) nameArgOf(obj *Object) *Object {
+	if obj.opcode == pOpAlias {
+		return tree.ArgAt(obj, 1)
+	}
+
+	return tree.ObjectAt(obj.firstArgIndex)
+}
+
 // findRelative attempts to resolve an object using relative scope lookup rules.
 func (tree *ObjectTree) findRelative(scopeIndex uint32, expr []byte) uint32 {
 	exprLen := len(expr)
@@ -337,9 +395,12 @@ nextSegment:
 				}
 			}
 
-			// Found match; set match as the next scope index and
-			// try to match the next segment
-			scopeIndex = nextIndex
+			// Found match; set match (or the target of the match
+			// if it is an alias) as the next scope index and try to
+			// match the next segment
+			if scopeIndex = tree.ResolveAlias(nextIndex); scopeIndex == InvalidIndex {
+				return InvalidIndex
+			}
 			continue nextSegment
 		}
 
@@ -376,6 +437,33 @@ func (tree *ObjectTree) ClosestNamedAncestor(obj *Object) uint32 {
 	return InvalidIndex
 }
 
+// Path returns the absolute namespace path of the object at the specified
+// index using dots to separate its name segments (e.g. `\_SB_.PCI0`). It
+// returns an empty string if index does not point to a named object.
+func (tree *ObjectTree) Path(index uint32) string {
+	obj := tree.ObjectAt(index)
+	if obj == nil || len(nameOf(obj)) == 0 {
+		return ""
+	}
+
+	var segments [][]byte
+	for ; obj != nil; obj = tree.ObjectAt(tree.ClosestNamedAncestor(obj)) {
+		if name := nameOf(obj); len(name) != 0 {
+			segments = append(segments, name)
+		}
+	}
+
+	var buf bytes.Buffer
+	for i := len(segments) - 1; i >= 0; i-- {
+		if buf.Len() != 0 && buf.Bytes()[buf.Len()-1] != '\\' {
+			buf.WriteByte('.')
+		}
+		buf.Write(segments[i])
+	}
+
+	return buf.String()
+}
+
 // NumArgs returns the number of arguments contained in obj.
 func (tree *ObjectTree) NumArgs(obj *Object) uint32 {
 	if obj == nil {
@@ -437,6 +525,9 @@ func (tree *ObjectTree) toString(w io.Writer, padBuf *bytes.Buffer, index uint32
 	} else if curObj.opcode == pOpIntResolvedNamePath {
 		resolvedObj := tree.ObjectAt(curObj.value.(uint32))
 		kfmt.Fprintf(w, " -> [resolved to \"%s\", table: %d, index: %d, offset: 0x%x]", nameOf(resolvedObj), resolvedObj.tableHandle, resolvedObj.index, resolvedObj.amlOffset)
+	} else if curObj.opcode == pOpAlias && curObj.value != nil {
+		targetObj := tree.ObjectAt(curObj.value.(uint32))
+		kfmt.Fprintf(w, " -> [alias to \"%s\", table: %d, index: %d, offset: 0x%x]", nameOf(targetObj), targetObj.tableHandle, targetObj.index, targetObj.amlOffset)
 	} else if curObj.opcode == pOpIntNamedField {
 		field := curObj.value.(*fieldElement)
 		kfmt.Fprintf(w, " -> [field index: %d, offset(bytes): 0x%x, width(bits): 0x%x, accType: ", field.fieldIndex, field.offset, field.width)
@@ -519,23 +610,8 @@ func (tree *ObjectTree) toString(w io.Writer, padBuf *bytes.Buffer, index uint32
 			kfmt.Fprintf(w, " -> [num value; dec: %d, hex: 0x%x]", v, v)
 
 			// If this is an encoded EISA id convert it back to a string
-			if curObj.opcode == pOpDwordPrefix && tree.ObjectAt(curObj.parentIndex).name == [amlNameLen]byte{'_', 'H', 'I', 'D'} {
-				// Poor-man's ntohl
-				id := uint32((v>>24)&0xff) |
-					uint32((v>>16)&0xff)<<8 |
-					uint32((v>>8)&0xff)<<16 |
-					uint32(v&0xff)<<24
-
-				var eisaID = [7]byte{
-					'@' + (byte)((id>>26)&0x1f),
-					'@' + (byte)((id>>21)&0x1f),
-					'@' + (byte)((id>>16)&0x1f),
-					hexToASCII(id >> 12),
-					hexToASCII(id >> 8),
-					hexToASCII(id >> 4),
-					hexToASCII(id),
-				}
-
+			if curObj.opcode == pOpDwordPrefix && tree.ObjectAt(curObj.parentIndex).name == nameHID {
+				eisaID := decodeEISAID(v)
 				kfmt.Fprintf(w, " [EISA: \"%s\"]", eisaID[:])
 			}
 		case []byte:
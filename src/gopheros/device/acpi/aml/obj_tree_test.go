@@ -395,6 +395,34 @@ func TestClosestNamedAncestor(t *testing.T) {
 	}
 }
 
+func TestPath(t *testing.T) {
+	tree, scopeMap := genTestScopes()
+
+	specs := []struct {
+		index uint32
+		exp   string
+	}{
+		{scopeMap["\\"], `\`},
+		{scopeMap["_SB_"], `\_SB_`},
+		{scopeMap["IDE0"], `\_SB_.PCI0.IDE0`},
+		{scopeMap["_ADR"], `\_SB_.PCI0.IDE0._ADR`},
+		{InvalidIndex, ""},
+	}
+
+	for specIndex, spec := range specs {
+		if got := tree.Path(spec.index); got != spec.exp {
+			t.Errorf("[spec %d] expected path %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+
+	// Non-named objects do not have a path
+	obj := tree.newObject(pOpAdd, 0)
+	tree.append(tree.ObjectAt(scopeMap["PCI0"]), obj)
+	if got := tree.Path(obj.index); got != "" {
+		t.Errorf("expected path for a non-named object to be empty; got %q", got)
+	}
+}
+
 func genTestScopes() (*ObjectTree, map[string]uint32) {
 	// Setup the example tree from page 252 of the acpi 6.2 spec
 	// \
@@ -130,6 +130,10 @@ func (p *Parser) ParseAML(tableHandle uint8, tableName string, header *table.SDT
 		}
 	}
 
+	// Now that all named objects are in place, resolve alias sources so
+	// that lookups through aliases do not need to repeat the search.
+	p.resolveAliases(0)
+
 	// Parse deferred blocks
 	if p.parseDeferredBlocks(0) != parseResultOk {
 		return errParsingAML
@@ -161,6 +165,11 @@ func (p *Parser) init(tableHandle uint8, tableName string, header *table.SDTHead
 	// Keep track of the stream end for parsing deferred objects
 	p.streamEnd = header.Length
 	_ = p.pushPkgEnd(header.Length)
+
+	// The DSDT revision selects the integer width for the entire namespace
+	if tableName == "DSDT" {
+		p.objTree.SetIntegerWidth(header.Revision)
+	}
 }
 
 func (p *Parser) resetState(tableHandle uint8, tableName string) {
@@ -296,6 +305,13 @@ func (p *Parser) parseArg(info *pOpcodeInfo, curObj *Object, argType pArgType) (
 			return nil, parseResultFailed
 		}
 
+		// The predicate and body of If blocks are parsed as siblings of
+		// the If object. Keep track of the package end so the body can
+		// be told apart from any objects (e.g. an Else) that follow it.
+		if curObj.opcode == pOpIf {
+			curObj.pkgEnd = origOffset + pkgLen
+		}
+
 		return nil, parseResultOk
 	case pArgTypeFieldList:
 		return nil, p.parseFieldElements(curObj)
@@ -1027,8 +1043,9 @@ func (p *Parser) connectNamedObjArgs(objIndex uint32) parseResult {
 			continue
 		}
 
-		// Named opcodes contain a namepath as the first arg
-		if namepath, ok = p.objTree.ObjectAt(argObj.firstArgIndex).value.([]byte); !ok {
+		// Named opcodes contain a namepath as the first arg (or the
+		// second arg for aliases)
+		if namepath, ok = p.objTree.nameArgOf(argObj).value.([]byte); !ok {
 			kfmt.Fprintf(p.errWriter, "[table: %s, offset: 0x%x] named object of type %s without a valid name\n", p.tableName, argObj.amlOffset, pOpcodeName(argObj.opcode))
 			return parseResultFailed
 		}
@@ -1186,7 +1203,7 @@ func (p *Parser) relocateNamedObjects(objIndex uint32) parseResult {
 
 	if flags&pOpFlagNamed != 0 && obj.firstArgIndex != InvalidIndex && obj.tableHandle == p.tableHandle && obj.opcode != pOpIntScopeBlock {
 		// This is a named object. Check if its namepath requires relocation
-		if namepath, ok = p.objTree.ObjectAt(obj.firstArgIndex).value.([]byte); !ok {
+		if namepath, ok = p.objTree.nameArgOf(obj).value.([]byte); !ok {
 			kfmt.Fprintf(p.errWriter, "[table: %s, offset: 0x%x] named object of type %s without a valid name\n", p.tableName, obj.amlOffset, pOpcodeName(obj.opcode))
 			return parseResultFailed
 		}
@@ -1221,7 +1238,7 @@ func (p *Parser) relocateNamedObjects(objIndex uint32) parseResult {
 			}
 			p.objTree.detach(p.objTree.ObjectAt(obj.parentIndex), obj)
 			p.objTree.append(targetObj, obj)
-			p.objTree.ObjectAt(obj.firstArgIndex).value = namepath[nameIndex:]
+			p.objTree.nameArgOf(obj).value = namepath[nameIndex:]
 			p.relocatedObjects++
 		}
 	}
@@ -1242,6 +1259,24 @@ func (p *Parser) relocateNamedObjects(objIndex uint32) parseResult {
 	return res
 }
 
+// resolveAliases visits each Alias object defined by the table currently
+// parsed and caches the index of the object it refers to. Aliases whose source
+// cannot be resolved are left as is so that lookups retry the resolution at
+// run-time (e.g. when the source is defined by a table that is loaded later).
+func (p *Parser) resolveAliases(objIndex uint32) {
+	obj := p.objTree.ObjectAt(objIndex)
+	if obj.opcode == pOpAlias && obj.tableHandle == p.tableHandle {
+		if targetIndex := p.objTree.ResolveAlias(objIndex); targetIndex != InvalidIndex {
+			obj.value = targetIndex
+		}
+		return
+	}
+
+	for argIndex := obj.firstArgIndex; argIndex != InvalidIndex; argIndex = p.objTree.ObjectAt(argIndex).nextSiblingIndex {
+		p.resolveAliases(argIndex)
+	}
+}
+
 // parseDeferredBlocks attempts to parse any objects that contain objects that
 // are flagged as deferred (e.g. Buffers and BankFields).
 func (p *Parser) parseDeferredBlocks(objIndex uint32) parseResult {
@@ -1322,6 +1357,15 @@ func (p *Parser) connectNonNamedObjArgs(objIndex uint32) parseResult {
 			continue
 		}
 
+		// If blocks contain a variable number of objects in their body
+		// so they need to be handled separately.
+		if argObj.opcode == pOpIf {
+			if p.connectIfBlockArgs(obj, argObj) != parseResultOk {
+				return parseResultFailed
+			}
+			continue
+		}
+
 		// The parser has already attached args [0, termArgIndex) to
 		// the object and has parsed the remaining args as siblings to
 		// the object. Detach the missing args from the sibling list and
@@ -1335,6 +1379,39 @@ func (p *Parser) connectNonNamedObjArgs(objIndex uint32) parseResult {
 	return parseResultOk
 }
 
+// connectIfBlockArgs attaches the predicate and the body of an If block that
+// were parsed as siblings of ifObj. The predicate becomes the first arg of
+// ifObj while the siblings that are located before the end of the If package
+// are moved into a ScopeBlock which becomes the second arg. This ensures that
+// the objects that follow the If block (e.g. the Else blocks and the nested If
+// blocks generated by iasl for ElseIf chains) are not mistaken for part of
+// its body.
+func (p *Parser) connectIfBlockArgs(parentObj, ifObj *Object) parseResult {
+	if p.attachSiblingsAsArgs(parentObj, ifObj, 1, false) != parseResultOk {
+		return parseResultFailed
+	}
+
+	body := p.objTree.newObject(pOpIntScopeBlock, ifObj.tableHandle)
+	body.amlOffset = ifObj.pkgEnd
+	for siblingIndex := ifObj.nextSiblingIndex; siblingIndex != InvalidIndex; {
+		siblingObj := p.objTree.ObjectAt(siblingIndex)
+		if siblingObj.amlOffset >= ifObj.pkgEnd {
+			break
+		}
+
+		if body.firstArgIndex == InvalidIndex {
+			body.amlOffset = siblingObj.amlOffset
+		}
+
+		siblingIndex = siblingObj.nextSiblingIndex
+		p.objTree.detach(parentObj, siblingObj)
+		p.objTree.append(body, siblingObj)
+	}
+
+	p.objTree.append(ifObj, body)
+	return parseResultOk
+}
+
 // resolveMethodCalls visits each object with the pOpIntNamePathOrMethodCall
 // opcode and resolves it to either a pOpIntMethodCall or a pOpIntNamePath based
 // on the result of a lookup using the attached namepath.
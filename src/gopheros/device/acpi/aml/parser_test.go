@@ -914,6 +914,17 @@ func TestConnectNonNamedObjectsErrors(t *testing.T) {
 	if res := p.connectNonNamedObjArgs(0); res != parseResultFailed {
 		t.Fatalf("expected to get parseResultFailed(%d); got %d", parseResultFailed, res)
 	}
+
+	t.Run("If block without predicate", func(t *testing.T) {
+		tree := NewObjectTree()
+		root := tree.newObject(pOpIntScopeBlock, 0)
+		tree.append(root, tree.newObject(pOpIf, 0))
+
+		p := NewParser(os.Stdout, tree)
+		if res := p.connectNonNamedObjArgs(0); res != parseResultFailed {
+			t.Fatalf("expected to get parseResultFailed(%d); got %d", parseResultFailed, res)
+		}
+	})
 }
 
 func TestResolveMethodCallsErrors(t *testing.T) {
@@ -990,6 +1001,202 @@ func TestResolveMethodCallsErrors(t *testing.T) {
 	})
 }
 
+func TestParseElseIfChain(t *testing.T) {
+	// genPkg prefixes data with an encoded PkgLength.
+	genPkg := func(data []byte) []byte {
+		if pkgLen := len(data) + 1; pkgLen <= 0x3f {
+			return append([]byte{byte(pkgLen)}, data...)
+		}
+
+		pkgLen := len(data) + 2
+		return append([]byte{0x40 | byte(pkgLen&0xf), byte(pkgLen >> 4)}, data...)
+	}
+
+	// genChain emits the bytecode that iasl generates for:
+	//  If (Arg0 == level) { Local0 = level; Return (level) }
+	//  ElseIf (Arg0 == level + 1) { ... }
+	//  ...
+	//  Else { Return (Zero) }
+	// Each ElseIf is encoded as an Else block containing an If block
+	// followed by the remaining Else blocks.
+	var genChain func(level, depth int) []byte
+	genChain = func(level, depth int) []byte {
+		if level > depth {
+			return []byte{0xa4, 0x00}
+		}
+
+		ifBody := []byte{
+			0x93, 0x68, 0x0a, byte(level), // LEqual(Arg0, level)
+			0x70, 0x0a, byte(level), 0x60, // Store(level, Local0)
+			0xa4, 0x0a, byte(level), // Return(level)
+		}
+
+		chain := append([]byte{0xa0}, genPkg(ifBody)...)
+		chain = append(chain, 0xa1)
+		return append(chain, genPkg(genChain(level+1, depth))...)
+	}
+
+	for _, depth := range []int{1, 5, 8} {
+		// Method(TEST, 1) { <chain> }
+		payload := append([]byte{0x14}, genPkg(append([]byte{'T', 'E', 'S', 'T', 0x01}, genChain(1, depth)...))...)
+
+		tree := NewObjectTree()
+		tree.CreateDefaultScopes(0)
+
+		p := NewParser(&testWriter{t: t}, tree)
+		if err := p.ParseAML(1, "DSDT", mockByteDataResolver(payload).LookupTable("DSDT")); err != nil {
+			t.Fatalf("[depth %d] %v", depth, err)
+		}
+
+		scope := tree.ArgAt(tree.ObjectAt(tree.Find(0, []byte(`\TEST`))), 2)
+		for level := 1; level <= depth; level++ {
+			if exp, got := uint32(2), tree.NumArgs(scope); got != exp {
+				t.Fatalf("[depth %d, level %d] expected scope to contain %d objects; got %d", depth, level, exp, got)
+			}
+
+			ifObj, elseObj := tree.ArgAt(scope, 0), tree.ArgAt(scope, 1)
+			if ifObj.opcode != pOpIf || elseObj.opcode != pOpElse {
+				t.Fatalf("[depth %d, level %d] expected scope to contain an If and an Else block; got %s and %s", depth, level, pOpcodeName(ifObj.opcode), pOpcodeName(elseObj.opcode))
+			}
+
+			if exp, got := uint32(2), tree.NumArgs(ifObj); got != exp {
+				t.Fatalf("[depth %d, level %d] expected If block to have %d args; got %d", depth, level, exp, got)
+			}
+
+			predicate := tree.ArgAt(ifObj, 0)
+			if predicate.opcode != pOpLEqual || tree.ArgAt(predicate, 1).value.(uint64) != uint64(level) {
+				t.Fatalf("[depth %d, level %d] expected If predicate to be LEqual(Arg0, %d)", depth, level, level)
+			}
+
+			body := tree.ArgAt(ifObj, 1)
+			if body.opcode != pOpIntScopeBlock || tree.NumArgs(body) != 2 ||
+				tree.ArgAt(body, 0).opcode != pOpStore || tree.ArgAt(body, 1).opcode != pOpReturn {
+				t.Fatalf("[depth %d, level %d] expected If body to contain a Store and a Return statement", depth, level)
+			}
+
+			scope = tree.ArgAt(elseObj, 0)
+		}
+
+		if tree.NumArgs(scope) != 1 || tree.ArgAt(scope, 0).opcode != pOpReturn {
+			t.Fatalf("[depth %d] expected the last Else block to contain a Return statement", depth)
+		}
+	}
+}
+
+func TestParseAlias(t *testing.T) {
+	payload := []byte{
+		// Method(MTH0, 1) { Return(Arg0) }
+		0x14, 0x08, 'M', 'T', 'H', '0', 0x01, 0xa4, 0x68,
+		// Alias(MTH0, MTH1)
+		0x06, 'M', 'T', 'H', '0', 'M', 'T', 'H', '1',
+		// Method(MTH2, 0) { Return(MTH1(5)) }
+		0x14, 0x0d, 'M', 'T', 'H', '2', 0x00, 0xa4, 'M', 'T', 'H', '1', 0x0a, 0x05,
+		// Device(DEV0) { Alias(\HIDV, _HID) }
+		0x5b, 0x82, 0x0f, 'D', 'E', 'V', '0', 0x06, '\\', 'H', 'I', 'D', 'V', '_', 'H', 'I', 'D',
+		// Alias(DEV0, DEVA)
+		0x06, 'D', 'E', 'V', '0', 'D', 'E', 'V', 'A',
+		// Scope(DEVA) { Name(FOO_, One) }
+		0x10, 0x0b, 'D', 'E', 'V', 'A', 0x08, 'F', 'O', 'O', '_', 0x01,
+		// Name(HIDV, EisaId("PNP0303"))
+		0x08, 'H', 'I', 'D', 'V', 0x0c, 0x41, 0xd0, 0x03, 0x03,
+		// Alias(\CYC1, CYC0); Alias(\CYC0, CYC1)
+		0x06, '\\', 'C', 'Y', 'C', '1', 'C', 'Y', 'C', '0',
+		0x06, '\\', 'C', 'Y', 'C', '0', 'C', 'Y', 'C', '1',
+	}
+
+	tree := NewObjectTree()
+	tree.CreateDefaultScopes(0)
+
+	p := NewParser(&testWriter{t: t}, tree)
+	if err := p.ParseAML(1, "DSDT", mockByteDataResolver(payload).LookupTable("DSDT")); err != nil {
+		t.Fatal(err)
+	}
+
+	find := func(path string) uint32 { return tree.Find(0, []byte(path)) }
+
+	t.Run("lookup via alias", func(t *testing.T) {
+		specs := []struct {
+			aliasPath, targetPath string
+		}{
+			{`\MTH1`, `\MTH0`},
+			{`\DEVA`, `\DEV0`},
+		}
+
+		for specIndex, spec := range specs {
+			targetIndex := find(spec.targetPath)
+			if targetIndex == InvalidIndex {
+				t.Errorf("[spec %d] unable to find %s", specIndex, spec.targetPath)
+				continue
+			}
+
+			if got := find(spec.aliasPath); got != targetIndex {
+				t.Errorf("[spec %d] expected %s to resolve to %s (index %d); got %d", specIndex, spec.aliasPath, spec.targetPath, targetIndex, got)
+			}
+		}
+	})
+
+	t.Run("scope directive via alias", func(t *testing.T) {
+		for _, obj := range tree.objPool {
+			if obj.opcode == pOpName && string(obj.name[:]) == "FOO_" {
+				if got, exp := tree.Path(obj.index), `\DEV0.FOO_`; got != exp {
+					t.Fatalf("expected FOO_ to be defined at %s; got %s", exp, got)
+				}
+				return
+			}
+		}
+
+		t.Fatal("unable to find FOO_")
+	})
+
+	t.Run("alias targets cached by the parser", func(t *testing.T) {
+		var aliases int
+		for _, obj := range tree.objPool {
+			if obj.opcode != pOpAlias || string(obj.name[:3]) == "CYC" {
+				continue
+			}
+
+			aliases++
+			if _, resolved := obj.value.(uint32); !resolved {
+				t.Errorf("expected alias %s to be resolved by the parser", obj.name[:])
+			}
+		}
+
+		if exp := 3; aliases != exp {
+			t.Errorf("expected to find %d aliases; got %d", exp, aliases)
+		}
+	})
+
+	t.Run("method call via alias", func(t *testing.T) {
+		body := tree.ArgAt(tree.ObjectAt(find(`\MTH2`)), 2)
+		retObj := tree.ObjectAt(body.firstArgIndex)
+		callObj := tree.ArgAt(retObj, 0)
+		if callObj == nil || callObj.opcode != pOpIntMethodCall {
+			t.Fatal("expected call to MTH1 to be parsed as a method call")
+		}
+
+		if got, exp := callObj.value.(uint32), find(`\MTH0`); got != exp {
+			t.Fatalf("expected call to MTH1 to invoke MTH0 (index %d); got index %d", exp, got)
+		}
+
+		if argObj := tree.ArgAt(callObj, 0); argObj == nil || argObj.value.(uint64) != 5 {
+			t.Fatal("expected method call to consume 1 arg")
+		}
+	})
+
+	t.Run("device identification via alias", func(t *testing.T) {
+		tree.IdentifyDevices()
+		if id := tree.DeviceIDOf(find(`\DEV0`)); id == nil || id.HID != "PNP0303" {
+			t.Fatalf("expected _HID alias to resolve to PNP0303; got %v", id)
+		}
+	})
+
+	t.Run("alias cycle", func(t *testing.T) {
+		if got := find(`\CYC0`); got != InvalidIndex {
+			t.Fatalf("expected alias cycle lookup to return InvalidIndex; got %d", got)
+		}
+	})
+}
+
 func parserForMockPayload(t *testing.T, payload []byte) (*Parser, table.Resolver) {
 	tree := NewObjectTree()
 	tree.CreateDefaultScopes(42)
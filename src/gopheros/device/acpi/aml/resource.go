@@ -0,0 +1,184 @@
+package aml
+
+import "gopheros/kernel"
+
+const (
+	// Resource descriptors are encoded either as small items (1-byte
+	// header with the item type in bits 3-6 and the payload length in bits
+	// 0-2) or as large items (bit 7 set followed by a 16-bit payload
+	// length).
+	resLargeItem        = byte(1 << 7)
+	resSmallItemTypeEnd = byte(0x0f)
+
+	// resEndTag is the header of the end tag small item. The end tag
+	// payload is a checksum byte covering the entire resource template.
+	resEndTag = byte(resSmallItemTypeEnd<<3 | 1)
+
+	// Large item headers for the address space descriptors.
+	resDWordAddressSpace    = byte(0x87)
+	resWordAddressSpace     = byte(0x88)
+	resQWordAddressSpace    = byte(0x8a)
+	resExtendedAddressSpace = byte(0x8b)
+)
+
+// AddressSpaceType describes the type of resource that is specified by an
+// address space descriptor.
+type AddressSpaceType uint8
+
+// The list of supported address space types.
+const (
+	AddressSpaceMemory AddressSpaceType = iota
+	AddressSpaceIO
+	AddressSpaceBusNumber
+)
+
+// AddressSpace describes a resource range that is defined by a Word, DWord,
+// QWord or Extended Address Space Descriptor.
+type AddressSpace struct {
+	Type AddressSpaceType
+
+	// Min and Max specify the range of addresses (or bus numbers) that
+	// are decoded by the device.
+	Min, Max uint64
+
+	// Translation is the offset that must be added to an address on the
+	// secondary side of a bridge to obtain the address on its primary
+	// side.
+	Translation uint64
+
+	// Length is the size of the range.
+	Length uint64
+}
+
+var (
+	errMalformedResTemplate = &kernel.Error{Module: "acpi_aml", Message: "resource template contains a truncated descriptor"}
+	errMissingResEndTag     = &kernel.Error{Module: "acpi_aml", Message: "resource template is missing an end tag"}
+)
+
+// ConcatResourceTemplates implements the semantics of the ConcatRes opcode.
+// It returns a new resource template that contains the resource descriptors
+// of src1 followed by the descriptors of src2 and a single end tag whose
+// checksum covers the entire template. Zero-length buffers are treated as
+// empty resource templates.
+//
+// An error is returned if any of the supplied buffers contains a truncated
+// resource descriptor or does not contain an end tag.
+func ConcatResourceTemplates(src1, src2 []byte) ([]byte, *kernel.Error) {
+	len1, err := resourceTemplateLen(src1)
+	if err != nil {
+		return nil, err
+	}
+
+	len2, err := resourceTemplateLen(src2)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len1+len2+2)
+	copy(out, src1[:len1])
+	copy(out[len1:], src2[:len2])
+	out[len1+len2] = resEndTag
+
+	// The checksum is chosen so that all bytes in the template add up to 0
+	var sum byte
+	for _, b := range out {
+		sum += b
+	}
+	out[len(out)-1] = -sum
+
+	return out, nil
+}
+
+// ParseAddressSpaces returns the memory, I/O and bus number ranges defined by
+// the address space descriptors in a resource template (e.g. the value of
+// _CRS for a PCI root bridge). Other descriptor types are ignored.
+func ParseAddressSpaces(template []byte) ([]AddressSpace, *kernel.Error) {
+	var ranges []AddressSpace
+
+	_, err := visitResourceDescriptors(template, func(desc []byte) {
+		var fieldLen, fieldOffset int
+		switch desc[0] {
+		case resWordAddressSpace:
+			fieldLen, fieldOffset = 2, 6
+		case resDWordAddressSpace:
+			fieldLen, fieldOffset = 4, 6
+		case resQWordAddressSpace:
+			fieldLen, fieldOffset = 8, 6
+		case resExtendedAddressSpace:
+			fieldLen, fieldOffset = 8, 8
+		default:
+			return
+		}
+
+		// The descriptor contains the granularity, min, max, translation
+		// and length fields.
+		if len(desc) < fieldOffset+5*fieldLen || desc[3] > byte(AddressSpaceBusNumber) {
+			return
+		}
+
+		field := func(index int) uint64 {
+			var v uint64
+			for i := fieldLen - 1; i >= 0; i-- {
+				v = v<<8 | uint64(desc[fieldOffset+index*fieldLen+i])
+			}
+			return v
+		}
+
+		ranges = append(ranges, AddressSpace{
+			Type:        AddressSpaceType(desc[3]),
+			Min:         field(1),
+			Max:         field(2),
+			Translation: field(3),
+			Length:      field(4),
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ranges, nil
+}
+
+// resourceTemplateLen scans the resource descriptors in buf and returns the
+// number of bytes that precede the end tag.
+func resourceTemplateLen(buf []byte) (int, *kernel.Error) {
+	return visitResourceDescriptors(buf, nil)
+}
+
+// visitResourceDescriptors invokes visitor (if not nil) with the contents of
+// each resource descriptor (including its header) in buf up to the end tag.
+// It returns the number of bytes that precede the end tag.
+func visitResourceDescriptors(buf []byte, visitor func(desc []byte)) (int, *kernel.Error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	for offset := 0; offset < len(buf); {
+		header := buf[offset]
+
+		var itemLen int
+		switch {
+		case header&resLargeItem != 0:
+			if offset+3 > len(buf) {
+				return 0, errMalformedResTemplate
+			}
+			itemLen = 3 + (int(buf[offset+1]) | int(buf[offset+2])<<8)
+		case (header>>3)&0x0f == resSmallItemTypeEnd:
+			return offset, nil
+		default:
+			itemLen = 1 + int(header&0x07)
+		}
+
+		if offset+itemLen > len(buf) {
+			return 0, errMalformedResTemplate
+		}
+
+		if visitor != nil {
+			visitor(buf[offset : offset+itemLen])
+		}
+		offset += itemLen
+	}
+
+	return 0, errMissingResEndTag
+}
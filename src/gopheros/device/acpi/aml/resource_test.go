@@ -0,0 +1,126 @@
+package aml
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"testing"
+)
+
+func TestConcatResourceTemplates(t *testing.T) {
+	var (
+		// IO (Decode16, 0x0060, 0x0060, 0x00, 0x01) + IRQNoFlags () {1}
+		kbdRes = []byte{0x47, 0x01, 0x60, 0x00, 0x60, 0x00, 0x00, 0x01, 0x22, 0x02, 0x00, 0x79, 0x00}
+
+		// Memory32Fixed (ReadOnly, 0xfed00000, 0x00000400)
+		hpetRes = []byte{0x86, 0x09, 0x00, 0x00, 0x00, 0x00, 0xd0, 0xfe, 0x00, 0x04, 0x00, 0x00, 0x79, 0x00}
+	)
+
+	specs := []struct {
+		src1, src2 []byte
+		exp        []byte
+		expErr     *kernel.Error
+	}{
+		{
+			kbdRes,
+			hpetRes,
+			[]byte{
+				0x47, 0x01, 0x60, 0x00, 0x60, 0x00, 0x00, 0x01, 0x22, 0x02, 0x00,
+				0x86, 0x09, 0x00, 0x00, 0x00, 0x00, 0xd0, 0xfe, 0x00, 0x04, 0x00, 0x00,
+				0x79, 0xf9,
+			},
+			nil,
+		},
+		// Bytes following the end tag are ignored and empty buffers are
+		// treated as empty templates
+		{append(append([]byte{}, kbdRes...), 0xaa, 0xbb), nil, append(append([]byte{}, kbdRes[:11]...), 0x79, 0x5a), nil},
+		{nil, []byte{0x79, 0x00}, []byte{0x79, 0x87}, nil},
+		// Missing end tags
+		{[]byte{0x22, 0x02, 0x00}, kbdRes, nil, errMissingResEndTag},
+		{kbdRes, []byte{0x22, 0x02, 0x00}, nil, errMissingResEndTag},
+		// Truncated small and large items
+		{[]byte{0x47, 0x01, 0x60}, kbdRes, nil, errMalformedResTemplate},
+		{[]byte{0x86, 0x09, 0x00, 0x00}, kbdRes, nil, errMalformedResTemplate},
+		{[]byte{0x86, 0x09}, kbdRes, nil, errMalformedResTemplate},
+	}
+
+	for specIndex, spec := range specs {
+		got, err := ConcatResourceTemplates(spec.src1, spec.src2)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if !bytes.Equal(got, spec.exp) {
+			t.Errorf("[spec %d] expected resource template:\n%x\ngot:\n%x", specIndex, spec.exp, got)
+			continue
+		}
+
+		var sum byte
+		for _, b := range got {
+			sum += b
+		}
+		if sum != 0 {
+			t.Errorf("[spec %d] expected resource template bytes to add up to 0; got 0x%x", specIndex, sum)
+		}
+	}
+}
+
+func TestParseAddressSpaces(t *testing.T) {
+	template := []byte{
+		// WordBusNumber (ResourceProducer, MinFixed, MaxFixed, PosDecode, 0x0000, 0x0000, 0x00ff, 0x0000, 0x0100)
+		0x88, 0x0d, 0x00, 0x02, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00, 0x00, 0x01,
+		// IO (Decode16, 0x0cf8, 0x0cf8, 0x01, 0x08); ignored
+		0x47, 0x01, 0xf8, 0x0c, 0xf8, 0x0c, 0x01, 0x08,
+		// WordIO (ResourceProducer, MinFixed, MaxFixed, PosDecode, EntireRange, 0x0000, 0x0000, 0x0cf7, 0x0000, 0x0cf8)
+		0x88, 0x0d, 0x00, 0x01, 0x0c, 0x03, 0x00, 0x00, 0x00, 0x00, 0xf7, 0x0c, 0x00, 0x00, 0xf8, 0x0c,
+		// DWordMemory (ResourceProducer, PosDecode, MinFixed, MaxFixed, NonCacheable, ReadWrite, 0x00000000, 0xc0000000, 0xfebfffff, 0x00000000, 0x3ec00000)
+		0x87, 0x17, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0xff, 0xff, 0xbf, 0xfe, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x3e,
+		// QWordMemory (ResourceProducer, PosDecode, MinFixed, MaxFixed, Cacheable, ReadWrite, 0x0, 0x800000000, 0x8ffffffff, 0x0, 0x100000000)
+		0x8a, 0x2b, 0x00, 0x00, 0x0c, 0x03,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00,
+		0xff, 0xff, 0xff, 0xff, 0x08, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		// ExtendedIO (ResourceProducer, MinFixed, MaxFixed, PosDecode, EntireRange, 0x0, 0x1000, 0x1fff, 0x10000, 0x1000, 0x0)
+		0x8b, 0x35, 0x00, 0x01, 0x0c, 0x03, 0x01, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xff, 0x1f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// Vendor-defined address space; ignored
+		0x88, 0x0d, 0x00, 0xc0, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00, 0x00, 0x01,
+		// Truncated word address space; ignored
+		0x88, 0x02, 0x00, 0x02, 0x0c,
+		0x79, 0x00,
+	}
+
+	exp := []AddressSpace{
+		{Type: AddressSpaceBusNumber, Min: 0, Max: 0xff, Length: 0x100},
+		{Type: AddressSpaceIO, Min: 0, Max: 0xcf7, Length: 0xcf8},
+		{Type: AddressSpaceMemory, Min: 0xc0000000, Max: 0xfebfffff, Length: 0x3ec00000},
+		{Type: AddressSpaceMemory, Min: 0x800000000, Max: 0x8ffffffff, Length: 0x100000000},
+		{Type: AddressSpaceIO, Min: 0x1000, Max: 0x1fff, Translation: 0x10000, Length: 0x1000},
+	}
+
+	got, err := ParseAddressSpaces(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d address spaces; got %d: %+v", len(exp), len(got), got)
+	}
+
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Errorf("[spec %d] expected address space %+v; got %+v", i, exp[i], got[i])
+		}
+	}
+
+	if _, err = ParseAddressSpaces(template[:len(template)-2]); err != errMissingResEndTag {
+		t.Errorf("expected error %v; got %v", errMissingResEndTag, err)
+	}
+}
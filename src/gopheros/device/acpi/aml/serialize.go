@@ -0,0 +1,334 @@
+package aml
+
+import (
+	"encoding/binary"
+	"gopheros/kernel"
+	"io"
+)
+
+const (
+	// serializedTreeMagic and serializedTreeVersion form the header of a
+	// serialized ObjectTree. The version must be bumped whenever the
+	// layout of the serialized objects or the opcode table changes.
+	serializedTreeMagic   = "AMLT"
+	serializedTreeVersion = uint8(2)
+
+	// maxSerializedLen bounds the number of objects and the length of the
+	// byte values that are accepted by Deserialize so that a corrupted
+	// stream cannot trigger arbitrarily large allocations.
+	maxSerializedLen = 1 << 24
+)
+
+// The tags that prefix each serialized object value.
+const (
+	valueTagNil uint8 = iota
+	valueTagUint64
+	valueTagBytes
+	valueTagIndex
+	valueTagFieldElement
+	valueTagDeviceID
+)
+
+var (
+	errTreeWriteFailed       = &kernel.Error{Module: "acpi_aml", Message: "could not write serialized object tree"}
+	errTreeUnsupportedValue  = &kernel.Error{Module: "acpi_aml", Message: "object tree contains a value that cannot be serialized"}
+	errTreeMalformed         = &kernel.Error{Module: "acpi_aml", Message: "serialized object tree is truncated or malformed"}
+	errTreeUnsupportedFormat = &kernel.Error{Module: "acpi_aml", Message: "serialized object tree uses an unsupported format version"}
+)
+
+// Serialize writes a compact binary representation of the tree to w. The
+// serialized data includes the integer width, the structure of the tree, the
+// names and values of all objects and any cached device identification
+// objects so that a call to Deserialize yields a tree that is equivalent to
+// the original one.
+//
+// Byte values that refer to AML table contents are copied into the stream so
+// the deserialized tree does not depend on the tables that it was parsed from.
+func (tree *ObjectTree) Serialize(w io.Writer) *kernel.Error {
+	enc := treeEncoder{w: w}
+
+	enc.writeBytes([]byte(serializedTreeMagic))
+	enc.writeUint8(serializedTreeVersion)
+	enc.writeUint32(uint32(len(tree.objPool)))
+	enc.writeUint32(tree.freeListHeadIndex)
+	enc.writeUint8(tree.IntegerWidth())
+
+	for _, obj := range tree.objPool {
+		enc.writeUint16(obj.opcode)
+		enc.writeUint8(obj.infoIndex)
+		enc.writeUint8(obj.tableHandle)
+		enc.writeBytes(obj.name[:])
+		enc.writeUint32(obj.parentIndex)
+		enc.writeUint32(obj.prevSiblingIndex)
+		enc.writeUint32(obj.nextSiblingIndex)
+		enc.writeUint32(obj.firstArgIndex)
+		enc.writeUint32(obj.lastArgIndex)
+		enc.writeUint32(obj.amlOffset)
+		enc.writeUint32(obj.pkgEnd)
+		enc.writeValue(obj.value)
+
+		if enc.err != nil {
+			return enc.err
+		}
+	}
+
+	return enc.err
+}
+
+// Deserialize replaces the contents of the tree with a tree that was
+// previously serialized via a call to Serialize.
+//
+// If an error occurs, the tree contents are left unmodified.
+func (tree *ObjectTree) Deserialize(r io.Reader) *kernel.Error {
+	dec := treeDecoder{r: r}
+
+	var magic [len(serializedTreeMagic)]byte
+	dec.readBytes(magic[:])
+	if dec.err != nil || string(magic[:]) != serializedTreeMagic {
+		return errTreeMalformed
+	}
+
+	if version := dec.readUint8(); dec.err == nil && version != serializedTreeVersion {
+		return errTreeUnsupportedFormat
+	}
+
+	count := dec.readUint32()
+	freeListHeadIndex := dec.readUint32()
+	intWidth := dec.readUint8()
+	if dec.err != nil || count > maxSerializedLen || (intWidth != 32 && intWidth != 64) {
+		return errTreeMalformed
+	}
+
+	objPool := make([]*Object, count)
+	for index := range objPool {
+		obj := &Object{index: uint32(index)}
+		obj.opcode = dec.readUint16()
+		obj.infoIndex = dec.readUint8()
+		obj.tableHandle = dec.readUint8()
+		dec.readBytes(obj.name[:])
+		obj.parentIndex = dec.readUint32()
+		obj.prevSiblingIndex = dec.readUint32()
+		obj.nextSiblingIndex = dec.readUint32()
+		obj.firstArgIndex = dec.readUint32()
+		obj.lastArgIndex = dec.readUint32()
+		obj.amlOffset = dec.readUint32()
+		obj.pkgEnd = dec.readUint32()
+		obj.value = dec.readValue()
+
+		if dec.err != nil {
+			return dec.err
+		}
+
+		objPool[index] = obj
+	}
+
+	// Ensure that all object references point inside the pool
+	validIndex := func(index uint32) bool { return index == InvalidIndex || index < count }
+	if !validIndex(freeListHeadIndex) {
+		return errTreeMalformed
+	}
+
+	for _, obj := range objPool {
+		if !validIndex(obj.parentIndex) || !validIndex(obj.prevSiblingIndex) ||
+			!validIndex(obj.nextSiblingIndex) || !validIndex(obj.firstArgIndex) ||
+			!validIndex(obj.lastArgIndex) || int(obj.infoIndex) >= len(pOpcodeTable) {
+			return errTreeMalformed
+		}
+
+		if index, isIndex := obj.value.(uint32); isIndex && index >= count {
+			return errTreeMalformed
+		}
+	}
+
+	tree.objPool = objPool
+	tree.freeListHeadIndex = freeListHeadIndex
+	tree.intMask = intMask64
+	if intWidth == 32 {
+		tree.intMask = intMask32
+	}
+	return nil
+}
+
+// treeEncoder writes little-endian encoded values to an io.Writer. Once a
+// write fails, all subsequent writes are ignored and err is set.
+type treeEncoder struct {
+	w       io.Writer
+	scratch [8]byte
+	err     *kernel.Error
+}
+
+func (enc *treeEncoder) writeBytes(data []byte) {
+	if enc.err != nil {
+		return
+	}
+
+	if _, err := enc.w.Write(data); err != nil {
+		enc.err = errTreeWriteFailed
+	}
+}
+
+func (enc *treeEncoder) writeUint8(v uint8) {
+	enc.scratch[0] = v
+	enc.writeBytes(enc.scratch[:1])
+}
+
+func (enc *treeEncoder) writeUint16(v uint16) {
+	binary.LittleEndian.PutUint16(enc.scratch[:], v)
+	enc.writeBytes(enc.scratch[:2])
+}
+
+func (enc *treeEncoder) writeUint32(v uint32) {
+	binary.LittleEndian.PutUint32(enc.scratch[:], v)
+	enc.writeBytes(enc.scratch[:4])
+}
+
+func (enc *treeEncoder) writeUint64(v uint64) {
+	binary.LittleEndian.PutUint64(enc.scratch[:], v)
+	enc.writeBytes(enc.scratch[:8])
+}
+
+func (enc *treeEncoder) writeLenPrefixed(data []byte) {
+	enc.writeUint32(uint32(len(data)))
+	enc.writeBytes(data)
+}
+
+func (enc *treeEncoder) writeValue(value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		enc.writeUint8(valueTagNil)
+	case uint64:
+		enc.writeUint8(valueTagUint64)
+		enc.writeUint64(v)
+	case []byte:
+		enc.writeUint8(valueTagBytes)
+		enc.writeLenPrefixed(v)
+	case uint32:
+		enc.writeUint8(valueTagIndex)
+		enc.writeUint32(v)
+	case *fieldElement:
+		enc.writeUint8(valueTagFieldElement)
+		enc.writeUint32(v.offset)
+		enc.writeUint32(v.width)
+		enc.writeBytes([]byte{v.accessLength, v.accessType, v.accessAttrib, v.lockType, v.updateType})
+		enc.writeUint32(v.connectionIndex)
+		enc.writeUint32(v.fieldIndex)
+	case *DeviceID:
+		enc.writeUint8(valueTagDeviceID)
+		enc.writeLenPrefixed([]byte(v.HID))
+		enc.writeUint32(uint32(len(v.CIDs)))
+		for _, cid := range v.CIDs {
+			enc.writeLenPrefixed([]byte(cid))
+		}
+		enc.writeLenPrefixed([]byte(v.UID))
+		enc.writeUint64(v.ADR)
+		enc.writeUint64(v.STA)
+		enc.writeUint8(uint8(v.Defined))
+		enc.writeUint8(uint8(v.NeedsEval))
+	default:
+		if enc.err == nil {
+			enc.err = errTreeUnsupportedValue
+		}
+	}
+}
+
+// treeDecoder reads little-endian encoded values from an io.Reader. Once a
+// read fails, all subsequent reads return zero values and err is set.
+type treeDecoder struct {
+	r       io.Reader
+	scratch [8]byte
+	err     *kernel.Error
+}
+
+func (dec *treeDecoder) readBytes(data []byte) {
+	if dec.err != nil {
+		for i := range data {
+			data[i] = 0
+		}
+		return
+	}
+
+	if _, err := io.ReadFull(dec.r, data); err != nil {
+		dec.err = errTreeMalformed
+	}
+}
+
+func (dec *treeDecoder) readUint8() uint8 {
+	dec.readBytes(dec.scratch[:1])
+	return dec.scratch[0]
+}
+
+func (dec *treeDecoder) readUint16() uint16 {
+	dec.readBytes(dec.scratch[:2])
+	return binary.LittleEndian.Uint16(dec.scratch[:])
+}
+
+func (dec *treeDecoder) readUint32() uint32 {
+	dec.readBytes(dec.scratch[:4])
+	return binary.LittleEndian.Uint32(dec.scratch[:])
+}
+
+func (dec *treeDecoder) readUint64() uint64 {
+	dec.readBytes(dec.scratch[:8])
+	return binary.LittleEndian.Uint64(dec.scratch[:])
+}
+
+func (dec *treeDecoder) readLenPrefixed() []byte {
+	dataLen := dec.readUint32()
+	if dec.err != nil {
+		return nil
+	}
+
+	if dataLen > maxSerializedLen {
+		dec.err = errTreeMalformed
+		return nil
+	}
+
+	data := make([]byte, dataLen)
+	dec.readBytes(data)
+	return data
+}
+
+func (dec *treeDecoder) readValue() interface{} {
+	switch tag := dec.readUint8(); tag {
+	case valueTagNil:
+		return nil
+	case valueTagUint64:
+		return dec.readUint64()
+	case valueTagBytes:
+		return dec.readLenPrefixed()
+	case valueTagIndex:
+		return dec.readUint32()
+	case valueTagFieldElement:
+		field := &fieldElement{
+			offset: dec.readUint32(),
+			width:  dec.readUint32(),
+		}
+		var attrs [5]byte
+		dec.readBytes(attrs[:])
+		field.accessLength, field.accessType, field.accessAttrib, field.lockType, field.updateType = attrs[0], attrs[1], attrs[2], attrs[3], attrs[4]
+		field.connectionIndex = dec.readUint32()
+		field.fieldIndex = dec.readUint32()
+		return field
+	case valueTagDeviceID:
+		id := &DeviceID{HID: string(dec.readLenPrefixed())}
+		numCIDs := dec.readUint32()
+		if numCIDs > maxSerializedLen {
+			dec.err = errTreeMalformed
+			return nil
+		}
+		for i := uint32(0); i < numCIDs && dec.err == nil; i++ {
+			id.CIDs = append(id.CIDs, string(dec.readLenPrefixed()))
+		}
+		id.UID = string(dec.readLenPrefixed())
+		id.ADR = dec.readUint64()
+		id.STA = dec.readUint64()
+		id.Defined = DeviceIDField(dec.readUint8())
+		id.NeedsEval = DeviceIDField(dec.readUint8())
+		return id
+	default:
+		if dec.err == nil {
+			dec.err = errTreeMalformed
+		}
+		return nil
+	}
+}
@@ -0,0 +1,186 @@
+package aml
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSerializeRoundTrip(t *testing.T) {
+	var resolver = mockResolver{
+		pathToDumps: pkgDir() + "/../table/tabletest/",
+		tableFiles:  []string{"DSDT.aml", "SSDT.aml"},
+	}
+
+	tree := NewObjectTree()
+	tree.CreateDefaultScopes(0)
+
+	p := NewParser(&testWriter{t: t}, tree)
+	for tableIndex, tableName := range []string{"DSDT", "SSDT"} {
+		if err := p.ParseAML(uint8(tableIndex), tableName, resolver.LookupTable(tableName)); err != nil {
+			t.Fatalf("[%s]: %v", tableName, err)
+		}
+	}
+	tree.IdentifyDevices()
+
+	var buf bytes.Buffer
+	if err := tree.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewObjectTree()
+	if err := restored.Deserialize(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	var expOut, gotOut bytes.Buffer
+	tree.PrettyPrint(&expOut)
+	restored.PrettyPrint(&gotOut)
+	if expOut.String() != gotOut.String() {
+		t.Fatal("expected the deserialized tree to match the original tree")
+	}
+
+	if len(restored.objPool) != len(tree.objPool) || restored.freeListHeadIndex != tree.freeListHeadIndex {
+		t.Fatalf("expected deserialized tree to contain %d objects; got %d", len(tree.objPool), len(restored.objPool))
+	}
+
+	for index, obj := range tree.objPool {
+		got := restored.objPool[index]
+		if got.infoIndex != obj.infoIndex || got.pkgEnd != obj.pkgEnd || got.index != obj.index {
+			t.Errorf("object %d: expected %+v; got %+v", index, obj, got)
+		}
+
+		if field, ok := obj.value.(*fieldElement); ok && !reflect.DeepEqual(field, got.value) {
+			t.Errorf("object %d: expected field element %+v; got %+v", index, field, got.value)
+		}
+	}
+
+	tree.VisitDevices(func(index uint32, id *DeviceID) {
+		if got := restored.DeviceIDOf(index); !reflect.DeepEqual(got, id) {
+			t.Errorf("expected identification for device %s to be:\n%+v\ngot:\n%+v", tree.Path(index), id, got)
+		}
+	})
+
+	// Byte values should not alias the original table contents
+	if crs, ok := restored.DeviceBufferValue(findDevice(restored, "PS2K"), "_CRS"); !ok || len(crs) != 21 {
+		t.Errorf("expected PS2K._CRS to be restored; got %x, %t", crs, ok)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(_ []byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestSerializeErrors(t *testing.T) {
+	tree := NewObjectTree()
+	tree.CreateDefaultScopes(0)
+
+	if err := tree.Serialize(failingWriter{}); err != errTreeWriteFailed {
+		t.Errorf("expected error %v; got %v", errTreeWriteFailed, err)
+	}
+
+	tree.ObjectAt(1).value = "unsupported"
+	if err := tree.Serialize(&bytes.Buffer{}); err != errTreeUnsupportedValue {
+		t.Errorf("expected error %v; got %v", errTreeUnsupportedValue, err)
+	}
+}
+
+func TestSerializeIntegerWidth(t *testing.T) {
+	for _, dsdtRevision := range []uint8{1, 2} {
+		tree := NewObjectTree()
+		tree.CreateDefaultScopes(0)
+		tree.SetIntegerWidth(dsdtRevision)
+
+		var buf bytes.Buffer
+		if err := tree.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := NewObjectTree()
+		if err := restored.Deserialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp, got := tree.IntegerWidth(), restored.IntegerWidth(); got != exp {
+			t.Errorf("[rev %d] expected deserialized tree to use %d-bit integers; got %d", dsdtRevision, exp, got)
+		}
+	}
+}
+
+func TestDeserializeErrors(t *testing.T) {
+	tree := NewObjectTree()
+	tree.CreateDefaultScopes(0)
+
+	// Populate the tree with objects that contain all supported value types
+	tree.ObjectAt(1).value = uint64(42)
+	tree.ObjectAt(2).value = []byte("foo")
+	tree.ObjectAt(3).value = uint32(0)
+	tree.ObjectAt(4).value = &fieldElement{offset: 1, width: 8, accessType: 1, connectionIndex: InvalidIndex}
+	tree.ObjectAt(5).value = &DeviceID{HID: "PNP0A03", CIDs: []string{"PNP0A08"}, UID: "1", STA: StatusDefault, Defined: DeviceHID | DeviceCID}
+
+	var buf bytes.Buffer
+	if err := tree.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// Truncating the stream at any point should be detected
+	for dataLen := 0; dataLen < len(data); dataLen++ {
+		restored := NewObjectTree()
+		if err := restored.Deserialize(bytes.NewReader(data[:dataLen])); err != errTreeMalformed {
+			t.Fatalf("[len %d] expected error %v; got %v", dataLen, errTreeMalformed, err)
+		}
+
+		if restored.objPool != nil {
+			t.Fatalf("[len %d] expected tree contents to be left unmodified", dataLen)
+		}
+	}
+
+	// The offset of the value tag of the last object in the stream. Its
+	// value is a DeviceID that is encoded as: tag, HID, CID count, CIDs,
+	// UID, ADR, STA, Defined and NeedsEval.
+	lastObjOffset := len(data) - (1 + (4 + 7) + 4 + (4 + 7) + (4 + 1) + 8 + 8 + 1 + 1)
+
+	specs := []struct {
+		patch  func(data []byte)
+		expErr error
+	}{
+		{func(data []byte) { data[0] = 'X' }, errTreeMalformed},
+		{func(data []byte) { data[4] = serializedTreeVersion + 1 }, errTreeUnsupportedFormat},
+		// object count too large
+		{func(data []byte) { data[8] = 0xff }, errTreeMalformed},
+		// free list head index out of range
+		{func(data []byte) { data[9] = 0x10 }, errTreeMalformed},
+		// unsupported integer width
+		{func(data []byte) { data[13] = 16 }, errTreeMalformed},
+		// opcode table index of root object out of range
+		{func(data []byte) { data[16] = 0xff }, errTreeMalformed},
+		// parent index of root object out of range
+		{func(data []byte) { data[22] = 0x10 }, errTreeMalformed},
+		// unknown value tag
+		{func(data []byte) { data[lastObjOffset] = 0xff }, errTreeMalformed},
+		// CID count too large
+		{func(data []byte) { data[lastObjOffset+1+(4+7)+3] = 0xff }, errTreeMalformed},
+	}
+
+	for specIndex, spec := range specs {
+		patched := append([]byte(nil), data...)
+		spec.patch(patched)
+
+		if err := NewObjectTree().Deserialize(bytes.NewReader(patched)); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	// Resolved references must point inside the object pool
+	tree.ObjectAt(3).value = uint32(len(tree.objPool))
+	buf.Reset()
+	if err := tree.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewObjectTree().Deserialize(&buf); err != errTreeMalformed {
+		t.Errorf("expected error %v; got %v", errTreeMalformed, err)
+	}
+}
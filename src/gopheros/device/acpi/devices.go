@@ -0,0 +1,143 @@
+package acpi
+
+import (
+	"gopheros/device/acpi/aml"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+// Device describes a device that is defined in the AML namespace.
+type Device struct {
+	// Path contains the absolute namespace path of the device
+	// (e.g. `\_SB_.PCI0`).
+	Path string
+
+	// ID contains the cached identification objects of the device.
+	ID *aml.DeviceID
+
+	// Status contains the device status bits (see aml.StatusPresent).
+	// Devices whose parent device is not present are also reported as
+	// not present.
+	Status uint64
+
+	namespace *aml.ObjectTree
+	index     uint32
+}
+
+// Present returns true if the firmware reports the device as present.
+func (dev *Device) Present() bool {
+	return dev.Status&aml.StatusPresent != 0
+}
+
+// Enabled returns true if the firmware reports the device as enabled.
+func (dev *Device) Enabled() bool {
+	return dev.Status&aml.StatusEnabled != 0
+}
+
+// IntValue returns the value of the integer object with the specified name
+// (e.g. "_BBN") that is defined in the scope of the device. The lookup fails
+// if the object is not defined or if its value can only be obtained by
+// evaluating AML.
+func (dev *Device) IntValue(name string) (uint64, bool) {
+	if dev.namespace == nil {
+		return 0, false
+	}
+
+	return dev.namespace.DeviceIntValue(dev.index, name)
+}
+
+// BufferValue returns the contents of the buffer object with the specified
+// name (e.g. "_CRS") that is defined in the scope of the device. Like
+// IntValue, the lookup fails for values that need to be evaluated.
+func (dev *Device) BufferValue(name string) ([]byte, bool) {
+	if dev.namespace == nil {
+		return nil, false
+	}
+
+	return dev.namespace.DeviceBufferValue(dev.index, name)
+}
+
+// matches returns true if the _HID or any of the _CID values of the device
+// are equal to one of the supplied IDs.
+func (dev *Device) matches(ids []string) bool {
+	for _, id := range ids {
+		if dev.ID.HID == id {
+			return true
+		}
+
+		for _, cid := range dev.ID.CIDs {
+			if cid == id {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// VisitDevices invokes visitor for each device defined in the AML namespace in
+// the order that the devices were loaded. It is a no-op if the ACPI driver has
+// not been initialized or if the AML namespace could not be loaded.
+func VisitDevices(visitor func(dev *Device)) {
+	if activeDriver == nil {
+		return
+	}
+
+	for i := range activeDriver.devices {
+		visitor(&activeDriver.devices[i])
+	}
+}
+
+// DevicesPresent implements device.PresenceFn. It reports whether the AML
+// namespace defines any devices whose _HID or _CID matches one of ids and
+// whether at least one of them is both present and enabled.
+func DevicesPresent(ids []string) (present, described bool) {
+	VisitDevices(func(dev *Device) {
+		if !dev.matches(ids) {
+			return
+		}
+
+		described = true
+		if dev.Present() && dev.Enabled() {
+			present = true
+		}
+	})
+
+	return present, described
+}
+
+// registerDevices populates the device registry with the devices defined in
+// the AML namespace. Devices with a malformed _HID are still registered but
+// a warning is written to w.
+//
+// The status of each device is obtained from its _STA object. As _STA methods
+// that need to be evaluated by an AML interpreter are not supported yet, such
+// devices are assumed to be present. Changes to the device status that are
+// signaled via Notify(0x00/0x01) are also not tracked yet.
+func (drv *acpiDriver) registerDevices(w io.Writer) {
+	drv.devices = drv.devices[:0]
+	drv.namespace.VisitDevices(func(index uint32, id *aml.DeviceID) {
+		dev := Device{Path: drv.namespace.Path(index), ID: id, Status: drv.deviceStatus(index), namespace: drv.namespace, index: index}
+		if id.Defined&aml.DeviceHID != 0 && id.NeedsEval&aml.DeviceHID == 0 && !aml.ValidHID(id.HID) {
+			kfmt.Fprintf(w, "%s: malformed _HID \"%s\"\n", dev.Path, id.HID)
+		}
+
+		drv.devices = append(drv.devices, dev)
+	})
+}
+
+// deviceStatus returns the status of the device at the specified namespace
+// index. Devices whose parent device is not present are reported as not
+// present and not enabled.
+func (drv *acpiDriver) deviceStatus(index uint32) uint64 {
+	tree := drv.namespace
+	status := tree.DeviceIDOf(index).STA
+
+	for ancestor := tree.ClosestNamedAncestor(tree.ObjectAt(index)); ancestor != aml.InvalidIndex; ancestor = tree.ClosestNamedAncestor(tree.ObjectAt(ancestor)) {
+		if id := tree.DeviceIDOf(ancestor); id != nil && id.STA&aml.StatusPresent == 0 {
+			return status &^ (aml.StatusPresent | aml.StatusEnabled)
+		}
+	}
+
+	return status
+}
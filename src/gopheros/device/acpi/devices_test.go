@@ -0,0 +1,137 @@
+package acpi
+
+import (
+	"bytes"
+	"gopheros/device/acpi/aml"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel/cmdline"
+	"io/ioutil"
+	"testing"
+	"unsafe"
+)
+
+func TestVisitDevices(t *testing.T) {
+	defer func() {
+		cmdlineBoolFn = cmdline.Bool
+		activeDriver = nil
+	}()
+
+	cmdlineBoolFn = func(_ string) bool { return false }
+
+	visited := 0
+	VisitDevices(func(_ *Device) { visited++ })
+	if visited != 0 {
+		t.Fatal("expected no devices to be visited if the driver is not initialized")
+	}
+
+	drv := &acpiDriver{tableMap: make(map[string]*table.SDTHeader)}
+	for _, name := range []string{dsdtSignature, "SSDT"} {
+		data, err := ioutil.ReadFile(pkgDir() + "/table/tabletest/" + name + ".aml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		drv.tableMap[name] = (*table.SDTHeader)(unsafe.Pointer(&data[0]))
+	}
+
+	var buf bytes.Buffer
+	drv.loadNamespace(&buf)
+	activeDriver = drv
+
+	devices := make(map[string]*Device)
+	VisitDevices(func(dev *Device) { devices[dev.Path] = dev })
+
+	if exp := 28; len(devices) != exp {
+		t.Fatalf("expected %d devices to be visited; got %d", exp, len(devices))
+	}
+
+	specs := []struct {
+		path   string
+		expHID string
+	}{
+		{`\_SB_.PCI0`, "PNP0A03"},
+		{`\_SB_.PCI0.SBRG.HPET`, "PNP0103"},
+		{`\_SB_.PCI0.AC__`, "ACPI0003"},
+	}
+
+	for specIndex, spec := range specs {
+		dev := devices[spec.path]
+		if dev == nil {
+			t.Errorf("[spec %d] expected device %s to be registered", specIndex, spec.path)
+			continue
+		}
+
+		if dev.ID.HID != spec.expHID {
+			t.Errorf("[spec %d] expected device %s to have _HID %q; got %q", specIndex, spec.path, spec.expHID, dev.ID.HID)
+		}
+	}
+
+	t.Run("device values", func(t *testing.T) {
+		pci0 := devices[`\_SB_.PCI0`]
+		if bbn, ok := pci0.IntValue("_BBN"); !ok || bbn != 0 {
+			t.Errorf("expected %s._BBN to be 0; got %d, %t", pci0.Path, bbn, ok)
+		}
+
+		if _, ok := pci0.BufferValue("_CRS"); ok {
+			t.Errorf("expected lookup of missing %s._CRS to fail", pci0.Path)
+		}
+
+		hpet := devices[`\_SB_.PCI0.SBRG.HPET`]
+		if crs, ok := hpet.BufferValue("_CRS"); !ok || len(crs) != 20 {
+			t.Errorf("expected %s._CRS to contain 20 bytes; got %d, %t", hpet.Path, len(crs), ok)
+		}
+	})
+
+	t.Run("device status", func(t *testing.T) {
+		if present, described := DevicesPresent([]string{"PNP0103"}); !present || !described {
+			t.Errorf("expected HPET to be described and present; got %t, %t", described, present)
+		}
+
+		if present, described := DevicesPresent([]string{"PNP0303"}); !present || !described {
+			t.Errorf("expected PS2K to be described and present; got %t, %t", described, present)
+		}
+
+		if present, described := DevicesPresent([]string{"FOO0001"}); present || described {
+			t.Errorf("expected FOO0001 not to be described; got %t, %t", described, present)
+		}
+
+		// Mark the SBRG device as not present; all its children should
+		// be reported as not present
+		defer func() {
+			devices[`\_SB_.PCI0.SBRG`].ID.STA = aml.StatusDefault
+			drv.registerDevices(&buf)
+		}()
+		devices[`\_SB_.PCI0.SBRG`].ID.STA = 0
+		drv.registerDevices(&buf)
+
+		if present, described := DevicesPresent([]string{"PNP0103"}); present || !described {
+			t.Errorf("expected HPET to be described and not present; got %t, %t", described, present)
+		}
+
+		VisitDevices(func(dev *Device) {
+			switch dev.Path {
+			case `\_SB_.PCI0`:
+				if !dev.Present() || !dev.Enabled() {
+					t.Errorf("expected device %s to be present and enabled", dev.Path)
+				}
+			case `\_SB_.PCI0.SBRG.PS2K`:
+				if dev.Present() || dev.Enabled() {
+					t.Errorf("expected device %s not to be present or enabled", dev.Path)
+				}
+			}
+		})
+	})
+
+	t.Run("malformed HID", func(t *testing.T) {
+		devices[`\_SB_.PCI0`].ID.HID = "pnp0a03"
+		buf.Reset()
+		drv.registerDevices(&buf)
+
+		if exp := "\\_SB_.PCI0: malformed _HID \"pnp0a03\"\n"; buf.String() != exp {
+			t.Fatalf("expected output %q; got %q", exp, buf.String())
+		}
+
+		if exp := 28; len(drv.devices) != exp {
+			t.Fatalf("expected %d devices to be registered; got %d", exp, len(drv.devices))
+		}
+	})
+}
@@ -187,6 +187,30 @@ type FADT struct {
 	Ext FADT64
 }
 
+// BGRTImageTypeBitmap indicates that the BGRT image is stored as a Windows
+// bitmap (BMP).
+const BGRTImageTypeBitmap = 0
+
+// BGRT (Boot Graphics Resource Table) is an ACPI table that describes the
+// image that was displayed by the firmware while the system was booting.
+type BGRT struct {
+	SDTHeader
+
+	Version uint16
+
+	// If bit 0 of Status is set, the image is still displayed on screen.
+	Status uint8
+
+	ImageType uint8
+
+	// The physical address of the image data.
+	ImageAddress uint64
+
+	// The position of the top-left corner of the image on screen.
+	ImageOffsetX uint32
+	ImageOffsetY uint32
+}
+
 // MADT (Multiple APIC Description Table) is an ACPI table containing
 // information about the interrupt controllers and the number of installed
 // CPUs. Following the table header are a series of variable sized records
@@ -0,0 +1,236 @@
+// Package ahci implements a driver for AHCI SATA host bus adapters.
+//
+// The driver currently supports reading from SATA disks. Commands are issued
+// via the first command slot of each port and their completion is polled so
+// the driver does not depend on interrupt routing for the HBA.
+package ahci
+
+import (
+	"gopheros/device"
+	"gopheros/device/blockdev"
+	"gopheros/device/pci"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"io"
+	"unsafe"
+)
+
+const (
+	// PCI class code for AHCI controllers.
+	classMassStorage = uint8(0x01)
+	subclassSATA     = uint8(0x06)
+	progIFAHCI       = uint8(0x01)
+
+	// abarIndex is the BAR that contains the HBA registers.
+	abarIndex = uint8(5)
+
+	// Generic host control registers.
+	regCAP  = uintptr(0x00)
+	regGHC  = uintptr(0x04)
+	regIS   = uintptr(0x08)
+	regPI   = uintptr(0x0c)
+	regVS   = uintptr(0x10)
+	regCAP2 = uintptr(0x24)
+	regBOHC = uintptr(0x28)
+
+	capS64A = uint32(1 << 31)
+	ghcAE   = uint32(1 << 31)
+	cap2BOH = uint32(1 << 0)
+	bohcBOS = uint32(1 << 0)
+	bohcOOS = uint32(1 << 1)
+
+	// The port registers follow the generic host control registers.
+	portRegBase = uintptr(0x100)
+	portRegSize = uintptr(0x80)
+	maxPorts    = 32
+	abarSize    = portRegBase + maxPorts*portRegSize
+
+	// maxSpins bounds the number of polls while waiting for the HBA to
+	// update a register.
+	maxSpins = 1000000
+)
+
+var (
+	errNoMemoryBAR  = &kernel.Error{Module: "ahci", Message: "HBA registers are not located in a memory BAR"}
+	errHandoff      = &kernel.Error{Module: "ahci", Message: "timed out waiting for the BIOS to release the HBA"}
+	errNoDisks      = &kernel.Error{Module: "ahci", Message: "no SATA disks found"}
+	errNo64BitDMA   = &kernel.Error{Module: "ahci", Message: "DMA memory is not addressable by the HBA"}
+	errPortHung     = &kernel.Error{Module: "ahci", Message: "timed out waiting for the port command engine to stop"}
+	errPortBusy     = &kernel.Error{Module: "ahci", Message: "timed out waiting for the device to become ready"}
+	errCmdTimeout   = &kernel.Error{Module: "ahci", Message: "timed out waiting for command completion"}
+	errTaskFile     = &kernel.Error{Module: "ahci", Message: "device reported a command error"}
+	errNotSupported = &kernel.Error{Module: "ahci", Message: "device does not support the LBA addressing mode"}
+
+	// The following functions are used by tests to mock calls to the pci
+	// and vmm packages and accesses to the HBA registers.
+	pciDevicesFn          = pci.Devices
+	barFn                 = (*pci.Device).BAR
+	enableCommandFlagsFn  = (*pci.Device).EnableCommandFlags
+	disableCommandFlagsFn = (*pci.Device).DisableCommandFlags
+	mapRegionFn           = vmm.MapRegion
+	allocDMAFn            = vmm.AllocDMA
+	registerBlockFn       = blockdev.Register
+	readRegFn             = read32
+	writeRegFn            = write32
+)
+
+// controller describes an AHCI host bus adapter.
+type controller struct {
+	pciDev *pci.Device
+	regs   uintptr
+
+	// dma64 is set if the HBA supports 64-bit DMA addresses.
+	dma64 bool
+}
+
+// Driver implements a driver for the AHCI controllers attached to the PCI bus.
+// Each SATA disk connected to a controller is registered as a block device.
+type Driver struct {
+	pciDevs []*pci.Device
+	disks   []*disk
+}
+
+// DriverName returns the name of this driver.
+func (*Driver) DriverName() string {
+	return "ahci"
+}
+
+// DriverVersion returns the version of this driver.
+func (*Driver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit initializes all detected controllers and the disks attached to
+// them. An error is returned only if no disk could be initialized.
+func (drv *Driver) DriverInit(w io.Writer) *kernel.Error {
+	lastErr := errNoDisks
+	for _, pciDev := range drv.pciDevs {
+		ctrl, err := newController(pciDev)
+		if err != nil {
+			kfmt.Fprintf(w, "%2x:%2x.%d: %s\n", pciDev.Bus, pciDev.Slot, pciDev.Func, err.Message)
+			lastErr = err
+			continue
+		}
+
+		vs, pi := ctrl.read(regVS), ctrl.read(regPI)
+		kfmt.Fprintf(w, "%2x:%2x.%d: AHCI %d.%d, ports 0x%x\n", pciDev.Bus, pciDev.Slot, pciDev.Func, vs>>16, (vs>>8)&0xff, pi)
+
+		for index := uint8(0); index < maxPorts; index++ {
+			if pi&(1<<index) == 0 {
+				continue
+			}
+
+			d, err := ctrl.initPort(index)
+			switch {
+			case err != nil:
+				kfmt.Fprintf(w, "port %d: %s\n", index, err.Message)
+				lastErr = err
+				continue
+			case d == nil:
+				continue
+			}
+
+			d.dev = registerBlockFn("sd", d)
+			drv.disks = append(drv.disks, d)
+			kfmt.Fprintf(w, "%s: port %d, %s, %d MiB\n", d.dev.Name(), index, d.model, (d.sectorCount*uint64(d.sectorSize))>>20)
+		}
+	}
+
+	if len(drv.disks) == 0 {
+		return lastErr
+	}
+
+	return nil
+}
+
+// newController maps the registers of an HBA, takes over its ownership from
+// the BIOS and switches it to AHCI mode.
+func newController(pciDev *pci.Device) (*controller, *kernel.Error) {
+	abar, isIO := barFn(pciDev, abarIndex)
+	if isIO || abar == 0 {
+		return nil, errNoMemoryBAR
+	}
+
+	page, err := mapRegionFn(
+		mm.FrameFromAddress(uintptr(abar)),
+		vmm.PageOffset(uintptr(abar))+abarSize,
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute|vmm.FlagDoNotCache,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	enableCommandFlagsFn(pciDev, pci.CommandMemorySpace|pci.CommandBusMaster)
+
+	ctrl := &controller{
+		pciDev: pciDev,
+		regs:   page.Address() + vmm.PageOffset(uintptr(abar)),
+	}
+	ctrl.dma64 = ctrl.read(regCAP)&capS64A != 0
+
+	if ctrl.read(regCAP2)&cap2BOH != 0 {
+		ctrl.write(regBOHC, ctrl.read(regBOHC)|bohcOOS)
+		if !waitClear(ctrl.regs+regBOHC, bohcBOS) {
+			disableCommandFlagsFn(pciDev, pci.CommandMemorySpace|pci.CommandBusMaster)
+			return nil, errHandoff
+		}
+	}
+
+	ctrl.write(regGHC, ctrl.read(regGHC)|ghcAE)
+	ctrl.write(regIS, ctrl.read(regIS))
+	return ctrl, nil
+}
+
+func (ctrl *controller) read(reg uintptr) uint32 {
+	return readRegFn(ctrl.regs + reg)
+}
+
+func (ctrl *controller) write(reg uintptr, val uint32) {
+	writeRegFn(ctrl.regs+reg, val)
+}
+
+// waitClear polls the register at the specified address until all bits in
+// mask are cleared and returns false if the bits remain set.
+func waitClear(addr uintptr, mask uint32) bool {
+	for spins := 0; spins < maxSpins; spins++ {
+		if readRegFn(addr)&mask == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func read32(addr uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(addr))
+}
+
+func write32(addr uintptr, val uint32) {
+	*(*uint32)(unsafe.Pointer(addr)) = val
+}
+
+func probeForAHCI() device.Driver {
+	var pciDevs []*pci.Device
+	for _, pciDev := range pciDevicesFn() {
+		if pciDev.ClassCode == classMassStorage && pciDev.Subclass == subclassSATA && pciDev.ProgIF == progIFAHCI {
+			pciDevs = append(pciDevs, pciDev)
+		}
+	}
+
+	if len(pciDevs) == 0 {
+		return nil
+	}
+
+	return &Driver{pciDevs: pciDevs}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:      "ahci",
+		DependsOn: []string{"pci"},
+		Order:     device.DetectOrderLast,
+		Probe:     probeForAHCI,
+	})
+}
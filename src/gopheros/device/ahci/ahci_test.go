@@ -0,0 +1,505 @@
+package ahci
+
+import (
+	"bytes"
+	"gopheros/device/blockdev"
+	"gopheros/device/pci"
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	pciDevicesFn = pci.Devices
+	barFn = (*pci.Device).BAR
+	enableCommandFlagsFn = (*pci.Device).EnableCommandFlags
+	disableCommandFlagsFn = (*pci.Device).DisableCommandFlags
+	mapRegionFn = vmm.MapRegion
+	allocDMAFn = vmm.AllocDMA
+	registerBlockFn = blockdev.Register
+	readRegFn = read32
+	writeRegFn = write32
+}
+
+// mockDisk emulates a SATA disk attached to an HBA port.
+type mockDisk struct {
+	id         [256]uint16
+	sectorSize uint32
+	data       []byte
+
+	// commands records the ATA command, LBA and sector count for each
+	// command executed by the disk.
+	commands [][3]uint64
+}
+
+func newMockDisk(model string, sectors uint64, lba48 bool) *mockDisk {
+	d := &mockDisk{sectorSize: 512, data: make([]byte, sectors*512)}
+	for i := range d.data {
+		d.data[i] = byte(i / 512)
+	}
+
+	model += strings.Repeat(" ", 40-len(model))
+	for i := 0; i < 20; i++ {
+		d.id[27+i] = uint16(model[2*i])<<8 | uint16(model[2*i+1])
+	}
+
+	d.id[49] = 1 << 9
+	if lba48 {
+		d.id[83] = 1 << 10
+		d.id[100], d.id[101], d.id[102], d.id[103] = uint16(sectors), uint16(sectors>>16), uint16(sectors>>32), uint16(sectors>>48)
+	} else {
+		d.id[60], d.id[61] = uint16(sectors), uint16(sectors>>16)
+	}
+
+	return d
+}
+
+// mockHBA emulates the registers of an AHCI controller. DMA addresses are
+// expected to be identical to the virtual addresses of the buffers.
+type mockHBA struct {
+	mem   []byte
+	regs  uintptr
+	disks map[uint8]*mockDisk
+
+	// If set, the BIOS never releases the HBA.
+	biosHang bool
+
+	// If set, the command engine of each port never stops.
+	engineHang bool
+
+	// If set, all commands fail with a task file error.
+	failCommands bool
+}
+
+func newMockHBA(dma64 bool) *mockHBA {
+	h := &mockHBA{
+		mem:   make([]byte, abarSize+mm.PageSize),
+		disks: make(map[uint8]*mockDisk),
+	}
+	h.regs = (uintptr(unsafe.Pointer(&h.mem[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+	h.set(regVS, 0x00010300)
+	if dma64 {
+		h.set(regCAP, capS64A)
+	}
+	return h
+}
+
+func (h *mockHBA) get(reg uintptr) uint32      { return read32(h.regs + reg) }
+func (h *mockHBA) set(reg uintptr, val uint32) { write32(h.regs+reg, val) }
+
+func portReg(index uint8, reg uintptr) uintptr {
+	return portRegBase + uintptr(index)*portRegSize + reg
+}
+
+// addPort marks a port as implemented. If sig is not zero, a device with the
+// specified signature is attached to the port.
+func (h *mockHBA) addPort(index uint8, sig uint32, d *mockDisk) {
+	h.set(regPI, h.get(regPI)|1<<index)
+	if sig != 0 {
+		h.set(portReg(index, pxSSTS), 0x113)
+		h.set(portReg(index, pxSIG), sig)
+	}
+	if d != nil {
+		h.disks[index] = d
+	}
+}
+
+func (h *mockHBA) install(t *testing.T) {
+	barFn = func(_ *pci.Device, index uint8) (uint64, bool) {
+		if index != abarIndex {
+			t.Errorf("unexpected access to BAR %d", index)
+		}
+		return 0xfebf1000, false
+	}
+	mapRegionFn = func(frame mm.Frame, size uintptr, flags vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		if frame.Address() != 0xfebf1000 || size < abarSize || flags&vmm.FlagDoNotCache == 0 {
+			t.Errorf("unexpected ABAR mapping request for frame 0x%x (size %d, flags %d)", frame.Address(), size, flags)
+		}
+		return mm.PageFromAddress(h.regs), nil
+	}
+	enableCommandFlagsFn = func(_ *pci.Device, _ uint16) {}
+	disableCommandFlagsFn = func(_ *pci.Device, _ uint16) {}
+	allocDMAFn = func(size uintptr) (uintptr, uintptr, *kernel.Error) {
+		buf := make([]byte, size+mm.PageSize)
+		addr := (uintptr(unsafe.Pointer(&buf[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+		dmaBuffers = append(dmaBuffers, buf)
+		return addr, addr, nil
+	}
+	writeRegFn = h.write
+}
+
+// dmaBuffers keeps the memory returned by the mocked DMA allocator reachable.
+var dmaBuffers [][]byte
+
+func (h *mockHBA) write(addr uintptr, val uint32) {
+	reg := addr - h.regs
+	if reg < portRegBase {
+		switch reg {
+		case regBOHC:
+			if val&bohcOOS != 0 && !h.biosHang {
+				val &^= bohcBOS
+			}
+		case regIS:
+			val = h.get(regIS) &^ val
+		}
+		h.set(reg, val)
+		return
+	}
+
+	index := uint8((reg - portRegBase) / portRegSize)
+	switch (reg - portRegBase) % portRegSize {
+	case pxIS, pxSERR:
+		val = h.get(reg) &^ val
+	case pxCMD:
+		if !h.engineHang {
+			val &^= cmdCR | cmdFR
+			if val&cmdST != 0 {
+				val |= cmdCR
+			}
+			if val&cmdFRE != 0 {
+				val |= cmdFR
+			}
+		}
+	case pxCI:
+		h.set(reg, val)
+		h.execute(index)
+		return
+	}
+
+	h.set(reg, val)
+}
+
+// execute runs the command in slot 0 of the specified port.
+func (h *mockHBA) execute(index uint8) {
+	var (
+		d      = h.disks[index]
+		clb    = uintptr(h.get(portReg(index, pxCLB))) | uintptr(h.get(portReg(index, pxCLBU)))<<32
+		hdr    = (*[8]uint32)(unsafe.Pointer(clb))
+		table  = uintptr(hdr[2]) | uintptr(hdr[3])<<32
+		fis    = (*[64]uint8)(unsafe.Pointer(table))
+		prd    = (*[4]uint32)(unsafe.Pointer(table + prdtOffset))
+		dst    = (*[1 << 20]byte)(unsafe.Pointer(uintptr(prd[0]) | uintptr(prd[1])<<32))[:prd[3]+1]
+		lba    = uint64(fis[4]) | uint64(fis[5])<<8 | uint64(fis[6])<<16
+		count  = uint64(fis[12]) | uint64(fis[13])<<8
+		failed = h.failCommands || d == nil || fis[0] != fisTypeRegH2D || hdr[0]&0x1f != cmdFISLen
+	)
+
+	if fis[2] == ataCmdReadDMAExt {
+		lba |= uint64(fis[8])<<24 | uint64(fis[9])<<32 | uint64(fis[10])<<40
+	} else {
+		lba |= uint64(fis[7]&0xf) << 24
+	}
+
+	if !failed {
+		d.commands = append(d.commands, [3]uint64{uint64(fis[2]), lba, count})
+		switch fis[2] {
+		case ataCmdIdentify:
+			copy(dst, (*[512]byte)(unsafe.Pointer(&d.id[0]))[:])
+		case ataCmdReadDMA, ataCmdReadDMAExt:
+			start, end := lba*uint64(d.sectorSize), (lba+count)*uint64(d.sectorSize)
+			if uint64(len(dst)) != end-start || end > uint64(len(d.data)) {
+				failed = true
+				break
+			}
+			copy(dst, d.data[start:end])
+		default:
+			failed = true
+		}
+	}
+
+	if failed {
+		h.set(portReg(index, pxIS), isTFES)
+		h.set(portReg(index, pxTFD), tfdERR)
+	}
+	h.set(portReg(index, pxCI), 0)
+}
+
+func TestProbe(t *testing.T) {
+	defer restoreMocks()
+
+	ahciDev := &pci.Device{ClassCode: classMassStorage, Subclass: subclassSATA, ProgIF: progIFAHCI}
+	pciDevicesFn = func() []*pci.Device {
+		return []*pci.Device{
+			{ClassCode: classMassStorage, Subclass: 0x01},
+			{ClassCode: classMassStorage, Subclass: subclassSATA, ProgIF: 0},
+			ahciDev,
+		}
+	}
+
+	drv, ok := probeForAHCI().(*Driver)
+	if !ok || len(drv.pciDevs) != 1 || drv.pciDevs[0] != ahciDev {
+		t.Fatal("expected probe to return a driver for the AHCI controller")
+	}
+
+	if drv.DriverName() != "ahci" {
+		t.Fatalf("unexpected driver name %q", drv.DriverName())
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Fatalf("unexpected driver version %d.%d.%d", major, minor, patch)
+	}
+
+	pciDevicesFn = func() []*pci.Device { return nil }
+	if probeForAHCI() != nil {
+		t.Fatal("expected probe to return nil when no controllers are present")
+	}
+}
+
+func TestDriverInit(t *testing.T) {
+	defer restoreMocks()
+
+	h := newMockHBA(true)
+	h.set(regCAP2, cap2BOH)
+	h.set(regBOHC, bohcBOS)
+	h.addPort(0, sigATA, newMockDisk("QEMU HARDDISK", 16384, true))
+	h.addPort(1, 0xeb140101, nil)
+	h.addPort(2, 0, nil)
+	h.addPort(4, sigATA, nil)
+	h.install(t)
+
+	var registered []string
+	registerBlockFn = func(prefix string, drv blockdev.Driver) *blockdev.Device {
+		dev := blockdev.Register(prefix, drv)
+		registered = append(registered, dev.Name())
+		return dev
+	}
+
+	drv := &Driver{pciDevs: []*pci.Device{{Bus: 0, Slot: 0x1f, Func: 2}}}
+	var buf bytes.Buffer
+	if err := drv.DriverInit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.get(regGHC)&ghcAE == 0 || h.get(regBOHC)&bohcOOS == 0 {
+		t.Fatal("expected the HBA to be claimed from the BIOS and switched to AHCI mode")
+	}
+
+	if len(drv.disks) != 1 || len(registered) != 1 || registered[0] != "sda" {
+		t.Fatalf("expected one disk to be registered as sda; got %v", registered)
+	}
+
+	if cmd := h.get(portReg(0, pxCMD)); cmd&cmdST == 0 || cmd&cmdFRE == 0 {
+		t.Fatal("expected the port command engine to be started")
+	}
+
+	exp := "00:1f.2: AHCI 1.3, ports 0x17\nsda: port 0, QEMU HARDDISK, 8 MiB\nport 4: device reported a command error\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected driver output:\n%q\ngot:\n%q", exp, got)
+	}
+
+	// Controllers without any disks
+	h = newMockHBA(true)
+	h.addPort(0, 0, nil)
+	h.install(t)
+	drv = &Driver{pciDevs: drv.pciDevs}
+	if err := drv.DriverInit(&buf); err != errNoDisks {
+		t.Fatalf("expected error %v; got %v", errNoDisks, err)
+	}
+}
+
+func TestNewController(t *testing.T) {
+	defer restoreMocks()
+
+	h := newMockHBA(false)
+	h.install(t)
+	h.set(regIS, 0x5)
+
+	ctrl, err := newController(&pci.Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ctrl.dma64 || ctrl.regs != h.regs || h.get(regIS) != 0 {
+		t.Fatal("expected a 32-bit controller with its pending interrupts cleared")
+	}
+
+	h.set(regCAP2, cap2BOH)
+	h.set(regBOHC, bohcBOS)
+	h.biosHang = true
+	var releasedFlags uint16
+	disableCommandFlagsFn = func(_ *pci.Device, flags uint16) { releasedFlags |= flags }
+	if _, err = newController(&pci.Device{}); err != errHandoff {
+		t.Fatalf("expected error %v; got %v", errHandoff, err)
+	}
+	if exp := pci.CommandMemorySpace | pci.CommandBusMaster; releasedFlags != exp {
+		t.Fatalf("expected command flags 0x%x to be released after a failed handoff; got 0x%x", exp, releasedFlags)
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "map failed"}
+	mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		return 0, expErr
+	}
+	if _, err = newController(&pci.Device{}); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	barFn = func(_ *pci.Device, _ uint8) (uint64, bool) { return 0xc000, true }
+	if _, err = newController(&pci.Device{}); err != errNoMemoryBAR {
+		t.Fatalf("expected error %v; got %v", errNoMemoryBAR, err)
+	}
+}
+
+func TestInitPortErrors(t *testing.T) {
+	defer restoreMocks()
+
+	h := newMockHBA(true)
+	h.addPort(0, sigATA, newMockDisk("disk", 128, true))
+	h.install(t)
+	ctrl, err := newController(&pci.Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.engineHang = true
+	h.set(portReg(0, pxCMD), cmdST|cmdCR)
+	if _, err = ctrl.initPort(0); err != errPortHung {
+		t.Fatalf("expected error %v; got %v", errPortHung, err)
+	}
+
+	h.engineHang = false
+	h.set(portReg(0, pxCMD), 0)
+	h.set(portReg(0, pxTFD), tfdBSY)
+	if _, err = ctrl.initPort(0); err != errPortBusy {
+		t.Fatalf("expected error %v; got %v", errPortBusy, err)
+	}
+
+	// 32-bit HBAs cannot access memory above 4G
+	h.set(portReg(0, pxTFD), 0)
+	ctrl.dma64 = false
+	allocDMAFn = func(_ uintptr) (uintptr, uintptr, *kernel.Error) { return 0x1000, 0x100000000, nil }
+	if _, err = ctrl.initPort(0); err != errNo64BitDMA {
+		t.Fatalf("expected error %v; got %v", errNo64BitDMA, err)
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+	allocDMAFn = func(_ uintptr) (uintptr, uintptr, *kernel.Error) { return 0, 0, expErr }
+	if _, err = ctrl.initPort(0); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	defer restoreMocks()
+
+	specs := []struct {
+		setup          func(*mockDisk)
+		expErr         *kernel.Error
+		expLBA48       bool
+		expSectorSize  uint32
+		expSectorCount uint64
+	}{
+		{func(_ *mockDisk) {}, nil, true, 512, 1 << 33},
+		{func(d *mockDisk) { d.id[83] = 0; d.id[60], d.id[61] = 0x4000, 0x1 }, nil, false, 512, 0x14000},
+		// 4K logical sectors
+		{func(d *mockDisk) { d.id[106], d.id[117] = 0x5000, 2048 }, nil, true, 4096, 1 << 33},
+		// Word 106 is not valid
+		{func(d *mockDisk) { d.id[106], d.id[117] = 0x9000, 2048 }, nil, true, 512, 1 << 33},
+		// CHS-only device
+		{func(d *mockDisk) { d.id[83], d.id[49] = 0, 0 }, errNotSupported, false, 0, 0},
+		{func(d *mockDisk) { d.id[106], d.id[117], d.id[118] = 0x5000, 0, 1 }, errNotSupported, false, 0, 0},
+	}
+
+	for specIndex, spec := range specs {
+		h := newMockHBA(true)
+		md := newMockDisk("  WDC WD10EZEX", 0, true)
+		md.id[100], md.id[101], md.id[102] = 0, 0, 2
+		spec.setup(md)
+		h.addPort(3, sigATA, md)
+		h.install(t)
+
+		ctrl, _ := newController(&pci.Device{})
+		d, err := ctrl.initPort(3)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if d.model != "  WDC WD10EZEX" || d.lba48 != spec.expLBA48 || d.SectorSize() != spec.expSectorSize || d.SectorCount() != spec.expSectorCount {
+			t.Errorf("[spec %d] expected model %q, LBA48 %t and %d sectors of %d bytes; got %q, %t and %d sectors of %d bytes",
+				specIndex, "  WDC WD10EZEX", spec.expLBA48, spec.expSectorCount, spec.expSectorSize, d.model, d.lba48, d.SectorCount(), d.SectorSize())
+		}
+	}
+}
+
+func TestReadSectors(t *testing.T) {
+	defer restoreMocks()
+
+	specs := []struct {
+		lba48       bool
+		lba         uint64
+		count       uint32
+		expCommands [][3]uint64
+	}{
+		{true, 3, 2, [][3]uint64{{uint64(ataCmdReadDMAExt), 3, 2}}},
+		// Requests larger than the bounce buffer are split
+		{true, 10, 200, [][3]uint64{{uint64(ataCmdReadDMAExt), 10, 128}, {uint64(ataCmdReadDMAExt), 138, 72}}},
+		{false, 250, 6, [][3]uint64{{uint64(ataCmdReadDMA), 250, 6}}},
+	}
+
+	for specIndex, spec := range specs {
+		h := newMockHBA(true)
+		md := newMockDisk("disk", 256, spec.lba48)
+		h.addPort(0, sigATA, md)
+		h.install(t)
+
+		ctrl, _ := newController(&pci.Device{})
+		d, err := ctrl.initPort(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		md.commands = nil
+
+		buf := make([]byte, spec.count*512)
+		if err = d.ReadSectors(spec.lba, spec.count, buf); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if !bytes.Equal(buf, md.data[spec.lba*512:(spec.lba+uint64(spec.count))*512]) {
+			t.Errorf("[spec %d] sector data mismatch", specIndex)
+		}
+
+		if len(md.commands) != len(spec.expCommands) {
+			t.Errorf("[spec %d] expected commands %v; got %v", specIndex, spec.expCommands, md.commands)
+			continue
+		}
+		for i, exp := range spec.expCommands {
+			if md.commands[i] != exp {
+				t.Errorf("[spec %d] expected commands %v; got %v", specIndex, spec.expCommands, md.commands)
+				break
+			}
+		}
+	}
+
+	// Command errors
+	h := newMockHBA(true)
+	h.addPort(0, sigATA, newMockDisk("disk", 256, true))
+	h.install(t)
+	ctrl, _ := newController(&pci.Device{})
+	d, _ := ctrl.initPort(0)
+
+	h.failCommands = true
+	if err := d.ReadSectors(0, 1, make([]byte, 512)); err != errTaskFile {
+		t.Fatalf("expected error %v; got %v", errTaskFile, err)
+	}
+
+	// Commands that never complete
+	h.failCommands = false
+	writeRegFn = func(addr uintptr, val uint32) {
+		if addr != d.regs+pxCI {
+			h.write(addr, val)
+			return
+		}
+		write32(addr, val)
+	}
+	if err := d.ReadSectors(0, 1, make([]byte, 512)); err != errCmdTimeout {
+		t.Fatalf("expected error %v; got %v", errCmdTimeout, err)
+	}
+}
@@ -0,0 +1,290 @@
+package ahci
+
+import (
+	"gopheros/device/blockdev"
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/sync"
+	"unsafe"
+)
+
+const (
+	// Port registers.
+	pxCLB  = uintptr(0x00)
+	pxCLBU = uintptr(0x04)
+	pxFB   = uintptr(0x08)
+	pxFBU  = uintptr(0x0c)
+	pxIS   = uintptr(0x10)
+	pxIE   = uintptr(0x14)
+	pxCMD  = uintptr(0x18)
+	pxTFD  = uintptr(0x20)
+	pxSIG  = uintptr(0x24)
+	pxSSTS = uintptr(0x28)
+	pxSERR = uintptr(0x30)
+	pxCI   = uintptr(0x38)
+
+	cmdST  = uint32(1 << 0)
+	cmdFRE = uint32(1 << 4)
+	cmdFR  = uint32(1 << 14)
+	cmdCR  = uint32(1 << 15)
+
+	tfdERR = uint32(1 << 0)
+	tfdDRQ = uint32(1 << 3)
+	tfdBSY = uint32(1 << 7)
+
+	isTFES = uint32(1 << 30)
+
+	sstsDETMask        = uint32(0xf)
+	sstsDETEstablished = uint32(3)
+
+	// sigATA is the signature reported by ports with an attached SATA
+	// disk.
+	sigATA = uint32(0x00000101)
+
+	// Layout of the per-port DMA page which holds the command list, the
+	// received FIS area and the command table for the first command slot.
+	cmdListOffset  = uintptr(0x000)
+	fisOffset      = uintptr(0x400)
+	cmdTableOffset = uintptr(0x500)
+	prdtOffset     = uintptr(0x80)
+
+	// cmdFISLen is the length of a register host-to-device FIS in dwords.
+	cmdFISLen      = uint32(5)
+	fisTypeRegH2D  = uint8(0x27)
+	fisFlagCommand = uint8(0x80)
+	fisDeviceLBA   = uint8(1 << 6)
+
+	// ATA commands.
+	ataCmdIdentify    = uint8(0xec)
+	ataCmdReadDMA     = uint8(0xc8)
+	ataCmdReadDMAExt  = uint8(0x25)
+	identifySize      = uint32(512)
+	defaultSectorSize = uint32(512)
+
+	// bounceSize is the size of the buffer that receives the data
+	// transferred by each command.
+	bounceSize = uintptr(64 * 1024)
+)
+
+// disk describes a SATA disk attached to an HBA port.
+type disk struct {
+	regs uintptr
+	dev  *blockdev.Device
+
+	// lock serializes the use of the command slot and the bounce buffer.
+	lock sync.Spinlock
+
+	memVirt, memPhys       uintptr
+	bounceVirt, bouncePhys uintptr
+
+	model       string
+	lba48       bool
+	sectorSize  uint32
+	sectorCount uint64
+}
+
+// initPort sets up the command list and the received FIS area for a port and
+// identifies the attached disk. It returns nil if no SATA disk is attached to
+// the port.
+func (ctrl *controller) initPort(index uint8) (*disk, *kernel.Error) {
+	d := &disk{regs: ctrl.regs + portRegBase + uintptr(index)*portRegSize}
+
+	if d.read(pxSSTS)&sstsDETMask != sstsDETEstablished || d.read(pxSIG) != sigATA {
+		return nil, nil
+	}
+
+	// The command engine must be idle while the memory areas are updated
+	d.write(pxCMD, d.read(pxCMD)&^cmdST)
+	if !waitClear(d.regs+pxCMD, cmdCR) {
+		return nil, errPortHung
+	}
+	d.write(pxCMD, d.read(pxCMD)&^cmdFRE)
+	if !waitClear(d.regs+pxCMD, cmdFR) {
+		return nil, errPortHung
+	}
+
+	var err *kernel.Error
+	if d.memVirt, d.memPhys, err = allocDMAFn(mm.PageSize); err != nil {
+		return nil, err
+	}
+	if d.bounceVirt, d.bouncePhys, err = allocDMAFn(bounceSize); err != nil {
+		return nil, err
+	}
+	if !ctrl.dma64 && (d.memPhys>>32 != 0 || (d.bouncePhys+bounceSize-1)>>32 != 0) {
+		return nil, errNo64BitDMA
+	}
+
+	d.write(pxCLB, uint32(d.memPhys+cmdListOffset))
+	d.write(pxCLBU, uint32(uint64(d.memPhys+cmdListOffset)>>32))
+	d.write(pxFB, uint32(d.memPhys+fisOffset))
+	d.write(pxFBU, uint32(uint64(d.memPhys+fisOffset)>>32))
+
+	// Clear any pending errors and interrupts; completions are polled
+	d.write(pxSERR, 0xffffffff)
+	d.write(pxIS, 0xffffffff)
+	d.write(pxIE, 0)
+
+	d.write(pxCMD, d.read(pxCMD)|cmdFRE)
+	if !waitClear(d.regs+pxTFD, tfdBSY|tfdDRQ) {
+		return nil, errPortBusy
+	}
+	d.write(pxCMD, d.read(pxCMD)|cmdST)
+
+	if err = d.identify(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// identify issues an IDENTIFY DEVICE command and extracts the disk model and
+// geometry from the returned data.
+func (d *disk) identify() *kernel.Error {
+	if err := d.issue(ataCmdIdentify, 0, 0, identifySize); err != nil {
+		return err
+	}
+
+	id := (*[256]uint16)(unsafe.Pointer(d.bounceVirt))
+
+	// Words 27-46 contain the model as a space-padded string with the
+	// bytes of each word swapped.
+	var model [40]byte
+	for i := 0; i < 20; i++ {
+		model[2*i], model[2*i+1] = byte(id[27+i]>>8), byte(id[27+i])
+	}
+	end := len(model)
+	for end > 0 && (model[end-1] == ' ' || model[end-1] == 0) {
+		end--
+	}
+	d.model = string(model[:end])
+
+	switch {
+	case id[83]&(1<<10) != 0:
+		d.lba48 = true
+		d.sectorCount = uint64(id[100]) | uint64(id[101])<<16 | uint64(id[102])<<32 | uint64(id[103])<<48
+	case id[49]&(1<<9) != 0:
+		d.sectorCount = uint64(id[60]) | uint64(id[61])<<16
+	default:
+		return errNotSupported
+	}
+
+	// Word 106 is valid if bit 14 is set and bit 15 is cleared. Bit 12
+	// indicates that the logical sector size in words is reported by
+	// words 117-118.
+	d.sectorSize = defaultSectorSize
+	if id[106]&0xc000 == 0x4000 && id[106]&(1<<12) != 0 {
+		d.sectorSize = 2 * (uint32(id[117]) | uint32(id[118])<<16)
+	}
+
+	if d.sectorSize == 0 || uintptr(d.sectorSize) > bounceSize {
+		return errNotSupported
+	}
+
+	return nil
+}
+
+// SectorSize returns the size of a logical sector in bytes.
+func (d *disk) SectorSize() uint32 {
+	return d.sectorSize
+}
+
+// SectorCount returns the number of logical sectors.
+func (d *disk) SectorCount() uint64 {
+	return d.sectorCount
+}
+
+// ReadSectors reads count sectors starting at the specified LBA into buf.
+func (d *disk) ReadSectors(lba uint64, count uint32, buf []byte) *kernel.Error {
+	d.lock.Acquire()
+	defer d.lock.Release()
+
+	var (
+		maxCount = uint32(bounceSize / uintptr(d.sectorSize))
+		cmd      = ataCmdReadDMA
+		bounce   = (*[bounceSize]byte)(unsafe.Pointer(d.bounceVirt))
+	)
+
+	if d.lba48 {
+		cmd = ataCmdReadDMAExt
+	}
+
+	for count > 0 {
+		n := count
+		if n > maxCount {
+			n = maxCount
+		}
+
+		size := n * d.sectorSize
+		if err := d.issue(cmd, lba, uint16(n), size); err != nil {
+			return err
+		}
+
+		buf = buf[copy(buf, bounce[:size]):]
+		lba += uint64(n)
+		count -= n
+	}
+
+	return nil
+}
+
+// issue sends an ATA command that transfers size bytes from the device to the
+// bounce buffer and waits for its completion.
+func (d *disk) issue(cmd uint8, lba uint64, count uint16, size uint32) *kernel.Error {
+	if !waitClear(d.regs+pxTFD, tfdBSY|tfdDRQ) {
+		return errPortBusy
+	}
+
+	// Command header for slot 0 with a single PRD entry
+	var (
+		hdr     = (*[8]uint32)(unsafe.Pointer(d.memVirt + cmdListOffset))
+		table   = d.memVirt + cmdTableOffset
+		fis     = (*[64]uint8)(unsafe.Pointer(table))
+		prd     = (*[4]uint32)(unsafe.Pointer(table + prdtOffset))
+		tablePA = uint64(d.memPhys + cmdTableOffset)
+	)
+
+	hdr[0] = cmdFISLen | 1<<16
+	hdr[1] = 0
+	hdr[2], hdr[3] = uint32(tablePA), uint32(tablePA>>32)
+
+	for i := range fis {
+		fis[i] = 0
+	}
+	fis[0], fis[1], fis[2] = fisTypeRegH2D, fisFlagCommand, cmd
+	fis[4], fis[5], fis[6] = uint8(lba), uint8(lba>>8), uint8(lba>>16)
+	fis[7] = fisDeviceLBA
+	if cmd == ataCmdReadDMA {
+		fis[7] |= uint8(lba>>24) & 0xf
+	} else {
+		fis[8], fis[9], fis[10] = uint8(lba>>24), uint8(lba>>32), uint8(lba>>40)
+	}
+	fis[12], fis[13] = uint8(count), uint8(count>>8)
+
+	prd[0], prd[1] = uint32(d.bouncePhys), uint32(uint64(d.bouncePhys)>>32)
+	prd[2], prd[3] = 0, size-1
+
+	d.write(pxIS, 0xffffffff)
+	d.write(pxCI, 1)
+
+	for spins := 0; ; spins++ {
+		switch {
+		case d.read(pxIS)&isTFES != 0:
+			return errTaskFile
+		case d.read(pxCI)&1 == 0:
+			if d.read(pxTFD)&tfdERR != 0 {
+				return errTaskFile
+			}
+			return nil
+		case spins == maxSpins:
+			return errCmdTimeout
+		}
+	}
+}
+
+func (d *disk) read(reg uintptr) uint32 {
+	return readRegFn(d.regs + reg)
+}
+
+func (d *disk) write(reg uintptr, val uint32) {
+	writeRegFn(d.regs+reg, val)
+}
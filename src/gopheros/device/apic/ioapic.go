@@ -0,0 +1,308 @@
+package apic
+
+import (
+	"gopheros/device"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"io"
+	"unsafe"
+)
+
+const (
+	// I/O APIC register select and data window offsets.
+	ioRegSel = uintptr(0x00)
+	ioWin    = uintptr(0x10)
+
+	// I/O APIC indirect register indices.
+	ioRegVersion     = uint32(0x01)
+	ioRegRedirection = uint32(0x10)
+
+	redirDeliveryNMI = uint32(4 << 8)
+	redirPolarityLow = uint32(1 << 13)
+	redirLevel       = uint32(1 << 15)
+	redirMasked      = uint32(1 << 16)
+
+	// MADT interrupt source override flag values.
+	isoPolarityMask  = uint16(0x3)
+	isoPolarityLow   = uint16(0x3)
+	isoTriggerMask   = uint16(0x3 << 2)
+	isoTriggerLevel  = uint16(0x3 << 2)
+	madtSignature    = "APIC"
+	ioAPICRegionSize = uintptr(0x20)
+)
+
+var (
+	errUnknownGSI = &kernel.Error{Module: "ioapic", Message: "GSI is not managed by any I/O APIC"}
+
+	// acpiLookupTableFn is used by tests to mock calls to the acpi package.
+	acpiLookupTableFn = acpi.LookupTable
+)
+
+// gsiMode stores the trigger mode and polarity for a GSI.
+type gsiMode struct {
+	trigger  irq.TriggerMode
+	polarity irq.Polarity
+}
+
+// ioAPIC describes a single I/O APIC chip.
+type ioAPIC struct {
+	id       uint8
+	physAddr uintptr
+	regBase  uintptr
+
+	// gsiBase is the first GSI handled by this I/O APIC and numPins is the
+	// number of its redirection table entries.
+	gsiBase uint32
+	numPins uint32
+}
+
+func (chip *ioAPIC) read(reg uint32) uint32 {
+	*(*uint32)(unsafe.Pointer(chip.regBase + ioRegSel)) = reg
+	return *(*uint32)(unsafe.Pointer(chip.regBase + ioWin))
+}
+
+func (chip *ioAPIC) write(reg, val uint32) {
+	*(*uint32)(unsafe.Pointer(chip.regBase + ioRegSel)) = reg
+	*(*uint32)(unsafe.Pointer(chip.regBase + ioWin)) = val
+}
+
+// IOAPICController implements a driver for the I/O APICs that are described
+// by the ACPI MADT table. The driver implements irq.Controller and replaces any
+// previously installed interrupt controller once initialized.
+type IOAPICController struct {
+	chips []*ioAPIC
+
+	// modes holds the GSIs whose trigger mode and polarity differ from
+	// the ISA defaults (edge-triggered, active high). It is populated
+	// from the MADT interrupt source overrides and via SetTriggerMode.
+	modes map[uint32]gsiMode
+}
+
+// Route implements irq.Controller. It programs the redirection entry for the
+// GSI so that it is delivered to the boot processor using the given vector.
+// The entry remains masked until Unmask is invoked.
+func (ctrl *IOAPICController) Route(gsi uint32, vector gate.InterruptNumber) *kernel.Error {
+	chip, pin := ctrl.chipForGSI(gsi)
+	if chip == nil {
+		return errUnknownGSI
+	}
+
+	entryLow := redirMasked | uint32(vector)
+	if mode, ok := ctrl.modes[gsi]; ok {
+		if mode.trigger == irq.TriggerLevel {
+			entryLow |= redirLevel
+		}
+		if mode.polarity == irq.PolarityActiveLow {
+			entryLow |= redirPolarityLow
+		}
+	}
+
+	var destID uint8
+	if lapic := ActiveLocalAPIC(); lapic != nil {
+		destID = lapic.ID()
+	}
+
+	chip.write(ioRegRedirection+2*pin, redirMasked)
+	chip.write(ioRegRedirection+2*pin+1, uint32(destID)<<24)
+	chip.write(ioRegRedirection+2*pin, entryLow)
+	return nil
+}
+
+// RouteNMI implements irq.NMIRouter. It programs the redirection entry for the
+// GSI so that it is delivered to the boot processor as an edge-triggered NMI.
+// The entry remains masked until Unmask is invoked.
+func (ctrl *IOAPICController) RouteNMI(gsi uint32) *kernel.Error {
+	chip, pin := ctrl.chipForGSI(gsi)
+	if chip == nil {
+		return errUnknownGSI
+	}
+
+	var destID uint8
+	if lapic := ActiveLocalAPIC(); lapic != nil {
+		destID = lapic.ID()
+	}
+
+	chip.write(ioRegRedirection+2*pin, redirMasked)
+	chip.write(ioRegRedirection+2*pin+1, uint32(destID)<<24)
+	chip.write(ioRegRedirection+2*pin, redirMasked|redirDeliveryNMI)
+	return nil
+}
+
+// Mask implements irq.Controller.
+func (ctrl *IOAPICController) Mask(gsi uint32) {
+	if chip, pin := ctrl.chipForGSI(gsi); chip != nil {
+		reg := ioRegRedirection + 2*pin
+		chip.write(reg, chip.read(reg)|redirMasked)
+	}
+}
+
+// Unmask implements irq.Controller.
+func (ctrl *IOAPICController) Unmask(gsi uint32) {
+	if chip, pin := ctrl.chipForGSI(gsi); chip != nil {
+		reg := ioRegRedirection + 2*pin
+		chip.write(reg, chip.read(reg)&^redirMasked)
+	}
+}
+
+// EOI implements irq.Controller. Interrupts delivered by the I/O APIC are
+// acknowledged via the local APIC.
+func (ctrl *IOAPICController) EOI(_ gate.InterruptNumber) {
+	if lapic := ActiveLocalAPIC(); lapic != nil {
+		lapic.EOI()
+	}
+}
+
+// SetTriggerMode implements irq.TriggerModeSetter. PCI devices use it to
+// request level-triggered, active-low delivery for their INTx lines.
+func (ctrl *IOAPICController) SetTriggerMode(gsi uint32, trigger irq.TriggerMode, polarity irq.Polarity) *kernel.Error {
+	if chip, _ := ctrl.chipForGSI(gsi); chip == nil {
+		return errUnknownGSI
+	}
+
+	ctrl.modes[gsi] = gsiMode{trigger: trigger, polarity: polarity}
+	return nil
+}
+
+// chipForGSI returns the I/O APIC that handles gsi and the pin number
+// corresponding to it.
+func (ctrl *IOAPICController) chipForGSI(gsi uint32) (*ioAPIC, uint32) {
+	for _, chip := range ctrl.chips {
+		if gsi >= chip.gsiBase && gsi < chip.gsiBase+chip.numPins {
+			return chip, gsi - chip.gsiBase
+		}
+	}
+
+	return nil, 0
+}
+
+// DriverName returns the name of this driver.
+func (*IOAPICController) DriverName() string {
+	return "io_apic"
+}
+
+// DriverVersion returns the version of this driver.
+func (*IOAPICController) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit initializes this driver.
+func (ctrl *IOAPICController) DriverInit(w io.Writer) *kernel.Error {
+	for _, chip := range ctrl.chips {
+		page, err := mapRegionFn(
+			mm.FrameFromAddress(chip.physAddr),
+			ioAPICRegionSize,
+			vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute|vmm.FlagDoNotCache,
+		)
+		if err != nil {
+			return err
+		}
+		chip.regBase = page.Address() + vmm.PageOffset(chip.physAddr)
+		chip.numPins = ((chip.read(ioRegVersion) >> 16) & 0xff) + 1
+
+		// Mask all pins until a handler is registered for them
+		for pin := uint32(0); pin < chip.numPins; pin++ {
+			chip.write(ioRegRedirection+2*pin, redirMasked)
+		}
+
+		kfmt.Fprintf(w, "id: %d, GSIs: %d-%d, mapped to 0x%x\n", chip.id, chip.gsiBase, chip.gsiBase+chip.numPins-1, chip.regBase)
+	}
+
+	// The I/O APIC takes over the delivery of the ISA IRQs; mask all
+	// lines of the legacy PIC so it does not deliver them as well.
+	portWriteByteFn(picMasterDataPort, 0xff)
+	portWriteByteFn(picSlaveDataPort, 0xff)
+
+	irq.SetController(ctrl)
+	return nil
+}
+
+// parseMADT scans the MADT entries for I/O APICs and interrupt source
+// overrides. The overrides are used to update the ISA IRQ to GSI mappings
+// maintained by the irq package.
+func (ctrl *IOAPICController) parseMADT(madt *table.MADT) {
+	visitMADTEntries(madt, func(entryType table.MADTEntryType, entryAddr uintptr) {
+		switch entryType {
+		case table.MADTEntryTypeIOAPIC:
+			ctrl.chips = append(ctrl.chips, &ioAPIC{
+				id:       *(*uint8)(unsafe.Pointer(entryAddr + 2)),
+				physAddr: uintptr(*(*uint32)(unsafe.Pointer(entryAddr + 4))),
+				gsiBase:  *(*uint32)(unsafe.Pointer(entryAddr + 8)),
+				numPins:  1,
+			})
+		case table.MADTEntryTypeIntSrcOverride:
+			var (
+				irqSrc = *(*uint8)(unsafe.Pointer(entryAddr + 3))
+				gsi    = *(*uint32)(unsafe.Pointer(entryAddr + 4))
+				flags  = *(*uint16)(unsafe.Pointer(entryAddr + 8))
+			)
+			irq.MapISAIRQ(irqSrc, gsi)
+
+			// Conforming ISA interrupts are edge-triggered, active high
+			mode := gsiMode{trigger: irq.TriggerEdge, polarity: irq.PolarityActiveHigh}
+			if flags&isoTriggerMask == isoTriggerLevel {
+				mode.trigger = irq.TriggerLevel
+			}
+			if flags&isoPolarityMask == isoPolarityLow {
+				mode.polarity = irq.PolarityActiveLow
+			}
+			ctrl.modes[gsi] = mode
+		}
+	})
+}
+
+// visitMADTEntries invokes visitor with the type and address of each entry in
+// the MADT. The MADT entry structs in the table package are not packed so
+// visitors need to read the entry fields using their spec-defined offsets.
+func visitMADTEntries(madt *table.MADT, visitor func(table.MADTEntryType, uintptr)) {
+	var (
+		madtAddr  = uintptr(unsafe.Pointer(madt))
+		curPtr    = madtAddr + unsafe.Sizeof(*madt)
+		endPtr    = madtAddr + uintptr(madt.Length)
+		entryHdr  *table.MADTEntry
+		sizeofHdr = unsafe.Sizeof(table.MADTEntry{})
+	)
+
+	for ; curPtr+sizeofHdr <= endPtr; curPtr += uintptr(entryHdr.Length) {
+		entryHdr = (*table.MADTEntry)(unsafe.Pointer(curPtr))
+		if entryHdr.Length == 0 {
+			break
+		}
+
+		visitor(entryHdr.Type, curPtr)
+	}
+}
+
+func probeForIOAPIC() device.Driver {
+	// The I/O APIC can only be used in conjunction with the local APIC
+	if ActiveLocalAPIC() == nil {
+		return nil
+	}
+
+	madt := acpiLookupTableFn(madtSignature)
+	if madt == nil {
+		return nil
+	}
+
+	ctrl := &IOAPICController{modes: make(map[uint32]gsiMode)}
+	ctrl.parseMADT((*table.MADT)(unsafe.Pointer(madt)))
+	if len(ctrl.chips) == 0 {
+		return nil
+	}
+
+	return ctrl
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:      "io_apic",
+		DependsOn: []string{"local_apic", "ACPI"},
+		Order:     device.DetectOrderInterruptController,
+		Probe:     probeForIOAPIC,
+	})
+}
@@ -0,0 +1,214 @@
+package apic
+
+import (
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func restoreIOAPICMocks() {
+	acpiLookupTableFn = acpi.LookupTable
+	for isaIRQ := uint8(0); isaIRQ < irq.NumISAIRQs; isaIRQ++ {
+		irq.MapISAIRQ(isaIRQ, uint32(isaIRQ))
+	}
+	restoreLAPICMocks()
+}
+
+func TestProbeForIOAPIC(t *testing.T) {
+	defer restoreIOAPICMocks()
+
+	madt := loadTestMADT(t)
+	acpiLookupTableFn = func(name string) *table.SDTHeader {
+		if name == madtSignature {
+			return madt
+		}
+		return nil
+	}
+
+	t.Run("no local APIC", func(t *testing.T) {
+		if drv := probeForIOAPIC(); drv != nil {
+			t.Fatal("expected probe to fail when no local APIC is available")
+		}
+	})
+
+	localAPIC = &LocalAPIC{regBase: mockRegisterSpace()}
+
+	t.Run("no MADT", func(t *testing.T) {
+		defer func(fn func(string) *table.SDTHeader) { acpiLookupTableFn = fn }(acpiLookupTableFn)
+		acpiLookupTableFn = func(_ string) *table.SDTHeader { return nil }
+
+		if drv := probeForIOAPIC(); drv != nil {
+			t.Fatal("expected probe to fail when no MADT is available")
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		drv := probeForIOAPIC()
+		if drv == nil {
+			t.Fatal("expected probe to succeed")
+		}
+
+		ctrl := drv.(*IOAPICController)
+		if got := len(ctrl.chips); got != 1 {
+			t.Fatalf("expected MADT to contain 1 I/O APIC; got %d", got)
+		}
+
+		if chip := ctrl.chips[0]; chip.id != 1 || chip.physAddr != 0xfec00000 || chip.gsiBase != 0 {
+			t.Fatalf("unexpected I/O APIC entry: id: %d, addr: 0x%x, gsiBase: %d", chip.id, chip.physAddr, chip.gsiBase)
+		}
+
+		// The test MADT maps ISA IRQ 0 to GSI 2 and sets IRQ 9 to level-triggered
+		if got := irq.ISAIRQToGSI(0); got != 2 {
+			t.Errorf("expected ISA IRQ 0 to be mapped to GSI 2; got %d", got)
+		}
+
+		if mode := ctrl.modes[9]; mode.trigger != irq.TriggerLevel || mode.polarity != irq.PolarityActiveHigh {
+			t.Errorf("expected GSI 9 to be level-triggered, active high; got %+v", mode)
+		}
+	})
+}
+
+func TestIOAPICController(t *testing.T) {
+	defer restoreIOAPICMocks()
+
+	regBase := mockRegisterSpace()
+	localAPIC = &LocalAPIC{regBase: mockRegisterSpace()}
+	*(*uint32)(unsafe.Pointer(localAPIC.regBase + regID)) = 2 << 24
+
+	ctrl := &IOAPICController{
+		chips: []*ioAPIC{
+			{id: 1, physAddr: 0xfec00000, numPins: 1},
+		},
+		modes: make(map[uint32]gsiMode),
+	}
+
+	t.Run("map error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if err := ctrl.DriverInit(nil); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+
+	mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		return mm.PageFromAddress(regBase), nil
+	}
+
+	// Report 24 redirection entries via the version register
+	*(*uint32)(unsafe.Pointer(regBase + ioWin)) = 23 << 16
+
+	portWrites := make(map[uint16]uint8)
+	portWriteByteFn = func(port uint16, val uint8) { portWrites[port] = val }
+
+	if err := ctrl.DriverInit(&discardWriter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if portWrites[picMasterDataPort] != 0xff || portWrites[picSlaveDataPort] != 0xff {
+		t.Error("expected legacy PIC lines to be masked")
+	}
+
+	if got := ctrl.chips[0].numPins; got != 24 {
+		t.Fatalf("expected I/O APIC to have 24 pins; got %d", got)
+	}
+
+	if irq.ActiveController() != ctrl {
+		t.Fatal("expected I/O APIC to be installed as the active interrupt controller")
+	}
+
+	win := (*uint32)(unsafe.Pointer(regBase + ioWin))
+	sel := (*uint32)(unsafe.Pointer(regBase + ioRegSel))
+
+	if err := ctrl.Route(24, irq.VectorForGSI(24)); err != errUnknownGSI {
+		t.Errorf("expected to get errUnknownGSI; got %v", err)
+	}
+
+	if err := ctrl.SetTriggerMode(24, irq.TriggerLevel, irq.PolarityActiveLow); err != errUnknownGSI {
+		t.Errorf("expected to get errUnknownGSI; got %v", err)
+	}
+
+	if err := ctrl.SetTriggerMode(16, irq.TriggerLevel, irq.PolarityActiveLow); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		gsi      uint32
+		expEntry uint32
+	}{
+		{1, redirMasked | uint32(irq.VectorForGSI(1))},
+		{16, redirMasked | redirLevel | redirPolarityLow | uint32(irq.VectorForGSI(16))},
+	}
+
+	for specIndex, spec := range specs {
+		if err := ctrl.Route(spec.gsi, irq.VectorForGSI(spec.gsi)); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if exp := ioRegRedirection + 2*spec.gsi; *sel != exp {
+			t.Errorf("[spec %d] expected last selected register to be 0x%x; got 0x%x", specIndex, exp, *sel)
+		}
+
+		if *win != spec.expEntry {
+			t.Errorf("[spec %d] expected redirection entry to be 0x%x; got 0x%x", specIndex, spec.expEntry, *win)
+		}
+
+		ctrl.Unmask(spec.gsi)
+		if *win&redirMasked != 0 {
+			t.Errorf("[spec %d] expected redirection entry to be unmasked", specIndex)
+		}
+
+		ctrl.Mask(spec.gsi)
+		if *win&redirMasked == 0 {
+			t.Errorf("[spec %d] expected redirection entry to be masked", specIndex)
+		}
+	}
+
+	if err := ctrl.RouteNMI(24); err != errUnknownGSI {
+		t.Errorf("expected to get errUnknownGSI; got %v", err)
+	}
+
+	if err := ctrl.RouteNMI(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := redirMasked | redirDeliveryNMI; *sel != ioRegRedirection+4 || *win != exp {
+		t.Errorf("expected NMI redirection entry to be 0x%x; got 0x%x", exp, *win)
+	}
+
+	*(*uint32)(unsafe.Pointer(localAPIC.regBase + regEOI)) = 0xbadf00d
+	ctrl.EOI(irq.VectorForGSI(1))
+	if got := localAPIC.read(regEOI); got != 0 {
+		t.Errorf("expected local APIC EOI register to be cleared; got 0x%x", got)
+	}
+
+	if drvName := ctrl.DriverName(); drvName != "io_apic" {
+		t.Errorf("unexpected driver name: %s", drvName)
+	}
+
+	if major, minor, patch := ctrl.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Errorf("unexpected driver version: %d.%d.%d", major, minor, patch)
+	}
+}
+
+func loadTestMADT(t *testing.T) *table.SDTHeader {
+	_, f, _, _ := runtime.Caller(0)
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(f), "..", "acpi", "table", "tabletest", "APIC.aml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockRegisterBufs = append(mockRegisterBufs, data)
+	return (*table.SDTHeader)(unsafe.Pointer(&data[0]))
+}
@@ -0,0 +1,377 @@
+// Package apic provides drivers for the local and I/O advanced programmable
+// interrupt controllers (APIC).
+package apic
+
+import (
+	"gopheros/device"
+	"gopheros/device/acpi/table"
+	"gopheros/device/pit"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"io"
+	"unsafe"
+)
+
+const (
+	// TimerVector is the interrupt vector used by the local APIC timer.
+	TimerVector = gate.InterruptNumber(0xf0)
+
+	// SpuriousVector is the interrupt vector used by the local APIC for
+	// reporting spurious interrupts.
+	SpuriousVector = gate.InterruptNumber(0xff)
+
+	msrAPICBase      = uint32(0x1b)
+	msrTSCDeadline   = uint32(0x6e0)
+	apicBaseEnable   = uint64(1 << 11)
+	apicBaseAddrMask = uint64(0xffffff000)
+
+	// Local APIC register offsets.
+	regID               = uintptr(0x20)
+	regVersion          = uintptr(0x30)
+	regTaskPriority     = uintptr(0x80)
+	regEOI              = uintptr(0xb0)
+	regSpurious         = uintptr(0xf0)
+	regICRLow           = uintptr(0x300)
+	regICRHigh          = uintptr(0x310)
+	regLVTTimer         = uintptr(0x320)
+	regLVTPerfCounter   = uintptr(0x340)
+	regTimerInitCount   = uintptr(0x380)
+	regTimerCurCount    = uintptr(0x390)
+	regTimerDivideCfg   = uintptr(0x3e0)
+	regSize             = uintptr(0x400)
+	spuriousAPICEnable  = uint32(1 << 8)
+	icrDeliveryPending  = uint32(1 << 12)
+	icrLevelAssert      = uint32(1 << 14)
+	lvtMasked           = uint32(1 << 16)
+	lvtTimerPeriodic    = uint32(1 << 17)
+	lvtTimerTSCDeadline = uint32(2 << 17)
+	timerDivideBy16     = uint32(0x3)
+
+	// CPUID leaf 1 feature bits.
+	cpuidEDXAPIC        = uint32(1 << 9)
+	cpuidECXTSCDeadline = uint32(1 << 24)
+
+	// madtProcessorEnabled is set in the flags of MADT local APIC entries
+	// for processors that can be started by the OS.
+	madtProcessorEnabled = uint32(1 << 0)
+
+	// The legacy 8259 PIC data ports.
+	picMasterDataPort = uint16(0x21)
+	picSlaveDataPort  = uint16(0xa1)
+)
+
+// IPIDeliveryMode specifies how an inter-processor interrupt is delivered to
+// its destination.
+type IPIDeliveryMode uint32
+
+// The supported IPI delivery modes.
+const (
+	IPIFixed   IPIDeliveryMode = 0 << 8
+	IPINMI     IPIDeliveryMode = 4 << 8
+	IPIInit    IPIDeliveryMode = 5 << 8
+	IPIStartup IPIDeliveryMode = 6 << 8
+)
+
+// TimerMode describes the operating mode of the local APIC timer.
+type TimerMode uint8
+
+// The supported timer modes.
+const (
+	TimerModeStopped TimerMode = iota
+	TimerModePeriodic
+	TimerModeTSCDeadline
+)
+
+var (
+	errNoTSCDeadline = &kernel.Error{Module: "lapic", Message: "TSC-deadline timer mode is not supported by this CPU"}
+	errInvalidFreq   = &kernel.Error{Module: "lapic", Message: "requested timer frequency is out of range"}
+
+	// The following functions are used by tests to mock calls to the cpu,
+	// vmm, irq, pit and cmdline packages.
+	cpuidFn            = cpu.ID
+	readMSRFn          = cpu.ReadMSR
+	writeMSRFn         = cpu.WriteMSR
+	readTSCFn          = cpu.ReadTSC
+	portWriteByteFn    = cpu.PortWriteByte
+	mapRegionFn        = vmm.MapRegion
+	registerHandlerFn  = irq.RegisterHandler
+	registerSpuriousFn = irq.RegisterSpuriousVector
+	cmdlineGetFn       = cmdline.Get
+	pitCalibrateFn     = pit.Calibrate
+
+	// localAPIC points to the initialized local APIC driver.
+	localAPIC *LocalAPIC
+)
+
+// LocalAPIC implements a driver for the local APIC of the boot processor.
+type LocalAPIC struct {
+	physAddr uintptr
+	regBase  uintptr
+
+	// tscDeadline is set to true if the CPU supports the TSC-deadline
+	// timer mode.
+	tscDeadline bool
+
+	// timerTicksPerSec and tscTicksPerSec store the calibrated rates for
+	// the local APIC timer (using a divider of 16) and the TSC.
+	timerTicksPerSec uint64
+	tscTicksPerSec   uint64
+
+	timerMode TimerMode
+}
+
+// ActiveLocalAPIC returns the initialized local APIC driver or nil if no local
+// APIC is available.
+func ActiveLocalAPIC() *LocalAPIC {
+	return localAPIC
+}
+
+// ID returns the ID of the local APIC.
+func (lapic *LocalAPIC) ID() uint8 {
+	return uint8(lapic.read(regID) >> 24)
+}
+
+// EOI signals the end of interrupt processing to the local APIC.
+func (lapic *LocalAPIC) EOI() {
+	lapic.write(regEOI, 0)
+}
+
+// SendIPI sends an inter-processor interrupt with the specified vector and
+// delivery mode to the local APIC with ID dest. The method blocks until the
+// local APIC reports that the IPI has been delivered.
+func (lapic *LocalAPIC) SendIPI(dest uint8, vector gate.InterruptNumber, mode IPIDeliveryMode) {
+	lapic.write(regICRHigh, uint32(dest)<<24)
+	lapic.write(regICRLow, icrLevelAssert|uint32(mode)|uint32(vector))
+
+	for lapic.read(regICRLow)&icrDeliveryPending != 0 {
+	}
+}
+
+// InitAP enables the local APIC of the calling application processor. Each CPU
+// accesses its own local APIC through the same physical address so the
+// register mapping established by the boot processor is reused.
+func (lapic *LocalAPIC) InitAP() {
+	writeMSRFn(msrAPICBase, readMSRFn(msrAPICBase)|apicBaseEnable)
+	lapic.write(regTaskPriority, 0)
+	lapic.write(regSpurious, spuriousAPICEnable|uint32(SpuriousVector))
+	lapic.write(regLVTTimer, lvtMasked|uint32(TimerVector))
+}
+
+// ProcessorAPICIDs returns the local APIC IDs of the enabled processors listed
+// in the ACPI MADT table or nil if no MADT is available.
+func ProcessorAPICIDs() []uint8 {
+	madt := acpiLookupTableFn(madtSignature)
+	if madt == nil {
+		return nil
+	}
+
+	var ids []uint8
+	visitMADTEntries((*table.MADT)(unsafe.Pointer(madt)), func(entryType table.MADTEntryType, entryAddr uintptr) {
+		// Local APIC entry layout: ACPI processor ID (offset 2), APIC
+		// ID (offset 3) and flags (offset 4).
+		if entryType == table.MADTEntryTypeLocalAPIC && *(*uint32)(unsafe.Pointer(entryAddr + 4))&madtProcessorEnabled != 0 {
+			ids = append(ids, *(*uint8)(unsafe.Pointer(entryAddr + 3)))
+		}
+	})
+
+	return ids
+}
+
+// TimerFrequency returns the calibrated frequency of the local APIC timer.
+func (lapic *LocalAPIC) TimerFrequency() uint64 {
+	return lapic.timerTicksPerSec
+}
+
+// TimerCount returns the current count of the local APIC timer. In periodic
+// mode, the timer counts down from its initial count which is reloaded each
+// time the count reaches 0.
+func (lapic *LocalAPIC) TimerCount() uint32 {
+	return lapic.read(regTimerCurCount)
+}
+
+// TimerInitialCount returns the count that the local APIC timer counts down
+// from.
+func (lapic *LocalAPIC) TimerInitialCount() uint32 {
+	return lapic.read(regTimerInitCount)
+}
+
+// TSCFrequency returns the calibrated frequency of the time-stamp counter.
+func (lapic *LocalAPIC) TSCFrequency() uint64 {
+	return lapic.tscTicksPerSec
+}
+
+// TimerMode returns the current operating mode of the local APIC timer.
+func (lapic *LocalAPIC) TimerMode() TimerMode {
+	return lapic.timerMode
+}
+
+// SetTimerHandler registers handler to be invoked whenever the local APIC
+// timer fires.
+func (lapic *LocalAPIC) SetTimerHandler(handler irq.Handler) *kernel.Error {
+	return registerHandlerFn(TimerVector, handler)
+}
+
+// StartPeriodicTimer configures the local APIC timer to fire hz times per
+// second.
+func (lapic *LocalAPIC) StartPeriodicTimer(hz uint32) *kernel.Error {
+	if hz == 0 || uint64(hz) > lapic.timerTicksPerSec {
+		return errInvalidFreq
+	}
+
+	lapic.write(regTimerDivideCfg, timerDivideBy16)
+	lapic.write(regLVTTimer, lvtTimerPeriodic|uint32(TimerVector))
+	lapic.write(regTimerInitCount, uint32(lapic.timerTicksPerSec/uint64(hz)))
+	lapic.timerMode = TimerModePeriodic
+	return nil
+}
+
+// SetTimerDeadline configures the local APIC timer to fire once when the TSC
+// reaches the specified value. A deadline of 0 disarms the timer.
+func (lapic *LocalAPIC) SetTimerDeadline(tsc uint64) *kernel.Error {
+	if !lapic.tscDeadline {
+		return errNoTSCDeadline
+	}
+
+	if lapic.timerMode != TimerModeTSCDeadline {
+		lapic.write(regTimerInitCount, 0)
+		lapic.write(regLVTTimer, lvtTimerTSCDeadline|uint32(TimerVector))
+		lapic.timerMode = TimerModeTSCDeadline
+	}
+
+	writeMSRFn(msrTSCDeadline, tsc)
+	return nil
+}
+
+// StopTimer masks the local APIC timer.
+func (lapic *LocalAPIC) StopTimer() {
+	lapic.write(regTimerInitCount, 0)
+	lapic.write(regLVTTimer, lvtMasked|uint32(TimerVector))
+	if lapic.tscDeadline {
+		writeMSRFn(msrTSCDeadline, 0)
+	}
+	lapic.timerMode = TimerModeStopped
+}
+
+// SetPerfCounterVector unmasks the performance counter LVT entry and routes
+// performance counter overflow interrupts to the specified vector. As the
+// local APIC masks the entry each time such an interrupt is delivered, the
+// interrupt handler must invoke this method again to receive further
+// interrupts.
+func (lapic *LocalAPIC) SetPerfCounterVector(vector gate.InterruptNumber) {
+	lapic.write(regLVTPerfCounter, uint32(vector))
+}
+
+// DriverName returns the name of this driver.
+func (*LocalAPIC) DriverName() string {
+	return "local_apic"
+}
+
+// DriverVersion returns the version of this driver.
+func (*LocalAPIC) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit initializes this driver.
+func (lapic *LocalAPIC) DriverInit(w io.Writer) *kernel.Error {
+	page, err := mapRegionFn(
+		mm.FrameFromAddress(lapic.physAddr),
+		regSize,
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute|vmm.FlagDoNotCache,
+	)
+	if err != nil {
+		return err
+	}
+	lapic.regBase = page.Address() + vmm.PageOffset(lapic.physAddr)
+
+	// Enable the local APIC, accept all interrupt priorities and set up
+	// the spurious interrupt vector.
+	writeMSRFn(msrAPICBase, readMSRFn(msrAPICBase)|apicBaseEnable)
+	lapic.write(regTaskPriority, 0)
+	lapic.write(regSpurious, spuriousAPICEnable|uint32(SpuriousVector))
+	if err = registerSpuriousFn(SpuriousVector); err != nil {
+		return err
+	}
+
+	lapic.calibrate()
+	lapic.StopTimer()
+
+	kfmt.Fprintf(w, "id: %d, version: 0x%x, mapped to 0x%x\n", lapic.ID(), lapic.read(regVersion)&0xff, lapic.regBase)
+	kfmt.Fprintf(w, "timer: %d ticks/sec, TSC: %d ticks/sec, TSC-deadline: %t\n", lapic.timerTicksPerSec, lapic.tscTicksPerSec, lapic.tscDeadline)
+
+	// GSIs are routed by the I/O APIC or, if the system does not provide
+	// one, by the legacy PIC. The local APIC only acknowledges the
+	// interrupts that are not delivered via a GSI.
+	localAPIC = lapic
+	irq.SetLocalController(localAPICController{lapic})
+
+	return nil
+}
+
+// calibrate measures the frequency of the local APIC timer and the TSC using
+// the PIT as a reference clock.
+func (lapic *LocalAPIC) calibrate() {
+	lapic.write(regTimerDivideCfg, timerDivideBy16)
+	lapic.write(regLVTTimer, lvtMasked|uint32(TimerVector))
+	lapic.write(regTimerInitCount, 0xffffffff)
+
+	rates := pitCalibrateFn(
+		// The timer counts down from its initial count
+		func() uint64 { return uint64(0xffffffff - lapic.read(regTimerCurCount)) },
+		readTSCFn,
+	)
+	lapic.write(regTimerInitCount, 0)
+
+	lapic.timerTicksPerSec, lapic.tscTicksPerSec = rates[0], rates[1]
+}
+
+func (lapic *LocalAPIC) read(reg uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(lapic.regBase + reg))
+}
+
+func (lapic *LocalAPIC) write(reg uintptr, val uint32) {
+	*(*uint32)(unsafe.Pointer(lapic.regBase + reg)) = val
+}
+
+// localAPICController adapts the local APIC to the irq.LocalController
+// interface so that interrupts which are not associated with a GSI (e.g. the
+// local APIC timer, IPIs and MSIs) can be acknowledged.
+type localAPICController struct {
+	lapic *LocalAPIC
+}
+
+// EOI implements irq.LocalController.
+func (ctrl localAPICController) EOI(_ gate.InterruptNumber) {
+	ctrl.lapic.EOI()
+}
+
+func probeForLocalAPIC() device.Driver {
+	// The APICs can be disabled via the boot command line in favor of the
+	// legacy PIC.
+	if cmdlineGetFn("irqController") == "pic" {
+		return nil
+	}
+
+	_, _, ecx, edx := cpuidFn(1)
+	if edx&cpuidEDXAPIC == 0 {
+		return nil
+	}
+
+	return &LocalAPIC{
+		physAddr:    uintptr(readMSRFn(msrAPICBase) & apicBaseAddrMask),
+		tscDeadline: ecx&cpuidECXTSCDeadline != 0,
+	}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:  "local_apic",
+		Order: device.DetectOrderBeforeACPI,
+		Probe: probeForLocalAPIC,
+	})
+}
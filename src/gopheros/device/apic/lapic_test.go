@@ -0,0 +1,419 @@
+package apic
+
+import (
+	"gopheros/device/acpi/table"
+	"gopheros/device/pit"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"testing"
+	"unsafe"
+)
+
+// mockRegisterBufs keeps the buffers returned by mockRegisterSpace reachable
+// so that they do not get garbage-collected while in use.
+var mockRegisterBufs [][]byte
+
+// mockRegisterSpace returns a page-aligned buffer that can be used in place of
+// memory-mapped device registers.
+func mockRegisterSpace() uintptr {
+	buf := make([]byte, 2*mm.PageSize)
+	mockRegisterBufs = append(mockRegisterBufs, buf)
+	addr := uintptr(unsafe.Pointer(&buf[0]))
+	return (addr + mm.PageSize - 1) &^ (mm.PageSize - 1)
+}
+
+func restoreLAPICMocks() {
+	cpuidFn = cpu.ID
+	readMSRFn = cpu.ReadMSR
+	writeMSRFn = cpu.WriteMSR
+	readTSCFn = cpu.ReadTSC
+	portWriteByteFn = cpu.PortWriteByte
+	mapRegionFn = vmm.MapRegion
+	registerHandlerFn = irq.RegisterHandler
+	registerSpuriousFn = irq.RegisterSpuriousVector
+	cmdlineGetFn = cmdline.Get
+	pitCalibrateFn = pit.Calibrate
+	localAPIC = nil
+	irq.SetController(nil)
+	irq.SetLocalController(nil)
+}
+
+func TestProbeForLocalAPIC(t *testing.T) {
+	defer restoreLAPICMocks()
+
+	var cmdLine map[string]string
+	cmdlineGetFn = func(name string) string { return cmdLine[name] }
+
+	readMSRFn = func(msr uint32) uint64 {
+		if msr != msrAPICBase {
+			t.Fatalf("unexpected MSR read: 0x%x", msr)
+		}
+		return 0xfee00000 | apicBaseEnable | 0x100
+	}
+
+	specs := []struct {
+		ecx, edx       uint32
+		expDrv         bool
+		expTSCDeadline bool
+	}{
+		{0, 0, false, false},
+		{0, cpuidEDXAPIC, true, false},
+		{cpuidECXTSCDeadline, cpuidEDXAPIC, true, true},
+	}
+
+	cmdLine = map[string]string{"irqController": "pic"}
+	cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) {
+		return 0, 0, 0, cpuidEDXAPIC
+	}
+	if drv := probeForLocalAPIC(); drv != nil {
+		t.Fatal("expected probe to fail when the PIC is selected via the boot command line")
+	}
+	cmdLine = nil
+
+	for specIndex, spec := range specs {
+		cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) {
+			return 0, 0, spec.ecx, spec.edx
+		}
+
+		drv := probeForLocalAPIC()
+		if (drv != nil) != spec.expDrv {
+			t.Errorf("[spec %d] expected probe to return a driver: %t", specIndex, spec.expDrv)
+			continue
+		}
+
+		if drv == nil {
+			continue
+		}
+
+		lapic := drv.(*LocalAPIC)
+		if exp := uintptr(0xfee00000); lapic.physAddr != exp {
+			t.Errorf("[spec %d] expected physical address to be 0x%x; got 0x%x", specIndex, exp, lapic.physAddr)
+		}
+
+		if lapic.tscDeadline != spec.expTSCDeadline {
+			t.Errorf("[spec %d] expected tscDeadline to be %t; got %t", specIndex, spec.expTSCDeadline, lapic.tscDeadline)
+		}
+	}
+}
+
+func TestLocalAPICInit(t *testing.T) {
+	defer restoreLAPICMocks()
+
+	regBase := mockRegisterSpace()
+
+	t.Run("map error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return 0, expErr
+		}
+
+		lapic := &LocalAPIC{physAddr: 0xfee00000}
+		if err := lapic.DriverInit(nil); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("spurious vector error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "register failed"}
+		mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return mm.PageFromAddress(regBase), nil
+		}
+		readMSRFn = func(_ uint32) uint64 { return 0 }
+		writeMSRFn = func(_ uint32, _ uint64) {}
+		portWriteByteFn = func(_ uint16, _ uint8) {}
+		registerSpuriousFn = func(_ gate.InterruptNumber) *kernel.Error { return expErr }
+
+		lapic := &LocalAPIC{physAddr: 0xfee00000}
+		if err := lapic.DriverInit(nil); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var (
+			apicBaseMSR     uint64
+			tsc             uint64
+			portWrites      = make(map[uint16]uint8)
+			spuriousVectors []gate.InterruptNumber
+		)
+
+		registerSpuriousFn = func(vector gate.InterruptNumber) *kernel.Error {
+			spuriousVectors = append(spuriousVectors, vector)
+			return nil
+		}
+
+		mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return mm.PageFromAddress(regBase), nil
+		}
+		readMSRFn = func(_ uint32) uint64 { return apicBaseMSR }
+		writeMSRFn = func(msr uint32, val uint64) {
+			if msr == msrAPICBase {
+				apicBaseMSR = val
+			}
+		}
+		readTSCFn = func() uint64 {
+			tsc += 50000
+			return tsc
+		}
+		portWriteByteFn = func(port uint16, val uint8) { portWrites[port] = val }
+
+		// Simulate 1000 timer ticks elapsing during a 10ms calibration
+		// window.
+		curCount := (*uint32)(unsafe.Pointer(regBase + regTimerCurCount))
+		*curCount = 0xffffffff
+		pitCalibrateFn = func(counters ...func() uint64) []uint64 {
+			rates := make([]uint64, len(counters))
+			for i, counter := range counters {
+				rates[i] = counter()
+			}
+			*curCount -= 1000
+			for i, counter := range counters {
+				rates[i] = (counter() - rates[i]) * 100
+			}
+			return rates
+		}
+
+		lapic := &LocalAPIC{physAddr: 0xfee00000}
+		*(*uint32)(unsafe.Pointer(regBase + regID)) = 3 << 24
+
+		if err := lapic.DriverInit(&discardWriter{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if apicBaseMSR&apicBaseEnable == 0 {
+			t.Error("expected APIC to be enabled via the APIC base MSR")
+		}
+
+		if got := lapic.read(regSpurious); got != spuriousAPICEnable|uint32(SpuriousVector) {
+			t.Errorf("expected spurious register to be 0x%x; got 0x%x", spuriousAPICEnable|uint32(SpuriousVector), got)
+		}
+
+		if len(spuriousVectors) != 1 || spuriousVectors[0] != SpuriousVector {
+			t.Errorf("expected vector 0x%x to be registered as the spurious vector; got %v", SpuriousVector, spuriousVectors)
+		}
+
+		if len(portWrites) != 0 {
+			t.Error("expected the legacy PIC lines to be left untouched")
+		}
+
+		if exp := uint64(100000); lapic.TimerFrequency() != exp {
+			t.Errorf("expected timer frequency to be %d; got %d", exp, lapic.TimerFrequency())
+		}
+
+		if exp := uint64(5000000); lapic.TSCFrequency() != exp {
+			t.Errorf("expected TSC frequency to be %d; got %d", exp, lapic.TSCFrequency())
+		}
+
+		if got := lapic.ID(); got != 3 {
+			t.Errorf("expected APIC ID to be 3; got %d", got)
+		}
+
+		if ActiveLocalAPIC() != lapic {
+			t.Error("expected ActiveLocalAPIC to return the initialized driver")
+		}
+
+		if irq.ActiveController() != nil {
+			t.Fatal("expected local APIC not to be installed as the GSI controller")
+		}
+
+		*(*uint32)(unsafe.Pointer(regBase + regEOI)) = 0xbadf00d
+		localAPICController{lapic}.EOI(TimerVector)
+		if got := lapic.read(regEOI); got != 0 {
+			t.Errorf("expected EOI register to be cleared; got 0x%x", got)
+		}
+
+		if drvName := lapic.DriverName(); drvName != "local_apic" {
+			t.Errorf("unexpected driver name: %s", drvName)
+		}
+
+		if major, minor, patch := lapic.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+			t.Errorf("unexpected driver version: %d.%d.%d", major, minor, patch)
+		}
+	})
+}
+
+func TestLocalAPICTimer(t *testing.T) {
+	defer restoreLAPICMocks()
+
+	var deadline uint64
+	writeMSRFn = func(msr uint32, val uint64) {
+		if msr == msrTSCDeadline {
+			deadline = val
+		}
+	}
+
+	lapic := &LocalAPIC{
+		regBase:          mockRegisterSpace(),
+		timerTicksPerSec: 1000000,
+	}
+
+	t.Run("periodic", func(t *testing.T) {
+		for _, hz := range []uint32{0, 1000001} {
+			if err := lapic.StartPeriodicTimer(hz); err != errInvalidFreq {
+				t.Errorf("[hz %d] expected to get errInvalidFreq; got %v", hz, err)
+			}
+		}
+
+		if err := lapic.StartPeriodicTimer(100); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := lapic.TimerInitialCount(); got != 10000 {
+			t.Errorf("expected initial count to be 10000; got %d", got)
+		}
+
+		lapic.write(regTimerCurCount, 1234)
+		if got := lapic.TimerCount(); got != 1234 {
+			t.Errorf("expected current count to be 1234; got %d", got)
+		}
+
+		if exp, got := lvtTimerPeriodic|uint32(TimerVector), lapic.read(regLVTTimer); got != exp {
+			t.Errorf("expected LVT timer entry to be 0x%x; got 0x%x", exp, got)
+		}
+
+		if lapic.TimerMode() != TimerModePeriodic {
+			t.Errorf("expected timer mode to be periodic")
+		}
+	})
+
+	t.Run("TSC deadline", func(t *testing.T) {
+		if err := lapic.SetTimerDeadline(42); err != errNoTSCDeadline {
+			t.Fatalf("expected to get errNoTSCDeadline; got %v", err)
+		}
+
+		lapic.tscDeadline = true
+		if err := lapic.SetTimerDeadline(42); err != nil {
+			t.Fatal(err)
+		}
+
+		if deadline != 42 {
+			t.Errorf("expected TSC deadline MSR to be 42; got %d", deadline)
+		}
+
+		if exp, got := lvtTimerTSCDeadline|uint32(TimerVector), lapic.read(regLVTTimer); got != exp {
+			t.Errorf("expected LVT timer entry to be 0x%x; got 0x%x", exp, got)
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		lapic.StopTimer()
+
+		if lapic.read(regLVTTimer)&lvtMasked == 0 {
+			t.Error("expected LVT timer entry to be masked")
+		}
+
+		if deadline != 0 {
+			t.Errorf("expected TSC deadline MSR to be cleared; got %d", deadline)
+		}
+
+		if lapic.TimerMode() != TimerModeStopped {
+			t.Errorf("expected timer mode to be stopped")
+		}
+	})
+
+	t.Run("handler", func(t *testing.T) {
+		var regVector gate.InterruptNumber
+		registerHandlerFn = func(vector gate.InterruptNumber, _ irq.Handler) *kernel.Error {
+			regVector = vector
+			return nil
+		}
+
+		if err := lapic.SetTimerHandler(func(_ *gate.Registers) bool { return true }); err != nil {
+			t.Fatal(err)
+		}
+
+		if regVector != TimerVector {
+			t.Errorf("expected handler to be registered for vector %d; got %d", TimerVector, regVector)
+		}
+	})
+}
+
+func TestSendIPI(t *testing.T) {
+	lapic := &LocalAPIC{regBase: mockRegisterSpace()}
+
+	lapic.SendIPI(2, 0x42, IPIFixed)
+
+	if got := lapic.read(regICRHigh); got != 2<<24 {
+		t.Errorf("expected ICR high to be 0x%x; got 0x%x", 2<<24, got)
+	}
+
+	if exp, got := icrLevelAssert|uint32(IPIFixed)|0x42, lapic.read(regICRLow); got != exp {
+		t.Errorf("expected ICR low to be 0x%x; got 0x%x", exp, got)
+	}
+}
+
+func TestPerfCounterVector(t *testing.T) {
+	lapic := &LocalAPIC{regBase: mockRegisterSpace()}
+
+	lapic.SetPerfCounterVector(0x42)
+	if exp, got := uint32(0x42), lapic.read(regLVTPerfCounter); got != exp {
+		t.Errorf("expected performance counter LVT entry to be 0x%x; got 0x%x", exp, got)
+	}
+}
+
+func TestInitAP(t *testing.T) {
+	defer restoreLAPICMocks()
+
+	var apicBase uint64
+	readMSRFn = func(_ uint32) uint64 { return 0xfee00000 }
+	writeMSRFn = func(_ uint32, val uint64) { apicBase = val }
+
+	lapic := &LocalAPIC{regBase: mockRegisterSpace()}
+	lapic.write(regTaskPriority, 0xff)
+	lapic.InitAP()
+
+	if exp := uint64(0xfee00000) | apicBaseEnable; apicBase != exp {
+		t.Errorf("expected APIC base MSR to be 0x%x; got 0x%x", exp, apicBase)
+	}
+
+	if got := lapic.read(regTaskPriority); got != 0 {
+		t.Errorf("expected task priority to be cleared; got 0x%x", got)
+	}
+
+	if exp, got := spuriousAPICEnable|uint32(SpuriousVector), lapic.read(regSpurious); got != exp {
+		t.Errorf("expected spurious vector register to be 0x%x; got 0x%x", exp, got)
+	}
+
+	if got := lapic.read(regLVTTimer); got&lvtMasked == 0 {
+		t.Error("expected timer LVT entry to be masked")
+	}
+}
+
+func TestProcessorAPICIDs(t *testing.T) {
+	defer restoreIOAPICMocks()
+
+	acpiLookupTableFn = func(_ string) *table.SDTHeader { return nil }
+	if ids := ProcessorAPICIDs(); ids != nil {
+		t.Fatalf("expected to get nil when no MADT is available; got %v", ids)
+	}
+
+	// Build a MADT with three local APIC entries (the last one disabled)
+	// and an I/O APIC entry.
+	madtLen := unsafe.Sizeof(table.MADT{})
+	buf := make([]byte, madtLen, madtLen+36)
+	buf = append(buf,
+		0, 8, 0, 0, 1, 0, 0, 0,
+		0, 8, 1, 4, 1, 0, 0, 0,
+		0, 8, 2, 6, 0, 0, 0, 0,
+		1, 12, 1, 0, 0, 0, 0xc0, 0xfe, 0, 0, 0, 0,
+	)
+	mockRegisterBufs = append(mockRegisterBufs, buf)
+	madt := (*table.SDTHeader)(unsafe.Pointer(&buf[0]))
+	madt.Length = uint32(len(buf))
+
+	acpiLookupTableFn = func(_ string) *table.SDTHeader { return madt }
+
+	ids := ProcessorAPICIDs()
+	if len(ids) != 2 || ids[0] != 0 || ids[1] != 4 {
+		t.Fatalf("expected enabled processor APIC IDs to be [0 4]; got %v", ids)
+	}
+}
+
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
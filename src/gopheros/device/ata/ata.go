@@ -0,0 +1,241 @@
+// Package ata implements a driver for parallel ATA (IDE) disks attached to the
+// legacy primary and secondary channels.
+//
+// The driver transfers data via programmed I/O and is intended as a fallback
+// for old hardware and minimal virtual machine configurations that do not
+// provide an AHCI controller. Interrupts are disabled for both channels and
+// the completion of each command is polled.
+package ata
+
+import (
+	"gopheros/device"
+	"gopheros/device/blockdev"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/sync"
+	"io"
+)
+
+const (
+	// Offsets of the command block registers from the channel base port.
+	regData     = uint16(0)
+	regError    = uint16(1)
+	regSecCount = uint16(2)
+	regLBALo    = uint16(3)
+	regLBAMid   = uint16(4)
+	regLBAHi    = uint16(5)
+	regDrive    = uint16(6)
+	regStatus   = uint16(7)
+	regCommand  = uint16(7)
+
+	statusERR  = uint8(1 << 0)
+	statusDRQ  = uint8(1 << 3)
+	statusDF   = uint8(1 << 5)
+	statusDRDY = uint8(1 << 6)
+	statusBSY  = uint8(1 << 7)
+
+	// floatingBus is read from the status register of a channel without
+	// any attached drives.
+	floatingBus = uint8(0xff)
+
+	// Bits of the device control register which shares its port with the
+	// alternate status register.
+	ctrlNIEN = uint8(1 << 1)
+	ctrlSRST = uint8(1 << 2)
+
+	// Bits of the drive/head register. Bits 5 and 7 are obsolete but must
+	// be set by older drives.
+	driveObsolete = uint8(0xa0)
+	driveLBA      = uint8(1 << 6)
+	driveSlave    = uint8(1 << 4)
+
+	// ATA commands.
+	ataCmdIdentify      = uint8(0xec)
+	ataCmdReadPIO       = uint8(0x20)
+	ataCmdReadPIOExt    = uint8(0x24)
+	ataCmdWritePIO      = uint8(0x30)
+	ataCmdWritePIOExt   = uint8(0x34)
+	ataCmdFlushCache    = uint8(0xe7)
+	ataCmdFlushCacheExt = uint8(0xea)
+
+	sectorSize  = uint32(512)
+	sectorWords = sectorSize / 2
+
+	// maxSectorsPerCmd is the number of sectors that can be transferred
+	// by a single LBA28 command.
+	maxSectorsPerCmd = uint32(256)
+
+	// maxSpins bounds the number of polls while waiting for a drive to
+	// update its status register.
+	maxSpins = 1000000
+)
+
+var (
+	errNoDisks      = &kernel.Error{Module: "ata", Message: "no ATA disks found"}
+	errBusy         = &kernel.Error{Module: "ata", Message: "timed out waiting for the drive to become ready"}
+	errCmdTimeout   = &kernel.Error{Module: "ata", Message: "timed out waiting for command completion"}
+	errDevice       = &kernel.Error{Module: "ata", Message: "drive reported a command error"}
+	errNotSupported = &kernel.Error{Module: "ata", Message: "drive does not support the LBA addressing mode"}
+
+	// channels lists the I/O ports of the legacy ATA channels as pairs of
+	// command block and control block base ports.
+	channels = [][2]uint16{
+		{0x1f0, 0x3f6},
+		{0x170, 0x376},
+	}
+
+	// The following functions are used by tests to mock calls to the cpu
+	// and blockdev packages.
+	portReadByteFn  = cpu.PortReadByte
+	portWriteByteFn = cpu.PortWriteByte
+	portReadWordFn  = cpu.PortReadWord
+	portWriteWordFn = cpu.PortWriteWord
+	registerBlockFn = blockdev.Register
+)
+
+// channel describes an ATA channel which can host a master and a slave drive.
+type channel struct {
+	index      int
+	base, ctrl uint16
+
+	// lock serializes the commands issued to the drives of the channel
+	// as they share the same set of registers.
+	lock sync.Spinlock
+}
+
+// Driver implements a driver for the disks attached to the legacy ATA
+// channels. Each detected disk is registered as a block device.
+type Driver struct {
+	channels []*channel
+	disks    []*disk
+}
+
+// DriverName returns the name of this driver.
+func (*Driver) DriverName() string {
+	return "ata"
+}
+
+// DriverVersion returns the version of this driver.
+func (*Driver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit resets each channel and identifies the drives attached to it. An
+// error is returned only if no disk could be initialized.
+func (drv *Driver) DriverInit(w io.Writer) *kernel.Error {
+	lastErr := errNoDisks
+	for _, ch := range drv.channels {
+		ch.reset()
+
+		for _, slave := range []bool{false, true} {
+			d, err := ch.identify(slave)
+			switch {
+			case err != nil:
+				kfmt.Fprintf(w, "channel %d, %s: %s\n", ch.index, driveName(slave), err.Message)
+				lastErr = err
+				continue
+			case d == nil:
+				continue
+			}
+
+			d.dev = registerBlockFn("hd", d)
+			drv.disks = append(drv.disks, d)
+			kfmt.Fprintf(w, "%s: channel %d, %s, %s, %d MiB\n", d.dev.Name(), ch.index, driveName(slave), d.model, (d.sectorCount*uint64(sectorSize))>>20)
+		}
+	}
+
+	if len(drv.disks) == 0 {
+		return lastErr
+	}
+
+	return nil
+}
+
+// reset performs a software reset of both drives on the channel and disables
+// interrupts for the channel.
+func (ch *channel) reset() {
+	portWriteByteFn(ch.ctrl, ctrlNIEN|ctrlSRST)
+	ch.delay()
+	portWriteByteFn(ch.ctrl, ctrlNIEN)
+	ch.waitNotBusy()
+}
+
+// selectDrive selects the master or slave drive and waits for the drive to
+// update its status register.
+func (ch *channel) selectDrive(slave bool, lbaBits uint8) {
+	val := driveObsolete | driveLBA | lbaBits
+	if slave {
+		val |= driveSlave
+	}
+	portWriteByteFn(ch.base+regDrive, val)
+	ch.delay()
+}
+
+// delay waits for at least 400ns by reading the alternate status register
+// which does not acknowledge pending interrupts.
+func (ch *channel) delay() {
+	for i := 0; i < 4; i++ {
+		portReadByteFn(ch.ctrl)
+	}
+}
+
+// waitNotBusy polls the status register until the BSY bit is cleared and
+// returns the last read status and true or false if the drive remains busy.
+func (ch *channel) waitNotBusy() (uint8, bool) {
+	for spins := 0; spins < maxSpins; spins++ {
+		if status := portReadByteFn(ch.base + regStatus); status&statusBSY == 0 {
+			return status, true
+		}
+	}
+
+	return 0, false
+}
+
+// waitData waits until the drive is ready to transfer a block of data via the
+// data register.
+func (ch *channel) waitData() *kernel.Error {
+	for spins := 0; spins < maxSpins; spins++ {
+		status := portReadByteFn(ch.base + regStatus)
+		switch {
+		case status&statusBSY != 0:
+			continue
+		case status&(statusERR|statusDF) != 0:
+			return errDevice
+		case status&statusDRQ != 0:
+			return nil
+		}
+	}
+
+	return errCmdTimeout
+}
+
+func driveName(slave bool) string {
+	if slave {
+		return "slave"
+	}
+	return "master"
+}
+
+func probeForATA() device.Driver {
+	var chans []*channel
+	for index, ports := range channels {
+		if portReadByteFn(ports[0]+regStatus) != floatingBus {
+			chans = append(chans, &channel{index: index, base: ports[0], ctrl: ports[1]})
+		}
+	}
+
+	if len(chans) == 0 {
+		return nil
+	}
+
+	return &Driver{channels: chans}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:  "ata",
+		Order: device.DetectOrderLast,
+		Probe: probeForATA,
+	})
+}
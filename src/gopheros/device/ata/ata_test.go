@@ -0,0 +1,381 @@
+package ata
+
+import (
+	"bytes"
+	"gopheros/device/blockdev"
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func restoreMocks() {
+	portReadByteFn = cpu.PortReadByte
+	portWriteByteFn = cpu.PortWriteByte
+	portReadWordFn = cpu.PortReadWord
+	portWriteWordFn = cpu.PortWriteWord
+	registerBlockFn = blockdev.Register
+}
+
+// mockDrive emulates a drive attached to an ATA channel.
+type mockDrive struct {
+	id     [256]uint16
+	data   []byte
+	atapi  bool
+	failOn uint8
+}
+
+func newMockDrive(model string, sectorCount uint32, lba48 bool) *mockDrive {
+	d := &mockDrive{data: make([]byte, sectorCount*sectorSize)}
+
+	padded := []byte(model + "                                        ")[:40]
+	for i := 0; i < 20; i++ {
+		d.id[27+i] = uint16(padded[2*i])<<8 | uint16(padded[2*i+1])
+	}
+
+	d.id[49] = 1 << 9
+	d.id[60], d.id[61] = uint16(sectorCount), uint16(sectorCount>>16)
+	if lba48 {
+		d.id[83] = 1 << 10
+		d.id[100], d.id[101] = uint16(sectorCount), uint16(sectorCount>>16)
+	}
+
+	return d
+}
+
+// mockChannel emulates the registers of an ATA channel. Writes to the LBA and
+// sector count registers shift the previous value into a second register to
+// emulate the FIFO behavior of LBA48 drives.
+type mockChannel struct {
+	base, ctrl uint16
+	drives     [2]*mockDrive
+	selected   int
+	ctrlReg    uint8
+
+	regs, hob [8]uint8
+	status    uint8
+
+	// pio holds the data block that is transferred via the data port.
+	pio      []byte
+	pioPos   int
+	pioWrite bool
+	pioLBA   uint64
+
+	commands []uint8
+	stuck    bool
+}
+
+func newMockChannel(base, ctrl uint16) *mockChannel {
+	return &mockChannel{base: base, ctrl: ctrl}
+}
+
+// install redirects the port accesses for the channel ports to the mock
+// channels. Accesses to the ports of channels without a mock return a
+// floating bus value.
+func install(chans ...*mockChannel) {
+	find := func(port uint16) (*mockChannel, uint16, bool) {
+		for _, ch := range chans {
+			switch {
+			case port == ch.ctrl:
+				return ch, 0, true
+			case port >= ch.base && port <= ch.base+regCommand:
+				return ch, port - ch.base, false
+			}
+		}
+		return nil, 0, false
+	}
+
+	portReadByteFn = func(port uint16) uint8 {
+		ch, reg, isCtrl := find(port)
+		switch {
+		case ch == nil:
+			return floatingBus
+		case isCtrl || reg == regStatus:
+			return ch.readStatus()
+		}
+		return ch.regs[reg]
+	}
+	portWriteByteFn = func(port uint16, val uint8) {
+		ch, reg, isCtrl := find(port)
+		switch {
+		case ch == nil:
+		case isCtrl:
+			ch.ctrlReg = val
+		case reg == regDrive:
+			ch.regs[reg] = val
+			ch.selected = int(val&driveSlave) >> 4
+		case reg == regCommand:
+			ch.exec(val)
+		default:
+			ch.hob[reg], ch.regs[reg] = ch.regs[reg], val
+		}
+	}
+	portReadWordFn = func(port uint16) uint16 {
+		ch, _, _ := find(port)
+		val := uint16(ch.pio[ch.pioPos]) | uint16(ch.pio[ch.pioPos+1])<<8
+		ch.advance(2)
+		return val
+	}
+	portWriteWordFn = func(port uint16, val uint16) {
+		ch, _, _ := find(port)
+		ch.pio[ch.pioPos], ch.pio[ch.pioPos+1] = byte(val), byte(val>>8)
+		ch.advance(2)
+	}
+}
+
+func (ch *mockChannel) drive() *mockDrive {
+	return ch.drives[ch.selected]
+}
+
+func (ch *mockChannel) readStatus() uint8 {
+	switch {
+	case ch.drive() == nil:
+		return 0
+	case ch.stuck:
+		return statusBSY
+	}
+	return ch.status
+}
+
+func (ch *mockChannel) exec(cmd uint8) {
+	d := ch.drive()
+	if d == nil {
+		return
+	}
+	ch.commands = append(ch.commands, cmd)
+
+	if cmd == d.failOn {
+		ch.status = statusDRDY | statusERR
+		return
+	}
+
+	var (
+		lba28   = uint64(ch.regs[regLBALo]) | uint64(ch.regs[regLBAMid])<<8 | uint64(ch.regs[regLBAHi])<<16 | uint64(ch.regs[regDrive]&0xf)<<24
+		count28 = uint32(ch.regs[regSecCount])
+		lba48   = uint64(ch.regs[regLBALo]) | uint64(ch.regs[regLBAMid])<<8 | uint64(ch.regs[regLBAHi])<<16 |
+			uint64(ch.hob[regLBALo])<<24 | uint64(ch.hob[regLBAMid])<<32 | uint64(ch.hob[regLBAHi])<<40
+		count48 = uint32(ch.hob[regSecCount])<<8 | uint32(ch.regs[regSecCount])
+	)
+	if count28 == 0 {
+		count28 = 256
+	}
+	if count48 == 0 {
+		count48 = 65536
+	}
+
+	ch.status = statusDRDY
+	switch cmd {
+	case ataCmdIdentify:
+		if d.atapi {
+			ch.regs[regLBAMid], ch.regs[regLBAHi] = 0x14, 0xeb
+			ch.status |= statusERR
+			return
+		}
+		ch.pio = make([]byte, sectorSize)
+		for i, word := range d.id {
+			ch.pio[2*i], ch.pio[2*i+1] = byte(word), byte(word>>8)
+		}
+		ch.startPIO(false, 0)
+	case ataCmdReadPIO:
+		ch.pio = d.data[lba28*uint64(sectorSize) : (lba28+uint64(count28))*uint64(sectorSize)]
+		ch.startPIO(false, lba28)
+	case ataCmdReadPIOExt:
+		ch.pio = d.data[lba48*uint64(sectorSize) : (lba48+uint64(count48))*uint64(sectorSize)]
+		ch.startPIO(false, lba48)
+	case ataCmdWritePIO:
+		ch.pio = make([]byte, count28*sectorSize)
+		ch.startPIO(true, lba28)
+	case ataCmdWritePIOExt:
+		ch.pio = make([]byte, count48*sectorSize)
+		ch.startPIO(true, lba48)
+	}
+}
+
+func (ch *mockChannel) startPIO(write bool, lba uint64) {
+	ch.pioPos, ch.pioWrite, ch.pioLBA = 0, write, lba
+	ch.status |= statusDRQ
+}
+
+func (ch *mockChannel) advance(n int) {
+	ch.pioPos += n
+	if ch.pioPos < len(ch.pio) {
+		return
+	}
+
+	if ch.pioWrite {
+		copy(ch.drive().data[ch.pioLBA*uint64(sectorSize):], ch.pio)
+	}
+	ch.status &^= statusDRQ
+}
+
+func TestProbe(t *testing.T) {
+	defer restoreMocks()
+
+	install()
+	if probeForATA() != nil {
+		t.Fatal("expected probe to return nil when both channels are floating")
+	}
+
+	install(newMockChannel(0x170, 0x376))
+	drv, ok := probeForATA().(*Driver)
+	if !ok || len(drv.channels) != 1 || drv.channels[0].index != 1 || drv.channels[0].base != 0x170 {
+		t.Fatal("expected probe to return a driver for the secondary channel")
+	}
+
+	if drv.DriverName() != "ata" {
+		t.Fatalf("unexpected driver name %q", drv.DriverName())
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Fatalf("unexpected driver version %d.%d.%d", major, minor, patch)
+	}
+}
+
+func TestDriverInit(t *testing.T) {
+	defer restoreMocks()
+
+	primary := newMockChannel(0x1f0, 0x3f6)
+	primary.drives[0] = newMockDrive("QEMU HARDDISK", 16384, true)
+	primary.drives[1] = &mockDrive{atapi: true}
+	secondary := newMockChannel(0x170, 0x376)
+	secondary.drives[1] = newMockDrive("OLD DISK", 2048, false)
+	secondary.drives[1].id[49] = 0
+	install(primary, secondary)
+
+	var registered []string
+	registerBlockFn = func(prefix string, drv blockdev.Driver) *blockdev.Device {
+		dev := blockdev.Register(prefix, drv)
+		registered = append(registered, dev.Name())
+		return dev
+	}
+
+	drv := probeForATA().(*Driver)
+	var buf bytes.Buffer
+	if err := drv.DriverInit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if primary.ctrlReg != ctrlNIEN || secondary.ctrlReg != ctrlNIEN {
+		t.Fatal("expected interrupts to be disabled for both channels")
+	}
+
+	if len(drv.disks) != 1 || len(registered) != 1 || registered[0] != "hda" {
+		t.Fatalf("expected one disk to be registered as hda; got %v", registered)
+	}
+
+	if d := drv.disks[0]; !d.lba48 || d.slave || d.SectorCount() != 16384 || d.SectorSize() != 512 {
+		t.Fatalf("unexpected disk geometry: lba48 %t, %d sectors", d.lba48, d.SectorCount())
+	}
+
+	exp := "hda: channel 0, master, QEMU HARDDISK, 8 MiB\nchannel 1, slave: drive does not support the LBA addressing mode\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected driver output:\n%q\ngot:\n%q", exp, got)
+	}
+
+	// Channels without any usable disks
+	secondary.drives[1] = nil
+	drv = &Driver{channels: drv.channels[1:]}
+	if err := drv.DriverInit(&buf); err != errNoDisks {
+		t.Fatalf("expected error %v; got %v", errNoDisks, err)
+	}
+}
+
+func TestIdentifyErrors(t *testing.T) {
+	defer restoreMocks()
+
+	ch := newMockChannel(0x1f0, 0x3f6)
+	ch.drives[0] = newMockDrive("DISK", 64, false)
+	install(ch)
+	c := &channel{base: 0x1f0, ctrl: 0x3f6}
+
+	ch.drives[0].failOn = ataCmdIdentify
+	if _, err := c.identify(false); err != errDevice {
+		t.Fatalf("expected error %v; got %v", errDevice, err)
+	}
+
+	ch.stuck = true
+	if _, err := c.identify(false); err != errBusy {
+		t.Fatalf("expected error %v; got %v", errBusy, err)
+	}
+
+	ch.stuck = false
+	ch.drives[0] = newMockDrive("DISK", 64, false)
+	ch.drives[0].id[106] = 0x4000 | 1<<12
+	ch.drives[0].id[117] = 2048
+	if _, err := c.identify(false); err != errNotSupported {
+		t.Fatalf("expected error %v; got %v", errNotSupported, err)
+	}
+}
+
+func TestReadWriteSectors(t *testing.T) {
+	defer restoreMocks()
+
+	for _, lba48 := range []bool{false, true} {
+		ch := newMockChannel(0x1f0, 0x3f6)
+		drive := newMockDrive("DISK", 1024, lba48)
+		ch.drives[1] = drive
+		install(ch)
+
+		for i := range drive.data {
+			drive.data[i] = byte(i / int(sectorSize))
+		}
+
+		d, err := (&channel{base: 0x1f0, ctrl: 0x3f6}).identify(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Requests larger than maxSectorsPerCmd are split
+		buf := make([]byte, 300*sectorSize)
+		if err = d.ReadSectors(600, 300, buf); err != nil {
+			t.Fatalf("[lba48: %t] unexpected error: %v", lba48, err)
+		}
+
+		for i := uint32(0); i < 300; i++ {
+			if exp := byte(600 + i); buf[i*sectorSize] != exp || buf[(i+1)*sectorSize-1] != exp {
+				t.Fatalf("[lba48: %t] expected sector %d to contain 0x%x", lba48, 600+i, exp)
+			}
+		}
+
+		expRead := ataCmdReadPIO
+		if lba48 {
+			expRead = ataCmdReadPIOExt
+		}
+		if exp := []uint8{ataCmdIdentify, expRead, expRead}; !bytes.Equal(ch.commands, exp) {
+			t.Fatalf("[lba48: %t] expected commands %v; got %v", lba48, exp, ch.commands)
+		}
+
+		ch.commands = nil
+		for i := range buf {
+			buf[i] = 0xaa
+		}
+		if err = d.WriteSectors(10, 2, buf); err != nil {
+			t.Fatalf("[lba48: %t] unexpected error: %v", lba48, err)
+		}
+
+		if drive.data[10*sectorSize] != 0xaa || drive.data[12*sectorSize-1] != 0xaa || drive.data[12*sectorSize] != 12 {
+			t.Fatalf("[lba48: %t] expected sectors 10-11 to be overwritten", lba48)
+		}
+
+		expWrite, expFlush := ataCmdWritePIO, ataCmdFlushCache
+		if lba48 {
+			expWrite, expFlush = ataCmdWritePIOExt, ataCmdFlushCacheExt
+		}
+		if exp := []uint8{expWrite, expFlush}; !bytes.Equal(ch.commands, exp) {
+			t.Fatalf("[lba48: %t] expected commands %v; got %v", lba48, exp, ch.commands)
+		}
+
+		drive.failOn = expFlush
+		if err = d.WriteSectors(10, 1, buf); err != errDevice {
+			t.Fatalf("[lba48: %t] expected error %v; got %v", lba48, errDevice, err)
+		}
+
+		drive.failOn = expRead
+		if err = d.ReadSectors(0, 1, buf); err != errDevice {
+			t.Fatalf("[lba48: %t] expected error %v; got %v", lba48, errDevice, err)
+		}
+
+		ch.stuck = true
+		if err = d.ReadSectors(0, 1, buf); err != errBusy {
+			t.Fatalf("[lba48: %t] expected error %v; got %v", lba48, errBusy, err)
+		}
+	}
+}
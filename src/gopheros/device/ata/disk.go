@@ -0,0 +1,223 @@
+package ata
+
+import (
+	"gopheros/device/blockdev"
+	"gopheros/kernel"
+)
+
+// disk describes a drive attached to an ATA channel.
+type disk struct {
+	ch    *channel
+	slave bool
+	dev   *blockdev.Device
+
+	model       string
+	lba48       bool
+	sectorCount uint64
+}
+
+// identify issues an IDENTIFY DEVICE command to the master or slave drive of
+// the channel and extracts the disk model and geometry from the returned data.
+// It returns nil if no ATA disk is attached to the channel at that position.
+func (ch *channel) identify(slave bool) (*disk, *kernel.Error) {
+	ch.lock.Acquire()
+	defer ch.lock.Release()
+
+	ch.selectDrive(slave, 0)
+	for reg := regSecCount; reg <= regLBAHi; reg++ {
+		portWriteByteFn(ch.base+reg, 0)
+	}
+	portWriteByteFn(ch.base+regCommand, ataCmdIdentify)
+
+	// A status of 0 indicates that no drive is present
+	if portReadByteFn(ch.base+regStatus) == 0 {
+		return nil, nil
+	}
+
+	if _, ok := ch.waitNotBusy(); !ok {
+		return nil, errBusy
+	}
+
+	// ATAPI and SATA drives abort the command and report their signature
+	// via the LBA mid/high registers.
+	if portReadByteFn(ch.base+regLBAMid) != 0 || portReadByteFn(ch.base+regLBAHi) != 0 {
+		return nil, nil
+	}
+
+	if err := ch.waitData(); err != nil {
+		return nil, err
+	}
+
+	var id [sectorWords]uint16
+	for i := range id {
+		id[i] = portReadWordFn(ch.base + regData)
+	}
+
+	d := &disk{ch: ch, slave: slave}
+
+	// Words 27-46 contain the model as a space-padded string with the
+	// bytes of each word swapped.
+	var model [40]byte
+	for i := 0; i < 20; i++ {
+		model[2*i], model[2*i+1] = byte(id[27+i]>>8), byte(id[27+i])
+	}
+	end := len(model)
+	for end > 0 && (model[end-1] == ' ' || model[end-1] == 0) {
+		end--
+	}
+	d.model = string(model[:end])
+
+	switch {
+	case id[83]&(1<<10) != 0:
+		d.lba48 = true
+		d.sectorCount = uint64(id[100]) | uint64(id[101])<<16 | uint64(id[102])<<32 | uint64(id[103])<<48
+	case id[49]&(1<<9) != 0:
+		d.sectorCount = uint64(id[60]) | uint64(id[61])<<16
+	default:
+		return nil, errNotSupported
+	}
+
+	// Each PIO data block holds a single sector so drives that report a
+	// logical sector size other than 512 bytes are not supported.
+	if id[106]&0xc000 == 0x4000 && id[106]&(1<<12) != 0 && 2*(uint32(id[117])|uint32(id[118])<<16) != sectorSize {
+		return nil, errNotSupported
+	}
+
+	return d, nil
+}
+
+// SectorSize returns the size of a logical sector in bytes.
+func (d *disk) SectorSize() uint32 {
+	return sectorSize
+}
+
+// SectorCount returns the number of logical sectors.
+func (d *disk) SectorCount() uint64 {
+	return d.sectorCount
+}
+
+// ReadSectors reads count sectors starting at the specified LBA into buf.
+func (d *disk) ReadSectors(lba uint64, count uint32, buf []byte) *kernel.Error {
+	d.ch.lock.Acquire()
+	defer d.ch.lock.Release()
+
+	return d.transfer(lba, count, buf, false)
+}
+
+// WriteSectors writes count sectors from buf starting at the specified LBA and
+// flushes the drive's write cache.
+func (d *disk) WriteSectors(lba uint64, count uint32, buf []byte) *kernel.Error {
+	d.ch.lock.Acquire()
+	defer d.ch.lock.Release()
+
+	if err := d.transfer(lba, count, buf, true); err != nil {
+		return err
+	}
+
+	cmd := ataCmdFlushCache
+	if d.lba48 {
+		cmd = ataCmdFlushCacheExt
+	}
+	if err := d.issue(cmd, 0, 0); err != nil {
+		return err
+	}
+
+	return d.complete()
+}
+
+// transfer splits a read or write request into commands that transfer up to
+// maxSectorsPerCmd sectors each. The caller must hold the channel lock.
+func (d *disk) transfer(lba uint64, count uint32, buf []byte, write bool) *kernel.Error {
+	cmd := ataCmdReadPIO
+	switch {
+	case d.lba48 && write:
+		cmd = ataCmdWritePIOExt
+	case d.lba48:
+		cmd = ataCmdReadPIOExt
+	case write:
+		cmd = ataCmdWritePIO
+	}
+
+	for count > 0 {
+		n := count
+		if n > maxSectorsPerCmd {
+			n = maxSectorsPerCmd
+		}
+
+		if err := d.issue(cmd, lba, n); err != nil {
+			return err
+		}
+
+		for i := uint32(0); i < n; i++ {
+			if err := d.ch.waitData(); err != nil {
+				return err
+			}
+
+			for word := uint32(0); word < sectorWords; word++ {
+				if write {
+					portWriteWordFn(d.ch.base+regData, uint16(buf[2*word])|uint16(buf[2*word+1])<<8)
+				} else {
+					val := portReadWordFn(d.ch.base + regData)
+					buf[2*word], buf[2*word+1] = byte(val), byte(val>>8)
+				}
+			}
+			buf = buf[sectorSize:]
+		}
+
+		if err := d.complete(); err != nil {
+			return err
+		}
+
+		lba += uint64(n)
+		count -= n
+	}
+
+	return nil
+}
+
+// issue programs the task file registers for a command that transfers count
+// sectors starting at lba and writes the command register. For LBA28 drives,
+// bits 24-27 of the address are stored in the drive/head register.
+func (d *disk) issue(cmd uint8, lba uint64, count uint32) *kernel.Error {
+	var lbaBits uint8
+	if !d.lba48 {
+		lbaBits = uint8(lba>>24) & 0xf
+	}
+
+	d.ch.selectDrive(d.slave, lbaBits)
+	if status, ok := d.ch.waitNotBusy(); !ok || status&statusDRDY == 0 {
+		return errBusy
+	}
+
+	// The registers of LBA48 drives are FIFOs that receive the high order
+	// bytes first. A count of 0 encodes the maximum number of sectors.
+	base := d.ch.base
+	if d.lba48 {
+		portWriteByteFn(base+regSecCount, uint8(count>>8))
+		portWriteByteFn(base+regLBALo, uint8(lba>>24))
+		portWriteByteFn(base+regLBAMid, uint8(lba>>32))
+		portWriteByteFn(base+regLBAHi, uint8(lba>>40))
+	}
+	portWriteByteFn(base+regSecCount, uint8(count))
+	portWriteByteFn(base+regLBALo, uint8(lba))
+	portWriteByteFn(base+regLBAMid, uint8(lba>>8))
+	portWriteByteFn(base+regLBAHi, uint8(lba>>16))
+	portWriteByteFn(base+regCommand, cmd)
+	d.ch.delay()
+
+	return nil
+}
+
+// complete waits for the drive to finish processing the current command and
+// checks for errors.
+func (d *disk) complete() *kernel.Error {
+	status, ok := d.ch.waitNotBusy()
+	switch {
+	case !ok:
+		return errCmdTimeout
+	case status&(statusERR|statusDF) != 0:
+		return errDevice
+	}
+
+	return nil
+}
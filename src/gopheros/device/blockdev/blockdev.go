@@ -0,0 +1,324 @@
+// Package blockdev defines the interface between the drivers for storage
+// devices and the kernel subsystems that access them.
+//
+// Drivers register each detected disk via Register which assigns it a name
+// such as sda or vdb and exposes the partitions listed in its MBR or GPT
+// partition table as sub-devices (sda1, sda2, ...). Other subsystems locate
+// devices via Devices or Lookup and access them through the returned Device
+// which validates all requests before passing them to the driver.
+//
+// Requests can either be performed synchronously via ReadSectors and
+// WriteSectors or queued via Submit. Queued requests are dispatched to the
+// driver by the softirq daemon using a deadline scheduler which services reads
+// and writes in batches sorted by their location on the disk, merges requests
+// for adjacent sectors and prevents requests from being starved by a stream of
+// requests for other parts of the disk.
+package blockdev
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/softirq"
+	"gopheros/kernel/timer"
+)
+
+// Driver is implemented by the drivers for storage devices.
+type Driver interface {
+	// SectorSize returns the size of a logical sector in bytes.
+	SectorSize() uint32
+
+	// SectorCount returns the number of logical sectors.
+	SectorCount() uint64
+
+	// ReadSectors reads count sectors starting at the specified LBA into
+	// buf which is large enough to hold them.
+	ReadSectors(lba uint64, count uint32, buf []byte) *kernel.Error
+}
+
+// Writer is implemented by drivers for storage devices that can be written
+// to. Devices whose driver does not implement it are read-only.
+type Writer interface {
+	// WriteSectors writes count sectors from buf starting at the
+	// specified LBA.
+	WriteSectors(lba uint64, count uint32, buf []byte) *kernel.Error
+}
+
+// Request describes a read or write request that is queued via Submit.
+type Request struct {
+	// LBA is the first sector to access relative to the start of the
+	// device the request is submitted to.
+	LBA uint64
+
+	// Count is the number of sectors to access.
+	Count uint32
+
+	// Buf receives the sector contents for reads and supplies them for
+	// writes.
+	Buf []byte
+
+	// Write is set for requests that write Buf to the device.
+	Write bool
+
+	// Err is set to the result of the request before Done is invoked.
+	Err *kernel.Error
+
+	// Done, if not nil, is invoked by the softirq daemon once the request
+	// has been completed.
+	Done func(*Request)
+
+	// diskLBA is the first sector to access relative to the start of the
+	// disk.
+	diskLBA uint64
+	next    *Request
+
+	// deadline is the time by which the request should be dispatched.
+	deadline timer.Duration
+
+	// merged links the requests for adjacent sectors that are dispatched
+	// to the driver along with this request.
+	merged *Request
+}
+
+// Device is a disk or a disk partition registered with the kernel.
+type Device struct {
+	name   string
+	driver Driver
+
+	// The following fields are only set for partitions.
+	parent      *Device
+	start       uint64
+	sectorCount uint64
+
+	// partitions contains the partitions of a disk.
+	partitions []*Device
+
+	// The following fields are only used by disks. They are protected by
+	// disabling interrupts.
+	queues    [numDirs]queue
+	batchDir  direction
+	batchLeft int
+
+	// writesStarved counts the read batches that were dispatched while
+	// writes were pending.
+	writesStarved int
+	stats         QueueStats
+}
+
+var (
+	errOutOfRange  = &kernel.Error{Module: "blockdev", Message: "request exceeds the device capacity"}
+	errShortBuffer = &kernel.Error{Module: "blockdev", Message: "buffer is too small for the requested sectors"}
+	errReadOnly    = &kernel.Error{Module: "blockdev", Message: "device does not support writes"}
+
+	// devices contains the registered disks and partitions. It is only
+	// updated by drivers during hardware detection.
+	devices []*Device
+
+	// The following functions are used by tests to mock calls to the cpu
+	// and softirq packages.
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn  = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	registerSoftIRQFn   = softirq.Register
+	raiseSoftIRQFn      = softirq.Raise
+	nowFn               = timer.Now
+)
+
+// Init registers the softirq handler that dispatches queued requests.
+func Init() *kernel.Error {
+	return registerSoftIRQFn(softirq.Block, dispatch)
+}
+
+// Register adds a disk to the list of devices followed by the partitions
+// listed in its partition table. The disk is named by appending a letter
+// sequence (a, b, ..., z, aa, ab, ...) to the supplied prefix which identifies
+// the device type. Disks with a missing or malformed partition table are
+// registered without any partitions.
+func Register(prefix string, drv Driver) *Device {
+	index := 0
+	for _, dev := range devices {
+		if dev.parent == nil && len(dev.name) > len(prefix) && dev.name[:len(prefix)] == prefix {
+			index++
+		}
+	}
+
+	dev := &Device{name: prefix + diskSuffix(index), driver: drv}
+	devices = append(devices, dev)
+
+	_ = scanPartitions(dev)
+	return dev
+}
+
+// Devices returns the list of registered devices.
+func Devices() []*Device {
+	return devices
+}
+
+// Lookup returns the registered device with the specified name or nil if no
+// such device exists.
+func Lookup(name string) *Device {
+	for _, dev := range devices {
+		if dev.name == name {
+			return dev
+		}
+	}
+
+	return nil
+}
+
+// Name returns the device name.
+func (dev *Device) Name() string {
+	return dev.name
+}
+
+// Parent returns the disk that contains a partition or nil if the device is a
+// disk.
+func (dev *Device) Parent() *Device {
+	return dev.parent
+}
+
+// Partitions returns the partitions of a disk.
+func (dev *Device) Partitions() []*Device {
+	return dev.partitions
+}
+
+// StartLBA returns the first sector of a partition relative to the start of
+// its disk. It always returns 0 for disks.
+func (dev *Device) StartLBA() uint64 {
+	return dev.start
+}
+
+// SectorSize returns the size of a logical sector in bytes.
+func (dev *Device) SectorSize() uint32 {
+	return dev.driver.SectorSize()
+}
+
+// SectorCount returns the number of logical sectors.
+func (dev *Device) SectorCount() uint64 {
+	if dev.parent != nil {
+		return dev.sectorCount
+	}
+
+	return dev.driver.SectorCount()
+}
+
+// Size returns the device capacity in bytes.
+func (dev *Device) Size() uint64 {
+	return dev.SectorCount() * uint64(dev.driver.SectorSize())
+}
+
+// ReadSectors reads count sectors starting at the specified LBA into buf. The
+// request is passed directly to the driver, bypassing any queued requests.
+func (dev *Device) ReadSectors(lba uint64, count uint32, buf []byte) *kernel.Error {
+	if err := dev.validate(lba, count, buf); err != nil || count == 0 {
+		return err
+	}
+
+	return dev.driver.ReadSectors(dev.start+lba, count, buf)
+}
+
+// ReadOnly returns true if the device driver does not support writes.
+func (dev *Device) ReadOnly() bool {
+	_, ok := dev.driver.(Writer)
+	return !ok
+}
+
+// WriteSectors writes count sectors from buf starting at the specified LBA.
+// The request is passed directly to the driver, bypassing any queued requests.
+func (dev *Device) WriteSectors(lba uint64, count uint32, buf []byte) *kernel.Error {
+	w, ok := dev.driver.(Writer)
+	if !ok {
+		return errReadOnly
+	}
+
+	if err := dev.validate(lba, count, buf); err != nil || count == 0 {
+		return err
+	}
+
+	return w.WriteSectors(dev.start+lba, count, buf)
+}
+
+// Submit queues a read or write request for the device and returns without
+// waiting for it to complete. Requests that fail validation are not queued.
+func (dev *Device) Submit(req *Request) *kernel.Error {
+	if req.Write && dev.ReadOnly() {
+		return errReadOnly
+	}
+
+	if err := dev.validate(req.LBA, req.Count, req.Buf); err != nil {
+		return err
+	}
+
+	req.Err = nil
+	req.diskLBA = dev.start + req.LBA
+	dev.disk().enqueue(req)
+
+	raiseSoftIRQFn(softirq.Block)
+	return nil
+}
+
+// QueueStats returns the request queue statistics of the disk that contains
+// the device.
+func (dev *Device) QueueStats() QueueStats {
+	disk := dev.disk()
+
+	intr := lock()
+	stats := disk.stats
+	unlock(intr)
+
+	return stats
+}
+
+// disk returns the disk that contains the device.
+func (dev *Device) disk() *Device {
+	if dev.parent != nil {
+		return dev.parent
+	}
+
+	return dev
+}
+
+// validate checks that a request is within the device bounds and that the
+// supplied buffer can hold the requested sectors.
+func (dev *Device) validate(lba uint64, count uint32, buf []byte) *kernel.Error {
+	switch {
+	case count == 0:
+		return nil
+	case lba+uint64(count) > dev.SectorCount() || lba+uint64(count) < lba:
+		return errOutOfRange
+	case uint64(len(buf)) < uint64(count)*uint64(dev.driver.SectorSize()):
+		return errShortBuffer
+	}
+
+	return nil
+}
+
+// diskSuffix returns the letter sequence for the device with the specified
+// index.
+func diskSuffix(index int) string {
+	var (
+		buf [8]byte
+		pos = len(buf)
+	)
+
+	for {
+		pos--
+		buf[pos] = byte('a' + index%26)
+		if index = index/26 - 1; index < 0 {
+			break
+		}
+	}
+
+	return string(buf[pos:])
+}
+
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+	return intr
+}
+
+func unlock(intr bool) {
+	if intr {
+		enableInterruptsFn()
+	}
+}
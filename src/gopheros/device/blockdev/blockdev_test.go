@@ -0,0 +1,311 @@
+package blockdev
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/softirq"
+	"gopheros/kernel/timer"
+	"testing"
+)
+
+func restoreMocks() {
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	registerSoftIRQFn = softirq.Register
+	raiseSoftIRQFn = softirq.Raise
+	nowFn = timer.Now
+	devices = nil
+}
+
+func mockInterrupts() {
+	interruptsEnabledFn = func() bool { return false }
+	enableInterruptsFn = func() {}
+	disableInterruptsFn = func() {}
+}
+
+// mockDisk is a memory-backed disk that records the LBA of each read.
+type mockDisk struct {
+	sectorSize uint32
+	data       []byte
+	reads      []uint64
+	err        *kernel.Error
+}
+
+func newMockDisk(sectorSize uint32, sectorCount uint64) *mockDisk {
+	return &mockDisk{sectorSize: sectorSize, data: make([]byte, uint64(sectorSize)*sectorCount)}
+}
+
+func (d *mockDisk) SectorSize() uint32  { return d.sectorSize }
+func (d *mockDisk) SectorCount() uint64 { return uint64(len(d.data)) / uint64(d.sectorSize) }
+
+func (d *mockDisk) ReadSectors(lba uint64, count uint32, buf []byte) *kernel.Error {
+	d.reads = append(d.reads, lba)
+	if d.err != nil {
+		return d.err
+	}
+
+	offset := lba * uint64(d.sectorSize)
+	copy(buf, d.data[offset:offset+uint64(count)*uint64(d.sectorSize)])
+	return nil
+}
+
+// mockWritableDisk extends mockDisk with support for writes.
+type mockWritableDisk struct {
+	*mockDisk
+	writes []uint64
+}
+
+func (d *mockWritableDisk) WriteSectors(lba uint64, count uint32, buf []byte) *kernel.Error {
+	d.writes = append(d.writes, lba)
+	if d.err != nil {
+		return d.err
+	}
+
+	offset := lba * uint64(d.sectorSize)
+	copy(d.data[offset:offset+uint64(count)*uint64(d.sectorSize)], buf)
+	return nil
+}
+
+func (d *mockDisk) sector(lba uint64) []byte {
+	return d.data[lba*uint64(d.sectorSize) : (lba+1)*uint64(d.sectorSize)]
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	var gotVector softirq.Vector
+	registerSoftIRQFn = func(vector softirq.Vector, _ softirq.Handler) *kernel.Error {
+		gotVector = vector
+		return nil
+	}
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if gotVector != softirq.Block {
+		t.Fatalf("expected the Block softirq handler to be registered; got vector %d", gotVector)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	defer restoreMocks()
+
+	drv := newMockDisk(512, 8)
+	for i := 0; i < 28; i++ {
+		Register("sd", drv)
+	}
+	Register("vd", drv)
+
+	specs := []struct {
+		index int
+		exp   string
+	}{
+		{0, "sda"},
+		{1, "sdb"},
+		{25, "sdz"},
+		{26, "sdaa"},
+		{27, "sdab"},
+		{28, "vda"},
+	}
+
+	list := Devices()
+	for specIndex, spec := range specs {
+		if got := list[spec.index].Name(); got != spec.exp {
+			t.Errorf("[spec %d] expected device %d to be named %q; got %q", specIndex, spec.index, spec.exp, got)
+		}
+
+		if Lookup(spec.exp) != list[spec.index] {
+			t.Errorf("[spec %d] expected Lookup to return the device named %q", specIndex, spec.exp)
+		}
+	}
+
+	if Lookup("hda") != nil {
+		t.Error("expected Lookup to return nil for an unknown device")
+	}
+
+	if exp := "zz"; diskSuffix(701) != exp {
+		t.Errorf("expected suffix %q for index 701; got %q", exp, diskSuffix(701))
+	}
+}
+
+func TestReadSectors(t *testing.T) {
+	defer restoreMocks()
+
+	drv := newMockDisk(512, 8)
+	drv.sector(6)[0] = 6
+	dev := Register("sd", drv)
+	drv.reads = nil
+
+	if dev.SectorSize() != 512 || dev.SectorCount() != 8 || dev.Size() != 4096 {
+		t.Fatalf("unexpected device geometry: %d sectors of %d bytes", dev.SectorCount(), dev.SectorSize())
+	}
+
+	if dev.Parent() != nil || dev.StartLBA() != 0 || len(dev.Partitions()) != 0 {
+		t.Fatal("expected device to be a disk without partitions")
+	}
+
+	buf := make([]byte, 1024)
+	specs := []struct {
+		lba      uint64
+		count    uint32
+		buf      []byte
+		expErr   *kernel.Error
+		expReads int
+	}{
+		{6, 2, buf, nil, 1},
+		{0, 0, nil, nil, 1},
+		{7, 2, buf, errOutOfRange, 1},
+		{^uint64(0), 2, buf, errOutOfRange, 1},
+		{0, 3, buf, errShortBuffer, 1},
+	}
+
+	for specIndex, spec := range specs {
+		if err := dev.ReadSectors(spec.lba, spec.count, spec.buf); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+
+		if len(drv.reads) != spec.expReads {
+			t.Errorf("[spec %d] expected the driver to be invoked %d times; got %d", specIndex, spec.expReads, len(drv.reads))
+		}
+	}
+
+	if buf[0] != 6 {
+		t.Fatal("expected the sectors to be read into the buffer")
+	}
+}
+
+func TestWriteSectors(t *testing.T) {
+	defer restoreMocks()
+
+	roDev := Register("sd", newMockDisk(512, 8))
+	if !roDev.ReadOnly() {
+		t.Fatal("expected device without a Writer driver to be read-only")
+	}
+	if err := roDev.WriteSectors(0, 1, make([]byte, 512)); err != errReadOnly {
+		t.Fatalf("expected to get errReadOnly; got %v", err)
+	}
+
+	drv := &mockWritableDisk{mockDisk: newMockDisk(512, 8)}
+	dev := Register("sd", drv)
+	if dev.ReadOnly() {
+		t.Fatal("expected device with a Writer driver to be writable")
+	}
+
+	buf := make([]byte, 1024)
+	buf[512] = 0xaa
+	specs := []struct {
+		lba       uint64
+		count     uint32
+		buf       []byte
+		expErr    *kernel.Error
+		expWrites int
+	}{
+		{5, 2, buf, nil, 1},
+		{0, 0, nil, nil, 1},
+		{7, 2, buf, errOutOfRange, 1},
+		{0, 3, buf, errShortBuffer, 1},
+	}
+
+	for specIndex, spec := range specs {
+		if err := dev.WriteSectors(spec.lba, spec.count, spec.buf); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+
+		if len(drv.writes) != spec.expWrites {
+			t.Errorf("[spec %d] expected the driver to be invoked %d times; got %d", specIndex, spec.expWrites, len(drv.writes))
+		}
+	}
+
+	if drv.sector(6)[0] != 0xaa {
+		t.Fatal("expected the buffer contents to be written to the disk")
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var raised int
+	raiseSoftIRQFn = func(vector softirq.Vector) {
+		if vector == softirq.Block {
+			raised++
+		}
+	}
+
+	drvA, drvB := newMockDisk(512, 64), newMockDisk(512, 64)
+	diskA, diskB := Register("sd", drvA), Register("sd", drvB)
+	drvA.reads, drvB.reads = nil, nil
+
+	// Fake a partition on the second disk
+	addPartition(diskB, 1, 32, 32)
+	part := diskB.Partitions()[0]
+
+	var completed []*Request
+	done := func(req *Request) { completed = append(completed, req) }
+	newReq := func(lba uint64) *Request {
+		return &Request{LBA: lba, Count: 1, Buf: make([]byte, 512), Done: done}
+	}
+
+	if err := diskA.Submit(&Request{LBA: 64, Count: 1, Buf: make([]byte, 512)}); err != errOutOfRange {
+		t.Fatalf("expected error %v; got %v", errOutOfRange, err)
+	}
+
+	if err := part.Submit(&Request{LBA: 0, Count: 2, Buf: make([]byte, 512)}); err != errShortBuffer {
+		t.Fatalf("expected error %v; got %v", errShortBuffer, err)
+	}
+
+	// Requests are serviced in ascending LBA order starting from the
+	// sector that follows the last serviced request.
+	diskA.queues[dirRead].nextLBA = 20
+	for _, lba := range []uint64{30, 10, 20, 40} {
+		if err := diskA.Submit(newReq(lba)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := part.Submit(newReq(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := diskB.Submit(&Request{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if raised != 6 {
+		t.Fatalf("expected the Block softirq to be raised 6 times; got %d", raised)
+	}
+
+	dispatch()
+
+	expA := []uint64{20, 30, 40, 10}
+	if len(drvA.reads) != len(expA) {
+		t.Fatalf("expected %d reads from the first disk; got %v", len(expA), drvA.reads)
+	}
+	for i, lba := range expA {
+		if drvA.reads[i] != lba {
+			t.Errorf("expected read %d from the first disk to access LBA %d; got %d", i, lba, drvA.reads[i])
+		}
+	}
+
+	// The partition request is translated to a disk LBA while the empty
+	// request is completed without invoking the driver
+	if len(drvB.reads) != 1 || drvB.reads[0] != 37 {
+		t.Fatalf("expected a single read at LBA 37 from the second disk; got %v", drvB.reads)
+	}
+
+	if len(completed) != 5 {
+		t.Fatalf("expected 5 completion callbacks; got %d", len(completed))
+	}
+
+	// Request errors are reported to the completion callback
+	completed = nil
+	drvA.err = &kernel.Error{Module: "test", Message: "read failed"}
+	if err := diskA.Submit(newReq(1)); err != nil {
+		t.Fatal(err)
+	}
+	dispatch()
+
+	if len(completed) != 1 || completed[0].Err != drvA.err {
+		t.Fatalf("expected the request to complete with error %v", drvA.err)
+	}
+}
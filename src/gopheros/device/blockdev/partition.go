@@ -0,0 +1,255 @@
+package blockdev
+
+import (
+	"encoding/binary"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+)
+
+const (
+	// MBR layout.
+	mbrMinSectorSize  = 512
+	mbrTableOffset    = 446
+	mbrEntrySize      = 16
+	mbrEntryCount     = 4
+	mbrSignatureOff   = 510
+	mbrSignature      = uint16(0xaa55)
+	mbrTypeOffset     = 4
+	mbrStartOffset    = 8
+	mbrCountOffset    = 12
+	mbrTypeEmpty      = uint8(0x00)
+	mbrTypeExtCHS     = uint8(0x05)
+	mbrTypeExtLBA     = uint8(0x0f)
+	mbrTypeExtLinux   = uint8(0x85)
+	mbrTypeProtective = uint8(0xee)
+
+	// mbrFirstLogical is the partition number assigned to the first
+	// logical partition inside an extended partition.
+	mbrFirstLogical = 5
+
+	// mbrMaxLogical bounds the length of the extended boot record chain so
+	// that loops in malformed tables are detected.
+	mbrMaxLogical = 64
+
+	// GPT layout.
+	gptHeaderLBA       = 1
+	gptSignature       = "EFI PART"
+	gptMinHeaderSize   = 92
+	gptMinEntrySize    = 128
+	gptHeaderCRCOffset = 16
+	gptEntriesLBAOff   = 72
+	gptEntryCountOff   = 80
+	gptEntrySizeOff    = 84
+	gptEntriesCRCOff   = 88
+	gptEntryFirstLBA   = 32
+	gptEntryLastLBA    = 40
+	gptTypeGUIDSize    = 16
+
+	// gptMaxEntriesSize bounds the size of the partition entry array.
+	gptMaxEntriesSize = 128 * 1024
+)
+
+var (
+	errBadGPTHeader  = &kernel.Error{Module: "blockdev", Message: "invalid GPT header"}
+	errBadGPTEntries = &kernel.Error{Module: "blockdev", Message: "GPT partition entry checksum mismatch"}
+	errEBRLoop       = &kernel.Error{Module: "blockdev", Message: "too many logical partitions"}
+)
+
+// scanPartitions parses the partition table of a disk and registers each
+// partition as a sub-device. Disks using a GPT partition table are detected
+// via the protective MBR entry that covers the disk.
+func scanPartitions(dev *Device) *kernel.Error {
+	sectorSize := dev.SectorSize()
+	if sectorSize < mbrMinSectorSize || dev.SectorCount() < 2 {
+		return nil
+	}
+
+	mbr := make([]byte, sectorSize)
+	if err := dev.ReadSectors(0, 1, mbr); err != nil {
+		return err
+	}
+
+	if binary.LittleEndian.Uint16(mbr[mbrSignatureOff:]) != mbrSignature {
+		return nil
+	}
+
+	for i := 0; i < mbrEntryCount; i++ {
+		if mbr[mbrTableOffset+i*mbrEntrySize+mbrTypeOffset] == mbrTypeProtective {
+			return scanGPT(dev)
+		}
+	}
+
+	for i := 0; i < mbrEntryCount; i++ {
+		entry := mbr[mbrTableOffset+i*mbrEntrySize:]
+		start, count := mbrEntryExtent(entry, 0)
+
+		switch entry[mbrTypeOffset] {
+		case mbrTypeEmpty:
+		case mbrTypeExtCHS, mbrTypeExtLBA, mbrTypeExtLinux:
+			if err := scanEBR(dev, start, count); err != nil {
+				return err
+			}
+		default:
+			addPartition(dev, i+1, start, count)
+		}
+	}
+
+	return nil
+}
+
+// scanEBR follows the chain of extended boot records inside an extended
+// partition and registers the logical partitions that they describe. The
+// first entry of each record describes a logical partition relative to the
+// record while the second entry points to the next record relative to the
+// start of the extended partition.
+func scanEBR(dev *Device, extStart, extCount uint64) *kernel.Error {
+	ebr := make([]byte, dev.SectorSize())
+
+	for lba, num := extStart, mbrFirstLogical; lba != 0; num++ {
+		if num == mbrFirstLogical+mbrMaxLogical {
+			return errEBRLoop
+		}
+
+		if lba < extStart || lba >= extStart+extCount {
+			return nil
+		}
+
+		if err := dev.ReadSectors(lba, 1, ebr); err != nil {
+			return err
+		}
+
+		if binary.LittleEndian.Uint16(ebr[mbrSignatureOff:]) != mbrSignature {
+			return nil
+		}
+
+		entry := ebr[mbrTableOffset:]
+		if entry[mbrTypeOffset] != mbrTypeEmpty {
+			start, count := mbrEntryExtent(entry, lba)
+			addPartition(dev, num, start, count)
+		}
+
+		lba = 0
+		if next := ebr[mbrTableOffset+mbrEntrySize:]; next[mbrTypeOffset] != mbrTypeEmpty {
+			lba, _ = mbrEntryExtent(next, extStart)
+		}
+	}
+
+	return nil
+}
+
+// scanGPT parses a GPT partition table and registers the partitions it lists.
+// Both the header and the partition entry array are validated using their
+// CRC32 checksums.
+func scanGPT(dev *Device) *kernel.Error {
+	sectorSize := dev.SectorSize()
+
+	hdr := make([]byte, sectorSize)
+	if err := dev.ReadSectors(gptHeaderLBA, 1, hdr); err != nil {
+		return err
+	}
+
+	hdrSize := binary.LittleEndian.Uint32(hdr[12:])
+	if string(hdr[:len(gptSignature)]) != gptSignature || hdrSize < gptMinHeaderSize || hdrSize > sectorSize {
+		return errBadGPTHeader
+	}
+
+	// The header checksum is calculated with the checksum field set to 0
+	hdrCRC := binary.LittleEndian.Uint32(hdr[gptHeaderCRCOffset:])
+	binary.LittleEndian.PutUint32(hdr[gptHeaderCRCOffset:], 0)
+	if crc32(hdr[:hdrSize]) != hdrCRC {
+		return errBadGPTHeader
+	}
+
+	var (
+		entriesLBA = binary.LittleEndian.Uint64(hdr[gptEntriesLBAOff:])
+		entryCount = uint64(binary.LittleEndian.Uint32(hdr[gptEntryCountOff:]))
+		entrySize  = uint64(binary.LittleEndian.Uint32(hdr[gptEntrySizeOff:]))
+		tableSize  = entryCount * entrySize
+	)
+
+	if entrySize < gptMinEntrySize || entrySize%8 != 0 || tableSize > gptMaxEntriesSize {
+		return errBadGPTHeader
+	}
+
+	sectors := uint32((tableSize + uint64(sectorSize) - 1) / uint64(sectorSize))
+	table := make([]byte, uint64(sectors)*uint64(sectorSize))
+	if err := dev.ReadSectors(entriesLBA, sectors, table); err != nil {
+		return err
+	}
+
+	if crc32(table[:tableSize]) != binary.LittleEndian.Uint32(hdr[gptEntriesCRCOff:]) {
+		return errBadGPTEntries
+	}
+
+	for i := uint64(0); i < entryCount; i++ {
+		entry := table[i*entrySize : (i+1)*entrySize]
+		if isZero(entry[:gptTypeGUIDSize]) {
+			continue
+		}
+
+		first := binary.LittleEndian.Uint64(entry[gptEntryFirstLBA:])
+		last := binary.LittleEndian.Uint64(entry[gptEntryLastLBA:])
+		if last < first {
+			continue
+		}
+
+		addPartition(dev, int(i)+1, first, last-first+1)
+	}
+
+	return nil
+}
+
+// addPartition registers a partition of disk with the specified number unless
+// it lies outside the disk.
+func addPartition(disk *Device, num int, start, count uint64) {
+	if start == 0 || count == 0 || start+count > disk.SectorCount() || start+count < start {
+		return
+	}
+
+	// Separate the number from disk names ending in a digit (e.g. nvme0n1p1)
+	name := disk.name
+	if last := name[len(name)-1]; last >= '0' && last <= '9' {
+		name += "p"
+	}
+
+	part := &Device{
+		name:        name + kfmt.Itoa(num),
+		driver:      disk.driver,
+		parent:      disk,
+		start:       start,
+		sectorCount: count,
+	}
+
+	disk.partitions = append(disk.partitions, part)
+	devices = append(devices, part)
+}
+
+// mbrEntryExtent returns the first sector and the sector count for an MBR
+// partition entry whose start is relative to base.
+func mbrEntryExtent(entry []byte, base uint64) (uint64, uint64) {
+	return base + uint64(binary.LittleEndian.Uint32(entry[mbrStartOffset:])),
+		uint64(binary.LittleEndian.Uint32(entry[mbrCountOffset:]))
+}
+
+// crc32 calculates the IEEE CRC32 checksum of data.
+func crc32(data []byte) uint32 {
+	crc := ^uint32(0)
+	for _, b := range data {
+		crc ^= uint32(b)
+		for i := 0; i < 8; i++ {
+			crc = (crc >> 1) ^ (0xedb88320 & -(crc & 1))
+		}
+	}
+
+	return ^crc
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
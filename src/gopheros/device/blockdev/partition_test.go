@@ -0,0 +1,211 @@
+package blockdev
+
+import (
+	"encoding/binary"
+	"gopheros/kernel"
+	"testing"
+)
+
+func setMBREntry(sector []byte, index int, partType uint8, start, count uint32) {
+	entry := sector[mbrTableOffset+index*mbrEntrySize:]
+	entry[mbrTypeOffset] = partType
+	binary.LittleEndian.PutUint32(entry[mbrStartOffset:], start)
+	binary.LittleEndian.PutUint32(entry[mbrCountOffset:], count)
+	binary.LittleEndian.PutUint16(sector[mbrSignatureOff:], mbrSignature)
+}
+
+type gptPart struct {
+	first, last uint64
+}
+
+// writeGPT populates a protective MBR, a GPT header and a partition entry
+// array at LBA 2.
+func writeGPT(d *mockDisk, entryCount uint32, parts map[int]gptPart) {
+	setMBREntry(d.sector(0), 0, mbrTypeProtective, 1, uint32(d.SectorCount()-1))
+
+	var (
+		entrySize = uint32(gptMinEntrySize)
+		table     = d.data[2*d.sectorSize : 2*d.sectorSize+entryCount*entrySize]
+		hdr       = d.sector(gptHeaderLBA)
+	)
+
+	for index, part := range parts {
+		entry := table[uint32(index)*entrySize:]
+		entry[0] = 0xaf
+		binary.LittleEndian.PutUint64(entry[gptEntryFirstLBA:], part.first)
+		binary.LittleEndian.PutUint64(entry[gptEntryLastLBA:], part.last)
+	}
+
+	copy(hdr, gptSignature)
+	binary.LittleEndian.PutUint32(hdr[12:], gptMinHeaderSize)
+	binary.LittleEndian.PutUint64(hdr[gptEntriesLBAOff:], 2)
+	binary.LittleEndian.PutUint32(hdr[gptEntryCountOff:], entryCount)
+	binary.LittleEndian.PutUint32(hdr[gptEntrySizeOff:], entrySize)
+	binary.LittleEndian.PutUint32(hdr[gptEntriesCRCOff:], crc32(table))
+	binary.LittleEndian.PutUint32(hdr[gptHeaderCRCOffset:], 0)
+	binary.LittleEndian.PutUint32(hdr[gptHeaderCRCOffset:], crc32(hdr[:gptMinHeaderSize]))
+}
+
+type expPart struct {
+	name         string
+	start, count uint64
+}
+
+func checkPartitions(t *testing.T, disk *Device, exp []expPart) {
+	t.Helper()
+
+	parts := disk.Partitions()
+	if len(parts) != len(exp) {
+		t.Fatalf("expected %d partitions; got %d", len(exp), len(parts))
+	}
+
+	for i, spec := range exp {
+		part := parts[i]
+		if part.Name() != spec.name || part.StartLBA() != spec.start || part.SectorCount() != spec.count {
+			t.Errorf("[spec %d] expected partition %s at LBA %d with %d sectors; got %s at LBA %d with %d sectors",
+				i, spec.name, spec.start, spec.count, part.Name(), part.StartLBA(), part.SectorCount())
+		}
+
+		if part.Parent() != disk || Lookup(spec.name) != part {
+			t.Errorf("[spec %d] expected partition to be registered as a sub-device of %s", i, disk.Name())
+		}
+	}
+}
+
+func TestScanMBR(t *testing.T) {
+	defer restoreMocks()
+
+	d := newMockDisk(512, 1024)
+	mbr := d.sector(0)
+	setMBREntry(mbr, 0, 0x83, 16, 100)
+	setMBREntry(mbr, 1, 0x0c, 1000, 100) // beyond the end of the disk
+	setMBREntry(mbr, 2, mbrTypeExtLBA, 200, 400)
+
+	// Extended partition with two logical partitions and a link to a
+	// record outside the extended partition.
+	setMBREntry(d.sector(200), 0, 0x83, 10, 50)
+	setMBREntry(d.sector(200), 1, mbrTypeExtLBA, 100, 60)
+	setMBREntry(d.sector(300), 0, 0x82, 5, 20)
+	setMBREntry(d.sector(300), 1, mbrTypeExtLBA, 500, 10)
+
+	disk := Register("sd", d)
+	checkPartitions(t, disk, []expPart{
+		{"sda1", 16, 100},
+		{"sda5", 210, 50},
+		{"sda6", 305, 20},
+	})
+
+	part := Lookup("sda5")
+	d.sector(215)[0] = 0xfe
+	buf := make([]byte, 512)
+	if err := part.ReadSectors(5, 1, buf); err != nil || buf[0] != 0xfe {
+		t.Fatalf("expected partition reads to be relative to the partition start; got error %v", err)
+	}
+
+	if err := part.ReadSectors(49, 2, make([]byte, 1024)); err != errOutOfRange {
+		t.Fatalf("expected error %v; got %v", errOutOfRange, err)
+	}
+
+	if got := Devices(); len(got) != 4 || got[0] != disk {
+		t.Fatalf("expected the disk and its partitions to be registered; got %d devices", len(got))
+	}
+
+	// Partitions are not counted when naming disks
+	if got := Register("sd", newMockDisk(512, 8)).Name(); got != "sdb" {
+		t.Fatalf("expected second disk to be named sdb; got %s", got)
+	}
+}
+
+func TestScanEBRLoop(t *testing.T) {
+	defer restoreMocks()
+
+	d := newMockDisk(512, 64)
+	setMBREntry(d.sector(0), 0, mbrTypeExtCHS, 8, 32)
+	setMBREntry(d.sector(8), 0, 0x83, 1, 1)
+	setMBREntry(d.sector(8), 1, mbrTypeExtCHS, 0, 32)
+
+	disk := &Device{name: "sda", driver: d}
+	if err := scanPartitions(disk); err != errEBRLoop {
+		t.Fatalf("expected error %v; got %v", errEBRLoop, err)
+	}
+}
+
+func TestScanGPT(t *testing.T) {
+	defer restoreMocks()
+
+	d := newMockDisk(512, 256)
+	writeGPT(d, 8, map[int]gptPart{
+		0: {34, 99},
+		2: {100, 199},
+		3: {300, 400}, // beyond the end of the disk
+		4: {50, 40},
+	})
+
+	disk := Register("vd", d)
+	checkPartitions(t, disk, []expPart{
+		{"vda1", 34, 66},
+		{"vda3", 100, 100},
+	})
+
+	// Partition numbers are separated from disk names ending in a digit
+	mmc := &Device{name: "mmcblk0", driver: d}
+	addPartition(mmc, 1, 1, 1)
+	if got := mmc.Partitions()[0].Name(); got != "mmcblk0p1" {
+		t.Fatalf("expected partition to be named mmcblk0p1; got %s", got)
+	}
+
+	specs := []struct {
+		corrupt func()
+		expErr  *kernel.Error
+	}{
+		{func() { d.sector(gptHeaderLBA)[0] = 'X' }, errBadGPTHeader},
+		{func() { d.sector(gptHeaderLBA)[40]++ }, errBadGPTHeader},
+		{func() { d.sector(2)[0]++ }, errBadGPTEntries},
+		{
+			func() {
+				hdr := d.sector(gptHeaderLBA)
+				binary.LittleEndian.PutUint32(hdr[gptEntrySizeOff:], 100)
+				binary.LittleEndian.PutUint32(hdr[gptHeaderCRCOffset:], 0)
+				binary.LittleEndian.PutUint32(hdr[gptHeaderCRCOffset:], crc32(hdr[:gptMinHeaderSize]))
+			},
+			errBadGPTHeader,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		writeGPT(d, 8, nil)
+		spec.corrupt()
+
+		if err := scanPartitions(&Device{name: "sdz", driver: d}); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
+
+func TestScanPartitionsWithoutTable(t *testing.T) {
+	defer restoreMocks()
+
+	specs := []*mockDisk{
+		newMockDisk(512, 16),
+		newMockDisk(256, 16),
+		newMockDisk(512, 1),
+	}
+
+	for specIndex, d := range specs {
+		if err := scanPartitions(&Device{name: "sda", driver: d}); err != nil {
+			t.Errorf("[spec %d] unexpected error %v", specIndex, err)
+		}
+	}
+
+	d := newMockDisk(512, 16)
+	d.err = errShortBuffer
+	if err := scanPartitions(&Device{name: "sda", driver: d}); err != errShortBuffer {
+		t.Fatalf("expected read errors to be reported; got %v", err)
+	}
+}
+
+func TestCRC32(t *testing.T) {
+	if got := crc32([]byte("123456789")); got != 0xcbf43926 {
+		t.Fatalf("expected checksum 0xcbf43926; got 0x%x", got)
+	}
+}
@@ -0,0 +1,286 @@
+package blockdev
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/timer"
+)
+
+// direction selects the read or write queue of a disk.
+type direction uint8
+
+const (
+	dirRead direction = iota
+	dirWrite
+	numDirs
+)
+
+const (
+	// Queued requests are dispatched ahead of the requests that precede
+	// them in LBA order once their deadline expires. Reads are usually
+	// waited upon so they expire sooner than writes.
+	readExpire  = 500 * timer.Millisecond
+	writeExpire = 5 * timer.Second
+
+	// batchSize is the maximum number of requests that are dispatched in
+	// the same direction before the scheduler re-evaluates which queue to
+	// service.
+	batchSize = 16
+
+	// maxWritesStarved is the number of read batches that can be
+	// dispatched while writes are pending before a write batch is forced.
+	maxWritesStarved = 2
+
+	// maxMergeSectors bounds the number of sectors that are transferred
+	// by a single driver call when requests for adjacent sectors are
+	// merged.
+	maxMergeSectors = 256
+)
+
+// QueueStats contains the request queue statistics of a disk.
+type QueueStats struct {
+	// ReadDepth and WriteDepth are the number of queued requests in each
+	// direction. MaxDepth is the highest number of requests that were
+	// queued at the same time.
+	ReadDepth  int
+	WriteDepth int
+	MaxDepth   int
+
+	// Completed is the number of completed requests and Dispatched the
+	// number of driver calls that were made to service them.
+	Completed  uint64
+	Dispatched uint64
+
+	// Merged is the number of requests that were dispatched along with a
+	// request for the preceding sectors.
+	Merged uint64
+
+	// Expired is the number of requests that were dispatched out of LBA
+	// order because their deadline expired.
+	Expired uint64
+}
+
+// queue contains the pending requests of a disk in one direction.
+type queue struct {
+	// head points to the requests sorted by LBA.
+	head *Request
+
+	// nextLBA is the sector following the last dispatched request. It is
+	// used to service the pending requests in a single direction.
+	nextLBA uint64
+}
+
+// oldest returns the link to the request with the earliest deadline or nil if
+// the queue is empty.
+func (q *queue) oldest() **Request {
+	var oldest **Request
+	for link := &q.head; *link != nil; link = &(*link).next {
+		if oldest == nil || (*link).deadline < (*oldest).deadline {
+			oldest = link
+		}
+	}
+
+	return oldest
+}
+
+// expired returns true if the deadline of any queued request has passed.
+func (q *queue) expired(now timer.Duration) bool {
+	oldest := q.oldest()
+	return oldest != nil && (*oldest).deadline <= now
+}
+
+// enqueue inserts a request into the queue for its direction in LBA order.
+func (disk *Device) enqueue(req *Request) {
+	dir, expire := dirRead, readExpire
+	if req.Write {
+		dir, expire = dirWrite, writeExpire
+	}
+
+	intr := lock()
+	defer unlock(intr)
+
+	req.deadline = nowFn() + expire
+	link := &disk.queues[dir].head
+	for *link != nil && (*link).diskLBA <= req.diskLBA {
+		link = &(*link).next
+	}
+	req.next, *link = *link, req
+
+	if dir == dirRead {
+		disk.stats.ReadDepth++
+	} else {
+		disk.stats.WriteDepth++
+	}
+	if depth := disk.stats.ReadDepth + disk.stats.WriteDepth; depth > disk.stats.MaxDepth {
+		disk.stats.MaxDepth = depth
+	}
+}
+
+// nextRequest removes the next request to be dispatched from the queues of a
+// disk along with any queued requests in the same direction that access the
+// sectors directly following it. The merged requests are linked via the
+// merged field of the returned request.
+//
+// Requests are serviced in ascending LBA order starting from the sector
+// following the last dispatched request in the same direction; once the end of
+// the queue is reached, the disk continues with the request with the lowest
+// LBA. Requests whose deadline has expired are dispatched first.
+func (disk *Device) nextRequest() *Request {
+	intr := lock()
+	defer unlock(intr)
+
+	var (
+		now = nowFn()
+		dir = disk.batchDir
+	)
+
+	if disk.batchLeft == 0 || disk.queues[dir].head == nil || disk.queues[1-dir].expired(now) {
+		if dir = disk.chooseDirection(now); dir == numDirs {
+			return nil
+		}
+		disk.batchDir, disk.batchLeft = dir, batchSize
+	}
+	disk.batchLeft--
+
+	q := &disk.queues[dir]
+	link := q.oldest()
+	if (*link).deadline <= now {
+		disk.stats.Expired++
+	} else {
+		link = &q.head
+		for *link != nil && (*link).diskLBA < q.nextLBA {
+			link = &(*link).next
+		}
+		if *link == nil {
+			link = &q.head
+		}
+	}
+
+	// Requests are sorted by LBA so the requests for the following
+	// sectors are the ones that follow the selected request.
+	req := *link
+	*link = req.next
+	req.next = nil
+	count := req.Count
+	for tail := req; *link != nil && (*link).diskLBA == req.diskLBA+uint64(count) && count+(*link).Count <= maxMergeSectors; {
+		tail.merged, tail = *link, *link
+		*link = tail.next
+		tail.next = nil
+		count += tail.Count
+		disk.stats.Merged++
+	}
+
+	q.nextLBA = req.diskLBA + uint64(count)
+	return req
+}
+
+// chooseDirection selects the queue from which the next batch of requests is
+// dispatched or returns numDirs if both queues are empty. Reads are preferred
+// unless writes have expired or have been starved for too many batches.
+func (disk *Device) chooseDirection(now timer.Duration) direction {
+	reads, writes := &disk.queues[dirRead], &disk.queues[dirWrite]
+	switch {
+	case reads.head == nil && writes.head == nil:
+		return numDirs
+	case writes.head == nil:
+		return dirRead
+	case reads.head != nil && !writes.expired(now) && disk.writesStarved < maxWritesStarved:
+		disk.writesStarved++
+		return dirRead
+	}
+
+	disk.writesStarved = 0
+	return dirWrite
+}
+
+// service passes a request and any requests merged with it to the driver and
+// invokes their completion callbacks.
+func (disk *Device) service(req *Request) {
+	var (
+		count   uint32
+		reqs    int
+		isWrite = req.Write
+	)
+	for r := req; r != nil; r = r.merged {
+		count += r.Count
+		reqs++
+	}
+
+	var err *kernel.Error
+	switch {
+	case count == 0:
+	case req.merged == nil:
+		err = disk.transfer(req.diskLBA, count, req.Buf, isWrite)
+	default:
+		// Merged requests are transferred via a buffer that holds the
+		// sectors of all requests.
+		var (
+			sectorSize = disk.driver.SectorSize()
+			buf        = make([]byte, count*sectorSize)
+			offset     uint32
+		)
+
+		if isWrite {
+			for r := req; r != nil; r, offset = r.merged, offset+r.Count*sectorSize {
+				copy(buf[offset:], r.Buf[:r.Count*sectorSize])
+			}
+		}
+
+		err = disk.transfer(req.diskLBA, count, buf, isWrite)
+
+		if !isWrite && err == nil {
+			for r := req; r != nil; r, offset = r.merged, offset+r.Count*sectorSize {
+				copy(r.Buf, buf[offset:offset+r.Count*sectorSize])
+			}
+		}
+	}
+
+	intr := lock()
+	if isWrite {
+		disk.stats.WriteDepth -= reqs
+	} else {
+		disk.stats.ReadDepth -= reqs
+	}
+	disk.stats.Completed += uint64(reqs)
+	if count != 0 {
+		disk.stats.Dispatched++
+	}
+	unlock(intr)
+
+	for r := req; r != nil; {
+		next := r.merged
+		r.merged = nil
+		r.Err = err
+		if r.Done != nil {
+			r.Done(r)
+		}
+		r = next
+	}
+}
+
+// transfer passes a read or write request to the disk driver.
+func (disk *Device) transfer(lba uint64, count uint32, buf []byte, write bool) *kernel.Error {
+	if write {
+		return disk.driver.(Writer).WriteSectors(lba, count, buf)
+	}
+
+	return disk.driver.ReadSectors(lba, count, buf)
+}
+
+// dispatch services the queued requests for all disks. Disks are visited in a
+// round-robin fashion so that a busy disk cannot delay the requests queued for
+// other disks.
+func dispatch() {
+	for serviced := true; serviced; {
+		serviced = false
+		for _, dev := range devices {
+			if dev.parent != nil {
+				continue
+			}
+
+			if req := dev.nextRequest(); req != nil {
+				serviced = true
+				dev.service(req)
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package blockdev
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/softirq"
+	"gopheros/kernel/timer"
+	"testing"
+)
+
+// recordingDisk is a writable mock disk that logs each driver call.
+type recordingDisk struct {
+	*mockWritableDisk
+	calls []string
+}
+
+func newRecordingDisk(sectorCount uint64) *recordingDisk {
+	return &recordingDisk{mockWritableDisk: &mockWritableDisk{mockDisk: newMockDisk(512, sectorCount)}}
+}
+
+func (d *recordingDisk) ReadSectors(lba uint64, count uint32, buf []byte) *kernel.Error {
+	d.calls = append(d.calls, "r"+kfmt.Itoa(int(lba))+"+"+kfmt.Itoa(int(count)))
+	return d.mockDisk.ReadSectors(lba, count, buf)
+}
+
+func (d *recordingDisk) WriteSectors(lba uint64, count uint32, buf []byte) *kernel.Error {
+	d.calls = append(d.calls, "w"+kfmt.Itoa(int(lba))+"+"+kfmt.Itoa(int(count)))
+	return d.mockWritableDisk.WriteSectors(lba, count, buf)
+}
+
+func (d *recordingDisk) expCalls(t *testing.T, exp ...string) {
+	t.Helper()
+	if len(d.calls) != len(exp) {
+		t.Fatalf("expected driver calls %v; got %v", exp, d.calls)
+	}
+	for i := range exp {
+		if d.calls[i] != exp[i] {
+			t.Fatalf("expected driver calls %v; got %v", exp, d.calls)
+		}
+	}
+	d.calls = nil
+}
+
+func mockSchedulerEnv() *timer.Duration {
+	var now timer.Duration
+	mockInterrupts()
+	raiseSoftIRQFn = func(_ softirq.Vector) {}
+	nowFn = func() timer.Duration { return now }
+	return &now
+}
+
+func TestSchedulerMerging(t *testing.T) {
+	defer restoreMocks()
+	mockSchedulerEnv()
+
+	drv := newRecordingDisk(1024)
+	dev := Register("sd", drv)
+	drv.calls = nil
+
+	for i := range drv.data {
+		drv.data[i] = byte(i / 512)
+	}
+
+	var (
+		completed int
+		reqs      []*Request
+	)
+	done := func(req *Request) {
+		if req.Err != nil {
+			t.Errorf("unexpected request error: %v", req.Err)
+		}
+		completed++
+	}
+
+	// Adjacent reads are merged into a single driver call while the
+	// request at LBA 20 is dispatched separately.
+	for _, lba := range []uint64{12, 10, 20, 11} {
+		req := &Request{LBA: lba, Count: 1, Buf: make([]byte, 512), Done: done}
+		reqs = append(reqs, req)
+		if err := dev.Submit(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Writes are not merged with reads
+	wbuf := make([]byte, 1024)
+	for i := range wbuf {
+		wbuf[i] = 0xaa
+	}
+	for _, lba := range []uint64{13, 14} {
+		if err := dev.Submit(&Request{LBA: lba, Count: 1, Buf: wbuf[(lba-13)*512:], Write: true, Done: done}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stats := dev.QueueStats(); stats.ReadDepth != 4 || stats.WriteDepth != 2 || stats.MaxDepth != 6 {
+		t.Fatalf("unexpected queue depth: %+v", stats)
+	}
+
+	dispatch()
+	drv.expCalls(t, "r10+3", "r20+1", "w13+2")
+
+	for _, req := range reqs {
+		if req.Buf[0] != byte(req.LBA) || req.Buf[511] != byte(req.LBA) {
+			t.Fatalf("expected merged read buffer for LBA %d to receive its sector contents", req.LBA)
+		}
+	}
+
+	if drv.sector(13)[0] != 0xaa || drv.sector(14)[511] != 0xaa {
+		t.Fatal("expected merged writes to update both sectors")
+	}
+
+	exp := QueueStats{MaxDepth: 6, Completed: 6, Dispatched: 3, Merged: 3}
+	if stats := dev.QueueStats(); stats != exp || completed != 6 {
+		t.Fatalf("expected queue stats %+v; got %+v", exp, stats)
+	}
+
+	// Merging is limited to maxMergeSectors. The elevator resumes from the
+	// sector following the last read (21) before wrapping around.
+	for _, lba := range []uint64{0, 200} {
+		if err := dev.Submit(&Request{LBA: lba, Count: 200, Buf: make([]byte, 200*512)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dispatch()
+	drv.expCalls(t, "r200+200", "r0+200")
+
+	// Errors are reported to all merged requests
+	drv.err = &kernel.Error{Module: "test", Message: "read failed"}
+	var errs []*kernel.Error
+	for _, lba := range []uint64{0, 1} {
+		req := &Request{LBA: lba, Count: 1, Buf: make([]byte, 512), Done: func(req *Request) { errs = append(errs, req.Err) }}
+		if err := dev.Submit(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dispatch()
+	if len(errs) != 2 || errs[0] != drv.err || errs[1] != drv.err {
+		t.Fatalf("expected both merged requests to fail with %v; got %v", drv.err, errs)
+	}
+}
+
+func TestSchedulerDeadlines(t *testing.T) {
+	defer restoreMocks()
+	now := mockSchedulerEnv()
+
+	drv := newRecordingDisk(4096)
+	dev := Register("sd", drv)
+	drv.calls = nil
+
+	submit := func(lba uint64, write bool) {
+		t.Helper()
+		if err := dev.Submit(&Request{LBA: lba, Count: 1, Buf: make([]byte, 512), Write: write}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("expired read is dispatched first", func(t *testing.T) {
+		submit(100, false)
+		*now += readExpire
+		submit(50, false)
+		dev.queues[dirRead].nextLBA = 0
+
+		dispatch()
+		drv.expCalls(t, "r100+1", "r50+1")
+		if dev.QueueStats().Expired != 1 {
+			t.Fatal("expected the expired read to be accounted for")
+		}
+	})
+
+	t.Run("reads are preferred over writes", func(t *testing.T) {
+		submit(10, true)
+		submit(20, false)
+		dispatch()
+		drv.expCalls(t, "r20+1", "w10+1")
+	})
+
+	t.Run("writes are not starved by reads", func(t *testing.T) {
+		dev.batchLeft, dev.writesStarved = 0, 0
+		submit(3000, true)
+
+		// Queue enough non-adjacent reads for maxWritesStarved+1
+		// batches.
+		for i := uint64(0); i < (maxWritesStarved+1)*batchSize; i++ {
+			submit(2*i, false)
+		}
+
+		dispatch()
+		if len(drv.calls) != (maxWritesStarved+1)*batchSize+1 {
+			t.Fatalf("expected all requests to be dispatched; got %v", drv.calls)
+		}
+		if got := drv.calls[maxWritesStarved*batchSize]; got != "w3000+1" {
+			t.Fatalf("expected the write to be dispatched after %d read batches; got %s", maxWritesStarved, got)
+		}
+		drv.calls = nil
+	})
+
+	t.Run("expired writes interrupt a read batch", func(t *testing.T) {
+		submit(500, true)
+		*now += writeExpire
+		submit(1000, false)
+		submit(1002, false)
+
+		// Start a read batch before the write expires
+		dev.batchDir, dev.batchLeft = dirRead, batchSize
+		dispatch()
+		drv.expCalls(t, "w500+1", "r1000+1", "r1002+1")
+	})
+
+	if stats := dev.QueueStats(); stats.ReadDepth != 0 || stats.WriteDepth != 0 {
+		t.Fatalf("expected queues to be drained; got %+v", stats)
+	}
+}
+
+func TestSubmitWrite(t *testing.T) {
+	defer restoreMocks()
+	mockSchedulerEnv()
+
+	roDev := Register("sd", newMockDisk(512, 8))
+	if err := roDev.Submit(&Request{LBA: 0, Count: 1, Buf: make([]byte, 512), Write: true}); err != errReadOnly {
+		t.Fatalf("expected to get errReadOnly; got %v", err)
+	}
+
+	// Partition requests are accounted to the disk
+	drv := newRecordingDisk(64)
+	dev := Register("sd", drv)
+	addPartition(dev, 1, 32, 32)
+	part := dev.Partitions()[0]
+	drv.calls = nil
+
+	if err := part.Submit(&Request{LBA: 1, Count: 1, Buf: make([]byte, 512), Write: true}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := part.QueueStats(); stats.WriteDepth != 1 {
+		t.Fatalf("expected partition request to be queued on the disk; got %+v", stats)
+	}
+
+	dispatch()
+	drv.expCalls(t, "w33+1")
+}
@@ -0,0 +1,247 @@
+// Package cmos provides access to the battery-backed CMOS memory found on
+// PC-compatible systems.
+//
+// The CMOS contains the registers of the real-time clock followed by a
+// non-volatile RAM area whose contents are maintained by the firmware. The
+// registers are accessed indirectly by writing the register index to the index
+// port and then accessing the data port. As the top bit of the index port also
+// controls the delivery of NMIs, this package keeps track of the NMI mask and
+// serializes all register accesses.
+package cmos
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/sync"
+	"io"
+)
+
+const (
+	// NumRegisters is the number of registers in the standard CMOS bank.
+	NumRegisters = 128
+
+	// FirstNVRAMRegister is the index of the first register that is not
+	// used by the real-time clock. Registers below it can be read but are
+	// owned by the RTC driver and cannot be written via this package.
+	FirstNVRAMRegister = uint8(0x0e)
+
+	// RegDiagnostic contains the status of the firmware power-on self
+	// test.
+	RegDiagnostic = uint8(0x0e)
+
+	indexPort = uint16(0x70)
+	dataPort  = uint16(0x71)
+
+	// nmiDisable is the bit of the index port that masks NMIs.
+	nmiDisable = uint8(0x80)
+
+	// Bit 7 of RTC status register D is cleared if the CMOS battery
+	// failed and the CMOS contents can no longer be trusted.
+	regStatusD      = uint8(0x0d)
+	statusDValidRAM = uint8(1 << 7)
+
+	// The firmware stores a 16-bit (big-endian) sum of the registers in
+	// the checksummed range in the two registers that follow it.
+	checksumFirst = uint8(0x10)
+	checksumLast  = uint8(0x2d)
+	regChecksumHi = uint8(0x2e)
+	regChecksumLo = uint8(0x2f)
+)
+
+// The bits of the RegDiagnostic register.
+const (
+	DiagTimeInvalid    = uint8(1 << 2)
+	DiagDiskFailed     = uint8(1 << 3)
+	DiagMemSizeInvalid = uint8(1 << 4)
+	DiagConfigInvalid  = uint8(1 << 5)
+	DiagChecksumBad    = uint8(1 << 6)
+	DiagPowerLost      = uint8(1 << 7)
+)
+
+var (
+	errInvalidRegister  = &kernel.Error{Module: "cmos", Message: "CMOS register index is out of range"}
+	errReservedRegister = &kernel.Error{Module: "cmos", Message: "CMOS register is reserved and cannot be written"}
+
+	// lock serializes accesses to the index and data ports.
+	lock sync.Spinlock
+
+	// nmiMasked tracks the state of the NMI mask. As the index port is
+	// write-only, its value is re-applied on each register access.
+	nmiMasked bool
+
+	// The following functions are used by tests to mock calls to the cpu
+	// package.
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn  = cpu.PortReadByte
+)
+
+// Read returns the contents of the CMOS register at index reg.
+func Read(reg uint8) (uint8, *kernel.Error) {
+	if reg >= NumRegisters {
+		return 0, errInvalidRegister
+	}
+
+	lock.Acquire()
+	val := readRegister(reg)
+	lock.Release()
+	return val, nil
+}
+
+// Write stores val to the CMOS register at index reg. Writes to the RTC
+// registers and to the checksum registers are rejected. If reg belongs to the
+// checksummed area of the NVRAM, the checksum is updated to reflect the new
+// register contents.
+func Write(reg, val uint8) *kernel.Error {
+	switch {
+	case reg >= NumRegisters:
+		return errInvalidRegister
+	case reg < FirstNVRAMRegister, reg == regChecksumHi, reg == regChecksumLo:
+		return errReservedRegister
+	}
+
+	lock.Acquire()
+	writeRegister(reg, val)
+	if reg >= checksumFirst && reg <= checksumLast {
+		updateChecksum()
+	}
+	lock.Release()
+	return nil
+}
+
+// ChecksumValid returns true if the checksum maintained by the firmware
+// matches the contents of the checksummed NVRAM area.
+func ChecksumValid() bool {
+	lock.Acquire()
+	defer lock.Release()
+
+	stored := uint16(readRegister(regChecksumHi))<<8 | uint16(readRegister(regChecksumLo))
+	return stored == checksum()
+}
+
+// UpdateChecksum recalculates the checksum of the NVRAM area. It can be used
+// to repair the checksum after the firmware reported it as invalid.
+func UpdateChecksum() {
+	lock.Acquire()
+	updateChecksum()
+	lock.Release()
+}
+
+// SetNMIMask controls the delivery of NMIs. NMIs are delivered unless they
+// are explicitly masked via a call to this function.
+func SetNMIMask(masked bool) {
+	lock.Acquire()
+	nmiMasked = masked
+
+	// Apply the new mask by selecting a register that has no read side
+	// effects.
+	portWriteByteFn(indexPort, indexValue(regStatusD))
+	lock.Release()
+}
+
+// NMIMasked returns true if the delivery of NMIs is masked.
+func NMIMasked() bool {
+	return nmiMasked
+}
+
+// checksum returns the sum of the registers in the checksummed area. It must
+// be invoked while holding lock.
+func checksum() uint16 {
+	var sum uint16
+	for reg := checksumFirst; reg <= checksumLast; reg++ {
+		sum += uint16(readRegister(reg))
+	}
+	return sum
+}
+
+// updateChecksum stores the checksum of the NVRAM area to the checksum
+// registers. It must be invoked while holding lock.
+func updateChecksum() {
+	sum := checksum()
+	writeRegister(regChecksumHi, uint8(sum>>8))
+	writeRegister(regChecksumLo, uint8(sum))
+}
+
+func indexValue(reg uint8) uint8 {
+	if nmiMasked {
+		return reg | nmiDisable
+	}
+	return reg
+}
+
+func readRegister(reg uint8) uint8 {
+	portWriteByteFn(indexPort, indexValue(reg))
+	return portReadByteFn(dataPort)
+}
+
+func writeRegister(reg, val uint8) {
+	portWriteByteFn(indexPort, indexValue(reg))
+	portWriteByteFn(dataPort, val)
+}
+
+// Driver reports the state of the CMOS battery, the NVRAM checksum and the
+// firmware self-test diagnostics during boot.
+type Driver struct{}
+
+// DriverName returns the name of this driver.
+func (*Driver) DriverName() string {
+	return "cmos_nvram"
+}
+
+// DriverVersion returns the version of this driver.
+func (*Driver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit initializes this driver.
+func (*Driver) DriverInit(w io.Writer) *kernel.Error {
+	statusD, _ := Read(regStatusD)
+	diag, _ := Read(RegDiagnostic)
+
+	battery := "ok"
+	if statusD&statusDValidRAM == 0 {
+		battery = "failed"
+	}
+
+	checksumState := "valid"
+	if !ChecksumValid() {
+		checksumState = "invalid"
+	}
+
+	kfmt.Fprintf(w, "battery: %s, checksum: %s, diagnostic status: 0x%x\n", battery, checksumState, diag)
+
+	for _, flag := range []struct {
+		bit  uint8
+		desc string
+	}{
+		{DiagPowerLost, "CMOS lost power"},
+		{DiagChecksumBad, "bad checksum"},
+		{DiagConfigInvalid, "invalid configuration"},
+		{DiagMemSizeInvalid, "memory size mismatch"},
+		{DiagDiskFailed, "fixed disk failure"},
+		{DiagTimeInvalid, "invalid time"},
+	} {
+		if diag&flag.bit != 0 {
+			kfmt.Fprintf(w, "firmware reported: %s\n", flag.desc)
+		}
+	}
+
+	return nil
+}
+
+// probeForCMOS returns a CMOS driver. Like the RTC, the CMOS cannot be
+// detected by reading its registers so it is assumed to be present unless the
+// firmware reports otherwise.
+func probeForCMOS() device.Driver {
+	return &Driver{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:    "cmos_nvram",
+		Order:   device.DetectOrderLast,
+		Probe:   probeForCMOS,
+		ACPIIDs: []string{"PNP0B00", "PNP0B01", "PNP0B02"},
+	})
+}
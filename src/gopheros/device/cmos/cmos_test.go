@@ -0,0 +1,188 @@
+package cmos
+
+import (
+	"bytes"
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func restoreMocks() {
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn = cpu.PortReadByte
+	nmiMasked = false
+}
+
+// mockCMOS emulates the CMOS index and data ports.
+type mockCMOS struct {
+	regs  [NumRegisters]uint8
+	index uint8
+
+	// nmiMaskWrites records the state of the NMI mask bit for each write
+	// to the index port.
+	nmiMaskWrites []bool
+}
+
+func (m *mockCMOS) install() {
+	portWriteByteFn = func(port uint16, val uint8) {
+		switch port {
+		case indexPort:
+			m.index = val &^ nmiDisable
+			m.nmiMaskWrites = append(m.nmiMaskWrites, val&nmiDisable != 0)
+		case dataPort:
+			m.regs[m.index] = val
+		}
+	}
+
+	portReadByteFn = func(port uint16) uint8 {
+		if port != dataPort {
+			return 0xff
+		}
+		return m.regs[m.index]
+	}
+}
+
+// setChecksum stores a valid checksum to the mocked registers.
+func (m *mockCMOS) setChecksum() {
+	var sum uint16
+	for reg := checksumFirst; reg <= checksumLast; reg++ {
+		sum += uint16(m.regs[reg])
+	}
+	m.regs[regChecksumHi], m.regs[regChecksumLo] = uint8(sum>>8), uint8(sum)
+}
+
+func TestReadWrite(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockCMOS{}
+	m.install()
+	m.regs[0x00] = 0x42
+	m.regs[0x20] = 0xff
+	m.regs[0x21] = 0x10
+	m.setChecksum()
+
+	if val, err := Read(0x00); err != nil || val != 0x42 {
+		t.Fatalf("expected to read 0x42; got 0x%x, %v", val, err)
+	}
+
+	if _, err := Read(NumRegisters); err != errInvalidRegister {
+		t.Fatalf("expected to get errInvalidRegister; got %v", err)
+	}
+
+	specs := []struct {
+		reg    uint8
+		expErr bool
+	}{
+		{0x00, true},
+		{0x0d, true},
+		{regChecksumHi, true},
+		{regChecksumLo, true},
+		{NumRegisters, true},
+		{0x0e, false},
+		{0x20, false},
+		{0x40, false},
+	}
+
+	for specIndex, spec := range specs {
+		err := Write(spec.reg, 0x80)
+		if spec.expErr {
+			if err == nil {
+				t.Errorf("[spec %d] expected write to register 0x%x to fail", specIndex, spec.reg)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if m.regs[spec.reg] != 0x80 {
+			t.Errorf("[spec %d] expected register 0x%x to contain 0x80; got 0x%x", specIndex, spec.reg, m.regs[spec.reg])
+		}
+
+		if !ChecksumValid() {
+			t.Errorf("[spec %d] expected the checksum to remain valid after writing register 0x%x", specIndex, spec.reg)
+		}
+	}
+
+	if exp := uint16(0x80 + 0x10); uint16(m.regs[regChecksumHi])<<8|uint16(m.regs[regChecksumLo]) != exp {
+		t.Errorf("expected checksum to be 0x%x", exp)
+	}
+
+	// Corrupt and repair the checksum
+	m.regs[regChecksumLo]++
+	if ChecksumValid() {
+		t.Fatal("expected ChecksumValid to return false")
+	}
+
+	UpdateChecksum()
+	if !ChecksumValid() {
+		t.Fatal("expected ChecksumValid to return true after UpdateChecksum")
+	}
+}
+
+func TestNMIMask(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockCMOS{}
+	m.install()
+
+	Read(0x00)
+	SetNMIMask(true)
+	if !NMIMasked() {
+		t.Fatal("expected NMIMasked to return true")
+	}
+	Read(0x00)
+	Write(0x40, 1)
+	SetNMIMask(false)
+	Read(0x00)
+
+	exp := []bool{false, true, true, true, false, false}
+	if len(m.nmiMaskWrites) != len(exp) {
+		t.Fatalf("expected %d index port writes; got %d", len(exp), len(m.nmiMaskWrites))
+	}
+
+	for i, masked := range exp {
+		if m.nmiMaskWrites[i] != masked {
+			t.Errorf("expected NMI mask bit for index port write %d to be %t", i, masked)
+		}
+	}
+}
+
+func TestDriverInit(t *testing.T) {
+	defer restoreMocks()
+
+	specs := []struct {
+		statusD, diag uint8
+		validChecksum bool
+		exp           string
+	}{
+		{
+			statusDValidRAM, 0, true,
+			"battery: ok, checksum: valid, diagnostic status: 0x0\n",
+		},
+		{
+			0, DiagPowerLost | DiagChecksumBad | DiagTimeInvalid, false,
+			"battery: failed, checksum: invalid, diagnostic status: 0xc4\nfirmware reported: CMOS lost power\nfirmware reported: bad checksum\nfirmware reported: invalid time\n",
+		},
+	}
+
+	for specIndex, spec := range specs {
+		m := &mockCMOS{}
+		m.install()
+		m.regs[regStatusD], m.regs[RegDiagnostic] = spec.statusD, spec.diag
+		m.regs[0x10] = 0x12
+		if m.setChecksum(); !spec.validChecksum {
+			m.regs[regChecksumHi] = 0xff
+		}
+
+		var buf bytes.Buffer
+		if err := probeForCMOS().DriverInit(&buf); err != nil {
+			t.Fatalf("[spec %d] %v", specIndex, err)
+		}
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected driver output %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
@@ -19,6 +19,50 @@ type Driver interface {
 	DriverInit(io.Writer) *kernel.Error
 }
 
+// Health describes the operational state of an initialized driver.
+type Health uint8
+
+const (
+	// HealthUnknown indicates that the driver is not active and its
+	// health cannot be determined.
+	HealthUnknown Health = iota
+
+	// HealthOK indicates that the driver is operating normally.
+	HealthOK
+
+	// HealthDegraded indicates that the driver is operational but has
+	// encountered errors (e.g. dropped data).
+	HealthDegraded
+
+	// HealthFailed indicates that the driver failed to initialize or is
+	// no longer able to drive its hardware.
+	HealthFailed
+)
+
+// String implements fmt.Stringer for Health.
+func (h Health) String() string {
+	switch h {
+	case HealthOK:
+		return "ok"
+	case HealthDegraded:
+		return "degraded"
+	case HealthFailed:
+		return "failed"
+	default:
+		return "-"
+	}
+}
+
+// StatusReporter is an interface implemented by drivers that monitor the
+// state of their hardware after they have been initialized.
+//
+// DriverStatus returns the driver health and, if the driver is not healthy, a
+// message describing the detected problem. Active drivers that do not
+// implement this interface are reported as healthy.
+type StatusReporter interface {
+	DriverStatus() (Health, string)
+}
+
 // ProbeFn is a function that scans for the presence of a particular
 // piece of hardware and returns a driver for it.
 type ProbeFn func() Driver
@@ -38,6 +82,19 @@ const (
 	// after any drivers with DetectOrderEarly.
 	DetectOrderBeforeACPI = -127
 
+	// DetectOrderInterruptController specifies that the driver's probe
+	// function should be executed after the ACPI tables have been parsed
+	// but before probing any drivers that need to register interrupt
+	// handlers.
+	DetectOrderInterruptController = -126
+
+	// DetectOrderInterruptControllerFallback specifies that the driver's
+	// probe function should be executed after all drivers with
+	// DetectOrderInterruptController. It is used by drivers for legacy
+	// interrupt controllers that are only activated if no other
+	// interrupt controller is available.
+	DetectOrderInterruptControllerFallback = -125
+
 	// DetectOrderACPI specifies that the driver's probe function should
 	// be executed after parsing the ACPI tables. This is the default (zero
 	// value) for all drivers.
@@ -50,13 +107,98 @@ const (
 
 // DriverInfo is a driver-defined struct that is passed to calls to RegisterDriver.
 type DriverInfo struct {
+	// Name identifies the driver in the registry. Other drivers refer to
+	// it by this name when declaring their dependencies.
+	Name string
+
+	// DependsOn lists the names of the drivers that must be successfully
+	// initialized before the probe function of this driver is invoked.
+	DependsOn []string
+
 	// Order specifies at which stage of the HW detection step should
-	// the probe function be invoked.
+	// the probe function be invoked. Drivers are always probed after
+	// their dependencies regardless of their Order.
 	Order DetectOrder
 
 	// Probe is a function that checks for the presence of a particular
 	// piece of hardware and returns back a driver for it.
 	Probe ProbeFn
+
+	// ACPIIDs optionally lists the ACPI hardware or compatible IDs (e.g.
+	// "PNP0303") of the devices supported by this driver. If the firmware
+	// describes matching devices but reports all of them as not present
+	// or not enabled, the probe function is not invoked.
+	ACPIIDs []string
+
+	// The outcome of the last call to ProbeDrivers for this entry.
+	status  ProbeStatus
+	driver  Driver
+	initErr *kernel.Error
+}
+
+// Status returns the outcome of probing this driver.
+func (info *DriverInfo) Status() ProbeStatus {
+	return info.status
+}
+
+// Driver returns the driver instance returned by the probe function or nil if
+// the driver has not been probed or no hardware was detected.
+func (info *DriverInfo) Driver() Driver {
+	return info.driver
+}
+
+// InitError returns the error reported by the driver's DriverInit method or
+// nil if the driver was initialized successfully.
+func (info *DriverInfo) InitError() *kernel.Error {
+	return info.initErr
+}
+
+// Metadata describes a registered driver and the outcome of probing it.
+type Metadata struct {
+	// The name and version reported by the driver. If the driver has
+	// not been probed or no hardware was detected, Name is set to the
+	// name of the registry entry and the version is set to 0.0.0.
+	Name                string
+	Major, Minor, Patch uint16
+
+	Status ProbeStatus
+	Health Health
+
+	// Detail describes why the driver is not active or not healthy. It
+	// is empty for healthy drivers.
+	Detail string
+}
+
+// Metadata returns a summary of the driver information, its probe status and
+// its current health.
+func (info *DriverInfo) Metadata() Metadata {
+	md := Metadata{Name: info.Name, Status: info.status}
+	if info.driver != nil {
+		md.Name = info.driver.DriverName()
+		md.Major, md.Minor, md.Patch = info.driver.DriverVersion()
+	}
+
+	switch info.status {
+	case ProbeStatusActive:
+		md.Health = HealthOK
+		if reporter, ok := info.driver.(StatusReporter); ok {
+			md.Health, md.Detail = reporter.DriverStatus()
+		}
+	case ProbeStatusInitFailed:
+		md.Health, md.Detail = HealthFailed, info.initErr.Error()
+	case ProbeStatusMissingDeps:
+		for _, depName := range info.DependsOn {
+			if dep := Lookup(depName); dep == nil || dep.status != ProbeStatusActive {
+				if md.Detail == "" {
+					md.Detail = "requires " + depName
+				} else {
+					md.Detail += ", " + depName
+				}
+			}
+		}
+	}
+
+	return md
 }
 
 // DriverInfoList is a list of registered drivers that implements sort.Sort.
@@ -87,3 +229,15 @@ func RegisterDriver(info *DriverInfo) {
 func DriverList() DriverInfoList {
 	return registeredDrivers
 }
+
+// Lookup returns the registered driver with the specified name or nil if no
+// such driver exists.
+func Lookup(name string) *DriverInfo {
+	for _, info := range registeredDrivers {
+		if info.Name == name {
+			return info
+		}
+	}
+
+	return nil
+}
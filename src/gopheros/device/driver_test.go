@@ -1,6 +1,7 @@
 package device
 
 import (
+	"gopheros/kernel"
 	"sort"
 	"testing"
 )
@@ -34,3 +35,87 @@ func TestDriverInfoListSorting(t *testing.T) {
 		}
 	}
 }
+
+func TestDriverInfoMetadata(t *testing.T) {
+	defer func() {
+		registeredDrivers = nil
+	}()
+
+	RegisterDriver(&DriverInfo{Name: "dep-ok", status: ProbeStatusActive, driver: &mockDriver{}})
+	RegisterDriver(&DriverInfo{Name: "dep-failed", status: ProbeStatusInitFailed})
+
+	initErr := &kernel.Error{Module: "test", Message: "unable to map framebuffer"}
+	specs := []struct {
+		info      *DriverInfo
+		expName   string
+		expPatch  uint16
+		expHealth Health
+		expDetail string
+	}{
+		{&DriverInfo{Name: "pending"}, "pending", 0, HealthUnknown, ""},
+		{&DriverInfo{Name: "absent", status: ProbeStatusNotDetected}, "absent", 0, HealthUnknown, ""},
+		{
+			&DriverInfo{Name: "deps", DependsOn: []string{"dep-ok", "dep-failed", "dep-unknown"}, status: ProbeStatusMissingDeps},
+			"deps", 0, HealthUnknown, "requires dep-failed, dep-unknown",
+		},
+		{
+			&DriverInfo{Name: "broken", status: ProbeStatusInitFailed, driver: &mockDriver{}, initErr: initErr},
+			"mock", 1, HealthFailed, "unable to map framebuffer",
+		},
+		{&DriverInfo{Name: "ok", status: ProbeStatusActive, driver: &mockDriver{}}, "mock", 1, HealthOK, ""},
+		{
+			&DriverInfo{Name: "reporter", status: ProbeStatusActive, driver: &mockReporterDriver{health: HealthDegraded, detail: "dropped 3 packets"}},
+			"mock", 1, HealthDegraded, "dropped 3 packets",
+		},
+	}
+
+	for specIndex, spec := range specs {
+		md := spec.info.Metadata()
+		if md.Name != spec.expName {
+			t.Errorf("[spec %d] expected name %q; got %q", specIndex, spec.expName, md.Name)
+		}
+
+		if md.Major != 0 || md.Minor != 0 || md.Patch != spec.expPatch {
+			t.Errorf("[spec %d] expected version 0.0.%d; got %d.%d.%d", specIndex, spec.expPatch, md.Major, md.Minor, md.Patch)
+		}
+
+		if md.Status != spec.info.Status() {
+			t.Errorf("[spec %d] expected status %q; got %q", specIndex, spec.info.Status().String(), md.Status.String())
+		}
+
+		if md.Health != spec.expHealth {
+			t.Errorf("[spec %d] expected health %q; got %q", specIndex, spec.expHealth.String(), md.Health.String())
+		}
+
+		if md.Detail != spec.expDetail {
+			t.Errorf("[spec %d] expected detail %q; got %q", specIndex, spec.expDetail, md.Detail)
+		}
+	}
+}
+
+func TestHealthString(t *testing.T) {
+	specs := []struct {
+		health Health
+		exp    string
+	}{
+		{HealthUnknown, "-"},
+		{HealthOK, "ok"},
+		{HealthDegraded, "degraded"},
+		{HealthFailed, "failed"},
+		{Health(99), "-"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.health.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+type mockReporterDriver struct {
+	mockDriver
+	health Health
+	detail string
+}
+
+func (d *mockReporterDriver) DriverStatus() (Health, string) { return d.health, d.detail }
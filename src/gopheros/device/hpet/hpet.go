@@ -0,0 +1,199 @@
+// Package hpet provides a driver for the high precision event timer (HPET).
+//
+// The driver exposes the HPET main counter as a clocksource for the monotonic
+// clock. Unlike the TSC, the main counter runs at a constant rate that is
+// reported by the hardware so it does not require calibration.
+package hpet
+
+import (
+	"gopheros/device"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"io"
+	"unsafe"
+)
+
+const (
+	// Rating is the clocksource rating of the HPET main counter. It ranks
+	// below an invariant TSC as reading the counter requires an uncached
+	// memory access.
+	Rating = 250
+
+	hpetSignature = "HPET"
+
+	// HPET register offsets.
+	regCapabilities = uintptr(0x00)
+	regConfig       = uintptr(0x10)
+	regMainCounter  = uintptr(0xf0)
+	regSize         = uintptr(0x400)
+
+	capCounter64    = uint64(1 << 13)
+	capPeriodShift  = 32
+	cfgEnable       = uint64(1 << 0)
+	femtosPerSecond = uint64(1000000000000000)
+
+	// maxPeriod is the longest main counter tick period, in femtoseconds,
+	// that is allowed by the HPET specification.
+	maxPeriod = uint64(100000000)
+)
+
+var (
+	errInvalidPeriod = &kernel.Error{Module: "hpet", Message: "HPET reports an invalid counter period"}
+
+	// The following functions are used by tests to mock calls to the acpi,
+	// cmdline and vmm packages.
+	acpiLookupTableFn = acpi.LookupTable
+	cmdlineBoolFn     = cmdline.Bool
+	mapRegionFn       = vmm.MapRegion
+
+	// hpet points to the initialized HPET driver.
+	hpet *HPET
+)
+
+// acpiTable mirrors the layout of the ACPI HPET description table. The base
+// address is split into two words as it is not naturally aligned.
+type acpiTable struct {
+	table.SDTHeader
+
+	EventTimerBlockID uint32
+	AddressSpace      table.AddressSpace
+	BitWidth          uint8
+	BitOffset         uint8
+	AccessSize        uint8
+	AddressLo         uint32
+	AddressHi         uint32
+	Number            uint8
+	MinTick           [2]uint8
+	PageProtection    uint8
+}
+
+// HPET implements a driver for the HPET main counter.
+type HPET struct {
+	physAddr uintptr
+	regBase  uintptr
+
+	// period is the duration of a main counter tick in femtoseconds.
+	period uint64
+
+	// counter64 is set if the main counter is 64 bits wide.
+	counter64 bool
+}
+
+// Active returns the initialized HPET driver or nil if no HPET is available.
+func Active() *HPET {
+	return hpet
+}
+
+// Name returns the clocksource name of the HPET.
+func (*HPET) Name() string {
+	return "hpet"
+}
+
+// Rating returns the clocksource rating of the HPET.
+func (*HPET) Rating() int {
+	return Rating
+}
+
+// Frequency returns the frequency of the main counter in Hz rounded to the
+// nearest integer.
+func (h *HPET) Frequency() uint64 {
+	return (femtosPerSecond + h.period/2) / h.period
+}
+
+// Mask returns a mask with the implemented bits of the main counter.
+func (h *HPET) Mask() uint64 {
+	if h.counter64 {
+		return ^uint64(0)
+	}
+	return 0xffffffff
+}
+
+// Read returns the current value of the main counter.
+func (h *HPET) Read() uint64 {
+	return h.read(regMainCounter) & h.Mask()
+}
+
+// DriverName returns the name of this driver.
+func (*HPET) DriverName() string {
+	return "hpet"
+}
+
+// DriverVersion returns the version of this driver.
+func (*HPET) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit maps the HPET registers and starts the main counter.
+func (h *HPET) DriverInit(w io.Writer) *kernel.Error {
+	page, err := mapRegionFn(
+		mm.FrameFromAddress(h.physAddr),
+		regSize,
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute|vmm.FlagDoNotCache,
+	)
+	if err != nil {
+		return err
+	}
+	h.regBase = page.Address() + vmm.PageOffset(h.physAddr)
+
+	caps := h.read(regCapabilities)
+	h.period = caps >> capPeriodShift
+	h.counter64 = caps&capCounter64 != 0
+	if h.period == 0 || h.period > maxPeriod {
+		return errInvalidPeriod
+	}
+
+	h.write(regConfig, h.read(regConfig)|cfgEnable)
+
+	counterBits := 32
+	if h.counter64 {
+		counterBits = 64
+	}
+	kfmt.Fprintf(w, "mapped to 0x%x, counter: %d Hz, %d bits\n", h.regBase, h.Frequency(), counterBits)
+
+	hpet = h
+	return nil
+}
+
+func (h *HPET) read(reg uintptr) uint64 {
+	return *(*uint64)(unsafe.Pointer(h.regBase + reg))
+}
+
+func (h *HPET) write(reg uintptr, val uint64) {
+	*(*uint64)(unsafe.Pointer(h.regBase + reg)) = val
+}
+
+// probeForHPET returns a driver for the HPET described by the ACPI HPET table.
+// The HPET can be disabled via the nohpet boot option.
+func probeForHPET() device.Driver {
+	if cmdlineBoolFn("nohpet") {
+		return nil
+	}
+
+	hdr := acpiLookupTableFn(hpetSignature)
+	if hdr == nil {
+		return nil
+	}
+
+	tbl := (*acpiTable)(unsafe.Pointer(hdr))
+	addr := uintptr(tbl.AddressHi)<<32 | uintptr(tbl.AddressLo)
+	if tbl.AddressSpace != table.AddressSpaceSysMemory || addr == 0 {
+		return nil
+	}
+
+	return &HPET{physAddr: addr}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:      "hpet",
+		DependsOn: []string{"ACPI"},
+		Order:     device.DetectOrderACPI,
+		Probe:     probeForHPET,
+		ACPIIDs:   []string{"PNP0103"},
+	})
+}
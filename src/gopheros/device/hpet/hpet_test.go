@@ -0,0 +1,177 @@
+package hpet
+
+import (
+	"bytes"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	acpiLookupTableFn = acpi.LookupTable
+	cmdlineBoolFn = cmdline.Bool
+	mapRegionFn = vmm.MapRegion
+	hpet = nil
+}
+
+// mockRegisterBufs keeps the buffers returned by mockRegisterSpace reachable
+// so that they do not get garbage-collected while in use.
+var mockRegisterBufs [][]byte
+
+// mockRegisterSpace returns a page-aligned buffer that can be used in place of
+// the memory-mapped HPET registers.
+func mockRegisterSpace() uintptr {
+	buf := make([]byte, 2*mm.PageSize)
+	mockRegisterBufs = append(mockRegisterBufs, buf)
+	addr := uintptr(unsafe.Pointer(&buf[0]))
+	return (addr + mm.PageSize - 1) &^ (mm.PageSize - 1)
+}
+
+func TestACPITableLayout(t *testing.T) {
+	var tbl acpiTable
+
+	specs := []struct {
+		field string
+		got   uintptr
+		exp   uintptr
+	}{
+		{"EventTimerBlockID", unsafe.Offsetof(tbl.EventTimerBlockID), 36},
+		{"AddressSpace", unsafe.Offsetof(tbl.AddressSpace), 40},
+		{"AddressLo", unsafe.Offsetof(tbl.AddressLo), 44},
+		{"AddressHi", unsafe.Offsetof(tbl.AddressHi), 48},
+		{"Number", unsafe.Offsetof(tbl.Number), 52},
+		{"PageProtection", unsafe.Offsetof(tbl.PageProtection), 55},
+	}
+
+	for specIndex, spec := range specs {
+		if spec.got != spec.exp {
+			t.Errorf("[spec %d] expected %s to be located at offset %d; got %d", specIndex, spec.field, spec.exp, spec.got)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	defer restoreMocks()
+
+	var tbl acpiTable
+	cmdlineBoolFn = func(_ string) bool { return false }
+	acpiLookupTableFn = func(name string) *table.SDTHeader {
+		if name == hpetSignature {
+			return &tbl.SDTHeader
+		}
+		return nil
+	}
+
+	if drv := probeForHPET(); drv != nil {
+		t.Fatal("expected probe to fail when the HPET table does not specify a base address")
+	}
+
+	tbl.AddressLo, tbl.AddressHi = 0xfed00000, 0x1
+	tbl.AddressSpace = table.AddressSpaceSysIO
+	if drv := probeForHPET(); drv != nil {
+		t.Fatal("expected probe to fail for HPETs that are not memory-mapped")
+	}
+
+	tbl.AddressSpace = table.AddressSpaceSysMemory
+	drv := probeForHPET()
+	if drv == nil {
+		t.Fatal("expected probe to succeed")
+	}
+
+	if exp, got := uintptr(0x1fed00000), drv.(*HPET).physAddr; got != exp {
+		t.Errorf("expected physical address to be 0x%x; got 0x%x", exp, got)
+	}
+
+	cmdlineBoolFn = func(name string) bool { return name == "nohpet" }
+	if drv := probeForHPET(); drv != nil {
+		t.Error("expected probe to fail when the nohpet option is specified")
+	}
+
+	cmdlineBoolFn = func(_ string) bool { return false }
+	acpiLookupTableFn = func(_ string) *table.SDTHeader { return nil }
+	if drv := probeForHPET(); drv != nil {
+		t.Error("expected probe to fail when no HPET table is available")
+	}
+}
+
+func TestDriverInit(t *testing.T) {
+	defer restoreMocks()
+
+	regs := &HPET{regBase: mockRegisterSpace()}
+
+	expErr := &kernel.Error{Module: "test", Message: "map failed"}
+	mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		return 0, expErr
+	}
+
+	h := &HPET{physAddr: 0xfed00000}
+	if err := h.DriverInit(nil); err != expErr {
+		t.Fatalf("expected to get error %v; got %v", expErr, err)
+	}
+
+	mapRegionFn = func(frame mm.Frame, size uintptr, flags vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		if frame != mm.FrameFromAddress(0xfed00000) || size != regSize || flags&vmm.FlagDoNotCache == 0 {
+			t.Errorf("unexpected mapping request: frame %d, size %d, flags %x", frame, size, flags)
+		}
+		return mm.PageFromAddress(regs.regBase), nil
+	}
+
+	for _, period := range []uint64{0, maxPeriod + 1} {
+		regs.write(regCapabilities, period<<capPeriodShift)
+		if err := (&HPET{physAddr: 0xfed00000}).DriverInit(nil); err != errInvalidPeriod {
+			t.Fatalf("expected errInvalidPeriod for period %d; got %v", period, err)
+		}
+	}
+
+	specs := []struct {
+		caps    uint64
+		expFreq uint64
+		expMask uint64
+		expOut  string
+	}{
+		// QEMU reports a 100MHz, 64-bit main counter
+		{10000000<<capPeriodShift | capCounter64, 100000000, ^uint64(0), "counter: 100000000 Hz, 64 bits\n"},
+		{69841279 << capPeriodShift, 14318180, 0xffffffff, "counter: 14318180 Hz, 32 bits\n"},
+	}
+
+	for specIndex, spec := range specs {
+		regs.write(regCapabilities, spec.caps)
+		regs.write(regConfig, 0)
+		regs.write(regMainCounter, 0x100000042)
+
+		var out bytes.Buffer
+		drv := &HPET{physAddr: 0xfed00000}
+		if err := drv.DriverInit(&out); err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+
+		if got := out.String(); !bytes.HasSuffix([]byte(got), []byte(spec.expOut)) {
+			t.Errorf("[spec %d] expected output to end with %q; got %q", specIndex, spec.expOut, got)
+		}
+
+		if drv.read(regConfig)&cfgEnable == 0 {
+			t.Errorf("[spec %d] expected the main counter to be enabled", specIndex)
+		}
+
+		if got := drv.Frequency(); got != spec.expFreq {
+			t.Errorf("[spec %d] expected frequency to be %d; got %d", specIndex, spec.expFreq, got)
+		}
+
+		if got := drv.Mask(); got != spec.expMask {
+			t.Errorf("[spec %d] expected mask to be 0x%x; got 0x%x", specIndex, spec.expMask, got)
+		}
+
+		if exp, got := uint64(0x100000042)&spec.expMask, drv.Read(); got != exp {
+			t.Errorf("[spec %d] expected Read to return 0x%x; got 0x%x", specIndex, exp, got)
+		}
+
+		if Active() != drv || drv.Name() != "hpet" || drv.Rating() != Rating {
+			t.Errorf("[spec %d] expected initialized driver to be registered as the active HPET", specIndex)
+		}
+	}
+}
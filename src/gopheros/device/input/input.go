@@ -0,0 +1,185 @@
+// Package input implements a multiplexer for the events reported by input
+// device drivers such as keyboards and mice.
+//
+// Drivers report events from their interrupt handlers via Report. Events are
+// queued and then delivered to the registered handlers by the softirq daemon
+// so that handlers run with interrupts enabled. Events that are reported
+// together (e.g. the motion and button state changes decoded from a single
+// mouse packet) are terminated by an EventSync event.
+package input
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/softirq"
+)
+
+// EventType describes the kind of an input event.
+type EventType uint8
+
+// The list of supported event types.
+const (
+	// EventSync marks the end of a group of events that were reported
+	// together by a device.
+	EventSync EventType = iota
+
+	// EventKey reports a key or button state change. The event Code
+	// contains the key or button code and Value is set to 1 when the key
+	// is pressed and 0 when it is released.
+	EventKey
+
+	// EventRel reports a relative change for one of the axes of a device.
+	// The event Code contains the axis and Value contains the signed delta.
+	EventRel
+)
+
+// Relative axis codes for EventRel events. Positive deltas indicate motion to
+// the right, down and, for the wheel, scrolling up.
+const (
+	RelX uint16 = iota
+	RelY
+	RelWheel
+)
+
+// Button codes for EventKey events reported by pointing devices. Buttons use
+// the same code space as keyboard keys and are allocated after them.
+const (
+	BtnLeft uint16 = 0x110 + iota
+	BtnRight
+	BtnMiddle
+)
+
+// Event describes a state change reported by an input device.
+type Event struct {
+	Type  EventType
+	Code  uint16
+	Value int32
+}
+
+// Handler is a function that receives input events. Handlers are invoked by
+// the softirq daemon and should not block.
+type Handler func(*Event)
+
+const (
+	// queueSize is the number of events that can be buffered until they
+	// are delivered to the registered handlers.
+	queueSize = 256
+)
+
+var (
+	// queue is a ring buffer that holds the events that have not been
+	// delivered yet. It is statically allocated so that Report does not
+	// allocate memory while running in interrupt context.
+	queue      [queueSize]Event
+	queueHead  uint32
+	queueCount uint32
+
+	// dropped counts the events that were discarded because the queue was
+	// full.
+	dropped uint64
+
+	handlers []Handler
+
+	// The following functions are used by tests to mock calls to the cpu,
+	// cmdline and softirq packages.
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn  = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	registerSoftIRQFn   = softirq.Register
+	raiseSoftIRQFn      = softirq.Raise
+	cmdlineGetFn        = cmdline.Get
+)
+
+// Init registers the softirq handler that delivers queued events. Events that
+// are reported before Init is invoked are delivered once the softirq daemon
+// runs.
+//
+// If a keymap is selected via the keymap boot option (e.g. keymap=de), Init
+// also loads it from the root filesystem. As the built-in US keymap remains
+// active if the keymap cannot be loaded, such errors are reported but not
+// returned.
+func Init() *kernel.Error {
+	if err := registerSoftIRQFn(softirq.Input, deliver); err != nil {
+		return err
+	}
+
+	if name := cmdlineGetFn("keymap"); name != "" {
+		if err := LoadKeymap(name); err != nil {
+			kfmt.Printf("[input] could not load keymap %s: %s\n", name, err.Message)
+		}
+	}
+
+	return nil
+}
+
+// AddHandler registers a handler for all input events.
+func AddHandler(handler Handler) {
+	if handler == nil {
+		return
+	}
+
+	intr := lock()
+	handlers = append(handlers, handler)
+	unlock(intr)
+}
+
+// Report queues an event for delivery. It never blocks and can be invoked
+// from interrupt handlers. If the queue is full, the event is discarded.
+func Report(ev Event) {
+	intr := lock()
+	if queueCount == queueSize {
+		dropped++
+		unlock(intr)
+		return
+	}
+
+	queue[(queueHead+queueCount)%queueSize] = ev
+	queueCount++
+	unlock(intr)
+
+	// Only wake up the softirq daemon once a group of events is complete.
+	if ev.Type == EventSync {
+		raiseSoftIRQFn(softirq.Input)
+	}
+}
+
+// Dropped returns the number of events that were discarded because they
+// could not be delivered in time.
+func Dropped() uint64 {
+	return dropped
+}
+
+// deliver dispatches the queued events to the registered handlers.
+func deliver() {
+	for {
+		intr := lock()
+		if queueCount == 0 {
+			unlock(intr)
+			return
+		}
+
+		ev := queue[queueHead]
+		queueHead = (queueHead + 1) % queueSize
+		queueCount--
+		targets := handlers
+		unlock(intr)
+
+		for _, handler := range targets {
+			handler(&ev)
+		}
+	}
+}
+
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+	return intr
+}
+
+func unlock(intr bool) {
+	if intr {
+		enableInterruptsFn()
+	}
+}
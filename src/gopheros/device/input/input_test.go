@@ -0,0 +1,158 @@
+package input
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/softirq"
+	"gopheros/kernel/vfs"
+	"testing"
+)
+
+func restoreMocks() {
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	registerSoftIRQFn = softirq.Register
+	raiseSoftIRQFn = softirq.Raise
+	cmdlineGetFn = cmdline.Get
+	readFileFn = vfs.ReadFile
+	activeKeymap = usKeymap
+	queueHead, queueCount, dropped = 0, 0, 0
+	handlers = nil
+}
+
+func mockInterrupts() {
+	interruptsEnabledFn = func() bool { return true }
+	enableInterruptsFn = func() {}
+	disableInterruptsFn = func() {}
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		gotVector softirq.Vector
+		gotFn     softirq.Handler
+		expErr    = &kernel.Error{Module: "test", Message: "vector in use"}
+	)
+	registerSoftIRQFn = func(vector softirq.Vector, fn softirq.Handler) *kernel.Error {
+		gotVector, gotFn = vector, fn
+		return expErr
+	}
+
+	if err := Init(); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	if gotVector != softirq.Input || gotFn == nil {
+		t.Fatalf("expected a handler to be registered for the input softirq vector")
+	}
+
+	// Keymap errors are not fatal
+	registerSoftIRQFn = func(softirq.Vector, softirq.Handler) *kernel.Error { return nil }
+	cmdlineGetFn = func(name string) string {
+		if name == "keymap" {
+			return "de"
+		}
+		return ""
+	}
+
+	for specIndex, readErr := range []*kernel.Error{expErr, nil} {
+		var readPath string
+		readFileFn = func(path string) ([]byte, *kernel.Error) {
+			readPath = path
+			return []byte("21 +z Z\n"), readErr
+		}
+
+		if err := Init(); err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+
+		if exp := "/keymaps/de.kmap"; readPath != exp {
+			t.Errorf("[spec %d] expected keymap to be loaded from %q; got %q", specIndex, exp, readPath)
+		}
+
+		if expName := [...]string{"us", "de"}[specIndex]; ActiveKeymap().Name != expName {
+			t.Errorf("[spec %d] expected active keymap to be %q; got %q", specIndex, expName, ActiveKeymap().Name)
+		}
+	}
+}
+
+func TestReportAndDeliver(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var raised int
+	raiseSoftIRQFn = func(vector softirq.Vector) {
+		if vector != softirq.Input {
+			t.Errorf("expected the input softirq vector to be raised; got %d", vector)
+		}
+		raised++
+	}
+
+	var got1, got2 []Event
+	AddHandler(func(ev *Event) { got1 = append(got1, *ev) })
+	AddHandler(nil)
+	AddHandler(func(ev *Event) { got2 = append(got2, *ev) })
+
+	events := []Event{
+		{Type: EventRel, Code: RelX, Value: -4},
+		{Type: EventKey, Code: BtnLeft, Value: 1},
+		{Type: EventSync},
+	}
+	for _, ev := range events {
+		Report(ev)
+	}
+
+	if raised != 1 {
+		t.Fatalf("expected the softirq to be raised once per event group; got %d", raised)
+	}
+
+	deliver()
+
+	for handlerIndex, got := range [][]Event{got1, got2} {
+		if len(got) != len(events) {
+			t.Errorf("[handler %d] expected %d events; got %d", handlerIndex, len(events), len(got))
+			continue
+		}
+
+		for i, ev := range events {
+			if got[i] != ev {
+				t.Errorf("[handler %d] expected event %d to be %+v; got %+v", handlerIndex, i, ev, got[i])
+			}
+		}
+	}
+
+	if queueCount != 0 {
+		t.Fatalf("expected queue to be drained; %d events remain", queueCount)
+	}
+}
+
+func TestReportQueueFull(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	raiseSoftIRQFn = func(_ softirq.Vector) {}
+
+	for i := 0; i < queueSize+10; i++ {
+		Report(Event{Type: EventRel, Code: RelX, Value: int32(i)})
+	}
+
+	if exp := uint64(10); Dropped() != exp {
+		t.Fatalf("expected %d dropped events; got %d", exp, Dropped())
+	}
+
+	var (
+		count int
+		last  int32
+	)
+	AddHandler(func(ev *Event) {
+		count++
+		last = ev.Value
+	})
+	deliver()
+
+	if count != queueSize || last != queueSize-1 {
+		t.Fatalf("expected the first %d events to be delivered; got %d events (last value %d)", queueSize, count, last)
+	}
+}
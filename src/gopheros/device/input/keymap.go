@@ -0,0 +1,272 @@
+package input
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/vfs"
+	"unicode/utf8"
+)
+
+const (
+	// NumKeyCodes is the number of key codes that can be mapped by a
+	// keymap.
+	NumKeyCodes = 128
+
+	// KeymapDir is the directory that LoadKeymap searches for keymap
+	// files. Each keymap is stored in a file called NAME.kmap.
+	KeymapDir = "/keymaps"
+
+	// USKeymapName is the name of the built-in keymap.
+	USKeymapName = "us"
+)
+
+// KeyLevel selects one of the characters that a key produces depending on the
+// state of the modifier keys.
+type KeyLevel uint8
+
+// The supported key levels.
+const (
+	LevelPlain KeyLevel = iota
+	LevelShift
+	LevelAltGr
+	numKeyLevels
+)
+
+// keymapEntry describes the characters produced by a key.
+type keymapEntry struct {
+	levels [numKeyLevels]rune
+
+	// caps is set if caps lock inverts the effect of shift for the key.
+	caps bool
+}
+
+// Keymap translates key codes to the characters they produce on a particular
+// keyboard layout.
+type Keymap struct {
+	// Name is the name of the layout (e.g. "de").
+	Name string
+
+	entries [NumKeyCodes]keymapEntry
+}
+
+var (
+	errKeymapSyntax  = &kernel.Error{Module: "input", Message: "keymap contains a malformed entry"}
+	errKeymapKeyCode = &kernel.Error{Module: "input", Message: "keymap contains an invalid key code"}
+	errKeymapName    = &kernel.Error{Module: "input", Message: "invalid keymap name"}
+
+	usKeymap = newUSKeymap()
+
+	// activeKeymap is the keymap used for translating key codes.
+	activeKeymap = usKeymap
+
+	// readFileFn is used by tests to mock calls to the vfs package.
+	readFileFn = vfs.ReadFile
+)
+
+// Rune returns the character produced by a key or 0 if the key does not
+// produce a character. If altGr is set, the AltGr level is selected regardless
+// of the shift state. Caps lock inverts the effect of shift for keys that are
+// marked as caps lock sensitive (usually letters).
+func (km *Keymap) Rune(code uint16, shift, altGr, capsLock bool) rune {
+	if int(code) >= len(km.entries) {
+		return 0
+	}
+
+	entry := &km.entries[code]
+	switch {
+	case altGr:
+		return entry.levels[LevelAltGr]
+	case capsLock && entry.caps:
+		shift = !shift
+	}
+
+	if shift {
+		return entry.levels[LevelShift]
+	}
+
+	return entry.levels[LevelPlain]
+}
+
+// ActiveKeymap returns the keymap used for translating key codes.
+func ActiveKeymap() *Keymap {
+	return activeKeymap
+}
+
+// SetKeymap replaces the active keymap. Passing nil restores the built-in US
+// keymap.
+func SetKeymap(km *Keymap) {
+	if km == nil {
+		km = usKeymap
+	}
+
+	activeKeymap = km
+}
+
+// LoadKeymap loads the keymap with the specified name from KeymapDir and makes
+// it the active keymap. The name "us" selects the built-in keymap.
+func LoadKeymap(name string) *kernel.Error {
+	if name == USKeymapName {
+		SetKeymap(nil)
+		return nil
+	}
+
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' || name[i] == '.' {
+			return errKeymapName
+		}
+	}
+
+	data, err := readFileFn(KeymapDir + "/" + name + ".kmap")
+	if err != nil {
+		return err
+	}
+
+	km, err := ParseKeymap(name, data)
+	if err != nil {
+		return err
+	}
+
+	SetKeymap(km)
+	return nil
+}
+
+// ParseKeymap parses a keymap definition. Entries in the definition override
+// the corresponding entries of the built-in US keymap so a definition only
+// needs to list the keys whose characters differ.
+//
+// Each line of the definition contains a decimal key code followed by up to
+// three whitespace-separated values that specify the characters produced by
+// the key on its own, together with shift and together with AltGr. Omitted
+// values do not produce a character. Each value is either a single (UTF-8
+// encoded) character, a code point in the U+XXXX notation or a '-' if the key
+// produces no character at that level. A '+' in front of the first value
+// marks the key as caps lock sensitive. Empty lines and lines starting with a
+// '#' are ignored. For example:
+//
+//	# z and y are swapped on a German keyboard
+//	21 +z Z
+//	44 +y Y
+//	16 +q Q @
+//	26 +ü Ü
+func ParseKeymap(name string, data []byte) (*Keymap, *kernel.Error) {
+	km := &Keymap{Name: name, entries: usKeymap.entries}
+
+	for len(data) != 0 {
+		var line []byte
+		line, data = nextLine(data)
+
+		fields := splitFields(line)
+		if len(fields) == 0 || fields[0][0] == '#' {
+			continue
+		}
+
+		if len(fields) > 1+int(numKeyLevels) {
+			return nil, errKeymapSyntax
+		}
+
+		code, ok := parseDecimal(fields[0])
+		if !ok || code >= NumKeyCodes {
+			return nil, errKeymapKeyCode
+		}
+
+		entry := keymapEntry{}
+		for level, field := range fields[1:] {
+			if level == int(LevelPlain) && len(field) > 1 && field[0] == '+' {
+				entry.caps, field = true, field[1:]
+			}
+
+			r, ok := parseKeymapValue(field)
+			if !ok {
+				return nil, errKeymapSyntax
+			}
+			entry.levels[level] = r
+		}
+
+		km.entries[code] = entry
+	}
+
+	return km, nil
+}
+
+// parseKeymapValue decodes a keymap value into a character.
+func parseKeymapValue(field []byte) (rune, bool) {
+	switch {
+	case len(field) == 1 && field[0] == '-':
+		return 0, true
+	case len(field) > 2 && field[0] == 'U' && field[1] == '+':
+		var r rune
+		for _, ch := range field[2:] {
+			var digit byte
+			switch {
+			case ch >= '0' && ch <= '9':
+				digit = ch - '0'
+			case ch >= 'a' && ch <= 'f':
+				digit = ch - 'a' + 10
+			case ch >= 'A' && ch <= 'F':
+				digit = ch - 'A' + 10
+			default:
+				return 0, false
+			}
+
+			if r = r<<4 | rune(digit); r > utf8.MaxRune {
+				return 0, false
+			}
+		}
+		return r, utf8.ValidRune(r)
+	}
+
+	r, size := utf8.DecodeRune(field)
+	if r == utf8.RuneError || size != len(field) {
+		return 0, false
+	}
+
+	return r, true
+}
+
+// nextLine returns the first line in data and the remaining data.
+func nextLine(data []byte) ([]byte, []byte) {
+	for i, ch := range data {
+		if ch == '\n' {
+			return data[:i], data[i+1:]
+		}
+	}
+
+	return data, nil
+}
+
+// splitFields splits a line into its whitespace-separated fields.
+func splitFields(line []byte) [][]byte {
+	var (
+		fields [][]byte
+		start  = -1
+	)
+
+	for i, ch := range line {
+		isSpace := ch == ' ' || ch == '\t' || ch == '\r'
+		switch {
+		case isSpace && start != -1:
+			fields = append(fields, line[start:i])
+			start = -1
+		case !isSpace && start == -1:
+			start = i
+		}
+	}
+
+	if start != -1 {
+		fields = append(fields, line[start:])
+	}
+
+	return fields
+}
+
+// parseDecimal parses an unsigned decimal number.
+func parseDecimal(field []byte) (uint64, bool) {
+	var v uint64
+	for _, ch := range field {
+		if ch < '0' || ch > '9' || v > NumKeyCodes {
+			return 0, false
+		}
+		v = v*10 + uint64(ch-'0')
+	}
+
+	return v, len(field) != 0
+}
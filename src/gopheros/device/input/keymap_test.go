@@ -0,0 +1,173 @@
+package input
+
+import (
+	"gopheros/kernel"
+	"io/ioutil"
+	"testing"
+)
+
+func TestKeymapRune(t *testing.T) {
+	km := ActiveKeymap()
+	if km.Name != USKeymapName {
+		t.Fatalf("expected the US keymap to be active by default; got %q", km.Name)
+	}
+
+	specs := []struct {
+		code                   uint16
+		shift, altGr, capsLock bool
+		exp                    rune
+	}{
+		{KeyA, false, false, false, 'a'},
+		{KeyA, true, false, false, 'A'},
+		{KeyA, false, false, true, 'A'},
+		{KeyA, true, false, true, 'a'},
+		{Key1, false, false, true, '1'},
+		{Key1, true, false, true, '!'},
+		{KeyA, false, true, false, 0},
+		{KeyF1, false, false, false, 0},
+		{NumKeyCodes, false, false, false, 0},
+	}
+
+	for specIndex, spec := range specs {
+		if got := km.Rune(spec.code, spec.shift, spec.altGr, spec.capsLock); got != spec.exp {
+			t.Errorf("[spec %d] expected rune %d; got %d", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestParseKeymap(t *testing.T) {
+	km, err := ParseKeymap("test", []byte("# comment\r\n\n  16\t+q Q  @\r\n21 +z Z\n30 - U+00c4\n\t44 +U+00fc U+00DC U+20ac\n86 < > |\n12 + -"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if km.Name != "test" {
+		t.Errorf("expected keymap name to be %q; got %q", "test", km.Name)
+	}
+
+	specs := []struct {
+		code                   uint16
+		shift, altGr, capsLock bool
+		exp                    rune
+	}{
+		{KeyQ, false, true, false, '@'},
+		{KeyQ, false, false, true, 'Q'},
+		{KeyY, false, false, false, 'z'},
+		{KeyY, true, true, false, 0},
+		{KeyA, false, false, false, 0},
+		{KeyA, true, false, false, 'Ä'},
+		{KeyZ, false, false, true, 'Ü'},
+		{KeyZ, false, true, false, '€'},
+		{Key102nd, true, false, false, '>'},
+		{KeyMinus, false, false, false, '+'},
+		{KeyMinus, true, false, false, 0},
+		// Keys that are not listed are inherited from the US keymap
+		{KeyW, true, false, false, 'W'},
+		{KeySpace, false, false, false, ' '},
+	}
+
+	for specIndex, spec := range specs {
+		if got := km.Rune(spec.code, spec.shift, spec.altGr, spec.capsLock); got != spec.exp {
+			t.Errorf("[spec %d] expected rune %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+
+	if got := ActiveKeymap().Rune(KeyY, false, false, false); got != 'y' {
+		t.Errorf("expected the US keymap to remain unmodified; got %q for KeyY", got)
+	}
+
+	errSpecs := []struct {
+		input  string
+		expErr *kernel.Error
+	}{
+		{"x a A", errKeymapKeyCode},
+		{"128 a A", errKeymapKeyCode},
+		{"99999999999999999999999 a", errKeymapKeyCode},
+		{"16 q Q @ x", errKeymapSyntax},
+		{"16 qq", errKeymapSyntax},
+		{"16 q U+", errKeymapSyntax},
+		{"16 q U+00g1", errKeymapSyntax},
+		{"16 q U+110000", errKeymapSyntax},
+		{"16 q U+d800", errKeymapSyntax},
+		{"16 \xff", errKeymapSyntax},
+	}
+
+	for specIndex, spec := range errSpecs {
+		if _, err := ParseKeymap("test", []byte(spec.input)); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
+
+func TestLoadKeymap(t *testing.T) {
+	defer restoreMocks()
+
+	var readPath string
+	readFileFn = func(path string) ([]byte, *kernel.Error) {
+		readPath = path
+		return []byte("21 +z Z\n44 +y Y"), nil
+	}
+
+	if err := LoadKeymap("de"); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := "/keymaps/de.kmap"; readPath != exp {
+		t.Fatalf("expected keymap to be loaded from %q; got %q", exp, readPath)
+	}
+
+	if km := ActiveKeymap(); km.Name != "de" || km.Rune(KeyY, false, false, false) != 'z' {
+		t.Fatal("expected the loaded keymap to become active")
+	}
+
+	if err := LoadKeymap(USKeymapName); err != nil || ActiveKeymap() != usKeymap {
+		t.Fatalf("expected the built-in keymap to be restored; got error %v", err)
+	}
+
+	for _, name := range []string{"../etc/passwd", "de.bak"} {
+		if err := LoadKeymap(name); err != errKeymapName {
+			t.Errorf("expected to get errKeymapName for %q; got %v", name, err)
+		}
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "not found"}
+	readFileFn = func(string) ([]byte, *kernel.Error) { return nil, expErr }
+	if err := LoadKeymap("fr"); err != expErr {
+		t.Fatalf("expected to get error %v; got %v", expErr, err)
+	}
+
+	readFileFn = func(string) ([]byte, *kernel.Error) { return []byte("16 qq"), nil }
+	if err := LoadKeymap("fr"); err != errKeymapSyntax || ActiveKeymap() != usKeymap {
+		t.Fatalf("expected to get errKeymapSyntax and keep the active keymap; got %v", err)
+	}
+}
+
+func TestBundledKeymaps(t *testing.T) {
+	data, err := ioutil.ReadFile("../../../../initrd/keymaps/de.kmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	km, kerr := ParseKeymap("de", data)
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+
+	for specIndex, spec := range []struct {
+		code         uint16
+		shift, altGr bool
+		exp          rune
+	}{
+		{KeyY, false, false, 'z'},
+		{KeyZ, true, false, 'Y'},
+		{KeyQ, false, true, '@'},
+		{KeyMinus, false, false, 'ß'},
+		{KeySlash, false, false, '-'},
+		{KeyApostrophe, true, false, 'Ä'},
+		{Key102nd, false, true, '|'},
+	} {
+		if got := km.Rune(spec.code, spec.shift, spec.altGr, false); got != spec.exp {
+			t.Errorf("[spec %d] expected rune %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package input
+
+// newUSKeymap returns the built-in keymap for the US keyboard layout.
+func newUSKeymap() *Keymap {
+	return &Keymap{
+		Name: USKeymapName,
+		entries: [NumKeyCodes]keymapEntry{
+			Key1:          key('1', '!'),
+			Key2:          key('2', '@'),
+			Key3:          key('3', '#'),
+			Key4:          key('4', '$'),
+			Key5:          key('5', '%'),
+			Key6:          key('6', '^'),
+			Key7:          key('7', '&'),
+			Key8:          key('8', '*'),
+			Key9:          key('9', '('),
+			Key0:          key('0', ')'),
+			KeyMinus:      key('-', '_'),
+			KeyEqual:      key('=', '+'),
+			KeyQ:          letter('q', 'Q'),
+			KeyW:          letter('w', 'W'),
+			KeyE:          letter('e', 'E'),
+			KeyR:          letter('r', 'R'),
+			KeyT:          letter('t', 'T'),
+			KeyY:          letter('y', 'Y'),
+			KeyU:          letter('u', 'U'),
+			KeyI:          letter('i', 'I'),
+			KeyO:          letter('o', 'O'),
+			KeyP:          letter('p', 'P'),
+			KeyLeftBrace:  key('[', '{'),
+			KeyRightBrace: key(']', '}'),
+			KeyA:          letter('a', 'A'),
+			KeyS:          letter('s', 'S'),
+			KeyD:          letter('d', 'D'),
+			KeyF:          letter('f', 'F'),
+			KeyG:          letter('g', 'G'),
+			KeyH:          letter('h', 'H'),
+			KeyJ:          letter('j', 'J'),
+			KeyK:          letter('k', 'K'),
+			KeyL:          letter('l', 'L'),
+			KeySemicolon:  key(';', ':'),
+			KeyApostrophe: key('\'', '"'),
+			KeyGrave:      key('`', '~'),
+			KeyBackslash:  key('\\', '|'),
+			KeyZ:          letter('z', 'Z'),
+			KeyX:          letter('x', 'X'),
+			KeyC:          letter('c', 'C'),
+			KeyV:          letter('v', 'V'),
+			KeyB:          letter('b', 'B'),
+			KeyN:          letter('n', 'N'),
+			KeyM:          letter('m', 'M'),
+			KeyComma:      key(',', '<'),
+			KeyDot:        key('.', '>'),
+			KeySlash:      key('/', '?'),
+			KeyKPAsterisk: key('*', '*'),
+			KeySpace:      key(' ', ' '),
+			KeyKP7:        key('7', '7'),
+			KeyKP8:        key('8', '8'),
+			KeyKP9:        key('9', '9'),
+			KeyKPMinus:    key('-', '-'),
+			KeyKP4:        key('4', '4'),
+			KeyKP5:        key('5', '5'),
+			KeyKP6:        key('6', '6'),
+			KeyKPPlus:     key('+', '+'),
+			KeyKP1:        key('1', '1'),
+			KeyKP2:        key('2', '2'),
+			KeyKP3:        key('3', '3'),
+			KeyKP0:        key('0', '0'),
+			KeyKPDot:      key('.', '.'),
+		},
+	}
+}
+
+// key returns a keymap entry for a key that produces the specified characters
+// with and without shift.
+func key(plain, shift rune) keymapEntry {
+	return keymapEntry{levels: [numKeyLevels]rune{plain, shift}}
+}
+
+// letter returns a keymap entry for a key that is affected by caps lock.
+func letter(plain, shift rune) keymapEntry {
+	return keymapEntry{levels: [numKeyLevels]rune{plain, shift}, caps: true}
+}
@@ -0,0 +1,116 @@
+package input
+
+// Key codes for EventKey events reported by keyboards. Codes 1-88 match the
+// scan codes of scan code set 1 so that drivers for keyboards using this set
+// only need to translate the extended (0xe0-prefixed) scan codes.
+const (
+	KeyEsc uint16 = 1 + iota
+	Key1
+	Key2
+	Key3
+	Key4
+	Key5
+	Key6
+	Key7
+	Key8
+	Key9
+	Key0
+	KeyMinus
+	KeyEqual
+	KeyBackspace
+	KeyTab
+	KeyQ
+	KeyW
+	KeyE
+	KeyR
+	KeyT
+	KeyY
+	KeyU
+	KeyI
+	KeyO
+	KeyP
+	KeyLeftBrace
+	KeyRightBrace
+	KeyEnter
+	KeyLeftCtrl
+	KeyA
+	KeyS
+	KeyD
+	KeyF
+	KeyG
+	KeyH
+	KeyJ
+	KeyK
+	KeyL
+	KeySemicolon
+	KeyApostrophe
+	KeyGrave
+	KeyLeftShift
+	KeyBackslash
+	KeyZ
+	KeyX
+	KeyC
+	KeyV
+	KeyB
+	KeyN
+	KeyM
+	KeyComma
+	KeyDot
+	KeySlash
+	KeyRightShift
+	KeyKPAsterisk
+	KeyLeftAlt
+	KeySpace
+	KeyCapsLock
+	KeyF1
+	KeyF2
+	KeyF3
+	KeyF4
+	KeyF5
+	KeyF6
+	KeyF7
+	KeyF8
+	KeyF9
+	KeyF10
+	KeyNumLock
+	KeyScrollLock
+	KeyKP7
+	KeyKP8
+	KeyKP9
+	KeyKPMinus
+	KeyKP4
+	KeyKP5
+	KeyKP6
+	KeyKPPlus
+	KeyKP1
+	KeyKP2
+	KeyKP3
+	KeyKP0
+	KeyKPDot
+)
+
+// Key codes for keys that are not part of the contiguous block above.
+const (
+	Key102nd     uint16 = 86
+	KeyF11       uint16 = 87
+	KeyF12       uint16 = 88
+	KeyKPEnter   uint16 = 96
+	KeyRightCtrl uint16 = 97
+	KeyKPSlash   uint16 = 98
+	KeySysRq     uint16 = 99
+	KeyRightAlt  uint16 = 100
+	KeyHome      uint16 = 102
+	KeyUp        uint16 = 103
+	KeyPageUp    uint16 = 104
+	KeyLeft      uint16 = 105
+	KeyRight     uint16 = 106
+	KeyEnd       uint16 = 107
+	KeyDown      uint16 = 108
+	KeyPageDown  uint16 = 109
+	KeyInsert    uint16 = 110
+	KeyDelete    uint16 = 111
+	KeyPause     uint16 = 119
+	KeyLeftMeta  uint16 = 125
+	KeyRightMeta uint16 = 126
+	KeyCompose   uint16 = 127
+)
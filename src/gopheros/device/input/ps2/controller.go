@@ -0,0 +1,194 @@
+// Package ps2 provides drivers for devices attached to the 8042 PS/2
+// controller found on PC-compatible systems.
+package ps2
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+)
+
+const (
+	dataPort    = uint16(0x60)
+	statusPort  = uint16(0x64)
+	commandPort = uint16(0x64)
+
+	// Status register bits.
+	statusOutputFull = uint8(1 << 0)
+	statusInputFull  = uint8(1 << 1)
+	statusAuxData    = uint8(1 << 5)
+
+	// Controller commands.
+	ctrlReadConfig  = uint8(0x20)
+	ctrlWriteConfig = uint8(0x60)
+	ctrlDisableAux  = uint8(0xa7)
+	ctrlEnableAux   = uint8(0xa8)
+	ctrlTestAux     = uint8(0xa9)
+	ctrlWriteAux    = uint8(0xd4)
+	ctrlPulseReset  = uint8(0xfe)
+
+	// Controller configuration byte bits.
+	configKbdIRQ           = uint8(1 << 0)
+	configAuxIRQ           = uint8(1 << 1)
+	configKbdClockDisabled = uint8(1 << 4)
+	configAuxClockDisabled = uint8(1 << 5)
+	configTranslation      = uint8(1 << 6)
+
+	// Responses sent by the controller and the attached devices.
+	auxTestPassed  = uint8(0x00)
+	devAck         = uint8(0xfa)
+	devResend      = uint8(0xfe)
+	devSelfTestOK  = uint8(0xaa)
+	maxSendRetries = 3
+
+	// maxWaitSpins bounds the number of status register polls while
+	// waiting for the controller. Device resets can take several hundred
+	// milliseconds to complete so the limit is deliberately generous.
+	maxWaitSpins = 1000000
+
+	// maxFlushBytes bounds the number of stale bytes that are discarded
+	// from the controller output buffer.
+	maxFlushBytes = 32
+)
+
+var (
+	errTimeout    = &kernel.Error{Module: "ps2", Message: "timed out waiting for the PS/2 controller"}
+	errNoAck      = &kernel.Error{Module: "ps2", Message: "device did not acknowledge command"}
+	errAuxTest    = &kernel.Error{Module: "ps2", Message: "auxiliary port failed the interface test"}
+	errResetFail  = &kernel.Error{Module: "ps2", Message: "device failed its self-test after reset"}
+	errNoResponse = &kernel.Error{Module: "ps2", Message: "device did not respond to command"}
+
+	// The following functions are used by tests to mock calls to the cpu
+	// package.
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn  = cpu.PortReadByte
+)
+
+// controllerPresent returns true if an 8042 controller appears to be
+// present. Reads from unpopulated I/O ports return 0xff.
+func controllerPresent() bool {
+	return portReadByteFn(statusPort) != 0xff
+}
+
+// waitInput waits until the controller is ready to accept a byte.
+func waitInput() *kernel.Error {
+	for spins := 0; spins < maxWaitSpins; spins++ {
+		if portReadByteFn(statusPort)&statusInputFull == 0 {
+			return nil
+		}
+	}
+
+	return errTimeout
+}
+
+// readData waits for the controller output buffer to fill and returns its
+// contents.
+func readData() (uint8, *kernel.Error) {
+	for spins := 0; spins < maxWaitSpins; spins++ {
+		if portReadByteFn(statusPort)&statusOutputFull != 0 {
+			return portReadByteFn(dataPort), nil
+		}
+	}
+
+	return 0, errTimeout
+}
+
+// flushOutput discards any pending bytes from the controller output buffer.
+func flushOutput() {
+	for i := 0; i < maxFlushBytes && portReadByteFn(statusPort)&statusOutputFull != 0; i++ {
+		portReadByteFn(dataPort)
+	}
+}
+
+// writeCommand sends a command to the controller.
+func writeCommand(cmd uint8) *kernel.Error {
+	if err := waitInput(); err != nil {
+		return err
+	}
+
+	portWriteByteFn(commandPort, cmd)
+	return nil
+}
+
+// writeData writes a byte to the controller data port.
+func writeData(data uint8) *kernel.Error {
+	if err := waitInput(); err != nil {
+		return err
+	}
+
+	portWriteByteFn(dataPort, data)
+	return nil
+}
+
+// readConfig returns the controller configuration byte.
+func readConfig() (uint8, *kernel.Error) {
+	if err := writeCommand(ctrlReadConfig); err != nil {
+		return 0, err
+	}
+
+	return readData()
+}
+
+// writeConfig updates the controller configuration byte.
+func writeConfig(config uint8) *kernel.Error {
+	if err := writeCommand(ctrlWriteConfig); err != nil {
+		return err
+	}
+
+	return writeData(config)
+}
+
+// sendAux sends a byte to the device attached to the auxiliary port and
+// waits for it to be acknowledged.
+func sendAux(data uint8) *kernel.Error {
+	return send(true, data)
+}
+
+// sendKbd sends a byte to the device attached to the keyboard port and waits
+// for it to be acknowledged.
+func sendKbd(data uint8) *kernel.Error {
+	return send(false, data)
+}
+
+// send sends a byte to the device attached to the auxiliary or the keyboard
+// port and waits for it to be acknowledged. The byte is re-sent if the device
+// requests it.
+func send(aux bool, data uint8) *kernel.Error {
+	for attempt := 0; attempt < maxSendRetries; attempt++ {
+		if aux {
+			if err := writeCommand(ctrlWriteAux); err != nil {
+				return err
+			}
+		}
+
+		if err := writeData(data); err != nil {
+			return err
+		}
+
+		res, err := readData()
+		if err != nil {
+			return errNoResponse
+		}
+
+		switch res {
+		case devAck:
+			return nil
+		case devResend:
+			continue
+		default:
+			return errNoAck
+		}
+	}
+
+	return errNoAck
+}
+
+// Reboot resets the system by pulsing the CPU reset line which is wired to
+// one of the 8042 output pins on PC-compatible systems. Reboot returns if the
+// controller is not present or fails to reset the CPU.
+func Reboot() {
+	if !controllerPresent() || waitInput() != nil {
+		return
+	}
+
+	portWriteByteFn(commandPort, ctrlPulseReset)
+}
@@ -0,0 +1,199 @@
+package ps2
+
+import (
+	"gopheros/device"
+	"gopheros/device/input"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+const (
+	kbdIRQ = uint8(1)
+
+	// Keyboard commands.
+	kbdSetDefaults    = uint8(0xf6)
+	kbdEnableScanning = uint8(0xf4)
+
+	// Scan code set 1 prefixes and flags.
+	scanExtended = uint8(0xe0)
+	scanPause    = uint8(0xe1)
+	scanRelease  = uint8(0x80)
+
+	// pauseSeqLen is the number of bytes that follow the pause prefix. The
+	// pause key does not generate a release sequence.
+	pauseSeqLen = 5
+
+	// maxBaseScanCode is the largest non-extended scan code that maps to a
+	// key code with the same value. Within this range, scanAltSysRq is sent
+	// when SysRq is pressed together with Alt and scanUnused is not
+	// assigned to any key.
+	maxBaseScanCode = uint8(0x58)
+	scanAltSysRq    = uint8(0x54)
+	scanUnused      = uint8(0x55)
+)
+
+var (
+	// extendedKeys maps the scan codes that follow the extended prefix to
+	// key codes. Codes that are not listed (e.g. the fake shift sequences
+	// sent around navigation keys) are ignored.
+	extendedKeys = [...]uint16{
+		0x1c: input.KeyKPEnter,
+		0x1d: input.KeyRightCtrl,
+		0x35: input.KeyKPSlash,
+		0x37: input.KeySysRq,
+		0x38: input.KeyRightAlt,
+		0x47: input.KeyHome,
+		0x48: input.KeyUp,
+		0x49: input.KeyPageUp,
+		0x4b: input.KeyLeft,
+		0x4d: input.KeyRight,
+		0x4f: input.KeyEnd,
+		0x50: input.KeyDown,
+		0x51: input.KeyPageDown,
+		0x52: input.KeyInsert,
+		0x53: input.KeyDelete,
+		0x5b: input.KeyLeftMeta,
+		0x5c: input.KeyRightMeta,
+		0x5d: input.KeyCompose,
+	}
+)
+
+// Keyboard implements a driver for PS/2 keyboards attached to the first port
+// of the 8042 controller. The controller is configured to translate the scan
+// codes sent by the keyboard to scan code set 1; decoded key presses and
+// releases are delivered to the input subsystem.
+type Keyboard struct {
+	// extended is set after receiving the extended scan code prefix.
+	extended bool
+
+	// skip counts the remaining bytes of a pause key sequence.
+	skip uint8
+}
+
+// DriverName returns the name of this driver.
+func (*Keyboard) DriverName() string {
+	return "ps2_keyboard"
+}
+
+// DriverVersion returns the version of this driver.
+func (*Keyboard) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit initializes this driver.
+func (k *Keyboard) DriverInit(w io.Writer) *kernel.Error {
+	flushOutput()
+
+	// Mask the keyboard IRQ while the keyboard is set up by polling.
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	config &^= configKbdIRQ
+	if err = writeConfig(config); err != nil {
+		return err
+	}
+
+	if err = sendKbd(kbdSetDefaults); err != nil {
+		return err
+	}
+
+	if err = sendKbd(kbdEnableScanning); err != nil {
+		return err
+	}
+
+	if err = registerIRQFn(irq.ISAIRQToGSI(kbdIRQ), k.handleIRQ); err != nil {
+		return err
+	}
+
+	config = (config | configKbdIRQ | configTranslation) &^ configKbdClockDisabled
+	if err = writeConfig(config); err != nil {
+		return err
+	}
+
+	kfmt.Fprintf(w, "translated scan code set 1\n")
+	return nil
+}
+
+// handleIRQ reads a byte from the controller if it originates from the
+// keyboard port.
+func (k *Keyboard) handleIRQ(_ *gate.Registers) bool {
+	status := portReadByteFn(statusPort)
+	if status&statusOutputFull == 0 || status&statusAuxData != 0 {
+		return false
+	}
+
+	k.feed(portReadByteFn(dataPort))
+	return true
+}
+
+// feed decodes a scan code byte and reports the key event it completes.
+func (k *Keyboard) feed(b uint8) {
+	switch {
+	case k.skip != 0:
+		k.skip--
+		return
+	case b == scanPause:
+		k.skip = pauseSeqLen
+		reportFn(input.Event{Type: input.EventKey, Code: input.KeyPause, Value: 1})
+		reportFn(input.Event{Type: input.EventKey, Code: input.KeyPause, Value: 0})
+		reportFn(input.Event{Type: input.EventSync})
+		return
+	case b == scanExtended:
+		k.extended = true
+		return
+	}
+
+	var (
+		code  uint16
+		value = int32(1)
+	)
+
+	if b&scanRelease != 0 {
+		b, value = b&^scanRelease, 0
+	}
+
+	switch {
+	case k.extended:
+		k.extended = false
+		if int(b) < len(extendedKeys) {
+			code = extendedKeys[b]
+		}
+	case b == scanAltSysRq:
+		code = input.KeySysRq
+	case b <= maxBaseScanCode && b != scanUnused:
+		code = uint16(b)
+	}
+
+	// Scan codes without a key code (including the 0x00 and 0xff error
+	// codes) are dropped.
+	if code == 0 {
+		return
+	}
+
+	reportFn(input.Event{Type: input.EventKey, Code: code, Value: value})
+	reportFn(input.Event{Type: input.EventSync})
+}
+
+// probeForPS2Keyboard returns a keyboard driver if an 8042 controller is
+// present. Whether a keyboard is actually attached is checked by DriverInit.
+func probeForPS2Keyboard() device.Driver {
+	if !controllerPresent() {
+		return nil
+	}
+
+	return &Keyboard{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:    "ps2_keyboard",
+		Order:   device.DetectOrderLast,
+		Probe:   probeForPS2Keyboard,
+		ACPIIDs: []string{"PNP0303", "PNP030B"},
+	})
+}
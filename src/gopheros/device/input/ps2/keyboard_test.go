@@ -0,0 +1,202 @@
+package ps2
+
+import (
+	"bytes"
+	"gopheros/device/input"
+	"gopheros/kernel"
+	"gopheros/kernel/irq"
+	"reflect"
+	"testing"
+)
+
+func (m *mock8042) keyboard(val uint8) {
+	if !m.hasKbd {
+		return
+	}
+
+	switch val {
+	case kbdSetDefaults:
+		m.kbdScanning = false
+		m.push(false, devAck)
+	case kbdEnableScanning:
+		m.kbdScanning = true
+		m.push(false, devAck)
+	default:
+		m.push(false, devResend)
+	}
+}
+
+func TestProbeForPS2Keyboard(t *testing.T) {
+	defer restoreMocks()
+
+	ctrl := &mock8042{}
+	ctrl.install()
+	if drv := probeForPS2Keyboard(); drv != nil {
+		t.Fatalf("expected probe to fail when no controller is present")
+	}
+
+	ctrl.present = true
+	if drv := probeForPS2Keyboard(); drv == nil {
+		t.Fatalf("expected probe to return a driver when a controller is present")
+	}
+}
+
+func TestKeyboardDriverInit(t *testing.T) {
+	defer restoreMocks()
+
+	irqErr := &kernel.Error{Module: "test", Message: "no controller"}
+
+	specs := []struct {
+		ctrl   mock8042
+		irqErr *kernel.Error
+		expErr *kernel.Error
+	}{
+		{mock8042{present: true, hasKbd: true}, nil, nil},
+		{mock8042{present: true}, nil, errNoResponse},
+		{mock8042{present: true, hasKbd: true}, irqErr, irqErr},
+	}
+
+	for specIndex, spec := range specs {
+		var (
+			ctrl   = spec.ctrl
+			buf    bytes.Buffer
+			k      Keyboard
+			irqGSI = ^uint32(0)
+		)
+		ctrl.config = configKbdClockDisabled | configAuxIRQ
+		ctrl.install()
+
+		registerIRQFn = func(gsi uint32, fn irq.Handler) *kernel.Error {
+			irqGSI = gsi
+			return spec.irqErr
+		}
+
+		if err := k.DriverInit(&buf); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if spec.expErr != nil {
+			if ctrl.config&configKbdIRQ != 0 {
+				t.Errorf("[spec %d] expected keyboard IRQ to remain disabled", specIndex)
+			}
+			continue
+		}
+
+		if exp := "translated scan code set 1\n"; buf.String() != exp {
+			t.Errorf("[spec %d] expected log output %q; got %q", specIndex, exp, buf.String())
+		}
+
+		if !ctrl.kbdScanning {
+			t.Errorf("[spec %d] expected scanning to be enabled", specIndex)
+		}
+
+		if exp := irq.ISAIRQToGSI(kbdIRQ); irqGSI != exp {
+			t.Errorf("[spec %d] expected an IRQ handler to be registered for GSI %d; got GSI %d", specIndex, exp, irqGSI)
+		}
+
+		if exp := configKbdIRQ | configAuxIRQ | configTranslation; ctrl.config != exp {
+			t.Errorf("[spec %d] expected controller config to be 0x%x; got 0x%x", specIndex, exp, ctrl.config)
+		}
+	}
+}
+
+func TestKeyboardDecode(t *testing.T) {
+	defer restoreMocks()
+
+	var events []input.Event
+	reportFn = func(ev input.Event) { events = append(events, ev) }
+
+	key := func(code uint16, value int32) []input.Event {
+		return []input.Event{{Type: input.EventKey, Code: code, Value: value}, {Type: input.EventSync}}
+	}
+
+	specs := []struct {
+		in  []uint8
+		exp []input.Event
+	}{
+		{[]uint8{0x1e}, key(input.KeyA, 1)},
+		{[]uint8{0x9e}, key(input.KeyA, 0)},
+		{[]uint8{0x58}, key(input.KeyF12, 1)},
+		{[]uint8{0x54}, key(input.KeySysRq, 1)},
+		{[]uint8{0xe0, 0x49}, key(input.KeyPageUp, 1)},
+		{[]uint8{0xe0, 0xc9}, key(input.KeyPageUp, 0)},
+		// Fake shifts around navigation keys are ignored
+		{[]uint8{0xe0, 0x2a, 0xe0, 0x48}, key(input.KeyUp, 1)},
+		{[]uint8{0xe0, 0x7f}, nil},
+		{
+			[]uint8{0xe1, 0x1d, 0x45, 0xe1, 0x9d, 0xc5, 0x01},
+			append(
+				[]input.Event{
+					{Type: input.EventKey, Code: input.KeyPause, Value: 1},
+					{Type: input.EventKey, Code: input.KeyPause, Value: 0},
+					{Type: input.EventSync},
+				},
+				key(input.KeyEsc, 1)...,
+			),
+		},
+		// Unassigned scan codes and controller responses are ignored
+		{[]uint8{0x00, 0x55, 0x59, 0xfa, 0xff}, nil},
+	}
+
+	for specIndex, spec := range specs {
+		var k Keyboard
+		events = nil
+		for _, b := range spec.in {
+			k.feed(b)
+		}
+
+		if !reflect.DeepEqual(events, spec.exp) {
+			t.Errorf("[spec %d] expected events:\n%+v\ngot:\n%+v", specIndex, spec.exp, events)
+		}
+	}
+}
+
+func TestKeyboardHandleIRQ(t *testing.T) {
+	defer restoreMocks()
+
+	var events []input.Event
+	reportFn = func(ev input.Event) { events = append(events, ev) }
+
+	ctrl := &mock8042{present: true}
+	ctrl.install()
+
+	var k Keyboard
+
+	if k.handleIRQ(nil) {
+		t.Fatal("expected handler to return false when the output buffer is empty")
+	}
+
+	ctrl.push(true, 0x08)
+	if k.handleIRQ(nil) {
+		t.Fatal("expected handler to ignore mouse data")
+	}
+
+	ctrl.output, ctrl.outputAux = nil, nil
+	ctrl.push(false, 0x1c)
+	if !k.handleIRQ(nil) {
+		t.Fatal("expected handler to service keyboard data")
+	}
+
+	if exp := 2; len(events) != exp {
+		t.Fatalf("expected %d events; got %+v", exp, events)
+	}
+}
+
+func TestReboot(t *testing.T) {
+	defer restoreMocks()
+
+	ctrl := &mock8042{}
+	ctrl.install()
+
+	Reboot()
+	if ctrl.resetPulsed {
+		t.Fatal("expected Reboot to be a no-op when no controller is present")
+	}
+
+	ctrl.present = true
+	Reboot()
+	if !ctrl.resetPulsed {
+		t.Fatal("expected Reboot to pulse the reset line")
+	}
+}
@@ -0,0 +1,280 @@
+package ps2
+
+import (
+	"gopheros/device"
+	"gopheros/device/input"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+const (
+	mouseIRQ = uint8(12)
+
+	// Mouse commands.
+	mouseReset           = uint8(0xff)
+	mouseSetDefaults     = uint8(0xf6)
+	mouseEnableReporting = uint8(0xf4)
+	mouseSetSampleRate   = uint8(0xf3)
+	mouseGetID           = uint8(0xf2)
+
+	// mouseIDIntelliMouse is the device ID reported by mice once the
+	// scroll wheel extension has been enabled.
+	mouseIDIntelliMouse = uint8(0x03)
+
+	// Bits of the first byte of each movement packet.
+	packetButtons   = uint8(0x07)
+	packetAlwaysOne = uint8(1 << 3)
+	packetXSign     = uint8(1 << 4)
+	packetYSign     = uint8(1 << 5)
+	packetXOverflow = uint8(1 << 6)
+	packetYOverflow = uint8(1 << 7)
+
+	standardPacketSize = 3
+	wheelPacketSize    = 4
+)
+
+var (
+	// intelliMouseKnock is the sample rate sequence that switches a
+	// mouse supporting the IntelliMouse extension into scroll wheel mode.
+	intelliMouseKnock = [...]uint8{200, 100, 80}
+
+	// The following functions are used by tests to mock calls to the irq
+	// and input packages.
+	registerIRQFn = irq.RegisterIRQ
+	reportFn      = input.Report
+)
+
+// Mouse implements a driver for PS/2 mice attached to the auxiliary port of
+// the 8042 controller. Mice that support the IntelliMouse extension are
+// switched to 4-byte packet mode so that scroll wheel motion is also
+// reported. Decoded packets are delivered to the input subsystem.
+type Mouse struct {
+	packetSize uint8
+
+	// packet buffers the bytes of the packet that is being received and
+	// index points to the next byte to be filled.
+	packet [wheelPacketSize]uint8
+	index  uint8
+
+	// buttons holds the button state from the last decoded packet.
+	buttons uint8
+}
+
+// DriverName returns the name of this driver.
+func (*Mouse) DriverName() string {
+	return "ps2_mouse"
+}
+
+// DriverVersion returns the version of this driver.
+func (*Mouse) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit initializes this driver.
+func (m *Mouse) DriverInit(w io.Writer) *kernel.Error {
+	flushOutput()
+
+	// Enable the auxiliary port with its IRQ masked; the device is set up
+	// by polling until the interrupt handler is installed.
+	if err := writeCommand(ctrlDisableAux); err != nil {
+		return err
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	config &^= configAuxIRQ
+	if err = writeConfig(config); err != nil {
+		return err
+	}
+
+	if err = writeCommand(ctrlTestAux); err != nil {
+		return err
+	}
+
+	if res, err := readData(); err != nil || res != auxTestPassed {
+		return errAuxTest
+	}
+
+	if err = writeCommand(ctrlEnableAux); err != nil {
+		return err
+	}
+
+	if err = m.reset(); err != nil {
+		return err
+	}
+
+	m.packetSize = standardPacketSize
+	if m.detectWheel() {
+		m.packetSize = wheelPacketSize
+	}
+
+	if err = sendAux(mouseSetDefaults); err != nil {
+		return err
+	}
+
+	if err = sendAux(mouseEnableReporting); err != nil {
+		return err
+	}
+
+	if err = registerIRQFn(irq.ISAIRQToGSI(mouseIRQ), m.handleIRQ); err != nil {
+		return err
+	}
+
+	config = (config | configAuxIRQ) &^ configAuxClockDisabled
+	if err = writeConfig(config); err != nil {
+		return err
+	}
+
+	if m.packetSize == wheelPacketSize {
+		kfmt.Fprintf(w, "IntelliMouse with scroll wheel\n")
+	} else {
+		kfmt.Fprintf(w, "standard mouse\n")
+	}
+	return nil
+}
+
+// reset resets the mouse and waits for it to complete its self-test.
+func (m *Mouse) reset() *kernel.Error {
+	if err := sendAux(mouseReset); err != nil {
+		return err
+	}
+
+	if res, err := readData(); err != nil || res != devSelfTestOK {
+		return errResetFail
+	}
+
+	// The self-test result is followed by the device ID
+	_, err := readData()
+	return err
+}
+
+// detectWheel attempts to enable the IntelliMouse extension and returns true
+// if the mouse reports that scroll wheel mode is active.
+func (m *Mouse) detectWheel() bool {
+	for _, rate := range intelliMouseKnock {
+		if sendAux(mouseSetSampleRate) != nil || sendAux(rate) != nil {
+			return false
+		}
+	}
+
+	if sendAux(mouseGetID) != nil {
+		return false
+	}
+
+	id, err := readData()
+	return err == nil && id == mouseIDIntelliMouse
+}
+
+// handleIRQ reads a byte from the controller if it originates from the
+// auxiliary port.
+func (m *Mouse) handleIRQ(_ *gate.Registers) bool {
+	status := portReadByteFn(statusPort)
+	if status&statusOutputFull == 0 || status&statusAuxData == 0 {
+		return false
+	}
+
+	m.feed(portReadByteFn(dataPort))
+	return true
+}
+
+// feed appends a byte to the current packet and decodes the packet once it
+// is complete. As the first byte of each packet always has bit 3 set, bytes
+// that do not satisfy this condition are dropped until the driver is back in
+// sync with the mouse.
+func (m *Mouse) feed(b uint8) {
+	if m.index == 0 && b&packetAlwaysOne == 0 {
+		return
+	}
+
+	m.packet[m.index] = b
+	if m.index++; m.index < m.packetSize {
+		return
+	}
+
+	m.index = 0
+	m.decode()
+}
+
+// decode converts the buffered packet into input events.
+func (m *Mouse) decode() {
+	flags := m.packet[0]
+	if flags&(packetXOverflow|packetYOverflow) != 0 {
+		return
+	}
+
+	var (
+		dx       = int32(m.packet[1])
+		dy       = int32(m.packet[2])
+		reported bool
+	)
+
+	if flags&packetXSign != 0 {
+		dx -= 256
+	}
+	if flags&packetYSign != 0 {
+		dy -= 256
+	}
+
+	// PS/2 mice report upward motion as a positive Y delta whereas the
+	// input subsystem uses screen coordinates.
+	reported = reportRel(input.RelX, dx) || reported
+	reported = reportRel(input.RelY, -dy) || reported
+
+	if m.packetSize == wheelPacketSize {
+		// The wheel delta is a 4-bit signed value that is positive
+		// when the wheel is scrolled down.
+		dz := int32(m.packet[3] & 0x0f)
+		if dz&0x08 != 0 {
+			dz -= 16
+		}
+		reported = reportRel(input.RelWheel, -dz) || reported
+	}
+
+	buttons := flags & packetButtons
+	for bit, changed := uint8(0), buttons^m.buttons; changed != 0; bit, changed = bit+1, changed>>1 {
+		if changed&1 != 0 {
+			reportFn(input.Event{Type: input.EventKey, Code: input.BtnLeft + uint16(bit), Value: int32(buttons>>bit) & 1})
+			reported = true
+		}
+	}
+	m.buttons = buttons
+
+	if reported {
+		reportFn(input.Event{Type: input.EventSync})
+	}
+}
+
+// reportRel emits a relative motion event if value is non-zero.
+func reportRel(code uint16, value int32) bool {
+	if value == 0 {
+		return false
+	}
+
+	reportFn(input.Event{Type: input.EventRel, Code: code, Value: value})
+	return true
+}
+
+// probeForPS2Mouse returns a mouse driver if an 8042 controller is present.
+// Whether a mouse is actually attached is checked by DriverInit.
+func probeForPS2Mouse() device.Driver {
+	if !controllerPresent() {
+		return nil
+	}
+
+	return &Mouse{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:    "ps2_mouse",
+		Order:   device.DetectOrderLast,
+		Probe:   probeForPS2Mouse,
+		ACPIIDs: []string{"PNP0F03", "PNP0F13"},
+	})
+}
@@ -0,0 +1,385 @@
+package ps2
+
+import (
+	"bytes"
+	"gopheros/device/input"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"reflect"
+	"testing"
+)
+
+func restoreMocks() {
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn = cpu.PortReadByte
+	registerIRQFn = irq.RegisterIRQ
+	reportFn = input.Report
+}
+
+// mock8042 emulates an 8042 controller with a keyboard attached to its first
+// port and a mouse attached to its auxiliary port.
+type mock8042 struct {
+	present    bool
+	auxBroken  bool
+	hasMouse   bool
+	hasKbd     bool
+	wheel      bool
+	failReset  bool
+	resendOnce bool
+
+	config      uint8
+	auxEnabled  bool
+	pendingCmd  uint8
+	sampleRates []uint8
+	wheelMode   bool
+	reporting   bool
+	kbdScanning bool
+	resetPulsed bool
+
+	// output holds the bytes waiting to be read from the data port and
+	// outputAux tracks whether each byte originates from the mouse.
+	output    []uint8
+	outputAux []bool
+}
+
+func (m *mock8042) push(aux bool, data ...uint8) {
+	for _, b := range data {
+		m.output = append(m.output, b)
+		m.outputAux = append(m.outputAux, aux)
+	}
+}
+
+func (m *mock8042) install() {
+	portReadByteFn = func(port uint16) uint8 {
+		if !m.present {
+			return 0xff
+		}
+
+		switch port {
+		case statusPort:
+			var status uint8
+			if len(m.output) != 0 {
+				status |= statusOutputFull
+				if m.outputAux[0] {
+					status |= statusAuxData
+				}
+			}
+			return status
+		case dataPort:
+			if len(m.output) == 0 {
+				return 0
+			}
+			b := m.output[0]
+			m.output, m.outputAux = m.output[1:], m.outputAux[1:]
+			return b
+		}
+		return 0
+	}
+
+	portWriteByteFn = func(port uint16, val uint8) {
+		if !m.present {
+			return
+		}
+
+		switch port {
+		case commandPort:
+			m.command(val)
+		case dataPort:
+			cmd := m.pendingCmd
+			m.pendingCmd = 0
+			switch cmd {
+			case ctrlWriteConfig:
+				m.config = val
+			case ctrlWriteAux:
+				m.mouse(val)
+			case 0:
+				m.keyboard(val)
+			}
+		}
+	}
+}
+
+func (m *mock8042) command(cmd uint8) {
+	switch cmd {
+	case ctrlReadConfig:
+		m.push(false, m.config)
+	case ctrlDisableAux:
+		m.auxEnabled = false
+		m.config |= configAuxClockDisabled
+	case ctrlEnableAux:
+		m.auxEnabled = true
+		m.config &^= configAuxClockDisabled
+	case ctrlTestAux:
+		if m.auxBroken {
+			m.push(false, 0x01)
+		} else {
+			m.push(false, auxTestPassed)
+		}
+	case ctrlWriteConfig, ctrlWriteAux:
+		m.pendingCmd = cmd
+	case ctrlPulseReset:
+		m.resetPulsed = true
+	}
+}
+
+func (m *mock8042) mouse(val uint8) {
+	if !m.hasMouse || !m.auxEnabled {
+		return
+	}
+
+	if m.resendOnce {
+		m.resendOnce = false
+		m.push(true, devResend)
+		return
+	}
+
+	if n := len(m.sampleRates); n != 0 && m.sampleRates[n-1] == 0 {
+		m.sampleRates[n-1] = val
+		m.push(true, devAck)
+		return
+	}
+
+	switch val {
+	case mouseReset:
+		m.sampleRates, m.wheelMode, m.reporting = nil, false, false
+		if m.failReset {
+			m.push(true, devAck, 0xfc)
+			return
+		}
+		m.push(true, devAck, devSelfTestOK, 0x00)
+	case mouseSetSampleRate:
+		m.sampleRates = append(m.sampleRates, 0)
+		m.push(true, devAck)
+	case mouseGetID:
+		if n := len(m.sampleRates); m.wheel && n >= 3 && reflect.DeepEqual(m.sampleRates[n-3:], intelliMouseKnock[:]) {
+			m.wheelMode = true
+		}
+
+		id := uint8(0x00)
+		if m.wheelMode {
+			id = mouseIDIntelliMouse
+		}
+		m.push(true, devAck, id)
+	case mouseSetDefaults:
+		m.push(true, devAck)
+	case mouseEnableReporting:
+		m.reporting = true
+		m.push(true, devAck)
+	default:
+		m.push(true, 0xfc)
+	}
+}
+
+func TestProbeForPS2Mouse(t *testing.T) {
+	defer restoreMocks()
+
+	ctrl := &mock8042{}
+	ctrl.install()
+	if drv := probeForPS2Mouse(); drv != nil {
+		t.Fatalf("expected probe to fail when no controller is present")
+	}
+
+	ctrl.present = true
+	if drv := probeForPS2Mouse(); drv == nil {
+		t.Fatalf("expected probe to return a driver when a controller is present")
+	}
+}
+
+func TestMouseDriverInit(t *testing.T) {
+	defer restoreMocks()
+
+	irqErr := &kernel.Error{Module: "test", Message: "no controller"}
+
+	specs := []struct {
+		ctrl          mock8042
+		irqErr        *kernel.Error
+		expErr        *kernel.Error
+		expPacketSize uint8
+		expLog        string
+	}{
+		{mock8042{present: true, hasMouse: true}, nil, nil, standardPacketSize, "standard mouse\n"},
+		{mock8042{present: true, hasMouse: true, wheel: true}, nil, nil, wheelPacketSize, "IntelliMouse with scroll wheel\n"},
+		{mock8042{present: true, hasMouse: true, wheel: true, resendOnce: true}, nil, nil, wheelPacketSize, "IntelliMouse with scroll wheel\n"},
+		{mock8042{present: true, hasMouse: true, auxBroken: true}, nil, errAuxTest, 0, ""},
+		{mock8042{present: true, hasMouse: true, failReset: true}, nil, errResetFail, 0, ""},
+		{mock8042{present: true}, nil, errNoResponse, 0, ""},
+		{mock8042{present: true, hasMouse: true}, irqErr, irqErr, 0, ""},
+	}
+
+	for specIndex, spec := range specs {
+		var (
+			ctrl     = spec.ctrl
+			buf      bytes.Buffer
+			m        Mouse
+			irqGSI   = ^uint32(0)
+			irqFnSet bool
+		)
+		ctrl.config = configAuxClockDisabled | 0x01
+		ctrl.install()
+
+		registerIRQFn = func(gsi uint32, fn irq.Handler) *kernel.Error {
+			irqGSI, irqFnSet = gsi, fn != nil
+			return spec.irqErr
+		}
+
+		if err := m.DriverInit(&buf); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if spec.expErr != nil {
+			if spec.irqErr == nil && ctrl.config&configAuxIRQ != 0 {
+				t.Errorf("[spec %d] expected aux IRQ to remain disabled", specIndex)
+			}
+			continue
+		}
+
+		if m.packetSize != spec.expPacketSize {
+			t.Errorf("[spec %d] expected packet size %d; got %d", specIndex, spec.expPacketSize, m.packetSize)
+		}
+
+		if got := buf.String(); got != spec.expLog {
+			t.Errorf("[spec %d] expected log output %q; got %q", specIndex, spec.expLog, got)
+		}
+
+		if !ctrl.reporting {
+			t.Errorf("[spec %d] expected data reporting to be enabled", specIndex)
+		}
+
+		if exp := irq.ISAIRQToGSI(mouseIRQ); irqGSI != exp || !irqFnSet {
+			t.Errorf("[spec %d] expected an IRQ handler to be registered for GSI %d; got GSI %d", specIndex, exp, irqGSI)
+		}
+
+		if exp := uint8(configAuxIRQ | 0x01); ctrl.config != exp {
+			t.Errorf("[spec %d] expected controller config to be 0x%x; got 0x%x", specIndex, exp, ctrl.config)
+		}
+	}
+}
+
+func TestMouseDecode(t *testing.T) {
+	defer restoreMocks()
+
+	var events []input.Event
+	reportFn = func(ev input.Event) { events = append(events, ev) }
+
+	sync := input.Event{Type: input.EventSync}
+
+	specs := []struct {
+		packetSize uint8
+		data       []uint8
+		exp        []input.Event
+	}{
+		// Motion to the right and upwards
+		{
+			standardPacketSize,
+			[]uint8{0x08, 5, 3},
+			[]input.Event{
+				{Type: input.EventRel, Code: input.RelX, Value: 5},
+				{Type: input.EventRel, Code: input.RelY, Value: -3},
+				sync,
+			},
+		},
+		// Motion to the left and downwards with the left button pressed
+		{
+			standardPacketSize,
+			[]uint8{0x39, 0xfe, 0xfc},
+			[]input.Event{
+				{Type: input.EventRel, Code: input.RelX, Value: -2},
+				{Type: input.EventRel, Code: input.RelY, Value: 4},
+				{Type: input.EventKey, Code: input.BtnLeft, Value: 1},
+				sync,
+			},
+		},
+		// Left button release and middle button press
+		{
+			standardPacketSize,
+			[]uint8{0x0c, 0, 0},
+			[]input.Event{
+				{Type: input.EventKey, Code: input.BtnLeft, Value: 0},
+				{Type: input.EventKey, Code: input.BtnMiddle, Value: 1},
+				sync,
+			},
+		},
+		// Unchanged state does not generate any events
+		{
+			standardPacketSize,
+			[]uint8{0x0c, 0, 0},
+			nil,
+		},
+		// Overflowing packets are dropped
+		{
+			standardPacketSize,
+			[]uint8{0x48, 0xff, 0},
+			nil,
+		},
+		// Bytes are skipped until the start of a packet is found
+		{
+			standardPacketSize,
+			[]uint8{0x00, 0x01, 0x0a, 1, 0},
+			[]input.Event{
+				{Type: input.EventRel, Code: input.RelX, Value: 1},
+				{Type: input.EventKey, Code: input.BtnRight, Value: 1},
+				{Type: input.EventKey, Code: input.BtnMiddle, Value: 0},
+				sync,
+			},
+		},
+		// Wheel scrolled down and up
+		{
+			wheelPacketSize,
+			[]uint8{0x0a, 0, 0, 0x01, 0x0a, 0, 0, 0x0f},
+			[]input.Event{
+				{Type: input.EventRel, Code: input.RelWheel, Value: -1},
+				sync,
+				{Type: input.EventRel, Code: input.RelWheel, Value: 1},
+				sync,
+			},
+		},
+	}
+
+	var m Mouse
+	for specIndex, spec := range specs {
+		events = nil
+		m.packetSize = spec.packetSize
+		for _, b := range spec.data {
+			m.feed(b)
+		}
+
+		if !reflect.DeepEqual(events, spec.exp) {
+			t.Errorf("[spec %d] expected events:\n%+v\ngot:\n%+v", specIndex, spec.exp, events)
+		}
+	}
+}
+
+func TestMouseHandleIRQ(t *testing.T) {
+	defer restoreMocks()
+
+	var events []input.Event
+	reportFn = func(ev input.Event) { events = append(events, ev) }
+
+	ctrl := &mock8042{present: true}
+	ctrl.install()
+
+	m := &Mouse{packetSize: standardPacketSize}
+
+	if m.handleIRQ(nil) {
+		t.Fatal("expected handler to return false when the output buffer is empty")
+	}
+
+	ctrl.push(false, 0x1c)
+	if m.handleIRQ(nil) {
+		t.Fatal("expected handler to ignore keyboard data")
+	}
+
+	ctrl.output, ctrl.outputAux = nil, nil
+	ctrl.push(true, 0x08, 1, 1)
+	for i := 0; i < 3; i++ {
+		if !m.handleIRQ(nil) {
+			t.Fatalf("expected handler to service byte %d", i)
+		}
+	}
+
+	if exp := 3; len(events) != exp {
+		t.Fatalf("expected %d events; got %+v", exp, events)
+	}
+}
@@ -0,0 +1,324 @@
+// Package netdev defines the interface between network device drivers and the
+// network stack.
+//
+// Drivers register each network device via Register and receive an Interface
+// that is used by the stack for transmitting frames. Received frames are not
+// processed in interrupt context. Instead, the driver's interrupt handler
+// invokes ScheduleRX and the softirq daemon later polls the driver which
+// passes the received frames to Interface.Receive.
+package netdev
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/softirq"
+	"sync/atomic"
+)
+
+// HardwareAddr is an Ethernet MAC address.
+type HardwareAddr [6]byte
+
+// String returns the address in the colon-separated hexadecimal notation.
+func (addr HardwareAddr) String() string {
+	const hexDigits = "0123456789abcdef"
+
+	var buf [17]byte
+	for i, b := range addr {
+		if i != 0 {
+			buf[i*3-1] = ':'
+		}
+		buf[i*3] = hexDigits[b>>4]
+		buf[i*3+1] = hexDigits[b&0xf]
+	}
+
+	return string(buf[:])
+}
+
+// Feature describes an offload capability of a network device.
+type Feature uint32
+
+// The list of supported device features.
+const (
+	// FeatureTxChecksum indicates that the device can compute the
+	// checksum for frames with the NeedsChecksum flag set.
+	FeatureTxChecksum Feature = 1 << iota
+
+	// FeatureRxChecksum indicates that the device may report that it has
+	// validated the checksum of a received frame.
+	FeatureRxChecksum
+)
+
+// EthernetHeaderLen is the size of an Ethernet frame header without a VLAN
+// tag.
+const EthernetHeaderLen = 14
+
+// Frame is an Ethernet frame exchanged between a driver and the stack.
+type Frame struct {
+	// Data contains the frame including its Ethernet header but without
+	// the trailing frame check sequence.
+	Data []byte
+
+	// NeedsChecksum is set by the stack for outgoing frames whose L4
+	// checksum must be computed over Data[ChecksumStart:] and stored at
+	// offset ChecksumStart + ChecksumOffset. The checksum field must be
+	// initialized with the sum of the L4 pseudo-header.
+	NeedsChecksum  bool
+	ChecksumStart  uint16
+	ChecksumOffset uint16
+
+	// ChecksumValid is set by drivers for incoming frames whose L4
+	// checksum was validated by the device.
+	ChecksumValid bool
+}
+
+// Driver is implemented by network device drivers.
+type Driver interface {
+	HardwareAddr() HardwareAddr
+	MTU() uint16
+	Features() Feature
+	LinkUp() bool
+
+	// Transmit queues a frame for transmission. The frame data may be
+	// reused by the caller once Transmit returns.
+	Transmit(*Frame) *kernel.Error
+
+	// Poll is invoked by the softirq daemon after the driver invokes
+	// ScheduleRX. It passes all frames received by the device to
+	// Interface.Receive.
+	Poll()
+}
+
+// Stats contains the traffic counters for an interface.
+type Stats struct {
+	RxPackets uint64
+	RxBytes   uint64
+	RxDropped uint64
+	TxPackets uint64
+	TxBytes   uint64
+	TxErrors  uint64
+}
+
+// Interface is a network device registered with the stack.
+type Interface struct {
+	name   string
+	driver Driver
+	stats  Stats
+
+	// rxPending is set to 1 when the driver has frames to be polled.
+	rxPending uint32
+}
+
+// ReceiveHandler is a function that processes a received frame. The handler
+// owns the frame once it has been invoked.
+type ReceiveHandler func(*Interface, *Frame)
+
+var (
+	errFrameTooLarge = &kernel.Error{Module: "netdev", Message: "frame exceeds the interface MTU"}
+	errFrameTooShort = &kernel.Error{Module: "netdev", Message: "frame is shorter than the Ethernet header"}
+	errLinkDown      = &kernel.Error{Module: "netdev", Message: "interface link is down"}
+	errBadChecksum   = &kernel.Error{Module: "netdev", Message: "invalid checksum offsets"}
+
+	interfaces     []*Interface
+	receiveHandler ReceiveHandler
+
+	// The following functions are used by tests to mock calls to the cpu
+	// and softirq packages.
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn  = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	registerSoftIRQFn   = softirq.Register
+	raiseSoftIRQFn      = softirq.Raise
+)
+
+// Init registers the softirq handler that polls the drivers for received
+// frames.
+func Init() *kernel.Error {
+	return registerSoftIRQFn(softirq.NetRX, poll)
+}
+
+// Register adds a network device to the list of interfaces and returns the
+// Interface for it. Interfaces are named ethN in registration order.
+func Register(drv Driver) *Interface {
+	intr := lock()
+	defer unlock(intr)
+
+	iface := &Interface{
+		name:   "eth" + kfmt.Itoa(len(interfaces)),
+		driver: drv,
+	}
+	interfaces = append(interfaces, iface)
+	return iface
+}
+
+// Interfaces returns the list of registered interfaces.
+func Interfaces() []*Interface {
+	intr := lock()
+	list := interfaces
+	unlock(intr)
+	return list
+}
+
+// SetReceiveHandler installs the function that processes the frames received
+// by all interfaces. Frames received while no handler is installed are
+// dropped.
+func SetReceiveHandler(handler ReceiveHandler) {
+	intr := lock()
+	receiveHandler = handler
+	unlock(intr)
+}
+
+// Name returns the interface name.
+func (iface *Interface) Name() string {
+	return iface.name
+}
+
+// HardwareAddr returns the MAC address of the interface.
+func (iface *Interface) HardwareAddr() HardwareAddr {
+	return iface.driver.HardwareAddr()
+}
+
+// MTU returns the largest payload that can be carried by a frame sent over
+// the interface.
+func (iface *Interface) MTU() uint16 {
+	return iface.driver.MTU()
+}
+
+// Features returns the offload capabilities of the interface.
+func (iface *Interface) Features() Feature {
+	return iface.driver.Features()
+}
+
+// LinkUp returns true if the interface is connected to a network.
+func (iface *Interface) LinkUp() bool {
+	return iface.driver.LinkUp()
+}
+
+// Stats returns a snapshot of the traffic counters for the interface.
+func (iface *Interface) Stats() Stats {
+	intr := lock()
+	stats := iface.stats
+	unlock(intr)
+	return stats
+}
+
+// Transmit sends a frame over the interface. If the frame requires a checksum
+// and the device does not support checksum offloading, the checksum is
+// computed in software.
+func (iface *Interface) Transmit(frame *Frame) *kernel.Error {
+	err := iface.transmit(frame)
+
+	intr := lock()
+	if err != nil {
+		iface.stats.TxErrors++
+	} else {
+		iface.stats.TxPackets++
+		iface.stats.TxBytes += uint64(len(frame.Data))
+	}
+	unlock(intr)
+
+	return err
+}
+
+func (iface *Interface) transmit(frame *Frame) *kernel.Error {
+	switch {
+	case len(frame.Data) < EthernetHeaderLen:
+		return errFrameTooShort
+	case len(frame.Data) > EthernetHeaderLen+int(iface.driver.MTU()):
+		return errFrameTooLarge
+	case !iface.driver.LinkUp():
+		return errLinkDown
+	}
+
+	if frame.NeedsChecksum && iface.driver.Features()&FeatureTxChecksum == 0 {
+		if err := completeChecksum(frame); err != nil {
+			return err
+		}
+	}
+
+	return iface.driver.Transmit(frame)
+}
+
+// ScheduleRX requests the softirq daemon to poll the interface driver for
+// received frames. It never blocks and is meant to be invoked by the driver's
+// interrupt handler.
+func (iface *Interface) ScheduleRX() {
+	atomic.StoreUint32(&iface.rxPending, 1)
+	raiseSoftIRQFn(softirq.NetRX)
+}
+
+// Receive passes a frame received by the interface to the stack. It must only
+// be invoked by the driver's Poll method.
+func (iface *Interface) Receive(frame *Frame) {
+	intr := lock()
+	handler := receiveHandler
+	if handler == nil {
+		iface.stats.RxDropped++
+	} else {
+		iface.stats.RxPackets++
+		iface.stats.RxBytes += uint64(len(frame.Data))
+	}
+	unlock(intr)
+
+	if handler != nil {
+		handler(iface, frame)
+	}
+}
+
+// poll invokes the Poll method of each driver that has scheduled a receive
+// operation.
+func poll() {
+	for _, iface := range Interfaces() {
+		if atomic.SwapUint32(&iface.rxPending, 0) == 1 {
+			iface.driver.Poll()
+		}
+	}
+}
+
+// Checksum returns the Internet checksum (RFC 1071) of data. The initial
+// value allows the sum of other fields such as the L4 pseudo-header to be
+// included.
+func Checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for ; len(data) > 1; data = data[2:] {
+		sum += uint32(data[0])<<8 | uint32(data[1])
+	}
+
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
+
+// completeChecksum computes the checksum for a frame that requires one and
+// stores it at the location specified by the frame.
+func completeChecksum(frame *Frame) *kernel.Error {
+	start, field := int(frame.ChecksumStart), int(frame.ChecksumStart)+int(frame.ChecksumOffset)
+	if start < EthernetHeaderLen || field+2 > len(frame.Data) {
+		return errBadChecksum
+	}
+
+	// The checksum field holds the pseudo-header sum and is covered by
+	// the computed checksum.
+	csum := Checksum(frame.Data[start:], 0)
+	frame.Data[field], frame.Data[field+1] = byte(csum>>8), byte(csum)
+	frame.NeedsChecksum = false
+	return nil
+}
+
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+	return intr
+}
+
+func unlock(intr bool) {
+	if intr {
+		enableInterruptsFn()
+	}
+}
@@ -0,0 +1,216 @@
+package netdev
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/softirq"
+	"testing"
+)
+
+func restoreMocks() {
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	registerSoftIRQFn = softirq.Register
+	raiseSoftIRQFn = softirq.Raise
+	interfaces = nil
+	receiveHandler = nil
+}
+
+func mockInterrupts() {
+	interruptsEnabledFn = func() bool { return false }
+	enableInterruptsFn = func() {}
+	disableInterruptsFn = func() {}
+}
+
+type mockDriver struct {
+	features Feature
+	linkDown bool
+	txErr    *kernel.Error
+	sent     []*Frame
+	polls    int
+}
+
+func (d *mockDriver) HardwareAddr() HardwareAddr {
+	return HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0xab}
+}
+func (d *mockDriver) MTU() uint16       { return 100 }
+func (d *mockDriver) Features() Feature { return d.features }
+func (d *mockDriver) LinkUp() bool      { return !d.linkDown }
+func (d *mockDriver) Poll()             { d.polls++ }
+
+func (d *mockDriver) Transmit(frame *Frame) *kernel.Error {
+	if d.txErr != nil {
+		return d.txErr
+	}
+	d.sent = append(d.sent, frame)
+	return nil
+}
+
+func TestHardwareAddrString(t *testing.T) {
+	if exp, got := "52:54:00:12:34:ab", (&mockDriver{}).HardwareAddr().String(); got != exp {
+		t.Fatalf("expected %q; got %q", exp, got)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var softirqVector softirq.Vector
+	registerSoftIRQFn = func(vector softirq.Vector, _ softirq.Handler) *kernel.Error {
+		softirqVector = vector
+		return nil
+	}
+	if err := Init(); err != nil || softirqVector != softirq.NetRX {
+		t.Fatalf("expected Init to register a handler for the NetRX softirq; got vector %d, %v", softirqVector, err)
+	}
+
+	drv := &mockDriver{}
+	for i := 0; i < 12; i++ {
+		Register(drv)
+	}
+
+	list := Interfaces()
+	if len(list) != 12 {
+		t.Fatalf("expected 12 registered interfaces; got %d", len(list))
+	}
+
+	for i, exp := range map[int]string{0: "eth0", 1: "eth1", 10: "eth10", 11: "eth11"} {
+		if got := list[i].Name(); got != exp {
+			t.Errorf("expected interface %d to be named %q; got %q", i, exp, got)
+		}
+	}
+
+	if iface := list[0]; iface.HardwareAddr() != drv.HardwareAddr() || iface.MTU() != 100 || !iface.LinkUp() || iface.Features() != 0 {
+		t.Error("expected interface attributes to be provided by the driver")
+	}
+}
+
+func TestTransmit(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	// A UDP datagram whose checksum field contains the pseudo-header sum
+	udpFrame := func() *Frame {
+		data := make([]byte, 34+12)
+		copy(data[34:], []byte{0x04, 0x00, 0x00, 0x35, 0x00, 0x0c, 0x00, 0x00, 'p', 'i', 'n', 'g'})
+		data[40], data[41] = 0x12, 0x34
+		return &Frame{Data: data, NeedsChecksum: true, ChecksumStart: 34, ChecksumOffset: 6}
+	}
+	expSum := Checksum(udpFrame().Data[34:], 0)
+
+	driverErr := &kernel.Error{Module: "test", Message: "tx error"}
+	specs := []struct {
+		frame    *Frame
+		drv      *mockDriver
+		expErr   *kernel.Error
+		expCsum  bool
+		expField uint16
+	}{
+		{&Frame{Data: make([]byte, 60)}, &mockDriver{}, nil, false, 0},
+		{&Frame{Data: make([]byte, 13)}, &mockDriver{}, errFrameTooShort, false, 0},
+		{&Frame{Data: make([]byte, 115)}, &mockDriver{}, errFrameTooLarge, false, 0},
+		{&Frame{Data: make([]byte, 60)}, &mockDriver{linkDown: true}, errLinkDown, false, 0},
+		{&Frame{Data: make([]byte, 60)}, &mockDriver{txErr: driverErr}, driverErr, false, 0},
+		// Checksum computed in software
+		{udpFrame(), &mockDriver{}, nil, false, expSum},
+		// Checksum offloaded to the device
+		{udpFrame(), &mockDriver{features: FeatureTxChecksum}, nil, true, 0x1234},
+		// Checksum field outside the frame
+		{&Frame{Data: make([]byte, 40), NeedsChecksum: true, ChecksumStart: 34, ChecksumOffset: 6}, &mockDriver{}, errBadChecksum, false, 0},
+	}
+
+	for specIndex, spec := range specs {
+		iface := Register(spec.drv)
+		err := iface.Transmit(spec.frame)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		stats := iface.Stats()
+		if err != nil {
+			if stats.TxErrors != 1 || len(spec.drv.sent) != 0 {
+				t.Errorf("[spec %d] expected frame to be counted as a transmit error", specIndex)
+			}
+			continue
+		}
+
+		if stats.TxPackets != 1 || stats.TxBytes != uint64(len(spec.frame.Data)) || len(spec.drv.sent) != 1 {
+			t.Errorf("[spec %d] expected frame to be passed to the driver and counted", specIndex)
+		}
+
+		if spec.frame.NeedsChecksum != spec.expCsum {
+			t.Errorf("[spec %d] expected NeedsChecksum to be %t", specIndex, spec.expCsum)
+		}
+
+		if len(spec.frame.Data) > 41 {
+			if got := uint16(spec.frame.Data[40])<<8 | uint16(spec.frame.Data[41]); got != spec.expField {
+				t.Errorf("[spec %d] expected checksum field to contain 0x%x; got 0x%x", specIndex, spec.expField, got)
+			}
+		}
+	}
+}
+
+func TestReceive(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var raised []softirq.Vector
+	raiseSoftIRQFn = func(vector softirq.Vector) { raised = append(raised, vector) }
+
+	drv1, drv2 := &mockDriver{}, &mockDriver{}
+	iface1, _ := Register(drv1), Register(drv2)
+
+	iface1.ScheduleRX()
+	if len(raised) != 1 || raised[0] != softirq.NetRX {
+		t.Fatalf("expected the NetRX softirq to be raised; got %v", raised)
+	}
+
+	poll()
+	poll()
+	if drv1.polls != 1 || drv2.polls != 0 {
+		t.Fatalf("expected only the scheduled driver to be polled once; got %d and %d polls", drv1.polls, drv2.polls)
+	}
+
+	frame := &Frame{Data: make([]byte, 64)}
+	iface1.Receive(frame)
+	if stats := iface1.Stats(); stats.RxDropped != 1 || stats.RxPackets != 0 {
+		t.Fatalf("expected frame to be dropped without a receive handler; got %+v", stats)
+	}
+
+	var received []*Frame
+	SetReceiveHandler(func(iface *Interface, f *Frame) {
+		if iface != iface1 {
+			t.Error("expected handler to be invoked with the receiving interface")
+		}
+		received = append(received, f)
+	})
+
+	iface1.Receive(frame)
+	if stats := iface1.Stats(); stats.RxPackets != 1 || stats.RxBytes != 64 || len(received) != 1 || received[0] != frame {
+		t.Fatalf("expected frame to be passed to the receive handler; got %+v", stats)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	specs := []struct {
+		data    []byte
+		initial uint32
+		exp     uint16
+	}{
+		// RFC 1071 section 3 example
+		{[]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, 0, 0x220d},
+		{[]byte{0x01}, 0, 0xfeff},
+		{nil, 0, 0xffff},
+		{[]byte{0xff, 0xff}, 0x1, 0xfffe},
+		{[]byte{0x00, 0x01}, 0x1fffe, 0xfffe},
+	}
+
+	for specIndex, spec := range specs {
+		if got := Checksum(spec.data, spec.initial); got != spec.exp {
+			t.Errorf("[spec %d] expected checksum 0x%x; got 0x%x", specIndex, spec.exp, got)
+		}
+	}
+}
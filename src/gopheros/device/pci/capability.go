@@ -0,0 +1,293 @@
+package pci
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/timer"
+)
+
+// Capability IDs for power management and PCI Express capabilities.
+const (
+	CapPowerManagement = uint8(0x01)
+	CapPCIExpress      = uint8(0x10)
+)
+
+// PCIe device/port types reported by the PCI Express capability.
+const (
+	PCIeEndpoint                  = uint8(0x0)
+	PCIeLegacyEndpoint            = uint8(0x1)
+	PCIeRootPort                  = uint8(0x4)
+	PCIeUpstreamPort              = uint8(0x5)
+	PCIeDownstreamPort            = uint8(0x6)
+	PCIeToPCIBridge               = uint8(0x7)
+	PCIToPCIeBridge               = uint8(0x8)
+	PCIeRootComplexEndpoint       = uint8(0x9)
+	PCIeRootComplexEventCollector = uint8(0xa)
+)
+
+const (
+	pmCaps        = uint8(2)
+	pmControl     = uint8(4)
+	pmVersionMask = uint16(0x7)
+	pmD1Support   = uint16(1 << 9)
+	pmD2Support   = uint16(1 << 10)
+	pmPMEShift    = 11
+	pmStateMask   = uint16(0x3)
+	pmNoSoftReset = uint16(1 << 3)
+	pmPMEStatus   = uint16(1 << 15)
+
+	msiMultiMsgCap   = uint16(7 << 1)
+	msiPerVectorMask = uint16(1 << 8)
+	msixPBA          = uint8(8)
+
+	pcieCaps           = uint8(2)
+	pcieDevCaps        = uint8(4)
+	pcieLinkCaps       = uint8(12)
+	pcieVersionMask    = uint16(0xf)
+	pcieTypeShift      = 4
+	pcieTypeMask       = uint16(0xf)
+	pcieMaxPayload     = uint32(0x7)
+	pcieLinkSpeedMask  = uint32(0xf)
+	pcieLinkWidthMask  = uint32(0x3f)
+	pcieLinkWidthShift = 4
+
+	// Devices need 10ms to recover from D3hot and 200us to enter or leave
+	// D2 before their configuration space can be accessed again.
+	pmD3HotDelay = 10 * timer.Millisecond
+	pmD2Delay    = 200 * timer.Microsecond
+)
+
+// PowerState describes a PCI device power state.
+type PowerState uint8
+
+// The list of power states that can be programmed via the power management
+// capability. D3cold is entered by removing power from the device and is not
+// listed here.
+const (
+	PowerStateD0 PowerState = iota
+	PowerStateD1
+	PowerStateD2
+	PowerStateD3Hot
+)
+
+// String implements fmt.Stringer for PowerState.
+func (s PowerState) String() string {
+	switch s {
+	case PowerStateD0:
+		return "D0"
+	case PowerStateD1:
+		return "D1"
+	case PowerStateD2:
+		return "D2"
+	default:
+		return "D3hot"
+	}
+}
+
+var (
+	errNoPowerManagement      = &kernel.Error{Module: "pci", Message: "device does not support power management"}
+	errUnsupportedPowerState  = &kernel.Error{Module: "pci", Message: "device does not support the requested power state"}
+	errPowerStateNotConfirmed = &kernel.Error{Module: "pci", Message: "device did not enter the requested power state"}
+
+	// sleepFn is used by tests to avoid waiting for power state
+	// transitions to complete.
+	sleepFn = timer.Sleep
+)
+
+// PMCapability describes the power management capability of a device.
+type PMCapability struct {
+	// Offset of the capability in the configuration space.
+	Offset uint8
+
+	// Version of the power management interface specification.
+	Version uint8
+
+	D1Support bool
+	D2Support bool
+
+	// PMESupport is a bitmask of the states (bit 0 for D0 to bit 4 for
+	// D3cold) from which the device can signal PME#.
+	PMESupport uint8
+
+	// NoSoftReset is set if the device retains its configuration when
+	// transitioning from D3hot to D0.
+	NoSoftReset bool
+}
+
+// MSICapability describes the MSI capability of a device.
+type MSICapability struct {
+	// Offset of the capability in the configuration space.
+	Offset uint8
+
+	Is64Bit       bool
+	PerVectorMask bool
+	MaxVectors    uint8
+	Enabled       bool
+}
+
+// MSIXCapability describes the MSI-X capability of a device.
+type MSIXCapability struct {
+	// Offset of the capability in the configuration space.
+	Offset uint8
+
+	TableSize   uint16
+	TableBIR    uint8
+	TableOffset uint32
+	PBABIR      uint8
+	PBAOffset   uint32
+	Enabled     bool
+}
+
+// PCIeCapability describes the PCI Express capability of a device.
+type PCIeCapability struct {
+	// Offset of the capability in the configuration space.
+	Offset uint8
+
+	Version uint8
+
+	// DeviceType is one of the PCIe* device/port type constants.
+	DeviceType uint8
+
+	// MaxPayload is the maximum supported payload size in bytes.
+	MaxPayload uint16
+
+	// LinkSpeed is an index into the supported link speeds vector (1 for
+	// 2.5GT/s, 2 for 5GT/s and so on) and LinkWidth the maximum number
+	// of lanes.
+	LinkSpeed uint8
+	LinkWidth uint8
+}
+
+// PMCapability returns the device's power management capability and true or
+// false if the device does not support power management.
+func (dev *Device) PMCapability() (PMCapability, bool) {
+	offset, found := dev.FindCapability(CapPowerManagement)
+	if !found {
+		return PMCapability{}, false
+	}
+
+	caps := dev.ReadConfig16(offset + pmCaps)
+	return PMCapability{
+		Offset:      offset,
+		Version:     uint8(caps & pmVersionMask),
+		D1Support:   caps&pmD1Support != 0,
+		D2Support:   caps&pmD2Support != 0,
+		PMESupport:  uint8(caps >> pmPMEShift),
+		NoSoftReset: dev.ReadConfig16(offset+pmControl)&pmNoSoftReset != 0,
+	}, true
+}
+
+// MSICapability returns the device's MSI capability and true or false if the
+// device does not support MSI.
+func (dev *Device) MSICapability() (MSICapability, bool) {
+	offset, found := dev.FindCapability(CapMSI)
+	if !found {
+		return MSICapability{}, false
+	}
+
+	control := dev.ReadConfig16(offset + msiControl)
+	return MSICapability{
+		Offset:        offset,
+		Is64Bit:       control&msi64BitAddr != 0,
+		PerVectorMask: control&msiPerVectorMask != 0,
+		MaxVectors:    1 << ((control & msiMultiMsgCap) >> 1),
+		Enabled:       control&msiEnable != 0,
+	}, true
+}
+
+// MSIXCapability returns the device's MSI-X capability and true or false if
+// the device does not support MSI-X.
+func (dev *Device) MSIXCapability() (MSIXCapability, bool) {
+	offset, found := dev.FindCapability(CapMSIX)
+	if !found {
+		return MSIXCapability{}, false
+	}
+
+	var (
+		control = dev.ReadConfig16(offset + msixControl)
+		table   = dev.ReadConfig32(offset + msixTable)
+		pba     = dev.ReadConfig32(offset + msixPBA)
+	)
+	return MSIXCapability{
+		Offset:      offset,
+		TableSize:   control&msixTableSize + 1,
+		TableBIR:    uint8(table & msixBIRMask),
+		TableOffset: table &^ msixBIRMask,
+		PBABIR:      uint8(pba & msixBIRMask),
+		PBAOffset:   pba &^ msixBIRMask,
+		Enabled:     control&msixEnable != 0,
+	}, true
+}
+
+// PCIeCapability returns the device's PCI Express capability and true or false
+// if this is a conventional PCI device.
+func (dev *Device) PCIeCapability() (PCIeCapability, bool) {
+	offset, found := dev.FindCapability(CapPCIExpress)
+	if !found {
+		return PCIeCapability{}, false
+	}
+
+	var (
+		caps     = dev.ReadConfig16(offset + pcieCaps)
+		devCaps  = dev.ReadConfig32(offset + pcieDevCaps)
+		linkCaps = dev.ReadConfig32(offset + pcieLinkCaps)
+	)
+	return PCIeCapability{
+		Offset:     offset,
+		Version:    uint8(caps & pcieVersionMask),
+		DeviceType: uint8((caps >> pcieTypeShift) & pcieTypeMask),
+		MaxPayload: 128 << (devCaps & pcieMaxPayload),
+		LinkSpeed:  uint8(linkCaps & pcieLinkSpeedMask),
+		LinkWidth:  uint8((linkCaps >> pcieLinkWidthShift) & pcieLinkWidthMask),
+	}, true
+}
+
+// PowerState returns the current power state of the device. Devices without
+// a power management capability are always reported to be in D0.
+func (dev *Device) PowerState() PowerState {
+	offset, found := dev.FindCapability(CapPowerManagement)
+	if !found {
+		return PowerStateD0
+	}
+
+	return PowerState(dev.ReadConfig16(offset+pmControl) & pmStateMask)
+}
+
+// SetPowerState transitions the device to the specified power state and waits
+// for the transition delay mandated by the PCI power management specification
+// to elapse. Unless the device reports NoSoftReset, a transition from D3hot to
+// D0 resets its configuration so callers must reprogram the BARs and command
+// register once the device has been resumed.
+func (dev *Device) SetPowerState(state PowerState) *kernel.Error {
+	pm, found := dev.PMCapability()
+	if !found {
+		return errNoPowerManagement
+	}
+
+	if state > PowerStateD3Hot ||
+		(state == PowerStateD1 && !pm.D1Support) ||
+		(state == PowerStateD2 && !pm.D2Support) {
+		return errUnsupportedPowerState
+	}
+
+	control := dev.ReadConfig16(pm.Offset + pmControl)
+	cur := PowerState(control & pmStateMask)
+	if cur == state {
+		return nil
+	}
+
+	// Writing back a set PME status bit would clear it
+	dev.WriteConfig16(pm.Offset+pmControl, control&^(pmStateMask|pmPMEStatus)|uint16(state))
+
+	switch {
+	case cur == PowerStateD3Hot || state == PowerStateD3Hot:
+		sleepFn(pmD3HotDelay)
+	case cur == PowerStateD2 || state == PowerStateD2:
+		sleepFn(pmD2Delay)
+	}
+
+	if dev.PowerState() != state {
+		return errPowerStateNotConfirmed
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package pci
+
+import (
+	"encoding/binary"
+	"gopheros/kernel/timer"
+	"testing"
+)
+
+// addCapabilities chains the specified capabilities, each one occupying 0x10
+// bytes starting at offset 0x40, and returns the offset of each one.
+func addCapabilities(regs *[256]byte, capIDs ...uint8) []uint8 {
+	binary.LittleEndian.PutUint16(regs[RegStatus:], statusCapabilities)
+	regs[RegCapabilities] = 0x40
+
+	offsets := make([]uint8, len(capIDs))
+	for i, capID := range capIDs {
+		offsets[i] = uint8(0x40 + 0x10*i)
+		regs[offsets[i]] = capID
+		if i < len(capIDs)-1 {
+			regs[offsets[i]+1] = offsets[i] + 0x10
+		}
+	}
+
+	return offsets
+}
+
+func TestTypedCapabilities(t *testing.T) {
+	defer restorePortMocks()
+
+	cs := newFakeConfigSpace()
+	regs := cs.addFunc(0, 3, 0, 0x8086, 0x10d3)
+	dev := &Device{Slot: 3}
+
+	if _, found := dev.PMCapability(); found {
+		t.Fatal("expected PMCapability to return false for a device without capabilities")
+	}
+	if _, found := dev.MSICapability(); found {
+		t.Fatal("expected MSICapability to return false for a device without capabilities")
+	}
+	if _, found := dev.MSIXCapability(); found {
+		t.Fatal("expected MSIXCapability to return false for a device without capabilities")
+	}
+	if _, found := dev.PCIeCapability(); found {
+		t.Fatal("expected PCIeCapability to return false for a device without capabilities")
+	}
+
+	offsets := addCapabilities(regs, CapPowerManagement, CapMSI, CapMSIX, CapPCIExpress)
+
+	binary.LittleEndian.PutUint16(regs[offsets[0]+pmCaps:], 0x3<<pmPMEShift|pmD2Support|0x3)
+	binary.LittleEndian.PutUint16(regs[offsets[0]+pmControl:], pmNoSoftReset)
+	binary.LittleEndian.PutUint16(regs[offsets[1]+msiControl:], msiPerVectorMask|msi64BitAddr|3<<1|msiEnable)
+	binary.LittleEndian.PutUint16(regs[offsets[2]+msixControl:], 0x1f)
+	binary.LittleEndian.PutUint32(regs[offsets[2]+msixTable:], 0x2000|2)
+	binary.LittleEndian.PutUint32(regs[offsets[2]+msixPBA:], 0x3000|4)
+	binary.LittleEndian.PutUint16(regs[offsets[3]+pcieCaps:], uint16(PCIeEndpoint)<<pcieTypeShift|2)
+	binary.LittleEndian.PutUint32(regs[offsets[3]+pcieDevCaps:], 0x2)
+	binary.LittleEndian.PutUint32(regs[offsets[3]+pcieLinkCaps:], 4<<pcieLinkWidthShift|3)
+
+	expPM := PMCapability{Offset: offsets[0], Version: 3, D2Support: true, PMESupport: 0x3, NoSoftReset: true}
+	if pm, found := dev.PMCapability(); !found || pm != expPM {
+		t.Errorf("expected PMCapability to return %+v; got %+v, %t", expPM, pm, found)
+	}
+
+	expMSI := MSICapability{Offset: offsets[1], Is64Bit: true, PerVectorMask: true, MaxVectors: 8, Enabled: true}
+	if msi, found := dev.MSICapability(); !found || msi != expMSI {
+		t.Errorf("expected MSICapability to return %+v; got %+v, %t", expMSI, msi, found)
+	}
+
+	expMSIX := MSIXCapability{Offset: offsets[2], TableSize: 32, TableBIR: 2, TableOffset: 0x2000, PBABIR: 4, PBAOffset: 0x3000}
+	if msix, found := dev.MSIXCapability(); !found || msix != expMSIX {
+		t.Errorf("expected MSIXCapability to return %+v; got %+v, %t", expMSIX, msix, found)
+	}
+
+	expPCIe := PCIeCapability{Offset: offsets[3], Version: 2, DeviceType: PCIeEndpoint, MaxPayload: 512, LinkSpeed: 3, LinkWidth: 4}
+	if pcie, found := dev.PCIeCapability(); !found || pcie != expPCIe {
+		t.Errorf("expected PCIeCapability to return %+v; got %+v, %t", expPCIe, pcie, found)
+	}
+}
+
+func TestSetPowerState(t *testing.T) {
+	defer func() {
+		sleepFn = timer.Sleep
+		restorePortMocks()
+	}()
+
+	var sleeps []timer.Duration
+	sleepFn = func(d timer.Duration) {
+		sleeps = append(sleeps, d)
+	}
+
+	cs := newFakeConfigSpace()
+	regs := cs.addFunc(0, 3, 0, 0x8086, 0x10d3)
+	dev := &Device{Slot: 3}
+
+	if got := dev.PowerState(); got != PowerStateD0 {
+		t.Fatalf("expected devices without PM support to report D0; got %s", got)
+	}
+	if err := dev.SetPowerState(PowerStateD3Hot); err != errNoPowerManagement {
+		t.Fatalf("expected to get errNoPowerManagement; got %v", err)
+	}
+
+	offsets := addCapabilities(regs, CapPowerManagement)
+	binary.LittleEndian.PutUint16(regs[offsets[0]+pmCaps:], pmD2Support|0x3)
+	control := offsets[0] + pmControl
+
+	for _, state := range []PowerState{PowerStateD1, PowerStateD3Hot + 1} {
+		if err := dev.SetPowerState(state); err != errUnsupportedPowerState {
+			t.Errorf("[%s] expected to get errUnsupportedPowerState; got %v", state, err)
+		}
+	}
+
+	// PME status is write-1-to-clear so it must never be written back
+	binary.LittleEndian.PutUint16(regs[control:], pmPMEStatus|pmNoSoftReset)
+
+	specs := []struct {
+		state    PowerState
+		expSleep timer.Duration
+	}{
+		{PowerStateD2, pmD2Delay},
+		{PowerStateD3Hot, pmD3HotDelay},
+		{PowerStateD0, pmD3HotDelay},
+	}
+
+	for specIndex, spec := range specs {
+		sleeps = sleeps[:0]
+		if err := dev.SetPowerState(spec.state); err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+
+		if got := dev.PowerState(); got != spec.state {
+			t.Errorf("[spec %d] expected device to be in %s; got %s", specIndex, spec.state, got)
+		}
+
+		if len(sleeps) != 1 || sleeps[0] != spec.expSleep {
+			t.Errorf("[spec %d] expected a single sleep of %d; got %v", specIndex, spec.expSleep, sleeps)
+		}
+
+		if exp, got := pmNoSoftReset|uint16(spec.state), binary.LittleEndian.Uint16(regs[control:]); got != exp {
+			t.Errorf("[spec %d] expected PMCSR to be 0x%x; got 0x%x", specIndex, exp, got)
+		}
+	}
+
+	t.Run("already in requested state", func(t *testing.T) {
+		sleeps = sleeps[:0]
+		if err := dev.SetPowerState(PowerStateD0); err != nil || len(sleeps) != 0 {
+			t.Fatalf("expected a no-op transition; got err %v and sleeps %v", err, sleeps)
+		}
+	})
+
+	t.Run("state change not confirmed", func(t *testing.T) {
+		sleepFn = func(_ timer.Duration) {
+			binary.LittleEndian.PutUint16(regs[control:], 0)
+		}
+		if err := dev.SetPowerState(PowerStateD3Hot); err != errPowerStateNotConfirmed {
+			t.Fatalf("expected to get errPowerStateNotConfirmed; got %v", err)
+		}
+	})
+
+	if got := PowerState(7).String(); got != "D3hot" {
+		t.Errorf("expected out-of-range states to be reported as D3hot; got %s", got)
+	}
+}
@@ -0,0 +1,61 @@
+package pci
+
+import "gopheros/kernel/cpu"
+
+const (
+	configAddressPort = uint16(0xcf8)
+	configDataPort    = uint16(0xcfc)
+	configEnable      = uint32(1 << 31)
+)
+
+var (
+	// The following functions are used by tests to mock calls to the cpu
+	// package.
+	portWriteDwordFn = cpu.PortWriteDword
+	portReadDwordFn  = cpu.PortReadDword
+	portWriteWordFn  = cpu.PortWriteWord
+	portReadWordFn   = cpu.PortReadWord
+	portWriteByteFn  = cpu.PortWriteByte
+	portReadByteFn   = cpu.PortReadByte
+)
+
+// selectConfigRegister uses configuration access mechanism #1 to select the
+// config space dword that contains the register at the specified offset.
+func selectConfigRegister(bus, slot, fn, offset uint8) {
+	portWriteDwordFn(configAddressPort, configEnable|
+		uint32(bus)<<16|
+		uint32(slot&0x1f)<<11|
+		uint32(fn&0x7)<<8|
+		uint32(offset&0xfc),
+	)
+}
+
+func readConfig32(bus, slot, fn, offset uint8) uint32 {
+	selectConfigRegister(bus, slot, fn, offset)
+	return portReadDwordFn(configDataPort)
+}
+
+func readConfig16(bus, slot, fn, offset uint8) uint16 {
+	selectConfigRegister(bus, slot, fn, offset)
+	return portReadWordFn(configDataPort + uint16(offset&0x2))
+}
+
+func readConfig8(bus, slot, fn, offset uint8) uint8 {
+	selectConfigRegister(bus, slot, fn, offset)
+	return portReadByteFn(configDataPort + uint16(offset&0x3))
+}
+
+func writeConfig32(bus, slot, fn, offset uint8, val uint32) {
+	selectConfigRegister(bus, slot, fn, offset)
+	portWriteDwordFn(configDataPort, val)
+}
+
+func writeConfig16(bus, slot, fn, offset uint8, val uint16) {
+	selectConfigRegister(bus, slot, fn, offset)
+	portWriteWordFn(configDataPort+uint16(offset&0x2), val)
+}
+
+func writeConfig8(bus, slot, fn, offset uint8, val uint8) {
+	selectConfigRegister(bus, slot, fn, offset)
+	portWriteByteFn(configDataPort+uint16(offset&0x3), val)
+}
@@ -0,0 +1,191 @@
+package pci
+
+import (
+	"encoding/binary"
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+// fakeConfigSpace emulates configuration access mechanism #1 for a set of PCI
+// functions. Reads from functions that are not present return all ones.
+//
+// If emulateBARs is set, dword writes to BARs only update the address bits
+// that are writable for the BAR size registered via addBAR; the BARs of a
+// function that were not registered are hardwired to zero.
+type fakeConfigSpace struct {
+	addr  uint32
+	funcs map[uint32]*[256]byte
+
+	emulateBARs bool
+	barMasks    map[uint32]uint32
+}
+
+func newFakeConfigSpace() *fakeConfigSpace {
+	cs := &fakeConfigSpace{
+		funcs:    make(map[uint32]*[256]byte),
+		barMasks: make(map[uint32]uint32),
+	}
+
+	portWriteDwordFn = func(port uint16, val uint32) {
+		if port == configAddressPort {
+			cs.addr = val
+			return
+		}
+		if regs := cs.selected(); regs != nil {
+			offset := cs.offset(port)
+			if cs.emulateBARs && isBARRegister(regs, offset) {
+				mask := cs.barMasks[cs.addr&0xffff00|offset]
+				val = val&mask | binary.LittleEndian.Uint32(regs[offset:])&^mask
+			}
+			binary.LittleEndian.PutUint32(regs[offset:], val)
+		}
+	}
+	portWriteWordFn = func(port uint16, val uint16) {
+		if regs := cs.selected(); regs != nil {
+			binary.LittleEndian.PutUint16(regs[cs.offset(port):], val)
+		}
+	}
+	portWriteByteFn = func(port uint16, val uint8) {
+		if regs := cs.selected(); regs != nil {
+			regs[cs.offset(port)] = val
+		}
+	}
+	portReadDwordFn = func(port uint16) uint32 {
+		if regs := cs.selected(); regs != nil {
+			return binary.LittleEndian.Uint32(regs[cs.offset(port):])
+		}
+		return 0xffffffff
+	}
+	portReadWordFn = func(port uint16) uint16 {
+		if regs := cs.selected(); regs != nil {
+			return binary.LittleEndian.Uint16(regs[cs.offset(port):])
+		}
+		return 0xffff
+	}
+	portReadByteFn = func(port uint16) uint8 {
+		if regs := cs.selected(); regs != nil {
+			return regs[cs.offset(port)]
+		}
+		return 0xff
+	}
+
+	return cs
+}
+
+// addFunc registers a PCI function with the specified vendor and device ID and
+// returns its configuration space.
+func (cs *fakeConfigSpace) addFunc(bus, slot, fn uint8, vendorID, deviceID uint16) *[256]byte {
+	regs := new([256]byte)
+	binary.LittleEndian.PutUint16(regs[RegVendorID:], vendorID)
+	binary.LittleEndian.PutUint16(regs[RegDeviceID:], deviceID)
+	cs.funcs[uint32(bus)<<16|uint32(slot)<<11|uint32(fn)<<8] = regs
+	return regs
+}
+
+// addBAR sets up an unassigned BAR with the specified size and type flags for
+// a registered function. 64-bit memory BARs also occupy the following BAR.
+func (cs *fakeConfigSpace) addBAR(bus, slot, fn, index uint8, size uint64, flags uint32) {
+	var (
+		key    = uint32(bus)<<16 | uint32(slot)<<11 | uint32(fn)<<8
+		regs   = cs.funcs[key]
+		offset = uint32(RegBAR0 + 4*index)
+		mask   = ^(size - 1)
+	)
+
+	binary.LittleEndian.PutUint32(regs[offset:], flags)
+	cs.barMasks[key|offset] = uint32(mask)
+	if flags&barIOSpace == 0 && flags&barTypeMask == barType64 {
+		cs.barMasks[key|(offset+4)] = uint32(mask >> 32)
+	}
+}
+
+// isBARRegister returns true if offset refers to a BAR of the function with
+// the specified configuration space.
+func isBARRegister(regs *[256]byte, offset uint32) bool {
+	count := uint32(numBARs)
+	if regs[RegHeaderType]&headerTypeMask == headerTypeBridge {
+		count = numBridgeBARs
+	}
+
+	return offset >= uint32(RegBAR0) && offset < uint32(RegBAR0)+4*count
+}
+
+func (cs *fakeConfigSpace) selected() *[256]byte {
+	if cs.addr&configEnable == 0 {
+		return nil
+	}
+	return cs.funcs[cs.addr&0xffff00]
+}
+
+func (cs *fakeConfigSpace) offset(port uint16) uint32 {
+	return cs.addr&0xfc + uint32(port-configDataPort)
+}
+
+func restorePortMocks() {
+	portWriteDwordFn = cpu.PortWriteDword
+	portReadDwordFn = cpu.PortReadDword
+	portWriteWordFn = cpu.PortWriteWord
+	portReadWordFn = cpu.PortReadWord
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn = cpu.PortReadByte
+}
+
+func TestConfigAccess(t *testing.T) {
+	defer restorePortMocks()
+
+	var lastAddr uint32
+	portWriteDwordFn = func(port uint16, val uint32) {
+		if port == configAddressPort {
+			lastAddr = val
+		}
+	}
+
+	selectConfigRegister(0x12, 0x1f, 0x7, 0x3f)
+	if exp := uint32(0x8012ff3c); lastAddr != exp {
+		t.Fatalf("expected config address to be 0x%x; got 0x%x", exp, lastAddr)
+	}
+
+	cs := newFakeConfigSpace()
+	regs := cs.addFunc(1, 2, 3, 0x8086, 0x100e)
+
+	writeConfig32(1, 2, 3, 0x10, 0xfebc0000)
+	writeConfig16(1, 2, 3, 0x16, 0xbeef)
+	writeConfig8(1, 2, 3, 0x3c, 0x0b)
+
+	specs := []struct {
+		offset uint8
+		width  int
+		exp    uint32
+	}{
+		{0x00, 32, 0x100e8086},
+		{0x02, 16, 0x100e},
+		{0x01, 8, 0x80},
+		{0x10, 32, 0xfebc0000},
+		{0x16, 16, 0xbeef},
+		{0x3c, 8, 0x0b},
+	}
+
+	for specIndex, spec := range specs {
+		var got uint32
+		switch spec.width {
+		case 32:
+			got = readConfig32(1, 2, 3, spec.offset)
+		case 16:
+			got = uint32(readConfig16(1, 2, 3, spec.offset))
+		case 8:
+			got = uint32(readConfig8(1, 2, 3, spec.offset))
+		}
+
+		if got != spec.exp {
+			t.Errorf("[spec %d] expected %d-bit read at offset 0x%x to return 0x%x; got 0x%x", specIndex, spec.width, spec.offset, spec.exp, got)
+		}
+	}
+
+	if regs[0x17] != 0xbe {
+		t.Error("expected 16-bit write to update the upper half of the selected dword")
+	}
+
+	if got := readConfig16(0, 0, 0, RegVendorID); got != invalidVendorID {
+		t.Errorf("expected read from missing function to return 0x%x; got 0x%x", invalidVendorID, got)
+	}
+}
@@ -0,0 +1,249 @@
+package pci
+
+// Standard configuration space register offsets.
+const (
+	RegVendorID      = uint8(0x00)
+	RegDeviceID      = uint8(0x02)
+	RegCommand       = uint8(0x04)
+	RegStatus        = uint8(0x06)
+	RegRevisionID    = uint8(0x08)
+	RegProgIF        = uint8(0x09)
+	RegSubclass      = uint8(0x0a)
+	RegClassCode     = uint8(0x0b)
+	RegHeaderType    = uint8(0x0e)
+	RegBAR0          = uint8(0x10)
+	RegSecondaryBus  = uint8(0x19)
+	RegCapabilities  = uint8(0x34)
+	RegInterruptLine = uint8(0x3c)
+	RegInterruptPin  = uint8(0x3d)
+)
+
+// PCI-to-PCI bridge (type 1 header) configuration space register offsets.
+const (
+	RegIOBase          = uint8(0x1c)
+	RegIOLimit         = uint8(0x1d)
+	RegMemoryBase      = uint8(0x20)
+	RegMemoryLimit     = uint8(0x22)
+	RegPrefMemoryBase  = uint8(0x24)
+	RegPrefMemoryLimit = uint8(0x26)
+	RegPrefBaseUpper   = uint8(0x28)
+	RegPrefLimitUpper  = uint8(0x2c)
+)
+
+// Command register bits.
+const (
+	CommandIOSpace          = uint16(1 << 0)
+	CommandMemorySpace      = uint16(1 << 1)
+	CommandBusMaster        = uint16(1 << 2)
+	CommandInterruptDisable = uint16(1 << 10)
+)
+
+const (
+	statusCapabilities  = uint16(1 << 4)
+	headerTypeMask      = uint8(0x7f)
+	headerMultiFunction = uint8(0x80)
+	invalidVendorID     = uint16(0xffff)
+
+	barIOSpace   = uint32(1 << 0)
+	barType64    = uint32(2 << 1)
+	barTypeMask  = uint32(3 << 1)
+	barIOMask    = ^uint32(0x3)
+	barMemMask   = ^uint32(0xf)
+	numBARs      = 6
+	maxCapLength = 48
+
+	// Enable requests for the I/O space, memory space and bus master bits
+	// (the low command register bits) are reference-counted.
+	refCommandFlags    = CommandIOSpace | CommandMemorySpace | CommandBusMaster
+	numRefCommandFlags = 3
+)
+
+// Device describes a PCI function that was discovered while enumerating the
+// PCI buses.
+type Device struct {
+	Bus  uint8
+	Slot uint8
+	Func uint8
+
+	VendorID   uint16
+	DeviceID   uint16
+	ClassCode  uint8
+	Subclass   uint8
+	ProgIF     uint8
+	RevisionID uint8
+	HeaderType uint8
+
+	// secondaryBus is the bus number behind a PCI-to-PCI bridge. It is
+	// set to 0 for all other devices.
+	secondaryBus uint8
+
+	// InterruptPin is set to 0 if the device does not use legacy INTx
+	// interrupts or to 1-4 for INTA-INTD.
+	InterruptPin uint8
+
+	// commandRefs counts the outstanding EnableCommandFlags requests for
+	// each reference-counted command register bit.
+	commandRefs [numRefCommandFlags]uint16
+}
+
+// ReadConfig32 reads a dword from the device's configuration space.
+func (dev *Device) ReadConfig32(offset uint8) uint32 {
+	return readConfig32(dev.Bus, dev.Slot, dev.Func, offset)
+}
+
+// ReadConfig16 reads a word from the device's configuration space.
+func (dev *Device) ReadConfig16(offset uint8) uint16 {
+	return readConfig16(dev.Bus, dev.Slot, dev.Func, offset)
+}
+
+// ReadConfig8 reads a byte from the device's configuration space.
+func (dev *Device) ReadConfig8(offset uint8) uint8 {
+	return readConfig8(dev.Bus, dev.Slot, dev.Func, offset)
+}
+
+// WriteConfig32 writes a dword to the device's configuration space.
+func (dev *Device) WriteConfig32(offset uint8, val uint32) {
+	writeConfig32(dev.Bus, dev.Slot, dev.Func, offset, val)
+}
+
+// WriteConfig16 writes a word to the device's configuration space.
+func (dev *Device) WriteConfig16(offset uint8, val uint16) {
+	writeConfig16(dev.Bus, dev.Slot, dev.Func, offset, val)
+}
+
+// WriteConfig8 writes a byte to the device's configuration space.
+func (dev *Device) WriteConfig8(offset uint8, val uint8) {
+	writeConfig8(dev.Bus, dev.Slot, dev.Func, offset, val)
+}
+
+// VisitCapabilities invokes visitor for each entry in the device's capability
+// list. The visitor receives the capability ID and its offset in the
+// configuration space and may abort the scan by returning false.
+func (dev *Device) VisitCapabilities(visitor func(id, offset uint8) bool) {
+	if dev.ReadConfig16(RegStatus)&statusCapabilities == 0 {
+		return
+	}
+
+	// Guard against malformed capability lists that contain loops
+	offset := dev.ReadConfig8(RegCapabilities) &^ 0x3
+	for count := 0; offset != 0 && count < maxCapLength; count++ {
+		if !visitor(dev.ReadConfig8(offset), offset) {
+			return
+		}
+		offset = dev.ReadConfig8(offset+1) &^ 0x3
+	}
+}
+
+// FindCapability returns the configuration space offset of the first
+// capability with the specified ID and true or 0 and false if the device does
+// not provide the capability.
+func (dev *Device) FindCapability(capID uint8) (uint8, bool) {
+	var capOffset uint8
+	dev.VisitCapabilities(func(id, offset uint8) bool {
+		if id == capID {
+			capOffset = offset
+			return false
+		}
+		return true
+	})
+
+	return capOffset, capOffset != 0
+}
+
+// BAR returns the address programmed into the specified base address register
+// and a flag indicating whether it refers to the I/O space. For 64-bit memory
+// BARs, the upper half of the address is read from the following register.
+func (dev *Device) BAR(index uint8) (uint64, bool) {
+	if index >= numBARs {
+		return 0, false
+	}
+
+	reg := RegBAR0 + 4*index
+	val := dev.ReadConfig32(reg)
+	if val&barIOSpace != 0 {
+		return uint64(val & barIOMask), true
+	}
+
+	addr := uint64(val & barMemMask)
+	if val&barTypeMask == barType64 && index+1 < numBARs {
+		addr |= uint64(dev.ReadConfig32(reg+4)) << 32
+	}
+
+	return addr, false
+}
+
+// SetCommandFlags sets the specified flags in the device's command register.
+func (dev *Device) SetCommandFlags(flags uint16) {
+	dev.WriteConfig16(RegCommand, dev.ReadConfig16(RegCommand)|flags)
+}
+
+// ClearCommandFlags clears the specified flags in the device's command
+// register.
+func (dev *Device) ClearCommandFlags(flags uint16) {
+	dev.WriteConfig16(RegCommand, dev.ReadConfig16(RegCommand)&^flags)
+}
+
+// EnableCommandFlags sets the specified flags in the device's command register.
+// Requests to enable the I/O space, memory space and bus master bits are
+// reference-counted so that drivers sharing a function can each pair their
+// enable call with a DisableCommandFlags call when they unbind.
+func (dev *Device) EnableCommandFlags(flags uint16) {
+	for bit := uint16(0); bit < numRefCommandFlags; bit++ {
+		if flags&(1<<bit) != 0 {
+			dev.commandRefs[bit]++
+		}
+	}
+
+	dev.SetCommandFlags(flags)
+}
+
+// DisableCommandFlags releases a reference obtained via EnableCommandFlags.
+// Reference-counted bits are cleared once their last reference is released;
+// any other specified flags are cleared immediately.
+func (dev *Device) DisableCommandFlags(flags uint16) {
+	var clear uint16
+	for bit := uint16(0); bit < numRefCommandFlags; bit++ {
+		if flags&(1<<bit) == 0 {
+			continue
+		}
+
+		if dev.commandRefs[bit] > 0 {
+			dev.commandRefs[bit]--
+		}
+		if dev.commandRefs[bit] == 0 {
+			clear |= 1 << bit
+		}
+	}
+
+	dev.ClearCommandFlags(clear | flags&^refCommandFlags)
+}
+
+// EnableBusMaster allows the device to initiate DMA transfers.
+func (dev *Device) EnableBusMaster() {
+	dev.EnableCommandFlags(CommandBusMaster)
+}
+
+// DisableBusMaster releases a reference obtained via EnableBusMaster.
+func (dev *Device) DisableBusMaster() {
+	dev.DisableCommandFlags(CommandBusMaster)
+}
+
+// EnableMemorySpace enables decoding of the device's memory BARs.
+func (dev *Device) EnableMemorySpace() {
+	dev.EnableCommandFlags(CommandMemorySpace)
+}
+
+// DisableMemorySpace releases a reference obtained via EnableMemorySpace.
+func (dev *Device) DisableMemorySpace() {
+	dev.DisableCommandFlags(CommandMemorySpace)
+}
+
+// EnableIOSpace enables decoding of the device's I/O BARs.
+func (dev *Device) EnableIOSpace() {
+	dev.EnableCommandFlags(CommandIOSpace)
+}
+
+// DisableIOSpace releases a reference obtained via EnableIOSpace.
+func (dev *Device) DisableIOSpace() {
+	dev.DisableCommandFlags(CommandIOSpace)
+}
@@ -0,0 +1,129 @@
+package pci
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDeviceCapabilities(t *testing.T) {
+	defer restorePortMocks()
+
+	cs := newFakeConfigSpace()
+	regs := cs.addFunc(0, 3, 0, 0x1af4, 0x1000)
+	dev := &Device{Slot: 3}
+
+	if _, found := dev.FindCapability(CapMSI); found {
+		t.Fatal("expected capability lookup to fail when the status register does not advertise a capability list")
+	}
+
+	binary.LittleEndian.PutUint16(regs[RegStatus:], statusCapabilities)
+	regs[RegCapabilities] = 0x40
+	regs[0x40], regs[0x41] = 0x01, 0x50 // power management
+	regs[0x50], regs[0x51] = CapMSI, 0x60
+	regs[0x60], regs[0x61] = CapMSIX, 0x00
+
+	var visited []uint8
+	dev.VisitCapabilities(func(id, _ uint8) bool {
+		visited = append(visited, id)
+		return true
+	})
+
+	if exp := []uint8{0x01, CapMSI, CapMSIX}; len(visited) != len(exp) || visited[0] != exp[0] || visited[1] != exp[1] || visited[2] != exp[2] {
+		t.Fatalf("expected to visit capabilities %v; got %v", exp, visited)
+	}
+
+	if offset, found := dev.FindCapability(CapMSIX); !found || offset != 0x60 {
+		t.Fatalf("expected MSI-X capability at offset 0x60; got 0x%x (found: %t)", offset, found)
+	}
+
+	if _, found := dev.FindCapability(0x10); found {
+		t.Fatal("expected lookup for missing capability to fail")
+	}
+
+	t.Run("looping capability list", func(t *testing.T) {
+		regs[0x61] = 0x40
+
+		var count int
+		dev.VisitCapabilities(func(_, _ uint8) bool {
+			count++
+			return true
+		})
+
+		if count != maxCapLength {
+			t.Fatalf("expected capability scan to stop after %d entries; got %d", maxCapLength, count)
+		}
+	})
+}
+
+func TestDeviceBAR(t *testing.T) {
+	defer restorePortMocks()
+
+	cs := newFakeConfigSpace()
+	regs := cs.addFunc(0, 1, 0, 0x8086, 0x2922)
+	dev := &Device{Slot: 1}
+
+	binary.LittleEndian.PutUint32(regs[RegBAR0:], 0xc041)
+	binary.LittleEndian.PutUint32(regs[RegBAR0+4:], 0xfebf1008)
+	binary.LittleEndian.PutUint32(regs[RegBAR0+8:], 0xe000000c)
+	binary.LittleEndian.PutUint32(regs[RegBAR0+12:], 0x1)
+
+	specs := []struct {
+		index   uint8
+		expAddr uint64
+		expIO   bool
+	}{
+		{0, 0xc040, true},
+		{1, 0xfebf1000, false},
+		{2, 0x1e0000000, false},
+		{6, 0, false},
+	}
+
+	for specIndex, spec := range specs {
+		addr, isIO := dev.BAR(spec.index)
+		if addr != spec.expAddr || isIO != spec.expIO {
+			t.Errorf("[spec %d] expected BAR%d to be (0x%x, %t); got (0x%x, %t)", specIndex, spec.index, spec.expAddr, spec.expIO, addr, isIO)
+		}
+	}
+
+	dev.SetCommandFlags(CommandMemorySpace | CommandBusMaster)
+	dev.ClearCommandFlags(CommandMemorySpace)
+	if got := dev.ReadConfig16(RegCommand); got != CommandBusMaster {
+		t.Fatalf("expected command register to be 0x%x; got 0x%x", CommandBusMaster, got)
+	}
+}
+
+func TestCommandFlagRefCounting(t *testing.T) {
+	defer restorePortMocks()
+
+	cs := newFakeConfigSpace()
+	cs.addFunc(0, 2, 0, 0x8086, 0x100e)
+	dev := &Device{Slot: 2}
+
+	// Two drivers sharing the function both request bus mastering
+	dev.EnableBusMaster()
+	dev.EnableCommandFlags(CommandBusMaster | CommandMemorySpace | CommandInterruptDisable)
+	dev.EnableIOSpace()
+	if exp, got := CommandBusMaster|CommandMemorySpace|CommandIOSpace|CommandInterruptDisable, dev.ReadConfig16(RegCommand); got != exp {
+		t.Fatalf("expected command register to be 0x%x; got 0x%x", exp, got)
+	}
+
+	dev.DisableCommandFlags(CommandBusMaster | CommandInterruptDisable)
+	dev.DisableIOSpace()
+	if exp, got := CommandBusMaster|CommandMemorySpace, dev.ReadConfig16(RegCommand); got != exp {
+		t.Fatalf("expected command register to be 0x%x; got 0x%x", exp, got)
+	}
+
+	dev.DisableBusMaster()
+	dev.DisableMemorySpace()
+	if got := dev.ReadConfig16(RegCommand); got != 0 {
+		t.Fatalf("expected command register to be cleared; got 0x%x", got)
+	}
+
+	// Unbalanced disable calls must not underflow the reference counts
+	dev.DisableBusMaster()
+	dev.EnableBusMaster()
+	dev.EnableMemorySpace()
+	if exp, got := CommandBusMaster|CommandMemorySpace, dev.ReadConfig16(RegCommand); got != exp {
+		t.Fatalf("expected command register to be 0x%x; got 0x%x", exp, got)
+	}
+}
@@ -0,0 +1,27 @@
+package pci
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/irq"
+)
+
+var (
+	// The following functions are used by tests to mock calls to the irq
+	// package.
+	activeControllerFn = irq.ActiveController
+	setTriggerModeFn   = irq.SetTriggerMode
+)
+
+// SetINTxTriggerMode configures the GSI that delivers the legacy INTx
+// interrupt line of a device as level-triggered and active-low, as required
+// by the PCI specification. It must be invoked before the first handler for
+// the GSI is registered. Interrupt controllers that do not support configuring
+// trigger modes (e.g. the legacy PIC whose PCI lines are set up by the
+// firmware) are left untouched.
+func SetINTxTriggerMode(gsi uint32) *kernel.Error {
+	if _, ok := activeControllerFn().(irq.TriggerModeSetter); !ok {
+		return nil
+	}
+
+	return setTriggerModeFn(gsi, irq.TriggerLevel, irq.PolarityActiveLow)
+}
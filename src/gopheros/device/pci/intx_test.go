@@ -0,0 +1,66 @@
+package pci
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"testing"
+)
+
+type mockController struct{}
+
+func (mockController) Route(_ uint32, _ gate.InterruptNumber) *kernel.Error { return nil }
+func (mockController) EOI(_ gate.InterruptNumber)                           {}
+func (mockController) Mask(_ uint32)                                        {}
+func (mockController) Unmask(_ uint32)                                      {}
+
+type mockTriggerController struct {
+	mockController
+}
+
+func (mockTriggerController) SetTriggerMode(_ uint32, _ irq.TriggerMode, _ irq.Polarity) *kernel.Error {
+	return nil
+}
+
+func TestSetINTxTriggerMode(t *testing.T) {
+	defer func() {
+		activeControllerFn = irq.ActiveController
+		setTriggerModeFn = irq.SetTriggerMode
+	}()
+
+	type call struct {
+		gsi      uint32
+		trigger  irq.TriggerMode
+		polarity irq.Polarity
+	}
+
+	var (
+		calls  []call
+		expErr = &kernel.Error{Module: "test", Message: "unknown GSI"}
+		retErr *kernel.Error
+	)
+	setTriggerModeFn = func(gsi uint32, trigger irq.TriggerMode, polarity irq.Polarity) *kernel.Error {
+		calls = append(calls, call{gsi, trigger, polarity})
+		return retErr
+	}
+
+	// Controllers without trigger mode support are left untouched
+	activeControllerFn = func() irq.Controller { return mockController{} }
+	if err := SetINTxTriggerMode(11); err != nil || len(calls) != 0 {
+		t.Fatalf("expected no trigger mode changes for the PIC; got %v, %d calls", err, len(calls))
+	}
+
+	activeControllerFn = func() irq.Controller { return mockTriggerController{} }
+	if err := SetINTxTriggerMode(16); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := (call{16, irq.TriggerLevel, irq.PolarityActiveLow}); len(calls) != 1 || calls[0] != exp {
+		t.Fatalf("expected GSI 16 to be configured as level-triggered and active-low; got %v", calls)
+	}
+
+	retErr = expErr
+	if err := SetINTxTriggerMode(16); err != expErr {
+		t.Errorf("expected to get error %v; got %v", expErr, err)
+	}
+}
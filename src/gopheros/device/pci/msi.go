@@ -0,0 +1,233 @@
+package pci
+
+import (
+	"gopheros/device/apic"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"unsafe"
+)
+
+// Capability IDs for message-signaled interrupts.
+const (
+	CapMSI  = uint8(0x05)
+	CapMSIX = uint8(0x11)
+)
+
+const (
+	msiControl    = uint8(2)
+	msiAddrLo     = uint8(4)
+	msiAddrHi     = uint8(8)
+	msiData32     = uint8(8)
+	msiData64     = uint8(12)
+	msiEnable     = uint16(1 << 0)
+	msiMultiMsg   = uint16(7 << 4)
+	msi64BitAddr  = uint16(1 << 7)
+	msixControl   = uint8(2)
+	msixTable     = uint8(4)
+	msixTableSize = uint16(0x7ff)
+	msixFuncMask  = uint16(1 << 14)
+	msixEnable    = uint16(1 << 15)
+	msixBIRMask   = uint32(0x7)
+
+	msixEntrySize    = 16
+	msixEntryAddrLo  = 0
+	msixEntryAddrHi  = 4
+	msixEntryData    = 8
+	msixEntryControl = 12
+	msixEntryMasked  = uint32(1 << 0)
+
+	// msiAddressBase is the base of the address range that the local APICs
+	// decode as message-signaled interrupt writes. The destination APIC ID
+	// is encoded in bits 12-19.
+	msiAddressBase = uint32(0xfee00000)
+)
+
+var (
+	errNoLocalAPIC      = &kernel.Error{Module: "pci", Message: "message-signaled interrupts require a local APIC"}
+	errNoMSI            = &kernel.Error{Module: "pci", Message: "device does not support MSI"}
+	errNoMSIX           = &kernel.Error{Module: "pci", Message: "device does not support MSI-X"}
+	errTooManyVectors   = &kernel.Error{Module: "pci", Message: "requested number of MSI-X vectors exceeds the device's table size"}
+	errInvalidMSIXTable = &kernel.Error{Module: "pci", Message: "MSI-X table is located in an I/O or unassigned BAR"}
+
+	// The following functions are used by tests to mock calls to the irq,
+	// vmm and apic packages.
+	allocVectorFn     = irq.AllocVector
+	freeVectorFn      = irq.FreeVector
+	registerHandlerFn = irq.RegisterHandler
+	mapRegionFn       = vmm.MapRegion
+	unmapFn           = vmm.Unmap
+	localAPICIDFn     = localAPICID
+)
+
+// EnableMSI configures the device to signal interrupts using a single MSI
+// message, allocates an interrupt vector for it and attaches handler to that
+// vector. Legacy INTx interrupts are disabled for the device once MSI has been
+// enabled. The function returns the allocated vector which can be released via
+// irq.FreeVector after a call to DisableMSI.
+func (dev *Device) EnableMSI(handler irq.Handler) (gate.InterruptNumber, *kernel.Error) {
+	capOffset, found := dev.FindCapability(CapMSI)
+	if !found {
+		return 0, errNoMSI
+	}
+
+	addr, err := msiAddress()
+	if err != nil {
+		return 0, err
+	}
+
+	vector, err := allocVectorFn()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = registerHandlerFn(vector, handler); err != nil {
+		freeVectorFn(vector)
+		return 0, err
+	}
+
+	// Only a single message is requested so the multiple message enable
+	// field is always cleared.
+	control := dev.ReadConfig16(capOffset+msiControl) &^ (msiEnable | msiMultiMsg)
+	dev.WriteConfig32(capOffset+msiAddrLo, addr)
+	if control&msi64BitAddr != 0 {
+		dev.WriteConfig32(capOffset+msiAddrHi, 0)
+		dev.WriteConfig16(capOffset+msiData64, uint16(vector))
+	} else {
+		dev.WriteConfig16(capOffset+msiData32, uint16(vector))
+	}
+	dev.WriteConfig16(capOffset+msiControl, control|msiEnable)
+
+	dev.SetCommandFlags(CommandInterruptDisable)
+	return vector, nil
+}
+
+// DisableMSI disables message-signaled interrupts for the device.
+func (dev *Device) DisableMSI() {
+	if capOffset, found := dev.FindCapability(CapMSI); found {
+		dev.WriteConfig16(capOffset+msiControl, dev.ReadConfig16(capOffset+msiControl)&^msiEnable)
+	}
+}
+
+// EnableMSIX configures the device to signal interrupts using MSI-X. A vector
+// is allocated for each one of the supplied handlers and programmed into the
+// MSI-X table entry with the same index. Legacy INTx interrupts are disabled
+// for the device once MSI-X has been enabled. The function returns the
+// allocated vectors which can be released via irq.FreeVector after a call to
+// DisableMSIX.
+func (dev *Device) EnableMSIX(handlers []irq.Handler) ([]gate.InterruptNumber, *kernel.Error) {
+	capOffset, found := dev.FindCapability(CapMSIX)
+	if !found {
+		return nil, errNoMSIX
+	}
+
+	control := dev.ReadConfig16(capOffset + msixControl)
+	if len(handlers) > int(control&msixTableSize)+1 {
+		return nil, errTooManyVectors
+	}
+
+	addr, err := msiAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	numEntries := int(control&msixTableSize) + 1
+	tableBase, err := dev.mapMSIXTable(capOffset, numEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	vectors := make([]gate.InterruptNumber, 0, len(handlers))
+	for _, handler := range handlers {
+		vector, err := allocVectorFn()
+		if err == nil {
+			if err = registerHandlerFn(vector, handler); err != nil {
+				freeVectorFn(vector)
+			}
+		}
+
+		if err != nil {
+			for _, allocated := range vectors {
+				freeVectorFn(allocated)
+			}
+			unmapMSIXTable(tableBase, numEntries)
+			return nil, err
+		}
+
+		vectors = append(vectors, vector)
+	}
+
+	// Mask all vectors while the table is being programmed
+	dev.WriteConfig16(capOffset+msixControl, control|msixEnable|msixFuncMask)
+	for index, vector := range vectors {
+		entry := tableBase + uintptr(index*msixEntrySize)
+		*(*uint32)(unsafe.Pointer(entry + msixEntryAddrLo)) = addr
+		*(*uint32)(unsafe.Pointer(entry + msixEntryAddrHi)) = 0
+		*(*uint32)(unsafe.Pointer(entry + msixEntryData)) = uint32(vector)
+		*(*uint32)(unsafe.Pointer(entry + msixEntryControl)) &^= msixEntryMasked
+	}
+	dev.WriteConfig16(capOffset+msixControl, (control|msixEnable)&^msixFuncMask)
+
+	dev.SetCommandFlags(CommandInterruptDisable)
+	return vectors, nil
+}
+
+// DisableMSIX disables MSI-X interrupts for the device.
+func (dev *Device) DisableMSIX() {
+	if capOffset, found := dev.FindCapability(CapMSIX); found {
+		dev.WriteConfig16(capOffset+msixControl, dev.ReadConfig16(capOffset+msixControl)&^msixEnable)
+	}
+}
+
+// mapMSIXTable maps the MSI-X table into the kernel's address space and
+// returns its virtual address.
+func (dev *Device) mapMSIXTable(capOffset uint8, numEntries int) (uintptr, *kernel.Error) {
+	tableInfo := dev.ReadConfig32(capOffset + msixTable)
+	barAddr, isIO := dev.BAR(uint8(tableInfo & msixBIRMask))
+	if isIO || barAddr == 0 {
+		return 0, errInvalidMSIXTable
+	}
+
+	tableAddr := uintptr(barAddr) + uintptr(tableInfo&^msixBIRMask)
+	page, err := mapRegionFn(
+		mm.FrameFromAddress(tableAddr),
+		vmm.PageOffset(tableAddr)+uintptr(numEntries*msixEntrySize),
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute|vmm.FlagDoNotCache,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return page.Address() + vmm.PageOffset(tableAddr), nil
+}
+
+// unmapMSIXTable removes the mapping established by mapMSIXTable for a table
+// with numEntries entries at the virtual address tableBase.
+func unmapMSIXTable(tableBase uintptr, numEntries int) {
+	end := tableBase + uintptr(numEntries*msixEntrySize)
+	for page := mm.PageFromAddress(tableBase); page.Address() < end; page++ {
+		_ = unmapFn(page)
+	}
+}
+
+// msiAddress returns the message address that routes MSI writes to the local
+// APIC of the current CPU.
+func msiAddress() (uint32, *kernel.Error) {
+	id, err := localAPICIDFn()
+	if err != nil {
+		return 0, err
+	}
+
+	return msiAddressBase | uint32(id)<<12, nil
+}
+
+func localAPICID() (uint8, *kernel.Error) {
+	lapic := apic.ActiveLocalAPIC()
+	if lapic == nil {
+		return 0, errNoLocalAPIC
+	}
+
+	return lapic.ID(), nil
+}
@@ -0,0 +1,273 @@
+package pci
+
+import (
+	"encoding/binary"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"testing"
+	"unsafe"
+)
+
+func restoreMSIMocks() {
+	allocVectorFn = irq.AllocVector
+	freeVectorFn = irq.FreeVector
+	registerHandlerFn = irq.RegisterHandler
+	mapRegionFn = vmm.MapRegion
+	unmapFn = vmm.Unmap
+	localAPICIDFn = localAPICID
+	restorePortMocks()
+}
+
+func testMSIHandler(_ *gate.Registers) bool { return true }
+
+// mockVectorAllocator hands out sequential vectors starting at
+// irq.FirstDynamicVector and tracks the vectors that were freed.
+type mockVectorAllocator struct {
+	next  gate.InterruptNumber
+	limit int
+	freed []gate.InterruptNumber
+}
+
+func newMockVectorAllocator(limit int) *mockVectorAllocator {
+	alloc := &mockVectorAllocator{next: irq.FirstDynamicVector, limit: limit}
+
+	allocVectorFn = func() (gate.InterruptNumber, *kernel.Error) {
+		if alloc.limit == 0 {
+			return 0, &kernel.Error{Module: "test", Message: "out of vectors"}
+		}
+		alloc.limit--
+		alloc.next++
+		return alloc.next - 1, nil
+	}
+	freeVectorFn = func(vector gate.InterruptNumber) {
+		alloc.freed = append(alloc.freed, vector)
+	}
+	registerHandlerFn = func(_ gate.InterruptNumber, _ irq.Handler) *kernel.Error {
+		return nil
+	}
+	localAPICIDFn = func() (uint8, *kernel.Error) {
+		return 3, nil
+	}
+
+	return alloc
+}
+
+func TestEnableMSI(t *testing.T) {
+	defer restoreMSIMocks()
+
+	cs := newFakeConfigSpace()
+	regs := cs.addFunc(0, 5, 0, 0x1af4, 0x1041)
+	dev := &Device{Slot: 5}
+
+	if _, err := dev.EnableMSI(testMSIHandler); err != errNoMSI {
+		t.Fatalf("expected to get errNoMSI; got %v", err)
+	}
+
+	binary.LittleEndian.PutUint16(regs[RegStatus:], statusCapabilities)
+	regs[RegCapabilities] = 0x50
+	regs[0x50] = CapMSI
+
+	t.Run("no local APIC", func(t *testing.T) {
+		localAPICIDFn = localAPICID
+		if _, err := dev.EnableMSI(testMSIHandler); err != errNoLocalAPIC {
+			t.Fatalf("expected to get errNoLocalAPIC; got %v", err)
+		}
+	})
+
+	t.Run("handler registration error", func(t *testing.T) {
+		alloc := newMockVectorAllocator(1)
+		expErr := &kernel.Error{Module: "test", Message: "register failed"}
+		registerHandlerFn = func(_ gate.InterruptNumber, _ irq.Handler) *kernel.Error {
+			return expErr
+		}
+
+		if _, err := dev.EnableMSI(testMSIHandler); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+
+		if len(alloc.freed) != 1 || alloc.freed[0] != irq.FirstDynamicVector {
+			t.Fatalf("expected allocated vector to be freed; freed: %v", alloc.freed)
+		}
+	})
+
+	specs := []struct {
+		control    uint16
+		dataOffset uint8
+	}{
+		{0x0000, msiData32},
+		{msi64BitAddr | 0x0012, msiData64},
+	}
+
+	for specIndex, spec := range specs {
+		for i := 0x52; i < 0x60; i++ {
+			regs[i] = 0
+		}
+		binary.LittleEndian.PutUint16(regs[0x52:], spec.control)
+		binary.LittleEndian.PutUint16(regs[RegCommand:], 0)
+		newMockVectorAllocator(1)
+
+		vector, err := dev.EnableMSI(testMSIHandler)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if vector != irq.FirstDynamicVector {
+			t.Errorf("[spec %d] expected to get vector %d; got %d", specIndex, irq.FirstDynamicVector, vector)
+		}
+
+		if got := dev.ReadConfig32(0x50 + msiAddrLo); got != 0xfee03000 {
+			t.Errorf("[spec %d] expected message address to be 0xfee03000; got 0x%x", specIndex, got)
+		}
+
+		if got := dev.ReadConfig16(0x50 + spec.dataOffset); got != uint16(vector) {
+			t.Errorf("[spec %d] expected message data to be 0x%x; got 0x%x", specIndex, vector, got)
+		}
+
+		if got := dev.ReadConfig16(0x50 + msiControl); got != (spec.control&^msiMultiMsg)|msiEnable {
+			t.Errorf("[spec %d] unexpected MSI control register value: 0x%x", specIndex, got)
+		}
+
+		if got := dev.ReadConfig16(RegCommand); got&CommandInterruptDisable == 0 {
+			t.Errorf("[spec %d] expected INTx interrupts to be disabled", specIndex)
+		}
+
+		dev.DisableMSI()
+		if got := dev.ReadConfig16(0x50 + msiControl); got&msiEnable != 0 {
+			t.Errorf("[spec %d] expected MSI to be disabled", specIndex)
+		}
+	}
+}
+
+func TestEnableMSIX(t *testing.T) {
+	defer restoreMSIMocks()
+
+	cs := newFakeConfigSpace()
+	regs := cs.addFunc(0, 6, 0, 0x8086, 0x10d3)
+	dev := &Device{Slot: 6}
+	handlers := []irq.Handler{testMSIHandler, testMSIHandler, testMSIHandler}
+
+	if _, err := dev.EnableMSIX(handlers); err != errNoMSIX {
+		t.Fatalf("expected to get errNoMSIX; got %v", err)
+	}
+
+	// MSI-X capability with a 4-entry table at offset 0x2000 of BAR3
+	binary.LittleEndian.PutUint16(regs[RegStatus:], statusCapabilities)
+	regs[RegCapabilities] = 0xa0
+	regs[0xa0] = CapMSIX
+	binary.LittleEndian.PutUint16(regs[0xa2:], 3)
+	binary.LittleEndian.PutUint32(regs[0xa4:], 0x2000|3)
+	newMockVectorAllocator(8)
+
+	t.Run("too many vectors", func(t *testing.T) {
+		if _, err := dev.EnableMSIX(make([]irq.Handler, 5)); err != errTooManyVectors {
+			t.Fatalf("expected to get errTooManyVectors; got %v", err)
+		}
+	})
+
+	t.Run("unassigned BAR", func(t *testing.T) {
+		if _, err := dev.EnableMSIX(handlers); err != errInvalidMSIXTable {
+			t.Fatalf("expected to get errInvalidMSIXTable; got %v", err)
+		}
+	})
+
+	binary.LittleEndian.PutUint32(regs[RegBAR0+12:], 0xfebf0000)
+
+	t.Run("map error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if _, err := dev.EnableMSIX(handlers); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+
+	// Allocate a page-aligned buffer for the MSI-X table with all entries
+	// masked.
+	buf := make([]byte, 2*mm.PageSize)
+	tableBase := (uintptr(unsafe.Pointer(&buf[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+	for index := uintptr(0); index < 4; index++ {
+		*(*uint32)(unsafe.Pointer(tableBase + index*msixEntrySize + msixEntryControl)) = msixEntryMasked
+	}
+
+	var mappedFrame mm.Frame
+	mapRegionFn = func(frame mm.Frame, _ uintptr, flags vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		mappedFrame = frame
+		if flags&vmm.FlagDoNotCache == 0 {
+			t.Error("expected MSI-X table to be mapped as uncacheable")
+		}
+		return mm.PageFromAddress(tableBase), nil
+	}
+
+	t.Run("vector allocation error", func(t *testing.T) {
+		var unmapped []mm.Page
+		unmapFn = func(page mm.Page) *kernel.Error {
+			unmapped = append(unmapped, page)
+			return nil
+		}
+		defer func() { unmapFn = vmm.Unmap }()
+
+		alloc := newMockVectorAllocator(2)
+		if _, err := dev.EnableMSIX(handlers); err == nil {
+			t.Fatal("expected to get an error")
+		}
+
+		if len(alloc.freed) != 2 {
+			t.Fatalf("expected previously allocated vectors to be freed; freed: %v", alloc.freed)
+		}
+
+		if exp := mm.PageFromAddress(tableBase); len(unmapped) != 1 || unmapped[0] != exp {
+			t.Fatalf("expected the MSI-X table page %d to be unmapped; got %v", exp, unmapped)
+		}
+	})
+
+	newMockVectorAllocator(8)
+	vectors, err := dev.EnableMSIX(handlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := mm.FrameFromAddress(0xfebf2000); mappedFrame != exp {
+		t.Errorf("expected frame %d to be mapped; got %d", exp, mappedFrame)
+	}
+
+	if len(vectors) != len(handlers) {
+		t.Fatalf("expected %d vectors; got %d", len(handlers), len(vectors))
+	}
+
+	for index := uintptr(0); index < 4; index++ {
+		entry := tableBase + index*msixEntrySize
+		addr := *(*uint32)(unsafe.Pointer(entry + msixEntryAddrLo))
+		data := *(*uint32)(unsafe.Pointer(entry + msixEntryData))
+		control := *(*uint32)(unsafe.Pointer(entry + msixEntryControl))
+
+		if index >= uintptr(len(vectors)) {
+			if control&msixEntryMasked == 0 {
+				t.Errorf("[entry %d] expected unused entry to remain masked", index)
+			}
+			continue
+		}
+
+		if addr != 0xfee03000 || data != uint32(vectors[index]) || control&msixEntryMasked != 0 {
+			t.Errorf("[entry %d] unexpected entry contents: addr: 0x%x, data: 0x%x, control: 0x%x", index, addr, data, control)
+		}
+	}
+
+	if got := dev.ReadConfig16(0xa0 + msixControl); got&(msixEnable|msixFuncMask) != msixEnable {
+		t.Errorf("expected MSI-X to be enabled and unmasked; control: 0x%x", got)
+	}
+
+	if got := dev.ReadConfig16(RegCommand); got&CommandInterruptDisable == 0 {
+		t.Error("expected INTx interrupts to be disabled")
+	}
+
+	dev.DisableMSIX()
+	if got := dev.ReadConfig16(0xa0 + msixControl); got&msixEnable != 0 {
+		t.Error("expected MSI-X to be disabled")
+	}
+}
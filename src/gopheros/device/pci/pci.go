@@ -0,0 +1,180 @@
+// Package pci provides a driver for enumerating the devices attached to the
+// PCI buses and helpers for accessing their configuration space.
+package pci
+
+import (
+	"gopheros/device"
+	"gopheros/device/acpi/aml"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+const (
+	numSlots = 32
+	numFuncs = 8
+
+	classBridge       = uint8(0x06)
+	subclassPCIBridge = uint8(0x04)
+)
+
+var (
+	// devices contains the list of PCI functions discovered by the bus
+	// driver.
+	devices []*Device
+)
+
+// Devices returns the list of PCI functions that were discovered while
+// enumerating the PCI buses.
+func Devices() []*Device {
+	return devices
+}
+
+// busDriver implements a driver that enumerates the PCI buses.
+type busDriver struct {
+	devices     []*Device
+	rootBridges []*RootBridge
+}
+
+// DriverName returns the name of this driver.
+func (*busDriver) DriverName() string {
+	return "pci"
+}
+
+// DriverVersion returns the version of this driver.
+func (*busDriver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit initializes this driver.
+func (drv *busDriver) DriverInit(w io.Writer) *kernel.Error {
+	drv.rootBridges = discoverRootBridges()
+	for _, bridge := range drv.rootBridges {
+		kfmt.Fprintf(w, "root bridge %s: segment %d, bus %2x-%2x\n", bridge.Path, bridge.Segment, bridge.BusStart, bridge.BusEnd)
+		for _, aperture := range bridge.Apertures {
+			kind := "mem"
+			if aperture.Type == aml.AddressSpaceIO {
+				kind = "io "
+			}
+			kfmt.Fprintf(w, "  %s 0x%x-0x%x\n", kind, aperture.Min, aperture.Max)
+		}
+	}
+
+	drv.enumerate(w)
+
+	for _, dev := range drv.devices {
+		kfmt.Fprintf(w, "%2x:%2x.%d %4x:%4x class %2x.%2x.%2x\n",
+			dev.Bus, dev.Slot, dev.Func,
+			dev.VendorID, dev.DeviceID,
+			dev.ClassCode, dev.Subclass, dev.ProgIF,
+		)
+	}
+
+	// Firmware may leave the BARs of some devices (e.g. hotplugged
+	// devices) unprogrammed.
+	drv.assignResources(w)
+
+	devices = drv.devices
+	rootBridges = drv.rootBridges
+	return nil
+}
+
+// enumerate scans the PCI bus hierarchy starting from the root bus of each
+// host bridge that is described by the firmware. As only configuration access
+// mechanism #1 is supported, host bridges in segments other than 0 are
+// skipped.
+//
+// If the firmware does not describe any host bridges, enumerate falls back to
+// probing the host bridge at 00:00.0. If it is a multi-function device then
+// each one of its functions is a separate host controller responsible for the
+// bus with the same number as the function.
+func (drv *busDriver) enumerate(w io.Writer) {
+	if len(drv.rootBridges) != 0 {
+		var scanned [256]bool
+		for _, bridge := range drv.rootBridges {
+			if bridge.Segment != 0 {
+				kfmt.Fprintf(w, "root bridge %s: skipping unsupported segment %d\n", bridge.Path, bridge.Segment)
+				continue
+			}
+
+			if !scanned[bridge.BusStart] {
+				scanned[bridge.BusStart] = true
+				drv.scanBus(bridge.BusStart)
+			}
+		}
+		return
+	}
+
+	if readConfig8(0, 0, 0, RegHeaderType)&headerMultiFunction == 0 {
+		drv.scanBus(0)
+		return
+	}
+
+	for fn := uint8(0); fn < numFuncs; fn++ {
+		if readConfig16(0, 0, fn, RegVendorID) == invalidVendorID {
+			break
+		}
+		drv.scanBus(fn)
+	}
+}
+
+// scanBus scans all slots of the specified bus and recursively scans the
+// secondary bus of any PCI-to-PCI bridges that are found.
+func (drv *busDriver) scanBus(bus uint8) {
+	for slot := uint8(0); slot < numSlots; slot++ {
+		if readConfig16(bus, slot, 0, RegVendorID) == invalidVendorID {
+			continue
+		}
+
+		numSlotFuncs := uint8(1)
+		if readConfig8(bus, slot, 0, RegHeaderType)&headerMultiFunction != 0 {
+			numSlotFuncs = numFuncs
+		}
+
+		for fn := uint8(0); fn < numSlotFuncs; fn++ {
+			vendorID := readConfig16(bus, slot, fn, RegVendorID)
+			if vendorID == invalidVendorID {
+				continue
+			}
+
+			dev := &Device{
+				Bus:          bus,
+				Slot:         slot,
+				Func:         fn,
+				VendorID:     vendorID,
+				DeviceID:     readConfig16(bus, slot, fn, RegDeviceID),
+				ClassCode:    readConfig8(bus, slot, fn, RegClassCode),
+				Subclass:     readConfig8(bus, slot, fn, RegSubclass),
+				ProgIF:       readConfig8(bus, slot, fn, RegProgIF),
+				RevisionID:   readConfig8(bus, slot, fn, RegRevisionID),
+				HeaderType:   readConfig8(bus, slot, fn, RegHeaderType) & headerTypeMask,
+				InterruptPin: readConfig8(bus, slot, fn, RegInterruptPin),
+			}
+			drv.devices = append(drv.devices, dev)
+
+			if dev.ClassCode == classBridge && dev.Subclass == subclassPCIBridge {
+				if secondaryBus := readConfig8(bus, slot, fn, RegSecondaryBus); secondaryBus > bus {
+					dev.secondaryBus = secondaryBus
+					drv.scanBus(secondaryBus)
+				}
+			}
+		}
+	}
+}
+
+func probeForPCI() device.Driver {
+	// Check whether a host bridge is present
+	if readConfig16(0, 0, 0, RegVendorID) == invalidVendorID {
+		return nil
+	}
+
+	return &busDriver{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:  "pci",
+		Order: device.DetectOrderACPI,
+		Probe: probeForPCI,
+	})
+}
@@ -0,0 +1,91 @@
+package pci
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProbeForPCI(t *testing.T) {
+	defer restorePortMocks()
+
+	cs := newFakeConfigSpace()
+	if drv := probeForPCI(); drv != nil {
+		t.Fatal("expected probe to fail when no host bridge is present")
+	}
+
+	cs.addFunc(0, 0, 0, 0x8086, 0x1237)
+	if drv := probeForPCI(); drv == nil {
+		t.Fatal("expected probe to succeed")
+	}
+}
+
+func TestBusDriver(t *testing.T) {
+	defer func() {
+		restorePortMocks()
+		devices = nil
+	}()
+
+	cs := newFakeConfigSpace()
+	cs.emulateBARs = true
+	cs.addFunc(0, 0, 0, 0x8086, 0x1237)
+
+	// Multi-function device in slot 1 with a gap at function 1
+	isa := cs.addFunc(0, 1, 0, 0x8086, 0x7000)
+	isa[RegHeaderType] = headerMultiFunction
+	isa[RegClassCode], isa[RegSubclass] = 0x06, 0x01
+	cs.addFunc(0, 1, 2, 0x8086, 0x7020)
+
+	// PCI-to-PCI bridge leading to bus 2
+	bridge := cs.addFunc(0, 4, 0, 0x1b36, 0x0001)
+	bridge[RegHeaderType] = 0x01
+	bridge[RegClassCode], bridge[RegSubclass] = classBridge, subclassPCIBridge
+	bridge[RegSecondaryBus] = 2
+
+	nic := cs.addFunc(2, 0, 0, 0x8086, 0x100e)
+	nic[RegClassCode], nic[RegSubclass] = 0x02, 0x00
+	nic[RegInterruptPin] = 1
+
+	drv := probeForPCI().(*busDriver)
+	var buf bytes.Buffer
+	if err := drv.DriverInit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		bus, slot, fn uint8
+		deviceID      uint16
+	}{
+		{0, 0, 0, 0x1237},
+		{0, 1, 0, 0x7000},
+		{0, 1, 2, 0x7020},
+		{0, 4, 0, 0x0001},
+		{2, 0, 0, 0x100e},
+	}
+
+	if got := Devices(); len(got) != len(specs) {
+		t.Fatalf("expected %d devices; got %d", len(specs), len(got))
+	}
+
+	for specIndex, spec := range specs {
+		dev := Devices()[specIndex]
+		if dev.Bus != spec.bus || dev.Slot != spec.slot || dev.Func != spec.fn || dev.DeviceID != spec.deviceID {
+			t.Errorf("[spec %d] expected device %x:%x.%d with ID 0x%x; got %x:%x.%d with ID 0x%x", specIndex, spec.bus, spec.slot, spec.fn, spec.deviceID, dev.Bus, dev.Slot, dev.Func, dev.DeviceID)
+		}
+	}
+
+	if dev := Devices()[4]; dev.InterruptPin != 1 || dev.ClassCode != 0x02 {
+		t.Errorf("unexpected device attributes: %+v", dev)
+	}
+
+	if exp := "02:00.0 8086:100e class 02.00.00\n"; !bytes.HasSuffix(buf.Bytes(), []byte(exp)) {
+		t.Errorf("expected driver output to end with %q; got:\n%s", exp, buf.String())
+	}
+
+	if drvName := drv.DriverName(); drvName != "pci" {
+		t.Errorf("unexpected driver name: %s", drvName)
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Errorf("unexpected driver version: %d.%d.%d", major, minor, patch)
+	}
+}
@@ -0,0 +1,406 @@
+package pci
+
+import (
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+// resourceKind identifies the address space that a BAR or bridge window
+// decodes.
+type resourceKind uint8
+
+const (
+	resourceMem resourceKind = iota
+	resourceIO
+)
+
+const (
+	// Bridge windows are programmed in units of 1M for memory and 4K for
+	// I/O space.
+	bridgeMemGranularity = uint64(1 << 20)
+	bridgeIOGranularity  = uint64(1 << 12)
+
+	// The bridge window registers hold bits 31:20 of the memory window
+	// addresses and bits 15:12 of the I/O window addresses.
+	bridgeMemShift = 16
+	bridgeIOShift  = 8
+	bridgeMemMask  = uint16(0xfff0)
+	bridgeIOMask   = uint8(0xf0)
+
+	// bridgePrefType64 is set in the prefetchable window registers of
+	// bridges that support 64-bit prefetchable windows.
+	bridgePrefType64 = uint16(0x1)
+
+	// numBridgeBARs is the number of BARs in a type 1 (PCI-to-PCI bridge)
+	// configuration space header.
+	numBridgeBARs = 2
+
+	headerTypeBridge = uint8(0x01)
+)
+
+var (
+	// The windows used for assigning resources to the devices on the root
+	// buses. The host bridge windows are described by the firmware via
+	// the _CRS method of the host bridge which requires an AML
+	// interpreter; until one is available, the PC-compatible defaults for
+	// the 32-bit PCI hole and the upper I/O space are used instead. Any
+	// ranges claimed by firmware-assigned BARs are never reused.
+	rootMemWindow = [2]uint64{0xe0000000, 0xfebfffff}
+	rootIOWindow  = [2]uint64{0xc000, 0xffff}
+)
+
+// barInfo describes a base address register and the resource it decodes.
+type barInfo struct {
+	dev   *Device
+	index uint8
+	kind  resourceKind
+	is64  bool
+	addr  uint64
+	size  uint64
+}
+
+// addrRange describes an address range that has been claimed by a BAR or a
+// bridge window. For bridge windows, owner points to the bridge.
+type addrRange struct {
+	kind       resourceKind
+	start, end uint64
+	owner      *Device
+}
+
+// aperture is a window of the memory or I/O space from which resources are
+// allocated to the devices on a bus. Apertures behind bridges can grow within
+// the aperture of the parent bus provided that no other resource has been
+// allocated after them.
+type aperture struct {
+	kind        resourceKind
+	base, limit uint64
+
+	// next is the lowest address that may be allocated.
+	next uint64
+
+	// bridge is the PCI-to-PCI bridge whose window is described by this
+	// aperture or nil for the windows of the root buses.
+	bridge      *Device
+	parent      *aperture
+	granularity uint64
+}
+
+// alloc reserves a naturally aligned region with the specified size,
+// growing the aperture if required. It returns the region address and true
+// or false if the aperture cannot accommodate the request.
+func (a *aperture) alloc(size uint64) (uint64, bool) {
+	addr := alignUp(a.next, size)
+	end := addr + size - 1
+	if end < addr || (end > a.limit && !a.grow(end)) {
+		return 0, false
+	}
+
+	a.next = end + 1
+	return addr, true
+}
+
+// grow extends the limit of a bridge aperture so that it includes the
+// address end. Apertures can only grow if their window is the last region
+// that was allocated from the parent aperture.
+func (a *aperture) grow(end uint64) bool {
+	if a.bridge == nil || a.parent.next != a.limit+1 {
+		return false
+	}
+
+	newLimit := alignUp(end+1, a.granularity) - 1
+	if newLimit > a.parent.limit && !a.parent.grow(newLimit) {
+		return false
+	}
+
+	a.parent.next = newLimit + 1
+	a.limit = newLimit
+	a.bridge.setWindow(a.kind, a.base, a.limit)
+	return true
+}
+
+// assignResources assigns addresses to any implemented BARs that have not
+// been programmed by the firmware. Resources are allocated from the window of
+// the bridge leading to each device's bus; bridge windows are programmed or
+// extended as needed to cover the newly assigned BARs.
+func (drv *busDriver) assignResources(w io.Writer) {
+	var (
+		bars    []barInfo
+		claimed []addrRange
+	)
+
+	for _, dev := range drv.devices {
+		for _, bar := range dev.sizeBARs() {
+			bars = append(bars, bar)
+			if bar.addr != 0 {
+				claimed = append(claimed, addrRange{bar.kind, bar.addr, bar.addr + bar.size - 1, nil})
+			}
+		}
+
+		if dev.isBridge() {
+			for _, kind := range []resourceKind{resourceMem, resourceIO} {
+				if base, limit, ok := dev.window(kind); ok {
+					claimed = append(claimed, addrRange{kind, base, limit, dev})
+				}
+			}
+
+			// Prefetchable windows are never allocated from but they
+			// must not overlap with any newly assigned resources.
+			if base, limit, ok := dev.prefetchWindow(); ok {
+				claimed = append(claimed, addrRange{resourceMem, base, limit, nil})
+			}
+		}
+	}
+
+	for _, bus := range drv.rootBuses() {
+		memAp := newAperture(resourceMem, rootMemWindow[0], rootMemWindow[1], nil, nil, claimed)
+		ioAp := newAperture(resourceIO, rootIOWindow[0], rootIOWindow[1], nil, nil, claimed)
+		drv.assignBus(w, bus, memAp, ioAp, bars, claimed)
+	}
+}
+
+// assignBus assigns resources to the unprogrammed BARs of the devices on the
+// specified bus and recursively processes the buses behind any bridges.
+func (drv *busDriver) assignBus(w io.Writer, bus uint8, memAp, ioAp *aperture, bars []barInfo, claimed []addrRange) {
+	for _, dev := range drv.devices {
+		if dev.Bus != bus {
+			continue
+		}
+
+		for _, bar := range bars {
+			if bar.dev != dev || bar.addr != 0 {
+				continue
+			}
+
+			ap := memAp
+			if bar.kind == resourceIO {
+				ap = ioAp
+			}
+
+			addr, ok := ap.alloc(bar.size)
+			if !ok {
+				kfmt.Fprintf(w, "%2x:%2x.%d BAR%d: no space for 0x%x bytes\n", dev.Bus, dev.Slot, dev.Func, bar.index, bar.size)
+				continue
+			}
+
+			dev.setBAR(bar, addr)
+			kfmt.Fprintf(w, "%2x:%2x.%d BAR%d: assigned 0x%x (size 0x%x)\n", dev.Bus, dev.Slot, dev.Func, bar.index, addr, bar.size)
+		}
+
+		if dev.isBridge() && dev.secondaryBus > bus {
+			drv.assignBus(w, dev.secondaryBus,
+				bridgeAperture(dev, resourceMem, memAp, claimed),
+				bridgeAperture(dev, resourceIO, ioAp, claimed),
+				bars, claimed,
+			)
+		}
+	}
+}
+
+// rootBuses returns the numbers of the buses that are not located behind a
+// PCI-to-PCI bridge.
+func (drv *busDriver) rootBuses() []uint8 {
+	var (
+		buses     []uint8
+		seen      [256]bool
+		secondary [256]bool
+	)
+
+	for _, dev := range drv.devices {
+		if dev.isBridge() && dev.secondaryBus > dev.Bus {
+			secondary[dev.secondaryBus] = true
+		}
+	}
+
+	for _, dev := range drv.devices {
+		if !secondary[dev.Bus] && !seen[dev.Bus] {
+			seen[dev.Bus] = true
+			buses = append(buses, dev.Bus)
+		}
+	}
+
+	return buses
+}
+
+// newAperture returns an aperture for the window [base, limit] whose next
+// free address is located after any claimed ranges that overlap the window.
+// The range claimed by the window of the bridge itself is ignored.
+func newAperture(kind resourceKind, base, limit uint64, bridge *Device, parent *aperture, claimed []addrRange) *aperture {
+	next := base
+	for _, r := range claimed {
+		if r.kind != kind || (bridge != nil && r.owner == bridge) {
+			continue
+		}
+
+		if r.start <= limit && r.end >= next {
+			next = r.end + 1
+		}
+	}
+
+	granularity := bridgeMemGranularity
+	if kind == resourceIO {
+		granularity = bridgeIOGranularity
+	}
+
+	return &aperture{
+		kind:        kind,
+		base:        base,
+		limit:       limit,
+		next:        next,
+		bridge:      bridge,
+		parent:      parent,
+		granularity: granularity,
+	}
+}
+
+// bridgeAperture returns the aperture for the window of the specified bridge.
+// If the firmware has not programmed the window, an empty aperture is placed
+// at the next free address of the parent aperture so that it can grow as
+// resources get allocated from it.
+func bridgeAperture(bridge *Device, kind resourceKind, parent *aperture, claimed []addrRange) *aperture {
+	if base, limit, ok := bridge.window(kind); ok {
+		return newAperture(kind, base, limit, bridge, parent, claimed)
+	}
+
+	ap := newAperture(kind, 0, 0, bridge, parent, nil)
+	ap.base = alignUp(parent.next, ap.granularity)
+	ap.limit, ap.next = ap.base-1, ap.base
+	parent.next = ap.base
+	return ap
+}
+
+// isBridge returns true if the device is a PCI-to-PCI bridge.
+func (dev *Device) isBridge() bool {
+	return dev.HeaderType == headerTypeBridge && dev.ClassCode == classBridge && dev.Subclass == subclassPCIBridge
+}
+
+// sizeBARs returns the implemented BARs of the device together with their
+// current address and size. Address decoding is disabled while the BARs are
+// being sized.
+func (dev *Device) sizeBARs() []barInfo {
+	var count uint8
+	switch dev.HeaderType {
+	case 0:
+		count = numBARs
+	case headerTypeBridge:
+		count = numBridgeBARs
+	default:
+		return nil
+	}
+
+	cmd := dev.ReadConfig16(RegCommand)
+	dev.WriteConfig16(RegCommand, cmd&^(CommandIOSpace|CommandMemorySpace))
+	defer dev.WriteConfig16(RegCommand, cmd)
+
+	var bars []barInfo
+	for index := uint8(0); index < count; index++ {
+		reg := RegBAR0 + 4*index
+		orig := dev.ReadConfig32(reg)
+		dev.WriteConfig32(reg, 0xffffffff)
+		mask := dev.ReadConfig32(reg)
+		dev.WriteConfig32(reg, orig)
+
+		bar := barInfo{dev: dev, index: index}
+		switch {
+		case orig&barIOSpace != 0:
+			bar.kind = resourceIO
+			bar.addr = uint64(orig & barIOMask)
+			bar.size = uint64(^(mask&barIOMask)&0xffff) + 1
+			if mask&barIOMask == 0 {
+				bar.size = 0
+			}
+		case orig&barTypeMask == barType64 && index+1 < count:
+			origHi := dev.ReadConfig32(reg + 4)
+			dev.WriteConfig32(reg+4, 0xffffffff)
+			maskHi := dev.ReadConfig32(reg + 4)
+			dev.WriteConfig32(reg+4, origHi)
+
+			bar.is64 = true
+			bar.addr = uint64(origHi)<<32 | uint64(orig&barMemMask)
+			if fullMask := uint64(maskHi)<<32 | uint64(mask&barMemMask); fullMask != 0 {
+				bar.size = ^fullMask + 1
+			}
+			index++
+		default:
+			bar.addr = uint64(orig & barMemMask)
+			if mask&barMemMask != 0 {
+				bar.size = uint64(^(mask & barMemMask) + 1)
+			}
+		}
+
+		if bar.size != 0 {
+			bars = append(bars, bar)
+		}
+	}
+
+	return bars
+}
+
+// setBAR programs the address of the specified BAR and enables decoding of
+// the address space that it refers to.
+func (dev *Device) setBAR(bar barInfo, addr uint64) {
+	reg := RegBAR0 + 4*bar.index
+	flags := dev.ReadConfig32(reg)
+	if bar.kind == resourceIO {
+		dev.WriteConfig32(reg, uint32(addr)|flags&^barIOMask)
+		dev.SetCommandFlags(CommandIOSpace)
+		return
+	}
+
+	dev.WriteConfig32(reg, uint32(addr)|flags&^barMemMask)
+	if bar.is64 {
+		dev.WriteConfig32(reg+4, uint32(addr>>32))
+	}
+	dev.SetCommandFlags(CommandMemorySpace)
+}
+
+// window returns the memory or I/O window of a PCI-to-PCI bridge and true or
+// false if the window is disabled or has not been programmed (base address 0)
+// by the firmware. Only the non-prefetchable memory window and 16-bit I/O
+// windows are supported.
+func (dev *Device) window(kind resourceKind) (uint64, uint64, bool) {
+	var base, limit uint64
+	if kind == resourceIO {
+		base = uint64(dev.ReadConfig8(RegIOBase)&bridgeIOMask) << bridgeIOShift
+		limit = uint64(dev.ReadConfig8(RegIOLimit)&bridgeIOMask)<<bridgeIOShift | (bridgeIOGranularity - 1)
+	} else {
+		base = uint64(dev.ReadConfig16(RegMemoryBase)&bridgeMemMask) << bridgeMemShift
+		limit = uint64(dev.ReadConfig16(RegMemoryLimit)&bridgeMemMask)<<bridgeMemShift | (bridgeMemGranularity - 1)
+	}
+
+	return base, limit, base != 0 && base <= limit
+}
+
+// prefetchWindow returns the prefetchable memory window of a PCI-to-PCI
+// bridge and true or false if the window is disabled or unprogrammed.
+func (dev *Device) prefetchWindow() (uint64, uint64, bool) {
+	baseReg, limitReg := dev.ReadConfig16(RegPrefMemoryBase), dev.ReadConfig16(RegPrefMemoryLimit)
+	base := uint64(baseReg&bridgeMemMask) << bridgeMemShift
+	limit := uint64(limitReg&bridgeMemMask)<<bridgeMemShift | (bridgeMemGranularity - 1)
+	if baseReg&bridgePrefType64 != 0 {
+		base |= uint64(dev.ReadConfig32(RegPrefBaseUpper)) << 32
+		limit |= uint64(dev.ReadConfig32(RegPrefLimitUpper)) << 32
+	}
+
+	return base, limit, base != 0 && base <= limit
+}
+
+// setWindow programs the memory or I/O window of a PCI-to-PCI bridge and
+// enables forwarding of the corresponding address space.
+func (dev *Device) setWindow(kind resourceKind, base, limit uint64) {
+	if kind == resourceIO {
+		dev.WriteConfig8(RegIOBase, uint8(base>>bridgeIOShift)&bridgeIOMask)
+		dev.WriteConfig8(RegIOLimit, uint8(limit>>bridgeIOShift)&bridgeIOMask)
+		dev.SetCommandFlags(CommandIOSpace)
+		return
+	}
+
+	dev.WriteConfig16(RegMemoryBase, uint16(base>>bridgeMemShift)&bridgeMemMask)
+	dev.WriteConfig16(RegMemoryLimit, uint16(limit>>bridgeMemShift)&bridgeMemMask)
+	dev.SetCommandFlags(CommandMemorySpace)
+}
+
+// alignUp rounds addr up to the next multiple of align which must be a power
+// of 2.
+func alignUp(addr, align uint64) uint64 {
+	return (addr + align - 1) &^ (align - 1)
+}
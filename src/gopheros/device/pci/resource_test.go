@@ -0,0 +1,220 @@
+package pci
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestAssignResources(t *testing.T) {
+	defer restorePortMocks()
+
+	cs := newFakeConfigSpace()
+	cs.emulateBARs = true
+	cs.addFunc(0, 0, 0, 0x8086, 0x1237)
+
+	// Device with a firmware-assigned memory BAR and an unassigned I/O BAR
+	dev1 := cs.addFunc(0, 1, 0, 0x8086, 0x100e)
+	cs.addBAR(0, 1, 0, 0, 0x1000, 0)
+	binary.LittleEndian.PutUint32(dev1[RegBAR0:], 0xe0000000)
+	cs.addBAR(0, 1, 0, 1, 0x20, barIOSpace)
+
+	// Device with an unassigned 64-bit memory BAR
+	cs.addFunc(0, 2, 0, 0x1af4, 0x1041)
+	cs.addBAR(0, 2, 0, 0, 0x4000, barType64)
+
+	// Bridge with unprogrammed windows leading to bus 1
+	bridge1 := addBridge(cs, 0, 3, 1)
+	cs.addFunc(1, 0, 0, 0x1af4, 0x1042)
+	cs.addBAR(1, 0, 0, 0, 0x2000, 0)
+	cs.addBAR(1, 0, 0, 1, 0x40, barIOSpace)
+
+	// Bridge with firmware-programmed windows leading to bus 2
+	bridge2 := addBridge(cs, 0, 4, 2)
+	binary.LittleEndian.PutUint16(bridge2[RegMemoryBase:], 0xe040)
+	binary.LittleEndian.PutUint16(bridge2[RegMemoryLimit:], 0xe040)
+	bridge2[RegIOBase], bridge2[RegIOLimit] = 0xd0, 0xd0
+	cs.addFunc(2, 0, 0, 0x1af4, 0x1043)
+	cs.addBAR(2, 0, 0, 0, 0x1000, 0)
+
+	// Device whose I/O BAR cannot fit in the root I/O window
+	cs.addFunc(0, 5, 0, 0x1234, 0x5678)
+	cs.addBAR(0, 5, 0, 0, 0x10000, barIOSpace)
+
+	drv := probeForPCI().(*busDriver)
+	var buf bytes.Buffer
+	if err := drv.DriverInit(&buf); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { devices = nil }()
+
+	specs := []struct {
+		bus, slot, fn uint8
+		reg           uint8
+		exp           uint32
+	}{
+		// Firmware assignments are preserved
+		{0, 1, 0, RegBAR0, 0xe0000000},
+		// New root bus resources are allocated above any claimed ranges
+		{0, 1, 0, RegBAR0 + 4, 0xe000 | barIOSpace},
+		{0, 2, 0, RegBAR0, 0xe0500000 | barType64},
+		{0, 2, 0, RegBAR0 + 4, 0},
+		// Unprogrammed bridge windows are allocated on demand
+		{1, 0, 0, RegBAR0, 0xe0600000},
+		{1, 0, 0, RegBAR0 + 4, 0xf000 | barIOSpace},
+		// Programmed bridge windows are used as is
+		{2, 0, 0, RegBAR0, 0xe0400000},
+		// Resources that do not fit remain unassigned
+		{0, 5, 0, RegBAR0, barIOSpace},
+	}
+
+	for specIndex, spec := range specs {
+		if got := readConfig32(spec.bus, spec.slot, spec.fn, spec.reg); got != spec.exp {
+			t.Errorf("[spec %d] expected register 0x%x of %x:%x.%d to be 0x%x; got 0x%x", specIndex, spec.reg, spec.bus, spec.slot, spec.fn, spec.exp, got)
+		}
+	}
+
+	if base, limit := binary.LittleEndian.Uint16(bridge1[RegMemoryBase:]), binary.LittleEndian.Uint16(bridge1[RegMemoryLimit:]); base != 0xe060 || limit != 0xe060 {
+		t.Errorf("expected bridge memory window registers to be 0xe060-0xe060; got 0x%x-0x%x", base, limit)
+	}
+
+	if base, limit := bridge1[RegIOBase], bridge1[RegIOLimit]; base != 0xf0 || limit != 0xf0 {
+		t.Errorf("expected bridge I/O window registers to be 0xf0-0xf0; got 0x%x-0x%x", base, limit)
+	}
+
+	if cmd := readConfig16(1, 0, 0, RegCommand); cmd&(CommandIOSpace|CommandMemorySpace) != CommandIOSpace|CommandMemorySpace {
+		t.Errorf("expected I/O and memory decoding to be enabled for 01:00.0; command register is 0x%x", cmd)
+	}
+
+	if cmd := readConfig16(0, 3, 0, RegCommand); cmd&(CommandIOSpace|CommandMemorySpace) != CommandIOSpace|CommandMemorySpace {
+		t.Errorf("expected I/O and memory forwarding to be enabled for bridge 00:03.0; command register is 0x%x", cmd)
+	}
+
+	for _, exp := range []string{
+		"01:00.0 BAR0: assigned 0xe0600000 (size 0x2000)\n",
+		"00:05.0 BAR0: no space for 0x10000 bytes\n",
+	} {
+		if !strings.Contains(buf.String(), exp) {
+			t.Errorf("expected driver output to contain %q; got:\n%s", exp, buf.String())
+		}
+	}
+}
+
+func TestApertureGrow(t *testing.T) {
+	defer restorePortMocks()
+
+	cs := newFakeConfigSpace()
+	regs := addBridge(cs, 0, 1, 1)
+	bridge := &Device{Bus: 0, Slot: 1, HeaderType: headerTypeBridge, ClassCode: classBridge, Subclass: subclassPCIBridge}
+
+	specs := []struct {
+		parentNext, parentLimit uint64
+		size                    uint64
+		expAddr                 uint64
+		expOK                   bool
+		expLimit                uint64
+	}{
+		// Allocation fits in the window
+		{0x200000, 0xffffffff, 0x1000, 0x100000, true, 0x1fffff},
+		// Window grows into the free space of the parent
+		{0x200000, 0xffffffff, 0x200000, 0x200000, true, 0x3fffff},
+		// Another resource was allocated after the window
+		{0x300000, 0xffffffff, 0x200000, 0, false, 0x1fffff},
+		// Parent aperture is exhausted
+		{0x200000, 0x2fffff, 0x200000, 0, false, 0x1fffff},
+	}
+
+	for specIndex, spec := range specs {
+		parent := &aperture{kind: resourceMem, base: 0, limit: spec.parentLimit, next: spec.parentNext}
+		ap := &aperture{
+			kind:        resourceMem,
+			base:        0x100000,
+			limit:       0x1fffff,
+			next:        0x100000,
+			bridge:      bridge,
+			parent:      parent,
+			granularity: bridgeMemGranularity,
+		}
+
+		// Except for the first spec, part of the window is already in
+		// use so the requested region does not fit in it.
+		if specIndex != 0 {
+			ap.next = 0x101000
+		}
+
+		addr, ok := ap.alloc(spec.size)
+		if ok != spec.expOK || addr != spec.expAddr {
+			t.Errorf("[spec %d] expected alloc to return 0x%x, %t; got 0x%x, %t", specIndex, spec.expAddr, spec.expOK, addr, ok)
+		}
+
+		if ap.limit != spec.expLimit {
+			t.Errorf("[spec %d] expected window limit to be 0x%x; got 0x%x", specIndex, spec.expLimit, ap.limit)
+		}
+
+		if spec.expLimit != 0x1fffff {
+			if parent.next != spec.expLimit+1 {
+				t.Errorf("[spec %d] expected parent aperture to be advanced to 0x%x; got 0x%x", specIndex, spec.expLimit+1, parent.next)
+			}
+
+			if got := binary.LittleEndian.Uint16(regs[RegMemoryLimit:]); got != uint16(spec.expLimit>>bridgeMemShift)&bridgeMemMask {
+				t.Errorf("[spec %d] expected bridge memory limit register to be updated; got 0x%x", specIndex, got)
+			}
+		}
+	}
+}
+
+func TestSizeBARs(t *testing.T) {
+	defer restorePortMocks()
+
+	cs := newFakeConfigSpace()
+	cs.emulateBARs = true
+	regs := cs.addFunc(0, 1, 0, 0x8086, 0x100e)
+	cs.addBAR(0, 1, 0, 0, 0x20000, 0)
+	binary.LittleEndian.PutUint32(regs[RegBAR0:], 0xfebc0000)
+	cs.addBAR(0, 1, 0, 2, 0x40, barIOSpace)
+	cs.addBAR(0, 1, 0, 4, 0x100000000, barType64)
+	binary.LittleEndian.PutUint16(regs[RegCommand:], CommandMemorySpace|CommandBusMaster)
+
+	dev := &Device{Bus: 0, Slot: 1}
+	bars := dev.sizeBARs()
+
+	specs := []barInfo{
+		{dev: dev, index: 0, kind: resourceMem, addr: 0xfebc0000, size: 0x20000},
+		{dev: dev, index: 2, kind: resourceIO, size: 0x40},
+		{dev: dev, index: 4, kind: resourceMem, is64: true, size: 0x100000000},
+	}
+
+	if len(bars) != len(specs) {
+		t.Fatalf("expected %d BARs; got %d: %+v", len(specs), len(bars), bars)
+	}
+
+	for specIndex, spec := range specs {
+		if bars[specIndex] != spec {
+			t.Errorf("[spec %d] expected BAR %+v; got %+v", specIndex, spec, bars[specIndex])
+		}
+	}
+
+	if got := readConfig32(0, 1, 0, RegBAR0); got != 0xfebc0000 {
+		t.Errorf("expected sizing to restore the BAR contents; got 0x%x", got)
+	}
+
+	if got := readConfig16(0, 1, 0, RegCommand); got != CommandMemorySpace|CommandBusMaster {
+		t.Errorf("expected sizing to restore the command register; got 0x%x", got)
+	}
+
+	// Only type 0 and type 1 headers have BARs
+	if got := (&Device{HeaderType: 2}).sizeBARs(); got != nil {
+		t.Errorf("expected no BARs for CardBus bridges; got %+v", got)
+	}
+}
+
+// addBridge registers a PCI-to-PCI bridge leading to secondaryBus with
+// disabled windows and returns its configuration space.
+func addBridge(cs *fakeConfigSpace, bus, slot, secondaryBus uint8) *[256]byte {
+	regs := cs.addFunc(bus, slot, 0, 0x1b36, 0x0001)
+	regs[RegHeaderType] = headerTypeBridge
+	regs[RegClassCode], regs[RegSubclass] = classBridge, subclassPCIBridge
+	regs[RegSecondaryBus] = secondaryBus
+	return regs
+}
@@ -0,0 +1,132 @@
+package pci
+
+import (
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/aml"
+)
+
+var (
+	// acpiRootBridgeIDs contains the _HID/_CID values that identify PCI
+	// (PNP0A03) and PCI Express (PNP0A08) host bridges.
+	acpiRootBridgeIDs = []string{"PNP0A03", "PNP0A08"}
+
+	// rootBridges contains the list of host bridges that were described
+	// by the firmware.
+	rootBridges []*RootBridge
+
+	visitACPIDevicesFn = acpi.VisitDevices
+)
+
+// RootBridge describes a PCI host bridge that is defined in the ACPI
+// namespace.
+type RootBridge struct {
+	// Path contains the absolute namespace path of the bridge device.
+	Path string
+
+	// Segment is the PCI segment group (_SEG) that contains the bridge.
+	Segment uint16
+
+	// BusStart and BusEnd specify the range of bus numbers that are
+	// decoded by the bridge. BusStart is the number of the root bus.
+	BusStart, BusEnd uint8
+
+	// Apertures contains the memory and I/O ranges that the bridge
+	// forwards to its root bus.
+	Apertures []aml.AddressSpace
+}
+
+// RootBridges returns the list of host bridges that were described by the
+// firmware. The list is empty if the system does not support ACPI or if the
+// bridge definitions could not be extracted from the AML namespace.
+func RootBridges() []*RootBridge {
+	return rootBridges
+}
+
+// acpiValueSource is implemented by objects that provide access to the
+// constant values defined in the scope of an ACPI device.
+type acpiValueSource interface {
+	IntValue(name string) (uint64, bool)
+	BufferValue(name string) ([]byte, bool)
+}
+
+// discoverRootBridges returns the list of present host bridges that are
+// defined in the ACPI namespace.
+func discoverRootBridges() []*RootBridge {
+	var list []*RootBridge
+
+	visitACPIDevicesFn(func(dev *acpi.Device) {
+		if !dev.Present() || !isRootBridgeID(dev.ID) {
+			return
+		}
+
+		list = append(list, newRootBridge(dev.Path, dev))
+	})
+
+	return list
+}
+
+// newRootBridge extracts the segment, bus range and apertures of a host bridge
+// from its _SEG, _BBN and _CRS objects. If an object is missing or needs to be
+// evaluated, the defaults specified by the ACPI standard (segment 0, bus 0)
+// are used instead and the bridge is assumed to decode all bus numbers above
+// its root bus.
+func newRootBridge(path string, values acpiValueSource) *RootBridge {
+	bridge := &RootBridge{Path: path, BusEnd: 0xff}
+
+	if seg, ok := values.IntValue("_SEG"); ok {
+		bridge.Segment = uint16(seg)
+	}
+
+	var haveBBN bool
+	if bbn, ok := values.IntValue("_BBN"); ok {
+		bridge.BusStart, haveBBN = uint8(bbn), true
+	}
+
+	crs, ok := values.BufferValue("_CRS")
+	if !ok {
+		return bridge
+	}
+
+	ranges, err := aml.ParseAddressSpaces(crs)
+	if err != nil {
+		return bridge
+	}
+
+	for _, r := range ranges {
+		if r.Type != aml.AddressSpaceBusNumber {
+			bridge.Apertures = append(bridge.Apertures, r)
+			continue
+		}
+
+		// _BBN takes precedence over the bus range start as some
+		// firmware reports a bus range that starts at 0 for all bridges.
+		if !haveBBN {
+			bridge.BusStart = uint8(r.Min)
+		}
+		bridge.BusEnd = uint8(r.Max)
+	}
+
+	return bridge
+}
+
+// isRootBridgeID returns true if the supplied device identification matches
+// a PCI host bridge.
+func isRootBridgeID(id *aml.DeviceID) bool {
+	if id == nil {
+		return false
+	}
+
+	for _, bridgeID := range acpiRootBridgeIDs {
+		if id.HID == bridgeID {
+			return true
+		}
+
+		for _, cid := range id.CIDs {
+			if cid == bridgeID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,148 @@
+package pci
+
+import (
+	"bytes"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/aml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type fakeACPIValues struct {
+	ints    map[string]uint64
+	buffers map[string][]byte
+}
+
+func (v fakeACPIValues) IntValue(name string) (uint64, bool) {
+	val, ok := v.ints[name]
+	return val, ok
+}
+
+func (v fakeACPIValues) BufferValue(name string) ([]byte, bool) {
+	val, ok := v.buffers[name]
+	return val, ok
+}
+
+func TestNewRootBridge(t *testing.T) {
+	crs := []byte{
+		// WordBusNumber (0x10 - 0x1f)
+		0x88, 0x0d, 0x00, 0x02, 0x0c, 0x00, 0x00, 0x00, 0x10, 0x00, 0x1f, 0x00, 0x00, 0x00, 0x10, 0x00,
+		// WordIO (0x0000 - 0x0cf7)
+		0x88, 0x0d, 0x00, 0x01, 0x0c, 0x03, 0x00, 0x00, 0x00, 0x00, 0xf7, 0x0c, 0x00, 0x00, 0xf8, 0x0c,
+		// DWordMemory (0xc0000000 - 0xfebfffff)
+		0x87, 0x17, 0x00, 0x00, 0x0c, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0xff, 0xff, 0xbf, 0xfe, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x3e,
+		0x79, 0x00,
+	}
+
+	expApertures := []aml.AddressSpace{
+		{Type: aml.AddressSpaceIO, Min: 0, Max: 0xcf7, Length: 0xcf8},
+		{Type: aml.AddressSpaceMemory, Min: 0xc0000000, Max: 0xfebfffff, Length: 0x3ec00000},
+	}
+
+	specs := []struct {
+		values fakeACPIValues
+		exp    RootBridge
+	}{
+		// No objects defined; use defaults
+		{
+			fakeACPIValues{},
+			RootBridge{Path: "BR0", BusEnd: 0xff},
+		},
+		// Bus range obtained from _CRS
+		{
+			fakeACPIValues{
+				ints:    map[string]uint64{"_SEG": 1},
+				buffers: map[string][]byte{"_CRS": crs},
+			},
+			RootBridge{Path: "BR0", Segment: 1, BusStart: 0x10, BusEnd: 0x1f, Apertures: expApertures},
+		},
+		// _BBN takes precedence over the _CRS bus range
+		{
+			fakeACPIValues{
+				ints:    map[string]uint64{"_BBN": 0x12},
+				buffers: map[string][]byte{"_CRS": crs},
+			},
+			RootBridge{Path: "BR0", BusStart: 0x12, BusEnd: 0x1f, Apertures: expApertures},
+		},
+		// Malformed _CRS
+		{
+			fakeACPIValues{
+				ints:    map[string]uint64{"_BBN": 0x12},
+				buffers: map[string][]byte{"_CRS": crs[:len(crs)-2]},
+			},
+			RootBridge{Path: "BR0", BusStart: 0x12, BusEnd: 0xff},
+		},
+	}
+
+	for specIndex, spec := range specs {
+		if got := newRootBridge("BR0", spec.values); !reflect.DeepEqual(*got, spec.exp) {
+			t.Errorf("[spec %d] expected root bridge:\n%+v\ngot:\n%+v", specIndex, spec.exp, *got)
+		}
+	}
+}
+
+func TestBusDriverWithRootBridges(t *testing.T) {
+	defer func() {
+		restorePortMocks()
+		visitACPIDevicesFn = acpi.VisitDevices
+		devices = nil
+		rootBridges = nil
+	}()
+
+	visitACPIDevicesFn = func(visitor func(*acpi.Device)) {
+		for _, dev := range []*acpi.Device{
+			{Path: `\_SB_.PCI0`, ID: &aml.DeviceID{HID: "PNP0A08", CIDs: []string{"PNP0A03"}}, Status: aml.StatusDefault},
+			// Duplicate root bus
+			{Path: `\_SB_.PCI1`, ID: &aml.DeviceID{CIDs: []string{"PNP0A03"}}, Status: aml.StatusDefault},
+			// Not present
+			{Path: `\_SB_.PCI2`, ID: &aml.DeviceID{HID: "PNP0A03"}},
+			// Not a host bridge
+			{Path: `\_SB_.LNKA`, ID: &aml.DeviceID{HID: "PNP0C0F"}, Status: aml.StatusDefault},
+			{Path: `\_SB_.FOO0`, Status: aml.StatusDefault},
+		} {
+			visitor(dev)
+		}
+	}
+
+	cs := newFakeConfigSpace()
+
+	// The fallback heuristic would also scan bus 1 as the host bridge is a
+	// multi-function device.
+	hostBridge := cs.addFunc(0, 0, 0, 0x8086, 0x29c0)
+	hostBridge[RegHeaderType] = headerMultiFunction
+	cs.addFunc(0, 0, 1, 0x8086, 0x29c0)
+	cs.addFunc(1, 0, 0, 0x8086, 0x100e)
+
+	drv := probeForPCI().(*busDriver)
+	var buf bytes.Buffer
+	if err := drv.DriverInit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := RootBridges(); len(got) != 2 || got[0].Path != `\_SB_.PCI0` || got[1].Path != `\_SB_.PCI1` {
+		t.Fatalf("expected 2 root bridges to be discovered; got %d", len(got))
+	}
+
+	if got := Devices(); len(got) != 2 || got[0].Bus != 0 || got[1].Bus != 0 {
+		t.Fatalf("expected only bus 0 to be scanned; got %d devices", len(got))
+	}
+
+	if exp := "root bridge \\_SB_.PCI0: segment 0, bus 00-ff\n"; !strings.HasPrefix(buf.String(), exp) {
+		t.Errorf("expected driver output to start with %q; got:\n%s", exp, buf.String())
+	}
+
+	t.Run("unsupported segment", func(t *testing.T) {
+		buf.Reset()
+		drv := &busDriver{rootBridges: []*RootBridge{{Path: `\_SB_.PCI3`, Segment: 1}}}
+		drv.enumerate(&buf)
+
+		if len(drv.devices) != 0 {
+			t.Errorf("expected no devices to be discovered; got %d", len(drv.devices))
+		}
+
+		if exp := "root bridge \\_SB_.PCI3: skipping unsupported segment 1\n"; buf.String() != exp {
+			t.Errorf("expected output %q; got %q", exp, buf.String())
+		}
+	})
+}
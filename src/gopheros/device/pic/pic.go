@@ -0,0 +1,203 @@
+// Package pic provides a driver for the legacy 8259 programmable interrupt
+// controller (PIC) pair found on PC-compatible systems.
+package pic
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+const (
+	masterCmdPort  = uint16(0x20)
+	masterDataPort = uint16(0x21)
+	slaveCmdPort   = uint16(0xa0)
+	slaveDataPort  = uint16(0xa1)
+
+	// ioWaitPort is an unused port; writing to it provides a small delay
+	// that gives the PICs enough time to process each command.
+	ioWaitPort = uint16(0x80)
+
+	icw1Init      = uint8(0x10)
+	icw1ICW4      = uint8(0x01)
+	icw48086Mode  = uint8(0x01)
+	ocw2EOI       = uint8(0x20)
+	ocw3ReadISR   = uint8(0x0b)
+	cascadeIRQ    = uint8(2)
+	numIRQs       = 16
+	irqsPerChip   = 8
+	spuriousIRQLo = uint8(7)
+	spuriousIRQHi = uint8(15)
+)
+
+var (
+	errInvalidIRQ   = &kernel.Error{Module: "pic", Message: "IRQ number is not handled by the PIC"}
+	errFixedVectors = &kernel.Error{Module: "pic", Message: "PIC IRQs can only be routed to their remapped vectors"}
+
+	// The following functions are used by tests to mock calls to the cpu
+	// package.
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn  = cpu.PortReadByte
+
+	// reportSpuriousFn is used by tests.
+	reportSpuriousFn = irq.ReportSpurious
+)
+
+// PIC implements a driver for the cascaded 8259 PIC pair. The driver remaps the
+// PIC IRQs to the vectors starting at irq.BaseVector so that they do not
+// overlap with the CPU exception vectors.
+type PIC struct {
+	// mask caches the contents of the interrupt mask registers for the
+	// master (low byte) and slave (high byte) PICs.
+	mask uint16
+
+	// spuriousCount tracks the number of spurious IRQs that were detected.
+	spuriousCount uint64
+}
+
+// Route implements irq.Controller. As the PIC IRQs are remapped to a fixed
+// vector range during initialization, Route only validates its arguments.
+func (p *PIC) Route(gsi uint32, vector gate.InterruptNumber) *kernel.Error {
+	if gsi >= numIRQs {
+		return errInvalidIRQ
+	}
+
+	if vector != irq.VectorForGSI(gsi) {
+		return errFixedVectors
+	}
+
+	return nil
+}
+
+// Mask implements irq.Controller.
+func (p *PIC) Mask(gsi uint32) {
+	if gsi >= numIRQs || uint8(gsi) == cascadeIRQ {
+		return
+	}
+
+	p.mask |= 1 << gsi
+	p.writeMask()
+}
+
+// Unmask implements irq.Controller.
+func (p *PIC) Unmask(gsi uint32) {
+	if gsi >= numIRQs || uint8(gsi) == cascadeIRQ {
+		return
+	}
+
+	p.mask &^= 1 << gsi
+	p.writeMask()
+}
+
+// EOI implements irq.Controller. Spurious IRQs (IRQ 7 and IRQ 15 without the
+// corresponding in-service bit set) are not acknowledged by the PIC that
+// raised them. However, for spurious IRQs raised by the slave PIC, the master
+// PIC still needs to receive an EOI for the cascade line. Spurious IRQs are
+// also reported to the irq package so they show up in the interrupt statistics.
+func (p *PIC) EOI(vector gate.InterruptNumber) {
+	if vector < irq.BaseVector || vector >= irq.BaseVector+numIRQs {
+		return
+	}
+
+	line := uint8(vector - irq.BaseVector)
+	if (line == spuriousIRQLo || line == spuriousIRQHi) && p.inService()&(1<<line) == 0 {
+		p.spuriousCount++
+		reportSpuriousFn(vector)
+		if line == spuriousIRQHi {
+			portWriteByteFn(masterCmdPort, ocw2EOI)
+		}
+		return
+	}
+
+	if line >= irqsPerChip {
+		portWriteByteFn(slaveCmdPort, ocw2EOI)
+	}
+	portWriteByteFn(masterCmdPort, ocw2EOI)
+}
+
+// SpuriousCount returns the number of spurious IRQs detected by the driver.
+func (p *PIC) SpuriousCount() uint64 {
+	return p.spuriousCount
+}
+
+// inService returns the contents of the in-service registers for the master
+// (low byte) and slave (high byte) PICs.
+func (p *PIC) inService() uint16 {
+	portWriteByteFn(masterCmdPort, ocw3ReadISR)
+	portWriteByteFn(slaveCmdPort, ocw3ReadISR)
+	return uint16(portReadByteFn(masterCmdPort)) | uint16(portReadByteFn(slaveCmdPort))<<8
+}
+
+// writeCmd writes a value to a PIC port and waits for the PIC to process it.
+func (p *PIC) writeCmd(port uint16, val uint8) {
+	portWriteByteFn(port, val)
+	portWriteByteFn(ioWaitPort, 0)
+}
+
+func (p *PIC) writeMask() {
+	portWriteByteFn(masterDataPort, uint8(p.mask))
+	portWriteByteFn(slaveDataPort, uint8(p.mask>>8))
+}
+
+// DriverName returns the name of this driver.
+func (*PIC) DriverName() string {
+	return "pic8259"
+}
+
+// DriverVersion returns the version of this driver.
+func (*PIC) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit initializes this driver.
+func (p *PIC) DriverInit(w io.Writer) *kernel.Error {
+	var (
+		masterOffset = uint8(irq.BaseVector)
+		slaveOffset  = masterOffset + irqsPerChip
+	)
+
+	// Start the initialization sequence and set up the vector offsets,
+	// the master/slave cascade wiring and 8086 mode.
+	p.writeCmd(masterCmdPort, icw1Init|icw1ICW4)
+	p.writeCmd(slaveCmdPort, icw1Init|icw1ICW4)
+	p.writeCmd(masterDataPort, masterOffset)
+	p.writeCmd(slaveDataPort, slaveOffset)
+	p.writeCmd(masterDataPort, 1<<cascadeIRQ)
+	p.writeCmd(slaveDataPort, cascadeIRQ)
+	p.writeCmd(masterDataPort, icw48086Mode)
+	p.writeCmd(slaveDataPort, icw48086Mode)
+
+	// Mask everything except the cascade line
+	p.mask = 0xffff &^ (1 << cascadeIRQ)
+	p.writeMask()
+
+	kfmt.Fprintf(w, "remapped IRQs to vectors %d-%d\n", masterOffset, slaveOffset+irqsPerChip-1)
+
+	irq.SetController(p)
+	return nil
+}
+
+// probeForPIC returns a PIC driver if no other interrupt controller has been
+// installed. This is the case when the system does not provide an I/O APIC or
+// when the APIC drivers are disabled via the irqController=pic boot option.
+// If a local APIC is active, it keeps acknowledging the interrupts that are not
+// delivered via the PIC.
+func probeForPIC() device.Driver {
+	if irq.ActiveController() != nil {
+		return nil
+	}
+
+	return &PIC{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:  "pic8259",
+		Order: device.DetectOrderInterruptControllerFallback,
+		Probe: probeForPIC,
+	})
+}
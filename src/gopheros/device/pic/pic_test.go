@@ -0,0 +1,211 @@
+package pic
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"testing"
+)
+
+type portWrite struct {
+	port uint16
+	val  uint8
+}
+
+func TestProbeForPIC(t *testing.T) {
+	defer irq.SetController(nil)
+
+	if drv := probeForPIC(); drv == nil {
+		t.Fatal("expected probe to succeed when no interrupt controller is installed")
+	}
+
+	irq.SetController(&PIC{})
+	if drv := probeForPIC(); drv != nil {
+		t.Fatal("expected probe to fail when an interrupt controller is already installed")
+	}
+}
+
+func TestDriverInit(t *testing.T) {
+	defer func() {
+		portWriteByteFn = cpu.PortWriteByte
+		irq.SetController(nil)
+	}()
+
+	var writes []portWrite
+	portWriteByteFn = func(port uint16, val uint8) {
+		if port != ioWaitPort {
+			writes = append(writes, portWrite{port, val})
+		}
+	}
+
+	p := &PIC{}
+	if err := p.DriverInit(&discardWriter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expWrites := []portWrite{
+		{masterCmdPort, 0x11},
+		{slaveCmdPort, 0x11},
+		{masterDataPort, uint8(irq.BaseVector)},
+		{slaveDataPort, uint8(irq.BaseVector) + 8},
+		{masterDataPort, 0x04},
+		{slaveDataPort, 0x02},
+		{masterDataPort, 0x01},
+		{slaveDataPort, 0x01},
+		{masterDataPort, 0xfb},
+		{slaveDataPort, 0xff},
+	}
+
+	if len(writes) != len(expWrites) {
+		t.Fatalf("expected %d port writes; got %d", len(expWrites), len(writes))
+	}
+
+	for i, exp := range expWrites {
+		if writes[i] != exp {
+			t.Errorf("[write %d] expected %+v; got %+v", i, exp, writes[i])
+		}
+	}
+
+	if irq.ActiveController() != p {
+		t.Error("expected PIC to be installed as the active interrupt controller")
+	}
+
+	if drvName := p.DriverName(); drvName != "pic8259" {
+		t.Errorf("unexpected driver name: %s", drvName)
+	}
+
+	if major, minor, patch := p.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Errorf("unexpected driver version: %d.%d.%d", major, minor, patch)
+	}
+}
+
+func TestRouteAndMask(t *testing.T) {
+	defer func() {
+		portWriteByteFn = cpu.PortWriteByte
+	}()
+
+	ports := make(map[uint16]uint8)
+	portWriteByteFn = func(port uint16, val uint8) { ports[port] = val }
+
+	p := &PIC{mask: 0xffff &^ (1 << cascadeIRQ)}
+
+	specs := []struct {
+		gsi    uint32
+		vector gate.InterruptNumber
+		expErr *kernel.Error
+	}{
+		{1, irq.VectorForGSI(1), nil},
+		{12, irq.VectorForGSI(12), nil},
+		{16, irq.VectorForGSI(16), errInvalidIRQ},
+		{1, irq.VectorForGSI(2), errFixedVectors},
+	}
+
+	for specIndex, spec := range specs {
+		if err := p.Route(spec.gsi, spec.vector); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	p.Unmask(1)
+	p.Unmask(12)
+	if ports[masterDataPort] != 0xf9 || ports[slaveDataPort] != 0xef {
+		t.Fatalf("expected masks to be 0xf9, 0xef; got 0x%x, 0x%x", ports[masterDataPort], ports[slaveDataPort])
+	}
+
+	// Masking the cascade line or an invalid IRQ should be ignored
+	p.Mask(uint32(cascadeIRQ))
+	p.Mask(16)
+	p.Mask(12)
+	if ports[masterDataPort] != 0xf9 || ports[slaveDataPort] != 0xff {
+		t.Fatalf("expected masks to be 0xf9, 0xff; got 0x%x, 0x%x", ports[masterDataPort], ports[slaveDataPort])
+	}
+}
+
+func TestEOI(t *testing.T) {
+	defer func() {
+		portWriteByteFn = cpu.PortWriteByte
+		portReadByteFn = cpu.PortReadByte
+		reportSpuriousFn = irq.ReportSpurious
+	}()
+
+	var (
+		writes   []portWrite
+		isr      uint16
+		reported []gate.InterruptNumber
+	)
+	reportSpuriousFn = func(vector gate.InterruptNumber) { reported = append(reported, vector) }
+	portWriteByteFn = func(port uint16, val uint8) { writes = append(writes, portWrite{port, val}) }
+	portReadByteFn = func(port uint16) uint8 {
+		if port == masterCmdPort {
+			return uint8(isr)
+		}
+		return uint8(isr >> 8)
+	}
+
+	eoiWrites := func() []portWrite {
+		var eois []portWrite
+		for _, w := range writes {
+			if w.val == ocw2EOI {
+				eois = append(eois, w)
+			}
+		}
+		return eois
+	}
+
+	specs := []struct {
+		line     uint8
+		isr      uint16
+		expEOIs  []portWrite
+		spurious bool
+	}{
+		{1, 1 << 1, []portWrite{{masterCmdPort, ocw2EOI}}, false},
+		{12, 1 << 12, []portWrite{{slaveCmdPort, ocw2EOI}, {masterCmdPort, ocw2EOI}}, false},
+		{7, 0, nil, true},
+		{7, 1 << 7, []portWrite{{masterCmdPort, ocw2EOI}}, false},
+		{15, 0, []portWrite{{masterCmdPort, ocw2EOI}}, true},
+	}
+
+	p := &PIC{}
+	var expSpurious uint64
+	for specIndex, spec := range specs {
+		writes = nil
+		isr = spec.isr
+		p.EOI(irq.BaseVector + gate.InterruptNumber(spec.line))
+
+		got := eoiWrites()
+		if len(got) != len(spec.expEOIs) {
+			t.Errorf("[spec %d] expected %d EOI writes; got %d", specIndex, len(spec.expEOIs), len(got))
+			continue
+		}
+
+		for i, exp := range spec.expEOIs {
+			if got[i] != exp {
+				t.Errorf("[spec %d] expected EOI write %+v; got %+v", specIndex, exp, got[i])
+			}
+		}
+
+		if spec.spurious {
+			expSpurious++
+		}
+		if p.SpuriousCount() != expSpurious {
+			t.Errorf("[spec %d] expected spurious count to be %d; got %d", specIndex, expSpurious, p.SpuriousCount())
+		}
+	}
+
+	if exp := []gate.InterruptNumber{irq.BaseVector + 7, irq.BaseVector + 15}; len(reported) != 2 || reported[0] != exp[0] || reported[1] != exp[1] {
+		t.Errorf("expected spurious IRQs to be reported for vectors %v; got %v", exp, reported)
+	}
+
+	// Vectors not managed by the PIC should be ignored
+	writes = nil
+	p.EOI(irq.BaseVector - 1)
+	p.EOI(irq.BaseVector + numIRQs)
+	if len(writes) != 0 {
+		t.Fatalf("expected no port writes for vectors not managed by the PIC; got %d", len(writes))
+	}
+}
+
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
@@ -0,0 +1,270 @@
+// Package pit provides a driver for the 8254 programmable interval timer
+// (PIT) found on PC-compatible systems.
+//
+// As the PIT runs at a fixed, well-known frequency, it serves as the reference
+// clock for measuring the frequency of the TSC and the local APIC timer. In
+// addition, the driver can generate the timer tick on systems that do not
+// provide a local APIC.
+package pit
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+const (
+	// Frequency is the input clock frequency of the PIT in Hz.
+	Frequency = uint32(1193182)
+
+	// IRQ is the ISA IRQ line that channel 0 is wired to.
+	IRQ = uint8(0)
+
+	// calibrationHz specifies the length of the calibration window as a
+	// fraction of a second.
+	calibrationHz = uint32(100)
+
+	channel0DataPort = uint16(0x40)
+	channel2DataPort = uint16(0x42)
+	commandPort      = uint16(0x43)
+
+	// Port 0x61 controls the channel 2 gate (bit 0) and the PC speaker
+	// output (bit 1) and reports the state of the channel 2 output (bit 5).
+	channel2GatePort = uint16(0x61)
+	channel2GateOn   = uint8(1 << 0)
+	speakerOn        = uint8(1 << 1)
+	channel2Out      = uint8(1 << 5)
+
+	// Command port values. Each mode command selects a 16-bit binary
+	// counter that is loaded low byte first.
+	cmdChannel0OneShot = uint8(0x30)
+	cmdChannel0Rate    = uint8(0x34)
+	cmdChannel2OneShot = uint8(0xb0)
+
+	// cmdLatchChannel0 latches the current count of channel 0 so that it
+	// can be read (low byte first) from the channel 0 data port.
+	cmdLatchChannel0 = uint8(0x00)
+
+	// cmdReadBackStatus0 latches the status byte of channel 0. Bit 7 of
+	// the status byte reflects the state of the channel output.
+	cmdReadBackStatus0 = uint8(0xe2)
+	statusOut          = uint8(1 << 7)
+
+	// maxDivisor is the largest supported divisor. It is programmed by
+	// writing 0 to the counter.
+	maxDivisor = uint32(0x10000)
+)
+
+// CalibrationMethod specifies which PIT channel is used as the reference clock
+// for frequency measurements.
+type CalibrationMethod uint8
+
+// The supported calibration methods.
+const (
+	// CalibrationPoll programs channel 0 for a one-shot countdown and
+	// polls its output via the read-back command.
+	CalibrationPoll CalibrationMethod = iota
+
+	// CalibrationGate programs channel 2 for a one-shot countdown and
+	// polls its output via the speaker gate port. It can be selected via
+	// the pit.calibration=gate boot option for systems where the read-back
+	// command is not reliable.
+	CalibrationGate
+)
+
+var (
+	errInvalidFreq = &kernel.Error{Module: "pit", Message: "requested timer frequency is out of range"}
+
+	// pit points to the initialized PIT driver.
+	pit *PIT
+
+	// The following functions are used by tests to mock calls to the cpu,
+	// irq and cmdline packages.
+	portReadByteFn  = cpu.PortReadByte
+	portWriteByteFn = cpu.PortWriteByte
+	readTSCFn       = cpu.ReadTSC
+	registerIRQFn   = irq.RegisterIRQ
+	cmdlineGetFn    = cmdline.Get
+)
+
+// ActiveCalibrationMethod returns the calibration method selected via the
+// kernel command line.
+func ActiveCalibrationMethod() CalibrationMethod {
+	if cmdlineGetFn("pit.calibration") == "gate" {
+		return CalibrationGate
+	}
+
+	return CalibrationPoll
+}
+
+// Calibrate measures the rate, in ticks per second, of each supplied counter
+// using the PIT as a reference clock. All counters are sampled at the start
+// and at the end of the same reference interval and the returned slice
+// contains their rates in the order they were supplied.
+//
+// Calibrate busy-waits for the reference interval to elapse and overwrites
+// the configuration of the PIT channel that is used for the measurement.
+func Calibrate(counters ...func() uint64) []uint64 {
+	var (
+		method = ActiveCalibrationMethod()
+		count  = Frequency / calibrationHz
+		start  = make([]uint64, len(counters))
+		rates  = make([]uint64, len(counters))
+	)
+
+	if method == CalibrationGate {
+		// Enable the channel 2 gate and disable the PC speaker output,
+		// then program channel 2 for a one-shot (mode 0) countdown.
+		portWriteByteFn(channel2GatePort, (portReadByteFn(channel2GatePort)&^speakerOn)|channel2GateOn)
+		writeCounter(channel2DataPort, cmdChannel2OneShot, count)
+
+		// Restart the countdown by toggling the gate
+		gateVal := portReadByteFn(channel2GatePort) &^ channel2GateOn
+		portWriteByteFn(channel2GatePort, gateVal)
+		portWriteByteFn(channel2GatePort, gateVal|channel2GateOn)
+	} else {
+		// In mode 0, the countdown starts once the counter is loaded.
+		writeCounter(channel0DataPort, cmdChannel0OneShot, count)
+	}
+
+	for i, counter := range counters {
+		start[i] = counter()
+	}
+
+	if method == CalibrationGate {
+		for portReadByteFn(channel2GatePort)&channel2Out == 0 {
+		}
+	} else {
+		for {
+			portWriteByteFn(commandPort, cmdReadBackStatus0)
+			if portReadByteFn(channel0DataPort)&statusOut != 0 {
+				break
+			}
+		}
+	}
+
+	for i, counter := range counters {
+		rates[i] = (counter() - start[i]) * uint64(calibrationHz)
+	}
+
+	return rates
+}
+
+// writeCounter programs the mode of a PIT channel and loads its counter.
+func writeCounter(dataPort uint16, cmd uint8, count uint32) {
+	portWriteByteFn(commandPort, cmd)
+	portWriteByteFn(dataPort, uint8(count))
+	portWriteByteFn(dataPort, uint8(count>>8))
+}
+
+// PIT implements a driver for the 8254 PIT.
+type PIT struct {
+	tscTicksPerSec uint64
+
+	// periodicHz is the frequency of the periodic channel 0 interrupt or
+	// 0 if the driver is not used as a tick source.
+	periodicHz uint32
+}
+
+// Active returns the initialized PIT driver or nil if the PIT is not available.
+func Active() *PIT {
+	return pit
+}
+
+// TickSourceActive returns true if PIT channel 0 is used for generating a
+// periodic interrupt. Other subsystems must not reprogram channel 0 or
+// reroute its IRQ while this is the case.
+func TickSourceActive() bool {
+	return pit != nil && pit.periodicHz != 0
+}
+
+// TSCFrequency returns the calibrated frequency of the time-stamp counter.
+func (p *PIT) TSCFrequency() uint64 {
+	return p.tscTicksPerSec
+}
+
+// SetTimerHandler registers handler to be invoked whenever channel 0 fires.
+func (p *PIT) SetTimerHandler(handler irq.Handler) *kernel.Error {
+	return registerIRQFn(irq.ISAIRQToGSI(IRQ), handler)
+}
+
+// StartPeriodicTimer programs channel 0 as a rate generator (mode 2) that
+// fires hz times per second. The achievable frequencies range from 19Hz to
+// the PIT input frequency.
+func (p *PIT) StartPeriodicTimer(hz uint32) *kernel.Error {
+	if hz == 0 {
+		return errInvalidFreq
+	}
+
+	divisor := Frequency / hz
+	if divisor == 0 || divisor > maxDivisor {
+		return errInvalidFreq
+	}
+
+	writeCounter(channel0DataPort, cmdChannel0Rate, divisor)
+	p.periodicHz = hz
+	return nil
+}
+
+// PeriodicDivisor returns the value that channel 0 counts down from while
+// generating the periodic interrupt or 0 if the PIT is not used as a tick
+// source.
+func (p *PIT) PeriodicDivisor() uint32 {
+	if p.periodicHz == 0 {
+		return 0
+	}
+	return Frequency / p.periodicHz
+}
+
+// Counter returns the current value of the channel 0 down-counter. A value of
+// 0 corresponds to the maximum divisor.
+func (p *PIT) Counter() uint32 {
+	portWriteByteFn(commandPort, cmdLatchChannel0)
+	lo := portReadByteFn(channel0DataPort)
+	hi := portReadByteFn(channel0DataPort)
+	return uint32(hi)<<8 | uint32(lo)
+}
+
+// DriverName returns the name of this driver.
+func (*PIT) DriverName() string {
+	return "pit8254"
+}
+
+// DriverVersion returns the version of this driver.
+func (*PIT) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit initializes this driver.
+func (p *PIT) DriverInit(w io.Writer) *kernel.Error {
+	p.tscTicksPerSec = Calibrate(readTSCFn)[0]
+
+	method := "read-back"
+	if ActiveCalibrationMethod() == CalibrationGate {
+		method = "channel 2 gate"
+	}
+	kfmt.Fprintf(w, "TSC: %d ticks/sec (calibration: %s)\n", p.tscTicksPerSec, method)
+
+	pit = p
+	return nil
+}
+
+// probeForPIT returns a PIT driver. Like the RTC, the PIT cannot be reliably
+// detected so it is assumed to be present unless the firmware reports
+// otherwise.
+func probeForPIT() device.Driver {
+	return &PIT{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:    "pit8254",
+		Order:   device.DetectOrderLast,
+		Probe:   probeForPIT,
+		ACPIIDs: []string{"PNP0100"},
+	})
+}
@@ -0,0 +1,271 @@
+package pit
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"testing"
+)
+
+func restoreMocks() {
+	portReadByteFn = cpu.PortReadByte
+	portWriteByteFn = cpu.PortWriteByte
+	readTSCFn = cpu.ReadTSC
+	registerIRQFn = irq.RegisterIRQ
+	cmdlineGetFn = cmdline.Get
+	pit = nil
+}
+
+type portWrite struct {
+	port uint16
+	val  uint8
+}
+
+// mockPIT emulates the PIT ports. The output of the channel used for the
+// calibration goes high after the specified number of polls.
+type mockPIT struct {
+	writes    []portWrite
+	gate      uint8
+	pollsLeft int
+	polls     int
+}
+
+func (m *mockPIT) install(method string) {
+	cmdlineGetFn = func(name string) string {
+		if name == "pit.calibration" {
+			return method
+		}
+		return ""
+	}
+	portWriteByteFn = func(port uint16, val uint8) {
+		m.writes = append(m.writes, portWrite{port, val})
+		if port == channel2GatePort {
+			m.gate = val
+		}
+	}
+	portReadByteFn = func(port uint16) uint8 {
+		var out uint8
+		switch port {
+		case channel0DataPort:
+			out = statusOut
+		case channel2GatePort:
+			out = channel2Out
+		default:
+			return 0
+		}
+
+		if m.polls++; m.polls <= m.pollsLeft {
+			return m.gate
+		}
+		return m.gate | out
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	defer restoreMocks()
+
+	count := Frequency / calibrationHz
+	specs := []struct {
+		method    string
+		expMethod CalibrationMethod
+		expWrites []portWrite
+	}{
+		{
+			"",
+			CalibrationPoll,
+			[]portWrite{
+				{commandPort, cmdChannel0OneShot},
+				{channel0DataPort, uint8(count)},
+				{channel0DataPort, uint8(count >> 8)},
+				{commandPort, cmdReadBackStatus0},
+				{commandPort, cmdReadBackStatus0},
+				{commandPort, cmdReadBackStatus0},
+			},
+		},
+		{
+			"gate",
+			CalibrationGate,
+			[]portWrite{
+				{channel2GatePort, channel2GateOn},
+				{commandPort, cmdChannel2OneShot},
+				{channel2DataPort, uint8(count)},
+				{channel2DataPort, uint8(count >> 8)},
+				{channel2GatePort, 0},
+				{channel2GatePort, channel2GateOn},
+			},
+		},
+	}
+
+	for specIndex, spec := range specs {
+		m := &mockPIT{gate: speakerOn, pollsLeft: 2}
+		m.install(spec.method)
+
+		if got := ActiveCalibrationMethod(); got != spec.expMethod {
+			t.Errorf("[spec %d] expected calibration method %d; got %d", specIndex, spec.expMethod, got)
+		}
+
+		var slow, fast uint64
+		rates := Calibrate(
+			func() uint64 { slow += 10; return slow },
+			func() uint64 { fast += 1000; return fast },
+		)
+
+		if exp := []uint64{10 * uint64(calibrationHz), 1000 * uint64(calibrationHz)}; len(rates) != 2 || rates[0] != exp[0] || rates[1] != exp[1] {
+			t.Errorf("[spec %d] expected rates to be %v; got %v", specIndex, exp, rates)
+		}
+
+		if len(m.writes) != len(spec.expWrites) {
+			t.Errorf("[spec %d] expected %d port writes; got %d", specIndex, len(spec.expWrites), len(m.writes))
+			continue
+		}
+
+		for i, exp := range spec.expWrites {
+			if got := m.writes[i]; got != exp {
+				t.Errorf("[spec %d] expected port write %d to be %v; got %v", specIndex, i, exp, got)
+			}
+		}
+	}
+}
+
+func TestStartPeriodicTimer(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockPIT{}
+	m.install("")
+
+	p := &PIT{}
+	pit = p
+
+	for _, hz := range []uint32{0, 18, Frequency + 1} {
+		if err := p.StartPeriodicTimer(hz); err != errInvalidFreq {
+			t.Errorf("expected to get errInvalidFreq for %dHz; got %v", hz, err)
+		}
+	}
+
+	if TickSourceActive() {
+		t.Fatal("expected TickSourceActive to return false before the timer is started")
+	}
+
+	if err := p.StartPeriodicTimer(1000); err != nil {
+		t.Fatal(err)
+	}
+
+	divisor := Frequency / 1000
+	exp := []portWrite{
+		{commandPort, cmdChannel0Rate},
+		{channel0DataPort, uint8(divisor)},
+		{channel0DataPort, uint8(divisor >> 8)},
+	}
+	if len(m.writes) != len(exp) || m.writes[0] != exp[0] || m.writes[1] != exp[1] || m.writes[2] != exp[2] {
+		t.Errorf("expected port writes %v; got %v", exp, m.writes)
+	}
+
+	if !TickSourceActive() {
+		t.Fatal("expected TickSourceActive to return true after the timer is started")
+	}
+
+	if got := p.PeriodicDivisor(); got != divisor {
+		t.Errorf("expected periodic divisor to be %d; got %d", divisor, got)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		writes []portWrite
+		data   = []uint8{0x34, 0x12}
+	)
+	portWriteByteFn = func(port uint16, val uint8) { writes = append(writes, portWrite{port, val}) }
+	portReadByteFn = func(port uint16) uint8 {
+		if port != channel0DataPort || len(data) == 0 {
+			t.Fatalf("unexpected read from port 0x%x", port)
+		}
+		val := data[0]
+		data = data[1:]
+		return val
+	}
+
+	p := &PIT{}
+	if got := p.PeriodicDivisor(); got != 0 {
+		t.Errorf("expected periodic divisor to be 0 when the PIT is not a tick source; got %d", got)
+	}
+
+	if got := p.Counter(); got != 0x1234 {
+		t.Errorf("expected counter to be 0x1234; got 0x%x", got)
+	}
+
+	if exp := []portWrite{{commandPort, cmdLatchChannel0}}; len(writes) != 1 || writes[0] != exp[0] {
+		t.Errorf("expected the channel 0 count to be latched; got writes %v", writes)
+	}
+}
+
+func TestSetTimerHandler(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		expErr = &kernel.Error{Module: "test", Message: "no controller"}
+		gotGSI uint32
+	)
+	registerIRQFn = func(gsi uint32, _ irq.Handler) *kernel.Error {
+		gotGSI = gsi
+		return expErr
+	}
+
+	if err := (&PIT{}).SetTimerHandler(nil); err != expErr {
+		t.Fatalf("expected to get error %v; got %v", expErr, err)
+	}
+
+	if exp := irq.ISAIRQToGSI(IRQ); gotGSI != exp {
+		t.Fatalf("expected handler to be registered for GSI %d; got %d", exp, gotGSI)
+	}
+}
+
+func TestDriverInit(t *testing.T) {
+	defer restoreMocks()
+
+	specs := []struct {
+		method string
+		expOut string
+	}{
+		{"", "TSC: 500000 ticks/sec (calibration: read-back)\n"},
+		{"gate", "TSC: 500000 ticks/sec (calibration: channel 2 gate)\n"},
+	}
+
+	for specIndex, spec := range specs {
+		pit = nil
+
+		m := &mockPIT{}
+		m.install(spec.method)
+
+		var tsc uint64
+		readTSCFn = func() uint64 {
+			tsc += 5000
+			return tsc
+		}
+
+		drv, ok := probeForPIT().(*PIT)
+		if !ok {
+			t.Fatalf("[spec %d] expected probe to return a PIT driver", specIndex)
+		}
+
+		var buf bytes.Buffer
+		if err := drv.DriverInit(&buf); err != nil {
+			t.Fatalf("[spec %d] %v", specIndex, err)
+		}
+
+		if got := buf.String(); got != spec.expOut {
+			t.Errorf("[spec %d] expected driver output %q; got %q", specIndex, spec.expOut, got)
+		}
+
+		if exp := uint64(5000 * calibrationHz); drv.TSCFrequency() != exp {
+			t.Errorf("[spec %d] expected TSC frequency to be %d; got %d", specIndex, exp, drv.TSCFrequency())
+		}
+
+		if Active() != drv {
+			t.Errorf("[spec %d] expected Active to return the initialized driver", specIndex)
+		}
+	}
+}
@@ -0,0 +1,599 @@
+// Package pmu provides a driver for the architectural performance monitoring
+// unit (PMU) of Intel CPUs.
+//
+// The driver counts CPU cycles, retired instructions and last-level cache
+// references and misses. Counter values are accumulated both globally and for
+// each kernel thread by sampling the hardware counters whenever the scheduler
+// switches threads. In addition, one event can be sampled: the counter for the
+// event is armed to overflow after a configurable number of events and each
+// overflow interrupt records the interrupted instruction pointer into the
+// kernel trace buffer.
+package pmu
+
+import (
+	"gopheros/device"
+	"gopheros/device/apic"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/trace"
+	"io"
+)
+
+const (
+	cpuidPerfMonLeaf = uint32(0xa)
+
+	// Performance monitoring MSRs.
+	msrPMC0              = uint32(0xc1)
+	msrPerfEvtSel0       = uint32(0x186)
+	msrFixedCtr0         = uint32(0x309)
+	msrFixedCtrCtrl      = uint32(0x38d)
+	msrPerfGlobalStatus  = uint32(0x38e)
+	msrPerfGlobalCtrl    = uint32(0x38f)
+	msrPerfGlobalOvfCtrl = uint32(0x390)
+
+	// Flags for the event select MSRs of the general-purpose counters.
+	evtSelUSR = uint64(1 << 16)
+	evtSelOS  = uint64(1 << 17)
+	evtSelINT = uint64(1 << 20)
+	evtSelEN  = uint64(1 << 22)
+
+	// Each fixed counter is controlled by a 4-bit field in the fixed
+	// counter control MSR.
+	fixedCtrlOS  = uint64(1 << 0)
+	fixedCtrlUSR = uint64(1 << 1)
+	fixedCtrlPMI = uint64(1 << 3)
+
+	// The bits for the fixed counters in the global control and status
+	// MSRs start at this offset.
+	globalFixedShift = 32
+
+	// minVersion is the oldest architectural performance monitoring
+	// version supported by the driver. Version 2 introduced the fixed
+	// counters and the global control and status MSRs.
+	minVersion = 2
+
+	// MaxSamplePeriod is the largest supported sampling period. Writes to
+	// the general-purpose counters only set the low 32 bits of the counter
+	// and sign-extend them.
+	MaxSamplePeriod = uint64(1<<31 - 1)
+)
+
+// Event identifies a hardware event that can be counted by the PMU.
+type Event uint8
+
+// The supported events.
+const (
+	EventCycles Event = iota
+	EventInstructions
+	EventCacheReferences
+	EventCacheMisses
+	numEvents
+)
+
+// String implements fmt.Stringer for Event.
+func (ev Event) String() string {
+	if ev >= numEvents {
+		return "unknown"
+	}
+	return events[ev].name
+}
+
+// Counters holds a value for each supported event.
+type Counters [numEvents]uint64
+
+var (
+	errNoLocalAPIC      = &kernel.Error{Module: "pmu", Message: "performance counter interrupts require a local APIC"}
+	errNotAvailable     = &kernel.Error{Module: "pmu", Message: "no performance monitoring unit available"}
+	errUnsupportedEvent = &kernel.Error{Module: "pmu", Message: "event is not supported by this CPU"}
+	errInvalidPeriod    = &kernel.Error{Module: "pmu", Message: "sampling period is out of range"}
+	errNoCounters       = &kernel.Error{Module: "pmu", Message: "none of the supported events can be counted"}
+	errUnknownEvent     = &kernel.Error{Module: "pmu", Message: "unknown event name"}
+	errAlreadySampling  = &kernel.Error{Module: "pmu", Message: "an event is already being sampled"}
+
+	// events describes how each Event is counted.
+	events = [numEvents]struct {
+		name string
+
+		// archBit is the bit in CPUID.0AH:EBX that is set if the CPU
+		// does not support the event.
+		archBit uint32
+
+		eventSel, umask uint8
+
+		// fixed is the index of the fixed counter that counts the
+		// event or -1 if the event requires a general-purpose counter.
+		fixed int8
+	}{
+		EventCycles:          {"cycles", 0, 0x3c, 0x00, 1},
+		EventInstructions:    {"instructions", 1, 0xc0, 0x00, 0},
+		EventCacheReferences: {"cache-references", 3, 0x2e, 0x4f, -1},
+		EventCacheMisses:     {"cache-misses", 4, 0x2e, 0x41, -1},
+	}
+
+	// activePMU points to the initialized PMU driver.
+	activePMU *PMU
+
+	// The following functions are used by tests to mock calls to the cpu,
+	// irq, sched and apic packages.
+	cpuidFn             = cpu.ID
+	isIntelFn           = cpu.IsIntel
+	readMSRFn           = cpu.ReadMSR
+	writeMSRFn          = cpu.WriteMSR
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn  = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	allocVectorFn       = irq.AllocVector
+	registerHandlerFn   = irq.RegisterHandler
+	addSwitchHookFn     = sched.AddSwitchHook
+	currentThreadFn     = sched.Current
+	activeLocalAPICFn   = activeLocalAPIC
+)
+
+// localAPIC describes the local APIC operations required for receiving
+// performance counter overflow interrupts.
+type localAPIC interface {
+	SetPerfCounterVector(gate.InterruptNumber)
+}
+
+// counter describes a hardware counter that has been assigned to an event.
+type counter struct {
+	// fixed is set to true for fixed-function counters.
+	fixed bool
+	index uint8
+
+	// mask covers the implemented bits of the counter.
+	mask uint64
+
+	// last is the counter value when the counter was last accounted.
+	last uint64
+}
+
+// msr returns the MSR that holds the counter value.
+func (c *counter) msr() uint32 {
+	if c.fixed {
+		return msrFixedCtr0 + uint32(c.index)
+	}
+	return msrPMC0 + uint32(c.index)
+}
+
+// globalBit returns the bit for the counter in the global control and status
+// MSRs.
+func (c *counter) globalBit() uint64 {
+	if c.fixed {
+		return 1 << (globalFixedShift + c.index)
+	}
+	return 1 << c.index
+}
+
+// taskCounters holds the event counts for a thread.
+type taskCounters struct {
+	thread *sched.Thread
+	counts Counters
+}
+
+// PMU implements a driver for the architectural performance monitoring unit.
+type PMU struct {
+	version             uint8
+	numGP, numFixed     uint8
+	gpWidth, fixedWidth uint8
+
+	// unavailable has a bit set for each architectural event that the CPU
+	// does not support.
+	unavailable uint32
+
+	// counters contains the counter assigned to each event or nil if the
+	// event cannot be counted.
+	counters [numEvents]*counter
+
+	fixedCtrl uint64
+	vector    gate.InterruptNumber
+	lapic     localAPIC
+
+	totals  Counters
+	tasks   []*taskCounters
+	running *sched.Thread
+
+	sampling     bool
+	sampledEvent Event
+	samplePeriod uint64
+	sampleCount  uint64
+}
+
+// DriverName returns the name of this driver.
+func (*PMU) DriverName() string {
+	return "pmu"
+}
+
+// DriverVersion returns the version of this driver.
+func (*PMU) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit assigns a hardware counter to each supported event, installs the
+// overflow interrupt handler and starts counting.
+func (p *PMU) DriverInit(w io.Writer) *kernel.Error {
+	var nextGP uint8
+	for ev := range events {
+		desc := &events[ev]
+		if p.unavailable&(1<<desc.archBit) != 0 {
+			continue
+		}
+
+		switch {
+		case desc.fixed >= 0 && uint8(desc.fixed) < p.numFixed:
+			p.counters[ev] = &counter{fixed: true, index: uint8(desc.fixed), mask: widthMask(p.fixedWidth)}
+		case nextGP < p.numGP:
+			p.counters[ev] = &counter{index: nextGP, mask: widthMask(p.gpWidth)}
+			nextGP++
+		}
+	}
+
+	var enableMask uint64
+	for ev, c := range p.counters {
+		if c != nil {
+			enableMask |= c.globalBit()
+			p.program(Event(ev), c, false)
+			writeMSRFn(c.msr(), 0)
+		}
+	}
+
+	if enableMask == 0 {
+		return errNoCounters
+	}
+
+	if p.lapic = activeLocalAPICFn(); p.lapic == nil {
+		return errNoLocalAPIC
+	}
+
+	var err *kernel.Error
+	if p.vector, err = allocVectorFn(); err != nil {
+		return err
+	}
+
+	if err = registerHandlerFn(p.vector, p.handleOverflow); err != nil {
+		return err
+	}
+
+	p.running = currentThreadFn()
+	addSwitchHookFn(p.switchTo)
+	p.lapic.SetPerfCounterVector(p.vector)
+	writeMSRFn(msrPerfGlobalCtrl, enableMask)
+
+	kfmt.Fprintf(w, "version: %d, counters: %d general-purpose (%d bits), %d fixed (%d bits)\n",
+		p.version, p.numGP, p.gpWidth, p.numFixed, p.fixedWidth,
+	)
+	kfmt.Fprintf(w, "events:")
+	for ev, c := range p.counters {
+		if c != nil {
+			kfmt.Fprintf(w, " %s", Event(ev).String())
+		}
+	}
+	kfmt.Fprintf(w, "\n")
+
+	activePMU = p
+	return nil
+}
+
+// program configures the counter for an event. If pmi is true, the counter
+// raises an interrupt when it overflows.
+func (p *PMU) program(ev Event, c *counter, pmi bool) {
+	if c.fixed {
+		shift := 4 * uint64(c.index)
+		field := fixedCtrlOS | fixedCtrlUSR
+		if pmi {
+			field |= fixedCtrlPMI
+		}
+		p.fixedCtrl = p.fixedCtrl&^(0xf<<shift) | field<<shift
+		writeMSRFn(msrFixedCtrCtrl, p.fixedCtrl)
+	} else {
+		evtSel := uint64(events[ev].eventSel) | uint64(events[ev].umask)<<8 | evtSelUSR | evtSelOS | evtSelEN
+		if pmi {
+			evtSel |= evtSelINT
+		}
+		writeMSRFn(msrPerfEvtSel0+uint32(c.index), evtSel)
+	}
+}
+
+// account adds the events counted since the previous call to the totals and
+// to the counters of the running thread. It must be invoked with interrupts
+// disabled.
+func (p *PMU) account() {
+	var task *taskCounters
+	if p.running != nil {
+		task = p.taskCounters(p.running)
+	}
+
+	for ev, c := range p.counters {
+		if c == nil {
+			continue
+		}
+
+		cur := readMSRFn(c.msr()) & c.mask
+		delta := (cur - c.last) & c.mask
+		c.last = cur
+
+		p.totals[ev] += delta
+		if task != nil {
+			task.counts[ev] += delta
+		}
+	}
+}
+
+// taskCounters returns the counters for t, allocating them if required.
+func (p *PMU) taskCounters(t *sched.Thread) *taskCounters {
+	for _, task := range p.tasks {
+		if task.thread == t {
+			return task
+		}
+	}
+
+	task := &taskCounters{thread: t}
+	p.tasks = append(p.tasks, task)
+	return task
+}
+
+// switchTo is invoked by the scheduler with interrupts disabled before it
+// switches to next. The counters for threads that have exited are released.
+func (p *PMU) switchTo(next *sched.Thread) {
+	p.account()
+
+	if prev := p.running; prev != nil && prev.State() == sched.StateDead {
+		for i, task := range p.tasks {
+			if task.thread == prev {
+				p.tasks = append(p.tasks[:i], p.tasks[i+1:]...)
+				break
+			}
+		}
+	}
+
+	p.running = next
+}
+
+// handleOverflow is invoked when a counter with an enabled overflow interrupt
+// overflows. It records a sample into the trace buffer and re-arms the
+// counter.
+func (p *PMU) handleOverflow(regs *gate.Registers) bool {
+	status := readMSRFn(msrPerfGlobalStatus)
+	if status == 0 {
+		return false
+	}
+
+	if p.sampling {
+		if c := p.counters[p.sampledEvent]; status&c.globalBit() != 0 {
+			p.account()
+			p.sampleCount++
+			pc, _ := regs.Frame()
+			trace.Record(trace.EventPMUSample, uint64(pc), uint64(p.sampledEvent))
+			p.arm(c)
+		}
+	}
+
+	writeMSRFn(msrPerfGlobalOvfCtrl, status)
+
+	// The local APIC masks the LVT entry when delivering the interrupt
+	p.lapic.SetPerfCounterVector(p.vector)
+	return true
+}
+
+// arm sets the counter so that it overflows after the sample period elapses.
+func (p *PMU) arm(c *counter) {
+	c.last = -p.samplePeriod & c.mask
+	writeMSRFn(c.msr(), c.last)
+}
+
+// startSampling arms the counter for ev to raise an interrupt every period
+// events.
+func (p *PMU) startSampling(ev Event, period uint64) *kernel.Error {
+	if ev >= numEvents || p.counters[ev] == nil {
+		return errUnsupportedEvent
+	}
+
+	if period == 0 || period > MaxSamplePeriod {
+		return errInvalidPeriod
+	}
+
+	intr := lock()
+	defer unlock(intr)
+
+	if p.sampling {
+		return errAlreadySampling
+	}
+
+	c := p.counters[ev]
+	p.account()
+	p.sampling, p.sampledEvent, p.samplePeriod, p.sampleCount = true, ev, period, 0
+	p.arm(c)
+	p.program(ev, c, true)
+	return nil
+}
+
+// stopSampling disables the overflow interrupt for the sampled counter. The
+// counter keeps counting events.
+func (p *PMU) stopSampling() {
+	intr := lock()
+	defer unlock(intr)
+
+	if !p.sampling {
+		return
+	}
+
+	p.account()
+	p.program(p.sampledEvent, p.counters[p.sampledEvent], false)
+	p.sampling = false
+}
+
+// writeStats writes the event totals, the sampling state and the per-thread
+// counters to w.
+func (p *PMU) writeStats(w io.Writer) {
+	intr := lock()
+	p.account()
+	totals := p.totals
+	tasks := make([]taskCounters, len(p.tasks))
+	for i, task := range p.tasks {
+		tasks[i] = *task
+	}
+	sampling, sampledEvent, samplePeriod, sampleCount := p.sampling, p.sampledEvent, p.samplePeriod, p.sampleCount
+	unlock(intr)
+
+	kfmt.Fprintf(w, "%-17s %s\n", "EVENT", "TOTAL")
+	for ev, c := range p.counters {
+		if c == nil {
+			kfmt.Fprintf(w, "%-17s %s\n", Event(ev).String(), "-")
+			continue
+		}
+		kfmt.Fprintf(w, "%-17s %d\n", Event(ev).String(), totals[ev])
+	}
+
+	if sampling {
+		kfmt.Fprintf(w, "\nsampling: %s every %d events, %d samples\n", sampledEvent.String(), samplePeriod, sampleCount)
+	} else {
+		kfmt.Fprintf(w, "\nsampling: off\n")
+	}
+
+	kfmt.Fprintf(w, "\n%-5s %-14s %-14s %-14s %-14s %s\n", "TID", "CYCLES", "INSTRUCTIONS", "CACHE-REFS", "CACHE-MISSES", "NAME")
+	for _, task := range tasks {
+		kfmt.Fprintf(w, "%-5d %-14d %-14d %-14d %-14d %s\n",
+			task.thread.ID(),
+			task.counts[EventCycles], task.counts[EventInstructions],
+			task.counts[EventCacheReferences], task.counts[EventCacheMisses],
+			task.thread.Name(),
+		)
+	}
+}
+
+// Supported returns true if the PMU can count ev.
+func Supported(ev Event) bool {
+	return activePMU != nil && ev < numEvents && activePMU.counters[ev] != nil
+}
+
+// ParseEvent returns the event with the specified name.
+func ParseEvent(name string) (Event, *kernel.Error) {
+	for ev := range events {
+		if events[ev].name == name {
+			return Event(ev), nil
+		}
+	}
+
+	return 0, errUnknownEvent
+}
+
+// TaskCounters returns the number of events counted while t was running. The
+// second return value is false if no counters are available for t.
+func TaskCounters(t *sched.Thread) (Counters, bool) {
+	p := activePMU
+	if p == nil {
+		return Counters{}, false
+	}
+
+	intr := lock()
+	defer unlock(intr)
+
+	p.account()
+	for _, task := range p.tasks {
+		if task.thread == t {
+			return task.counts, true
+		}
+	}
+
+	return Counters{}, false
+}
+
+// StartSampling records a trace event with the interrupted instruction pointer
+// every period occurrences of ev. Only one event can be sampled at a time.
+func StartSampling(ev Event, period uint64) *kernel.Error {
+	if activePMU == nil {
+		return errNotAvailable
+	}
+
+	return activePMU.startSampling(ev, period)
+}
+
+// StopSampling stops sampling events.
+func StopSampling() {
+	if activePMU != nil {
+		activePMU.stopSampling()
+	}
+}
+
+// WriteStats writes the event totals and the events counted for each thread
+// to w.
+func WriteStats(w io.Writer) {
+	if activePMU == nil {
+		kfmt.Fprintf(w, "%s\n", errNotAvailable.Message)
+		return
+	}
+
+	activePMU.writeStats(w)
+}
+
+// widthMask returns a mask covering the low width bits.
+func widthMask(width uint8) uint64 {
+	if width >= 64 {
+		return ^uint64(0)
+	}
+	return 1<<width - 1
+}
+
+func activeLocalAPIC() localAPIC {
+	if lapic := apic.ActiveLocalAPIC(); lapic != nil {
+		return lapic
+	}
+	return nil
+}
+
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+	return intr
+}
+
+func unlock(intr bool) {
+	if intr {
+		enableInterruptsFn()
+	}
+}
+
+func probeForPMU() device.Driver {
+	if !isIntelFn() {
+		return nil
+	}
+
+	if maxLeaf, _, _, _ := cpuidFn(0); maxLeaf < cpuidPerfMonLeaf {
+		return nil
+	}
+
+	eax, ebx, _, edx := cpuidFn(cpuidPerfMonLeaf)
+	p := &PMU{
+		version:    uint8(eax),
+		numGP:      uint8(eax >> 8),
+		gpWidth:    uint8(eax >> 16),
+		numFixed:   uint8(edx & 0x1f),
+		fixedWidth: uint8(edx >> 5),
+	}
+
+	if p.version < minVersion || (p.numGP == 0 && p.numFixed == 0) {
+		return nil
+	}
+
+	// EAX[31:24] specifies the number of valid bits in EBX; events beyond
+	// that are not supported.
+	p.unavailable = ebx
+	if vecLen := eax >> 24; vecLen < 32 {
+		p.unavailable |= ^uint32(0) << vecLen
+	}
+
+	return p
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:      "pmu",
+		DependsOn: []string{"local_apic"},
+		Order:     device.DetectOrderLast,
+		Probe:     probeForPMU,
+	})
+}
@@ -0,0 +1,425 @@
+package pmu
+
+import (
+	"bytes"
+	"fmt"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/sched"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	cpuidFn = cpu.ID
+	isIntelFn = cpu.IsIntel
+	readMSRFn = cpu.ReadMSR
+	writeMSRFn = cpu.WriteMSR
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	allocVectorFn = irq.AllocVector
+	registerHandlerFn = irq.RegisterHandler
+	addSwitchHookFn = sched.AddSwitchHook
+	currentThreadFn = sched.Current
+	activeLocalAPICFn = activeLocalAPIC
+	activePMU = nil
+}
+
+// mockLocalAPIC records the vector used for performance counter interrupts.
+type mockLocalAPIC struct {
+	vector gate.InterruptNumber
+	unmask int
+}
+
+func (lapic *mockLocalAPIC) SetPerfCounterVector(vector gate.InterruptNumber) {
+	lapic.vector = vector
+	lapic.unmask++
+}
+
+// mockMSRs replaces the MSR accessors with a map-backed implementation.
+func mockMSRs() map[uint32]uint64 {
+	msrs := make(map[uint32]uint64)
+	readMSRFn = func(msr uint32) uint64 { return msrs[msr] }
+	writeMSRFn = func(msr uint32, val uint64) { msrs[msr] = val }
+	interruptsEnabledFn = func() bool { return false }
+	enableInterruptsFn = func() {}
+	disableInterruptsFn = func() {}
+	return msrs
+}
+
+// mockThread returns a kernel thread that is only used as an accounting key.
+func mockThread(name string) *sched.Thread {
+	stack := make([]uintptr, 64)
+	lo := uintptr(unsafe.Pointer(&stack[0]))
+	return sched.NewThread(name, lo, lo+uintptr(len(stack))*8, func() {})
+}
+
+// mockPMU returns an initialized PMU with 4 general-purpose and 3 fixed
+// counters.
+func mockPMU(t *testing.T, running *sched.Thread) (*PMU, *mockLocalAPIC, map[uint32]uint64, func(*sched.Thread), irq.Handler) {
+	msrs := mockMSRs()
+	lapic := &mockLocalAPIC{}
+
+	var (
+		hook    func(*sched.Thread)
+		handler irq.Handler
+	)
+	activeLocalAPICFn = func() localAPIC { return lapic }
+	allocVectorFn = func() (gate.InterruptNumber, *kernel.Error) { return 0x42, nil }
+	registerHandlerFn = func(_ gate.InterruptNumber, fn irq.Handler) *kernel.Error {
+		handler = fn
+		return nil
+	}
+	addSwitchHookFn = func(fn func(*sched.Thread)) { hook = fn }
+	currentThreadFn = func() *sched.Thread { return running }
+
+	p := &PMU{version: 4, numGP: 4, gpWidth: 48, numFixed: 3, fixedWidth: 48}
+	if err := p.DriverInit(&bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return p, lapic, msrs, hook, handler
+}
+
+func TestProbeForPMU(t *testing.T) {
+	defer restoreMocks()
+
+	specs := []struct {
+		intel          bool
+		maxLeaf        uint32
+		eax, ebx, edx  uint32
+		expDrv         bool
+		expUnavailable uint32
+	}{
+		{false, 0xd, 0x07300804, 0, 0x0603, false, 0},
+		{true, 0x7, 0x07300804, 0, 0x0603, false, 0},
+		// version 1
+		{true, 0xd, 0x07300401, 0, 0, false, 0},
+		// no counters
+		{true, 0xd, 0x07300002, 0, 0, false, 0},
+		{true, 0xd, 0x07300804, 0, 0x0603, true, 0xffffff80},
+		// LLC misses unavailable; only 5 events reported
+		{true, 0xd, 0x05300404, 0x10, 0x0603, true, 0xffffffe0 | 0x10},
+	}
+
+	for specIndex, spec := range specs {
+		isIntelFn = func() bool { return spec.intel }
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			switch leaf {
+			case 0:
+				return spec.maxLeaf, 0, 0, 0
+			case cpuidPerfMonLeaf:
+				return spec.eax, spec.ebx, 0, spec.edx
+			}
+			t.Fatalf("[spec %d] unexpected CPUID leaf 0x%x", specIndex, leaf)
+			return 0, 0, 0, 0
+		}
+
+		drv := probeForPMU()
+		if (drv != nil) != spec.expDrv {
+			t.Errorf("[spec %d] expected probe to return a driver: %t", specIndex, spec.expDrv)
+			continue
+		}
+
+		if drv == nil {
+			continue
+		}
+
+		p := drv.(*PMU)
+		if p.version != uint8(spec.eax) || p.numGP != uint8(spec.eax>>8) || p.gpWidth != 48 || p.numFixed != 3 || p.fixedWidth != 48 {
+			t.Errorf("[spec %d] unexpected PMU capabilities: %+v", specIndex, p)
+		}
+
+		if p.unavailable != spec.expUnavailable {
+			t.Errorf("[spec %d] expected unavailable event mask to be 0x%x; got 0x%x", specIndex, spec.expUnavailable, p.unavailable)
+		}
+	}
+}
+
+func TestDriverInit(t *testing.T) {
+	defer restoreMocks()
+
+	t.Run("success", func(t *testing.T) {
+		running := mockThread("boot")
+		p, lapic, msrs, hook, handler := mockPMU(t, running)
+
+		if activePMU != p || hook == nil || handler == nil || p.running != running {
+			t.Fatal("expected driver to register itself, its switch hook and its interrupt handler")
+		}
+
+		if lapic.vector != 0x42 {
+			t.Fatalf("expected performance counter interrupts to be routed to vector 0x42; got 0x%x", lapic.vector)
+		}
+
+		expCounters := [numEvents]counter{
+			EventCycles:          {fixed: true, index: 1, mask: 1<<48 - 1},
+			EventInstructions:    {fixed: true, index: 0, mask: 1<<48 - 1},
+			EventCacheReferences: {index: 0, mask: 1<<48 - 1},
+			EventCacheMisses:     {index: 1, mask: 1<<48 - 1},
+		}
+		for ev, exp := range expCounters {
+			if got := p.counters[ev]; got == nil || *got != exp {
+				t.Errorf("expected counter for %s to be %+v; got %+v", Event(ev).String(), exp, got)
+			}
+		}
+
+		expMSRs := map[uint32]uint64{
+			msrFixedCtrCtrl:    0x33,
+			msrPerfEvtSel0:     0x2e | 0x4f<<8 | evtSelUSR | evtSelOS | evtSelEN,
+			msrPerfEvtSel0 + 1: 0x2e | 0x41<<8 | evtSelUSR | evtSelOS | evtSelEN,
+			msrPerfGlobalCtrl:  1<<32 | 1<<33 | 1<<0 | 1<<1,
+		}
+		for msr, exp := range expMSRs {
+			if got := msrs[msr]; got != exp {
+				t.Errorf("expected MSR 0x%x to be 0x%x; got 0x%x", msr, exp, got)
+			}
+		}
+	})
+
+	t.Run("unsupported events", func(t *testing.T) {
+		mockMSRs()
+
+		// Only the instructions event can be counted using the fixed
+		// counter; the cycles event needs a general-purpose counter
+		p := &PMU{version: 2, numGP: 1, gpWidth: 40, numFixed: 1, fixedWidth: 40, unavailable: 1 << 3}
+		activeLocalAPICFn = func() localAPIC { return &mockLocalAPIC{} }
+		allocVectorFn = func() (gate.InterruptNumber, *kernel.Error) { return 0x42, nil }
+		registerHandlerFn = func(_ gate.InterruptNumber, _ irq.Handler) *kernel.Error { return nil }
+		addSwitchHookFn = func(func(*sched.Thread)) {}
+		currentThreadFn = func() *sched.Thread { return nil }
+
+		var buf bytes.Buffer
+		if err := p.DriverInit(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if p.counters[EventCycles] == nil || p.counters[EventCycles].fixed || p.counters[EventInstructions] == nil || !p.counters[EventInstructions].fixed {
+			t.Fatal("expected cycles to use a general-purpose counter and instructions to use a fixed counter")
+		}
+
+		if p.counters[EventCacheReferences] != nil || p.counters[EventCacheMisses] != nil {
+			t.Fatal("expected cache events to be unsupported")
+		}
+
+		exp := "version: 2, counters: 1 general-purpose (40 bits), 1 fixed (40 bits)\nevents: cycles instructions\n"
+		if got := buf.String(); got != exp {
+			t.Fatalf("expected output:\n%q\ngot:\n%q", exp, got)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		mockMSRs()
+		expErr := &kernel.Error{Module: "test", Message: "out of vectors"}
+
+		specs := []struct {
+			pmu    *PMU
+			lapic  localAPIC
+			vecErr *kernel.Error
+			expErr *kernel.Error
+		}{
+			{&PMU{version: 2, unavailable: ^uint32(0), numGP: 2, numFixed: 3}, &mockLocalAPIC{}, nil, errNoCounters},
+			{&PMU{version: 2, numGP: 2, numFixed: 3}, nil, nil, errNoLocalAPIC},
+			{&PMU{version: 2, numGP: 2, numFixed: 3}, &mockLocalAPIC{}, expErr, expErr},
+		}
+
+		for specIndex, spec := range specs {
+			activeLocalAPICFn = func() localAPIC { return spec.lapic }
+			allocVectorFn = func() (gate.InterruptNumber, *kernel.Error) { return 0x42, spec.vecErr }
+
+			if err := spec.pmu.DriverInit(&bytes.Buffer{}); err != spec.expErr {
+				t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			}
+		}
+	})
+}
+
+func TestAccounting(t *testing.T) {
+	defer restoreMocks()
+
+	boot, worker := mockThread("boot"), mockThread("kworker")
+	p, _, msrs, hook, _ := mockPMU(t, boot)
+
+	msrs[msrFixedCtr0+1] = 1000
+	msrs[msrFixedCtr0] = 500
+	msrs[msrPMC0+1] = 3
+	hook(worker)
+
+	msrs[msrFixedCtr0+1] = 1500
+	msrs[msrFixedCtr0] = 700
+	msrs[msrPMC0] = 10
+
+	if p.running != worker {
+		t.Fatal("expected the switch hook to track the running thread")
+	}
+
+	specs := []struct {
+		thread *sched.Thread
+		exp    Counters
+	}{
+		{boot, Counters{1000, 500, 0, 3}},
+		{worker, Counters{500, 200, 10, 0}},
+	}
+
+	for specIndex, spec := range specs {
+		got, ok := TaskCounters(spec.thread)
+		if !ok || got != spec.exp {
+			t.Errorf("[spec %d] expected counters for %s to be %v; got %v", specIndex, spec.thread.Name(), spec.exp, got)
+		}
+	}
+
+	if _, ok := TaskCounters(mockThread("idle")); ok {
+		t.Error("expected no counters for a thread that never ran")
+	}
+
+	if exp := (Counters{1500, 700, 10, 3}); p.totals != exp {
+		t.Errorf("expected totals to be %v; got %v", exp, p.totals)
+	}
+
+	// The counters wrap around at their width
+	msrs[msrFixedCtr0+1] = 100
+	p.account()
+	if exp := uint64(1500 + (1<<48 - 1500) + 100); p.totals[EventCycles] != exp {
+		t.Errorf("expected counter wrap-around to be handled; got %d cycles", p.totals[EventCycles])
+	}
+}
+
+func TestSampling(t *testing.T) {
+	defer restoreMocks()
+
+	if err := StartSampling(EventCycles, 100); err != errNotAvailable {
+		t.Fatalf("expected error %v; got %v", errNotAvailable, err)
+	}
+	StopSampling()
+
+	p, lapic, msrs, _, handler := mockPMU(t, nil)
+	p.counters[EventCacheMisses] = nil
+
+	specs := []struct {
+		ev     Event
+		period uint64
+		expErr *kernel.Error
+	}{
+		{numEvents, 100, errUnsupportedEvent},
+		{EventCacheMisses, 100, errUnsupportedEvent},
+		{EventCycles, 0, errInvalidPeriod},
+		{EventCycles, MaxSamplePeriod + 1, errInvalidPeriod},
+	}
+
+	for specIndex, spec := range specs {
+		if err := StartSampling(spec.ev, spec.period); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	// Interrupts without overflowed counters are not handled
+	if handler(&gate.Registers{}) {
+		t.Fatal("expected handler to ignore the interrupt when no counter overflowed")
+	}
+
+	if err := StartSampling(EventCacheReferences, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := StartSampling(EventCycles, 1000); err != errAlreadySampling {
+		t.Fatalf("expected error %v; got %v", errAlreadySampling, err)
+	}
+
+	if exp, got := uint64(1<<48-1000), msrs[msrPMC0]; got != exp {
+		t.Fatalf("expected counter to be armed with 0x%x; got 0x%x", exp, got)
+	}
+
+	if msrs[msrPerfEvtSel0]&evtSelINT == 0 {
+		t.Fatal("expected overflow interrupt to be enabled for the sampled counter")
+	}
+
+	// Overflow the sampled counter
+	unmask := lapic.unmask
+	msrs[msrPMC0] = 5
+	msrs[msrPerfGlobalStatus] = 1 << 0
+	if !handler(&gate.Registers{}) {
+		t.Fatal("expected handler to service the overflow interrupt")
+	}
+
+	if p.sampleCount != 1 || p.totals[EventCacheReferences] != 1005 {
+		t.Fatalf("expected 1 sample and 1005 counted events; got %d samples and %d events", p.sampleCount, p.totals[EventCacheReferences])
+	}
+
+	if msrs[msrPMC0] != 1<<48-1000 || msrs[msrPerfGlobalOvfCtrl] != 1<<0 || lapic.unmask != unmask+1 {
+		t.Fatal("expected counter to be re-armed, the overflow status to be cleared and the LVT entry to be unmasked")
+	}
+
+	var buf bytes.Buffer
+	WriteStats(&buf)
+	exp := "EVENT             TOTAL\n" +
+		"cycles            0\n" +
+		"instructions      0\n" +
+		"cache-references  1005\n" +
+		"cache-misses      -\n" +
+		"\nsampling: cache-references every 1000 events, 1 samples\n" +
+		"\nTID   CYCLES         INSTRUCTIONS   CACHE-REFS     CACHE-MISSES   NAME\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output:\n%q\ngot:\n%q", exp, got)
+	}
+
+	StopSampling()
+	if p.sampling || msrs[msrPerfEvtSel0]&evtSelINT != 0 {
+		t.Fatal("expected sampling to be stopped")
+	}
+
+	// Stopping twice is a no-op
+	StopSampling()
+}
+
+func TestWriteStats(t *testing.T) {
+	defer restoreMocks()
+
+	var buf bytes.Buffer
+	WriteStats(&buf)
+	if exp := errNotAvailable.Message + "\n"; buf.String() != exp {
+		t.Fatalf("expected output %q; got %q", exp, buf.String())
+	}
+
+	worker := mockThread("kworker")
+	_, _, msrs, _, _ := mockPMU(t, worker)
+	msrs[msrFixedCtr0+1] = 1200
+	msrs[msrFixedCtr0] = 340
+
+	buf.Reset()
+	WriteStats(&buf)
+
+	exp := "EVENT             TOTAL\n" +
+		"cycles            1200\n" +
+		"instructions      340\n" +
+		"cache-references  0\n" +
+		"cache-misses      0\n" +
+		"\nsampling: off\n" +
+		"\nTID   CYCLES         INSTRUCTIONS   CACHE-REFS     CACHE-MISSES   NAME\n"
+	exp += fmt.Sprintf("%-5d 1200           340            0              0              kworker\n", worker.ID())
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output:\n%q\ngot:\n%q", exp, got)
+	}
+
+	if !Supported(EventCycles) || Supported(numEvents) {
+		t.Fatal("expected Supported to report the events with an assigned counter")
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	for ev := Event(0); ev < numEvents; ev++ {
+		got, err := ParseEvent(ev.String())
+		if err != nil || got != ev {
+			t.Errorf("expected %q to be parsed as event %d; got %d, %v", ev.String(), ev, got, err)
+		}
+	}
+
+	if _, err := ParseEvent("branch-misses"); err != errUnknownEvent {
+		t.Errorf("expected error %v; got %v", errUnknownEvent, err)
+	}
+
+	if got := numEvents.String(); got != "unknown" {
+		t.Errorf("expected unknown event name; got %q", got)
+	}
+}
@@ -0,0 +1,198 @@
+package device
+
+import (
+	"gopheros/kernel"
+	"io"
+)
+
+// ProbeStatus describes the outcome of probing a registered driver.
+type ProbeStatus uint8
+
+const (
+	// ProbeStatusPending indicates that the driver has not been probed.
+	ProbeStatusPending ProbeStatus = iota
+
+	// ProbeStatusNotDetected indicates that the driver's probe function
+	// did not detect any supported hardware.
+	ProbeStatusNotDetected
+
+	// ProbeStatusMissingDeps indicates that the driver was not probed as
+	// at least one of its dependencies was not initialized.
+	ProbeStatusMissingDeps
+
+	// ProbeStatusInitFailed indicates that hardware was detected but the
+	// driver failed to initialize it.
+	ProbeStatusInitFailed
+
+	// ProbeStatusActive indicates that the driver was successfully
+	// initialized.
+	ProbeStatusActive
+
+	// ProbeStatusNotPresent indicates that the driver was not probed as
+	// the firmware reports the supported hardware as not present or not
+	// enabled.
+	ProbeStatusNotPresent
+)
+
+// PresenceFn reports whether the firmware describes any devices matching one
+// of the supplied ACPI IDs and whether at least one of them is present and
+// enabled.
+type PresenceFn func(acpiIDs []string) (present, described bool)
+
+// String implements fmt.Stringer for ProbeStatus.
+func (s ProbeStatus) String() string {
+	switch s {
+	case ProbeStatusPending:
+		return "pending"
+	case ProbeStatusNotDetected:
+		return "not detected"
+	case ProbeStatusMissingDeps:
+		return "missing dependencies"
+	case ProbeStatusInitFailed:
+		return "init failed"
+	case ProbeStatusActive:
+		return "active"
+	case ProbeStatusNotPresent:
+		return "not present"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	errDependencyCycle = &kernel.Error{Module: "device", Message: "circular driver dependencies detected"}
+
+	// presenceFn is used by ProbeDrivers to query the firmware about the
+	// presence of the devices supported by a driver.
+	presenceFn PresenceFn
+)
+
+// SetPresenceFn registers a function that ProbeDrivers uses to skip drivers
+// for hardware that the firmware reports as not present. Drivers that do not
+// specify any ACPI IDs are always probed.
+func SetPresenceFn(fn PresenceFn) {
+	presenceFn = fn
+}
+
+// ProbeOrder returns the list of registered drivers sorted so that each
+// driver appears after the drivers it depends on. Drivers whose relative order
+// is not constrained by their dependencies are sorted by their DetectOrder and
+// then by the order in which they were registered. Dependencies on drivers
+// that have not been registered do not affect the ordering; they are reported
+// when the driver is probed.
+//
+// If the driver dependencies contain a cycle, ProbeOrder returns
+// errDependencyCycle together with a list where the drivers that are part of
+// the cycle (or depend on it) are placed at the end. As their dependencies
+// never get initialized first, ProbeDrivers will skip them.
+func ProbeOrder() (DriverInfoList, *kernel.Error) {
+	var (
+		list   = make(DriverInfoList, 0, len(registeredDrivers))
+		placed = make(map[*DriverInfo]bool, len(registeredDrivers))
+	)
+
+	for len(list) < len(registeredDrivers) {
+		var next *DriverInfo
+		for _, info := range registeredDrivers {
+			if placed[info] || !dependenciesPlaced(info, placed) {
+				continue
+			}
+
+			if next == nil || info.Order < next.Order {
+				next = info
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		placed[next] = true
+		list = append(list, next)
+	}
+
+	if len(list) == len(registeredDrivers) {
+		return list, nil
+	}
+
+	for _, info := range registeredDrivers {
+		if !placed[info] {
+			list = append(list, info)
+		}
+	}
+
+	return list, errDependencyCycle
+}
+
+// dependenciesPlaced returns true if all registered dependencies of info have
+// already been placed in the probe order.
+func dependenciesPlaced(info *DriverInfo, placed map[*DriverInfo]bool) bool {
+	for _, depName := range info.DependsOn {
+		if dep := Lookup(depName); dep != nil && !placed[dep] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ProbeDrivers invokes the probe function of each driver in list in order and
+// initializes the drivers for any detected hardware, recording the outcome
+// for each list entry. Drivers whose dependencies have not been successfully
+// initialized are skipped. Drivers for hardware that the firmware reports as
+// not present are also skipped.
+//
+// Prior to initializing a driver, ProbeDrivers invokes logWriterFn to obtain
+// the io.Writer that is passed to the driver's DriverInit method. After each
+// list entry has been processed, ProbeDrivers invokes onProbe with it.
+func ProbeDrivers(list DriverInfoList, logWriterFn func(Driver) io.Writer, onProbe func(*DriverInfo)) {
+	for _, info := range list {
+		info.driver, info.initErr = nil, nil
+
+		switch {
+		case !dependenciesActive(info):
+			info.status = ProbeStatusMissingDeps
+		case !firmwareReportsPresent(info):
+			info.status = ProbeStatusNotPresent
+		default:
+			if info.driver = info.Probe(); info.driver == nil {
+				info.status = ProbeStatusNotDetected
+				break
+			}
+
+			if info.initErr = info.driver.DriverInit(logWriterFn(info.driver)); info.initErr != nil {
+				info.status = ProbeStatusInitFailed
+				break
+			}
+
+			info.status = ProbeStatusActive
+		}
+
+		if onProbe != nil {
+			onProbe(info)
+		}
+	}
+}
+
+// firmwareReportsPresent returns false if the firmware describes devices that
+// are supported by info but reports all of them as not present.
+func firmwareReportsPresent(info *DriverInfo) bool {
+	if len(info.ACPIIDs) == 0 || presenceFn == nil {
+		return true
+	}
+
+	present, described := presenceFn(info.ACPIIDs)
+	return present || !described
+}
+
+// dependenciesActive returns true if all dependencies of info have been
+// successfully initialized.
+func dependenciesActive(info *DriverInfo) bool {
+	for _, depName := range info.DependsOn {
+		if dep := Lookup(depName); dep == nil || dep.status != ProbeStatusActive {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,233 @@
+package device
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"io"
+	"testing"
+)
+
+func TestProbeOrder(t *testing.T) {
+	defer func() {
+		registeredDrivers = nil
+	}()
+
+	specs := []struct {
+		drivers  []*DriverInfo
+		expOrder []string
+		expErr   *kernel.Error
+	}{
+		// Without dependencies, drivers are sorted by DetectOrder and
+		// registration order.
+		{
+			[]*DriverInfo{
+				{Name: "a", Order: DetectOrderACPI},
+				{Name: "b", Order: DetectOrderEarly},
+				{Name: "c", Order: DetectOrderACPI},
+				{Name: "d", Order: DetectOrderBeforeACPI},
+			},
+			[]string{"b", "d", "a", "c"},
+			nil,
+		},
+		// Dependencies take precedence over DetectOrder
+		{
+			[]*DriverInfo{
+				{Name: "a", Order: DetectOrderEarly, DependsOn: []string{"c"}},
+				{Name: "b", Order: DetectOrderBeforeACPI},
+				{Name: "c", Order: DetectOrderLast, DependsOn: []string{"b"}},
+				{Name: "d", Order: DetectOrderACPI},
+			},
+			[]string{"b", "d", "c", "a"},
+			nil,
+		},
+		// Unregistered dependencies do not affect the order
+		{
+			[]*DriverInfo{
+				{Name: "a", Order: DetectOrderACPI, DependsOn: []string{"missing"}},
+				{Name: "b", Order: DetectOrderLast},
+			},
+			[]string{"a", "b"},
+			nil,
+		},
+		// Drivers that are part of (or depend on) a cycle are placed last
+		{
+			[]*DriverInfo{
+				{Name: "a", DependsOn: []string{"b"}},
+				{Name: "b", DependsOn: []string{"a"}},
+				{Name: "c", Order: DetectOrderLast},
+				{Name: "d", Order: DetectOrderEarly, DependsOn: []string{"a"}},
+			},
+			[]string{"c", "a", "b", "d"},
+			errDependencyCycle,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		registeredDrivers = nil
+		for _, info := range spec.drivers {
+			RegisterDriver(info)
+		}
+
+		list, err := ProbeOrder()
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+
+		if len(list) != len(spec.expOrder) {
+			t.Errorf("[spec %d] expected list to contain %d entries; got %d", specIndex, len(spec.expOrder), len(list))
+			continue
+		}
+
+		for i, expName := range spec.expOrder {
+			if list[i].Name != expName {
+				t.Errorf("[spec %d] expected entry %d to be %q; got %q", specIndex, i, expName, list[i].Name)
+			}
+		}
+	}
+}
+
+func TestProbeDrivers(t *testing.T) {
+	defer func() {
+		registeredDrivers = nil
+		presenceFn = nil
+	}()
+
+	SetPresenceFn(func(acpiIDs []string) (bool, bool) {
+		switch acpiIDs[0] {
+		case "PNP0303":
+			return true, true
+		case "PNP0B00":
+			return false, true
+		default:
+			return false, false
+		}
+	})
+
+	initErr := &kernel.Error{Module: "test", Message: "init failed"}
+	drivers := []*DriverInfo{
+		{Name: "missing", DependsOn: []string{"not-registered"}},
+		{Name: "absent", Probe: func() Driver { return nil }},
+		{Name: "broken", Probe: func() Driver { return &mockDriver{initErr: initErr} }},
+		{Name: "ok", Probe: func() Driver { return &mockDriver{} }},
+		{Name: "needs-ok", DependsOn: []string{"ok"}, Probe: func() Driver { return &mockDriver{} }},
+		{Name: "needs-broken", DependsOn: []string{"broken"}, Probe: func() Driver { return &mockDriver{} }},
+		{Name: "needs-absent", DependsOn: []string{"ok", "absent"}, Probe: func() Driver { return &mockDriver{} }},
+		{Name: "acpi-present", ACPIIDs: []string{"PNP0303"}, Probe: func() Driver { return &mockDriver{} }},
+		{Name: "acpi-not-present", ACPIIDs: []string{"PNP0B00"}, Probe: func() Driver { return &mockDriver{} }},
+		{Name: "acpi-not-described", ACPIIDs: []string{"PNP0501"}, Probe: func() Driver { return &mockDriver{} }},
+	}
+	for _, info := range drivers {
+		RegisterDriver(info)
+	}
+
+	var (
+		buf       bytes.Buffer
+		logWrites int
+		probed    []*DriverInfo
+	)
+	ProbeDrivers(DriverList(),
+		func(_ Driver) io.Writer {
+			logWrites++
+			return &buf
+		},
+		func(info *DriverInfo) { probed = append(probed, info) },
+	)
+
+	if len(probed) != len(drivers) {
+		t.Fatalf("expected onProbe to be invoked %d times; got %d", len(drivers), len(probed))
+	}
+
+	if exp := 5; logWrites != exp {
+		t.Errorf("expected the log writer to be requested %d times; got %d", exp, logWrites)
+	}
+
+	if exp := "init:init:init:init:init:"; buf.String() != exp {
+		t.Errorf("expected detected drivers to log %q; got %q", exp, buf.String())
+	}
+
+	specs := []struct {
+		status    ProbeStatus
+		hasDriver bool
+		initErr   *kernel.Error
+	}{
+		{ProbeStatusMissingDeps, false, nil},
+		{ProbeStatusNotDetected, false, nil},
+		{ProbeStatusInitFailed, true, initErr},
+		{ProbeStatusActive, true, nil},
+		{ProbeStatusActive, true, nil},
+		{ProbeStatusMissingDeps, false, nil},
+		{ProbeStatusMissingDeps, false, nil},
+		{ProbeStatusActive, true, nil},
+		{ProbeStatusNotPresent, false, nil},
+		{ProbeStatusActive, true, nil},
+	}
+
+	for specIndex, spec := range specs {
+		info := drivers[specIndex]
+		if probed[specIndex] != info {
+			t.Errorf("[spec %d] expected onProbe to be invoked in list order", specIndex)
+		}
+
+		if got := info.Status(); got != spec.status {
+			t.Errorf("[spec %d] expected status %q; got %q", specIndex, spec.status.String(), got.String())
+		}
+
+		if got := info.Driver() != nil; got != spec.hasDriver {
+			t.Errorf("[spec %d] expected Driver() != nil to be %t", specIndex, spec.hasDriver)
+		}
+
+		if got := info.InitError(); got != spec.initErr {
+			t.Errorf("[spec %d] expected init error %v; got %v", specIndex, spec.initErr, got)
+		}
+	}
+}
+
+func TestProbeStatusString(t *testing.T) {
+	specs := []struct {
+		status ProbeStatus
+		exp    string
+	}{
+		{ProbeStatusPending, "pending"},
+		{ProbeStatusNotDetected, "not detected"},
+		{ProbeStatusMissingDeps, "missing dependencies"},
+		{ProbeStatusInitFailed, "init failed"},
+		{ProbeStatusActive, "active"},
+		{ProbeStatusNotPresent, "not present"},
+		{ProbeStatus(99), "unknown"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.status.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	defer func() {
+		registeredDrivers = nil
+	}()
+
+	info := &DriverInfo{Name: "foo"}
+	RegisterDriver(&DriverInfo{Name: "bar"})
+	RegisterDriver(info)
+
+	if got := Lookup("foo"); got != info {
+		t.Errorf("expected Lookup to return the registered driver; got %v", got)
+	}
+
+	if got := Lookup("baz"); got != nil {
+		t.Errorf("expected Lookup to return nil for unknown drivers; got %v", got)
+	}
+}
+
+type mockDriver struct {
+	initErr *kernel.Error
+}
+
+func (*mockDriver) DriverName() string                      { return "mock" }
+func (*mockDriver) DriverVersion() (uint16, uint16, uint16) { return 0, 0, 1 }
+func (d *mockDriver) DriverInit(w io.Writer) *kernel.Error {
+	w.Write([]byte("init:"))
+	return d.initErr
+}
@@ -0,0 +1,283 @@
+// Package rtc provides a driver for the MC146818-compatible real-time clock
+// (RTC) found in the CMOS of PC-compatible systems. The driver uses the RTC
+// to initialize the kernel wall clock and periodically corrects any drift
+// between the wall clock and the RTC.
+package rtc
+
+import (
+	"gopheros/device"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/device/cmos"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/workqueue"
+	"io"
+	"unsafe"
+)
+
+const (
+	// RTC register indices.
+	regSeconds = uint8(0x00)
+	regMinutes = uint8(0x02)
+	regHours   = uint8(0x04)
+	regDay     = uint8(0x07)
+	regMonth   = uint8(0x08)
+	regYear    = uint8(0x09)
+	regStatusA = uint8(0x0a)
+	regStatusB = uint8(0x0b)
+
+	statusAUpdateInProgress = uint8(1 << 7)
+	statusB24Hour           = uint8(1 << 1)
+	statusBBinary           = uint8(1 << 2)
+	hourPM                  = uint8(1 << 7)
+
+	// maxUpdateSpins bounds the number of polls while waiting for an RTC
+	// update cycle to complete. An update cycle takes less than 2ms.
+	maxUpdateSpins = 100000
+
+	// maxReadAttempts bounds the number of times the RTC registers are
+	// read while trying to obtain two consistent snapshots.
+	maxReadAttempts = 10
+
+	// defaultCentury is used when the firmware does not report the
+	// location of the RTC century register.
+	defaultCentury = 20
+
+	// resyncInterval specifies how often the wall clock is compared
+	// against the RTC.
+	resyncInterval = 10 * 60 * timer.Second
+)
+
+var (
+	errUpdateTimeout = &kernel.Error{Module: "rtc", Message: "timed out waiting for the RTC update cycle to complete"}
+	errInconsistent  = &kernel.Error{Module: "rtc", Message: "could not obtain a consistent RTC reading"}
+	errInvalidTime   = &kernel.Error{Module: "rtc", Message: "RTC contains an invalid date/time"}
+
+	// The following functions are used by tests to mock calls to the cmos,
+	// acpi, timer and workqueue packages.
+	cmosReadFn     = cmos.Read
+	lookupTableFn  = acpi.LookupTable
+	setWallClockFn = timer.SetWallClock
+	wallClockFn    = timer.WallClock
+	everyFn        = timer.Every
+	enqueueFn      = workqueue.Enqueue
+)
+
+// DateTime describes a calendar date and time of day in UTC.
+type DateTime struct {
+	Year   uint16
+	Month  uint8
+	Day    uint8
+	Hour   uint8
+	Minute uint8
+	Second uint8
+}
+
+// Unix returns the number of seconds elapsed between the Unix epoch and dt.
+func (dt DateTime) Unix() int64 {
+	// Convert the date to a day count using the days-from-civil algorithm
+	// which treats March as the first month of the year so that the leap
+	// day is the last day of the year.
+	year, month := int64(dt.Year), int64(dt.Month)
+	if month <= 2 {
+		year--
+		month += 12
+	}
+
+	era := year / 400
+	yearOfEra := year - era*400
+	dayOfYear := (153*(month-3)+2)/5 + int64(dt.Day) - 1
+	dayOfEra := yearOfEra*365 + yearOfEra/4 - yearOfEra/100 + dayOfYear
+	days := era*146097 + dayOfEra - 719468
+
+	return days*86400 + int64(dt.Hour)*3600 + int64(dt.Minute)*60 + int64(dt.Second)
+}
+
+// valid returns true if all dt fields are within their allowed ranges.
+func (dt DateTime) valid() bool {
+	return dt.Month >= 1 && dt.Month <= 12 &&
+		dt.Day >= 1 && dt.Day <= 31 &&
+		dt.Hour <= 23 && dt.Minute <= 59 && dt.Second <= 59
+}
+
+// Driver implements a driver for the CMOS RTC.
+type Driver struct {
+	// centuryReg is the index of the CMOS register that holds the
+	// century or 0 if the RTC does not provide one.
+	centuryReg uint8
+
+	syncWork *workqueue.Work
+}
+
+// DriverName returns the name of this driver.
+func (*Driver) DriverName() string {
+	return "rtc_cmos"
+}
+
+// DriverVersion returns the version of this driver.
+func (*Driver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit reads the current date and time from the RTC, uses it to set the
+// kernel wall clock and schedules periodic wall clock corrections.
+func (drv *Driver) DriverInit(w io.Writer) *kernel.Error {
+	if header := lookupTableFn("FACP"); header != nil {
+		drv.centuryReg = (*table.FADT)(unsafe.Pointer(header)).Century
+	}
+
+	if drv.centuryReg >= cmos.NumRegisters {
+		drv.centuryReg = 0
+	}
+
+	dt, err := drv.Read()
+	if err != nil {
+		return err
+	}
+
+	setWallClockFn(dt.Unix() * int64(timer.Second))
+	kfmt.Fprintf(w, "%4d-%02d-%02d %02d:%02d:%02d UTC\n", dt.Year, dt.Month, dt.Day, dt.Hour, dt.Minute, dt.Second)
+
+	// The RTC is read by a kernel thread as waiting for an update cycle
+	// to complete is too slow for a timer callback.
+	drv.syncWork = workqueue.NewWork(drv.sync)
+	everyFn(resyncInterval, func() { enqueueFn(drv.syncWork) })
+	return nil
+}
+
+// Read returns the date and time stored in the RTC. As the RTC registers may
+// change while they are being read, Read retries until two consecutive reads
+// return the same values.
+func (drv *Driver) Read() (DateTime, *kernel.Error) {
+	var raw, prev [7]uint8
+
+	if err := drv.readRaw(&prev); err != nil {
+		return DateTime{}, err
+	}
+
+	for attempt := 0; attempt < maxReadAttempts; attempt++ {
+		if err := drv.readRaw(&raw); err != nil {
+			return DateTime{}, err
+		}
+
+		if raw == prev {
+			dt := decode(raw, readRegister(regStatusB))
+			if !dt.valid() {
+				return DateTime{}, errInvalidTime
+			}
+			return dt, nil
+		}
+		prev = raw
+	}
+
+	return DateTime{}, errInconsistent
+}
+
+// readRaw waits for any in-progress update cycle to complete and then reads
+// the seconds, minutes, hours, day, month, year and century registers.
+func (drv *Driver) readRaw(raw *[7]uint8) *kernel.Error {
+	for spins := 0; readRegister(regStatusA)&statusAUpdateInProgress != 0; spins++ {
+		if spins == maxUpdateSpins {
+			return errUpdateTimeout
+		}
+	}
+
+	for i, reg := range [...]uint8{regSeconds, regMinutes, regHours, regDay, regMonth, regYear} {
+		raw[i] = readRegister(reg)
+	}
+
+	raw[6] = 0
+	if drv.centuryReg != 0 {
+		raw[6] = readRegister(drv.centuryReg)
+	}
+
+	return nil
+}
+
+// decode converts the raw RTC register values into a DateTime taking into
+// account the BCD/binary and 12/24-hour modes selected in status register B.
+func decode(raw [7]uint8, statusB uint8) DateTime {
+	pm := raw[2]&hourPM != 0
+	raw[2] &^= hourPM
+
+	if statusB&statusBBinary == 0 {
+		for i := range raw {
+			raw[i] = fromBCD(raw[i])
+		}
+	}
+
+	hour := raw[2]
+	if statusB&statusB24Hour == 0 {
+		// In 12-hour mode, midnight and noon are reported as 12
+		hour %= 12
+		if pm {
+			hour += 12
+		}
+	}
+
+	century := uint16(raw[6])
+	if century == 0 {
+		century = defaultCentury
+	}
+
+	return DateTime{
+		Year:   century*100 + uint16(raw[5]),
+		Month:  raw[4],
+		Day:    raw[3],
+		Hour:   hour,
+		Minute: raw[1],
+		Second: raw[0],
+	}
+}
+
+// sync compares the wall clock against the RTC. As the RTC only has a
+// resolution of one second, the wall clock is only adjusted if it has drifted
+// outside the second reported by the RTC.
+func (drv *Driver) sync() {
+	dt, err := drv.Read()
+	if err != nil {
+		return
+	}
+
+	var (
+		lo  = dt.Unix() * int64(timer.Second)
+		hi  = lo + int64(timer.Second) - 1
+		now = wallClockFn()
+	)
+
+	switch {
+	case now < lo:
+		setWallClockFn(lo)
+	case now > hi:
+		setWallClockFn(hi)
+	}
+}
+
+// readRegister returns the contents of an RTC register. DriverInit ensures that
+// the century register index is valid so reads never fail.
+func readRegister(reg uint8) uint8 {
+	val, _ := cmosReadFn(reg)
+	return val
+}
+
+func fromBCD(v uint8) uint8 {
+	return (v>>4)*10 + v&0x0f
+}
+
+// probeForRTC returns an RTC driver. Unlike most legacy devices, an absent
+// RTC cannot be detected by reading its registers so the RTC is assumed to
+// be present; DriverInit fails if its contents are not valid.
+func probeForRTC() device.Driver {
+	return &Driver{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:    "rtc_cmos",
+		Order:   device.DetectOrderLast,
+		Probe:   probeForRTC,
+		ACPIIDs: []string{"PNP0B00", "PNP0B01", "PNP0B02"},
+	})
+}
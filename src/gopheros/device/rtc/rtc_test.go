@@ -0,0 +1,240 @@
+package rtc
+
+import (
+	"bytes"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/device/cmos"
+	"gopheros/kernel"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/workqueue"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	cmosReadFn = cmos.Read
+	lookupTableFn = acpi.LookupTable
+	setWallClockFn = timer.SetWallClock
+	wallClockFn = timer.WallClock
+	everyFn = timer.Every
+	enqueueFn = workqueue.Enqueue
+}
+
+// mockCMOS emulates the CMOS register file. If onRead is set, it is invoked
+// before each register read.
+type mockCMOS struct {
+	regs   [cmos.NumRegisters]uint8
+	onRead func(reg uint8)
+}
+
+func (m *mockCMOS) install() {
+	cmosReadFn = func(reg uint8) (uint8, *kernel.Error) {
+		if reg >= cmos.NumRegisters {
+			return 0, &kernel.Error{Module: "test", Message: "invalid register"}
+		}
+		if m.onRead != nil {
+			m.onRead(reg)
+		}
+		return m.regs[reg], nil
+	}
+}
+
+func TestDateTimeUnix(t *testing.T) {
+	specs := []struct {
+		dt  DateTime
+		exp int64
+	}{
+		{DateTime{1970, 1, 1, 0, 0, 0}, 0},
+		{DateTime{2000, 2, 29, 12, 30, 45}, 951827445},
+		{DateTime{2017, 7, 14, 2, 40, 0}, 1500000000},
+		{DateTime{2024, 12, 31, 23, 59, 59}, 1735689599},
+		{DateTime{2100, 3, 1, 0, 0, 0}, 4107542400},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.dt.Unix(); got != spec.exp {
+			t.Errorf("[spec %d] expected %+v to map to %d; got %d", specIndex, spec.dt, spec.exp, got)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	specs := []struct {
+		raw     [7]uint8
+		statusB uint8
+		exp     DateTime
+	}{
+		// BCD, 24-hour mode with century register
+		{[7]uint8{0x45, 0x30, 0x23, 0x31, 0x12, 0x99, 0x19}, statusB24Hour, DateTime{1999, 12, 31, 23, 30, 45}},
+		// BCD, 12-hour mode without century register
+		{[7]uint8{0x00, 0x15, 0x81 | 0x10, 0x01, 0x06, 0x24, 0}, 0, DateTime{2024, 6, 1, 23, 15, 0}},
+		{[7]uint8{0x00, 0x00, 0x12, 0x01, 0x06, 0x24, 0}, 0, DateTime{2024, 6, 1, 0, 0, 0}},
+		{[7]uint8{0x00, 0x00, 0x12 | hourPM, 0x01, 0x06, 0x24, 0}, 0, DateTime{2024, 6, 1, 12, 0, 0}},
+		// Binary, 24-hour mode
+		{[7]uint8{59, 1, 13, 29, 2, 4, 21}, statusBBinary | statusB24Hour, DateTime{2104, 2, 29, 13, 1, 59}},
+		// Binary, 12-hour mode
+		{[7]uint8{0, 0, 7 | hourPM, 1, 1, 0, 20}, statusBBinary, DateTime{2000, 1, 1, 19, 0, 0}},
+	}
+
+	for specIndex, spec := range specs {
+		if got := decode(spec.raw, spec.statusB); got != spec.exp {
+			t.Errorf("[spec %d] expected %+v; got %+v", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	defer restoreMocks()
+
+	cmos := &mockCMOS{}
+	cmos.install()
+	cmos.regs[regSeconds], cmos.regs[regMinutes], cmos.regs[regHours] = 0x59, 0x59, 0x23
+	cmos.regs[regDay], cmos.regs[regMonth], cmos.regs[regYear] = 0x31, 0x12, 0x23
+	cmos.regs[regStatusB] = statusB24Hour
+
+	// The clock ticks over to the next year after the first snapshot;
+	// Read must return the value from the second consistent snapshot.
+	secondReads := 0
+	cmos.onRead = func(reg uint8) {
+		if reg == regSeconds {
+			if secondReads++; secondReads == 2 {
+				cmos.regs[regSeconds], cmos.regs[regMinutes], cmos.regs[regHours] = 0, 0, 0
+				cmos.regs[regDay], cmos.regs[regMonth], cmos.regs[regYear] = 1, 1, 0x24
+			}
+		}
+	}
+
+	drv := &Driver{}
+	dt, err := drv.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := (DateTime{2024, 1, 1, 0, 0, 0}); dt != exp {
+		t.Fatalf("expected %+v; got %+v", exp, dt)
+	}
+
+	// Century register
+	cmos.onRead = nil
+	cmos.regs[0x32] = 0x21
+	drv.centuryReg = 0x32
+	if dt, _ = drv.Read(); dt.Year != 2124 {
+		t.Fatalf("expected century register to be used; got year %d", dt.Year)
+	}
+
+	// Invalid contents
+	cmos.regs[regMonth] = 0xff
+	if _, err = drv.Read(); err != errInvalidTime {
+		t.Fatalf("expected error %v; got %v", errInvalidTime, err)
+	}
+
+	// Registers that keep changing
+	cmos.onRead = func(reg uint8) {
+		if reg == regSeconds {
+			cmos.regs[regSeconds]++
+		}
+	}
+	if _, err = drv.Read(); err != errInconsistent {
+		t.Fatalf("expected error %v; got %v", errInconsistent, err)
+	}
+
+	// Update cycle that never completes
+	cmos.onRead = nil
+	cmos.regs[regStatusA] = statusAUpdateInProgress
+	if _, err = drv.Read(); err != errUpdateTimeout {
+		t.Fatalf("expected error %v; got %v", errUpdateTimeout, err)
+	}
+}
+
+func TestDriverInit(t *testing.T) {
+	defer restoreMocks()
+
+	cmos := &mockCMOS{}
+	cmos.install()
+	cmos.regs[regSeconds], cmos.regs[regMinutes], cmos.regs[regHours] = 0x00, 0x40, 0x02
+	cmos.regs[regDay], cmos.regs[regMonth], cmos.regs[regYear] = 0x14, 0x07, 0x17
+	cmos.regs[regStatusB] = statusB24Hour
+	cmos.regs[0x32] = 0x20
+
+	fadt := &table.FADT{Century: 0x32}
+	lookupTableFn = func(name string) *table.SDTHeader {
+		if name != "FACP" {
+			t.Errorf("unexpected table lookup for %q", name)
+		}
+		return (*table.SDTHeader)(unsafe.Pointer(fadt))
+	}
+
+	var (
+		wallClock   int64
+		interval    timer.Duration
+		timerFn     func()
+		enqueued    *workqueue.Work
+		expWallTime = int64(1500000000) * int64(timer.Second)
+	)
+	setWallClockFn = func(unixNano int64) { wallClock = unixNano }
+	wallClockFn = func() int64 { return wallClock }
+	everyFn = func(d timer.Duration, fn func()) *timer.Timer {
+		interval, timerFn = d, fn
+		return nil
+	}
+	enqueueFn = func(w *workqueue.Work) bool {
+		enqueued = w
+		return true
+	}
+
+	drv := probeForRTC().(*Driver)
+	var buf bytes.Buffer
+	if err := drv.DriverInit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if wallClock != expWallTime {
+		t.Fatalf("expected wall clock to be set to %d; got %d", expWallTime, wallClock)
+	}
+
+	if exp := "2017-07-14 02:40:00 UTC\n"; buf.String() != exp {
+		t.Fatalf("expected driver output %q; got %q", exp, buf.String())
+	}
+
+	if interval != resyncInterval || timerFn == nil {
+		t.Fatal("expected a periodic resync timer to be armed")
+	}
+
+	timerFn()
+	if enqueued == nil || enqueued != drv.syncWork {
+		t.Fatal("expected resync timer to enqueue the sync work item")
+	}
+
+	specs := []struct {
+		wallClock int64
+		exp       int64
+	}{
+		// Within the second reported by the RTC
+		{expWallTime + 999999999, expWallTime + 999999999},
+		// Wall clock is behind the RTC
+		{expWallTime - 3*int64(timer.Second), expWallTime},
+		// Wall clock is ahead of the RTC
+		{expWallTime + 2*int64(timer.Second), expWallTime + int64(timer.Second) - 1},
+	}
+
+	for specIndex, spec := range specs {
+		wallClock = spec.wallClock
+		drv.sync()
+		if wallClock != spec.exp {
+			t.Errorf("[spec %d] expected wall clock to be %d after sync; got %d", specIndex, spec.exp, wallClock)
+		}
+	}
+
+	// Century register indices outside the CMOS are ignored
+	fadt.Century = 0x90
+	if err := drv.DriverInit(&buf); err != nil || drv.centuryReg != 0 {
+		t.Fatalf("expected an invalid century register to be ignored; got error %v, register 0x%x", err, drv.centuryReg)
+	}
+
+	// Errors are propagated
+	cmos.regs[regDay] = 0
+	if err := drv.DriverInit(&buf); err != errInvalidTime {
+		t.Fatalf("expected error %v; got %v", errInvalidTime, err)
+	}
+}
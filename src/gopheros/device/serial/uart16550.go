@@ -0,0 +1,203 @@
+// Package serial provides a polled driver for 16550-compatible UARTs that can
+// be used as an early kernel console.
+package serial
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"io"
+)
+
+const (
+	// Register offsets relative to the UART base port. The divisor latch
+	// registers overlap the data and interrupt enable registers and are
+	// accessible while the DLAB bit of the line control register is set.
+	regData         = uint16(0)
+	regIntEnable    = uint16(1)
+	regDivisorLo    = uint16(0)
+	regDivisorHi    = uint16(1)
+	regFIFOControl  = uint16(2)
+	regLineControl  = uint16(3)
+	regModemControl = uint16(4)
+	regLineStatus   = uint16(5)
+
+	lcrDLAB        = uint8(0x80)
+	lcr8N1         = uint8(0x03)
+	fcrEnable14    = uint8(0xc7)
+	mcrLoopback    = uint8(0x1e)
+	mcrNormal      = uint8(0x0f)
+	lsrTxEmpty     = uint8(0x20)
+	loopbackProbe  = uint8(0xae)
+	baseClock      = uint32(115200)
+	defaultBaud    = uint32(115200)
+	maxTxWaitSpins = 100000
+
+	// consoleArg is the boot command line argument that selects the early
+	// console (e.g. console=ttyS0,115200).
+	consoleArg    = "console"
+	consolePrefix = "ttyS"
+)
+
+var (
+	errNoUART      = &kernel.Error{Module: "uart16550", Message: "UART did not pass the loopback test"}
+	errInvalidBaud = &kernel.Error{Module: "uart16550", Message: "unsupported baud rate"}
+
+	// comPorts contains the base I/O ports of the standard PC serial ports.
+	comPorts = [...]uint16{0x3f8, 0x2f8, 0x3e8, 0x2e8}
+
+	// earlyConsole is statically allocated so that it can be set up
+	// before the memory allocator is bootstrapped.
+	earlyConsole UART16550
+
+	// The following functions are used by tests to mock calls to the cpu
+	// and cmdline packages.
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn  = cpu.PortReadByte
+	cmdlineLookupFn = cmdline.Lookup
+)
+
+// UART16550 implements a polled driver for a 16550-compatible UART. It does
+// not use interrupts and does not allocate memory so it can be used for
+// emitting kernel output at any point during the boot process.
+type UART16550 struct {
+	port uint16
+	baud uint32
+}
+
+// EarlyConsole checks the boot command line for a console=ttyS<n>[,<baud>]
+// argument and returns an initialized driver for the requested serial port.
+// If no serial console is requested or the requested UART is not present,
+// EarlyConsole returns nil.
+func EarlyConsole() *UART16550 {
+	index, baud, ok := parseConsoleArg()
+	if !ok {
+		return nil
+	}
+
+	earlyConsole = UART16550{port: comPorts[index], baud: baud}
+	if err := earlyConsole.DriverInit(nil); err != nil {
+		earlyConsole = UART16550{}
+		return nil
+	}
+
+	return &earlyConsole
+}
+
+// ActiveConsole returns the serial port that was set up by EarlyConsole or nil
+// if no serial console is in use.
+func ActiveConsole() *UART16550 {
+	if earlyConsole.port == 0 {
+		return nil
+	}
+
+	return &earlyConsole
+}
+
+// parseConsoleArg extracts the serial port index and baud rate from the
+// console boot command line argument.
+func parseConsoleArg() (int, uint32, bool) {
+	arg, found := cmdlineLookupFn(consoleArg)
+	if !found || len(arg) <= len(consolePrefix) || arg[:len(consolePrefix)] != consolePrefix {
+		return 0, 0, false
+	}
+
+	index := int(arg[len(consolePrefix)] - '0')
+	if index < 0 || index >= len(comPorts) {
+		return 0, 0, false
+	}
+
+	arg = arg[len(consolePrefix)+1:]
+	if len(arg) == 0 {
+		return index, defaultBaud, true
+	}
+
+	if arg[0] != ',' {
+		return 0, 0, false
+	}
+
+	// Parse the leading digits of the baud rate; any parity/data bit
+	// suffix (e.g. 115200n8) is ignored as the UART is always set to 8N1.
+	var baud uint32
+	for i := 1; i < len(arg) && arg[i] >= '0' && arg[i] <= '9'; i++ {
+		baud = baud*10 + uint32(arg[i]-'0')
+	}
+
+	if baud == 0 {
+		baud = defaultBaud
+	}
+
+	return index, baud, true
+}
+
+// Write implements io.Writer. Line feeds are converted to CR/LF pairs. If the
+// UART stops draining its transmit buffer, the remaining output is dropped so
+// that kernel output can never hang the system.
+func (u *UART16550) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' && !u.putByte('\r') {
+			break
+		}
+
+		if !u.putByte(b) {
+			break
+		}
+	}
+
+	return len(p), nil
+}
+
+// putByte waits for the transmit holding register to become empty and then
+// writes b to it. It returns false if the UART did not become ready in time.
+func (u *UART16550) putByte(b byte) bool {
+	for spins := 0; portReadByteFn(u.port+regLineStatus)&lsrTxEmpty == 0; spins++ {
+		if spins == maxTxWaitSpins {
+			return false
+		}
+	}
+
+	portWriteByteFn(u.port+regData, b)
+	return true
+}
+
+// Port returns the base I/O port of the UART.
+func (u *UART16550) Port() uint16 {
+	return u.port
+}
+
+// DriverName returns the name of this driver.
+func (*UART16550) DriverName() string {
+	return "uart16550"
+}
+
+// DriverVersion returns the version of this driver.
+func (*UART16550) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit programs the UART for 8N1 operation at the configured baud rate
+// with interrupts disabled and verifies that it is present using the UART
+// loopback mode.
+func (u *UART16550) DriverInit(_ io.Writer) *kernel.Error {
+	if u.baud == 0 || u.baud > baseClock || baseClock%u.baud != 0 {
+		return errInvalidBaud
+	}
+	divisor := baseClock / u.baud
+
+	portWriteByteFn(u.port+regIntEnable, 0)
+	portWriteByteFn(u.port+regLineControl, lcrDLAB)
+	portWriteByteFn(u.port+regDivisorLo, uint8(divisor))
+	portWriteByteFn(u.port+regDivisorHi, uint8(divisor>>8))
+	portWriteByteFn(u.port+regLineControl, lcr8N1)
+	portWriteByteFn(u.port+regFIFOControl, fcrEnable14)
+
+	// Check that the UART echoes back a byte while in loopback mode
+	portWriteByteFn(u.port+regModemControl, mcrLoopback)
+	portWriteByteFn(u.port+regData, loopbackProbe)
+	if portReadByteFn(u.port+regData) != loopbackProbe {
+		return errNoUART
+	}
+
+	portWriteByteFn(u.port+regModemControl, mcrNormal)
+	return nil
+}
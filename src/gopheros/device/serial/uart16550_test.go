@@ -0,0 +1,146 @@
+package serial
+
+import (
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func restoreMocks() {
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn = cpu.PortReadByte
+	cmdlineLookupFn = cmdline.Lookup
+	earlyConsole = UART16550{}
+}
+
+// mockUART emulates the registers of a 16550 UART at a particular base port.
+type mockUART struct {
+	port     uint16
+	present  bool
+	txReady  bool
+	regs     [8]uint8
+	divisor  uint16
+	loopback bool
+	echo     uint8
+	sent     []byte
+}
+
+func (m *mockUART) install() {
+	portWriteByteFn = func(port uint16, val uint8) {
+		reg := port - m.port
+		switch {
+		case m.regs[regLineControl]&lcrDLAB != 0 && reg == regDivisorLo:
+			m.divisor = m.divisor&0xff00 | uint16(val)
+		case m.regs[regLineControl]&lcrDLAB != 0 && reg == regDivisorHi:
+			m.divisor = m.divisor&0x00ff | uint16(val)<<8
+		case reg == regData && m.loopback:
+			m.echo = val
+		case reg == regData:
+			m.sent = append(m.sent, val)
+		default:
+			m.regs[reg] = val
+			m.loopback = reg == regModemControl && val == mcrLoopback
+		}
+	}
+
+	portReadByteFn = func(port uint16) uint8 {
+		switch reg := port - m.port; {
+		case !m.present:
+			return 0xff
+		case reg == regData:
+			return m.echo
+		case reg == regLineStatus && m.txReady:
+			return lsrTxEmpty
+		default:
+			return 0
+		}
+	}
+}
+
+func TestEarlyConsole(t *testing.T) {
+	defer restoreMocks()
+
+	specs := []struct {
+		arg        string
+		present    bool
+		port       uint16
+		expOK      bool
+		expDivisor uint16
+	}{
+		{"", true, 0x3f8, false, 0},
+		{"tty0", true, 0x3f8, false, 0},
+		{"ttyS", true, 0x3f8, false, 0},
+		{"ttyS4", true, 0x3f8, false, 0},
+		{"ttyS0x", true, 0x3f8, false, 0},
+		{"ttyS0", true, 0x3f8, true, 1},
+		{"ttyS1,9600", true, 0x2f8, true, 12},
+		{"ttyS2,38400n8", true, 0x3e8, true, 3},
+		{"ttyS3,", true, 0x2e8, true, 1},
+		{"ttyS0,12345", true, 0x3f8, false, 0},
+		{"ttyS0", false, 0x3f8, false, 0},
+	}
+
+	for specIndex, spec := range specs {
+		arg := spec.arg
+		cmdlineLookupFn = func(key string) (string, bool) {
+			if key != consoleArg || arg == "" {
+				return "", false
+			}
+			return arg, true
+		}
+
+		m := &mockUART{port: spec.port, present: spec.present}
+		m.install()
+
+		earlyConsole = UART16550{}
+		uart := EarlyConsole()
+		if !spec.expOK {
+			if uart != nil || ActiveConsole() != nil {
+				t.Errorf("[spec %d] expected EarlyConsole and ActiveConsole to return nil", specIndex)
+			}
+			continue
+		}
+
+		if uart == nil || uart.Port() != spec.port || ActiveConsole() != uart {
+			t.Errorf("[spec %d] expected EarlyConsole and ActiveConsole to return a driver for port 0x%x", specIndex, spec.port)
+			continue
+		}
+
+		if m.divisor != spec.expDivisor || m.regs[regLineControl] != lcr8N1 || m.regs[regModemControl] != mcrNormal || m.regs[regIntEnable] != 0 {
+			t.Errorf("[spec %d] unexpected UART programming: divisor %d, regs %v", specIndex, m.divisor, m.regs)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockUART{port: 0x3f8, present: true, txReady: true}
+	m.install()
+
+	uart := &UART16550{port: 0x3f8, baud: defaultBaud}
+	if n, err := uart.Write([]byte("a\nb")); n != 3 || err != nil {
+		t.Fatalf("expected Write to return (3, nil); got (%d, %v)", n, err)
+	}
+
+	if exp := "a\r\nb"; string(m.sent) != exp {
+		t.Fatalf("expected UART to transmit %q; got %q", exp, m.sent)
+	}
+
+	// Output is dropped if the UART never becomes ready
+	m.sent, m.txReady = nil, false
+	if n, _ := uart.Write([]byte("lost")); n != 4 || len(m.sent) != 0 {
+		t.Fatalf("expected output to be dropped; got %q", m.sent)
+	}
+}
+
+func TestDriverInfo(t *testing.T) {
+	uart := &UART16550{}
+	if drvName := uart.DriverName(); drvName != "uart16550" {
+		t.Errorf("unexpected driver name: %s", drvName)
+	}
+
+	if major, minor, patch := uart.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Errorf("unexpected driver version: %d.%d.%d", major, minor, patch)
+	}
+}
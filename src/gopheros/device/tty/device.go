@@ -6,8 +6,9 @@ import (
 )
 
 const (
-	// DefaultScrollback defines the terminal scrollback in lines.
-	DefaultScrollback = 80
+	// DefaultScrollback defines the terminal scrollback in lines. It can
+	// be overridden using the "scrollback=N" boot command line argument.
+	DefaultScrollback = 500
 
 	// DefaultTabWidth defines the number of spaces that tabs expand to.
 	DefaultTabWidth = 4
@@ -50,3 +51,30 @@ type Device interface {
 	// viewport.
 	SetCursorPosition(x, y uint32)
 }
+
+// Scroller is implemented by terminal devices that keep a scrollback buffer
+// with output that has been scrolled off the screen. Keyboard drivers are
+// expected to invoke PageUp and PageDown in response to Shift+PgUp and
+// Shift+PgDn.
+type Scroller interface {
+	// PageUp moves the displayed window towards older output.
+	PageUp()
+
+	// PageDown moves the displayed window towards the most recent output.
+	PageDown()
+}
+
+// CursorBlinker is implemented by terminal devices that render a blinking
+// cursor on the attached console. BlinkCursor toggles the cursor visibility
+// and is expected to be invoked periodically from a timer callback.
+type CursorBlinker interface {
+	BlinkCursor()
+}
+
+// Resizer is implemented by terminal devices that can adapt to a change of the
+// dimensions of the attached console (e.g. after a resolution switch) without
+// discarding their contents. Resize is expected to be invoked after the
+// attached console dimensions have changed.
+type Resizer interface {
+	Resize()
+}
@@ -0,0 +1,144 @@
+package tty
+
+import (
+	"gopheros/device/input"
+	"gopheros/kernel"
+	"gopheros/kernel/initcall"
+	"gopheros/kernel/kfmt"
+	"unicode/utf8"
+)
+
+// Bits of the modifier key state tracked by the keyboard handler.
+const (
+	modShift uint8 = 1 << iota
+	modCtrl
+	modAltGr
+)
+
+var (
+	// consoleLD is the line discipline for the system console. Its output is
+	// written to the kernel output sink which points to the active terminal
+	// once the hardware has been detected.
+	consoleLD = NewLineDiscipline(sinkWriter{})
+
+	// keyboardGrabbed is set while another component (e.g. the kernel
+	// debug shell) consumes the keyboard input.
+	keyboardGrabbed bool
+
+	mods     uint8
+	capsLock bool
+
+	// The following functions are used by tests to mock calls to the
+	// kfmt and input packages.
+	outputSinkFn      = kfmt.GetOutputSink
+	addInputHandlerFn = input.AddHandler
+)
+
+// Console returns the line discipline for the system console.
+func Console() *LineDiscipline {
+	return consoleLD
+}
+
+// GrabKeyboard controls whether keyboard input is delivered to the console
+// line discipline. While grabbed, key presses are ignored by the console.
+func GrabKeyboard(grab bool) {
+	keyboardGrabbed = grab
+}
+
+// sinkWriter writes to the kernel output sink.
+type sinkWriter struct{}
+
+func (sinkWriter) Write(buf []byte) (int, error) {
+	if w := outputSinkFn(); w != nil {
+		return w.Write(buf)
+	}
+
+	return len(buf), nil
+}
+
+// handleKeyEvent translates key presses into the byte sequences expected by
+// terminal programs and passes them to the console line discipline.
+func handleKeyEvent(ev *input.Event) {
+	if ev.Type != input.EventKey {
+		return
+	}
+
+	pressed := ev.Value != 0
+	var bit uint8
+	switch ev.Code {
+	case input.KeyLeftShift, input.KeyRightShift:
+		bit = modShift
+	case input.KeyLeftCtrl, input.KeyRightCtrl:
+		bit = modCtrl
+	case input.KeyRightAlt:
+		bit = modAltGr
+	}
+
+	switch {
+	case bit != 0 && pressed:
+		mods |= bit
+	case bit != 0:
+		mods &^= bit
+	case pressed && ev.Code == input.KeyCapsLock:
+		capsLock = !capsLock
+	case pressed && !keyboardGrabbed:
+		if seq := keySequence(ev.Code); len(seq) != 0 {
+			consoleLD.Input(seq)
+		}
+	}
+}
+
+// keySequence returns the bytes produced by a key press given the current
+// modifier state.
+func keySequence(code uint16) []byte {
+	switch code {
+	case input.KeyEnter, input.KeyKPEnter:
+		return []byte{'\n'}
+	case input.KeyBackspace:
+		return []byte{charErase}
+	case input.KeyTab:
+		return []byte{'\t'}
+	case input.KeyEsc:
+		return []byte{0x1b}
+	case input.KeyUp:
+		return []byte("\x1b[A")
+	case input.KeyDown:
+		return []byte("\x1b[B")
+	case input.KeyRight:
+		return []byte("\x1b[C")
+	case input.KeyLeft:
+		return []byte("\x1b[D")
+	case input.KeyDelete:
+		return []byte("\x1b[3~")
+	}
+
+	ch := input.ActiveKeymap().Rune(code, mods&modShift != 0, mods&modAltGr != 0, capsLock)
+	switch {
+	case ch == 0:
+		return nil
+	case mods&modCtrl != 0:
+		// Ctrl combined with a letter or one of @[\]^_ produces the
+		// matching control character.
+		if ch >= 'a' && ch <= 'z' {
+			ch -= 'a' - 'A'
+		}
+		if ch < '@' || ch > '_' {
+			return nil
+		}
+		return []byte{byte(ch - '@')}
+	}
+
+	seq := make([]byte, utf8.RuneLen(ch))
+	utf8.EncodeRune(seq, ch)
+	return seq
+}
+
+// initConsole registers the keyboard handler for the console line discipline.
+func initConsole() *kernel.Error {
+	addInputHandlerFn(handleKeyEvent)
+	return nil
+}
+
+func init() {
+	initcall.Register(initcall.LevelLate, initConsole)
+}
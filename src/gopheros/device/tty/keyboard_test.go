@@ -0,0 +1,80 @@
+package tty
+
+import (
+	"bytes"
+	"gopheros/device/input"
+	"gopheros/kernel/kfmt"
+	"io"
+	"testing"
+)
+
+func TestKeyboardInput(t *testing.T) {
+	defer func() {
+		restoreWaitQueue()
+		outputSinkFn = kfmt.GetOutputSink
+		addInputHandlerFn = input.AddHandler
+		consoleLD = NewLineDiscipline(sinkWriter{})
+		mods, capsLock, keyboardGrabbed = 0, false, false
+	}()
+	mockWait(t, nil)
+
+	var (
+		out     bytes.Buffer
+		handler input.Handler
+	)
+	outputSinkFn = func() io.Writer { return &out }
+	addInputHandlerFn = func(h input.Handler) { handler = h }
+
+	if err := initConsole(); err != nil || handler == nil {
+		t.Fatalf("expected initConsole to register an input handler; got %v", err)
+	}
+
+	Console().SetFlags(0)
+	key := func(code uint16, pressed bool) {
+		var value int32
+		if pressed {
+			value = 1
+		}
+		handler(&input.Event{Type: input.EventKey, Code: code, Value: value})
+	}
+	press := func(codes ...uint16) {
+		for _, code := range codes {
+			key(code, true)
+			key(code, false)
+		}
+	}
+
+	press(input.KeyH, input.KeyI, input.KeyEnter, input.KeyTab, input.KeyBackspace, input.KeyEsc)
+	press(input.KeyUp, input.KeyDown, input.KeyRight, input.KeyLeft, input.KeyDelete, input.KeyF1)
+
+	// Modifiers and caps lock
+	key(input.KeyLeftShift, true)
+	press(input.KeyA, input.Key1)
+	key(input.KeyLeftShift, false)
+	press(input.KeyCapsLock, input.KeyB, input.KeyCapsLock)
+
+	key(input.KeyLeftCtrl, true)
+	press(input.KeyC, input.KeyBackslash, input.Key1)
+	key(input.KeyLeftCtrl, false)
+
+	// Relative events and key presses while the keyboard is grabbed are
+	// ignored.
+	handler(&input.Event{Type: input.EventRel, Code: input.RelX, Value: 1})
+	GrabKeyboard(true)
+	press(input.KeyZ)
+
+	exp := "hi\n\t\x7f\x1b\x1b[A\x1b[B\x1b[C\x1b[D\x1b[3~A!B\x03\x1c"
+	if got := readString(t, Console(), 64); got != exp {
+		t.Fatalf("expected console input %q; got %q", exp, got)
+	}
+
+	// Console output is written to the kernel output sink
+	if _, err := Console().Write([]byte("ok")); err != nil || out.String() != "ok" {
+		t.Fatalf("expected output to reach the output sink; got %q, %v", out.String(), err)
+	}
+
+	outputSinkFn = func() io.Writer { return nil }
+	if n, err := Console().Write([]byte("ok")); n != 2 || err != nil {
+		t.Fatalf("expected writes to succeed without an output sink; got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,327 @@
+package tty
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/vfs"
+	"io"
+	"unicode/utf8"
+)
+
+// Flags controls the input processing performed by a LineDiscipline.
+type Flags uint8
+
+// The list of supported line discipline flags.
+const (
+	// FlagCanonical enables line editing. Input is made available to
+	// readers one line at a time once a line is terminated by a newline
+	// or the EOF character. Without this flag (raw mode), each input byte
+	// is made available to readers as soon as it is received.
+	FlagCanonical Flags = 1 << iota
+
+	// FlagEcho echoes input bytes to the terminal output.
+	FlagEcho
+
+	// FlagSignals enables the generation of signals when the interrupt
+	// or quit characters are received.
+	FlagSignals
+
+	// DefaultFlags is the initial set of flags for a LineDiscipline.
+	DefaultFlags = FlagCanonical | FlagEcho | FlagSignals
+)
+
+// Signal identifies a signal that is generated by a LineDiscipline. Its value
+// matches the POSIX signal number.
+type Signal uint8
+
+// The list of signals generated by a LineDiscipline.
+const (
+	SigInt  Signal = 2
+	SigQuit Signal = 3
+)
+
+// The control characters that are recognized by a LineDiscipline.
+const (
+	charInt       = 0x03 // Ctrl+C
+	charEOF       = 0x04 // Ctrl+D
+	charBackspace = 0x08 // Ctrl+H
+	charKill      = 0x15 // Ctrl+U
+	charQuit      = 0x1c // Ctrl+\
+	charErase     = 0x7f
+)
+
+const (
+	// inputBufSize is the maximum number of input bytes that are buffered
+	// by a LineDiscipline including the line that is being edited.
+	inputBufSize = 1024
+)
+
+var (
+	// ErrInterrupted is returned by reads that were interrupted by a
+	// signal generated by the line discipline.
+	ErrInterrupted = &kernel.Error{Module: "tty", Message: "interrupted system call", Code: kernel.CodeInterrupted}
+
+	// The following functions are used by tests to mock calls to the sync
+	// package.
+	waitFn    = (*sync.WaitQueue).WaitInterruptible
+	wakeAllFn = (*sync.WaitQueue).WakeAll
+)
+
+// LineDiscipline sits between a terminal and the programs that use it. It
+// buffers and edits the bytes received from the keyboard, echoes them to the
+// terminal output and generates signals. LineDiscipline implements vfs.File so
+// it can be installed as the standard input and output of processes.
+type LineDiscipline struct {
+	out   io.Writer
+	flags Flags
+
+	// line holds the line that is being edited in canonical mode.
+	line []byte
+
+	// ready holds the input that is available to readers. In canonical
+	// mode, lineEnds contains the offset in ready past the end of each
+	// completed line; lines terminated by the EOF character do not include
+	// a terminator and may be empty.
+	ready    []byte
+	lineEnds []int
+
+	// interrupts is incremented each time a signal is generated so that
+	// blocked readers can detect that they were interrupted.
+	interrupts uint64
+	readers    sync.WaitQueue
+
+	signalHandler func(Signal)
+}
+
+// NewLineDiscipline returns a LineDiscipline with the default flags that
+// writes output and echoed input to out.
+func NewLineDiscipline(out io.Writer) *LineDiscipline {
+	return &LineDiscipline{out: out, flags: DefaultFlags}
+}
+
+// Flags returns the flags of the line discipline.
+func (ld *LineDiscipline) Flags() Flags {
+	return ld.flags
+}
+
+// SetFlags updates the flags of the line discipline. When switching out of
+// canonical mode, the partially edited line becomes available to readers;
+// when switching into canonical mode, any unread input is treated as a
+// completed line.
+func (ld *LineDiscipline) SetFlags(flags Flags) {
+	switch wasCanonical := ld.flags&FlagCanonical != 0; {
+	case wasCanonical && flags&FlagCanonical == 0:
+		ld.ready = append(ld.ready, ld.line...)
+		ld.line, ld.lineEnds = ld.line[:0], ld.lineEnds[:0]
+		ld.wakeReaders()
+	case !wasCanonical && flags&FlagCanonical != 0 && len(ld.ready) != 0:
+		ld.lineEnds = append(ld.lineEnds[:0], len(ld.ready))
+	}
+
+	ld.flags = flags
+}
+
+// SetSignalHandler registers a function that is invoked each time the line
+// discipline generates a signal.
+func (ld *LineDiscipline) SetSignalHandler(handler func(Signal)) {
+	ld.signalHandler = handler
+}
+
+// Input processes a sequence of bytes received from the keyboard. Input never
+// blocks; bytes that do not fit in the input buffer are discarded.
+func (ld *LineDiscipline) Input(data []byte) {
+	for _, b := range data {
+		ld.inputByte(b)
+	}
+}
+
+func (ld *LineDiscipline) inputByte(b byte) {
+	if ld.flags&FlagSignals != 0 {
+		switch b {
+		case charInt:
+			ld.signal(SigInt, "^C\n")
+			return
+		case charQuit:
+			ld.signal(SigQuit, "^\\\n")
+			return
+		}
+	}
+
+	if ld.flags&FlagCanonical == 0 {
+		if len(ld.ready) < inputBufSize {
+			ld.ready = append(ld.ready, b)
+			ld.echo(b)
+			ld.wakeReaders()
+		}
+		return
+	}
+
+	switch b {
+	case charErase, charBackspace:
+		ld.eraseRune()
+	case charKill:
+		for len(ld.line) != 0 {
+			ld.eraseRune()
+		}
+	case charEOF:
+		ld.commitLine()
+	case '\r', '\n':
+		ld.line = append(ld.line, '\n')
+		ld.echo('\n')
+		ld.commitLine()
+	default:
+		// Reserve room for the terminator so lines can always be
+		// completed.
+		if len(ld.ready)+len(ld.line) < inputBufSize-1 {
+			ld.line = append(ld.line, b)
+			ld.echo(b)
+		}
+	}
+}
+
+// eraseRune removes the last (possibly multi-byte) character from the line
+// that is being edited.
+func (ld *LineDiscipline) eraseRune() {
+	if len(ld.line) == 0 {
+		return
+	}
+
+	_, size := utf8.DecodeLastRune(ld.line)
+	erased := ld.line[len(ld.line)-size]
+	ld.line = ld.line[:len(ld.line)-size]
+
+	if ld.flags&FlagEcho != 0 {
+		ld.write("\b")
+		// Control characters are echoed as two characters
+		if erased < ' ' && erased != '\t' {
+			ld.write("\b")
+		}
+	}
+}
+
+// commitLine makes the line that is being edited available to readers.
+func (ld *LineDiscipline) commitLine() {
+	ld.ready = append(ld.ready, ld.line...)
+	ld.lineEnds = append(ld.lineEnds, len(ld.ready))
+	ld.line = ld.line[:0]
+	ld.wakeReaders()
+}
+
+// signal discards all buffered input, interrupts any blocked readers and
+// invokes the registered signal handler.
+func (ld *LineDiscipline) signal(sig Signal, echo string) {
+	ld.line, ld.ready, ld.lineEnds = ld.line[:0], ld.ready[:0], ld.lineEnds[:0]
+	ld.interrupts++
+	ld.wakeReaders()
+
+	if ld.flags&FlagEcho != 0 {
+		ld.write(echo)
+	}
+
+	if ld.signalHandler != nil {
+		ld.signalHandler(sig)
+	}
+}
+
+// wakeReaders notifies blocked readers and pollers that input is available
+// or that a signal was generated.
+func (ld *LineDiscipline) wakeReaders() {
+	wakeAllFn(&ld.readers)
+	vfs.NotifyPoll()
+}
+
+// echo writes an input byte to the terminal output if echoing is enabled.
+// Control characters other than tabs and newlines are echoed in caret
+// notation (e.g. ^A).
+func (ld *LineDiscipline) echo(b byte) {
+	switch {
+	case ld.flags&FlagEcho == 0:
+	case b < ' ' && b != '\t' && b != '\n':
+		ld.write(string([]byte{'^', b + '@'}))
+	default:
+		ld.write(string([]byte{b}))
+	}
+}
+
+func (ld *LineDiscipline) write(s string) {
+	_, _ = io.WriteString(ld.out, s)
+}
+
+// Read blocks until input is available and copies it to buf. In canonical
+// mode, Read returns at most one line and returns 0 if the line was terminated
+// by the EOF character without any preceding input. If a signal is generated
+// by the line discipline or becomes pending for the calling thread while
+// waiting for input, Read returns ErrInterrupted.
+func (ld *LineDiscipline) Read(buf []byte) (int, *kernel.Error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	interrupts := ld.interrupts
+	if !waitFn(&ld.readers, func() bool {
+		return ld.interrupts != interrupts || ld.available() != 0 || len(ld.lineEnds) != 0
+	}) || ld.interrupts != interrupts {
+		return 0, ErrInterrupted
+	}
+
+	n := copy(buf, ld.ready[:ld.available()])
+	ld.ready = ld.ready[:copy(ld.ready, ld.ready[n:])]
+
+	if ld.flags&FlagCanonical != 0 {
+		for i := range ld.lineEnds {
+			ld.lineEnds[i] -= n
+		}
+
+		// Drop the line once it has been fully consumed
+		if ld.lineEnds[0] == 0 {
+			ld.lineEnds = ld.lineEnds[:copy(ld.lineEnds, ld.lineEnds[1:])]
+		}
+	}
+
+	return n, nil
+}
+
+// available returns the number of bytes that can be returned by the next
+// read.
+func (ld *LineDiscipline) available() int {
+	if ld.flags&FlagCanonical == 0 {
+		return len(ld.ready)
+	}
+
+	if len(ld.lineEnds) == 0 {
+		return 0
+	}
+
+	return ld.lineEnds[0]
+}
+
+// Poll implements vfs.Pollable. Terminals are always writable.
+func (ld *LineDiscipline) Poll() vfs.Events {
+	if ld.available() != 0 || len(ld.lineEnds) != 0 {
+		return vfs.PollIn | vfs.PollOut
+	}
+
+	return vfs.PollOut
+}
+
+// Write writes buf to the terminal output.
+func (ld *LineDiscipline) Write(buf []byte) (int, *kernel.Error) {
+	_, _ = ld.out.Write(buf)
+	return len(buf), nil
+}
+
+// Lseek always fails as terminals are not seekable.
+func (ld *LineDiscipline) Lseek(_ int64, _ int) (int64, *kernel.Error) {
+	return 0, vfs.ErrInvalidSeek
+}
+
+// Stat returns information about the terminal.
+func (ld *LineDiscipline) Stat() (vfs.FileInfo, *kernel.Error) {
+	return vfs.FileInfo{Name: "console", Mode: 0620}, nil
+}
+
+// Close releases the file. The line discipline remains usable as it is shared
+// by all descriptors that refer to the terminal.
+func (ld *LineDiscipline) Close() *kernel.Error {
+	return nil
+}
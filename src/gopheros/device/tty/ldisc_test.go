@@ -0,0 +1,197 @@
+package tty
+
+import (
+	"bytes"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/vfs"
+	"testing"
+)
+
+// mockWait replaces waitFn with a function that invokes onBlock each time the
+// wait condition is not satisfied. Tests use onBlock to deliver the input that
+// a blocked reader is waiting for.
+func mockWait(t *testing.T, onBlock func()) {
+	wakeAllFn = func(_ *sync.WaitQueue) int { return 0 }
+	waitFn = func(_ *sync.WaitQueue, cond func() bool) bool {
+		for blocks := 0; !cond(); blocks++ {
+			if onBlock == nil || blocks == 1 {
+				t.Fatal("unexpected call to Wait; the calling thread would block forever")
+			}
+			onBlock()
+		}
+		return true
+	}
+}
+
+func restoreWaitQueue() {
+	waitFn = (*sync.WaitQueue).WaitInterruptible
+	wakeAllFn = (*sync.WaitQueue).WakeAll
+}
+
+func readString(t *testing.T, ld *LineDiscipline, size int) string {
+	t.Helper()
+	buf := make([]byte, size)
+	n, err := ld.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestLineDisciplineCanonical(t *testing.T) {
+	defer restoreWaitQueue()
+	mockWait(t, nil)
+
+	var out bytes.Buffer
+	ld := NewLineDiscipline(&out)
+
+	// Edit a line using backspace, a control character and the kill
+	// character.
+	ld.Input([]byte("junk\x15ls -l\x01\x7f\x7f\x7f\x7fa\xc3\xa9\x7f\n"))
+	if exp := "junk\b\b\b\bls -l^A\b\b\b\b\ba\xc3\xa9\b\n"; out.String() != exp {
+		t.Fatalf("expected echoed output %q; got %q", exp, out.String())
+	}
+
+	// Input is not available until a line is completed
+	ld.Input([]byte("cat"))
+	if got := readString(t, ld, 64); got != "lsa\n" {
+		t.Fatalf("expected to read %q; got %q", "lsa\n", got)
+	}
+
+	// Lines may be read in several chunks and EOF terminates a line
+	// without a newline.
+	ld.Input([]byte{'\r', 'x', charEOF, charEOF})
+	for _, exp := range []string{"ca", "t\n", "x", ""} {
+		if got := readString(t, ld, 2); got != exp {
+			t.Fatalf("expected to read %q; got %q", exp, got)
+		}
+	}
+
+	if n, err := ld.Read(nil); n != 0 || err != nil {
+		t.Fatalf("expected empty reads to return immediately; got %d, %v", n, err)
+	}
+
+	// Input that does not fit in the buffer is dropped but lines can
+	// always be completed.
+	out.Reset()
+	ld.SetFlags(FlagCanonical)
+	ld.Input(bytes.Repeat([]byte{'a'}, 2*inputBufSize))
+	ld.Input([]byte{'\n'})
+	if got := readString(t, ld, 2*inputBufSize); len(got) != inputBufSize || got[len(got)-1] != '\n' {
+		t.Fatalf("expected to read a truncated line of %d bytes; got %d", inputBufSize, len(got))
+	}
+	if out.Len() != 0 {
+		t.Fatalf("expected no output with echo disabled; got %q", out.String())
+	}
+}
+
+func TestLineDisciplineRaw(t *testing.T) {
+	defer restoreWaitQueue()
+	mockWait(t, nil)
+
+	var (
+		out bytes.Buffer
+		ld  = NewLineDiscipline(&out)
+	)
+
+	ld.Input([]byte("partial"))
+	if ld.Poll() != vfs.PollOut {
+		t.Fatalf("expected a partially edited line not to be readable; got 0x%x", ld.Poll())
+	}
+
+	ld.SetFlags(FlagEcho)
+	if ld.Flags() != FlagEcho {
+		t.Fatalf("expected flags to be %d; got %d", FlagEcho, ld.Flags())
+	}
+	if ld.Poll() != vfs.PollIn|vfs.PollOut {
+		t.Fatalf("expected the terminal to be readable in raw mode; got 0x%x", ld.Poll())
+	}
+
+	// Readers are woken up as soon as input arrives
+	mockWait(t, func() { ld.Input([]byte("\x03\x7f")) })
+	if got := readString(t, ld, 64); got != "partial" {
+		t.Fatalf("expected the partially edited line to become available; got %q", got)
+	}
+	if got := readString(t, ld, 64); got != "\x03\x7f" {
+		t.Fatalf("expected control characters to be passed through; got %q", got)
+	}
+	if exp := "partial^C\x7f"; out.String() != exp {
+		t.Fatalf("expected echoed output %q; got %q", exp, out.String())
+	}
+
+	ld.Input(bytes.Repeat([]byte{'a'}, 2*inputBufSize))
+	if got := readString(t, ld, 2*inputBufSize); len(got) != inputBufSize {
+		t.Fatalf("expected to read %d bytes; got %d", inputBufSize, len(got))
+	}
+
+	// Unread input becomes a line when switching back to canonical mode
+	mockWait(t, nil)
+	ld.Input([]byte("abc"))
+	ld.SetFlags(DefaultFlags)
+	if got := readString(t, ld, 64); got != "abc" {
+		t.Fatalf("expected to read %q; got %q", "abc", got)
+	}
+}
+
+func TestLineDisciplineSignals(t *testing.T) {
+	defer restoreWaitQueue()
+	mockWait(t, nil)
+
+	var (
+		out     bytes.Buffer
+		signals []Signal
+		ld      = NewLineDiscipline(&out)
+	)
+	ld.SetSignalHandler(func(sig Signal) { signals = append(signals, sig) })
+
+	// Signals discard pending input and interrupt blocked readers
+	mockWait(t, func() { ld.Input([]byte("ls\n\x03")) })
+	if _, err := ld.Read(make([]byte, 8)); err != ErrInterrupted {
+		t.Fatalf("expected to get ErrInterrupted; got %v", err)
+	}
+
+	ld.Input([]byte("ls\x1c"))
+	if exp := "ls\n^C\nls^\\\n"; out.String() != exp {
+		t.Fatalf("expected echoed output %q; got %q", exp, out.String())
+	}
+	if len(signals) != 2 || signals[0] != SigInt || signals[1] != SigQuit {
+		t.Fatalf("expected SigInt and SigQuit to be generated; got %v", signals)
+	}
+
+	// Signals posted to the reading thread also interrupt blocked readers
+	waitFn = func(_ *sync.WaitQueue, _ func() bool) bool { return false }
+	if _, err := ld.Read(make([]byte, 8)); err != ErrInterrupted {
+		t.Fatalf("expected to get ErrInterrupted; got %v", err)
+	}
+
+	// Without FlagSignals, the characters are treated as input
+	ld.SetFlags(FlagCanonical)
+	ld.Input([]byte("\x03\n"))
+	mockWait(t, nil)
+	if got := readString(t, ld, 8); got != "\x03\n" || len(signals) != 2 {
+		t.Fatalf("expected the interrupt character to be read; got %q", got)
+	}
+}
+
+func TestLineDisciplineFile(t *testing.T) {
+	var (
+		out bytes.Buffer
+		ld  vfs.File = NewLineDiscipline(&out)
+	)
+
+	if n, err := ld.Write([]byte("hello")); n != 5 || err != nil || out.String() != "hello" {
+		t.Fatalf("expected write to reach the terminal; got %d, %v, %q", n, err, out.String())
+	}
+
+	if _, err := ld.Lseek(0, vfs.SeekStart); err != vfs.ErrInvalidSeek {
+		t.Fatalf("expected to get ErrInvalidSeek; got %v", err)
+	}
+
+	if info, err := ld.Stat(); err != nil || info.Name != "console" {
+		t.Fatalf("unexpected file info: %v, %v", info, err)
+	}
+
+	if err := ld.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,18 +4,58 @@ import (
 	"gopheros/device"
 	"gopheros/device/video/console"
 	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
 	"io"
 )
 
+const (
+	// scrollbackArg is the boot command line argument that overrides the
+	// default terminal scrollback size (in lines).
+	scrollbackArg = "scrollback"
+
+	// maxScrollback caps the scrollback size requested via the boot
+	// command line.
+	maxScrollback = 10000
+)
+
+var (
+	// cmdlineUintFn is used by tests to mock calls to the cmdline package.
+	cmdlineUintFn = cmdline.Uint
+)
+
 // VT implements a terminal supporting scrollback. The terminal interprets the
 // following special characters:
 //  - \r (carriage-return)
 //  - \n (line-feed)
 //  - \b (backspace)
 //  - \t (tab; expanded to tabWidth spaces)
+//  - ESC (start of an ANSI escape sequence)
+//
+// Input is expected to be UTF-8 encoded. Characters outside the ASCII range
+// are mapped to glyphs by consoles implementing console.RuneMapper; characters
+// without a glyph are rendered using a replacement glyph.
+//
+// If the attached console implements console.CursorDrawer, the terminal also
+// renders a cursor at the current cursor position. The cursor blinks when
+// BlinkCursor is invoked periodically. Consoles implementing
+// console.HardwareCursor are instead asked to move their own cursor.
+//
+// The following subset of ANSI/VT100 escape sequences is supported:
+//  - ESC [ n A/B/C/D (cursor up/down/forward/back)
+//  - ESC [ n G (cursor to column) and ESC [ row ; col H/f (cursor position)
+//  - ESC [ n J (clear screen) and ESC [ n K (clear line)
+//  - ESC [ ... m (colors, bold and reverse video attributes)
+//  - ESC [ s / ESC [ u (save/restore cursor position) and ESC c (reset)
 type VT struct {
 	cons console.Device
 
+	// flusher is set if the attached console buffers its output.
+	flusher console.Flusher
+
+	// runeMapper is set if the attached console can render non-ASCII
+	// characters.
+	runeMapper console.RuneMapper
+
 	// Terminal dimensions
 	termWidth      uint32
 	termHeight     uint32
@@ -39,6 +79,31 @@ type VT struct {
 	viewportY        uint32
 	dataOffset       uint
 	state            State
+
+	// viewOffset is the number of lines that the displayed window is
+	// moved back from the viewport when paging through the scrollback.
+	viewOffset uint32
+
+	// cursorDrawer is set if the attached console can render a cursor.
+	// While cursorShown is set, the cell under the cursor at position
+	// (shownX, shownY) displays the cursor instead of its contents.
+	cursorDrawer   console.CursorDrawer
+	cursorShown    bool
+	shownX, shownY uint32
+
+	// hwCursor is set if the attached console provides a hardware cursor.
+	hwCursor console.HardwareCursor
+
+	// busy is set while the terminal contents are being updated so that
+	// cursor blink requests from interrupt context do not interfere with
+	// a write in progress.
+	busy bool
+
+	// ansi tracks the state of the escape sequence parser.
+	ansi ansiParser
+
+	// utf8 tracks partially received multi-byte characters.
+	utf8 utf8Decoder
 }
 
 // NewVT creates a new virtual terminal device. The tabWidth parameter controls
@@ -61,12 +126,19 @@ func (t *VT) AttachTo(cons console.Device) {
 	}
 
 	t.cons = cons
+	t.flusher, _ = cons.(console.Flusher)
+	t.runeMapper, _ = cons.(console.RuneMapper)
+	t.cursorDrawer, _ = cons.(console.CursorDrawer)
+	t.hwCursor, _ = cons.(console.HardwareCursor)
+	t.cursorShown = false
 	t.viewportWidth, t.viewportHeight = cons.Dimensions(console.Characters)
-	t.viewportY = 0
+	t.viewportY, t.viewOffset = 0, 0
 	t.defaultFg, t.defaultBg = cons.DefaultColors()
 	t.curFg, t.curBg = t.defaultFg, t.defaultBg
 	t.termWidth, t.termHeight = t.viewportWidth, t.viewportHeight+t.scrollback
 	t.cursorX, t.cursorY = 1, 1
+	t.ansi = ansiParser{}
+	t.utf8 = utf8Decoder{}
 
 	// Allocate space for the contents and fill it with empty characters
 	// using the default fg/bg colors for the attached console.
@@ -78,6 +150,76 @@ func (t *VT) AttachTo(cons console.Device) {
 	}
 }
 
+// Resize adapts the terminal to the current dimensions of the attached console
+// and implements Resizer. The most recent lines of output, up to and including
+// the line containing the cursor, are preserved; each line is truncated or
+// padded to the new console width. If the terminal is active, the console is
+// redrawn.
+func (t *VT) Resize() {
+	if t.cons == nil {
+		return
+	}
+
+	newWidth, newHeight := t.cons.Dimensions(console.Characters)
+	if newWidth == 0 || newHeight == 0 {
+		return
+	}
+
+	// The console contents have already been replaced so the cursor must
+	// not be erased using the old coordinates.
+	t.cursorShown = false
+	if t.beginUpdate() {
+		defer t.endUpdate()
+	}
+
+	var (
+		newTermHeight = newHeight + t.scrollback
+		newData       = make([]uint8, newWidth*newTermHeight*3)
+		usedLines     = t.viewportY + t.cursorY
+		keptLines     = usedLines
+		rowLen        = t.viewportWidth * 3
+	)
+
+	if keptLines > newTermHeight {
+		keptLines = newTermHeight
+	}
+
+	if newWidth < t.viewportWidth {
+		rowLen = newWidth * 3
+	}
+
+	for i := 0; i < len(newData); i += 3 {
+		newData[i] = ' '
+		newData[i+1] = t.defaultFg
+		newData[i+2] = t.defaultBg
+	}
+
+	for row, srcRow := uint32(0), usedLines-keptLines; row < keptLines; row, srcRow = row+1, srcRow+1 {
+		srcOffset := srcRow * t.viewportWidth * 3
+		copy(newData[row*newWidth*3:row*newWidth*3+rowLen], t.data[srcOffset:srcOffset+rowLen])
+	}
+
+	t.data = newData
+	t.viewportWidth, t.viewportHeight = newWidth, newHeight
+	t.termWidth, t.termHeight = newWidth, newTermHeight
+	t.viewOffset = 0
+
+	if keptLines > newHeight {
+		t.viewportY, t.cursorY = keptLines-newHeight, newHeight
+	} else {
+		t.viewportY, t.cursorY = 0, keptLines
+	}
+
+	if t.cursorX > newWidth {
+		t.cursorX = newWidth
+	}
+	t.updateDataOffset()
+
+	if t.state == StateActive {
+		t.redraw()
+	}
+}
+
 // State returns the TTY's state.
 func (t *VT) State() State {
 	return t.state
@@ -91,17 +233,72 @@ func (t *VT) SetState(newState State) {
 
 	t.state = newState
 
-	// If the terminal became active, update the console with its contents
+	// If the terminal became active, update the console with its contents.
+	// Otherwise, the console is now owned by another terminal which will
+	// overwrite our cursor.
+	t.cursorShown = false
 	if t.state == StateActive && t.cons != nil {
-		for y := uint32(1); y <= t.viewportHeight; y++ {
-			offset := (y - 1 + t.viewportY) * (t.viewportWidth * 3)
-			for x := uint32(1); x <= t.viewportWidth; x, offset = x+1, offset+3 {
-				t.cons.Write(t.data[offset], t.data[offset+1], t.data[offset+2], x, y)
-			}
+		t.redraw()
+		t.showCursor()
+		t.flush()
+	}
+}
+
+// redraw copies the contents of the displayed terminal window to the console.
+// As redraw overwrites all console cells, it also erases the cursor.
+func (t *VT) redraw() {
+	t.cursorShown = false
+	for y := uint32(1); y <= t.viewportHeight; y++ {
+		offset := (y - 1 + t.viewportY - t.viewOffset) * (t.viewportWidth * 3)
+		for x := uint32(1); x <= t.viewportWidth; x, offset = x+1, offset+3 {
+			t.cons.Write(t.data[offset], t.data[offset+1], t.data[offset+2], x, y)
 		}
 	}
 }
 
+// PageUp moves the displayed window half a screen towards older output that
+// has been scrolled off the screen.
+func (t *VT) PageUp() {
+	t.ScrollView(-int(t.viewportHeight / 2))
+}
+
+// PageDown moves the displayed window half a screen towards the most recent
+// output.
+func (t *VT) PageDown() {
+	t.ScrollView(int(t.viewportHeight / 2))
+}
+
+// ScrollView moves the displayed window by the specified number of lines.
+// Negative values move the window towards older output whereas positive
+// values move it towards the most recent output. The window is clipped to the
+// available scrollback. Writing to the terminal moves the window back to the
+// most recent output.
+func (t *VT) ScrollView(lines int) {
+	if t.cons == nil {
+		return
+	}
+
+	newOffset := int(t.viewOffset) - lines
+	if newOffset < 0 {
+		newOffset = 0
+	} else if newOffset > int(t.viewportY) {
+		newOffset = int(t.viewportY)
+	}
+
+	if uint32(newOffset) == t.viewOffset {
+		return
+	}
+
+	if t.beginUpdate() {
+		defer t.endUpdate()
+	}
+
+	t.viewOffset = uint32(newOffset)
+	if t.state == StateActive {
+		t.redraw()
+	}
+}
+
 // CursorPosition returns the current cursor position.
 func (t *VT) CursorPosition() (uint32, uint32) {
 	return t.cursorX, t.cursorY
@@ -125,12 +322,21 @@ func (t *VT) SetCursorPosition(x, y uint32) {
 		y = t.viewportHeight
 	}
 
+	if t.beginUpdate() {
+		defer t.endUpdate()
+	}
+
 	t.cursorX, t.cursorY = x, y
 	t.updateDataOffset()
 }
 
-// Write implements io.Writer.
+// Write implements io.Writer. If the attached console buffers its output,
+// Write flushes it after processing data.
 func (t *VT) Write(data []byte) (int, error) {
+	if t.beginUpdate() {
+		defer t.endUpdate()
+	}
+
 	for count, b := range data {
 		err := t.WriteByte(b)
 		if err != nil {
@@ -141,13 +347,108 @@ func (t *VT) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
+// beginUpdate marks the terminal as busy and erases the cursor before the
+// terminal contents are modified. It returns false if an update is already in
+// progress; in that case the caller must not invoke endUpdate.
+func (t *VT) beginUpdate() bool {
+	if t.busy {
+		return false
+	}
+
+	t.busy = true
+	t.hideCursor()
+	return true
+}
+
+// endUpdate draws the cursor at its new position, flushes the console and
+// clears the busy flag.
+func (t *VT) endUpdate() {
+	t.showCursor()
+	t.flush()
+	t.busy = false
+}
+
+// BlinkCursor toggles the visibility of the cursor and implements
+// CursorBlinker. It is meant to be invoked periodically from a timer callback
+// and is a no-op if the terminal is inactive, the attached console cannot draw
+// a cursor or if a terminal update is in progress.
+func (t *VT) BlinkCursor() {
+	if t.busy || t.cursorDrawer == nil || t.state != StateActive {
+		return
+	}
+
+	if t.cursorShown {
+		t.hideCursor()
+	} else {
+		t.showCursor()
+	}
+	t.flush()
+}
+
+// showCursor draws the cursor at the current cursor position. The cursor is
+// only drawn while the most recent output is displayed.
+func (t *VT) showCursor() {
+	if t.hwCursor != nil && t.state == StateActive {
+		t.hwCursor.SetCursor(t.cursorX, t.cursorY, t.viewOffset == 0)
+	}
+
+	if t.cursorShown || t.cursorDrawer == nil || t.state != StateActive || t.viewOffset != 0 {
+		return
+	}
+
+	t.cursorDrawer.DrawCursor(t.cursorX, t.cursorY, t.curFg)
+	t.cursorShown, t.shownX, t.shownY = true, t.cursorX, t.cursorY
+}
+
+// hideCursor erases the cursor by writing back the contents of the cell that
+// it was drawn over.
+func (t *VT) hideCursor() {
+	if !t.cursorShown {
+		return
+	}
+
+	t.cursorShown = false
+	if t.state != StateActive {
+		return
+	}
+
+	offset := (t.viewportY+t.shownY-1)*(t.viewportWidth*3) + (t.shownX-1)*3
+	t.cons.Write(t.data[offset], t.data[offset+1], t.data[offset+2], t.shownX, t.shownY)
+}
+
+// flush copies any buffered output of the attached console to the display if
+// the terminal is active.
+func (t *VT) flush() {
+	if t.flusher != nil && t.state == StateActive {
+		t.flusher.Flush()
+	}
+}
+
 // WriteByte implements io.ByteWriter.
 func (t *VT) WriteByte(b byte) error {
 	if t.cons == nil {
 		return io.ErrClosedPipe
 	}
 
+	// Writes always display the most recent output
+	if t.viewOffset != 0 {
+		t.ScrollView(int(t.viewOffset))
+	}
+
+	if b >= 0x80 {
+		t.writeUTF8(b)
+		return nil
+	}
+	t.abortUTF8()
+
+	if t.ansi.state != escStateNone {
+		t.handleEscape(b)
+		return nil
+	}
+
 	switch b {
+	case escChar:
+		t.ansi.state = escStateEsc
 	case '\r':
 		t.cr()
 	case '\n':
@@ -261,11 +562,20 @@ func (t *VT) DriverVersion() (uint16, uint16, uint16) {
 func (t *VT) DriverInit(_ io.Writer) *kernel.Error { return nil }
 
 func probeForVT() device.Driver {
-	return NewVT(DefaultTabWidth, DefaultScrollback)
+	scrollback := uint64(DefaultScrollback)
+	if lines, ok := cmdlineUintFn(scrollbackArg); ok {
+		scrollback = lines
+		if scrollback > maxScrollback {
+			scrollback = maxScrollback
+		}
+	}
+
+	return NewVT(DefaultTabWidth, uint32(scrollback))
 }
 
 func init() {
 	device.RegisterDriver(&device.DriverInfo{
+		Name:  "vt",
 		Order: device.DetectOrderEarly,
 		Probe: probeForVT,
 	})
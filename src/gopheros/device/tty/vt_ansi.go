@@ -0,0 +1,253 @@
+package tty
+
+// escState tracks the progress of the ANSI escape sequence parser.
+type escState uint8
+
+const (
+	escStateNone escState = iota
+	// escStateEsc indicates that an ESC character was received.
+	escStateEsc
+	// escStateIntermediate indicates that an ESC character followed by
+	// one or more intermediate bytes (e.g. ESC ( B) was received.
+	escStateIntermediate
+	// escStateCSI indicates that a control sequence introducer (ESC [)
+	// was received and the parser is collecting parameters.
+	escStateCSI
+)
+
+const (
+	escChar = 0x1b
+
+	// maxEscParams defines the maximum number of numeric parameters that
+	// are tracked for a control sequence. Any extra parameters are ignored.
+	maxEscParams = 8
+
+	// maxEscParamValue caps numeric parameter values so they do not
+	// overflow while being parsed.
+	maxEscParamValue = 9999
+
+	// brightColorOffset is added to a palette index to select the bright
+	// variant of one of the 8 standard colors.
+	brightColorOffset = 8
+)
+
+// ansiColorToPalette maps the standard ANSI color numbers (black, red, green,
+// yellow, blue, magenta, cyan, white) to the indices of the equivalent colors
+// in the EGA-compatible palette exposed by consoles.
+var ansiColorToPalette = [8]uint8{0, 4, 2, 6, 1, 5, 3, 7}
+
+// ansiParser holds the state of the ANSI escape sequence parser.
+type ansiParser struct {
+	state      escState
+	params     [maxEscParams]uint32
+	paramCount int
+
+	// Saved cursor position (ESC [ s and ESC [ u).
+	savedX, savedY uint32
+
+	// bold is set while the bold SGR attribute is active. Bold text is
+	// rendered using the bright variant of the foreground color.
+	bold bool
+}
+
+// reset clears the parser parameters and returns it to its initial state.
+func (p *ansiParser) reset() {
+	p.state = escStateNone
+	p.paramCount = 0
+	for i := range p.params {
+		p.params[i] = 0
+	}
+}
+
+// param returns the i-th sequence parameter or def if the parameter was not
+// specified or is zero.
+func (p *ansiParser) param(i int, def uint32) uint32 {
+	if i >= p.paramCount || p.params[i] == 0 {
+		return def
+	}
+
+	return p.params[i]
+}
+
+// handleEscape feeds a character to the ANSI escape sequence parser and
+// applies the sequence once it is complete. Unsupported sequences are
+// silently discarded.
+func (t *VT) handleEscape(b byte) {
+	p := &t.ansi
+	switch p.state {
+	case escStateEsc:
+		switch {
+		case b == '[':
+			p.state = escStateCSI
+			p.paramCount = 1
+		case b == 'c':
+			// Full reset (RIS)
+			t.ansi.bold = false
+			t.curFg, t.curBg = t.defaultFg, t.defaultBg
+			t.eraseDisplay(2)
+			t.SetCursorPosition(1, 1)
+			p.reset()
+		case b >= 0x20 && b <= 0x2f:
+			p.state = escStateIntermediate
+		default:
+			p.reset()
+		}
+	case escStateIntermediate:
+		// Sequences such as character set selection are not supported;
+		// discard everything up to the final byte.
+		if b < 0x20 || b > 0x2f {
+			p.reset()
+		}
+	case escStateCSI:
+		switch {
+		case b >= '0' && b <= '9':
+			if v := &p.params[p.paramCount-1]; *v < maxEscParamValue {
+				*v = *v*10 + uint32(b-'0')
+			}
+		case b == ';':
+			if p.paramCount < maxEscParams {
+				p.paramCount++
+			}
+		case b == '?':
+			// Private mode prefix; the parameters are parsed but
+			// the sequence is otherwise treated as a regular one.
+		case b >= 0x40 && b <= 0x7e:
+			t.applyCSI(b)
+			p.reset()
+		default:
+			// Control characters and intermediate bytes are not
+			// supported; abort the sequence.
+			p.reset()
+		}
+	}
+}
+
+// applyCSI executes the control sequence identified by the final byte cmd
+// using the parameters collected by the parser.
+func (t *VT) applyCSI(cmd byte) {
+	p := &t.ansi
+	switch cmd {
+	case 'A':
+		t.SetCursorPosition(t.cursorX, sub1(t.cursorY, p.param(0, 1)))
+	case 'B':
+		t.SetCursorPosition(t.cursorX, t.cursorY+p.param(0, 1))
+	case 'C':
+		t.SetCursorPosition(t.cursorX+p.param(0, 1), t.cursorY)
+	case 'D':
+		t.SetCursorPosition(sub1(t.cursorX, p.param(0, 1)), t.cursorY)
+	case 'G':
+		t.SetCursorPosition(p.param(0, 1), t.cursorY)
+	case 'H', 'f':
+		t.SetCursorPosition(p.param(1, 1), p.param(0, 1))
+	case 'J':
+		t.eraseDisplay(p.params[0])
+	case 'K':
+		t.eraseLine(p.params[0])
+	case 'm':
+		for i := 0; i < p.paramCount; i++ {
+			t.applySGR(p.params[i])
+		}
+	case 's':
+		p.savedX, p.savedY = t.cursorX, t.cursorY
+	case 'u':
+		if p.savedX != 0 {
+			t.SetCursorPosition(p.savedX, p.savedY)
+		}
+	}
+}
+
+// applySGR applies a single "select graphic rendition" attribute.
+func (t *VT) applySGR(attr uint32) {
+	switch {
+	case attr == 0:
+		t.ansi.bold = false
+		t.curFg, t.curBg = t.defaultFg, t.defaultBg
+	case attr == 1:
+		t.ansi.bold = true
+		if t.curFg < brightColorOffset {
+			t.curFg += brightColorOffset
+		}
+	case attr == 22:
+		t.ansi.bold = false
+		if t.curFg >= brightColorOffset && t.curFg < 2*brightColorOffset {
+			t.curFg -= brightColorOffset
+		}
+	case attr == 7:
+		t.curFg, t.curBg = t.curBg, t.curFg
+	case attr >= 30 && attr <= 37:
+		t.curFg = ansiColorToPalette[attr-30]
+		if t.ansi.bold {
+			t.curFg += brightColorOffset
+		}
+	case attr == 39:
+		t.curFg = t.defaultFg
+	case attr >= 40 && attr <= 47:
+		t.curBg = ansiColorToPalette[attr-40]
+	case attr == 49:
+		t.curBg = t.defaultBg
+	case attr >= 90 && attr <= 97:
+		t.curFg = ansiColorToPalette[attr-90] + brightColorOffset
+	case attr >= 100 && attr <= 107:
+		t.curBg = ansiColorToPalette[attr-100] + brightColorOffset
+	}
+}
+
+// eraseDisplay clears part of the viewport: from the cursor to the end of the
+// viewport (mode 0), from the start of the viewport to the cursor (mode 1) or
+// the entire viewport (mode 2).
+func (t *VT) eraseDisplay(mode uint32) {
+	switch mode {
+	case 0:
+		t.clearLine(t.cursorY, t.cursorX, t.viewportWidth)
+		for y := t.cursorY + 1; y <= t.viewportHeight; y++ {
+			t.clearLine(y, 1, t.viewportWidth)
+		}
+	case 1:
+		for y := uint32(1); y < t.cursorY; y++ {
+			t.clearLine(y, 1, t.viewportWidth)
+		}
+		t.clearLine(t.cursorY, 1, t.cursorX)
+	case 2:
+		for y := uint32(1); y <= t.viewportHeight; y++ {
+			t.clearLine(y, 1, t.viewportWidth)
+		}
+	}
+}
+
+// eraseLine clears part of the cursor line: from the cursor to the end of the
+// line (mode 0), from the start of the line to the cursor (mode 1) or the
+// entire line (mode 2).
+func (t *VT) eraseLine(mode uint32) {
+	switch mode {
+	case 0:
+		t.clearLine(t.cursorY, t.cursorX, t.viewportWidth)
+	case 1:
+		t.clearLine(t.cursorY, 1, t.cursorX)
+	case 2:
+		t.clearLine(t.cursorY, 1, t.viewportWidth)
+	}
+}
+
+// clearLine replaces the characters in the [fromX, toX] column range of the
+// viewport line y with blanks using the current background color.
+func (t *VT) clearLine(y, fromX, toX uint32) {
+	offset := (t.viewportY+(y-1))*(t.viewportWidth*3) + (fromX-1)*3
+	for x := fromX; x <= toX; x, offset = x+1, offset+3 {
+		t.data[offset] = ' '
+		t.data[offset+1] = t.curFg
+		t.data[offset+2] = t.curBg
+	}
+
+	if t.state == StateActive {
+		t.cons.Fill(fromX, y, toX-fromX+1, 1, t.curFg, t.curBg)
+	}
+}
+
+// sub1 returns a-b clamped to a minimum value of 1.
+func sub1(a, b uint32) uint32 {
+	if b >= a {
+		return 1
+	}
+
+	return a - b
+}
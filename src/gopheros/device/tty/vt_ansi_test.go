@@ -0,0 +1,141 @@
+package tty
+
+import "testing"
+
+func TestVtANSICursorMovement(t *testing.T) {
+	cons := newMockConsole(80, 25)
+	term := NewVT(4, 0)
+	term.AttachTo(cons)
+
+	specs := []struct {
+		input      string
+		expX, expY uint32
+	}{
+		{"\x1b[10;20H", 20, 10},
+		{"\x1b[H", 1, 1},
+		{"\x1b[5;5f", 5, 5},
+		{"\x1b[2A", 5, 3},
+		{"\x1b[A", 5, 2},
+		{"\x1b[10A", 5, 1},
+		{"\x1b[3B", 5, 4},
+		{"\x1b[100B", 5, 25},
+		{"\x1b[4C", 9, 25},
+		{"\x1b[200C", 80, 25},
+		{"\x1b[D", 79, 25},
+		{"\x1b[200D", 1, 25},
+		{"\x1b[12G", 12, 25},
+		{"\x1b[3;4H\x1b[s\x1b[H\x1b[u", 4, 3},
+		{"\x1b[999;999H", 80, 25},
+		// Unsupported sequences are ignored
+		{"\x1b[1;2;3;4;5;6;7;8;9;10z\x1b(B", 80, 25},
+	}
+
+	for specIndex, spec := range specs {
+		term.Write([]byte(spec.input))
+		if x, y := term.CursorPosition(); x != spec.expX || y != spec.expY {
+			t.Errorf("[spec %d] expected cursor position to be (%d, %d); got (%d, %d)", specIndex, spec.expX, spec.expY, x, y)
+		}
+
+		if term.ansi.state != escStateNone {
+			t.Errorf("[spec %d] expected parser to return to its initial state", specIndex)
+		}
+	}
+
+	// Sequences with no effect should not produce any output
+	if cons.bytesWritten != 0 {
+		t.Errorf("expected no characters to be written to the console; got %d", cons.bytesWritten)
+	}
+}
+
+func TestVtANSIGraphicRendition(t *testing.T) {
+	term := NewVT(4, 0)
+	term.AttachTo(newMockConsole(80, 25))
+
+	specs := []struct {
+		input        string
+		expFg, expBg uint8
+	}{
+		{"\x1b[31m", 4, 0},
+		{"\x1b[44m", 4, 1},
+		{"\x1b[1m", 12, 1},
+		{"\x1b[32m", 10, 1},
+		{"\x1b[22m", 2, 1},
+		{"\x1b[39;49m", 7, 0},
+		{"\x1b[93;106m", 14, 11},
+		{"\x1b[7m", 11, 14},
+		{"\x1b[m", 7, 0},
+		{"\x1b[1;33;41m", 14, 4},
+		{"\x1b[0m", 7, 0},
+	}
+
+	for specIndex, spec := range specs {
+		term.Write([]byte(spec.input))
+		if term.curFg != spec.expFg || term.curBg != spec.expBg {
+			t.Errorf("[spec %d] expected fg/bg to be %d/%d; got %d/%d", specIndex, spec.expFg, spec.expBg, term.curFg, term.curBg)
+		}
+	}
+
+	// Characters written after an SGR sequence use the selected colors
+	cons := newMockConsole(80, 25)
+	term.AttachTo(cons)
+	term.SetState(StateActive)
+	term.Write([]byte("\x1b[31;42mA\x1b[0mB"))
+	if cons.chars[0] != 'A' || cons.fgAttrs[0] != 4 || cons.bgAttrs[0] != 2 {
+		t.Errorf("expected 'A' to be written with fg/bg 4/2; got %q with %d/%d", cons.chars[0], cons.fgAttrs[0], cons.bgAttrs[0])
+	}
+
+	if cons.chars[1] != 'B' || cons.fgAttrs[1] != 7 || cons.bgAttrs[1] != 0 {
+		t.Errorf("expected 'B' to be written with default colors; got %q with %d/%d", cons.chars[1], cons.fgAttrs[1], cons.bgAttrs[1])
+	}
+}
+
+func TestVtANSIErase(t *testing.T) {
+	specs := []struct {
+		input string
+		// expected contents of the 4x3 viewport after the sequence
+		// gets applied to a terminal filled with 'x' characters with
+		// the cursor at (2,2).
+		exp string
+	}{
+		{"\x1b[K", "xxxx" + "x   " + "xxxx"},
+		{"\x1b[0K", "xxxx" + "x   " + "xxxx"},
+		{"\x1b[1K", "xxxx" + "  xx" + "xxxx"},
+		{"\x1b[2K", "xxxx" + "    " + "xxxx"},
+		{"\x1b[J", "xxxx" + "x   " + "    "},
+		{"\x1b[1J", "    " + "  xx" + "xxxx"},
+		{"\x1b[2J", "    " + "    " + "    "},
+		{"\x1bc", "    " + "    " + "    "},
+	}
+
+	for specIndex, spec := range specs {
+		cons := newMockConsole(4, 3)
+		term := NewVT(4, 0)
+		term.AttachTo(cons)
+		term.SetState(StateActive)
+		for y := uint32(1); y <= 3; y++ {
+			term.SetCursorPosition(1, y)
+			term.Write([]byte("xxx"))
+			term.doWrite('x', false)
+		}
+		term.SetCursorPosition(2, 2)
+		term.Write([]byte("\x1b[44m" + spec.input))
+
+		if got := string(cons.chars); got != spec.exp {
+			t.Errorf("[spec %d] expected console contents to be %q; got %q", specIndex, spec.exp, got)
+		}
+
+		var termContents []byte
+		for i := 0; i < len(term.data); i += 3 {
+			termContents = append(termContents, term.data[i])
+		}
+		if got := string(termContents); got != spec.exp {
+			t.Errorf("[spec %d] expected terminal contents to be %q; got %q", specIndex, spec.exp, got)
+		}
+
+		for i, ch := range spec.exp {
+			if ch == ' ' && spec.input != "\x1bc" && cons.bgAttrs[i] != 1 {
+				t.Errorf("[spec %d] expected cleared char at index %d to use the current bg color; got %d", specIndex, i, cons.bgAttrs[i])
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package tty
 import (
 	"gopheros/device"
 	"gopheros/device/video/console"
+	"gopheros/kernel/cmdline"
 	"image/color"
 	"io"
 	"testing"
@@ -321,6 +322,221 @@ func TestVtSetState(t *testing.T) {
 	}
 }
 
+func TestVtFlush(t *testing.T) {
+	cons := &mockFlushingConsole{mockConsole: newMockConsole(80, 25)}
+	term := NewVT(4, 0)
+	term.AttachTo(cons)
+
+	// Inactive terminals do not flush the console
+	term.Write([]byte("hello"))
+	if cons.flushCount != 0 {
+		t.Fatalf("expected inactive terminal not to flush the console; got %d flushes", cons.flushCount)
+	}
+
+	term.SetState(StateActive)
+	if cons.flushCount != 1 {
+		t.Fatalf("expected terminal activation to flush the console once; got %d flushes", cons.flushCount)
+	}
+
+	term.Write([]byte("hello\nworld"))
+	if cons.flushCount != 2 {
+		t.Fatalf("expected Write to flush the console once; got %d flushes", cons.flushCount)
+	}
+
+	term.AttachTo(newMockConsole(80, 25))
+	if term.flusher != nil {
+		t.Fatal("expected flusher to be cleared when attaching to a non-buffered console")
+	}
+}
+
+func TestVtCursor(t *testing.T) {
+	cons := &mockCursorConsole{
+		mockFlushingConsole: &mockFlushingConsole{mockConsole: newMockConsole(80, 25)},
+	}
+	term := NewVT(4, 10)
+	term.AttachTo(cons)
+
+	charAt := func(x, y uint32) uint8 {
+		return cons.chars[(y-1)*cons.width+(x-1)]
+	}
+
+	// Inactive terminals do not draw a cursor
+	term.Write([]byte("hi"))
+	term.BlinkCursor()
+	if cons.drawCount != 0 {
+		t.Fatalf("expected inactive terminal not to draw a cursor; got %d draws", cons.drawCount)
+	}
+
+	term.SetState(StateActive)
+	if !term.cursorShown || charAt(3, 1) != mockCursorChar {
+		t.Fatal("expected terminal activation to draw the cursor at (3, 1)")
+	}
+
+	term.Write([]byte("\x1b[31ma"))
+	if exp := "hia"; string(cons.chars[:3]) != exp {
+		t.Fatalf("expected Write to erase the cursor; got %q", cons.chars[:3])
+	}
+	if charAt(4, 1) != mockCursorChar || cons.cursorFg != 4 {
+		t.Fatalf("expected cursor to be drawn at (4, 1) using the current fg color; got fg %d", cons.cursorFg)
+	}
+
+	// Blinking toggles the cursor and flushes the console
+	flushCount := cons.flushCount
+	for specIndex, expShown := range []bool{false, true, false} {
+		term.BlinkCursor()
+		if term.cursorShown != expShown || (charAt(4, 1) == mockCursorChar) != expShown {
+			t.Errorf("[spec %d] expected cursor visibility to be %t", specIndex, expShown)
+		}
+
+		if exp := flushCount + specIndex + 1; cons.flushCount != exp {
+			t.Errorf("[spec %d] expected %d flushes; got %d", specIndex, exp, cons.flushCount)
+		}
+	}
+
+	// Blink requests while the terminal is being updated are ignored
+	term.busy = true
+	term.BlinkCursor()
+	term.busy = false
+	if term.cursorShown {
+		t.Fatal("expected BlinkCursor to be a no-op while the terminal is busy")
+	}
+
+	term.BlinkCursor()
+	term.SetCursorPosition(10, 5)
+	if charAt(4, 1) != ' ' || charAt(10, 5) != mockCursorChar {
+		t.Fatal("expected SetCursorPosition to move the cursor to (10, 5)")
+	}
+
+	// The cursor is hidden while paging through the scrollback
+	term.Write([]byte("\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n"))
+	term.PageUp()
+	term.BlinkCursor()
+	if term.cursorShown {
+		t.Fatal("expected cursor to be hidden while the view is scrolled back")
+	}
+
+	term.PageDown()
+	if !term.cursorShown || charAt(1, 25) != mockCursorChar {
+		t.Fatal("expected cursor to be drawn at (1, 25) when the view returns to the most recent output")
+	}
+
+	term.SetState(StateInactive)
+	if term.cursorShown {
+		t.Fatal("expected cursor to be hidden when the terminal becomes inactive")
+	}
+
+	term.AttachTo(newMockConsole(80, 25))
+	if term.cursorDrawer != nil {
+		t.Fatal("expected cursorDrawer to be cleared when attaching to a console without cursor support")
+	}
+}
+
+func TestVtHardwareCursor(t *testing.T) {
+	cons := &mockHardwareCursorConsole{mockConsole: newMockConsole(80, 25)}
+	term := NewVT(4, 10)
+	term.AttachTo(cons)
+
+	// Inactive terminals do not move the cursor
+	term.Write([]byte("hi"))
+	if cons.updates != 0 {
+		t.Fatalf("expected inactive terminal not to move the cursor; got %d updates", cons.updates)
+	}
+
+	specs := []struct {
+		action     func()
+		expX, expY uint32
+		expVisible bool
+	}{
+		{func() { term.SetState(StateActive) }, 3, 1, true},
+		{func() { term.Write([]byte("a\nb")) }, 2, 2, true},
+		{func() { term.SetCursorPosition(10, 5) }, 10, 5, true},
+	}
+
+	for specIndex, spec := range specs {
+		spec.action()
+		if cons.x != spec.expX || cons.y != spec.expY || cons.visible != spec.expVisible {
+			t.Errorf("[spec %d] expected cursor at (%d, %d) with visibility %t; got (%d, %d) with visibility %t",
+				specIndex, spec.expX, spec.expY, spec.expVisible, cons.x, cons.y, cons.visible)
+		}
+	}
+
+	// The cursor is hidden while paging through the scrollback
+	term.Write([]byte("\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n\n"))
+	term.PageUp()
+	if cons.visible {
+		t.Fatal("expected cursor to be hidden while the view is scrolled back")
+	}
+
+	term.PageDown()
+	if !cons.visible || cons.x != 1 || cons.y != 25 {
+		t.Fatalf("expected cursor to be shown at (1, 25) when the view returns to the most recent output; got (%d, %d)", cons.x, cons.y)
+	}
+
+	term.AttachTo(newMockConsole(80, 25))
+	if term.hwCursor != nil {
+		t.Fatal("expected hwCursor to be cleared when attaching to a console without a hardware cursor")
+	}
+}
+
+func TestVtResize(t *testing.T) {
+	// Resizing a detached terminal should be a no-op
+	NewVT(4, 2).Resize()
+
+	cons := newMockConsole(6, 3)
+	term := NewVT(4, 2)
+	term.AttachTo(cons)
+	term.SetState(StateActive)
+	term.Write([]byte("ab\ncd\nef\ngh"))
+
+	specs := []struct {
+		width, height    uint32
+		expChars         string
+		expX, expY       uint32
+		expTermHeight    uint32
+		expViewportY     uint32
+		expDataOffsetRow uint32
+	}{
+		{4, 2, "ef  gh  ", 3, 2, 4, 2, 3},
+		{8, 5, "ab      cd      ef      gh              ", 3, 4, 7, 0, 3},
+		{1, 2, "eg", 1, 2, 4, 2, 3},
+	}
+
+	for specIndex, spec := range specs {
+		*cons = *newMockConsole(spec.width, spec.height)
+		term.Resize()
+
+		if got := string(cons.chars); got != spec.expChars {
+			t.Errorf("[spec %d] expected console contents to be %q; got %q", specIndex, spec.expChars, got)
+		}
+
+		if x, y := term.CursorPosition(); x != spec.expX || y != spec.expY {
+			t.Errorf("[spec %d] expected cursor position to be (%d, %d); got (%d, %d)", specIndex, spec.expX, spec.expY, x, y)
+		}
+
+		if term.termWidth != spec.width || term.termHeight != spec.expTermHeight || term.viewportY != spec.expViewportY {
+			t.Errorf("[spec %d] expected terminal dimensions %dx%d with viewportY %d; got %dx%d with viewportY %d",
+				specIndex, spec.width, spec.expTermHeight, spec.expViewportY, term.termWidth, term.termHeight, term.viewportY)
+		}
+
+		if exp := uint((spec.expDataOffsetRow*spec.width + spec.expX - 1) * 3); term.dataOffset != exp {
+			t.Errorf("[spec %d] expected data offset to be %d; got %d", specIndex, exp, term.dataOffset)
+		}
+	}
+
+	// Inactive terminals update their contents without writing to the console
+	term.SetState(StateInactive)
+	*cons = *newMockConsole(4, 2)
+	term.Resize()
+	if cons.bytesWritten != 0 {
+		t.Fatalf("expected inactive terminal not to write to the console; got %d writes", cons.bytesWritten)
+	}
+
+	term.SetState(StateActive)
+	if exp, got := "e   g   ", string(cons.chars); got != exp {
+		t.Fatalf("expected console contents to be %q after activating the terminal; got %q", exp, got)
+	}
+}
+
 func TestVTDriverInterface(t *testing.T) {
 	var dev device.Driver = NewVT(0, 0)
 
@@ -338,8 +554,103 @@ func TestVTDriverInterface(t *testing.T) {
 }
 
 func TestVTProbe(t *testing.T) {
-	if drv := probeForVT(); drv == nil {
-		t.Fatal("expected probeForVT to return a driver")
+	defer func() {
+		cmdlineUintFn = cmdline.Uint
+	}()
+
+	specs := []struct {
+		arg           uint64
+		argFound      bool
+		expScrollback uint32
+	}{
+		{0, false, DefaultScrollback},
+		{1000, true, 1000},
+		{0, true, 0},
+		{1 << 40, true, maxScrollback},
+	}
+
+	for specIndex, spec := range specs {
+		cmdlineUintFn = func(name string) (uint64, bool) {
+			if name != scrollbackArg {
+				t.Errorf("[spec %d] unexpected lookup for argument %q", specIndex, name)
+			}
+			return spec.arg, spec.argFound
+		}
+
+		drv := probeForVT()
+		if drv == nil {
+			t.Fatalf("[spec %d] expected probeForVT to return a driver", specIndex)
+		}
+
+		if got := drv.(*VT).scrollback; got != spec.expScrollback {
+			t.Errorf("[spec %d] expected scrollback to be %d; got %d", specIndex, spec.expScrollback, got)
+		}
+	}
+}
+
+func TestVtScrollView(t *testing.T) {
+	cons := newMockConsole(10, 4)
+	term := NewVT(4, 10)
+
+	// Calls on a detached terminal are ignored
+	term.PageUp()
+
+	term.AttachTo(cons)
+	term.SetState(StateActive)
+
+	// Write 10 lines so that lines "0" to "6" scroll off the screen
+	for i := 0; i < 10; i++ {
+		if i != 0 {
+			term.WriteByte('\n')
+		}
+		term.WriteByte(byte('0' + i))
+	}
+
+	firstCol := func() string {
+		var col []byte
+		for y := uint32(0); y < cons.height; y++ {
+			col = append(col, cons.chars[y*cons.width])
+		}
+		return string(col)
+	}
+
+	specs := []struct {
+		scroll        func()
+		expViewOffset uint32
+		expDisplay    string
+	}{
+		{term.PageUp, 2, "4567"},
+		{term.PageUp, 4, "2345"},
+		{func() { term.ScrollView(-100) }, 6, "0123"},
+		{term.PageDown, 4, "2345"},
+		{func() { term.ScrollView(100) }, 0, "6789"},
+		{term.PageDown, 0, "6789"},
+	}
+
+	for specIndex, spec := range specs {
+		spec.scroll()
+		if term.viewOffset != spec.expViewOffset {
+			t.Errorf("[spec %d] expected view offset to be %d; got %d", specIndex, spec.expViewOffset, term.viewOffset)
+		}
+
+		if got := firstCol(); got != spec.expDisplay {
+			t.Errorf("[spec %d] expected console to display lines %q; got %q", specIndex, spec.expDisplay, got)
+		}
+	}
+
+	// Writing to the terminal snaps the view back to the most recent output
+	term.ScrollView(-3)
+	term.WriteByte('!')
+	if term.viewOffset != 0 || firstCol() != "6789" || cons.chars[3*cons.width+1] != '!' {
+		t.Errorf("expected write to restore the view to the most recent output; got %q", firstCol())
+	}
+
+	// Inactive terminals update the view offset without touching the console
+	term.SetState(StateInactive)
+	written := cons.bytesWritten
+	term.PageUp()
+	if term.viewOffset != 2 || cons.bytesWritten != written {
+		t.Error("expected inactive terminal to scroll its view without updating the console")
 	}
 }
 
@@ -354,6 +665,45 @@ type mockConsole struct {
 	scrollDownCount int
 }
 
+// mockFlushingConsole is a mock console that buffers its output.
+type mockFlushingConsole struct {
+	*mockConsole
+	flushCount int
+}
+
+func (cons *mockFlushingConsole) Flush() {
+	cons.flushCount++
+}
+
+// mockCursorChar is written by mockCursorConsole to the cell under the cursor.
+const mockCursorChar = '_'
+
+// mockCursorConsole is a mock buffered console that can draw a cursor.
+type mockCursorConsole struct {
+	*mockFlushingConsole
+	cursorFg  uint8
+	drawCount int
+}
+
+func (cons *mockCursorConsole) DrawCursor(x, y uint32, fg uint8) {
+	cons.chars[(y-1)*cons.width+(x-1)] = mockCursorChar
+	cons.cursorFg = fg
+	cons.drawCount++
+}
+
+// mockHardwareCursorConsole is a mock console with a hardware cursor.
+type mockHardwareCursorConsole struct {
+	*mockConsole
+	x, y    uint32
+	visible bool
+	updates int
+}
+
+func (cons *mockHardwareCursorConsole) SetCursor(x, y uint32, visible bool) {
+	cons.x, cons.y, cons.visible = x, y, visible
+	cons.updates++
+}
+
 func newMockConsole(w, h uint32) *mockConsole {
 	return &mockConsole{
 		width:   w,
@@ -379,7 +729,7 @@ func (cons *mockConsole) Fill(x, y, width, height uint32, fg, bg uint8) {
 	xEnd := x + width - 1
 
 	for fy := y; fy <= yEnd; fy++ {
-		offset := ((fy - 1) * cons.width)
+		offset := ((fy - 1) * cons.width) + (x - 1)
 		for fx := x; fx <= xEnd; fx, offset = fx+1, offset+1 {
 			cons.chars[offset] = ' '
 			cons.fgAttrs[offset] = fg
@@ -0,0 +1,88 @@
+package tty
+
+import "unicode/utf8"
+
+// replacementGlyph is rendered for invalid UTF-8 sequences and for characters
+// that the console cannot render if its font lacks a glyph for U+FFFD.
+const replacementGlyph = '?'
+
+// utf8Decoder accumulates the bytes of a multi-byte UTF-8 sequence that may be
+// split across several writes.
+type utf8Decoder struct {
+	buf    [utf8.UTFMax]byte
+	len    int
+	expLen int
+}
+
+// sequenceLen returns the length of the UTF-8 sequence that starts with the
+// lead byte b or 0 if b is not a valid lead byte.
+func sequenceLen(b byte) int {
+	switch {
+	case b >= 0xc2 && b <= 0xdf:
+		return 2
+	case b >= 0xe0 && b <= 0xef:
+		return 3
+	case b >= 0xf0 && b <= 0xf4:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// writeUTF8 feeds a non-ASCII byte to the UTF-8 decoder and renders the
+// decoded character once the sequence is complete.
+func (t *VT) writeUTF8(b byte) {
+	d := &t.utf8
+	if d.len == 0 {
+		if d.expLen = sequenceLen(b); d.expLen == 0 {
+			t.writeRune(utf8.RuneError)
+			return
+		}
+
+		d.buf[0], d.len = b, 1
+		return
+	}
+
+	// A lead byte while a sequence is in progress terminates the current
+	// (incomplete) sequence.
+	if b&0xc0 != 0x80 {
+		t.abortUTF8()
+		t.writeUTF8(b)
+		return
+	}
+
+	d.buf[d.len] = b
+	d.len++
+	if d.len < d.expLen {
+		return
+	}
+
+	r, _ := utf8.DecodeRune(d.buf[:d.len])
+	d.len = 0
+	t.writeRune(r)
+}
+
+// abortUTF8 discards an incomplete UTF-8 sequence, rendering a replacement
+// character in its place.
+func (t *VT) abortUTF8() {
+	if t.utf8.len != 0 {
+		t.utf8.len = 0
+		t.writeRune(utf8.RuneError)
+	}
+}
+
+// writeRune maps r to a glyph using the attached console and writes it at the
+// cursor position. Characters without a glyph are rendered using the glyph for
+// U+FFFD or replacementGlyph if the console does not provide one.
+func (t *VT) writeRune(r rune) {
+	glyph := uint8(replacementGlyph)
+	if t.runeMapper != nil {
+		if g, ok := t.runeMapper.MapRune(r); ok {
+			glyph = g
+		} else if g, ok = t.runeMapper.MapRune(utf8.RuneError); ok {
+			glyph = g
+		}
+	}
+
+	t.doWrite(glyph, true)
+}
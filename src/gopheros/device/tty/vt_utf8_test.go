@@ -0,0 +1,70 @@
+package tty
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+// mockRuneMapperConsole is a mock console that renders a fixed set of runes.
+type mockRuneMapperConsole struct {
+	*mockConsole
+	glyphs map[rune]uint8
+}
+
+func (cons *mockRuneMapperConsole) MapRune(r rune) (uint8, bool) {
+	glyph, ok := cons.glyphs[r]
+	return glyph, ok
+}
+
+func TestVtUTF8(t *testing.T) {
+	specs := []struct {
+		glyphs map[rune]uint8
+		input  []string
+		exp    string
+	}{
+		// Without a rune mapper all non-ASCII characters use the replacement glyph
+		{nil, []string{"aé€b"}, "a??b"},
+		{
+			map[rune]uint8{'é': 0x82, '€': 0xee, '😀': 0x01},
+			[]string{"aé€😀b"},
+			"a\x82\xee\x01b",
+		},
+		// Sequences split across writes
+		{
+			map[rune]uint8{'€': 0xee},
+			[]string{"a\xe2", "\x82", "\xacb"},
+			"a\xeeb",
+		},
+		// Missing glyphs use the glyph for U+FFFD if available
+		{
+			map[rune]uint8{utf8.RuneError: 0xfe},
+			[]string{"aé"},
+			"a\xfe",
+		},
+		// Invalid and truncated sequences
+		{
+			map[rune]uint8{'é': 0x82},
+			[]string{"\x80\xc0\xff", "\xc3a", "\xe2\x82é", "\xe2\x82"},
+			"???" + "?a" + "?\x82",
+		},
+	}
+
+	for specIndex, spec := range specs {
+		cons := newMockConsole(16, 1)
+		term := NewVT(4, 0)
+		if spec.glyphs != nil {
+			term.AttachTo(&mockRuneMapperConsole{mockConsole: cons, glyphs: spec.glyphs})
+		} else {
+			term.AttachTo(cons)
+		}
+		term.SetState(StateActive)
+
+		for _, input := range spec.input {
+			term.Write([]byte(input))
+		}
+
+		if got := string(cons.chars[:len(spec.exp)]); got != spec.exp {
+			t.Errorf("[spec %d] expected console contents to be %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package console
 import (
 	"gopheros/device/video/console/font"
 	"gopheros/device/video/console/logo"
+	"gopheros/kernel"
 	"gopheros/kernel/cpu"
 	"gopheros/kernel/mm/vmm"
 	"gopheros/multiboot"
@@ -12,6 +13,9 @@ import (
 var (
 	mapRegionFn          = vmm.MapRegion
 	portWriteByteFn      = cpu.PortWriteByte
+	portReadByteFn       = cpu.PortReadByte
+	portWriteWordFn      = cpu.PortWriteWord
+	portReadWordFn       = cpu.PortReadWord
 	getFramebufferInfoFn = multiboot.GetFramebufferInfo
 )
 
@@ -86,3 +90,83 @@ type FontSetter interface {
 type LogoSetter interface {
 	SetLogo(*logo.Image)
 }
+
+// Flusher is an interface implemented by console devices that buffer their
+// output.
+//
+// Flush copies any pending changes to the output device.
+type Flusher interface {
+	Flush()
+}
+
+// RuneMapper is an interface implemented by console devices that can render
+// characters outside the ASCII range.
+//
+// MapRune returns the index of the glyph that renders r or false if the
+// console font does not contain a suitable glyph.
+type RuneMapper interface {
+	MapRune(r rune) (uint8, bool)
+}
+
+// CursorDrawer is an interface implemented by console devices that can render
+// a text cursor.
+//
+// DrawCursor draws a cursor using the fg color over the character cell at
+// (x, y). Both x and y coordinates are 1-based. Callers erase the cursor by
+// writing the cell contents back to the console.
+type CursorDrawer interface {
+	DrawCursor(x, y uint32, fg uint8)
+}
+
+// HardwareCursor is an interface implemented by console devices whose cursor
+// is rendered by the display hardware.
+//
+// SetCursor moves the cursor to the character cell at (x, y) and shows or
+// hides it. Both x and y coordinates are 1-based.
+type HardwareCursor interface {
+	SetCursor(x, y uint32, visible bool)
+}
+
+// RegionScroller is an interface implemented by console devices that can
+// scroll a subset of their rows.
+//
+// ScrollRegion scrolls the contents of the rows from top to bottom
+// (inclusive, 1-based) to the specified direction leaving the remaining rows
+// untouched. The caller is responsible for updating the contents of the rows
+// that were scrolled into the region.
+type RegionScroller interface {
+	ScrollRegion(dir ScrollDir, top, bottom, lines uint32)
+}
+
+// PixelDrawer is an interface implemented by console devices that can render
+// true-color graphics. Unlike the text rendering methods, the pixel
+// coordinates are 0-based and cover the entire framebuffer including any area
+// reserved for a logo. Pixels outside the framebuffer are clipped.
+//
+// DrawPixels copies a width x height block of pixels, stored in row-major
+// order, to the region with its top-left corner at (x, y). FillPixels sets
+// all pixels in the specified region to c.
+type PixelDrawer interface {
+	DrawPixels(x, y, width, height uint32, pixels []color.RGBA)
+	FillPixels(x, y, width, height uint32, c color.RGBA)
+}
+
+// PixelReader is an interface implemented by console devices that can read
+// back the contents of their framebuffer. The pixel coordinates follow the
+// same conventions as PixelDrawer.
+//
+// ReadPixels copies the pixels of the width x height region with its top-left
+// corner at (x, y) to pixels in row-major order.
+type PixelReader interface {
+	ReadPixels(x, y, width, height uint32, pixels []color.RGBA)
+}
+
+// ModeSetter is an interface implemented by console devices that can switch
+// the display resolution at runtime.
+//
+// SetMode switches the display to the specified resolution (in pixels) and
+// depth and recomputes the console dimensions. Passing 0 as bpp retains the
+// current depth. The console contents are cleared when the mode is switched.
+type ModeSetter interface {
+	SetMode(width, height uint32, bpp uint8) *kernel.Error
+}
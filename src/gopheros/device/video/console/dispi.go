@@ -0,0 +1,79 @@
+package console
+
+// The Bochs display interface (DISPI) is the VBE implementation provided by
+// the display adapters emulated by Bochs, QEMU (std VGA) and VirtualBox.
+// Unlike the VBE BIOS calls, which require real mode, the DISPI registers can
+// be programmed directly from long mode which allows the framebuffer mode to
+// be switched at runtime. The linear framebuffer address is not affected by
+// mode switches.
+const (
+	dispiIndexPort = 0x1ce
+	dispiDataPort  = 0x1cf
+
+	dispiRegID         = 0
+	dispiRegXRes       = 1
+	dispiRegYRes       = 2
+	dispiRegBpp        = 3
+	dispiRegEnable     = 4
+	dispiRegVirtWidth  = 6
+	dispiRegVirtHeight = 7
+	dispiRegXOffset    = 8
+	dispiRegYOffset    = 9
+
+	// The range of interface versions that support 32 bpp modes and a
+	// linear framebuffer.
+	dispiIDMin = 0xb0c2
+	dispiIDMax = 0xb0cf
+
+	// Bits of the enable register. While dispiGetCaps is set, the
+	// resolution and depth registers report the maximum supported values.
+	dispiEnabled    = 1 << 0
+	dispiGetCaps    = 1 << 1
+	dispiLFBEnabled = 1 << 6
+)
+
+func dispiRead(reg uint16) uint16 {
+	portWriteWordFn(dispiIndexPort, reg)
+	return portReadWordFn(dispiDataPort)
+}
+
+func dispiWrite(reg, val uint16) {
+	portWriteWordFn(dispiIndexPort, reg)
+	portWriteWordFn(dispiDataPort, val)
+}
+
+// dispiPresent returns true if the display adapter implements DISPI.
+func dispiPresent() bool {
+	id := dispiRead(dispiRegID)
+	return id >= dispiIDMin && id <= dispiIDMax
+}
+
+// dispiMaxMode returns the maximum resolution and depth supported by the
+// display adapter.
+func dispiMaxMode() (width, height uint32, bpp uint8) {
+	enable := dispiRead(dispiRegEnable)
+	dispiWrite(dispiRegEnable, enable|dispiGetCaps)
+	width, height, bpp = uint32(dispiRead(dispiRegXRes)), uint32(dispiRead(dispiRegYRes)), uint8(dispiRead(dispiRegBpp))
+	dispiWrite(dispiRegEnable, enable)
+	return width, height, bpp
+}
+
+// dispiMode returns the active resolution and depth.
+func dispiMode() (width, height uint32, bpp uint8) {
+	return uint32(dispiRead(dispiRegXRes)), uint32(dispiRead(dispiRegYRes)), uint8(dispiRead(dispiRegBpp))
+}
+
+// dispiSetMode switches the display adapter to the specified mode using a
+// linear framebuffer. The adapter clears the framebuffer contents as part of
+// the mode switch.
+func dispiSetMode(width, height uint32, bpp uint8) {
+	dispiWrite(dispiRegEnable, 0)
+	dispiWrite(dispiRegXRes, uint16(width))
+	dispiWrite(dispiRegYRes, uint16(height))
+	dispiWrite(dispiRegBpp, uint16(bpp))
+	dispiWrite(dispiRegVirtWidth, uint16(width))
+	dispiWrite(dispiRegVirtHeight, uint16(height))
+	dispiWrite(dispiRegXOffset, 0)
+	dispiWrite(dispiRegYOffset, 0)
+	dispiWrite(dispiRegEnable, dispiEnabled|dispiLFBEnabled)
+}
@@ -0,0 +1,31 @@
+package font
+
+// cp437 lists the Unicode code points for the upper half (0x80-0xff) of the
+// IBM PC code page 437. The built-in fonts and the VGA hardware font use this
+// glyph layout.
+var cp437 = [128]rune{
+	'Ç', 'ü', 'é', 'â', 'ä', 'à', 'å', 'ç', 'ê', 'ë', 'è', 'ï', 'î', 'ì', 'Ä', 'Å',
+	'É', 'æ', 'Æ', 'ô', 'ö', 'ò', 'û', 'ù', 'ÿ', 'Ö', 'Ü', '¢', '£', '¥', '₧', 'ƒ',
+	'á', 'í', 'ó', 'ú', 'ñ', 'Ñ', 'ª', 'º', '¿', '⌐', '¬', '½', '¼', '¡', '«', '»',
+	'░', '▒', '▓', '│', '┤', '╡', '╢', '╖', '╕', '╣', '║', '╗', '╝', '╜', '╛', '┐',
+	'└', '┴', '┬', '├', '─', '┼', '╞', '╟', '╚', '╔', '╩', '╦', '╠', '═', '╬', '╧',
+	'╨', '╤', '╥', '╙', '╘', '╒', '╓', '╫', '╪', '┘', '┌', '█', '▄', '▌', '▐', '▀',
+	'α', 'ß', 'Γ', 'π', 'Σ', 'σ', 'µ', 'τ', 'Φ', 'Θ', 'Ω', 'δ', '∞', 'φ', 'ε', '∩',
+	'≡', '±', '≥', '≤', '⌠', '⌡', '÷', '≈', '°', '∙', '·', '√', 'ⁿ', '²', '■', ' ',
+}
+
+// LookupCP437 returns the code page 437 glyph index for r. The function
+// returns false if r cannot be represented using code page 437.
+func LookupCP437(r rune) (uint8, bool) {
+	if r >= 0 && r < 0x80 {
+		return uint8(r), true
+	}
+
+	for i, cpRune := range cp437 {
+		if cpRune == r {
+			return uint8(0x80 + i), true
+		}
+	}
+
+	return 0, false
+}
@@ -31,6 +31,36 @@ type Font struct {
 	// bytes where each bit indicates whether a pixel should be set to the
 	// foreground or the background color.
 	Data []byte
+
+	// Unicode maps runes to glyph indices. It is only populated for fonts
+	// that provide a Unicode table (e.g. fonts loaded via ParsePSF).
+	Unicode map[rune]uint32
+}
+
+// Glyph returns the index of the glyph that renders r. Fonts without a Unicode
+// table are assumed to use the code page 437 glyph layout. Glyph returns false
+// if the font does not contain a glyph for r.
+func (f *Font) Glyph(r rune) (uint32, bool) {
+	if f.Unicode == nil {
+		glyph, ok := LookupCP437(r)
+		return uint32(glyph), ok
+	}
+
+	glyph, ok := f.Unicode[r]
+	return glyph, ok
+}
+
+// Register adds a font to the list of available fonts. If a font with the same
+// name is already registered, it is replaced by f.
+func Register(f *Font) {
+	for i, existing := range availableFonts {
+		if existing.Name == f.Name {
+			availableFonts[i] = f
+			return
+		}
+	}
+
+	availableFonts = append(availableFonts, f)
 }
 
 // FindByName looks up a font instance by name. If the font is not found then
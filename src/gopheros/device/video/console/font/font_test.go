@@ -57,3 +57,51 @@ func TestBestFit(t *testing.T) {
 		}
 	}
 }
+
+func TestRegister(t *testing.T) {
+	defer func(origList []*Font) {
+		availableFonts = origList
+	}(availableFonts)
+
+	availableFonts = nil
+
+	foo, bar, newFoo := &Font{Name: "foo"}, &Font{Name: "bar"}, &Font{Name: "foo"}
+	Register(foo)
+	Register(bar)
+	Register(newFoo)
+
+	if len(availableFonts) != 2 || FindByName("foo") != newFoo || FindByName("bar") != bar {
+		t.Fatal("expected Register to add new fonts and replace fonts with the same name")
+	}
+}
+
+func TestGlyph(t *testing.T) {
+	var (
+		cp437Font   = &Font{}
+		unicodeFont = &Font{Unicode: map[rune]uint32{'A': 33, '€': 300}}
+	)
+
+	specs := []struct {
+		f        *Font
+		r        rune
+		expGlyph uint32
+		expOK    bool
+	}{
+		{cp437Font, 'A', 'A', true},
+		{cp437Font, 'é', 0x82, true},
+		{cp437Font, '═', 0xcd, true},
+		{cp437Font, ' ', 0xff, true},
+		{cp437Font, '€', 0, false},
+		{cp437Font, -1, 0, false},
+		{unicodeFont, 'A', 33, true},
+		{unicodeFont, '€', 300, true},
+		{unicodeFont, 'B', 0, false},
+	}
+
+	for specIndex, spec := range specs {
+		glyph, ok := spec.f.Glyph(spec.r)
+		if glyph != spec.expGlyph || ok != spec.expOK {
+			t.Errorf("[spec %d] expected Glyph(%U) to return %d, %t; got %d, %t", specIndex, spec.r, spec.expGlyph, spec.expOK, glyph, ok)
+		}
+	}
+}
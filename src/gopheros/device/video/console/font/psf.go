@@ -0,0 +1,166 @@
+package font
+
+import (
+	"encoding/binary"
+	"gopheros/kernel"
+	"unicode/utf8"
+)
+
+const (
+	psf1Magic0 = 0x36
+	psf1Magic1 = 0x04
+
+	// PSF1 mode flags.
+	psf1Mode512        = 0x01
+	psf1ModeHasTab     = 0x02
+	psf1ModeHasSeq     = 0x04
+	psf1HeaderSize     = 4
+	psf1GlyphWidth     = 8
+	psf1TableSeparator = 0xffff
+	psf1TableSeqStart  = 0xfffe
+
+	psf2Magic          = 0x864ab572
+	psf2FlagHasTable   = 0x01
+	psf2MinHeaderSize  = 32
+	psf2TableSeparator = 0xff
+	psf2TableSeqStart  = 0xfe
+)
+
+var (
+	errPSFBadMagic  = &kernel.Error{Module: "font", Message: "unsupported font format; expected a PSF1 or PSF2 font"}
+	errPSFTruncated = &kernel.Error{Module: "font", Message: "PSF font data is truncated"}
+	errPSFBadHeader = &kernel.Error{Module: "font", Message: "PSF font header contains invalid glyph dimensions"}
+)
+
+// ParsePSF parses a font in PC Screen Font format (version 1 or 2) and returns
+// a Font with the specified name. The returned font shares its glyph bitmaps
+// with data. If the font contains a Unicode table, it is used to populate the
+// Unicode field of the returned font; character sequences are ignored.
+func ParsePSF(name string, data []byte) (*Font, *kernel.Error) {
+	switch {
+	case len(data) >= 2 && data[0] == psf1Magic0 && data[1] == psf1Magic1:
+		return parsePSF1(name, data)
+	case len(data) >= 4 && binary.LittleEndian.Uint32(data) == psf2Magic:
+		return parsePSF2(name, data)
+	default:
+		return nil, errPSFBadMagic
+	}
+}
+
+// parsePSF1 parses a PSF1 font. PSF1 glyphs are always 8 pixels wide.
+func parsePSF1(name string, data []byte) (*Font, *kernel.Error) {
+	if len(data) < psf1HeaderSize {
+		return nil, errPSFTruncated
+	}
+
+	var (
+		mode       = data[2]
+		height     = uint32(data[3])
+		glyphCount = uint32(256)
+	)
+
+	if height == 0 {
+		return nil, errPSFBadHeader
+	}
+
+	if mode&psf1Mode512 != 0 {
+		glyphCount = 512
+	}
+
+	glyphEnd := psf1HeaderSize + glyphCount*height
+	if uint32(len(data)) < glyphEnd {
+		return nil, errPSFTruncated
+	}
+
+	f := &Font{
+		Name:        name,
+		GlyphWidth:  psf1GlyphWidth,
+		GlyphHeight: height,
+		BytesPerRow: 1,
+		Data:        data[psf1HeaderSize:glyphEnd],
+	}
+
+	if mode&(psf1ModeHasTab|psf1ModeHasSeq) != 0 {
+		f.Unicode = make(map[rune]uint32)
+		table := data[glyphEnd:]
+		for glyph, inSeq := uint32(0), false; glyph < glyphCount && len(table) >= 2; table = table[2:] {
+			switch entry := binary.LittleEndian.Uint16(table); entry {
+			case psf1TableSeparator:
+				glyph, inSeq = glyph+1, false
+			case psf1TableSeqStart:
+				inSeq = true
+			default:
+				if !inSeq {
+					f.addUnicodeMapping(rune(entry), glyph)
+				}
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// parsePSF2 parses a PSF2 font.
+func parsePSF2(name string, data []byte) (*Font, *kernel.Error) {
+	if len(data) < psf2MinHeaderSize {
+		return nil, errPSFTruncated
+	}
+
+	var (
+		headerSize   = binary.LittleEndian.Uint32(data[8:])
+		flags        = binary.LittleEndian.Uint32(data[12:])
+		glyphCount   = binary.LittleEndian.Uint32(data[16:])
+		bytesPerChar = binary.LittleEndian.Uint32(data[20:])
+		height       = binary.LittleEndian.Uint32(data[24:])
+		width        = binary.LittleEndian.Uint32(data[28:])
+		bytesPerRow  = (width + 7) >> 3
+	)
+
+	if width == 0 || height == 0 || bytesPerChar != bytesPerRow*height || headerSize < psf2MinHeaderSize {
+		return nil, errPSFBadHeader
+	}
+
+	glyphEnd := uint64(headerSize) + uint64(glyphCount)*uint64(bytesPerChar)
+	if uint64(len(data)) < glyphEnd {
+		return nil, errPSFTruncated
+	}
+
+	f := &Font{
+		Name:        name,
+		GlyphWidth:  width,
+		GlyphHeight: height,
+		BytesPerRow: bytesPerRow,
+		Data:        data[headerSize:glyphEnd],
+	}
+
+	if flags&psf2FlagHasTable != 0 {
+		f.Unicode = make(map[rune]uint32)
+		table := data[glyphEnd:]
+		for glyph, inSeq := uint32(0), false; glyph < glyphCount && len(table) > 0; {
+			switch table[0] {
+			case psf2TableSeparator:
+				glyph, inSeq = glyph+1, false
+				table = table[1:]
+			case psf2TableSeqStart:
+				inSeq = true
+				table = table[1:]
+			default:
+				r, size := utf8.DecodeRune(table)
+				if !inSeq && r != utf8.RuneError {
+					f.addUnicodeMapping(r, glyph)
+				}
+				table = table[size:]
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// addUnicodeMapping maps r to the specified glyph unless r is already mapped
+// to another glyph.
+func (f *Font) addUnicodeMapping(r rune, glyph uint32) {
+	if _, exists := f.Unicode[r]; !exists {
+		f.Unicode[r] = glyph
+	}
+}
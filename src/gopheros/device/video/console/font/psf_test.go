@@ -0,0 +1,153 @@
+package font
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopheros/kernel"
+	"reflect"
+	"testing"
+)
+
+// buildPSF1 encodes a PSF1 font with the specified mode and glyph height. Each
+// glyph row is set to the glyph index. The table argument is appended after
+// the glyph data.
+func buildPSF1(mode uint8, height uint8, table []uint16) []byte {
+	glyphCount := 256
+	if mode&psf1Mode512 != 0 {
+		glyphCount = 512
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{psf1Magic0, psf1Magic1, mode, height})
+	for glyph := 0; glyph < glyphCount; glyph++ {
+		buf.Write(bytes.Repeat([]byte{byte(glyph)}, int(height)))
+	}
+	binary.Write(&buf, binary.LittleEndian, table)
+	return buf.Bytes()
+}
+
+// buildPSF2 encodes a PSF2 font with the specified glyph count and
+// dimensions. The table argument is appended after the glyph data.
+func buildPSF2(flags, glyphCount, width, height uint32, table []byte) []byte {
+	bytesPerChar := ((width + 7) >> 3) * height
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []uint32{
+		psf2Magic, 0, psf2MinHeaderSize, flags, glyphCount, bytesPerChar, height, width,
+	})
+	for glyph := uint32(0); glyph < glyphCount; glyph++ {
+		buf.Write(bytes.Repeat([]byte{byte(glyph)}, int(bytesPerChar)))
+	}
+	buf.Write(table)
+	return buf.Bytes()
+}
+
+func TestParsePSF1(t *testing.T) {
+	table := make([]uint16, 0)
+	for glyph := 0; glyph < 256; glyph++ {
+		switch glyph {
+		case 'A':
+			// glyph 'A' also maps to U+0391 (greek capital alpha)
+			// and contains a sequence that should be ignored
+			table = append(table, 'A', 0x391, psf1TableSeqStart, 'A', 0x301)
+		case 'B':
+			// U+0041 is already mapped to glyph 'A'
+			table = append(table, 'B', 'A')
+		default:
+			table = append(table, uint16(glyph))
+		}
+		table = append(table, psf1TableSeparator)
+	}
+
+	f, err := ParsePSF("psf1", buildPSF1(psf1ModeHasTab, 14, table))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Name != "psf1" || f.GlyphWidth != 8 || f.GlyphHeight != 14 || f.BytesPerRow != 1 || len(f.Data) != 256*14 {
+		t.Fatalf("unexpected font attributes: %dx%d, %d bytes per row, %d data bytes", f.GlyphWidth, f.GlyphHeight, f.BytesPerRow, len(f.Data))
+	}
+
+	if f.Data[14*'A'] != 'A' {
+		t.Errorf("expected glyph data for 'A' to start at offset %d", 14*'A')
+	}
+
+	expMappings := map[rune]uint32{'A': 'A', 0x391: 'A', 'B': 'B', 'z': 'z'}
+	for r, exp := range expMappings {
+		if got, ok := f.Unicode[r]; !ok || got != exp {
+			t.Errorf("expected rune %U to map to glyph %d; got %d", r, exp, got)
+		}
+	}
+
+	if _, ok := f.Unicode[0x301]; ok {
+		t.Error("expected runes in character sequences to be ignored")
+	}
+
+	// 512-glyph font without a unicode table
+	f, err = ParsePSF("psf1-512", buildPSF1(psf1Mode512, 16, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.Data) != 512*16 || f.Unicode != nil {
+		t.Fatalf("expected a 512-glyph font without a unicode table; got %d data bytes", len(f.Data))
+	}
+}
+
+func TestParsePSF2(t *testing.T) {
+	var table []byte
+	for glyph := 0; glyph < 4; glyph++ {
+		switch glyph {
+		case 1:
+			table = append(table, []byte("é€")...)
+			table = append(table, psf2TableSeqStart)
+			table = append(table, []byte("é")...)
+		case 2:
+			// invalid UTF-8 sequences are skipped
+			table = append(table, 0xc3, 'x')
+		default:
+			table = append(table, byte('a'+glyph))
+		}
+		table = append(table, psf2TableSeparator)
+	}
+
+	f, err := ParsePSF("psf2", buildPSF2(psf2FlagHasTable, 4, 12, 24, table))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.GlyphWidth != 12 || f.GlyphHeight != 24 || f.BytesPerRow != 2 || len(f.Data) != 4*48 {
+		t.Fatalf("unexpected font attributes: %dx%d, %d bytes per row, %d data bytes", f.GlyphWidth, f.GlyphHeight, f.BytesPerRow, len(f.Data))
+	}
+
+	expMappings := map[rune]uint32{'a': 0, 'é': 1, '€': 1, 'x': 2, 'd': 3}
+	if !reflect.DeepEqual(f.Unicode, expMappings) {
+		t.Fatalf("expected unicode mappings %v; got %v", expMappings, f.Unicode)
+	}
+}
+
+func TestParsePSFErrors(t *testing.T) {
+	validPSF2 := buildPSF2(0, 2, 8, 8, nil)
+	badDims := append([]byte{}, validPSF2...)
+	binary.LittleEndian.PutUint32(badDims[28:], 0)
+
+	specs := []struct {
+		data   []byte
+		expErr *kernel.Error
+	}{
+		{nil, errPSFBadMagic},
+		{[]byte("not a font"), errPSFBadMagic},
+		{[]byte{psf1Magic0, psf1Magic1, 0}, errPSFTruncated},
+		{[]byte{psf1Magic0, psf1Magic1, 0, 0}, errPSFBadHeader},
+		{buildPSF1(0, 8, nil)[:100], errPSFTruncated},
+		{validPSF2[:20], errPSFTruncated},
+		{validPSF2[:len(validPSF2)-1], errPSFTruncated},
+		{badDims, errPSFBadHeader},
+	}
+
+	for specIndex, spec := range specs {
+		if _, err := ParsePSF("bad", spec.data); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package console
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"image/color"
+	"io"
+)
+
+var errNoPixelReader = &kernel.Error{Module: "console", Message: "console cannot read back its framebuffer contents"}
+
+// EncodePPM writes the framebuffer contents of cons to w as a binary (P6) PPM
+// image. The image is encoded one row at a time so only a single row of pixels
+// is buffered. EncodePPM returns an error if cons does not implement
+// PixelReader.
+func EncodePPM(w io.Writer, cons Device) *kernel.Error {
+	reader, ok := cons.(PixelReader)
+	if !ok {
+		return errNoPixelReader
+	}
+
+	width, height := cons.Dimensions(Pixels)
+	kfmt.Fprintf(w, "P6\n%d %d\n255\n", width, height)
+
+	var (
+		rowPixels = make([]color.RGBA, width)
+		rowData   = make([]byte, width*3)
+	)
+
+	for y := uint32(0); y < height; y++ {
+		reader.ReadPixels(0, y, width, 1, rowPixels)
+		for x, c := range rowPixels {
+			rowData[x*3], rowData[x*3+1], rowData[x*3+2] = c.R, c.G, c.B
+		}
+		w.Write(rowData)
+	}
+
+	return nil
+}
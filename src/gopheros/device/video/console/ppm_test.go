@@ -0,0 +1,40 @@
+package console
+
+import (
+	"bytes"
+	"gopheros/kernel/cpu"
+	"image/color"
+	"testing"
+)
+
+func TestEncodePPM(t *testing.T) {
+	defer func() {
+		portWriteByteFn = cpu.PortWriteByte
+	}()
+	portWriteByteFn = func(_ uint16, _ uint8) {}
+
+	cons := NewVesaFbConsole(3, 2, 32, 12, nil, 0)
+	cons.fb = make([]uint8, 3*2*4)
+	cons.loadDefaultPalette()
+	cons.DrawPixels(0, 0, 3, 2, []color.RGBA{
+		{R: 255}, {G: 255}, {B: 255},
+		{R: 255, G: 255, B: 255}, {}, {R: 255, B: 255},
+	})
+
+	var buf bytes.Buffer
+	if err := EncodePPM(&buf, cons); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := "P6\n3 2\n255\n" +
+		"\xff\x00\x00\x00\xff\x00\x00\x00\xff" +
+		"\xff\xff\xff\x00\x00\x00\xff\x00\xff"
+
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output:\n%q\ngot:\n%q", exp, got)
+	}
+
+	if err := EncodePPM(&buf, NewVgaTextConsole(80, 25, 0xb8000)); err != errNoPixelReader {
+		t.Fatalf("expected to get errNoPixelReader for a text console; got %v", err)
+	}
+}
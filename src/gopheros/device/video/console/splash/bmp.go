@@ -0,0 +1,111 @@
+package splash
+
+import (
+	"encoding/binary"
+	"gopheros/kernel"
+	"image/color"
+)
+
+const (
+	bmpFileHeaderLen = 14
+	bmpInfoHeaderLen = 40
+
+	// The offsets of the BMP file and info header fields that are used by
+	// the decoder.
+	bmpFileSizeOff    = 2
+	bmpPixelDataOff   = 10
+	bmpInfoLenOff     = 14
+	bmpWidthOff       = 18
+	bmpHeightOff      = 22
+	bmpBppOff         = 28
+	bmpCompressionOff = 30
+	bmpMasksOff       = bmpFileHeaderLen + bmpInfoHeaderLen
+
+	bmpCompressionNone      = 0
+	bmpCompressionBitfields = 3
+)
+
+var (
+	errBMPInvalid     = &kernel.Error{Module: "splash", Message: "image is not a valid BMP file"}
+	errBMPUnsupported = &kernel.Error{Module: "splash", Message: "unsupported BMP format; only uncompressed 24 and 32 bpp images are supported"}
+)
+
+// Image describes a true-color image.
+type Image struct {
+	// The width and height of the image in pixels.
+	Width  uint32
+	Height uint32
+
+	// Pixels contains Width*Height pixels in row-major order starting
+	// with the top-left pixel.
+	Pixels []color.RGBA
+}
+
+// DecodeBMP decodes an uncompressed 24 or 32 bpp BMP image. This is the
+// format that the firmware uses for the image referenced by the BGRT table.
+// 32 bpp images that specify their color layout using bit fields are only
+// supported if they use the standard BGRX layout.
+func DecodeBMP(data []byte) (*Image, *kernel.Error) {
+	if len(data) < bmpFileHeaderLen+bmpInfoHeaderLen || data[0] != 'B' || data[1] != 'M' {
+		return nil, errBMPInvalid
+	}
+
+	var (
+		pixelOff    = uint64(binary.LittleEndian.Uint32(data[bmpPixelDataOff:]))
+		infoLen     = binary.LittleEndian.Uint32(data[bmpInfoLenOff:])
+		width       = int32(binary.LittleEndian.Uint32(data[bmpWidthOff:]))
+		height      = int32(binary.LittleEndian.Uint32(data[bmpHeightOff:]))
+		bpp         = binary.LittleEndian.Uint16(data[bmpBppOff:])
+		compression = binary.LittleEndian.Uint32(data[bmpCompressionOff:])
+	)
+
+	if infoLen < bmpInfoHeaderLen || width <= 0 || height == 0 {
+		return nil, errBMPInvalid
+	}
+
+	switch {
+	case compression == bmpCompressionNone && (bpp == 24 || bpp == 32):
+	case compression == bmpCompressionBitfields && bpp == 32:
+		if len(data) < bmpMasksOff+12 ||
+			binary.LittleEndian.Uint32(data[bmpMasksOff:]) != 0xff0000 ||
+			binary.LittleEndian.Uint32(data[bmpMasksOff+4:]) != 0xff00 ||
+			binary.LittleEndian.Uint32(data[bmpMasksOff+8:]) != 0xff {
+			return nil, errBMPUnsupported
+		}
+	default:
+		return nil, errBMPUnsupported
+	}
+
+	// Rows are stored bottom-up unless the height is negative and each
+	// row is padded to a multiple of 4 bytes.
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+
+	bytesPerPixel := uint64(bpp >> 3)
+	rowLen := (uint64(width)*bytesPerPixel + 3) &^ 3
+	if pixelOff+rowLen*uint64(height) > uint64(len(data)) {
+		return nil, errBMPInvalid
+	}
+
+	img := &Image{
+		Width:  uint32(width),
+		Height: uint32(height),
+		Pixels: make([]color.RGBA, uint64(width)*uint64(height)),
+	}
+
+	for y := uint64(0); y < uint64(height); y++ {
+		rowOff := pixelOff + y*rowLen
+		if !topDown {
+			rowOff = pixelOff + (uint64(height)-1-y)*rowLen
+		}
+
+		row := img.Pixels[y*uint64(width) : (y+1)*uint64(width)]
+		for x, off := 0, rowOff; x < len(row); x, off = x+1, off+bytesPerPixel {
+			row[x] = color.RGBA{R: data[off+2], G: data[off+1], B: data[off], A: 255}
+		}
+	}
+
+	return img, nil
+}
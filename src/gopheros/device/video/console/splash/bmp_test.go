@@ -0,0 +1,138 @@
+package splash
+
+import (
+	"encoding/binary"
+	"gopheros/kernel"
+	"image/color"
+	"testing"
+)
+
+// encodeBMP returns a BMP file containing the specified pixels. If topDown is
+// set, the rows are stored in top-down order. 32 bpp images use the bit field
+// compression mode.
+func encodeBMP(width, height uint32, bpp uint16, topDown bool, pixels []color.RGBA) []byte {
+	var (
+		bytesPerPixel = uint32(bpp >> 3)
+		rowLen        = (width*bytesPerPixel + 3) &^ 3
+		pixelOff      = uint32(bmpFileHeaderLen + bmpInfoHeaderLen)
+		compression   = uint32(bmpCompressionNone)
+		heightField   = int32(height)
+	)
+
+	if bpp == 32 {
+		pixelOff += 12
+		compression = bmpCompressionBitfields
+	}
+
+	if topDown {
+		heightField = -heightField
+	}
+
+	data := make([]byte, pixelOff+rowLen*height)
+	data[0], data[1] = 'B', 'M'
+	binary.LittleEndian.PutUint32(data[bmpFileSizeOff:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(data[bmpPixelDataOff:], pixelOff)
+	binary.LittleEndian.PutUint32(data[bmpInfoLenOff:], bmpInfoHeaderLen)
+	binary.LittleEndian.PutUint32(data[bmpWidthOff:], width)
+	binary.LittleEndian.PutUint32(data[bmpHeightOff:], uint32(heightField))
+	binary.LittleEndian.PutUint16(data[bmpBppOff:], bpp)
+	binary.LittleEndian.PutUint32(data[bmpCompressionOff:], compression)
+
+	if bpp == 32 {
+		binary.LittleEndian.PutUint32(data[bmpMasksOff:], 0xff0000)
+		binary.LittleEndian.PutUint32(data[bmpMasksOff+4:], 0xff00)
+		binary.LittleEndian.PutUint32(data[bmpMasksOff+8:], 0xff)
+	}
+
+	for y := uint32(0); y < height; y++ {
+		rowOff := pixelOff + (height-1-y)*rowLen
+		if topDown {
+			rowOff = pixelOff + y*rowLen
+		}
+
+		for x := uint32(0); x < width; x++ {
+			c := pixels[y*width+x]
+			off := rowOff + x*bytesPerPixel
+			data[off], data[off+1], data[off+2] = c.B, c.G, c.R
+		}
+	}
+
+	return data
+}
+
+func TestDecodeBMP(t *testing.T) {
+	pixels := []color.RGBA{
+		{R: 1, G: 2, B: 3, A: 255}, {R: 4, G: 5, B: 6, A: 255}, {R: 7, G: 8, B: 9, A: 255},
+		{R: 10, G: 11, B: 12, A: 255}, {R: 13, G: 14, B: 15, A: 255}, {R: 16, G: 17, B: 18, A: 255},
+	}
+
+	specs := []struct {
+		bpp     uint16
+		topDown bool
+	}{
+		{24, false},
+		{24, true},
+		{32, false},
+		{32, true},
+	}
+
+	for specIndex, spec := range specs {
+		img, err := DecodeBMP(encodeBMP(3, 2, spec.bpp, spec.topDown, pixels))
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if img.Width != 3 || img.Height != 2 || len(img.Pixels) != len(pixels) {
+			t.Errorf("[spec %d] expected a 3x2 image; got %dx%d with %d pixels", specIndex, img.Width, img.Height, len(img.Pixels))
+			continue
+		}
+
+		for i, exp := range pixels {
+			if got := img.Pixels[i]; got != exp {
+				t.Errorf("[spec %d] expected pixel %d to be %v; got %v", specIndex, i, exp, got)
+			}
+		}
+	}
+}
+
+func TestDecodeBMPErrors(t *testing.T) {
+	valid := encodeBMP(2, 2, 32, false, make([]color.RGBA, 4))
+
+	for specIndex, data := range [][]byte{valid[:bmpFileHeaderLen], valid[:len(valid)-1]} {
+		if _, err := DecodeBMP(data); err != errBMPInvalid {
+			t.Errorf("[spec %d] expected to get errBMPInvalid for truncated image; got %v", specIndex, err)
+		}
+	}
+
+	specs := []struct {
+		off    int
+		val    uint32
+		expErr *kernel.Error
+	}{
+		{0, 'X', errBMPInvalid},
+		{bmpInfoLenOff, 12, errBMPInvalid},
+		{bmpWidthOff, 0, errBMPInvalid},
+		{bmpHeightOff, 0, errBMPInvalid},
+		{bmpPixelDataOff, 0xffffffff, errBMPInvalid},
+		{bmpBppOff, 8, errBMPUnsupported},
+		{bmpCompressionOff, 1, errBMPUnsupported},
+		{bmpMasksOff, 0xff, errBMPUnsupported},
+	}
+
+	for specIndex, spec := range specs {
+		data := append([]byte(nil), valid...)
+		switch spec.off {
+		case 0:
+			data[0] = uint8(spec.val)
+		case bmpBppOff:
+			binary.LittleEndian.PutUint16(data[spec.off:], uint16(spec.val))
+		default:
+			binary.LittleEndian.PutUint32(data[spec.off:], spec.val)
+		}
+
+		if _, err := DecodeBMP(data); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
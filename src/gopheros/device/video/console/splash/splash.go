@@ -0,0 +1,269 @@
+// Package splash displays a boot splash image together with a progress
+// indicator while the kernel subsystems are being initialized.
+//
+// The splash image is loaded from the initrd or, if the initrd does not
+// provide one, from the image that the firmware displayed while booting (as
+// reported by the ACPI BGRT table). If the active console cannot render
+// graphics, the progress is reported as plain text instead.
+package splash
+
+import (
+	"encoding/binary"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/device/video/console"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/vfs"
+	"image/color"
+	"reflect"
+	"unsafe"
+)
+
+const (
+	// ImagePath is the location of the splash image in the initrd. The
+	// image must be stored as an uncompressed 24 or 32 bpp BMP file.
+	ImagePath = "/splash.bmp"
+
+	// The height of the progress bar and the space between the bar and
+	// the splash image in pixels.
+	barHeight = 8
+	barGap    = 2 * barHeight
+
+	// textBarLen is the number of characters used for rendering the
+	// progress bar when the console cannot render graphics.
+	textBarLen = 20
+
+	// maxBGRTImageSize bounds the size of the firmware-provided image
+	// that will be mapped.
+	maxBGRTImageSize = 16 * 1024 * 1024
+)
+
+var (
+	errNoBGRTImage = &kernel.Error{Module: "splash", Message: "firmware does not provide a BGRT bitmap image"}
+
+	backgroundColor = color.RGBA{A: 255}
+	barTrackColor   = color.RGBA{R: 64, G: 64, B: 64, A: 255}
+	barFillColor    = color.RGBA{R: 102, G: 215, B: 232, A: 255}
+
+	// active is set while a splash screen is displayed. If the console
+	// cannot render graphics, drawer is nil.
+	active bool
+	cons   console.Device
+	drawer console.PixelDrawer
+
+	steps, step uint32
+
+	// The position and width of the progress bar in pixels.
+	barX, barY, barW uint32
+
+	// The following functions are used by tests to mock calls to the vfs
+	// and acpi packages and to the code that maps physical memory.
+	readFileFn    = vfs.ReadFile
+	lookupTableFn = acpi.LookupTable
+	mapPhysFn     = mapPhys
+)
+
+// Begin displays the splash screen on c and resets the progress indicator to
+// track the specified number of steps. Begin returns true if c supports
+// graphics and the splash screen was drawn; in that case the caller must
+// prevent other code from writing to the console until End is invoked.
+// Otherwise, each call to Step prints the progress as plain text.
+func Begin(c console.Device, numSteps uint32) bool {
+	active, cons, drawer = true, c, nil
+	steps, step = numSteps, 0
+
+	if c == nil {
+		return false
+	}
+
+	if drawer, _ = c.(console.PixelDrawer); drawer == nil {
+		return false
+	}
+
+	consW, consH := c.Dimensions(console.Pixels)
+	drawer.FillPixels(0, 0, consW, consH, backgroundColor)
+
+	barW = consW / 3
+	barX, barY = (consW-barW)/2, consH/2
+
+	if img := loadImage(); img != nil && img.Width <= consW && img.Height <= consH {
+		imgX, imgY := (consW-img.Width)/2, (consH-img.Height)/2
+		drawer.DrawPixels(imgX, imgY, img.Width, img.Height, img.Pixels)
+
+		if imgBottom := imgY + img.Height; imgBottom+barGap+barHeight <= consH {
+			barY = imgBottom + barGap
+		}
+	}
+
+	drawBar()
+	flush()
+	return true
+}
+
+// Step advances the progress indicator by one step and displays label as the
+// description of the step that is about to run. It is a no-op if no splash
+// screen is active.
+func Step(label string) {
+	if !active {
+		return
+	}
+
+	if step < steps {
+		step++
+	}
+
+	if drawer == nil {
+		printProgress(label)
+		return
+	}
+
+	drawBar()
+	drawLabel(label)
+	flush()
+}
+
+// End removes the splash screen. It returns true if a graphical splash screen
+// was displayed; in that case the screen is cleared and the caller is
+// responsible for restoring the console contents.
+func End() bool {
+	if !active {
+		return false
+	}
+
+	active = false
+	if drawer == nil {
+		cons = nil
+		return false
+	}
+
+	consW, consH := cons.Dimensions(console.Pixels)
+	drawer.FillPixels(0, 0, consW, consH, backgroundColor)
+	flush()
+
+	cons, drawer = nil, nil
+	return true
+}
+
+// drawBar renders the progress bar for the current step.
+func drawBar() {
+	var filled uint32
+	if steps != 0 {
+		filled = uint32(uint64(barW) * uint64(step) / uint64(steps))
+	}
+
+	drawer.FillPixels(barX, barY, filled, barHeight, barFillColor)
+	drawer.FillPixels(barX+filled, barY, barW-filled, barHeight, barTrackColor)
+}
+
+// drawLabel renders label centered at the last text row of the console.
+func drawLabel(label string) {
+	consW, consH := cons.Dimensions(console.Characters)
+	if consW == 0 || consH == 0 {
+		return
+	}
+
+	fg, bg := cons.DefaultColors()
+	cons.Fill(1, consH, consW, 1, fg, bg)
+
+	x := uint32(1)
+	if uint32(len(label)) < consW {
+		x += (consW - uint32(len(label))) / 2
+	}
+
+	for i := 0; i < len(label) && x <= consW; i, x = i+1, x+1 {
+		cons.Write(label[i], fg, bg, x, consH)
+	}
+}
+
+// printProgress reports the current step as plain text.
+func printProgress(label string) {
+	var bar [textBarLen]byte
+	for i := range bar {
+		bar[i] = ' '
+		if steps != 0 && uint32(i) < textBarLen*step/steps {
+			bar[i] = '='
+		}
+	}
+
+	kfmt.Printf("[boot] [%s] %d/%d %s\n", bar[:], step, steps, label)
+}
+
+func flush() {
+	if flusher, ok := cons.(console.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// loadImage returns the splash image or nil if no image is available. The
+// image stored in the initrd takes precedence over the firmware-provided one.
+func loadImage() *Image {
+	var (
+		img *Image
+		err *kernel.Error
+	)
+
+	if data, readErr := readFileFn(ImagePath); readErr == nil {
+		if img, err = DecodeBMP(data); err == nil {
+			return img
+		}
+		kfmt.Printf("[splash] unable to load %s: %s\n", ImagePath, err.Message)
+	}
+
+	if img, err = loadBGRTImage(); err != nil && err != errNoBGRTImage {
+		kfmt.Printf("[splash] unable to load BGRT image: %s\n", err.Message)
+	}
+
+	return img
+}
+
+// loadBGRTImage decodes the image that is referenced by the BGRT table.
+func loadBGRTImage() (*Image, *kernel.Error) {
+	header := lookupTableFn("BGRT")
+	if header == nil || uintptr(header.Length) < unsafe.Sizeof(table.BGRT{}) {
+		return nil, errNoBGRTImage
+	}
+
+	bgrt := (*table.BGRT)(unsafe.Pointer(header))
+	if bgrt.ImageType != table.BGRTImageTypeBitmap || bgrt.ImageAddress == 0 {
+		return nil, errNoBGRTImage
+	}
+
+	// The image size is stored in the BMP file header.
+	data, err := mapPhysFn(uintptr(bgrt.ImageAddress), bmpFileHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+
+	size := uintptr(binary.LittleEndian.Uint32(data[bmpFileSizeOff:]))
+	if size < bmpFileHeaderLen+bmpInfoHeaderLen || size > maxBGRTImageSize {
+		return nil, errBMPInvalid
+	}
+
+	if data, err = mapPhysFn(uintptr(bgrt.ImageAddress), size); err != nil {
+		return nil, err
+	}
+
+	return DecodeBMP(data)
+}
+
+// mapPhys maps the physical memory region [physAddr, physAddr+size) and
+// returns a slice with its contents.
+func mapPhys(physAddr, size uintptr) ([]byte, *kernel.Error) {
+	page, err := vmm.MapRegion(
+		mm.FrameFromAddress(physAddr),
+		size+vmm.PageOffset(physAddr),
+		vmm.FlagPresent|vmm.FlagNoExecute,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Data: page.Address() + vmm.PageOffset(physAddr),
+		Len:  int(size),
+		Cap:  int(size),
+	})), nil
+}
@@ -0,0 +1,294 @@
+package splash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/device/video/console"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/vfs"
+	"image/color"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	readFileFn = vfs.ReadFile
+	lookupTableFn = acpi.LookupTable
+	mapPhysFn = mapPhys
+	active, cons, drawer = false, nil, nil
+}
+
+// mockTextConsole emulates a text-only console.
+type mockTextConsole struct {
+	widthInChars, heightInChars uint32
+	text                        []byte
+}
+
+func (c *mockTextConsole) Dimensions(dim console.Dimension) (uint32, uint32) {
+	if dim == console.Characters {
+		return c.widthInChars, c.heightInChars
+	}
+	return c.widthInChars * 8, c.heightInChars * 16
+}
+func (c *mockTextConsole) DefaultColors() (uint8, uint8) { return 7, 0 }
+func (c *mockTextConsole) Fill(x, y, width, height uint32, _, _ uint8) {
+	c.text = make([]byte, c.widthInChars)
+	for i := range c.text {
+		c.text[i] = ' '
+	}
+}
+func (c *mockTextConsole) Scroll(console.ScrollDir, uint32) {}
+func (c *mockTextConsole) Write(ch byte, _, _ uint8, x, y uint32) {
+	if y == c.heightInChars {
+		c.text[x-1] = ch
+	}
+}
+func (c *mockTextConsole) Palette() color.Palette            { return nil }
+func (c *mockTextConsole) SetPaletteColor(uint8, color.RGBA) {}
+
+// mockFbConsole emulates a framebuffer console.
+type mockFbConsole struct {
+	mockTextConsole
+	pixels  []color.RGBA
+	flushes int
+}
+
+func newMockFbConsole(widthInChars, heightInChars uint32) *mockFbConsole {
+	c := &mockFbConsole{mockTextConsole: mockTextConsole{widthInChars: widthInChars, heightInChars: heightInChars}}
+	c.pixels = make([]color.RGBA, widthInChars*8*heightInChars*16)
+	return c
+}
+
+func (c *mockFbConsole) DrawPixels(x, y, width, height uint32, pixels []color.RGBA) {
+	consW, _ := c.Dimensions(console.Pixels)
+	for row := uint32(0); row < height; row++ {
+		copy(c.pixels[(y+row)*consW+x:(y+row)*consW+x+width], pixels[row*width:(row+1)*width])
+	}
+}
+func (c *mockFbConsole) FillPixels(x, y, width, height uint32, fill color.RGBA) {
+	consW, _ := c.Dimensions(console.Pixels)
+	for row := uint32(0); row < height; row++ {
+		for col := uint32(0); col < width; col++ {
+			c.pixels[(y+row)*consW+x+col] = fill
+		}
+	}
+}
+func (c *mockFbConsole) Flush() { c.flushes++ }
+
+func (c *mockFbConsole) pixel(x, y uint32) color.RGBA {
+	consW, _ := c.Dimensions(console.Pixels)
+	return c.pixels[y*consW+x]
+}
+
+func solidImage(width, height uint32, c color.RGBA) []color.RGBA {
+	pixels := make([]color.RGBA, width*height)
+	for i := range pixels {
+		pixels[i] = c
+	}
+	return pixels
+}
+
+func TestTextFallback(t *testing.T) {
+	defer func() {
+		kfmt.SetOutputSink(nil)
+		restoreMocks()
+	}()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+
+	for specIndex, cons := range []console.Device{nil, &mockTextConsole{widthInChars: 80, heightInChars: 25}} {
+		buf.Reset()
+		if Begin(cons, 4) {
+			t.Errorf("[spec %d] expected Begin to fall back to text mode", specIndex)
+		}
+
+		Step("detecting hardware")
+		Step("starting timers")
+		if End() {
+			t.Errorf("[spec %d] expected End to return false in text mode", specIndex)
+		}
+		Step("ignored")
+
+		exp := "[boot] [=====               ] 1/4 detecting hardware\n[boot] [==========          ] 2/4 starting timers\n"
+		if got := buf.String(); got != exp {
+			t.Errorf("[spec %d] expected output:\n%q\ngot:\n%q", specIndex, exp, got)
+		}
+	}
+}
+
+func TestGraphicalSplash(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		red   = color.RGBA{R: 255, A: 255}
+		cons  = newMockFbConsole(10, 6) // 80x96 pixels
+		label = "timers"
+	)
+
+	readFileFn = func(path string) ([]byte, *kernel.Error) {
+		if path != ImagePath {
+			t.Fatalf("expected splash image to be read from %q; got %q", ImagePath, path)
+		}
+		return encodeBMP(20, 10, 24, false, solidImage(20, 10, red)), nil
+	}
+
+	if !Begin(cons, 2) {
+		t.Fatal("expected Begin to return true")
+	}
+
+	// The image is centered and the progress bar is drawn below it
+	if got := cons.pixel(30, 43); got != red {
+		t.Errorf("expected the image to be drawn at the center of the screen; got pixel %v", got)
+	}
+
+	if got := cons.pixel(29, 43); got != backgroundColor {
+		t.Errorf("expected the screen to be cleared around the image; got pixel %v", got)
+	}
+
+	if exp := uint32(43 + 10 + barGap); barY != exp || barX != 27 || barW != 26 {
+		t.Fatalf("expected progress bar at (27, %d) with width 26; got (%d, %d) with width %d", exp, barX, barY, barW)
+	}
+
+	if got := cons.pixel(barX, barY); got != barTrackColor {
+		t.Errorf("expected an empty progress bar; got pixel %v", got)
+	}
+
+	Step(label)
+	if got := cons.pixel(barX+12, barY+barHeight-1); got != barFillColor {
+		t.Errorf("expected the first half of the progress bar to be filled; got pixel %v", got)
+	}
+
+	if got := cons.pixel(barX+13, barY); got != barTrackColor {
+		t.Errorf("expected the second half of the progress bar to be empty; got pixel %v", got)
+	}
+
+	if exp := "  timers  "; string(cons.text) != exp {
+		t.Errorf("expected label %q to be centered at the last console row; got %q", exp, string(cons.text))
+	}
+
+	Step("done")
+	Step("extra steps are ignored")
+	if got := cons.pixel(barX+barW-1, barY); got != barFillColor {
+		t.Errorf("expected the progress bar to be filled; got pixel %v", got)
+	}
+
+	if !End() || End() {
+		t.Fatal("expected End to return true only once")
+	}
+
+	for i, got := range cons.pixels {
+		if got != backgroundColor {
+			t.Fatalf("expected End to clear the screen; got pixel %v at offset %d", got, i)
+		}
+	}
+
+	if cons.flushes != 5 {
+		t.Fatalf("expected the console to be flushed 5 times; got %d", cons.flushes)
+	}
+}
+
+func TestLoadImage(t *testing.T) {
+	defer func() {
+		kfmt.SetOutputSink(nil)
+		restoreMocks()
+	}()
+
+	var (
+		buf      bytes.Buffer
+		blue     = color.RGBA{B: 255, A: 255}
+		bgrtData = encodeBMP(2, 2, 32, true, solidImage(2, 2, blue))
+		bgrt     = table.BGRT{
+			SDTHeader:    table.SDTHeader{Length: uint32(unsafe.Sizeof(table.BGRT{}))},
+			ImageType:    table.BGRTImageTypeBitmap,
+			ImageAddress: 0x1000,
+		}
+		mappedSizes []uintptr
+	)
+
+	kfmt.SetOutputSink(&buf)
+	lookupTableFn = func(name string) *table.SDTHeader {
+		if name != "BGRT" {
+			return nil
+		}
+		return &bgrt.SDTHeader
+	}
+	mapPhysFn = func(physAddr, size uintptr) ([]byte, *kernel.Error) {
+		if physAddr != 0x1000 {
+			t.Fatalf("expected the BGRT image address to be mapped; got 0x%x", physAddr)
+		}
+		mappedSizes = append(mappedSizes, size)
+		return bgrtData[:size], nil
+	}
+
+	// The initrd image takes precedence over the BGRT image
+	readFileFn = func(string) ([]byte, *kernel.Error) {
+		return encodeBMP(1, 1, 24, false, []color.RGBA{{R: 255, A: 255}}), nil
+	}
+	if img := loadImage(); img == nil || img.Width != 1 {
+		t.Fatalf("expected the initrd image to be loaded; got %v", img)
+	}
+
+	// Fall back to the BGRT image if the initrd image is missing or invalid
+	for specIndex, initrdData := range [][]byte{nil, []byte("garbage")} {
+		mappedSizes = nil
+		readFileFn = func(string) ([]byte, *kernel.Error) {
+			if initrdData == nil {
+				return nil, &kernel.Error{Module: "test", Message: "not found"}
+			}
+			return initrdData, nil
+		}
+
+		img := loadImage()
+		if img == nil || img.Width != 2 || img.Pixels[0] != blue {
+			t.Fatalf("[spec %d] expected the BGRT image to be loaded; got %v", specIndex, img)
+		}
+
+		if len(mappedSizes) != 2 || mappedSizes[0] != bmpFileHeaderLen || mappedSizes[1] != uintptr(len(bgrtData)) {
+			t.Fatalf("[spec %d] expected the BMP header and then the entire image to be mapped; got sizes %v", specIndex, mappedSizes)
+		}
+	}
+
+	if exp := "[splash] unable to load /splash.bmp: image is not a valid BMP file\n"; buf.String() != exp {
+		t.Fatalf("expected output %q; got %q", exp, buf.String())
+	}
+
+	// BGRT errors
+	readFileFn = func(string) ([]byte, *kernel.Error) { return nil, &kernel.Error{Module: "test", Message: "not found"} }
+	specs := []struct {
+		setup  func()
+		expErr *kernel.Error
+	}{
+		{func() { bgrt.ImageType = 1 }, errNoBGRTImage},
+		{func() { bgrt.ImageAddress = 0 }, errNoBGRTImage},
+		{func() { bgrt.Length = 36 }, errNoBGRTImage},
+		{func() { binary.LittleEndian.PutUint32(bgrtData[bmpFileSizeOff:], 1) }, errBMPInvalid},
+		{func() { binary.LittleEndian.PutUint32(bgrtData[bmpFileSizeOff:], maxBGRTImageSize+1) }, errBMPInvalid},
+		{func() { bgrtData[0] = 'X' }, errBMPInvalid},
+	}
+
+	for specIndex, spec := range specs {
+		bgrt.Length, bgrt.ImageType, bgrt.ImageAddress = uint32(unsafe.Sizeof(table.BGRT{})), table.BGRTImageTypeBitmap, 0x1000
+		bgrtData = encodeBMP(2, 2, 32, true, solidImage(2, 2, blue))
+		spec.setup()
+
+		if img, err := loadBGRTImage(); img != nil || err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "map failed"}
+	mapPhysFn = func(uintptr, uintptr) ([]byte, *kernel.Error) { return nil, expErr }
+	bgrtData = encodeBMP(2, 2, 32, true, solidImage(2, 2, blue))
+	if _, err := loadBGRTImage(); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	lookupTableFn = func(string) *table.SDTHeader { return nil }
+	if img := loadImage(); img != nil {
+		t.Fatalf("expected loadImage to return nil when no image is available; got %v", img)
+	}
+}
@@ -15,19 +15,42 @@ import (
 	"unsafe"
 )
 
+const (
+	// cursorHeightDivisor controls the height of the cursor underline as
+	// a fraction of the font glyph height.
+	cursorHeightDivisor = 8
+)
+
 // VesaFbConsole is a driver for a console backed by a VESA linear framebuffer.
 // The driver supports framebuffers with depth 8, 15, 16, 24 and 32 bpp. In
 // all framebuffer configurations, the driver exposes a 256-color palette whose
 // entries get mapped to the correct pixel format for the framebuffer.
 //
 // To provide text output, a font needs to be specified via the SetFont method.
+//
+// All drawing operations render into a shadow buffer in normal RAM. The
+// driver keeps track of the framebuffer region that was modified since the
+// last flush and copies it to the device framebuffer when Flush is invoked.
+// This avoids slow reads from device memory when scrolling.
 type VesaFbConsole struct {
 	bpp           uint32
 	bytesPerPixel uint32
 	fbPhysAddr    uintptr
-	fb            []uint8
 	colorInfo     *multiboot.FramebufferRGBColorInfo
 
+	// fb points to the shadow buffer that is used for rendering whereas
+	// hwFb points to the mapped device framebuffer.
+	fb   []uint8
+	hwFb []uint8
+
+	// The dirty rectangle [dirtyX0, dirtyX1) x [dirtyY0, dirtyY1) tracks
+	// the region of fb that has not been flushed yet. The X coordinates are
+	// byte offsets into a framebuffer row and the Y coordinates are
+	// framebuffer rows. An empty rectangle indicates that there are no
+	// pending changes.
+	dirtyX0, dirtyX1 uint32
+	dirtyY0, dirtyY1 uint32
+
 	// Console dimensions in pixels
 	width  uint32
 	height uint32
@@ -51,8 +74,39 @@ type VesaFbConsole struct {
 	clearChar uint16
 }
 
-// NewVesaFbConsole returns a new instance of the vesa framebuffer driver.
+var (
+	errModeSwitchUnsupported = &kernel.Error{Module: "vesa_fb_console", Message: "display adapter does not support switching modes at runtime"}
+	errUnsupportedMode       = &kernel.Error{Module: "vesa_fb_console", Message: "display mode not supported by the display adapter"}
+
+	// The following color layouts are used for 15, 16, 24 and 32 bpp
+	// framebuffers when the bootloader does not provide the RGB field
+	// masks (e.g. when the mode was set up via VBE without a color info
+	// block).
+	rgb555ColorInfo = multiboot.FramebufferRGBColorInfo{
+		RedPosition: 10, RedMaskSize: 5,
+		GreenPosition: 5, GreenMaskSize: 5,
+		BluePosition: 0, BlueMaskSize: 5,
+	}
+	rgb565ColorInfo = multiboot.FramebufferRGBColorInfo{
+		RedPosition: 11, RedMaskSize: 5,
+		GreenPosition: 5, GreenMaskSize: 6,
+		BluePosition: 0, BlueMaskSize: 5,
+	}
+	rgb888ColorInfo = multiboot.FramebufferRGBColorInfo{
+		RedPosition: 16, RedMaskSize: 8,
+		GreenPosition: 8, GreenMaskSize: 8,
+		BluePosition: 0, BlueMaskSize: 8,
+	}
+)
+
+// NewVesaFbConsole returns a new instance of the vesa framebuffer driver. If
+// colorInfo is nil or does not define any of the color field masks, the
+// driver falls back to the standard VBE direct color layout for bpp.
 func NewVesaFbConsole(width, height uint32, bpp uint8, pitch uint32, colorInfo *multiboot.FramebufferRGBColorInfo, fbPhysAddr uintptr) *VesaFbConsole {
+	if bpp > 8 && (colorInfo == nil || colorInfo.RedMaskSize|colorInfo.GreenMaskSize|colorInfo.BlueMaskSize == 0) {
+		colorInfo = defaultColorInfo(bpp)
+	}
+
 	return &VesaFbConsole{
 		bpp:           uint32(bpp),
 		bytesPerPixel: uint32(bpp+1) >> 3,
@@ -68,6 +122,19 @@ func NewVesaFbConsole(width, height uint32, bpp uint8, pitch uint32, colorInfo *
 	}
 }
 
+// defaultColorInfo returns the standard VBE direct color layout for a
+// framebuffer with the specified depth.
+func defaultColorInfo(bpp uint8) *multiboot.FramebufferRGBColorInfo {
+	switch bpp {
+	case 15:
+		return &rgb555ColorInfo
+	case 16:
+		return &rgb565ColorInfo
+	default:
+		return &rgb888ColorInfo
+	}
+}
+
 // SetFont selects a bitmap font to be used by the console.
 func (cons *VesaFbConsole) SetFont(f *font.Font) {
 	if f == nil {
@@ -79,6 +146,21 @@ func (cons *VesaFbConsole) SetFont(f *font.Font) {
 	cons.heightInChars = (cons.height - cons.offsetY) / f.GlyphHeight
 }
 
+// MapRune returns the index of the glyph in the active font that renders r.
+// Only the first 256 glyphs of a font can be addressed.
+func (cons *VesaFbConsole) MapRune(r rune) (uint8, bool) {
+	if cons.font == nil {
+		return 0, false
+	}
+
+	glyph, ok := cons.font.Glyph(r)
+	if !ok || glyph > 0xff {
+		return 0, false
+	}
+
+	return uint8(glyph), true
+}
+
 // SetLogo selects the logo to be displayed by the console. The logo colors will
 // be remapped to the end of the console's palette and space equal to the logo
 // height will be reserved at the top of the framebuffer for diplaying the logo.
@@ -123,17 +205,102 @@ func (cons *VesaFbConsole) SetLogo(l *logo.Image) {
 				cons.fb[fbOffset] = colorComp[0]
 				cons.fb[fbOffset+1] = colorComp[1]
 			case 24, 32:
-				colorComp := cons.packColor24(c)
+				colorComp := cons.packColor32(c)
 				cons.fb[fbOffset] = colorComp[0]
 				cons.fb[fbOffset+1] = colorComp[1]
 				cons.fb[fbOffset+2] = colorComp[2]
+				if cons.bytesPerPixel == 4 {
+					cons.fb[fbOffset+3] = colorComp[3]
+				}
 			}
 		}
 	}
 
+	cons.markDirty(0, 0, cons.width, l.Height)
 	cons.offsetY = l.Height
 }
 
+// SetMode switches the framebuffer to the specified resolution and depth and
+// implements ModeSetter. If bpp is 0, the current depth is retained. Switching
+// between the 8 bpp indexed mode and the direct color modes is not supported.
+// Mode switches require a display adapter implementing the Bochs display
+// interface; for other adapters, SetMode returns an error and the active mode
+// is not modified.
+//
+// Once the mode is switched, the shadow buffer is reallocated and cleared to
+// the default background color and the console dimensions are recomputed for
+// the active font. As the space reserved for the logo is released, callers
+// need to invoke SetLogo followed by SetFont to restore the logo.
+func (cons *VesaFbConsole) SetMode(width, height uint32, bpp uint8) *kernel.Error {
+	if bpp == 0 {
+		bpp = uint8(cons.bpp)
+	}
+
+	switch {
+	case cons.fb == nil || !dispiPresent():
+		return errModeSwitchUnsupported
+	case width == 0 || height == 0 || width%8 != 0 || (bpp == 8) != (cons.bpp == 8):
+		return errUnsupportedMode
+	case bpp != 8 && bpp != 15 && bpp != 16 && bpp != 24 && bpp != 32:
+		return errUnsupportedMode
+	}
+
+	if maxWidth, maxHeight, maxBpp := dispiMaxMode(); width > maxWidth || height > maxHeight || bpp > maxBpp {
+		return errUnsupportedMode
+	}
+
+	var (
+		bytesPerPixel = uint32(bpp+1) >> 3
+		pitch         = width * bytesPerPixel
+		fbSize        = pitch * height
+		hwFb          = cons.hwFb
+		err           *kernel.Error
+	)
+
+	// The existing framebuffer mapping is reused if it is large enough
+	// to fit the new mode. The mapping is established before switching
+	// modes so that a mapping error leaves the console intact.
+	if uintptr(fbSize) > uintptr(cap(hwFb)) {
+		if hwFb, _, err = cons.mapFramebuffer(fbSize); err != nil {
+			return err
+		}
+	}
+
+	prevWidth, prevHeight, prevBpp := dispiMode()
+	dispiSetMode(width, height, bpp)
+	if gotWidth, gotHeight, gotBpp := dispiMode(); gotWidth != width || gotHeight != height || gotBpp != bpp {
+		// Restore the previous mode and redraw the console contents
+		// as the adapter clears the framebuffer when switching modes.
+		dispiSetMode(prevWidth, prevHeight, prevBpp)
+		cons.markDirty(0, 0, cons.width, cons.height)
+		return errUnsupportedMode
+	}
+
+	if uint32(bpp) != cons.bpp && bpp != 8 {
+		cons.colorInfo = defaultColorInfo(bpp)
+	}
+
+	cons.width, cons.height, cons.pitch = width, height, pitch
+	cons.bpp, cons.bytesPerPixel = uint32(bpp), bytesPerPixel
+	cons.hwFb = hwFb[:fbSize]
+	cons.fb = make([]uint8, fbSize)
+	cons.offsetY = 0
+	cons.dirtyX0, cons.dirtyX1, cons.dirtyY0, cons.dirtyY1 = 0, 0, 0, 0
+	cons.SetFont(cons.font)
+
+	switch cons.bpp {
+	case 8:
+		cons.fill8(0, 0, width, height, cons.defaultBg)
+	case 15, 16:
+		cons.fill16(0, 0, width, height, cons.defaultBg)
+	case 24, 32:
+		cons.fill24(0, 0, width, height, cons.defaultBg)
+	}
+	cons.markDirty(0, 0, width, height)
+
+	return nil
+}
+
 // Dimensions returns the console width and height in the specified dimension.
 func (cons *VesaFbConsole) Dimensions(dim Dimension) (uint32, uint32) {
 	switch dim {
@@ -190,6 +357,8 @@ func (cons *VesaFbConsole) Fill(x, y, width, height uint32, _, bg uint8) {
 	case 24, 32:
 		cons.fill24(pX, pY, pW, pH, bg)
 	}
+
+	cons.markDirty(pX, pY+cons.offsetY, pW, pH)
 }
 
 // fill8 implements a fill operation using an 8bpp framebuffer.
@@ -216,13 +385,16 @@ func (cons *VesaFbConsole) fill16(pX, pY, pW, pH uint32, bg uint8) {
 
 // fill24 implements a fill operation using a 24/32bpp framebuffer.
 func (cons *VesaFbConsole) fill24(pX, pY, pW, pH uint32, bg uint8) {
-	comp := cons.packColor24(bg)
+	comp := cons.packColor32(bg)
 	fbRowOffset := cons.fbOffset(pX, pY)
 	for ; pH > 0; pH, fbRowOffset = pH-1, fbRowOffset+cons.pitch {
 		for fbOffset := fbRowOffset; fbOffset < fbRowOffset+pW*cons.bytesPerPixel; fbOffset += cons.bytesPerPixel {
 			cons.fb[fbOffset] = comp[0]
 			cons.fb[fbOffset+1] = comp[1]
 			cons.fb[fbOffset+2] = comp[2]
+			if cons.bytesPerPixel == 4 {
+				cons.fb[fbOffset+3] = comp[3]
+			}
 		}
 	}
 }
@@ -250,6 +422,78 @@ func (cons *VesaFbConsole) Scroll(dir ScrollDir, lines uint32) {
 			cons.fb[i] = cons.fb[i-offset]
 		}
 	}
+
+	cons.markDirty(0, cons.offsetY, cons.width, cons.height-cons.offsetY)
+}
+
+// ScrollRegion scrolls the contents of the text rows from top to bottom
+// (inclusive) to the specified direction. Rows outside the region are not
+// modified. Both top and bottom are 1-based. The caller is responsible for
+// updating the contents of the rows that were scrolled into the region.
+func (cons *VesaFbConsole) ScrollRegion(dir ScrollDir, top, bottom, lines uint32) {
+	if cons.font == nil || top < 1 || top > bottom || bottom > cons.heightInChars || lines == 0 || lines > bottom-top+1 {
+		return
+	}
+
+	var (
+		startOffset = cons.fbOffset(0, (top-1)*cons.font.GlyphHeight)
+		endOffset   = cons.fbOffset(0, bottom*cons.font.GlyphHeight)
+		offset      = lines * cons.font.GlyphHeight * cons.pitch
+	)
+
+	switch dir {
+	case ScrollDirUp:
+		copy(cons.fb[startOffset:endOffset-offset], cons.fb[startOffset+offset:endOffset])
+	case ScrollDirDown:
+		copy(cons.fb[startOffset+offset:endOffset], cons.fb[startOffset:endOffset-offset])
+	}
+
+	cons.markDirty(0, cons.offsetY+(top-1)*cons.font.GlyphHeight, cons.width, (bottom-top+1)*cons.font.GlyphHeight)
+}
+
+// markDirty adds the rectangle with its top-left corner at pixel (pX, pY) and
+// the specified pixel dimensions to the region that needs to be flushed.
+func (cons *VesaFbConsole) markDirty(pX, pY, pW, pH uint32) {
+	if pW == 0 || pH == 0 {
+		return
+	}
+
+	x0, x1 := pX*cons.bytesPerPixel, (pX+pW)*cons.bytesPerPixel
+	y0, y1 := pY, pY+pH
+
+	if cons.dirtyX0 == cons.dirtyX1 {
+		cons.dirtyX0, cons.dirtyX1, cons.dirtyY0, cons.dirtyY1 = x0, x1, y0, y1
+		return
+	}
+
+	if x0 < cons.dirtyX0 {
+		cons.dirtyX0 = x0
+	}
+	if x1 > cons.dirtyX1 {
+		cons.dirtyX1 = x1
+	}
+	if y0 < cons.dirtyY0 {
+		cons.dirtyY0 = y0
+	}
+	if y1 > cons.dirtyY1 {
+		cons.dirtyY1 = y1
+	}
+}
+
+// Flush copies the framebuffer region that was modified since the last call
+// to Flush from the shadow buffer to the device framebuffer.
+func (cons *VesaFbConsole) Flush() {
+	if cons.dirtyX0 == cons.dirtyX1 {
+		return
+	}
+
+	if cons.hwFb != nil {
+		for y, rowOffset := cons.dirtyY0, cons.dirtyY0*cons.pitch; y < cons.dirtyY1; y, rowOffset = y+1, rowOffset+cons.pitch {
+			copy(cons.hwFb[rowOffset+cons.dirtyX0:rowOffset+cons.dirtyX1], cons.fb[rowOffset+cons.dirtyX0:rowOffset+cons.dirtyX1])
+		}
+	}
+
+	cons.dirtyX0, cons.dirtyX1, cons.dirtyY0, cons.dirtyY1 = 0, 0, 0, 0
 }
 
 // Write a char to the specified location. If fg or bg exceed the supported
@@ -271,6 +515,173 @@ func (cons *VesaFbConsole) Write(ch byte, fg, bg uint8, x, y uint32) {
 	case 24, 32:
 		cons.write24(ch, fg, bg, pX, pY)
 	}
+
+	cons.markDirty(pX, pY+cons.offsetY, cons.font.GlyphWidth, cons.font.GlyphHeight)
+}
+
+// DrawCursor renders a cursor as an underline at the bottom of the character
+// cell at (x, y) using the fg color. Both x and y coordinates are 1-based.
+func (cons *VesaFbConsole) DrawCursor(x, y uint32, fg uint8) {
+	if x < 1 || x > cons.widthInChars || y < 1 || y > cons.heightInChars || cons.font == nil {
+		return
+	}
+
+	// The underline height scales with the font so that the cursor remains
+	// visible with large glyphs.
+	pH := cons.font.GlyphHeight / cursorHeightDivisor
+	if pH == 0 {
+		pH = 1
+	}
+
+	pX := (x - 1) * cons.font.GlyphWidth
+	pY := y*cons.font.GlyphHeight - pH
+	pW := cons.font.GlyphWidth
+	switch cons.bpp {
+	case 8:
+		cons.fill8(pX, pY, pW, pH, fg)
+	case 15, 16:
+		cons.fill16(pX, pY, pW, pH, fg)
+	case 24, 32:
+		cons.fill24(pX, pY, pW, pH, fg)
+	}
+
+	cons.markDirty(pX, pY+cons.offsetY, pW, pH)
+}
+
+// DrawPixels copies a width x height block of pixels, stored in row-major
+// order, to the framebuffer region with its top-left corner at pixel (x, y).
+// The coordinates are 0-based and are not affected by the space reserved for
+// the logo. Pixels outside the framebuffer are clipped.
+//
+// On 8bpp framebuffers, each pixel is rendered using the closest of the
+// standard EGA colors at the start of the console palette.
+func (cons *VesaFbConsole) DrawPixels(x, y, width, height uint32, pixels []color.RGBA) {
+	if uint32(len(pixels)) < width*height {
+		return
+	}
+
+	clipW, clipH := cons.clipPixels(x, y, width, height)
+	for row, fbRowOffset := uint32(0), y*cons.pitch+x*cons.bytesPerPixel; row < clipH; row, fbRowOffset = row+1, fbRowOffset+cons.pitch {
+		rowPixels := pixels[row*width : row*width+clipW]
+		for col, fbOffset := 0, fbRowOffset; col < len(rowPixels); col, fbOffset = col+1, fbOffset+cons.bytesPerPixel {
+			cons.putPixel(fbOffset, cons.pixelValue(rowPixels[col]))
+		}
+	}
+
+	cons.markDirty(x, y, clipW, clipH)
+}
+
+// FillPixels sets the framebuffer region with its top-left corner at pixel
+// (x, y) to c. The coordinates are 0-based and are not affected by the space
+// reserved for the logo. Pixels outside the framebuffer are clipped.
+func (cons *VesaFbConsole) FillPixels(x, y, width, height uint32, c color.RGBA) {
+	clipW, clipH := cons.clipPixels(x, y, width, height)
+	packed := cons.pixelValue(c)
+	for row, fbRowOffset := uint32(0), y*cons.pitch+x*cons.bytesPerPixel; row < clipH; row, fbRowOffset = row+1, fbRowOffset+cons.pitch {
+		for col, fbOffset := uint32(0), fbRowOffset; col < clipW; col, fbOffset = col+1, fbOffset+cons.bytesPerPixel {
+			cons.putPixel(fbOffset, packed)
+		}
+	}
+
+	cons.markDirty(x, y, clipW, clipH)
+}
+
+// ReadPixels copies the pixels of the framebuffer region with its top-left
+// corner at pixel (x, y) to pixels in row-major order. The coordinates are
+// 0-based and are not affected by the space reserved for the logo. Pixels
+// outside the framebuffer are not copied. As the pixels are read from the
+// shadow buffer, ReadPixels also returns any changes that have not been
+// flushed yet.
+func (cons *VesaFbConsole) ReadPixels(x, y, width, height uint32, pixels []color.RGBA) {
+	if uint32(len(pixels)) < width*height {
+		return
+	}
+
+	clipW, clipH := cons.clipPixels(x, y, width, height)
+	for row, fbRowOffset := uint32(0), y*cons.pitch+x*cons.bytesPerPixel; row < clipH; row, fbRowOffset = row+1, fbRowOffset+cons.pitch {
+		rowPixels := pixels[row*width : row*width+clipW]
+		for col, fbOffset := 0, fbRowOffset; col < len(rowPixels); col, fbOffset = col+1, fbOffset+cons.bytesPerPixel {
+			rowPixels[col] = cons.getPixel(fbOffset)
+		}
+	}
+}
+
+// getPixel returns the color of the framebuffer pixel at fbOffset.
+func (cons *VesaFbConsole) getPixel(fbOffset uint32) color.RGBA {
+	if cons.bpp == 8 {
+		c := cons.palette[cons.fb[fbOffset]].(color.RGBA)
+		c.A = 255
+		return c
+	}
+
+	var packed uint32
+	for i := cons.bytesPerPixel; i > 0; i-- {
+		packed = packed<<8 | uint32(cons.fb[fbOffset+i-1])
+	}
+
+	return color.RGBA{
+		R: unpackComponent(packed, cons.colorInfo.RedPosition, cons.colorInfo.RedMaskSize),
+		G: unpackComponent(packed, cons.colorInfo.GreenPosition, cons.colorInfo.GreenMaskSize),
+		B: unpackComponent(packed, cons.colorInfo.BluePosition, cons.colorInfo.BlueMaskSize),
+		A: 255,
+	}
+}
+
+// clipPixels returns the dimensions of the part of the region with its
+// top-left corner at pixel (x, y) that lies inside the framebuffer.
+func (cons *VesaFbConsole) clipPixels(x, y, width, height uint32) (uint32, uint32) {
+	if x >= cons.width || y >= cons.height {
+		return 0, 0
+	}
+
+	if width > cons.width-x {
+		width = cons.width - x
+	}
+
+	if height > cons.height-y {
+		height = cons.height - y
+	}
+
+	return width, height
+}
+
+// pixelValue returns the framebuffer representation of c.
+func (cons *VesaFbConsole) pixelValue(c color.RGBA) uint32 {
+	if cons.bpp == 8 {
+		return uint32(cons.closestEGAColor(c))
+	}
+
+	return cons.packRGBA(c)
+}
+
+// closestEGAColor returns the index of the EGA palette entry that is closest
+// to c.
+func (cons *VesaFbConsole) closestEGAColor(c color.RGBA) uint8 {
+	var (
+		best     uint8
+		bestDist = ^uint32(0)
+	)
+
+	for index := 0; index < 16 && index < len(cons.palette); index++ {
+		entry, ok := cons.palette[index].(color.RGBA)
+		if !ok {
+			continue
+		}
+
+		dR, dG, dB := int32(entry.R)-int32(c.R), int32(entry.G)-int32(c.G), int32(entry.B)-int32(c.B)
+		if dist := uint32(dR*dR + dG*dG + dB*dB); dist < bestDist {
+			best, bestDist = uint8(index), dist
+		}
+	}
+
+	return best
+}
+
+// putPixel stores a pixel value at the specified framebuffer offset.
+func (cons *VesaFbConsole) putPixel(fbOffset, packed uint32) {
+	for i := uint32(0); i < cons.bytesPerPixel; i, packed = i+1, packed>>8 {
+		cons.fb[fbOffset+i] = uint8(packed)
+	}
 }
 
 // write8 writes a character using an 8bpp framebuffer.
@@ -351,8 +762,8 @@ func (cons *VesaFbConsole) write24(glyphIndex, fg, bg uint8, pX, pY uint32) {
 		fbOffset    uint32
 		x, y        uint32
 		mask        uint8
-		fgComp      = cons.packColor24(fg)
-		bgComp      = cons.packColor24(bg)
+		fgComp      = cons.packColor32(fg)
+		bgComp      = cons.packColor32(bg)
 	)
 
 	for y = 0; y < cons.font.GlyphHeight; y, fbRowOffset, fontOffset = y+1, fbRowOffset+cons.pitch, fontOffset+1 {
@@ -373,10 +784,16 @@ func (cons *VesaFbConsole) write24(glyphIndex, fg, bg uint8, pX, pY uint32) {
 				cons.fb[fbOffset] = fgComp[0]
 				cons.fb[fbOffset+1] = fgComp[1]
 				cons.fb[fbOffset+2] = fgComp[2]
+				if cons.bytesPerPixel == 4 {
+					cons.fb[fbOffset+3] = fgComp[3]
+				}
 			} else {
 				cons.fb[fbOffset] = bgComp[0]
 				cons.fb[fbOffset+1] = bgComp[1]
 				cons.fb[fbOffset+2] = bgComp[2]
+				if cons.bytesPerPixel == 4 {
+					cons.fb[fbOffset+3] = bgComp[3]
+				}
 			}
 		}
 	}
@@ -388,41 +805,80 @@ func (cons *VesaFbConsole) fbOffset(x, y uint32) uint32 {
 	return ((y + cons.offsetY) * cons.pitch) + (x * cons.bytesPerPixel)
 }
 
-// packColor24 encodes a palette color into the pixel format required by a
-// 24/32 bpp framebuffer.
-func (cons *VesaFbConsole) packColor24(colorIndex uint8) [3]uint8 {
-	var (
-		c             = cons.palette[colorIndex].(color.RGBA)
-		packed uint32 = 0 |
-			(uint32(c.R>>(8-cons.colorInfo.RedMaskSize)) << cons.colorInfo.RedPosition) |
-			(uint32(c.G>>(8-cons.colorInfo.GreenMaskSize)) << cons.colorInfo.GreenPosition) |
-			(uint32(c.B>>(8-cons.colorInfo.BlueMaskSize)) << cons.colorInfo.BluePosition)
-	)
-
-	return [3]uint8{
+// packColor32 encodes a palette color into the pixel format required by a
+// 24/32 bpp framebuffer. For 24 bpp framebuffers, only the first 3 bytes of
+// the returned value are used.
+func (cons *VesaFbConsole) packColor32(colorIndex uint8) [4]uint8 {
+	packed := cons.packColor(colorIndex)
+	return [4]uint8{
 		uint8(packed),
 		uint8(packed >> 8),
 		uint8(packed >> 16),
+		uint8(packed >> 24),
 	}
 }
 
 // packColor16 encodes a palette color into the pixel format required by a
 // 15/16 bpp framebuffer.
 func (cons *VesaFbConsole) packColor16(colorIndex uint8) [2]uint8 {
-	var (
-		c             = cons.palette[colorIndex].(color.RGBA)
-		packed uint16 = 0 |
-			(uint16(c.R>>(8-cons.colorInfo.RedMaskSize)) << cons.colorInfo.RedPosition) |
-			(uint16(c.G>>(8-cons.colorInfo.GreenMaskSize)) << cons.colorInfo.GreenPosition) |
-			(uint16(c.B>>(8-cons.colorInfo.BlueMaskSize)) << cons.colorInfo.BluePosition)
-	)
-
+	packed := cons.packColor(colorIndex)
 	return [2]uint8{
 		uint8(packed),
 		uint8(packed >> 8),
 	}
 }
 
+// packColor encodes a palette color into a pixel value using the color field
+// positions and mask sizes reported by the bootloader.
+func (cons *VesaFbConsole) packColor(colorIndex uint8) uint32 {
+	return cons.packRGBA(cons.palette[colorIndex].(color.RGBA))
+}
+
+// packRGBA encodes c into a pixel value using the color field positions and
+// mask sizes reported by the bootloader.
+func (cons *VesaFbConsole) packRGBA(c color.RGBA) uint32 {
+	return packComponent(c.R, cons.colorInfo.RedPosition, cons.colorInfo.RedMaskSize) |
+		packComponent(c.G, cons.colorInfo.GreenPosition, cons.colorInfo.GreenMaskSize) |
+		packComponent(c.B, cons.colorInfo.BluePosition, cons.colorInfo.BlueMaskSize)
+}
+
+// packComponent scales an 8-bit color component to a field with the specified
+// width (in bits) and shifts it to the field position.
+func packComponent(value, position, maskSize uint8) uint32 {
+	var scaled uint32
+	if maskSize >= 8 {
+		// Replicate the most significant bits into the extra field bits
+		// so that full intensity maps to an all-ones field value.
+		scaled = uint32(value) << (maskSize - 8)
+		scaled |= scaled >> 8
+	} else {
+		scaled = uint32(value >> (8 - maskSize))
+	}
+
+	return scaled << position
+}
+
+// unpackComponent extracts a color component from a packed pixel value and
+// scales it to 8 bits. The field bits are replicated into the low bits of
+// narrow fields so that an all-ones field value maps to full intensity.
+func unpackComponent(packed uint32, position, maskSize uint8) uint8 {
+	if maskSize == 0 {
+		return 0
+	}
+
+	var (
+		field    = (packed >> position) & (1<<maskSize - 1)
+		expanded uint32
+		bits     uint8
+	)
+
+	for ; bits < 8; bits += maskSize {
+		expanded = expanded<<maskSize | field
+	}
+
+	return uint8(expanded >> (bits - 8))
+}
+
 // Palette returns the active color palette for this console.
 func (cons *VesaFbConsole) Palette() color.Palette {
 	return cons.palette
@@ -487,6 +943,8 @@ func (cons *VesaFbConsole) replace16(src, dst color.RGBA) {
 			cons.fb[fbOffset+1] = dstComp[1]
 		}
 	}
+
+	cons.markDirty(0, cons.offsetY, cons.width, cons.height-cons.offsetY)
 }
 
 // replace24 replaces all srcColor values with dstColor using a 24/32bpp
@@ -494,19 +952,25 @@ func (cons *VesaFbConsole) replace16(src, dst color.RGBA) {
 func (cons *VesaFbConsole) replace24(src, dst color.RGBA) {
 	tmp := cons.palette[0]
 	cons.palette[0] = src
-	srcComp := cons.packColor24(0)
+	srcComp := cons.packColor32(0)
 	cons.palette[0] = dst
-	dstComp := cons.packColor24(0)
+	dstComp := cons.packColor32(0)
 	cons.palette[0] = tmp
 	for fbOffset := cons.fbOffset(0, 0); fbOffset < uint32(len(cons.fb)); fbOffset += cons.bytesPerPixel {
 		if cons.fb[fbOffset] == srcComp[0] &&
 			cons.fb[fbOffset+1] == srcComp[1] &&
-			cons.fb[fbOffset+2] == srcComp[2] {
+			cons.fb[fbOffset+2] == srcComp[2] &&
+			(cons.bytesPerPixel == 3 || cons.fb[fbOffset+3] == srcComp[3]) {
 			cons.fb[fbOffset] = dstComp[0]
 			cons.fb[fbOffset+1] = dstComp[1]
 			cons.fb[fbOffset+2] = dstComp[2]
+			if cons.bytesPerPixel == 4 {
+				cons.fb[fbOffset+3] = dstComp[3]
+			}
 		}
 	}
+
+	cons.markDirty(0, cons.offsetY, cons.width, cons.height-cons.offsetY)
 }
 
 // loadDefaultPalette is called during driver initialization to setup the
@@ -558,25 +1022,20 @@ func (cons *VesaFbConsole) DriverVersion() (uint16, uint16, uint16) {
 
 // DriverInit initializes this driver.
 func (cons *VesaFbConsole) DriverInit(w io.Writer) *kernel.Error {
-	// Map the framebuffer so we can write to it
-	fbSize := uintptr(cons.height * cons.pitch)
-	fbPage, err := mapRegionFn(
-		mm.Frame(cons.fbPhysAddr>>mm.PageShift),
-		fbSize,
-		vmm.FlagPresent|vmm.FlagRW,
-	)
-
+	fbSize := cons.height * cons.pitch
+	hwFb, fbAddr, err := cons.mapFramebuffer(fbSize)
 	if err != nil {
 		return err
 	}
 
-	cons.fb = *(*[]uint8)(unsafe.Pointer(&reflect.SliceHeader{
-		Len:  int(fbSize),
-		Cap:  int(fbSize),
-		Data: fbPage.Address(),
-	}))
+	// Allocate the shadow buffer and mark the entire framebuffer as dirty
+	// so that the first flush synchronizes the device with the buffer
+	// contents.
+	cons.hwFb = hwFb
+	cons.fb = make([]uint8, fbSize)
+	cons.markDirty(0, 0, cons.width, cons.height)
 
-	kfmt.Fprintf(w, "mapped framebuffer to 0x%x\n", fbPage.Address())
+	kfmt.Fprintf(w, "mapped framebuffer to 0x%x\n", fbAddr)
 	kfmt.Fprintf(w, "framebuffer dimensions: %dx%dx%d\n", cons.width, cons.height, cons.bpp)
 
 	cons.loadDefaultPalette()
@@ -584,12 +1043,49 @@ func (cons *VesaFbConsole) DriverInit(w io.Writer) *kernel.Error {
 	return nil
 }
 
-// probeForVesaFbConsole checks for the presence of a vga text console.
+// mapFramebuffer maps the first size bytes of the device framebuffer and
+// returns a slice with the mapped region and its virtual address. The
+// framebuffer address reported by the bootloader is not guaranteed to be
+// page-aligned.
+func (cons *VesaFbConsole) mapFramebuffer(size uint32) ([]uint8, uintptr, *kernel.Error) {
+	fbPageOffset := vmm.PageOffset(cons.fbPhysAddr)
+	fbPage, err := mapRegionFn(
+		mm.Frame(cons.fbPhysAddr>>mm.PageShift),
+		uintptr(size)+fbPageOffset,
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute,
+	)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fbAddr := fbPage.Address() + fbPageOffset
+	return *(*[]uint8)(unsafe.Pointer(&reflect.SliceHeader{
+		Len:  int(size),
+		Cap:  int(size),
+		Data: fbAddr,
+	})), fbAddr, nil
+}
+
+// probeForVesaFbConsole checks for the presence of a linear framebuffer with
+// a depth supported by the driver.
 func probeForVesaFbConsole() device.Driver {
 	var drv device.Driver
 
 	fbInfo := getFramebufferInfoFn()
-	if fbInfo.Type == multiboot.FramebufferTypeIndexed || fbInfo.Type == multiboot.FramebufferTypeRGB {
+	if fbInfo == nil {
+		return nil
+	}
+
+	var supported bool
+	switch fbInfo.Type {
+	case multiboot.FramebufferTypeIndexed:
+		supported = fbInfo.Bpp == 8
+	case multiboot.FramebufferTypeRGB:
+		supported = fbInfo.Bpp == 15 || fbInfo.Bpp == 16 || fbInfo.Bpp == 24 || fbInfo.Bpp == 32
+	}
+
+	if supported {
 		drv = NewVesaFbConsole(
 			fbInfo.Width, fbInfo.Height,
 			fbInfo.Bpp, fbInfo.Pitch,
@@ -603,6 +1099,7 @@ func probeForVesaFbConsole() device.Driver {
 
 func init() {
 	device.RegisterDriver(&device.DriverInfo{
+		Name:  "vesa_fb_console",
 		Order: device.DetectOrderEarly,
 		Probe: probeForVesaFbConsole,
 	})
@@ -15,6 +15,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"unsafe"
 )
 
 func TestVesaFbTextDimensions(t *testing.T) {
@@ -1436,6 +1437,288 @@ func TestVesaFbReplace24(t *testing.T) {
 	}
 }
 
+func TestVesaFbFlush(t *testing.T) {
+	var (
+		consW, consH uint32 = 16, 16
+		pitch               = consW * 2
+		hwFb                = make([]uint8, consH*pitch)
+	)
+
+	cons := NewVesaFbConsole(consW, consH, 16, pitch, nil, 0)
+	cons.fb = make([]uint8, consH*pitch)
+	cons.hwFb = hwFb
+	cons.offsetY = 2
+	cons.SetFont(mockFont8x10)
+	cons.loadDefaultPalette()
+
+	// Flushing without pending changes should be a no-op
+	for i := range cons.fb {
+		cons.fb[i] = 0xff
+	}
+	cons.Flush()
+	if !bytes.Equal(hwFb, make([]uint8, len(hwFb))) {
+		t.Fatal("expected Flush to be a no-op when there are no pending changes")
+	}
+
+	specs := []struct {
+		draw func()
+		// expected dirty rectangle; X coordinates are byte offsets
+		expX0, expX1, expY0, expY1 uint32
+	}{
+		{
+			func() { cons.Write(1, 7, 0, 2, 1) },
+			16, 32, 2, 12,
+		},
+		{
+			func() {
+				cons.Write(1, 7, 0, 2, 1)
+				cons.Fill(1, 1, 1, 1, 7, 0)
+			},
+			0, 32, 2, 12,
+		},
+		{
+			func() { cons.Scroll(ScrollDirUp, 1) },
+			0, 32, 2, 16,
+		},
+		{
+			func() { cons.DrawCursor(2, 1, 7) },
+			16, 32, 11, 12,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		for i := range hwFb {
+			hwFb[i] = 0
+		}
+		for i := range cons.fb {
+			cons.fb[i] = 0xff
+		}
+
+		spec.draw()
+		if cons.dirtyX0 != spec.expX0 || cons.dirtyX1 != spec.expX1 || cons.dirtyY0 != spec.expY0 || cons.dirtyY1 != spec.expY1 {
+			t.Errorf("[spec %d] expected dirty rect [%d, %d) x [%d, %d); got [%d, %d) x [%d, %d)",
+				specIndex, spec.expX0, spec.expX1, spec.expY0, spec.expY1,
+				cons.dirtyX0, cons.dirtyX1, cons.dirtyY0, cons.dirtyY1,
+			)
+		}
+
+		cons.Flush()
+		for y := uint32(0); y < consH; y++ {
+			for x := uint32(0); x < pitch; x++ {
+				offset := y*pitch + x
+				inDirtyRect := x >= spec.expX0 && x < spec.expX1 && y >= spec.expY0 && y < spec.expY1
+				if inDirtyRect && hwFb[offset] != cons.fb[offset] {
+					t.Errorf("[spec %d] expected byte at offset %d to be flushed", specIndex, offset)
+				} else if !inDirtyRect && hwFb[offset] != 0 {
+					t.Errorf("[spec %d] expected byte at offset %d outside the dirty rect not to be flushed", specIndex, offset)
+				}
+			}
+		}
+
+		if cons.dirtyX0 != cons.dirtyX1 {
+			t.Errorf("[spec %d] expected Flush to reset the dirty rect", specIndex)
+		}
+	}
+}
+
+func TestVesaFbDrawCursor(t *testing.T) {
+	var (
+		consW, consH uint32 = 16, 16
+		fg           uint8  = 3
+	)
+
+	cons := NewVesaFbConsole(consW, consH, 8, consW, nil, 0)
+	cons.fb = make([]uint8, consW*consH)
+	cons.SetFont(mockFont8x10)
+
+	// Requests for cells outside the console are ignored
+	cons.DrawCursor(3, 1, fg)
+	cons.DrawCursor(1, 2, fg)
+	if !bytes.Equal(cons.fb, make([]uint8, len(cons.fb))) {
+		t.Fatal("expected DrawCursor to ignore cells outside the console")
+	}
+
+	// The cursor is rendered as an underline in the last glyph row
+	cons.DrawCursor(2, 1, fg)
+	for y := uint32(0); y < consH; y++ {
+		for x := uint32(0); x < consW; x++ {
+			exp := uint8(0)
+			if y == 9 && x >= 8 {
+				exp = fg
+			}
+
+			if got := cons.fb[y*consW+x]; got != exp {
+				t.Fatalf("expected pixel (%d, %d) to be %d; got %d", x, y, exp, got)
+			}
+		}
+	}
+}
+
+func TestVesaFbDrawPixels(t *testing.T) {
+	defer func() {
+		portWriteByteFn = cpu.PortWriteByte
+	}()
+	portWriteByteFn = func(_ uint16, _ uint8) {}
+
+	var (
+		consW, consH uint32 = 4, 3
+		red                 = color.RGBA{R: 250, G: 10, B: 10}
+		blue                = color.RGBA{R: 0, G: 0, B: 120}
+		white               = color.RGBA{R: 255, G: 255, B: 255}
+	)
+
+	specs := []struct {
+		bpp    uint8
+		expRed []uint8
+	}{
+		{8, []uint8{12}},
+		{16, []uint8{0x41, 0xf8}},
+		{24, []uint8{10, 10, 250}},
+		{32, []uint8{10, 10, 250, 0}},
+	}
+
+	for specIndex, spec := range specs {
+		bytesPerPixel := uint32(spec.bpp+1) >> 3
+		cons := NewVesaFbConsole(consW, consH, spec.bpp, consW*bytesPerPixel, nil, 0)
+		cons.fb = make([]uint8, consW*consH*bytesPerPixel)
+		cons.loadDefaultPalette()
+
+		// Draw a 3x2 image so that its right column is clipped
+		cons.FillPixels(0, 0, consW, consH, blue)
+		cons.DrawPixels(2, 1, 3, 2, []color.RGBA{red, red, white, red, red, white})
+
+		// Requests that are fully outside the framebuffer or that do not
+		// provide enough pixels are ignored
+		cons.FillPixels(consW, 0, 1, 1, white)
+		cons.DrawPixels(0, 0, 2, 2, []color.RGBA{white})
+
+		expBlue := make([]uint8, bytesPerPixel)
+		for i, packed := 0, cons.pixelValue(blue); i < len(expBlue); i, packed = i+1, packed>>8 {
+			expBlue[i] = uint8(packed)
+		}
+
+		for y := uint32(0); y < consH; y++ {
+			for x := uint32(0); x < consW; x++ {
+				exp := expBlue
+				if x >= 2 && y >= 1 {
+					exp = spec.expRed
+				}
+
+				offset := (y*consW + x) * bytesPerPixel
+				if got := cons.fb[offset : offset+bytesPerPixel]; !bytes.Equal(got, exp) {
+					t.Errorf("[spec %d] expected pixel (%d, %d) to be %v; got %v", specIndex, x, y, exp, got)
+				}
+			}
+		}
+
+		if cons.dirtyX0 != 0 || cons.dirtyX1 != consW*bytesPerPixel || cons.dirtyY0 != 0 || cons.dirtyY1 != consH {
+			t.Errorf("[spec %d] expected the entire framebuffer to be marked as dirty", specIndex)
+		}
+	}
+}
+
+func TestVesaFbReadPixels(t *testing.T) {
+	defer func() {
+		portWriteByteFn = cpu.PortWriteByte
+	}()
+	portWriteByteFn = func(_ uint16, _ uint8) {}
+
+	var (
+		consW, consH uint32 = 4, 3
+		black               = color.RGBA{A: 255}
+		cyan                = color.RGBA{G: 255, B: 255, A: 255}
+		white               = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+		magenta             = color.RGBA{R: 255, B: 255, A: 255}
+		unset               = color.RGBA{R: 1, G: 2, B: 3, A: 4}
+	)
+
+	for specIndex, bpp := range []uint8{8, 15, 16, 24, 32} {
+		bytesPerPixel := uint32(bpp+1) >> 3
+		cons := NewVesaFbConsole(consW, consH, bpp, consW*bytesPerPixel, nil, 0)
+		cons.fb = make([]uint8, consW*consH*bytesPerPixel)
+		cons.loadDefaultPalette()
+
+		cons.FillPixels(0, 0, consW, consH, black)
+		cons.DrawPixels(1, 1, 2, 2, []color.RGBA{cyan, white, magenta, cyan})
+
+		// Read a 4x3 region so that its right column is clipped
+		got := make([]color.RGBA, 12)
+		for i := range got {
+			got[i] = unset
+		}
+		cons.ReadPixels(1, 0, 4, 3, got)
+
+		exp := []color.RGBA{
+			black, black, black, unset,
+			cyan, white, black, unset,
+			magenta, cyan, black, unset,
+		}
+
+		for i := range exp {
+			if got[i] != exp[i] {
+				t.Errorf("[spec %d] expected pixel %d to be %v; got %v", specIndex, i, exp[i], got[i])
+			}
+		}
+
+		// Requests that do not provide enough space are ignored
+		got[0] = unset
+		cons.ReadPixels(0, 0, 2, 2, got[:3])
+		if got[0] != unset {
+			t.Errorf("[spec %d] expected ReadPixels to ignore requests with an undersized pixel slice", specIndex)
+		}
+	}
+}
+
+func TestVesaFbUnpackComponent(t *testing.T) {
+	specs := []struct {
+		packed             uint32
+		position, maskSize uint8
+		exp                uint8
+	}{
+		{0x1f << 11, 11, 5, 255},
+		{0x10, 0, 5, 132},
+		{0x3f << 5, 5, 6, 255},
+		{0x20 << 5, 5, 6, 130},
+		{0xff0000, 16, 8, 255},
+		{0x80ff0000, 16, 8, 255},
+		{0x3ff << 20, 20, 10, 255},
+		{0x200 << 20, 20, 10, 128},
+		{0xffffffff, 0, 0, 0},
+	}
+
+	for specIndex, spec := range specs {
+		if got := unpackComponent(spec.packed, spec.position, spec.maskSize); got != spec.exp {
+			t.Errorf("[spec %d] expected unpacked component to be %d; got %d", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestVesaFbMapRune(t *testing.T) {
+	cons := NewVesaFbConsole(0, 0, 8, 0, nil, 0)
+	if _, ok := cons.MapRune('A'); ok {
+		t.Error("expected MapRune to return false when no font is set")
+	}
+
+	cons.SetFont(&font.Font{GlyphWidth: 8, GlyphHeight: 8, Unicode: map[rune]uint32{'A': 65, 'é': 130, '€': 300}})
+	specs := []struct {
+		r        rune
+		expGlyph uint8
+		expOK    bool
+	}{
+		{'A', 65, true},
+		{'é', 130, true},
+		// glyph index cannot be addressed by the console
+		{'€', 0, false},
+		{'B', 0, false},
+	}
+
+	for specIndex, spec := range specs {
+		if glyph, ok := cons.MapRune(spec.r); glyph != spec.expGlyph || ok != spec.expOK {
+			t.Errorf("[spec %d] expected MapRune(%U) to return %d, %t; got %d, %t", specIndex, spec.r, spec.expGlyph, spec.expOK, glyph, ok)
+		}
+	}
+}
+
 func TestVesaFbDriverInterface(t *testing.T) {
 	defer func() {
 		mapRegionFn = vmm.MapRegion
@@ -1463,6 +1746,30 @@ func TestVesaFbDriverInterface(t *testing.T) {
 		}
 	})
 
+	t.Run("unaligned framebuffer address", func(t *testing.T) {
+		var mappedFrame mm.Frame
+		var mappedSize uintptr
+		mapRegionFn = func(frame mm.Frame, size uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			mappedFrame, mappedSize = frame, size
+			return 0xa0, nil
+		}
+
+		portWriteByteFn = func(_ uint16, _ uint8) {}
+
+		cons := NewVesaFbConsole(320, 200, 8, 320, nil, uintptr(0xa0800))
+		if err := cons.DriverInit(nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := uintptr(320*200 + 0x800); mappedFrame != mm.Frame(0xa0) || mappedSize != exp {
+			t.Fatalf("expected DriverInit to map frame 0xa0 with size %d; got frame 0x%x with size %d", exp, mappedFrame, mappedSize)
+		}
+
+		if got := uintptr(unsafe.Pointer(&cons.hwFb[0])); got != 0xa0800 {
+			t.Fatalf("expected framebuffer to start at 0xa0800; got 0x%x", got)
+		}
+	})
+
 	t.Run("init fail", func(t *testing.T) {
 		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
 		mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
@@ -1494,6 +1801,76 @@ func TestVesaFbProbe(t *testing.T) {
 	if drv := probeForVesaFbConsole(); drv == nil {
 		t.Fatal("expected probeForVesaFbConsole to return a driver")
 	}
+
+	specs := []struct {
+		fbInfo *multiboot.FramebufferInfo
+		expDrv bool
+	}{
+		{nil, false},
+		{&multiboot.FramebufferInfo{Type: multiboot.FramebufferTypeEGA}, false},
+		{&multiboot.FramebufferInfo{Type: multiboot.FramebufferTypeIndexed, Bpp: 4}, false},
+		{&multiboot.FramebufferInfo{Type: multiboot.FramebufferTypeRGB, Bpp: 8}, false},
+		{&multiboot.FramebufferInfo{Type: multiboot.FramebufferTypeRGB, Bpp: 15}, true},
+		{&multiboot.FramebufferInfo{Type: multiboot.FramebufferTypeRGB, Bpp: 16}, true},
+		{&multiboot.FramebufferInfo{Type: multiboot.FramebufferTypeRGB, Bpp: 24}, true},
+		{&multiboot.FramebufferInfo{Type: multiboot.FramebufferTypeRGB, Bpp: 32}, true},
+	}
+
+	for specIndex, spec := range specs {
+		getFramebufferInfoFn = func() *multiboot.FramebufferInfo { return spec.fbInfo }
+		if got := probeForVesaFbConsole() != nil; got != spec.expDrv {
+			t.Errorf("[spec %d] expected probe to return a driver: %t; got %t", specIndex, spec.expDrv, got)
+		}
+	}
+}
+
+func TestVesaFbScrollRegion(t *testing.T) {
+	var (
+		consW, consH uint32 = 8, 40
+		cons                = NewVesaFbConsole(consW, consH, 8, consW, nil, 0)
+	)
+	cons.fb = make([]uint8, consW*consH)
+	cons.offsetY = 10
+	cons.SetFont(mockFont8x10)
+
+	// Each pixel row of the text area contains the index of its text row
+	fill := func() {
+		for y := uint32(0); y < consH; y++ {
+			for x := uint32(0); x < consW; x++ {
+				cons.fb[y*consW+x] = uint8(y / 10)
+			}
+		}
+	}
+
+	specs := []struct {
+		dir                ScrollDir
+		top, bottom, lines uint32
+		expRows            []uint8
+	}{
+		// The first entry is the reserved logo area
+		{ScrollDirUp, 1, 2, 1, []uint8{0, 2, 2, 3}},
+		{ScrollDirDown, 2, 3, 1, []uint8{0, 1, 2, 2}},
+		{ScrollDirUp, 2, 4, 1, []uint8{0, 1, 2, 3}},
+		{ScrollDirUp, 2, 3, 3, []uint8{0, 1, 2, 3}},
+	}
+
+	for specIndex, spec := range specs {
+		fill()
+		cons.dirtyX0, cons.dirtyX1 = 0, 0
+		cons.ScrollRegion(spec.dir, spec.top, spec.bottom, spec.lines)
+
+		for y := uint32(0); y < consH; y++ {
+			if exp, got := spec.expRows[y/10], cons.fb[y*consW]; got != exp {
+				t.Errorf("[spec %d] expected pixel row %d to contain %d; got %d", specIndex, y, exp, got)
+				break
+			}
+		}
+
+		valid := spec.bottom <= 3 && spec.lines <= spec.bottom-spec.top+1
+		if expY0 := 10 + (spec.top-1)*10; valid && (cons.dirtyY0 != expY0 || cons.dirtyY1 != 10+spec.bottom*10) {
+			t.Errorf("[spec %d] expected rows [%d, %d) to be marked dirty; got [%d, %d)", specIndex, expY0, 10+spec.bottom*10, cons.dirtyY0, cons.dirtyY1)
+		}
+	}
 }
 
 func TestVesaFbPackColor16(t *testing.T) {
@@ -1548,11 +1925,11 @@ func TestVesaFbPackColor16(t *testing.T) {
 	}
 }
 
-func TestVesaFbPackColor24(t *testing.T) {
+func TestVesaFbPackColor32(t *testing.T) {
 	specs := []struct {
 		colorInfo *multiboot.FramebufferRGBColorInfo
 		input     color.RGBA
-		exp       [3]uint8
+		exp       [4]uint8
 	}{
 		{
 			// RGB
@@ -1565,7 +1942,7 @@ func TestVesaFbPackColor24(t *testing.T) {
 				BlueMaskSize:  8,
 			},
 			color.RGBA{R: 100, G: 200, B: 255},
-			[3]uint8{100, 200, 255},
+			[4]uint8{100, 200, 255, 0},
 		},
 		{
 			// BGR
@@ -1578,7 +1955,33 @@ func TestVesaFbPackColor24(t *testing.T) {
 				BlueMaskSize:  8,
 			},
 			color.RGBA{R: 250, G: 200, B: 120},
-			[3]uint8{120, 200, 250},
+			[4]uint8{120, 200, 250, 0},
+		},
+		{
+			// XBGR; the red component is stored in the most significant byte
+			&multiboot.FramebufferRGBColorInfo{
+				RedPosition:   24,
+				RedMaskSize:   8,
+				GreenPosition: 16,
+				GreenMaskSize: 8,
+				BluePosition:  8,
+				BlueMaskSize:  8,
+			},
+			color.RGBA{R: 250, G: 200, B: 120},
+			[4]uint8{0, 120, 200, 250},
+		},
+		{
+			// 10-bit components (30bpp depth in a 32bpp pixel)
+			&multiboot.FramebufferRGBColorInfo{
+				RedPosition:   20,
+				RedMaskSize:   10,
+				GreenPosition: 10,
+				GreenMaskSize: 10,
+				BluePosition:  0,
+				BlueMaskSize:  10,
+			},
+			color.RGBA{R: 255, G: 0, B: 255},
+			[4]uint8{0xff, 0x03, 0xf0, 0x3f},
 		},
 	}
 
@@ -1589,12 +1992,85 @@ func TestVesaFbPackColor24(t *testing.T) {
 		cons.colorInfo = spec.colorInfo
 		cons.palette[0] = spec.input
 
-		if got := cons.packColor24(0); got != spec.exp {
+		if got := cons.packColor32(0); got != spec.exp {
 			t.Errorf("[spec %d] expected: %v; got %v", specIndex, spec.exp, got)
 		}
 	}
 }
 
+func TestVesaFbDefaultColorInfo(t *testing.T) {
+	specs := []struct {
+		bpp          uint8
+		colorInfo    *multiboot.FramebufferRGBColorInfo
+		expColorInfo *multiboot.FramebufferRGBColorInfo
+	}{
+		{8, nil, nil},
+		{15, nil, &rgb555ColorInfo},
+		{16, nil, &rgb565ColorInfo},
+		{16, &multiboot.FramebufferRGBColorInfo{}, &rgb565ColorInfo},
+		{24, nil, &rgb888ColorInfo},
+		{32, nil, &rgb888ColorInfo},
+		{32, &multiboot.FramebufferRGBColorInfo{RedMaskSize: 8}, &multiboot.FramebufferRGBColorInfo{RedMaskSize: 8}},
+	}
+
+	for specIndex, spec := range specs {
+		cons := NewVesaFbConsole(0, 0, spec.bpp, 0, spec.colorInfo, 0)
+		if !reflect.DeepEqual(cons.colorInfo, spec.expColorInfo) {
+			t.Errorf("[spec %d] expected color info %v; got %v", specIndex, spec.expColorInfo, cons.colorInfo)
+		}
+	}
+}
+
+func TestVesaFbWrite32bpp(t *testing.T) {
+	var (
+		consW, consH uint32 = 8, 10
+		// XBGR
+		colorInfo = &multiboot.FramebufferRGBColorInfo{
+			RedPosition:   24,
+			RedMaskSize:   8,
+			GreenPosition: 16,
+			GreenMaskSize: 8,
+			BluePosition:  8,
+			BlueMaskSize:  8,
+		}
+		fg      = uint8(1)
+		fgColor = color.RGBA{R: 1, G: 2, B: 3}
+		bg      = uint8(0)
+		fb      = make([]uint8, consW*consH*4)
+	)
+
+	cons := NewVesaFbConsole(consW, consH, 32, consW*4, colorInfo, 0)
+	cons.fb = fb
+	cons.SetFont(mockFont8x10)
+	cons.loadDefaultPalette()
+	cons.SetPaletteColor(fg, fgColor)
+
+	// ASCII 1 maps to the letter 'A' in the mock font
+	cons.Write(1, fg, bg, 1, 1)
+
+	var expFgPixels int
+	for _, rowData := range mockFont8x10.Data[10:20] {
+		for ; rowData != 0; rowData &= rowData - 1 {
+			expFgPixels++
+		}
+	}
+
+	var fgPixels int
+	for offset := 0; offset < len(fb); offset += 4 {
+		switch pixel := [4]uint8{fb[offset], fb[offset+1], fb[offset+2], fb[offset+3]}; pixel {
+		case [4]uint8{0, 3, 2, 1}:
+			fgPixels++
+		case [4]uint8{}:
+		default:
+			t.Fatalf("unexpected pixel value %v at offset %d", pixel, offset)
+		}
+	}
+
+	if fgPixels != expFgPixels {
+		t.Fatalf("expected %d foreground pixels; got %d", expFgPixels, fgPixels)
+	}
+}
+
 func TestVesaFbSetLogo(t *testing.T) {
 	defer func() {
 		portWriteByteFn = cpu.PortWriteByte
@@ -1743,6 +2219,203 @@ func TestVesaFbSetLogo(t *testing.T) {
 	}
 }
 
+func TestVesaFbSetMode(t *testing.T) {
+	defer func() {
+		mapRegionFn = vmm.MapRegion
+		portWriteByteFn = cpu.PortWriteByte
+		portWriteWordFn = cpu.PortWriteWord
+		portReadWordFn = cpu.PortReadWord
+	}()
+
+	var (
+		dispi       = &mockDispi{maxWidth: 1024, maxHeight: 768, maxBpp: 32, rejectBpp: 24}
+		mappedSizes []uintptr
+		hwFbBuf     = make([]byte, 1024*768*4+mm.PageSize)
+		hwFbPage    = mm.PageFromAddress(uintptr(unsafe.Pointer(&hwFbBuf[0])) + mm.PageSize - 1)
+	)
+
+	dispi.install()
+	portWriteByteFn = func(_ uint16, _ uint8) {}
+	mapRegionFn = func(_ mm.Frame, size uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		mappedSizes = append(mappedSizes, size)
+		return hwFbPage, nil
+	}
+
+	newConsole := func() *VesaFbConsole {
+		cons := NewVesaFbConsole(640, 480, 32, 640*4, nil, 0)
+		if err := cons.DriverInit(nil); err != nil {
+			t.Fatal(err)
+		}
+		cons.SetFont(mockFont8x10)
+		cons.offsetY = 10
+		dispi.regs = [10]uint16{dispiRegID: 0xb0c5, dispiRegXRes: 640, dispiRegYRes: 480, dispiRegBpp: 32, dispiRegEnable: dispiEnabled | dispiLFBEnabled}
+		mappedSizes = nil
+		return cons
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		if err := NewVesaFbConsole(640, 480, 32, 640*4, nil, 0).SetMode(800, 600, 32); err != errModeSwitchUnsupported {
+			t.Fatalf("expected to get errModeSwitchUnsupported for an uninitialized console; got %v", err)
+		}
+
+		cons := newConsole()
+		dispi.regs[dispiRegID] = 0xffff
+		if err := cons.SetMode(800, 600, 32); err != errModeSwitchUnsupported {
+			t.Fatalf("expected to get errModeSwitchUnsupported for a display adapter without DISPI support; got %v", err)
+		}
+
+		specs := []struct {
+			width, height uint32
+			bpp           uint8
+		}{
+			{0, 600, 32},
+			{800, 0, 32},
+			{801, 600, 32},
+			{800, 600, 8},
+			{800, 600, 12},
+			{1280, 768, 32},
+			{1024, 1024, 32},
+			// rejected by the display adapter
+			{800, 600, 24},
+		}
+
+		for specIndex, spec := range specs {
+			cons = newConsole()
+			cons.Flush()
+			if err := cons.SetMode(spec.width, spec.height, spec.bpp); err != errUnsupportedMode {
+				t.Errorf("[spec %d] expected to get errUnsupportedMode; got %v", specIndex, err)
+				continue
+			}
+
+			if w, h := cons.Dimensions(Pixels); w != 640 || h != 480 || cons.bpp != 32 || len(cons.fb) != 640*480*4 {
+				t.Errorf("[spec %d] expected console mode to remain 640x480x32; got %dx%dx%d", specIndex, w, h, cons.bpp)
+			}
+
+			if w, h, bpp := dispiMode(); w != 640 || h != 480 || bpp != 32 {
+				t.Errorf("[spec %d] expected display adapter mode to remain 640x480x32; got %dx%dx%d", specIndex, w, h, bpp)
+			}
+
+			if uint16(spec.bpp) == dispi.rejectBpp && (cons.dirtyX1 != 640*4 || cons.dirtyY1 != 480) {
+				t.Errorf("[spec %d] expected console to be redrawn after restoring the previous mode", specIndex)
+			}
+		}
+
+		cons = newConsole()
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) { return 0, expErr }
+		defer func() {
+			mapRegionFn = func(_ mm.Frame, size uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+				mappedSizes = append(mappedSizes, size)
+				return hwFbPage, nil
+			}
+		}()
+		if err := cons.SetMode(1024, 768, 32); err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+
+		if w, _, _ := dispiMode(); w != 640 {
+			t.Fatalf("expected the display adapter mode not to be switched if the framebuffer cannot be mapped")
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		specs := []struct {
+			width, height uint32
+			bpp           uint8
+			expBpp        uint32
+			expColorInfo  *multiboot.FramebufferRGBColorInfo
+			expRemap      bool
+		}{
+			{1024, 768, 0, 32, &rgb888ColorInfo, true},
+			{320, 200, 16, 16, &rgb565ColorInfo, false},
+		}
+
+		for specIndex, spec := range specs {
+			cons := newConsole()
+			cons.defaultBg = 1
+			if err := cons.SetMode(spec.width, spec.height, spec.bpp); err != nil {
+				t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+				continue
+			}
+
+			if w, h, bpp := dispiMode(); w != spec.width || h != spec.height || uint32(bpp) != spec.expBpp || dispi.regs[dispiRegEnable] != dispiEnabled|dispiLFBEnabled {
+				t.Errorf("[spec %d] expected display adapter mode to be %dx%dx%d; got %dx%dx%d", specIndex, spec.width, spec.height, spec.expBpp, w, h, bpp)
+			}
+
+			if w, h := cons.Dimensions(Characters); w != spec.width/8 || h != spec.height/10 || cons.offsetY != 0 {
+				t.Errorf("[spec %d] expected console dimensions to be recomputed for the new mode; got %dx%d", specIndex, w, h)
+			}
+
+			if exp := spec.width * spec.expBpp / 8; cons.pitch != exp || cons.bpp != spec.expBpp || cons.colorInfo != spec.expColorInfo {
+				t.Errorf("[spec %d] expected pitch %d, bpp %d and color info %v; got %d, %d and %v", specIndex, exp, spec.expBpp, spec.expColorInfo, cons.pitch, cons.bpp, cons.colorInfo)
+			}
+
+			if exp := int(cons.pitch * spec.height); len(cons.fb) != exp || len(cons.hwFb) != exp {
+				t.Errorf("[spec %d] expected shadow and device framebuffers to contain %d bytes; got %d and %d", specIndex, exp, len(cons.fb), len(cons.hwFb))
+			}
+
+			if gotRemap := len(mappedSizes) != 0; gotRemap != spec.expRemap {
+				t.Errorf("[spec %d] expected framebuffer to be remapped: %t; got %t", specIndex, spec.expRemap, gotRemap)
+			}
+
+			packed := cons.packColor(cons.defaultBg)
+			for i := 0; i < len(cons.fb); i += int(cons.bytesPerPixel) {
+				var got uint32
+				for b := 0; b < int(cons.bytesPerPixel); b++ {
+					got |= uint32(cons.fb[i+b]) << uint(b*8)
+				}
+
+				if got != packed {
+					t.Errorf("[spec %d] expected framebuffer to be cleared to the default background color; got pixel 0x%x at offset %d", specIndex, got, i)
+					break
+				}
+			}
+
+			if cons.dirtyX0 != 0 || cons.dirtyX1 != cons.pitch || cons.dirtyY0 != 0 || cons.dirtyY1 != spec.height {
+				t.Errorf("[spec %d] expected the entire framebuffer to be marked as dirty", specIndex)
+			}
+		}
+	})
+}
+
+// mockDispi emulates the DISPI registers of a display adapter.
+type mockDispi struct {
+	index uint16
+	regs  [10]uint16
+
+	// The maximum mode reported by the adapter. Modes using rejectBpp
+	// are rejected by the adapter.
+	maxWidth, maxHeight, maxBpp uint16
+	rejectBpp                   uint16
+}
+
+func (d *mockDispi) install() {
+	portWriteWordFn = func(port, val uint16) {
+		switch {
+		case port == dispiIndexPort:
+			d.index = val
+		case port == dispiDataPort && d.index == dispiRegBpp && val == d.rejectBpp:
+		case port == dispiDataPort:
+			d.regs[d.index] = val
+		}
+	}
+
+	portReadWordFn = func(port uint16) uint16 {
+		if d.regs[dispiRegEnable]&dispiGetCaps != 0 {
+			switch d.index {
+			case dispiRegXRes:
+				return d.maxWidth
+			case dispiRegYRes:
+				return d.maxHeight
+			case dispiRegBpp:
+				return d.maxBpp
+			}
+		}
+
+		return d.regs[d.index]
+	}
+}
+
 func dumpFramebuffer(consW, consH, consPitch uint32, fb []byte) string {
 	var buf bytes.Buffer
 
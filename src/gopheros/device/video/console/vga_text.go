@@ -2,6 +2,7 @@ package console
 
 import (
 	"gopheros/device"
+	"gopheros/device/video/console/font"
 	"gopheros/kernel"
 	"gopheros/kernel/kfmt"
 	"gopheros/kernel/mm"
@@ -20,14 +21,52 @@ var egaColorIndexToDACEntry = []uint8{
 	0x3c, 0x3d, 0x3e, 0x3f,
 }
 
+const (
+	// The legacy VGA text mode that is used when the bootloader does not
+	// provide any framebuffer information.
+	legacyTextColumns = 80
+	legacyTextRows    = 25
+	legacyTextFbAddr  = 0xb8000
+
+	// The VGA CRT controller registers that control the hardware cursor.
+	crtcIndexPort      = 0x3d4
+	crtcDataPort       = 0x3d5
+	crtcCursorStart    = 0x0a
+	crtcCursorEnd      = 0x0b
+	crtcCursorLocHi    = 0x0e
+	crtcCursorLocLo    = 0x0f
+	crtcCursorDisabled = 1 << 5
+
+	// The scan lines of the 16-line character cell that are covered by
+	// the hardware cursor.
+	cursorStartLine = 14
+	cursorEndLine   = 15
+
+	// The VGA attribute controller registers. Reading the input status
+	// port resets the controller's index/data flip-flop. Bit 3 of the
+	// mode control register selects whether bit 7 of the character
+	// attributes enables blinking or selects a bright background color.
+	attrIndexPort     = 0x3c0
+	attrDataReadPort  = 0x3c1
+	inputStatusPort   = 0x3da
+	attrModeControl   = 0x10
+	attrPaletteSource = 1 << 5
+	attrBlinkEnable   = 1 << 3
+)
+
 // VgaTextConsole implements an EGA-compatible 80x25 text console using VGA
 // mode 0x3. The console supports the default 16 EGA colors which can be
-// overridden using the SetPaletteColor method.
+// overridden using the SetPaletteColor method. As character blinking is
+// disabled when the driver is initialized, all 16 colors can be used both as
+// foreground and background colors.
 //
 // Each character in the console framebuffer is represented using two bytes,
 // a byte for the character ASCII code and a byte that encodes the foreground
 // and background colors (4 bits for each).
 //
+// The console cursor is rendered by the VGA hardware and is controlled via the
+// SetCursor method.
+//
 // The default settings for the console are:
 //  - light gray text (color 7) on black background (color 0).
 //  - space as the clear character
@@ -38,6 +77,9 @@ type VgaTextConsole struct {
 	fbPhysAddr uintptr
 	fb         []uint16
 
+	// cursorVisible tracks whether the hardware cursor is enabled.
+	cursorVisible bool
+
 	palette   color.Palette
 	defaultFg uint8
 	defaultBg uint8
@@ -96,7 +138,7 @@ func (cons *VgaTextConsole) DefaultColors() (fg uint8, bg uint8) {
 // color. Both x and y coordinates are 1-based.
 func (cons *VgaTextConsole) Fill(x, y, width, height uint32, fg, bg uint8) {
 	var (
-		clr                  = (((uint16(bg) << 4) | uint16(fg)) << 8) | cons.clearChar
+		clr                  = cons.attribute(fg, bg) | cons.clearChar
 		rowOffset, colOffset uint32
 	)
 
@@ -133,22 +175,29 @@ func (cons *VgaTextConsole) Fill(x, y, width, height uint32, fg, bg uint8) {
 // is responsible for updating (e.g. clear or replace) the contents of
 // the region that was scrolled.
 func (cons *VgaTextConsole) Scroll(dir ScrollDir, lines uint32) {
-	if lines == 0 || lines > cons.height {
+	cons.ScrollRegion(dir, 1, cons.height, lines)
+}
+
+// ScrollRegion scrolls the contents of the rows from top to bottom (inclusive)
+// to the specified direction. Rows outside the region are not modified. Both
+// top and bottom are 1-based. The caller is responsible for updating the
+// contents of the rows that were scrolled into the region.
+func (cons *VgaTextConsole) ScrollRegion(dir ScrollDir, top, bottom, lines uint32) {
+	if top < 1 || top > bottom || bottom > cons.height || lines == 0 || lines > bottom-top+1 {
 		return
 	}
 
-	var i uint32
-	offset := lines * cons.width
+	var (
+		start  = (top - 1) * cons.width
+		end    = bottom * cons.width
+		offset = lines * cons.width
+	)
 
 	switch dir {
 	case ScrollDirUp:
-		for ; i < (cons.height-lines)*cons.width; i++ {
-			cons.fb[i] = cons.fb[i+offset]
-		}
+		copy(cons.fb[start:end-offset], cons.fb[start+offset:end])
 	case ScrollDirDown:
-		for i = cons.height*cons.width - 1; i >= lines*cons.width; i-- {
-			cons.fb[i] = cons.fb[i-offset]
-		}
+		copy(cons.fb[start+offset:end], cons.fb[start:end-offset])
 	}
 }
 
@@ -160,15 +209,71 @@ func (cons *VgaTextConsole) Write(ch byte, fg, bg uint8, x, y uint32) {
 		return
 	}
 
+	cons.fb[((y-1)*cons.width)+(x-1)] = cons.attribute(fg, bg) | uint16(ch)
+}
+
+// attribute returns the character attributes for the fg and bg colors shifted
+// to the upper byte of a framebuffer entry. Colors that exceed the supported
+// colors for this console are replaced by their default value.
+func (cons *VgaTextConsole) attribute(fg, bg uint8) uint16 {
 	maxColorIndex := uint8(len(cons.palette) - 1)
 	if fg > maxColorIndex {
 		fg = cons.defaultFg
 	}
-	if bg >= maxColorIndex {
+	if bg > maxColorIndex {
 		bg = cons.defaultBg
 	}
 
-	cons.fb[((y-1)*cons.width)+(x-1)] = (((uint16(bg) << 4) | uint16(fg)) << 8) | uint16(ch)
+	return ((uint16(bg) << 4) | uint16(fg)) << 8
+}
+
+// SetCursor moves the hardware cursor to the character cell at (x, y) and
+// shows or hides it. Both x and y coordinates are 1-based. The cursor is
+// hidden if the coordinates are outside the console.
+func (cons *VgaTextConsole) SetCursor(x, y uint32, visible bool) {
+	if x < 1 || x > cons.width || y < 1 || y > cons.height {
+		visible = false
+	}
+
+	if visible {
+		pos := ((y - 1) * cons.width) + (x - 1)
+		writeCRTC(crtcCursorLocHi, uint8(pos>>8))
+		writeCRTC(crtcCursorLocLo, uint8(pos))
+	}
+
+	if visible == cons.cursorVisible {
+		return
+	}
+
+	cons.cursorVisible = visible
+	if visible {
+		writeCRTC(crtcCursorStart, cursorStartLine)
+		writeCRTC(crtcCursorEnd, cursorEndLine)
+	} else {
+		writeCRTC(crtcCursorStart, crtcCursorDisabled)
+	}
+}
+
+// writeCRTC writes val to the CRT controller register at index reg.
+func writeCRTC(reg, val uint8) {
+	portWriteByteFn(crtcIndexPort, reg)
+	portWriteByteFn(crtcDataPort, val)
+}
+
+// disableBlink configures the attribute controller so that bit 7 of the
+// character attributes selects a bright background color instead of enabling
+// blinking.
+func disableBlink() {
+	portReadByteFn(inputStatusPort)
+	portWriteByteFn(attrIndexPort, attrModeControl|attrPaletteSource)
+	mode := portReadByteFn(attrDataReadPort)
+	portWriteByteFn(attrIndexPort, mode&^attrBlinkEnable)
+}
+
+// MapRune returns the index of the glyph that renders r. The VGA hardware
+// font uses the code page 437 glyph layout.
+func (cons *VgaTextConsole) MapRune(r rune) (uint8, bool) {
+	return font.LookupCP437(r)
 }
 
 // Palette returns the active color palette for this console.
@@ -212,7 +317,7 @@ func (cons *VgaTextConsole) DriverInit(w io.Writer) *kernel.Error {
 	fbPage, err := mapRegionFn(
 		mm.Frame(cons.fbPhysAddr>>mm.PageShift),
 		fbSize,
-		vmm.FlagPresent|vmm.FlagRW,
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute,
 	)
 
 	if err != nil {
@@ -227,14 +332,25 @@ func (cons *VgaTextConsole) DriverInit(w io.Writer) *kernel.Error {
 
 	kfmt.Fprintf(w, "mapped framebuffer to 0x%x\n", fbPage.Address())
 
+	// Enable the bright background colors and keep the cursor hidden
+	// until a TTY positions it.
+	disableBlink()
+	cons.cursorVisible = true
+	cons.SetCursor(0, 0, false)
+
 	return nil
 }
 
-// probeForVgaTextConsole checks for the presence of a vga text console.
+// probeForVgaTextConsole checks for the presence of a vga text console. If the
+// bootloader did not provide any framebuffer information, the console is
+// assumed to be in the legacy 80x25 text mode set up by the BIOS.
 func probeForVgaTextConsole() device.Driver {
 	var drv device.Driver
 	fbInfo := getFramebufferInfoFn()
-	if fbInfo.Type == multiboot.FramebufferTypeEGA {
+	switch {
+	case fbInfo == nil:
+		drv = NewVgaTextConsole(legacyTextColumns, legacyTextRows, legacyTextFbAddr)
+	case fbInfo.Type == multiboot.FramebufferTypeEGA:
 		drv = NewVgaTextConsole(fbInfo.Width, fbInfo.Height, uintptr(fbInfo.PhysAddr))
 	}
 
@@ -243,6 +359,7 @@ func probeForVgaTextConsole() device.Driver {
 
 func init() {
 	device.RegisterDriver(&device.DriverInfo{
+		Name:  "vga_text_console",
 		Order: device.DetectOrderEarly,
 		Probe: probeForVgaTextConsole,
 	})
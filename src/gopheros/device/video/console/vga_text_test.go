@@ -8,10 +8,16 @@ import (
 	"gopheros/kernel/mm/vmm"
 	"gopheros/multiboot"
 	"image/color"
+	"reflect"
 	"testing"
 	"unsafe"
 )
 
+type portWrite struct {
+	port uint16
+	val  uint8
+}
+
 func TestVgaTextDimensions(t *testing.T) {
 	var cons Device = NewVgaTextConsole(40, 50, 0)
 	if w, h := cons.Dimensions(Characters); w != 40 || h != 50 {
@@ -187,6 +193,110 @@ func TestVgaTextScroll(t *testing.T) {
 	})
 }
 
+func TestVgaTextScrollRegion(t *testing.T) {
+	var (
+		cw, ch uint32 = 4, 6
+		fb            = make([]uint16, cw*ch)
+		cons          = NewVgaTextConsole(cw, ch, uintptr(unsafe.Pointer(&fb[0])))
+	)
+	cons.fb = fb
+
+	specs := []struct {
+		dir                ScrollDir
+		top, bottom, lines uint32
+		expRows            []uint16
+	}{
+		{ScrollDirUp, 2, 4, 1, []uint16{0, 2, 3, 3, 4, 5}},
+		{ScrollDirUp, 2, 4, 3, []uint16{0, 1, 2, 3, 4, 5}},
+		{ScrollDirDown, 3, 6, 2, []uint16{0, 1, 2, 3, 2, 3}},
+		{ScrollDirDown, 1, 6, 1, []uint16{0, 0, 1, 2, 3, 4}},
+		// Invalid regions are ignored
+		{ScrollDirUp, 0, 4, 1, []uint16{0, 1, 2, 3, 4, 5}},
+		{ScrollDirUp, 4, 3, 1, []uint16{0, 1, 2, 3, 4, 5}},
+		{ScrollDirUp, 1, 7, 1, []uint16{0, 1, 2, 3, 4, 5}},
+		{ScrollDirUp, 2, 4, 4, []uint16{0, 1, 2, 3, 4, 5}},
+		{ScrollDirUp, 2, 4, 0, []uint16{0, 1, 2, 3, 4, 5}},
+	}
+
+	for specIndex, spec := range specs {
+		// Each cell contains the index of its row
+		for i := range fb {
+			fb[i] = uint16(uint32(i) / cw)
+		}
+
+		cons.ScrollRegion(spec.dir, spec.top, spec.bottom, spec.lines)
+
+		for i, got := range fb {
+			if exp := spec.expRows[uint32(i)/cw]; got != exp {
+				t.Errorf("[spec %d] expected row %d to contain the contents of row %d; got %d", specIndex, uint32(i)/cw, exp, got)
+				break
+			}
+		}
+	}
+}
+
+func TestVgaTextSetCursor(t *testing.T) {
+	defer func() {
+		portWriteByteFn = cpu.PortWriteByte
+	}()
+
+	var writes []portWrite
+	portWriteByteFn = func(port uint16, val uint8) {
+		writes = append(writes, portWrite{port, val})
+	}
+
+	cons := NewVgaTextConsole(80, 25, 0)
+
+	specs := []struct {
+		x, y      uint32
+		visible   bool
+		expWrites []portWrite
+	}{
+		{
+			// Enabling the cursor also programs its shape
+			2, 3, true,
+			[]portWrite{
+				{crtcIndexPort, crtcCursorLocHi}, {crtcDataPort, 0},
+				{crtcIndexPort, crtcCursorLocLo}, {crtcDataPort, 161},
+				{crtcIndexPort, crtcCursorStart}, {crtcDataPort, cursorStartLine},
+				{crtcIndexPort, crtcCursorEnd}, {crtcDataPort, cursorEndLine},
+			},
+		},
+		{
+			80, 25, true,
+			[]portWrite{
+				{crtcIndexPort, crtcCursorLocHi}, {crtcDataPort, 0x07},
+				{crtcIndexPort, crtcCursorLocLo}, {crtcDataPort, 0xcf},
+			},
+		},
+		{
+			1, 1, false,
+			[]portWrite{
+				{crtcIndexPort, crtcCursorStart}, {crtcDataPort, crtcCursorDisabled},
+			},
+		},
+		{
+			// Already hidden
+			1, 1, false,
+			nil,
+		},
+		{
+			// Off-screen coordinates keep the cursor hidden
+			81, 1, true,
+			nil,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		writes = nil
+		cons.SetCursor(spec.x, spec.y, spec.visible)
+
+		if !reflect.DeepEqual(writes, spec.expWrites) {
+			t.Errorf("[spec %d] expected port writes %v; got %v", specIndex, spec.expWrites, writes)
+		}
+	}
+}
+
 func TestVgaTextWrite(t *testing.T) {
 	fb := make([]uint16, 80*25)
 	cons := NewVgaTextConsole(80, 25, uintptr(unsafe.Pointer(&fb[0])))
@@ -254,6 +364,19 @@ func TestVgaTextWrite(t *testing.T) {
 		}
 	})
 
+	t.Run("bright bg", func(t *testing.T) {
+		fg := uint8(0)
+		bg := uint8(15)
+		expAttr := uint16((uint16(bg) << 4) | uint16(fg))
+
+		cons.Write('!', fg, bg, 1, 1)
+
+		expVal := (expAttr << 8) | uint16('!')
+		if got := fb[0]; got != expVal {
+			t.Errorf("expected call to Write() to set fb[0] to %d; got %d", expVal, got)
+		}
+	})
+
 	t.Run("bg out of range", func(t *testing.T) {
 		for i := 0; i < len(fb); i++ {
 			fb[i] = 0
@@ -272,6 +395,18 @@ func TestVgaTextWrite(t *testing.T) {
 	})
 }
 
+func TestVgaTextMapRune(t *testing.T) {
+	var cons VgaTextConsole
+
+	if glyph, ok := cons.MapRune('é'); !ok || glyph != 0x82 {
+		t.Errorf("expected 'é' to map to glyph 0x82; got 0x%x, %t", glyph, ok)
+	}
+
+	if _, ok := cons.MapRune('€'); ok {
+		t.Error("expected MapRune to return false for runes not in code page 437")
+	}
+}
+
 func TestVgaTextSetPaletteColor(t *testing.T) {
 	defer func() {
 		portWriteByteFn = cpu.PortWriteByte
@@ -326,6 +461,8 @@ func TestVgaTextSetPaletteColor(t *testing.T) {
 func TestVgaTextDriverInterface(t *testing.T) {
 	defer func() {
 		mapRegionFn = vmm.MapRegion
+		portWriteByteFn = cpu.PortWriteByte
+		portReadByteFn = cpu.PortReadByte
 	}()
 	var dev device.Driver = NewVgaTextConsole(80, 25, 0)
 
@@ -342,9 +479,31 @@ func TestVgaTextDriverInterface(t *testing.T) {
 			return 0xb8000, nil
 		}
 
+		var writes []portWrite
+		portWriteByteFn = func(port uint16, val uint8) {
+			writes = append(writes, portWrite{port, val})
+		}
+		portReadByteFn = func(port uint16) uint8 {
+			if port == attrDataReadPort {
+				return 0x0c
+			}
+			return 0
+		}
+
 		if err := dev.DriverInit(nil); err != nil {
 			t.Fatal(err)
 		}
+
+		// Blinking is disabled and the cursor is hidden
+		expWrites := []portWrite{
+			{attrIndexPort, attrModeControl | attrPaletteSource},
+			{attrIndexPort, 0x04},
+			{crtcIndexPort, crtcCursorStart},
+			{crtcDataPort, crtcCursorDisabled},
+		}
+		if !reflect.DeepEqual(writes, expWrites) {
+			t.Fatalf("expected port writes %v; got %v", expWrites, writes)
+		}
 	})
 
 	t.Run("init fail", func(t *testing.T) {
@@ -377,4 +536,22 @@ func TestVgaTextProbe(t *testing.T) {
 	if drv := probeForVgaTextConsole(); drv == nil {
 		t.Fatal("expected probeForVgaTextConsole to return a driver")
 	}
+
+	// Without framebuffer information, the legacy text mode is assumed
+	getFramebufferInfoFn = func() *multiboot.FramebufferInfo { return nil }
+	drv, ok := probeForVgaTextConsole().(*VgaTextConsole)
+	if !ok {
+		t.Fatal("expected probeForVgaTextConsole to return a driver when no framebuffer info is available")
+	}
+
+	if w, h := drv.Dimensions(Characters); w != 80 || h != 25 || drv.fbPhysAddr != 0xb8000 {
+		t.Fatalf("expected an 80x25 console at 0xb8000; got %dx%d at 0x%x", w, h, drv.fbPhysAddr)
+	}
+
+	getFramebufferInfoFn = func() *multiboot.FramebufferInfo {
+		return &multiboot.FramebufferInfo{Type: multiboot.FramebufferTypeRGB, Bpp: 32}
+	}
+	if drv := probeForVgaTextConsole(); drv != nil {
+		t.Fatal("expected probeForVgaTextConsole to return nil for a graphics framebuffer")
+	}
 }
@@ -0,0 +1,370 @@
+package virtio
+
+import (
+	"gopheros/device"
+	"gopheros/device/netdev"
+	"gopheros/device/pci"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"io"
+	"unsafe"
+)
+
+const (
+	// Device-specific feature bits for network devices.
+	netFeatureCsum      = uint64(1 << 0)
+	netFeatureGuestCsum = uint64(1 << 1)
+	netFeatureMTU       = uint64(1 << 3)
+	netFeatureMAC       = uint64(1 << 5)
+	netFeatureStatus    = uint64(1 << 16)
+
+	// Layout of the device-specific configuration space.
+	netConfigMAC    = uint16(0)
+	netConfigStatus = uint16(6)
+	netConfigMTU    = uint16(10)
+	netStatusLinkUp = uint16(1 << 0)
+
+	netQueueRX = uint16(0)
+	netQueueTX = uint16(1)
+
+	// Each frame is preceded by a virtio_net_hdr. Modern devices always
+	// include the num_buffers field in the header.
+	netHdrLenLegacy   = uintptr(10)
+	netHdrLenModern   = uintptr(12)
+	netHdrNeedsCsum   = uint8(1 << 0)
+	netHdrDataValid   = uint8(1 << 1)
+	netHdrOffCsumInfo = uintptr(6)
+
+	// netBufSize is the size of each receive and transmit buffer. A buffer
+	// holds the header and a full-sized Ethernet frame with a VLAN tag.
+	netBufSize = uintptr(2048)
+
+	// netMaxBuffers limits the number of receive and transmit buffers that
+	// are allocated for each device.
+	netMaxBuffers = uint16(128)
+
+	netDefaultMTU = uint16(1500)
+)
+
+var (
+	errTxBusy = &kernel.Error{Module: "virtio_net", Message: "no transmit buffers available"}
+
+	// The following functions are used by tests to mock calls to the
+	// virtio and netdev packages.
+	findDevicesFn    = FindDevices
+	newDeviceFn      = NewDevice
+	registerNetDevFn = netdev.Register
+	scheduleRXFn     = (*netdev.Interface).ScheduleRX
+	receiveFrameFn   = (*netdev.Interface).Receive
+
+	// nextLocalMAC is the last byte of the locally administered address
+	// assigned to the next device that does not report its MAC address.
+	nextLocalMAC uint8
+)
+
+// netDevice implements netdev.Driver for a virtio network device.
+type netDevice struct {
+	dev   *Device
+	iface *netdev.Interface
+	mac   netdev.HardwareAddr
+	mtu   uint16
+
+	hdrLen uintptr
+	rx     *Queue
+	tx     *Queue
+
+	rxVirt, rxPhys uintptr
+	txVirt, txPhys uintptr
+
+	// txFree contains the indices of the unused transmit buffers.
+	txFree []uint16
+}
+
+// init negotiates the device features, sets up the virtqueues and posts the
+// receive buffers. The device is started once init returns successfully.
+func (nic *netDevice) init() *kernel.Error {
+	if _, err := nic.dev.Negotiate(netFeatureCsum | netFeatureGuestCsum | netFeatureMTU | netFeatureMAC | netFeatureStatus); err != nil {
+		return err
+	}
+
+	nic.hdrLen = netHdrLenLegacy
+	if nic.dev.Modern() {
+		nic.hdrLen = netHdrLenModern
+	}
+
+	if nic.dev.HasFeature(netFeatureMAC) {
+		for i := range nic.mac {
+			nic.mac[i] = nic.dev.ReadConfig8(netConfigMAC + uint16(i))
+		}
+	} else {
+		// Use a locally administered address
+		nic.mac = netdev.HardwareAddr{0x02, 0, 0, 0, 0, nextLocalMAC}
+		nextLocalMAC++
+	}
+
+	nic.mtu = netDefaultMTU
+	if nic.dev.HasFeature(netFeatureMTU) {
+		nic.mtu = nic.dev.ReadConfig16(netConfigMTU)
+	}
+	if maxMTU := uint16(netBufSize - nic.hdrLen - netdev.EthernetHeaderLen); nic.mtu > maxMTU {
+		nic.mtu = maxMTU
+	}
+
+	var err *kernel.Error
+	if nic.rx, err = nic.dev.SetupQueue(netQueueRX, nic.handleRX); err != nil {
+		nic.dev.Fail()
+		return err
+	}
+
+	// Transmitted buffers are reclaimed by Transmit so no handler is
+	// required for the TX queue.
+	if nic.tx, err = nic.dev.SetupQueue(netQueueTX, nil); err != nil {
+		nic.dev.Fail()
+		return err
+	}
+
+	rxCount, txCount := minU16(nic.rx.NumFree(), netMaxBuffers), minU16(nic.tx.NumFree(), netMaxBuffers)
+	if nic.rxVirt, nic.rxPhys, err = allocDMAFn(uintptr(rxCount) * netBufSize); err != nil {
+		nic.dev.Fail()
+		return err
+	}
+	if nic.txVirt, nic.txPhys, err = allocDMAFn(uintptr(txCount) * netBufSize); err != nil {
+		nic.dev.Fail()
+		return err
+	}
+
+	for i := uint16(0); i < rxCount; i++ {
+		nic.postRXBuffer(i)
+	}
+
+	nic.txFree = make([]uint16, txCount)
+	for i := range nic.txFree {
+		nic.txFree[i] = uint16(i)
+	}
+
+	if err = nic.dev.Start(); err != nil {
+		return err
+	}
+
+	nic.rx.Kick()
+	return nil
+}
+
+// HardwareAddr returns the MAC address of the device.
+func (nic *netDevice) HardwareAddr() netdev.HardwareAddr {
+	return nic.mac
+}
+
+// MTU returns the device MTU.
+func (nic *netDevice) MTU() uint16 {
+	return nic.mtu
+}
+
+// Features returns the checksum offload features negotiated with the device.
+func (nic *netDevice) Features() netdev.Feature {
+	var features netdev.Feature
+	if nic.dev.HasFeature(netFeatureCsum) {
+		features |= netdev.FeatureTxChecksum
+	}
+	if nic.dev.HasFeature(netFeatureGuestCsum) {
+		features |= netdev.FeatureRxChecksum
+	}
+	return features
+}
+
+// LinkUp returns the link state reported by the device. Devices that do not
+// report their link state are assumed to be always connected.
+func (nic *netDevice) LinkUp() bool {
+	if !nic.dev.HasFeature(netFeatureStatus) {
+		return true
+	}
+
+	return nic.dev.ReadConfig16(netConfigStatus)&netStatusLinkUp != 0
+}
+
+// Transmit copies a frame to a transmit buffer and passes it to the device.
+func (nic *netDevice) Transmit(frame *netdev.Frame) *kernel.Error {
+	intr := lock()
+
+	// Reclaim the buffers that were sent by the device
+	for {
+		token, _, ok := nic.tx.Next()
+		if !ok {
+			break
+		}
+		nic.txFree = append(nic.txFree, token.(uint16))
+	}
+
+	if len(nic.txFree) == 0 {
+		unlock(intr)
+		return errTxBusy
+	}
+
+	slot := nic.txFree[len(nic.txFree)-1]
+	nic.txFree = nic.txFree[:len(nic.txFree)-1]
+	unlock(intr)
+
+	buf := nic.txVirt + uintptr(slot)*netBufSize
+	hdr := (*[netBufSize]byte)(unsafe.Pointer(buf))[:nic.hdrLen]
+	for i := range hdr {
+		hdr[i] = 0
+	}
+
+	if frame.NeedsChecksum {
+		hdr[0] = netHdrNeedsCsum
+		*(*uint16)(unsafe.Pointer(buf + netHdrOffCsumInfo)) = frame.ChecksumStart
+		*(*uint16)(unsafe.Pointer(buf + netHdrOffCsumInfo + 2)) = frame.ChecksumOffset
+	}
+
+	frameLen := copy((*[netBufSize]byte)(unsafe.Pointer(buf + nic.hdrLen))[:netBufSize-nic.hdrLen], frame.Data)
+	err := nic.tx.Add([]Buffer{{
+		Addr: nic.txPhys + uintptr(slot)*netBufSize,
+		Len:  uint32(nic.hdrLen) + uint32(frameLen),
+	}}, slot)
+	if err != nil {
+		intr = lock()
+		nic.txFree = append(nic.txFree, slot)
+		unlock(intr)
+		return err
+	}
+
+	nic.tx.Kick()
+	return nil
+}
+
+// Poll passes the frames received by the device to the network stack and
+// returns their buffers to the device.
+func (nic *netDevice) Poll() {
+	posted := false
+	for {
+		token, written, ok := nic.rx.Next()
+		if !ok {
+			break
+		}
+
+		var (
+			slot  = token.(uint16)
+			frame *netdev.Frame
+		)
+
+		// Runt frames are discarded
+		if uintptr(written) > nic.hdrLen {
+			buf := nic.rxVirt + uintptr(slot)*netBufSize
+			frame = &netdev.Frame{Data: make([]byte, uintptr(written)-nic.hdrLen)}
+			copy(frame.Data, (*[netBufSize]byte)(unsafe.Pointer(buf + nic.hdrLen))[:netBufSize-nic.hdrLen])
+
+			// Frames with a partial checksum originate from the
+			// host and are considered valid.
+			flags := *(*uint8)(unsafe.Pointer(buf))
+			frame.ChecksumValid = flags&(netHdrDataValid|netHdrNeedsCsum) != 0
+		}
+
+		// The frame has been copied so the buffer can be reused
+		nic.postRXBuffer(slot)
+		posted = true
+
+		if frame != nil {
+			receiveFrameFn(nic.iface, frame)
+		}
+	}
+
+	if posted {
+		nic.rx.Kick()
+	}
+}
+
+// postRXBuffer passes the receive buffer with the specified index to the
+// device.
+func (nic *netDevice) postRXBuffer(slot uint16) {
+	// The RX queue has at least as many entries as buffers so this never
+	// fails.
+	_ = nic.rx.Add([]Buffer{{
+		Addr:           nic.rxPhys + uintptr(slot)*netBufSize,
+		Len:            uint32(netBufSize),
+		DeviceWritable: true,
+	}}, slot)
+}
+
+// handleRX is invoked from interrupt context when the device has filled
+// receive buffers.
+func (nic *netDevice) handleRX(_ *Queue) {
+	if nic.iface != nil {
+		scheduleRXFn(nic.iface)
+	}
+}
+
+// netDriver implements a driver for the virtio network devices attached to the
+// PCI bus. Each device is registered as a network interface.
+type netDriver struct {
+	pciDevs []*pci.Device
+	nics    []*netDevice
+}
+
+// DriverName returns the name of this driver.
+func (*netDriver) DriverName() string {
+	return "virtio_net"
+}
+
+// DriverVersion returns the version of this driver.
+func (*netDriver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit initializes all detected virtio network devices. An error is
+// returned only if none of the devices could be initialized.
+func (drv *netDriver) DriverInit(w io.Writer) *kernel.Error {
+	var lastErr *kernel.Error
+	for _, pciDev := range drv.pciDevs {
+		dev, err := newDeviceFn(pciDev)
+		if err == nil {
+			nic := &netDevice{dev: dev}
+			if err = nic.init(); err == nil {
+				nic.iface = registerNetDevFn(nic)
+				drv.nics = append(drv.nics, nic)
+
+				// Pick up any frames received before the
+				// interface was registered.
+				scheduleRXFn(nic.iface)
+
+				kfmt.Fprintf(w, "%s: %2x:%2x.%d, mac %s, mtu %d\n",
+					nic.iface.Name(), pciDev.Bus, pciDev.Slot, pciDev.Func, nic.mac.String(), nic.mtu,
+				)
+				continue
+			}
+		}
+
+		kfmt.Fprintf(w, "%2x:%2x.%d: %s\n", pciDev.Bus, pciDev.Slot, pciDev.Func, err.Message)
+		lastErr = err
+	}
+
+	if len(drv.nics) == 0 {
+		return lastErr
+	}
+
+	return nil
+}
+
+func minU16(a, b uint16) uint16 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func probeForVirtioNet() device.Driver {
+	pciDevs := findDevicesFn(TypeNet)
+	if len(pciDevs) == 0 {
+		return nil
+	}
+
+	return &netDriver{pciDevs: pciDevs}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:      "virtio_net",
+		DependsOn: []string{"pci"},
+		Order:     device.DetectOrderLast,
+		Probe:     probeForVirtioNet,
+	})
+}
@@ -0,0 +1,327 @@
+package virtio
+
+import (
+	"bytes"
+	"gopheros/device/netdev"
+	"gopheros/device/pci"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// mockNetDevice returns a virtio network device backed by a mock transport
+// that signals interrupts via INTx.
+func mockNetDevice(modern bool, features uint64) (*Device, *mockTransport) {
+	enableMSIXFn = func(_ *pci.Device, _ []irq.Handler) ([]gate.InterruptNumber, *kernel.Error) {
+		return nil, errNoMSIXMock
+	}
+	readConfig8Fn = func(_ *pci.Device, _ uint8) uint8 { return 11 }
+	registerIRQFn = func(_ uint32, _ irq.Handler) *kernel.Error { return nil }
+
+	tr := newMockTransport(modern)
+	tr.devFeatures = features
+	if modern {
+		tr.devFeatures |= featureVersion1
+	}
+	copy(tr.config[netConfigMAC:], []uint8{0x52, 0x54, 0x00, 0x12, 0x34, 0x56})
+	tr.config[netConfigStatus] = uint8(netStatusLinkUp)
+	tr.config[netConfigMTU], tr.config[netConfigMTU+1] = 0x28, 0x23 // 9000
+
+	return &Device{PCI: &pci.Device{InterruptPin: 1}, Type: TypeNet, transport: tr}, tr
+}
+
+func TestNetDeviceInit(t *testing.T) {
+	defer restoreMocks()
+	mockDMA(0)
+
+	specs := []struct {
+		modern      bool
+		features    uint64
+		expMAC      string
+		expMTU      uint16
+		expHdrLen   uintptr
+		expFeatures netdev.Feature
+	}{
+		{
+			true, netFeatureCsum | netFeatureGuestCsum | netFeatureMAC | netFeatureMTU | netFeatureStatus,
+			"52:54:00:12:34:56", uint16(netBufSize - netHdrLenModern - netdev.EthernetHeaderLen), netHdrLenModern,
+			netdev.FeatureTxChecksum | netdev.FeatureRxChecksum,
+		},
+		{
+			false, netFeatureGuestCsum,
+			"02:00:00:00:00:00", netDefaultMTU, netHdrLenLegacy,
+			netdev.FeatureRxChecksum,
+		},
+		{
+			false, 0,
+			"02:00:00:00:00:01", netDefaultMTU, netHdrLenLegacy,
+			0,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		dev, tr := mockNetDevice(spec.modern, spec.features)
+		nic := &netDevice{dev: dev}
+		if err := nic.init(); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if got := nic.HardwareAddr().String(); got != spec.expMAC {
+			t.Errorf("[spec %d] expected MAC %s; got %s", specIndex, spec.expMAC, got)
+		}
+
+		if nic.MTU() != spec.expMTU || nic.hdrLen != spec.expHdrLen || nic.Features() != spec.expFeatures {
+			t.Errorf("[spec %d] expected MTU %d, header length %d and features %d; got %d, %d and %d",
+				specIndex, spec.expMTU, spec.expHdrLen, spec.expFeatures, nic.MTU(), nic.hdrLen, nic.Features())
+		}
+
+		if !nic.LinkUp() {
+			t.Errorf("[spec %d] expected link to be up", specIndex)
+		}
+
+		// All RX buffers are passed to the device and all TX buffers
+		// are available.
+		if nic.rx.NumFree() != 0 || len(nic.txFree) != 16 {
+			t.Errorf("[spec %d] expected 8 posted RX buffers and 16 free TX buffers; got %d and %d", specIndex, 8-nic.rx.NumFree(), len(nic.txFree))
+		}
+
+		if tr.statusReg&statusDriverOK == 0 || len(tr.notified) != 1 || tr.notified[0] != netQueueRX {
+			t.Errorf("[spec %d] expected device to be started and the RX queue to be notified", specIndex)
+		}
+	}
+
+	// The link state is read from the device
+	dev, tr := mockNetDevice(true, netFeatureStatus)
+	nic := &netDevice{dev: dev}
+	if err := nic.init(); err != nil {
+		t.Fatal(err)
+	}
+	tr.config[netConfigStatus] = 0
+	if nic.LinkUp() {
+		t.Fatal("expected link to be down")
+	}
+
+	// Missing TX queue
+	dev, tr = mockNetDevice(true, 0)
+	delete(tr.queueSizes, netQueueTX)
+	if err := (&netDevice{dev: dev}).init(); err != errNoQueue {
+		t.Fatalf("expected error %v; got %v", errNoQueue, err)
+	}
+	if tr.statusReg&statusFailed == 0 {
+		t.Fatal("expected device to be marked as failed")
+	}
+
+	// Modern device without VERSION_1
+	dev, tr = mockNetDevice(true, 0)
+	tr.devFeatures = 0
+	if err := (&netDevice{dev: dev}).init(); err != errFeaturesRejected {
+		t.Fatalf("expected error %v; got %v", errFeaturesRejected, err)
+	}
+}
+
+func TestNetDeviceTransmit(t *testing.T) {
+	defer restoreMocks()
+	mockDMA(0)
+
+	dev, tr := mockNetDevice(true, netFeatureCsum)
+	nic := &netDevice{dev: dev}
+	if err := nic.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := &netdev.Frame{
+		Data:           []byte("0123456789abcdefghij"),
+		NeedsChecksum:  true,
+		ChecksumStart:  14,
+		ChecksumOffset: 4,
+	}
+	if err := nic.Transmit(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	head := nic.tx.availRing[0]
+	desc := nic.tx.desc[head]
+	if desc.length != uint32(netHdrLenModern)+20 || desc.flags != 0 {
+		t.Fatalf("expected a device-readable buffer with %d bytes; got %+v", netHdrLenModern+20, desc)
+	}
+
+	buf := (*[netBufSize]byte)(unsafe.Pointer(uintptr(desc.addr)))[:desc.length]
+	if exp := []byte{netHdrNeedsCsum, 0, 0, 0, 0, 0, 14, 0, 4, 0, 0, 0}; !bytes.Equal(buf[:netHdrLenModern], exp) {
+		t.Fatalf("expected header %v; got %v", exp, buf[:netHdrLenModern])
+	}
+
+	if !bytes.Equal(buf[netHdrLenModern:], frame.Data) {
+		t.Fatalf("expected frame data to be copied to the TX buffer; got %q", buf[netHdrLenModern:])
+	}
+
+	if len(tr.notified) != 2 || tr.notified[1] != netQueueTX {
+		t.Fatalf("expected the TX queue to be notified; got %v", tr.notified)
+	}
+
+	// Fill the TX queue
+	frame.NeedsChecksum = false
+	for i := 1; i < 16; i++ {
+		if err := nic.Transmit(frame); err != nil {
+			t.Fatalf("[tx %d] unexpected error: %v", i, err)
+		}
+	}
+
+	if err := nic.Transmit(frame); err != errTxBusy {
+		t.Fatalf("expected error %v; got %v", errTxBusy, err)
+	}
+
+	// Once the device has sent a frame its buffer can be reused
+	complete(nic.tx, head, 0)
+	if err := nic.Transmit(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := nic.tx.desc[nic.tx.availRing[0]].addr; got != desc.addr {
+		t.Fatalf("expected the reclaimed buffer at 0x%x to be reused; got 0x%x", desc.addr, got)
+	}
+}
+
+func TestNetDevicePoll(t *testing.T) {
+	defer restoreMocks()
+	mockDMA(0)
+
+	dev, tr := mockNetDevice(false, netFeatureGuestCsum)
+	nic := &netDevice{dev: dev, iface: &netdev.Interface{}}
+	if err := nic.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var scheduled int
+	scheduleRXFn = func(iface *netdev.Interface) {
+		if iface != nic.iface {
+			t.Error("expected the RX work to be scheduled for the device interface")
+		}
+		scheduled++
+	}
+
+	var received []*netdev.Frame
+	receiveFrameFn = func(iface *netdev.Interface, frame *netdev.Frame) {
+		// The buffer must have been returned to the device
+		if nic.rx.NumFree() != 0 {
+			t.Error("expected the RX buffer to be reposted before passing the frame to the stack")
+		}
+		received = append(received, frame)
+	}
+
+	// The device fills the buffers posted in slots 2, 0 and 5
+	fill := func(slot uint16, flags uint8, payload string) uint32 {
+		buf := (*[netBufSize]byte)(unsafe.Pointer(nic.rxVirt + uintptr(slot)*netBufSize))[:]
+		buf[0] = flags
+		return uint32(netHdrLenLegacy) + uint32(copy(buf[netHdrLenLegacy:], payload))
+	}
+	complete(nic.rx, nic.rx.availRing[2], fill(2, netHdrDataValid, "frame-2"))
+	complete(nic.rx, nic.rx.availRing[0], fill(0, 0, "frame-0"))
+	complete(nic.rx, nic.rx.availRing[5], 4)
+	tr.isrReg = isrQueue
+
+	if !dev.handleINTx(nil) || scheduled != 1 {
+		t.Fatal("expected the interrupt handler to schedule RX processing")
+	}
+
+	nic.Poll()
+
+	if len(received) != 2 {
+		t.Fatalf("expected 2 frames to be received; got %d", len(received))
+	}
+
+	specs := []struct {
+		data  string
+		valid bool
+	}{
+		{"frame-2", true},
+		{"frame-0", false},
+	}
+
+	for specIndex, spec := range specs {
+		if got := string(received[specIndex].Data); got != spec.data || received[specIndex].ChecksumValid != spec.valid {
+			t.Errorf("[spec %d] expected frame %q with valid checksum %t; got %q, %t", specIndex, spec.data, spec.valid, got, received[specIndex].ChecksumValid)
+		}
+	}
+
+	// The RX queue is notified about the reposted buffers
+	if *nic.rx.availIdx != 11 || tr.notified[len(tr.notified)-1] != netQueueRX {
+		t.Fatalf("expected 3 buffers to be reposted; got available index %d", *nic.rx.availIdx)
+	}
+
+	// Nothing to do
+	tr.notified = nil
+	nic.Poll()
+	if len(tr.notified) != 0 {
+		t.Fatal("expected the RX queue not to be notified when no buffers were used")
+	}
+}
+
+func TestNetDriverInit(t *testing.T) {
+	defer restoreMocks()
+	mockDMA(0)
+
+	findDevicesFn = func(_ DeviceType) []*pci.Device { return nil }
+	if drv := probeForVirtioNet(); drv != nil {
+		t.Fatal("expected probe to return nil when no devices are present")
+	}
+
+	var (
+		pciDevs   = []*pci.Device{{Bus: 0, Slot: 3}, {Bus: 0, Slot: 4}}
+		devErr    = &kernel.Error{Module: "test", Message: "no transport"}
+		scheduled int
+		ifaces    []*netdev.Interface
+	)
+
+	findDevicesFn = func(typ DeviceType) []*pci.Device {
+		if typ != TypeNet {
+			t.Errorf("expected probe to look for network devices; got type %d", typ)
+		}
+		return pciDevs
+	}
+	newDeviceFn = func(pciDev *pci.Device) (*Device, *kernel.Error) {
+		if pciDev.Slot == 4 {
+			return nil, devErr
+		}
+		dev, _ := mockNetDevice(true, netFeatureMAC)
+		return dev, nil
+	}
+	registerNetDevFn = func(_ netdev.Driver) *netdev.Interface {
+		ifaces = append(ifaces, &netdev.Interface{})
+		return ifaces[len(ifaces)-1]
+	}
+	scheduleRXFn = func(_ *netdev.Interface) { scheduled++ }
+
+	drv := probeForVirtioNet().(*netDriver)
+	if drv.DriverName() != "virtio_net" {
+		t.Fatalf("unexpected driver name %q", drv.DriverName())
+	}
+	if major, minor, patch := drv.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Fatalf("unexpected driver version %d.%d.%d", major, minor, patch)
+	}
+
+	var buf bytes.Buffer
+	if err := drv.DriverInit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(drv.nics) != 1 || len(ifaces) != 1 || drv.nics[0].iface != ifaces[0] || scheduled != 1 {
+		t.Fatal("expected one interface to be registered")
+	}
+
+	for _, exp := range []string{": 00:03.0, mac 52:54:00:12:34:56, mtu 1500\n", "00:04.0: no transport\n"} {
+		if !strings.Contains(buf.String(), exp) {
+			t.Errorf("expected driver output to contain %q; got %q", exp, buf.String())
+		}
+	}
+
+	// No device could be initialized
+	pciDevs = pciDevs[1:]
+	drv = probeForVirtioNet().(*netDriver)
+	if err := drv.DriverInit(&buf); err != devErr {
+		t.Fatalf("expected error %v; got %v", devErr, err)
+	}
+}
@@ -0,0 +1,260 @@
+package virtio
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// maxQueueSize limits the number of entries allocated for the
+	// virtqueues of modern devices so that the descriptor table fits in a
+	// single page.
+	maxQueueSize = uint16(256)
+
+	// maxRingSize is the largest queue size allowed by the virtio
+	// specification.
+	maxRingSize = 1 << 15
+
+	descSize      = 16
+	ringAlign     = uintptr(mm.PageSize)
+	descFlagNext  = uint16(1 << 0)
+	descFlagWrite = uint16(1 << 1)
+)
+
+var (
+	errEmptyChain = &kernel.Error{Module: "virtio", Message: "descriptor chain must contain at least one buffer"}
+	errQueueFull  = &kernel.Error{Module: "virtio", Message: "not enough free descriptors in virtqueue"}
+
+	// The following functions are used by tests to mock calls to the cpu
+	// and vmm packages.
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn  = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	allocDMAFn          = vmm.AllocDMA
+)
+
+// descriptor is an entry in the virtqueue descriptor table.
+type descriptor struct {
+	addr   uint64
+	length uint32
+	flags  uint16
+	next   uint16
+}
+
+// usedElem is an entry in the used ring.
+type usedElem struct {
+	id     uint32
+	length uint32
+}
+
+// Buffer describes a physically contiguous memory region that is shared with
+// the device.
+type Buffer struct {
+	// Addr is the physical address of the buffer.
+	Addr uintptr
+	Len  uint32
+
+	// DeviceWritable is set for buffers that are filled in by the device.
+	DeviceWritable bool
+}
+
+// Queue implements a split virtqueue. The driver exposes chains of buffers to
+// the device via the available ring and the device returns them via the used
+// ring once it has processed them.
+type Queue struct {
+	dev     *Device
+	index   uint16
+	size    uint16
+	handler func(*Queue)
+
+	desc      []descriptor
+	availIdx  *uint16
+	availRing []uint16
+	usedRing  []usedElem
+
+	// usedHeader points to the flags (low word) and index (high word)
+	// fields of the used ring which are updated by the device.
+	usedHeader *uint32
+
+	descPhys  uintptr
+	availPhys uintptr
+	usedPhys  uintptr
+
+	// The unused descriptors are linked via their next field. freeHead
+	// points to the first free descriptor.
+	freeHead uint16
+	numFree  uint16
+
+	// lastUsed is the used ring index of the next entry to be returned by
+	// Next.
+	lastUsed uint16
+
+	// tokens holds the value passed to Add for each chain that is owned
+	// by the device, indexed by the chain's head descriptor.
+	tokens []interface{}
+}
+
+// usedRingOffset returns the offset of the used ring from the start of the
+// virtqueue memory. The rings are laid out using the legacy virtio layout
+// which places the used ring at the first page boundary after the available
+// ring so that the same memory layout can be used with both transports.
+func usedRingOffset(size uint16) uintptr {
+	return alignUp(uintptr(size)*descSize+6+2*uintptr(size), ringAlign)
+}
+
+// newQueue allocates and initializes the memory for a virtqueue.
+func newQueue(dev *Device, index, size uint16, handler func(*Queue)) (*Queue, *kernel.Error) {
+	var (
+		usedOffset = usedRingOffset(size)
+		totalSize  = usedOffset + alignUp(6+8*uintptr(size), ringAlign)
+	)
+
+	virt, phys, err := allocDMAFn(totalSize)
+	if err != nil {
+		return nil, err
+	}
+
+	avail := virt + uintptr(size)*descSize
+	used := virt + usedOffset
+	q := &Queue{
+		dev:        dev,
+		index:      index,
+		size:       size,
+		handler:    handler,
+		desc:       (*[maxRingSize]descriptor)(unsafe.Pointer(virt))[:size:size],
+		availIdx:   (*uint16)(unsafe.Pointer(avail + 2)),
+		availRing:  (*[maxRingSize]uint16)(unsafe.Pointer(avail + 4))[:size:size],
+		usedRing:   (*[maxRingSize]usedElem)(unsafe.Pointer(used + 4))[:size:size],
+		usedHeader: (*uint32)(unsafe.Pointer(used)),
+		descPhys:   phys,
+		availPhys:  phys + uintptr(size)*descSize,
+		usedPhys:   phys + usedOffset,
+		numFree:    size,
+		tokens:     make([]interface{}, size),
+	}
+
+	for i := uint16(0); i < size-1; i++ {
+		q.desc[i].next = i + 1
+	}
+
+	return q, nil
+}
+
+// Index returns the index of the virtqueue.
+func (q *Queue) Index() uint16 {
+	return q.index
+}
+
+// NumFree returns the number of unused descriptors.
+func (q *Queue) NumFree() uint16 {
+	intr := lock()
+	numFree := q.numFree
+	unlock(intr)
+	return numFree
+}
+
+// Add exposes a chain of buffers to the device. Buffers that are read by the
+// device must precede the ones written by it. The token is returned by Next
+// once the device has processed the chain. The device is not notified about
+// the new buffers until Kick is invoked.
+func (q *Queue) Add(bufs []Buffer, token interface{}) *kernel.Error {
+	if len(bufs) == 0 {
+		return errEmptyChain
+	}
+
+	intr := lock()
+	defer unlock(intr)
+
+	if int(q.numFree) < len(bufs) {
+		return errQueueFull
+	}
+
+	// Free descriptors are already linked so the chain is formed by
+	// setting the next flag on all but the last descriptor.
+	head, last := q.freeHead, q.freeHead
+	for i, buf := range bufs {
+		d := &q.desc[last]
+		d.addr, d.length, d.flags = uint64(buf.Addr), buf.Len, 0
+		if buf.DeviceWritable {
+			d.flags |= descFlagWrite
+		}
+
+		if i != len(bufs)-1 {
+			d.flags |= descFlagNext
+			last = d.next
+		}
+	}
+
+	q.freeHead = q.desc[last].next
+	q.numFree -= uint16(len(bufs))
+	q.tokens[head] = token
+
+	// The ring entry must be visible to the device before the index is
+	// updated. Stores are not reordered on x86 so no fence is required.
+	availIdx := *q.availIdx
+	q.availRing[availIdx%q.size] = head
+	*q.availIdx = availIdx + 1
+	return nil
+}
+
+// Kick notifies the device that new buffers are available.
+func (q *Queue) Kick() {
+	q.dev.transport.notify(q.index)
+}
+
+// Next returns the token for the next chain that was processed by the device
+// along with the number of bytes that the device wrote to the chain buffers.
+// The last return value is false if there are no processed chains.
+func (q *Queue) Next() (interface{}, uint32, bool) {
+	intr := lock()
+	defer unlock(intr)
+
+	if !q.pending() {
+		return nil, 0, false
+	}
+
+	elem := q.usedRing[q.lastUsed%q.size]
+	q.lastUsed++
+
+	// Return the chain descriptors to the free list
+	head := uint16(elem.id)
+	last, count := head, uint16(1)
+	for q.desc[last].flags&descFlagNext != 0 {
+		last = q.desc[last].next
+		count++
+	}
+	q.desc[last].next = q.freeHead
+	q.freeHead = head
+	q.numFree += count
+
+	token := q.tokens[head]
+	q.tokens[head] = nil
+	return token, elem.length, true
+}
+
+// pending returns true if the used ring contains entries that have not been
+// returned by Next.
+func (q *Queue) pending() bool {
+	// The atomic load ensures that the index is always read from memory
+	return q.lastUsed != uint16(atomic.LoadUint32(q.usedHeader)>>16)
+}
+
+func alignUp(addr, align uintptr) uintptr {
+	return (addr + align - 1) &^ (align - 1)
+}
+
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+	return intr
+}
+
+func unlock(intr bool) {
+	if intr {
+		enableInterruptsFn()
+	}
+}
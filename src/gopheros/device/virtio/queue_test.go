@@ -0,0 +1,150 @@
+package virtio
+
+import (
+	"gopheros/kernel/mm"
+	"testing"
+)
+
+// complete emulates the device returning a processed chain via the used ring.
+func complete(q *Queue, head uint16, written uint32) {
+	usedIdx := uint16(*q.usedHeader >> 16)
+	q.usedRing[usedIdx%q.size] = usedElem{id: uint32(head), length: written}
+	*q.usedHeader = uint32(usedIdx+1) << 16
+}
+
+func TestQueueLayout(t *testing.T) {
+	defer restoreMocks()
+	mockDMA(0x100000000)
+
+	q, err := newQueue(&Device{}, 0, 128, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.descPhys&(mm.PageSize-1) != 0 || q.descPhys < 0x100000000 {
+		t.Fatalf("expected a page-aligned physical address for the descriptor table; got 0x%x", q.descPhys)
+	}
+
+	if exp := q.descPhys + 128*descSize; q.availPhys != exp {
+		t.Fatalf("expected available ring at 0x%x; got 0x%x", exp, q.availPhys)
+	}
+
+	if exp := q.descPhys + usedRingOffset(128); q.usedPhys != exp {
+		t.Fatalf("expected used ring at 0x%x; got 0x%x", exp, q.usedPhys)
+	}
+
+	specs := []struct {
+		size uint16
+		exp  uintptr
+	}{
+		{16, mm.PageSize},
+		{128, mm.PageSize},
+		{256, 2 * mm.PageSize},
+		{1024, 5 * mm.PageSize},
+	}
+
+	for specIndex, spec := range specs {
+		if got := usedRingOffset(spec.size); got != spec.exp {
+			t.Errorf("[spec %d] expected used ring offset 0x%x for a queue with %d entries; got 0x%x", specIndex, spec.exp, spec.size, got)
+		}
+	}
+}
+
+func TestQueueAddNext(t *testing.T) {
+	defer restoreMocks()
+	mockDMA(0)
+
+	tr := newMockTransport(true)
+	q, err := newQueue(&Device{transport: tr}, 1, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = q.Add(nil, nil); err != errEmptyChain {
+		t.Fatalf("expected error %v; got %v", errEmptyChain, err)
+	}
+
+	if _, _, ok := q.Next(); ok {
+		t.Fatal("expected Next to return false when the used ring is empty")
+	}
+
+	// A request with a device-readable header and a device-writable
+	// response buffer followed by a single buffer.
+	if err = q.Add([]Buffer{{Addr: 0x1000, Len: 16}, {Addr: 0x2000, Len: 512, DeviceWritable: true}}, "req0"); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Add([]Buffer{{Addr: 0x3000, Len: 64}}, "req1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if q.NumFree() != 1 || *q.availIdx != 2 {
+		t.Fatalf("expected 1 free descriptor and available index 2; got %d and %d", q.NumFree(), *q.availIdx)
+	}
+
+	head0, head1 := q.availRing[0], q.availRing[1]
+	if d := q.desc[head0]; d.addr != 0x1000 || d.length != 16 || d.flags != descFlagNext {
+		t.Fatalf("unexpected head descriptor %+v", d)
+	}
+	if d := q.desc[q.desc[head0].next]; d.addr != 0x2000 || d.length != 512 || d.flags != descFlagWrite {
+		t.Fatalf("unexpected tail descriptor %+v", d)
+	}
+	if d := q.desc[head1]; d.addr != 0x3000 || d.flags != 0 {
+		t.Fatalf("unexpected descriptor %+v", d)
+	}
+
+	if err = q.Add([]Buffer{{Addr: 0x4000}, {Addr: 0x5000}}, "req2"); err != errQueueFull {
+		t.Fatalf("expected error %v; got %v", errQueueFull, err)
+	}
+
+	q.Kick()
+	if len(tr.notified) != 1 || tr.notified[0] != 1 {
+		t.Fatalf("expected queue 1 to be notified; got %v", tr.notified)
+	}
+
+	// The device may complete chains out of order
+	complete(q, head1, 0)
+	complete(q, head0, 100)
+
+	specs := []struct {
+		expToken   interface{}
+		expWritten uint32
+		expFree    uint16
+	}{
+		{"req1", 0, 2},
+		{"req0", 100, 4},
+	}
+
+	for specIndex, spec := range specs {
+		token, written, ok := q.Next()
+		if !ok || token != spec.expToken || written != spec.expWritten {
+			t.Errorf("[spec %d] expected (%v, %d, true); got (%v, %d, %t)", specIndex, spec.expToken, spec.expWritten, token, written, ok)
+		}
+
+		if got := q.NumFree(); got != spec.expFree {
+			t.Errorf("[spec %d] expected %d free descriptors; got %d", specIndex, spec.expFree, got)
+		}
+	}
+
+	if _, _, ok := q.Next(); ok {
+		t.Fatal("expected Next to return false after all chains have been returned")
+	}
+
+	// The recycled descriptors can be used to fill the whole queue and
+	// the ring indices wrap around.
+	for i := 0; i < 4; i++ {
+		if err = q.Add([]Buffer{{Addr: uintptr(i) << 12, Len: 8}}, i); err != nil {
+			t.Fatalf("[add %d] unexpected error: %v", i, err)
+		}
+	}
+
+	if q.NumFree() != 0 || *q.availIdx != 6 {
+		t.Fatalf("expected the queue to be full with available index 6; got %d free and index %d", q.NumFree(), *q.availIdx)
+	}
+
+	for i := 0; i < 4; i++ {
+		complete(q, q.availRing[(2+i)%4], 8)
+		if token, _, ok := q.Next(); !ok || token != i {
+			t.Fatalf("[next %d] expected token %d; got %v", i, i, token)
+		}
+	}
+}
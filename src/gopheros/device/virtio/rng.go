@@ -0,0 +1,158 @@
+package virtio
+
+import (
+	"gopheros/device"
+	"gopheros/device/pci"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/rand"
+	"gopheros/kernel/timer"
+	"io"
+	"unsafe"
+)
+
+const (
+	rngQueue = uint16(0)
+
+	// rngRequestSize is the number of random bytes requested from the
+	// device at a time.
+	rngRequestSize = 64
+
+	// rngReseedInterval is the delay between successive requests. The
+	// first request is sent when the device is initialized.
+	rngReseedInterval = 60 * timer.Second
+)
+
+var (
+	// The following functions are used by tests to mock calls to the rand
+	// and timer packages.
+	addEntropyFn = rand.AddEntropy
+	timerAfterFn = timer.After
+)
+
+// rngDevice feeds the output of a virtio entropy device to the kernel random
+// number generator.
+type rngDevice struct {
+	dev *Device
+	q   *Queue
+
+	bufVirt, bufPhys uintptr
+
+	// received counts the random bytes delivered by the device.
+	received uint64
+}
+
+// init negotiates the device features, sets up the request queue, starts the
+// device and requests the first batch of random bytes.
+func (rng *rngDevice) init() *kernel.Error {
+	// The entropy device has no device-specific features
+	if _, err := rng.dev.Negotiate(0); err != nil {
+		return err
+	}
+
+	var err *kernel.Error
+	if rng.q, err = rng.dev.SetupQueue(rngQueue, rng.handleRequest); err != nil {
+		rng.dev.Fail()
+		return err
+	}
+
+	if rng.bufVirt, rng.bufPhys, err = allocDMAFn(rngRequestSize); err != nil {
+		rng.dev.Fail()
+		return err
+	}
+
+	if err = rng.dev.Start(); err != nil {
+		return err
+	}
+
+	rng.request()
+	return nil
+}
+
+// request passes the receive buffer to the device.
+func (rng *rngDevice) request() {
+	// Only one request is ever outstanding so this never fails.
+	_ = rng.q.Add([]Buffer{{Addr: rng.bufPhys, Len: rngRequestSize, DeviceWritable: true}}, nil)
+	rng.q.Kick()
+}
+
+// handleRequest is invoked from interrupt context when the device has filled
+// the receive buffer. The random bytes are mixed into the kernel generator
+// and the next request is scheduled.
+func (rng *rngDevice) handleRequest(q *Queue) {
+	for {
+		_, written, ok := q.Next()
+		if !ok {
+			break
+		}
+
+		if written > rngRequestSize {
+			written = rngRequestSize
+		}
+		addEntropyFn((*[rngRequestSize]byte)(unsafe.Pointer(rng.bufVirt))[:written])
+		rng.received += uint64(written)
+	}
+
+	timerAfterFn(rngReseedInterval, rng.request)
+}
+
+// rngDriver implements a driver for the virtio entropy devices attached to the
+// PCI bus.
+type rngDriver struct {
+	pciDevs []*pci.Device
+	rngs    []*rngDevice
+}
+
+// DriverName returns the name of this driver.
+func (*rngDriver) DriverName() string {
+	return "virtio_rng"
+}
+
+// DriverVersion returns the version of this driver.
+func (*rngDriver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit initializes all detected virtio entropy devices. An error is
+// returned only if none of the devices could be initialized.
+func (drv *rngDriver) DriverInit(w io.Writer) *kernel.Error {
+	var lastErr *kernel.Error
+	for _, pciDev := range drv.pciDevs {
+		dev, err := newDeviceFn(pciDev)
+		if err == nil {
+			rng := &rngDevice{dev: dev}
+			if err = rng.init(); err == nil {
+				drv.rngs = append(drv.rngs, rng)
+				kfmt.Fprintf(w, "%2x:%2x.%d: entropy source\n", pciDev.Bus, pciDev.Slot, pciDev.Func)
+				continue
+			}
+		}
+
+		kfmt.Fprintf(w, "%2x:%2x.%d: %s\n", pciDev.Bus, pciDev.Slot, pciDev.Func, err.Message)
+		lastErr = err
+	}
+
+	if len(drv.rngs) == 0 {
+		return lastErr
+	}
+
+	return nil
+}
+
+func probeForVirtioRNG() device.Driver {
+	pciDevs := findDevicesFn(TypeRNG)
+	if len(pciDevs) == 0 {
+		return nil
+	}
+
+	return &rngDriver{pciDevs: pciDevs}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Name:      "virtio_rng",
+		DependsOn: []string{"pci"},
+		Order:     device.DetectOrderLast,
+		Probe:     probeForVirtioRNG,
+	})
+}
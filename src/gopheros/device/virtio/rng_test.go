@@ -0,0 +1,178 @@
+package virtio
+
+import (
+	"bytes"
+	"gopheros/device/pci"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/timer"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// mockRNGDevice returns a virtio entropy device backed by a mock transport
+// that signals interrupts via INTx.
+func mockRNGDevice() (*Device, *mockTransport) {
+	enableMSIXFn = func(_ *pci.Device, _ []irq.Handler) ([]gate.InterruptNumber, *kernel.Error) {
+		return nil, errNoMSIXMock
+	}
+	readConfig8Fn = func(_ *pci.Device, _ uint8) uint8 { return 11 }
+	registerIRQFn = func(_ uint32, _ irq.Handler) *kernel.Error { return nil }
+
+	tr := newMockTransport(true)
+	tr.devFeatures = featureVersion1
+	return &Device{PCI: &pci.Device{InterruptPin: 1}, Type: TypeRNG, transport: tr}, tr
+}
+
+func TestRNGDevice(t *testing.T) {
+	defer restoreMocks()
+	mockDMA(0)
+
+	var (
+		entropy   [][]byte
+		timerFn   func()
+		timerWait timer.Duration
+	)
+	addEntropyFn = func(data []byte) { entropy = append(entropy, append([]byte{}, data...)) }
+	timerAfterFn = func(d timer.Duration, fn func()) *timer.Timer {
+		timerWait, timerFn = d, fn
+		return nil
+	}
+
+	dev, tr := mockRNGDevice()
+	rng := &rngDevice{dev: dev}
+	if err := rng.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.statusReg&statusDriverOK == 0 || len(tr.notified) != 1 || tr.notified[0] != rngQueue {
+		t.Fatal("expected device to be started and the first request to be sent")
+	}
+
+	desc := rng.q.desc[rng.q.availRing[0]]
+	if uintptr(desc.addr) != rng.bufPhys || desc.length != rngRequestSize || desc.flags != descFlagWrite {
+		t.Fatalf("expected a device-writable request for %d bytes; got %+v", rngRequestSize, desc)
+	}
+
+	// The device fills part of the buffer
+	buf := (*[rngRequestSize]byte)(unsafe.Pointer(rng.bufVirt))
+	copy(buf[:], "random")
+	complete(rng.q, rng.q.availRing[0], 6)
+	tr.isrReg = isrQueue
+	dev.handleINTx(nil)
+
+	if len(entropy) != 1 || string(entropy[0]) != "random" || rng.received != 6 {
+		t.Fatalf("expected the random bytes to be added to the kernel generator; got %q", entropy)
+	}
+
+	if timerFn == nil || timerWait != rngReseedInterval || len(tr.notified) != 1 {
+		t.Fatal("expected the next request to be delayed by the reseed interval")
+	}
+
+	// Lengths reported by the device are capped to the buffer size
+	timerFn()
+	if len(tr.notified) != 2 {
+		t.Fatal("expected the next request to be sent when the timer fires")
+	}
+	complete(rng.q, rng.q.availRing[1], 2*rngRequestSize)
+	rng.handleRequest(rng.q)
+	if len(entropy) != 2 || len(entropy[1]) != rngRequestSize {
+		t.Fatalf("expected %d bytes to be added; got %d", rngRequestSize, len(entropy[1]))
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		dev, tr := mockRNGDevice()
+		tr.devFeatures = 0
+		if err := (&rngDevice{dev: dev}).init(); err != errFeaturesRejected {
+			t.Errorf("expected error %v; got %v", errFeaturesRejected, err)
+		}
+
+		dev, tr = mockRNGDevice()
+		delete(tr.queueSizes, rngQueue)
+		if err := (&rngDevice{dev: dev}).init(); err != errNoQueue || tr.statusReg&statusFailed == 0 {
+			t.Errorf("expected error %v and the device to be marked as failed; got %v", errNoQueue, err)
+		}
+
+		dev, _ = mockRNGDevice()
+		dev.PCI.InterruptPin = 0
+		if err := (&rngDevice{dev: dev}).init(); err != errNoInterrupt {
+			t.Errorf("expected error %v; got %v", errNoInterrupt, err)
+		}
+
+		dmaErr := &kernel.Error{Module: "test", Message: "out of memory"}
+		allocQueue := allocDMAFn
+		allocDMAFn = func(size uintptr) (uintptr, uintptr, *kernel.Error) {
+			// Fail the allocation of the request buffer
+			if size == rngRequestSize {
+				return 0, 0, dmaErr
+			}
+			return allocQueue(size)
+		}
+		dev, tr = mockRNGDevice()
+		if err := (&rngDevice{dev: dev}).init(); err != dmaErr || tr.statusReg&statusFailed == 0 {
+			t.Errorf("expected error %v and the device to be marked as failed; got %v", dmaErr, err)
+		}
+	})
+}
+
+func TestRNGDriverInit(t *testing.T) {
+	defer restoreMocks()
+	mockDMA(0)
+	timerAfterFn = func(_ timer.Duration, _ func()) *timer.Timer { return nil }
+
+	findDevicesFn = func(_ DeviceType) []*pci.Device { return nil }
+	if drv := probeForVirtioRNG(); drv != nil {
+		t.Fatal("expected probe to return nil when no devices are present")
+	}
+
+	var (
+		pciDevs = []*pci.Device{{Bus: 0, Slot: 5}, {Bus: 0, Slot: 6}}
+		devErr  = &kernel.Error{Module: "test", Message: "no transport"}
+	)
+
+	findDevicesFn = func(typ DeviceType) []*pci.Device {
+		if typ != TypeRNG {
+			t.Errorf("expected probe to look for entropy devices; got type %d", typ)
+		}
+		return pciDevs
+	}
+	newDeviceFn = func(pciDev *pci.Device) (*Device, *kernel.Error) {
+		if pciDev.Slot == 6 {
+			return nil, devErr
+		}
+		dev, _ := mockRNGDevice()
+		return dev, nil
+	}
+
+	drv := probeForVirtioRNG().(*rngDriver)
+	if drv.DriverName() != "virtio_rng" {
+		t.Fatalf("unexpected driver name %q", drv.DriverName())
+	}
+	if major, minor, patch := drv.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Fatalf("unexpected driver version %d.%d.%d", major, minor, patch)
+	}
+
+	var buf bytes.Buffer
+	if err := drv.DriverInit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(drv.rngs) != 1 {
+		t.Fatalf("expected one device to be initialized; got %d", len(drv.rngs))
+	}
+
+	for _, exp := range []string{"00:05.0: entropy source\n", "00:06.0: no transport\n"} {
+		if !strings.Contains(buf.String(), exp) {
+			t.Errorf("expected driver output to contain %q; got %q", exp, buf.String())
+		}
+	}
+
+	// No device could be initialized
+	pciDevs = pciDevs[1:]
+	drv = probeForVirtioRNG().(*rngDriver)
+	if err := drv.DriverInit(&buf); err != devErr {
+		t.Fatalf("expected error %v; got %v", devErr, err)
+	}
+}
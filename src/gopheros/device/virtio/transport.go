@@ -0,0 +1,405 @@
+package virtio
+
+import (
+	"gopheros/device/pci"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"unsafe"
+)
+
+// transport abstracts the differences between the register layouts of modern
+// and legacy virtio PCI devices.
+type transport interface {
+	modern() bool
+
+	deviceFeatures() uint64
+	setDriverFeatures(features uint64)
+
+	status() uint8
+	setStatus(status uint8)
+
+	// queueSize returns the number of entries to allocate for a
+	// virtqueue or 0 if the queue does not exist.
+	queueSize(index uint16) uint16
+
+	// enableQueue passes the physical addresses of the descriptor table
+	// and the available (driver) and used (device) rings to the device.
+	enableQueue(index, size uint16, desc, driver, device uintptr) *kernel.Error
+	notify(index uint16)
+
+	// setConfigVector and setQueueVector assign an MSI-X table entry to
+	// configuration change and virtqueue notifications. They return false
+	// if the device could not assign the entry.
+	setConfigVector(entry uint16) bool
+	setQueueVector(index, entry uint16) bool
+
+	// isr reads and clears the ISR status register.
+	isr() uint8
+
+	configGeneration() uint8
+	readConfig8(offset uint16) uint8
+	readConfig16(offset uint16) uint16
+	readConfig32(offset uint16) uint32
+}
+
+const (
+	// noVector indicates that no MSI-X entry is assigned to a
+	// notification source.
+	noVector = uint16(0xffff)
+
+	// Vendor-specific capability that describes the location of a modern
+	// register block.
+	capVendor       = uint8(0x09)
+	capCfgType      = uint8(3)
+	capBAR          = uint8(4)
+	capOffset       = uint8(8)
+	capLength       = uint8(12)
+	capNotifyOffMul = uint8(16)
+
+	cfgTypeCommon = uint8(1)
+	cfgTypeNotify = uint8(2)
+	cfgTypeISR    = uint8(3)
+	cfgTypeDevice = uint8(4)
+
+	// Register offsets in the modern common configuration block.
+	commonDeviceFeatureSel = uintptr(0x00)
+	commonDeviceFeature    = uintptr(0x04)
+	commonDriverFeatureSel = uintptr(0x08)
+	commonDriverFeature    = uintptr(0x0c)
+	commonMSIXConfig       = uintptr(0x10)
+	commonDeviceStatus     = uintptr(0x14)
+	commonConfigGeneration = uintptr(0x15)
+	commonQueueSelect      = uintptr(0x16)
+	commonQueueSize        = uintptr(0x18)
+	commonQueueMSIXVector  = uintptr(0x1a)
+	commonQueueEnable      = uintptr(0x1c)
+	commonQueueNotifyOff   = uintptr(0x1e)
+	commonQueueDesc        = uintptr(0x20)
+	commonQueueDriver      = uintptr(0x28)
+	commonQueueDevice      = uintptr(0x30)
+
+	// Register offsets in the legacy I/O port block. The device-specific
+	// configuration follows the header; its offset changes if MSI-X is
+	// enabled so legacy devices always use INTx.
+	legacyDeviceFeatures = uint16(0x00)
+	legacyDriverFeatures = uint16(0x04)
+	legacyQueuePFN       = uint16(0x08)
+	legacyQueueSize      = uint16(0x0c)
+	legacyQueueSelect    = uint16(0x0e)
+	legacyQueueNotify    = uint16(0x10)
+	legacyDeviceStatus   = uint16(0x12)
+	legacyISR            = uint16(0x13)
+	legacyConfig         = uint16(0x14)
+	legacyPFNShift       = 12
+)
+
+var (
+	errNoModernCaps  = &kernel.Error{Module: "virtio", Message: "device does not provide the modern virtio capabilities"}
+	errInvalidBAR    = &kernel.Error{Module: "virtio", Message: "virtio register block is located in an I/O or unassigned BAR"}
+	errLegacyLayout  = &kernel.Error{Module: "virtio", Message: "virtqueue layout is not supported by legacy devices"}
+	errNoLegacyPorts = &kernel.Error{Module: "virtio", Message: "legacy virtio device does not have an I/O BAR"}
+
+	// The following functions are used by tests to mock calls to the cpu
+	// and vmm packages.
+	portReadByteFn   = cpu.PortReadByte
+	portReadWordFn   = cpu.PortReadWord
+	portReadDwordFn  = cpu.PortReadDword
+	portWriteByteFn  = cpu.PortWriteByte
+	portWriteWordFn  = cpu.PortWriteWord
+	portWriteDwordFn = cpu.PortWriteDword
+	mapRegionFn      = vmm.MapRegion
+)
+
+// modernTransport accesses the registers of a virtio 1.x device via the
+// memory-mapped register blocks described by its vendor capabilities.
+type modernTransport struct {
+	common     uintptr
+	notifyBase uintptr
+	isrReg     uintptr
+	device     uintptr
+
+	notifyOffMultiplier uint32
+
+	// notifyOffsets caches the notification offset of each enabled
+	// virtqueue.
+	notifyOffsets map[uint16]uint16
+}
+
+// newModernTransport locates and maps the register blocks of a modern device.
+// It returns errNoModernCaps if the device only supports the legacy interface.
+func newModernTransport(dev *pci.Device) (transport, *kernel.Error) {
+	var (
+		t   = &modernTransport{notifyOffsets: make(map[uint16]uint16)}
+		err *kernel.Error
+	)
+
+	visitCapabilitiesFn(dev, func(id, offset uint8) bool {
+		if id != capVendor {
+			return true
+		}
+
+		var target *uintptr
+		switch readConfig8Fn(dev, offset+capCfgType) {
+		case cfgTypeCommon:
+			target = &t.common
+		case cfgTypeNotify:
+			target = &t.notifyBase
+		case cfgTypeISR:
+			target = &t.isrReg
+		case cfgTypeDevice:
+			target = &t.device
+		default:
+			return true
+		}
+
+		// Only the first capability of each type is used
+		if *target != 0 {
+			return true
+		}
+
+		if *target, err = mapCapability(dev, offset); err != nil {
+			return false
+		}
+
+		if target == &t.notifyBase {
+			t.notifyOffMultiplier = readConfig32Fn(dev, offset+capNotifyOffMul)
+		}
+		return true
+	})
+
+	switch {
+	case err != nil:
+		return nil, err
+	case t.common == 0 || t.notifyBase == 0 || t.isrReg == 0:
+		return nil, errNoModernCaps
+	}
+
+	return t, nil
+}
+
+// mapCapability maps the register block described by the vendor capability
+// at the specified configuration space offset and returns its virtual
+// address.
+func mapCapability(dev *pci.Device, offset uint8) (uintptr, *kernel.Error) {
+	barAddr, isIO := barFn(dev, readConfig8Fn(dev, offset+capBAR))
+	if isIO || barAddr == 0 {
+		return 0, errInvalidBAR
+	}
+
+	regAddr := uintptr(barAddr) + uintptr(readConfig32Fn(dev, offset+capOffset))
+	page, err := mapRegionFn(
+		mm.FrameFromAddress(regAddr),
+		vmm.PageOffset(regAddr)+uintptr(readConfig32Fn(dev, offset+capLength)),
+		vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute|vmm.FlagDoNotCache,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return page.Address() + vmm.PageOffset(regAddr), nil
+}
+
+func (t *modernTransport) modern() bool { return true }
+
+func (t *modernTransport) deviceFeatures() uint64 {
+	write32(t.common+commonDeviceFeatureSel, 0)
+	lo := read32(t.common + commonDeviceFeature)
+	write32(t.common+commonDeviceFeatureSel, 1)
+	return uint64(read32(t.common+commonDeviceFeature))<<32 | uint64(lo)
+}
+
+func (t *modernTransport) setDriverFeatures(features uint64) {
+	write32(t.common+commonDriverFeatureSel, 0)
+	write32(t.common+commonDriverFeature, uint32(features))
+	write32(t.common+commonDriverFeatureSel, 1)
+	write32(t.common+commonDriverFeature, uint32(features>>32))
+}
+
+func (t *modernTransport) status() uint8 {
+	return read8(t.common + commonDeviceStatus)
+}
+
+func (t *modernTransport) setStatus(status uint8) {
+	write8(t.common+commonDeviceStatus, status)
+}
+
+func (t *modernTransport) queueSize(index uint16) uint16 {
+	write16(t.common+commonQueueSelect, index)
+	if size := read16(t.common + commonQueueSize); size < maxQueueSize {
+		return size
+	}
+
+	// Modern devices allow the driver to use fewer queue entries
+	return maxQueueSize
+}
+
+func (t *modernTransport) enableQueue(index, size uint16, desc, driver, device uintptr) *kernel.Error {
+	write16(t.common+commonQueueSelect, index)
+	write16(t.common+commonQueueSize, size)
+	write64(t.common+commonQueueDesc, uint64(desc))
+	write64(t.common+commonQueueDriver, uint64(driver))
+	write64(t.common+commonQueueDevice, uint64(device))
+	t.notifyOffsets[index] = read16(t.common + commonQueueNotifyOff)
+	write16(t.common+commonQueueEnable, 1)
+	return nil
+}
+
+func (t *modernTransport) notify(index uint16) {
+	write16(t.notifyBase+uintptr(t.notifyOffsets[index])*uintptr(t.notifyOffMultiplier), index)
+}
+
+func (t *modernTransport) setConfigVector(entry uint16) bool {
+	write16(t.common+commonMSIXConfig, entry)
+	return read16(t.common+commonMSIXConfig) == entry
+}
+
+func (t *modernTransport) setQueueVector(index, entry uint16) bool {
+	write16(t.common+commonQueueSelect, index)
+	write16(t.common+commonQueueMSIXVector, entry)
+	return read16(t.common+commonQueueMSIXVector) == entry
+}
+
+func (t *modernTransport) isr() uint8 {
+	return read8(t.isrReg)
+}
+
+func (t *modernTransport) configGeneration() uint8 {
+	return read8(t.common + commonConfigGeneration)
+}
+
+func (t *modernTransport) readConfig8(offset uint16) uint8 {
+	if t.device == 0 {
+		return 0
+	}
+	return read8(t.device + uintptr(offset))
+}
+
+func (t *modernTransport) readConfig16(offset uint16) uint16 {
+	if t.device == 0 {
+		return 0
+	}
+	return read16(t.device + uintptr(offset))
+}
+
+func (t *modernTransport) readConfig32(offset uint16) uint32 {
+	if t.device == 0 {
+		return 0
+	}
+	return read32(t.device + uintptr(offset))
+}
+
+// legacyTransport accesses the registers of a legacy virtio device via the I/O
+// ports decoded by its first BAR.
+type legacyTransport struct {
+	port uint16
+}
+
+func newLegacyTransport(dev *pci.Device) (transport, *kernel.Error) {
+	port, isIO := barFn(dev, 0)
+	if !isIO || port == 0 {
+		return nil, errNoLegacyPorts
+	}
+
+	return &legacyTransport{port: uint16(port)}, nil
+}
+
+func (t *legacyTransport) modern() bool { return false }
+
+func (t *legacyTransport) deviceFeatures() uint64 {
+	return uint64(portReadDwordFn(t.port + legacyDeviceFeatures))
+}
+
+func (t *legacyTransport) setDriverFeatures(features uint64) {
+	portWriteDwordFn(t.port+legacyDriverFeatures, uint32(features))
+}
+
+func (t *legacyTransport) status() uint8 {
+	return portReadByteFn(t.port + legacyDeviceStatus)
+}
+
+func (t *legacyTransport) setStatus(status uint8) {
+	portWriteByteFn(t.port+legacyDeviceStatus, status)
+}
+
+// queueSize returns the queue size selected by the device. Unlike modern
+// devices, legacy devices require drivers to use the full queue size.
+func (t *legacyTransport) queueSize(index uint16) uint16 {
+	portWriteWordFn(t.port+legacyQueueSelect, index)
+	return portReadWordFn(t.port + legacyQueueSize)
+}
+
+// enableQueue passes the virtqueue to the device. Legacy devices only accept
+// the page frame of the descriptor table and expect the rings to follow it
+// using the layout produced by newQueue.
+func (t *legacyTransport) enableQueue(index, size uint16, desc, driver, device uintptr) *kernel.Error {
+	if vmm.PageOffset(desc) != 0 ||
+		driver != desc+uintptr(size)*descSize ||
+		device != desc+usedRingOffset(size) ||
+		uint64(desc)>>legacyPFNShift > 0xffffffff {
+		return errLegacyLayout
+	}
+
+	portWriteWordFn(t.port+legacyQueueSelect, index)
+	portWriteDwordFn(t.port+legacyQueuePFN, uint32(desc>>legacyPFNShift))
+	return nil
+}
+
+func (t *legacyTransport) notify(index uint16) {
+	portWriteWordFn(t.port+legacyQueueNotify, index)
+}
+
+func (t *legacyTransport) setConfigVector(_ uint16) bool          { return false }
+func (t *legacyTransport) setQueueVector(_ uint16, _ uint16) bool { return false }
+
+func (t *legacyTransport) isr() uint8 {
+	return portReadByteFn(t.port + legacyISR)
+}
+
+// configGeneration returns 0 as legacy devices do not provide a configuration
+// generation counter.
+func (t *legacyTransport) configGeneration() uint8 { return 0 }
+
+func (t *legacyTransport) readConfig8(offset uint16) uint8 {
+	return portReadByteFn(t.port + legacyConfig + offset)
+}
+
+func (t *legacyTransport) readConfig16(offset uint16) uint16 {
+	return portReadWordFn(t.port + legacyConfig + offset)
+}
+
+func (t *legacyTransport) readConfig32(offset uint16) uint32 {
+	return portReadDwordFn(t.port + legacyConfig + offset)
+}
+
+func read8(addr uintptr) uint8 {
+	return *(*uint8)(unsafe.Pointer(addr))
+}
+
+func read16(addr uintptr) uint16 {
+	return *(*uint16)(unsafe.Pointer(addr))
+}
+
+func read32(addr uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(addr))
+}
+
+func write8(addr uintptr, val uint8) {
+	*(*uint8)(unsafe.Pointer(addr)) = val
+}
+
+func write16(addr uintptr, val uint16) {
+	*(*uint16)(unsafe.Pointer(addr)) = val
+}
+
+func write32(addr uintptr, val uint32) {
+	*(*uint32)(unsafe.Pointer(addr)) = val
+}
+
+// write64 writes a 64-bit register using two dword accesses as required by
+// the virtio specification.
+func write64(addr uintptr, val uint64) {
+	write32(addr, uint32(val))
+	write32(addr+4, uint32(val>>32))
+}
@@ -0,0 +1,345 @@
+package virtio
+
+import (
+	"gopheros/device/pci"
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"testing"
+	"unsafe"
+)
+
+// mockPCIFunction emulates the configuration space and the memory BARs of a
+// virtio PCI function.
+type mockPCIFunction struct {
+	dev    *pci.Device
+	config [256]uint8
+	caps   []uint8
+
+	// mmio backs BAR 4; ioPort is the base address of BAR 0.
+	mmio     []byte
+	mmioBase uintptr
+	ioPort   uint16
+}
+
+func newMockPCIFunction(deviceID uint16) *mockPCIFunction {
+	f := &mockPCIFunction{
+		dev:  &pci.Device{VendorID: pciVendorID, DeviceID: deviceID, InterruptPin: 1},
+		mmio: make([]byte, 2*mm.PageSize),
+	}
+	f.mmioBase = alignUp(uintptr(unsafe.Pointer(&f.mmio[0])), mm.PageSize)
+	return f
+}
+
+// addCap appends a virtio vendor capability to the capability list.
+func (f *mockPCIFunction) addCap(cfgType, bar uint8, offset, length, notifyMul uint32) {
+	capOff := uint8(0x40 + 0x14*len(f.caps))
+	f.caps = append(f.caps, capOff)
+	f.config[capOff] = capVendor
+	f.config[capOff+capCfgType] = cfgType
+	f.config[capOff+capBAR] = bar
+	*(*uint32)(unsafe.Pointer(&f.config[capOff+capOffset])) = offset
+	*(*uint32)(unsafe.Pointer(&f.config[capOff+capLength])) = length
+	*(*uint32)(unsafe.Pointer(&f.config[capOff+capNotifyOffMul])) = notifyMul
+}
+
+func (f *mockPCIFunction) install(t *testing.T) {
+	visitCapabilitiesFn = func(dev *pci.Device, visitor func(id, offset uint8) bool) {
+		for _, capOff := range f.caps {
+			if !visitor(f.config[capOff], capOff) {
+				return
+			}
+		}
+	}
+	readConfig8Fn = func(_ *pci.Device, offset uint8) uint8 { return f.config[offset] }
+	readConfig32Fn = func(_ *pci.Device, offset uint8) uint32 {
+		return *(*uint32)(unsafe.Pointer(&f.config[offset]))
+	}
+	barFn = func(_ *pci.Device, index uint8) (uint64, bool) {
+		switch index {
+		case 0:
+			return uint64(f.ioPort), true
+		case 4:
+			// Use a fake physical address so the mapping can be verified
+			return 0xfe000000, false
+		}
+		return 0, false
+	}
+	mapRegionFn = func(frame mm.Frame, size uintptr, flags vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		if frame.Address() != 0xfe000000 {
+			t.Errorf("unexpected mapping request for frame 0x%x", frame.Address())
+		}
+		if flags&vmm.FlagDoNotCache == 0 {
+			t.Error("expected register blocks to be mapped as uncacheable")
+		}
+		return mm.PageFromAddress(f.mmioBase), nil
+	}
+}
+
+func TestNewDevice(t *testing.T) {
+	defer restoreMocks()
+
+	var setFlags uint16
+	enableCommandFlagsFn = func(_ *pci.Device, flags uint16) { setFlags |= flags }
+
+	t.Run("modern", func(t *testing.T) {
+		setFlags = 0
+		f := newMockPCIFunction(0x1041)
+		f.addCap(cfgTypeCommon, 4, 0x000, 0x38, 0)
+		f.addCap(cfgTypeISR, 4, 0x100, 0x1, 0)
+		f.addCap(cfgTypeDevice, 4, 0x200, 0x20, 0)
+		f.addCap(cfgTypeNotify, 4, 0x300, 0x100, 4)
+		// Duplicate capabilities are ignored
+		f.addCap(cfgTypeCommon, 4, 0x800, 0x38, 0)
+		f.install(t)
+
+		dev, err := NewDevice(f.dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dev.Type != TypeNet || !dev.Modern() {
+			t.Fatalf("expected a modern network device; got type %d", dev.Type)
+		}
+
+		if exp := pci.CommandIOSpace | pci.CommandMemorySpace | pci.CommandBusMaster; setFlags != exp {
+			t.Fatalf("expected command flags 0x%x to be set; got 0x%x", exp, setFlags)
+		}
+
+		tr := dev.transport.(*modernTransport)
+		if tr.common != f.mmioBase || tr.isrReg != f.mmioBase+0x100 || tr.device != f.mmioBase+0x200 || tr.notifyBase != f.mmioBase+0x300 {
+			t.Fatal("register blocks were mapped at unexpected addresses")
+		}
+
+		if tr.notifyOffMultiplier != 4 {
+			t.Fatalf("expected notify offset multiplier to be 4; got %d", tr.notifyOffMultiplier)
+		}
+	})
+
+	t.Run("legacy fallback", func(t *testing.T) {
+		setFlags = 0
+		f := newMockPCIFunction(0x1001)
+		f.ioPort = 0xc000
+		f.install(t)
+		readConfig16Fn = func(_ *pci.Device, _ uint8) uint16 { return uint16(TypeBlock) }
+
+		dev, err := NewDevice(f.dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dev.Type != TypeBlock || dev.Modern() {
+			t.Fatalf("expected a legacy block device; got type %d", dev.Type)
+		}
+
+		if tr := dev.transport.(*legacyTransport); tr.port != 0xc000 {
+			t.Fatalf("expected legacy transport to use port 0xc000; got 0x%x", tr.port)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		specs := []struct {
+			deviceID uint16
+			setup    func(*mockPCIFunction)
+			expErr   *kernel.Error
+		}{
+			// Modern-only devices without capabilities
+			{0x1042, func(_ *mockPCIFunction) {}, errNoModernCaps},
+			// Transitional device without an I/O BAR
+			{0x1000, func(_ *mockPCIFunction) {}, errNoLegacyPorts},
+			// Register block in an I/O BAR
+			{0x1042, func(f *mockPCIFunction) { f.addCap(cfgTypeCommon, 0, 0, 0x38, 0) }, errInvalidBAR},
+			// Missing ISR capability
+			{0x1042, func(f *mockPCIFunction) {
+				f.addCap(cfgTypeCommon, 4, 0, 0x38, 0)
+				f.addCap(cfgTypeNotify, 4, 0x300, 0x100, 4)
+			}, errNoModernCaps},
+			// Not a virtio device
+			{0x1100, func(_ *mockPCIFunction) {}, errNotVirtio},
+		}
+
+		for specIndex, spec := range specs {
+			f := newMockPCIFunction(spec.deviceID)
+			spec.setup(f)
+			f.install(t)
+			readConfig16Fn = func(_ *pci.Device, _ uint8) uint16 { return uint16(TypeBlock) }
+
+			if _, err := NewDevice(f.dev); err != spec.expErr {
+				t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			}
+		}
+
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		f := newMockPCIFunction(0x1042)
+		f.addCap(cfgTypeCommon, 4, 0, 0x38, 0)
+		f.install(t)
+		mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return 0, expErr
+		}
+		if _, err := NewDevice(f.dev); err != expErr {
+			t.Errorf("expected error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestModernTransport(t *testing.T) {
+	buf := make([]byte, 2*mm.PageSize)
+	base := alignUp(uintptr(unsafe.Pointer(&buf[0])), mm.PageSize)
+
+	tr := &modernTransport{
+		common:              base,
+		isrReg:              base + 0x100,
+		device:              base + 0x200,
+		notifyBase:          base + 0x300,
+		notifyOffMultiplier: 4,
+		notifyOffsets:       make(map[uint16]uint16),
+	}
+
+	// As the registers are backed by plain memory, the feature select
+	// register has no effect and both halves read the same value.
+	write32(base+commonDeviceFeature, 0x11)
+	if exp, got := uint64(0x1100000011), tr.deviceFeatures(); got != exp {
+		t.Errorf("expected device features 0x%x; got 0x%x", exp, got)
+	}
+
+	tr.setDriverFeatures(featureVersion1 | 0x4)
+	if got := read32(base + commonDriverFeature); got != 1 {
+		t.Errorf("expected the high feature dword to be written last; got 0x%x", got)
+	}
+
+	tr.setStatus(statusAcknowledge)
+	if got := tr.status(); got != statusAcknowledge {
+		t.Errorf("expected status 0x%x; got 0x%x", statusAcknowledge, got)
+	}
+
+	specs := []struct {
+		devSize, expSize uint16
+	}{
+		{128, 128},
+		{1024, maxQueueSize},
+		{0, 0},
+	}
+	for specIndex, spec := range specs {
+		write16(base+commonQueueSize, spec.devSize)
+		if got := tr.queueSize(2); got != spec.expSize {
+			t.Errorf("[spec %d] expected queue size %d; got %d", specIndex, spec.expSize, got)
+		}
+	}
+
+	write16(base+commonQueueNotifyOff, 3)
+	if err := tr.enableQueue(2, 64, 0x123456789000, 0x2000, 0x3000); err != nil {
+		t.Fatal(err)
+	}
+
+	if read16(base+commonQueueSelect) != 2 || read16(base+commonQueueSize) != 64 || read16(base+commonQueueEnable) != 1 {
+		t.Error("expected queue 2 to be enabled with 64 entries")
+	}
+
+	if got := *(*uint64)(unsafe.Pointer(base + commonQueueDesc)); got != 0x123456789000 {
+		t.Errorf("expected descriptor table address 0x123456789000; got 0x%x", got)
+	}
+
+	if read32(base+commonQueueDriver) != 0x2000 || read32(base+commonQueueDevice) != 0x3000 {
+		t.Error("expected ring addresses to be written to the common configuration")
+	}
+
+	tr.notify(2)
+	if got := read16(base + 0x300 + 3*4); got != 2 {
+		t.Errorf("expected queue index to be written to the notification address; got %d", got)
+	}
+
+	if !tr.setConfigVector(msixConfigEntry) || !tr.setQueueVector(2, msixQueueEntry) || read16(base+commonQueueMSIXVector) != msixQueueEntry {
+		t.Error("expected MSI-X entries to be assigned")
+	}
+
+	write8(base+0x100, isrQueue)
+	write8(base+commonConfigGeneration, 7)
+	write32(base+0x200, 0xaabbccdd)
+	if tr.isr() != isrQueue || tr.configGeneration() != 7 {
+		t.Error("unexpected ISR or configuration generation value")
+	}
+
+	if tr.readConfig8(0) != 0xdd || tr.readConfig16(0) != 0xccdd || tr.readConfig32(0) != 0xaabbccdd {
+		t.Error("unexpected device configuration value")
+	}
+
+	// Devices without a device-specific configuration block
+	tr.device = 0
+	if tr.readConfig8(0) != 0 || tr.readConfig16(0) != 0 || tr.readConfig32(0) != 0 {
+		t.Error("expected reads to return 0 when the device has no configuration block")
+	}
+}
+
+func TestLegacyTransport(t *testing.T) {
+	defer restoreMocks()
+
+	ports := make(map[uint16]uint32)
+	portReadByteFn = func(port uint16) uint8 { return uint8(ports[port]) }
+	portReadWordFn = func(port uint16) uint16 { return uint16(ports[port]) }
+	portReadDwordFn = func(port uint16) uint32 { return ports[port] }
+	portWriteByteFn = func(port uint16, val uint8) { ports[port] = uint32(val) }
+	portWriteWordFn = func(port uint16, val uint16) { ports[port] = uint32(val) }
+	portWriteDwordFn = func(port uint16, val uint32) { ports[port] = val }
+
+	const base = uint16(0xc000)
+	tr := &legacyTransport{port: base}
+
+	ports[base+legacyDeviceFeatures] = 0x30
+	tr.setDriverFeatures(featureVersion1 | 0x10)
+	if tr.deviceFeatures() != 0x30 || ports[base+legacyDriverFeatures] != 0x10 {
+		t.Error("expected the low feature dword to be exchanged with the device")
+	}
+
+	tr.setStatus(statusDriver)
+	if tr.status() != statusDriver {
+		t.Errorf("expected status 0x%x; got 0x%x", statusDriver, tr.status())
+	}
+
+	ports[base+legacyQueueSize] = 1024
+	if got := tr.queueSize(1); got != 1024 || ports[base+legacyQueueSelect] != 1 {
+		t.Errorf("expected queue 1 to be selected and its full size to be used; got %d", got)
+	}
+
+	specs := []struct {
+		size                 uint16
+		desc, driver, device uintptr
+		expErr               *kernel.Error
+	}{
+		{128, 0x10000, 0x10000 + 128*descSize, 0x10000 + usedRingOffset(128), nil},
+		{128, 0x10010, 0x10010 + 128*descSize, 0x10010 + usedRingOffset(128), errLegacyLayout},
+		{128, 0x10000, 0x20000, 0x10000 + usedRingOffset(128), errLegacyLayout},
+		{128, 0x10000, 0x10000 + 128*descSize, 0x30000, errLegacyLayout},
+	}
+
+	for specIndex, spec := range specs {
+		ports[base+legacyQueuePFN] = 0
+		err := tr.enableQueue(3, spec.size, spec.desc, spec.driver, spec.device)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if err == nil && (ports[base+legacyQueuePFN] != uint32(spec.desc>>legacyPFNShift) || ports[base+legacyQueueSelect] != 3) {
+			t.Errorf("[spec %d] expected the queue PFN to be written to the device", specIndex)
+		}
+	}
+
+	tr.notify(3)
+	if ports[base+legacyQueueNotify] != 3 {
+		t.Error("expected the queue index to be written to the notify register")
+	}
+
+	if tr.setConfigVector(0) || tr.setQueueVector(0, 1) {
+		t.Error("expected MSI-X vectors to be unsupported")
+	}
+
+	ports[base+legacyISR] = uint32(isrConfig)
+	ports[base+legacyConfig+4] = 0x12345678
+	if tr.isr() != isrConfig || tr.configGeneration() != 0 {
+		t.Error("unexpected ISR or configuration generation value")
+	}
+
+	if tr.readConfig8(4) != 0x78 || tr.readConfig16(4) != 0x5678 || tr.readConfig32(4) != 0x12345678 {
+		t.Error("expected config reads to be offset by the legacy header size")
+	}
+}
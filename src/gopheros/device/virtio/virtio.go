@@ -0,0 +1,368 @@
+// Package virtio implements the transport layer that is shared by the drivers
+// for virtio devices attached to the PCI bus. Both the modern (virtio 1.x)
+// interface, which exposes the device registers via vendor-specific PCI
+// capabilities, and the legacy (virtio 0.9.5) I/O port interface are
+// supported.
+//
+// Drivers locate their devices via FindDevices, wrap them using NewDevice and
+// then initialize them by negotiating the device features, setting up the
+// device's virtqueues and finally invoking Start.
+package virtio
+
+import (
+	"gopheros/device/pci"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+)
+
+// DeviceType identifies the kind of a virtio device.
+type DeviceType uint16
+
+// The list of virtio device types with drivers in this tree or in progress.
+const (
+	TypeNet     DeviceType = 1
+	TypeBlock   DeviceType = 2
+	TypeConsole DeviceType = 3
+	TypeRNG     DeviceType = 4
+)
+
+const (
+	pciVendorID = uint16(0x1af4)
+
+	// Transitional devices use the PCI device IDs 0x1000-0x103f and
+	// report their virtio device type via the subsystem ID register.
+	// Modern devices use the device ID 0x1040 + device type.
+	legacyDeviceIDFirst = uint16(0x1000)
+	legacyDeviceIDLast  = uint16(0x103f)
+	modernDeviceIDFirst = uint16(0x1040)
+	modernDeviceIDLast  = uint16(0x107f)
+	regSubsystemID      = uint8(0x2e)
+
+	// Device status bits.
+	statusAcknowledge = uint8(1 << 0)
+	statusDriver      = uint8(1 << 1)
+	statusDriverOK    = uint8(1 << 2)
+	statusFeaturesOK  = uint8(1 << 3)
+	statusFailed      = uint8(1 << 7)
+
+	// ISR status bits which are used when the device signals interrupts
+	// via INTx.
+	isrQueue  = uint8(1 << 0)
+	isrConfig = uint8(1 << 1)
+
+	// featureVersion1 is offered by devices that comply with the virtio
+	// 1.x specification. It must be accepted by drivers that use the
+	// modern interface.
+	featureVersion1 = uint64(1) << 32
+
+	// msixConfigEntry and msixQueueEntry are the MSI-X table entries used
+	// for configuration change and virtqueue notifications.
+	msixConfigEntry = uint16(0)
+	msixQueueEntry  = uint16(1)
+
+	// maxResetSpins bounds the number of polls while waiting for the
+	// device to complete a reset.
+	maxResetSpins = 100000
+
+	// maxConfigRetries bounds the number of attempts to read a consistent
+	// snapshot of a device configuration field wider than 32 bits.
+	maxConfigRetries = 16
+)
+
+var (
+	errNotVirtio         = &kernel.Error{Module: "virtio", Message: "PCI function is not a virtio device"}
+	errResetTimeout      = &kernel.Error{Module: "virtio", Message: "timed out waiting for device reset"}
+	errFeaturesRejected  = &kernel.Error{Module: "virtio", Message: "device rejected the negotiated features"}
+	errNoQueue           = &kernel.Error{Module: "virtio", Message: "virtqueue is not available"}
+	errNoInterrupt       = &kernel.Error{Module: "virtio", Message: "device has no usable interrupt"}
+	errConfigUnavailable = &kernel.Error{Module: "virtio", Message: "could not read a consistent device configuration value"}
+
+	// The following functions are used by tests to mock calls to the pci
+	// and irq packages.
+	pciDevicesFn         = pci.Devices
+	readConfig8Fn        = (*pci.Device).ReadConfig8
+	readConfig16Fn       = (*pci.Device).ReadConfig16
+	readConfig32Fn       = (*pci.Device).ReadConfig32
+	visitCapabilitiesFn  = (*pci.Device).VisitCapabilities
+	barFn                = (*pci.Device).BAR
+	enableCommandFlagsFn = (*pci.Device).EnableCommandFlags
+	enableMSIXFn         = (*pci.Device).EnableMSIX
+	disableMSIXFn        = (*pci.Device).DisableMSIX
+	freeVectorFn         = irq.FreeVector
+	registerIRQFn        = irq.RegisterIRQ
+	setINTxTriggerModeFn = pci.SetINTxTriggerMode
+)
+
+// Device describes a virtio device attached to the PCI bus.
+type Device struct {
+	PCI  *pci.Device
+	Type DeviceType
+
+	// OnConfigChange, if set, is invoked from interrupt context when the
+	// device signals that its configuration space has changed.
+	OnConfigChange func()
+
+	transport transport
+	features  uint64
+	queues    []*Queue
+}
+
+// FindDevices returns the PCI functions that implement the specified virtio
+// device type.
+func FindDevices(typ DeviceType) []*pci.Device {
+	var found []*pci.Device
+	for _, dev := range pciDevicesFn() {
+		if devType, ok := deviceType(dev); ok && devType == typ {
+			found = append(found, dev)
+		}
+	}
+
+	return found
+}
+
+// NewDevice sets up the transport for accessing the registers of a virtio PCI
+// function. The modern interface is used if the device supports it.
+func NewDevice(dev *pci.Device) (*Device, *kernel.Error) {
+	typ, ok := deviceType(dev)
+	if !ok {
+		return nil, errNotVirtio
+	}
+
+	t, err := newModernTransport(dev)
+	if err == errNoModernCaps && dev.DeviceID <= legacyDeviceIDLast {
+		t, err = newLegacyTransport(dev)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	enableCommandFlagsFn(dev, pci.CommandIOSpace|pci.CommandMemorySpace|pci.CommandBusMaster)
+	return &Device{PCI: dev, Type: typ, transport: t}, nil
+}
+
+// deviceType returns the virtio device type for a PCI function and true or 0
+// and false if the function is not a virtio device.
+func deviceType(dev *pci.Device) (DeviceType, bool) {
+	if dev.VendorID != pciVendorID {
+		return 0, false
+	}
+
+	switch {
+	case dev.DeviceID >= modernDeviceIDFirst && dev.DeviceID <= modernDeviceIDLast:
+		return DeviceType(dev.DeviceID - modernDeviceIDFirst), true
+	case dev.DeviceID >= legacyDeviceIDFirst && dev.DeviceID <= legacyDeviceIDLast:
+		return DeviceType(readConfig16Fn(dev, regSubsystemID)), true
+	}
+
+	return 0, false
+}
+
+// Modern returns true if the device is accessed via the virtio 1.x interface.
+func (d *Device) Modern() bool {
+	return d.transport.modern()
+}
+
+// Negotiate resets the device and negotiates the set of features that are
+// supported by both the device and the driver. It returns the negotiated
+// features. Drivers must only pass device-specific feature bits; the bits
+// required by the transport are added automatically.
+func (d *Device) Negotiate(driverFeatures uint64) (uint64, *kernel.Error) {
+	d.transport.setStatus(0)
+	for spins := 0; d.transport.status() != 0; spins++ {
+		if spins == maxResetSpins {
+			return 0, errResetTimeout
+		}
+	}
+
+	d.transport.setStatus(statusAcknowledge)
+	d.transport.setStatus(statusAcknowledge | statusDriver)
+
+	if d.transport.modern() {
+		driverFeatures |= featureVersion1
+	}
+
+	d.features = d.transport.deviceFeatures() & driverFeatures
+	d.transport.setDriverFeatures(d.features)
+
+	// Legacy devices have no way to reject the selected features
+	if d.transport.modern() {
+		d.transport.setStatus(statusAcknowledge | statusDriver | statusFeaturesOK)
+		if d.features&featureVersion1 == 0 || d.transport.status()&statusFeaturesOK == 0 {
+			d.Fail()
+			return 0, errFeaturesRejected
+		}
+	}
+
+	return d.features, nil
+}
+
+// HasFeature returns true if the specified feature bit was negotiated.
+func (d *Device) HasFeature(feature uint64) bool {
+	return d.features&feature == feature
+}
+
+// SetupQueue allocates the rings for the virtqueue with the specified index
+// and passes them to the device. If handler is not nil, it is invoked from
+// interrupt context whenever the device signals that it has processed
+// buffers from the queue. SetupQueue must be invoked after Negotiate and
+// before Start.
+func (d *Device) SetupQueue(index uint16, handler func(*Queue)) (*Queue, *kernel.Error) {
+	size := d.transport.queueSize(index)
+	if size == 0 {
+		return nil, errNoQueue
+	}
+
+	q, err := newQueue(d, index, size, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = d.transport.enableQueue(index, size, q.descPhys, q.availPhys, q.usedPhys); err != nil {
+		return nil, err
+	}
+
+	d.queues = append(d.queues, q)
+	return q, nil
+}
+
+// Start installs the device interrupt handlers and notifies the device that
+// the driver is ready to use it. MSI-X is used if supported by the device;
+// otherwise the device's INTx line is used.
+func (d *Device) Start() *kernel.Error {
+	if !d.enableMSIX() {
+		line := readConfig8Fn(d.PCI, pci.RegInterruptLine)
+		if d.PCI.InterruptPin == 0 || line == 0xff {
+			d.Fail()
+			return errNoInterrupt
+		}
+
+		// Until the ACPI interpreter can evaluate the PCI routing
+		// tables, the firmware-assigned legacy IRQ is used.
+		gsi := irq.ISAIRQToGSI(line)
+		if err := setINTxTriggerModeFn(gsi); err != nil {
+			d.Fail()
+			return err
+		}
+
+		if err := registerIRQFn(gsi, d.handleINTx); err != nil {
+			d.Fail()
+			return err
+		}
+	}
+
+	d.transport.setStatus(d.transport.status() | statusDriverOK)
+	return nil
+}
+
+// enableMSIX attempts to route the device's configuration change and virtqueue
+// notifications to dedicated MSI-X vectors and returns true on success.
+func (d *Device) enableMSIX() bool {
+	if !d.transport.modern() {
+		return false
+	}
+
+	vectors, err := enableMSIXFn(d.PCI, []irq.Handler{d.handleConfigMSIX, d.handleQueueMSIX})
+	if err != nil {
+		return false
+	}
+
+	// The device may fail to allocate the resources for a vector in which
+	// case it reports that no vector is assigned.
+	ok := d.transport.setConfigVector(msixConfigEntry)
+	for _, q := range d.queues {
+		ok = ok && d.transport.setQueueVector(q.index, msixQueueEntry)
+	}
+
+	if !ok {
+		d.transport.setConfigVector(noVector)
+		for _, q := range d.queues {
+			d.transport.setQueueVector(q.index, noVector)
+		}
+
+		disableMSIXFn(d.PCI)
+		for _, vector := range vectors {
+			freeVectorFn(vector)
+		}
+	}
+
+	return ok
+}
+
+// Fail notifies the device that the driver has given up on it.
+func (d *Device) Fail() {
+	d.transport.setStatus(d.transport.status() | statusFailed)
+}
+
+// ReadConfig8 reads a byte from the device-specific configuration space.
+func (d *Device) ReadConfig8(offset uint16) uint8 {
+	return d.transport.readConfig8(offset)
+}
+
+// ReadConfig16 reads a word from the device-specific configuration space.
+func (d *Device) ReadConfig16(offset uint16) uint16 {
+	return d.transport.readConfig16(offset)
+}
+
+// ReadConfig32 reads a dword from the device-specific configuration space.
+func (d *Device) ReadConfig32(offset uint16) uint32 {
+	return d.transport.readConfig32(offset)
+}
+
+// ReadConfig64 reads a qword from the device-specific configuration space.
+// As the value is read using two dword accesses, the read is retried if the
+// device updates its configuration in the meantime.
+func (d *Device) ReadConfig64(offset uint16) (uint64, *kernel.Error) {
+	for attempt := 0; attempt < maxConfigRetries; attempt++ {
+		gen := d.transport.configGeneration()
+		val := uint64(d.transport.readConfig32(offset)) | uint64(d.transport.readConfig32(offset+4))<<32
+		if d.transport.configGeneration() == gen {
+			return val, nil
+		}
+	}
+
+	return 0, errConfigUnavailable
+}
+
+// handleINTx services the device's legacy interrupt. Reading the ISR status
+// acknowledges the interrupt; a zero status indicates that the interrupt was
+// raised by another device sharing the same line.
+func (d *Device) handleINTx(_ *gate.Registers) bool {
+	isr := d.transport.isr()
+	if isr == 0 {
+		return false
+	}
+
+	if isr&isrConfig != 0 && d.OnConfigChange != nil {
+		d.OnConfigChange()
+	}
+
+	if isr&isrQueue != 0 {
+		d.serviceQueues()
+	}
+
+	return true
+}
+
+func (d *Device) handleConfigMSIX(_ *gate.Registers) bool {
+	if d.OnConfigChange != nil {
+		d.OnConfigChange()
+	}
+	return true
+}
+
+func (d *Device) handleQueueMSIX(_ *gate.Registers) bool {
+	d.serviceQueues()
+	return true
+}
+
+// serviceQueues invokes the handlers of all virtqueues with pending used
+// buffers.
+func (d *Device) serviceQueues() {
+	for _, q := range d.queues {
+		if q.handler != nil && q.pending() {
+			q.handler(q)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package virtio
+
+import (
+	"gopheros/device/netdev"
+	"gopheros/device/pci"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/rand"
+	"gopheros/kernel/timer"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	pciDevicesFn = pci.Devices
+	readConfig8Fn = (*pci.Device).ReadConfig8
+	readConfig16Fn = (*pci.Device).ReadConfig16
+	readConfig32Fn = (*pci.Device).ReadConfig32
+	visitCapabilitiesFn = (*pci.Device).VisitCapabilities
+	barFn = (*pci.Device).BAR
+	enableCommandFlagsFn = (*pci.Device).EnableCommandFlags
+	enableMSIXFn = (*pci.Device).EnableMSIX
+	disableMSIXFn = (*pci.Device).DisableMSIX
+	freeVectorFn = irq.FreeVector
+	registerIRQFn = irq.RegisterIRQ
+	setINTxTriggerModeFn = pci.SetINTxTriggerMode
+	portReadByteFn = cpu.PortReadByte
+	portReadWordFn = cpu.PortReadWord
+	portReadDwordFn = cpu.PortReadDword
+	portWriteByteFn = cpu.PortWriteByte
+	portWriteWordFn = cpu.PortWriteWord
+	portWriteDwordFn = cpu.PortWriteDword
+	mapRegionFn = vmm.MapRegion
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	allocDMAFn = vmm.AllocDMA
+	findDevicesFn = FindDevices
+	newDeviceFn = NewDevice
+	registerNetDevFn = netdev.Register
+	scheduleRXFn = (*netdev.Interface).ScheduleRX
+	receiveFrameFn = (*netdev.Interface).Receive
+	addEntropyFn = rand.AddEntropy
+	timerAfterFn = timer.After
+	nextLocalMAC = 0
+	dmaBuffers = nil
+}
+
+// dmaBuffers keeps the memory returned by the mocked DMA allocator reachable
+// for the duration of a test.
+var dmaBuffers [][]byte
+
+// mockDMA redirects DMA allocations to page-aligned Go memory. The physical
+// address of each allocation is reported as its virtual address plus
+// physOffset.
+func mockDMA(physOffset uintptr) {
+	mockInterrupts()
+
+	allocDMAFn = func(size uintptr) (uintptr, uintptr, *kernel.Error) {
+		buf := make([]byte, size+2*mm.PageSize)
+		dmaBuffers = append(dmaBuffers, buf)
+		virt := alignUp(uintptr(unsafe.Pointer(&buf[0])), mm.PageSize)
+		return virt, virt + physOffset, nil
+	}
+}
+
+func mockInterrupts() {
+	interruptsEnabledFn = func() bool { return false }
+	enableInterruptsFn = func() {}
+	disableInterruptsFn = func() {}
+}
+
+// mockTransport records the operations performed by the Device methods.
+type mockTransport struct {
+	isModern       bool
+	devFeatures    uint64
+	drvFeatures    uint64
+	statusReg      uint8
+	statusHistory  []uint8
+	stuckReset     bool
+	rejectFeatures bool
+	queueSizes     map[uint16]uint16
+	enabledQueues  map[uint16][3]uintptr
+	enableErr      *kernel.Error
+	notified       []uint16
+	acceptVectors  bool
+	configVector   uint16
+	queueVectors   map[uint16]uint16
+	isrReg         uint8
+	generations    []uint8
+	config         [64]uint8
+}
+
+func newMockTransport(modern bool) *mockTransport {
+	return &mockTransport{
+		isModern:      modern,
+		queueSizes:    map[uint16]uint16{0: 8, 1: 16},
+		enabledQueues: make(map[uint16][3]uintptr),
+		queueVectors:  make(map[uint16]uint16),
+		configVector:  noVector,
+		acceptVectors: true,
+	}
+}
+
+func (t *mockTransport) modern() bool                  { return t.isModern }
+func (t *mockTransport) deviceFeatures() uint64        { return t.devFeatures }
+func (t *mockTransport) setDriverFeatures(f uint64)    { t.drvFeatures = f }
+func (t *mockTransport) queueSize(index uint16) uint16 { return t.queueSizes[index] }
+func (t *mockTransport) notify(index uint16)           { t.notified = append(t.notified, index) }
+
+func (t *mockTransport) readConfig8(off uint16) uint8 { return t.config[off] }
+
+func (t *mockTransport) readConfig16(off uint16) uint16 {
+	return uint16(t.config[off]) | uint16(t.config[off+1])<<8
+}
+
+func (t *mockTransport) readConfig32(off uint16) uint32 {
+	return uint32(t.readConfig16(off)) | uint32(t.readConfig16(off+2))<<16
+}
+
+func (t *mockTransport) status() uint8 {
+	if t.stuckReset {
+		return statusAcknowledge
+	}
+	return t.statusReg
+}
+
+func (t *mockTransport) setStatus(status uint8) {
+	if t.rejectFeatures {
+		status &^= statusFeaturesOK
+	}
+	t.statusReg = status
+	t.statusHistory = append(t.statusHistory, status)
+}
+
+func (t *mockTransport) enableQueue(index, size uint16, desc, driver, device uintptr) *kernel.Error {
+	if t.enableErr != nil {
+		return t.enableErr
+	}
+	t.enabledQueues[index] = [3]uintptr{desc, driver, device}
+	return nil
+}
+
+func (t *mockTransport) setConfigVector(entry uint16) bool {
+	if !t.acceptVectors && entry != noVector {
+		t.configVector = noVector
+		return false
+	}
+	t.configVector = entry
+	return true
+}
+
+func (t *mockTransport) setQueueVector(index, entry uint16) bool {
+	t.queueVectors[index] = entry
+	return true
+}
+
+func (t *mockTransport) isr() uint8 {
+	isr := t.isrReg
+	t.isrReg = 0
+	return isr
+}
+
+func (t *mockTransport) configGeneration() uint8 {
+	if len(t.generations) == 0 {
+		return 0
+	}
+	gen := t.generations[0]
+	t.generations = t.generations[1:]
+	return gen
+}
+
+func TestFindDevices(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		modernBlk = &pci.Device{VendorID: pciVendorID, DeviceID: 0x1042}
+		legacyNet = &pci.Device{VendorID: pciVendorID, DeviceID: 0x1000}
+		otherNet  = &pci.Device{VendorID: 0x8086, DeviceID: 0x100e}
+		unknown   = &pci.Device{VendorID: pciVendorID, DeviceID: 0x1100}
+		modernNet = &pci.Device{VendorID: pciVendorID, DeviceID: 0x1041}
+	)
+
+	pciDevicesFn = func() []*pci.Device {
+		return []*pci.Device{modernBlk, legacyNet, otherNet, unknown, modernNet}
+	}
+	readConfig16Fn = func(dev *pci.Device, offset uint8) uint16 {
+		if dev != legacyNet || offset != regSubsystemID {
+			t.Errorf("unexpected subsystem ID read")
+		}
+		return uint16(TypeNet)
+	}
+
+	specs := []struct {
+		typ DeviceType
+		exp []*pci.Device
+	}{
+		{TypeNet, []*pci.Device{legacyNet, modernNet}},
+		{TypeBlock, []*pci.Device{modernBlk}},
+		{TypeRNG, nil},
+	}
+
+	for specIndex, spec := range specs {
+		got := FindDevices(spec.typ)
+		if len(got) != len(spec.exp) {
+			t.Errorf("[spec %d] expected %d devices; got %d", specIndex, len(spec.exp), len(got))
+			continue
+		}
+
+		for i := range got {
+			if got[i] != spec.exp[i] {
+				t.Errorf("[spec %d] expected device %d to be %v; got %v", specIndex, i, spec.exp[i], got[i])
+			}
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	specs := []struct {
+		modern         bool
+		devFeatures    uint64
+		drvFeatures    uint64
+		stuckReset     bool
+		rejectFeatures bool
+		expFeatures    uint64
+		expErr         *kernel.Error
+		expStatus      []uint8
+	}{
+		{
+			true, featureVersion1 | 0x5, 0x6, false, false,
+			featureVersion1 | 0x4, nil,
+			[]uint8{0, statusAcknowledge, statusAcknowledge | statusDriver, statusAcknowledge | statusDriver | statusFeaturesOK},
+		},
+		{
+			false, 0x5, 0x6, false, false,
+			0x4, nil,
+			[]uint8{0, statusAcknowledge, statusAcknowledge | statusDriver},
+		},
+		// Modern devices must offer VERSION_1
+		{
+			true, 0x5, 0x6, false, false,
+			0, errFeaturesRejected,
+			[]uint8{0, statusAcknowledge, statusAcknowledge | statusDriver, statusAcknowledge | statusDriver | statusFeaturesOK, statusAcknowledge | statusDriver | statusFeaturesOK | statusFailed},
+		},
+		{
+			true, featureVersion1, 0, false, true,
+			0, errFeaturesRejected,
+			[]uint8{0, statusAcknowledge, statusAcknowledge | statusDriver, statusAcknowledge | statusDriver, statusAcknowledge | statusDriver | statusFailed},
+		},
+		{
+			true, featureVersion1, 0, true, false,
+			0, errResetTimeout,
+			[]uint8{0},
+		},
+	}
+
+	for specIndex, spec := range specs {
+		tr := newMockTransport(spec.modern)
+		tr.devFeatures, tr.stuckReset, tr.rejectFeatures = spec.devFeatures, spec.stuckReset, spec.rejectFeatures
+		dev := &Device{transport: tr}
+
+		features, err := dev.Negotiate(spec.drvFeatures)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if features != spec.expFeatures {
+			t.Errorf("[spec %d] expected negotiated features 0x%x; got 0x%x", specIndex, spec.expFeatures, features)
+		}
+
+		if err == nil && (tr.drvFeatures != spec.expFeatures || !dev.HasFeature(spec.expFeatures)) {
+			t.Errorf("[spec %d] expected driver features 0x%x to be written to the device; got 0x%x", specIndex, spec.expFeatures, tr.drvFeatures)
+		}
+
+		if len(tr.statusHistory) != len(spec.expStatus) {
+			t.Errorf("[spec %d] expected status writes %v; got %v", specIndex, spec.expStatus, tr.statusHistory)
+			continue
+		}
+		for i, exp := range spec.expStatus {
+			if tr.statusHistory[i] != exp {
+				t.Errorf("[spec %d] expected status writes %v; got %v", specIndex, spec.expStatus, tr.statusHistory)
+				break
+			}
+		}
+	}
+}
+
+func TestSetupQueue(t *testing.T) {
+	defer restoreMocks()
+	mockDMA(0)
+
+	tr := newMockTransport(true)
+	dev := &Device{transport: tr}
+
+	q, err := dev.SetupQueue(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Index() != 1 || q.size != 16 || q.NumFree() != 16 {
+		t.Fatalf("expected queue 1 with 16 free entries; got queue %d with %d/%d free entries", q.Index(), q.NumFree(), q.size)
+	}
+
+	if exp, got := [3]uintptr{q.descPhys, q.availPhys, q.usedPhys}, tr.enabledQueues[1]; got != exp {
+		t.Fatalf("expected queue addresses %v to be passed to the device; got %v", exp, got)
+	}
+
+	if _, err = dev.SetupQueue(2, nil); err != errNoQueue {
+		t.Fatalf("expected error %v; got %v", errNoQueue, err)
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "enable failed"}
+	tr.enableErr = expErr
+	if _, err = dev.SetupQueue(0, nil); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	allocDMAFn = func(_ uintptr) (uintptr, uintptr, *kernel.Error) { return 0, 0, expErr }
+	if _, err = dev.SetupQueue(0, nil); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	if len(dev.queues) != 1 {
+		t.Fatalf("expected 1 active queue; got %d", len(dev.queues))
+	}
+}
+
+func TestStart(t *testing.T) {
+	defer restoreMocks()
+	mockDMA(0)
+
+	irqErr := &kernel.Error{Module: "test", Message: "irq error"}
+	trigErr := &kernel.Error{Module: "test", Message: "trigger mode error"}
+
+	specs := []struct {
+		modern        bool
+		msixErr       *kernel.Error
+		acceptVectors bool
+		pin, line     uint8
+		trigErr       *kernel.Error
+		irqErr        *kernel.Error
+		expMSIX       bool
+		expGSI        uint32
+		expErr        *kernel.Error
+	}{
+		{true, nil, true, 1, 11, nil, nil, true, 0, nil},
+		{true, nil, false, 1, 11, nil, nil, false, 11, nil},
+		{true, errNoMSIXMock, true, 1, 10, nil, nil, false, 10, nil},
+		{false, nil, true, 1, 10, nil, nil, false, 10, nil},
+		{false, nil, true, 0, 10, nil, nil, false, 0, errNoInterrupt},
+		{false, nil, true, 1, 0xff, nil, nil, false, 0, errNoInterrupt},
+		{false, nil, true, 1, 10, trigErr, nil, false, 10, trigErr},
+		{false, nil, true, 1, 10, nil, irqErr, false, 10, irqErr},
+	}
+
+	for specIndex, spec := range specs {
+		var (
+			tr         = newMockTransport(spec.modern)
+			pciDev     = &pci.Device{InterruptPin: spec.pin}
+			dev        = &Device{PCI: pciDev, transport: tr}
+			msixActive bool
+			freed      int
+			gotGSI     uint32
+			levelGSI   = ^uint32(0)
+		)
+		tr.acceptVectors = spec.acceptVectors
+
+		enableMSIXFn = func(_ *pci.Device, handlers []irq.Handler) ([]gate.InterruptNumber, *kernel.Error) {
+			if spec.msixErr != nil {
+				return nil, spec.msixErr
+			}
+			if len(handlers) != 2 {
+				t.Errorf("[spec %d] expected 2 MSI-X handlers; got %d", specIndex, len(handlers))
+			}
+			msixActive = true
+			return []gate.InterruptNumber{0x40, 0x41}, nil
+		}
+		disableMSIXFn = func(_ *pci.Device) { msixActive = false }
+		freeVectorFn = func(_ gate.InterruptNumber) { freed++ }
+		readConfig8Fn = func(_ *pci.Device, offset uint8) uint8 {
+			if offset != pci.RegInterruptLine {
+				t.Errorf("[spec %d] unexpected config read at 0x%x", specIndex, offset)
+			}
+			return spec.line
+		}
+		setINTxTriggerModeFn = func(gsi uint32) *kernel.Error {
+			levelGSI = gsi
+			return spec.trigErr
+		}
+		registerIRQFn = func(gsi uint32, _ irq.Handler) *kernel.Error {
+			if levelGSI != gsi {
+				t.Errorf("[spec %d] expected trigger mode of GSI %d to be configured before registering its handler", specIndex, gsi)
+			}
+			gotGSI = gsi
+			return spec.irqErr
+		}
+
+		if _, err := dev.SetupQueue(0, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		err := dev.Start()
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if err != nil {
+			if tr.statusReg&statusFailed == 0 {
+				t.Errorf("[spec %d] expected device to be marked as failed", specIndex)
+			}
+			continue
+		}
+
+		if tr.statusReg&statusDriverOK == 0 {
+			t.Errorf("[spec %d] expected DRIVER_OK to be set", specIndex)
+		}
+
+		if msixActive != spec.expMSIX {
+			t.Errorf("[spec %d] expected MSI-X enabled to be %t", specIndex, spec.expMSIX)
+		}
+
+		if spec.expMSIX {
+			if tr.configVector != msixConfigEntry || tr.queueVectors[0] != msixQueueEntry {
+				t.Errorf("[spec %d] expected config and queue notifications to use MSI-X entries %d and %d", specIndex, msixConfigEntry, msixQueueEntry)
+			}
+		} else if gotGSI != spec.expGSI {
+			t.Errorf("[spec %d] expected INTx handler to be registered for GSI %d; got %d", specIndex, spec.expGSI, gotGSI)
+		}
+
+		if spec.modern && spec.msixErr == nil && !spec.acceptVectors && freed != 2 {
+			t.Errorf("[spec %d] expected the MSI-X vectors to be released; %d were freed", specIndex, freed)
+		}
+	}
+}
+
+var errNoMSIXMock = &kernel.Error{Module: "test", Message: "no MSI-X"}
+
+func TestInterruptHandlers(t *testing.T) {
+	defer restoreMocks()
+	mockDMA(0)
+
+	var (
+		tr            = newMockTransport(false)
+		dev           = &Device{transport: tr}
+		configChanges int
+		serviced      []uint16
+	)
+
+	handler := func(q *Queue) { serviced = append(serviced, q.Index()) }
+	q0, _ := dev.SetupQueue(0, handler)
+	q1, _ := dev.SetupQueue(1, handler)
+
+	// Shared interrupt raised by another device
+	if dev.handleINTx(nil) {
+		t.Fatal("expected handler to return false when the ISR status is 0")
+	}
+
+	// Config changes are ignored without a callback
+	tr.isrReg = isrConfig
+	if !dev.handleINTx(nil) {
+		t.Fatal("expected handler to service the interrupt")
+	}
+
+	dev.OnConfigChange = func() { configChanges++ }
+	tr.isrReg = isrConfig | isrQueue
+	*q1.usedHeader = 1 << 16
+	if !dev.handleINTx(nil) {
+		t.Fatal("expected handler to service the interrupt")
+	}
+
+	if configChanges != 1 {
+		t.Fatalf("expected config change callback to be invoked once; got %d", configChanges)
+	}
+
+	if len(serviced) != 1 || serviced[0] != 1 {
+		t.Fatalf("expected only queue 1 to be serviced; got %v", serviced)
+	}
+
+	serviced = nil
+	*q0.usedHeader = 1 << 16
+	if !dev.handleQueueMSIX(nil) || len(serviced) != 2 {
+		t.Fatalf("expected both queues with pending entries to be serviced; got %v", serviced)
+	}
+
+	if !dev.handleConfigMSIX(nil) || configChanges != 2 {
+		t.Fatalf("expected config change callback to be invoked by the MSI-X handler")
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	tr := newMockTransport(true)
+	copy(tr.config[:], []uint8{0x44, 0x33, 0x22, 0x11, 0x88, 0x77, 0x66, 0x55, 0x78, 0x56, 0x34, 0x12})
+	dev := &Device{transport: tr}
+
+	if got := dev.ReadConfig8(8); got != 0x78 {
+		t.Errorf("expected ReadConfig8 to return 0x78; got 0x%x", got)
+	}
+
+	if got := dev.ReadConfig16(8); got != 0x5678 {
+		t.Errorf("expected ReadConfig16 to return 0x5678; got 0x%x", got)
+	}
+
+	if got := dev.ReadConfig32(8); got != 0x12345678 {
+		t.Errorf("expected ReadConfig32 to return 0x12345678; got 0x%x", got)
+	}
+
+	// The generation changes while the first read is in progress
+	tr.generations = []uint8{1, 2, 2, 2}
+	if got, err := dev.ReadConfig64(0); err != nil || got != 0x5566778811223344 {
+		t.Errorf("expected ReadConfig64 to return 0x5566778811223344; got 0x%x, %v", got, err)
+	}
+
+	tr.generations = make([]uint8, 2*maxConfigRetries)
+	for i := range tr.generations {
+		tr.generations[i] = uint8(i)
+	}
+	if _, err := dev.ReadConfig64(0); err != errConfigUnavailable {
+		t.Errorf("expected error %v; got %v", errConfigUnavailable, err)
+	}
+
+	if !dev.Modern() {
+		t.Error("expected Modern to return true")
+	}
+}
@@ -0,0 +1,168 @@
+// Package cmdline provides access to the arguments passed to the kernel via the
+// boot command line.
+//
+// Arguments are whitespace-separated and are either key/value pairs (e.g.
+// console=ttyS0,115200) or flags (e.g. acpi.off). The command line is parsed
+// into a map once Init is invoked. Before that, lookups scan the command line
+// supplied by the bootloader without allocating any memory so they can be used
+// before the memory allocator is bootstrapped.
+package cmdline
+
+import (
+	"gopheros/multiboot"
+)
+
+var (
+	// args holds the parsed command line arguments. It is nil until Init
+	// is invoked.
+	args map[string]string
+
+	// bootCmdLineFn is used by tests to mock calls to the multiboot package.
+	bootCmdLineFn = multiboot.BootCmdLine
+)
+
+// Init parses the boot command line. It must be invoked after the memory
+// allocator has been bootstrapped.
+func Init() {
+	parsed := make(map[string]string)
+
+	cmdLine := bootCmdLineFn()
+	for pos := 0; ; {
+		key, value, next := nextArg(cmdLine, pos)
+		if key == "" {
+			break
+		}
+
+		// Copy the argument contents out of the bootloader-supplied
+		// memory region.
+		parsed[string([]byte(key))] = string([]byte(value))
+		pos = next
+	}
+
+	args = parsed
+}
+
+// Lookup returns the value of the named argument and a flag indicating whether
+// the argument is present. Flags (arguments without a value) have an empty
+// value. If an argument is specified multiple times, its last value is used.
+func Lookup(name string) (string, bool) {
+	if args != nil {
+		value, found := args[name]
+		return value, found
+	}
+
+	var (
+		cmdLine       = bootCmdLineFn()
+		value         string
+		found         bool
+		key, argValue string
+	)
+
+	for pos := 0; ; {
+		if key, argValue, pos = nextArg(cmdLine, pos); key == "" {
+			break
+		}
+
+		if key == name {
+			value, found = argValue, true
+		}
+	}
+
+	return value, found
+}
+
+// Get returns the value of the named argument or an empty string if the
+// argument is not present.
+func Get(name string) string {
+	value, _ := Lookup(name)
+	return value
+}
+
+// Bool returns true if the named argument is present as a flag or if its value
+// is one of "1", "true", "on" or "yes".
+func Bool(name string) bool {
+	value, found := Lookup(name)
+	if !found {
+		return false
+	}
+
+	switch value {
+	case "", "1", "true", "on", "yes":
+		return true
+	}
+
+	return false
+}
+
+// Uint returns the value of the named argument parsed as an unsigned integer
+// and a flag indicating whether the argument is present and contains a valid
+// decimal or hex (0x-prefixed) number.
+func Uint(name string) (uint64, bool) {
+	value, found := Lookup(name)
+	if !found || value == "" {
+		return 0, false
+	}
+
+	base := uint64(10)
+	if len(value) > 2 && value[0] == '0' && (value[1] == 'x' || value[1] == 'X') {
+		base, value = 16, value[2:]
+	}
+
+	var res uint64
+	for i := 0; i < len(value); i++ {
+		var digit uint64
+		switch ch := value[i]; {
+		case ch >= '0' && ch <= '9':
+			digit = uint64(ch - '0')
+		case base == 16 && ch >= 'a' && ch <= 'f':
+			digit = uint64(ch-'a') + 10
+		case base == 16 && ch >= 'A' && ch <= 'F':
+			digit = uint64(ch-'A') + 10
+		default:
+			return 0, false
+		}
+
+		if res > (^uint64(0)-digit)/base {
+			return 0, false
+		}
+		res = res*base + digit
+	}
+
+	return res, true
+}
+
+// nextArg returns the key and value of the first argument in cmdLine that
+// starts at or after pos as well as the position where the scan for the next
+// argument should resume. Arguments with an empty key are skipped. If no more
+// arguments are available, nextArg returns an empty key. The returned strings
+// share their storage with cmdLine.
+func nextArg(cmdLine string, pos int) (string, string, int) {
+	for pos < len(cmdLine) {
+		if isSpace(cmdLine[pos]) {
+			pos++
+			continue
+		}
+
+		start := pos
+		for ; pos < len(cmdLine) && !isSpace(cmdLine[pos]); pos++ {
+		}
+
+		key, value := cmdLine[start:pos], ""
+		for i := 0; i < len(key); i++ {
+			if key[i] == '=' {
+				key, value = key[:i], key[i+1:]
+				break
+			}
+		}
+
+		if key != "" {
+			return key, value, pos
+		}
+	}
+
+	return "", "", pos
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n'
+}
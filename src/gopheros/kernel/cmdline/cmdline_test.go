@@ -0,0 +1,87 @@
+package cmdline
+
+import (
+	"gopheros/multiboot"
+	"testing"
+)
+
+func restoreMocks() {
+	bootCmdLineFn = multiboot.BootCmdLine
+	args = nil
+}
+
+func TestLookup(t *testing.T) {
+	defer restoreMocks()
+
+	bootCmdLineFn = func() string {
+		return "  console=ttyS0,115200 acpi.off\tdebug=on =novalue quiet=0 count=42 count=43 "
+	}
+
+	specs := []struct {
+		name     string
+		expValue string
+		expFound bool
+		expBool  bool
+	}{
+		{"console", "ttyS0,115200", true, false},
+		{"acpi.off", "", true, true},
+		{"debug", "on", true, true},
+		{"quiet", "0", true, false},
+		{"count", "43", true, false},
+		{"missing", "", false, false},
+		{"acpi", "", false, false},
+	}
+
+	// Run the specs both before and after parsing the command line
+	for pass := 0; pass < 2; pass++ {
+		if pass == 1 {
+			Init()
+		}
+
+		for specIndex, spec := range specs {
+			value, found := Lookup(spec.name)
+			if value != spec.expValue || found != spec.expFound {
+				t.Errorf("[pass %d, spec %d] expected Lookup(%q) to return (%q, %t); got (%q, %t)", pass, specIndex, spec.name, spec.expValue, spec.expFound, value, found)
+			}
+
+			if got := Get(spec.name); got != spec.expValue {
+				t.Errorf("[pass %d, spec %d] expected Get(%q) to return %q; got %q", pass, specIndex, spec.name, spec.expValue, got)
+			}
+
+			if got := Bool(spec.name); got != spec.expBool {
+				t.Errorf("[pass %d, spec %d] expected Bool(%q) to return %t; got %t", pass, specIndex, spec.name, spec.expBool, got)
+			}
+		}
+	}
+}
+
+func TestUint(t *testing.T) {
+	defer restoreMocks()
+
+	bootCmdLineFn = func() string {
+		return "dec=1234 hex=0xBeef zero=0 flag bad=12z badhex=0xg overflow=18446744073709551616 max=18446744073709551615"
+	}
+	Init()
+
+	specs := []struct {
+		name     string
+		expValue uint64
+		expOK    bool
+	}{
+		{"dec", 1234, true},
+		{"hex", 0xbeef, true},
+		{"zero", 0, true},
+		{"max", ^uint64(0), true},
+		{"flag", 0, false},
+		{"bad", 0, false},
+		{"badhex", 0, false},
+		{"overflow", 0, false},
+		{"missing", 0, false},
+	}
+
+	for specIndex, spec := range specs {
+		if value, ok := Uint(spec.name); value != spec.expValue || ok != spec.expOK {
+			t.Errorf("[spec %d] expected Uint(%q) to return (%d, %t); got (%d, %t)", specIndex, spec.name, spec.expValue, spec.expOK, value, ok)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+// Package coredump writes ELF core files for user processes that are
+// terminated by a signal whose default action dumps core.
+//
+// The core files follow the layout produced by Linux so that they can be
+// loaded into gdb together with the crashed executable: a PT_NOTE segment with
+// the process status (including the user-mode registers), process information
+// and auxiliary vector notes is followed by a PT_LOAD segment for each mapping
+// of the process. Pages that have not been populated yet are written as zeroes
+// unless they are at the end of a mapping; the file contents of such mappings
+// are truncated and debuggers treat the remainder as zero-filled. Mappings
+// without read access are recorded without contents.
+package coredump
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/proc"
+	"gopheros/kernel/vfs"
+	"strings"
+	"unsafe"
+)
+
+const (
+	// Dir is the directory where core files are written. Core files are
+	// named core.<process name>.<pid> or core.<pid> for unnamed processes.
+	Dir = "/tmp"
+
+	// The ELF identification, type and machine values of core files.
+	elfMagic          = "\x7fELF"
+	elfClass64        = 2
+	elfDataLSB        = 1
+	elfVersionCurrent = 1
+	elfTypeCore       = 4
+
+	// Program header types and flags.
+	ptLoad = 1
+	ptNote = 4
+	pfX    = 1
+	pfW    = 2
+	pfR    = 4
+
+	// Note types and the name of the notes.
+	ntPrStatus = 1
+	ntPrPsInfo = 3
+	ntAuxv     = 6
+	noteName   = "CORE"
+)
+
+// elfHeader mirrors the layout of Elf64_Ehdr.
+type elfHeader struct {
+	ident     [16]byte
+	typ       uint16
+	machine   uint16
+	version   uint32
+	entry     uint64
+	phoff     uint64
+	shoff     uint64
+	flags     uint32
+	ehsize    uint16
+	phentsize uint16
+	phnum     uint16
+	shentsize uint16
+	shnum     uint16
+	shstrndx  uint16
+}
+
+// programHeader mirrors the layout of Elf64_Phdr.
+type programHeader struct {
+	typ    uint32
+	flags  uint32
+	offset uint64
+	vaddr  uint64
+	paddr  uint64
+	filesz uint64
+	memsz  uint64
+	align  uint64
+}
+
+// prStatus mirrors the layout of struct elf_prstatus.
+type prStatus struct {
+	sigNo, sigCode, sigErrno int32
+	curSig                   uint16
+	_                        uint16
+	sigPend, sigHold         uint64
+	pid, ppid, pgrp, sid     int32
+
+	// The user, system and cumulative child times as timevals.
+	times [8]int64
+
+	regs    userRegs
+	fpValid int32
+	_       int32
+}
+
+// prPsInfo mirrors the layout of struct elf_prpsinfo.
+type prPsInfo struct {
+	state, sname, zombie, nice uint8
+	_                          uint32
+	flag                       uint64
+	uid, gid                   uint32
+	pid, ppid, pgrp, sid       int32
+	fname                      [16]byte
+	psargs                     [80]byte
+}
+
+var (
+	errShortWrite = &kernel.Error{Module: "coredump", Message: "short write", Code: kernel.CodeIO}
+
+	// The following functions are used by tests to mock calls to the vfs
+	// and vmm packages.
+	createFn         = vfs.Create
+	userAccessibleFn = vmm.UserAccessible
+	copyUserFn       = vmm.CopyUser
+)
+
+// Write writes a core file for p, which must be the calling process, after it
+// received sig. The registers saved when the process entered the kernel are
+// recorded in the core file. Write returns the path of the core file.
+func Write(p *proc.Process, sig proc.Signal, regs *gate.Registers) (string, *kernel.Error) {
+	var regions []vmm.Region
+	p.Regions().Visit(func(r vmm.Region) bool {
+		regions = append(regions, r)
+		return true
+	})
+
+	path := Path(p)
+	f, err := createFn(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var (
+		notes      = buildNotes(p, sig, regs)
+		headerSize = uint64(unsafe.Sizeof(elfHeader{})) + uint64(len(regions)+1)*uint64(unsafe.Sizeof(programHeader{}))
+		dataOffset = (headerSize + uint64(len(notes)) + uint64(mm.PageSize-1)) &^ uint64(mm.PageSize-1)
+		phdrs      = make([]programHeader, 0, len(regions)+1)
+	)
+
+	phdrs = append(phdrs, programHeader{typ: ptNote, offset: headerSize, filesz: uint64(len(notes)), align: 4})
+	for offset, i := dataOffset, 0; i < len(regions); i++ {
+		ph := segmentHeader(regions[i], offset)
+		offset += ph.filesz
+		phdrs = append(phdrs, ph)
+	}
+
+	hdr := elfHeader{
+		typ:       elfTypeCore,
+		machine:   elfMachine,
+		version:   elfVersionCurrent,
+		phoff:     uint64(unsafe.Sizeof(elfHeader{})),
+		ehsize:    uint16(unsafe.Sizeof(elfHeader{})),
+		phentsize: uint16(unsafe.Sizeof(programHeader{})),
+		phnum:     uint16(len(phdrs)),
+	}
+	copy(hdr.ident[:], elfMagic)
+	hdr.ident[4], hdr.ident[5], hdr.ident[6] = elfClass64, elfDataLSB, elfVersionCurrent
+
+	header := make([]byte, 0, dataOffset)
+	header = append(header, (*[unsafe.Sizeof(hdr)]byte)(unsafe.Pointer(&hdr))[:]...)
+	for i := range phdrs {
+		header = append(header, (*[unsafe.Sizeof(phdrs[i])]byte)(unsafe.Pointer(&phdrs[i]))[:]...)
+	}
+	header = append(header, notes...)
+	header = header[:dataOffset]
+	if err = write(f, header); err != nil {
+		return "", err
+	}
+
+	page := make([]byte, mm.PageSize)
+	for i, r := range regions {
+		for addr := r.Start; addr < r.Start+uintptr(phdrs[i+1].filesz); addr += mm.PageSize {
+			readPage(page, addr)
+			if err = write(f, page); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return path, nil
+}
+
+// Path returns the path of the core file for p.
+func Path(p *proc.Process) string {
+	var buf bytes.Buffer
+	if name := baseName(p.Name()); name != "" {
+		kfmt.Fprintf(&buf, "%s/core.%s.%d", Dir, name, uint32(p.PID()))
+	} else {
+		kfmt.Fprintf(&buf, "%s/core.%d", Dir, uint32(p.PID()))
+	}
+	return buf.String()
+}
+
+// baseName returns the last element of a slash-separated path.
+func baseName(path string) string {
+	return path[strings.LastIndexByte(path, '/')+1:]
+}
+
+// segmentHeader returns the program header for a mapping whose contents are
+// stored at the specified file offset. Only the part of the mapping up to its
+// last populated page is stored in the file.
+func segmentHeader(r vmm.Region, offset uint64) programHeader {
+	ph := programHeader{
+		typ:    ptLoad,
+		offset: offset,
+		vaddr:  uint64(r.Start),
+		memsz:  uint64(r.End - r.Start),
+		align:  uint64(mm.PageSize),
+	}
+
+	if r.Flags&vmm.FlagPresent == 0 {
+		return ph
+	}
+
+	ph.flags = pfR
+	if r.Flags&vmm.FlagRW != 0 {
+		ph.flags |= pfW
+	}
+	if r.Flags&vmm.FlagNoExecute == 0 {
+		ph.flags |= pfX
+	}
+
+	for end := r.End; end > r.Start; end -= mm.PageSize {
+		if userAccessibleFn(end-mm.PageSize, false) {
+			ph.filesz = uint64(end - r.Start)
+			break
+		}
+	}
+	return ph
+}
+
+// readPage copies the user-space page at addr to buf. The buffer is zeroed if
+// the page has not been populated.
+func readPage(buf []byte, addr uintptr) {
+	if userAccessibleFn(addr, false) && copyUserFn(uintptr(unsafe.Pointer(&buf[0])), addr, uintptr(len(buf))) == nil {
+		return
+	}
+
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+// buildNotes returns the contents of the PT_NOTE segment of the core file.
+func buildNotes(p *proc.Process, sig proc.Signal, regs *gate.Registers) []byte {
+	status := prStatus{
+		sigNo:   int32(sig),
+		curSig:  uint16(sig),
+		sigPend: uint64(p.PendingSignals()),
+		sigHold: uint64(p.SignalMask()),
+		pid:     int32(p.PID()),
+		pgrp:    int32(p.PID()),
+		sid:     int32(p.PID()),
+		regs:    makeUserRegs(p, regs),
+	}
+
+	info := prPsInfo{
+		sname: 'R',
+		pid:   int32(p.PID()),
+		pgrp:  int32(p.PID()),
+		sid:   int32(p.PID()),
+	}
+	copy(info.fname[:len(info.fname)-1], baseName(p.Name()))
+	copy(info.psargs[:len(info.psargs)-1], p.Name())
+
+	if parent := p.Parent(); parent != nil {
+		status.ppid = int32(parent.PID())
+		info.ppid = status.ppid
+	}
+
+	var notes []byte
+	notes = appendNote(notes, ntPrStatus, (*[unsafe.Sizeof(status)]byte)(unsafe.Pointer(&status))[:])
+	notes = appendNote(notes, ntPrPsInfo, (*[unsafe.Sizeof(info)]byte)(unsafe.Pointer(&info))[:])
+	if auxv := p.AuxVector(); len(auxv) != 0 {
+		notes = appendNote(notes, ntAuxv, (*[1 << 16]byte)(unsafe.Pointer(&auxv[0]))[:len(auxv)*8])
+	}
+
+	return notes
+}
+
+// appendNote appends an ELF note with the specified type and description to
+// notes. The name and description are padded to a multiple of 4 bytes.
+func appendNote(notes []byte, typ uint32, desc []byte) []byte {
+	hdr := [3]uint32{uint32(len(noteName) + 1), uint32(len(desc)), typ}
+	notes = append(notes, (*[unsafe.Sizeof(hdr)]byte)(unsafe.Pointer(&hdr))[:]...)
+	notes = append(notes, noteName...)
+	notes = append(notes, make([]byte, align4(len(noteName)+1)-len(noteName))...)
+	notes = append(notes, desc...)
+	return append(notes, make([]byte, align4(len(desc))-len(desc))...)
+}
+
+// align4 rounds n up to a multiple of 4.
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// write writes data to f, failing if not all of it could be written.
+func write(f vfs.File, data []byte) *kernel.Error {
+	for len(data) != 0 {
+		n, err := f.Write(data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errShortWrite
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package coredump
+
+import (
+	"gopheros/kernel/gate"
+	"gopheros/kernel/proc"
+)
+
+// elfMachine is the ELF machine value of core files.
+const elfMachine = 62
+
+// userRegs mirrors the layout of struct user_regs_struct on amd64.
+type userRegs struct {
+	r15, r14, r13, r12, rbp, rbx, r11, r10 uint64
+	r9, r8, rax, rcx, rdx, rsi, rdi        uint64
+	origRAX, rip, cs, rflags, rsp, ss      uint64
+	fsBase, gsBase, ds, es, fs, gs         uint64
+}
+
+// makeUserRegs converts the registers saved when p was interrupted into the
+// format expected by debuggers.
+func makeUserRegs(p *proc.Process, regs *gate.Registers) userRegs {
+	return userRegs{
+		r15: regs.R15, r14: regs.R14, r13: regs.R13, r12: regs.R12,
+		rbp: regs.RBP, rbx: regs.RBX, r11: regs.R11, r10: regs.R10,
+		r9: regs.R9, r8: regs.R8, rax: regs.RAX, rcx: regs.RCX,
+		rdx: regs.RDX, rsi: regs.RSI, rdi: regs.RDI,
+		origRAX: ^uint64(0),
+		rip:     regs.RIP, cs: regs.CS, rflags: regs.RFlags,
+		rsp: regs.RSP, ss: regs.SS,
+		fsBase: uint64(p.FSBase()),
+	}
+}
@@ -0,0 +1,266 @@
+package coredump
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/proc"
+	"gopheros/kernel/vfs"
+	"gopheros/kernel/vfs/ramfs"
+	"io"
+	"io/ioutil"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	createFn = vfs.Create
+	userAccessibleFn = vmm.UserAccessible
+	copyUserFn = vmm.CopyUser
+}
+
+// mockUserMemory serves the populated pages of a fake user address space
+// and records the core file written by Write.
+func mockUserMemory(t *testing.T, pages map[uintptr][]byte) *ramfs.FS {
+	fs := ramfs.New()
+	createFn = func(path string) (vfs.File, *kernel.Error) {
+		if path != Dir+"/core.0" {
+			t.Errorf("expected the core file to be created at %s/core.0; got %q", Dir, path)
+		}
+		return fs.Create("/core")
+	}
+	userAccessibleFn = func(addr uintptr, _ bool) bool {
+		_, ok := pages[addr]
+		return ok
+	}
+	copyUserFn = func(dst, src, size uintptr) *kernel.Error {
+		copy((*[mm.PageSize]byte)(unsafe.Pointer(dst))[:size], pages[src])
+		return nil
+	}
+
+	return fs
+}
+
+func TestLayout(t *testing.T) {
+	for _, spec := range []struct {
+		name    string
+		got     uintptr
+		expSize uintptr
+	}{
+		{"elf_prstatus", unsafe.Sizeof(prStatus{}), 336},
+		{"elf_prpsinfo", unsafe.Sizeof(prPsInfo{}), 136},
+		{"user_regs_struct", unsafe.Sizeof(userRegs{}), 216},
+	} {
+		if spec.got != spec.expSize {
+			t.Errorf("expected struct %s to be %d bytes long; got %d", spec.name, spec.expSize, spec.got)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		p    = &proc.Process{}
+		text = bytes.Repeat([]byte{0xc3}, int(mm.PageSize))
+		data = bytes.Repeat([]byte{0x42}, int(mm.PageSize))
+		fs   = mockUserMemory(t, map[uintptr][]byte{
+			0x400000: text,
+			0x600000: data,
+			0x602000: data,
+		})
+		regs = &gate.Registers{RAX: 1, R15: 15, RIP: 0x400010, RSP: 0x7ff000, CS: 0x23, SS: 0x1b}
+	)
+	p.SetAuxVector([]uint64{9, 0x400010, 0, 0})
+	for _, r := range []vmm.Region{
+		{Start: 0x400000, End: 0x401000, Flags: vmm.FlagPresent | vmm.FlagUserAccessible},
+		// The last page of the data segment has not been populated
+		{Start: 0x600000, End: 0x604000, Flags: vmm.FlagPresent | vmm.FlagUserAccessible | vmm.FlagRW | vmm.FlagNoExecute},
+		// Inaccessible mappings are recorded without contents
+		{Start: 0x700000, End: 0x702000},
+	} {
+		if err := p.Regions().Insert(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, err := Write(p, proc.SigSegv, regs)
+	if err != nil || path != Dir+"/core.0" {
+		t.Fatalf("expected the core file to be written to %s/core.0; got %q, %v", Dir, path, err)
+	}
+
+	f, _ := fs.Open("/core")
+	image, _ := ioutil.ReadAll(readerFunc(f.Read))
+	core, perr := elf.NewFile(bytes.NewReader(image))
+	if perr != nil {
+		t.Fatal(perr)
+	}
+
+	if core.Type != elf.ET_CORE || core.Machine != elf.EM_X86_64 || len(core.Progs) != 4 {
+		t.Fatalf("expected an amd64 core file with 4 program headers; got type %v, machine %v, %d headers", core.Type, core.Machine, len(core.Progs))
+	}
+
+	for specIndex, spec := range []struct {
+		vaddr, filesz, memsz uint64
+		flags                elf.ProgFlag
+		contents             []byte
+	}{
+		{0x400000, 0x1000, 0x1000, elf.PF_R | elf.PF_X, text},
+		{0x600000, 0x3000, 0x4000, elf.PF_R | elf.PF_W, append(append(append([]byte{}, data...), make([]byte, mm.PageSize)...), data...)},
+		{0x700000, 0, 0x2000, 0, nil},
+	} {
+		prog := core.Progs[specIndex+1]
+		if prog.Type != elf.PT_LOAD || prog.Vaddr != spec.vaddr || prog.Filesz != spec.filesz || prog.Memsz != spec.memsz || prog.Flags != spec.flags {
+			t.Errorf("[spec %d] unexpected program header %+v", specIndex, prog.ProgHeader)
+			continue
+		}
+
+		if prog.Off&uint64(mm.PageSize-1) != 0 {
+			t.Errorf("[spec %d] expected the segment contents to be page-aligned; got offset 0x%x", specIndex, prog.Off)
+		}
+
+		got, _ := ioutil.ReadAll(prog.Open())
+		if !bytes.Equal(got, spec.contents) {
+			t.Errorf("[spec %d] unexpected segment contents", specIndex)
+		}
+	}
+
+	notes := readNotes(t, core.Progs[0])
+	status := notes[1]
+	if len(status) != int(unsafe.Sizeof(prStatus{})) {
+		t.Fatalf("expected a NT_PRSTATUS note of %d bytes; got %d", unsafe.Sizeof(prStatus{}), len(status))
+	}
+
+	le := binary.LittleEndian
+	regsOffset := int(unsafe.Offsetof(prStatus{}.regs))
+	for _, spec := range []struct {
+		name  string
+		index int
+		exp   uint64
+	}{
+		{"r15", 0, 15},
+		{"rax", 10, 1},
+		{"rip", 16, 0x400010},
+		{"cs", 17, 0x23},
+		{"rsp", 19, 0x7ff000},
+	} {
+		if got := le.Uint64(status[regsOffset+spec.index*8:]); got != spec.exp {
+			t.Errorf("expected register %s to be 0x%x; got 0x%x", spec.name, spec.exp, got)
+		}
+	}
+	if sig := le.Uint32(status); sig != uint32(proc.SigSegv) {
+		t.Errorf("expected the signal number to be %d; got %d", proc.SigSegv, sig)
+	}
+
+	if len(notes[3]) != int(unsafe.Sizeof(prPsInfo{})) {
+		t.Errorf("expected a NT_PRPSINFO note of %d bytes; got %d", unsafe.Sizeof(prPsInfo{}), len(notes[3]))
+	}
+
+	if auxv := notes[6]; len(auxv) != 32 || le.Uint64(auxv) != 9 || le.Uint64(auxv[8:]) != 0x400010 {
+		t.Errorf("expected a NT_AUXV note with the auxiliary vector; got %x", auxv)
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		p      = &proc.Process{}
+		expErr = &kernel.Error{Module: "test", Message: "error"}
+	)
+	mockUserMemory(t, nil)
+	_ = p.Regions().Insert(vmm.Region{Start: 0x400000, End: 0x401000, Flags: vmm.FlagPresent | vmm.FlagUserAccessible})
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return true }
+
+	createFn = func(_ string) (vfs.File, *kernel.Error) { return nil, expErr }
+	if _, err := Write(p, proc.SigSegv, &gate.Registers{}); err != expErr {
+		t.Errorf("expected error %v; got %v", expErr, err)
+	}
+
+	for specIndex, spec := range []struct {
+		failAt   int
+		writeErr *kernel.Error
+		expErr   *kernel.Error
+	}{
+		// Writing the headers or the segment contents fails
+		{0, expErr, expErr},
+		{1, expErr, expErr},
+		{0, nil, errShortWrite},
+	} {
+		f := &failingFile{failAt: spec.failAt, err: spec.writeErr}
+		createFn = func(_ string) (vfs.File, *kernel.Error) { return f, nil }
+
+		if _, err := Write(p, proc.SigSegv, &gate.Registers{}); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	if got := Path(&proc.Process{}); got != Dir+"/core.0" {
+		t.Errorf("expected the core file of an unnamed process to be %s/core.0; got %q", Dir, got)
+	}
+
+	if got := baseName("/sbin/init"); got != "init" {
+		t.Errorf("expected the base name to be init; got %q", got)
+	}
+}
+
+// readNotes returns the descriptions of the notes in a PT_NOTE segment by
+// type.
+func readNotes(t *testing.T, prog *elf.Prog) map[uint32][]byte {
+	data, _ := ioutil.ReadAll(prog.Open())
+	notes := make(map[uint32][]byte)
+
+	le := binary.LittleEndian
+	for len(data) >= 12 {
+		nameSize, descSize, typ := int(le.Uint32(data)), int(le.Uint32(data[4:])), le.Uint32(data[8:])
+		data = data[12:]
+
+		if name := string(data[:nameSize]); name != noteName+"\x00" {
+			t.Errorf("expected note name %q; got %q", noteName, name)
+		}
+		data = data[align4(nameSize):]
+
+		notes[typ] = data[:descSize]
+		data = data[align4(descSize):]
+	}
+
+	return notes
+}
+
+// readerFunc adapts a vfs read function to io.Reader.
+type readerFunc func([]byte) (int, *kernel.Error)
+
+func (fn readerFunc) Read(buf []byte) (int, error) {
+	n, err := fn(buf)
+	switch {
+	case err != nil:
+		return n, err
+	case n == 0:
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// failingFile writes nothing and returns err on the write with index failAt.
+type failingFile struct {
+	failAt int
+	err    *kernel.Error
+	writes int
+}
+
+func (f *failingFile) Read(_ []byte) (int, *kernel.Error) { return 0, nil }
+func (f *failingFile) Write(buf []byte) (int, *kernel.Error) {
+	if f.writes++; f.writes-1 == f.failAt {
+		return 0, f.err
+	}
+	return len(buf), nil
+}
+func (f *failingFile) Lseek(_ int64, _ int) (int64, *kernel.Error) { return 0, nil }
+func (f *failingFile) Stat() (vfs.FileInfo, *kernel.Error)         { return vfs.FileInfo{}, nil }
+func (f *failingFile) Close() *kernel.Error                        { return nil }
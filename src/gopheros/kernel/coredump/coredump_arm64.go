@@ -0,0 +1,23 @@
+package coredump
+
+import (
+	"gopheros/kernel/gate"
+	"gopheros/kernel/proc"
+)
+
+// elfMachine is the ELF machine value of core files.
+const elfMachine = 183
+
+// userRegs mirrors the layout of struct user_pt_regs on arm64.
+type userRegs struct {
+	regs   [31]uint64
+	sp     uint64
+	pc     uint64
+	pstate uint64
+}
+
+// makeUserRegs converts the registers saved when p was interrupted into the
+// format expected by debuggers.
+func makeUserRegs(_ *proc.Process, regs *gate.Registers) userRegs {
+	return userRegs{regs: regs.X, sp: regs.SP, pc: regs.PC, pstate: regs.PState}
+}
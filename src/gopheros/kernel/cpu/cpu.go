@@ -0,0 +1,6 @@
+// Package cpu provides access to the processor features that the kernel
+// depends on. Each supported architecture implements the same set of entry
+// points for controlling interrupts, halting the processor and switching
+// address spaces in a cpu_<arch>.go file; the amd64 implementation also
+// exposes the x86-specific registers, instructions and I/O ports.
+package cpu
@@ -10,9 +10,27 @@ func EnableInterrupts()
 // DisableInterrupts disables interrupt handling.
 func DisableInterrupts()
 
+// InterruptsEnabled returns true if interrupt handling is currently enabled.
+func InterruptsEnabled() bool
+
 // Halt stops instruction execution.
 func Halt()
 
+// WaitForInterrupt enables interrupt handling and stops instruction execution
+// until the next interrupt arrives. Interrupts remain enabled when it returns.
+func WaitForInterrupt()
+
+// Monitor arms the address monitoring hardware for the cache line containing
+// addr so that a subsequent MWait returns when the line is written to. Monitor
+// must only be used if the CPU supports it (CPUID.01H:ECX.MONITOR[bit 3]).
+func Monitor(addr uintptr)
+
+// MWait enables interrupt handling and stops instruction execution until the
+// next interrupt arrives or the address armed via Monitor is written to. The
+// hint selects the target C-state; a zero hint requests C1. Interrupts remain
+// enabled when it returns.
+func MWait(hint uint32)
+
 // FlushTLBEntry flushes a TLB entry for a particular virtual address.
 func FlushTLBEntry(virtAddr uintptr)
 
@@ -26,11 +44,48 @@ func ActivePDT() uintptr
 // ReadCR2 returns the value stored in the CR2 register.
 func ReadCR2() uint64
 
+// ReadCR4 returns the value stored in the CR4 register.
+func ReadCR4() uint64
+
+// WriteCR4 loads the specified value into the CR4 register.
+func WriteCR4(value uint64)
+
+// STAC sets the AC flag in RFLAGS allowing supervisor-mode code to access
+// user-mode pages while SMAP is enabled. STAC must only be used if the CPU
+// supports SMAP (CPUID.(EAX=07H, ECX=0):EBX.SMAP[bit 20]).
+func STAC()
+
+// CLAC clears the AC flag in RFLAGS restoring SMAP protection. Like STAC, it
+// must only be used if the CPU supports SMAP.
+func CLAC()
+
 // ID returns information about the CPU and its features. It
 // is implemented as a CPUID instruction with EAX=leaf and
-// returns the values in EAX, EBX, ECX and EDX.
+// ECX=0 (the first subleaf for leaves that have subleaves)
+// and returns the values in EAX, EBX, ECX and EDX.
 func ID(leaf uint32) (uint32, uint32, uint32, uint32)
 
+// ReadMSR returns the contents of the specified model-specific register.
+func ReadMSR(msr uint32) uint64
+
+// WriteMSR writes a 64-bit value to the specified model-specific register.
+func WriteMSR(msr uint32, value uint64)
+
+// ReadTSC returns the current value of the time-stamp counter.
+func ReadTSC() uint64
+
+// RDRAND returns a random value from the CPU's hardware random number
+// generator. It returns false if the generator could not provide a value; the
+// caller should retry a few times before giving up. RDRAND must only be used
+// if the CPU supports it (CPUID.01H:ECX.RDRAND[bit 30]).
+func RDRAND() (uint64, bool)
+
+// RDSEED returns a value from the CPU's entropy source that is suitable for
+// seeding other random number generators. Like RDRAND, it returns false if no
+// value is available. RDSEED must only be used if the CPU supports it
+// (CPUID.(EAX=07H, ECX=0):EBX.RDSEED[bit 18]).
+func RDSEED() (uint64, bool)
+
 // IsIntel returns true if the code is running on an Intel processor.
 func IsIntel() bool {
 	_, ebx, ecx, edx := cpuidFn(0)
@@ -8,11 +8,42 @@ TEXT ·DisableInterrupts(SB),NOSPLIT,$0
 	CLI
 	RET
 
+TEXT ·InterruptsEnabled(SB),NOSPLIT,$0
+	PUSHFQ
+	POPQ AX
+	SHRQ $9, AX 	// RFLAGS.IF
+	ANDQ $1, AX
+	MOVB AX, ret+0(FP)
+	RET
+
 TEXT ·Halt(SB),NOSPLIT,$0
 	CLI
 	HLT
 	RET
 
+TEXT ·WaitForInterrupt(SB),NOSPLIT,$0
+	// STI delays interrupt delivery until after the following
+	// instruction so no interrupt can be missed before HLT executes.
+	STI
+	HLT
+	RET
+
+TEXT ·Monitor(SB),NOSPLIT,$0
+	MOVQ addr+0(FP), AX
+	XORQ CX, CX 	// no extensions
+	XORQ DX, DX 	// no hints
+	MONITOR
+	RET
+
+TEXT ·MWait(SB),NOSPLIT,$0
+	MOVL hint+0(FP), AX
+	XORQ CX, CX 	// no extensions
+	// Like with HLT, the STI shadow ensures that no interrupt is missed
+	// before MWAIT executes.
+	STI
+	MWAIT
+	RET
+
 TEXT ·FlushTLBEntry(SB),NOSPLIT,$0
 	MOVQ virtAddr+0(FP), AX
 	INVLPG (AX)
@@ -34,13 +65,67 @@ TEXT ·ReadCR2(SB),NOSPLIT,$0
 	MOVQ AX, ret+0(FP)
 	RET
 
+TEXT ·ReadCR4(SB),NOSPLIT,$0
+	MOVQ CR4, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·WriteCR4(SB),NOSPLIT,$0
+	MOVQ value+0(FP), AX
+	MOVQ AX, CR4
+	RET
+
+TEXT ·STAC(SB),NOSPLIT,$0
+	BYTE $0x0f; BYTE $0x01; BYTE $0xcb 	// STAC
+	RET
+
+TEXT ·CLAC(SB),NOSPLIT,$0
+	BYTE $0x0f; BYTE $0x01; BYTE $0xca 	// CLAC
+	RET
+
 TEXT ·ID(SB),NOSPLIT,$0
-	MOVQ leaf+0(FP), AX
+	MOVL leaf+0(FP), AX
+	XORL CX, CX
 	CPUID
-	MOVL AX, ret+0(FP)
-	MOVL BX, ret+4(FP)
-	MOVL CX, ret+8(FP)
-	MOVL DX, ret+12(FP)
+	MOVL AX, ret+8(FP)
+	MOVL BX, ret1+12(FP)
+	MOVL CX, ret2+16(FP)
+	MOVL DX, ret3+20(FP)
+	RET
+
+TEXT ·ReadMSR(SB),NOSPLIT,$0
+	MOVL msr+0(FP), CX
+	RDMSR
+	SHLQ $32, DX
+	ORQ DX, AX
+	MOVQ AX, ret+8(FP)
+	RET
+
+TEXT ·WriteMSR(SB),NOSPLIT,$0
+	MOVL msr+0(FP), CX
+	MOVQ value+8(FP), AX
+	MOVQ AX, DX
+	SHRQ $32, DX
+	WRMSR
+	RET
+
+TEXT ·RDRAND(SB),NOSPLIT,$0
+	RDRANDQ AX
+	SETCS ret1+8(FP) 	// CF is set if a value was returned
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·RDSEED(SB),NOSPLIT,$0
+	RDSEEDQ AX
+	SETCS ret1+8(FP)
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·ReadTSC(SB),NOSPLIT,$0
+	RDTSC
+	SHLQ $32, DX
+	ORQ DX, AX
+	MOVQ AX, ret+0(FP)
 	RET
 
 TEXT ·PortWriteByte(SB),NOSPLIT,$0
@@ -58,25 +143,25 @@ TEXT ·PortWriteWord(SB),NOSPLIT,$0
 
 TEXT ·PortWriteDword(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
-	MOVL val+2(FP), AX
+	MOVL val+4(FP), AX
 	BYTE $0xef  // out eax, dx
 	RET
 
 TEXT ·PortReadByte(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
 	BYTE $0xec  // in al, dx
-	MOVB AX, ret+0(FP)
+	MOVB AX, ret+8(FP)
 	RET
 
 TEXT ·PortReadWord(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
 	BYTE $0x66  
 	BYTE $0xed  // in ax, dx
-	MOVW AX, ret+0(FP)
+	MOVW AX, ret+8(FP)
 	RET
 
 TEXT ·PortReadDword(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
 	BYTE $0xed  // in eax, dx
-	MOVL AX, ret+0(FP)
+	MOVL AX, ret+8(FP)
 	RET
@@ -27,3 +27,42 @@ func TestIsIntel(t *testing.T) {
 		}
 	}
 }
+
+func TestInterruptsEnabled(t *testing.T) {
+	// Interrupts are always enabled for user-space processes
+	if !InterruptsEnabled() {
+		t.Fatal("expected InterruptsEnabled to return true")
+	}
+}
+
+func TestRDRAND(t *testing.T) {
+	specs := []struct {
+		name      string
+		supported func() bool
+		fn        func() (uint64, bool)
+	}{
+		{"RDRAND", func() bool { _, _, ecx, _ := ID(1); return ecx&(1<<30) != 0 }, RDRAND},
+		{"RDSEED", func() bool { _, ebx, _, _ := ID(7); return ebx&(1<<18) != 0 }, RDSEED},
+	}
+
+	for _, spec := range specs {
+		t.Run(spec.name, func(t *testing.T) {
+			if !spec.supported() {
+				t.Skipf("%s is not supported by the host CPU", spec.name)
+			}
+
+			// The generator may transiently fail to return a value but
+			// successive values should differ.
+			var vals []uint64
+			for attempt := 0; attempt < 100 && len(vals) < 2; attempt++ {
+				if val, ok := spec.fn(); ok {
+					vals = append(vals, val)
+				}
+			}
+
+			if len(vals) != 2 || vals[0] == vals[1] {
+				t.Fatalf("expected %s to return two different values; got %v", spec.name, vals)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package cpu
+
+// The arm64 port is a stub: its entry points allow the architecture-neutral
+// kernel packages to be type-checked for arm64 but panic when invoked.
+
+func unimplemented() {
+	panic("cpu: not implemented on arm64")
+}
+
+// EnableInterrupts enables interrupt handling.
+func EnableInterrupts() { unimplemented() }
+
+// DisableInterrupts disables interrupt handling.
+func DisableInterrupts() { unimplemented() }
+
+// InterruptsEnabled returns true if interrupt handling is currently enabled.
+func InterruptsEnabled() bool {
+	unimplemented()
+	return false
+}
+
+// Halt stops instruction execution.
+func Halt() { unimplemented() }
+
+// WaitForInterrupt enables interrupt handling and stops instruction execution
+// until the next interrupt arrives. Interrupts remain enabled when it returns.
+func WaitForInterrupt() { unimplemented() }
+
+// FlushTLBEntry flushes a TLB entry for a particular virtual address.
+func FlushTLBEntry(_ uintptr) { unimplemented() }
+
+// SwitchPDT sets the root page table to point to the specified physical
+// address and flushes the TLB.
+func SwitchPDT(_ uintptr) { unimplemented() }
+
+// ActivePDT returns the physical address of the currently active page table.
+func ActivePDT() uintptr {
+	unimplemented()
+	return 0
+}
+
+// The remaining entry points mirror the x86-specific ones of the amd64 port so
+// that the drivers and feature probes shared with amd64 type-check. Feature
+// queries report that no x86 features are available; the other entry points
+// panic.
+
+// Monitor arms the address monitoring hardware for the cache line containing
+// addr.
+func Monitor(_ uintptr) { unimplemented() }
+
+// MWait stops instruction execution until the next interrupt arrives or the
+// address armed via Monitor is written to.
+func MWait(_ uint32) { unimplemented() }
+
+// ReadCR2 returns the value stored in the CR2 register.
+func ReadCR2() uint64 {
+	unimplemented()
+	return 0
+}
+
+// ReadCR4 returns the value stored in the CR4 register.
+func ReadCR4() uint64 {
+	unimplemented()
+	return 0
+}
+
+// WriteCR4 loads the specified value into the CR4 register.
+func WriteCR4(_ uint64) { unimplemented() }
+
+// STAC allows supervisor-mode code to access user-mode pages.
+func STAC() { unimplemented() }
+
+// CLAC restores the protection of user-mode pages.
+func CLAC() { unimplemented() }
+
+// ID returns information about the CPU and its features. As arm64 does not
+// support CPUID, all leaves are reported as empty.
+func ID(_ uint32) (uint32, uint32, uint32, uint32) {
+	return 0, 0, 0, 0
+}
+
+// ReadMSR returns the contents of the specified model-specific register.
+func ReadMSR(_ uint32) uint64 {
+	unimplemented()
+	return 0
+}
+
+// WriteMSR writes a 64-bit value to the specified model-specific register.
+func WriteMSR(_ uint32, _ uint64) { unimplemented() }
+
+// ReadTSC returns the current value of the time-stamp counter.
+func ReadTSC() uint64 {
+	unimplemented()
+	return 0
+}
+
+// RDRAND returns a random value from the CPU's hardware random number
+// generator. It always fails on arm64.
+func RDRAND() (uint64, bool) {
+	return 0, false
+}
+
+// RDSEED returns a value from the CPU's entropy source. It always fails on
+// arm64.
+func RDSEED() (uint64, bool) {
+	return 0, false
+}
+
+// IsIntel returns true if the code is running on an Intel processor.
+func IsIntel() bool {
+	return false
+}
+
+// PortWriteByte writes a uint8 value to the requested port.
+func PortWriteByte(_ uint16, _ uint8) { unimplemented() }
+
+// PortWriteWord writes a uint16 value to the requested port.
+func PortWriteWord(_ uint16, _ uint16) { unimplemented() }
+
+// PortWriteDword writes a uint32 value to the requested port.
+func PortWriteDword(_ uint16, _ uint32) { unimplemented() }
+
+// PortReadByte reads a uint8 value from the requested port.
+func PortReadByte(_ uint16) uint8 {
+	unimplemented()
+	return 0
+}
+
+// PortReadWord reads a uint16 value from the requested port.
+func PortReadWord(_ uint16) uint16 {
+	unimplemented()
+	return 0
+}
+
+// PortReadDword reads a uint32 value from the requested port.
+func PortReadDword(_ uint16) uint32 {
+	unimplemented()
+	return 0
+}
@@ -0,0 +1,129 @@
+package kernel
+
+// Code classifies an Error independently of the module that raised it. Kernel
+// code can compare codes instead of specific error values and system calls map
+// codes to the POSIX error numbers reported to user-mode code.
+type Code uint8
+
+// The supported error codes. The comments list the POSIX error number that
+// each code maps to.
+const (
+	// CodeUnknown is the code of errors that do not fall into any of the
+	// other categories.
+	CodeUnknown         Code = iota // EINVAL
+	CodeNotPermitted                // EPERM
+	CodeNotFound                    // ENOENT
+	CodeInterrupted                 // EINTR
+	CodeIO                          // EIO
+	CodeArgsTooLong                 // E2BIG
+	CodeExecFormat                  // ENOEXEC
+	CodeBadDescriptor               // EBADF
+	CodeNoChild                     // ECHILD
+	CodeWouldBlock                  // EAGAIN
+	CodeOutOfMemory                 // ENOMEM
+	CodeBadAddress                  // EFAULT
+	CodeBusy                        // EBUSY
+	CodeExists                      // EEXIST
+	CodeNoDevice                    // ENODEV
+	CodeNotDir                      // ENOTDIR
+	CodeIsDir                       // EISDIR
+	CodeInvalid                     // EINVAL
+	CodeTooManyFiles                // EMFILE
+	CodeNotTTY                      // ENOTTY
+	CodeNoSpace                     // ENOSPC
+	CodeReadOnly                    // EROFS
+	CodeBrokenPipe                  // EPIPE
+	CodeOutOfRange                  // ERANGE
+	CodeNameTooLong                 // ENAMETOOLONG
+	CodeNotImplemented              // ENOSYS
+	CodeLoop                        // ELOOP
+	CodeMessageTooLong              // EMSGSIZE
+	CodeNotSupported                // EOPNOTSUPP
+	CodeAddrInUse                   // EADDRINUSE
+	CodeConnReset                   // ECONNRESET
+	CodeTimedOut                    // ETIMEDOUT
+	CodeConnRefused                 // ECONNREFUSED
+	CodeHostUnreachable             // EHOSTUNREACH
+	CodeNoProcess                   // ESRCH
+
+	numCodes
+)
+
+// errnoTable maps each code to a POSIX error number (as used by Linux on
+// amd64) and its symbolic name.
+var errnoTable = [numCodes]struct {
+	errno uint16
+	name  string
+}{
+	CodeUnknown:         {22, "EINVAL"},
+	CodeNotPermitted:    {1, "EPERM"},
+	CodeNotFound:        {2, "ENOENT"},
+	CodeInterrupted:     {4, "EINTR"},
+	CodeIO:              {5, "EIO"},
+	CodeArgsTooLong:     {7, "E2BIG"},
+	CodeExecFormat:      {8, "ENOEXEC"},
+	CodeBadDescriptor:   {9, "EBADF"},
+	CodeNoChild:         {10, "ECHILD"},
+	CodeWouldBlock:      {11, "EAGAIN"},
+	CodeOutOfMemory:     {12, "ENOMEM"},
+	CodeBadAddress:      {14, "EFAULT"},
+	CodeBusy:            {16, "EBUSY"},
+	CodeExists:          {17, "EEXIST"},
+	CodeNoDevice:        {19, "ENODEV"},
+	CodeNotDir:          {20, "ENOTDIR"},
+	CodeIsDir:           {21, "EISDIR"},
+	CodeInvalid:         {22, "EINVAL"},
+	CodeTooManyFiles:    {24, "EMFILE"},
+	CodeNotTTY:          {25, "ENOTTY"},
+	CodeNoSpace:         {28, "ENOSPC"},
+	CodeReadOnly:        {30, "EROFS"},
+	CodeBrokenPipe:      {32, "EPIPE"},
+	CodeOutOfRange:      {34, "ERANGE"},
+	CodeNameTooLong:     {36, "ENAMETOOLONG"},
+	CodeNotImplemented:  {38, "ENOSYS"},
+	CodeLoop:            {40, "ELOOP"},
+	CodeMessageTooLong:  {90, "EMSGSIZE"},
+	CodeNotSupported:    {95, "EOPNOTSUPP"},
+	CodeAddrInUse:       {98, "EADDRINUSE"},
+	CodeConnReset:       {104, "ECONNRESET"},
+	CodeTimedOut:        {110, "ETIMEDOUT"},
+	CodeConnRefused:     {111, "ECONNREFUSED"},
+	CodeHostUnreachable: {113, "EHOSTUNREACH"},
+	CodeNoProcess:       {3, "ESRCH"},
+}
+
+// Errno returns the POSIX error number that corresponds to the code. Codes
+// without a more specific error number map to EINVAL.
+func (c Code) Errno() int {
+	if c >= numCodes {
+		c = CodeUnknown
+	}
+	return int(errnoTable[c].errno)
+}
+
+// String returns the symbolic name of the POSIX error number that corresponds
+// to the code (e.g. "ENOENT").
+func (c Code) String() string {
+	if c >= numCodes {
+		c = CodeUnknown
+	}
+	return errnoTable[c].name
+}
+
+// ErrorCode returns the code of e or, if e does not specify a code, the code of
+// the first error in the chain of its causes that does. It returns CodeUnknown
+// if no error in the chain specifies a code or if e is nil.
+func (e *Error) ErrorCode() Code {
+	for ; e != nil; e = e.Cause {
+		if e.Code != CodeUnknown {
+			return e.Code
+		}
+	}
+
+	return CodeUnknown
+}
+
+// Errno returns the POSIX error number that corresponds to the code of e.
+func (e *Error) Errno() int {
+	return e.ErrorCode().Errno()
+}
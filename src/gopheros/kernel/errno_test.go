@@ -0,0 +1,77 @@
+package kernel
+
+import "testing"
+
+func TestCodeErrno(t *testing.T) {
+	specs := []struct {
+		code     Code
+		expErrno int
+		expName  string
+	}{
+		{CodeUnknown, 22, "EINVAL"},
+		{CodeNotPermitted, 1, "EPERM"},
+		{CodeNotFound, 2, "ENOENT"},
+		{CodeBadAddress, 14, "EFAULT"},
+		{CodeNameTooLong, 36, "ENAMETOOLONG"},
+		{CodeTimedOut, 110, "ETIMEDOUT"},
+		{CodeNoProcess, 3, "ESRCH"},
+		{numCodes, 22, "EINVAL"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.code.Errno(); got != spec.expErrno {
+			t.Errorf("[spec %d] expected errno %d; got %d", specIndex, spec.expErrno, got)
+		}
+
+		if got := spec.code.String(); got != spec.expName {
+			t.Errorf("[spec %d] expected name %q; got %q", specIndex, spec.expName, got)
+		}
+	}
+
+	// Every code must have a mapping
+	for code := CodeUnknown; code < numCodes; code++ {
+		if errnoTable[code].errno == 0 || errnoTable[code].name == "" {
+			t.Errorf("missing errno mapping for code %d", code)
+		}
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	defer func() { framePointerFn = framePointer }()
+	framePointerFn = func() uintptr { return 0 }
+
+	var (
+		errNoMem  = &Error{Module: "pmm", Message: "out of memory", Code: CodeOutOfMemory}
+		errMap    = &Error{Module: "vmm", Message: "unable to map page"}
+		errAccess = &Error{Module: "vfs", Message: "no such file", Code: CodeNotFound}
+		nilErr    *Error
+	)
+
+	specs := []struct {
+		err      *Error
+		expCode  Code
+		expErrno int
+	}{
+		{nilErr, CodeUnknown, 22},
+		{errMap, CodeUnknown, 22},
+		{errNoMem, CodeOutOfMemory, 12},
+		// Errors without a code inherit the code of their cause
+		{errMap.CausedBy(errNoMem), CodeOutOfMemory, 12},
+		// The outermost code takes precedence
+		{errAccess.CausedBy(errMap.CausedBy(errNoMem)), CodeNotFound, 2},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.err.ErrorCode(); got != spec.expCode {
+			t.Errorf("[spec %d] expected code %s; got %s", specIndex, spec.expCode, got)
+		}
+
+		if got := spec.err.Errno(); got != spec.expErrno {
+			t.Errorf("[spec %d] expected errno %d; got %d", specIndex, spec.expErrno, got)
+		}
+	}
+
+	if wrapped := errAccess.CausedBy(nil); wrapped.Code != CodeNotFound {
+		t.Error("expected CausedBy to preserve the error code")
+	}
+}
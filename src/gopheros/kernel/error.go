@@ -1,18 +1,128 @@
 package kernel
 
+import "unsafe"
+
+// maxTraceDepth limits the number of return addresses captured by CausedBy.
+const maxTraceDepth = 16
+
+// framePointerFn is used by tests to provide a synthetic frame pointer chain.
+var framePointerFn = framePointer
+
 // Error describes a kernel error. All kernel errors must be defined as global
 // variables that are pointers to the Error structure. This requirement stems
 // from the fact that the Go allocator is not available to us so we cannot use
 // errors.New.
+//
+// Once the Go allocator is available, errors can be chained via CausedBy to
+// record the lower-level error that triggered them together with the call
+// chain where the error was raised.
 type Error struct {
 	// The module where the error occurred.
 	Module string
 
 	// The error message
 	Message string
+
+	// Code classifies the error and determines the error number that
+	// system calls report to user-mode code; see ErrorCode.
+	Code Code
+
+	// Cause is the error that triggered this error or nil if this error
+	// was not created by CausedBy.
+	Cause *Error
+
+	// Trace contains the return addresses of the call chain that invoked
+	// CausedBy, starting with the caller of CausedBy.
+	Trace []uintptr
+
+	// base points to the error that CausedBy was invoked on so that the
+	// returned copy still matches it.
+	base *Error
 }
 
-// Error implements the error interface.
+// Error implements the error interface. If the error has a cause, the
+// returned message also includes the messages of all errors in the chain.
 func (e *Error) Error() string {
-	return e.Message
+	if e.Cause == nil {
+		return e.Message
+	}
+
+	return e.Message + ": " + e.Cause.Error()
+}
+
+// Unwrap returns the error that caused e or nil if e has no cause. It allows
+// errors.Is to match any error in the chain.
+func (e *Error) Unwrap() error {
+	if e.Cause == nil {
+		return nil
+	}
+
+	return e.Cause
+}
+
+// Has returns true if target is e or any error in the chain of its causes.
+// Errors returned by CausedBy match the error that CausedBy was invoked on.
+func (e *Error) Has(target *Error) bool {
+	for ; e != nil; e = e.Cause {
+		if e == target || (e.base != nil && e.base == target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CausedBy returns a new error with the module, message and code of e that
+// records cause as the error that triggered it and captures the call chain of
+// the caller. As it allocates memory, CausedBy must not be invoked before the
+// Go allocator has been initialized.
+//
+//go:noinline
+func (e *Error) CausedBy(cause *Error) *Error {
+	return &Error{
+		Module:  e.Module,
+		Message: e.Message,
+		Code:    e.Code,
+		Cause:   cause,
+		Trace:   captureTrace(),
+		base:    e,
+	}
+}
+
+// captureTrace returns the return addresses obtained by following the chain of
+// saved frame pointers, skipping the frames of captureTrace and its caller.
+// The walk stops at the first frame pointer that is not properly aligned or
+// does not point further up the stack.
+//
+//go:noinline
+func captureTrace() []uintptr {
+	var (
+		pcs   [maxTraceDepth]uintptr
+		depth int
+		fp    = framePointerFn()
+	)
+
+	for skip := 0; depth < maxTraceDepth && fp != 0 && fp&(unsafe.Sizeof(fp)-1) == 0; {
+		retAddr := *(*uintptr)(unsafe.Pointer(fp + unsafe.Sizeof(fp)))
+		if retAddr == 0 {
+			break
+		}
+
+		// The first return address points into the caller of
+		// captureTrace
+		if skip < 1 {
+			skip++
+		} else {
+			pcs[depth] = retAddr
+			depth++
+		}
+
+		nextFP := *(*uintptr)(unsafe.Pointer(fp))
+		if nextFP <= fp {
+			break
+		}
+		fp = nextFP
+	}
+
+	return append([]uintptr(nil), pcs[:depth]...)
 }
@@ -0,0 +1,4 @@
+package kernel
+
+// framePointer returns the frame pointer of its caller.
+func framePointer() uintptr
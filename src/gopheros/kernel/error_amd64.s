@@ -0,0 +1,5 @@
+#include "textflag.h"
+
+TEXT ·framePointer(SB),NOSPLIT,$0-8
+	MOVQ BP, ret+0(FP)
+	RET
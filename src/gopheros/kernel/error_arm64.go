@@ -0,0 +1,7 @@
+package kernel
+
+// framePointer returns the frame pointer of its caller. The arm64 port is a
+// stub so no frames are captured.
+func framePointer() uintptr {
+	return 0
+}
@@ -1,6 +1,10 @@
 package kernel
 
-import "testing"
+import (
+	"errors"
+	"testing"
+	"unsafe"
+)
 
 func TestKernelError(t *testing.T) {
 	err := &Error{
@@ -12,3 +16,81 @@ func TestKernelError(t *testing.T) {
 		t.Fatalf("expected to err.Error() to return %q; got %q", err.Message, err.Error())
 	}
 }
+
+func TestErrorChain(t *testing.T) {
+	defer func() { framePointerFn = framePointer }()
+	framePointerFn = func() uintptr { return 0 }
+
+	var (
+		errVMM    = &Error{Module: "vmm", Message: "out of memory"}
+		errACPI   = &Error{Module: "acpi", Message: "unable to map table"}
+		errDriver = &Error{Module: "driver", Message: "init failed"}
+		errOther  = &Error{Module: "other", Message: "other error"}
+	)
+
+	err := errDriver.CausedBy(errACPI.CausedBy(errVMM))
+	if err == errDriver || err.Module != errDriver.Module || err.Message != errDriver.Message {
+		t.Fatal("expected CausedBy to return a copy of the wrapping error")
+	}
+
+	if exp := "init failed: unable to map table: out of memory"; err.Error() != exp {
+		t.Errorf("expected err.Error() to return %q; got %q", exp, err.Error())
+	}
+
+	// Copies returned by CausedBy match the original error
+	for specIndex, target := range []*Error{err, errDriver, err.Cause, errACPI, errVMM} {
+		if !err.Has(target) {
+			t.Errorf("[spec %d] expected error chain to include %q", specIndex, target.Message)
+		}
+	}
+
+	if err.Has(errOther) || err.Has(nil) {
+		t.Error("expected Has to only match errors in the chain")
+	}
+
+	if !errors.Is(err, errVMM) || errors.Is(err, errOther) {
+		t.Error("expected errors.Is to follow the chain via Unwrap")
+	}
+
+	if errVMM.Unwrap() != nil {
+		t.Error("expected Unwrap to return nil for errors without a cause")
+	}
+}
+
+func TestCaptureTrace(t *testing.T) {
+	defer func() { framePointerFn = framePointer }()
+
+	// Each synthetic frame holds the saved frame pointer followed by the
+	// return address.
+	stack := make([]uintptr, 2*(maxTraceDepth+4))
+	for i := 0; i < len(stack)-2; i += 2 {
+		stack[i], stack[i+1] = uintptr(unsafe.Pointer(&stack[i+2])), 0x1000+uintptr(i)
+	}
+	framePointerFn = func() uintptr { return uintptr(unsafe.Pointer(&stack[0])) }
+
+	specs := []struct {
+		setup     func()
+		expFrames int
+	}{
+		{func() {}, maxTraceDepth},
+		// A misaligned frame pointer terminates the walk
+		{func() { stack[6]++ }, 3},
+		// So does a zero return address
+		{func() { stack[6]--; stack[7] = 0 }, 2},
+	}
+
+	for specIndex, spec := range specs {
+		spec.setup()
+
+		trace := (&Error{}).CausedBy(nil).Trace
+		if len(trace) != spec.expFrames {
+			t.Errorf("[spec %d] expected %d frames; got %d", specIndex, spec.expFrames, len(trace))
+			continue
+		}
+
+		// The return address of the first frame is skipped
+		if trace[0] != 0x1002 {
+			t.Errorf("[spec %d] expected trace to start at 0x1002; got 0x%x", specIndex, trace[0])
+		}
+	}
+}
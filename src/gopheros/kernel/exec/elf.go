@@ -0,0 +1,330 @@
+package exec
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/vfs"
+	"unsafe"
+)
+
+// The ELF identification, type and machine values of the executables that can
+// be loaded.
+const (
+	elfMagic          = "\x7fELF"
+	elfClass64        = 2
+	elfDataLSB        = 1
+	elfVersionCurrent = 1
+	elfTypeExec       = 2
+	elfTypeDyn        = 3
+	elfMachineAMD64   = 62
+
+	// The program header types that are handled by Load. All other types
+	// are ignored.
+	ptLoad    = 1
+	ptDynamic = 2
+	ptInterp  = 3
+
+	// The segment permission flags.
+	pfX = 1
+	pfW = 2
+
+	// maxProgramHeaders is the maximum number of program headers in an
+	// executable.
+	maxProgramHeaders = 64
+)
+
+// elfHeader mirrors the layout of Elf64_Ehdr.
+type elfHeader struct {
+	ident     [16]byte
+	typ       uint16
+	machine   uint16
+	version   uint32
+	entry     uint64
+	phoff     uint64
+	shoff     uint64
+	flags     uint32
+	ehsize    uint16
+	phentsize uint16
+	phnum     uint16
+	shentsize uint16
+	shnum     uint16
+	shstrndx  uint16
+}
+
+// programHeader mirrors the layout of Elf64_Phdr.
+type programHeader struct {
+	typ    uint32
+	flags  uint32
+	offset uint64
+	vaddr  uint64
+	paddr  uint64
+	filesz uint64
+	memsz  uint64
+	align  uint64
+}
+
+var (
+	errNotELF      = &kernel.Error{Module: "exec", Message: "not an ELF executable", Code: kernel.CodeExecFormat}
+	errUnsupported = &kernel.Error{Module: "exec", Message: "unsupported ELF class, byte order, type or machine", Code: kernel.CodeExecFormat}
+	errDynamic     = &kernel.Error{Module: "exec", Message: "dynamically linked executables are not supported", Code: kernel.CodeExecFormat}
+	errBadSegment  = &kernel.Error{Module: "exec", Message: "ELF segment is malformed or outside of user space", Code: kernel.CodeExecFormat}
+	errBadEntry    = &kernel.Error{Module: "exec", Message: "ELF entry point is not inside an executable segment", Code: kernel.CodeExecFormat}
+	errTruncated   = &kernel.Error{Module: "exec", Message: "unexpected end of executable", Code: kernel.CodeExecFormat}
+
+	// The following functions are used by tests to mock calls to the mm
+	// and vmm packages.
+	allocFrameFn      = mm.AllocFrame
+	mapFn             = vmm.Map
+	beginUserAccessFn = vmm.BeginUserAccess
+	endUserAccessFn   = vmm.EndUserAccess
+)
+
+// Image describes an executable that has been loaded into user space.
+type Image struct {
+	// Entry is the address of the first instruction of the executable.
+	Entry uintptr
+
+	// Phdr is the user-space address of the program header table or 0 if
+	// the table is not contained in a loaded segment. PhNum is the number
+	// of entries in the table.
+	Phdr  uintptr
+	PhNum int
+
+	// End is the first page-aligned address past the highest loaded
+	// segment.
+	End uintptr
+}
+
+// Load maps the loadable segments of a statically linked ELF64 executable for
+// amd64 into the user-space part of the active address space and records them
+// in regions. Position-independent executables (ELF type ET_DYN without an
+// interpreter) are relocated so that their lowest segment starts at pieBase;
+// they must relocate themselves before accessing their dynamic section.
+//
+// The segments are backed by newly allocated frames and mapped with the
+// permissions requested by their program headers; the part of each segment
+// that is not backed by file contents (e.g. .bss) is zero-filled.
+func Load(f vfs.File, regions *vmm.RegionTree, pieBase uintptr) (*Image, *kernel.Error) {
+	var hdr elfHeader
+	if err := readAt(f, 0, (*[unsafe.Sizeof(hdr)]byte)(unsafe.Pointer(&hdr))[:]); err != nil {
+		if err == errTruncated {
+			err = errNotELF
+		}
+		return nil, err
+	}
+
+	if string(hdr.ident[:4]) != elfMagic {
+		return nil, errNotELF
+	}
+
+	if hdr.ident[4] != elfClass64 || hdr.ident[5] != elfDataLSB || hdr.ident[6] != elfVersionCurrent ||
+		(hdr.typ != elfTypeExec && hdr.typ != elfTypeDyn) || hdr.machine != elfMachineAMD64 ||
+		uintptr(hdr.phentsize) != unsafe.Sizeof(programHeader{}) || hdr.phnum > maxProgramHeaders {
+		return nil, errUnsupported
+	}
+
+	phdrs := make([]programHeader, hdr.phnum)
+	if len(phdrs) != 0 {
+		phdrBuf := (*[maxProgramHeaders * unsafe.Sizeof(programHeader{})]byte)(unsafe.Pointer(&phdrs[0]))[:uintptr(len(phdrs))*unsafe.Sizeof(programHeader{})]
+		if err := readAt(f, int64(hdr.phoff), phdrBuf); err != nil {
+			return nil, err
+		}
+	}
+
+	if hdr.typ == elfTypeDyn {
+		relocate(&hdr, phdrs, pieBase)
+	}
+
+	im := &Image{Entry: uintptr(hdr.entry), PhNum: len(phdrs)}
+	for i := range phdrs {
+		switch ph := &phdrs[i]; {
+		case ph.typ == ptInterp, ph.typ == ptDynamic && hdr.typ != elfTypeDyn:
+			return nil, errDynamic
+		case ph.typ == ptLoad:
+			if ph.filesz > ph.memsz || ph.vaddr < uint64(mm.PageSize) ||
+				ph.vaddr+ph.memsz < ph.vaddr || ph.vaddr+ph.memsz > uint64(vmm.UserSpaceEnd) ||
+				ph.vaddr&uint64(mm.PageSize-1) != ph.offset&uint64(mm.PageSize-1) {
+				return nil, errBadSegment
+			}
+		}
+	}
+
+	if !insideExecSegment(phdrs, hdr.entry) {
+		return nil, errBadEntry
+	}
+
+	// Pages that are shared by adjacent segments are mapped with the
+	// union of their permissions.
+	var (
+		mapped = make(map[mm.Page]pageMapping)
+		buf    = make([]byte, mm.PageSize)
+	)
+	for i := range phdrs {
+		ph := &phdrs[i]
+		if ph.typ != ptLoad {
+			continue
+		}
+
+		if err := loadSegment(f, ph, mapped, buf); err != nil {
+			return nil, err
+		}
+
+		end := uintptr(ph.vaddr+ph.memsz+uint64(mm.PageSize-1)) &^ (mm.PageSize - 1)
+		if end > im.End {
+			im.End = end
+		}
+
+		if hdr.phoff >= ph.offset && hdr.phoff+uint64(len(phdrs))*uint64(hdr.phentsize) <= ph.offset+ph.filesz {
+			im.Phdr = uintptr(ph.vaddr + hdr.phoff - ph.offset)
+		}
+	}
+
+	for page, m := range mapped {
+		if err := regions.Insert(vmm.Region{Start: page.Address(), End: page.Address() + mm.PageSize, Flags: segmentFlags(m.pflags)}); err != nil {
+			return nil, err
+		}
+	}
+
+	return im, nil
+}
+
+// relocate moves the entry point and the segments of a position-independent
+// executable so that its lowest loadable segment starts at base. Invalid
+// addresses that result from the relocation are rejected by Load.
+func relocate(hdr *elfHeader, phdrs []programHeader, base uintptr) {
+	lowest := ^uint64(0)
+	for _, ph := range phdrs {
+		if ph.typ == ptLoad && ph.vaddr < lowest {
+			lowest = ph.vaddr
+		}
+	}
+	if lowest == ^uint64(0) {
+		return
+	}
+
+	bias := uint64(base) - lowest&^uint64(mm.PageSize-1)
+	hdr.entry += bias
+	for i := range phdrs {
+		phdrs[i].vaddr += bias
+	}
+}
+
+// pageMapping describes a page that has been mapped by Load.
+type pageMapping struct {
+	frame mm.Frame
+
+	// pflags contains the union of the permission flags of the segments
+	// that overlap the page.
+	pflags uint32
+}
+
+// loadSegment maps the pages of a loadable segment and populates them with the
+// segment contents. The pages are initially mapped as writable so that they can
+// be populated and are then remapped with the requested permissions.
+func loadSegment(f vfs.File, ph *programHeader, mapped map[mm.Page]pageMapping, buf []byte) *kernel.Error {
+	var (
+		start     = uintptr(ph.vaddr) &^ (mm.PageSize - 1)
+		end       = uintptr(ph.vaddr + ph.memsz)
+		fileStart = uintptr(ph.vaddr)
+		fileEnd   = uintptr(ph.vaddr + ph.filesz)
+	)
+
+	for addr := start; addr < end; addr += mm.PageSize {
+		page := mm.PageFromAddress(addr)
+		m, shared := mapped[page]
+		if !shared {
+			frame, err := allocFrameFn()
+			if err != nil {
+				return err
+			}
+			m.frame = frame
+		}
+		m.pflags |= ph.flags
+		flags := segmentFlags(m.pflags)
+
+		if err := mapFn(page, m.frame, flags|vmm.FlagRW); err != nil {
+			return err
+		}
+		mapped[page] = m
+
+		if !shared {
+			beginUserAccessFn()
+			kernel.Memset(addr, 0, mm.PageSize)
+			endUserAccessFn()
+		}
+
+		// Copy the part of the file contents that overlaps this page
+		copyStart, copyEnd := addr, addr+mm.PageSize
+		if copyStart < fileStart {
+			copyStart = fileStart
+		}
+		if copyEnd > fileEnd {
+			copyEnd = fileEnd
+		}
+
+		if copyStart < copyEnd {
+			n := copyEnd - copyStart
+			if err := readAt(f, int64(ph.offset)+int64(copyStart-fileStart), buf[:n]); err != nil {
+				return err
+			}
+
+			beginUserAccessFn()
+			kernel.Memcopy(uintptr(unsafe.Pointer(&buf[0])), copyStart, n)
+			endUserAccessFn()
+		}
+
+		if flags&vmm.FlagRW == 0 {
+			if err := mapFn(page, m.frame, flags); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// segmentFlags returns the page table entry flags for a segment with the
+// specified permission flags.
+func segmentFlags(pflags uint32) vmm.PageTableEntryFlag {
+	flags := vmm.FlagPresent | vmm.FlagUserAccessible
+	if pflags&pfW != 0 {
+		flags |= vmm.FlagRW
+	}
+	if pflags&pfX == 0 {
+		flags |= vmm.FlagNoExecute
+	}
+	return flags
+}
+
+// insideExecSegment returns true if addr lies inside an executable loadable
+// segment.
+func insideExecSegment(phdrs []programHeader, addr uint64) bool {
+	for _, ph := range phdrs {
+		if ph.typ == ptLoad && ph.flags&pfX != 0 && addr >= ph.vaddr && addr < ph.vaddr+ph.memsz {
+			return true
+		}
+	}
+	return false
+}
+
+// readAt fills buf with the file contents starting at the specified offset.
+func readAt(f vfs.File, offset int64, buf []byte) *kernel.Error {
+	if _, err := f.Lseek(offset, vfs.SeekStart); err != nil {
+		return err
+	}
+
+	for read := 0; read < len(buf); {
+		n, err := f.Read(buf[read:])
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return errTruncated
+		}
+		read += n
+	}
+
+	return nil
+}
@@ -0,0 +1,435 @@
+package exec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/vfs"
+	"testing"
+	"unsafe"
+)
+
+// memFile is a read-only vfs.File backed by a byte slice.
+type memFile struct {
+	data   []byte
+	off    int64
+	closed bool
+
+	seekErr, readErr *kernel.Error
+}
+
+func (f *memFile) Read(buf []byte) (int, *kernel.Error) {
+	if f.readErr != nil {
+		return 0, f.readErr
+	}
+
+	if f.off >= int64(len(f.data)) {
+		return 0, nil
+	}
+
+	// Return short reads to exercise the read loop
+	if len(buf) > 512 {
+		buf = buf[:512]
+	}
+
+	n := copy(buf, f.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(_ []byte) (int, *kernel.Error) {
+	return 0, vfs.ErrReadOnly
+}
+
+func (f *memFile) Lseek(offset int64, _ int) (int64, *kernel.Error) {
+	if f.seekErr != nil {
+		return 0, f.seekErr
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (vfs.FileInfo, *kernel.Error) {
+	return vfs.FileInfo{Size: int64(len(f.data))}, nil
+}
+
+func (f *memFile) Close() *kernel.Error {
+	f.closed = true
+	return nil
+}
+
+// testSegment describes a segment of an executable built by buildELF. If
+// withHeaders is set, the segment must be the first one; it starts at file
+// offset 0 and its contents are preceded by the ELF and program headers so
+// that data is located at vaddr.
+type testSegment struct {
+	typ         uint32
+	flags       uint32
+	vaddr       uintptr
+	data        []byte
+	memsz       uintptr
+	withHeaders bool
+}
+
+const (
+	elfHeaderSize     = int(unsafe.Sizeof(elfHeader{}))
+	programHeaderSize = int(unsafe.Sizeof(programHeader{}))
+)
+
+// buildELF returns an ELF executable containing the specified segments.
+// Segments default to the PT_LOAD type.
+func buildELF(entry uintptr, segments ...testSegment) []byte {
+	var (
+		headerSize = elfHeaderSize + len(segments)*programHeaderSize
+		image      = make([]byte, headerSize)
+		le         = binary.LittleEndian
+	)
+
+	copy(image, elfMagic)
+	image[4], image[5], image[6] = elfClass64, elfDataLSB, elfVersionCurrent
+	le.PutUint16(image[16:], elfTypeExec)
+	le.PutUint16(image[18:], elfMachineAMD64)
+	le.PutUint64(image[24:], uint64(entry))
+	le.PutUint64(image[32:], uint64(elfHeaderSize))
+	le.PutUint16(image[54:], uint16(programHeaderSize))
+	le.PutUint16(image[56:], uint16(len(segments)))
+
+	for i, seg := range segments {
+		var (
+			offset uint64
+			vaddr  = seg.vaddr
+			extra  uint64
+		)
+
+		if seg.withHeaders {
+			vaddr -= uintptr(headerSize)
+			extra = uint64(headerSize)
+		} else {
+			offset = uint64(len(image)+int(mm.PageSize-1))&^uint64(mm.PageSize-1) + uint64(seg.vaddr&(mm.PageSize-1))
+			image = append(image, make([]byte, int(offset)-len(image))...)
+		}
+		image = append(image, seg.data...)
+
+		typ := seg.typ
+		if typ == 0 {
+			typ = ptLoad
+		}
+
+		ph := image[elfHeaderSize+i*programHeaderSize:]
+		le.PutUint32(ph[0:], typ)
+		le.PutUint32(ph[4:], seg.flags)
+		le.PutUint64(ph[8:], offset)
+		le.PutUint64(ph[16:], uint64(vaddr))
+		le.PutUint64(ph[32:], uint64(len(seg.data))+extra)
+		le.PutUint64(ph[40:], uint64(seg.memsz)+extra)
+	}
+
+	return image
+}
+
+// userMemory is a page-aligned buffer that emulates user-space memory.
+type userMemory struct {
+	buf  []byte
+	base uintptr
+}
+
+func newUserMemory(pages int) *userMemory {
+	m := &userMemory{buf: make([]byte, (pages+1)*int(mm.PageSize))}
+	m.base = (uintptr(unsafe.Pointer(&m.buf[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+	for i := range m.buf {
+		m.buf[i] = 0xff
+	}
+	return m
+}
+
+func (m *userMemory) bytes(addr, size uintptr) []byte {
+	off := addr - uintptr(unsafe.Pointer(&m.buf[0]))
+	return m.buf[off : off+size]
+}
+
+// mapCall records a call to mapFn.
+type mapCall struct {
+	page  mm.Page
+	frame mm.Frame
+	flags vmm.PageTableEntryFlag
+}
+
+// mockVMM emulates the frame allocator and page mapping code and records the
+// established mappings.
+type mockVMM struct {
+	nextFrame mm.Frame
+	maps      []mapCall
+
+	// allocErr and mapErr are returned once the specified number of
+	// frames has been allocated or mapped.
+	allocErr, mapErr       *kernel.Error
+	failAllocAt, failMapAt int
+}
+
+func (m *mockVMM) install() {
+	m.nextFrame = 1
+	allocFrameFn = func() (mm.Frame, *kernel.Error) {
+		if m.allocErr != nil && int(m.nextFrame-1) == m.failAllocAt {
+			return mm.InvalidFrame, m.allocErr
+		}
+		m.nextFrame++
+		return m.nextFrame - 1, nil
+	}
+	mapFn = func(page mm.Page, frame mm.Frame, flags vmm.PageTableEntryFlag) *kernel.Error {
+		if m.mapErr != nil && len(m.maps) == m.failMapAt {
+			return m.mapErr
+		}
+		m.maps = append(m.maps, mapCall{page, frame, flags})
+		return nil
+	}
+	beginUserAccessFn = func() {}
+	endUserAccessFn = func() {}
+}
+
+func TestLoad(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		vmmMock    = &mockVMM{}
+		mem        = newUserMemory(4)
+		headerSize = uintptr(elfHeaderSize + 2*programHeaderSize)
+		code       = []byte{0x90, 0x90, 0xc3}
+		data       = []byte("data")
+		image      = buildELF(mem.base+headerSize,
+			testSegment{flags: pfX, vaddr: mem.base + headerSize, data: code, memsz: uintptr(len(code)), withHeaders: true},
+			testSegment{flags: pfW, vaddr: mem.base + mm.PageSize + 0x20, data: data, memsz: 2 * mm.PageSize},
+		)
+		f = &memFile{data: image}
+	)
+	vmmMock.install()
+
+	var regions vmm.RegionTree
+	im, err := Load(f, &regions, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := Image{
+		Entry: mem.base + headerSize,
+		Phdr:  mem.base + uintptr(elfHeaderSize),
+		PhNum: 2,
+		End:   mem.base + 4*mm.PageSize,
+	}
+	if *im != exp {
+		t.Errorf("expected image %+v; got %+v", exp, *im)
+	}
+
+	text := mem.bytes(mem.base, mm.PageSize)
+	if !bytes.Equal(text[:headerSize], image[:headerSize]) || !bytes.Equal(text[headerSize:headerSize+3], code) {
+		t.Error("expected the text segment to contain the headers and the code")
+	}
+	if !bytes.Equal(text[headerSize+3:], make([]byte, mm.PageSize-headerSize-3)) {
+		t.Error("expected the remainder of the text page to be zero-filled")
+	}
+
+	bss := mem.bytes(mem.base+mm.PageSize, 3*mm.PageSize)
+	if !bytes.Equal(bss[0x20:0x24], data) {
+		t.Errorf("expected data segment contents to be %q; got %q", data, bss[0x20:0x24])
+	}
+	bss[0x20], bss[0x21], bss[0x22], bss[0x23] = 0, 0, 0, 0
+	if !bytes.Equal(bss, make([]byte, len(bss))) {
+		t.Error("expected the remainder of the data segment to be zero-filled")
+	}
+
+	var (
+		userRX = vmm.FlagPresent | vmm.FlagUserAccessible
+		userRW = userRX | vmm.FlagRW | vmm.FlagNoExecute
+	)
+	expMaps := []mapCall{
+		{mm.PageFromAddress(mem.base), 1, userRX | vmm.FlagRW},
+		{mm.PageFromAddress(mem.base), 1, userRX},
+		{mm.PageFromAddress(mem.base + mm.PageSize), 2, userRW},
+		{mm.PageFromAddress(mem.base + 2*mm.PageSize), 3, userRW},
+		{mm.PageFromAddress(mem.base + 3*mm.PageSize), 4, userRW},
+	}
+	if len(vmmMock.maps) != len(expMaps) {
+		t.Fatalf("expected %d map calls; got %d: %+v", len(expMaps), len(vmmMock.maps), vmmMock.maps)
+	}
+	for i, exp := range expMaps {
+		if got := vmmMock.maps[i]; got != exp {
+			t.Errorf("[map %d] expected %+v; got %+v", i, exp, got)
+		}
+	}
+
+	// Adjacent pages with the same permissions are merged into a region
+	var gotRegions []vmm.Region
+	regions.Visit(func(r vmm.Region) bool {
+		gotRegions = append(gotRegions, r)
+		return true
+	})
+	expRegions := []vmm.Region{
+		{Start: mem.base, End: mem.base + mm.PageSize, Flags: userRX},
+		{Start: mem.base + mm.PageSize, End: mem.base + 4*mm.PageSize, Flags: userRW},
+	}
+	if len(gotRegions) != len(expRegions) || gotRegions[0] != expRegions[0] || gotRegions[1] != expRegions[1] {
+		t.Errorf("expected regions %+v; got %+v", expRegions, gotRegions)
+	}
+}
+
+func TestLoadSharedPage(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		vmmMock = &mockVMM{}
+		mem     = newUserMemory(1)
+		image   = buildELF(mem.base,
+			testSegment{flags: pfX, vaddr: mem.base, data: []byte{0xc3}, memsz: 0x100},
+			testSegment{flags: pfW, vaddr: mem.base + 0x100, data: []byte{0x42}, memsz: 0x100},
+		)
+	)
+	vmmMock.install()
+
+	if _, err := Load(&memFile{data: image}, &vmm.RegionTree{}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The page is allocated and zeroed once and mapped with the union of
+	// the segment permissions.
+	expFlags := vmm.FlagPresent | vmm.FlagUserAccessible | vmm.FlagRW
+	for i, call := range vmmMock.maps {
+		if call.frame != 1 {
+			t.Errorf("[map %d] expected the shared page to be backed by frame 1; got %d", i, call.frame)
+		}
+	}
+	if last := vmmMock.maps[len(vmmMock.maps)-1]; last.flags != expFlags {
+		t.Errorf("expected the shared page to be mapped with flags %x; got %x", expFlags, last.flags)
+	}
+
+	page := mem.bytes(mem.base, mm.PageSize)
+	if page[0] != 0xc3 || page[0x100] != 0x42 || page[1] != 0 || page[0x101] != 0 {
+		t.Errorf("expected the shared page to contain the contents of both segments; got %x", page[:0x102])
+	}
+}
+
+func TestLoadPIE(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		vmmMock = &mockVMM{}
+		mem     = newUserMemory(2)
+		le      = binary.LittleEndian
+		image   = buildELF(0x1000,
+			testSegment{flags: pfX, vaddr: 0x1000, data: []byte{0xc3}, memsz: 1},
+			testSegment{flags: pfW, vaddr: 0x2010, data: []byte{0x42}, memsz: 1},
+			testSegment{typ: ptDynamic, vaddr: 0x2010},
+		)
+	)
+	le.PutUint16(image[16:], elfTypeDyn)
+	vmmMock.install()
+
+	var regions vmm.RegionTree
+	im, err := Load(&memFile{data: image}, &regions, mem.base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if im.Entry != mem.base || im.End != mem.base+2*mm.PageSize {
+		t.Errorf("expected the executable to be relocated to 0x%x; got entry 0x%x, end 0x%x", mem.base, im.Entry, im.End)
+	}
+
+	if got := mem.bytes(mem.base+mm.PageSize+0x10, 1); got[0] != 0x42 {
+		t.Errorf("expected the data segment to be loaded at its relocated address; got %x", got)
+	}
+
+	if _, ok := regions.Lookup(mem.base); !ok {
+		t.Error("expected the relocated segments to be recorded as regions")
+	}
+
+	// Executables relocated outside of user space are rejected
+	if _, err = Load(&memFile{data: image}, &vmm.RegionTree{}, vmm.UserSpaceEnd-mm.PageSize); err != errBadSegment {
+		t.Errorf("expected error %v; got %v", errBadSegment, err)
+	}
+
+	le.PutUint32(image[elfHeaderSize+2*programHeaderSize:], ptInterp)
+	if _, err = Load(&memFile{data: image}, &vmm.RegionTree{}, mem.base); err != errDynamic {
+		t.Errorf("expected error %v; got %v", errDynamic, err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		mem   = newUserMemory(2)
+		valid = func() []byte {
+			return buildELF(mem.base,
+				testSegment{flags: pfX, vaddr: mem.base, data: []byte{0xc3}, memsz: 1},
+				testSegment{flags: pfW, vaddr: mem.base + mm.PageSize, data: []byte("data"), memsz: 4},
+			)
+		}
+		le     = binary.LittleEndian
+		ph1    = elfHeaderSize + programHeaderSize
+		expErr = &kernel.Error{Module: "test", Message: "error"}
+	)
+
+	specs := []struct {
+		mutate  func(image []byte) []byte
+		setup   func(f *memFile, m *mockVMM)
+		expErr  *kernel.Error
+		expMaps int
+	}{
+		{func(_ []byte) []byte { return nil }, nil, errNotELF, 0},
+		{func(image []byte) []byte { image[0] = 0; return image }, nil, errNotELF, 0},
+		{func(image []byte) []byte { image[4] = 1; return image }, nil, errUnsupported, 0},
+		{func(image []byte) []byte { le.PutUint16(image[16:], 4); return image }, nil, errUnsupported, 0},
+		{func(image []byte) []byte { le.PutUint16(image[18:], 3); return image }, nil, errUnsupported, 0},
+		{func(image []byte) []byte { le.PutUint16(image[54:], 32); return image }, nil, errUnsupported, 0},
+		{func(image []byte) []byte { le.PutUint16(image[56:], maxProgramHeaders+1); return image }, nil, errUnsupported, 0},
+		{func(image []byte) []byte { le.PutUint64(image[32:], 1<<20); return image }, nil, errTruncated, 0},
+		{func(image []byte) []byte { le.PutUint32(image[ph1:], ptInterp); return image }, nil, errDynamic, 0},
+		{func(image []byte) []byte { le.PutUint32(image[ph1:], ptDynamic); return image }, nil, errDynamic, 0},
+		// filesz > memsz
+		{func(image []byte) []byte { le.PutUint64(image[ph1+40:], 1); return image }, nil, errBadSegment, 0},
+		// segment maps the NULL page
+		{func(image []byte) []byte { le.PutUint64(image[ph1+16:], 0); return image }, nil, errBadSegment, 0},
+		// segment outside of user space
+		{func(image []byte) []byte { le.PutUint64(image[ph1+16:], uint64(vmm.UserSpaceEnd)); return image }, nil, errBadSegment, 0},
+		// segment wraps around
+		{func(image []byte) []byte { le.PutUint64(image[ph1+40:], ^uint64(0)); return image }, nil, errBadSegment, 0},
+		// offset and address are not congruent modulo the page size
+		{func(image []byte) []byte { le.PutUint64(image[ph1+8:], 0x1001); return image }, nil, errBadSegment, 0},
+		// entry point in a non-executable segment
+		{func(image []byte) []byte { le.PutUint64(image[24:], uint64(mem.base+mm.PageSize)); return image }, nil, errBadEntry, 0},
+		// truncated segment contents
+		{func(image []byte) []byte { return image[:len(image)-1] }, nil, errTruncated, 3},
+		{nil, func(f *memFile, _ *mockVMM) { f.seekErr = expErr }, expErr, 0},
+		{nil, func(f *memFile, _ *mockVMM) { f.readErr = expErr }, expErr, 0},
+		{nil, func(_ *memFile, m *mockVMM) { m.allocErr, m.failAllocAt = expErr, 1 }, expErr, 2},
+		{nil, func(_ *memFile, m *mockVMM) { m.mapErr = expErr }, expErr, 0},
+		// remapping the text page read-only fails
+		{nil, func(_ *memFile, m *mockVMM) { m.mapErr, m.failMapAt = expErr, 1 }, expErr, 1},
+	}
+
+	for specIndex, spec := range specs {
+		var (
+			vmmMock = &mockVMM{}
+			image   = valid()
+		)
+		vmmMock.install()
+
+		if spec.mutate != nil {
+			image = spec.mutate(image)
+		}
+
+		f := &memFile{data: image}
+		if spec.setup != nil {
+			spec.setup(f, vmmMock)
+		}
+
+		if _, err := Load(f, &vmm.RegionTree{}, 0); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+
+		if got := len(vmmMock.maps); got != spec.expMaps {
+			t.Errorf("[spec %d] expected %d map calls; got %d", specIndex, spec.expMaps, got)
+		}
+	}
+}
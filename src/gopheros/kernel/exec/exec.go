@@ -0,0 +1,293 @@
+// Package exec loads statically linked ELF executables into the address space
+// of a process and runs them in user mode. It also starts the init process,
+// the first user-mode process, from the root filesystem.
+package exec
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/kthread"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/proc"
+	"gopheros/kernel/rand"
+	"gopheros/kernel/user"
+	"gopheros/kernel/vfs"
+	"unsafe"
+)
+
+const (
+	// stackPages is the size of the user-mode stack in pages.
+	stackPages = 32
+
+	// stackFlags are the page table entry flags for the user-mode stack.
+	stackFlags = vmm.FlagPresent | vmm.FlagRW | vmm.FlagUserAccessible | vmm.FlagNoExecute
+
+	// maxArgSize is the maximum size of the argument and environment
+	// strings including their terminators.
+	maxArgSize = stackPages * mm.PageSize / 4
+
+	// pieBase is the address at which position-independent executables
+	// are loaded unless address space randomization is disabled.
+	pieBase = uintptr(0x555555554000)
+
+	// The number of random page-granular bits in the load address of
+	// position-independent executables, the stack top and the top of the
+	// mmap area.
+	pieRandomBits   = 28
+	stackRandomBits = 22
+	mmapRandomBits  = 28
+
+	// DefaultInitPath is the path of the init executable unless a
+	// different path is specified via the init boot command line option.
+	DefaultInitPath = "/sbin/init"
+
+	// The auxiliary vector entry types passed to executables.
+	atNull   = 0
+	atPhdr   = 3
+	atPhent  = 4
+	atPhnum  = 5
+	atPagesz = 6
+	atEntry  = 9
+	atRandom = 25
+)
+
+var (
+	errKernelProcess = &kernel.Error{Module: "exec", Message: "executables cannot be loaded into the kernel process", Code: kernel.CodeInvalid}
+	errArgsTooLong   = &kernel.Error{Module: "exec", Message: "argument list too long", Code: kernel.CodeArgsTooLong}
+
+	// stackTop is the address past the end of the user-mode stack of
+	// loaded executables.
+	stackTop = vmm.UserSpaceEnd - mm.PageSize
+
+	// initEnv contains the environment passed to the init process.
+	initEnv = []string{"HOME=/", "TERM=linux"}
+
+	// The following functions are used by tests to mock calls to the
+	// cmdline, kthread, proc, rand, user and vfs packages.
+	lookupCmdlineFn  = cmdline.Lookup
+	openFn           = vfs.Open
+	statFn           = vfs.Stat
+	currentProcessFn = proc.Current
+	spawnFn          = proc.Spawn
+	waitFn           = proc.Wait
+	exitFn           = proc.Exit
+	spawnThreadFn    = kthread.Spawn
+	boolCmdlineFn    = cmdline.Bool
+	randomFn         = rand.Read
+	randUint64Fn     = rand.Uint64
+	enterFn          = user.Enter
+)
+
+// Exec loads the executable at path into the address space of the calling
+// process and starts executing it in user mode with the specified arguments
+// and environment. The FS base of the process is reset to 0. The heap of the
+// process starts right after the executable and mappings whose address is
+// chosen by the kernel are placed below the stack. Unless the norandmaps boot
+// command line option is specified, the load address of position-independent
+// executables, the stack and the mmap area are placed at random offsets.
+//
+// The user-mode part of the address space must not contain any mappings as
+// Exec does not remove them. Exec does not return unless the executable
+// cannot be loaded.
+func Exec(path string, argv, envv []string) *kernel.Error {
+	p := currentProcessFn()
+	if p == proc.Lookup(proc.KernelPID) {
+		return errKernelProcess
+	}
+
+	f, err := openFn(path)
+	if err != nil {
+		return err
+	}
+
+	layout := newAddressLayout()
+	im, err := Load(f, p.Regions(), layout.pieBase)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+
+	sp, auxv, err := setupStack(p.Regions(), layout.stackTop, im, argv, envv)
+	if err != nil {
+		return err
+	}
+
+	p.SetMemoryLayout(im.End, layout.mmapTop)
+	p.SetAuxVector(auxv)
+	p.SetFSBase(0)
+	enterFn(im.Entry, sp)
+	return nil
+}
+
+// addressLayout describes the placement of an executable, its stack and the
+// mmap area in a user-mode address space.
+type addressLayout struct {
+	pieBase  uintptr
+	stackTop uintptr
+	mmapTop  uintptr
+}
+
+// newAddressLayout returns the layout of a new address space. Unless the
+// norandmaps boot command line option is specified, each part is moved by a
+// random number of pages. An unmapped guard page always separates the stack
+// from the mmap area.
+func newAddressLayout() addressLayout {
+	var (
+		layout  = addressLayout{pieBase: pieBase, stackTop: stackTop}
+		mmapGap uintptr
+	)
+	if !boolCmdlineFn("norandmaps") {
+		layout.pieBase += randomPages(pieRandomBits)
+		layout.stackTop -= randomPages(stackRandomBits)
+		mmapGap = randomPages(mmapRandomBits)
+	}
+
+	layout.mmapTop = layout.stackTop - (stackPages+1)*mm.PageSize - mmapGap
+	return layout
+}
+
+// randomPages returns a random page-aligned offset with the specified number
+// of random bits above the page offset.
+func randomPages(bits uint) uintptr {
+	return uintptr(randUint64Fn()&(1<<bits-1)) * mm.PageSize
+}
+
+// setupStack maps the user-mode stack that ends at top, records it in regions
+// and populates it with the argument count, argument and environment vectors
+// and auxiliary vector expected by the System V amd64 ABI. It returns the
+// initial user-mode stack pointer and the auxiliary vector.
+//
+// The strings referenced by the vectors and 16 random bytes for seeding
+// user-space random number generators are placed at the top of the stack.
+func setupStack(regions *vmm.RegionTree, top uintptr, im *Image, argv, envv []string) (uintptr, []uint64, *kernel.Error) {
+	strSize := uintptr(16)
+	for _, strs := range [][]string{argv, envv} {
+		for _, str := range strs {
+			strSize += uintptr(len(str)) + 1
+		}
+	}
+
+	if strSize > maxArgSize {
+		return 0, nil, errArgsTooLong
+	}
+
+	stackBottom := top - stackPages*mm.PageSize
+	for addr := stackBottom; addr < top; addr += mm.PageSize {
+		frame, err := allocFrameFn()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if err = mapFn(mm.PageFromAddress(addr), frame, stackFlags); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if err := regions.Insert(vmm.Region{Start: stackBottom, End: top, Flags: stackFlags}); err != nil {
+		return 0, nil, err
+	}
+
+	beginUserAccessFn()
+	kernel.Memset(stackBottom, 0, top-stackBottom)
+	endUserAccessFn()
+
+	auxv := [...]uint64{
+		atPhdr, uint64(im.Phdr),
+		atPhent, uint64(unsafe.Sizeof(programHeader{})),
+		atPhnum, uint64(im.PhNum),
+		atPagesz, uint64(mm.PageSize),
+		atEntry, uint64(im.Entry),
+		atRandom, 0,
+		atNull, 0,
+	}
+
+	var (
+		// The vectors consist of argc, the NULL-terminated argv and
+		// envp arrays and auxv. The stack pointer must be 16-byte
+		// aligned when pointing at argc.
+		vecWords = 1 + len(argv) + 1 + len(envv) + 1 + len(auxv)
+		strStart = top - strSize
+		sp       = (strStart - uintptr(vecWords)*8) &^ 15
+		image    = make([]byte, top-sp)
+		vec      = image[:vecWords*8]
+		strs     = image[strStart-sp:]
+	)
+
+	putWord := func(index int, value uint64) {
+		*(*uint64)(unsafe.Pointer(&vec[index*8])) = value
+	}
+
+	// The random bytes are placed first followed by the strings
+	randomFn(strs[:16])
+	auxv[len(auxv)-3] = uint64(strStart)
+
+	putWord(0, uint64(len(argv)))
+	var (
+		index  = 1
+		strOff = uintptr(16)
+	)
+	for _, vector := range [][]string{argv, envv} {
+		for _, str := range vector {
+			putWord(index, uint64(strStart+strOff))
+			strOff += uintptr(copy(strs[strOff:], str)) + 1
+			index++
+		}
+		putWord(index, 0)
+		index++
+	}
+
+	for _, word := range auxv {
+		putWord(index, word)
+		index++
+	}
+
+	beginUserAccessFn()
+	kernel.Memcopy(uintptr(unsafe.Pointer(&image[0])), sp, uintptr(len(image)))
+	endUserAccessFn()
+
+	return sp, auxv[:], nil
+}
+
+// StartInit spawns the init process which executes the file specified via the
+// init boot command line option or DefaultInitPath. As it is the first process
+// started by the kernel, init is assigned proc.InitPID. A kernel thread waits
+// for init to exit and reports its exit code.
+//
+// An error is returned if the init executable does not exist. Errors that
+// occur while loading the executable are reported by the init process which
+// then exits with code 127.
+func StartInit() *kernel.Error {
+	path := DefaultInitPath
+	if value, ok := lookupCmdlineFn("init"); ok {
+		path = value
+	}
+
+	if _, err := statFn(path); err != nil {
+		return err
+	}
+
+	p, err := spawnFn("init", func() {
+		if err := Exec(path, []string{path}, initEnv); err != nil {
+			kfmt.Printf("[init] unable to execute %s: %s\n", path, err.Message)
+			exitFn(127)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = spawnThreadFn("initwait", func() {
+		_, code, err := waitFn(p.PID())
+		switch {
+		case err != nil:
+			return
+		case code < 0:
+			kfmt.Printf("[init] %s killed by signal %d\n", path, -code)
+		default:
+			kfmt.Printf("[init] %s exited with code %d\n", path, code)
+		}
+	})
+	return err
+}
@@ -0,0 +1,379 @@
+package exec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/kthread"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/proc"
+	"gopheros/kernel/rand"
+	"gopheros/kernel/user"
+	"gopheros/kernel/vfs"
+	"testing"
+)
+
+func restoreMocks() {
+	allocFrameFn = mm.AllocFrame
+	mapFn = vmm.Map
+	beginUserAccessFn = vmm.BeginUserAccess
+	endUserAccessFn = vmm.EndUserAccess
+	lookupCmdlineFn = cmdline.Lookup
+	boolCmdlineFn = cmdline.Bool
+	openFn = vfs.Open
+	statFn = vfs.Stat
+	currentProcessFn = proc.Current
+	spawnFn = proc.Spawn
+	waitFn = proc.Wait
+	exitFn = proc.Exit
+	spawnThreadFn = kthread.Spawn
+	randomFn = rand.Read
+	randUint64Fn = rand.Uint64
+	enterFn = user.Enter
+	stackTop = vmm.UserSpaceEnd - mm.PageSize
+}
+
+func TestSetupStack(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		vmmMock = &mockVMM{}
+		mem     = newUserMemory(stackPages)
+		im      = &Image{Entry: 0x401000, Phdr: 0x400040, PhNum: 6}
+		argv    = []string{"/sbin/init", "-v"}
+		envv    = []string{"HOME=/"}
+	)
+	vmmMock.install()
+	stackTop = mem.base + stackPages*mm.PageSize
+	randomFn = func(p []byte) {
+		for i := range p {
+			p[i] = 0xaa
+		}
+	}
+
+	sp, savedAuxv, err := setupStack(&vmm.RegionTree{}, stackTop, im, argv, envv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(vmmMock.maps) != stackPages {
+		t.Fatalf("expected %d stack pages to be mapped; got %d", stackPages, len(vmmMock.maps))
+	}
+	for i, call := range vmmMock.maps {
+		expPage := mm.PageFromAddress(stackTop - stackPages*mm.PageSize + uintptr(i)*mm.PageSize)
+		if expFlags := vmm.FlagPresent | vmm.FlagRW | vmm.FlagUserAccessible | vmm.FlagNoExecute; call.page != expPage || call.flags != expFlags {
+			t.Errorf("[map %d] expected page %d to be mapped with flags %x; got %+v", i, expPage, expFlags, call)
+		}
+	}
+
+	if sp&15 != 0 || sp >= stackTop || sp < stackTop-mm.PageSize {
+		t.Fatalf("expected a 16-byte aligned stack pointer near the top of the stack; got 0x%x", sp)
+	}
+
+	if !bytes.Equal(mem.bytes(stackTop-stackPages*mm.PageSize, sp-(stackTop-stackPages*mm.PageSize)), make([]byte, sp-(stackTop-stackPages*mm.PageSize))) {
+		t.Error("expected the unused part of the stack to be zero-filled")
+	}
+
+	var (
+		word = func(index int) uint64 {
+			return binary.LittleEndian.Uint64(mem.bytes(sp+uintptr(index)*8, 8))
+		}
+		cstring = func(addr uint64) string {
+			str := mem.bytes(uintptr(addr), stackTop-uintptr(addr))
+			return string(str[:bytes.IndexByte(str, 0)])
+		}
+	)
+
+	if argc := word(0); argc != 2 {
+		t.Fatalf("expected argc to be 2; got %d", argc)
+	}
+
+	var got []string
+	for _, index := range []int{1, 2, 4} {
+		got = append(got, cstring(word(index)))
+	}
+	if exp := []string{"/sbin/init", "-v", "HOME=/"}; !equalStrings(got, exp) {
+		t.Errorf("expected argv and envp to contain %q; got %q", exp, got)
+	}
+	if word(3) != 0 || word(5) != 0 {
+		t.Error("expected argv and envp to be NULL-terminated")
+	}
+
+	auxv := make(map[uint64]uint64)
+	for index := 6; ; index += 2 {
+		if saved := savedAuxv[index-6 : index-4]; saved[0] != word(index) || saved[1] != word(index+1) {
+			t.Errorf("expected the returned auxv to match the stack contents; got %x", saved)
+		}
+		if word(index) == atNull {
+			break
+		}
+		auxv[word(index)] = word(index + 1)
+	}
+
+	expAuxv := map[uint64]uint64{
+		atPhdr:   0x400040,
+		atPhent:  uint64(programHeaderSize),
+		atPhnum:  6,
+		atPagesz: uint64(mm.PageSize),
+		atEntry:  0x401000,
+	}
+	for key, exp := range expAuxv {
+		if got := auxv[key]; got != exp {
+			t.Errorf("expected auxv entry %d to be 0x%x; got 0x%x", key, exp, got)
+		}
+	}
+
+	if random := mem.bytes(uintptr(auxv[atRandom]), 16); !bytes.Equal(random, bytes.Repeat([]byte{0xaa}, 16)) {
+		t.Errorf("expected AT_RANDOM to point to the random bytes; got %x", random)
+	}
+}
+
+func TestSetupStackErrors(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		mem    = newUserMemory(stackPages)
+		expErr = &kernel.Error{Module: "test", Message: "error"}
+	)
+	stackTop = mem.base + stackPages*mm.PageSize
+
+	specs := []struct {
+		argv   []string
+		setup  func(m *mockVMM)
+		expErr *kernel.Error
+	}{
+		{[]string{string(make([]byte, maxArgSize))}, nil, errArgsTooLong},
+		{nil, func(m *mockVMM) { m.allocErr, m.failAllocAt = expErr, 3 }, expErr},
+		{nil, func(m *mockVMM) { m.mapErr, m.failMapAt = expErr, 3 }, expErr},
+	}
+
+	for specIndex, spec := range specs {
+		vmmMock := &mockVMM{}
+		vmmMock.install()
+		if spec.setup != nil {
+			spec.setup(vmmMock)
+		}
+
+		if _, _, err := setupStack(&vmm.RegionTree{}, stackTop, &Image{}, spec.argv, nil); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		vmmMock = &mockVMM{}
+		mem     = newUserMemory(1 + stackPages)
+		image   = buildELF(mem.base, testSegment{flags: pfX, vaddr: mem.base, data: []byte{0xc3}, memsz: 1})
+		f       = &memFile{data: image}
+		p       = &proc.Process{}
+		expErr  = &kernel.Error{Module: "test", Message: "error"}
+		entered [2]uintptr
+	)
+	vmmMock.install()
+	stackTop = mem.base + (1+stackPages)*mm.PageSize
+	enterFn = func(entry, stack uintptr) { entered = [2]uintptr{entry, stack} }
+	randomFn = func(_ []byte) {}
+	boolCmdlineFn = func(_ string) bool { return true }
+
+	// Exec cannot replace the kernel process
+	currentProcessFn = func() *proc.Process { return proc.Lookup(proc.KernelPID) }
+	if err := Exec("/sbin/init", nil, nil); err != errKernelProcess {
+		t.Errorf("expected error %v; got %v", errKernelProcess, err)
+	}
+
+	currentProcessFn = func() *proc.Process { return p }
+	openFn = func(_ string) (vfs.File, *kernel.Error) { return nil, expErr }
+	if err := Exec("/sbin/init", nil, nil); err != expErr {
+		t.Errorf("expected error %v; got %v", expErr, err)
+	}
+
+	openFn = func(_ string) (vfs.File, *kernel.Error) { return &memFile{}, nil }
+	if err := Exec("/sbin/init", nil, nil); err != errNotELF {
+		t.Errorf("expected error %v; got %v", errNotELF, err)
+	}
+
+	openFn = func(_ string) (vfs.File, *kernel.Error) { return &memFile{data: image}, nil }
+	if err := Exec("/sbin/init", []string{string(make([]byte, maxArgSize))}, nil); err != errArgsTooLong {
+		t.Errorf("expected error %v; got %v", errArgsTooLong, err)
+	}
+
+	var openedPath string
+	openFn = func(path string) (vfs.File, *kernel.Error) {
+		openedPath = path
+		return f, nil
+	}
+	// The failed attempts above left the image mapped
+	p = &proc.Process{}
+	p.SetFSBase(0x1234)
+	if err := Exec("/sbin/init", []string{"/sbin/init"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if openedPath != "/sbin/init" || !f.closed {
+		t.Errorf("expected the executable to be opened and closed; got path %q, closed: %t", openedPath, f.closed)
+	}
+
+	if entered[0] != mem.base || entered[1] == 0 || entered[1] >= stackTop {
+		t.Errorf("expected user mode to be entered at 0x%x with a stack below 0x%x; got %x", mem.base, stackTop, entered)
+	}
+
+	if p.FSBase() != 0 {
+		t.Errorf("expected the FS base of the process to be reset; got 0x%x", p.FSBase())
+	}
+
+	stack, ok := p.Regions().Lookup(stackTop - 1)
+	if !ok || stack.Start != stackTop-stackPages*mm.PageSize || stack.Flags != stackFlags {
+		t.Errorf("expected the stack to be recorded as a region; got %+v", stack)
+	}
+
+	if p.Break() != mem.base+mm.PageSize || p.MmapTop() != stack.Start-mm.PageSize {
+		t.Errorf("expected the heap to start after the executable and mappings below the stack; got 0x%x, 0x%x", p.Break(), p.MmapTop())
+	}
+
+	if auxv := p.AuxVector(); len(auxv) == 0 || auxv[len(auxv)-2] != atNull {
+		t.Errorf("expected the auxiliary vector to be recorded; got %x", auxv)
+	}
+}
+
+func TestNewAddressLayout(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		norandmaps bool
+		randValue  uint64
+	)
+	boolCmdlineFn = func(name string) bool { return name == "norandmaps" && norandmaps }
+	randUint64Fn = func() uint64 { return randValue }
+
+	for specIndex, spec := range []struct {
+		norandmaps bool
+		randValue  uint64
+		exp        addressLayout
+	}{
+		{true, 0x1234, addressLayout{pieBase, stackTop, stackTop - (stackPages+1)*mm.PageSize}},
+		{false, 0, addressLayout{pieBase, stackTop, stackTop - (stackPages+1)*mm.PageSize}},
+		{false, 3, addressLayout{pieBase + 3*mm.PageSize, stackTop - 3*mm.PageSize, stackTop - (stackPages+7)*mm.PageSize}},
+		// The offsets are limited to the configured number of bits
+		{
+			false, ^uint64(0),
+			addressLayout{
+				pieBase + (1<<pieRandomBits-1)*mm.PageSize,
+				stackTop - (1<<stackRandomBits-1)*mm.PageSize,
+				stackTop - (1<<stackRandomBits-1)*mm.PageSize - (stackPages+1)*mm.PageSize - (1<<mmapRandomBits-1)*mm.PageSize,
+			},
+		},
+	} {
+		norandmaps, randValue = spec.norandmaps, spec.randValue
+		if got := newAddressLayout(); got != spec.exp {
+			t.Errorf("[spec %d] expected layout %+v; got %+v", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestStartInit(t *testing.T) {
+	defer func() {
+		restoreMocks()
+		kfmt.SetOutputSink(nil)
+	}()
+
+	var (
+		buf        bytes.Buffer
+		expErr     = &kernel.Error{Module: "test", Message: "error"}
+		statPath   string
+		entry      func()
+		waiter     func()
+		exitCode   int
+		waitedFor  proc.PID
+		initProc   = &proc.Process{}
+		cmdlineArg = map[string]string{}
+	)
+	kfmt.SetOutputSink(&buf)
+
+	lookupCmdlineFn = func(name string) (string, bool) {
+		value, ok := cmdlineArg[name]
+		return value, ok
+	}
+	statFn = func(path string) (vfs.FileInfo, *kernel.Error) {
+		statPath = path
+		return vfs.FileInfo{}, nil
+	}
+	spawnFn = func(name string, fn func()) (*proc.Process, *kernel.Error) {
+		entry = fn
+		return initProc, nil
+	}
+	spawnThreadFn = func(name string, fn func()) (*kthread.Thread, *kernel.Error) {
+		waiter = fn
+		return nil, nil
+	}
+	exitFn = func(code int) { exitCode = code }
+	waitFn = func(pid proc.PID) (proc.PID, int, *kernel.Error) {
+		waitedFor = pid
+		return pid, 3, nil
+	}
+
+	if err := StartInit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if statPath != DefaultInitPath || entry == nil || waiter == nil {
+		t.Fatalf("expected init to be started from %s", DefaultInitPath)
+	}
+
+	// Errors while loading the executable terminate init
+	currentProcessFn = func() *proc.Process { return initProc }
+	openFn = func(_ string) (vfs.File, *kernel.Error) { return nil, vfs.ErrNotFound }
+	entry()
+	if exitCode != 127 {
+		t.Errorf("expected init to exit with code 127; got %d", exitCode)
+	}
+
+	waiter()
+	if waitedFor != initProc.PID() {
+		t.Errorf("expected the init process to be waited for; got PID %d", waitedFor)
+	}
+
+	// Processes terminated by a signal exit with the negated signal number
+	waitFn = func(pid proc.PID) (proc.PID, int, *kernel.Error) { return pid, -int(proc.SigSegv), nil }
+	waiter()
+
+	exp := "[init] unable to execute /sbin/init: no such file or directory\n[init] /sbin/init exited with code 3\n[init] /sbin/init killed by signal 11\n"
+	if got := buf.String(); got != exp {
+		t.Errorf("expected output:\n%q\ngot:\n%q", exp, got)
+	}
+
+	// The init path can be overridden via the command line
+	cmdlineArg["init"] = "/bin/custom"
+	if err := StartInit(); err != nil || statPath != "/bin/custom" {
+		t.Errorf("expected init to be started from /bin/custom; got %q, %v", statPath, err)
+	}
+
+	statFn = func(_ string) (vfs.FileInfo, *kernel.Error) { return vfs.FileInfo{}, vfs.ErrNotFound }
+	if err := StartInit(); err != vfs.ErrNotFound {
+		t.Errorf("expected error %v; got %v", vfs.ErrNotFound, err)
+	}
+
+	statFn = func(_ string) (vfs.FileInfo, *kernel.Error) { return vfs.FileInfo{}, nil }
+	spawnFn = func(_ string, _ func()) (*proc.Process, *kernel.Error) { return nil, expErr }
+	if err := StartInit(); err != expErr {
+		t.Errorf("expected error %v; got %v", expErr, err)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
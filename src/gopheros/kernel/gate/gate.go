@@ -0,0 +1,9 @@
+// Package gate installs the entry points that the CPU invokes when an
+// interrupt, exception or trap occurs and routes them to Go handlers. Each
+// supported architecture provides Init, LoadIDT, HandleInterrupt,
+// SetUserReturnHandler, the user-mode thread pointer accessors and a Registers
+// type describing the interrupted context in a gate_<arch>.go file.
+package gate
+
+// InterruptNumber describes an interrupt/exception/trap slot.
+type InterruptNumber uint8
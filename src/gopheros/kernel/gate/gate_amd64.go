@@ -1,8 +1,10 @@
 package gate
 
 import (
+	"gopheros/kernel/cpu"
 	"gopheros/kernel/kfmt"
 	"io"
+	"unsafe"
 )
 
 // Registers contains a snapshot of all register values when an exception,
@@ -52,8 +54,11 @@ func (r *Registers) DumpTo(w io.Writer) {
 	kfmt.Fprintf(w, "RFL = %16x\n", r.RFlags)
 }
 
-// InterruptNumber describes an x86 interrupt/exception/trap slot.
-type InterruptNumber uint8
+// Frame returns the instruction pointer and frame pointer of the interrupted
+// context.
+func (r *Registers) Frame() (uintptr, uintptr) {
+	return uintptr(r.RIP), uintptr(r.RBP)
+}
 
 const (
 	// DivideByZero occurs when dividing any number by 0 using the DIV or
@@ -127,18 +132,58 @@ const (
 	SIMDFloatingPointException = InterruptNumber(19)
 )
 
+// msrFSBase is the MSR that holds the base address of the FS segment.
+const msrFSBase = 0xc0000100
+
+// fsBase contains the FS base of the kernel followed by the FS base of the
+// user-mode code that runs on the boot processor. Go code looks up the current
+// g at FS:-8 so the entrypoints load the kernel FS base when an interrupt or a
+// system call is raised while executing user-mode code and restore the
+// user-mode FS base before returning to it.
+var fsBase [2]uintptr
+
 // Init runs the appropriate CPU-specific initialization code for enabling
 // support for interrupt handling.
 func Init() {
+	fsBase[0] = uintptr(cpu.ReadMSR(msrFSBase))
 	installIDT()
 }
 
+// SetUserFSBase sets the FS base that is loaded when returning to user mode.
+// User-mode code uses it to locate its thread-local storage.
+func SetUserFSBase(addr uintptr) {
+	fsBase[1] = addr
+}
+
+// UserFSBase returns the FS base that is loaded when returning to user mode.
+func UserFSBase() uintptr {
+	return fsBase[1]
+}
+
+// FSBaseSlots returns the address of the kernel FS base which is immediately
+// followed by the user-mode FS base. It allows entrypoints that are not
+// implemented by this package (e.g. SYSCALL) to switch between the two.
+func FSBaseSlots() uintptr {
+	return uintptr(unsafe.Pointer(&fsBase[0]))
+}
+
+// LoadIDT loads the IDT populated by Init to the calling CPU. It is used by
+// the application processors which share the IDT of the boot processor.
+func LoadIDT()
+
 // HandleInterrupt ensures that the provided handler will be invoked when a
 // particular interrupt number occurs. The value of the istOffset argument
 // specifies the offset in the interrupt stack table (if 0 then IST is not
 // used).
 func HandleInterrupt(intNumber InterruptNumber, istOffset uint8, handler func(*Registers))
 
+// SetUserReturnHandler registers a handler that is invoked with the saved
+// registers each time an interrupt gate entrypoint is about to return to
+// user-mode code. As with HandleInterrupt, the handler runs with the kernel FS
+// base loaded and may modify the saved registers; the handler must be a
+// top-level function.
+func SetUserReturnHandler(handler func(*Registers))
+
 // installIDT populates idtDescriptor with the address of IDT and loads it to
 // the CPU. All gate entries are initially marked as non-present and must be
 // explicitly enabled via a call to install{Trap,IRQ,Task}Handler.
@@ -6,6 +6,19 @@
 
 #define ENTRY_TYPE_INTERRUPT_GATE 0x8e
 
+#define MSR_FS_BASE 0xc0000100
+
+// The offset of the CS field of the Registers struct relative to the stack
+// pointer while dispatchInterrupt has the XMM regs saved on the stack.
+#define SAVED_CS 16*16+17*8
+
+// Load the FS base stored in AX. CX and DX are clobbered.
+#define LOAD_FS_BASE \
+	MOVQ AX, DX;            \
+	SHRQ $32, DX;           \
+	MOVL $MSR_FS_BASE, CX;  \
+	WRMSR
+
 // The 64-bit SIDT consists of 10 bytes and has the following layout:
 //   BYTE
 // [00 - 01] size of IDT minus 1
@@ -28,6 +41,9 @@ GLOBL ·idt<>(SB), NOPTR, $NUM_IDT_ENTRIES*IDT_ENTRY_SIZE
 // serve as the jump targets for the trap/int/task dispatchers.
 GLOBL ·gateHandlers<>(SB), NOPTR, $NUM_IDT_ENTRIES*8
 
+// The address of the handler registered via SetUserReturnHandler or 0.
+GLOBL ·userReturnHandler<>(SB), NOPTR, $8
+
 // installIDT populates idtDescriptor with the address of IDT and loads it to 
 // the CPU. All gate entries are initially marked as non-present and must be 
 // explicitly enabled by invoking HandleInterrupt.
@@ -39,6 +55,20 @@ TEXT ·installIDT(SB),NOSPLIT,$0
 	MOVQ 0(AX), IDTR 	// LIDT[RAX]
 	RET
 
+// LoadIDT loads the IDT descriptor populated by installIDT to the calling CPU.
+TEXT ·LoadIDT(SB),NOSPLIT,$0
+	LEAQ ·idtDescriptor<>(SB), AX
+	MOVQ 0(AX), IDTR 	// LIDT[RAX]
+	RET
+
+// SetUserReturnHandler registers a handler that is invoked before returning
+// to user-mode code.
+TEXT ·SetUserReturnHandler(SB),NOSPLIT,$0-8
+	MOVQ handler+0(FP), BX
+	MOVQ 0(BX), BX
+	MOVQ BX, ·userReturnHandler<>(SB)
+	RET
+
 // HandleInterrupt ensures that the provided handler will be invoked when a
 // particular interrupt number occurs. The value of the istOffset argument
 // specifies the offset in the interrupt stack table (if 0 then IST is not
@@ -217,6 +247,16 @@ TEXT ·dispatchInterrupt(SB),NOSPLIT,$0
 	MOVOU X14, 14*16(SP)
 	MOVOU X15, 15*16(SP)
 
+	// Interrupts raised while running user-mode code are handled with the
+	// kernel FS base loaded.
+	MOVQ SAVED_CS(SP), AX
+	TESTQ $3, AX
+	JZ callHandler
+	MOVQ ·fsBase+0(SB), AX
+	LOAD_FS_BASE
+
+callHandler:
+
 	// Setup call stack and invoke handler 
 	MOVQ SP, R14
 	ADDQ $16*16, R14
@@ -224,6 +264,27 @@ TEXT ·dispatchInterrupt(SB),NOSPLIT,$0
 	CALL R15
 	ADDQ $8, SP
 
+	MOVQ SAVED_CS(SP), AX
+	TESTQ $3, AX
+	JZ restoreRegs
+
+	// Give the kernel a chance to act (e.g. deliver signals) before
+	// returning to user mode.
+	MOVQ ·userReturnHandler<>(SB), R15
+	TESTQ R15, R15
+	JZ loadUserFSBase
+	MOVQ SP, R14
+	ADDQ $16*16, R14
+	PUSHQ R14
+	CALL R15
+	ADDQ $8, SP
+
+loadUserFSBase:
+	MOVQ ·fsBase+8(SB), AX
+	LOAD_FS_BASE
+
+restoreRegs:
+
 	// Restore XMM regs
 	MOVOU 0*16(SP), X0
 	MOVOU 1*16(SP), X1
@@ -0,0 +1,74 @@
+package gate
+
+import (
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+// The arm64 port is a stub: its entry points allow the architecture-neutral
+// kernel packages to be type-checked for arm64 but panic when invoked.
+
+// Registers contains a snapshot of all register values when an exception,
+// interrupt or syscall occurs.
+type Registers struct {
+	// X holds the general purpose registers X0-X30.
+	X [31]uint64
+
+	// Info contains the exception syndrome for exceptions, the syscall
+	// number for syscall entries or the IRQ number for HW interrupts.
+	Info uint64
+
+	// The state restored by ERET
+	SP     uint64
+	PC     uint64
+	PState uint64
+}
+
+// DumpTo outputs the register contents to w.
+func (r *Registers) DumpTo(w io.Writer) {
+	for i := 0; i < len(r.X)-1; i += 2 {
+		kfmt.Fprintf(w, "X%2d = %16x X%2d = %16x\n", i, r.X[i], i+1, r.X[i+1])
+	}
+	kfmt.Fprintf(w, "X30 = %16x\n", r.X[30])
+	kfmt.Fprintf(w, "\n")
+	kfmt.Fprintf(w, "PC  = %16x SP  = %16x\n", r.PC, r.SP)
+	kfmt.Fprintf(w, "PST = %16x\n", r.PState)
+}
+
+// Frame returns the instruction pointer and frame pointer of the interrupted
+// context.
+func (r *Registers) Frame() (uintptr, uintptr) {
+	return uintptr(r.PC), uintptr(r.X[29])
+}
+
+func unimplemented() {
+	panic("gate: not implemented on arm64")
+}
+
+// Init runs the appropriate CPU-specific initialization code for enabling
+// support for interrupt handling.
+func Init() { unimplemented() }
+
+// LoadIDT loads the exception vector table populated by Init to the calling
+// CPU.
+func LoadIDT() { unimplemented() }
+
+// HandleInterrupt ensures that the provided handler will be invoked when a
+// particular interrupt number occurs. The istOffset argument is ignored.
+func HandleInterrupt(_ InterruptNumber, _ uint8, _ func(*Registers)) { unimplemented() }
+
+// SetUserReturnHandler registers a handler that is invoked with the saved
+// registers each time an exception entrypoint is about to return to user-mode
+// code.
+func SetUserReturnHandler(_ func(*Registers)) { unimplemented() }
+
+// SetUserFSBase sets the thread pointer that is loaded when returning to user
+// mode.
+func SetUserFSBase(_ uintptr) { unimplemented() }
+
+// UserFSBase returns the thread pointer that is loaded when returning to user
+// mode.
+func UserFSBase() uintptr {
+	unimplemented()
+	return 0
+}
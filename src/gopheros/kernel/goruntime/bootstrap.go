@@ -1,16 +1,21 @@
 // Package goruntime contains code for bootstrapping Go runtime features such
-// as the memory allocator.
+// as the memory allocator and for backing the runtime's thread, futex and
+// clock primitives with kernel threads and the kernel timer.
 package goruntime
 
 import (
 	"gopheros/kernel"
 	"gopheros/kernel/mm"
 	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/timer"
 	"unsafe"
 )
 
 var (
 	mapFn                = vmm.Map
+	unmapFn              = vmm.Unmap
+	translateFn          = vmm.Translate
+	freeFrameFn          = mm.FreeFrame
 	earlyReserveRegionFn = vmm.EarlyReserveRegion
 	memsetFn             = kernel.Memset
 	mallocInitFn         = mallocInit
@@ -125,20 +130,98 @@ func sysAlloc(size uintptr, sysStat *uint64) unsafe.Pointer {
 	return unsafe.Pointer(regionStartAddr)
 }
 
-// nanotime returns a monotonically increasing clock value. This is a dummy
-// implementation and will be replaced when the timekeeper package is
-// implemented.
+// sysUnused notifies the kernel that the contents of a memory region are no
+// longer needed. The frames backing the region are returned to the physical
+// frame allocator and the region is remapped to the reserved zeroed frame so
+// that subsequent writes allocate new frames via copy-on-write.
+//
+// This function replaces runtime.sysUnused and is invoked by the heap
+// scavenger to release memory held by free spans. As the scavenger is started
+// by gcenable, which the kernel cannot run until goroutines are supported, it
+// is not invoked yet.
+//
+//go:redirect-from runtime.sysUnused
+//go:nosplit
+func sysUnused(virtAddr unsafe.Pointer, size uintptr) {
+	releaseRegion(uintptr(virtAddr), size, true)
+}
+
+// sysUsed notifies the kernel that a memory region that was previously passed
+// to sysUnused is about to be used again. As the region is still mapped with
+// copy-on-write semantics, this is a no-op.
+//
+// This function replaces runtime.sysUsed.
+//
+//go:redirect-from runtime.sysUsed
+//go:nosplit
+func sysUsed(_ unsafe.Pointer, _ uintptr) {
+}
+
+// sysFree returns the frames backing a memory region to the physical frame
+// allocator and removes the region mappings. As the early reservation
+// allocator cannot release virtual address space, the region itself is not
+// reclaimed.
+//
+// This function replaces runtime.sysFree.
+//
+//go:redirect-from runtime.sysFree
+//go:nosplit
+func sysFree(virtAddr unsafe.Pointer, size uintptr, sysStat *uint64) {
+	releaseRegion(uintptr(virtAddr), size, false)
+	mSysStatDec(sysStat, size)
+}
+
+// releaseRegion frees the frames backing the pages that are fully contained in
+// the supplied region. Depending on the value of remap, each released page is
+// either remapped to the reserved zeroed frame or unmapped.
+//
+//go:nosplit
+func releaseRegion(regionStartAddr, size uintptr, remap bool) {
+	regionEndAddr := (regionStartAddr + size) & ^(mm.PageSize - 1)
+	regionStartAddr = (regionStartAddr + mm.PageSize - 1) & ^(mm.PageSize - 1)
+
+	mapFlags := vmm.FlagPresent | vmm.FlagNoExecute | vmm.FlagCopyOnWrite
+	for page := mm.PageFromAddress(regionStartAddr); page.Address() < regionEndAddr; page++ {
+		physAddr, err := translateFn(page.Address())
+		if err != nil {
+			continue
+		}
+
+		if remap {
+			err = mapFn(page, vmm.ReservedZeroedFrame, mapFlags)
+		} else {
+			err = unmapFn(page)
+		}
+
+		if frame := mm.FrameFromAddress(physAddr); err == nil && frame != vmm.ReservedZeroedFrame {
+			_ = freeFrameFn(frame)
+		}
+	}
+}
+
+// nanotime returns the value of the kernel monotonic clock in nanoseconds.
+// Until the timer package is initialized, the clock does not advance.
 //
 // This function replaces runtime.nanotime and is invoked by the Go allocator
-// when a span allocation is performed.
+// when a span allocation is performed and by the runtime timer implementation.
 //
 //go:redirect-from runtime.nanotime
 //go:nosplit
 func nanotime() uint64 {
-	// Use a dummy loop to prevent the compiler from inlining this function.
-	for i := 0; i < 100; i++ {
-	}
-	return 1
+	return uint64(nowFn())
+}
+
+// walltime returns the current wall-clock time as seconds and nanoseconds
+// since the Unix epoch. Until the wall clock is set by a clock driver, the
+// returned time is the Unix epoch.
+//
+// This function replaces runtime.walltime and is invoked by time.Now.
+//
+//go:redirect-from runtime.walltime
+//go:nosplit
+func walltime() (int64, int32) {
+	unixNano := wallClockFn()
+	return unixNano / int64(timer.Second), int32(unixNano % int64(timer.Second))
 }
 
 // getRandomData populates the given slice with random data. The implementation
@@ -185,6 +268,7 @@ func init() {
 	var (
 		reserved bool
 		stat     uint64
+		futex    uint32
 		zeroPtr  = unsafe.Pointer(uintptr(0))
 	)
 
@@ -192,6 +276,13 @@ func init() {
 	sysReserve(zeroPtr, 0, &reserved)
 	sysMap(zeroPtr, 0, reserved, &stat)
 	sysAlloc(0, &stat)
+	sysUnused(zeroPtr, 0)
+	sysUsed(zeroPtr, 0)
+	sysFree(zeroPtr, 0, &stat)
 	getRandomData(nil)
 	stat = nanotime()
+	osyield()
+	usleep(0)
+	futexsleep(&futex, 1, -1)
+	futexwakeup(&futex, 0)
 }
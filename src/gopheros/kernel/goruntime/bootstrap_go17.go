@@ -21,6 +21,9 @@ func mallocInit()
 //go:linkname mSysStatInc runtime.mSysStatInc
 func mSysStatInc(*uint64, uintptr)
 
+//go:linkname mSysStatDec runtime.mSysStatDec
+func mSysStatDec(*uint64, uintptr)
+
 //go:linkname procResize runtime.procresize
 func procResize(int32) uintptr
 
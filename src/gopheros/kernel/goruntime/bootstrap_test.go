@@ -245,6 +245,72 @@ func TestSysAlloc(t *testing.T) {
 	})
 }
 
+func TestSysUnusedAndFree(t *testing.T) {
+	defer func() {
+		mapFn = vmm.Map
+		unmapFn = vmm.Unmap
+		translateFn = vmm.Translate
+		freeFrameFn = mm.FreeFrame
+	}()
+
+	// Page 10 is unmapped and page 11 is backed by the reserved zeroed
+	// frame; all other pages are backed by frame (page + 100).
+	translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) {
+		switch mm.PageFromAddress(virtAddr) {
+		case 10:
+			return 0, vmm.ErrInvalidMapping
+		case 11:
+			return vmm.ReservedZeroedFrame.Address(), nil
+		default:
+			return (mm.Frame(mm.PageFromAddress(virtAddr)) + 100).Address(), nil
+		}
+	}
+
+	var (
+		mapped, unmapped []mm.Page
+		freed            []mm.Frame
+	)
+	mapFn = func(page mm.Page, frame mm.Frame, flags vmm.PageTableEntryFlag) *kernel.Error {
+		expFlags := vmm.FlagPresent | vmm.FlagNoExecute | vmm.FlagCopyOnWrite
+		if frame != vmm.ReservedZeroedFrame || flags != expFlags {
+			t.Errorf("expected page to be remapped to the reserved zeroed frame with flags %d; got frame %d, flags %d", expFlags, frame, flags)
+		}
+		mapped = append(mapped, page)
+		return nil
+	}
+	unmapFn = func(page mm.Page) *kernel.Error {
+		unmapped = append(unmapped, page)
+		return nil
+	}
+	freeFrameFn = func(frame mm.Frame) *kernel.Error {
+		freed = append(freed, frame)
+		return nil
+	}
+
+	// Partially covered pages at the region boundaries are not released
+	sysUnused(unsafe.Pointer(uintptr(9*mm.PageSize+1)), 5*mm.PageSize)
+	if len(mapped) != 3 || mapped[0] != 11 || mapped[2] != 13 {
+		t.Errorf("expected pages 11-13 to be remapped; got %v", mapped)
+	}
+
+	if len(freed) != 2 || freed[0] != 112 || freed[1] != 113 {
+		t.Errorf("expected frames 112 and 113 to be freed; got %v", freed)
+	}
+
+	sysUsed(unsafe.Pointer(uintptr(11*mm.PageSize)), 3*mm.PageSize)
+
+	freed = nil
+	sysStat := uint64(4 * mm.PageSize)
+	sysFree(unsafe.Pointer(uintptr(12*mm.PageSize)), 2*mm.PageSize, &sysStat)
+	if len(unmapped) != 2 || len(freed) != 2 || freed[0] != 112 || freed[1] != 113 {
+		t.Errorf("expected pages 12-13 to be unmapped and their frames freed; got %v, %v", unmapped, freed)
+	}
+
+	if exp := uint64(2 * mm.PageSize); sysStat != exp {
+		t.Errorf("expected stat counter to be %d; got %d", exp, sysStat)
+	}
+}
+
 func TestGetRandomData(t *testing.T) {
 	sample1 := make([]byte, 128)
 	sample2 := make([]byte, 128)
@@ -0,0 +1,226 @@
+package goruntime
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/timer"
+	"sync/atomic"
+	"unsafe"
+)
+
+// futexBucketCount is the number of hash buckets used for tracking threads
+// that sleep on a futex address.
+const futexBucketCount = 64
+
+// futexWaiter is linked into a futex bucket while a thread sleeps on a futex
+// address. Waiters are stored on the stack of the sleeping thread as the
+// runtime may invoke futexsleep while holding the allocator locks. For the same
+// reason, timed sleeps use the timer embedded in the waiter.
+type futexWaiter struct {
+	addr    uintptr
+	thread  *sched.Thread
+	woken   bool
+	expired bool
+	timer   timer.Timer
+	next    *futexWaiter
+}
+
+var (
+	futexBuckets [futexBucketCount]*futexWaiter
+
+	// The following functions are used by tests to mock calls to the cpu,
+	// sched and timer packages.
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn  = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	currentThreadFn     = sched.Current
+	yieldFn             = sched.Yield
+	blockFn             = sched.Block
+	readyFn             = sched.Ready
+	nowFn               = timer.Now
+	wallClockFn         = timer.WallClock
+	ticksFn             = timer.Ticks
+	startTimerFn        = (*timer.Timer).Start
+	stopTimerFn         = (*timer.Timer).Stop
+)
+
+// osyield yields the CPU to another runnable kernel thread.
+//
+// This function replaces runtime.osyield which is invoked by the runtime lock
+// implementation while spinning.
+//
+//go:redirect-from runtime.osyield
+//go:nosplit
+func osyield() {
+	if currentThreadFn() != nil {
+		yieldFn()
+	}
+}
+
+// usleep suspends the calling thread for at least usec microseconds. As the
+// runtime may invoke usleep while holding its internal locks, the thread polls
+// the monotonic clock while yielding instead of arming a timer.
+//
+// This function replaces runtime.usleep.
+//
+//go:redirect-from runtime.usleep
+//go:nosplit
+func usleep(usec uint32) {
+	deadline := nowFn() + timer.Duration(usec)*timer.Microsecond
+	for nowFn() < deadline {
+		osyield()
+	}
+}
+
+// futexsleep blocks the calling thread while *addr == val until a call to
+// futexwakeup is issued for the same address. If ns is non-negative, the
+// thread wakes up after at most ns nanoseconds; the thread is parked until a
+// kernel timer expires or, if the timer tick is not running yet, it polls the
+// monotonic clock while yielding. Like their Linux counterparts,
+// futexsleep may return spuriously and callers are expected to recheck the
+// value at addr.
+//
+// This function replaces runtime.futexsleep which is used by the runtime to
+// implement notes (e.g. for parking idle Ms) and locks.
+//
+//go:redirect-from runtime.futexsleep
+//go:nosplit
+func futexsleep(addr *uint32, val uint32, ns int64) {
+	intr := lock()
+	if atomic.LoadUint32(addr) != val || currentThreadFn() == nil {
+		unlock(intr)
+		return
+	}
+
+	var w futexWaiter
+	w.addr = uintptr(unsafe.Pointer(addr))
+	w.thread = currentThreadFn()
+
+	// The waiter is unlinked from its bucket and its timer is disarmed
+	// before futexsleep returns so it can remain on the stack. Once linked,
+	// it is only accessed via wp as futexwakeup and futexTimeout update it
+	// while the thread is blocked.
+	wp := (*futexWaiter)(noescape(unsafe.Pointer(&w)))
+	bucket := &futexBuckets[futexBucket(w.addr)]
+	w.next = *bucket
+	*bucket = wp
+
+	switch {
+	case ns < 0:
+		for !wp.woken {
+			blockFn()
+		}
+	case ticksFn() != 0:
+		// Park the thread until it is woken up or the timer expires.
+		startTimerFn(&wp.timer, timer.Duration(ns), futexTimeout, unsafe.Pointer(wp))
+		for !wp.woken && !wp.expired {
+			blockFn()
+		}
+
+		if wp.woken {
+			stopTimerFn(&wp.timer)
+		} else {
+			futexUnlink(bucket, wp)
+		}
+	default:
+		// Until the timer tick is running, timers never expire so the
+		// thread keeps yielding until it is woken up or the timeout
+		// expires.
+		deadline := nowFn() + timer.Duration(ns)
+		for !wp.woken && nowFn() < deadline {
+			unlock(intr)
+			osyield()
+			intr = lock()
+		}
+
+		if !wp.woken {
+			futexUnlink(bucket, wp)
+		}
+	}
+
+	unlock(intr)
+}
+
+// futexTimeout is invoked by the timer of a waiter once its timeout expires.
+// Timer callbacks run with interrupts disabled so it cannot race with
+// futexwakeup.
+//
+//go:nosplit
+func futexTimeout(arg unsafe.Pointer) {
+	w := (*futexWaiter)(arg)
+	if !w.woken {
+		w.expired = true
+		readyFn(w.thread)
+	}
+}
+
+// futexwakeup wakes up to cnt threads that sleep on addr.
+//
+// This function replaces runtime.futexwakeup.
+//
+//go:redirect-from runtime.futexwakeup
+//go:nosplit
+func futexwakeup(addr *uint32, cnt uint32) {
+	intr := lock()
+	bucket := &futexBuckets[futexBucket(uintptr(unsafe.Pointer(addr)))]
+	for w := *bucket; w != nil && cnt > 0; {
+		next := w.next
+		if w.addr == uintptr(unsafe.Pointer(addr)) {
+			futexUnlink(bucket, w)
+			w.woken = true
+			readyFn(w.thread)
+			cnt--
+		}
+		w = next
+	}
+	unlock(intr)
+}
+
+// futexBucket returns the bucket index for a futex address.
+//
+//go:nosplit
+func futexBucket(addr uintptr) uintptr {
+	return (addr >> 2) % futexBucketCount
+}
+
+// futexUnlink removes w from a futex bucket.
+//
+//go:nosplit
+func futexUnlink(bucket **futexWaiter, w *futexWaiter) {
+	for link := bucket; *link != nil; link = &(*link).next {
+		if *link == w {
+			*link = w.next
+			w.next = nil
+			return
+		}
+	}
+}
+
+// noescape hides a pointer from escape analysis so that stack-allocated
+// waiters can be linked into the futex buckets without being moved to the
+// heap.
+//
+//go:nosplit
+func noescape(p unsafe.Pointer) unsafe.Pointer {
+	x := uintptr(p)
+	return unsafe.Pointer(x ^ 0)
+}
+
+// lock disables interrupts and returns the previous interrupt state. This is
+// sufficient for protecting the futex buckets as the scheduler only allows
+// threads that never enter the Go runtime to run on the application
+// processors.
+//
+//go:nosplit
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+	return intr
+}
+
+//go:nosplit
+func unlock(intr bool) {
+	if intr {
+		enableInterruptsFn()
+	}
+}
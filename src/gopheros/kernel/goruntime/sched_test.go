@@ -0,0 +1,256 @@
+package goruntime
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/timer"
+	"testing"
+	"unsafe"
+)
+
+func restoreSchedMocks() {
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	currentThreadFn = sched.Current
+	yieldFn = sched.Yield
+	blockFn = sched.Block
+	readyFn = sched.Ready
+	nowFn = timer.Now
+	wallClockFn = timer.WallClock
+	ticksFn = timer.Ticks
+	startTimerFn = (*timer.Timer).Start
+	stopTimerFn = (*timer.Timer).Stop
+	futexBuckets = [futexBucketCount]*futexWaiter{}
+}
+
+func mockInterrupts() *bool {
+	intrEnabled := new(bool)
+	*intrEnabled = true
+	interruptsEnabledFn = func() bool { return *intrEnabled }
+	enableInterruptsFn = func() { *intrEnabled = true }
+	disableInterruptsFn = func() { *intrEnabled = false }
+	return intrEnabled
+}
+
+func TestOsyieldAndUsleep(t *testing.T) {
+	defer restoreSchedMocks()
+
+	var (
+		yields int
+		now    timer.Duration
+	)
+	currentThreadFn = func() *sched.Thread { return nil }
+	yieldFn = func() {
+		yields++
+		now += 10 * timer.Microsecond
+	}
+	nowFn = func() timer.Duration { return now }
+
+	// Before the scheduler is initialized osyield is a no-op
+	osyield()
+	if yields != 0 {
+		t.Fatal("expected osyield not to yield before the scheduler is initialized")
+	}
+
+	currentThreadFn = func() *sched.Thread { return &sched.Thread{} }
+	usleep(25)
+	if yields != 3 || now < 25*timer.Microsecond {
+		t.Errorf("expected usleep to yield until the deadline; yielded %d times", yields)
+	}
+}
+
+func TestNanotime(t *testing.T) {
+	defer restoreSchedMocks()
+
+	nowFn = func() timer.Duration { return 42 * timer.Second }
+	if got := nanotime(); got != uint64(42*timer.Second) {
+		t.Errorf("expected nanotime to return %d; got %d", 42*timer.Second, got)
+	}
+}
+
+func TestWalltime(t *testing.T) {
+	defer restoreSchedMocks()
+
+	wallClockFn = func() int64 { return 1500000000*int64(timer.Second) + 250 }
+	if sec, nsec := walltime(); sec != 1500000000 || nsec != 250 {
+		t.Errorf("expected walltime to return (1500000000, 250); got (%d, %d)", sec, nsec)
+	}
+}
+
+func TestFutexSleepWakeup(t *testing.T) {
+	defer restoreSchedMocks()
+	intrEnabled := mockInterrupts()
+
+	var (
+		futex, other uint32
+		self         = &sched.Thread{}
+		readied      []*sched.Thread
+	)
+	currentThreadFn = func() *sched.Thread { return self }
+	readyFn = func(th *sched.Thread) { readied = append(readied, th) }
+
+	// Value mismatch: futexsleep returns immediately
+	blockFn = func() { t.Fatal("unexpected call to Block") }
+	futexsleep(&futex, 1, -1)
+
+	// Emulate a wake-up for a different address followed by a wake-up for
+	// the futex the thread sleeps on.
+	var blocked int
+	blockFn = func() {
+		if *intrEnabled {
+			t.Error("expected interrupts to be disabled while blocking")
+		}
+
+		blocked++
+		switch blocked {
+		case 1:
+			futexwakeup(&other, 1)
+		case 2:
+			futexwakeup(&futex, 1)
+		default:
+			t.Fatal("expected thread to be woken up")
+		}
+	}
+	futexsleep(&futex, 0, -1)
+
+	if blocked != 2 || len(readied) != 1 || readied[0] != self {
+		t.Errorf("expected the sleeping thread to be readied once; blocked %d times, readied %d threads", blocked, len(readied))
+	}
+
+	if !*intrEnabled {
+		t.Error("expected futexsleep to restore the interrupt flag")
+	}
+
+	for specIndex, bucket := range futexBuckets {
+		if bucket != nil {
+			t.Errorf("[spec %d] expected futex bucket to be empty", specIndex)
+		}
+	}
+}
+
+func TestFutexSleepTimer(t *testing.T) {
+	defer restoreSchedMocks()
+	intrEnabled := mockInterrupts()
+
+	var (
+		futex    uint32
+		self     = &sched.Thread{}
+		readied  []*sched.Thread
+		expire   func()
+		armedFor timer.Duration
+		stopped  int
+	)
+	currentThreadFn = func() *sched.Thread { return self }
+	readyFn = func(th *sched.Thread) { readied = append(readied, th) }
+	ticksFn = func() uint64 { return 1 }
+	startTimerFn = func(_ *timer.Timer, d timer.Duration, fn func(unsafe.Pointer), arg unsafe.Pointer) {
+		armedFor, expire = d, func() { fn(arg) }
+	}
+	stopTimerFn = func(_ *timer.Timer) bool {
+		stopped++
+		return true
+	}
+	yieldFn = func() { t.Fatal("expected futexsleep to park instead of yielding") }
+
+	// The thread is readied once the timer expires
+	blockFn = func() {
+		if *intrEnabled {
+			t.Error("expected interrupts to be disabled while blocking")
+		}
+		expire()
+	}
+	futexsleep(&futex, 0, int64(3*timer.Millisecond))
+
+	if armedFor != 3*timer.Millisecond || len(readied) != 1 || readied[0] != self {
+		t.Fatalf("expected the timer to ready the sleeping thread; armed for %d, readied %d threads", armedFor, len(readied))
+	}
+
+	if futexBuckets[futexBucket(uintptr(unsafe.Pointer(&futex)))] != nil || stopped != 0 {
+		t.Error("expected timed out waiter to be removed from its bucket")
+	}
+
+	// A wake-up before the timeout stops the timer. As the waiter lives on
+	// the stack of the sleeping thread, the timer must not fire afterwards.
+	readied = readied[:0]
+	blockFn = func() { futexwakeup(&futex, 1) }
+	futexsleep(&futex, 0, int64(timer.Second))
+
+	if len(readied) != 1 || stopped != 1 {
+		t.Errorf("expected the wake-up to ready the thread once and stop the timer; readied %d threads, stopped %d timers", len(readied), stopped)
+	}
+
+	if !*intrEnabled {
+		t.Error("expected futexsleep to restore the interrupt flag")
+	}
+}
+
+func TestFutexSleepTimeout(t *testing.T) {
+	defer restoreSchedMocks()
+	mockInterrupts()
+
+	var (
+		futex  uint32
+		now    timer.Duration
+		yields int
+	)
+	currentThreadFn = func() *sched.Thread { return &sched.Thread{} }
+	nowFn = func() timer.Duration { return now }
+	ticksFn = func() uint64 { return 0 }
+	yieldFn = func() {
+		yields++
+		now += timer.Millisecond
+	}
+
+	futexsleep(&futex, 0, int64(3*timer.Millisecond))
+	if yields != 3 {
+		t.Errorf("expected futexsleep to yield until the timeout expires; yielded %d times", yields)
+	}
+
+	if futexBuckets[futexBucket(uintptr(unsafe.Pointer(&futex)))] != nil {
+		t.Error("expected timed out waiter to be removed from its bucket")
+	}
+
+	// A wake-up while polling ends the sleep early
+	var readied int
+	readyFn = func(_ *sched.Thread) { readied++ }
+	yields = 0
+	yieldFn = func() {
+		yields++
+		futexwakeup(&futex, 1)
+	}
+
+	futexsleep(&futex, 0, int64(timer.Second))
+	if yields != 1 || readied != 1 {
+		t.Errorf("expected futexsleep to return after being woken up; yielded %d times", yields)
+	}
+}
+
+func TestFutexWakeupCount(t *testing.T) {
+	defer restoreSchedMocks()
+	mockInterrupts()
+
+	var (
+		futex   uint32
+		readied int
+		waiters [3]futexWaiter
+	)
+	readyFn = func(_ *sched.Thread) { readied++ }
+
+	bucket := &futexBuckets[futexBucket(uintptr(unsafe.Pointer(&futex)))]
+	for i := range waiters {
+		waiters[i].addr = uintptr(unsafe.Pointer(&futex))
+		waiters[i].next = *bucket
+		*bucket = &waiters[i]
+	}
+
+	futexwakeup(&futex, 2)
+	if readied != 2 || *bucket != &waiters[0] || waiters[0].woken {
+		t.Fatalf("expected futexwakeup to wake up 2 of 3 waiters; woke up %d", readied)
+	}
+
+	futexwakeup(&futex, 5)
+	if readied != 3 || *bucket != nil {
+		t.Errorf("expected futexwakeup to wake up the remaining waiter; woke up %d", readied)
+	}
+}
@@ -3,73 +3,184 @@ package hal
 import (
 	"bytes"
 	"gopheros/device"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/aml"
 	"gopheros/device/tty"
 	"gopheros/device/video/console"
 	"gopheros/device/video/console/font"
 	"gopheros/device/video/console/logo"
+	"gopheros/device/video/console/splash"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
 	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/timer"
 	"gopheros/multiboot"
-	"sort"
+	"io"
+	"reflect"
+	"strings"
+	"unsafe"
 
-	// import and register acpi driver
-	_ "gopheros/device/acpi"
+	// import and register interrupt controller, bus, input, clock, network,
+	// storage and performance monitoring drivers
+	_ "gopheros/device/ahci"
+	_ "gopheros/device/ata"
+	_ "gopheros/device/apic"
+	_ "gopheros/device/cmos"
+	_ "gopheros/device/hpet"
+	_ "gopheros/device/input/ps2"
+	_ "gopheros/device/pci"
+	_ "gopheros/device/pic"
+	_ "gopheros/device/pit"
+	_ "gopheros/device/pmu"
+	_ "gopheros/device/rtc"
+	_ "gopheros/device/virtio"
 )
 
 // managedDevices contains the devices discovered by the HAL.
 type managedDevices struct {
 	activeConsole console.Device
+	activeFont    *font.Font
+	activeLogo    *logo.Image
 	activeTTY     tty.Device
-
-	// activeDrivers tracks all initialized device drivers.
-	activeDrivers []device.Driver
 }
 
 var (
 	devices managedDevices
 	strBuf  bytes.Buffer
+
+	// probeLog prefixes the output of the driver that is being initialized
+	// with the driver name and version.
+	probeLog kfmt.PrefixWriter
+
+	errNoFontSupport = &kernel.Error{Module: "hal", Message: "active console does not support fonts"}
+	errUnknownFont   = &kernel.Error{Module: "hal", Message: "unknown font"}
+	errNoModeSupport = &kernel.Error{Module: "hal", Message: "active console does not support switching modes"}
 )
 
+// cursorBlinkInterval is the period of the timer that blinks the cursor of
+// the active TTY.
+const cursorBlinkInterval = 500 * timer.Millisecond
+
+// fontModuleSuffixes lists the file extensions of boot modules that are
+// treated as PSF fonts.
+var fontModuleSuffixes = []string{".psf", ".psfu"}
+
 // ActiveTTY returns the currently active TTY
 func ActiveTTY() tty.Device {
 	return devices.activeTTY
 }
 
 // DetectHardware probes for hardware devices and initializes the appropriate
-// drivers.
+// drivers. Drivers are probed after the drivers they depend on; a dependency
+// cycle is reported but does not prevent the remaining drivers from being
+// probed.
 func DetectHardware() {
-	// Get driver list and sort by detection priority
-	drivers := device.DriverList()
-	sort.Sort(drivers)
+	drivers, err := device.ProbeOrder()
+	if err != nil {
+		kfmt.Printf("[hal] %s\n", err.Message)
+	}
 
-	probe(drivers)
+	device.ProbeDrivers(drivers, driverLogWriter, onProbe)
 }
 
-// probe executes the probe function for each driver and invokes
-// onDriverInit for each successfully initialized driver.
-func probe(driverInfoList device.DriverInfoList) {
-	var w kfmt.PrefixWriter
+// driverLogWriter returns the writer passed to the DriverInit method of drv.
+func driverLogWriter(drv device.Driver) io.Writer {
+	strBuf.Reset()
+	major, minor, patch := drv.DriverVersion()
+	kfmt.Fprintf(&strBuf, "[hal] %s(%d.%d.%d): ", drv.DriverName(), major, minor, patch)
+	probeLog.Prefix = strBuf.Bytes()
+	probeLog.Sink = kfmt.GetOutputSink()
+	return &probeLog
+}
+
+// onProbe is invoked by device.ProbeDrivers after each driver is probed. It
+// reports the outcome and invokes onDriverInit for each successfully
+// initialized driver.
+func onProbe(info *device.DriverInfo) {
+	switch info.Status() {
+	case device.ProbeStatusMissingDeps:
+		kfmt.Printf("[hal] %s: skipped; missing dependencies\n", info.Name)
+	case device.ProbeStatusNotPresent:
+		kfmt.Printf("[hal] %s: skipped; hardware reported as not present by the firmware\n", info.Name)
+	case device.ProbeStatusInitFailed:
+		kfmt.Fprintf(&probeLog, "init failed: %v\n", info.InitError())
+	case device.ProbeStatusActive:
+		kfmt.Fprintf(&probeLog, "initialized\n")
+		onDriverInit(info, info.Driver())
+	}
+}
 
-	for _, info := range driverInfoList {
-		drv := info.Probe()
-		if drv == nil {
-			continue
+// ListDevices writes the name, version, probe status and health of every
+// registered driver followed by the path, hardware IDs and status of every
+// device defined in the ACPI namespace to w in a format similar to the lsdev
+// command. Drivers that failed to initialize or report problems are followed by
+// a line describing the problem.
+func ListDevices(w io.Writer) {
+	kfmt.Fprintf(w, "%-20s %-10s %-20s %s\n", "DRIVER", "VERSION", "STATUS", "HEALTH")
+	for _, info := range device.DriverList() {
+		md, version := info.Metadata(), "-"
+		if info.Driver() != nil {
+			strBuf.Reset()
+			kfmt.Fprintf(&strBuf, "%d.%d.%d", md.Major, md.Minor, md.Patch)
+			version = strBuf.String()
 		}
 
-		strBuf.Reset()
-		major, minor, patch := drv.DriverVersion()
-		kfmt.Fprintf(&strBuf, "[hal] %s(%d.%d.%d): ", drv.DriverName(), major, minor, patch)
-		w.Prefix = strBuf.Bytes()
-		w.Sink = kfmt.GetOutputSink()
-
-		if err := drv.DriverInit(&w); err != nil {
-			kfmt.Fprintf(&w, "init failed: %s\n", err.Message)
-			continue
+		kfmt.Fprintf(w, "%-20s %-10s %-20s %s\n", md.Name, version, md.Status.String(), md.Health.String())
+		if md.Detail != "" {
+			kfmt.Fprintf(w, "  %s\n", md.Detail)
 		}
+	}
 
-		kfmt.Fprintf(&w, "initialized\n")
-		onDriverInit(info, drv)
-		devices.activeDrivers = append(devices.activeDrivers, drv)
+	var printedHeader bool
+	acpi.VisitDevices(func(dev *acpi.Device) {
+		if !printedHeader {
+			kfmt.Fprintf(w, "\n%-28s %-10s %-12s %s\n", "ACPI DEVICE", "HID", "STATUS", "CID")
+			printedHeader = true
+		}
+
+		status := "not present"
+		switch {
+		case dev.Present() && dev.Enabled():
+			status = "enabled"
+		case dev.Present():
+			status = "disabled"
+		}
+
+		kfmt.Fprintf(w, "%-28s %-10s %-12s ", dev.Path, formatHID(dev.ID, aml.DeviceHID, dev.ID.HID), status)
+
+		switch {
+		case len(dev.ID.CIDs) == 0:
+			kfmt.Fprintf(w, "%s\n", formatHID(dev.ID, aml.DeviceCID, ""))
+		default:
+			for i, cid := range dev.ID.CIDs {
+				if i != 0 {
+					kfmt.Fprintf(w, ",")
+				}
+				kfmt.Fprintf(w, "%s", formatHID(dev.ID, aml.DeviceCID, cid))
+			}
+			kfmt.Fprintf(w, "\n")
+		}
+	})
+}
+
+// formatHID returns a printable version of a _HID or _CID value of an ACPI
+// device. Values that are computed by a control method are reported as
+// "(method)" and malformed HIDs are enclosed in quotes.
+func formatHID(id *aml.DeviceID, field aml.DeviceIDField, hid string) string {
+	switch {
+	case id.NeedsEval&field != 0:
+		return "(method)"
+	case id.Defined&field == 0:
+		return "-"
+	case !aml.ValidHID(hid):
+		strBuf.Reset()
+		kfmt.Fprintf(&strBuf, "\"%s\"", hid)
+		return strBuf.String()
 	}
+
+	return hid
 }
 
 // onDriverInit is invoked by probe() whenever a piece of hardware is detected
@@ -104,39 +215,28 @@ func onConsoleInit(cons console.Device) {
 	devices.activeConsole = cons
 
 	if logoSetter, ok := (devices.activeConsole).(console.LogoSetter); ok {
-		disableLogo := false
-		for k, v := range multiboot.GetBootCmdLine() {
-			if k == "consoleLogo" && v == "off" {
-				disableLogo = true
-				break
-			}
-		}
-
-		if !disableLogo {
+		if cmdline.Get("consoleLogo") != "off" {
 			consW, consH := devices.activeConsole.Dimensions(console.Pixels)
-			logoSetter.SetLogo(logo.BestFit(consW, consH))
+			devices.activeLogo = logo.BestFit(consW, consH)
+			logoSetter.SetLogo(devices.activeLogo)
 		}
 	}
 
 	if fontSetter, ok := (devices.activeConsole).(console.FontSetter); ok {
 		consW, consH := devices.activeConsole.Dimensions(console.Pixels)
+		loadFontModules()
 
 		// Check boot cmdline for a font request
 		var selFont *font.Font
-		for k, v := range multiboot.GetBootCmdLine() {
-			if k != "consoleFont" {
-				continue
-			}
-
-			if selFont = font.FindByName(v); selFont != nil {
-				break
-			}
+		if name, found := cmdline.Lookup("consoleFont"); found {
+			selFont = font.FindByName(name)
 		}
 
 		if selFont == nil {
 			selFont = font.BestFit(consW, consH)
 		}
 
+		devices.activeFont = selFont
 		fontSetter.SetFont(selFont)
 	}
 
@@ -155,3 +255,174 @@ func linkTTYToConsole() {
 	devices.activeTTY.SetState(tty.StateActive)
 
 }
+
+// StartCursorBlink arms a periodic timer that blinks the cursor of the active
+// TTY. It is a no-op if the active TTY does not render a cursor. As timer
+// callbacks run in interrupt context, StartCursorBlink must only be invoked
+// after both the HAL and the timer subsystem have been initialized.
+func StartCursorBlink() {
+	if blinker, ok := devices.activeTTY.(tty.CursorBlinker); ok {
+		timer.Every(cursorBlinkInterval, blinker.BlinkCursor)
+	}
+}
+
+// BeginBootSplash displays the boot splash screen with a progress indicator
+// for the specified number of boot steps if the splash option was specified
+// on the kernel command line. While a graphical splash screen is displayed,
+// the active TTY is deactivated; its contents are restored by EndBootSplash.
+func BeginBootSplash(steps uint32) {
+	if !cmdline.Bool("splash") {
+		return
+	}
+
+	if splash.Begin(devices.activeConsole, steps) && devices.activeTTY != nil {
+		devices.activeTTY.SetState(tty.StateInactive)
+	}
+}
+
+// BootProgress advances the boot splash progress indicator and displays label
+// as the description of the next boot step. It is a no-op if no splash screen
+// is displayed.
+func BootProgress(label string) {
+	splash.Step(label)
+}
+
+// EndBootSplash removes the boot splash screen and restores the console logo
+// and the contents of the active TTY.
+func EndBootSplash() {
+	if !splash.End() {
+		return
+	}
+
+	if logoSetter, ok := (devices.activeConsole).(console.LogoSetter); ok && devices.activeLogo != nil {
+		logoSetter.SetLogo(devices.activeLogo)
+	}
+
+	if devices.activeTTY != nil {
+		devices.activeTTY.SetState(tty.StateActive)
+	}
+}
+
+// SetConsoleFont switches the font used by the active console to the font
+// with the specified name. As the console dimensions (in characters) depend on
+// the font, the active TTY is re-attached to the console which resets its
+// contents.
+func SetConsoleFont(name string) *kernel.Error {
+	fontSetter, ok := (devices.activeConsole).(console.FontSetter)
+	if !ok {
+		return errNoFontSupport
+	}
+
+	f := font.FindByName(name)
+	if f == nil {
+		return errUnknownFont
+	}
+
+	devices.activeFont = f
+	fontSetter.SetFont(f)
+	if devices.activeTTY != nil {
+		devices.activeTTY.SetState(tty.StateInactive)
+		consW, consH := devices.activeConsole.Dimensions(console.Characters)
+		fg, bg := devices.activeConsole.DefaultColors()
+		devices.activeConsole.Fill(1, 1, consW, consH, fg, bg)
+		linkTTYToConsole()
+	}
+
+	return nil
+}
+
+// SetConsoleMode switches the active console to the specified resolution and
+// depth (0 retains the current depth). The console logo is replaced by the
+// logo that best fits the new resolution and the contents of the active TTY
+// are reflowed to the new console dimensions.
+func SetConsoleMode(width, height uint32, bpp uint8) *kernel.Error {
+	modeSetter, ok := (devices.activeConsole).(console.ModeSetter)
+	if !ok {
+		return errNoModeSupport
+	}
+
+	if err := modeSetter.SetMode(width, height, bpp); err != nil {
+		return err
+	}
+
+	// The logo must be set before the font as it reduces the space that
+	// is available for rendering text.
+	if logoSetter, ok := (devices.activeConsole).(console.LogoSetter); ok && devices.activeLogo != nil {
+		devices.activeLogo = logo.BestFit(width, height)
+		logoSetter.SetLogo(devices.activeLogo)
+	}
+
+	if fontSetter, ok := (devices.activeConsole).(console.FontSetter); ok {
+		fontSetter.SetFont(devices.activeFont)
+	}
+
+	switch activeTTY := devices.activeTTY.(type) {
+	case nil:
+	case tty.Resizer:
+		activeTTY.Resize()
+	default:
+		linkTTYToConsole()
+	}
+
+	return nil
+}
+
+// Screenshot writes the contents of the active console framebuffer to w as a
+// binary PPM image. Consoles that cannot read back their framebuffer (e.g.
+// text-mode consoles) are not supported.
+func Screenshot(w io.Writer) *kernel.Error {
+	return console.EncodePPM(w, devices.activeConsole)
+}
+
+// loadFontModules scans the boot modules for PSF fonts and registers them with
+// the font package. Fonts are registered using the module file name without
+// its extension (e.g. a module loaded from /boot/fonts/ter-v16n.psf can be
+// selected by passing consoleFont=ter-v16n on the boot command line).
+func loadFontModules() {
+	multiboot.VisitModules(func(mod *multiboot.Module) bool {
+		name := mod.Name
+		if index := strings.IndexByte(name, ' '); index != -1 {
+			name = name[:index]
+		}
+		name = name[strings.LastIndexByte(name, '/')+1:]
+
+		var matched bool
+		for _, suffix := range fontModuleSuffixes {
+			if strings.HasSuffix(name, suffix) {
+				name, matched = strings.TrimSuffix(name, suffix), true
+				break
+			}
+		}
+
+		if !matched || mod.PhysEnd <= mod.PhysStart {
+			return true
+		}
+
+		size := mod.PhysEnd - mod.PhysStart
+		page, err := vmm.MapRegion(
+			mm.FrameFromAddress(mod.PhysStart),
+			size+vmm.PageOffset(mod.PhysStart),
+			vmm.FlagPresent|vmm.FlagNoExecute,
+		)
+		if err != nil {
+			kfmt.Printf("[hal] unable to map font module %s: %s\n", name, err.Message)
+			return true
+		}
+
+		data := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+			Data: page.Address() + vmm.PageOffset(mod.PhysStart),
+			Len:  int(size),
+			Cap:  int(size),
+		}))
+
+		f, err := font.ParsePSF(name, data)
+		if err != nil {
+			kfmt.Printf("[hal] unable to load font module %s: %s\n", name, err.Message)
+			return true
+		}
+
+		font.Register(f)
+		kfmt.Printf("[hal] loaded font %s (%dx%d)\n", name, f.GlyphWidth, f.GlyphHeight)
+		return true
+	})
+}
@@ -0,0 +1,81 @@
+// Package initcall allows kernel subsystems to register their initialization
+// functions so that they are invoked at a particular stage of the boot process
+// without having to edit the sequence of calls in the kmain package.
+//
+// Subsystems register their initializers from a package init function, much
+// like drivers register themselves with the device package. The kmain package
+// then invokes Run for each level once the kernel reaches the matching boot
+// stage. A package that registers initializers only needs to be linked into
+// the kernel image, e.g. via a blank import.
+package initcall
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+)
+
+// Level specifies the boot stage at which an initializer is invoked.
+type Level uint8
+
+const (
+	// LevelEarly initializers are invoked once the memory allocators and
+	// the Go runtime are available and the boot command line has been
+	// parsed but before the scheduler is initialized.
+	LevelEarly Level = iota
+
+	// LevelSubsys initializers are invoked after the scheduler and the
+	// core kernel subsystems have been initialized but before probing for
+	// hardware.
+	LevelSubsys
+
+	// LevelLate initializers are invoked after the hardware has been
+	// detected.
+	LevelLate
+
+	numLevels
+)
+
+// Func is an initializer registered via Register.
+type Func func() *kernel.Error
+
+var (
+	errInvalidLevel = &kernel.Error{Module: "initcall", Message: "invalid initcall level"}
+
+	// entries contains the initializers registered for each level.
+	entries [numLevels][]Func
+
+	// printErrorFn is used by tests to mock calls to kfmt.PrintError.
+	printErrorFn = kfmt.PrintError
+)
+
+// Register arranges for fn to be invoked when the kernel reaches the
+// specified boot stage. Initializers for the same level are invoked in the
+// order they were registered; as the order in which package init functions
+// run is only defined for packages that import each other, initializers that
+// depend on each other should be registered for different levels.
+//
+// Register is meant to be invoked from package init functions and panics if
+// an invalid level is specified.
+func Register(level Level, fn Func) {
+	if level >= numLevels {
+		panic(errInvalidLevel)
+	}
+
+	entries[level] = append(entries[level], fn)
+}
+
+// Run invokes the initializers registered for the specified level. Errors
+// returned by initializers are reported but do not prevent the remaining
+// initializers from running; subsystems whose failure should halt the boot
+// process need to be initialized explicitly by the kmain package.
+func Run(level Level) {
+	if level >= numLevels {
+		return
+	}
+
+	for _, fn := range entries[level] {
+		if err := fn(); err != nil {
+			printErrorFn(err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package initcall
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"testing"
+)
+
+func restoreMocks() {
+	entries = [numLevels][]Func{}
+	printErrorFn = kfmt.PrintError
+}
+
+func TestRun(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		calls    []string
+		reported []*kernel.Error
+		errFail  = &kernel.Error{Module: "test", Message: "init failed"}
+	)
+
+	printErrorFn = func(err *kernel.Error) { reported = append(reported, err) }
+
+	Register(LevelLate, func() *kernel.Error { calls = append(calls, "late"); return nil })
+	Register(LevelEarly, func() *kernel.Error { calls = append(calls, "early-1"); return errFail })
+	Register(LevelEarly, func() *kernel.Error { calls = append(calls, "early-2"); return nil })
+
+	specs := []struct {
+		level       Level
+		expCalls    []string
+		expReported int
+	}{
+		{LevelEarly, []string{"early-1", "early-2"}, 1},
+		{LevelSubsys, nil, 0},
+		{LevelLate, []string{"late"}, 0},
+		{numLevels, nil, 0},
+	}
+
+	for specIndex, spec := range specs {
+		calls, reported = nil, nil
+		Run(spec.level)
+
+		if len(calls) != len(spec.expCalls) {
+			t.Errorf("[spec %d] expected calls %v; got %v", specIndex, spec.expCalls, calls)
+			continue
+		}
+
+		for i, exp := range spec.expCalls {
+			if calls[i] != exp {
+				t.Errorf("[spec %d] expected calls %v; got %v", specIndex, spec.expCalls, calls)
+				break
+			}
+		}
+
+		if len(reported) != spec.expReported {
+			t.Errorf("[spec %d] expected %d errors to be reported; got %d", specIndex, spec.expReported, len(reported))
+		} else if len(reported) != 0 && reported[0] != errFail {
+			t.Errorf("[spec %d] expected error %v to be reported; got %v", specIndex, errFail, reported[0])
+		}
+	}
+}
+
+func TestRegisterInvalidLevel(t *testing.T) {
+	defer restoreMocks()
+	defer func() {
+		if err := recover(); err != errInvalidLevel {
+			t.Fatalf("expected Register to panic with %v; got %v", errInvalidLevel, err)
+		}
+	}()
+
+	Register(numLevels, func() *kernel.Error { return nil })
+}
@@ -0,0 +1,90 @@
+// Package initrd provides access to the initial ramdisk image that was loaded
+// as a boot module by the bootloader.
+package initrd
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/multiboot"
+	"reflect"
+	"unsafe"
+)
+
+// moduleName is the name (first word of the module command line) that
+// identifies the initrd module when more than one boot module is loaded.
+const moduleName = "initrd"
+
+var (
+	// The following functions are used by tests to mock calls to the
+	// multiboot and vmm packages.
+	visitModulesFn = multiboot.VisitModules
+	mapRegionFn    = vmm.MapRegion
+
+	// data points to the mapped initrd contents.
+	data []byte
+
+	errNoInitrd    = &kernel.Error{Module: "initrd", Message: "no initrd module was loaded by the bootloader"}
+	errEmptyInitrd = &kernel.Error{Module: "initrd", Message: "initrd module is empty"}
+)
+
+// Init locates the initrd boot module and maps its contents read-only into
+// the kernel address space. If several modules are loaded, Init selects the
+// one named "initrd"; otherwise the first module is used.
+func Init() *kernel.Error {
+	var (
+		mod   multiboot.Module
+		found bool
+	)
+
+	visitModulesFn(func(m *multiboot.Module) bool {
+		if !found || commandName(m.Name) == moduleName {
+			mod, found = *m, true
+		}
+		return commandName(m.Name) != moduleName
+	})
+
+	if !found {
+		return errNoInitrd
+	}
+
+	if mod.PhysEnd <= mod.PhysStart {
+		return errEmptyInitrd
+	}
+
+	size := mod.PhysEnd - mod.PhysStart
+	page, err := mapRegionFn(
+		mm.FrameFromAddress(mod.PhysStart),
+		size+vmm.PageOffset(mod.PhysStart),
+		vmm.FlagPresent|vmm.FlagNoExecute,
+	)
+	if err != nil {
+		return err
+	}
+
+	data = *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Data: page.Address() + vmm.PageOffset(mod.PhysStart),
+		Len:  int(size),
+		Cap:  int(size),
+	}))
+
+	return nil
+}
+
+// Bytes returns the contents of the initrd image or nil if no initrd has been
+// loaded. The returned slice points to read-only memory and must not be
+// modified.
+func Bytes() []byte {
+	return data
+}
+
+// commandName returns the first space-delimited word of a module command line.
+func commandName(cmdLine string) string {
+	for i := 0; i < len(cmdLine); i++ {
+		if cmdLine[i] == ' ' {
+			return cmdLine[:i]
+		}
+	}
+
+	return cmdLine
+}
@@ -0,0 +1,114 @@
+package initrd
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/multiboot"
+	"testing"
+	"unsafe"
+)
+
+// fakeMem emulates the virtual memory region where the initrd gets mapped. It
+// is allocated statically as the goroutine stack may move during the test.
+var fakeMem [3 * mm.PageSize]byte
+
+func restoreMocks() {
+	visitModulesFn = multiboot.VisitModules
+	mapRegionFn = vmm.MapRegion
+	data = nil
+}
+
+func mockModules(modules []multiboot.Module) {
+	visitModulesFn = func(visitor multiboot.ModuleVisitor) {
+		for i := range modules {
+			if !visitor(&modules[i]) {
+				return
+			}
+		}
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		contents    = []byte("initrd contents")
+		pageAddr    = (uintptr(unsafe.Pointer(&fakeMem[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+		physStart   = uintptr(0x200123)
+		mappedFrame mm.Frame
+		mappedSize  uintptr
+		mappedFlags vmm.PageTableEntryFlag
+	)
+	copy(fakeMem[pageAddr-uintptr(unsafe.Pointer(&fakeMem[0]))+0x123:], contents)
+
+	mapRegionFn = func(frame mm.Frame, size uintptr, flags vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		mappedFrame, mappedSize, mappedFlags = frame, size, flags
+		return mm.PageFromAddress(pageAddr), nil
+	}
+
+	specs := []struct {
+		modules []multiboot.Module
+	}{
+		{[]multiboot.Module{
+			{PhysStart: physStart, PhysEnd: physStart + uintptr(len(contents)), Name: "ramdisk.tar"},
+		}},
+		{[]multiboot.Module{
+			{PhysStart: 0x300000, PhysEnd: 0x301000, Name: "other"},
+			{PhysStart: physStart, PhysEnd: physStart + uintptr(len(contents)), Name: "initrd --ro"},
+			{PhysStart: 0x400000, PhysEnd: 0x401000, Name: "initrd"},
+		}},
+	}
+
+	for specIndex, spec := range specs {
+		data = nil
+		mockModules(spec.modules)
+
+		if err := Init(); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if mappedFrame != mm.Frame(0x200) || mappedSize != 0x123+uintptr(len(contents)) {
+			t.Errorf("[spec %d] expected Init to map frame 0x200 with size %d; got frame 0x%x with size %d", specIndex, 0x123+len(contents), mappedFrame, mappedSize)
+		}
+
+		if mappedFlags&vmm.FlagRW != 0 {
+			t.Errorf("[spec %d] expected initrd to be mapped read-only", specIndex)
+		}
+
+		if got := Bytes(); !bytes.Equal(got, contents) {
+			t.Errorf("[spec %d] expected initrd contents to be %q; got %q", specIndex, contents, got)
+		}
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	defer restoreMocks()
+
+	expErr := &kernel.Error{Module: "test", Message: "map failed"}
+	mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		return 0, expErr
+	}
+
+	specs := []struct {
+		modules []multiboot.Module
+		expErr  *kernel.Error
+	}{
+		{nil, errNoInitrd},
+		{[]multiboot.Module{{PhysStart: 0x1000, PhysEnd: 0x1000, Name: "initrd"}}, errEmptyInitrd},
+		{[]multiboot.Module{{PhysStart: 0x1000, PhysEnd: 0x2000, Name: "initrd"}}, expErr},
+	}
+
+	for specIndex, spec := range specs {
+		mockModules(spec.modules)
+		if err := Init(); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+
+		if Bytes() != nil {
+			t.Errorf("[spec %d] expected Bytes to return nil", specIndex)
+		}
+	}
+}
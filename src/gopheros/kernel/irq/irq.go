@@ -0,0 +1,573 @@
+// Package irq provides an API that allows drivers to register handlers for
+// hardware interrupts without having to interface with the installed
+// interrupt controller.
+package irq
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/trace"
+)
+
+const (
+	// BaseVector is the first interrupt vector that can be used for
+	// hardware interrupts. Vectors below this value are reserved for CPU
+	// exceptions.
+	BaseVector = gate.InterruptNumber(32)
+
+	// LastGSIVector is the last vector that is used for routing global
+	// system interrupts (GSIs).
+	LastGSIVector = gate.InterruptNumber(0x7f)
+
+	// FirstDynamicVector and LastDynamicVector define the range of vectors
+	// that can be allocated via AllocVector (e.g. for message-signaled
+	// interrupts). Vectors above LastDynamicVector are reserved for system
+	// use (e.g. local APIC timer, IPIs and spurious interrupts).
+	FirstDynamicVector = LastGSIVector + 1
+	LastDynamicVector  = gate.InterruptNumber(0xef)
+
+	// MaxGSI is the largest GSI number that can be passed to RegisterIRQ.
+	MaxGSI = uint32(LastGSIVector - BaseVector)
+
+	// NumISAIRQs is the number of legacy ISA IRQ lines.
+	NumISAIRQs = 16
+
+	numVectors = 256
+	noGSI      = -1
+)
+
+// TriggerMode describes whether an interrupt line is edge- or level-triggered.
+type TriggerMode uint8
+
+// The supported trigger modes.
+const (
+	TriggerEdge TriggerMode = iota
+	TriggerLevel
+)
+
+// Polarity describes the signal level that indicates an active interrupt.
+type Polarity uint8
+
+// The supported interrupt polarities.
+const (
+	PolarityActiveHigh Polarity = iota
+	PolarityActiveLow
+)
+
+var (
+	errInvalidVector = &kernel.Error{Module: "irq", Message: "vector is reserved for CPU exceptions"}
+	errInvalidGSI    = &kernel.Error{Module: "irq", Message: "GSI number is out of range"}
+	errNoController  = &kernel.Error{Module: "irq", Message: "no interrupt controller installed"}
+	errNilHandler    = &kernel.Error{Module: "irq", Message: "handler must not be nil"}
+	errNoTriggerMode = &kernel.Error{Module: "irq", Message: "interrupt controller does not support configuring trigger modes"}
+	errNoNMIRouting  = &kernel.Error{Module: "irq", Message: "interrupt controller does not support NMI delivery"}
+	errNoFreeVectors = &kernel.Error{Module: "irq", Message: "no free interrupt vectors available"}
+
+	// handleInterruptFn is used by tests.
+	handleInterruptFn = gate.HandleInterrupt
+
+	// clockFn returns the current time in nanoseconds. Until SetClock is
+	// invoked, all handler latencies are reported as zero.
+	clockFn = func() uint64 { return 0 }
+
+	mutex           sync.Spinlock
+	controller      Controller
+	localController LocalController
+	vectors         [numVectors]vectorEntry
+
+	// isaToGSI maps legacy ISA IRQs to GSIs. By default, each ISA IRQ is
+	// identity-mapped to a GSI but interrupt controller drivers may
+	// override this mapping (e.g. using the ACPI MADT contents).
+	isaToGSI = [NumISAIRQs]uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+)
+
+// Handler is a function that is invoked when an interrupt occurs. As multiple
+// devices may share the same interrupt line, handlers must check whether the
+// device they manage actually raised the interrupt and return true if they
+// serviced it or false otherwise.
+type Handler func(regs *gate.Registers) bool
+
+// Controller is implemented by interrupt controller drivers (e.g. the PIC or
+// the IO-APIC) that are responsible for delivering GSIs to the CPU.
+type Controller interface {
+	// Route configures the controller so that the specified GSI is
+	// delivered to the CPU using the supplied vector.
+	Route(gsi uint32, vector gate.InterruptNumber) *kernel.Error
+
+	// Mask prevents the controller from delivering the specified GSI.
+	Mask(gsi uint32)
+
+	// Unmask allows the controller to deliver the specified GSI.
+	Unmask(gsi uint32)
+
+	// EOI signals the end of processing for the specified vector.
+	EOI(vector gate.InterruptNumber)
+}
+
+// LocalController is implemented by CPU-local interrupt controllers (e.g. the
+// local APIC) that acknowledge the interrupts which are not delivered via a GSI
+// such as MSIs, IPIs and local timer interrupts.
+type LocalController interface {
+	// EOI signals the end of processing for the specified vector.
+	EOI(vector gate.InterruptNumber)
+}
+
+// TriggerModeSetter is implemented by interrupt controllers that allow the
+// trigger mode and polarity of a GSI to be configured.
+type TriggerModeSetter interface {
+	// SetTriggerMode sets the trigger mode and polarity for a GSI. The
+	// new settings take effect the next time the GSI is routed.
+	SetTriggerMode(gsi uint32, trigger TriggerMode, polarity Polarity) *kernel.Error
+}
+
+// NMIRouter is implemented by interrupt controllers that can deliver a GSI to
+// the CPU as a non-maskable interrupt.
+type NMIRouter interface {
+	// RouteNMI configures the controller so that the specified GSI is
+	// delivered as an NMI. The GSI remains masked until Unmask is invoked.
+	RouteNMI(gsi uint32) *kernel.Error
+}
+
+// handlerEntry wraps a registered Handler and keeps track of its statistics.
+type handlerEntry struct {
+	fn Handler
+
+	// handled counts the number of interrupts serviced by this handler.
+	handled uint64
+
+	// maxLatency is the longest time in nanoseconds between the start of
+	// the dispatch of an interrupt and this handler returning after
+	// servicing it.
+	maxLatency uint64
+}
+
+// vectorEntry tracks the handlers attached to a particular vector.
+type vectorEntry struct {
+	// gsi is set to the GSI routed to this vector or to noGSI if the
+	// vector is not connected to an interrupt line.
+	gsi int32
+
+	// installed is set to true once the vector has been linked to the
+	// dispatcher via the gate package.
+	installed bool
+
+	// allocated is set to true for dynamic vectors that have been
+	// reserved via a call to AllocVector.
+	allocated bool
+
+	// spuriousOnly is set to true for vectors that are used by the
+	// interrupt controller for signaling spurious interrupts.
+	spuriousOnly bool
+
+	// handlers is replaced (never modified in place) each time a new
+	// handler is registered so that dispatch can safely iterate it.
+	handlers []*handlerEntry
+
+	// count is the number of interrupts raised for this vector.
+	count uint64
+
+	// unhandled counts the interrupts that were not claimed by any of
+	// the registered handlers.
+	unhandled uint64
+
+	// spurious counts the interrupts that the interrupt controller
+	// reported as spurious.
+	spurious uint64
+
+	// maxLatency is the longest time in nanoseconds spent invoking the
+	// handlers for a single interrupt.
+	maxLatency uint64
+}
+
+// Stats contains the statistics for a registered interrupt handler.
+type Stats struct {
+	// Vector is the interrupt vector the handler is attached to.
+	Vector gate.InterruptNumber
+
+	// GSI is the global system interrupt routed to Vector or -1 if the
+	// vector is not connected to an interrupt line.
+	GSI int32
+
+	// Index is the position of the handler in the list of handlers that
+	// share Vector.
+	Index int
+
+	// Handled is the number of interrupts serviced by the handler.
+	Handled uint64
+
+	// MaxLatency is the longest time in nanoseconds between the start of
+	// the dispatch of an interrupt and the handler returning after
+	// servicing it. It includes the time spent in the handlers that
+	// precede the handler on a shared vector.
+	MaxLatency uint64
+}
+
+// VectorStats contains the statistics for an interrupt vector.
+type VectorStats struct {
+	// Vector is the interrupt vector.
+	Vector gate.InterruptNumber
+
+	// GSI is the global system interrupt routed to Vector or -1 if the
+	// vector is not connected to an interrupt line.
+	GSI int32
+
+	// Handlers is the number of handlers attached to Vector.
+	Handlers int
+
+	// Count is the number of interrupts raised for Vector.
+	Count uint64
+
+	// Unhandled is the number of interrupts that were not claimed by any
+	// handler.
+	Unhandled uint64
+
+	// Spurious is the number of interrupts that the interrupt controller
+	// reported as spurious.
+	Spurious uint64
+
+	// MaxLatency is the longest time in nanoseconds spent invoking the
+	// handlers for a single interrupt.
+	MaxLatency uint64
+}
+
+// SetClock registers the function used for measuring handler latencies. It
+// returns the elapsed time in nanoseconds and must be safe to call from
+// interrupt context.
+func SetClock(fn func() uint64) {
+	clockFn = fn
+}
+
+// SetLocalController installs the CPU-local interrupt controller that is used
+// for acknowledging interrupts with vectors above LastGSIVector. Interrupts
+// with such vectors are acknowledged by the controller installed via
+// SetController if no local controller is installed.
+func SetLocalController(ctrl LocalController) {
+	localController = ctrl
+}
+
+// SetController installs the interrupt controller that is used for routing,
+// masking and acknowledging hardware interrupts.
+func SetController(ctrl Controller) {
+	mutex.Acquire()
+	controller = ctrl
+	mutex.Release()
+}
+
+// ActiveController returns the currently installed interrupt controller or nil
+// if no controller has been installed.
+func ActiveController() Controller {
+	return controller
+}
+
+// RegisterHandler attaches fn to the specified interrupt vector. Multiple
+// handlers may be attached to the same vector; when an interrupt occurs, each
+// one of them is invoked in registration order.
+func RegisterHandler(vector gate.InterruptNumber, fn Handler) *kernel.Error {
+	mutex.Acquire()
+	defer mutex.Release()
+
+	return registerHandler(vector, noGSI, fn)
+}
+
+// RegisterIRQ attaches fn to the vector that is used for delivering the
+// specified GSI. Registering the first handler for a GSI causes the GSI to be
+// routed by the active interrupt controller and then unmasked. If the GSI
+// cannot be routed, fn is not registered.
+func RegisterIRQ(gsi uint32, fn Handler) *kernel.Error {
+	if gsi > MaxGSI {
+		return errInvalidGSI
+	}
+
+	if fn == nil {
+		return errNilHandler
+	}
+
+	mutex.Acquire()
+	defer mutex.Release()
+
+	if controller == nil {
+		return errNoController
+	}
+
+	var (
+		vector = VectorForGSI(gsi)
+		route  = len(vectors[vector].handlers) == 0
+	)
+
+	if route {
+		if err := controller.Route(gsi, vector); err != nil {
+			return err
+		}
+	}
+
+	if err := registerHandler(vector, int32(gsi), fn); err != nil {
+		return err
+	}
+
+	if route {
+		controller.Unmask(gsi)
+	}
+
+	return nil
+}
+
+// RegisterSpuriousVector links vector to the dispatcher so that the interrupts
+// raised for it are counted as spurious. It is used by interrupt controllers
+// that signal spurious interrupts via a dedicated vector (e.g. the local
+// APIC). As such interrupts must not be acknowledged, no EOI is sent for them.
+func RegisterSpuriousVector(vector gate.InterruptNumber) *kernel.Error {
+	if vector < BaseVector {
+		return errInvalidVector
+	}
+
+	mutex.Acquire()
+	defer mutex.Release()
+
+	entry := &vectors[vector]
+	entry.gsi = noGSI
+	entry.spuriousOnly = true
+	if !entry.installed {
+		entry.installed = true
+		handleInterruptFn(vector, 0, dispatch)
+	}
+
+	return nil
+}
+
+// ReportSpurious records a spurious interrupt for vector. It is invoked by
+// interrupt controllers that detect spurious interrupts while acknowledging
+// them (e.g. the 8259 PIC).
+func ReportSpurious(vector gate.InterruptNumber) {
+	vectors[vector].spurious++
+}
+
+// AllocVector reserves an unused vector from the dynamic vector range. Drivers
+// can attach handlers to the returned vector via RegisterHandler.
+func AllocVector() (gate.InterruptNumber, *kernel.Error) {
+	mutex.Acquire()
+	defer mutex.Release()
+
+	for vector := FirstDynamicVector; vector <= LastDynamicVector; vector++ {
+		if entry := &vectors[vector]; !entry.allocated && len(entry.handlers) == 0 {
+			entry.allocated = true
+			return vector, nil
+		}
+	}
+
+	return 0, errNoFreeVectors
+}
+
+// FreeVector releases a vector obtained via AllocVector and detaches any
+// handlers registered for it. The gate entry for the vector remains linked
+// to the dispatcher so it can be reused by subsequent allocations.
+func FreeVector(vector gate.InterruptNumber) {
+	if vector < FirstDynamicVector || vector > LastDynamicVector {
+		return
+	}
+
+	mutex.Acquire()
+	vectors[vector].allocated = false
+	vectors[vector].handlers = nil
+	vectors[vector].count = 0
+	vectors[vector].unhandled = 0
+	vectors[vector].spurious = 0
+	vectors[vector].maxLatency = 0
+	mutex.Release()
+}
+
+// Mask instructs the active interrupt controller to stop delivering the
+// specified GSI.
+func Mask(gsi uint32) {
+	if ctrl := controller; ctrl != nil {
+		ctrl.Mask(gsi)
+	}
+}
+
+// Unmask instructs the active interrupt controller to resume delivery of the
+// specified GSI.
+func Unmask(gsi uint32) {
+	if ctrl := controller; ctrl != nil {
+		ctrl.Unmask(gsi)
+	}
+}
+
+// SetTriggerMode configures the trigger mode and polarity of a GSI. It must be
+// invoked before the first handler for the GSI is registered. An error is
+// returned if the active interrupt controller does not support this feature.
+func SetTriggerMode(gsi uint32, trigger TriggerMode, polarity Polarity) *kernel.Error {
+	if gsi > MaxGSI {
+		return errInvalidGSI
+	}
+
+	setter, ok := controller.(TriggerModeSetter)
+	if !ok {
+		return errNoTriggerMode
+	}
+
+	return setter.SetTriggerMode(gsi, trigger, polarity)
+}
+
+// RouteNMI configures the active interrupt controller to deliver the specified
+// GSI as an NMI. NMIs are handled via the gate package rather than the handlers
+// registered with this package. An error is returned if the active interrupt
+// controller does not support this feature.
+func RouteNMI(gsi uint32) *kernel.Error {
+	if gsi > MaxGSI {
+		return errInvalidGSI
+	}
+
+	router, ok := controller.(NMIRouter)
+	if !ok {
+		return errNoNMIRouting
+	}
+
+	return router.RouteNMI(gsi)
+}
+
+// MapISAIRQ overrides the GSI that is used for delivering a legacy ISA IRQ.
+func MapISAIRQ(isaIRQ uint8, gsi uint32) {
+	if isaIRQ < NumISAIRQs {
+		isaToGSI[isaIRQ] = gsi
+	}
+}
+
+// ISAIRQToGSI returns the GSI that is used for delivering a legacy ISA IRQ.
+func ISAIRQToGSI(isaIRQ uint8) uint32 {
+	if isaIRQ >= NumISAIRQs {
+		return uint32(isaIRQ)
+	}
+
+	return isaToGSI[isaIRQ]
+}
+
+// VectorForGSI returns the interrupt vector used for delivering a GSI.
+func VectorForGSI(gsi uint32) gate.InterruptNumber {
+	return BaseVector + gate.InterruptNumber(gsi)
+}
+
+// UnhandledCount returns the number of interrupts that were raised for vector
+// but were not claimed by any registered handler.
+func UnhandledCount(vector gate.InterruptNumber) uint64 {
+	return vectors[vector].unhandled
+}
+
+// VisitStats invokes visitor with the statistics for each registered handler.
+// Handlers are visited in ascending vector order.
+func VisitStats(visitor func(*Stats)) {
+	var stats Stats
+	for vecIndex := int(BaseVector); vecIndex < numVectors; vecIndex++ {
+		entry := &vectors[vecIndex]
+		for handlerIndex, handler := range entry.handlers {
+			stats.Vector = gate.InterruptNumber(vecIndex)
+			stats.GSI = entry.gsi
+			stats.Index = handlerIndex
+			stats.Handled = handler.handled
+			stats.MaxLatency = handler.maxLatency
+			visitor(&stats)
+		}
+	}
+}
+
+// VisitVectorStats invokes visitor with the statistics for each vector that
+// has registered handlers, is used for spurious interrupts or has received
+// interrupts. Vectors are visited in ascending order.
+func VisitVectorStats(visitor func(*VectorStats)) {
+	var stats VectorStats
+	for vecIndex := int(BaseVector); vecIndex < numVectors; vecIndex++ {
+		entry := &vectors[vecIndex]
+		if len(entry.handlers) == 0 && !entry.spuriousOnly && entry.count == 0 && entry.spurious == 0 {
+			continue
+		}
+
+		stats.Vector = gate.InterruptNumber(vecIndex)
+		stats.GSI = entry.gsi
+		if len(entry.handlers) == 0 && !entry.spuriousOnly {
+			stats.GSI = noGSI
+		}
+		stats.Handlers = len(entry.handlers)
+		stats.Count = entry.count
+		stats.Unhandled = entry.unhandled
+		stats.Spurious = entry.spurious
+		stats.MaxLatency = entry.maxLatency
+		visitor(&stats)
+	}
+}
+
+// registerHandler appends fn to the handler list for vector and links the
+// vector to the dispatcher if this is the first registered handler. Callers
+// must hold mutex.
+func registerHandler(vector gate.InterruptNumber, gsi int32, fn Handler) *kernel.Error {
+	if vector < BaseVector {
+		return errInvalidVector
+	}
+
+	if fn == nil {
+		return errNilHandler
+	}
+
+	entry := &vectors[vector]
+	if len(entry.handlers) == 0 {
+		entry.gsi = gsi
+	}
+
+	handlers := make([]*handlerEntry, len(entry.handlers), len(entry.handlers)+1)
+	copy(handlers, entry.handlers)
+	entry.handlers = append(handlers, &handlerEntry{fn: fn})
+
+	if !entry.installed {
+		entry.installed = true
+		handleInterruptFn(vector, 0, dispatch)
+	}
+
+	return nil
+}
+
+// dispatch is invoked by the gate package when an interrupt with a vector
+// managed by this package occurs. The gate entrypoint stores the vector number
+// in the Info field of the supplied registers.
+func dispatch(regs *gate.Registers) {
+	var (
+		entry   = &vectors[uint8(regs.Info)]
+		handled bool
+	)
+
+	entry.count++
+	if entry.spuriousOnly {
+		entry.spurious++
+		return
+	}
+
+	trace.Record(trace.EventIRQEntry, regs.Info, 0)
+	start := clockFn()
+	for _, handler := range entry.handlers {
+		if handler.fn(regs) {
+			handler.handled++
+			handled = true
+			if latency := clockFn() - start; latency > handler.maxLatency {
+				handler.maxLatency = latency
+			}
+		}
+	}
+
+	if latency := clockFn() - start; latency > entry.maxLatency {
+		entry.maxLatency = latency
+	}
+
+	if !handled {
+		entry.unhandled++
+	}
+
+	var handledArg uint64
+	if handled {
+		handledArg = 1
+	}
+	trace.Record(trace.EventIRQExit, regs.Info, handledArg)
+
+	vector := gate.InterruptNumber(regs.Info)
+	if local := localController; local != nil && vector > LastGSIVector {
+		local.EOI(vector)
+	} else if ctrl := controller; ctrl != nil {
+		ctrl.EOI(vector)
+	}
+}
@@ -0,0 +1,483 @@
+package irq
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"testing"
+)
+
+type mockController struct {
+	routeErr *kernel.Error
+	routed   map[uint32]gate.InterruptNumber
+	masked   map[uint32]bool
+	eoiCount int
+}
+
+func newMockController() *mockController {
+	return &mockController{
+		routed: make(map[uint32]gate.InterruptNumber),
+		masked: make(map[uint32]bool),
+	}
+}
+
+func (c *mockController) Route(gsi uint32, vector gate.InterruptNumber) *kernel.Error {
+	if c.routeErr != nil {
+		return c.routeErr
+	}
+	c.routed[gsi] = vector
+	c.masked[gsi] = true
+	return nil
+}
+
+func (c *mockController) Mask(gsi uint32)                 { c.masked[gsi] = true }
+func (c *mockController) Unmask(gsi uint32)               { c.masked[gsi] = false }
+func (c *mockController) EOI(vector gate.InterruptNumber) { c.eoiCount++ }
+
+func resetState() {
+	controller = nil
+	localController = nil
+	clockFn = func() uint64 { return 0 }
+	vectors = [numVectors]vectorEntry{}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	defer func() {
+		handleInterruptFn = gate.HandleInterrupt
+		resetState()
+	}()
+	resetState()
+
+	var installCount int
+	handleInterruptFn = func(_ gate.InterruptNumber, _ uint8, _ func(*gate.Registers)) {
+		installCount++
+	}
+
+	noopHandler := func(_ *gate.Registers) bool { return true }
+
+	if err := RegisterHandler(BaseVector-1, noopHandler); err != errInvalidVector {
+		t.Fatalf("expected to get errInvalidVector; got %v", err)
+	}
+
+	if err := RegisterHandler(BaseVector, nil); err != errNilHandler {
+		t.Fatalf("expected to get errNilHandler; got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := RegisterHandler(BaseVector, noopHandler); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := len(vectors[BaseVector].handlers); got != 3 {
+		t.Fatalf("expected 3 handlers to be registered; got %d", got)
+	}
+
+	if installCount != 1 {
+		t.Fatalf("expected gate handler to be installed once; got %d", installCount)
+	}
+
+	if got := vectors[BaseVector].gsi; got != noGSI {
+		t.Fatalf("expected vector GSI to be %d; got %d", noGSI, got)
+	}
+}
+
+func TestRegisterIRQ(t *testing.T) {
+	defer func() {
+		handleInterruptFn = gate.HandleInterrupt
+		resetState()
+	}()
+	resetState()
+
+	handleInterruptFn = func(_ gate.InterruptNumber, _ uint8, _ func(*gate.Registers)) {}
+	noopHandler := func(_ *gate.Registers) bool { return true }
+
+	t.Run("no controller", func(t *testing.T) {
+		if err := RegisterIRQ(1, noopHandler); err != errNoController {
+			t.Fatalf("expected to get errNoController; got %v", err)
+		}
+	})
+
+	t.Run("invalid GSI", func(t *testing.T) {
+		if err := RegisterIRQ(MaxGSI+1, noopHandler); err != errInvalidGSI {
+			t.Fatalf("expected to get errInvalidGSI; got %v", err)
+		}
+	})
+
+	t.Run("route error", func(t *testing.T) {
+		defer resetState()
+		ctrl := newMockController()
+		ctrl.routeErr = &kernel.Error{Module: "test", Message: "route failed"}
+		SetController(ctrl)
+
+		if err := RegisterIRQ(4, noopHandler); err != ctrl.routeErr {
+			t.Fatalf("expected to get route error; got %v", err)
+		}
+
+		if got := len(vectors[VectorForGSI(4)].handlers); got != 0 {
+			t.Fatalf("expected handler not to be registered when routing fails; got %d handlers", got)
+		}
+
+		// A subsequent registration must retry routing the GSI
+		ctrl.routeErr = nil
+		if err := RegisterIRQ(4, noopHandler); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp, got := VectorForGSI(4), ctrl.routed[4]; got != exp {
+			t.Fatalf("expected GSI 4 to be routed to vector %d; got %d", exp, got)
+		}
+
+		if ctrl.masked[4] {
+			t.Fatal("expected GSI 4 to be unmasked")
+		}
+	})
+
+	t.Run("nil handler", func(t *testing.T) {
+		defer resetState()
+		ctrl := newMockController()
+		SetController(ctrl)
+
+		if err := RegisterIRQ(4, nil); err != errNilHandler {
+			t.Fatalf("expected to get errNilHandler; got %v", err)
+		}
+
+		if _, routed := ctrl.routed[4]; routed {
+			t.Fatal("expected GSI 4 not to be routed for a nil handler")
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		defer resetState()
+		ctrl := newMockController()
+		SetController(ctrl)
+
+		if ActiveController() != ctrl {
+			t.Fatal("expected ActiveController to return the installed controller")
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := RegisterIRQ(4, noopHandler); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if exp, got := VectorForGSI(4), ctrl.routed[4]; got != exp {
+			t.Fatalf("expected GSI 4 to be routed to vector %d; got %d", exp, got)
+		}
+
+		if ctrl.masked[4] {
+			t.Fatal("expected GSI 4 to be unmasked")
+		}
+
+		Mask(4)
+		if !ctrl.masked[4] {
+			t.Fatal("expected GSI 4 to be masked")
+		}
+
+		Unmask(4)
+		if ctrl.masked[4] {
+			t.Fatal("expected GSI 4 to be unmasked")
+		}
+
+		if got := vectors[VectorForGSI(4)].gsi; got != 4 {
+			t.Fatalf("expected vector GSI to be 4; got %d", got)
+		}
+	})
+}
+
+func TestDispatch(t *testing.T) {
+	defer func() {
+		handleInterruptFn = gate.HandleInterrupt
+		resetState()
+	}()
+	resetState()
+
+	handleInterruptFn = func(_ gate.InterruptNumber, _ uint8, _ func(*gate.Registers)) {}
+	ctrl := newMockController()
+	SetController(ctrl)
+
+	var (
+		claimFirst     bool
+		firstInvoked   int
+		secondInvoked  int
+		firstHandler   = func(_ *gate.Registers) bool { firstInvoked++; return claimFirst }
+		secondHandler  = func(_ *gate.Registers) bool { secondInvoked++; return false }
+		vector         = VectorForGSI(1)
+		regs           = &gate.Registers{Info: uint64(vector)}
+		expHandled     = []uint64{1, 0}
+		handledByIndex []uint64
+	)
+
+	if err := RegisterIRQ(1, firstHandler); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterIRQ(1, secondHandler); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not claimed by any handler
+	dispatch(regs)
+
+	// Claimed by first handler
+	claimFirst = true
+	dispatch(regs)
+
+	if firstInvoked != 2 || secondInvoked != 2 {
+		t.Fatalf("expected each shared handler to be invoked twice; got %d, %d", firstInvoked, secondInvoked)
+	}
+
+	if got := UnhandledCount(vector); got != 1 {
+		t.Fatalf("expected unhandled count to be 1; got %d", got)
+	}
+
+	if ctrl.eoiCount != 2 {
+		t.Fatalf("expected EOI to be sent twice; got %d", ctrl.eoiCount)
+	}
+
+	VisitStats(func(s *Stats) {
+		if s.Vector != vector || s.GSI != 1 {
+			t.Errorf("unexpected stats entry for vector %d, GSI %d", s.Vector, s.GSI)
+		}
+		if s.Index != len(handledByIndex) {
+			t.Errorf("expected handler index to be %d; got %d", len(handledByIndex), s.Index)
+		}
+		handledByIndex = append(handledByIndex, s.Handled)
+	})
+
+	if len(handledByIndex) != len(expHandled) {
+		t.Fatalf("expected to visit %d stat entries; got %d", len(expHandled), len(handledByIndex))
+	}
+
+	for i, exp := range expHandled {
+		if got := handledByIndex[i]; got != exp {
+			t.Errorf("[handler %d] expected handled count to be %d; got %d", i, exp, got)
+		}
+	}
+}
+
+func TestDispatchLocalEOI(t *testing.T) {
+	defer func() {
+		handleInterruptFn = gate.HandleInterrupt
+		resetState()
+	}()
+	resetState()
+
+	handleInterruptFn = func(_ gate.InterruptNumber, _ uint8, _ func(*gate.Registers)) {}
+	noopHandler := func(_ *gate.Registers) bool { return true }
+
+	var (
+		ctrl  = newMockController()
+		local = newMockController()
+	)
+	SetController(ctrl)
+
+	if err := RegisterHandler(FirstDynamicVector, noopHandler); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterIRQ(1, noopHandler); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a local controller, all EOIs go to the GSI controller
+	dispatch(&gate.Registers{Info: uint64(FirstDynamicVector)})
+	if ctrl.eoiCount != 1 {
+		t.Fatalf("expected the GSI controller to send 1 EOI; got %d", ctrl.eoiCount)
+	}
+
+	SetLocalController(local)
+	dispatch(&gate.Registers{Info: uint64(FirstDynamicVector)})
+	dispatch(&gate.Registers{Info: uint64(VectorForGSI(1))})
+
+	if local.eoiCount != 1 || ctrl.eoiCount != 2 {
+		t.Fatalf("expected the local and GSI controllers to send 1 and 2 EOIs; got %d and %d", local.eoiCount, ctrl.eoiCount)
+	}
+}
+
+func TestDispatchStats(t *testing.T) {
+	defer func() {
+		handleInterruptFn = gate.HandleInterrupt
+		resetState()
+	}()
+	resetState()
+
+	handleInterruptFn = func(_ gate.InterruptNumber, _ uint8, _ func(*gate.Registers)) {}
+	ctrl := newMockController()
+	SetController(ctrl)
+
+	// Each clock read advances the time by 10ns
+	var now uint64
+	SetClock(func() uint64 { now += 10; return now })
+
+	var (
+		vector      = VectorForGSI(1)
+		regs        = &gate.Registers{Info: uint64(vector)}
+		noopHandler = func(_ *gate.Registers) bool { return false }
+		claimFirst  = func(_ *gate.Registers) bool { return true }
+	)
+
+	if err := RegisterIRQ(1, claimFirst); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterIRQ(1, noopHandler); err != nil {
+		t.Fatal(err)
+	}
+	dispatch(regs)
+	dispatch(regs)
+
+	var gotLatency []uint64
+	VisitStats(func(s *Stats) { gotLatency = append(gotLatency, s.MaxLatency) })
+	if len(gotLatency) != 2 || gotLatency[0] != 10 || gotLatency[1] != 0 {
+		t.Fatalf("expected handler latencies to be [10 0]; got %v", gotLatency)
+	}
+
+	if err := RegisterSpuriousVector(BaseVector - 1); err != errInvalidVector {
+		t.Fatalf("expected to get errInvalidVector; got %v", err)
+	}
+
+	spuriousVector := gate.InterruptNumber(0xff)
+	if err := RegisterSpuriousVector(spuriousVector); err != nil {
+		t.Fatal(err)
+	}
+	dispatch(&gate.Registers{Info: uint64(spuriousVector)})
+
+	if ctrl.eoiCount != 2 {
+		t.Fatalf("expected EOI not to be sent for spurious interrupts; got %d EOIs", ctrl.eoiCount)
+	}
+
+	// Spurious interrupt reported by the controller for an unused vector
+	ReportSpurious(VectorForGSI(7))
+
+	expStats := []VectorStats{
+		{Vector: vector, GSI: 1, Handlers: 2, Count: 2, MaxLatency: 20},
+		{Vector: VectorForGSI(7), GSI: noGSI, Spurious: 1},
+		{Vector: spuriousVector, GSI: noGSI, Count: 1, Spurious: 1},
+	}
+
+	var gotStats []VectorStats
+	VisitVectorStats(func(s *VectorStats) { gotStats = append(gotStats, *s) })
+
+	if len(gotStats) != len(expStats) {
+		t.Fatalf("expected to visit %d vector stat entries; got %d", len(expStats), len(gotStats))
+	}
+
+	for i, exp := range expStats {
+		if gotStats[i] != exp {
+			t.Errorf("[entry %d] expected vector stats to be %+v; got %+v", i, exp, gotStats[i])
+		}
+	}
+}
+
+type mockTriggerController struct {
+	*mockController
+	trigger  TriggerMode
+	polarity Polarity
+}
+
+func (c *mockTriggerController) SetTriggerMode(_ uint32, trigger TriggerMode, polarity Polarity) *kernel.Error {
+	c.trigger, c.polarity = trigger, polarity
+	return nil
+}
+
+func TestSetTriggerMode(t *testing.T) {
+	defer resetState()
+	resetState()
+
+	if err := SetTriggerMode(MaxGSI+1, TriggerLevel, PolarityActiveLow); err != errInvalidGSI {
+		t.Fatalf("expected to get errInvalidGSI; got %v", err)
+	}
+
+	SetController(newMockController())
+	if err := SetTriggerMode(10, TriggerLevel, PolarityActiveLow); err != errNoTriggerMode {
+		t.Fatalf("expected to get errNoTriggerMode; got %v", err)
+	}
+
+	ctrl := &mockTriggerController{mockController: newMockController()}
+	SetController(ctrl)
+	if err := SetTriggerMode(10, TriggerLevel, PolarityActiveLow); err != nil {
+		t.Fatal(err)
+	}
+
+	if ctrl.trigger != TriggerLevel || ctrl.polarity != PolarityActiveLow {
+		t.Fatalf("expected trigger mode settings to be forwarded to the controller")
+	}
+}
+
+type mockNMIController struct {
+	*mockController
+	nmiGSIs []uint32
+}
+
+func (c *mockNMIController) RouteNMI(gsi uint32) *kernel.Error {
+	c.nmiGSIs = append(c.nmiGSIs, gsi)
+	return nil
+}
+
+func TestRouteNMI(t *testing.T) {
+	defer resetState()
+	resetState()
+
+	if err := RouteNMI(MaxGSI + 1); err != errInvalidGSI {
+		t.Fatalf("expected to get errInvalidGSI; got %v", err)
+	}
+
+	SetController(newMockController())
+	if err := RouteNMI(2); err != errNoNMIRouting {
+		t.Fatalf("expected to get errNoNMIRouting; got %v", err)
+	}
+
+	ctrl := &mockNMIController{mockController: newMockController()}
+	SetController(ctrl)
+	if err := RouteNMI(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ctrl.nmiGSIs) != 1 || ctrl.nmiGSIs[0] != 2 {
+		t.Fatalf("expected NMI routing request to be forwarded to the controller; got %v", ctrl.nmiGSIs)
+	}
+}
+
+func TestISAIRQMapping(t *testing.T) {
+	defer MapISAIRQ(0, 0)
+
+	if got := ISAIRQToGSI(0); got != 0 {
+		t.Fatalf("expected ISA IRQ 0 to be identity-mapped; got GSI %d", got)
+	}
+
+	MapISAIRQ(0, 2)
+	if got := ISAIRQToGSI(0); got != 2 {
+		t.Fatalf("expected ISA IRQ 0 to be mapped to GSI 2; got GSI %d", got)
+	}
+
+	if got := ISAIRQToGSI(NumISAIRQs + 1); got != NumISAIRQs+1 {
+		t.Fatalf("expected out of range ISA IRQ to be identity-mapped; got GSI %d", got)
+	}
+}
+
+func TestAllocVector(t *testing.T) {
+	defer resetState()
+	resetState()
+
+	numDynamic := int(LastDynamicVector-FirstDynamicVector) + 1
+	for i := 0; i < numDynamic; i++ {
+		vector, err := AllocVector()
+		if err != nil {
+			t.Fatalf("[alloc %d] unexpected error: %v", i, err)
+		}
+
+		if exp := FirstDynamicVector + gate.InterruptNumber(i); vector != exp {
+			t.Fatalf("[alloc %d] expected to get vector %d; got %d", i, exp, vector)
+		}
+	}
+
+	if _, err := AllocVector(); err != errNoFreeVectors {
+		t.Fatalf("expected to get errNoFreeVectors; got %v", err)
+	}
+
+	// Freeing a vector outside the dynamic range should be ignored
+	FreeVector(BaseVector)
+
+	FreeVector(FirstDynamicVector + 2)
+	if vector, err := AllocVector(); err != nil || vector != FirstDynamicVector+2 {
+		t.Fatalf("expected to get vector %d; got %d, %v", FirstDynamicVector+2, vector, err)
+	}
+}
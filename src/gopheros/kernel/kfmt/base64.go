@@ -0,0 +1,100 @@
+package kfmt
+
+import "io"
+
+const (
+	base64Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+	// base64LineLen is the number of encoded characters emitted in each
+	// line of Base64Writer output. It must be a multiple of 4.
+	base64LineLen = 76
+)
+
+// Base64Writer is an io.Writer that encodes the data written to it using the
+// standard base64 encoding (RFC 4648) and forwards the encoded output to an
+// underlying writer split into lines of 76 characters. Close must be invoked
+// after the last write to flush any pending input and pad the output. Like
+// Fprintf, Base64Writer does not allocate any memory.
+type Base64Writer struct {
+	// A writer where the encoded output gets sent to.
+	Sink io.Writer
+
+	// pending holds the input bytes that do not form a complete 3-byte
+	// group yet.
+	pending    [2]byte
+	pendingLen int
+
+	line    [base64LineLen + 1]byte
+	lineLen int
+}
+
+// Write encodes p and returns the number of bytes from p that were consumed.
+// Input bytes that do not form a complete 3-byte group are buffered until the
+// next call to Write or Close.
+func (w *Base64Writer) Write(p []byte) (int, error) {
+	for i, b := range p {
+		if w.pendingLen < len(w.pending) {
+			w.pending[w.pendingLen] = b
+			w.pendingLen++
+			continue
+		}
+
+		w.pendingLen = 0
+		if err := w.encodeGroup(w.pending[0], w.pending[1], b, 3); err != nil {
+			return i, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close encodes any pending input bytes, pads the output to a multiple of 4
+// characters and terminates the last line. The writer can be reused after
+// Close returns.
+func (w *Base64Writer) Close() error {
+	var err error
+	if w.pendingLen != 0 {
+		// Clear the unused input bits so they are encoded as zeros
+		if w.pendingLen == 1 {
+			w.pending[1] = 0
+		}
+
+		err = w.encodeGroup(w.pending[0], w.pending[1], 0, w.pendingLen)
+		w.pendingLen = 0
+	}
+
+	if err == nil && w.lineLen != 0 {
+		err = w.flushLine()
+	}
+
+	return err
+}
+
+// encodeGroup appends the encoding of a group of n (1 to 3) input bytes to the
+// current line. Groups with less than 3 bytes are padded.
+func (w *Base64Writer) encodeGroup(b0, b1, b2 byte, n int) error {
+	group := uint32(b0)<<16 | uint32(b1)<<8 | uint32(b2)
+	for i := 0; i < 4; i++ {
+		c := byte('=')
+		if i <= n {
+			c = base64Alphabet[group>>uint(18-6*i)&0x3f]
+		}
+
+		w.line[w.lineLen] = c
+		w.lineLen++
+	}
+
+	if w.lineLen == base64LineLen {
+		return w.flushLine()
+	}
+
+	return nil
+}
+
+// flushLine writes the current line to the sink followed by a line feed.
+func (w *Base64Writer) flushLine() error {
+	w.line[w.lineLen] = '\n'
+	_, err := w.Sink.Write(w.line[:w.lineLen+1])
+	w.lineLen = 0
+	return err
+}
@@ -0,0 +1,89 @@
+package kfmt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBase64Writer(t *testing.T) {
+	var (
+		buf bytes.Buffer
+		w   = Base64Writer{Sink: &buf}
+	)
+
+	for _, chunkLen := range []int{1, 2, 3, 7, 100} {
+		for dataLen := 0; dataLen <= 120; dataLen++ {
+			data := make([]byte, dataLen)
+			for i := range data {
+				data[i] = byte(i*37 + dataLen)
+			}
+
+			buf.Reset()
+			for offset := 0; offset < len(data); offset += chunkLen {
+				chunk := data[offset:]
+				if len(chunk) > chunkLen {
+					chunk = chunk[:chunkLen]
+				}
+
+				if n, err := w.Write(chunk); n != len(chunk) || err != nil {
+					t.Fatalf("[chunk %d, len %d] expected to write %d bytes; wrote %d (error: %v)", chunkLen, dataLen, len(chunk), n, err)
+				}
+			}
+
+			if err := w.Close(); err != nil {
+				t.Fatalf("[chunk %d, len %d] unexpected error: %v", chunkLen, dataLen, err)
+			}
+
+			var exp strings.Builder
+			for encoded := base64.StdEncoding.EncodeToString(data); len(encoded) != 0; {
+				lineLen := len(encoded)
+				if lineLen > base64LineLen {
+					lineLen = base64LineLen
+				}
+				exp.WriteString(encoded[:lineLen])
+				exp.WriteByte('\n')
+				encoded = encoded[lineLen:]
+			}
+
+			if got := buf.String(); got != exp.String() {
+				t.Fatalf("[chunk %d, len %d] expected output:\n%q\ngot:\n%q", chunkLen, dataLen, exp.String(), got)
+			}
+		}
+	}
+}
+
+func TestBase64WriterErrors(t *testing.T) {
+	var (
+		expErr = errors.New("write failed")
+		w      = Base64Writer{Sink: writerThatAlwaysErrors{expErr}}
+	)
+
+	if n, err := w.Write(make([]byte, 60)); n != 56 || err != expErr {
+		t.Fatalf("expected Write to consume 56 bytes and return error %v; got %d, %v", expErr, n, err)
+	}
+
+	w = Base64Writer{Sink: writerThatAlwaysErrors{expErr}}
+	w.Write([]byte("gopher"))
+	if err := w.Close(); err != expErr {
+		t.Fatalf("expected Close to return error %v; got %v", expErr, err)
+	}
+}
+
+func TestBase64WriterAllocations(t *testing.T) {
+	var (
+		w    = Base64Writer{Sink: discardWriter{}}
+		data = []byte("gopher-os base64 allocation test")
+	)
+
+	allocs := testing.AllocsPerRun(10, func() {
+		w.Write(data)
+		w.Close()
+	})
+
+	if allocs != 0 {
+		t.Fatalf("expected Base64Writer not to allocate memory; got %f allocations per call", allocs)
+	}
+}
@@ -0,0 +1,33 @@
+package kfmt
+
+import "gopheros/kernel"
+
+// PrintError outputs err followed by the chain of errors that caused it. For
+// each error created via kernel.Error.CausedBy, the call chain that raised it
+// is printed as well.
+func PrintError(err *kernel.Error) {
+	if err == nil {
+		return
+	}
+
+	Printf("[%s] %s\n", err.Module, err.Message)
+	printErrorChain(err)
+}
+
+// printErrorChain outputs the trace captured for err followed by the message
+// and trace of each error in its chain of causes.
+func printErrorChain(err *kernel.Error) {
+	printTrace(err.Trace)
+	for cause := err.Cause; cause != nil; cause = cause.Cause {
+		Printf("caused by: [%s] %s\n", cause.Module, cause.Message)
+		printTrace(cause.Trace)
+	}
+}
+
+// printTrace outputs the symbolized return addresses in trace.
+func printTrace(trace []uintptr) {
+	for depth, pc := range trace {
+		Printf("    ")
+		printFrame(depth, pc)
+	}
+}
@@ -0,0 +1,59 @@
+package kfmt
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"testing"
+)
+
+func TestPrintError(t *testing.T) {
+	defer func() {
+		symbolizeFn = symbolize
+		SetOutputSink(nil)
+	}()
+
+	var buf bytes.Buffer
+	SetOutputSink(&buf)
+	symbolizeFn = func(pc uintptr) (string, uintptr) { return "main.fn", pc & 0xff }
+
+	err := &kernel.Error{
+		Module:  "driver",
+		Message: "init failed",
+		Trace:   []uintptr{0x1010},
+		Cause: &kernel.Error{
+			Module:  "acpi",
+			Message: "unable to map table",
+			Trace:   []uintptr{0x2020, 0x3030},
+			Cause:   &kernel.Error{Module: "vmm", Message: "out of memory"},
+		},
+	}
+
+	specs := []struct {
+		err *kernel.Error
+		exp string
+	}{
+		{nil, ""},
+		{
+			&kernel.Error{Module: "test", Message: "plain error"},
+			"[test] plain error\n",
+		},
+		{
+			err,
+			"[driver] init failed\n" +
+				"     0: 0x0000000000001010 main.fn+0x10\n" +
+				"caused by: [acpi] unable to map table\n" +
+				"     0: 0x0000000000002020 main.fn+0x20\n" +
+				"     1: 0x0000000000003030 main.fn+0x30\n" +
+				"caused by: [vmm] out of memory\n",
+		},
+	}
+
+	for specIndex, spec := range specs {
+		buf.Reset()
+		PrintError(spec.err)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected to get:\n%q\ngot:\n%q", specIndex, spec.exp, got)
+		}
+	}
+}
@@ -1,12 +1,21 @@
 package kfmt
 
 import (
+	"gopheros/kernel"
 	"io"
 	"unsafe"
 )
 
-// maxBufSize defines the buffer size for formatting numbers.
-const maxBufSize = 32
+const (
+	// maxBufSize defines the buffer size for formatting numbers.
+	maxBufSize = 32
+
+	// Unicode code point limits used by the %c verb.
+	maxRune      = 0x10ffff
+	surrogateMin = 0xd800
+	surrogateMax = 0xdfff
+	runeError    = 0xfffd
+)
 
 var (
 	errMissingArg   = []byte("(MISSING)")
@@ -15,6 +24,8 @@ var (
 	errExtraArg     = []byte("%!(EXTRA)")
 	trueValue       = []byte("true")
 	falseValue      = []byte("false")
+	nilValue        = []byte("<nil>")
+	errChainSep     = []byte(": ")
 
 	numFmtBuf = []byte("012345678901234567890123456789012")
 
@@ -29,14 +40,39 @@ var (
 	// outputSink is a io.Writer where Printf will send its output. If set
 	// to nil, then the output will be redirected to the earlyPrintBuffer.
 	outputSink io.Writer
+
+	// mirrorSink, if set, receives a copy of all output sent to the
+	// default Printf target (e.g. a serial console).
+	mirrorSink io.Writer
+	mirror     mirrorWriter
 )
 
-// GetOutputSink returns the default target for calls to Printf.
-func GetOutputSink() io.Writer {
+// mirrorWriter is an io.Writer that sends its output both to the active output
+// sink (or the earlyPrintBuffer) and to the mirror sink.
+type mirrorWriter struct{}
+
+// Write implements io.Writer.
+func (mirrorWriter) Write(p []byte) (int, error) {
+	mirrorSink.Write(p)
 	if outputSink == nil {
-		return &earlyPrintBuffer
+		return earlyPrintBuffer.Write(p)
 	}
-	return outputSink
+	return outputSink.Write(p)
+}
+
+// GetOutputSink returns the default target for calls to Printf. Any output
+// written to it is also retained in the kernel log.
+func GetOutputSink() io.Writer {
+	return &logSink
+}
+
+// SetMirrorSink sets w as a secondary target for calls to Printf and for any
+// writes to the writer returned by GetOutputSink. Unlike the output sink, the
+// mirror sink is not replaced once the console and TTYs are initialized. It
+// is meant to be used by early consoles that are available before the memory
+// allocator is bootstrapped.
+func SetMirrorSink(w io.Writer) {
+	mirrorSink = w
 }
 
 // SetOutputSink sets the default target for calls to Printf to w and copies
@@ -55,13 +91,20 @@ func SetOutputSink(w io.Writer) {
 // Similar to fmt.Printf, this version of printf supports the following subset
 // of formatting verbs:
 //
+// General:
+//		%v the value in a default format: base 10 for integers, the
+//		   message for *kernel.Error values and errors and the result
+//		   of String() for values that implement it
+//
 // Strings:
 //		%s the uninterpreted bytes of the string or byte slice
 //
 // Integers:
+//              %c the character represented by the corresponding Unicode code point
 //              %o base 8
 //              %d base 10
 //              %x base 16, with lower-case letters for a-f
+//              %X base 16, with upper-case letters for A-F
 //
 // Booleans:
 //              %t "true" or "false"
@@ -69,13 +112,16 @@ func SetOutputSink(w io.Writer) {
 // Width is specified by an optional decimal number immediately preceding the verb.
 // If absent, the width is whatever is necessary to represent the value.
 //
-// String values with length less than the specified width will be left-padded with
-// spaces. Integer values formatted as base-10 will also be left-padded with spaces.
-// Finally, integer values formatted as base-16 will be left-padded with zeroes.
+// Values shorter than the specified width are left-padded with spaces. Integer
+// values formatted as base-8 or base-16 as well as any integer value whose
+// width is prefixed by a '0' flag are left-padded with zeroes instead; the
+// sign of negative values counts towards the width. Finally, the '-' flag
+// pads values with spaces on the right.
 //
-// Printf supports all built-in string and integer types but assumes that the
-// Go itables have not been initialized yet so it will not check whether its
-// arguments support io.Stringer if they don't match one of the supported tupes.
+// Printf supports all built-in string and integer types. The %v verb falls
+// back to checking whether its argument implements the error or Stringer
+// interfaces only if it does not match one of the supported types as type
+// assertions to interfaces require the Go itables to be initialized.
 //
 // This function does not provide support for printing pointers (%p) as this
 // requires importing the reflect package. By importing reflect, the go compiler
@@ -85,19 +131,34 @@ func SetOutputSink(w io.Writer) {
 //
 // The output of Printf is written to the currently active TTY. If no TTY is
 // available, then the output is buffered into a ring-buffer and can be
-// retrieved by a call to FlushRingBuffer.
+// retrieved by a call to FlushRingBuffer. In addition, the most recent output
+// is retained in the kernel log and can be retrieved via WriteLog.
 func Printf(format string, args ...interface{}) {
-	Fprintf(outputSink, format, args...)
+	Fprintf(&logSink, format, args...)
+}
+
+// fmtSpec describes the width and flags that precede a formatting verb.
+type fmtSpec struct {
+	width     int
+	zeroPad   bool
+	leftAlign bool
+}
+
+// stringer is implemented by values that can describe themselves. It mirrors
+// fmt.Stringer.
+type stringer interface {
+	String() string
 }
 
 // Fprintf behaves exactly like Printf but it writes the formatted output to
 // the specified io.Writer.
 func Fprintf(w io.Writer, format string, args ...interface{}) {
 	var (
-		nextCh                       byte
-		nextArgIndex                 int
-		blockStart, blockEnd, padLen int
-		fmtLen                       = len(format)
+		nextCh               byte
+		nextArgIndex         int
+		blockStart, blockEnd int
+		spec                 fmtSpec
+		fmtLen               = len(format)
 	)
 
 	for blockEnd < fmtLen {
@@ -117,7 +178,7 @@ func Fprintf(w io.Writer, format string, args ...interface{}) {
 		}
 
 		// Scan til we hit the format character
-		padLen = 0
+		spec = fmtSpec{}
 		blockEnd++
 	parseFmt:
 		for ; blockEnd < fmtLen; blockEnd++ {
@@ -127,10 +188,16 @@ func Fprintf(w io.Writer, format string, args ...interface{}) {
 				singleByte[0] = '%'
 				doWrite(w, singleByte)
 				break parseFmt
+			case nextCh == '-':
+				spec.leftAlign = true
+				continue
+			case nextCh == '0' && spec.width == 0:
+				spec.zeroPad = true
+				continue
 			case nextCh >= '0' && nextCh <= '9':
-				padLen = (padLen * 10) + int(nextCh-'0')
+				spec.width = (spec.width * 10) + int(nextCh-'0')
 				continue
-			case nextCh == 'd' || nextCh == 'x' || nextCh == 'o' || nextCh == 's' || nextCh == 't':
+			case nextCh == 'd' || nextCh == 'x' || nextCh == 'X' || nextCh == 'o' || nextCh == 's' || nextCh == 't' || nextCh == 'c' || nextCh == 'v':
 				// Run out of args to print
 				if nextArgIndex >= len(args) {
 					doWrite(w, errMissingArg)
@@ -139,22 +206,34 @@ func Fprintf(w io.Writer, format string, args ...interface{}) {
 
 				switch nextCh {
 				case 'o':
-					fmtInt(w, args[nextArgIndex], 8, padLen)
+					fmtInt(w, args[nextArgIndex], 8, false, spec)
 				case 'd':
-					fmtInt(w, args[nextArgIndex], 10, padLen)
+					fmtInt(w, args[nextArgIndex], 10, false, spec)
 				case 'x':
-					fmtInt(w, args[nextArgIndex], 16, padLen)
+					fmtInt(w, args[nextArgIndex], 16, false, spec)
+				case 'X':
+					fmtInt(w, args[nextArgIndex], 16, true, spec)
 				case 's':
-					fmtString(w, args[nextArgIndex], padLen)
+					fmtString(w, args[nextArgIndex], spec)
 				case 't':
-					fmtBool(w, args[nextArgIndex])
+					fmtBool(w, args[nextArgIndex], spec)
+				case 'c':
+					fmtChar(w, args[nextArgIndex], spec)
+				case 'v':
+					fmtValue(w, args[nextArgIndex], spec)
 				}
 
 				nextArgIndex++
 				break parseFmt
 			}
 
-			// reached end of formatting string without finding a verb
+			// found an unsupported verb
+			doWrite(w, errNoVerb)
+			break parseFmt
+		}
+
+		// reached end of formatting string without finding a verb
+		if blockEnd == fmtLen {
 			doWrite(w, errNoVerb)
 		}
 		blockStart, blockEnd = blockEnd+1, blockEnd+1
@@ -175,15 +254,46 @@ func Fprintf(w io.Writer, format string, args ...interface{}) {
 	}
 }
 
-// fmtBool prints a formatted version of boolean value v.
-func fmtBool(w io.Writer, v interface{}) {
+// fmtValue prints v using the default format for its type.
+func fmtValue(w io.Writer, v interface{}, spec fmtSpec) {
+	switch castedVal := v.(type) {
+	case nil:
+		writePadded(w, nilValue, spec)
+	case bool:
+		fmtBool(w, castedVal, spec)
+	case string, []byte:
+		fmtString(w, v, spec)
+	case uint8, uint16, uint32, uint64, uintptr, uint, int8, int16, int32, int64, int:
+		fmtInt(w, v, 10, false, spec)
+	case *kernel.Error:
+		if castedVal == nil {
+			writePadded(w, nilValue, spec)
+			return
+		}
+		writeString(w, castedVal.Message, spec)
+		for cause := castedVal.Cause; cause != nil; cause = cause.Cause {
+			doWrite(w, errChainSep)
+			writeString(w, cause.Message, fmtSpec{})
+		}
+	case error:
+		writeString(w, castedVal.Error(), spec)
+	case stringer:
+		writeString(w, castedVal.String(), spec)
+	default:
+		doWrite(w, errWrongArgType)
+	}
+}
+
+// fmtBool prints a formatted version of boolean value v, applying the padding
+// specified by spec.
+func fmtBool(w io.Writer, v interface{}, spec fmtSpec) {
 	switch bVal := v.(type) {
 	case bool:
 		switch bVal {
 		case true:
-			doWrite(w, trueValue)
+			writePadded(w, trueValue, spec)
 		case false:
-			doWrite(w, falseValue)
+			writePadded(w, falseValue, spec)
 		}
 	default:
 		doWrite(w, errWrongArgType)
@@ -192,22 +302,98 @@ func fmtBool(w io.Writer, v interface{}) {
 }
 
 // fmtString prints a formatted version of string or []byte value v, applying
-// the padding specified by padLen.
-func fmtString(w io.Writer, v interface{}, padLen int) {
+// the padding specified by spec.
+func fmtString(w io.Writer, v interface{}, spec fmtSpec) {
 	switch castedVal := v.(type) {
 	case string:
-		fmtRepeat(w, ' ', padLen-len(castedVal))
-		// converting the string to a byte slice triggers a memory allocation
-		// so we need to do this one byte at a time.
-		for i := 0; i < len(castedVal); i++ {
-			singleByte[0] = castedVal[i]
-			doWrite(w, singleByte)
-		}
+		writeString(w, castedVal, spec)
 	case []byte:
-		fmtRepeat(w, ' ', padLen-len(castedVal))
-		doWrite(w, castedVal)
+		writePadded(w, castedVal, spec)
+	default:
+		doWrite(w, errWrongArgType)
+	}
+}
+
+// fmtChar prints the UTF-8 encoding of the Unicode code point v, applying the
+// padding specified by spec. Invalid code points are replaced by U+FFFD.
+func fmtChar(w io.Writer, v interface{}, spec fmtSpec) {
+	var r uint64
+
+	switch castedVal := v.(type) {
+	case uint8:
+		r = uint64(castedVal)
+	case uint16:
+		r = uint64(castedVal)
+	case uint32:
+		r = uint64(castedVal)
+	case uint64:
+		r = castedVal
+	case uint:
+		r = uint64(castedVal)
+	case int32:
+		r = uint64(uint32(castedVal))
+	case int:
+		r = uint64(uint(castedVal))
 	default:
 		doWrite(w, errWrongArgType)
+		return
+	}
+
+	if r > maxRune || (r >= surrogateMin && r <= surrogateMax) {
+		r = runeError
+	}
+
+	var n int
+	switch {
+	case r < 0x80:
+		numFmtBuf[0] = byte(r)
+		n = 1
+	case r < 0x800:
+		numFmtBuf[0] = 0xc0 | byte(r>>6)
+		numFmtBuf[1] = 0x80 | byte(r)&0x3f
+		n = 2
+	case r < 0x10000:
+		numFmtBuf[0] = 0xe0 | byte(r>>12)
+		numFmtBuf[1] = 0x80 | byte(r>>6)&0x3f
+		numFmtBuf[2] = 0x80 | byte(r)&0x3f
+		n = 3
+	default:
+		numFmtBuf[0] = 0xf0 | byte(r>>18)
+		numFmtBuf[1] = 0x80 | byte(r>>12)&0x3f
+		numFmtBuf[2] = 0x80 | byte(r>>6)&0x3f
+		numFmtBuf[3] = 0x80 | byte(r)&0x3f
+		n = 4
+	}
+
+	// Width is measured in characters rather than bytes
+	spec.width -= n - 1
+	writePadded(w, numFmtBuf[:n], spec)
+}
+
+// writePadded writes p applying the padding specified by spec.
+func writePadded(w io.Writer, p []byte, spec fmtSpec) {
+	if !spec.leftAlign {
+		fmtRepeat(w, ' ', spec.width-len(p))
+	}
+	doWrite(w, p)
+	if spec.leftAlign {
+		fmtRepeat(w, ' ', spec.width-len(p))
+	}
+}
+
+// writeString writes str applying the padding specified by spec.
+func writeString(w io.Writer, str string, spec fmtSpec) {
+	if !spec.leftAlign {
+		fmtRepeat(w, ' ', spec.width-len(str))
+	}
+	// converting the string to a byte slice triggers a memory allocation
+	// so we need to do this one byte at a time.
+	for i := 0; i < len(str); i++ {
+		singleByte[0] = str[i]
+		doWrite(w, singleByte)
+	}
+	if spec.leftAlign {
+		fmtRepeat(w, ' ', spec.width-len(str))
 	}
 }
 
@@ -220,15 +406,18 @@ func fmtRepeat(w io.Writer, ch byte, count int) {
 }
 
 // fmtInt prints out a formatted version of v in the requested base, applying
-// the padding specified by padLen. This function supports all built-in signed
-// and unsigned integer types and base 8, 10 and 16 output.
-func fmtInt(w io.Writer, v interface{}, base, padLen int) {
+// the padding specified by spec. This function supports all built-in signed
+// and unsigned integer types and base 8, 10 and 16 output. If upper is true,
+// base 16 digits are printed using upper-case letters.
+func fmtInt(w io.Writer, v interface{}, base int, upper bool, spec fmtSpec) {
 	var (
 		sval             int64
 		uval             uint64
 		divider          uint64
 		remainder        uint64
-		padCh            byte
+		padLen           = spec.width
+		zeroPad          = spec.zeroPad || base != 10
+		letterBase       = byte('a')
 		left, right, end int
 	)
 
@@ -236,17 +425,10 @@ func fmtInt(w io.Writer, v interface{}, base, padLen int) {
 		padLen = maxBufSize - 1
 	}
 
-	switch base {
-	case 8:
-		divider = 8
-		padCh = '0'
-	case 10:
-		divider = 10
-		padCh = ' '
-	case 16:
-		divider = 16
-		padCh = '0'
+	if upper {
+		letterBase = 'A'
 	}
+	divider = uint64(base)
 
 	switch v.(type) {
 	case uint8:
@@ -259,6 +441,8 @@ func fmtInt(w io.Writer, v interface{}, base, padLen int) {
 		uval = v.(uint64)
 	case uintptr:
 		uval = uint64(v.(uintptr))
+	case uint:
+		uval = uint64(v.(uint))
 	case int8:
 		sval = int64(v.(int8))
 	case int16:
@@ -287,7 +471,7 @@ func fmtInt(w io.Writer, v interface{}, base, padLen int) {
 			numFmtBuf[right] = byte(remainder) + '0'
 		} else {
 			// map values from 10 to 15 -> a-f
-			numFmtBuf[right] = byte(remainder-10) + 'a'
+			numFmtBuf[right] = byte(remainder-10) + letterBase
 		}
 
 		right++
@@ -298,22 +482,29 @@ func fmtInt(w io.Writer, v interface{}, base, padLen int) {
 		}
 	}
 
-	// Apply padding if required
-	for ; right-left < padLen; right++ {
-		numFmtBuf[right] = padCh
+	// Apply padding if required. Zero padding is inserted between the sign
+	// and the digits while space padding is inserted before the sign. Values
+	// that are left-aligned are padded after being written.
+	signLen := 0
+	if sval < 0 {
+		signLen = 1
 	}
 
-	// Apply negative sign to the rightmost blank character (if using enough padding);
-	// otherwise append the sign as a new char
-	if sval < 0 {
-		for end = right - 1; numFmtBuf[end] == ' '; end-- {
+	if zeroPad && !spec.leftAlign {
+		for ; right+signLen < padLen; right++ {
+			numFmtBuf[right] = '0'
 		}
+	}
 
-		if end == right-1 {
-			right++
-		}
+	if sval < 0 {
+		numFmtBuf[right] = '-'
+		right++
+	}
 
-		numFmtBuf[end+1] = '-'
+	if !zeroPad && !spec.leftAlign {
+		for ; right < padLen; right++ {
+			numFmtBuf[right] = ' '
+		}
 	}
 
 	// Reverse in place
@@ -323,6 +514,9 @@ func fmtInt(w io.Writer, v interface{}, base, padLen int) {
 	}
 
 	doWrite(w, numFmtBuf[0:end])
+	if spec.leftAlign {
+		fmtRepeat(w, ' ', spec.width-end)
+	}
 }
 
 // doWrite is a proxy that uses the runtime.noescape hack to hide p from the
@@ -2,7 +2,9 @@ package kfmt
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"gopheros/kernel"
 	"strings"
 	"testing"
 )
@@ -30,7 +32,7 @@ func TestPrintf(t *testing.T) {
 		},
 		{
 			func() { printfn("%41t", false) },
-			"false",
+			strings.Repeat(" ", 36) + "false",
 		},
 		// strings and byte slices
 		{
@@ -115,7 +117,56 @@ func TestPrintf(t *testing.T) {
 		},
 		{
 			func() { printfn("padding longer than maxBufSize '%128x'", int(-0xbadf00d)) },
-			fmt.Sprintf("padding longer than maxBufSize '-%sbadf00d'", strings.Repeat("0", maxBufSize-8)),
+			fmt.Sprintf("padding longer than maxBufSize '-%sbadf00d'", strings.Repeat("0", maxBufSize-9)),
+		},
+		// flags
+		{
+			func() { printfn("zero-padded int: '%05d'", int32(-42)) },
+			"zero-padded int: '-0042'",
+		},
+		{
+			func() { printfn("zero-padded uint: '%08d'", uint16(1234)) },
+			"zero-padded uint: '00001234'",
+		},
+		{
+			func() { printfn("left-aligned: '%-6d' '%-6x' '%-4s' '%-6t'", -12, uint8(0xab), "a", true) },
+			"left-aligned: '-12   ' 'ab    ' 'a   ' 'true  '",
+		},
+		{
+			func() { printfn("upper-case hex: 0x%X 0x%4X", uint32(0xbadf00d), int(0xa)) },
+			"upper-case hex: 0xBADF00D 0x000A",
+		},
+		// chars
+		{
+			func() { printfn("chars: %c%c%c %3c|%-3c|", 'G', uint8('o'), 'π', '!', '!') },
+			"chars: Goπ   !|!  |",
+		},
+		{
+			func() { printfn("multi-byte chars: %c %c %c", '€', rune(0x1f600), 0xd800) },
+			"multi-byte chars: € \U0001f600 \ufffd",
+		},
+		{
+			func() { printfn("not char %c", "foo") },
+			`not char %!(WRONGTYPE)`,
+		},
+		// default formats
+		{
+			func() { printfn("%v %v %v %v %v", true, "str", []byte("bytes"), -12, uint64(34)) },
+			"true str bytes -12 34",
+		},
+		{
+			func() { printfn("%v|%12v|%v", &kernel.Error{Module: "test", Message: "failure"}, errors.New("std error"), (*kernel.Error)(nil)) },
+			"failure|   std error|<nil>",
+		},
+		{
+			func() {
+				printfn("%v", &kernel.Error{Message: "init failed", Cause: &kernel.Error{Message: "unable to map table", Cause: &kernel.Error{Message: "out of memory"}}})
+			},
+			"init failed: unable to map table: out of memory",
+		},
+		{
+			func() { printfn("%v %-6v|%v", testStringer("stringer"), nil, struct{}{}) },
+			"stringer <nil> |%!(WRONGTYPE)",
 		},
 		// multiple arguments
 		{
@@ -135,6 +186,14 @@ func TestPrintf(t *testing.T) {
 			func() { printfn("bad verb %Q") },
 			`bad verb %!(NOVERB)`,
 		},
+		{
+			func() { printfn("bad verb %Q in the middle %d", 1) },
+			`bad verb %!(NOVERB) in the middle 1`,
+		},
+		{
+			func() { printfn("no verb %12") },
+			`no verb %!(NOVERB)`,
+		},
 		{
 			func() { printfn("not bool %t", "foo") },
 			`not bool %!(WRONGTYPE)`,
@@ -149,17 +208,13 @@ func TestPrintf(t *testing.T) {
 		},
 	}
 
-	if sink := GetOutputSink(); sink != &earlyPrintBuffer {
-		t.Fatal("expected GetOutputSink() to return the earlyPrintBuffer when no output sink has been set")
+	if sink := GetOutputSink(); sink != &logSink {
+		t.Fatal("expected GetOutputSink() to return the kernel log writer")
 	}
 
 	var buf bytes.Buffer
 	SetOutputSink(&buf)
 
-	if sink := GetOutputSink(); sink != &buf {
-		t.Fatal("expected GetOutputSink() to return the value passed to SetOutputSink")
-	}
-
 	for specIndex, spec := range specs {
 		buf.Reset()
 		spec.fn()
@@ -170,6 +225,29 @@ func TestPrintf(t *testing.T) {
 	}
 }
 
+type testStringer string
+
+func (s testStringer) String() string { return string(s) }
+
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestFprintfAllocations(t *testing.T) {
+	var (
+		w   discardWriter
+		err = &kernel.Error{Module: "test", Message: "failure"}
+	)
+
+	allocs := testing.AllocsPerRun(10, func() {
+		Fprintf(w, "%d %05x %-4s %t %c %v %v", 42, uint32(0xf00), "str", true, 'x', err, uint8(7))
+	})
+
+	if allocs != 0 {
+		t.Fatalf("expected Fprintf not to allocate memory; got %f allocations per call", allocs)
+	}
+}
+
 func TestPrintfToRingBuffer(t *testing.T) {
 	defer func() {
 		outputSink = nil
@@ -186,6 +264,30 @@ func TestPrintfToRingBuffer(t *testing.T) {
 	}
 }
 
+func TestMirrorSink(t *testing.T) {
+	defer func() {
+		outputSink = nil
+		mirrorSink = nil
+	}()
+
+	var mirrorBuf, ttyBuf bytes.Buffer
+	SetMirrorSink(&mirrorBuf)
+
+	Printf("early %d\n", 1)
+
+	SetOutputSink(&ttyBuf)
+	Printf("late %d\n", 2)
+	Fprintf(GetOutputSink(), "sink %d\n", 3)
+
+	if exp, got := "early 1\nlate 2\nsink 3\n", ttyBuf.String(); got != exp {
+		t.Errorf("expected output sink to receive:\n%q\ngot:\n%q", exp, got)
+	}
+
+	if exp, got := "early 1\nlate 2\nsink 3\n", mirrorBuf.String(); got != exp {
+		t.Errorf("expected mirror sink to receive:\n%q\ngot:\n%q", exp, got)
+	}
+}
+
 func TestFprintf(t *testing.T) {
 	var buf bytes.Buffer
 
@@ -0,0 +1,76 @@
+package kfmt
+
+import "io"
+
+const (
+	// hexdumpRowLen is the number of bytes displayed in each Hexdump row.
+	hexdumpRowLen = 16
+
+	hexDigits = "0123456789abcdef"
+)
+
+// hexdumpLine is a shared buffer used by Hexdump for formatting a row. It
+// fits a 16-digit offset, the hex and ASCII columns and the separators.
+var hexdumpLine [96]byte
+
+// Hexdump writes the contents of data to w as rows of 16 bytes. Each row
+// starts with prefix and the offset of its first byte in hex followed by the
+// hex value of each byte and the printable characters in the row. For example:
+//
+//	00000000  53 53 44 54 00 01 67 6f  70 68 65 72 2d 6f 73 2d  |SSDT..gopher-os-|
+//
+// Like Fprintf, Hexdump does not allocate any memory.
+func Hexdump(w io.Writer, prefix string, data []byte) {
+	for offset := 0; offset < len(data); offset += hexdumpRowLen {
+		row := data[offset:]
+		if len(row) > hexdumpRowLen {
+			row = row[:hexdumpRowLen]
+		}
+
+		// passing prefix to doWrite triggers a memory allocation so we
+		// need to do this one byte at a time.
+		for i := 0; i < len(prefix); i++ {
+			singleByte[0] = prefix[i]
+			doWrite(w, singleByte)
+		}
+
+		// Offsets are padded to at least 8 digits
+		digits := uint(8)
+		for ; digits < 16 && uint64(offset)>>(4*digits) != 0; digits++ {
+		}
+
+		n := 0
+		for shift := 4 * (digits - 1); n < int(digits); shift, n = shift-4, n+1 {
+			hexdumpLine[n] = hexDigits[(uint64(offset)>>shift)&0xf]
+		}
+		hexdumpLine[n] = ' '
+		n++
+
+		for i := 0; i < hexdumpRowLen; i++ {
+			if i == hexdumpRowLen/2 {
+				hexdumpLine[n] = ' '
+				n++
+			}
+
+			hexdumpLine[n], hexdumpLine[n+1], hexdumpLine[n+2] = ' ', ' ', ' '
+			if i < len(row) {
+				hexdumpLine[n+1], hexdumpLine[n+2] = hexDigits[row[i]>>4], hexDigits[row[i]&0xf]
+			}
+			n += 3
+		}
+
+		hexdumpLine[n], hexdumpLine[n+1], hexdumpLine[n+2] = ' ', ' ', '|'
+		n += 3
+		for _, b := range row {
+			if b < ' ' || b > '~' {
+				b = '.'
+			}
+			hexdumpLine[n] = b
+			n++
+		}
+		hexdumpLine[n], hexdumpLine[n+1] = '|', '\n'
+		n += 2
+
+		doWrite(w, hexdumpLine[:n])
+	}
+}
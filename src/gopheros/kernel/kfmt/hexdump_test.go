@@ -0,0 +1,57 @@
+package kfmt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHexdump(t *testing.T) {
+	specs := []struct {
+		prefix string
+		data   []byte
+		exp    string
+	}{
+		{"", nil, ""},
+		{
+			"",
+			[]byte("APIC"),
+			"00000000  41 50 49 43" + strings.Repeat("   ", 12) + "   |APIC|\n",
+		},
+		{
+			"[aml] ",
+			[]byte("SSDT\x00\x01gopher-os-table!"),
+			"[aml] 00000000  53 53 44 54 00 01 67 6f  70 68 65 72 2d 6f 73 2d  |SSDT..gopher-os-|\n" +
+				"[aml] 00000010  74 61 62 6c 65 21" + strings.Repeat("   ", 10) + "   |table!|\n",
+		},
+		{
+			"",
+			[]byte{0x7f, 0x80, 0xff, '~', ' ', 0x1f, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			"00000000  7f 80 ff 7e 20 1f 00 00  00 00 00 00 00 00 00 00  |...~ ...........|\n",
+		},
+	}
+
+	for specIndex, spec := range specs {
+		var buf bytes.Buffer
+		Hexdump(&buf, spec.prefix, spec.data)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected output:\n%q\ngot:\n%q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestHexdumpAllocations(t *testing.T) {
+	var (
+		w    discardWriter
+		data = []byte("gopher-os hexdump allocation test")
+	)
+
+	allocs := testing.AllocsPerRun(10, func() {
+		Hexdump(w, "prefix ", data)
+	})
+
+	if allocs != 0 {
+		t.Fatalf("expected Hexdump not to allocate memory; got %f allocations per call", allocs)
+	}
+}
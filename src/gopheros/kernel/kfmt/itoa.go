@@ -0,0 +1,21 @@
+package kfmt
+
+// Itoa returns the decimal representation of a non-negative integer. Unlike
+// Fprintf, it does not require an io.Writer and is used for building names
+// such as device and table identifiers.
+func Itoa(val int) string {
+	var (
+		buf [20]byte
+		pos = len(buf)
+	)
+
+	for {
+		pos--
+		buf[pos] = byte('0' + val%10)
+		if val /= 10; val == 0 {
+			break
+		}
+	}
+
+	return string(buf[pos:])
+}
@@ -0,0 +1,21 @@
+package kfmt
+
+import "testing"
+
+func TestItoa(t *testing.T) {
+	specs := []struct {
+		val int
+		exp string
+	}{
+		{0, "0"},
+		{7, "7"},
+		{42, "42"},
+		{9223372036854775807, "9223372036854775807"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := Itoa(spec.val); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
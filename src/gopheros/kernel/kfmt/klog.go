@@ -0,0 +1,89 @@
+package kfmt
+
+import "io"
+
+// klogSize defines the size of the buffer that retains the most recent kernel
+// log output. It must always be a power of 2.
+const klogSize = 16384
+
+var (
+	// klog retains the output of Printf and of any writes to the writer
+	// returned by GetOutputSink.
+	klog logBuffer
+
+	// logSink records its output in klog before forwarding it to the
+	// default Printf target.
+	logSink logWriter
+
+	// extraLogSink, if set, receives a copy of all output recorded in the
+	// kernel log (e.g. a network console).
+	extraLogSink io.Writer
+)
+
+// logBuffer retains the last klogSize bytes written to it. Unlike ringBuffer,
+// reading its contents does not consume them.
+type logBuffer struct {
+	buffer  [klogSize]byte
+	wIndex  int
+	wrapped bool
+}
+
+// Write appends p to the buffer, overwriting the oldest data if required.
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	for _, b := range p {
+		lb.buffer[lb.wIndex] = b
+		if lb.wIndex = (lb.wIndex + 1) & (klogSize - 1); lb.wIndex == 0 {
+			lb.wrapped = true
+		}
+	}
+
+	return len(p), nil
+}
+
+// WriteTo writes the retained contents of the buffer to w in the order they
+// were written.
+func (lb *logBuffer) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	if lb.wrapped {
+		n, err := w.Write(lb.buffer[lb.wIndex:])
+		if total += int64(n); err != nil {
+			return total, err
+		}
+	}
+
+	n, err := w.Write(lb.buffer[:lb.wIndex])
+	return total + int64(n), err
+}
+
+// logWriter is an io.Writer that records its output in the kernel log and
+// forwards it to the mirror writer, the active output sink or the
+// earlyPrintBuffer.
+type logWriter struct{}
+
+// Write implements io.Writer.
+func (logWriter) Write(p []byte) (int, error) {
+	klog.Write(p)
+	if extraLogSink != nil {
+		extraLogSink.Write(p)
+	}
+
+	switch {
+	case mirrorSink != nil:
+		return mirror.Write(p)
+	case outputSink != nil:
+		return outputSink.Write(p)
+	default:
+		return earlyPrintBuffer.Write(p)
+	}
+}
+
+// SetLogSink sets w as an additional target for all output that is recorded
+// in the kernel log. Passing nil removes the previously set sink.
+func SetLogSink(w io.Writer) {
+	extraLogSink = w
+}
+
+// WriteLog writes the retained kernel log output to w.
+func WriteLog(w io.Writer) {
+	klog.WriteTo(w)
+}
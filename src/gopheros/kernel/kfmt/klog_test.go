@@ -0,0 +1,91 @@
+package kfmt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestKernelLog(t *testing.T) {
+	defer func() {
+		outputSink = nil
+		klog = logBuffer{}
+	}()
+	klog = logBuffer{}
+
+	var ttyBuf, logBuf bytes.Buffer
+	SetOutputSink(&ttyBuf)
+
+	Printf("printf %d\n", 1)
+	Fprintf(GetOutputSink(), "sink %d\n", 2)
+
+	exp := "printf 1\nsink 2\n"
+	if got := ttyBuf.String(); got != exp {
+		t.Fatalf("expected output sink to receive:\n%q\ngot:\n%q", exp, got)
+	}
+
+	WriteLog(&logBuf)
+	if got := logBuf.String(); got != exp {
+		t.Fatalf("expected kernel log to contain:\n%q\ngot:\n%q", exp, got)
+	}
+
+	// Once the buffer wraps, only the most recent output is retained
+	line := strings.Repeat("x", 99) + "\n"
+	for i := 0; i < klogSize/len(line)+1; i++ {
+		Printf(line)
+	}
+	Printf("last\n")
+
+	logBuf.Reset()
+	WriteLog(&logBuf)
+	got := logBuf.String()
+	if len(got) != klogSize || !strings.HasSuffix(got, line+"last\n") {
+		t.Fatalf("expected kernel log to retain the last %d bytes; got %d bytes ending with %q", klogSize, len(got), got[len(got)-10:])
+	}
+}
+
+func TestKernelLogAllocations(t *testing.T) {
+	defer func() {
+		outputSink = nil
+		klog = logBuffer{}
+	}()
+	outputSink = discardWriter{}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		Printf("%d %s\n", 42, "str")
+	})
+
+	if allocs != 0 {
+		t.Fatalf("expected Printf not to allocate memory; got %f allocations per call", allocs)
+	}
+}
+
+func TestLogSink(t *testing.T) {
+	defer func() {
+		outputSink = nil
+		extraLogSink = nil
+		klog = logBuffer{}
+	}()
+
+	var ttyBuf, sinkBuf bytes.Buffer
+	SetOutputSink(&ttyBuf)
+	SetLogSink(&sinkBuf)
+
+	Printf("printf %d\n", 1)
+	Fprintf(GetOutputSink(), "sink %d\n", 2)
+
+	exp := "printf 1\nsink 2\n"
+	if got := sinkBuf.String(); got != exp {
+		t.Fatalf("expected log sink to receive:\n%q\ngot:\n%q", exp, got)
+	}
+
+	if got := ttyBuf.String(); got != exp {
+		t.Fatalf("expected output sink to receive:\n%q\ngot:\n%q", exp, got)
+	}
+
+	SetLogSink(nil)
+	Printf("not forwarded\n")
+	if got := sinkBuf.String(); got != exp {
+		t.Fatalf("expected log sink to be removed; got:\n%q", got)
+	}
+}
@@ -3,28 +3,68 @@ package kfmt
 import (
 	"gopheros/kernel"
 	"gopheros/kernel/cpu"
+	"gopheros/kernel/ksym"
+	"io"
+	"runtime"
+	"unsafe"
 )
 
+// maxBacktraceDepth limits the number of frames printed by a kernel panic.
+const maxBacktraceDepth = 32
+
 var (
 	// cpuHaltFn is mocked by tests and is automatically inlined by the compiler.
 	cpuHaltFn = cpu.Halt
 
+	// framePointerFn, symbolizeFn and resolveSymbolFn are mocked by tests.
+	framePointerFn  = framePointer
+	symbolizeFn     = symbolize
+	resolveSymbolFn = ksym.Resolve
+
 	errRuntimePanic = &kernel.Error{Module: "rt", Message: "unknown cause"}
+
+	// panicHook, if set, is invoked after the panic details have been
+	// printed and before the CPU is halted.
+	panicHook func(fp uintptr)
 )
 
-// Panic outputs the supplied error (if not nil) to the console and halts the
-// CPU. Calls to Panic never return. Panic also works as a redirection target
-// for calls to panic() (resolved via runtime.gopanic)
+// RegisterState is implemented by snapshots of the CPU state of an interrupted
+// context such as the ones passed to exception handlers.
+type RegisterState interface {
+	// DumpTo outputs the register contents to w.
+	DumpTo(w io.Writer)
+
+	// Frame returns the instruction pointer and frame pointer of the
+	// interrupted context.
+	Frame() (pc, fp uintptr)
+}
+
+// Panic outputs the supplied error (if not nil) and a backtrace of the calling
+// code to the console and halts the CPU. Calls to Panic never return. Panic
+// also works as a redirection target for calls to panic() (resolved via
+// runtime.gopanic)
 //go:redirect-from runtime.gopanic
 func Panic(e interface{}) {
+	doPanic(e, nil, 0, framePointerFn())
+}
+
+// PanicWithRegisters behaves like Panic but also dumps the supplied register
+// state and collects the backtrace starting at the interrupted instruction. It
+// is meant to be used by exception handlers that cannot recover from a fault.
+func PanicWithRegisters(e interface{}, regs RegisterState) {
+	pc, fp := regs.Frame()
+	doPanic(e, regs, pc, fp)
+}
+
+func doPanic(e interface{}, regs RegisterState, pc, fp uintptr) {
 	var err *kernel.Error
 
 	switch t := e.(type) {
 	case *kernel.Error:
 		err = t
 	case string:
-		panicString(t)
-		return
+		errRuntimePanic.Message = t
+		err = errRuntimePanic
 	case error:
 		errRuntimePanic.Message = t.Error()
 		err = errRuntimePanic
@@ -33,16 +73,112 @@ func Panic(e interface{}) {
 	Printf("\n-----------------------------------\n")
 	if err != nil {
 		Printf("[%s] unrecoverable error: %s\n", err.Module, err.Message)
+		printErrorChain(err)
 	}
+	dumpState(regs, pc, fp)
 	Printf("*** kernel panic: system halted ***")
 	Printf("\n-----------------------------------\n")
 
+	// Clear the hook before invoking it so that a panic raised by the
+	// hook does not recurse.
+	if hook := panicHook; hook != nil {
+		panicHook = nil
+		hook(fp)
+	}
+
 	cpuHaltFn()
 }
 
+// SetPanicHook registers fn to be invoked by kernel panics after the panic
+// details have been written to the kernel log and before the CPU is halted.
+// The hook receives the frame pointer of the code that triggered the panic.
+func SetPanicHook(fn func(fp uintptr)) {
+	panicHook = fn
+}
+
+// DumpState outputs the supplied register state and a backtrace of the
+// interrupted code without halting the CPU. It allows diagnostics code such as
+// the lockup detector to report the state of code that is still running.
+func DumpState(regs RegisterState) {
+	pc, fp := regs.Frame()
+	dumpState(regs, pc, fp)
+}
+
+func dumpState(regs RegisterState, pc, fp uintptr) {
+	if regs != nil {
+		Printf("\nRegisters:\n")
+		regs.DumpTo(GetOutputSink())
+	}
+	printBacktrace(pc, fp)
+}
+
 // panicString serves as a redirect target for runtime.throw
 //go:redirect-from runtime.throw
 func panicString(msg string) {
 	errRuntimePanic.Message = msg
 	Panic(errRuntimePanic)
 }
+
+// printBacktrace outputs the symbolized return addresses obtained by following
+// the chain of saved frame pointers that starts at fp. If pc is not zero, it
+// is printed as the first frame. The walk stops at the first frame pointer
+// that is not properly aligned or does not point further up the stack.
+func printBacktrace(pc, fp uintptr) {
+	if fp == 0 && pc == 0 {
+		return
+	}
+
+	Printf("\nBacktrace:\n")
+	depth := 0
+	if pc != 0 {
+		printFrame(depth, pc)
+		depth++
+	}
+
+	for ; depth < maxBacktraceDepth && fp != 0 && fp&(unsafe.Sizeof(fp)-1) == 0; depth++ {
+		retAddr := *(*uintptr)(unsafe.Pointer(fp + unsafe.Sizeof(fp)))
+		if retAddr == 0 {
+			break
+		}
+		printFrame(depth, retAddr)
+
+		nextFP := *(*uintptr)(unsafe.Pointer(fp))
+		if nextFP <= fp {
+			break
+		}
+		fp = nextFP
+	}
+	Printf("\n")
+}
+
+func printFrame(depth int, pc uintptr) {
+	if name, offset := symbolizeFn(pc); name != "" {
+		Printf("%2d: 0x%16x %s+0x%x\n", depth, pc, name, offset)
+		return
+	}
+	Printf("%2d: 0x%16x ?\n", depth, pc)
+}
+
+// symbolize maps pc to the name of the function that contains it and the
+// offset from the function entrypoint. The embedded kernel symbol table is
+// consulted first as it also covers code without Go symbol information (e.g.
+// the rt0 assembly code); the Go runtime symbol information is used as a
+// fallback.
+func symbolize(pc uintptr) (string, uintptr) {
+	// Return addresses point to the instruction after the call
+	if sym, ok := resolveSymbolFn(pc - 1); ok {
+		return sym.Name, pc - sym.Addr
+	}
+	return runtimeSymbolize(pc)
+}
+
+// runtimeSymbolize uses the symbol information maintained by the Go runtime
+// to map pc to the name of the function that contains it and the offset from
+// the function entrypoint.
+func runtimeSymbolize(pc uintptr) (string, uintptr) {
+	// Return addresses point to the instruction after the call
+	if fn := runtime.FuncForPC(pc - 1); fn != nil {
+		return fn.Name(), pc - fn.Entry()
+	}
+	return "", 0
+}
@@ -0,0 +1,4 @@
+package kfmt
+
+// framePointer returns the frame pointer of its caller.
+func framePointer() uintptr
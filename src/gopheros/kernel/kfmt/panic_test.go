@@ -5,18 +5,25 @@ import (
 	"errors"
 	"gopheros/kernel"
 	"gopheros/kernel/cpu"
+	"gopheros/kernel/ksym"
+	"io"
 	"testing"
+	"unsafe"
 )
 
 func TestPanic(t *testing.T) {
 	defer func() {
 		cpuHaltFn = cpu.Halt
+		framePointerFn = framePointer
 		SetOutputSink(nil)
 	}()
 
 	var buf bytes.Buffer
 	SetOutputSink(&buf)
 
+	// Suppress the backtrace as its contents depend on the test binary
+	framePointerFn = func() uintptr { return 0 }
+
 	var cpuHaltCalled bool
 	cpuHaltFn = func() {
 		cpuHaltCalled = true
@@ -40,6 +47,20 @@ func TestPanic(t *testing.T) {
 		}
 	})
 
+	t.Run("with chained *kernel.Error", func(t *testing.T) {
+		cpuHaltCalled = false
+		buf.Reset()
+		err := &kernel.Error{Module: "test", Message: "panic test", Cause: &kernel.Error{Module: "vmm", Message: "out of memory"}}
+
+		Panic(err)
+
+		exp := "\n-----------------------------------\n[test] unrecoverable error: panic test\ncaused by: [vmm] out of memory\n*** kernel panic: system halted ***\n-----------------------------------\n"
+
+		if got := buf.String(); got != exp {
+			t.Fatalf("expected to get:\n%q\ngot:\n%q", exp, got)
+		}
+	})
+
 	t.Run("with error", func(t *testing.T) {
 		cpuHaltCalled = false
 		buf.Reset()
@@ -92,4 +113,200 @@ func TestPanic(t *testing.T) {
 			t.Fatal("expected cpu.Halt() to be called by Panic")
 		}
 	})
+
+	t.Run("with panic hook", func(t *testing.T) {
+		defer SetPanicHook(nil)
+		buf.Reset()
+
+		var (
+			hookCalls int
+			output    string
+		)
+		SetPanicHook(func(_ uintptr) {
+			hookCalls++
+			output = buf.String()
+		})
+
+		Panic(nil)
+		Panic(nil)
+
+		if hookCalls != 1 {
+			t.Fatalf("expected panic hook to be invoked once; got %d", hookCalls)
+		}
+
+		if exp := "\n-----------------------------------\n*** kernel panic: system halted ***\n-----------------------------------\n"; output != exp {
+			t.Fatalf("expected panic details to be printed before invoking the hook; got:\n%q", output)
+		}
+	})
+}
+
+type mockRegisters struct {
+	pc, fp uintptr
+}
+
+func (r *mockRegisters) DumpTo(w io.Writer) {
+	Fprintf(w, "RIP = %x\n", r.pc)
+}
+
+func (r *mockRegisters) Frame() (uintptr, uintptr) {
+	return r.pc, r.fp
+}
+
+// fakeStack holds a chain of frames; each frame consists of the saved frame
+// pointer followed by the return address.
+var fakeStack [8]uintptr
+
+func TestPanicWithRegisters(t *testing.T) {
+	defer func() {
+		cpuHaltFn = cpu.Halt
+		symbolizeFn = symbolize
+		SetOutputSink(nil)
+	}()
+
+	var buf bytes.Buffer
+	SetOutputSink(&buf)
+	cpuHaltFn = func() {}
+	symbolizeFn = func(pc uintptr) (string, uintptr) {
+		if pc == 0x3000 {
+			return "", 0
+		}
+		return "main.fn", pc & 0xff
+	}
+
+	frameAddr := func(index int) uintptr {
+		return uintptr(unsafe.Pointer(&fakeStack[index*2]))
+	}
+	fakeStack[0], fakeStack[1] = frameAddr(1), 0x2010
+	fakeStack[2], fakeStack[3] = frameAddr(2), 0x3000
+	// A frame pointer that points down the stack terminates the walk
+	fakeStack[4], fakeStack[5] = frameAddr(0), 0x4020
+
+	PanicWithRegisters(&kernel.Error{Module: "test", Message: "fault"}, &mockRegisters{pc: 0x1004, fp: frameAddr(0)})
+
+	exp := "\n-----------------------------------\n[test] unrecoverable error: fault\n" +
+		"\nRegisters:\nRIP = 1004\n" +
+		"\nBacktrace:\n" +
+		" 0: 0x0000000000001004 main.fn+0x4\n" +
+		" 1: 0x0000000000002010 main.fn+0x10\n" +
+		" 2: 0x0000000000003000 ?\n" +
+		" 3: 0x0000000000004020 main.fn+0x20\n" +
+		"\n*** kernel panic: system halted ***\n-----------------------------------\n"
+
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected to get:\n%q\ngot:\n%q", exp, got)
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	defer func() {
+		cpuHaltFn = cpu.Halt
+		symbolizeFn = symbolize
+		SetOutputSink(nil)
+	}()
+
+	var buf bytes.Buffer
+	SetOutputSink(&buf)
+	cpuHaltFn = func() { t.Error("expected DumpState not to halt the CPU") }
+	symbolizeFn = func(pc uintptr) (string, uintptr) { return "main.fn", pc & 0xff }
+
+	DumpState(&mockRegisters{pc: 0x1004})
+
+	exp := "\nRegisters:\nRIP = 1004\n" +
+		"\nBacktrace:\n" +
+		" 0: 0x0000000000001004 main.fn+0x4\n" +
+		"\n"
+
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected to get:\n%q\ngot:\n%q", exp, got)
+	}
+}
+
+func TestPrintBacktraceDepth(t *testing.T) {
+	defer func() {
+		symbolizeFn = symbolize
+		SetOutputSink(nil)
+	}()
+
+	var buf bytes.Buffer
+	SetOutputSink(&buf)
+	symbolizeFn = func(_ uintptr) (string, uintptr) { return "", 0 }
+
+	stack := make([]uintptr, 2*(maxBacktraceDepth+4))
+	for i := 0; i < len(stack)-2; i += 2 {
+		stack[i], stack[i+1] = uintptr(unsafe.Pointer(&stack[i+2])), 0x1000+uintptr(i)
+	}
+
+	specs := []struct {
+		setup     func()
+		expFrames int
+	}{
+		{func() {}, maxBacktraceDepth},
+		// A misaligned frame pointer terminates the walk
+		{func() { stack[4]++ }, 3},
+		// So does a zero return address
+		{func() { stack[4]--; stack[5] = 0 }, 2},
+	}
+
+	for specIndex, spec := range specs {
+		buf.Reset()
+		spec.setup()
+		printBacktrace(0, uintptr(unsafe.Pointer(&stack[0])))
+
+		if got := bytes.Count(buf.Bytes(), []byte("0x")); got != spec.expFrames {
+			t.Errorf("[spec %d] expected %d frames to be printed; got %d", specIndex, spec.expFrames, got)
+		}
+	}
+}
+
+func TestRuntimeSymbolize(t *testing.T) {
+	pc := framePointerCaller()
+	name, offset := runtimeSymbolize(pc)
+	if name != "gopheros/kernel/kfmt.framePointerCaller" || offset == 0 {
+		t.Errorf("expected pc to resolve to framePointerCaller; got %q+0x%x", name, offset)
+	}
+
+	if name, _ = runtimeSymbolize(1); name != "" {
+		t.Errorf("expected an invalid pc not to be resolved; got %q", name)
+	}
+}
+
+func TestSymbolize(t *testing.T) {
+	defer func() {
+		resolveSymbolFn = ksym.Resolve
+	}()
+
+	var resolved []uintptr
+	resolveSymbolFn = func(pc uintptr) (ksym.Symbol, bool) {
+		resolved = append(resolved, pc)
+		if pc >= 0x1000 && pc < 0x1100 {
+			return ksym.Symbol{Name: "rt0_64", Addr: 0x1000, Size: 0x100}, true
+		}
+		return ksym.Symbol{}, false
+	}
+
+	if name, offset := symbolize(0x1010); name != "rt0_64" || offset != 0x10 {
+		t.Errorf("expected pc to be resolved via the kernel symbol table; got %q+0x%x", name, offset)
+	}
+
+	if len(resolved) != 1 || resolved[0] != 0x100f {
+		t.Errorf("expected the symbol table to be queried for the call instruction address; got %v", resolved)
+	}
+
+	// Addresses not covered by the symbol table fall back to the Go runtime
+	pc := framePointerCaller()
+	if name, _ := symbolize(pc); name != "gopheros/kernel/kfmt.framePointerCaller" {
+		t.Errorf("expected pc to resolve to framePointerCaller; got %q", name)
+	}
+}
+
+// framePointerCaller returns its own return address as recorded in the frame
+// of its callee.
+//go:noinline
+func framePointerCaller() uintptr {
+	return readReturnAddress()
+}
+
+//go:noinline
+func readReturnAddress() uintptr {
+	return *(*uintptr)(unsafe.Pointer(framePointer() + unsafe.Sizeof(uintptr(0))))
 }
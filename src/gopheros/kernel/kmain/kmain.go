@@ -1,14 +1,44 @@
 package kmain
 
 import (
+	"gopheros/device/blockdev"
+	"gopheros/device/input"
+	"gopheros/device/netdev"
+	"gopheros/device/serial"
 	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/exec"
 	"gopheros/kernel/gate"
 	"gopheros/kernel/goruntime"
 	"gopheros/kernel/hal"
+	"gopheros/kernel/initcall"
+	"gopheros/kernel/initrd"
 	"gopheros/kernel/kfmt"
+	"gopheros/kernel/kshell"
+	"gopheros/kernel/ksym"
 	"gopheros/kernel/mm/pmm"
 	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/net"
+	"gopheros/kernel/proc"
+	"gopheros/kernel/rand"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/selftest"
+	"gopheros/kernel/smp"
+	"gopheros/kernel/softirq"
+	"gopheros/kernel/syscall"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/trace"
+	"gopheros/kernel/user"
+	"gopheros/kernel/vfs/tarfs"
+	"gopheros/kernel/watchdog"
+	"gopheros/kernel/workqueue"
 	"gopheros/multiboot"
+
+	// import and register subsystems that are initialized via initcalls
+	_ "gopheros/kernel/pstore"
+	_ "gopheros/kernel/vfs/iso9660"
+	_ "gopheros/kernel/vfs/procfs"
+	_ "gopheros/kernel/vfs/ramfs"
 )
 
 var (
@@ -31,6 +61,20 @@ var (
 func Kmain(multibootInfoPtr, kernelStart, kernelEnd, kernelPageOffset uintptr) {
 	multiboot.SetInfoPtr(multibootInfoPtr)
 
+	// Mirror kernel output to a serial port if requested via the boot
+	// command line (e.g. console=ttyS0,115200)
+	if uart := serial.EarlyConsole(); uart != nil {
+		kfmt.SetMirrorSink(uart)
+	}
+
+	// Randomize the placement of the early reservation region that holds
+	// the kernel heap, thread stacks and device mappings unless disabled
+	// via the boot command line. This must happen before the memory
+	// allocators reserve any address space.
+	if !cmdline.Bool("nokaslr") {
+		vmm.RandomizeEarlyReserveRegion()
+	}
+
 	var err *kernel.Error
 	gate.Init()
 	if err = pmm.Init(kernelStart, kernelEnd); err != nil {
@@ -41,6 +85,47 @@ func Kmain(multibootInfoPtr, kernelStart, kernelEnd, kernelPageOffset uintptr) {
 		panic(err)
 	}
 
+	// Parse the boot command line now that the memory allocator is available
+	cmdline.Init()
+
+	// Seed the kernel random number generator; hardware entropy sources
+	// contribute once they are detected.
+	rand.Init()
+
+	// Start recording trace events early if requested so that the device
+	// probes are also captured.
+	trace.Init()
+
+	// Run the initializers of subsystems that only need the memory
+	// allocators and the boot command line, e.g. the pstore region which
+	// preserves the details of kernel panics across warm reboots.
+	initcall.Run(initcall.LevelEarly)
+
+	// Backtraces fall back to the Go runtime symbol information if the
+	// kernel symbol table is not available.
+	if err = ksym.Init(); err != nil {
+		kfmt.Printf("[ksym] %s\n", err.Message)
+	}
+
+	// The initrd is optional; report its absence but keep booting. When
+	// present, it provides the root filesystem.
+	if err = initrd.Init(); err != nil {
+		kfmt.Printf("[initrd] %s\n", err.Message)
+	} else if err = tarfs.Mount("/", initrd.Bytes()); err != nil {
+		kfmt.Printf("[initrd] %s\n", err.Message)
+	}
+
+	// Register the current execution context as the boot thread so that
+	// kernel threads can be spawned while detecting hardware.
+	sched.Init()
+	if err = user.Init(); err != nil {
+		panic(err)
+	}
+	syscall.Init()
+	if err = proc.Init(); err != nil {
+		panic(err)
+	}
+
 	// After goruntime.Init returns we can safely use defer
 	defer func() {
 		// Use kfmt.Panic instead of panic to prevent the compiler from
@@ -48,6 +133,78 @@ func Kmain(multibootInfoPtr, kernelStart, kernelEnd, kernelPageOffset uintptr) {
 		kfmt.Panic(errKmainReturned)
 	}()
 
+	// Spawn the threads that run work deferred by interrupt handlers and
+	// start delivering input events, received network frames and queued
+	// block device requests
+	if err = softirq.Init(); err != nil {
+		panic(err)
+	} else if err = workqueue.Init(); err != nil {
+		panic(err)
+	} else if err = input.Init(); err != nil {
+		panic(err)
+	} else if err = netdev.Init(); err != nil {
+		panic(err)
+	} else if err = blockdev.Init(); err != nil {
+		panic(err)
+	}
+
+	// Initialize any subsystems that build on the ones above
+	initcall.Run(initcall.LevelSubsys)
+
 	// Detect and initialize hardware
 	hal.DetectHardware()
+
+	// Now that the console is available, display the boot splash screen
+	// (if requested via the splash command line option) while the
+	// remaining subsystems are initialized.
+	hal.BeginBootSplash(4)
+
+	// Expose the kernel state via procfs and run any other initializers
+	// that depend on the detected hardware
+	hal.BootProgress("running late initializers")
+	initcall.Run(initcall.LevelLate)
+
+	// The debug shell reads the kernel state from procfs
+	hal.BootProgress("starting debug shell")
+	kshell.Init()
+
+	// Start the application processors using the low memory frame that was
+	// reserved while initializing the frame allocator; failing to do so is
+	// not fatal as the kernel can still run on the boot processor.
+	hal.BootProgress("starting application processors")
+	if err = smp.Init(pmm.RealModeFrame()); err != nil {
+		kfmt.Printf("[smp] %s; running on the boot processor only\n", err.Message)
+	}
+
+	hal.BootProgress("starting timers")
+	if err = timer.Init(); err != nil {
+		kfmt.Printf("[timer] %s; timers are disabled\n", err.Message)
+	} else {
+		// Timers are now available for blinking the console cursor
+		hal.StartCursorBlink()
+
+		if err = watchdog.Init(); err != nil {
+			kfmt.Printf("[watchdog] %s; hard lockup detection is disabled\n", err.Message)
+		}
+
+		// The network stack ages its caches using a periodic timer
+		if err = net.Init(); err != nil {
+			kfmt.Printf("[net] %s\n", err.Message)
+		}
+
+		// Run the boot-time self tests if requested (selftest=1)
+		if err = selftest.Init(); err != nil {
+			kfmt.PrintError(err)
+		}
+	}
+
+	hal.EndBootSplash()
+
+	// Start the first user-mode process from the root filesystem
+	if err = exec.StartInit(); err != nil {
+		kfmt.Printf("[init] %s\n", err.Message)
+	}
+
+	// Turn the boot thread into the idle loop and run any kernel threads
+	sched.Run()
 }
@@ -0,0 +1,698 @@
+package kshell
+
+import (
+	"gopheros/device/input/ps2"
+	"gopheros/device/pci"
+	"gopheros/device/pmu"
+	"gopheros/device/serial"
+	"gopheros/kernel/hal"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/kthread"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/net"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/trace"
+	"gopheros/kernel/vfs"
+	"gopheros/kernel/vfs/procfs"
+	"io"
+	"strings"
+)
+
+// command describes a shell command.
+type command struct {
+	name  string
+	args  string
+	help  string
+	run   func(w io.Writer, args []string)
+	nargs int
+}
+
+var (
+	// commands is populated by init as the help command needs to access
+	// the command list.
+	commands []command
+
+	// pageLevelNames contains the names of the page tables at each paging
+	// level starting from the top-most table.
+	pageLevelNames = [...]string{"PML4", "PDPT", "PD", "PT"}
+
+	// pageFlagNames contains the names of the page table entry flags that
+	// are displayed by the pt command.
+	pageFlagNames = []struct {
+		flag vmm.PageTableEntryFlag
+		name string
+	}{
+		{vmm.FlagPresent, "P"},
+		{vmm.FlagRW, "RW"},
+		{vmm.FlagUserAccessible, "US"},
+		{vmm.FlagWriteThroughCaching, "PWT"},
+		{vmm.FlagDoNotCache, "PCD"},
+		{vmm.FlagAccessed, "A"},
+		{vmm.FlagDirty, "D"},
+		{vmm.FlagHugePage, "PS"},
+		{vmm.FlagGlobal, "G"},
+		{vmm.FlagCopyOnWrite, "COW"},
+		{vmm.FlagNoExecute, "NX"},
+	}
+
+	// The following functions are used by tests to mock calls to the
+	// vfs, pci, vmm, ps2, net, timer, trace, pmu, hal, serial, sched and
+	// kthread packages.
+	readFileFn              = vfs.ReadFile
+	readDirFn               = vfs.ReadDir
+	pciDevicesFn            = pci.Devices
+	visitPageTableEntriesFn = vmm.VisitPageTableEntries
+	translateFn             = vmm.Translate
+	rebootFn                = ps2.Reboot
+	pingFn                  = net.Ping
+	sleepFn                 = timer.Sleep
+	traceEnableFn           = trace.Enable
+	traceDisableFn          = trace.Disable
+	traceClearFn            = trace.Clear
+	startSamplingFn         = pmu.StartSampling
+	stopSamplingFn          = pmu.StopSampling
+	setConsoleModeFn        = hal.SetConsoleMode
+	screenshotFn            = hal.Screenshot
+	serialConsoleFn         = serialConsole
+	lookupThreadFn          = sched.LookupThread
+	setNiceFn               = (*sched.Thread).SetNice
+	setAffinityFn           = (*sched.Thread).SetAffinity
+	selectClocksourceFn     = timer.SelectClocksource
+	ticksFn                 = timer.Ticks
+	yieldFn                 = sched.Yield
+	currentCPUFn            = currentCPU
+	spawnNonAllocatingFn    = kthread.SpawnNonAllocating
+	joinFn                  = (*kthread.Thread).Join
+)
+
+const (
+	// pingCount is the number of echo requests sent by the ping command
+	// if no count is specified.
+	pingCount = 4
+
+	pingTimeout  = timer.Second
+	pingInterval = timer.Second
+
+	// The largest resolution and depth that can be requested via the
+	// mode command.
+	maxModeDimension = 0xffff
+	maxModeBpp       = 32
+
+	// The lines that enclose the base64-encoded image that is streamed
+	// over the serial console by the screenshot command.
+	screenshotBeginMarker = "-----BEGIN SCREENSHOT screenshot.ppm-----"
+	screenshotEndMarker   = "-----END SCREENSHOT-----"
+
+	// The limits for the number of threads and the duration that can be
+	// requested via the burn command.
+	maxBurnThreads = sched.MaxCPUs
+	maxBurnSeconds = 60
+
+	// burnBatch is the number of iterations that burn threads run before
+	// yielding the processor.
+	burnBatch = 1 << 16
+)
+
+func init() {
+	commands = []command{
+		{"help", "", "list the available commands", cmdHelp, 0},
+		{"mem", "", "show the physical memory usage", procFileCmd("/meminfo"), 0},
+		{"lsdev", "", "list the registered drivers", procFileCmd("/devices"), 0},
+		{"lspci", "", "list the PCI devices", cmdLspci, 0},
+		{"lsirq", "[handlers]", "show the interrupt statistics per vector or handler", cmdLsirq, -1},
+		{"ps", "", "list the running and runnable threads", procFileCmd("/runqueue"), 0},
+		{"top", "", "show the scheduling statistics of all threads", procFileCmd("/sched"), 0},
+		{"renice", "TID NICE", "change the nice value of a thread", cmdRenice, 2},
+		{"taskset", "TID MASK", "change the CPU affinity mask of a thread", cmdTaskset, 2},
+		{"burn", "COUNT SECONDS", "keep the processors busy with non-allocating threads", cmdBurn, 2},
+		{"dmesg", "", "show the kernel log", procFileCmd("/kmsg"), 0},
+		{"acpi", "[dump [SIG]]", "list or hex dump the ACPI tables", cmdACPI, -1},
+		{"pt", "ADDR", "show the page table entries for a virtual address", cmdPageTables, 1},
+		{"ls", "[PATH]", "list the contents of a directory", cmdLs, -1},
+		{"cat", "PATH", "show the contents of a file", cmdCat, 1},
+		{"arp", "", "show the ARP cache", procFileCmd("/net/arp"), 0},
+		{"ping", "ADDR [COUNT]", "send ICMP echo requests to an IPv4 address", cmdPing, -1},
+		{"trace", "[on|off|clear]", "show or control the recorded trace events", cmdTrace, -1},
+		{"perf", "[EVENT PERIOD]", "show the performance counters or sample an event", cmdPerf, -1},
+		{"clocksource", "[NAME]", "list the clocksources or switch to another one", cmdClocksource, -1},
+		{"mode", "WxH[xBPP]", "switch the console resolution", cmdMode, 1},
+		{"screenshot", "", "stream the console contents over the serial console", cmdScreenshot, 0},
+		{"reboot", "", "reboot the system", cmdReboot, 0},
+		{"exit", "", "close the shell", cmdExit, 0},
+	}
+}
+
+// execute runs the command in a command line.
+func execute(w io.Writer, cmdLine string) {
+	fields := strings.Fields(cmdLine)
+	if len(fields) == 0 {
+		return
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != fields[0] {
+			continue
+		}
+
+		if args := fields[1:]; cmd.nargs == -1 || len(args) == cmd.nargs {
+			cmd.run(w, args)
+		} else {
+			kfmt.Fprintf(w, "usage: %s %s\n", cmd.name, cmd.args)
+		}
+		return
+	}
+
+	kfmt.Fprintf(w, "%s: unknown command; type help for a list of commands\n", fields[0])
+}
+
+func cmdHelp(w io.Writer, _ []string) {
+	for _, cmd := range commands {
+		kfmt.Fprintf(w, "%-10s %-14s %s\n", cmd.name, cmd.args, cmd.help)
+	}
+}
+
+// procFileCmd returns a command that displays a file exposed by procfs.
+func procFileCmd(path string) func(io.Writer, []string) {
+	return func(w io.Writer, _ []string) {
+		cmdCat(w, []string{procfs.MountPoint + path})
+	}
+}
+
+func cmdCat(w io.Writer, args []string) {
+	data, err := readFileFn(args[0])
+	if err != nil {
+		kfmt.Fprintf(w, "%s: %s\n", args[0], err.Message)
+		return
+	}
+
+	w.Write(data)
+}
+
+func cmdLs(w io.Writer, args []string) {
+	path := "/"
+	if len(args) != 0 {
+		path = args[0]
+	}
+
+	list, err := readDirFn(path)
+	if err != nil {
+		kfmt.Fprintf(w, "%s: %s\n", path, err.Message)
+		return
+	}
+
+	for _, info := range list {
+		typ := '-'
+		switch {
+		case info.Mode.IsDir():
+			typ = 'd'
+		case info.Mode&vfs.ModeSymlink != 0:
+			typ = 'l'
+		}
+
+		kfmt.Fprintf(w, "%c%3o %10d %s\n", typ, uint32(info.Mode&vfs.ModePerm), info.Size, info.Name)
+	}
+}
+
+func cmdLspci(w io.Writer, _ []string) {
+	kfmt.Fprintf(w, "%-8s %-9s %s\n", "ADDRESS", "ID", "CLASS")
+	for _, dev := range pciDevicesFn() {
+		kfmt.Fprintf(w, "%2x:%2x.%x  %4x:%4x %2x%2x%2x\n",
+			dev.Bus, dev.Slot, dev.Func, dev.VendorID, dev.DeviceID,
+			dev.ClassCode, dev.Subclass, dev.ProgIF,
+		)
+	}
+}
+
+// cmdACPI lists the ACPI tables or hex dumps the contents of either the
+// specified or all tables.
+func cmdACPI(w io.Writer, args []string) {
+	dump := len(args) != 0
+	if len(args) > 2 || (dump && args[0] != "dump") {
+		kfmt.Fprintf(w, "usage: acpi [dump [SIG]]\n")
+		return
+	}
+
+	dir := procfs.MountPoint + "/acpi"
+	list, err := readDirFn(dir)
+	if err != nil {
+		kfmt.Fprintf(w, "acpi: %s\n", err.Message)
+		return
+	}
+
+	var found bool
+	for _, info := range list {
+		if len(args) == 2 && info.Name != args[1] {
+			continue
+		}
+		found = true
+
+		data, err := readFileFn(dir + "/" + info.Name)
+		if err != nil {
+			kfmt.Fprintf(w, "%s: %s\n", info.Name, err.Message)
+			continue
+		}
+
+		kfmt.Fprintf(w, "%s %d bytes\n", info.Name, len(data))
+		if dump {
+			kfmt.Hexdump(w, "", data)
+		}
+	}
+
+	if !found && len(args) == 2 {
+		kfmt.Fprintf(w, "acpi: %s: %s\n", args[1], vfs.ErrNotFound.Message)
+	}
+}
+
+// cmdPageTables displays the page table entries that are used for translating
+// a virtual address followed by the physical address it maps to.
+func cmdPageTables(w io.Writer, args []string) {
+	addr, ok := parseHex(args[0])
+	if !ok {
+		kfmt.Fprintf(w, "pt: invalid address %s\n", args[0])
+		return
+	}
+
+	visitPageTableEntriesFn(addr, func(level uint8, entry uintptr) {
+		kfmt.Fprintf(w, "%-4s 0x%16x", pageLevelNames[level], entry)
+		for _, f := range pageFlagNames {
+			if entry&uintptr(f.flag) != 0 {
+				kfmt.Fprintf(w, " %s", f.name)
+			}
+		}
+		kfmt.Fprintf(w, "\n")
+	})
+
+	if phys, err := translateFn(addr); err != nil {
+		kfmt.Fprintf(w, "0x%x: %s\n", addr, err.Message)
+	} else {
+		kfmt.Fprintf(w, "0x%x -> 0x%x\n", addr, phys)
+	}
+}
+
+// parseHex parses an address specified as a hex number with an optional 0x
+// prefix.
+func parseHex(s string) (uintptr, bool) {
+	s = strings.TrimPrefix(strings.ToLower(s), "0x")
+	if len(s) == 0 || len(s) > 16 {
+		return 0, false
+	}
+
+	var val uintptr
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c -= 'a' - 10
+		default:
+			return 0, false
+		}
+		val = val<<4 | uintptr(c)
+	}
+
+	return val, true
+}
+
+// cmdPing sends ICMP echo requests to an address and reports the round-trip
+// time of each reply.
+func cmdPing(w io.Writer, args []string) {
+	if len(args) == 0 || len(args) > 2 {
+		kfmt.Fprintf(w, "usage: ping ADDR [COUNT]\n")
+		return
+	}
+
+	addr, ok := net.ParseIP(args[0])
+	if !ok {
+		kfmt.Fprintf(w, "ping: invalid address %s\n", args[0])
+		return
+	}
+
+	count := pingCount
+	if len(args) == 2 {
+		if count, ok = parseCount(args[1]); !ok {
+			kfmt.Fprintf(w, "ping: invalid count %s\n", args[1])
+			return
+		}
+	}
+
+	var sent, received int
+	for seq := 1; seq <= count; seq++ {
+		if seq > 1 {
+			sleepFn(pingInterval)
+		}
+
+		rtt, err := pingFn(addr, uint16(seq), pingTimeout)
+		if err != nil && err != net.ErrTimeout {
+			kfmt.Fprintf(w, "ping: %s\n", err.Message)
+			break
+		}
+
+		sent++
+		if err != nil {
+			kfmt.Fprintf(w, "%s: icmp_seq=%d %s\n", addr.String(), seq, err.Message)
+			continue
+		}
+
+		received++
+		kfmt.Fprintf(w, "reply from %s: icmp_seq=%d time=%d.%03d ms\n", addr.String(), seq,
+			int64(rtt/timer.Millisecond), int64(rtt%timer.Millisecond/timer.Microsecond),
+		)
+	}
+
+	kfmt.Fprintf(w, "%d packets transmitted, %d received\n", sent, received)
+}
+
+// parseCount parses a positive decimal number that fits in 16 bits.
+func parseCount(s string) (int, bool) {
+	var val int
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, false
+		}
+
+		if val = val*10 + int(s[i]-'0'); val > 0xffff {
+			return 0, false
+		}
+	}
+
+	return val, val != 0
+}
+
+// cmdTrace shows the recorded trace events or enables, disables or clears the
+// event recording.
+func cmdTrace(w io.Writer, args []string) {
+	if len(args) == 0 {
+		procFileCmd("/trace")(w, nil)
+		return
+	}
+
+	switch {
+	case len(args) == 1 && args[0] == "on":
+		traceEnableFn()
+	case len(args) == 1 && args[0] == "off":
+		traceDisableFn()
+	case len(args) == 1 && args[0] == "clear":
+		traceClearFn()
+	default:
+		kfmt.Fprintf(w, "usage: trace [on|off|clear]\n")
+		return
+	}
+
+	kfmt.Fprintf(w, "trace: %s\n", args[0])
+}
+
+// cmdLsirq shows the interrupt statistics for each active vector or, when
+// invoked with the handlers argument, for each registered handler.
+func cmdLsirq(w io.Writer, args []string) {
+	switch {
+	case len(args) == 0:
+		procFileCmd("/irqstats")(w, nil)
+	case len(args) == 1 && args[0] == "handlers":
+		procFileCmd("/interrupts")(w, nil)
+	default:
+		kfmt.Fprintf(w, "usage: lsirq [handlers]\n")
+	}
+}
+
+// cmdClocksource lists the registered clocksources or switches the monotonic
+// clock to the clocksource with the specified name.
+func cmdClocksource(w io.Writer, args []string) {
+	switch len(args) {
+	case 0:
+		procFileCmd("/clocksource")(w, nil)
+	case 1:
+		if err := selectClocksourceFn(args[0]); err != nil {
+			kfmt.Fprintf(w, "clocksource: %s\n", err.Message)
+			return
+		}
+		kfmt.Fprintf(w, "clocksource: switched to %s\n", args[0])
+	default:
+		kfmt.Fprintf(w, "usage: clocksource [NAME]\n")
+	}
+}
+
+// cmdPerf shows the performance counters, samples an event every PERIOD
+// occurrences or stops sampling.
+func cmdPerf(w io.Writer, args []string) {
+	switch {
+	case len(args) == 0:
+		procFileCmd("/pmu")(w, nil)
+	case len(args) == 1 && args[0] == "stop":
+		stopSamplingFn()
+		kfmt.Fprintf(w, "perf: sampling stopped\n")
+	case len(args) == 2:
+		ev, err := pmu.ParseEvent(args[0])
+		if err != nil {
+			kfmt.Fprintf(w, "perf: %s: %s\n", args[0], err.Message)
+			return
+		}
+
+		period, ok := parseDecimal(args[1], pmu.MaxSamplePeriod)
+		if !ok {
+			kfmt.Fprintf(w, "perf: invalid period %s\n", args[1])
+			return
+		}
+
+		if err = startSamplingFn(ev, period); err != nil {
+			kfmt.Fprintf(w, "perf: %s\n", err.Message)
+			return
+		}
+		kfmt.Fprintf(w, "perf: sampling %s every %d events\n", ev.String(), period)
+	default:
+		kfmt.Fprintf(w, "usage: perf [EVENT PERIOD | stop]\n")
+	}
+}
+
+// parseDecimal parses a positive decimal number that does not exceed max.
+func parseDecimal(s string, max uint64) (uint64, bool) {
+	var val uint64
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, false
+		}
+
+		if val = val*10 + uint64(s[i]-'0'); val > max {
+			return 0, false
+		}
+	}
+
+	return val, val != 0
+}
+
+// cmdMode switches the active console to the resolution and optional depth
+// specified as WIDTHxHEIGHT[xBPP].
+func cmdMode(w io.Writer, args []string) {
+	var (
+		fields = strings.Split(args[0], "x")
+		vals   [3]uint64
+		ok     = len(fields) == 2 || len(fields) == 3
+	)
+
+	for i := 0; ok && i < len(fields); i++ {
+		max := uint64(maxModeDimension)
+		if i == 2 {
+			max = maxModeBpp
+		}
+		vals[i], ok = parseDecimal(fields[i], max)
+	}
+
+	if !ok {
+		kfmt.Fprintf(w, "mode: invalid mode %s\n", args[0])
+		return
+	}
+
+	if err := setConsoleModeFn(uint32(vals[0]), uint32(vals[1]), uint8(vals[2])); err != nil {
+		kfmt.Fprintf(w, "mode: %s\n", err.Message)
+		return
+	}
+	kfmt.Fprintf(w, "mode: switched to %dx%d\n", vals[0], vals[1])
+}
+
+// cmdScreenshot encodes the active console contents as a PPM image and streams
+// it base64-encoded over the serial console. The encoded image is enclosed in
+// marker lines so that it can be extracted from a serial log.
+func cmdScreenshot(w io.Writer, _ []string) {
+	sink := serialConsoleFn()
+	if sink == nil {
+		kfmt.Fprintf(w, "screenshot: no serial console; boot with console=ttyS0 to enable screenshots\n")
+		return
+	}
+
+	kfmt.Fprintf(sink, "%s\n", screenshotBeginMarker)
+	encoder := kfmt.Base64Writer{Sink: sink}
+	err := screenshotFn(&encoder)
+	encoder.Close()
+	kfmt.Fprintf(sink, "%s\n", screenshotEndMarker)
+
+	if err != nil {
+		kfmt.Fprintf(w, "screenshot: %s\n", err.Message)
+		return
+	}
+	kfmt.Fprintf(w, "screenshot: image sent over the serial console\n")
+}
+
+// serialConsole returns the serial console or nil if no serial console is in
+// use.
+func serialConsole() io.Writer {
+	if uart := serial.ActiveConsole(); uart != nil {
+		return uart
+	}
+
+	return nil
+}
+
+// cmdRenice changes the nice value of a thread.
+func cmdRenice(w io.Writer, args []string) {
+	tid, ok := parseInt(args[0], 0, 1<<32-1)
+	if !ok {
+		kfmt.Fprintf(w, "renice: invalid thread ID %s\n", args[0])
+		return
+	}
+
+	nice, ok := parseInt(args[1], sched.MinNice, sched.MaxNice)
+	if !ok {
+		kfmt.Fprintf(w, "renice: nice value must be between %d and %d\n", sched.MinNice, sched.MaxNice)
+		return
+	}
+
+	t := lookupThreadFn(uint32(tid))
+	if t == nil {
+		kfmt.Fprintf(w, "renice: no thread with ID %d\n", tid)
+		return
+	}
+
+	setNiceFn(t, nice)
+	kfmt.Fprintf(w, "renice: %s (%d) nice value set to %d\n", t.Name(), tid, nice)
+}
+
+// cmdTaskset changes the CPU affinity mask of a thread. The mask is specified
+// as a hex number where bit N selects the processor with index N.
+func cmdTaskset(w io.Writer, args []string) {
+	tid, ok := parseInt(args[0], 0, 1<<32-1)
+	if !ok {
+		kfmt.Fprintf(w, "taskset: invalid thread ID %s\n", args[0])
+		return
+	}
+
+	mask, ok := parseHex(args[1])
+	if !ok || mask == 0 {
+		kfmt.Fprintf(w, "taskset: invalid affinity mask %s\n", args[1])
+		return
+	}
+
+	t := lookupThreadFn(uint32(tid))
+	if t == nil {
+		kfmt.Fprintf(w, "taskset: no thread with ID %d\n", tid)
+		return
+	}
+
+	if err := setAffinityFn(t, sched.AffinityMask(mask)); err != nil {
+		kfmt.Fprintf(w, "taskset: %s\n", err.Message)
+		return
+	}
+	kfmt.Fprintf(w, "taskset: %s (%d) affinity mask set to %x\n", t.Name(), tid, uint64(mask))
+}
+
+// burner holds the state of a thread spawned by the burn command.
+type burner struct {
+	deadline uint64
+	state    uint64
+	batches  uint64
+
+	// cpus contains the processors that ran the thread.
+	cpus sched.AffinityMask
+}
+
+// run spins until the tick count reaches the deadline, yielding after each
+// batch of iterations so that other threads keep running. As it does not
+// allocate memory, the thread may run on the application processors.
+func (b *burner) run() {
+	for ticksFn() < b.deadline {
+		for i := 0; i < burnBatch; i++ {
+			b.state = b.state*6364136223846793005 + 1442695040888963407
+		}
+		b.batches++
+		b.cpus |= 1 << uint(currentCPUFn())
+		yieldFn()
+	}
+}
+
+// currentCPU returns the index of the processor that runs the calling thread.
+func currentCPU() int {
+	return sched.Current().CPU()
+}
+
+// cmdBurn spawns the requested number of non-allocating threads that keep the
+// processors busy for the specified number of seconds. Idle processors steal
+// the threads from the run queues of busy ones. Once all threads exit, the
+// processors that ran each thread are reported.
+func cmdBurn(w io.Writer, args []string) {
+	count, ok := parseInt(args[0], 1, maxBurnThreads)
+	if !ok {
+		kfmt.Fprintf(w, "burn: thread count must be between 1 and %d\n", maxBurnThreads)
+		return
+	}
+
+	secs, ok := parseInt(args[1], 1, maxBurnSeconds)
+	if !ok {
+		kfmt.Fprintf(w, "burn: duration must be between 1 and %d seconds\n", maxBurnSeconds)
+		return
+	}
+
+	var (
+		deadline = ticksFn() + uint64(secs)*timer.Hz
+		burners  = make([]burner, count)
+		threads  = make([]*kthread.Thread, 0, count)
+	)
+	for i := range burners {
+		burners[i].deadline = deadline
+		th, err := spawnNonAllocatingFn("burn", burners[i].run)
+		if err != nil {
+			kfmt.Fprintf(w, "burn: %s\n", err.Message)
+			break
+		}
+		threads = append(threads, th)
+	}
+
+	for i, th := range threads {
+		_ = joinFn(th)
+		kfmt.Fprintf(w, "burn: thread %d ran %d batches on CPUs %x\n", i, burners[i].batches, uint64(burners[i].cpus))
+	}
+}
+
+// parseInt parses a decimal number with an optional sign that lies in the
+// range [min, max].
+func parseInt(s string, min, max int) (int, bool) {
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+
+	var val int
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, false
+		}
+
+		if val = val*10 + int(s[i]-'0'); val > max-min {
+			return 0, false
+		}
+	}
+
+	if neg {
+		val = -val
+	}
+	return val, len(s) != 0 && val >= min && val <= max
+}
+
+func cmdReboot(w io.Writer, _ []string) {
+	kfmt.Fprintf(w, "rebooting...\n")
+	rebootFn()
+	kfmt.Fprintf(w, "reboot: unable to reset the system\n")
+}
+
+func cmdExit(_ io.Writer, _ []string) {
+	active = false
+}
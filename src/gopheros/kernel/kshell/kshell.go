@@ -0,0 +1,242 @@
+// Package kshell implements a small interactive shell that runs on the console
+// and allows inspecting the kernel state without requiring a serial port.
+//
+// The shell is activated by pressing Ctrl+Alt+F12 or by passing the kshell
+// flag on the boot command line. Keystrokes are received from the input
+// subsystem and edited into a command line which is executed by the system
+// work queue once Enter is pressed. Commands read the kernel state via the
+// files exposed by procfs so the shell must be initialized after procfs is
+// mounted.
+package kshell
+
+import (
+	"gopheros/device/input"
+	"gopheros/device/tty"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/hal"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/workqueue"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxLineLen is the maximum length of a command line.
+	maxLineLen = 128
+
+	prompt = "kshell> "
+)
+
+// Bits of the modifier key state. Each modifier key is tracked separately so
+// that releasing one of two pressed keys does not clear the modifier.
+const (
+	modLeftShift uint8 = 1 << iota
+	modRightShift
+	modLeftCtrl
+	modRightCtrl
+	modLeftAlt
+	modRightAlt
+
+	modShift = modLeftShift | modRightShift
+	modCtrl  = modLeftCtrl | modRightCtrl
+	modAlt   = modLeftAlt | modRightAlt
+)
+
+var (
+	// active is set while the shell is accepting commands.
+	active bool
+
+	// busy is set by the input handler when a command is submitted and
+	// cleared once the command completes. Keystrokes are ignored in the
+	// meantime.
+	busy bool
+
+	mods     uint8
+	capsLock bool
+
+	line    [maxLineLen]byte
+	lineLen int
+
+	// pending holds the command line that is executed by runWork.
+	pending string
+	runWork = workqueue.NewWork(runPending)
+
+	// The following functions are used by tests to mock calls to the
+	// input, cmdline, workqueue, hal and kfmt packages.
+	addInputHandlerFn = input.AddHandler
+	cmdlineLookupFn   = cmdline.Lookup
+	enqueueWorkFn     = workqueue.Enqueue
+	activeTTYFn       = hal.ActiveTTY
+	outputSinkFn      = kfmt.GetOutputSink
+	grabKeyboardFn    = tty.GrabKeyboard
+)
+
+// Init registers the input handler that drives the shell. If the kshell flag
+// is present on the boot command line, the shell is activated immediately.
+// Init must be invoked after the hardware has been detected and procfs has
+// been mounted.
+func Init() {
+	addInputHandlerFn(handleEvent)
+
+	if _, found := cmdlineLookupFn("kshell"); found {
+		activate()
+	}
+}
+
+// output returns the writer for the shell output. The shell writes directly
+// to the active TTY, if one is available, so that its output does not end up
+// in the kernel log.
+func output() io.Writer {
+	if t := activeTTYFn(); t != nil {
+		return t
+	}
+
+	return outputSinkFn()
+}
+
+// activate enables the shell and displays the prompt. Once active, the shell
+// grabs the keyboard so that key presses are no longer passed to the console
+// line discipline.
+func activate() {
+	if active {
+		return
+	}
+
+	active, lineLen = true, 0
+	grabKeyboardFn(true)
+	kfmt.Fprintf(output(), "\nkernel debug shell; type help for a list of commands\n%s", prompt)
+}
+
+// handleEvent processes the key events reported by the input subsystem.
+func handleEvent(ev *input.Event) {
+	if ev.Type != input.EventKey {
+		return
+	}
+
+	pressed := ev.Value != 0
+	if bit := modifierBit(ev.Code); bit != 0 {
+		if pressed {
+			mods |= bit
+		} else {
+			mods &^= bit
+		}
+		return
+	}
+
+	if !pressed {
+		return
+	}
+
+	switch {
+	case ev.Code == input.KeyCapsLock:
+		capsLock = !capsLock
+	case ev.Code == input.KeyF12 && mods&modCtrl != 0 && mods&modAlt != 0:
+		activate()
+	case (ev.Code == input.KeyPageUp || ev.Code == input.KeyPageDown) && mods&modShift != 0:
+		scroll(ev.Code == input.KeyPageUp)
+	case active && !busy:
+		editLine(ev.Code)
+	}
+}
+
+// modifierBit returns the modifier state bit for a key or 0 if the key is not
+// a modifier.
+func modifierBit(code uint16) uint8 {
+	switch code {
+	case input.KeyLeftShift:
+		return modLeftShift
+	case input.KeyRightShift:
+		return modRightShift
+	case input.KeyLeftCtrl:
+		return modLeftCtrl
+	case input.KeyRightCtrl:
+		return modRightCtrl
+	case input.KeyLeftAlt:
+		return modLeftAlt
+	case input.KeyRightAlt:
+		return modRightAlt
+	}
+
+	return 0
+}
+
+// scroll pages through the scrollback buffer of the active TTY.
+func scroll(up bool) {
+	scroller, ok := activeTTYFn().(tty.Scroller)
+	if !ok {
+		return
+	}
+
+	if up {
+		scroller.PageUp()
+	} else {
+		scroller.PageDown()
+	}
+}
+
+// editLine applies a key press to the command line.
+func editLine(code uint16) {
+	w := output()
+
+	switch {
+	case code == input.KeyEnter || code == input.KeyKPEnter:
+		kfmt.Fprintf(w, "\n")
+		submit(string(line[:lineLen]))
+	case code == input.KeyBackspace:
+		if lineLen != 0 {
+			_, size := utf8.DecodeLastRune(line[:lineLen])
+			lineLen -= size
+			kfmt.Fprintf(w, "\b")
+		}
+	case mods&modCtrl != 0:
+		switch code {
+		case input.KeyC:
+			lineLen = 0
+			kfmt.Fprintf(w, "^C\n%s", prompt)
+		case input.KeyU:
+			for lineLen != 0 {
+				_, size := utf8.DecodeLastRune(line[:lineLen])
+				lineLen -= size
+				kfmt.Fprintf(w, "\b")
+			}
+		}
+	default:
+		// The right Alt key acts as AltGr
+		ch := input.ActiveKeymap().Rune(code, mods&modShift != 0, mods&modRightAlt != 0, capsLock)
+		if ch == 0 || lineLen+utf8.RuneLen(ch) > maxLineLen {
+			return
+		}
+
+		size := utf8.EncodeRune(line[lineLen:], ch)
+		kfmt.Fprintf(w, "%s", string(line[lineLen:lineLen+size]))
+		lineLen += size
+	}
+}
+
+// submit queues a command line for execution by the system work queue. If the
+// work queue is not available, the command is executed immediately.
+func submit(cmdLine string) {
+	lineLen = 0
+	if strings.TrimSpace(cmdLine) == "" {
+		kfmt.Fprintf(output(), prompt)
+		return
+	}
+
+	busy, pending = true, cmdLine
+	if !enqueueWorkFn(runWork) {
+		runPending()
+	}
+}
+
+// runPending executes the pending command line and displays the prompt once
+// the command completes.
+func runPending() {
+	w := output()
+	execute(w, pending)
+
+	if active {
+		kfmt.Fprintf(w, prompt)
+	}
+	busy = false
+}
@@ -0,0 +1,899 @@
+package kshell
+
+import (
+	"bytes"
+	"gopheros/device/input"
+	"gopheros/device/input/ps2"
+	"gopheros/device/pci"
+	"gopheros/device/pmu"
+	"gopheros/device/tty"
+	"gopheros/device/video/console"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/hal"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/kthread"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/net"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/trace"
+	"gopheros/kernel/vfs"
+	"gopheros/kernel/workqueue"
+	"io"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	addInputHandlerFn = input.AddHandler
+	cmdlineLookupFn = cmdline.Lookup
+	enqueueWorkFn = workqueue.Enqueue
+	activeTTYFn = hal.ActiveTTY
+	outputSinkFn = kfmt.GetOutputSink
+	grabKeyboardFn = tty.GrabKeyboard
+	readFileFn = vfs.ReadFile
+	readDirFn = vfs.ReadDir
+	pciDevicesFn = pci.Devices
+	visitPageTableEntriesFn = vmm.VisitPageTableEntries
+	translateFn = vmm.Translate
+	rebootFn = ps2.Reboot
+	pingFn = net.Ping
+	sleepFn = timer.Sleep
+	traceEnableFn = trace.Enable
+	traceDisableFn = trace.Disable
+	traceClearFn = trace.Clear
+	startSamplingFn = pmu.StartSampling
+	stopSamplingFn = pmu.StopSampling
+	setConsoleModeFn = hal.SetConsoleMode
+	screenshotFn = hal.Screenshot
+	serialConsoleFn = serialConsole
+	lookupThreadFn = sched.LookupThread
+	setNiceFn = (*sched.Thread).SetNice
+	setAffinityFn = (*sched.Thread).SetAffinity
+	selectClocksourceFn = timer.SelectClocksource
+	ticksFn = timer.Ticks
+	yieldFn = sched.Yield
+	currentCPUFn = currentCPU
+	spawnNonAllocatingFn = kthread.SpawnNonAllocating
+	joinFn = (*kthread.Thread).Join
+
+	active, busy, mods, capsLock, lineLen, pending = false, false, 0, false, 0, ""
+}
+
+// mockTTY records the output written to it and the scroll requests.
+type mockTTY struct {
+	bytes.Buffer
+	scrolls []string
+}
+
+func (t *mockTTY) AttachTo(console.Device)          {}
+func (t *mockTTY) State() tty.State                 { return tty.StateActive }
+func (t *mockTTY) SetState(tty.State)               {}
+func (t *mockTTY) CursorPosition() (uint32, uint32) { return 1, 1 }
+func (t *mockTTY) SetCursorPosition(uint32, uint32) {}
+func (t *mockTTY) PageUp()                          { t.scrolls = append(t.scrolls, "up") }
+func (t *mockTTY) PageDown()                        { t.scrolls = append(t.scrolls, "down") }
+
+// press reports a key press followed by a key release.
+func press(code uint16) {
+	handleEvent(&input.Event{Type: input.EventKey, Code: code, Value: 1})
+	handleEvent(&input.Event{Type: input.EventKey, Code: code, Value: 0})
+}
+
+// chord presses a key while holding down the specified modifiers.
+func chord(code uint16, modifiers ...uint16) {
+	for _, mod := range modifiers {
+		handleEvent(&input.Event{Type: input.EventKey, Code: mod, Value: 1})
+	}
+	press(code)
+	for _, mod := range modifiers {
+		handleEvent(&input.Event{Type: input.EventKey, Code: mod, Value: 0})
+	}
+}
+
+// typeLine types a string using the active keymap followed by Enter.
+func typeLine(s string) {
+	km := input.ActiveKeymap()
+	for _, ch := range s {
+		for code := uint16(0); code < input.NumKeyCodes; code++ {
+			switch ch {
+			case km.Rune(code, false, false, false):
+				press(code)
+			case km.Rune(code, true, false, false):
+				chord(code, input.KeyLeftShift)
+			case km.Rune(code, false, true, false):
+				chord(code, input.KeyRightAlt)
+			default:
+				continue
+			}
+			break
+		}
+	}
+	press(input.KeyEnter)
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		buf      bytes.Buffer
+		handlers int
+		grabbed  bool
+	)
+
+	activeTTYFn = func() tty.Device { return nil }
+	outputSinkFn = func() io.Writer { return &buf }
+	addInputHandlerFn = func(input.Handler) { handlers++ }
+	grabKeyboardFn = func(grab bool) { grabbed = grab }
+
+	for specIndex, flag := range []bool{false, true} {
+		active, grabbed = false, false
+		buf.Reset()
+		cmdlineLookupFn = func(name string) (string, bool) { return "", flag && name == "kshell" }
+
+		Init()
+
+		if handlers != specIndex+1 {
+			t.Errorf("[spec %d] expected an input handler to be registered", specIndex)
+		}
+
+		if active != flag || strings.HasSuffix(buf.String(), prompt) != flag {
+			t.Errorf("[spec %d] expected shell active state to be %t; got %t with output %q", specIndex, flag, active, buf.String())
+		}
+
+		if grabbed != flag {
+			t.Errorf("[spec %d] expected keyboard grab state to be %t; got %t", specIndex, flag, grabbed)
+		}
+	}
+}
+
+func TestLineEditing(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		out      mockTTY
+		executed []string
+		enqueued int
+	)
+
+	activeTTYFn = func() tty.Device { return &out }
+	readFileFn = func(path string) ([]byte, *kernel.Error) {
+		executed = append(executed, path)
+		return nil, nil
+	}
+	enqueueWorkFn = func(w *workqueue.Work) bool {
+		enqueued++
+		return false
+	}
+
+	// Keys are ignored until the shell is activated via the hotkey
+	typeLine("cat /a")
+	if out.Len() != 0 || len(executed) != 0 {
+		t.Fatalf("expected input to be ignored while the shell is inactive; got output %q", out.String())
+	}
+
+	chord(input.KeyF12, input.KeyLeftCtrl, input.KeyRightAlt)
+	if !active {
+		t.Fatal("expected hotkey to activate the shell")
+	}
+
+	out.Reset()
+	typeLine("cat /Etc")
+	press(input.KeyCapsLock)
+	typeLine("CAT /Etc")
+	press(input.KeyCapsLock)
+
+	// Backspace, Ctrl+U and Ctrl+C discard characters
+	for _, code := range []uint16{input.KeyC, input.KeyA, input.KeyX, input.KeyBackspace, input.KeyT} {
+		press(code)
+	}
+	press(input.KeySpace)
+	press(input.KeyX)
+	chord(input.KeyU, input.KeyLeftCtrl)
+	typeLine("cat /b")
+	typeLine("ls")
+	chord(input.KeyC, input.KeyRightCtrl)
+	typeLine("   ")
+
+	if exp := "/Etc /eTC /b"; strings.Join(executed, " ") != exp {
+		t.Fatalf("expected commands to be executed for %q; got %q", exp, strings.Join(executed, " "))
+	}
+
+	if enqueued != 4 {
+		t.Fatalf("expected 4 commands to be submitted to the work queue; got %d", enqueued)
+	}
+
+	if !strings.Contains(out.String(), "cax\bt x\b\b\b\b\bcat /b\n") || !strings.Contains(out.String(), "^C\n"+prompt+"   \n"+prompt) {
+		t.Fatalf("unexpected echoed output %q", out.String())
+	}
+
+	// Shift+PgUp/PgDn page through the scrollback buffer
+	chord(input.KeyPageUp, input.KeyRightShift)
+	chord(input.KeyPageDown, input.KeyLeftShift)
+	press(input.KeyPageUp)
+	if exp := "up down"; strings.Join(out.scrolls, " ") != exp {
+		t.Fatalf("expected scroll requests %q; got %q", exp, strings.Join(out.scrolls, " "))
+	}
+
+	// Non-key events and keys without a character are ignored
+	out.Reset()
+	handleEvent(&input.Event{Type: input.EventRel, Code: input.RelX, Value: 1})
+	press(input.KeyF1)
+	press(input.KeyEsc)
+	press(input.KeyPause)
+	if out.Len() != 0 {
+		t.Fatalf("expected no output; got %q", out.String())
+	}
+
+	// The line length is capped
+	for i := 0; i < maxLineLen+10; i++ {
+		press(input.KeyA)
+	}
+	if lineLen != maxLineLen || out.Len() != maxLineLen {
+		t.Fatalf("expected line to be capped to %d characters; got %d", maxLineLen, lineLen)
+	}
+}
+
+func TestLineEditingWithKeymap(t *testing.T) {
+	defer func() {
+		input.SetKeymap(nil)
+		restoreMocks()
+	}()
+
+	km, err := input.ParseKeymap("test", []byte("16 +q Q @\n26 +U+00fc U+00DC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	input.SetKeymap(km)
+
+	var (
+		out      mockTTY
+		executed []string
+	)
+
+	activeTTYFn = func() tty.Device { return &out }
+	readFileFn = func(path string) ([]byte, *kernel.Error) {
+		executed = append(executed, path)
+		return nil, nil
+	}
+	enqueueWorkFn = func(*workqueue.Work) bool { return false }
+
+	activate()
+	out.Reset()
+
+	// Multi-byte characters are erased as a whole
+	press(input.KeyLeftBrace)
+	press(input.KeyBackspace)
+	typeLine("cat /@Ü")
+
+	if exp := "/@Ü"; strings.Join(executed, " ") != exp {
+		t.Fatalf("expected commands to be executed for %q; got %q", exp, strings.Join(executed, " "))
+	}
+
+	if exp := "ü\bcat /@Ü\n"; !strings.HasPrefix(out.String(), exp) {
+		t.Fatalf("expected echoed output to start with %q; got %q", exp, out.String())
+	}
+}
+
+func TestDeferredExecution(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		buf  bytes.Buffer
+		work *workqueue.Work
+	)
+
+	activeTTYFn = func() tty.Device { return nil }
+	outputSinkFn = func() io.Writer { return &buf }
+	enqueueWorkFn = func(w *workqueue.Work) bool {
+		work = w
+		return true
+	}
+
+	activate()
+	typeLine("exit")
+
+	if work != runWork || !busy || pending != "exit" {
+		t.Fatalf("expected command to be queued; got busy=%t, pending=%q", busy, pending)
+	}
+
+	// Input is ignored while a command is pending
+	buf.Reset()
+	typeLine("help")
+	if buf.Len() != 0 {
+		t.Fatalf("expected input to be ignored while busy; got %q", buf.String())
+	}
+
+	runPending()
+	if busy || active || buf.Len() != 0 {
+		t.Fatalf("expected exit to close the shell without displaying a prompt; got %q", buf.String())
+	}
+}
+
+func TestCommands(t *testing.T) {
+	defer restoreMocks()
+
+	files := map[string]string{
+		"/proc/meminfo":    "MemTotal: 4096 kB\n",
+		"/proc/devices":    "pci 0.0.1 active\n",
+		"/proc/irqstats":   "VECTOR GSI HANDLERS\n",
+		"/proc/interrupts": "VECTOR GSI HANDLER\n",
+		"/proc/runqueue":   "TID STATE NAME\n",
+		"/proc/sched":      "TID NICE STATE NAME\n",
+		"/proc/kmsg":       "booting\n",
+		"/proc/net/arp":    "IP ADDRESS\n",
+		"/proc/acpi/APIC":  "APIC",
+		"/proc/acpi/SSDT":  "SSDT\x00\x01gopher-os-table!",
+	}
+
+	readFileFn = func(path string) ([]byte, *kernel.Error) {
+		if data, ok := files[path]; ok {
+			return []byte(data), nil
+		}
+		return nil, vfs.ErrNotFound
+	}
+
+	readDirFn = func(path string) ([]vfs.FileInfo, *kernel.Error) {
+		switch path {
+		case "/proc/acpi":
+			return []vfs.FileInfo{{Name: "APIC"}, {Name: "FACP"}, {Name: "SSDT"}}, nil
+		case "/":
+			return []vfs.FileInfo{
+				{Name: "bin", Mode: vfs.ModeDir | 0755},
+				{Name: "init", Size: 1234, Mode: 0644},
+				{Name: "sh", Mode: vfs.ModeSymlink | 0777},
+			}, nil
+		}
+		return nil, vfs.ErrNotDir
+	}
+
+	pciDevicesFn = func() []*pci.Device {
+		return []*pci.Device{
+			{Bus: 0, Slot: 0x1f, Func: 2, VendorID: 0x8086, DeviceID: 0x2922, ClassCode: 1, Subclass: 6, ProgIF: 1},
+		}
+	}
+
+	visitPageTableEntriesFn = func(addr uintptr, visitor func(uint8, uintptr)) {
+		visitor(0, uintptr(vmm.FlagPresent|vmm.FlagRW)|0x1000)
+		if addr == 0xffff800000000000 {
+			visitor(1, uintptr(vmm.FlagPresent|vmm.FlagHugePage|vmm.FlagNoExecute))
+		} else {
+			visitor(1, 0)
+		}
+	}
+
+	translateFn = func(addr uintptr) (uintptr, *kernel.Error) {
+		if addr == 0xffff800000000000 {
+			return 0x40000000, nil
+		}
+		return 0, vmm.ErrInvalidMapping
+	}
+
+	var rebooted bool
+	rebootFn = func() { rebooted = true }
+
+	specs := []struct {
+		cmd string
+		exp string
+	}{
+		{"mem", "MemTotal: 4096 kB\n"},
+		{"lsdev", "pci 0.0.1 active\n"},
+		{"lsirq", "VECTOR GSI HANDLERS\n"},
+		{"lsirq handlers", "VECTOR GSI HANDLER\n"},
+		{"lsirq all", "usage: lsirq [handlers]\n"},
+		{"ps", "TID STATE NAME\n"},
+		{"top", "TID NICE STATE NAME\n"},
+		{"dmesg", "booting\n"},
+		{"arp", "IP ADDRESS\n"},
+		{"cat /missing", "/missing: " + vfs.ErrNotFound.Message + "\n"},
+		{"cat", "usage: cat PATH\n"},
+		{"ls", "d755          0 bin\n-644       1234 init\nl777          0 sh\n"},
+		{"ls /etc", "/etc: " + vfs.ErrNotDir.Message + "\n"},
+		{"lspci", "ADDRESS  ID        CLASS\n00:1f.2  8086:2922 010601\n"},
+		{"acpi", "APIC 4 bytes\nFACP: " + vfs.ErrNotFound.Message + "\nSSDT 22 bytes\n"},
+		{"acpi dump APIC", "APIC 4 bytes\n00000000  41 50 49 43" + strings.Repeat("   ", 12) + "   |APIC|\n"},
+		{
+			"acpi dump SSDT",
+			"SSDT 22 bytes\n" +
+				"00000000  53 53 44 54 00 01 67 6f  70 68 65 72 2d 6f 73 2d  |SSDT..gopher-os-|\n" +
+				"00000010  74 61 62 6c 65 21" + strings.Repeat("   ", 10) + "   |table!|\n",
+		},
+		{"acpi dump DSDT", "acpi: DSDT: " + vfs.ErrNotFound.Message + "\n"},
+		{"acpi list", "usage: acpi [dump [SIG]]\n"},
+		{"acpi dump SSDT DSDT", "usage: acpi [dump [SIG]]\n"},
+		{"pt 0xFFFF800000000000", "PML4 0x0000000000001003 P RW\nPDPT 0x8000000000000081 P PS NX\n0xffff800000000000 -> 0x40000000\n"},
+		{"pt 1000", "PML4 0x0000000000001003 P RW\nPDPT 0x0000000000000000\n0x1000: " + vmm.ErrInvalidMapping.Message + "\n"},
+		{"pt 0xzz", "pt: invalid address 0xzz\n"},
+		{"pt 0x", "pt: invalid address 0x\n"},
+		{"pt 12345678123456780", "pt: invalid address 12345678123456780\n"},
+		{"reboot", "rebooting...\nreboot: unable to reset the system\n"},
+		{"frobnicate now", "frobnicate: unknown command; type help for a list of commands\n"},
+		{"", ""},
+	}
+
+	for specIndex, spec := range specs {
+		var buf bytes.Buffer
+		execute(&buf, spec.cmd)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q to output:\n%q\ngot:\n%q", specIndex, spec.cmd, spec.exp, got)
+		}
+	}
+
+	if !rebooted {
+		t.Error("expected reboot command to reset the system")
+	}
+
+	var buf bytes.Buffer
+	execute(&buf, "help")
+	for _, cmd := range commands {
+		if !strings.Contains(buf.String(), cmd.name+" ") {
+			t.Errorf("expected help output to list the %s command", cmd.name)
+		}
+	}
+}
+
+func TestClocksourceCommand(t *testing.T) {
+	defer restoreMocks()
+
+	var selected []string
+	selectClocksourceFn = func(name string) *kernel.Error {
+		if name != "hpet" {
+			return &kernel.Error{Module: "timer", Message: "unknown clocksource"}
+		}
+		selected = append(selected, name)
+		return nil
+	}
+	readFileFn = func(path string) ([]byte, *kernel.Error) {
+		if path == "/proc/clocksource" {
+			return []byte("NAME     RATING FREQ(Hz)     ACTIVE\nhpet     250    100000000    *\n"), nil
+		}
+		return nil, vfs.ErrNotFound
+	}
+
+	specs := []struct {
+		cmd string
+		exp string
+	}{
+		{"clocksource", "NAME     RATING FREQ(Hz)     ACTIVE\nhpet     250    100000000    *\n"},
+		{"clocksource hpet", "clocksource: switched to hpet\n"},
+		{"clocksource sundial", "clocksource: unknown clocksource\n"},
+		{"clocksource hpet tsc", "usage: clocksource [NAME]\n"},
+	}
+
+	for specIndex, spec := range specs {
+		var buf bytes.Buffer
+		execute(&buf, spec.cmd)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q to output:\n%q\ngot:\n%q", specIndex, spec.cmd, spec.exp, got)
+		}
+	}
+
+	if len(selected) != 1 || selected[0] != "hpet" {
+		t.Errorf("expected hpet to be selected once; got %v", selected)
+	}
+}
+
+func TestTraceCommand(t *testing.T) {
+	defer restoreMocks()
+
+	var calls []string
+	traceEnableFn = func() { calls = append(calls, "enable") }
+	traceDisableFn = func() { calls = append(calls, "disable") }
+	traceClearFn = func() { calls = append(calls, "clear") }
+	readFileFn = func(path string) ([]byte, *kernel.Error) {
+		if path == "/proc/trace" {
+			return []byte("tracing: disabled\n"), nil
+		}
+		return nil, vfs.ErrNotFound
+	}
+
+	specs := []struct {
+		cmd     string
+		exp     string
+		expCall string
+	}{
+		{"trace", "tracing: disabled\n", ""},
+		{"trace on", "trace: on\n", "enable"},
+		{"trace off", "trace: off\n", "disable"},
+		{"trace clear", "trace: clear\n", "clear"},
+		{"trace start", "usage: trace [on|off|clear]\n", ""},
+		{"trace on now", "usage: trace [on|off|clear]\n", ""},
+	}
+
+	for specIndex, spec := range specs {
+		calls = nil
+
+		var buf bytes.Buffer
+		execute(&buf, spec.cmd)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q to output:\n%q\ngot:\n%q", specIndex, spec.cmd, spec.exp, got)
+		}
+
+		if gotCall := strings.Join(calls, ","); gotCall != spec.expCall {
+			t.Errorf("[spec %d] expected %q to call %q; got %q", specIndex, spec.cmd, spec.expCall, gotCall)
+		}
+	}
+}
+
+func TestPerfCommand(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		sampled pmu.Event
+		period  uint64
+		stopped bool
+
+		errSamplingMock = &kernel.Error{Module: "pmu", Message: "event is not supported by this CPU"}
+	)
+	startSamplingFn = func(ev pmu.Event, p uint64) *kernel.Error {
+		if p == 13 {
+			return errSamplingMock
+		}
+		sampled, period = ev, p
+		return nil
+	}
+	stopSamplingFn = func() { stopped = true }
+	readFileFn = func(path string) ([]byte, *kernel.Error) {
+		if path == "/proc/pmu" {
+			return []byte("EVENT TOTAL\n"), nil
+		}
+		return nil, vfs.ErrNotFound
+	}
+
+	specs := []struct {
+		cmd string
+		exp string
+	}{
+		{"perf", "EVENT TOTAL\n"},
+		{"perf cache-misses 10000", "perf: sampling cache-misses every 10000 events\n"},
+		{"perf stop", "perf: sampling stopped\n"},
+		{"perf branches 100", "perf: branches: unknown event name\n"},
+		{"perf cycles 0", "perf: invalid period 0\n"},
+		{"perf cycles 1x", "perf: invalid period 1x\n"},
+		{"perf cycles 4294967296", "perf: invalid period 4294967296\n"},
+		{"perf cycles 13", "perf: " + errSamplingMock.Message + "\n"},
+		{"perf start", "usage: perf [EVENT PERIOD | stop]\n"},
+	}
+
+	for specIndex, spec := range specs {
+		var buf bytes.Buffer
+		execute(&buf, spec.cmd)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q to output:\n%q\ngot:\n%q", specIndex, spec.cmd, spec.exp, got)
+		}
+	}
+
+	if sampled != pmu.EventCacheMisses || period != 10000 || !stopped {
+		t.Fatalf("expected cache misses to be sampled every 10000 events and sampling to be stopped; got event %d, period %d, stopped %t", sampled, period, stopped)
+	}
+}
+
+func TestModeCommand(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		width, height uint32
+		bpp           uint8
+
+		errModeMock = &kernel.Error{Module: "vesa_fb_console", Message: "display mode not supported by the display adapter"}
+	)
+	setConsoleModeFn = func(w, h uint32, b uint8) *kernel.Error {
+		if w == 13 {
+			return errModeMock
+		}
+		width, height, bpp = w, h, b
+		return nil
+	}
+
+	specs := []struct {
+		cmd        string
+		exp        string
+		expW, expH uint32
+		expBpp     uint8
+	}{
+		{"mode 1024x768", "mode: switched to 1024x768\n", 1024, 768, 0},
+		{"mode 800x600x16", "mode: switched to 800x600\n", 800, 600, 16},
+		{"mode 13x600", "mode: " + errModeMock.Message + "\n", 800, 600, 16},
+		{"mode 1024", "mode: invalid mode 1024\n", 800, 600, 16},
+		{"mode 1024x768x32x1", "mode: invalid mode 1024x768x32x1\n", 800, 600, 16},
+		{"mode 0x768", "mode: invalid mode 0x768\n", 800, 600, 16},
+		{"mode 65536x768", "mode: invalid mode 65536x768\n", 800, 600, 16},
+		{"mode 1024x768x64", "mode: invalid mode 1024x768x64\n", 800, 600, 16},
+		{"mode 1024xabc", "mode: invalid mode 1024xabc\n", 800, 600, 16},
+		{"mode", "usage: mode WxH[xBPP]\n", 800, 600, 16},
+	}
+
+	for specIndex, spec := range specs {
+		var buf bytes.Buffer
+		execute(&buf, spec.cmd)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q to output:\n%q\ngot:\n%q", specIndex, spec.cmd, spec.exp, got)
+		}
+
+		if width != spec.expW || height != spec.expH || bpp != spec.expBpp {
+			t.Errorf("[spec %d] expected mode to be %dx%dx%d; got %dx%dx%d", specIndex, spec.expW, spec.expH, spec.expBpp, width, height, bpp)
+		}
+	}
+}
+
+func TestReniceCommand(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		stack  = make([]uintptr, 64)
+		lo     = uintptr(unsafe.Pointer(&stack[0]))
+		worker = sched.NewThread("kworker", lo, lo+uintptr(len(stack))*8, func() {})
+		nice   = sched.DefaultNice
+	)
+
+	lookupThreadFn = func(id uint32) *sched.Thread {
+		if id == 7 {
+			return worker
+		}
+		return nil
+	}
+	setNiceFn = func(_ *sched.Thread, value int) { nice = value }
+
+	specs := []struct {
+		cmd     string
+		exp     string
+		expNice int
+	}{
+		{"renice 7 -5", "renice: kworker (7) nice value set to -5\n", -5},
+		{"renice 7 19", "renice: kworker (7) nice value set to 19\n", 19},
+		{"renice 7 20", "renice: nice value must be between -20 and 19\n", 19},
+		{"renice 7 -21", "renice: nice value must be between -20 and 19\n", 19},
+		{"renice 7 -", "renice: nice value must be between -20 and 19\n", 19},
+		{"renice 7 1x", "renice: nice value must be between -20 and 19\n", 19},
+		{"renice 4294967296 0", "renice: invalid thread ID 4294967296\n", 19},
+		{"renice -1 0", "renice: invalid thread ID -1\n", 19},
+		{"renice 424242 0", "renice: no thread with ID 424242\n", 19},
+		{"renice 1", "usage: renice TID NICE\n", 19},
+	}
+
+	for specIndex, spec := range specs {
+		var buf bytes.Buffer
+		execute(&buf, spec.cmd)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q to output:\n%q\ngot:\n%q", specIndex, spec.cmd, spec.exp, got)
+		}
+
+		if nice != spec.expNice {
+			t.Errorf("[spec %d] expected nice value to be %d; got %d", specIndex, spec.expNice, nice)
+		}
+	}
+}
+
+func TestTasksetCommand(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		stack  = make([]uintptr, 64)
+		lo     = uintptr(unsafe.Pointer(&stack[0]))
+		worker = sched.NewThread("kworker", lo, lo+uintptr(len(stack))*8, func() {})
+		mask   = sched.AffinityBoot
+	)
+
+	lookupThreadFn = func(id uint32) *sched.Thread {
+		if id == 7 {
+			return worker
+		}
+		return nil
+	}
+	setAffinityFn = func(_ *sched.Thread, value sched.AffinityMask) *kernel.Error {
+		if value&0x3 == 0 {
+			return &kernel.Error{Module: "sched", Message: "affinity mask does not include any online processor"}
+		}
+		mask = value
+		return nil
+	}
+
+	specs := []struct {
+		cmd     string
+		exp     string
+		expMask sched.AffinityMask
+	}{
+		{"taskset 7 0x3", "taskset: kworker (7) affinity mask set to 3\n", 0x3},
+		{"taskset 7 2", "taskset: kworker (7) affinity mask set to 2\n", 0x2},
+		{"taskset 7 4", "taskset: affinity mask does not include any online processor\n", 0x2},
+		{"taskset 7 0", "taskset: invalid affinity mask 0\n", 0x2},
+		{"taskset 7 xyz", "taskset: invalid affinity mask xyz\n", 0x2},
+		{"taskset -1 1", "taskset: invalid thread ID -1\n", 0x2},
+		{"taskset 424242 1", "taskset: no thread with ID 424242\n", 0x2},
+		{"taskset 7", "usage: taskset TID MASK\n", 0x2},
+	}
+
+	for specIndex, spec := range specs {
+		var buf bytes.Buffer
+		execute(&buf, spec.cmd)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q to output:\n%q\ngot:\n%q", specIndex, spec.cmd, spec.exp, got)
+		}
+
+		if mask != spec.expMask {
+			t.Errorf("[spec %d] expected affinity mask to be %x; got %x", specIndex, spec.expMask, mask)
+		}
+	}
+}
+
+func TestBurnCommand(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		ticks  uint64
+		cpu    int
+		spawns int
+		joins  int
+		fns    []func()
+	)
+
+	// Each batch advances the tick count by one second and the threads
+	// alternate between processors 1 and 2.
+	ticksFn = func() uint64 { return ticks }
+	currentCPUFn = func() int { return cpu }
+	yieldFn = func() {
+		ticks += timer.Hz
+		cpu = 3 - cpu
+	}
+	spawnNonAllocatingFn = func(name string, fn func()) (*kthread.Thread, *kernel.Error) {
+		if spawns++; spawns > 2 {
+			return nil, &kernel.Error{Module: "kthread", Message: "out of memory"}
+		}
+		fns = append(fns, fn)
+		return &kthread.Thread{}, nil
+	}
+	joinFn = func(_ *kthread.Thread) *kernel.Error {
+		fns[joins]()
+		joins++
+		return nil
+	}
+
+	specs := []struct {
+		cmd string
+		exp string
+	}{
+		{"burn 2 2", "burn: thread 0 ran 2 batches on CPUs 6\nburn: thread 1 ran 0 batches on CPUs 0\n"},
+		{"burn 3 1", "burn: out of memory\nburn: thread 0 ran 1 batches on CPUs 2\nburn: thread 1 ran 0 batches on CPUs 0\n"},
+		{"burn 0 1", "burn: thread count must be between 1 and 64\n"},
+		{"burn 1 61", "burn: duration must be between 1 and 60 seconds\n"},
+		{"burn 1", "usage: burn COUNT SECONDS\n"},
+	}
+
+	for specIndex, spec := range specs {
+		var buf bytes.Buffer
+		ticks, cpu, spawns, joins, fns = 0, 1, 0, 0, nil
+		execute(&buf, spec.cmd)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q to output:\n%q\ngot:\n%q", specIndex, spec.cmd, spec.exp, got)
+		}
+	}
+}
+
+func TestScreenshotCommand(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		buf, serialBuf bytes.Buffer
+		expErr         = &kernel.Error{Module: "console", Message: "console cannot read back its framebuffer contents"}
+	)
+
+	serialConsoleFn = func() io.Writer { return nil }
+	execute(&buf, "screenshot")
+	if exp := "screenshot: no serial console; boot with console=ttyS0 to enable screenshots\n"; buf.String() != exp {
+		t.Fatalf("expected output %q; got %q", exp, buf.String())
+	}
+
+	serialConsoleFn = func() io.Writer { return &serialBuf }
+	screenshotFn = func(w io.Writer) *kernel.Error {
+		w.Write([]byte("P6\n1 1\n255\n\xff\x00\x80"))
+		return nil
+	}
+
+	buf.Reset()
+	execute(&buf, "screenshot")
+	if exp := "screenshot: image sent over the serial console\n"; buf.String() != exp {
+		t.Fatalf("expected output %q; got %q", exp, buf.String())
+	}
+
+	if exp := screenshotBeginMarker + "\nUDYKMSAxCjI1NQr/AIA=\n" + screenshotEndMarker + "\n"; serialBuf.String() != exp {
+		t.Fatalf("expected serial output %q; got %q", exp, serialBuf.String())
+	}
+
+	buf.Reset()
+	serialBuf.Reset()
+	screenshotFn = func(io.Writer) *kernel.Error { return expErr }
+	execute(&buf, "screenshot")
+	if exp := "screenshot: " + expErr.Message + "\n"; buf.String() != exp {
+		t.Fatalf("expected output %q; got %q", exp, buf.String())
+	}
+
+	if exp := screenshotBeginMarker + "\n" + screenshotEndMarker + "\n"; serialBuf.String() != exp {
+		t.Fatalf("expected serial output %q; got %q", exp, serialBuf.String())
+	}
+}
+
+func TestPingCommand(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		sleeps int
+		pings  []uint16
+	)
+	sleepFn = func(d timer.Duration) { sleeps++ }
+
+	specs := []struct {
+		cmd       string
+		ping      func(uint16) (timer.Duration, *kernel.Error)
+		exp       string
+		expSleeps int
+		expPings  int
+	}{
+		{
+			"ping 10.0.2.2 3",
+			func(seq uint16) (timer.Duration, *kernel.Error) {
+				if seq == 2 {
+					return 0, net.ErrTimeout
+				}
+				return timer.Duration(seq)*timer.Millisecond + 250*timer.Microsecond, nil
+			},
+			"reply from 10.0.2.2: icmp_seq=1 time=1.250 ms\n" +
+				"10.0.2.2: icmp_seq=2 " + net.ErrTimeout.Message + "\n" +
+				"reply from 10.0.2.2: icmp_seq=3 time=3.250 ms\n" +
+				"3 packets transmitted, 2 received\n",
+			2, 3,
+		},
+		{
+			"ping 10.0.2.2",
+			func(seq uint16) (timer.Duration, *kernel.Error) { return 0, nil },
+			"reply from 10.0.2.2: icmp_seq=1 time=0.000 ms\n" +
+				"reply from 10.0.2.2: icmp_seq=2 time=0.000 ms\n" +
+				"reply from 10.0.2.2: icmp_seq=3 time=0.000 ms\n" +
+				"reply from 10.0.2.2: icmp_seq=4 time=0.000 ms\n" +
+				"4 packets transmitted, 4 received\n",
+			pingCount - 1, pingCount,
+		},
+		{
+			"ping 8.8.8.8",
+			func(seq uint16) (timer.Duration, *kernel.Error) {
+				return 0, &kernel.Error{Module: "net", Message: "no route to host"}
+			},
+			"ping: no route to host\n0 packets transmitted, 0 received\n",
+			0, 1,
+		},
+		{"ping", nil, "usage: ping ADDR [COUNT]\n", 0, 0},
+		{"ping 10.0.2.2 1 2", nil, "usage: ping ADDR [COUNT]\n", 0, 0},
+		{"ping 10.0.2", nil, "ping: invalid address 10.0.2\n", 0, 0},
+		{"ping 10.0.2.2 0", nil, "ping: invalid count 0\n", 0, 0},
+		{"ping 10.0.2.2 65536", nil, "ping: invalid count 65536\n", 0, 0},
+		{"ping 10.0.2.2 -1", nil, "ping: invalid count -1\n", 0, 0},
+	}
+
+	for specIndex, spec := range specs {
+		sleeps, pings = 0, nil
+		pingFn = func(addr net.IPAddr, seq uint16, timeout timer.Duration) (timer.Duration, *kernel.Error) {
+			pings = append(pings, seq)
+			return spec.ping(seq)
+		}
+
+		var buf bytes.Buffer
+		execute(&buf, spec.cmd)
+
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q to output:\n%q\ngot:\n%q", specIndex, spec.cmd, spec.exp, got)
+		}
+
+		if sleeps != spec.expSleeps || len(pings) != spec.expPings {
+			t.Errorf("[spec %d] expected %d pings and %d sleeps; got %d and %d", specIndex, spec.expPings, spec.expSleeps, len(pings), sleeps)
+		}
+	}
+}
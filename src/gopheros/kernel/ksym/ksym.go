@@ -0,0 +1,159 @@
+// Package ksym provides access to the kernel symbol table that is embedded into
+// the .ksymtab section of the kernel image by tools/ksyms.
+package ksym
+
+import (
+	"gopheros/kernel"
+	"gopheros/multiboot"
+	"reflect"
+	"unsafe"
+)
+
+const (
+	// tableMagic identifies a populated symbol table ("KSYM").
+	tableMagic = 0x4d59534b
+
+	sectionName = ".ksymtab"
+)
+
+var (
+	// visitElfSectionsFn is used by tests and is automatically inlined
+	// by the compiler.
+	visitElfSectionsFn = multiboot.VisitElfSections
+
+	// entries and strtab point to the loaded symbol table contents.
+	entries []entry
+	strtab  []byte
+
+	errMissingTable = &kernel.Error{Module: "ksym", Message: "kernel image does not contain a symbol table"}
+	errInvalidTable = &kernel.Error{Module: "ksym", Message: "kernel symbol table is not populated or is corrupted"}
+)
+
+// header describes the layout of the symbol table header.
+type header struct {
+	magic      uint32
+	count      uint32
+	strtabOff  uint32
+	strtabSize uint32
+}
+
+// entry describes a symbol table entry. Entries are sorted by address and
+// nameOff is an offset to a NUL-terminated string in the table strings.
+type entry struct {
+	addr    uint64
+	size    uint32
+	nameOff uint32
+}
+
+// Symbol describes a code symbol defined by the kernel image.
+type Symbol struct {
+	Name string
+	Addr uintptr
+	Size uintptr
+}
+
+// Init locates the kernel symbol table and prepares it for use by Resolve.
+func Init() *kernel.Error {
+	var (
+		tableAddr uintptr
+		tableSize uint64
+	)
+
+	visitElfSectionsFn(func(name string, _ multiboot.ElfSectionFlag, address uintptr, size uint64) {
+		if name == sectionName {
+			tableAddr, tableSize = address, size
+		}
+	})
+
+	if tableSize == 0 {
+		return errMissingTable
+	}
+
+	return load(tableAddr, uintptr(tableSize))
+}
+
+// load validates the symbol table stored at the supplied address and sets up
+// the entries and strtab slices so they point to its contents.
+func load(addr, size uintptr) *kernel.Error {
+	var (
+		hdr        *header
+		headerSize = unsafe.Sizeof(*hdr)
+		entrySize  = unsafe.Sizeof(entry{})
+	)
+
+	if size < headerSize {
+		return errInvalidTable
+	}
+
+	hdr = (*header)(unsafe.Pointer(addr))
+	if hdr.magic != tableMagic ||
+		headerSize+uintptr(hdr.count)*entrySize > uintptr(hdr.strtabOff) ||
+		uintptr(hdr.strtabOff)+uintptr(hdr.strtabSize) > size {
+		return errInvalidTable
+	}
+
+	entries = *(*[]entry)(unsafe.Pointer(&reflect.SliceHeader{
+		Data: addr + headerSize,
+		Len:  int(hdr.count),
+		Cap:  int(hdr.count),
+	}))
+
+	strtab = *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Data: addr + uintptr(hdr.strtabOff),
+		Len:  int(hdr.strtabSize),
+		Cap:  int(hdr.strtabSize),
+	}))
+
+	return nil
+}
+
+// Resolve returns the symbol whose address range contains pc. If the symbol
+// table is not loaded or pc does not belong to any known symbol, Resolve
+// returns false. Resolve does not allocate any memory so it can be safely
+// used by the panic handler.
+func Resolve(pc uintptr) (Symbol, bool) {
+	// Find the first entry that starts after pc; the entry before it is
+	// the only one that may contain pc.
+	lo, hi := 0, len(entries)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if uintptr(entries[mid].addr) <= pc {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo == 0 {
+		return Symbol{}, false
+	}
+
+	e := &entries[lo-1]
+	if pc-uintptr(e.addr) >= uintptr(e.size) {
+		return Symbol{}, false
+	}
+
+	return Symbol{
+		Name: symbolName(e.nameOff),
+		Addr: uintptr(e.addr),
+		Size: uintptr(e.size),
+	}, true
+}
+
+// symbolName returns the NUL-terminated string at offset off in the symbol
+// table strings. The returned string shares its storage with the table.
+func symbolName(off uint32) string {
+	if int(off) >= len(strtab) {
+		return ""
+	}
+
+	end := int(off)
+	for ; end < len(strtab) && strtab[end] != 0; end++ {
+	}
+
+	var name string
+	nameHeader := (*reflect.StringHeader)(unsafe.Pointer(&name))
+	nameHeader.Data = uintptr(unsafe.Pointer(&strtab[off]))
+	nameHeader.Len = end - int(off)
+	return name
+}
@@ -0,0 +1,142 @@
+package ksym
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopheros/kernel"
+	"gopheros/multiboot"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	visitElfSectionsFn = multiboot.VisitElfSections
+	entries = nil
+	strtab = nil
+}
+
+type testSymbol struct {
+	name string
+	addr uint64
+	size uint32
+}
+
+// buildTable encodes symbols using the same format as tools/ksyms.
+func buildTable(symbols []testSymbol) []byte {
+	var entryBuf, strBuf, table bytes.Buffer
+	for _, sym := range symbols {
+		binary.Write(&entryBuf, binary.LittleEndian, sym.addr)
+		binary.Write(&entryBuf, binary.LittleEndian, sym.size)
+		binary.Write(&entryBuf, binary.LittleEndian, uint32(strBuf.Len()))
+		strBuf.WriteString(sym.name)
+		strBuf.WriteByte(0)
+	}
+
+	binary.Write(&table, binary.LittleEndian, uint32(tableMagic))
+	binary.Write(&table, binary.LittleEndian, uint32(len(symbols)))
+	binary.Write(&table, binary.LittleEndian, uint32(16+entryBuf.Len()))
+	binary.Write(&table, binary.LittleEndian, uint32(strBuf.Len()))
+	table.Write(entryBuf.Bytes())
+	table.Write(strBuf.Bytes())
+
+	return table.Bytes()
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	table := buildTable([]testSymbol{
+		{"rt0_64", 0x1000, 0x20},
+		{"main.main", 0x1020, 0x100},
+		{"gopheros/kernel/kmain.Kmain", 0x1200, 0x80},
+	})
+	tableAddr := uintptr(unsafe.Pointer(&table[0]))
+
+	visitElfSectionsFn = func(visitor multiboot.ElfSectionVisitor) {
+		visitor(".text", multiboot.ElfSectionExecutable, 0x1000, 0x1000)
+		visitor(sectionName, multiboot.ElfSectionAllocated, tableAddr, uint64(len(table)))
+	}
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		pc     uintptr
+		expOK  bool
+		expSym Symbol
+	}{
+		{0x0fff, false, Symbol{}},
+		{0x1000, true, Symbol{"rt0_64", 0x1000, 0x20}},
+		{0x101f, true, Symbol{"rt0_64", 0x1000, 0x20}},
+		{0x1020, true, Symbol{"main.main", 0x1020, 0x100}},
+		{0x1080, true, Symbol{"main.main", 0x1020, 0x100}},
+		// gap between main.main and Kmain
+		{0x1120, false, Symbol{}},
+		{0x1250, true, Symbol{"gopheros/kernel/kmain.Kmain", 0x1200, 0x80}},
+		{0x1280, false, Symbol{}},
+	}
+
+	for specIndex, spec := range specs {
+		sym, ok := Resolve(spec.pc)
+		if ok != spec.expOK || sym != spec.expSym {
+			t.Errorf("[spec %d] expected Resolve(0x%x) to return (%v, %t); got (%v, %t)", specIndex, spec.pc, spec.expSym, spec.expOK, sym, ok)
+		}
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	defer restoreMocks()
+
+	valid := buildTable([]testSymbol{{"main.main", 0x1000, 0x10}})
+	corrupt := func(fn func([]byte)) []byte {
+		table := append([]byte(nil), valid...)
+		fn(table)
+		return table
+	}
+
+	specs := []struct {
+		table  []byte
+		expErr *kernel.Error
+	}{
+		{nil, errMissingTable},
+		{make([]byte, 8), errInvalidTable},
+		// table not populated by tools/ksyms
+		{make([]byte, 64), errInvalidTable},
+		// entries overlap the string table
+		{corrupt(func(b []byte) { binary.LittleEndian.PutUint32(b[4:], 2) }), errInvalidTable},
+		// string table exceeds the section size
+		{corrupt(func(b []byte) { binary.LittleEndian.PutUint32(b[12:], 64) }), errInvalidTable},
+		{valid, nil},
+	}
+
+	for specIndex, spec := range specs {
+		table := spec.table
+		visitElfSectionsFn = func(visitor multiboot.ElfSectionVisitor) {
+			if len(table) != 0 {
+				visitor(sectionName, multiboot.ElfSectionAllocated, uintptr(unsafe.Pointer(&table[0])), uint64(len(table)))
+			}
+		}
+
+		if err := Init(); err != spec.expErr {
+			t.Errorf("[spec %d] expected to get error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
+
+func TestResolveWithoutTable(t *testing.T) {
+	defer restoreMocks()
+
+	if _, ok := Resolve(0x1000); ok {
+		t.Error("expected Resolve to fail when no symbol table is loaded")
+	}
+
+	strtab = []byte("name")
+	if got := symbolName(4); got != "" {
+		t.Errorf("expected out of range name offset to yield an empty string; got %q", got)
+	}
+
+	if got := symbolName(1); got != "ame" {
+		t.Errorf("expected unterminated name to be truncated at the end of the table; got %q", got)
+	}
+}
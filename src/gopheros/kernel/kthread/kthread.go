@@ -0,0 +1,192 @@
+// Package kthread provides an API for running background work in kernel
+// threads.
+package kthread
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/rand"
+	"gopheros/kernel/sched"
+)
+
+const (
+	// StackSize is the usable stack size for each kernel thread.
+	StackSize = 16384
+
+	// stackGuardSize is the size of the unmapped region below each thread
+	// stack. Overflowing the stack triggers a page fault instead of
+	// silently corrupting adjacent memory.
+	stackGuardSize = mm.PageSize
+
+	// stackJitterPages is the number of possible page offsets for the
+	// start of each thread stack. Randomizing the stack placement prevents
+	// the address of a stack from being inferred from the address of
+	// another.
+	stackJitterPages = 64
+)
+
+var (
+	errJoinSelf = &kernel.Error{Module: "kthread", Message: "thread cannot join itself"}
+
+	// threads tracks the live threads spawned via Spawn, keyed by their
+	// scheduler thread ID.
+	threads = make(map[uint32]*Thread)
+
+	// freeStacks holds the base addresses of stacks that belonged to
+	// exited threads. As vmm.EarlyReserveRegion does not support releasing
+	// regions, stacks are recycled by subsequent calls to Spawn.
+	freeStacks []uintptr
+
+	// The following functions are used by tests to mock calls to the mm,
+	// vmm, sched and rand packages.
+	earlyReserveRegionFn = vmm.EarlyReserveRegion
+	mapFn                = vmm.Map
+	allocFrameFn         = mm.AllocFrame
+	newThreadFn          = sched.NewThread
+	readyFn              = sched.Ready
+	blockFn              = sched.Block
+	exitFn               = sched.Exit
+	currentFn            = sched.Current
+	markNonAllocatingFn  = (*sched.Thread).MarkNonAllocating
+	setAffinityFn        = (*sched.Thread).SetAffinity
+	randUint32Fn         = rand.Uint32
+)
+
+// Thread is a kernel thread created by Spawn.
+type Thread struct {
+	t *sched.Thread
+
+	// stackBase points to the start of the reserved stack region,
+	// including the guard page.
+	stackBase uintptr
+
+	exited  bool
+	joiners []*sched.Thread
+}
+
+// ID returns the unique ID of the thread.
+func (t *Thread) ID() uint32 {
+	return t.t.ID()
+}
+
+// Name returns the name that was passed to Spawn.
+func (t *Thread) Name() string {
+	return t.t.Name()
+}
+
+// Exited returns true if the thread has terminated.
+func (t *Thread) Exited() bool {
+	return t.exited
+}
+
+// Join blocks the calling thread until t terminates. Join returns immediately
+// if t has already terminated.
+func (t *Thread) Join() *kernel.Error {
+	if currentFn() == t.t {
+		return errJoinSelf
+	}
+
+	for !t.exited {
+		t.joiners = append(t.joiners, currentFn())
+		blockFn()
+	}
+
+	return nil
+}
+
+// Spawn allocates a stack for a new kernel thread that executes fn and makes
+// it runnable. The thread terminates when fn returns or when it calls Exit.
+func Spawn(name string, fn func()) (*Thread, *kernel.Error) {
+	return spawn(name, fn, false)
+}
+
+// SpawnNonAllocating behaves like Spawn but allows the thread to run on any
+// online processor, including the application processors. As the Go heap is
+// not safe for use by the application processors, fn must not allocate memory,
+// block on wait queues or invoke code that does so.
+func SpawnNonAllocating(name string, fn func()) (*Thread, *kernel.Error) {
+	return spawn(name, fn, true)
+}
+
+func spawn(name string, fn func(), nonAllocating bool) (*Thread, *kernel.Error) {
+	stackBase, err := allocStack()
+	if err != nil {
+		return nil, err
+	}
+
+	stackLo := stackBase + stackGuardSize
+	t := &Thread{
+		t:         newThreadFn(name, stackLo, stackLo+StackSize, fn),
+		stackBase: stackBase,
+	}
+	if nonAllocating {
+		markNonAllocatingFn(t.t)
+		if err = setAffinityFn(t.t, sched.AffinityAll); err != nil {
+			freeStacks = append(freeStacks, stackBase)
+			return nil, err
+		}
+	}
+
+	threads[t.ID()] = t
+	readyFn(t.t)
+	return t, nil
+}
+
+// Exit terminates the calling thread. It never returns.
+func Exit() {
+	exitFn()
+}
+
+// allocStack returns the base address of a region with an unmapped guard page
+// followed by StackSize bytes of mapped memory. A random number of unmapped
+// pages is left below the guard page of each newly allocated stack.
+func allocStack() (uintptr, *kernel.Error) {
+	if count := len(freeStacks); count != 0 {
+		stackBase := freeStacks[count-1]
+		freeStacks = freeStacks[:count-1]
+		return stackBase, nil
+	}
+
+	jitter := uintptr(randUint32Fn()%stackJitterPages) << mm.PageShift
+	region, err := earlyReserveRegionFn(jitter + stackGuardSize + StackSize)
+	if err != nil {
+		return 0, err
+	}
+	stackBase := region + jitter
+
+	for offset := stackGuardSize; offset < stackGuardSize+StackSize; offset += mm.PageSize {
+		frame, err := allocFrameFn()
+		if err != nil {
+			return 0, err
+		}
+
+		if err = mapFn(mm.PageFromAddress(stackBase+offset), frame, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute); err != nil {
+			return 0, err
+		}
+	}
+
+	return stackBase, nil
+}
+
+// reap is invoked by the scheduler after switching away from an exited
+// thread. It recycles the thread stack and wakes up any joiners.
+func reap(st *sched.Thread) {
+	t, ok := threads[st.ID()]
+	if !ok {
+		return
+	}
+
+	delete(threads, st.ID())
+	freeStacks = append(freeStacks, t.stackBase)
+
+	t.exited = true
+	for _, joiner := range t.joiners {
+		readyFn(joiner)
+	}
+	t.joiners = nil
+}
+
+func init() {
+	sched.SetReaper(reap)
+}
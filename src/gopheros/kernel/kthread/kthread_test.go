@@ -0,0 +1,281 @@
+package kthread
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/rand"
+	"gopheros/kernel/sched"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	earlyReserveRegionFn = vmm.EarlyReserveRegion
+	mapFn = vmm.Map
+	allocFrameFn = mm.AllocFrame
+	newThreadFn = sched.NewThread
+	readyFn = sched.Ready
+	blockFn = sched.Block
+	exitFn = sched.Exit
+	currentFn = sched.Current
+	markNonAllocatingFn = (*sched.Thread).MarkNonAllocating
+	setAffinityFn = (*sched.Thread).SetAffinity
+	randUint32Fn = rand.Uint32
+	threads = make(map[uint32]*Thread)
+	freeStacks = nil
+}
+
+// lastRegion is the address of the last region returned by the mocked
+// earlyReserveRegionFn.
+var lastRegion uintptr
+
+// testStackJitter is the stack placement offset returned by the mocked
+// randUint32Fn.
+const testStackJitter = stackJitterPages + 2
+
+// mockStacks backs the regions returned by the mocked earlyReserveRegionFn with
+// real memory so that sched.NewThread can set up the initial stack frame.
+func mockStacks(t *testing.T) (reserved *int, mapped map[mm.Page]vmm.PageTableEntryFlag) {
+	reserved = new(int)
+	mapped = make(map[mm.Page]vmm.PageTableEntryFlag)
+
+	randUint32Fn = func() uint32 { return testStackJitter }
+	earlyReserveRegionFn = func(size uintptr) (uintptr, *kernel.Error) {
+		if exp := 2*mm.PageSize + stackGuardSize + StackSize; size != exp {
+			t.Errorf("expected reservation size to be %d; got %d", exp, size)
+		}
+		*reserved++
+		buf := make([]byte, size+mm.PageSize)
+		region := (uintptr(unsafe.Pointer(&buf[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+		lastRegion = region
+		return region, nil
+	}
+	allocFrameFn = func() (mm.Frame, *kernel.Error) { return mm.Frame(1), nil }
+	mapFn = func(page mm.Page, _ mm.Frame, flags vmm.PageTableEntryFlag) *kernel.Error {
+		mapped[page] = flags
+		return nil
+	}
+
+	return reserved, mapped
+}
+
+func TestSpawn(t *testing.T) {
+	defer restoreMocks()
+	reserved, mapped := mockStacks(t)
+
+	var readied []*sched.Thread
+	readyFn = func(st *sched.Thread) { readied = append(readied, st) }
+
+	th, err := Spawn("worker", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if th.Name() != "worker" || th.Exited() {
+		t.Fatalf("unexpected thread state: name %q, exited %t", th.Name(), th.Exited())
+	}
+
+	if len(readied) != 1 || readied[0] != th.t {
+		t.Fatal("expected spawned thread to be made runnable")
+	}
+
+	if threads[th.ID()] != th {
+		t.Error("expected spawned thread to be registered")
+	}
+
+	if exp := lastRegion + 2*mm.PageSize; th.stackBase != exp {
+		t.Errorf("expected the stack base to be offset by the random jitter to 0x%x; got 0x%x", exp, th.stackBase)
+	}
+
+	// The guard page must remain unmapped
+	if _, found := mapped[mm.PageFromAddress(th.stackBase)]; found {
+		t.Error("expected stack guard page not to be mapped")
+	}
+
+	if exp := int(StackSize / mm.PageSize); len(mapped) != exp {
+		t.Errorf("expected %d stack pages to be mapped; got %d", exp, len(mapped))
+	}
+
+	for page, flags := range mapped {
+		if exp := vmm.FlagPresent | vmm.FlagRW | vmm.FlagNoExecute; flags != exp {
+			t.Errorf("expected page 0x%x to be mapped with flags %x; got %x", page.Address(), exp, flags)
+		}
+	}
+
+	// Once the thread is reaped, its stack should be reused
+	reap(th.t)
+	th2, err := Spawn("worker2", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *reserved != 1 || th2.stackBase != th.stackBase {
+		t.Error("expected the stack of the exited thread to be reused")
+	}
+}
+
+func TestSpawnErrors(t *testing.T) {
+	defer restoreMocks()
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+
+	specs := []func(){
+		func() {
+			earlyReserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, expErr }
+		},
+		func() {
+			allocFrameFn = func() (mm.Frame, *kernel.Error) { return mm.InvalidFrame, expErr }
+		},
+		func() {
+			mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return expErr }
+		},
+	}
+
+	for specIndex, setup := range specs {
+		mockStacks(t)
+		setup()
+
+		if _, err := Spawn("worker", func() {}); err != expErr {
+			t.Errorf("[spec %d] expected to get error %v; got %v", specIndex, expErr, err)
+		}
+	}
+}
+
+func TestSpawnNonAllocating(t *testing.T) {
+	defer restoreMocks()
+	mockStacks(t)
+
+	var (
+		readied []*sched.Thread
+		marked  []*sched.Thread
+		masks   []sched.AffinityMask
+	)
+	readyFn = func(st *sched.Thread) { readied = append(readied, st) }
+	markNonAllocatingFn = func(st *sched.Thread) { marked = append(marked, st) }
+	setAffinityFn = func(st *sched.Thread, mask sched.AffinityMask) *kernel.Error {
+		if len(marked) == 0 || marked[len(marked)-1] != st {
+			t.Error("expected thread to be marked as non-allocating before changing its affinity")
+		}
+		masks = append(masks, mask)
+		return nil
+	}
+
+	// Regular threads are neither marked nor allowed to leave the boot
+	// processor.
+	if _, err := Spawn("worker", func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(marked) != 0 || len(masks) != 0 {
+		t.Fatal("expected Spawn not to mark the thread as non-allocating")
+	}
+
+	th, err := SpawnNonAllocating("spinner", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(marked) != 1 || marked[0] != th.t || len(masks) != 1 || masks[0] != sched.AffinityAll {
+		t.Fatal("expected SpawnNonAllocating to mark the thread and allow it to run on all processors")
+	}
+
+	if len(readied) != 2 || readied[1] != th.t || threads[th.ID()] != th {
+		t.Error("expected the non-allocating thread to be registered and made runnable")
+	}
+
+	// If the affinity cannot be changed, the stack is recycled
+	expErr := &kernel.Error{Module: "test", Message: "no online CPU"}
+	setAffinityFn = func(_ *sched.Thread, _ sched.AffinityMask) *kernel.Error { return expErr }
+	if _, err = SpawnNonAllocating("spinner", func() {}); err != expErr {
+		t.Fatalf("expected to get error %v; got %v", expErr, err)
+	}
+
+	if len(readied) != 2 || len(freeStacks) != 1 {
+		t.Errorf("expected the thread not to be made runnable and its stack to be recycled")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	defer restoreMocks()
+	mockStacks(t)
+	readyFn = func(_ *sched.Thread) {}
+
+	joiner, err := Spawn("joiner", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := joiner.t
+
+	var (
+		readied []*sched.Thread
+		blocked int
+	)
+	currentFn = func() *sched.Thread { return self }
+	readyFn = func(st *sched.Thread) { readied = append(readied, st) }
+
+	th, err := Spawn("worker", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate the worker exiting while the joiner is blocked
+	blockFn = func() {
+		blocked++
+		reap(th.t)
+	}
+
+	if err = th.Join(); err != nil {
+		t.Fatal(err)
+	}
+
+	if blocked != 1 || !th.Exited() {
+		t.Fatalf("expected Join to block once until the thread exits; blocked %d times", blocked)
+	}
+
+	if len(readied) != 2 || readied[1] != self {
+		t.Error("expected the joining thread to be woken up")
+	}
+
+	if _, found := threads[th.ID()]; found {
+		t.Error("expected exited thread to be unregistered")
+	}
+
+	// Joining an exited thread should not block
+	if err = th.Join(); err != nil || blocked != 1 {
+		t.Errorf("expected Join to return immediately for an exited thread")
+	}
+
+	// Reaping a thread not created by Spawn is a no-op
+	reap(sched.NewThread("other", joiner.stackBase, joiner.stackBase+stackGuardSize+StackSize, nil))
+	if len(freeStacks) != 1 {
+		t.Errorf("expected 1 free stack; got %d", len(freeStacks))
+	}
+}
+
+func TestJoinSelf(t *testing.T) {
+	defer restoreMocks()
+	mockStacks(t)
+	readyFn = func(_ *sched.Thread) {}
+
+	th, err := Spawn("worker", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentFn = func() *sched.Thread { return th.t }
+	if err = th.Join(); err != errJoinSelf {
+		t.Errorf("expected to get errJoinSelf; got %v", err)
+	}
+}
+
+func TestExit(t *testing.T) {
+	defer restoreMocks()
+
+	var called bool
+	exitFn = func() { called = true }
+
+	Exit()
+	if !called {
+		t.Error("expected Exit to invoke sched.Exit")
+	}
+}
@@ -37,6 +37,16 @@ var (
 	// frameAllocator points to a frame allocator function registered using
 	// SetFrameAllocator.
 	frameAllocator FrameAllocatorFn
+
+	// frameFreer points to a frame release function registered using
+	// SetFrameFreer.
+	frameFreer FrameFreerFn
+
+	// contiguousFrameAllocator points to a frame allocator function
+	// registered using SetContiguousFrameAllocator.
+	contiguousFrameAllocator ContiguousFrameAllocatorFn
+
+	errNoContiguousAllocator = &kernel.Error{Module: "mm", Message: "no allocator for contiguous frames has been registered", Code: kernel.CodeNotSupported}
 )
 
 // FrameAllocatorFn is a function that can allocate physical frames.
@@ -50,6 +60,43 @@ func SetFrameAllocator(allocFn FrameAllocatorFn) { frameAllocator = allocFn }
 // physical frame allocator.
 func AllocFrame() (Frame, *kernel.Error) { return frameAllocator() }
 
+// ContiguousFrameAllocatorFn is a function that can allocate a run of
+// physically contiguous frames.
+type ContiguousFrameAllocatorFn func(count uint32) (Frame, *kernel.Error)
+
+// SetContiguousFrameAllocator registers a function that will be used for
+// allocating physically contiguous frames.
+func SetContiguousFrameAllocator(allocFn ContiguousFrameAllocatorFn) {
+	contiguousFrameAllocator = allocFn
+}
+
+// AllocContiguousFrames allocates count physically contiguous frames and
+// returns the first one. It is meant to be used by drivers that need to share
+// buffers larger than a page with devices using DMA. The frames can be
+// released by passing each one of them to FreeFrame.
+func AllocContiguousFrames(count uint32) (Frame, *kernel.Error) {
+	if contiguousFrameAllocator == nil {
+		return InvalidFrame, errNoContiguousAllocator
+	}
+	return contiguousFrameAllocator(count)
+}
+
+// FrameFreerFn is a function that can release physical frames.
+type FrameFreerFn func(Frame) *kernel.Error
+
+// SetFrameFreer registers a function that will be used for returning frames to
+// the physical frame allocator.
+func SetFrameFreer(freeFn FrameFreerFn) { frameFreer = freeFn }
+
+// FreeFrame releases a frame that was previously obtained via AllocFrame. If
+// the active allocator does not support releasing frames, the frame is leaked.
+func FreeFrame(frame Frame) *kernel.Error {
+	if frameFreer == nil {
+		return nil
+	}
+	return frameFreer(frame)
+}
+
 // Page describes a virtual memory page index.
 type Page uintptr
 
@@ -61,6 +61,49 @@ func TestFrameAllocator(t *testing.T) {
 	}
 }
 
+func TestContiguousFrameAllocator(t *testing.T) {
+	if _, err := AllocContiguousFrames(2); err != errNoContiguousAllocator {
+		t.Fatalf("expected error %v; got %v", errNoContiguousAllocator, err)
+	}
+
+	var gotCount uint32
+	customAlloc := func(count uint32) (Frame, *kernel.Error) {
+		gotCount = count
+		return Frame(42), nil
+	}
+
+	defer SetContiguousFrameAllocator(nil)
+	SetContiguousFrameAllocator(customAlloc)
+
+	if frame, err := AllocContiguousFrames(3); err != nil || frame != Frame(42) || gotCount != 3 {
+		t.Fatalf("expected custom allocator to be invoked with count 3; got frame %d, count %d, err %v", frame, gotCount, err)
+	}
+}
+
+func TestFrameFreer(t *testing.T) {
+	// Without a registered freer, frames are leaked
+	if err := FreeFrame(Frame(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	var freed []Frame
+	customFree := func(frame Frame) *kernel.Error {
+		freed = append(freed, frame)
+		return nil
+	}
+
+	defer SetFrameFreer(nil)
+	SetFrameFreer(customFree)
+
+	if err := FreeFrame(Frame(123)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(freed) != 1 || freed[0] != Frame(123) {
+		t.Fatalf("expected custom freer to be invoked with frame 123; got %v", freed)
+	}
+}
+
 func TestPageMethods(t *testing.T) {
 	for pageIndex := uint64(0); pageIndex < 128; pageIndex++ {
 		page := Page(pageIndex)
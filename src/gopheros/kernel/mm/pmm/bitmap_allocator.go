@@ -13,9 +13,11 @@ import (
 )
 
 var (
-	errBitmapAllocOutOfMemory     = &kernel.Error{Module: "bitmap_alloc", Message: "out of memory"}
+	errBitmapAllocOutOfMemory     = &kernel.Error{Module: "bitmap_alloc", Message: "out of memory", Code: kernel.CodeOutOfMemory}
 	errBitmapAllocFrameNotManaged = &kernel.Error{Module: "bitmap_alloc", Message: "frame not managed by this allocator"}
 	errBitmapAllocDoubleFree      = &kernel.Error{Module: "bitmap_alloc", Message: "frame is already free"}
+	errBitmapAllocInvalidCount    = &kernel.Error{Module: "bitmap_alloc", Message: "frame count must be greater than zero", Code: kernel.CodeInvalid}
+	errBitmapAllocFrameInUse      = &kernel.Error{Module: "bitmap_alloc", Message: "frame is already reserved"}
 
 	// The followning functions are used by tests to mock calls to the vmm package
 	// and are automatically inlined by the compiler.
@@ -72,6 +74,7 @@ func (alloc *BitmapAllocator) init() *kernel.Error {
 	}
 
 	alloc.reserveKernelFrames()
+	alloc.reserveModuleFrames()
 	alloc.reserveEarlyAllocatorFrames()
 	alloc.printStats()
 	return nil
@@ -89,18 +92,14 @@ func (alloc *BitmapAllocator) setupPoolBitmaps() *kernel.Error {
 
 	// Detect available memory regions and calculate their pool bitmap
 	// requirements.
-	multiboot.VisitMemRegions(func(region *multiboot.MemoryMapEntry) bool {
-		if region.Type != multiboot.MemAvailable {
-			return true
-		}
-
+	multiboot.VisitMemRegionsByType(multiboot.MemAvailable, func(region *multiboot.MemoryMapEntry) bool {
 		alloc.poolsHdr.Len++
 		alloc.poolsHdr.Cap++
 
 		// Reported addresses may not be page-aligned; round up to get
 		// the start frame and round down to get the end frame
 		regionStartFrame := mm.Frame(((uintptr(region.PhysAddress) + pageSizeMinus1) & ^pageSizeMinus1) >> mm.PageShift)
-		regionEndFrame := mm.Frame((uintptr(region.PhysAddress+region.Length) & ^pageSizeMinus1)>>mm.PageShift) - 1
+		regionEndFrame := mm.Frame((uintptr(region.End()) & ^pageSizeMinus1)>>mm.PageShift) - 1
 		pageCount := uint32(regionEndFrame - regionStartFrame)
 		alloc.totalPages += pageCount
 
@@ -137,13 +136,9 @@ func (alloc *BitmapAllocator) setupPoolBitmaps() *kernel.Error {
 	// Run a second pass to initialize the free bitmap slices for all pools
 	bitmapStartAddr := alloc.poolsHdr.Data + uintptr(alloc.poolsHdr.Len)*sizeofPool
 	poolIndex := 0
-	multiboot.VisitMemRegions(func(region *multiboot.MemoryMapEntry) bool {
-		if region.Type != multiboot.MemAvailable {
-			return true
-		}
-
+	multiboot.VisitMemRegionsByType(multiboot.MemAvailable, func(region *multiboot.MemoryMapEntry) bool {
 		regionStartFrame := mm.Frame(((uintptr(region.PhysAddress) + pageSizeMinus1) & ^pageSizeMinus1) >> mm.PageShift)
-		regionEndFrame := mm.Frame((uintptr(region.PhysAddress+region.Length) & ^pageSizeMinus1)>>mm.PageShift) - 1
+		regionEndFrame := mm.Frame((uintptr(region.End()) & ^pageSizeMinus1)>>mm.PageShift) - 1
 		bitmapBytes := ((uintptr(regionEndFrame-regionStartFrame) + 63) &^ 63) >> 3
 
 		alloc.pools[poolIndex].startFrame = regionStartFrame
@@ -211,6 +206,27 @@ func (alloc *BitmapAllocator) reserveKernelFrames() {
 	}
 }
 
+// reserveModuleFrames marks as reserved the bitmap entries for the frames
+// occupied by boot modules so their contents remain accessible after the
+// bitmap allocator takes over.
+func (alloc *BitmapAllocator) reserveModuleFrames() {
+	multiboot.VisitModules(func(mod *multiboot.Module) bool {
+		modStartFrame, modEndFrame := moduleFrames(mod)
+		if !modStartFrame.Valid() {
+			return true
+		}
+
+		for frame := modStartFrame; frame <= modEndFrame; frame++ {
+			// Frames that overlap the kernel image are already reserved
+			if frame >= bootMemAllocator.kernelStartFrame && frame <= bootMemAllocator.kernelEndFrame {
+				continue
+			}
+			alloc.markFrame(alloc.poolForFrame(frame), frame, markReserved)
+		}
+		return true
+	})
+}
+
 // reserveEarlyAllocatorFrames makes as reserved the bitmap entries for the frames
 // already allocated by the early allocator.
 func (alloc *BitmapAllocator) reserveEarlyAllocatorFrames() {
@@ -240,6 +256,14 @@ func (alloc *BitmapAllocator) printStats() {
 	)
 }
 
+// stats returns the total and reserved page counts across all pools.
+func (alloc *BitmapAllocator) stats() (uint32, uint32) {
+	alloc.mutex.Acquire()
+	total, reserved := alloc.totalPages, alloc.reservedPages
+	alloc.mutex.Release()
+	return total, reserved
+}
+
 // AllocFrame reserves and returns a physical memory frame. An error will be
 // returned if no more memory can be allocated.
 func (alloc *BitmapAllocator) AllocFrame() (mm.Frame, *kernel.Error) {
@@ -275,6 +299,107 @@ func (alloc *BitmapAllocator) AllocFrame() (mm.Frame, *kernel.Error) {
 	return mm.InvalidFrame, errBitmapAllocOutOfMemory
 }
 
+// AllocFrameInRange reserves and returns the lowest free frame between first
+// and last (inclusive). An error will be returned if all frames in the range
+// are reserved or not managed by the allocator.
+func (alloc *BitmapAllocator) AllocFrameInRange(first, last mm.Frame) (mm.Frame, *kernel.Error) {
+	alloc.mutex.Acquire()
+
+	for frame := first; frame <= last; frame++ {
+		poolIndex := alloc.poolForFrame(frame)
+		if poolIndex < 0 {
+			continue
+		}
+
+		relFrame := frame - alloc.pools[poolIndex].startFrame
+		if alloc.pools[poolIndex].freeBitmap[relFrame>>6]&(1<<(63-(relFrame&63))) != 0 {
+			continue
+		}
+
+		alloc.markFrame(poolIndex, frame, markReserved)
+		alloc.mutex.Release()
+		return frame, nil
+	}
+
+	alloc.mutex.Release()
+	return mm.InvalidFrame, errBitmapAllocOutOfMemory
+}
+
+// AllocFrames reserves count physically contiguous frames and returns the
+// first one. An error will be returned if no pool contains a large enough run
+// of free frames.
+func (alloc *BitmapAllocator) AllocFrames(count uint32) (mm.Frame, *kernel.Error) {
+	if count == 0 {
+		return mm.InvalidFrame, errBitmapAllocInvalidCount
+	}
+
+	alloc.mutex.Acquire()
+
+	for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
+		pool := &alloc.pools[poolIndex]
+		if pool.freeCount < count {
+			continue
+		}
+
+		var runStart, runLen mm.Frame
+		for frame := pool.startFrame; frame <= pool.endFrame; frame++ {
+			relFrame := frame - pool.startFrame
+			if pool.freeBitmap[relFrame>>6]&(1<<(63-(relFrame&63))) != 0 {
+				runLen = 0
+				continue
+			}
+
+			if runLen == 0 {
+				runStart = frame
+			}
+
+			if runLen++; runLen == mm.Frame(count) {
+				for f := runStart; f <= frame; f++ {
+					alloc.markFrame(poolIndex, f, markReserved)
+				}
+				alloc.mutex.Release()
+				return runStart, nil
+			}
+		}
+	}
+
+	alloc.mutex.Release()
+	return mm.InvalidFrame, errBitmapAllocOutOfMemory
+}
+
+// ReserveFrames marks count frames starting at start as reserved so that their
+// contents are preserved. Frames that are not part of the allocator pools
+// (e.g. firmware-reserved memory) are skipped. If any of the managed frames
+// is already reserved, an error is returned and no frames are reserved.
+func (alloc *BitmapAllocator) ReserveFrames(start mm.Frame, count uint32) *kernel.Error {
+	if count == 0 {
+		return errBitmapAllocInvalidCount
+	}
+
+	alloc.mutex.Acquire()
+
+	end := start + mm.Frame(count-1)
+	for frame := start; frame <= end; frame++ {
+		poolIndex := alloc.poolForFrame(frame)
+		if poolIndex < 0 {
+			continue
+		}
+
+		relFrame := frame - alloc.pools[poolIndex].startFrame
+		if alloc.pools[poolIndex].freeBitmap[relFrame>>6]&(1<<(63-(relFrame&63))) != 0 {
+			alloc.mutex.Release()
+			return errBitmapAllocFrameInUse
+		}
+	}
+
+	for frame := start; frame <= end; frame++ {
+		alloc.markFrame(alloc.poolForFrame(frame), frame, markReserved)
+	}
+
+	alloc.mutex.Release()
+	return nil
+}
+
 // FreeFrame releases a frame previously allocated via a call to AllocFrame.
 // Trying to release a frame not part of the allocator pools or a frame that
 // is already marked as free will cause an error to be returned.
@@ -261,6 +261,44 @@ func TestBitmapAllocatorReserveKernelFrames(t *testing.T) {
 	}
 }
 
+func TestBitmapAllocatorReserveModuleFrames(t *testing.T) {
+	defer multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	var alloc = BitmapAllocator{
+		pools: []framePool{
+			{
+				startFrame: mm.Frame(0),
+				endFrame:   mm.Frame(63),
+				freeCount:  64,
+				freeBitmap: make([]uint64, 1),
+			},
+		},
+		totalPages: 64,
+	}
+
+	// module 0 occupies frames 4-7 and module 1 occupies frames 8-9 and
+	// partially overlaps the kernel (frames 9-10)
+	infoData := multibootMemoryMapWithModules([][2]uint32{
+		{0x4000, 0x8000},
+		{0x8000, 0x9800},
+	})
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&infoData[0])))
+	bootMemAllocator.kernelStartFrame = mm.Frame(9)
+	bootMemAllocator.kernelEndFrame = mm.Frame(10)
+	alloc.reserveModuleFrames()
+
+	if exp, got := uint32(5), alloc.reservedPages; got != exp {
+		t.Fatalf("expected reserved page counter to be %d; got %d", exp, got)
+	}
+
+	if exp, got := uint64(0x1f<<55), alloc.pools[0].freeBitmap[0]; got != exp {
+		t.Fatalf("expected block 0 in pool 0 to be:\n%064s\ngot:\n%064s",
+			strconv.FormatUint(exp, 2),
+			strconv.FormatUint(got, 2),
+		)
+	}
+}
+
 func TestBitmapAllocatorReserveEarlyAllocatorFrames(t *testing.T) {
 	var alloc = BitmapAllocator{
 		pools: []framePool{
@@ -385,6 +423,171 @@ func TestBitmapAllocatorAllocAndFreeFrame(t *testing.T) {
 	}
 }
 
+func TestBitmapAllocatorAllocFrames(t *testing.T) {
+	var alloc = BitmapAllocator{
+		pools: []framePool{
+			{
+				startFrame: mm.Frame(0),
+				endFrame:   mm.Frame(7),
+				freeCount:  8,
+				freeBitmap: make([]uint64, 1),
+			},
+			{
+				startFrame: mm.Frame(64),
+				endFrame:   mm.Frame(191),
+				freeCount:  128,
+				freeBitmap: make([]uint64, 2),
+			},
+		},
+		totalPages: 136,
+	}
+
+	// Fragment the first pool so that its longest free run is 3 frames
+	// and reserve the frames around the 64-bit block boundary of the
+	// second pool.
+	for _, frame := range []mm.Frame{1, 5, 64, 126} {
+		alloc.markFrame(alloc.poolForFrame(frame), frame, markReserved)
+	}
+
+	specs := []struct {
+		count    uint32
+		expFrame mm.Frame
+		expErr   *kernel.Error
+	}{
+		{0, mm.InvalidFrame, errBitmapAllocInvalidCount},
+		{3, 2, nil},
+		{2, 6, nil},
+		{1, 0, nil},
+		// Runs may span bitmap blocks
+		{64, 127, nil},
+		{61, 65, nil},
+		{2, mm.InvalidFrame, errBitmapAllocOutOfMemory},
+	}
+
+	for specIndex, spec := range specs {
+		frame, err := alloc.AllocFrames(spec.count)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if frame != spec.expFrame {
+			t.Errorf("[spec %d] expected first frame to be %d; got %d", specIndex, spec.expFrame, frame)
+		}
+	}
+
+	if exp := alloc.totalPages - 1; alloc.reservedPages != exp {
+		t.Errorf("expected reservedPages to be %d; got %d", exp, alloc.reservedPages)
+	}
+}
+
+func TestBitmapAllocatorAllocFrameInRange(t *testing.T) {
+	var alloc = BitmapAllocator{
+		pools: []framePool{
+			{
+				startFrame: mm.Frame(0),
+				endFrame:   mm.Frame(7),
+				freeCount:  8,
+				freeBitmap: make([]uint64, 1),
+			},
+			{
+				startFrame: mm.Frame(64),
+				endFrame:   mm.Frame(127),
+				freeCount:  64,
+				freeBitmap: make([]uint64, 1),
+			},
+		},
+		totalPages: 72,
+	}
+
+	for _, frame := range []mm.Frame{1, 2, 7} {
+		alloc.markFrame(alloc.poolForFrame(frame), frame, markReserved)
+	}
+
+	specs := []struct {
+		first, last mm.Frame
+		expFrame    mm.Frame
+		expErr      *kernel.Error
+	}{
+		{1, 10, 3, nil},
+		{1, 10, 4, nil},
+		// frames in the gap between the pools are not managed
+		{7, 100, 64, nil},
+		{7, 63, mm.InvalidFrame, errBitmapAllocOutOfMemory},
+		{5, 6, 5, nil},
+		{5, 6, 6, nil},
+		{5, 6, mm.InvalidFrame, errBitmapAllocOutOfMemory},
+	}
+
+	for specIndex, spec := range specs {
+		frame, err := alloc.AllocFrameInRange(spec.first, spec.last)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if frame != spec.expFrame {
+			t.Errorf("[spec %d] expected frame %d; got %d", specIndex, spec.expFrame, frame)
+		}
+	}
+
+	if exp := uint32(3 + 5); alloc.reservedPages != exp {
+		t.Errorf("expected reservedPages to be %d; got %d", exp, alloc.reservedPages)
+	}
+}
+
+func TestBitmapAllocatorReserveFrames(t *testing.T) {
+	var alloc = BitmapAllocator{
+		pools: []framePool{
+			{
+				startFrame: mm.Frame(0),
+				endFrame:   mm.Frame(63),
+				freeCount:  64,
+				freeBitmap: make([]uint64, 1),
+			},
+			{
+				startFrame: mm.Frame(128),
+				endFrame:   mm.Frame(191),
+				freeCount:  64,
+				freeBitmap: make([]uint64, 1),
+			},
+		},
+		totalPages: 128,
+	}
+	alloc.markFrame(0, mm.Frame(10), markReserved)
+
+	specs := []struct {
+		start       mm.Frame
+		count       uint32
+		expErr      *kernel.Error
+		expReserved uint32
+	}{
+		{0, 0, errBitmapAllocInvalidCount, 1},
+		// overlaps a reserved frame
+		{8, 4, errBitmapAllocFrameInUse, 1},
+		{20, 4, nil, 5},
+		// frames in the gap between the pools are not managed
+		{60, 72, nil, 5 + 4 + 4},
+		{22, 1, errBitmapAllocFrameInUse, 13},
+	}
+
+	for specIndex, spec := range specs {
+		if err := alloc.ReserveFrames(spec.start, spec.count); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+
+		if alloc.reservedPages != spec.expReserved {
+			t.Errorf("[spec %d] expected reservedPages to be %d; got %d", specIndex, spec.expReserved, alloc.reservedPages)
+		}
+	}
+
+	for _, frame := range []mm.Frame{20, 23, 60, 63, 128, 131} {
+		if err := alloc.FreeFrame(frame); err != nil {
+			t.Errorf("expected frame %d to be reserved; got %v", frame, err)
+		}
+	}
+}
+
 func TestAllocatorPackageInit(t *testing.T) {
 	defer func() {
 		mapFn = vmm.Map
@@ -409,10 +612,20 @@ func TestAllocatorPackageInit(t *testing.T) {
 			t.Fatal(err)
 		}
 
+		// A frame below 1M should be reserved for the AP startup code
+		if frame := RealModeFrame(); frame < firstRealModeFrame || frame > lastRealModeFrame {
+			t.Fatalf("expected a real-mode frame to be reserved; got %d", frame)
+		}
+
 		// At this point the bitmap allocator should be up and running
+		total, reserved := FrameStats()
 		if _, err := bitmapAllocFrame(); err != nil {
 			t.Fatal(err)
 		}
+
+		if gotTotal, gotReserved := FrameStats(); gotTotal != total || gotReserved != reserved+1 {
+			t.Fatalf("expected frame stats to report %d/%d reserved frames; got %d/%d", reserved+1, total, gotReserved, gotTotal)
+		}
 	})
 
 	t.Run("error", func(t *testing.T) {
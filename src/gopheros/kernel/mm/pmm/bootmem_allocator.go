@@ -8,7 +8,7 @@ import (
 )
 
 var (
-	errBootAllocOutOfMemory = &kernel.Error{Module: "boot_mem_alloc", Message: "out of memory"}
+	errBootAllocOutOfMemory = &kernel.Error{Module: "boot_mem_alloc", Message: "out of memory", Code: kernel.CodeOutOfMemory}
 )
 
 // BootMemAllocator implements a rudimentary physical memory allocator which is
@@ -54,9 +54,9 @@ func (alloc *BootMemAllocator) init(kernelStart, kernelEnd uintptr) {
 func (alloc *BootMemAllocator) AllocFrame() (mm.Frame, *kernel.Error) {
 	var err = errBootAllocOutOfMemory
 
-	multiboot.VisitMemRegions(func(region *multiboot.MemoryMapEntry) bool {
-		// Ignore reserved regions and regions smaller than a single page
-		if region.Type != multiboot.MemAvailable || region.Length < uint64(mm.PageSize) {
+	multiboot.VisitMemRegionsByType(multiboot.MemAvailable, func(region *multiboot.MemoryMapEntry) bool {
+		// Ignore regions smaller than a single page
+		if region.Length < uint64(mm.PageSize) {
 			return true
 		}
 
@@ -64,7 +64,7 @@ func (alloc *BootMemAllocator) AllocFrame() (mm.Frame, *kernel.Error) {
 		// the start frame and round down to get the end frame
 		pageSizeMinus1 := uint64(mm.PageSize - 1)
 		regionStartFrame := mm.Frame(((region.PhysAddress + pageSizeMinus1) & ^pageSizeMinus1) >> mm.PageShift)
-		regionEndFrame := mm.Frame(((region.PhysAddress+region.Length) & ^pageSizeMinus1)>>mm.PageShift) - 1
+		regionEndFrame := mm.Frame((region.End() & ^pageSizeMinus1)>>mm.PageShift) - 1
 
 		// Skip over already allocated regions
 		if alloc.lastAllocFrame >= regionEndFrame {
@@ -91,6 +91,22 @@ func (alloc *BootMemAllocator) AllocFrame() (mm.Frame, *kernel.Error) {
 			alloc.lastAllocFrame++
 		}
 
+		// Skip over any frames occupied by boot modules (and the kernel
+		// image if it immediately follows a module)
+		for {
+			if alloc.lastAllocFrame >= alloc.kernelStartFrame && alloc.lastAllocFrame <= alloc.kernelEndFrame {
+				alloc.lastAllocFrame = alloc.kernelEndFrame + 1
+				continue
+			}
+
+			if modEndFrame := moduleEndFrame(alloc.lastAllocFrame); modEndFrame.Valid() {
+				alloc.lastAllocFrame = modEndFrame + 1
+				continue
+			}
+
+			break
+		}
+
 		// The above adjustment might push lastAllocFrame outside of the
 		// region end (e.g kernel ends at last page in the region)
 		if alloc.lastAllocFrame > regionEndFrame {
@@ -109,13 +125,40 @@ func (alloc *BootMemAllocator) AllocFrame() (mm.Frame, *kernel.Error) {
 	return alloc.lastAllocFrame, nil
 }
 
+// moduleFrames returns the first and last frame occupied by a boot module.
+// Modules with an empty physical range return mm.InvalidFrame for both frames.
+func moduleFrames(mod *multiboot.Module) (mm.Frame, mm.Frame) {
+	if mod.PhysEnd <= mod.PhysStart {
+		return mm.InvalidFrame, mm.InvalidFrame
+	}
+
+	return mm.Frame(mod.PhysStart >> mm.PageShift), mm.Frame((mod.PhysEnd - 1) >> mm.PageShift)
+}
+
+// moduleEndFrame checks whether frame is occupied by a boot module and returns
+// the last frame used by that module. If frame does not belong to any module,
+// moduleEndFrame returns mm.InvalidFrame.
+func moduleEndFrame(frame mm.Frame) mm.Frame {
+	endFrame := mm.InvalidFrame
+	multiboot.VisitModules(func(mod *multiboot.Module) bool {
+		modStartFrame, modEndFrame := moduleFrames(mod)
+		if modStartFrame.Valid() && frame >= modStartFrame && frame <= modEndFrame {
+			endFrame = modEndFrame
+			return false
+		}
+		return true
+	})
+
+	return endFrame
+}
+
 // printMemoryMap scans the memory region information provided by the
 // bootloader and prints out the system's memory map.
 func (alloc *BootMemAllocator) printMemoryMap() {
 	kfmt.Printf("[boot_mem_alloc] system memory map:\n")
 	var totalFree uint64
 	multiboot.VisitMemRegions(func(region *multiboot.MemoryMapEntry) bool {
-		kfmt.Printf("\t[0x%10x - 0x%10x], size: %10d, type: %s\n", region.PhysAddress, region.PhysAddress+region.Length, region.Length, region.Type.String())
+		kfmt.Printf("\t[0x%10x - 0x%10x], size: %10d, type: %s\n", region.PhysAddress, region.End(), region.Length, region.Type.String())
 
 		if region.Type == multiboot.MemAvailable {
 			totalFree += region.Length
@@ -128,4 +171,8 @@ func (alloc *BootMemAllocator) printMemoryMap() {
 		uint64(alloc.kernelEndAddr-alloc.kernelStartAddr),
 		uint64(alloc.kernelEndFrame-alloc.kernelStartFrame+1),
 	)
+	multiboot.VisitModules(func(mod *multiboot.Module) bool {
+		kfmt.Printf("[boot_mem_alloc] module %s loaded at 0x%x - 0x%x\n", mod.Name, mod.PhysStart, mod.PhysEnd)
+		return true
+	})
 }
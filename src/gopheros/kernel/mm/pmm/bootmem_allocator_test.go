@@ -1,6 +1,9 @@
 package pmm
 
 import (
+	"bytes"
+	"encoding/binary"
+	"gopheros/kernel/mm"
 	"gopheros/multiboot"
 	"testing"
 	"unsafe"
@@ -90,6 +93,71 @@ func TestBootMemoryAllocator(t *testing.T) {
 	}
 }
 
+func TestBootMemoryAllocatorSkipsModules(t *testing.T) {
+	defer multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&multibootMemoryMap[0])))
+
+	// The kernel is loaded at region 2 start taking 2 pages; module 0
+	// immediately follows the kernel, module 1 uses 1.5 pages at the end of
+	// region 1 and module 2 has an empty range.
+	infoData := multibootMemoryMapWithModules([][2]uint32{
+		{0x102000, 0x104000},
+		{0x9d800, 0x9f000},
+		{0x200000, 0x200000},
+	})
+	multiboot.SetInfoPtr(uintptr(unsafe.Pointer(&infoData[0])))
+
+	var alloc BootMemAllocator
+	alloc.init(0x100000, 0x102000)
+
+	for {
+		frame, err := alloc.AllocFrame()
+		if err != nil {
+			break
+		}
+
+		if (frame >= 157 && frame <= 158) || (frame >= 256 && frame <= 259) {
+			t.Fatalf("allocator returned frame %d which is occupied by the kernel or a boot module", frame)
+		}
+	}
+
+	// region 1 provides 159 frames [0 to 158]; frames 157 and 158 are used by module 1
+	// region 2 provides 32480 frames [256-32735]; frames 256-259 are used by the kernel and module 0
+	if exp := uint64(159 - 2 + 32480 - 4); alloc.allocCount != exp {
+		t.Fatalf("expected allocator to allocate %d frames; allocated %d", exp, alloc.allocCount)
+	}
+}
+
+func TestModuleFrames(t *testing.T) {
+	specs := []struct {
+		mod                   multiboot.Module
+		expStart, expEndFrame mm.Frame
+	}{
+		{multiboot.Module{PhysStart: 0x1000, PhysEnd: 0x2000}, 1, 1},
+		{multiboot.Module{PhysStart: 0x1800, PhysEnd: 0x3001}, 1, 3},
+		{multiboot.Module{PhysStart: 0x1000, PhysEnd: 0x1000}, mm.InvalidFrame, mm.InvalidFrame},
+	}
+
+	for specIndex, spec := range specs {
+		start, end := moduleFrames(&spec.mod)
+		if start != spec.expStart || end != spec.expEndFrame {
+			t.Errorf("[spec %d] expected module frames [%d, %d]; got [%d, %d]", specIndex, spec.expStart, spec.expEndFrame, start, end)
+		}
+	}
+}
+
+// multibootMemoryMapWithModules returns a copy of multibootMemoryMap with a
+// module tag for each of the supplied [start, end) physical ranges.
+func multibootMemoryMapWithModules(modules [][2]uint32) []byte {
+	var buf bytes.Buffer
+	buf.Write(multibootMemoryMap[:len(multibootMemoryMap)-8])
+	for _, mod := range modules {
+		binary.Write(&buf, binary.LittleEndian, []uint32{3, 17, mod[0], mod[1]})
+		buf.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0})
+	}
+	buf.Write(multibootMemoryMap[len(multibootMemoryMap)-8:])
+	return buf.Bytes()
+}
+
 var (
 	// A dump of multiboot data when running under qemu containing only the
 	// memory region tag.  The dump encodes the following available memory
@@ -97,7 +165,7 @@ var (
 	// [     0 -   9fc00] length:    654336
 	// [100000 - 7fe0000] length: 133038080
 	multibootMemoryMap = []byte{
-		72, 5, 0, 0, 0, 0, 0, 0,
+		176, 0, 0, 0, 0, 0, 0, 0,
 		6, 0, 0, 0, 160, 0, 0, 0, 24, 0, 0, 0, 0, 0, 0, 0,
 		0, 0, 0, 0, 0, 0, 0, 0, 0, 252, 9, 0, 0, 0, 0, 0,
 		1, 0, 0, 0, 0, 0, 0, 0, 0, 252, 9, 0, 0, 0, 0, 0,
@@ -108,11 +176,6 @@ var (
 		0, 0, 254, 7, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0,
 		2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 252, 255, 0, 0, 0, 0,
 		0, 0, 4, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0,
-		9, 0, 0, 0, 212, 3, 0, 0, 24, 0, 0, 0, 40, 0, 0, 0,
-		21, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
-		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
-		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 27, 0, 0, 0,
-		1, 0, 0, 0, 2, 0, 0, 0, 0, 0, 16, 0, 0, 16, 0, 0,
-		24, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 8, 0, 0, 0,
 	}
 )
@@ -5,7 +5,21 @@ import (
 	"gopheros/kernel/mm"
 )
 
+const (
+	// firstRealModeFrame and lastRealModeFrame bound the frames that can
+	// be addressed by the 8-bit STARTUP IPI vector. Frame 0 is skipped as
+	// identity-mapping it would place its contents at the nil address.
+	firstRealModeFrame = mm.Frame(1)
+	lastRealModeFrame  = mm.Frame(0xff)
+)
+
 var (
+	// realModeFrame is a frame below 1M that is reserved while the
+	// allocators are initialized for the code that the application
+	// processors execute in real mode. It is set to mm.InvalidFrame if no
+	// such frame is available.
+	realModeFrame = mm.InvalidFrame
+
 	// bootMemAllocator is the page allocator used when the kernel boots.
 	// It is used to bootstrap the bitmap allocator which is used for all
 	// page allocations while the kernel runs.
@@ -25,11 +39,39 @@ func Init(kernelStart, kernelEnd uintptr) *kernel.Error {
 	if err := bitmapAllocator.init(); err != nil {
 		return err
 	}
+
+	// Reserve the real-mode frame before any other allocations can claim
+	// the low memory frames. Not finding one is not fatal as it is only
+	// required for starting the application processors.
+	realModeFrame, _ = bitmapAllocator.AllocFrameInRange(firstRealModeFrame, lastRealModeFrame)
+
 	mm.SetFrameAllocator(bitmapAllocFrame)
+	mm.SetContiguousFrameAllocator(bitmapAllocFrames)
+	mm.SetFrameFreer(bitmapFreeFrame)
 
 	return nil
 }
 
+// FrameStats returns the total number of physical frames managed by the frame
+// allocator and the number of frames that are currently reserved.
+func FrameStats() (total, reserved uint32) {
+	return bitmapAllocator.stats()
+}
+
+// RealModeFrame returns the frame below 1M that was reserved by Init for the
+// application processor startup code or mm.InvalidFrame if none was
+// available. The caller takes ownership of the frame.
+func RealModeFrame() mm.Frame {
+	return realModeFrame
+}
+
+// ReserveFrames prevents count frames starting at start from being allocated
+// so that their contents are preserved. It returns an error if any of the
+// frames has already been allocated.
+func ReserveFrames(start mm.Frame, count uint32) *kernel.Error {
+	return bitmapAllocator.ReserveFrames(start, count)
+}
+
 func earlyAllocFrame() (mm.Frame, *kernel.Error) {
 	return bootMemAllocator.AllocFrame()
 }
@@ -37,3 +79,11 @@ func earlyAllocFrame() (mm.Frame, *kernel.Error) {
 func bitmapAllocFrame() (mm.Frame, *kernel.Error) {
 	return bitmapAllocator.AllocFrame()
 }
+
+func bitmapAllocFrames(count uint32) (mm.Frame, *kernel.Error) {
+	return bitmapAllocator.AllocFrames(count)
+}
+
+func bitmapFreeFrame(frame mm.Frame) *kernel.Error {
+	return bitmapAllocator.FreeFrame(frame)
+}
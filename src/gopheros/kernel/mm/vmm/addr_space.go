@@ -3,25 +3,57 @@ package vmm
 import (
 	"gopheros/kernel"
 	"gopheros/kernel/mm"
+	"gopheros/kernel/rand"
 )
 
+// earlyReserveRandomPages is the number of possible page offsets for the top
+// of the region used by EarlyReserveRegion when its placement is randomized.
+// It amounts to 1G of virtual address space.
+const earlyReserveRandomPages = 1 << 18
+
 var (
+	// earlyReserveTop is the address past the region used by
+	// EarlyReserveRegion. Initially, it points to tempMappingAddr which
+	// coincides with the end of the kernel address space.
+	earlyReserveTop = tempMappingAddr
+
 	// earlyReserveLastUsed tracks the last reserved page address and is
 	// decreased after each allocation request. Initially, it points to
-	// tempMappingAddr which coincides with the end of the kernel address
-	// space.
+	// earlyReserveTop.
 	earlyReserveLastUsed = tempMappingAddr
 
-	errEarlyReserveNoSpace = &kernel.Error{Module: "early_reserve", Message: "remaining virtual address space not large enough to satisfy reservation request"}
+	// earlyUint64Fn is used by tests to mock calls to the rand package.
+	earlyUint64Fn = rand.EarlyUint64
+
+	errEarlyReserveNoSpace = &kernel.Error{Module: "early_reserve", Message: "remaining virtual address space not large enough to satisfy reservation request", Code: kernel.CodeOutOfMemory}
 )
 
+// RandomizeEarlyReserveRegion moves the region used by EarlyReserveRegion
+// down by a random number of pages so that the addresses of the kernel heap,
+// thread stacks, boot modules and device mappings differ between boots. The
+// kernel image itself is linked at a fixed address and is not relocated.
+//
+// RandomizeEarlyReserveRegion must be invoked before the first call to
+// EarlyReserveRegion; calling it afterwards has no effect.
+func RandomizeEarlyReserveRegion() {
+	if earlyReserveLastUsed != earlyReserveTop {
+		return
+	}
+
+	offset := uintptr(earlyUint64Fn()%earlyReserveRandomPages) << mm.PageShift
+	earlyReserveTop = tempMappingAddr - offset
+	earlyReserveLastUsed = earlyReserveTop
+}
+
 // EarlyReserveRegion reserves a page-aligned contiguous virtual memory region
 // with the requested size in the kernel address space and returns its virtual
 // address. If size is not a multiple of mm.PageSize it will be automatically
 // rounded up.
 //
 // This function allocates regions starting at the end of the kernel address
-// space. It should only be used during the early stages of kernel initialization.
+// space, or below a random offset from it if RandomizeEarlyReserveRegion has
+// been invoked. It should only be used during the early stages of kernel
+// initialization.
 func EarlyReserveRegion(size uintptr) (uintptr, *kernel.Error) {
 	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
 
@@ -1,6 +1,8 @@
 package vmm
 
 import (
+	"gopheros/kernel/mm"
+	"gopheros/kernel/rand"
 	"runtime"
 	"testing"
 )
@@ -27,3 +29,34 @@ func TestEarlyReserveAmd64(t *testing.T) {
 		t.Fatalf("expected to get errEarlyReserveNoSpace; got %v", err)
 	}
 }
+
+func TestRandomizeEarlyReserveRegion(t *testing.T) {
+	defer func() {
+		earlyReserveTop = tempMappingAddr
+		earlyReserveLastUsed = tempMappingAddr
+		earlyUint64Fn = rand.EarlyUint64
+	}()
+
+	earlyUint64Fn = func() uint64 { return 3*earlyReserveRandomPages + 5 }
+	RandomizeEarlyReserveRegion()
+
+	exp := tempMappingAddr - 5*mm.PageSize
+	if earlyReserveTop != exp || earlyReserveLastUsed != exp {
+		t.Fatalf("expected the early reservation region to end at 0x%x; got top 0x%x, last used 0x%x", exp, earlyReserveTop, earlyReserveLastUsed)
+	}
+
+	next, err := EarlyReserveRegion(mm.PageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp -= mm.PageSize; next != exp {
+		t.Fatalf("expected reservation at 0x%x; got 0x%x", exp, next)
+	}
+
+	// Once regions have been reserved, the region can no longer move
+	earlyUint64Fn = func() uint64 { return 0 }
+	RandomizeEarlyReserveRegion()
+	if earlyReserveLastUsed != next {
+		t.Fatal("expected RandomizeEarlyReserveRegion to have no effect after the first reservation")
+	}
+}
@@ -5,14 +5,62 @@ import (
 	"gopheros/kernel/gate"
 	"gopheros/kernel/kfmt"
 	"gopheros/kernel/mm"
+	"gopheros/kernel/trace"
 )
 
 var (
 	// handleInterruptFn is used by tests.
 	handleInterruptFn = gate.HandleInterrupt
+
+	// panicWithRegistersFn is used by tests.
+	panicWithRegistersFn = kfmt.PanicWithRegisters
+
+	// userFaultHandler is invoked for faults raised by user-mode code that
+	// the kernel cannot recover from.
+	userFaultHandler func(faultAddress uintptr, regs *gate.Registers) bool
+
+	// demandFaultHandler is invoked for accesses to non-present pages in
+	// the user half of the address space.
+	demandFaultHandler func(faultAddress uintptr, write bool) bool
+)
+
+// The page fault error code bits that are examined by the fault handler.
+const (
+	faultPresent = 1 << 0
+	faultWrite   = 1 << 1
 )
 
+// SetUserFaultHandler registers a function that is invoked when user-mode code
+// triggers a page fault or a general protection fault that the kernel cannot
+// recover from (e.g. by accessing an unmapped address). If the handler returns
+// true, the fault is considered handled and the kernel does not panic.
+func SetUserFaultHandler(handler func(faultAddress uintptr, regs *gate.Registers) bool) {
+	userFaultHandler = handler
+}
+
+// SetDemandFaultHandler registers a function that is invoked when either
+// user-mode code or the kernel accesses a non-present page in the user half of
+// the address space. If the handler returns true, it has mapped the page and
+// the faulting instruction is retried.
+func SetDemandFaultHandler(handler func(faultAddress uintptr, write bool) bool) {
+	demandFaultHandler = handler
+}
+
+// handleDemandFault passes faults on non-present user pages to the registered
+// demand fault handler and returns true if the handler mapped the page.
+func handleDemandFault(faultAddress uintptr, regs *gate.Registers) bool {
+	return regs.Info&faultPresent == 0 && faultAddress < UserSpaceEnd &&
+		demandFaultHandler != nil && demandFaultHandler(faultAddress, regs.Info&faultWrite != 0)
+}
+
+// handleUserFault passes faults raised by user-mode code to the registered
+// user fault handler and returns true if the handler dealt with the fault.
+func handleUserFault(faultAddress uintptr, regs *gate.Registers) bool {
+	return regs.CS&3 != 0 && userFaultHandler != nil && userFaultHandler(faultAddress, regs)
+}
+
 func installFaultHandlers() {
+	initExceptionTable()
 	handleInterruptFn(gate.PageFaultException, 0, pageFaultHandler)
 	handleInterruptFn(gate.GPFException, 0, generalProtectionFaultHandler)
 }
@@ -26,6 +74,8 @@ func pageFaultHandler(regs *gate.Registers) {
 		pageEntry    *pageTableEntry
 	)
 
+	trace.Record(trace.EventPageFault, uint64(faultAddress), regs.Info)
+
 	// Lookup entry for the page where the fault occurred
 	walk(faultPage.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
 		nextIsPresent := pte.HasFlags(FlagPresent)
@@ -51,8 +101,11 @@ func pageFaultHandler(regs *gate.Registers) {
 		} else if tmpPage, err = mapTemporaryFn(copy); err != nil {
 			nonRecoverablePageFault(faultAddress, regs, err)
 		} else {
-			// Copy page contents, mark as RW and remove CoW flag
+			// Copy page contents, mark as RW and remove CoW flag. The
+			// faulting page may belong to user-space.
+			BeginUserAccess()
 			kernel.Memcopy(faultPage.Address(), tmpPage.Address(), mm.PageSize)
+			EndUserAccess()
 			_ = unmapFn(tmpPage)
 
 			// Update mapping to point to the new frame, flag it as RW and
@@ -67,6 +120,12 @@ func pageFaultHandler(regs *gate.Registers) {
 		}
 	}
 
+	// Lazily populated user pages are mapped on first access. Other faults
+	// caused by the user access routines are reported to their callers.
+	if handleDemandFault(faultAddress, regs) || fixupFault(regs) || handleUserFault(faultAddress, regs) {
+		return
+	}
+
 	nonRecoverablePageFault(faultAddress, regs, errUnrecoverableFault)
 }
 
@@ -75,12 +134,13 @@ func pageFaultHandler(regs *gate.Registers) {
 // - executing privileged instructions outside ring-0
 // - attempts to access reserved or unimplemented CPU registers
 func generalProtectionFaultHandler(regs *gate.Registers) {
-	kfmt.Printf("\nGeneral protection fault while accessing address: 0x%x\n", readCR2Fn())
-	kfmt.Printf("Registers:\n")
-	regs.DumpTo(kfmt.GetOutputSink())
+	// Non-canonical user addresses raise a GPF instead of a page fault
+	if fixupFault(regs) || handleUserFault(0, regs) {
+		return
+	}
 
-	// TODO: Revisit this when user-mode tasks are implemented
-	panic(errUnrecoverableFault)
+	kfmt.Printf("\nGeneral protection fault while accessing address: 0x%x\n", readCR2Fn())
+	panicWithRegistersFn(errUnrecoverableFault, regs)
 }
 
 func nonRecoverablePageFault(faultAddress uintptr, regs *gate.Registers, err *kernel.Error) {
@@ -100,13 +160,13 @@ func nonRecoverablePageFault(faultAddress uintptr, regs *gate.Registers, err *ke
 		kfmt.Printf("page table has reserved bit set")
 	case regs.Info == 16:
 		kfmt.Printf("instruction fetch")
+	case regs.Info == 17:
+		kfmt.Printf("page protection violation (instruction fetch)")
 	default:
 		kfmt.Printf("unknown")
 	}
 
-	kfmt.Printf("\n\nRegisters:\n")
-	regs.DumpTo(kfmt.GetOutputSink())
+	kfmt.Printf("\n")
 
-	// TODO: Revisit this when user-mode tasks are implemented
-	panic(err)
+	panicWithRegistersFn(err, regs)
 }
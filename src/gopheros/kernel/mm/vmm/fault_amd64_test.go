@@ -13,6 +13,12 @@ import (
 	"unsafe"
 )
 
+// mockPanicWithRegisters replaces kfmt.PanicWithRegisters with a regular
+// panic so that tests can recover from it.
+func mockPanicWithRegisters(e interface{}, _ kfmt.RegisterState) {
+	panic(e)
+}
+
 func TestRecoverablePageFault(t *testing.T) {
 	var (
 		regs       gate.Registers
@@ -29,7 +35,9 @@ func TestRecoverablePageFault(t *testing.T) {
 		mapTemporaryFn = MapTemporary
 		unmapFn = Unmap
 		flushTLBEntryFn = cpu.FlushTLBEntry
+		panicWithRegistersFn = kfmt.PanicWithRegisters
 	}(ptePtrFn)
+	panicWithRegistersFn = mockPanicWithRegisters
 
 	specs := []struct {
 		pteFlags   PageTableEntryFlag
@@ -100,7 +108,9 @@ func TestRecoverablePageFault(t *testing.T) {
 func TestNonRecoverablePageFault(t *testing.T) {
 	defer func() {
 		kfmt.SetOutputSink(nil)
+		panicWithRegistersFn = kfmt.PanicWithRegisters
 	}()
+	panicWithRegistersFn = mockPanicWithRegisters
 
 	specs := []struct {
 		errCode   uint64
@@ -134,6 +144,10 @@ func TestNonRecoverablePageFault(t *testing.T) {
 			16,
 			"instruction fetch",
 		},
+		{
+			17,
+			"page protection violation (instruction fetch)",
+		},
 		{
 			0xf00,
 			"unknown",
@@ -167,7 +181,9 @@ func TestNonRecoverablePageFault(t *testing.T) {
 func TestGPFHandler(t *testing.T) {
 	defer func() {
 		readCR2Fn = cpu.ReadCR2
+		panicWithRegistersFn = kfmt.PanicWithRegisters
 	}()
+	panicWithRegistersFn = mockPanicWithRegisters
 
 	var regs gate.Registers
 
@@ -183,3 +199,75 @@ func TestGPFHandler(t *testing.T) {
 
 	generalProtectionFaultHandler(&regs)
 }
+
+func TestUserFaultHandler(t *testing.T) {
+	defer func() {
+		readCR2Fn = cpu.ReadCR2
+		panicWithRegistersFn = kfmt.PanicWithRegisters
+		SetUserFaultHandler(nil)
+	}()
+	panicWithRegistersFn = mockPanicWithRegisters
+	readCR2Fn = func() uint64 { return 0 }
+
+	var handled int
+	SetUserFaultHandler(func(_ uintptr, _ *gate.Registers) bool {
+		handled++
+		return true
+	})
+
+	// Faults raised by user-mode code are passed to the handler
+	regs := gate.Registers{CS: 0x23}
+	generalProtectionFaultHandler(&regs)
+	if handled != 1 {
+		t.Fatalf("expected the user fault handler to be invoked once; got %d", handled)
+	}
+
+	// Faults raised by kernel code are never passed to the handler
+	defer func() {
+		if err := recover(); err != errUnrecoverableFault {
+			t.Errorf("expected a panic with errUnrecoverableFault; got %v", err)
+		}
+		if handled != 1 {
+			t.Errorf("expected the user fault handler not to be invoked for kernel faults; got %d calls", handled)
+		}
+	}()
+
+	regs.CS = 0x8
+	generalProtectionFaultHandler(&regs)
+}
+
+func TestDemandFaultHandler(t *testing.T) {
+	defer SetDemandFaultHandler(nil)
+
+	var (
+		regs     gate.Registers
+		gotWrite bool
+	)
+	if handleDemandFault(0x1000, &regs) {
+		t.Fatal("expected demand faults not to be handled without a handler")
+	}
+
+	SetDemandFaultHandler(func(_ uintptr, write bool) bool {
+		gotWrite = write
+		return true
+	})
+
+	for specIndex, spec := range []struct {
+		addr     uintptr
+		info     uint64
+		expOK    bool
+		expWrite bool
+	}{
+		{0x1000, 0, true, false},
+		{0x1000, faultWrite, true, true},
+		// Protection violations on present pages are not demand faults
+		{0x1000, faultPresent | faultWrite, false, false},
+		{UserSpaceEnd, 0, false, false},
+	} {
+		gotWrite = false
+		regs.Info = spec.info
+		if ok := handleDemandFault(spec.addr, &regs); ok != spec.expOK || gotWrite != spec.expWrite {
+			t.Errorf("[spec %d] expected to get %t (write: %t); got %t (write: %t)", specIndex, spec.expOK, spec.expWrite, ok, gotWrite)
+		}
+	}
+}
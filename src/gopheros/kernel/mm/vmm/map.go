@@ -48,7 +48,7 @@ var (
 
 	earlyReserveRegionFn = EarlyReserveRegion
 
-	errNoHugePageSupport           = &kernel.Error{Module: "vmm", Message: "huge pages are not supported"}
+	errNoHugePageSupport           = &kernel.Error{Module: "vmm", Message: "huge pages are not supported", Code: kernel.CodeNotSupported}
 	errAttemptToRWMapReservedFrame = &kernel.Error{Module: "vmm", Message: "reserved blank frame cannot be mapped with a RW flag"}
 )
 
@@ -64,6 +64,7 @@ func Map(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
 	}
 
 	var err *kernel.Error
+	flags &^= unsupportedFlags
 
 	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
 		// If we reached the last level all we need to do is to map the
@@ -100,6 +101,12 @@ func Map(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
 			kernel.Memset(nextAddrFn(nextTableAddr), 0, mm.PageSize)
 		}
 
+		// The MMU only allows user-mode accesses to a page if all page
+		// table entries leading to it are flagged as user-accessible.
+		if flags&FlagUserAccessible != 0 {
+			pte.SetFlags(FlagUserAccessible)
+		}
+
 		return true
 	})
 
@@ -147,6 +154,26 @@ func IdentityMapRegion(startFrame mm.Frame, size uintptr, flags PageTableEntryFl
 	return startPage, nil
 }
 
+// AllocDMA allocates a zeroed, physically contiguous memory region that can
+// be shared with devices and maps it into the active address space. It returns
+// the virtual and physical address of the region. The size argument is always
+// rounded up to the nearest page boundary.
+func AllocDMA(size uintptr) (uintptr, uintptr, *kernel.Error) {
+	pageCount := (size + (mm.PageSize - 1)) >> mm.PageShift
+	frame, err := mm.AllocContiguousFrames(uint32(pageCount))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	page, err := MapRegion(frame, pageCount<<mm.PageShift, FlagPresent|FlagRW|FlagNoExecute)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	kernel.Memset(page.Address(), 0, pageCount<<mm.PageShift)
+	return page.Address(), frame.Address(), nil
+}
+
 // MapTemporary establishes a temporary RW mapping of a physical mmory frame
 // to a fixed virtual address overwriting any previous mapping. The temporary
 // mapping mechanism is primarily used by the kernel to access and initialize
@@ -158,7 +185,7 @@ func MapTemporary(frame mm.Frame) (mm.Page, *kernel.Error) {
 		return 0, errAttemptToRWMapReservedFrame
 	}
 
-	if err := Map(mm.PageFromAddress(tempMappingAddr), frame, FlagPresent|FlagRW); err != nil {
+	if err := Map(mm.PageFromAddress(tempMappingAddr), frame, FlagPresent|FlagRW|FlagNoExecute); err != nil {
 		return 0, err
 	}
 
@@ -210,6 +237,38 @@ func Translate(virtAddr uintptr) (uintptr, *kernel.Error) {
 	return physAddr, nil
 }
 
+// UserAccessible returns true if the page that contains virtAddr is mapped
+// and can be accessed by user-mode code. If write is true, the page must also
+// be writable or flagged as copy-on-write.
+func UserAccessible(virtAddr uintptr, write bool) bool {
+	accessible := true
+	walk(virtAddr, func(pteLevel uint8, pte *pageTableEntry) bool {
+		if !pte.HasFlags(FlagPresent | FlagUserAccessible) {
+			accessible = false
+			return false
+		}
+
+		if pteLevel == pageLevels-1 && write && !pte.HasAnyFlag(FlagRW|FlagCopyOnWrite) {
+			accessible = false
+		}
+
+		return true
+	})
+
+	return accessible
+}
+
+// VisitPageTableEntries invokes visitor with the raw contents of the page table
+// entry that is used for translating virtAddr at each paging level, starting
+// with the top-most table. The walk stops after visiting an entry that is
+// either not present or maps a huge page.
+func VisitPageTableEntries(virtAddr uintptr, visitor func(level uint8, entry uintptr)) {
+	walk(virtAddr, func(pteLevel uint8, pte *pageTableEntry) bool {
+		visitor(pteLevel, uintptr(*pte))
+		return pte.HasFlags(FlagPresent) && !pte.HasFlags(FlagHugePage)
+	})
+}
+
 // PageOffset returns the offset within the page specified by a virtual
 // address.
 func PageOffset(virtAddr uintptr) uintptr {
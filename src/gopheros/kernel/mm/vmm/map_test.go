@@ -83,11 +83,20 @@ func TestMapTemporaryAmd64(t *testing.T) {
 			if exp, got := mm.Frame(uintptr(unsafe.Pointer(&physPages[level+1][0]))>>mm.PageShift), pte.Frame(); got != exp {
 				t.Errorf("[pte at level %d] expected entry frame to be %d; got %d", level, exp, got)
 			}
+
+			// NX on intermediate entries would apply to all pages below them
+			if pte.HasFlags(FlagNoExecute) {
+				t.Errorf("[pte at level %d] expected entry not to have FlagNoExecute set", level)
+			}
 		default:
 			// The last pte entry should point to frame
 			if got := pte.Frame(); got != frame {
 				t.Errorf("[pte at level %d] expected entry frame to be %d; got %d", level, frame, got)
 			}
+
+			if !pte.HasFlags(FlagNoExecute) {
+				t.Errorf("[pte at level %d] expected entry to have FlagNoExecute set", level)
+			}
 		}
 	}
 
@@ -96,6 +105,94 @@ func TestMapTemporaryAmd64(t *testing.T) {
 	}
 }
 
+func TestMapUserAccessibleAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		flushTLBEntryFn = origFlushTLBEntryFn
+		mm.SetFrameAllocator(nil)
+	}(ptePtrFn, nextAddrFn, flushTLBEntryFn)
+
+	var physPages [pageLevels][mm.PageSize >> mm.PointerShift]pageTableEntry
+	nextPhysPage := 0
+
+	mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+		nextPhysPage++
+		pageAddr := unsafe.Pointer(&physPages[nextPhysPage][0])
+		return mm.Frame(uintptr(pageAddr) >> mm.PageShift), nil
+	})
+
+	pteCallCount := 0
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		pteCallCount++
+		pteIndex := (entry & uintptr(mm.PageSize-1)) >> mm.PointerShift
+		return unsafe.Pointer(&physPages[pteCallCount-1][pteIndex])
+	}
+	nextAddrFn = func(entry uintptr) uintptr {
+		return uintptr(unsafe.Pointer(&physPages[nextPhysPage][0]))
+	}
+	flushTLBEntryFn = func(uintptr) {}
+
+	// The page address breaks down to index 0 at every level
+	if err := Map(mm.Page(0), mm.Frame(123), FlagPresent|FlagRW|FlagUserAccessible); err != nil {
+		t.Fatal(err)
+	}
+
+	for level, physPage := range physPages {
+		if pte := physPage[0]; !pte.HasFlags(FlagPresent | FlagUserAccessible) {
+			t.Errorf("[pte at level %d] expected entry to have FlagPresent and FlagUserAccessible set", level)
+		}
+	}
+}
+
+func TestMapUnsupportedFlagsAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		flushTLBEntryFn = origFlushTLBEntryFn
+		unsupportedFlags = 0
+		mm.SetFrameAllocator(nil)
+	}(ptePtrFn, nextAddrFn, flushTLBEntryFn)
+
+	var physPages [pageLevels][mm.PageSize >> mm.PointerShift]pageTableEntry
+	nextPhysPage := 0
+
+	mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+		nextPhysPage++
+		pageAddr := unsafe.Pointer(&physPages[nextPhysPage][0])
+		return mm.Frame(uintptr(pageAddr) >> mm.PageShift), nil
+	})
+
+	pteCallCount := 0
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		pteCallCount++
+		pteIndex := (entry & uintptr(mm.PageSize-1)) >> mm.PointerShift
+		return unsafe.Pointer(&physPages[pteCallCount-1][pteIndex])
+	}
+	nextAddrFn = func(entry uintptr) uintptr {
+		return uintptr(unsafe.Pointer(&physPages[nextPhysPage][0]))
+	}
+	flushTLBEntryFn = func(uintptr) {}
+
+	// Emulate a CPU without NX support
+	unsupportedFlags = FlagNoExecute
+	if err := Map(mm.Page(0), mm.Frame(123), FlagPresent|FlagRW|FlagNoExecute); err != nil {
+		t.Fatal(err)
+	}
+
+	if pte := physPages[pageLevels-1][0]; !pte.HasFlags(FlagPresent|FlagRW) || pte.HasFlags(FlagNoExecute) {
+		t.Error("expected unsupported flags to be stripped from the page table entry")
+	}
+}
+
 func TestMapRegion(t *testing.T) {
 	defer func() {
 		mapFn = Map
@@ -163,6 +260,65 @@ func TestMapRegion(t *testing.T) {
 	})
 }
 
+func TestAllocDMA(t *testing.T) {
+	defer func() {
+		mapFn = Map
+		earlyReserveRegionFn = EarlyReserveRegion
+		mm.SetContiguousFrameAllocator(nil)
+	}()
+
+	var (
+		region      = make([]byte, 3*mm.PageSize)
+		regionAddr  = (uintptr(unsafe.Pointer(&region[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+		frameCount  uint32
+		mappedFlags PageTableEntryFlag
+	)
+
+	for i := range region {
+		region[i] = 0xfe
+	}
+
+	mm.SetContiguousFrameAllocator(func(count uint32) (mm.Frame, *kernel.Error) {
+		frameCount = count
+		return mm.Frame(0xdf0), nil
+	})
+	earlyReserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return regionAddr, nil }
+	mapFn = func(_ mm.Page, _ mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		mappedFlags = flags
+		return nil
+	}
+
+	virt, phys, err := AllocDMA(mm.PageSize + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if virt != regionAddr || phys != mm.Frame(0xdf0).Address() || frameCount != 2 {
+		t.Fatalf("expected 2 frames at 0x%x to be mapped at 0x%x; got %d frames at 0x%x mapped at 0x%x", mm.Frame(0xdf0).Address(), regionAddr, frameCount, phys, virt)
+	}
+
+	if exp := FlagPresent | FlagRW | FlagNoExecute; mappedFlags != exp {
+		t.Fatalf("expected region to be mapped with flags %d; got %d", exp, mappedFlags)
+	}
+
+	for i := uintptr(0); i < 2*mm.PageSize; i++ {
+		if *(*byte)(unsafe.Pointer(virt + i)) != 0 {
+			t.Fatalf("expected region to be zeroed; byte at offset %d is not", i)
+		}
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "out of address space"}
+	earlyReserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, expErr }
+	if _, _, err = AllocDMA(1); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+
+	mm.SetContiguousFrameAllocator(func(_ uint32) (mm.Frame, *kernel.Error) { return mm.InvalidFrame, expErr })
+	if _, _, err = AllocDMA(1); err != expErr {
+		t.Fatalf("expected error %v; got %v", expErr, err)
+	}
+}
+
 func TestIdentityMapRegion(t *testing.T) {
 	defer func() {
 		mapFn = Map
@@ -423,3 +579,96 @@ func TestTranslateAmd64(t *testing.T) {
 		}
 	}
 }
+
+func TestUserAccessibleAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+	}(ptePtrFn)
+
+	var (
+		user     = FlagPresent | FlagUserAccessible
+		userRW   = user | FlagRW
+		userCoW  = user | FlagCopyOnWrite
+		kernelRW = FlagPresent | FlagRW
+	)
+
+	specs := []struct {
+		levelFlags [pageLevels]PageTableEntryFlag
+		write      bool
+		exp        bool
+	}{
+		{[pageLevels]PageTableEntryFlag{userRW, userRW, userRW, user}, false, true},
+		{[pageLevels]PageTableEntryFlag{userRW, userRW, userRW, user}, true, false},
+		{[pageLevels]PageTableEntryFlag{userRW, userRW, userRW, userRW}, true, true},
+		{[pageLevels]PageTableEntryFlag{userRW, userRW, userRW, userCoW}, true, true},
+		{[pageLevels]PageTableEntryFlag{userRW, kernelRW, userRW, userRW}, false, false},
+		{[pageLevels]PageTableEntryFlag{userRW, userRW, userRW, kernelRW}, false, false},
+		{[pageLevels]PageTableEntryFlag{userRW, userRW, 0, userRW}, false, false},
+	}
+
+	for specIndex, spec := range specs {
+		pteCallCount := 0
+		ptePtrFn = func(entry uintptr) unsafe.Pointer {
+			var pte pageTableEntry
+			pte.SetFlags(spec.levelFlags[pteCallCount])
+			pteCallCount++
+
+			return unsafe.Pointer(&pte)
+		}
+
+		if got := UserAccessible(0x1000, spec.write); got != spec.exp {
+			t.Errorf("[spec %d] expected UserAccessible to return %t; got %t", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestVisitPageTableEntriesAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+	}(ptePtrFn)
+
+	var (
+		table = FlagPresent | FlagRW
+		huge  = table | FlagHugePage
+	)
+
+	specs := []struct {
+		levelFlags [pageLevels]PageTableEntryFlag
+		expLevels  int
+	}{
+		{[pageLevels]PageTableEntryFlag{table, table, table, table}, 4},
+		{[pageLevels]PageTableEntryFlag{table, table, huge, table}, 3},
+		{[pageLevels]PageTableEntryFlag{table, 0, table, table}, 2},
+	}
+
+	for specIndex, spec := range specs {
+		pteCallCount := 0
+		ptePtrFn = func(entry uintptr) unsafe.Pointer {
+			var pte pageTableEntry
+			pte.SetFlags(spec.levelFlags[pteCallCount])
+			pteCallCount++
+
+			return unsafe.Pointer(&pte)
+		}
+
+		var visited int
+		VisitPageTableEntries(0x1000, func(level uint8, entry uintptr) {
+			if int(level) != visited || entry != uintptr(spec.levelFlags[level]) {
+				t.Errorf("[spec %d] unexpected entry 0x%x at level %d", specIndex, entry, level)
+			}
+			visited++
+		})
+
+		if visited != spec.expLevels {
+			t.Errorf("[spec %d] expected %d entries to be visited; got %d", specIndex, spec.expLevels, visited)
+		}
+	}
+}
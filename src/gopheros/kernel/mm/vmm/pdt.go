@@ -138,6 +138,29 @@ func (pdt PageDirectoryTable) Unmap(page mm.Page) *kernel.Error {
 	return err
 }
 
+// ShareKernelMappings copies the top-level entries that cover the kernel half
+// of the address space from the active PDT to this PDT so that the kernel
+// remains accessible while this PDT is active. The lower-level tables are
+// shared, so kernel mappings established after this call are visible through
+// both PDTs as long as they do not require a new top-level entry.
+func (pdt PageDirectoryTable) ShareKernelMappings() *kernel.Error {
+	pdtPage, err := mapTemporaryFn(pdt.pdtFrame)
+	if err != nil {
+		return err
+	}
+
+	// The last entry holds the recursive mapping and must not be copied
+	lastPdtEntryIndex := uintptr(1<<pageLevelBits[0]) - 1
+	for index := uintptr(kernelPdtEntryIndex); index < lastPdtEntryIndex; index++ {
+		src := (*pageTableEntry)(unsafe.Pointer(pdtVirtualAddr + (index << mm.PointerShift)))
+		dst := (*pageTableEntry)(unsafe.Pointer(pdtPage.Address() + (index << mm.PointerShift)))
+		*dst = *src
+	}
+
+	_ = unmapFn(pdtPage)
+	return nil
+}
+
 // Activate enables this page directory table and flushes the TLB
 func (pdt PageDirectoryTable) Activate() {
 	switchPDTFn(pdt.pdtFrame.Address())
@@ -205,7 +228,7 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 
 	// Ensure that any pages mapped by the mmory allocator using
 	// EarlyReserveRegion are copied to the new page directory.
-	for rsvAddr := earlyReserveLastUsed; rsvAddr < tempMappingAddr; rsvAddr += mm.PageSize {
+	for rsvAddr := earlyReserveLastUsed; rsvAddr < earlyReserveTop; rsvAddr += mm.PageSize {
 		page := mm.PageFromAddress(rsvAddr)
 
 		frameAddr, err := translateFn(rsvAddr)
@@ -213,7 +236,7 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 			return err
 		}
 
-		if err = kernelPDT.Map(page, mm.Frame(frameAddr>>mm.PageShift), FlagPresent|FlagRW); err != nil {
+		if err = kernelPDT.Map(page, mm.Frame(frameAddr>>mm.PageShift), FlagPresent|FlagRW|FlagNoExecute); err != nil {
 			return err
 		}
 	}
@@ -235,7 +258,7 @@ func noEscape(p unsafe.Pointer) unsafe.Pointer {
 
 var (
 	// ErrInvalidMapping is returned when trying to lookup a virtual memory address that is not yet mapped.
-	ErrInvalidMapping = &kernel.Error{Module: "vmm", Message: "virtual address does not point to a mapped physical page"}
+	ErrInvalidMapping = &kernel.Error{Module: "vmm", Message: "virtual address does not point to a mapped physical page", Code: kernel.CodeBadAddress}
 )
 
 // PageTableEntryFlag describes a flag that can be applied to a page table entry.
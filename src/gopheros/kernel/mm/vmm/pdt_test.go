@@ -334,6 +334,74 @@ func TestPageDirectoryTableActivateAmd64(t *testing.T) {
 	}
 }
 
+func TestPageDirectoryTableShareKernelMappingsAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origMapTemporary func(mm.Frame) (mm.Page, *kernel.Error), origUnmap func(mm.Page) *kernel.Error, origPdtVirtualAddr uintptr) {
+		mapTemporaryFn = origMapTemporary
+		unmapFn = origUnmap
+		pdtVirtualAddr = origPdtVirtualAddr
+	}(mapTemporaryFn, unmapFn, pdtVirtualAddr)
+
+	var (
+		pdt       = PageDirectoryTable{pdtFrame: mm.Frame(123)}
+		activePdt = new([mm.PageSize >> mm.PointerShift]pageTableEntry)
+		newPdt    = new([mm.PageSize >> mm.PointerShift]pageTableEntry)
+	)
+
+	for i := range activePdt {
+		activePdt[i] = pageTableEntry(i + 1)
+	}
+	pdtVirtualAddr = uintptr(unsafe.Pointer(&activePdt[0]))
+
+	t.Run("map error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+		mapTemporaryFn = func(_ mm.Frame) (mm.Page, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if err := pdt.ShareKernelMappings(); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		mapTemporaryFn = func(frame mm.Frame) (mm.Page, *kernel.Error) {
+			if frame != pdt.pdtFrame {
+				t.Errorf("expected MapTemporary to be called with frame %d; got %d", pdt.pdtFrame, frame)
+			}
+			return mm.PageFromAddress(uintptr(unsafe.Pointer(&newPdt[0]))), nil
+		}
+
+		unmapCallCount := 0
+		unmapFn = func(_ mm.Page) *kernel.Error {
+			unmapCallCount++
+			return nil
+		}
+
+		if err := pdt.ShareKernelMappings(); err != nil {
+			t.Fatal(err)
+		}
+
+		if unmapCallCount != 1 {
+			t.Fatalf("expected Unmap to be called 1 time; called %d", unmapCallCount)
+		}
+
+		for i, pte := range newPdt {
+			var exp pageTableEntry
+			if i >= kernelPdtEntryIndex && i < len(newPdt)-1 {
+				exp = activePdt[i]
+			}
+
+			if pte != exp {
+				t.Errorf("expected PDT entry %d to be %x; got %x", i, exp, pte)
+			}
+		}
+	})
+}
+
 func TestSetupPDTForKernel(t *testing.T) {
 	defer func() {
 		mm.SetFrameAllocator(nil)
@@ -0,0 +1,107 @@
+package vmm
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+)
+
+const (
+	msrEFER = 0xc0000080
+
+	// eferNXE enables the no-execute page protection feature.
+	eferNXE = 1 << 11
+
+	// cr4SMEP prevents supervisor-mode code from executing instructions
+	// fetched from user-accessible pages.
+	cr4SMEP = 1 << 20
+
+	// cr4SMAP prevents supervisor-mode code from accessing user-accessible
+	// pages unless the AC flag in RFLAGS is set.
+	cr4SMAP = 1 << 21
+
+	cpuidExtEDXNX  = uint32(1 << 20)
+	cpuidEBXSMEP   = uint32(1 << 7)
+	cpuidEBXSMAP   = uint32(1 << 20)
+	cpuidExtLeaf   = uint32(0x80000000)
+	cpuidExtFeatID = uint32(0x80000001)
+)
+
+var (
+	// smapEnabled is set to true if supervisor-mode access prevention has
+	// been enabled. When set, BeginUserAccess and EndUserAccess toggle the
+	// AC flag.
+	smapEnabled bool
+
+	// unsupportedFlags contains the page table entry flags that are
+	// stripped by Map as the CPU does not support them.
+	unsupportedFlags PageTableEntryFlag
+
+	// The following functions are used by tests to mock calls to the cpu
+	// package which will cause a fault if called in user-mode.
+	cpuidFn    = cpu.ID
+	readMSRFn  = cpu.ReadMSR
+	writeMSRFn = cpu.WriteMSR
+	readCR4Fn  = cpu.ReadCR4
+	writeCR4Fn = cpu.WriteCR4
+	stacFn     = cpu.STAC
+	clacFn     = cpu.CLAC
+)
+
+// enableProtection enables the page protection features supported by the
+// CPU: no-execute pages and, if available, supervisor-mode execution (SMEP)
+// and access (SMAP) prevention. With SMEP and SMAP enabled, any attempt by the
+// kernel to execute or, outside of a BeginUserAccess/EndUserAccess block,
+// access user memory triggers a page fault.
+func enableProtection() {
+	var nx, smep, smap bool
+
+	if maxLeaf, _, _, _ := cpuidFn(cpuidExtLeaf); maxLeaf >= cpuidExtFeatID {
+		_, _, _, edx := cpuidFn(cpuidExtFeatID)
+		nx = edx&cpuidExtEDXNX != 0
+	}
+
+	if maxLeaf, _, _, _ := cpuidFn(0); maxLeaf >= 7 {
+		_, ebx, _, _ := cpuidFn(7)
+		smep = ebx&cpuidEBXSMEP != 0
+		smap = ebx&cpuidEBXSMAP != 0
+	}
+
+	if nx {
+		writeMSRFn(msrEFER, readMSRFn(msrEFER)|eferNXE)
+	} else {
+		// Setting the NX bit in a page table entry without NXE enabled
+		// causes a reserved bit violation.
+		unsupportedFlags |= FlagNoExecute
+	}
+
+	cr4 := readCR4Fn()
+	if smep {
+		cr4 |= cr4SMEP
+	}
+	if smap {
+		// Clear AC before enabling SMAP in case it happens to be set.
+		clacFn()
+		cr4 |= cr4SMAP
+	}
+	writeCR4Fn(cr4)
+	smapEnabled = smap
+
+	kfmt.Printf("[vmm] page protection: NX=%t SMEP=%t SMAP=%t\n", nx, smep, smap)
+}
+
+// BeginUserAccess allows the kernel to access user-accessible pages until the
+// next call to EndUserAccess. Accesses must be kept as short as possible and
+// must not block.
+func BeginUserAccess() {
+	if smapEnabled {
+		stacFn()
+	}
+}
+
+// EndUserAccess restores the protection of user-accessible pages after a call
+// to BeginUserAccess.
+func EndUserAccess() {
+	if smapEnabled {
+		clacFn()
+	}
+}
@@ -0,0 +1,145 @@
+package vmm
+
+import (
+	"bytes"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+	"strings"
+	"testing"
+)
+
+// cpuState records the register writes performed by enableProtection and
+// the user access helpers.
+var cpuState struct {
+	efer, cr4 uint64
+	ac        bool
+	calls     string
+}
+
+// mockProtection mocks the cpu package calls used by enableProtection. The
+// extended CPUID leaf reports extEDX and leaf 7 reports ebx7.
+func mockProtection(extEDX, ebx7 uint32) {
+	cpuState.efer, cpuState.cr4, cpuState.ac, cpuState.calls = 1<<8, 1<<5, true, ""
+	cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+		switch leaf {
+		case 0:
+			return 7, 0, 0, 0
+		case 7:
+			return 0, ebx7, 0, 0
+		case cpuidExtLeaf:
+			return cpuidExtFeatID, 0, 0, 0
+		case cpuidExtFeatID:
+			return 0, 0, 0, extEDX
+		}
+		return 0, 0, 0, 0
+	}
+	readMSRFn = func(msr uint32) uint64 {
+		if msr != msrEFER {
+			panic("unexpected MSR read")
+		}
+		return cpuState.efer
+	}
+	writeMSRFn = func(msr uint32, value uint64) {
+		if msr != msrEFER {
+			panic("unexpected MSR write")
+		}
+		cpuState.efer = value
+	}
+	readCR4Fn = func() uint64 { return cpuState.cr4 }
+	writeCR4Fn = func(value uint64) { cpuState.cr4 = value }
+	stacFn = func() { cpuState.ac = true; cpuState.calls += "stac;" }
+	clacFn = func() { cpuState.ac = false; cpuState.calls += "clac;" }
+}
+
+func restoreProtectionMocks() {
+	cpuidFn = cpu.ID
+	readMSRFn = cpu.ReadMSR
+	writeMSRFn = cpu.WriteMSR
+	readCR4Fn = cpu.ReadCR4
+	writeCR4Fn = cpu.WriteCR4
+	stacFn = cpu.STAC
+	clacFn = cpu.CLAC
+	smapEnabled = false
+	unsupportedFlags = 0
+}
+
+func TestEnableProtection(t *testing.T) {
+	defer func() {
+		restoreProtectionMocks()
+		kfmt.SetOutputSink(nil)
+	}()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+
+	specs := []struct {
+		extEDX, ebx7   uint32
+		expEFER        uint64
+		expCR4         uint64
+		expSMAP        bool
+		expUnsupported PageTableEntryFlag
+		expOutput      string
+	}{
+		{0, 0, 1 << 8, 1 << 5, false, FlagNoExecute, "NX=false SMEP=false SMAP=false"},
+		{cpuidExtEDXNX, 0, 1<<8 | eferNXE, 1 << 5, false, 0, "NX=true SMEP=false SMAP=false"},
+		{cpuidExtEDXNX, cpuidEBXSMEP, 1<<8 | eferNXE, 1<<5 | cr4SMEP, false, 0, "NX=true SMEP=true SMAP=false"},
+		{cpuidExtEDXNX, cpuidEBXSMEP | cpuidEBXSMAP, 1<<8 | eferNXE, 1<<5 | cr4SMEP | cr4SMAP, true, 0, "NX=true SMEP=true SMAP=true"},
+	}
+
+	for specIndex, spec := range specs {
+		restoreProtectionMocks()
+		mockProtection(spec.extEDX, spec.ebx7)
+		buf.Reset()
+
+		enableProtection()
+
+		if cpuState.efer != spec.expEFER {
+			t.Errorf("[spec %d] expected EFER to be 0x%x; got 0x%x", specIndex, spec.expEFER, cpuState.efer)
+		}
+
+		if cpuState.cr4 != spec.expCR4 {
+			t.Errorf("[spec %d] expected CR4 to be 0x%x; got 0x%x", specIndex, spec.expCR4, cpuState.cr4)
+		}
+
+		if smapEnabled != spec.expSMAP {
+			t.Errorf("[spec %d] expected smapEnabled to be %t; got %t", specIndex, spec.expSMAP, smapEnabled)
+		}
+
+		if spec.expSMAP && cpuState.ac {
+			t.Errorf("[spec %d] expected AC to be cleared before enabling SMAP", specIndex)
+		}
+
+		if unsupportedFlags != spec.expUnsupported {
+			t.Errorf("[spec %d] expected unsupported flags to be 0x%x; got 0x%x", specIndex, spec.expUnsupported, unsupportedFlags)
+		}
+
+		if got := buf.String(); !strings.Contains(got, spec.expOutput) {
+			t.Errorf("[spec %d] expected output to contain %q; got %q", specIndex, spec.expOutput, got)
+		}
+	}
+}
+
+func TestUserAccess(t *testing.T) {
+	defer restoreProtectionMocks()
+
+	mockProtection(0, 0)
+	BeginUserAccess()
+	EndUserAccess()
+	if cpuState.calls != "" {
+		t.Errorf("expected the AC flag not to be touched while SMAP is disabled; got %q", cpuState.calls)
+	}
+
+	smapEnabled = true
+	BeginUserAccess()
+	if !cpuState.ac {
+		t.Error("expected BeginUserAccess to set the AC flag")
+	}
+	EndUserAccess()
+	if cpuState.ac {
+		t.Error("expected EndUserAccess to clear the AC flag")
+	}
+
+	if exp := "stac;clac;"; cpuState.calls != exp {
+		t.Errorf("expected calls %q; got %q", exp, cpuState.calls)
+	}
+}
@@ -0,0 +1,387 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+)
+
+var (
+	errInvalidRegion   = &kernel.Error{Module: "vmm", Message: "region bounds are not page-aligned or empty", Code: kernel.CodeInvalid}
+	errRegionOverlap   = &kernel.Error{Module: "vmm", Message: "region overlaps an existing region", Code: kernel.CodeOutOfMemory}
+	errRegionNotMapped = &kernel.Error{Module: "vmm", Message: "address range is not fully covered by regions", Code: kernel.CodeOutOfMemory}
+
+	// The following functions are used by tests to mock calls to the mm
+	// package.
+	allocFrameFn = mm.AllocFrame
+	freeFrameFn  = mm.FreeFrame
+)
+
+// Region describes a page-aligned range of user-space addresses whose pages
+// share the same access permissions.
+type Region struct {
+	// Start is the address of the first page of the region and End is the
+	// address past its last page.
+	Start, End uintptr
+
+	// Flags contains the page table entry flags that are used for mapping
+	// the pages of the region. Regions whose flags do not include
+	// FlagPresent are reserved but cannot be accessed.
+	Flags PageTableEntryFlag
+}
+
+// regionNode is a node of the AVL tree that backs a RegionTree.
+type regionNode struct {
+	Region
+
+	left, right *regionNode
+	height      int
+}
+
+// RegionTree tracks the regions of a user address space. The regions never
+// overlap and are kept in a balanced binary search tree ordered by their start
+// address. Adjacent regions with the same flags are merged.
+//
+// Regions are populated lazily: the frames that back their pages are only
+// allocated when Populate is invoked for an address inside them, typically by
+// the page fault handler. Methods that modify the page tables operate on the
+// active page directory table and must only be invoked while the address space
+// described by the tree is active.
+//
+// The zero value is an empty tree that is ready to use.
+type RegionTree struct {
+	root *regionNode
+}
+
+// Lookup returns the region that contains addr.
+func (t *RegionTree) Lookup(addr uintptr) (Region, bool) {
+	for n := t.root; n != nil; {
+		switch {
+		case addr < n.Start:
+			n = n.left
+		case addr >= n.End:
+			n = n.right
+		default:
+			return n.Region, true
+		}
+	}
+
+	return Region{}, false
+}
+
+// Visit invokes visitor for each region in ascending address order until the
+// visitor returns false.
+func (t *RegionTree) Visit(visitor func(Region) bool) {
+	visitNodes(t.root, visitor)
+}
+
+// Overlaps returns true if any region overlaps the [start, end) range.
+func (t *RegionTree) Overlaps(start, end uintptr) bool {
+	return len(t.overlapping(start, end)) != 0
+}
+
+// Insert adds a region to the tree. The region must be page-aligned and must
+// not overlap any existing region. Insert only reserves the address range;
+// no frames are allocated for it.
+func (t *RegionTree) Insert(r Region) *kernel.Error {
+	if r.Start >= r.End || (r.Start|r.End)&(mm.PageSize-1) != 0 {
+		return errInvalidRegion
+	}
+
+	if t.Overlaps(r.Start, r.End) {
+		return errRegionOverlap
+	}
+
+	t.insert(r)
+	return nil
+}
+
+// Unmap removes the [start, end) range from the tree, splitting regions that
+// partially overlap it, and releases the frames that back the populated pages
+// in the range.
+func (t *RegionTree) Unmap(start, end uintptr) *kernel.Error {
+	if start >= end || (start|end)&(mm.PageSize-1) != 0 {
+		return errInvalidRegion
+	}
+
+	for _, r := range t.remove(start, end) {
+		for addr := r.Start; addr < r.End; addr += mm.PageSize {
+			if physAddr, err := translateFn(addr); err == nil {
+				_ = unmapFn(mm.PageFromAddress(addr))
+				_ = freeFrameFn(mm.FrameFromAddress(physAddr))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Protect changes the flags of the [start, end) range which must be fully
+// covered by regions. The page table entries of populated pages in the range
+// are updated to match the new flags.
+func (t *RegionTree) Protect(start, end uintptr, flags PageTableEntryFlag) *kernel.Error {
+	if start >= end || (start|end)&(mm.PageSize-1) != 0 {
+		return errInvalidRegion
+	}
+
+	next := start
+	for _, r := range t.overlapping(start, end) {
+		if r.Start > next {
+			break
+		}
+		next = r.End
+	}
+	if next < end {
+		return errRegionNotMapped
+	}
+
+	t.remove(start, end)
+	t.insert(Region{Start: start, End: end, Flags: flags})
+
+	for addr := start; addr < end; addr += mm.PageSize {
+		if physAddr, err := translateFn(addr); err == nil {
+			if err = mapFn(mm.PageFromAddress(addr), mm.FrameFromAddress(physAddr), populatedFlags(flags)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// FindFree returns the highest page-aligned address in [bottom, top) where a
+// region with the specified size can be inserted without overlapping any of
+// the existing regions.
+func (t *RegionTree) FindFree(size, bottom, top uintptr) (uintptr, bool) {
+	size = (size + mm.PageSize - 1) &^ (mm.PageSize - 1)
+	top &^= mm.PageSize - 1
+
+	var found bool
+	visitNodesReverse(t.root, func(r Region) bool {
+		if r.Start >= top {
+			return true
+		}
+
+		gapStart := r.End
+		if gapStart < bottom {
+			gapStart = bottom
+		}
+		if gapStart <= top && top-gapStart >= size {
+			found = true
+			return false
+		}
+
+		top = r.Start
+		return top > bottom
+	})
+
+	if !found && (top < bottom || top-bottom < size) {
+		return 0, false
+	}
+
+	return top - size, true
+}
+
+// Populate maps a zeroed frame to the page that contains addr if the page
+// belongs to a region that permits the requested access and is not mapped
+// yet. It returns true if the page has been populated.
+func (t *RegionTree) Populate(addr uintptr, write bool) bool {
+	r, ok := t.Lookup(addr)
+	if !ok || r.Flags&FlagPresent == 0 || (write && r.Flags&FlagRW == 0) {
+		return false
+	}
+
+	if _, err := translateFn(addr); err == nil {
+		return false
+	}
+
+	frame, err := allocFrameFn()
+	if err != nil {
+		return false
+	}
+
+	tmpPage, err := mapTemporaryFn(frame)
+	if err != nil {
+		_ = freeFrameFn(frame)
+		return false
+	}
+	kernel.Memset(tmpPage.Address(), 0, mm.PageSize)
+	_ = unmapFn(tmpPage)
+
+	if err = mapFn(mm.PageFromAddress(addr), frame, populatedFlags(r.Flags)); err != nil {
+		_ = freeFrameFn(frame)
+		return false
+	}
+
+	return true
+}
+
+// populatedFlags returns the page table entry flags for a populated page of a
+// region with the specified flags. Pages of inaccessible regions remain mapped
+// so that their contents are preserved but cannot be accessed by user-mode
+// code.
+func populatedFlags(flags PageTableEntryFlag) PageTableEntryFlag {
+	if flags&FlagPresent == 0 {
+		return FlagPresent | FlagNoExecute
+	}
+	return flags | FlagUserAccessible
+}
+
+// overlapping returns the regions that overlap [start, end) in ascending
+// address order.
+func (t *RegionTree) overlapping(start, end uintptr) []Region {
+	var regions []Region
+	collectOverlapping(t.root, start, end, &regions)
+	return regions
+}
+
+// insert adds r to the tree after merging it with adjacent regions that have
+// the same flags. The caller must ensure that r does not overlap any region.
+func (t *RegionTree) insert(r Region) {
+	if r.Start != 0 {
+		if prev, ok := t.Lookup(r.Start - 1); ok && prev.Flags == r.Flags {
+			t.root = removeNode(t.root, prev.Start)
+			r.Start = prev.Start
+		}
+	}
+
+	if next, ok := t.Lookup(r.End); ok && next.Flags == r.Flags {
+		t.root = removeNode(t.root, next.Start)
+		r.End = next.End
+	}
+
+	t.root = insertNode(t.root, r)
+}
+
+// remove removes [start, end) from the tree and returns the parts of the
+// regions that were removed.
+func (t *RegionTree) remove(start, end uintptr) []Region {
+	removed := t.overlapping(start, end)
+	for i, r := range removed {
+		t.root = removeNode(t.root, r.Start)
+
+		if r.Start < start {
+			t.root = insertNode(t.root, Region{Start: r.Start, End: start, Flags: r.Flags})
+			removed[i].Start = start
+		}
+
+		if r.End > end {
+			t.root = insertNode(t.root, Region{Start: end, End: r.End, Flags: r.Flags})
+			removed[i].End = end
+		}
+	}
+
+	return removed
+}
+
+func visitNodes(n *regionNode, visitor func(Region) bool) bool {
+	return n == nil || (visitNodes(n.left, visitor) && visitor(n.Region) && visitNodes(n.right, visitor))
+}
+
+func visitNodesReverse(n *regionNode, visitor func(Region) bool) bool {
+	return n == nil || (visitNodesReverse(n.right, visitor) && visitor(n.Region) && visitNodesReverse(n.left, visitor))
+}
+
+func collectOverlapping(n *regionNode, start, end uintptr, regions *[]Region) {
+	if n == nil {
+		return
+	}
+
+	if start < n.Start {
+		collectOverlapping(n.left, start, end, regions)
+	}
+	if n.Start < end && start < n.End {
+		*regions = append(*regions, n.Region)
+	}
+	if end > n.End {
+		collectOverlapping(n.right, start, end, regions)
+	}
+}
+
+func nodeHeight(n *regionNode) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func (n *regionNode) updateHeight() {
+	n.height = nodeHeight(n.left) + 1
+	if h := nodeHeight(n.right) + 1; h > n.height {
+		n.height = h
+	}
+}
+
+func rotateLeft(n *regionNode) *regionNode {
+	r := n.right
+	n.right, r.left = r.left, n
+	n.updateHeight()
+	r.updateHeight()
+	return r
+}
+
+func rotateRight(n *regionNode) *regionNode {
+	l := n.left
+	n.left, l.right = l.right, n
+	n.updateHeight()
+	l.updateHeight()
+	return l
+}
+
+// rebalance restores the AVL invariant for n after one of its subtrees has
+// changed height by at most one.
+func rebalance(n *regionNode) *regionNode {
+	n.updateHeight()
+	switch balance := nodeHeight(n.left) - nodeHeight(n.right); {
+	case balance > 1:
+		if nodeHeight(n.left.left) < nodeHeight(n.left.right) {
+			n.left = rotateLeft(n.left)
+		}
+		return rotateRight(n)
+	case balance < -1:
+		if nodeHeight(n.right.right) < nodeHeight(n.right.left) {
+			n.right = rotateRight(n.right)
+		}
+		return rotateLeft(n)
+	default:
+		return n
+	}
+}
+
+func insertNode(n *regionNode, r Region) *regionNode {
+	if n == nil {
+		return &regionNode{Region: r, height: 1}
+	}
+
+	if r.Start < n.Start {
+		n.left = insertNode(n.left, r)
+	} else {
+		n.right = insertNode(n.right, r)
+	}
+
+	return rebalance(n)
+}
+
+func removeNode(n *regionNode, start uintptr) *regionNode {
+	switch {
+	case n == nil:
+		return nil
+	case start < n.Start:
+		n.left = removeNode(n.left, start)
+	case start > n.Start:
+		n.right = removeNode(n.right, start)
+	case n.left == nil:
+		return n.right
+	case n.right == nil:
+		return n.left
+	default:
+		// Replace the node contents with its in-order successor
+		succ := n.right
+		for succ.left != nil {
+			succ = succ.left
+		}
+		n.Region = succ.Region
+		n.right = removeNode(n.right, succ.Start)
+	}
+
+	return rebalance(n)
+}
@@ -0,0 +1,342 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"testing"
+	"unsafe"
+)
+
+const (
+	userRO = FlagPresent | FlagUserAccessible | FlagNoExecute
+	userRW = userRO | FlagRW
+)
+
+func regionsOf(t *RegionTree) []Region {
+	var regions []Region
+	t.Visit(func(r Region) bool {
+		regions = append(regions, r)
+		return true
+	})
+	return regions
+}
+
+func expRegions(t *testing.T, tree *RegionTree, exp ...Region) {
+	got := regionsOf(tree)
+	if len(got) != len(exp) {
+		t.Fatalf("expected regions %+v; got %+v", exp, got)
+	}
+
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Fatalf("expected regions %+v; got %+v", exp, got)
+		}
+	}
+
+	checkAVL(t, tree.root)
+}
+
+// checkAVL verifies that the subtree rooted at n is balanced and returns its
+// height.
+func checkAVL(t *testing.T, n *regionNode) int {
+	if n == nil {
+		return 0
+	}
+
+	l, r := checkAVL(t, n.left), checkAVL(t, n.right)
+	if l-r > 1 || r-l > 1 {
+		t.Fatalf("region tree is unbalanced at node %+v: %d vs %d", n.Region, l, r)
+	}
+
+	h := l + 1
+	if r >= l {
+		h = r + 1
+	}
+	if h != n.height {
+		t.Fatalf("expected height of node %+v to be %d; got %d", n.Region, h, n.height)
+	}
+	return h
+}
+
+func TestRegionTreeInsert(t *testing.T) {
+	var tree RegionTree
+
+	for specIndex, r := range []Region{
+		{Start: 0x2000, End: 0x2000},
+		{Start: 0x3000, End: 0x2000},
+		{Start: 0x2001, End: 0x3000},
+	} {
+		if err := tree.Insert(r); err != errInvalidRegion {
+			t.Errorf("[spec %d] expected to get errInvalidRegion; got %v", specIndex, err)
+		}
+	}
+
+	// Insert pages in an order that exercises all rotations. Odd pages
+	// are writable so that adjacent pages are not merged.
+	for _, page := range []uintptr{10, 8, 6, 2, 4, 3, 12, 16, 14, 20, 18} {
+		flags := userRO
+		if page&1 != 0 {
+			flags = userRW
+		}
+		if err := tree.Insert(Region{Start: page << mm.PageShift, End: (page + 1) << mm.PageShift, Flags: flags}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkAVL(t, tree.root)
+
+	if err := tree.Insert(Region{Start: 0x3800 &^ 0xfff, End: 0x5000, Flags: userRO}); err != errRegionOverlap {
+		t.Errorf("expected to get errRegionOverlap; got %v", err)
+	}
+
+	if r, ok := tree.Lookup(0x4fff); !ok || r.Start != 0x4000 || r.End != 0x5000 {
+		t.Errorf("expected lookup to return the region for page 4; got %+v, %t", r, ok)
+	}
+	if _, ok := tree.Lookup(0x5000); ok {
+		t.Error("expected lookup of an address outside the regions to fail")
+	}
+
+	// Adjacent regions with the same flags are merged
+	var merged RegionTree
+	_ = merged.Insert(Region{Start: 0x1000, End: 0x2000, Flags: userRO})
+	_ = merged.Insert(Region{Start: 0x3000, End: 0x4000, Flags: userRO})
+	_ = merged.Insert(Region{Start: 0x4000, End: 0x5000, Flags: userRW})
+	_ = merged.Insert(Region{Start: 0x2000, End: 0x3000, Flags: userRO})
+	expRegions(t, &merged,
+		Region{Start: 0x1000, End: 0x4000, Flags: userRO},
+		Region{Start: 0x4000, End: 0x5000, Flags: userRW},
+	)
+
+	// Visiting stops when the visitor returns false
+	var visited int
+	tree.Visit(func(_ Region) bool {
+		visited++
+		return visited < 3
+	})
+	if visited != 3 {
+		t.Errorf("expected Visit to stop after 3 regions; visited %d", visited)
+	}
+}
+
+func TestRegionTreeFindFree(t *testing.T) {
+	var tree RegionTree
+	_ = tree.Insert(Region{Start: 0x10000, End: 0x12000, Flags: userRW})
+	_ = tree.Insert(Region{Start: 0x13000, End: 0x18000, Flags: userRO})
+	_ = tree.Insert(Region{Start: 0x20000, End: 0x30000, Flags: userRW})
+
+	for specIndex, spec := range []struct {
+		size, bottom, top uintptr
+		expAddr           uintptr
+		expOK             bool
+	}{
+		{0x1000, 0x1000, 0x40000, 0x3f000, true},
+		{0x1000, 0x1000, 0x30000, 0x1f000, true},
+		{0x8000, 0x1000, 0x30000, 0x18000, true},
+		{0x9000, 0x1000, 0x30000, 0x7000, true},
+		{0x800, 0x1000, 0x13800, 0x12000, true},
+		{0x9000, 0x9000, 0x30000, 0, false},
+		{0x1000, 0x11000, 0x12000, 0, false},
+		{0x2000, 0x1000, 0x2000, 0, false},
+	} {
+		addr, ok := tree.FindFree(spec.size, spec.bottom, spec.top)
+		if addr != spec.expAddr || ok != spec.expOK {
+			t.Errorf("[spec %d] expected to get 0x%x, %t; got 0x%x, %t", specIndex, spec.expAddr, spec.expOK, addr, ok)
+		}
+	}
+}
+
+// mockPages emulates the page tables for the user pages of a region tree.
+type mockPages struct {
+	mapped map[uintptr]mapping
+	freed  []mm.Frame
+
+	// tmpPage is the memory returned by the mocked MapTemporary.
+	tmpPage []byte
+}
+
+type mapping struct {
+	frame mm.Frame
+	flags PageTableEntryFlag
+}
+
+func (m *mockPages) install() {
+	buf := make([]byte, 2*mm.PageSize)
+	offset := (mm.PageSize - uintptr(unsafe.Pointer(&buf[0]))&(mm.PageSize-1)) & (mm.PageSize - 1)
+	m.tmpPage = buf[offset : offset+mm.PageSize]
+	m.mapped = make(map[uintptr]mapping)
+
+	var nextFrame mm.Frame = 100
+	allocFrameFn = func() (mm.Frame, *kernel.Error) {
+		nextFrame++
+		return nextFrame, nil
+	}
+	freeFrameFn = func(f mm.Frame) *kernel.Error {
+		m.freed = append(m.freed, f)
+		return nil
+	}
+	translateFn = func(addr uintptr) (uintptr, *kernel.Error) {
+		if pm, ok := m.mapped[addr&^(mm.PageSize-1)]; ok {
+			return pm.frame.Address(), nil
+		}
+		return 0, ErrInvalidMapping
+	}
+	mapFn = func(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		m.mapped[page.Address()] = mapping{frame, flags}
+		return nil
+	}
+	mapTemporaryFn = func(_ mm.Frame) (mm.Page, *kernel.Error) {
+		for i := range m.tmpPage {
+			m.tmpPage[i] = 0xff
+		}
+		return mm.PageFromAddress(uintptr(unsafe.Pointer(&m.tmpPage[0]))), nil
+	}
+	unmapFn = func(page mm.Page) *kernel.Error {
+		delete(m.mapped, page.Address())
+		return nil
+	}
+}
+
+func restoreRegionMocks() {
+	allocFrameFn = mm.AllocFrame
+	freeFrameFn = mm.FreeFrame
+	translateFn = Translate
+	mapFn = Map
+	mapTemporaryFn = MapTemporary
+	unmapFn = Unmap
+}
+
+func TestRegionTreePopulate(t *testing.T) {
+	defer restoreRegionMocks()
+
+	var (
+		m    mockPages
+		tree RegionTree
+	)
+	m.install()
+	_ = tree.Insert(Region{Start: 0x1000, End: 0x2000, Flags: userRO})
+	_ = tree.Insert(Region{Start: 0x2000, End: 0x4000, Flags: userRW})
+	_ = tree.Insert(Region{Start: 0x4000, End: 0x5000})
+
+	for specIndex, spec := range []struct {
+		addr     uintptr
+		write    bool
+		expOK    bool
+		expFrame mm.Frame
+	}{
+		{0x0800, false, false, 0},
+		{0x1800, true, false, 0},
+		{0x1800, false, true, 101},
+		{0x1800, false, false, 0},
+		{0x2010, true, true, 102},
+		{0x4000, false, false, 0},
+	} {
+		if ok := tree.Populate(spec.addr, spec.write); ok != spec.expOK {
+			t.Errorf("[spec %d] expected Populate to return %t; got %t", specIndex, spec.expOK, ok)
+		}
+
+		if !spec.expOK {
+			continue
+		}
+
+		pm := m.mapped[spec.addr&^(mm.PageSize-1)]
+		if r, _ := tree.Lookup(spec.addr); pm.frame != spec.expFrame || pm.flags != r.Flags {
+			t.Errorf("[spec %d] expected page to be mapped to frame %d with flags 0x%x; got %+v", specIndex, spec.expFrame, r.Flags, pm)
+		}
+
+		for _, b := range m.tmpPage {
+			if b != 0 {
+				t.Errorf("[spec %d] expected the populated frame to be zeroed", specIndex)
+				break
+			}
+		}
+	}
+
+	// Frames are released if the page cannot be mapped
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+	mapFn = func(_ mm.Page, _ mm.Frame, _ PageTableEntryFlag) *kernel.Error { return expErr }
+	if tree.Populate(0x3000, true) || len(m.freed) != 1 || m.freed[0] != 103 {
+		t.Errorf("expected the frame to be released when the page cannot be mapped; freed %v", m.freed)
+	}
+
+	allocFrameFn = func() (mm.Frame, *kernel.Error) { return mm.InvalidFrame, expErr }
+	if tree.Populate(0x3000, true) {
+		t.Error("expected Populate to fail when frames cannot be allocated")
+	}
+}
+
+func TestRegionTreeUnmap(t *testing.T) {
+	defer restoreRegionMocks()
+
+	var (
+		m    mockPages
+		tree RegionTree
+	)
+	m.install()
+	_ = tree.Insert(Region{Start: 0x1000, End: 0x5000, Flags: userRW})
+	_ = tree.Insert(Region{Start: 0x6000, End: 0x8000, Flags: userRO})
+	tree.Populate(0x2000, true)
+	tree.Populate(0x4000, true)
+
+	if err := tree.Unmap(0x2000, 0x1000); err != errInvalidRegion {
+		t.Errorf("expected to get errInvalidRegion; got %v", err)
+	}
+
+	if err := tree.Unmap(0x2000, 0x7000); err != nil {
+		t.Fatal(err)
+	}
+	expRegions(t, &tree,
+		Region{Start: 0x1000, End: 0x2000, Flags: userRW},
+		Region{Start: 0x7000, End: 0x8000, Flags: userRO},
+	)
+
+	if len(m.mapped) != 0 || len(m.freed) != 2 {
+		t.Errorf("expected the populated pages to be unmapped and their frames released; got %v, %v", m.mapped, m.freed)
+	}
+}
+
+func TestRegionTreeProtect(t *testing.T) {
+	defer restoreRegionMocks()
+
+	var (
+		m    mockPages
+		tree RegionTree
+	)
+	m.install()
+	_ = tree.Insert(Region{Start: 0x1000, End: 0x4000, Flags: userRW})
+	_ = tree.Insert(Region{Start: 0x4000, End: 0x5000, Flags: userRO})
+	_ = tree.Insert(Region{Start: 0x6000, End: 0x7000, Flags: userRW})
+	tree.Populate(0x2000, true)
+
+	if err := tree.Protect(0x3000, 0x7000, userRO); err != errRegionNotMapped {
+		t.Errorf("expected to get errRegionNotMapped; got %v", err)
+	}
+
+	if err := tree.Protect(0x2000, 0x3000, userRO); err != nil {
+		t.Fatal(err)
+	}
+	expRegions(t, &tree,
+		Region{Start: 0x1000, End: 0x2000, Flags: userRW},
+		Region{Start: 0x2000, End: 0x3000, Flags: userRO},
+		Region{Start: 0x3000, End: 0x4000, Flags: userRW},
+		Region{Start: 0x4000, End: 0x5000, Flags: userRO},
+		Region{Start: 0x6000, End: 0x7000, Flags: userRW},
+	)
+	if pm := m.mapped[0x2000]; pm.flags != userRO {
+		t.Errorf("expected the populated page to be remapped read-only; got flags 0x%x", pm.flags)
+	}
+
+	// Inaccessible pages remain mapped for the kernel only
+	if err := tree.Protect(0x1000, 0x5000, 0); err != nil {
+		t.Fatal(err)
+	}
+	expRegions(t, &tree,
+		Region{Start: 0x1000, End: 0x5000},
+		Region{Start: 0x6000, End: 0x7000, Flags: userRW},
+	)
+	if pm := m.mapped[0x2000]; pm.flags != FlagPresent|FlagNoExecute {
+		t.Errorf("expected the populated page to lose user access; got flags 0x%x", pm.flags)
+	}
+
+	if tree.Populate(0x3000, false) {
+		t.Error("expected pages of inaccessible regions not to be populated")
+	}
+}
@@ -0,0 +1,86 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+)
+
+// exceptionEntry describes a kernel instruction that may fault while
+// accessing user memory and the address where execution resumes if it does.
+type exceptionEntry struct {
+	insn  uintptr
+	fixup uintptr
+}
+
+var (
+	// exceptionTable contains the instructions whose faults are recovered
+	// by the fault handlers. It is populated by installFaultHandlers.
+	exceptionTable [1]exceptionEntry
+
+	// copyUserFn is used by tests.
+	copyUserFn = copyUser
+
+	errUserAccessFault = &kernel.Error{Module: "vmm", Message: "fault while accessing user memory", Code: kernel.CodeBadAddress}
+)
+
+// CopyUser copies size bytes from src to dst where either address may point to
+// user memory. Unlike a plain memory copy, CopyUser returns an error instead
+// of causing a kernel panic if the copy faults because a user address is not
+// mapped or does not allow the requested access. In that case, the bytes
+// preceding the faulting address have already been copied.
+//
+// Callers are still expected to check that user addresses do not point to
+// kernel memory which the copy can access without faulting.
+func CopyUser(dst, src, size uintptr) *kernel.Error {
+	if size == 0 {
+		return nil
+	}
+
+	BeginUserAccess()
+	left := copyUserFn(dst, src, size)
+	EndUserAccess()
+
+	if left != 0 {
+		return errUserAccessFault
+	}
+	return nil
+}
+
+// initExceptionTable populates the exception table with the addresses of the
+// user access routines.
+func initExceptionTable() {
+	exceptionTable[0].insn, exceptionTable[0].fixup = copyUserExceptionEntry()
+}
+
+// fixupFault checks whether a fault raised while running kernel code was
+// caused by an instruction listed in the exception table. If so, it updates
+// the saved instruction pointer so that execution resumes at the fixup address
+// for the instruction and returns true.
+func fixupFault(regs *gate.Registers) bool {
+	// Faults raised in user mode (CPL 3) are never fixed up
+	if regs.CS&3 != 0 {
+		return false
+	}
+
+	for _, entry := range exceptionTable {
+		if entry.insn != 0 && uintptr(regs.RIP) == entry.insn {
+			regs.RIP = uint64(entry.fixup)
+			return true
+		}
+	}
+
+	return false
+}
+
+// copyUser copies size bytes from src to dst and returns the number of bytes
+// that could not be copied because of a fault.
+func copyUser(dst, src, size uintptr) uintptr
+
+// copyUserInsn and copyUserFixup are the parts of copyUser referenced by the
+// exception table; they must only be invoked by copyUser.
+func copyUserInsn(dst, src, size uintptr) uintptr
+func copyUserFixup(dst, src, size uintptr) uintptr
+
+// copyUserExceptionEntry returns the address of the copyUser instruction that
+// may fault and the address of its fixup code.
+func copyUserExceptionEntry() (insn, fixup uintptr)
@@ -0,0 +1,30 @@
+#include "textflag.h"
+
+TEXT ·copyUser(SB),NOSPLIT,$0-32
+	MOVQ dst+0(FP), DI
+	MOVQ src+8(FP), SI
+	MOVQ size+16(FP), CX
+	CLD
+	JMP ·copyUserInsn(SB)
+
+// copyUserInsn contains the only instruction of copyUser that may fault. As
+// REP MOVSB updates its registers after each byte, CX holds the number of
+// bytes left to copy if a fault occurs.
+TEXT ·copyUserInsn(SB),NOSPLIT,$0-32
+	REP; MOVSB
+	MOVQ CX, ret+24(FP)
+	RET
+
+// copyUserFixup is where the fault handler resumes execution if copyUserInsn
+// faults. It shares the stack frame of copyUser and returns the number of
+// bytes that were not copied to its caller.
+TEXT ·copyUserFixup(SB),NOSPLIT,$0-32
+	MOVQ CX, ret+24(FP)
+	RET
+
+TEXT ·copyUserExceptionEntry(SB),NOSPLIT,$0-16
+	MOVQ $·copyUserInsn(SB), AX
+	MOVQ AX, insn+0(FP)
+	MOVQ $·copyUserFixup(SB), AX
+	MOVQ AX, fixup+8(FP)
+	RET
@@ -0,0 +1,94 @@
+package vmm
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/kfmt"
+	"testing"
+	"unsafe"
+)
+
+func TestCopyUser(t *testing.T) {
+	defer func() { copyUserFn = copyUser }()
+
+	var (
+		src = []byte("user data")
+		dst = make([]byte, len(src))
+	)
+
+	if err := CopyUser(uintptr(unsafe.Pointer(&dst[0])), uintptr(unsafe.Pointer(&src[0])), uintptr(len(src))); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(dst) != "user data" {
+		t.Fatalf("expected CopyUser to copy %q; got %q", src, dst)
+	}
+
+	// Empty copies always succeed
+	if err := CopyUser(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Emulate a fault in the middle of the copy
+	copyUserFn = func(_, _, size uintptr) uintptr { return size / 2 }
+	if err := CopyUser(uintptr(unsafe.Pointer(&dst[0])), uintptr(unsafe.Pointer(&src[0])), uintptr(len(src))); err != errUserAccessFault {
+		t.Fatalf("expected to get errUserAccessFault; got %v", err)
+	}
+}
+
+func TestFixupFault(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		readCR2Fn = cpu.ReadCR2
+		panicWithRegistersFn = kfmt.PanicWithRegisters
+		exceptionTable = [len(exceptionTable)]exceptionEntry{}
+	}(ptePtrFn)
+	panicWithRegistersFn = mockPanicWithRegisters
+
+	var pageEntry pageTableEntry
+	ptePtrFn = func(entry uintptr) unsafe.Pointer { return unsafe.Pointer(&pageEntry) }
+	readCR2Fn = func() uint64 { return 0x1000 }
+
+	initExceptionTable()
+	insn, fixup := exceptionTable[0].insn, exceptionTable[0].fixup
+	if insn == 0 || fixup == 0 || insn == fixup {
+		t.Fatalf("expected the exception table to be populated; got %+v", exceptionTable)
+	}
+
+	specs := []struct {
+		cs, rip uint64
+		exp     bool
+	}{
+		// Fault in the copy routine while running kernel code
+		{0x08, uint64(insn), true},
+		// Fault in the copy routine while running user code
+		{0x20 | 3, uint64(insn), false},
+		// Fault outside the copy routine
+		{0x08, uint64(insn) + 1, false},
+	}
+
+	for specIndex, spec := range specs {
+		regs := gate.Registers{CS: spec.cs, RIP: spec.rip}
+		if got := fixupFault(&regs); got != spec.exp {
+			t.Errorf("[spec %d] expected fixupFault to return %t; got %t", specIndex, spec.exp, got)
+		}
+
+		expRIP := spec.rip
+		if spec.exp {
+			expRIP = uint64(fixup)
+		}
+		if regs.RIP != expRIP {
+			t.Errorf("[spec %d] expected RIP to be 0x%x; got 0x%x", specIndex, expRIP, regs.RIP)
+		}
+	}
+
+	// Both fault handlers must resume execution at the fixup address
+	// instead of panicking.
+	for _, handler := range []func(*gate.Registers){pageFaultHandler, generalProtectionFaultHandler} {
+		regs := gate.Registers{CS: 0x08, RIP: uint64(insn), Info: 2}
+		handler(&regs)
+		if regs.RIP != uint64(fixup) {
+			t.Errorf("expected fault handler to set RIP to 0x%x; got 0x%x", fixup, regs.RIP)
+		}
+	}
+}
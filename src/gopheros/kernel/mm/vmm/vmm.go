@@ -15,9 +15,12 @@ var (
 	errUnrecoverableFault = &kernel.Error{Module: "vmm", Message: "page/gpf fault"}
 )
 
-// Init initializes the vmm system, creates a granular PDT for the kernel and
-// installs paging-related exception handlers.
+// Init initializes the vmm system, enables the page protection features
+// supported by the CPU, creates a granular PDT for the kernel and installs
+// paging-related exception handlers.
 func Init(kernelPageOffset uintptr) *kernel.Error {
+	enableProtection()
+
 	if err := setupPDTForKernel(kernelPageOffset); err != nil {
 		return err
 	}
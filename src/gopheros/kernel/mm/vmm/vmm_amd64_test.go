@@ -19,7 +19,9 @@ func TestInit(t *testing.T) {
 		mapTemporaryFn = MapTemporary
 		unmapFn = Unmap
 		handleInterruptFn = gate.HandleInterrupt
+		restoreProtectionMocks()
 	}()
+	mockProtection(0, 0)
 
 	// reserve space for an allocated page
 	reservedPage := make([]byte, mm.PageSize)
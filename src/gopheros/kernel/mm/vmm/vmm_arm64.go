@@ -0,0 +1,55 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+)
+
+// The arm64 port is a stub: its entry points allow the architecture-neutral
+// kernel packages to be type-checked for arm64 but panic when invoked.
+
+var (
+	errNotImplemented = &kernel.Error{Module: "vmm", Message: "not implemented on arm64", Code: kernel.CodeNotImplemented}
+
+	// unsupportedFlags contains the page table entry flags that are
+	// stripped by Map as the CPU does not support them.
+	unsupportedFlags PageTableEntryFlag
+)
+
+func unimplemented() {
+	panic("vmm: not implemented on arm64")
+}
+
+// enableProtection enables the page protection features supported by the
+// CPU.
+func enableProtection() { unimplemented() }
+
+// installFaultHandlers installs the handlers for translation faults.
+func installFaultHandlers() { unimplemented() }
+
+// SetUserFaultHandler registers a function that is invoked when user-mode code
+// triggers a fault that the kernel cannot recover from.
+func SetUserFaultHandler(_ func(faultAddress uintptr, regs *gate.Registers) bool) {
+	unimplemented()
+}
+
+// SetDemandFaultHandler registers a function that is invoked when either
+// user-mode code or the kernel accesses a non-present page in the user half of
+// the address space.
+func SetDemandFaultHandler(_ func(faultAddress uintptr, write bool) bool) {
+	unimplemented()
+}
+
+// BeginUserAccess allows the kernel to access user-accessible pages until the
+// next call to EndUserAccess.
+func BeginUserAccess() { unimplemented() }
+
+// EndUserAccess restores the protection of user-accessible pages after a call
+// to BeginUserAccess.
+func EndUserAccess() { unimplemented() }
+
+// CopyUser copies size bytes from src to dst where either address may point to
+// user memory.
+func CopyUser(_, _, _ uintptr) *kernel.Error {
+	return errNotImplemented
+}
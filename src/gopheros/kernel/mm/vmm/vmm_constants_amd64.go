@@ -16,6 +16,14 @@ const (
 	// pages). For amd64 this address uses the following table indices:
 	// 510, 511, 511, 511.
 	tempMappingAddr = uintptr(0Xffffff7ffffff000)
+
+	// kernelPdtEntryIndex is the index of the first top-level PDT entry
+	// that covers the kernel half of the address space.
+	kernelPdtEntryIndex = 256
+
+	// UserSpaceEnd is the first address past the lower canonical half of
+	// the address space that is available to user-mode code.
+	UserSpaceEnd = uintptr(0x0000800000000000)
 )
 
 var (
@@ -0,0 +1,306 @@
+package net
+
+import (
+	"encoding/binary"
+	"gopheros/device/netdev"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/timer"
+	"io"
+)
+
+const (
+	arpPacketLen = 28
+
+	arpHardwareEthernet = uint16(1)
+	arpOpRequest        = uint16(1)
+	arpOpReply          = uint16(2)
+
+	// arpCacheSize is the number of entries in the ARP cache of each
+	// interface. Once the cache is full, the entry that expires first is
+	// replaced.
+	arpCacheSize = 32
+
+	// arpReachableTime is the time after which resolved entries must be
+	// resolved again.
+	arpReachableTime = 5 * 60 * timer.Second
+
+	// arpRetryInterval is the delay between requests for an address that
+	// has not been resolved yet. The address is considered unreachable
+	// and any queued frames are dropped after arpMaxRequests requests.
+	arpRetryInterval = timer.Second
+	arpMaxRequests   = 3
+
+	// arpMaxPending is the maximum number of frames that can be queued
+	// while an address is being resolved. Once the limit is reached, the
+	// oldest frame is dropped.
+	arpMaxPending = 4
+)
+
+// arpState describes the state of an ARP cache entry.
+type arpState uint8
+
+const (
+	arpFree arpState = iota
+	arpIncomplete
+	arpReachable
+)
+
+// String implements fmt.Stringer for arpState.
+func (s arpState) String() string {
+	switch s {
+	case arpIncomplete:
+		return "incomplete"
+	case arpReachable:
+		return "reachable"
+	default:
+		return "free"
+	}
+}
+
+// pendingFrame is a frame that waits for the resolution of its next hop.
+type pendingFrame struct {
+	etherType uint16
+	frame     *netdev.Frame
+}
+
+// arpEntry maps an IPv4 address to a hardware address.
+type arpEntry struct {
+	ip    IPAddr
+	mac   netdev.HardwareAddr
+	state arpState
+
+	// deadline is the time when a reachable entry expires or the time when
+	// the next request for an incomplete entry is sent.
+	deadline timer.Duration
+	requests uint8
+	pending  []pendingFrame
+}
+
+// arpCache contains the address mappings for an interface.
+type arpCache struct {
+	entries [arpCacheSize]arpEntry
+}
+
+// lookup returns the entry for an address or nil if the address is not
+// cached.
+func (c *arpCache) lookup(ip IPAddr) *arpEntry {
+	for i := range c.entries {
+		if e := &c.entries[i]; e.state != arpFree && e.ip == ip {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// alloc returns an entry for an address that is not cached, replacing the
+// entry that expires first if the cache is full.
+func (c *arpCache) alloc(ip IPAddr) *arpEntry {
+	victim := &c.entries[0]
+	for i := range c.entries {
+		e := &c.entries[i]
+		if e.state == arpFree {
+			victim = e
+			break
+		}
+		if e.deadline < victim.deadline {
+			victim = e
+		}
+	}
+
+	*victim = arpEntry{ip: ip}
+	return victim
+}
+
+// Resolve returns the hardware address for an IPv4 address on the local
+// network. If the address is not cached, Resolve starts resolving it and
+// returns false.
+func (iface *Interface) Resolve(ip IPAddr) (netdev.HardwareAddr, bool) {
+	intr := lock()
+	mac, ok, sendRequest := iface.arp.resolve(ip, nowFn())
+	unlock(intr)
+
+	if sendRequest {
+		iface.sendARP(arpOpRequest, netdev.HardwareAddr{}, ip, BroadcastHardwareAddr)
+	}
+
+	return mac, ok
+}
+
+// resolve looks up the hardware address for ip and, if it is not cached,
+// creates an incomplete entry for it. It returns true as its last value if an
+// ARP request needs to be sent.
+func (c *arpCache) resolve(ip IPAddr, now timer.Duration) (netdev.HardwareAddr, bool, bool) {
+	e := c.lookup(ip)
+	switch {
+	case e == nil:
+	case e.state == arpReachable && now < e.deadline:
+		return e.mac, true, false
+	case e.state == arpIncomplete:
+		return netdev.HardwareAddr{}, false, false
+	}
+
+	if e == nil {
+		e = c.alloc(ip)
+	}
+
+	e.state, e.requests, e.deadline = arpIncomplete, 1, now+arpRetryInterval
+	return netdev.HardwareAddr{}, false, true
+}
+
+// output transmits a frame to the specified next hop. If the hardware address
+// of the next hop is not known, the frame is queued until the address is
+// resolved.
+func (iface *Interface) output(nextHop IPAddr, etherType uint16, frame *netdev.Frame) *kernel.Error {
+	if nextHop == BroadcastIPAddr {
+		return iface.sendFrame(BroadcastHardwareAddr, etherType, frame)
+	}
+
+	intr := lock()
+	mac, ok, sendRequest := iface.arp.resolve(nextHop, nowFn())
+	if !ok {
+		e := iface.arp.lookup(nextHop)
+		if len(e.pending) == arpMaxPending {
+			e.pending = e.pending[1:]
+		}
+		e.pending = append(e.pending, pendingFrame{etherType: etherType, frame: frame})
+	}
+	unlock(intr)
+
+	if sendRequest {
+		iface.sendARP(arpOpRequest, netdev.HardwareAddr{}, nextHop, BroadcastHardwareAddr)
+	}
+
+	if !ok {
+		return nil
+	}
+
+	return iface.sendFrame(mac, etherType, frame)
+}
+
+// handleARP processes a received ARP packet as described in RFC 826. The
+// sender mapping is recorded if the sender is already cached or if the packet
+// targets the interface address, in which case requests are also answered.
+func (iface *Interface) handleARP(pkt []byte) {
+	if len(pkt) < arpPacketLen ||
+		binary.BigEndian.Uint16(pkt[0:2]) != arpHardwareEthernet ||
+		binary.BigEndian.Uint16(pkt[2:4]) != EtherTypeIPv4 ||
+		pkt[4] != 6 || pkt[5] != 4 {
+		return
+	}
+
+	var (
+		op               = binary.BigEndian.Uint16(pkt[6:8])
+		senderMAC        netdev.HardwareAddr
+		senderIP, target IPAddr
+		pending          []pendingFrame
+		resolvedGateway  bool
+	)
+	copy(senderMAC[:], pkt[8:14])
+	copy(senderIP[:], pkt[14:18])
+	copy(target[:], pkt[24:28])
+
+	intr := lock()
+	cfg := iface.config
+	forUs := !cfg.Addr.IsZero() && target == cfg.Addr
+
+	// Probes (RFC 5227) use a zero sender address which must not be
+	// cached.
+	if !senderIP.IsZero() {
+		e := iface.arp.lookup(senderIP)
+		if e == nil && forUs {
+			e = iface.arp.alloc(senderIP)
+		}
+
+		if e != nil {
+			resolvedGateway = e.state == arpIncomplete && senderIP == cfg.Gateway
+			e.mac, e.state, e.deadline = senderMAC, arpReachable, nowFn()+arpReachableTime
+			pending, e.pending = e.pending, nil
+		}
+	}
+	unlock(intr)
+
+	if resolvedGateway {
+		kfmt.Printf("[net] %s: gateway %s is at %s\n", iface.Name(), senderIP.String(), senderMAC.String())
+	}
+
+	for _, p := range pending {
+		iface.sendFrame(senderMAC, p.etherType, p.frame)
+	}
+
+	if forUs && op == arpOpRequest {
+		iface.sendARP(arpOpReply, senderMAC, senderIP, senderMAC)
+	}
+}
+
+// sendARP transmits an ARP packet with the specified operation, target
+// addresses and Ethernet destination.
+func (iface *Interface) sendARP(op uint16, targetMAC netdev.HardwareAddr, targetIP IPAddr, dst netdev.HardwareAddr) *kernel.Error {
+	var (
+		frame = newFrame(arpPacketLen)
+		pkt   = framePayload(frame)
+		mac   = iface.dev.HardwareAddr()
+		cfg   = iface.Config()
+	)
+
+	binary.BigEndian.PutUint16(pkt[0:2], arpHardwareEthernet)
+	binary.BigEndian.PutUint16(pkt[2:4], EtherTypeIPv4)
+	pkt[4], pkt[5] = 6, 4
+	binary.BigEndian.PutUint16(pkt[6:8], op)
+	copy(pkt[8:14], mac[:])
+	copy(pkt[14:18], cfg.Addr[:])
+	copy(pkt[18:24], targetMAC[:])
+	copy(pkt[24:28], targetIP[:])
+
+	return iface.sendFrame(dst, EtherTypeARP, frame)
+}
+
+// arpTick resends the requests for incomplete entries and evicts the entries
+// that have expired or could not be resolved.
+func (iface *Interface) arpTick() {
+	var (
+		retry [arpCacheSize]IPAddr
+		count int
+		now   = nowFn()
+	)
+
+	intr := lock()
+	for i := range iface.arp.entries {
+		e := &iface.arp.entries[i]
+		if e.state == arpFree || now < e.deadline {
+			continue
+		}
+
+		if e.state == arpIncomplete && e.requests < arpMaxRequests {
+			e.requests++
+			e.deadline = now + arpRetryInterval
+			retry[count] = e.ip
+			count++
+			continue
+		}
+
+		*e = arpEntry{}
+	}
+	unlock(intr)
+
+	for _, ip := range retry[:count] {
+		iface.sendARP(arpOpRequest, netdev.HardwareAddr{}, ip, BroadcastHardwareAddr)
+	}
+}
+
+// genARPTable reports the contents of the ARP caches.
+func genARPTable(w io.Writer) {
+	kfmt.Fprintf(w, "%-15s %-17s %-10s %s\n", "IP ADDRESS", "HW ADDRESS", "STATE", "DEVICE")
+	for _, iface := range Interfaces() {
+		intr := lock()
+		entries := iface.arp.entries
+		unlock(intr)
+
+		for _, e := range entries {
+			if e.state != arpFree {
+				kfmt.Fprintf(w, "%-15s %-17s %-10s %s\n", e.ip.String(), e.mac.String(), e.state.String(), iface.Name())
+			}
+		}
+	}
+}
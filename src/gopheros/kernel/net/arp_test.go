@@ -0,0 +1,355 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopheros/device/netdev"
+	"gopheros/kernel/timer"
+	"strings"
+	"testing"
+)
+
+// arpPacket builds an ARP packet for an Ethernet/IPv4 network.
+func arpPacket(op uint16, senderMAC netdev.HardwareAddr, senderIP IPAddr, targetMAC netdev.HardwareAddr, targetIP IPAddr) []byte {
+	pkt := make([]byte, arpPacketLen)
+	binary.BigEndian.PutUint16(pkt[0:2], arpHardwareEthernet)
+	binary.BigEndian.PutUint16(pkt[2:4], EtherTypeIPv4)
+	pkt[4], pkt[5] = 6, 4
+	binary.BigEndian.PutUint16(pkt[6:8], op)
+	copy(pkt[8:14], senderMAC[:])
+	copy(pkt[14:18], senderIP[:])
+	copy(pkt[18:24], targetMAC[:])
+	copy(pkt[24:28], targetIP[:])
+	return pkt
+}
+
+// checkARPFrame verifies the Ethernet header and ARP fields of a frame sent
+// by the stack.
+func checkARPFrame(t *testing.T, frame *netdev.Frame, dst netdev.HardwareAddr, op uint16, targetMAC netdev.HardwareAddr, targetIP IPAddr) {
+	t.Helper()
+
+	if !bytes.Equal(frame.Data[0:6], dst[:]) {
+		t.Errorf("expected frame to be sent to %s; got % x", dst.String(), frame.Data[0:6])
+	}
+
+	if got := binary.BigEndian.Uint16(frame.Data[12:14]); got != EtherTypeARP {
+		t.Errorf("expected EtherType 0x%x; got 0x%x", EtherTypeARP, got)
+	}
+
+	pkt := framePayload(frame)
+	if got := binary.BigEndian.Uint16(pkt[6:8]); got != op {
+		t.Errorf("expected ARP op %d; got %d", op, got)
+	}
+
+	if !bytes.Equal(pkt[18:24], targetMAC[:]) || !bytes.Equal(pkt[24:28], targetIP[:]) {
+		t.Errorf("expected ARP target %s/%s; got % x/% x", targetMAC.String(), targetIP.String(), pkt[18:24], pkt[24:28])
+	}
+}
+
+func TestARPResolve(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	now := timer.Duration(0)
+	nowFn = func() timer.Duration { return now }
+
+	var (
+		localIP   = IPAddr{10, 0, 2, 15}
+		peerIP    = IPAddr{10, 0, 2, 2}
+		peerMAC   = netdev.HardwareAddr{0x52, 0x55, 0x0a, 0, 2, 2}
+		iface, dv = mockInterface(Config{Addr: localIP, Gateway: peerIP})
+	)
+
+	if _, ok := iface.Resolve(peerIP); ok {
+		t.Fatal("expected Resolve to return false for an address that is not cached")
+	}
+
+	if len(dv.sent) != 1 {
+		t.Fatalf("expected an ARP request to be sent; got %d frames", len(dv.sent))
+	}
+	checkARPFrame(t, dv.sent[0], BroadcastHardwareAddr, arpOpRequest, netdev.HardwareAddr{}, peerIP)
+	if pkt := framePayload(dv.sent[0]); !bytes.Equal(pkt[8:14], dv.mac[:]) || !bytes.Equal(pkt[14:18], localIP[:]) {
+		t.Errorf("expected the ARP sender fields to contain the interface addresses")
+	}
+
+	// Requests are not repeated while the address is being resolved
+	if _, ok := iface.Resolve(peerIP); ok || len(dv.sent) != 1 {
+		t.Fatalf("expected no additional requests to be sent; got %d frames", len(dv.sent))
+	}
+
+	iface.handleARP(arpPacket(arpOpReply, peerMAC, peerIP, dv.mac, localIP))
+	if mac, ok := iface.Resolve(peerIP); !ok || mac != peerMAC {
+		t.Fatalf("expected Resolve to return (%s, true); got (%s, %t)", peerMAC.String(), mac.String(), ok)
+	}
+
+	// Expired entries are resolved again
+	now += arpReachableTime
+	if _, ok := iface.Resolve(peerIP); ok || len(dv.sent) != 2 {
+		t.Fatalf("expected a new request to be sent for an expired entry; got %d frames", len(dv.sent))
+	}
+}
+
+func TestARPOutput(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+
+	var (
+		localIP   = IPAddr{10, 0, 2, 15}
+		peerIP    = IPAddr{10, 0, 2, 2}
+		peerMAC   = netdev.HardwareAddr{0x52, 0x55, 0x0a, 0, 2, 2}
+		iface, dv = mockInterface(Config{Addr: localIP})
+	)
+
+	t.Run("broadcast", func(t *testing.T) {
+		dv.sent = nil
+		if err := iface.output(BroadcastIPAddr, EtherTypeIPv4, newFrame(20)); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(dv.sent) != 1 || !bytes.Equal(dv.sent[0].Data[0:6], BroadcastHardwareAddr[:]) {
+			t.Fatal("expected frame to be sent to the broadcast address")
+		}
+	})
+
+	t.Run("queue until resolved", func(t *testing.T) {
+		dv.sent = nil
+
+		var frames []*netdev.Frame
+		for i := 0; i < arpMaxPending+2; i++ {
+			frame := newFrame(1)
+			framePayload(frame)[0] = byte(i)
+			frames = append(frames, frame)
+
+			if err := iface.output(peerIP, EtherTypeIPv4, frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if len(dv.sent) != 1 {
+			t.Fatalf("expected only the ARP request to be sent; got %d frames", len(dv.sent))
+		}
+
+		dv.sent = nil
+		iface.handleARP(arpPacket(arpOpReply, peerMAC, peerIP, dv.mac, localIP))
+
+		// The oldest frames are dropped when the queue is full
+		if len(dv.sent) != arpMaxPending {
+			t.Fatalf("expected %d queued frames to be sent; got %d", arpMaxPending, len(dv.sent))
+		}
+
+		for i, frame := range dv.sent {
+			if exp := frames[i+2]; frame != exp {
+				t.Errorf("expected queued frame %d to be sent in order", i+2)
+			}
+			if !bytes.Equal(frame.Data[0:6], peerMAC[:]) {
+				t.Errorf("expected queued frame to be sent to %s", peerMAC.String())
+			}
+		}
+	})
+
+	t.Run("resolved", func(t *testing.T) {
+		dv.sent = nil
+		if err := iface.output(peerIP, EtherTypeIPv4, newFrame(20)); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(dv.sent) != 1 || !bytes.Equal(dv.sent[0].Data[0:6], peerMAC[:]) {
+			t.Fatal("expected frame to be sent directly to the resolved address")
+		}
+	})
+}
+
+func TestHandleARP(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+
+	var (
+		localIP  = IPAddr{10, 0, 2, 15}
+		peerIP   = IPAddr{10, 0, 2, 3}
+		otherIP  = IPAddr{10, 0, 2, 4}
+		peerMAC  = netdev.HardwareAddr{0x52, 0x55, 0x0a, 0, 2, 3}
+		zeroMAC  = netdev.HardwareAddr{}
+		badHType = arpPacket(arpOpRequest, peerMAC, peerIP, zeroMAC, localIP)
+		badPType = arpPacket(arpOpRequest, peerMAC, peerIP, zeroMAC, localIP)
+		badHLen  = arpPacket(arpOpRequest, peerMAC, peerIP, zeroMAC, localIP)
+	)
+	badHType[1] = 6
+	badPType[2] = 0x86
+	badHLen[4] = 8
+
+	specs := []struct {
+		cfg       Config
+		pkt       []byte
+		expReply  bool
+		expCached bool
+	}{
+		// Requests for our address are answered and the sender is cached
+		{Config{Addr: localIP}, arpPacket(arpOpRequest, peerMAC, peerIP, zeroMAC, localIP), true, true},
+		// Replies for our address are cached but not answered
+		{Config{Addr: localIP}, arpPacket(arpOpReply, peerMAC, peerIP, zeroMAC, localIP), false, true},
+		// Packets for other hosts are ignored if the sender is not cached
+		{Config{Addr: localIP}, arpPacket(arpOpRequest, peerMAC, peerIP, zeroMAC, otherIP), false, false},
+		// Probes are answered but not cached
+		{Config{Addr: localIP}, arpPacket(arpOpRequest, peerMAC, IPAddr{}, zeroMAC, localIP), true, false},
+		// Unconfigured interfaces do not answer requests
+		{Config{}, arpPacket(arpOpRequest, peerMAC, peerIP, zeroMAC, IPAddr{}), false, false},
+		// Malformed packets
+		{Config{Addr: localIP}, arpPacket(arpOpRequest, peerMAC, peerIP, zeroMAC, localIP)[:arpPacketLen-1], false, false},
+		{Config{Addr: localIP}, badHType, false, false},
+		{Config{Addr: localIP}, badPType, false, false},
+		{Config{Addr: localIP}, badHLen, false, false},
+	}
+
+	for specIndex, spec := range specs {
+		iface, dv := mockInterface(spec.cfg)
+		iface.handleARP(spec.pkt)
+
+		if got := len(dv.sent) == 1; got != spec.expReply {
+			t.Errorf("[spec %d] expected reply to be sent: %t; sent %d frames", specIndex, spec.expReply, len(dv.sent))
+			continue
+		}
+
+		if spec.expReply {
+			var senderIP IPAddr
+			copy(senderIP[:], spec.pkt[14:18])
+			checkARPFrame(t, dv.sent[0], peerMAC, arpOpReply, peerMAC, senderIP)
+		}
+
+		if got := iface.arp.lookup(peerIP) != nil; got != spec.expCached {
+			t.Errorf("[spec %d] expected sender to be cached: %t", specIndex, spec.expCached)
+		}
+	}
+
+	t.Run("update cached entry", func(t *testing.T) {
+		iface, dv := mockInterface(Config{Addr: localIP})
+
+		iface.handleARP(arpPacket(arpOpReply, peerMAC, peerIP, zeroMAC, localIP))
+
+		// A gratuitous announcement from a cached host updates its entry
+		newMAC := netdev.HardwareAddr{0x52, 0x55, 0x0a, 0, 2, 0x33}
+		iface.handleARP(arpPacket(arpOpRequest, newMAC, peerIP, zeroMAC, peerIP))
+
+		if mac, ok := iface.Resolve(peerIP); !ok || mac != newMAC {
+			t.Fatalf("expected cached entry to be updated to %s; got %s", newMAC.String(), mac.String())
+		}
+
+		if len(dv.sent) != 0 {
+			t.Fatalf("expected no frames to be sent; got %d", len(dv.sent))
+		}
+	})
+}
+
+func TestARPTick(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	now := timer.Duration(0)
+	nowFn = func() timer.Duration { return now }
+
+	var (
+		localIP   = IPAddr{10, 0, 2, 15}
+		peerIP    = IPAddr{10, 0, 2, 2}
+		cachedIP  = IPAddr{10, 0, 2, 3}
+		peerMAC   = netdev.HardwareAddr{0x52, 0x55, 0x0a, 0, 2, 3}
+		iface, dv = mockInterface(Config{Addr: localIP})
+	)
+
+	iface.handleARP(arpPacket(arpOpReply, peerMAC, cachedIP, dv.mac, localIP))
+	iface.output(peerIP, EtherTypeIPv4, newFrame(20))
+
+	// Incomplete entries are retried up to arpMaxRequests times
+	for i := 1; i < arpMaxRequests; i++ {
+		iface.arpTick()
+		if len(dv.sent) != i {
+			t.Fatalf("[tick %d] expected no request to be sent before the retry interval elapses; got %d frames", i, len(dv.sent))
+		}
+
+		now += arpRetryInterval
+		iface.arpTick()
+		if len(dv.sent) != i+1 {
+			t.Fatalf("[tick %d] expected a request to be resent; got %d frames", i, len(dv.sent))
+		}
+		checkARPFrame(t, dv.sent[i], BroadcastHardwareAddr, arpOpRequest, netdev.HardwareAddr{}, peerIP)
+	}
+
+	// Unresolved entries are evicted along with their queued frames
+	now += arpRetryInterval
+	iface.arpTick()
+	if len(dv.sent) != arpMaxRequests {
+		t.Fatalf("expected no more than %d requests to be sent; got %d", arpMaxRequests, len(dv.sent))
+	}
+
+	if iface.arp.lookup(peerIP) != nil {
+		t.Fatal("expected unresolved entry to be evicted")
+	}
+
+	if iface.arp.lookup(cachedIP) == nil {
+		t.Fatal("expected resolved entry to remain cached until it expires")
+	}
+
+	now += arpReachableTime
+	iface.arpTick()
+	if iface.arp.lookup(cachedIP) != nil {
+		t.Fatal("expected expired entry to be evicted")
+	}
+}
+
+func TestARPCacheAlloc(t *testing.T) {
+	var c arpCache
+
+	for i := 0; i < arpCacheSize; i++ {
+		ip := IPAddr{10, 0, 1, byte(i)}
+		if _, _, sendRequest := c.resolve(ip, timer.Duration(arpCacheSize-i)); !sendRequest {
+			t.Fatalf("[entry %d] expected a request to be sent", i)
+		}
+	}
+
+	// The entry that expires first is replaced once the cache is full
+	newIP := IPAddr{10, 0, 2, 1}
+	c.resolve(newIP, timer.Duration(arpCacheSize))
+
+	if c.lookup(IPAddr{10, 0, 1, arpCacheSize - 1}) != nil {
+		t.Fatal("expected the entry with the earliest deadline to be replaced")
+	}
+
+	for _, ip := range []IPAddr{newIP, {10, 0, 1, 0}, {10, 0, 1, arpCacheSize - 2}} {
+		if c.lookup(ip) == nil {
+			t.Errorf("expected %s to be cached", ip.String())
+		}
+	}
+}
+
+func TestGenARPTable(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+
+	var (
+		localIP   = IPAddr{10, 0, 2, 15}
+		peerMAC   = netdev.HardwareAddr{0x52, 0x55, 0x0a, 0, 2, 2}
+		iface, dv = mockInterface(Config{Addr: localIP})
+	)
+	interfaces = []*Interface{iface}
+
+	iface.handleARP(arpPacket(arpOpReply, peerMAC, IPAddr{10, 0, 2, 2}, dv.mac, localIP))
+	iface.Resolve(IPAddr{10, 0, 2, 3})
+
+	var buf bytes.Buffer
+	genARPTable(&buf)
+
+	exp := []string{
+		"IP ADDRESS      HW ADDRESS        STATE      DEVICE",
+		"10.0.2.2        52:55:0a:00:02:02 reachable  eth0",
+		"10.0.2.3        00:00:00:00:00:00 incomplete eth0",
+	}
+
+	if got := buf.String(); got != strings.Join(exp, "\n")+"\n" {
+		t.Fatalf("expected output:\n%s\ngot:\n%s", strings.Join(exp, "\n"), got)
+	}
+
+	if got := arpFree.String(); got != "free" {
+		t.Fatalf("expected free state to be reported as %q; got %q", "free", got)
+	}
+}
@@ -0,0 +1,61 @@
+package net
+
+import (
+	"encoding/binary"
+	"gopheros/device/netdev"
+	"gopheros/kernel"
+)
+
+// EtherType values for the protocols supported by the stack.
+const (
+	EtherTypeIPv4 = uint16(0x0800)
+	EtherTypeARP  = uint16(0x0806)
+)
+
+// BroadcastHardwareAddr is the Ethernet broadcast address.
+var BroadcastHardwareAddr = netdev.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// newFrame allocates a frame with room for an Ethernet header followed by a
+// payload of the specified length.
+func newFrame(payloadLen int) *netdev.Frame {
+	return &netdev.Frame{Data: make([]byte, netdev.EthernetHeaderLen+payloadLen)}
+}
+
+// framePayload returns the part of a frame that follows the Ethernet header.
+func framePayload(frame *netdev.Frame) []byte {
+	return frame.Data[netdev.EthernetHeaderLen:]
+}
+
+// sendFrame fills in the Ethernet header of a frame allocated by newFrame and
+// transmits it to the specified hardware address.
+func (iface *Interface) sendFrame(dst netdev.HardwareAddr, etherType uint16, frame *netdev.Frame) *kernel.Error {
+	src := iface.dev.HardwareAddr()
+	copy(frame.Data[0:6], dst[:])
+	copy(frame.Data[6:12], src[:])
+	binary.BigEndian.PutUint16(frame.Data[12:14], etherType)
+
+	return iface.dev.Transmit(frame)
+}
+
+// receive validates the Ethernet header of a received frame and passes its
+// payload to the handler for the frame's EtherType. Frames that are not
+// addressed to the interface are dropped. VLAN-tagged frames are not
+// supported.
+func (iface *Interface) receive(frame *netdev.Frame) {
+	if len(frame.Data) < netdev.EthernetHeaderLen {
+		return
+	}
+
+	var dst netdev.HardwareAddr
+	copy(dst[:], frame.Data[0:6])
+	if dst != BroadcastHardwareAddr && dst != iface.dev.HardwareAddr() {
+		return
+	}
+
+	switch binary.BigEndian.Uint16(frame.Data[12:14]) {
+	case EtherTypeARP:
+		iface.handleARP(framePayload(frame))
+	case EtherTypeIPv4:
+		iface.handleIPv4(framePayload(frame), frame.ChecksumValid)
+	}
+}
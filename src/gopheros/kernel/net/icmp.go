@@ -0,0 +1,123 @@
+package net
+
+import (
+	"encoding/binary"
+	"gopheros/device/netdev"
+	"gopheros/kernel"
+	"gopheros/kernel/timer"
+)
+
+const (
+	icmpHeaderLen = 8
+
+	icmpTypeEchoReply   = uint8(0)
+	icmpTypeEchoRequest = uint8(8)
+
+	// pingDataLen is the size of the data carried by echo requests which
+	// matches the default size used by the ping utility.
+	pingDataLen = 56
+)
+
+// pingRequest tracks an echo request that waits for its reply.
+type pingRequest struct {
+	id, seq uint16
+	sentAt  timer.Duration
+	rtt     timer.Duration
+	replied bool
+	next    *pingRequest
+}
+
+var (
+	// pingRequests contains the echo requests that wait for a reply.
+	pingRequests *pingRequest
+	nextPingID   uint16
+)
+
+// Ping sends an ICMP echo request with the specified sequence number to dst
+// and blocks the calling kernel thread until the reply arrives or the timeout
+// expires. It returns the round-trip time.
+func Ping(dst IPAddr, seq uint16, timeout timer.Duration) (timer.Duration, *kernel.Error) {
+	req := &pingRequest{seq: seq}
+
+	intr := lock()
+	nextPingID++
+	req.id = nextPingID
+	req.next, pingRequests = pingRequests, req
+	unlock(intr)
+
+	defer removePingRequest(req)
+
+	frame := newIPv4Frame(icmpHeaderLen + pingDataLen)
+	msg := ipv4Payload(frame)
+	binary.BigEndian.PutUint16(msg[4:6], req.id)
+	binary.BigEndian.PutUint16(msg[6:8], seq)
+	for i := range msg[icmpHeaderLen:] {
+		msg[icmpHeaderLen+i] = byte(i)
+	}
+	setICMPHeader(msg, icmpTypeEchoRequest)
+
+	req.sentAt = nowFn()
+	if err := sendIPv4(dst, ProtoICMP, frame); err != nil {
+		return 0, err
+	}
+
+	if !wait(func() bool { return req.replied }, timeout) {
+		return 0, ErrTimeout
+	}
+
+	return req.rtt, nil
+}
+
+// removePingRequest removes a request from the list of pending requests.
+func removePingRequest(req *pingRequest) {
+	intr := lock()
+	for prev := &pingRequests; *prev != nil; prev = &(*prev).next {
+		if *prev == req {
+			*prev = req.next
+			break
+		}
+	}
+	unlock(intr)
+}
+
+// setICMPHeader sets the type of an ICMP message and computes its checksum.
+// The code is always zero as only echo messages are generated.
+func setICMPHeader(msg []byte, msgType uint8) {
+	msg[0], msg[1] = msgType, 0
+	msg[2], msg[3] = 0, 0
+	binary.BigEndian.PutUint16(msg[2:4], netdev.Checksum(msg, 0))
+}
+
+// handleICMP processes a received ICMP message. Echo requests are answered
+// only if they are sent to the unicast address of the interface; echo replies
+// complete the matching Ping call.
+func (iface *Interface) handleICMP(src IPAddr, unicast bool, msg []byte) {
+	if len(msg) < icmpHeaderLen || netdev.Checksum(msg, 0) != 0 || msg[1] != 0 {
+		return
+	}
+
+	switch msg[0] {
+	case icmpTypeEchoRequest:
+		if !unicast {
+			return
+		}
+
+		frame := newIPv4Frame(len(msg))
+		reply := ipv4Payload(frame)
+		copy(reply, msg)
+		setICMPHeader(reply, icmpTypeEchoReply)
+		sendIPv4(src, ProtoICMP, frame)
+	case icmpTypeEchoReply:
+		id, seq := binary.BigEndian.Uint16(msg[4:6]), binary.BigEndian.Uint16(msg[6:8])
+
+		intr := lock()
+		for req := pingRequests; req != nil; req = req.next {
+			if req.id == id && req.seq == seq && !req.replied {
+				req.replied, req.rtt = true, nowFn()-req.sentAt
+				wakeAllFn(&waiters)
+				break
+			}
+		}
+		unlock(intr)
+	}
+}
@@ -0,0 +1,161 @@
+package net
+
+import (
+	"encoding/binary"
+	"gopheros/device/netdev"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/timer"
+	"testing"
+)
+
+// icmpEcho builds an ICMP echo message with a valid checksum.
+func icmpEcho(msgType uint8, id, seq uint16, data []byte) []byte {
+	msg := make([]byte, icmpHeaderLen+len(data))
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	binary.BigEndian.PutUint16(msg[6:8], seq)
+	copy(msg[icmpHeaderLen:], data)
+	setICMPHeader(msg, msgType)
+	return msg
+}
+
+func TestHandleICMPEchoRequest(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+
+	iface, dev := resolvedInterface()
+	request := icmpEcho(icmpTypeEchoRequest, 0x1234, 7, []byte("gopher"))
+	iface.handleIPv4(ipv4Packet(IPAddr{8, 8, 8, 8}, testLocalIP, ProtoICMP, request), false)
+
+	if len(dev.sent) != 1 {
+		t.Fatalf("expected an echo reply to be sent; got %d frames", len(dev.sent))
+	}
+
+	pkt := framePayload(dev.sent[0])
+	if got := pkt[16:20]; string(got) != "\x08\x08\x08\x08" {
+		t.Errorf("expected reply to be sent to the requester; got % x", got)
+	}
+
+	reply := pkt[ipv4HeaderLen:]
+	if exp := icmpEcho(icmpTypeEchoReply, 0x1234, 7, []byte("gopher")); string(reply) != string(exp) {
+		t.Errorf("expected echo reply:\n% x\ngot:\n% x", exp, reply)
+	}
+
+	// Malformed messages are ignored
+	badChecksum := icmpEcho(icmpTypeEchoRequest, 1, 1, nil)
+	badChecksum[2]++
+	badCode := icmpEcho(icmpTypeEchoRequest, 1, 1, nil)
+	badCode[1] = 1
+
+	for specIndex, msg := range [][]byte{badChecksum, badCode, badCode[:icmpHeaderLen-1]} {
+		dev.sent = nil
+		iface.handleICMP(testGatewayIP, true, msg)
+		if len(dev.sent) != 0 {
+			t.Errorf("[spec %d] expected message to be ignored", specIndex)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	now := timer.Duration(0)
+	nowFn = func() timer.Duration { return now }
+
+	var (
+		iface, dev = resolvedInterface()
+		timerFn    func()
+		stopped    bool
+	)
+	timerAfterFn = func(_ timer.Duration, fn func()) *timer.Timer {
+		timerFn = fn
+		return nil
+	}
+	stopTimerFn = func(_ *timer.Timer) bool {
+		stopped = true
+		return true
+	}
+	wakeAllFn = func(_ *sync.WaitQueue) int { return 0 }
+
+	t.Run("reply", func(t *testing.T) {
+		dev.sent = nil
+		waitFn = func(_ *sync.WaitQueue, cond func() bool) {
+			if len(dev.sent) != 1 {
+				t.Fatalf("expected echo request to be sent; got %d frames", len(dev.sent))
+			}
+
+			request := ipv4Payload(dev.sent[0])
+			if request[0] != icmpTypeEchoRequest || netdev.Checksum(request, 0) != 0 ||
+				len(request) != icmpHeaderLen+pingDataLen || binary.BigEndian.Uint16(request[6:8]) != 3 {
+				t.Fatalf("unexpected echo request: % x", request)
+			}
+
+			// Replies with a different identifier or sequence are ignored
+			id := binary.BigEndian.Uint16(request[4:6])
+			for _, seq := range []uint16{2, 3} {
+				iface.handleICMP(testGatewayIP, true, icmpEcho(icmpTypeEchoReply, id+1, 3, nil))
+				if cond() {
+					t.Fatal("expected replies for other requests to be ignored")
+				}
+
+				now += timer.Millisecond
+				iface.handleICMP(testGatewayIP, true, icmpEcho(icmpTypeEchoReply, id, seq, request[icmpHeaderLen:]))
+			}
+
+			if !cond() {
+				t.Fatal("expected the wait condition to be satisfied by the reply")
+			}
+		}
+
+		rtt, err := Ping(testGatewayIP, 3, timer.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := 2 * timer.Millisecond; rtt != exp {
+			t.Errorf("expected rtt %d; got %d", exp, rtt)
+		}
+
+		if !stopped {
+			t.Error("expected the timeout timer to be stopped")
+		}
+
+		if pingRequests != nil {
+			t.Error("expected the request to be removed from the pending list")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		waitFn = func(_ *sync.WaitQueue, cond func() bool) {
+			timerFn()
+			if !cond() {
+				t.Fatal("expected the wait condition to be satisfied by the timeout")
+			}
+		}
+
+		// Add another pending request to exercise the list removal code
+		other := &pingRequest{}
+		pingRequests = other
+
+		if _, err := Ping(testGatewayIP, 1, timer.Second); err != ErrTimeout {
+			t.Fatalf("expected error %v; got %v", ErrTimeout, err)
+		}
+
+		if pingRequests != other || other.next != nil {
+			t.Error("expected only the timed out request to be removed from the pending list")
+		}
+	})
+
+	t.Run("no route", func(t *testing.T) {
+		pingRequests = nil
+		interfaces = nil
+		if _, err := Ping(IPAddr{8, 8, 8, 8}, 1, timer.Second); err != errNoRoute {
+			t.Fatalf("expected error %v; got %v", errNoRoute, err)
+		}
+
+		if pingRequests != nil {
+			t.Error("expected the request to be removed from the pending list")
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package net
+
+import (
+	"encoding/binary"
+	"gopheros/device/netdev"
+	"gopheros/kernel"
+)
+
+// IP protocol numbers for the protocols supported by the stack.
+const (
+	ProtoICMP = uint8(1)
+	ProtoTCP  = uint8(6)
+	ProtoUDP  = uint8(17)
+)
+
+const (
+	ipv4HeaderLen  = 20
+	ipv4DefaultTTL = 64
+
+	ipv4FlagDF         = 0x4000
+	ipv4FlagMF         = 0x2000
+	ipv4FragOffsetMask = 0x1fff
+)
+
+var (
+	errNoRoute        = &kernel.Error{Module: "net", Message: "no route to host", Code: kernel.CodeHostUnreachable}
+	errPacketTooLarge = &kernel.Error{Module: "net", Message: "packet exceeds the interface MTU", Code: kernel.CodeMessageTooLong}
+
+	// nextIPv4ID is the identification field of the next outgoing packet.
+	nextIPv4ID uint16
+)
+
+// route selects the interface and the next hop for a destination address.
+// Destinations on the local network of an interface are reached directly;
+// all other destinations are reached via the gateway of the first interface
+// that has one.
+func route(dst IPAddr) (*Interface, IPAddr, *kernel.Error) {
+	list := Interfaces()
+	for _, iface := range list {
+		cfg := iface.Config()
+		if cfg.Addr.IsZero() {
+			continue
+		}
+
+		if dst == BroadcastIPAddr || dst.Mask(cfg.Netmask) == cfg.Addr.Mask(cfg.Netmask) {
+			return iface, dst, nil
+		}
+	}
+
+	for _, iface := range list {
+		if cfg := iface.Config(); !cfg.Addr.IsZero() && !cfg.Gateway.IsZero() {
+			return iface, cfg.Gateway, nil
+		}
+	}
+
+	// Broadcasts can be sent before an interface is configured (e.g. by a
+	// DHCP client) using the zero source address.
+	if dst == BroadcastIPAddr && len(list) != 0 {
+		return list[0], dst, nil
+	}
+
+	return nil, IPAddr{}, errNoRoute
+}
+
+// newIPv4Frame allocates a frame with room for the Ethernet and IPv4 headers
+// followed by a payload of the specified length.
+func newIPv4Frame(payloadLen int) *netdev.Frame {
+	return newFrame(ipv4HeaderLen + payloadLen)
+}
+
+// ipv4Payload returns the part of a frame allocated by newIPv4Frame that
+// follows the IPv4 header.
+func ipv4Payload(frame *netdev.Frame) []byte {
+	return framePayload(frame)[ipv4HeaderLen:]
+}
+
+// sendIPv4 routes a frame allocated by newIPv4Frame to its destination.
+func sendIPv4(dst IPAddr, proto uint8, frame *netdev.Frame) *kernel.Error {
+	iface, nextHop, err := route(dst)
+	if err != nil {
+		return err
+	}
+
+	return iface.sendIPv4(nextHop, dst, proto, frame)
+}
+
+// sendIPv4 fills in the IPv4 header of a frame allocated by newIPv4Frame and
+// transmits it to the specified next hop. Outgoing packets are never
+// fragmented.
+func (iface *Interface) sendIPv4(nextHop, dst IPAddr, proto uint8, frame *netdev.Frame) *kernel.Error {
+	pkt := framePayload(frame)
+	if len(pkt) > int(iface.dev.MTU()) {
+		return errPacketTooLarge
+	}
+
+	src := iface.Config().Addr
+
+	intr := lock()
+	id := nextIPv4ID
+	nextIPv4ID++
+	unlock(intr)
+
+	hdr := pkt[:ipv4HeaderLen]
+	hdr[0], hdr[1] = 0x45, 0
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(hdr[4:6], id)
+	binary.BigEndian.PutUint16(hdr[6:8], ipv4FlagDF)
+	hdr[8], hdr[9] = ipv4DefaultTTL, proto
+	hdr[10], hdr[11] = 0, 0
+	copy(hdr[12:16], src[:])
+	copy(hdr[16:20], dst[:])
+	binary.BigEndian.PutUint16(hdr[10:12], netdev.Checksum(hdr, 0))
+
+	return iface.output(nextHop, EtherTypeIPv4, frame)
+}
+
+// handleIPv4 validates the header of a received IPv4 packet and passes its
+// payload to the handler for its protocol. Packets that are not addressed to
+// the interface and fragmented packets are dropped. The checksumValid flag
+// indicates that the device has already validated the L4 checksum.
+func (iface *Interface) handleIPv4(pkt []byte, checksumValid bool) {
+	if len(pkt) < ipv4HeaderLen || pkt[0]>>4 != 4 {
+		return
+	}
+
+	hdrLen := int(pkt[0]&0xf) * 4
+	totalLen := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if hdrLen < ipv4HeaderLen || totalLen < hdrLen || totalLen > len(pkt) ||
+		netdev.Checksum(pkt[:hdrLen], 0) != 0 {
+		return
+	}
+
+	if frag := binary.BigEndian.Uint16(pkt[6:8]); frag&ipv4FlagMF != 0 || frag&ipv4FragOffsetMask != 0 {
+		return
+	}
+
+	var src, dst IPAddr
+	copy(src[:], pkt[12:16])
+	copy(dst[:], pkt[16:20])
+
+	cfg := iface.Config()
+	unicast := !cfg.Addr.IsZero() && dst == cfg.Addr
+	if !unicast && dst != BroadcastIPAddr && dst != cfg.directedBroadcast() {
+		return
+	}
+
+	// Frames shorter than the Ethernet minimum are padded by the sender so
+	// the payload must be trimmed to the length reported by the header.
+	payload := pkt[hdrLen:totalLen]
+	switch pkt[9] {
+	case ProtoICMP:
+		iface.handleICMP(src, unicast, payload)
+	case ProtoTCP:
+		// TCP connections can only be established with unicast
+		// addresses.
+		if unicast {
+			iface.handleTCP(src, dst, payload, checksumValid)
+		}
+	case ProtoUDP:
+		handleUDP(src, dst, payload, checksumValid)
+	}
+}
+
+// directedBroadcast returns the broadcast address of the local network or
+// the limited broadcast address if the interface is not configured.
+func (cfg Config) directedBroadcast() IPAddr {
+	if cfg.Addr.IsZero() {
+		return BroadcastIPAddr
+	}
+
+	addr := cfg.Addr
+	for i := range addr {
+		addr[i] |= ^cfg.Netmask[i]
+	}
+	return addr
+}
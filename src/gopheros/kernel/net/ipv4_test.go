@@ -0,0 +1,186 @@
+package net
+
+import (
+	"encoding/binary"
+	"gopheros/device/netdev"
+	"gopheros/kernel/timer"
+	"testing"
+)
+
+var (
+	testLocalIP   = IPAddr{10, 0, 2, 15}
+	testGatewayIP = IPAddr{10, 0, 2, 2}
+	testGatewayHW = netdev.HardwareAddr{0x52, 0x55, 0x0a, 0, 2, 2}
+	testNetmask   = IPAddr{255, 255, 255, 0}
+)
+
+// ipv4Packet builds an IPv4 packet with a valid header checksum.
+func ipv4Packet(src, dst IPAddr, proto uint8, payload []byte) []byte {
+	pkt := make([]byte, ipv4HeaderLen+len(payload))
+	pkt[0], pkt[8], pkt[9] = 0x45, 64, proto
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	copy(pkt[12:16], src[:])
+	copy(pkt[16:20], dst[:])
+	binary.BigEndian.PutUint16(pkt[10:12], netdev.Checksum(pkt[:ipv4HeaderLen], 0))
+	copy(pkt[ipv4HeaderLen:], payload)
+	return pkt
+}
+
+// resolvedInterface returns a configured interface that is attached to the
+// stack and has already resolved the hardware address of its gateway.
+func resolvedInterface() (*Interface, *mockDevice) {
+	iface, dev := mockInterface(Config{Addr: testLocalIP, Netmask: testNetmask, Gateway: testGatewayIP})
+	interfaces = []*Interface{iface}
+	iface.handleARP(arpPacket(arpOpReply, testGatewayHW, testGatewayIP, dev.mac, testLocalIP))
+	return iface, dev
+}
+
+func TestRoute(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var (
+		unconfigured = &Interface{}
+		lan          = &Interface{config: Config{Addr: IPAddr{192, 168, 1, 10}, Netmask: IPAddr{255, 255, 0, 0}}}
+		wan          = &Interface{config: Config{Addr: testLocalIP, Netmask: testNetmask, Gateway: testGatewayIP}}
+	)
+	interfaces = []*Interface{unconfigured, lan, wan}
+
+	specs := []struct {
+		dst        IPAddr
+		expIface   *Interface
+		expNextHop IPAddr
+	}{
+		{IPAddr{10, 0, 2, 3}, wan, IPAddr{10, 0, 2, 3}},
+		{IPAddr{192, 168, 7, 1}, lan, IPAddr{192, 168, 7, 1}},
+		{BroadcastIPAddr, lan, BroadcastIPAddr},
+		{IPAddr{8, 8, 8, 8}, wan, testGatewayIP},
+	}
+
+	for specIndex, spec := range specs {
+		iface, nextHop, err := route(spec.dst)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if iface != spec.expIface || nextHop != spec.expNextHop {
+			t.Errorf("[spec %d] expected route via %s; got %s", specIndex, spec.expNextHop.String(), nextHop.String())
+		}
+	}
+
+	interfaces = []*Interface{unconfigured, lan}
+	if _, _, err := route(IPAddr{8, 8, 8, 8}); err != errNoRoute {
+		t.Fatalf("expected error %v; got %v", errNoRoute, err)
+	}
+}
+
+func TestSendIPv4(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+
+	_, dev := resolvedInterface()
+
+	dst := IPAddr{1, 1, 1, 1}
+	frame := newIPv4Frame(4)
+	copy(ipv4Payload(frame), "ping")
+	if err := sendIPv4(dst, ProtoICMP, frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dev.sent) != 1 {
+		t.Fatalf("expected a frame to be sent; got %d", len(dev.sent))
+	}
+
+	if got := dev.sent[0].Data[0:6]; string(got) != string(testGatewayHW[:]) {
+		t.Errorf("expected packet to be sent to the gateway; got % x", got)
+	}
+
+	pkt := framePayload(dev.sent[0])
+	if exp := ipv4Packet(testLocalIP, dst, ProtoICMP, []byte("ping")); pkt[0] != exp[0] ||
+		binary.BigEndian.Uint16(pkt[2:4]) != uint16(len(exp)) ||
+		pkt[8] != ipv4DefaultTTL || pkt[9] != ProtoICMP ||
+		string(pkt[12:20]) != string(exp[12:20]) {
+		t.Errorf("unexpected IPv4 header: % x", pkt[:ipv4HeaderLen])
+	}
+
+	if binary.BigEndian.Uint16(pkt[6:8]) != ipv4FlagDF {
+		t.Error("expected the DF flag to be set")
+	}
+
+	if netdev.Checksum(pkt[:ipv4HeaderLen], 0) != 0 {
+		t.Error("expected the header checksum to be valid")
+	}
+
+	// Each packet gets a new identification value
+	sendIPv4(dst, ProtoICMP, newIPv4Frame(0))
+	if id0, id1 := binary.BigEndian.Uint16(pkt[4:6]), binary.BigEndian.Uint16(framePayload(dev.sent[1])[4:6]); id1 != id0+1 {
+		t.Errorf("expected identification %d; got %d", id0+1, id1)
+	}
+
+	if err := sendIPv4(dst, ProtoICMP, newIPv4Frame(1500)); err != errPacketTooLarge {
+		t.Errorf("expected error %v; got %v", errPacketTooLarge, err)
+	}
+
+	interfaces = nil
+	if err := sendIPv4(dst, ProtoICMP, newIPv4Frame(0)); err != errNoRoute {
+		t.Errorf("expected error %v; got %v", errNoRoute, err)
+	}
+}
+
+func TestHandleIPv4(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+
+	echo := icmpEcho(icmpTypeEchoRequest, 1, 1, []byte("data"))
+	valid := func() []byte { return ipv4Packet(testGatewayIP, testLocalIP, ProtoICMP, echo) }
+	withHeader := func(offset int, val byte) []byte {
+		pkt := valid()
+		pkt[offset] = val
+		pkt[10], pkt[11] = 0, 0
+		binary.BigEndian.PutUint16(pkt[10:12], netdev.Checksum(pkt[:ipv4HeaderLen], 0))
+		return pkt
+	}
+
+	badChecksum := valid()
+	badChecksum[10]++
+
+	specs := []struct {
+		pkt      []byte
+		expReply bool
+	}{
+		{valid(), true},
+		// Ethernet padding is ignored
+		{append(valid(), 0, 0, 0, 0), true},
+		// Packets sent to the local network broadcast addresses are
+		// accepted but echo requests are only answered for unicast
+		{ipv4Packet(testGatewayIP, IPAddr{10, 0, 2, 255}, ProtoICMP, echo), false},
+		{ipv4Packet(testGatewayIP, BroadcastIPAddr, ProtoICMP, echo), false},
+		// Packets for other hosts and unsupported protocols
+		{ipv4Packet(testGatewayIP, IPAddr{10, 0, 2, 16}, ProtoICMP, echo), false},
+		{ipv4Packet(testGatewayIP, testLocalIP, 17, echo), false},
+		// Malformed and fragmented packets
+		{valid()[:ipv4HeaderLen-1], false},
+		{valid()[:ipv4HeaderLen+icmpHeaderLen], false},
+		{withHeader(0, 0x65), false},
+		{withHeader(0, 0x44), false},
+		{withHeader(6, 0x20), false},
+		{withHeader(7, 0x01), false},
+		{badChecksum, false},
+	}
+
+	for specIndex, spec := range specs {
+		iface, dev := resolvedInterface()
+		iface.handleIPv4(spec.pkt, false)
+
+		if got := len(dev.sent) == 1; got != spec.expReply {
+			t.Errorf("[spec %d] expected reply to be sent: %t; sent %d frames", specIndex, spec.expReply, len(dev.sent))
+		}
+	}
+
+	if exp, got := BroadcastIPAddr, (Config{}).directedBroadcast(); got != exp {
+		t.Fatalf("expected unconfigured interface broadcast address %s; got %s", exp.String(), got.String())
+	}
+}
@@ -0,0 +1,395 @@
+// Package net implements the kernel network stack.
+//
+// The stack sits on top of the interfaces registered with the netdev package.
+// Frames received by any interface are demultiplexed by their EtherType and
+// passed to the matching protocol handler; outgoing packets are encapsulated
+// into Ethernet frames whose destination address is resolved via ARP.
+//
+// Interfaces are configured statically via the boot command line. The
+// net.ip=ADDR/PREFIX argument sets the IPv4 address and netmask of the first
+// interface and net.gw=ADDR sets its default gateway.
+//
+// The netconsole=ADDR:PORT argument streams the kernel log as UDP datagrams to
+// a remote host so that the output of headless machines can be captured.
+//
+// Kernel code can exchange UDP datagrams using the sockets returned by
+// ListenUDP and open TCP connections using ListenTCP and DialTCP.
+package net
+
+import (
+	"gopheros/device/netdev"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/rand"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/vfs"
+	"gopheros/kernel/vfs/procfs"
+	"gopheros/kernel/workqueue"
+)
+
+// IPAddr is an IPv4 address.
+type IPAddr [4]byte
+
+// BroadcastIPAddr is the limited broadcast address.
+var BroadcastIPAddr = IPAddr{255, 255, 255, 255}
+
+// String returns the address in dotted decimal notation.
+func (ip IPAddr) String() string {
+	var (
+		buf [15]byte
+		pos int
+	)
+
+	for i, b := range ip {
+		if i != 0 {
+			buf[pos] = '.'
+			pos++
+		}
+
+		if b >= 100 {
+			buf[pos] = '0' + b/100
+			pos++
+		}
+		if b >= 10 {
+			buf[pos] = '0' + (b/10)%10
+			pos++
+		}
+		buf[pos] = '0' + b%10
+		pos++
+	}
+
+	return string(buf[:pos])
+}
+
+// IsZero returns true if the address is 0.0.0.0.
+func (ip IPAddr) IsZero() bool {
+	return ip == IPAddr{}
+}
+
+// Mask returns the result of masking the address with mask.
+func (ip IPAddr) Mask(mask IPAddr) IPAddr {
+	for i := range ip {
+		ip[i] &= mask[i]
+	}
+	return ip
+}
+
+// ParseIP parses an address in dotted decimal notation.
+func ParseIP(s string) (IPAddr, bool) {
+	var (
+		ip     IPAddr
+		octet  int
+		digits int
+	)
+
+	for i := 0; i <= len(s); i++ {
+		if i == len(s) || s[i] == '.' {
+			if digits == 0 || octet == len(ip) || (i == len(s)) != (octet == len(ip)-1) {
+				return IPAddr{}, false
+			}
+			octet, digits = octet+1, 0
+			continue
+		}
+
+		c := s[i]
+		if c < '0' || c > '9' || digits == 3 {
+			return IPAddr{}, false
+		}
+
+		val := int(ip[octet])*10 + int(c-'0')
+		if val > 255 {
+			return IPAddr{}, false
+		}
+		ip[octet] = byte(val)
+		digits++
+	}
+
+	return ip, true
+}
+
+// ParsePrefix parses an address followed by a slash and a prefix length
+// (e.g. 10.0.2.15/24) and returns the address and the netmask that
+// corresponds to the prefix length.
+func ParsePrefix(s string) (IPAddr, IPAddr, bool) {
+	slash := len(s) - 1
+	for ; slash >= 0 && s[slash] != '/'; slash-- {
+	}
+
+	if slash < 0 || slash == len(s)-1 || len(s)-slash > 3 {
+		return IPAddr{}, IPAddr{}, false
+	}
+
+	ip, ok := ParseIP(s[:slash])
+	if !ok {
+		return IPAddr{}, IPAddr{}, false
+	}
+
+	var prefixLen uint
+	for _, c := range s[slash+1:] {
+		if c < '0' || c > '9' {
+			return IPAddr{}, IPAddr{}, false
+		}
+		prefixLen = prefixLen*10 + uint(c-'0')
+	}
+
+	if prefixLen > 32 {
+		return IPAddr{}, IPAddr{}, false
+	}
+
+	var mask IPAddr
+	bits := ^uint32(0) << (32 - prefixLen)
+	if prefixLen == 0 {
+		bits = 0
+	}
+	mask[0], mask[1], mask[2], mask[3] = byte(bits>>24), byte(bits>>16), byte(bits>>8), byte(bits)
+
+	return ip, mask, true
+}
+
+// Config contains the IPv4 configuration of an interface.
+type Config struct {
+	Addr    IPAddr
+	Netmask IPAddr
+	Gateway IPAddr
+}
+
+// device is the subset of the netdev.Interface API used by the stack.
+type device interface {
+	Name() string
+	HardwareAddr() netdev.HardwareAddr
+	MTU() uint16
+	Transmit(*netdev.Frame) *kernel.Error
+}
+
+// Interface holds the protocol state for a network device.
+type Interface struct {
+	dev    device
+	config Config
+	arp    arpCache
+}
+
+// Name returns the name of the underlying network device.
+func (iface *Interface) Name() string {
+	return iface.dev.Name()
+}
+
+// HardwareAddr returns the MAC address of the underlying network device.
+func (iface *Interface) HardwareAddr() netdev.HardwareAddr {
+	return iface.dev.HardwareAddr()
+}
+
+// Config returns the IPv4 configuration of the interface.
+func (iface *Interface) Config() Config {
+	intr := lock()
+	cfg := iface.config
+	unlock(intr)
+	return cfg
+}
+
+// Configure updates the IPv4 configuration of the interface.
+func (iface *Interface) Configure(cfg Config) {
+	intr := lock()
+	iface.config = cfg
+	unlock(intr)
+}
+
+const (
+	// maintenanceInterval is the period of the timer that ages the
+	// protocol caches and runs the TCP retransmission timers.
+	maintenanceInterval = 200 * timer.Millisecond
+)
+
+var (
+	// ErrTimeout is returned by blocking operations that do not complete
+	// before their timeout expires.
+	ErrTimeout = &kernel.Error{Module: "net", Message: "operation timed out", Code: kernel.CodeTimedOut}
+
+	errBadAddrArg    = &kernel.Error{Module: "net", Message: "invalid net.ip boot argument; expected ADDR/PREFIX"}
+	errBadGatewayArg = &kernel.Error{Module: "net", Message: "invalid net.gw boot argument"}
+
+	interfaces []*Interface
+
+	// waiters contains the threads that wait for network events.
+	waiters sync.WaitQueue
+
+	// maintenanceWork ages the protocol caches. It is queued by a
+	// periodic timer as timer callbacks run in interrupt context.
+	maintenanceWork = workqueue.NewWork(maintain)
+
+	// The following functions are used by tests to mock calls to the
+	// cpu, netdev, cmdline, timer, workqueue, procfs, sync and rand
+	// packages.
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn  = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	netdevInterfacesFn  = netdev.Interfaces
+	setReceiveHandlerFn = netdev.SetReceiveHandler
+	cmdlineLookupFn     = cmdline.Lookup
+	nowFn               = timer.Now
+	timerEveryFn        = timer.Every
+	enqueueWorkFn       = workqueue.Enqueue
+	registerProcFileFn  = procfs.Register
+	timerAfterFn        = timer.After
+	stopTimerFn         = (*timer.Timer).Stop
+	waitFn              = (*sync.WaitQueue).Wait
+	wakeAllFn           = (*sync.WaitQueue).WakeAll
+	randUint32Fn        = rand.Uint32
+)
+
+// Init attaches the stack to the registered network devices and applies the
+// interface configuration from the boot command line. It must be invoked
+// after the hardware has been detected and the timer subsystem has been
+// initialized.
+func Init() *kernel.Error {
+	devs := netdevInterfacesFn()
+	if len(devs) == 0 {
+		return nil
+	}
+
+	var cfg Config
+	if arg, found := cmdlineLookupFn("net.ip"); found {
+		var ok bool
+		if cfg.Addr, cfg.Netmask, ok = ParsePrefix(arg); !ok {
+			return errBadAddrArg
+		}
+	}
+
+	if arg, found := cmdlineLookupFn("net.gw"); found {
+		var ok bool
+		if cfg.Gateway, ok = ParseIP(arg); !ok {
+			return errBadGatewayArg
+		}
+	}
+
+	var (
+		consoleDst     UDPAddr
+		consoleEnabled bool
+	)
+	if arg, found := cmdlineLookupFn("netconsole"); found {
+		if consoleDst, consoleEnabled = parseUDPAddr(arg); !consoleEnabled {
+			return errBadNetconsoleArg
+		}
+	}
+
+	list := make([]*Interface, len(devs))
+	for i, dev := range devs {
+		list[i] = &Interface{dev: dev}
+	}
+	list[0].config = cfg
+
+	intr := lock()
+	interfaces = list
+	unlock(intr)
+
+	setReceiveHandlerFn(receive)
+	timerEveryFn(maintenanceInterval, func() { enqueueWorkFn(maintenanceWork) })
+
+	if err := registerProcFileFn("/net/arp", genARPTable); err != nil {
+		return err
+	}
+
+	if err := registerProcFileFn("/net/udp", genUDPTable); err != nil {
+		return err
+	}
+
+	if err := registerProcFileFn("/net/tcp", genTCPTable); err != nil {
+		return err
+	}
+
+	if !cfg.Addr.IsZero() {
+		kfmt.Printf("[net] %s: address %s netmask %s\n", list[0].Name(), cfg.Addr.String(), cfg.Netmask.String())
+	}
+
+	// Resolve the gateway address in advance as most traffic is routed
+	// through it.
+	if !cfg.Gateway.IsZero() {
+		list[0].Resolve(cfg.Gateway)
+	}
+
+	if consoleEnabled {
+		return startNetconsole(consoleDst)
+	}
+
+	return nil
+}
+
+// Interfaces returns the list of interfaces attached to the stack.
+func Interfaces() []*Interface {
+	intr := lock()
+	list := interfaces
+	unlock(intr)
+	return list
+}
+
+// lookupInterface returns the interface for a network device.
+func lookupInterface(dev *netdev.Interface) *Interface {
+	for _, iface := range Interfaces() {
+		if iface.dev == device(dev) {
+			return iface
+		}
+	}
+
+	return nil
+}
+
+// receive is invoked by the netdev package for each received frame.
+func receive(dev *netdev.Interface, frame *netdev.Frame) {
+	if iface := lookupInterface(dev); iface != nil {
+		iface.receive(frame)
+	}
+}
+
+// maintain ages the protocol caches of all interfaces and runs the TCP
+// timers.
+func maintain() {
+	for _, iface := range Interfaces() {
+		iface.arpTick()
+	}
+
+	tcpTick()
+}
+
+// wakeWaiters wakes up the threads that wait for a change in the state of a
+// socket, including the threads that poll sockets via the vfs package.
+func wakeWaiters() {
+	wakeAllFn(&waiters)
+	vfs.NotifyPoll()
+}
+
+// wait blocks the calling kernel thread until cond returns true or, if timeout
+// is not zero, until the timeout expires. The condition is evaluated with
+// interrupts disabled and must be signaled by waking up the waiters. It
+// returns false if the timeout expired.
+func wait(cond func() bool, timeout timer.Duration) bool {
+	var done, expired bool
+
+	if timeout != 0 {
+		t := timerAfterFn(timeout, func() {
+			expired = true
+			wakeAllFn(&waiters)
+		})
+		defer stopTimerFn(t)
+	}
+
+	waitFn(&waiters, func() bool {
+		done = cond()
+		return done || expired
+	})
+
+	return done
+}
+
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+	return intr
+}
+
+func unlock(intr bool) {
+	if intr {
+		enableInterruptsFn()
+	}
+}
@@ -0,0 +1,314 @@
+package net
+
+import (
+	"encoding/binary"
+	"gopheros/device/netdev"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/rand"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/vfs/procfs"
+	"gopheros/kernel/workqueue"
+	"strings"
+	"testing"
+)
+
+func restoreMocks() {
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	netdevInterfacesFn = netdev.Interfaces
+	setReceiveHandlerFn = netdev.SetReceiveHandler
+	cmdlineLookupFn = cmdline.Lookup
+	nowFn = timer.Now
+	timerEveryFn = timer.Every
+	enqueueWorkFn = workqueue.Enqueue
+	registerProcFileFn = procfs.Register
+	waitFn = (*sync.WaitQueue).Wait
+	wakeAllFn = (*sync.WaitQueue).WakeAll
+	timerAfterFn = timer.After
+	stopTimerFn = (*timer.Timer).Stop
+	interfaces = nil
+	pingRequests = nil
+	udpConns = make(map[uint16]*UDPConn)
+	nextEphemeralPort = udpEphemeralFirst
+	tcpListeners = make(map[uint16]*TCPListener)
+	tcpConns = nil
+	nextTCPPort = udpEphemeralFirst
+	randUint32Fn = rand.Uint32
+	setLogSinkFn = kfmt.SetLogSink
+	console = nil
+}
+
+func mockInterrupts() {
+	interruptsEnabledFn = func() bool { return false }
+	enableInterruptsFn = func() {}
+	disableInterruptsFn = func() {}
+}
+
+// mockDevice records the frames transmitted by the stack.
+type mockDevice struct {
+	mac  netdev.HardwareAddr
+	sent []*netdev.Frame
+}
+
+func (d *mockDevice) Name() string                      { return "eth0" }
+func (d *mockDevice) HardwareAddr() netdev.HardwareAddr { return d.mac }
+func (d *mockDevice) MTU() uint16                       { return 1500 }
+
+func (d *mockDevice) Transmit(frame *netdev.Frame) *kernel.Error {
+	d.sent = append(d.sent, frame)
+	return nil
+}
+
+// mockInterface returns an interface backed by a mock device.
+func mockInterface(cfg Config) (*Interface, *mockDevice) {
+	dev := &mockDevice{mac: netdev.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56}}
+	return &Interface{dev: dev, config: cfg}, dev
+}
+
+// makeFrame builds an Ethernet frame with the specified header fields.
+func makeFrame(dst, src netdev.HardwareAddr, etherType uint16, payload []byte) *netdev.Frame {
+	frame := newFrame(len(payload))
+	copy(frame.Data[0:6], dst[:])
+	copy(frame.Data[6:12], src[:])
+	binary.BigEndian.PutUint16(frame.Data[12:14], etherType)
+	copy(framePayload(frame), payload)
+	return frame
+}
+
+func TestIPAddr(t *testing.T) {
+	specs := []struct {
+		in    string
+		exp   IPAddr
+		expOK bool
+	}{
+		{"10.0.2.15", IPAddr{10, 0, 2, 15}, true},
+		{"255.255.255.255", BroadcastIPAddr, true},
+		{"0.0.0.0", IPAddr{}, true},
+		{"192.168.100.1", IPAddr{192, 168, 100, 1}, true},
+		{"256.0.0.1", IPAddr{}, false},
+		{"10.0.2", IPAddr{}, false},
+		{"10.0.2.15.1", IPAddr{}, false},
+		{"10..2.15", IPAddr{}, false},
+		{"10.0.2.", IPAddr{}, false},
+		{"10.0.2.1234", IPAddr{}, false},
+		{"10.0.x.1", IPAddr{}, false},
+		{"", IPAddr{}, false},
+	}
+
+	for specIndex, spec := range specs {
+		got, ok := ParseIP(spec.in)
+		if got != spec.exp || ok != spec.expOK {
+			t.Errorf("[spec %d] expected ParseIP(%q) to return (%v, %t); got (%v, %t)", specIndex, spec.in, spec.exp, spec.expOK, got, ok)
+			continue
+		}
+
+		if ok && got.String() != spec.in {
+			t.Errorf("[spec %d] expected String() to return %q; got %q", specIndex, spec.in, got.String())
+		}
+	}
+
+	if exp, got := (IPAddr{10, 0, 2, 0}), (IPAddr{10, 0, 2, 15}).Mask(IPAddr{255, 255, 255, 0}); got != exp {
+		t.Fatalf("expected masked address %s; got %s", exp.String(), got.String())
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	specs := []struct {
+		in      string
+		expAddr IPAddr
+		expMask IPAddr
+		expOK   bool
+	}{
+		{"10.0.2.15/24", IPAddr{10, 0, 2, 15}, IPAddr{255, 255, 255, 0}, true},
+		{"172.16.1.1/12", IPAddr{172, 16, 1, 1}, IPAddr{255, 240, 0, 0}, true},
+		{"10.0.2.15/32", IPAddr{10, 0, 2, 15}, BroadcastIPAddr, true},
+		{"0.0.0.0/0", IPAddr{}, IPAddr{}, true},
+		{"10.0.2.15/33", IPAddr{}, IPAddr{}, false},
+		{"10.0.2.15/100", IPAddr{}, IPAddr{}, false},
+		{"10.0.2.15/2x", IPAddr{}, IPAddr{}, false},
+		{"10.0.2.15/", IPAddr{}, IPAddr{}, false},
+		{"10.0.2.15", IPAddr{}, IPAddr{}, false},
+		{"10.0.2/24", IPAddr{}, IPAddr{}, false},
+	}
+
+	for specIndex, spec := range specs {
+		addr, mask, ok := ParsePrefix(spec.in)
+		if addr != spec.expAddr || mask != spec.expMask || ok != spec.expOK {
+			t.Errorf("[spec %d] expected ParsePrefix(%q) to return (%v, %v, %t); got (%v, %v, %t)",
+				specIndex, spec.in, spec.expAddr, spec.expMask, spec.expOK, addr, mask, ok)
+		}
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	procErr := &kernel.Error{Module: "test", Message: "file exists"}
+
+	specs := []struct {
+		args       map[string]string
+		failPath   string
+		expErr     *kernel.Error
+		expConfig  Config
+		expARPSent bool
+	}{
+		{map[string]string{}, "", nil, Config{}, false},
+		{
+			map[string]string{"net.ip": "10.0.2.15/24", "net.gw": "10.0.2.2"},
+			"",
+			nil,
+			Config{Addr: IPAddr{10, 0, 2, 15}, Netmask: IPAddr{255, 255, 255, 0}, Gateway: IPAddr{10, 0, 2, 2}},
+			true,
+		},
+		{map[string]string{"net.ip": "10.0.2.15"}, "", errBadAddrArg, Config{}, false},
+		{map[string]string{"net.gw": "gateway"}, "", errBadGatewayArg, Config{}, false},
+		{map[string]string{"netconsole": "10.0.2.2"}, "", errBadNetconsoleArg, Config{}, false},
+		{map[string]string{}, "/net/arp", procErr, Config{}, false},
+		{map[string]string{}, "/net/udp", procErr, Config{}, false},
+		{map[string]string{}, "/net/tcp", procErr, Config{}, false},
+	}
+
+	nowFn = func() timer.Duration { return 0 }
+	timerEveryFn = func(_ timer.Duration, _ func()) *timer.Timer { return nil }
+
+	for specIndex, spec := range specs {
+		var (
+			dev        = &mockDevice{}
+			handlerSet bool
+			procPaths  []string
+		)
+
+		interfaces = nil
+		netdevInterfacesFn = func() []*netdev.Interface { return []*netdev.Interface{{}} }
+		cmdlineLookupFn = func(name string) (string, bool) {
+			arg, found := spec.args[name]
+			return arg, found
+		}
+		registerProcFileFn = func(path string, _ procfs.Generator) *kernel.Error {
+			procPaths = append(procPaths, path)
+			if path == spec.failPath {
+				return procErr
+			}
+			return nil
+		}
+
+		// Swap the attached netdev interface with a mock device so that
+		// the request for the gateway address can be captured.
+		setReceiveHandlerFn = func(handler netdev.ReceiveHandler) {
+			handlerSet = handler != nil
+			interfaces[0].dev = dev
+		}
+
+		if err := Init(); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if spec.expErr != nil {
+			if attached := len(Interfaces()) != 0; attached != (spec.expErr == procErr) {
+				t.Errorf("[spec %d] expected interfaces to be attached: %t", specIndex, !attached)
+			}
+			continue
+		}
+
+		if len(Interfaces()) != 1 || !handlerSet || strings.Join(procPaths, " ") != "/net/arp /net/udp /net/tcp" {
+			t.Errorf("[spec %d] expected the stack to attach to the device and register its handlers", specIndex)
+			continue
+		}
+
+		if got := interfaces[0].Config(); got != spec.expConfig {
+			t.Errorf("[spec %d] expected config %+v; got %+v", specIndex, spec.expConfig, got)
+		}
+
+		if got := len(dev.sent) == 1; got != spec.expARPSent {
+			t.Errorf("[spec %d] expected gateway resolution request to be sent: %t; sent %d frames", specIndex, spec.expARPSent, len(dev.sent))
+		}
+	}
+
+	t.Run("no devices", func(t *testing.T) {
+		interfaces = nil
+		netdevInterfacesFn = func() []*netdev.Interface { return nil }
+		if err := Init(); err != nil || len(Interfaces()) != 0 {
+			t.Fatalf("expected Init to be a no-op; got %v", err)
+		}
+	})
+}
+
+func TestReceive(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+
+	iface, dev := mockInterface(Config{Addr: IPAddr{10, 0, 2, 15}})
+
+	peerMAC := netdev.HardwareAddr{0x52, 0x55, 0x0a, 0, 2, 2}
+	request := arpPacket(arpOpRequest, peerMAC, IPAddr{10, 0, 2, 2}, netdev.HardwareAddr{}, IPAddr{10, 0, 2, 15})
+
+	specs := []struct {
+		frame    *netdev.Frame
+		expReply bool
+	}{
+		{makeFrame(BroadcastHardwareAddr, peerMAC, EtherTypeARP, request), true},
+		{makeFrame(dev.mac, peerMAC, EtherTypeARP, request), true},
+		// Frames for other hosts, unknown protocols and runt frames
+		{makeFrame(netdev.HardwareAddr{2}, peerMAC, EtherTypeARP, request), false},
+		{makeFrame(dev.mac, peerMAC, 0x86dd, request), false},
+		{&netdev.Frame{Data: make([]byte, netdev.EthernetHeaderLen-1)}, false},
+	}
+
+	for specIndex, spec := range specs {
+		dev.sent = nil
+		iface.receive(spec.frame)
+
+		if got := len(dev.sent) == 1; got != spec.expReply {
+			t.Errorf("[spec %d] expected reply to be sent: %t; sent %d frames", specIndex, spec.expReply, len(dev.sent))
+		}
+	}
+}
+
+func TestLookupInterface(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var (
+		attached = &netdev.Interface{}
+		iface    = &Interface{dev: attached}
+	)
+	interfaces = []*Interface{{dev: &mockDevice{}}, iface}
+
+	if got := lookupInterface(attached); got != iface {
+		t.Fatalf("expected lookupInterface to return the interface for the attached device")
+	}
+
+	if got := lookupInterface(&netdev.Interface{}); got != nil {
+		t.Fatalf("expected lookupInterface to return nil for a device that is not attached")
+	}
+
+	// Frames received by devices that are not attached are ignored
+	receive(&netdev.Interface{}, &netdev.Frame{})
+}
+
+func TestMaintain(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	now := timer.Duration(0)
+	nowFn = func() timer.Duration { return now }
+
+	iface, dev := mockInterface(Config{Addr: IPAddr{10, 0, 2, 15}})
+	interfaces = []*Interface{iface}
+
+	iface.Resolve(IPAddr{10, 0, 2, 2})
+	now += arpRetryInterval
+	maintain()
+
+	if exp := 2; len(dev.sent) != exp {
+		t.Fatalf("expected %d ARP requests to be sent; got %d", exp, len(dev.sent))
+	}
+}
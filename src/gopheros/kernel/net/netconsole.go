@@ -0,0 +1,110 @@
+package net
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+)
+
+const (
+	// netconsoleSrcPort is the local port used for sending log records.
+	netconsoleSrcPort = 6665
+
+	// netconsoleMaxLine is the largest payload of a log datagram. Longer
+	// lines are split into multiple datagrams.
+	netconsoleMaxLine = 512
+)
+
+var (
+	errBadNetconsoleArg = &kernel.Error{Module: "net", Message: "invalid netconsole boot argument; expected ADDR:PORT"}
+
+	// console is the active network console or nil if none was requested.
+	console *netconsole
+
+	setLogSinkFn = kfmt.SetLogSink
+)
+
+// netconsole is an io.Writer that ships the kernel log to a remote host as UDP
+// datagrams, one per line of output.
+type netconsole struct {
+	conn *UDPConn
+	dst  UDPAddr
+
+	buf [netconsoleMaxLine]byte
+	len int
+
+	// sending is set while a datagram is being transmitted so that any log
+	// output generated by the stack while doing so is not sent back to it.
+	sending bool
+}
+
+// Write implements io.Writer. Output is buffered until a complete line is
+// available.
+func (nc *netconsole) Write(p []byte) (int, error) {
+	intr := lock()
+	defer unlock(intr)
+
+	if nc.sending {
+		return len(p), nil
+	}
+
+	for _, b := range p {
+		nc.buf[nc.len] = b
+		if nc.len++; b == '\n' || nc.len == len(nc.buf) {
+			nc.flush()
+		}
+	}
+
+	return len(p), nil
+}
+
+// flush sends the buffered output. It must be invoked with interrupts disabled.
+func (nc *netconsole) flush() {
+	// Send errors are ignored as there is nowhere to report them to.
+	nc.sending = true
+	nc.conn.WriteTo(nc.buf[:nc.len], nc.dst)
+	nc.sending, nc.len = false, 0
+}
+
+// startNetconsole opens the socket of the network console and registers it as
+// a kernel log sink.
+func startNetconsole(dst UDPAddr) *kernel.Error {
+	conn, err := ListenUDP(netconsoleSrcPort)
+	if err != nil {
+		return err
+	}
+
+	console = &netconsole{conn: conn, dst: dst}
+	setLogSinkFn(console)
+	kfmt.Printf("[net] netconsole: logging to %s\n", dst.String())
+	return nil
+}
+
+// parseUDPAddr parses an address in ADDR:PORT form.
+func parseUDPAddr(s string) (UDPAddr, bool) {
+	sep := len(s) - 1
+	for ; sep >= 0 && s[sep] != ':'; sep-- {
+	}
+
+	if sep < 0 || sep == len(s)-1 || len(s)-sep > 6 {
+		return UDPAddr{}, false
+	}
+
+	ip, ok := ParseIP(s[:sep])
+	if !ok {
+		return UDPAddr{}, false
+	}
+
+	var port uint32
+	for _, c := range s[sep+1:] {
+		if c < '0' || c > '9' {
+			return UDPAddr{}, false
+		}
+		port = port*10 + uint32(c-'0')
+	}
+
+	if port == 0 || port > 0xffff {
+		return UDPAddr{}, false
+	}
+
+	return UDPAddr{IP: ip, Port: uint16(port)}, true
+}
@@ -0,0 +1,107 @@
+package net
+
+import (
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/timer"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseUDPAddr(t *testing.T) {
+	specs := []struct {
+		input   string
+		expAddr UDPAddr
+		expOK   bool
+	}{
+		{"10.0.2.2:6666", UDPAddr{IPAddr{10, 0, 2, 2}, 6666}, true},
+		{"255.255.255.255:65535", UDPAddr{BroadcastIPAddr, 65535}, true},
+		{"10.0.2.2", UDPAddr{}, false},
+		{"10.0.2.2:", UDPAddr{}, false},
+		{"10.0.2.2:0", UDPAddr{}, false},
+		{"10.0.2.2:65536", UDPAddr{}, false},
+		{"10.0.2.2:123456", UDPAddr{}, false},
+		{"10.0.2.2:6a", UDPAddr{}, false},
+		{"10.0.2:6666", UDPAddr{}, false},
+		{":6666", UDPAddr{}, false},
+	}
+
+	for specIndex, spec := range specs {
+		addr, ok := parseUDPAddr(spec.input)
+		if ok != spec.expOK || addr != spec.expAddr {
+			t.Errorf("[spec %d] expected parseUDPAddr(%q) to return (%s, %t); got (%s, %t)", specIndex, spec.input, spec.expAddr.String(), spec.expOK, addr.String(), ok)
+		}
+	}
+}
+
+func TestNetconsole(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+
+	var sink io.Writer
+	setLogSinkFn = func(w io.Writer) { sink = w }
+
+	_, dev := resolvedInterface()
+	dst := UDPAddr{testGatewayIP, 6666}
+	if err := startNetconsole(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if sink != console || console == nil {
+		t.Fatal("expected the network console to be registered as a log sink")
+	}
+
+	// sent returns the payloads of the datagrams sent since the last call
+	sent := func() []string {
+		var list []string
+		for _, frame := range dev.sent {
+			msg := ipv4Payload(frame)
+			if got := udpDatagram(UDPAddr{testLocalIP, netconsoleSrcPort}, dst, msg[udpHeaderLen:]); string(got) != string(msg) {
+				t.Fatalf("unexpected datagram:\n% x", msg)
+			}
+			list = append(list, string(msg[udpHeaderLen:]))
+		}
+		dev.sent = nil
+		return list
+	}
+
+	t.Run("lines", func(t *testing.T) {
+		kfmt.Fprintf(sink, "[net] %s: ", "eth0")
+		if got := sent(); len(got) != 0 {
+			t.Fatalf("expected partial lines to be buffered; got %q", got)
+		}
+
+		kfmt.Fprintf(sink, "link up\nsecond line\nthird")
+		exp := []string{"[net] eth0: link up\n", "second line\n"}
+		if got := sent(); strings.Join(got, "|") != strings.Join(exp, "|") {
+			t.Fatalf("expected datagrams %q; got %q", exp, got)
+		}
+		kfmt.Fprintf(sink, "\n")
+		sent()
+	})
+
+	t.Run("long lines", func(t *testing.T) {
+		line := strings.Repeat("x", netconsoleMaxLine+10) + "\n"
+		kfmt.Fprintf(sink, "%s", line)
+
+		got := sent()
+		if len(got) != 2 || len(got[0]) != netconsoleMaxLine || got[0]+got[1] != line {
+			t.Fatalf("expected line to be split into two datagrams; got %d", len(got))
+		}
+	})
+
+	t.Run("output while sending", func(t *testing.T) {
+		console.sending = true
+		kfmt.Fprintf(sink, "dropped\n")
+		console.sending = false
+
+		if got := sent(); len(got) != 0 || console.len != 0 {
+			t.Fatalf("expected output generated while sending to be dropped; got %q", got)
+		}
+	})
+
+	if err := startNetconsole(dst); err != ErrPortInUse {
+		t.Fatalf("expected error %v; got %v", ErrPortInUse, err)
+	}
+}
@@ -0,0 +1,1063 @@
+package net
+
+import (
+	"encoding/binary"
+	"gopheros/device/netdev"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/vfs"
+	"io"
+)
+
+const (
+	tcpHeaderLen = 20
+
+	tcpFlagFIN = uint8(1 << 0)
+	tcpFlagSYN = uint8(1 << 1)
+	tcpFlagRST = uint8(1 << 2)
+	tcpFlagPSH = uint8(1 << 3)
+	tcpFlagACK = uint8(1 << 4)
+
+	tcpOptionEnd = 0
+	tcpOptionNOP = 1
+	tcpOptionMSS = 2
+
+	// tcpDefaultMSS is the segment size assumed for peers that do not
+	// send the MSS option.
+	tcpDefaultMSS = 536
+
+	// tcpBufferSize is the size of the send and receive buffers of each
+	// connection. The receive window is never scaled so it cannot exceed
+	// 64K.
+	tcpBufferSize = 16384
+
+	// tcpBacklog is the number of connections that can be pending on a
+	// listener, including half-open connections.
+	tcpBacklog = 8
+
+	// Unacknowledged segments are retransmitted after the retransmission
+	// timeout which doubles on each attempt. The connection is aborted
+	// once tcpMaxRetries retransmissions (tcpMaxSynRetries for connection
+	// attempts) go unacknowledged. Round-trip times are not measured.
+	tcpInitialRTO    = timer.Second
+	tcpMaxRTO        = 60 * timer.Second
+	tcpMaxRetries    = 8
+	tcpMaxSynRetries = 5
+
+	// tcpTimeWaitDuration is the time that closed connections linger in
+	// the TIME-WAIT state; it is shorter than the 2*MSL suggested by
+	// RFC 793.
+	tcpTimeWaitDuration = 10 * timer.Second
+)
+
+// tcpState describes the state of a TCP connection as defined by RFC 793.
+type tcpState uint8
+
+const (
+	tcpClosed tcpState = iota
+	tcpSynSent
+	tcpSynReceived
+	tcpEstablished
+	tcpFinWait1
+	tcpFinWait2
+	tcpCloseWait
+	tcpClosing
+	tcpLastAck
+	tcpTimeWait
+)
+
+var tcpStateNames = [...]string{
+	tcpClosed:      "CLOSED",
+	tcpSynSent:     "SYN-SENT",
+	tcpSynReceived: "SYN-RECEIVED",
+	tcpEstablished: "ESTABLISHED",
+	tcpFinWait1:    "FIN-WAIT-1",
+	tcpFinWait2:    "FIN-WAIT-2",
+	tcpCloseWait:   "CLOSE-WAIT",
+	tcpClosing:     "CLOSING",
+	tcpLastAck:     "LAST-ACK",
+	tcpTimeWait:    "TIME-WAIT",
+}
+
+// String implements fmt.Stringer for tcpState.
+func (s tcpState) String() string {
+	return tcpStateNames[s]
+}
+
+var (
+	// ErrConnRefused is returned by DialTCP if the remote host rejects
+	// the connection.
+	ErrConnRefused = &kernel.Error{Module: "net", Message: "connection refused", Code: kernel.CodeConnRefused}
+
+	// ErrConnReset is returned by operations on a connection that was
+	// reset by the remote host.
+	ErrConnReset = &kernel.Error{Module: "net", Message: "connection reset by peer", Code: kernel.CodeConnReset}
+
+	// ErrEOF is returned by TCPConn.Read once the remote host has closed
+	// its side of the connection and all received data has been read.
+	ErrEOF = &kernel.Error{Module: "net", Message: "end of stream"}
+
+	// tcpListeners contains the listening sockets indexed by their port
+	// and tcpConns the connections in all states other than CLOSED.
+	tcpListeners = make(map[uint16]*TCPListener)
+	tcpConns     []*TCPConn
+
+	nextTCPPort uint16 = udpEphemeralFirst
+)
+
+// TCPAddr is the address of a TCP endpoint.
+type TCPAddr struct {
+	IP   IPAddr
+	Port uint16
+}
+
+// String returns the address in ADDR:PORT form.
+func (a TCPAddr) String() string {
+	return UDPAddr(a).String()
+}
+
+// TCPListener accepts incoming connections on a local port.
+type TCPListener struct {
+	port    uint16
+	pending int
+	queue   []*TCPConn
+	closed  bool
+}
+
+// TCPConn is a TCP connection.
+type TCPConn struct {
+	state         tcpState
+	local, remote TCPAddr
+	iface         *Interface
+	nextHop       IPAddr
+
+	// listener is the listener that accepts the connection while it is
+	// being established.
+	listener *TCPListener
+
+	// Send sequence variables. The send buffer contains the data from
+	// sndUna onwards which has either not been acknowledged or not been
+	// sent yet.
+	iss, sndUna, sndNxt uint32
+	sndWnd              uint16
+	mss                 uint16
+	sndBuf              []byte
+	finQueued, finSent  bool
+
+	// Receive sequence variables.
+	rcvNxt      uint32
+	rcvBuf      []byte
+	finReceived bool
+
+	// rtoDeadline is the time when unacknowledged segments are
+	// retransmitted or zero if nothing is outstanding.
+	rto         timer.Duration
+	rtoDeadline timer.Duration
+	retries     int
+
+	timeWaitDeadline timer.Duration
+
+	// err is set when the connection is aborted.
+	err         *kernel.Error
+	userClosed  bool
+	readTimeout timer.Duration
+}
+
+// ListenTCP returns a listener that accepts connections to the specified
+// local port on all interfaces.
+func ListenTCP(port uint16) (*TCPListener, *kernel.Error) {
+	intr := lock()
+	defer unlock(intr)
+
+	if tcpListeners[port] != nil {
+		return nil, ErrPortInUse
+	}
+
+	l := &TCPListener{port: port}
+	tcpListeners[port] = l
+	return l, nil
+}
+
+// Port returns the local port of the listener.
+func (l *TCPListener) Port() uint16 {
+	return l.port
+}
+
+// Accept blocks the calling kernel thread until a connection is established
+// and returns it.
+func (l *TCPListener) Accept() (*TCPConn, *kernel.Error) {
+	wait(func() bool { return len(l.queue) != 0 || l.closed }, 0)
+
+	intr := lock()
+	defer unlock(intr)
+
+	if l.closed {
+		return nil, ErrClosed
+	}
+
+	c := l.queue[0]
+	l.queue = l.queue[1:]
+	l.pending--
+	c.listener = nil
+	return c, nil
+}
+
+// Close stops accepting connections and resets the connections that have not
+// been accepted yet.
+func (l *TCPListener) Close() *kernel.Error {
+	intr := lock()
+	defer unlock(intr)
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	l.closed = true
+	delete(tcpListeners, l.port)
+	for _, c := range append([]*TCPConn{}, tcpConns...) {
+		if c.listener == l {
+			c.sendSegment(tcpFlagRST, c.sndNxt, nil)
+			c.abort(ErrConnReset)
+		}
+	}
+	l.queue = nil
+
+	wakeWaiters()
+	return nil
+}
+
+// Poll implements vfs.Pollable. The listener is readable while established
+// connections are waiting to be accepted.
+func (l *TCPListener) Poll() vfs.Events {
+	switch {
+	case l.closed:
+		return vfs.PollHup
+	case len(l.queue) != 0:
+		return vfs.PollIn
+	default:
+		return 0
+	}
+}
+
+// DialTCP connects to a remote host and blocks the calling kernel thread
+// until the connection is established or the connection attempt fails.
+func DialTCP(dst TCPAddr) (*TCPConn, *kernel.Error) {
+	iface, nextHop, err := route(dst.IP)
+	if err != nil {
+		return nil, err
+	}
+
+	intr := lock()
+	port, err := allocTCPPort()
+	if err != nil {
+		unlock(intr)
+		return nil, err
+	}
+
+	c := newTCPConn(iface, nextHop, TCPAddr{iface.Config().Addr, port}, dst)
+	c.state = tcpSynSent
+	c.sendSegment(tcpFlagSYN, c.iss, nil)
+	c.sndNxt = c.iss + 1
+	c.armRTO()
+	tcpConns = append(tcpConns, c)
+	unlock(intr)
+
+	wait(func() bool { return c.state != tcpSynSent }, 0)
+
+	intr = lock()
+	defer unlock(intr)
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return c, nil
+}
+
+// allocTCPPort returns a free port in the ephemeral range. It must be invoked
+// with interrupts disabled.
+func allocTCPPort() (uint16, *kernel.Error) {
+	for i := 0; i <= udpEphemeralLast-udpEphemeralFirst; i++ {
+		port := nextTCPPort
+		if nextTCPPort++; nextTCPPort == 0 {
+			nextTCPPort = udpEphemeralFirst
+		}
+
+		if tcpListeners[port] != nil {
+			continue
+		}
+
+		inUse := false
+		for _, c := range tcpConns {
+			if inUse = c.local.Port == port; inUse {
+				break
+			}
+		}
+
+		if !inUse {
+			return port, nil
+		}
+	}
+
+	return 0, errNoFreePorts
+}
+
+// newTCPConn returns a connection with a new initial sequence number.
+func newTCPConn(iface *Interface, nextHop IPAddr, local, remote TCPAddr) *TCPConn {
+	// Random initial sequence numbers prevent off-path attackers from
+	// guessing the sequence numbers of a connection.
+	iss := randUint32Fn()
+
+	return &TCPConn{
+		local:   local,
+		remote:  remote,
+		iface:   iface,
+		nextHop: nextHop,
+		iss:     iss,
+		sndUna:  iss,
+		sndNxt:  iss,
+		mss:     iface.tcpMSS(),
+		rto:     tcpInitialRTO,
+	}
+}
+
+// tcpMSS returns the largest segment that can be received by the interface
+// without fragmentation.
+func (iface *Interface) tcpMSS() uint16 {
+	if mtu := iface.dev.MTU(); mtu > ipv4HeaderLen+tcpHeaderLen {
+		return mtu - ipv4HeaderLen - tcpHeaderLen
+	}
+
+	return tcpDefaultMSS
+}
+
+// LocalAddr returns the local address of the connection.
+func (c *TCPConn) LocalAddr() TCPAddr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the remote host.
+func (c *TCPConn) RemoteAddr() TCPAddr {
+	return c.remote
+}
+
+// SetReadTimeout sets the time that Read waits for data before failing with
+// ErrTimeout. A zero timeout disables the timeout.
+func (c *TCPConn) SetReadTimeout(timeout timer.Duration) {
+	c.readTimeout = timeout
+}
+
+// Read blocks the calling kernel thread until data is received and copies it
+// to buf. It returns ErrEOF once the remote host has closed the connection and
+// all data has been read.
+func (c *TCPConn) Read(buf []byte) (int, *kernel.Error) {
+	ready := func() bool {
+		return len(c.rcvBuf) != 0 || c.finReceived || c.err != nil || c.userClosed
+	}
+	if !wait(ready, c.readTimeout) {
+		return 0, ErrTimeout
+	}
+
+	intr := lock()
+	defer unlock(intr)
+
+	switch {
+	case c.userClosed:
+		return 0, ErrClosed
+	case len(c.rcvBuf) != 0:
+	case c.err != nil:
+		return 0, c.err
+	default:
+		return 0, ErrEOF
+	}
+
+	// Let the remote host know that the window has opened if it was too
+	// small for a full segment.
+	oldWnd := c.rcvWnd()
+	n := copy(buf, c.rcvBuf)
+	c.rcvBuf = c.rcvBuf[n:]
+	if oldWnd < uint16(c.mss) && c.rcvWnd() >= uint16(c.mss) && c.state != tcpClosed {
+		c.sendSegment(tcpFlagACK, c.sndNxt, nil)
+	}
+
+	return n, nil
+}
+
+// Write queues data for transmission, blocking the calling kernel thread while
+// the send buffer is full. It returns the number of bytes queued.
+func (c *TCPConn) Write(data []byte) (int, *kernel.Error) {
+	var written int
+	for written < len(data) {
+		wait(func() bool { return len(c.sndBuf) < tcpBufferSize || !c.writable() }, 0)
+
+		intr := lock()
+		if !c.writable() {
+			err := c.err
+			if err == nil {
+				err = ErrClosed
+			}
+			unlock(intr)
+			return written, err
+		}
+
+		n := len(data) - written
+		if free := tcpBufferSize - len(c.sndBuf); n > free {
+			n = free
+		}
+		c.sndBuf = append(c.sndBuf, data[written:written+n]...)
+		written += n
+		c.output()
+		unlock(intr)
+	}
+
+	return written, nil
+}
+
+// Poll implements vfs.Pollable. The connection is readable while received
+// data is buffered or once the remote host has closed its end and writable
+// while the send buffer has free space. PollHup is reported once both ends
+// have been closed.
+func (c *TCPConn) Poll() vfs.Events {
+	var events vfs.Events
+	if len(c.rcvBuf) != 0 || c.finReceived || c.err != nil || c.userClosed {
+		events |= vfs.PollIn
+	}
+	if c.writable() && len(c.sndBuf) < tcpBufferSize {
+		events |= vfs.PollOut
+	}
+	if c.err != nil {
+		events |= vfs.PollErr
+	}
+	if c.err != nil || (c.finReceived && !c.writable()) {
+		events |= vfs.PollHup
+	}
+	return events
+}
+
+// writable returns true if data can be queued on the connection.
+func (c *TCPConn) writable() bool {
+	return !c.userClosed && c.err == nil && (c.state == tcpEstablished || c.state == tcpCloseWait)
+}
+
+// Close sends any queued data followed by a FIN. Close does not wait for the
+// remote host to acknowledge the FIN; the connection is released in the
+// background.
+func (c *TCPConn) Close() *kernel.Error {
+	intr := lock()
+	defer unlock(intr)
+
+	if c.userClosed {
+		return ErrClosed
+	}
+	c.userClosed = true
+
+	switch c.state {
+	case tcpSynSent:
+		c.release()
+	case tcpSynReceived, tcpEstablished, tcpCloseWait:
+		c.finQueued = true
+		c.output()
+	}
+
+	wakeWaiters()
+	return nil
+}
+
+// rcvWnd returns the free space in the receive buffer.
+func (c *TCPConn) rcvWnd() uint16 {
+	return uint16(tcpBufferSize - len(c.rcvBuf))
+}
+
+// sendSegment transmits a segment with the specified flags, sequence number
+// and payload. The ACK field is set to rcvNxt if the ACK flag is set. SYN
+// segments carry the MSS option.
+func (c *TCPConn) sendSegment(flags uint8, seq uint32, data []byte) {
+	hdrLen := tcpHeaderLen
+	if flags&tcpFlagSYN != 0 {
+		hdrLen += 4
+	}
+
+	var (
+		frame = newIPv4Frame(hdrLen + len(data))
+		seg   = ipv4Payload(frame)
+	)
+
+	binary.BigEndian.PutUint16(seg[0:2], c.local.Port)
+	binary.BigEndian.PutUint16(seg[2:4], c.remote.Port)
+	binary.BigEndian.PutUint32(seg[4:8], seq)
+	if flags&tcpFlagACK != 0 {
+		binary.BigEndian.PutUint32(seg[8:12], c.rcvNxt)
+	}
+	seg[12], seg[13] = byte(hdrLen/4)<<4, flags
+	binary.BigEndian.PutUint16(seg[14:16], c.rcvWnd())
+	if flags&tcpFlagSYN != 0 {
+		seg[20], seg[21] = tcpOptionMSS, 4
+		binary.BigEndian.PutUint16(seg[22:24], c.iface.tcpMSS())
+	}
+	copy(seg[hdrLen:], data)
+	binary.BigEndian.PutUint16(seg[16:18], netdev.Checksum(seg, pseudoHeaderSum(c.local.IP, c.remote.IP, ProtoTCP, len(seg))))
+
+	c.iface.sendIPv4(c.nextHop, c.remote.IP, ProtoTCP, frame)
+}
+
+// output transmits as much of the unsent data as the send window allows
+// followed by a FIN once all data has been sent and the connection has been
+// closed. It must be invoked with interrupts disabled.
+func (c *TCPConn) output() {
+	if c.state != tcpEstablished && c.state != tcpCloseWait {
+		return
+	}
+
+	for {
+		var (
+			inFlight = int(c.sndNxt - c.sndUna)
+			unsent   = len(c.sndBuf) - inFlight
+			n        = int(c.sndWnd) - inFlight
+		)
+
+		if n > unsent {
+			n = unsent
+		}
+		if n > int(c.mss) {
+			n = int(c.mss)
+		}
+		if n <= 0 {
+			break
+		}
+
+		c.sendSegment(tcpFlagACK|tcpFlagPSH, c.sndNxt, c.sndBuf[inFlight:inFlight+n])
+		c.sndNxt += uint32(n)
+		c.armRTO()
+	}
+
+	// Window probes are sent by the retransmission timer
+	if len(c.sndBuf) > int(c.sndNxt-c.sndUna) && c.sndWnd == 0 {
+		c.armRTO()
+	}
+
+	if c.finQueued && !c.finSent && int(c.sndNxt-c.sndUna) == len(c.sndBuf) {
+		c.sendSegment(tcpFlagFIN|tcpFlagACK, c.sndNxt, nil)
+		c.sndNxt++
+		c.finSent = true
+		c.armRTO()
+
+		if c.state == tcpEstablished {
+			c.state = tcpFinWait1
+		} else {
+			c.state = tcpLastAck
+		}
+	}
+}
+
+// armRTO starts the retransmission timer unless it is already running.
+func (c *TCPConn) armRTO() {
+	if c.rtoDeadline == 0 {
+		c.rtoDeadline = nowFn() + c.rto
+	}
+}
+
+// retransmit resends the oldest unacknowledged segment or, if the remote
+// window is closed, probes the window with a single byte.
+func (c *TCPConn) retransmit() {
+	switch c.state {
+	case tcpSynSent:
+		c.sendSegment(tcpFlagSYN, c.iss, nil)
+		return
+	case tcpSynReceived:
+		c.sendSegment(tcpFlagSYN|tcpFlagACK, c.iss, nil)
+		return
+	}
+
+	inFlight := int(c.sndNxt - c.sndUna)
+	dataInFlight := inFlight
+	if c.finSent {
+		dataInFlight--
+	}
+
+	switch {
+	case dataInFlight > 0:
+		n := dataInFlight
+		if n > int(c.mss) {
+			n = int(c.mss)
+		}
+		c.sendSegment(tcpFlagACK|tcpFlagPSH, c.sndUna, c.sndBuf[:n])
+	case inFlight > 0:
+		c.sendSegment(tcpFlagFIN|tcpFlagACK, c.sndNxt-1, nil)
+	case len(c.sndBuf) != 0:
+		c.sendSegment(tcpFlagACK, c.sndNxt, c.sndBuf[:1])
+		c.sndNxt++
+	}
+}
+
+// abort moves the connection to the CLOSED state and reports err to the
+// blocked threads. It must be invoked with interrupts disabled.
+func (c *TCPConn) abort(err *kernel.Error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.release()
+}
+
+// release moves the connection to the CLOSED state and removes it from the
+// connection list. It must be invoked with interrupts disabled.
+func (c *TCPConn) release() {
+	if c.listener != nil {
+		l := c.listener
+		l.pending--
+		for i, queued := range l.queue {
+			if queued == c {
+				l.queue = append(l.queue[:i], l.queue[i+1:]...)
+				break
+			}
+		}
+		c.listener = nil
+	}
+
+	c.state, c.rtoDeadline = tcpClosed, 0
+	for i, conn := range tcpConns {
+		if conn == c {
+			tcpConns = append(tcpConns[:i], tcpConns[i+1:]...)
+			break
+		}
+	}
+	wakeWaiters()
+}
+
+// tcpTick runs the retransmission and TIME-WAIT timers of all connections.
+func tcpTick() {
+	now := nowFn()
+
+	intr := lock()
+	defer unlock(intr)
+
+	for _, c := range append([]*TCPConn{}, tcpConns...) {
+		if c.state == tcpTimeWait {
+			if now >= c.timeWaitDeadline {
+				c.release()
+			}
+			continue
+		}
+
+		if c.rtoDeadline == 0 || now < c.rtoDeadline {
+			continue
+		}
+
+		maxRetries := tcpMaxRetries
+		if c.state == tcpSynSent || c.state == tcpSynReceived {
+			maxRetries = tcpMaxSynRetries
+		}
+
+		if c.retries++; c.retries > maxRetries {
+			c.abort(ErrTimeout)
+			continue
+		}
+
+		if c.rto *= 2; c.rto > tcpMaxRTO {
+			c.rto = tcpMaxRTO
+		}
+		c.rtoDeadline = now + c.rto
+		c.retransmit()
+	}
+}
+
+// tcpSegment contains the fields of a received TCP segment.
+type tcpSegment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            uint8
+	window           uint16
+	mss              uint16
+	data             []byte
+}
+
+// len returns the amount of sequence space occupied by the segment.
+func (seg *tcpSegment) len() uint32 {
+	n := uint32(len(seg.data))
+	if seg.flags&tcpFlagSYN != 0 {
+		n++
+	}
+	if seg.flags&tcpFlagFIN != 0 {
+		n++
+	}
+	return n
+}
+
+// parseTCPSegment validates the header and checksum of a received segment.
+func parseTCPSegment(src, dst IPAddr, msg []byte, checksumValid bool) (*tcpSegment, bool) {
+	if len(msg) < tcpHeaderLen {
+		return nil, false
+	}
+
+	hdrLen := int(msg[12]>>4) * 4
+	if hdrLen < tcpHeaderLen || hdrLen > len(msg) {
+		return nil, false
+	}
+
+	if !checksumValid && netdev.Checksum(msg, pseudoHeaderSum(src, dst, ProtoTCP, len(msg))) != 0 {
+		return nil, false
+	}
+
+	seg := &tcpSegment{
+		srcPort: binary.BigEndian.Uint16(msg[0:2]),
+		dstPort: binary.BigEndian.Uint16(msg[2:4]),
+		seq:     binary.BigEndian.Uint32(msg[4:8]),
+		ack:     binary.BigEndian.Uint32(msg[8:12]),
+		flags:   msg[13] & 0x3f,
+		window:  binary.BigEndian.Uint16(msg[14:16]),
+		data:    msg[hdrLen:],
+	}
+
+	for opts := msg[tcpHeaderLen:hdrLen]; len(opts) != 0 && opts[0] != tcpOptionEnd; {
+		if opts[0] == tcpOptionNOP {
+			opts = opts[1:]
+			continue
+		}
+
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+
+		if opts[0] == tcpOptionMSS && opts[1] == 4 {
+			seg.mss = binary.BigEndian.Uint16(opts[2:4])
+		}
+		opts = opts[opts[1]:]
+	}
+
+	return seg, true
+}
+
+// handleTCP processes a received TCP segment.
+func (iface *Interface) handleTCP(src, dst IPAddr, msg []byte, checksumValid bool) {
+	seg, ok := parseTCPSegment(src, dst, msg, checksumValid)
+	if !ok {
+		return
+	}
+
+	var (
+		local  = TCPAddr{dst, seg.dstPort}
+		remote = TCPAddr{src, seg.srcPort}
+	)
+
+	intr := lock()
+	defer unlock(intr)
+
+	for _, c := range tcpConns {
+		if c.local.Port == local.Port && c.remote == remote {
+			c.receive(seg)
+			return
+		}
+	}
+
+	if l := tcpListeners[local.Port]; l != nil && seg.flags&(tcpFlagSYN|tcpFlagACK|tcpFlagRST) == tcpFlagSYN {
+		iface.acceptSYN(l, local, remote, seg)
+		return
+	}
+
+	// Reset the remote end of connections that do not exist
+	if seg.flags&tcpFlagRST != 0 {
+		return
+	}
+
+	_, nextHop, err := route(src)
+	if err != nil {
+		return
+	}
+
+	c := &TCPConn{local: local, remote: remote, iface: iface, nextHop: nextHop}
+	if seg.flags&tcpFlagACK != 0 {
+		c.sendSegment(tcpFlagRST, seg.ack, nil)
+	} else {
+		c.rcvNxt = seg.seq + seg.len()
+		c.sendSegment(tcpFlagRST|tcpFlagACK, 0, nil)
+	}
+}
+
+// acceptSYN creates a connection in the SYN-RECEIVED state for a connection
+// request received by a listener. The request is ignored if the backlog of
+// the listener is full.
+func (iface *Interface) acceptSYN(l *TCPListener, local, remote TCPAddr, seg *tcpSegment) {
+	if l.pending == tcpBacklog {
+		return
+	}
+
+	_, nextHop, err := route(remote.IP)
+	if err != nil {
+		return
+	}
+
+	c := newTCPConn(iface, nextHop, local, remote)
+	c.state, c.listener = tcpSynReceived, l
+	c.rcvNxt = seg.seq + 1
+	c.sndWnd = seg.window
+	c.setPeerMSS(seg.mss)
+	c.sendSegment(tcpFlagSYN|tcpFlagACK, c.iss, nil)
+	c.sndNxt = c.iss + 1
+	c.armRTO()
+
+	l.pending++
+	tcpConns = append(tcpConns, c)
+}
+
+// setPeerMSS limits the segment size to the MSS advertised by the remote host.
+func (c *TCPConn) setPeerMSS(mss uint16) {
+	if mss == 0 {
+		mss = tcpDefaultMSS
+	}
+
+	if mss < c.mss {
+		c.mss = mss
+	}
+}
+
+// receive processes a segment for the connection as described in the
+// "SEGMENT ARRIVES" section of RFC 793. Out-of-order segments are dropped
+// and must be retransmitted by the remote host. It must be invoked with
+// interrupts disabled.
+func (c *TCPConn) receive(seg *tcpSegment) {
+	if c.state == tcpSynSent {
+		c.receiveSynSent(seg)
+		return
+	}
+
+	// Trim the part of the segment that has already been received and
+	// drop segments that do not start at the next expected sequence
+	// number.
+	if seqLT(seg.seq, c.rcvNxt) {
+		if seg.flags&tcpFlagRST != 0 {
+			return
+		}
+
+		if seqLEQ(seg.seq+seg.len(), c.rcvNxt) {
+			c.sendSegment(tcpFlagACK, c.sndNxt, nil)
+			return
+		}
+
+		dup := c.rcvNxt - seg.seq
+		if seg.flags&tcpFlagSYN != 0 {
+			seg.flags &^= tcpFlagSYN
+			dup--
+		}
+		seg.seq, seg.data = c.rcvNxt, seg.data[dup:]
+	}
+
+	if seg.seq != c.rcvNxt {
+		if seg.flags&tcpFlagRST == 0 {
+			c.sendSegment(tcpFlagACK, c.sndNxt, nil)
+		}
+		return
+	}
+
+	if seg.flags&tcpFlagRST != 0 {
+		if c.state == tcpSynReceived && c.listener != nil {
+			c.release()
+		} else {
+			c.abort(ErrConnReset)
+		}
+		return
+	}
+
+	if seg.flags&tcpFlagSYN != 0 {
+		c.sendSegment(tcpFlagRST, c.sndNxt, nil)
+		c.abort(ErrConnReset)
+		return
+	}
+
+	if seg.flags&tcpFlagACK == 0 {
+		return
+	}
+
+	if !c.receiveACK(seg) {
+		return
+	}
+
+	needACK := false
+	switch c.state {
+	case tcpEstablished, tcpFinWait1, tcpFinWait2:
+		if len(seg.data) == 0 {
+			break
+		}
+
+		n := len(seg.data)
+		if wnd := int(c.rcvWnd()); n > wnd {
+			// The FIN cannot be processed as it follows the data
+			// that does not fit in the window.
+			n = wnd
+			seg.flags &^= tcpFlagFIN
+		}
+		c.rcvBuf = append(c.rcvBuf, seg.data[:n]...)
+		c.rcvNxt += uint32(n)
+		needACK = true
+		wakeWaiters()
+	}
+
+	if seg.flags&tcpFlagFIN != 0 && c.state != tcpClosed {
+		c.receiveFIN()
+		needACK = true
+	}
+
+	if needACK && c.state != tcpClosed {
+		c.sendSegment(tcpFlagACK, c.sndNxt, nil)
+	}
+
+	c.output()
+}
+
+// receiveSynSent processes a segment for a connection in the SYN-SENT state.
+func (c *TCPConn) receiveSynSent(seg *tcpSegment) {
+	ackOK := seg.flags&tcpFlagACK != 0 && seg.ack == c.iss+1
+	if seg.flags&tcpFlagACK != 0 && !ackOK {
+		if seg.flags&tcpFlagRST == 0 {
+			c.sendSegment(tcpFlagRST, seg.ack, nil)
+		}
+		return
+	}
+
+	if seg.flags&tcpFlagRST != 0 {
+		if ackOK {
+			c.abort(ErrConnRefused)
+		}
+		return
+	}
+
+	if seg.flags&tcpFlagSYN == 0 {
+		return
+	}
+
+	c.rcvNxt = seg.seq + 1
+	c.sndWnd = seg.window
+	c.setPeerMSS(seg.mss)
+
+	if !ackOK {
+		// Simultaneous open
+		c.state = tcpSynReceived
+		c.sendSegment(tcpFlagSYN|tcpFlagACK, c.iss, nil)
+		return
+	}
+
+	c.sndUna = seg.ack
+	c.state, c.rtoDeadline, c.retries, c.rto = tcpEstablished, 0, 0, tcpInitialRTO
+	c.sendSegment(tcpFlagACK, c.sndNxt, nil)
+	wakeWaiters()
+}
+
+// receiveACK processes the acknowledgment of a segment. It returns false if
+// the rest of the segment must be ignored.
+func (c *TCPConn) receiveACK(seg *tcpSegment) bool {
+	if c.state == tcpSynReceived {
+		if !seqLT(c.sndUna, seg.ack) || seqLT(c.sndNxt, seg.ack) {
+			c.sendSegment(tcpFlagRST, seg.ack, nil)
+			return false
+		}
+
+		c.state = tcpEstablished
+		if l := c.listener; l != nil {
+			l.queue = append(l.queue, c)
+		}
+		wakeWaiters()
+	}
+
+	if seqLT(c.sndNxt, seg.ack) {
+		c.sendSegment(tcpFlagACK, c.sndNxt, nil)
+		return false
+	}
+
+	if seqLEQ(c.sndUna, seg.ack) {
+		c.sndWnd = seg.window
+	}
+
+	if seqLT(c.sndUna, seg.ack) {
+		acked := int(seg.ack - c.sndUna)
+		if c.sndUna == c.iss {
+			// The SYN occupies the first sequence number
+			acked--
+		}
+		if acked > len(c.sndBuf) {
+			acked = len(c.sndBuf)
+		}
+
+		c.sndBuf = c.sndBuf[acked:]
+		c.sndUna = seg.ack
+		c.rto, c.retries, c.rtoDeadline = tcpInitialRTO, 0, 0
+		if c.sndNxt != c.sndUna {
+			c.armRTO()
+		}
+		wakeWaiters()
+	}
+
+	finACKed := c.finSent && c.sndUna == c.sndNxt
+	switch {
+	case c.state == tcpFinWait1 && finACKed:
+		c.state = tcpFinWait2
+	case c.state == tcpClosing && finACKed:
+		c.enterTimeWait()
+	case c.state == tcpLastAck && finACKed:
+		c.release()
+		return false
+	}
+
+	return true
+}
+
+// receiveFIN processes the FIN flag of a segment.
+func (c *TCPConn) receiveFIN() {
+	c.rcvNxt++
+	c.finReceived = true
+	wakeWaiters()
+
+	switch c.state {
+	case tcpSynReceived, tcpEstablished:
+		c.state = tcpCloseWait
+	case tcpFinWait1:
+		c.state = tcpClosing
+	case tcpFinWait2, tcpTimeWait:
+		c.enterTimeWait()
+	}
+}
+
+// enterTimeWait moves the connection to the TIME-WAIT state.
+func (c *TCPConn) enterTimeWait() {
+	c.state, c.rtoDeadline = tcpTimeWait, 0
+	c.timeWaitDeadline = nowFn() + tcpTimeWaitDuration
+}
+
+// seqLT returns true if sequence number a precedes b.
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// seqLEQ returns true if sequence number a precedes or equals b.
+func seqLEQ(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+// genTCPTable reports the listening sockets and the open connections.
+func genTCPTable(w io.Writer) {
+	type connInfo struct {
+		local, remote TCPAddr
+		state         string
+		sendQ, recvQ  int
+	}
+
+	intr := lock()
+	list := make([]connInfo, 0, len(tcpListeners)+len(tcpConns))
+	for port := range tcpListeners {
+		info := connInfo{local: TCPAddr{Port: port}, state: "LISTEN"}
+
+		// Listeners are ordered by port
+		i := len(list)
+		list = append(list, info)
+		for ; i > 0 && list[i-1].local.Port > port; i-- {
+			list[i] = list[i-1]
+		}
+		list[i] = info
+	}
+	for _, c := range tcpConns {
+		list = append(list, connInfo{c.local, c.remote, c.state.String(), len(c.sndBuf), len(c.rcvBuf)})
+	}
+	unlock(intr)
+
+	kfmt.Fprintf(w, "%-21s %-21s %-12s %-6s %s\n", "LOCAL", "REMOTE", "STATE", "SENDQ", "RECVQ")
+	for _, info := range list {
+		kfmt.Fprintf(w, "%-21s %-21s %-12s %-6d %d\n", info.local.String(), info.remote.String(), info.state, info.sendQ, info.recvQ)
+	}
+}
@@ -0,0 +1,957 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopheros/device/netdev"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/vfs"
+	"testing"
+)
+
+const (
+	testPeerISN  = uint32(0xfffffff0)
+	testLocalISN = uint32(0xffffff00)
+)
+
+var (
+	testTCPLocal  = TCPAddr{testLocalIP, 80}
+	testTCPRemote = TCPAddr{testGatewayIP, 40000}
+)
+
+// tcpSegmentBytes builds a TCP segment with a valid checksum. A non-zero mss
+// is sent as an MSS option.
+func tcpSegmentBytes(src, dst TCPAddr, seq, ack uint32, flags uint8, window, mss uint16, data []byte) []byte {
+	hdrLen := tcpHeaderLen
+	if mss != 0 {
+		hdrLen += 4
+	}
+
+	msg := make([]byte, hdrLen+len(data))
+	binary.BigEndian.PutUint16(msg[0:2], src.Port)
+	binary.BigEndian.PutUint16(msg[2:4], dst.Port)
+	binary.BigEndian.PutUint32(msg[4:8], seq)
+	binary.BigEndian.PutUint32(msg[8:12], ack)
+	msg[12], msg[13] = byte(hdrLen/4)<<4, flags
+	binary.BigEndian.PutUint16(msg[14:16], window)
+	if mss != 0 {
+		msg[20], msg[21] = tcpOptionMSS, 4
+		binary.BigEndian.PutUint16(msg[22:24], mss)
+	}
+	copy(msg[hdrLen:], data)
+	binary.BigEndian.PutUint16(msg[16:18], netdev.Checksum(msg, pseudoHeaderSum(src.IP, dst.IP, ProtoTCP, len(msg))))
+	return msg
+}
+
+// tcpPeer injects segments from the remote end of a connection and inspects
+// the segments sent by the stack.
+type tcpPeer struct {
+	t     *testing.T
+	iface *Interface
+	dev   *mockDevice
+	local TCPAddr
+	seq   uint32
+}
+
+func newTCPPeer(t *testing.T, local TCPAddr) *tcpPeer {
+	randUint32Fn = func() uint32 { return testLocalISN }
+	iface, dev := resolvedInterface()
+	return &tcpPeer{t: t, iface: iface, dev: dev, local: local, seq: testPeerISN}
+}
+
+// send delivers a segment to the stack and advances the peer sequence number.
+func (p *tcpPeer) send(ack uint32, flags uint8, window uint16, data []byte) {
+	p.sendAt(p.seq, ack, flags, window, data)
+	p.seq += (&tcpSegment{flags: flags, data: data}).len()
+}
+
+// sendAt delivers a segment with the specified sequence number.
+func (p *tcpPeer) sendAt(seq, ack uint32, flags uint8, window uint16, data []byte) {
+	msg := tcpSegmentBytes(testTCPRemote, p.local, seq, ack, flags, window, 0, data)
+	p.iface.handleIPv4(ipv4Packet(testTCPRemote.IP, p.local.IP, ProtoTCP, msg), false)
+}
+
+// refreshARP answers the pending ARP request for the peer so that segments
+// are not queued when the cached address expires.
+func (p *tcpPeer) refreshARP() {
+	p.iface.handleARP(arpPacket(arpOpReply, testGatewayHW, testGatewayIP, p.dev.mac, testLocalIP))
+}
+
+// received returns the segments sent by the stack since the last call. ARP
+// requests are ignored.
+func (p *tcpPeer) received() []*tcpSegment {
+	var list []*tcpSegment
+	for _, frame := range p.dev.sent {
+		if binary.BigEndian.Uint16(frame.Data[12:14]) != EtherTypeIPv4 {
+			continue
+		}
+
+		pkt := framePayload(frame)
+		seg, ok := parseTCPSegment(p.local.IP, testTCPRemote.IP, pkt[ipv4HeaderLen:], false)
+		if !ok {
+			p.t.Fatal("expected the stack to send a TCP segment with a valid checksum")
+		}
+		list = append(list, seg)
+	}
+	p.dev.sent = nil
+	return list
+}
+
+// expect checks that the stack sent a single segment with the specified flags
+// and returns it.
+func (p *tcpPeer) expect(flags uint8) *tcpSegment {
+	p.t.Helper()
+
+	list := p.received()
+	if len(list) != 1 {
+		p.t.Fatalf("expected a segment to be sent; got %d", len(list))
+	}
+
+	if list[0].flags != flags {
+		p.t.Fatalf("expected segment flags 0x%x; got 0x%x", flags, list[0].flags)
+	}
+
+	return list[0]
+}
+
+// mockTCPWaits mocks the wait queue so that blocking calls invoke action if
+// their condition is not satisfied.
+func mockTCPWaits(t *testing.T, action *func()) {
+	wakeAllFn = func(_ *sync.WaitQueue) int { return 0 }
+	waitFn = func(_ *sync.WaitQueue, cond func() bool) {
+		if !cond() && *action != nil {
+			(*action)()
+		}
+		if !cond() {
+			t.Fatal("expected the wait condition to be satisfied")
+		}
+	}
+}
+
+// acceptConn completes a passive open and returns the accepted connection.
+func acceptConn(t *testing.T, p *tcpPeer) *TCPConn {
+	t.Helper()
+
+	l, err := ListenTCP(p.local.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.send(0, tcpFlagSYN, 8192, nil)
+	synAck := p.expect(tcpFlagSYN | tcpFlagACK)
+	p.send(synAck.seq+1, tcpFlagACK, 8192, nil)
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return conn
+}
+
+func TestTCPStateString(t *testing.T) {
+	specs := []struct {
+		state tcpState
+		exp   string
+	}{
+		{tcpClosed, "CLOSED"},
+		{tcpSynReceived, "SYN-RECEIVED"},
+		{tcpFinWait2, "FIN-WAIT-2"},
+		{tcpTimeWait, "TIME-WAIT"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.state.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+
+	if exp, got := "10.0.2.2:40000", testTCPRemote.String(); got != exp {
+		t.Errorf("expected address %q; got %q", exp, got)
+	}
+}
+
+func TestTCPPassiveOpen(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+
+	var waitAction func()
+	mockTCPWaits(t, &waitAction)
+
+	p := newTCPPeer(t, testTCPLocal)
+	l, err := ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ListenTCP(80); err != ErrPortInUse {
+		t.Fatalf("expected error %v; got %v", ErrPortInUse, err)
+	}
+
+	msg := tcpSegmentBytes(testTCPRemote, testTCPLocal, p.seq, 0, tcpFlagSYN, 8192, 1000, nil)
+	p.iface.handleIPv4(ipv4Packet(testTCPRemote.IP, testLocalIP, ProtoTCP, msg), false)
+	p.seq++
+
+	synAck := p.expect(tcpFlagSYN | tcpFlagACK)
+	if synAck.ack != p.seq || synAck.mss != 1460 || synAck.window != tcpBufferSize {
+		t.Fatalf("unexpected SYN-ACK: ack %d mss %d window %d", synAck.ack, synAck.mss, synAck.window)
+	}
+
+	if len(tcpConns) != 1 || tcpConns[0].state != tcpSynReceived || tcpConns[0].mss != 1000 {
+		t.Fatal("expected a connection in the SYN-RECEIVED state with the MSS of the peer")
+	}
+
+	waitAction = func() { p.send(synAck.seq+1, tcpFlagACK, 8192, nil) }
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conn.state != tcpEstablished || conn.LocalAddr() != testTCPLocal || conn.RemoteAddr() != testTCPRemote {
+		t.Fatalf("expected an established connection from %s; got %s from %s", testTCPRemote.String(), conn.state.String(), conn.RemoteAddr().String())
+	}
+
+	if len(p.received()) != 0 {
+		t.Fatal("expected no segments to be sent when the handshake completes")
+	}
+
+	t.Run("retransmitted SYN", func(t *testing.T) {
+		p.sendAt(testPeerISN, 0, tcpFlagSYN, 8192, nil)
+		if ack := p.expect(tcpFlagACK); ack.ack != p.seq {
+			t.Fatalf("expected duplicate SYN to be acknowledged with %d; got %d", p.seq, ack.ack)
+		}
+	})
+
+	t.Run("listener close", func(t *testing.T) {
+		// Half-open connections are reset when the listener is closed
+		remote := TCPAddr{testGatewayIP, 40001}
+		msg := tcpSegmentBytes(remote, testTCPLocal, 1000, 0, tcpFlagSYN, 8192, 0, nil)
+		p.iface.handleIPv4(ipv4Packet(remote.IP, testLocalIP, ProtoTCP, msg), false)
+		p.received()
+
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(p.dev.sent) != 1 || len(tcpConns) != 1 {
+			t.Fatal("expected the half-open connection to be reset")
+		}
+
+		if err := l.Close(); err != ErrClosed {
+			t.Fatalf("expected error %v; got %v", ErrClosed, err)
+		}
+
+		if _, err := l.Accept(); err != ErrClosed {
+			t.Fatalf("expected error %v; got %v", ErrClosed, err)
+		}
+	})
+}
+
+func TestTCPListenerBacklog(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+	wakeAllFn = func(_ *sync.WaitQueue) int { return 0 }
+
+	p := newTCPPeer(t, testTCPLocal)
+	ListenTCP(80)
+
+	for port := uint16(0); port <= tcpBacklog; port++ {
+		remote := TCPAddr{testGatewayIP, 40000 + port}
+		msg := tcpSegmentBytes(remote, testTCPLocal, 1, 0, tcpFlagSYN, 8192, 0, nil)
+		p.iface.handleIPv4(ipv4Packet(remote.IP, testLocalIP, ProtoTCP, msg), false)
+	}
+
+	if len(tcpConns) != tcpBacklog || len(p.received()) != tcpBacklog {
+		t.Fatalf("expected %d connections to be pending; got %d", tcpBacklog, len(tcpConns))
+	}
+
+	// A reset from the remote host releases the half-open connection
+	p.sendAt(2, 0, tcpFlagRST, 0, nil)
+	if len(tcpConns) != tcpBacklog-1 || tcpListeners[80].pending != tcpBacklog-1 {
+		t.Fatalf("expected the reset connection to be released; got %d connections", len(tcpConns))
+	}
+}
+
+func TestTCPActiveOpen(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var (
+		now        timer.Duration
+		waitAction func()
+	)
+	nowFn = func() timer.Duration { return now }
+	mockTCPWaits(t, &waitAction)
+
+	dst := testTCPRemote
+	local := TCPAddr{testLocalIP, udpEphemeralFirst}
+
+	t.Run("established", func(t *testing.T) {
+		p := newTCPPeer(t, local)
+		waitAction = func() {
+			syn := p.expect(tcpFlagSYN)
+			if syn.mss != 1460 {
+				t.Fatalf("expected MSS option 1460; got %d", syn.mss)
+			}
+
+			// Segments with unacceptable ACKs are reset
+			p.sendAt(p.seq, syn.seq+2, tcpFlagSYN|tcpFlagACK, 8192, nil)
+			if rst := p.expect(tcpFlagRST); rst.seq != syn.seq+2 {
+				t.Fatalf("expected reset with seq %d; got %d", syn.seq+2, rst.seq)
+			}
+
+			p.send(syn.seq+1, tcpFlagSYN|tcpFlagACK, 8192, nil)
+		}
+
+		conn, err := DialTCP(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if conn.state != tcpEstablished || conn.LocalAddr() != local || conn.mss != tcpDefaultMSS {
+			t.Fatalf("expected established connection from %s; got %s from %s", local.String(), conn.state.String(), conn.LocalAddr().String())
+		}
+
+		if ack := p.expect(tcpFlagACK); ack.ack != p.seq || ack.seq != conn.iss+1 {
+			t.Fatal("expected the SYN-ACK to be acknowledged")
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		p := newTCPPeer(t, TCPAddr{testLocalIP, udpEphemeralFirst + 1})
+		waitAction = func() {
+			syn := p.expect(tcpFlagSYN)
+
+			// Resets that do not acknowledge the SYN are ignored
+			p.sendAt(p.seq, 0, tcpFlagRST, 0, nil)
+			p.sendAt(p.seq, syn.seq+1, tcpFlagRST|tcpFlagACK, 0, nil)
+		}
+
+		if _, err := DialTCP(dst); err != ErrConnRefused {
+			t.Fatalf("expected error %v; got %v", ErrConnRefused, err)
+		}
+
+		if len(p.received()) != 0 || len(tcpConns) != 1 {
+			t.Fatal("expected the refused connection to be released")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		p := newTCPPeer(t, TCPAddr{testLocalIP, udpEphemeralFirst + 2})
+		waitAction = func() {
+			for i := 0; i < 10; i++ {
+				now += tcpMaxRTO
+				p.refreshARP()
+				tcpTick()
+			}
+		}
+
+		if _, err := DialTCP(dst); err != ErrTimeout {
+			t.Fatalf("expected error %v; got %v", ErrTimeout, err)
+		}
+
+		if exp, got := tcpMaxSynRetries+1, len(p.received()); got != exp {
+			t.Fatalf("expected %d SYN segments to be sent; got %d", exp, got)
+		}
+	})
+
+	t.Run("simultaneous open", func(t *testing.T) {
+		p := newTCPPeer(t, TCPAddr{testLocalIP, udpEphemeralFirst + 3})
+		waitAction = func() {
+			syn := p.expect(tcpFlagSYN)
+			p.send(0, tcpFlagSYN, 8192, nil)
+			p.expect(tcpFlagSYN | tcpFlagACK)
+			p.send(syn.seq+1, tcpFlagACK, 8192, nil)
+		}
+
+		if _, err := DialTCP(dst); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		interfaces = nil
+		if _, err := DialTCP(dst); err != errNoRoute {
+			t.Fatalf("expected error %v; got %v", errNoRoute, err)
+		}
+
+		resolvedInterface()
+		tcpListeners[udpEphemeralLast] = &TCPListener{}
+		nextTCPPort = udpEphemeralLast
+		for port := udpEphemeralFirst; port < udpEphemeralLast; port++ {
+			tcpConns = append(tcpConns, &TCPConn{local: TCPAddr{Port: uint16(port)}})
+		}
+
+		if _, err := DialTCP(dst); err != errNoFreePorts {
+			t.Fatalf("expected error %v; got %v", errNoFreePorts, err)
+		}
+	})
+}
+
+func TestTCPDataTransfer(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+
+	var waitAction func()
+	mockTCPWaits(t, &waitAction)
+
+	p := newTCPPeer(t, testTCPLocal)
+	conn := acceptConn(t, p)
+	iss := conn.iss
+
+	t.Run("receive", func(t *testing.T) {
+		p.send(iss+1, tcpFlagACK|tcpFlagPSH, 8192, []byte("hello "))
+		if ack := p.expect(tcpFlagACK); ack.ack != p.seq || ack.window != tcpBufferSize-6 {
+			t.Fatalf("expected data to be acknowledged; got ack %d window %d", ack.ack, ack.window)
+		}
+
+		// Out-of-order segments are dropped and the expected sequence
+		// number is acknowledged again
+		p.sendAt(p.seq+6, iss+1, tcpFlagACK, 8192, []byte("gopher"))
+		if ack := p.expect(tcpFlagACK); ack.ack != p.seq {
+			t.Fatalf("expected duplicate ack %d; got %d", p.seq, ack.ack)
+		}
+
+		// Retransmitted data that has already been received is trimmed
+		p.sendAt(p.seq-3, iss+1, tcpFlagACK, 8192, []byte("lo world"))
+		p.seq += 5
+		p.expect(tcpFlagACK)
+
+		waitAction = nil
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := "hello world"; string(buf[:n]) != exp {
+			t.Fatalf("expected to read %q; got %q", exp, buf[:n])
+		}
+	})
+
+	t.Run("read timeout", func(t *testing.T) {
+		var timerFn func()
+		timerAfterFn = func(_ timer.Duration, fn func()) *timer.Timer {
+			timerFn = fn
+			return nil
+		}
+		stopTimerFn = func(_ *timer.Timer) bool { return true }
+		waitFn = func(_ *sync.WaitQueue, cond func() bool) {
+			timerFn()
+			cond()
+		}
+		defer mockTCPWaits(t, &waitAction)
+
+		conn.SetReadTimeout(timer.Second)
+		if _, err := conn.Read(nil); err != ErrTimeout {
+			t.Fatalf("expected error %v; got %v", ErrTimeout, err)
+		}
+		conn.SetReadTimeout(0)
+	})
+
+	t.Run("send", func(t *testing.T) {
+		data := bytes.Repeat([]byte{'x'}, 10000)
+		if n, err := conn.Write(data); err != nil || n != len(data) {
+			t.Fatalf("expected Write to return (%d, nil); got (%d, %v)", len(data), n, err)
+		}
+
+		// Data is split into MSS-sized segments and the peer window
+		// limits the amount of data in flight
+		var sent int
+		for i, seg := range p.received() {
+			if seg.seq != iss+1+uint32(sent) || len(seg.data) > tcpDefaultMSS || seg.ack != p.seq {
+				t.Fatalf("unexpected segment %d: seq %d len %d", i, seg.seq, len(seg.data))
+			}
+			sent += len(seg.data)
+		}
+		if sent != 8192 {
+			t.Fatalf("expected 8192 bytes to be sent; got %d", sent)
+		}
+
+		// Acknowledgments open the window and release buffered data
+		p.send(iss+1+8192, tcpFlagACK, 8192, nil)
+		if exp := 10000 - 8192; len(conn.sndBuf) != exp {
+			t.Fatalf("expected %d bytes to remain buffered; got %d", exp, len(conn.sndBuf))
+		}
+
+		sent = 0
+		for _, seg := range p.received() {
+			sent += len(seg.data)
+		}
+		if exp := 10000 - 8192; sent != exp {
+			t.Fatalf("expected %d bytes to be sent; got %d", exp, sent)
+		}
+
+		p.send(conn.sndNxt, tcpFlagACK, 8192, nil)
+		if len(conn.sndBuf) != 0 || conn.rtoDeadline != 0 {
+			t.Fatal("expected the send buffer to be empty and the retransmission timer to be stopped")
+		}
+
+		// Acknowledgments for data that has not been sent are answered
+		// with an ACK and ignored
+		p.send(conn.sndNxt+100, tcpFlagACK, 8192, nil)
+		p.expect(tcpFlagACK)
+	})
+
+	t.Run("window update", func(t *testing.T) {
+		conn.rcvBuf = make([]byte, tcpBufferSize-100)
+		p.received()
+
+		waitAction = nil
+		conn.Read(make([]byte, tcpBufferSize))
+		if ack := p.expect(tcpFlagACK); ack.window != tcpBufferSize {
+			t.Fatalf("expected the window to be reopened; got %d", ack.window)
+		}
+
+		// Data that does not fit in the receive window is truncated
+		conn.rcvBuf = make([]byte, tcpBufferSize-2)
+		p.sendAt(p.seq, conn.sndNxt, tcpFlagACK|tcpFlagFIN, 8192, []byte("abcd"))
+		if ack := p.expect(tcpFlagACK); ack.ack != p.seq+2 || conn.finReceived {
+			t.Fatalf("expected 2 bytes to be acknowledged; got %d", ack.ack-p.seq)
+		}
+		p.seq += 2
+		conn.rcvBuf = nil
+	})
+}
+
+func TestTCPRetransmit(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var (
+		now        timer.Duration
+		waitAction func()
+	)
+	nowFn = func() timer.Duration { return now }
+	mockTCPWaits(t, &waitAction)
+
+	p := newTCPPeer(t, testTCPLocal)
+	conn := acceptConn(t, p)
+
+	conn.Write([]byte("data"))
+	seg := p.expect(tcpFlagACK | tcpFlagPSH)
+
+	// Nothing is retransmitted before the timeout expires
+	now += tcpInitialRTO - 1
+	tcpTick()
+	if len(p.received()) != 0 {
+		t.Fatal("expected no retransmission before the timeout")
+	}
+
+	now++
+	tcpTick()
+	if rtx := p.expect(tcpFlagACK | tcpFlagPSH); rtx.seq != seg.seq || string(rtx.data) != "data" {
+		t.Fatalf("expected segment %d to be retransmitted; got %d", seg.seq, rtx.seq)
+	}
+
+	if conn.rto != 2*tcpInitialRTO {
+		t.Fatalf("expected the timeout to double; got %d", conn.rto)
+	}
+
+	t.Run("zero window probe", func(t *testing.T) {
+		p.send(seg.seq+4, tcpFlagACK, 0, nil)
+		conn.Write([]byte("more"))
+		if len(p.received()) != 0 {
+			t.Fatal("expected no data to be sent while the window is closed")
+		}
+
+		now += tcpInitialRTO
+		tcpTick()
+		if probe := p.expect(tcpFlagACK); string(probe.data) != "m" {
+			t.Fatalf("expected a single byte window probe; got %q", probe.data)
+		}
+
+		p.send(conn.sndNxt, tcpFlagACK, 8192, nil)
+		if rest := p.expect(tcpFlagACK | tcpFlagPSH); string(rest.data) != "ore" {
+			t.Fatalf("expected the rest of the data to be sent; got %q", rest.data)
+		}
+		p.send(conn.sndNxt, tcpFlagACK, 8192, nil)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		conn.Write([]byte("lost"))
+		for i := 0; i <= tcpMaxRetries; i++ {
+			now += tcpMaxRTO
+			p.refreshARP()
+			tcpTick()
+		}
+
+		if exp, got := tcpMaxRetries+1, len(p.received()); got != exp {
+			t.Fatalf("expected %d transmissions; got %d", exp, got)
+		}
+
+		if conn.state != tcpClosed || len(tcpConns) != 0 {
+			t.Fatal("expected the connection to be aborted")
+		}
+
+		if _, err := conn.Write([]byte("x")); err != ErrTimeout {
+			t.Fatalf("expected error %v; got %v", ErrTimeout, err)
+		}
+
+		waitAction = nil
+		if _, err := conn.Read(nil); err != ErrTimeout {
+			t.Fatalf("expected error %v; got %v", ErrTimeout, err)
+		}
+	})
+}
+
+func TestTCPClose(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var (
+		now        timer.Duration
+		waitAction func()
+	)
+	nowFn = func() timer.Duration { return now }
+	mockTCPWaits(t, &waitAction)
+
+	t.Run("passive close", func(t *testing.T) {
+		p := newTCPPeer(t, testTCPLocal)
+		conn := acceptConn(t, p)
+
+		p.send(conn.sndNxt, tcpFlagACK|tcpFlagPSH|tcpFlagFIN, 8192, []byte("bye"))
+		if ack := p.expect(tcpFlagACK); ack.ack != p.seq || conn.state != tcpCloseWait {
+			t.Fatalf("expected the FIN to be acknowledged; got state %s", conn.state.String())
+		}
+
+		buf := make([]byte, 8)
+		if n, _ := conn.Read(buf); string(buf[:n]) != "bye" {
+			t.Fatalf("expected to read %q; got %q", "bye", buf[:n])
+		}
+
+		if _, err := conn.Read(buf); err != ErrEOF {
+			t.Fatalf("expected error %v; got %v", ErrEOF, err)
+		}
+
+		// Data can still be sent after the remote host has closed its side
+		conn.Write([]byte("ok"))
+		p.expect(tcpFlagACK | tcpFlagPSH)
+		p.send(conn.sndNxt, tcpFlagACK, 8192, nil)
+
+		if err := conn.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		fin := p.expect(tcpFlagACK | tcpFlagFIN)
+		if fin.seq != conn.iss+3 || conn.state != tcpLastAck {
+			t.Fatalf("expected FIN with seq %d; got %d", conn.iss+3, fin.seq)
+		}
+
+		// The FIN is retransmitted until it is acknowledged
+		now += tcpMaxRTO
+		tcpTick()
+		if rtx := p.expect(tcpFlagACK | tcpFlagFIN); rtx.seq != fin.seq || len(rtx.data) != 0 {
+			t.Fatal("expected the FIN to be retransmitted without data")
+		}
+
+		p.send(fin.seq+1, tcpFlagACK, 8192, nil)
+		if conn.state != tcpClosed || len(tcpConns) != 0 {
+			t.Fatalf("expected connection to be closed; got state %s", conn.state.String())
+		}
+
+		if err := conn.Close(); err != ErrClosed {
+			t.Fatalf("expected error %v; got %v", ErrClosed, err)
+		}
+
+		if _, err := conn.Read(buf); err != ErrClosed {
+			t.Fatalf("expected error %v; got %v", ErrClosed, err)
+		}
+
+		if _, err := conn.Write(buf); err != ErrClosed {
+			t.Fatalf("expected error %v; got %v", ErrClosed, err)
+		}
+	})
+
+	t.Run("active close", func(t *testing.T) {
+		p := newTCPPeer(t, testTCPLocal)
+		conn := acceptConn(t, p)
+
+		conn.Write([]byte("request"))
+		conn.Close()
+		if len(p.received()) != 2 || conn.state != tcpFinWait1 {
+			t.Fatalf("expected data and FIN to be sent; got state %s", conn.state.String())
+		}
+
+		p.send(conn.sndNxt, tcpFlagACK, 8192, nil)
+		if conn.state != tcpFinWait2 {
+			t.Fatalf("expected state %s; got %s", tcpFinWait2.String(), conn.state.String())
+		}
+
+		// Data can still be received after the local side is closed
+		p.send(conn.sndNxt, tcpFlagACK|tcpFlagFIN, 8192, []byte("response"))
+		if ack := p.expect(tcpFlagACK); ack.ack != p.seq || conn.state != tcpTimeWait {
+			t.Fatalf("expected the FIN to be acknowledged; got state %s", conn.state.String())
+		}
+
+		// Retransmitted FINs are acknowledged again
+		p.sendAt(p.seq-1, conn.sndNxt, tcpFlagACK|tcpFlagFIN, 8192, nil)
+		p.expect(tcpFlagACK)
+
+		now += tcpTimeWaitDuration - 1
+		tcpTick()
+		if len(tcpConns) != 1 {
+			t.Fatal("expected the connection to linger in TIME-WAIT")
+		}
+
+		now++
+		tcpTick()
+		if conn.state != tcpClosed || len(tcpConns) != 0 {
+			t.Fatal("expected the connection to be released")
+		}
+	})
+
+	t.Run("simultaneous close", func(t *testing.T) {
+		p := newTCPPeer(t, testTCPLocal)
+		conn := acceptConn(t, p)
+
+		conn.Close()
+		fin := p.expect(tcpFlagACK | tcpFlagFIN)
+
+		p.send(fin.seq, tcpFlagACK|tcpFlagFIN, 8192, nil)
+		if p.expect(tcpFlagACK); conn.state != tcpClosing {
+			t.Fatalf("expected state %s; got %s", tcpClosing.String(), conn.state.String())
+		}
+
+		p.send(fin.seq+1, tcpFlagACK, 8192, nil)
+		if conn.state != tcpTimeWait {
+			t.Fatalf("expected state %s; got %s", tcpTimeWait.String(), conn.state.String())
+		}
+	})
+
+	t.Run("close before connecting", func(t *testing.T) {
+		resolvedInterface()
+		conn := newTCPConn(interfaces[0], testGatewayIP, testTCPLocal, testTCPRemote)
+		conn.state = tcpSynSent
+		tcpConns = append(tcpConns, conn)
+
+		conn.Close()
+		if conn.state != tcpClosed || len(tcpConns) != 1 {
+			t.Fatal("expected the connection attempt to be abandoned")
+		}
+	})
+}
+
+func TestTCPReset(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+
+	var waitAction func()
+	mockTCPWaits(t, &waitAction)
+
+	t.Run("no connection", func(t *testing.T) {
+		p := newTCPPeer(t, testTCPLocal)
+
+		p.sendAt(100, 0, tcpFlagSYN, 8192, nil)
+		if rst := p.expect(tcpFlagRST | tcpFlagACK); rst.seq != 0 || rst.ack != 101 {
+			t.Fatalf("expected reset acknowledging seq 101; got %d", rst.ack)
+		}
+
+		p.sendAt(100, 500, tcpFlagACK, 8192, []byte("data"))
+		if rst := p.expect(tcpFlagRST); rst.seq != 500 {
+			t.Fatalf("expected reset with seq 500; got %d", rst.seq)
+		}
+
+		// Resets are never answered
+		p.sendAt(100, 500, tcpFlagRST, 0, nil)
+		if len(p.received()) != 0 {
+			t.Fatal("expected reset to be ignored")
+		}
+
+		// Segments from hosts without a route are dropped
+		interfaces[0].config.Gateway = IPAddr{}
+		msg := tcpSegmentBytes(TCPAddr{IPAddr{8, 8, 8, 8}, 1}, testTCPLocal, 100, 0, tcpFlagSYN, 8192, 0, nil)
+		p.iface.handleIPv4(ipv4Packet(IPAddr{8, 8, 8, 8}, testLocalIP, ProtoTCP, msg), false)
+		ListenTCP(80)
+		p.iface.handleIPv4(ipv4Packet(IPAddr{8, 8, 8, 8}, testLocalIP, ProtoTCP, msg), false)
+		if len(p.received()) != 0 || len(tcpConns) != 0 {
+			t.Fatal("expected segment to be dropped")
+		}
+	})
+
+	t.Run("reset by peer", func(t *testing.T) {
+		restoreMocks()
+		mockInterrupts()
+		nowFn = func() timer.Duration { return 0 }
+		mockTCPWaits(t, &waitAction)
+
+		p := newTCPPeer(t, testTCPLocal)
+		conn := acceptConn(t, p)
+
+		// Resets outside the window are ignored
+		p.sendAt(p.seq+10, 0, tcpFlagRST, 0, nil)
+		p.sendAt(p.seq-10, 0, tcpFlagRST, 0, nil)
+		if conn.state != tcpEstablished {
+			t.Fatalf("expected out of window reset to be ignored; got state %s", conn.state.String())
+		}
+
+		p.sendAt(p.seq, 0, tcpFlagRST, 0, nil)
+		if _, err := conn.Read(nil); err != ErrConnReset {
+			t.Fatalf("expected error %v; got %v", ErrConnReset, err)
+		}
+	})
+
+	t.Run("SYN in window", func(t *testing.T) {
+		p := newTCPPeer(t, testTCPLocal)
+		conn := acceptConn(t, p)
+
+		p.send(0, tcpFlagSYN, 8192, nil)
+		p.expect(tcpFlagRST)
+		if conn.err != ErrConnReset {
+			t.Fatalf("expected error %v; got %v", ErrConnReset, conn.err)
+		}
+	})
+
+	t.Run("bad ACK during handshake", func(t *testing.T) {
+		p := newTCPPeer(t, testTCPLocal)
+		ListenTCP(80)
+		p.send(0, tcpFlagSYN, 8192, nil)
+		p.received()
+
+		p.send(12345, tcpFlagACK, 8192, nil)
+		if rst := p.expect(tcpFlagRST); rst.seq != 12345 {
+			t.Fatalf("expected reset with seq 12345; got %d", rst.seq)
+		}
+
+		// Segments without the ACK flag are ignored
+		p.send(0, tcpFlagPSH, 8192, []byte("x"))
+		if len(p.received()) != 0 {
+			t.Fatal("expected segment without ACK to be ignored")
+		}
+	})
+}
+
+func TestParseTCPSegment(t *testing.T) {
+	valid := tcpSegmentBytes(testTCPRemote, testTCPLocal, 1, 2, tcpFlagSYN, 8192, 1200, nil)
+	withOptions := func(opts ...byte) []byte {
+		msg := make([]byte, tcpHeaderLen+len(opts))
+		copy(msg, valid[:tcpHeaderLen])
+		copy(msg[tcpHeaderLen:], opts)
+		msg[12] = byte(len(msg)/4) << 4
+		return msg
+	}
+
+	badChecksum := append([]byte{}, valid...)
+	badChecksum[16]++
+	badOffset := append([]byte{}, valid...)
+	badOffset[12] = 0x40
+
+	specs := []struct {
+		msg           []byte
+		checksumValid bool
+		expOK         bool
+		expMSS        uint16
+	}{
+		{valid, false, true, 1200},
+		{badChecksum, true, true, 1200},
+		{badChecksum, false, false, 0},
+		{badOffset, true, false, 0},
+		{valid[:tcpHeaderLen-1], true, false, 0},
+		{withOptions(tcpOptionNOP, tcpOptionNOP, tcpOptionMSS, 4, 0x02, 0x00, tcpOptionEnd, 0), true, true, 512},
+		{withOptions(8, 10, 0, 0, 0, 0, 0, 0, 0, 0, tcpOptionMSS, 4, 0x02, 0x00, 0, 0), true, true, 512},
+		{withOptions(tcpOptionEnd, 0, tcpOptionMSS, 4, 0x02, 0x00, 0, 0), true, true, 0},
+		{withOptions(tcpOptionMSS, 0, 0, 0), true, true, 0},
+		{withOptions(tcpOptionMSS, 8, 0, 0), true, true, 0},
+	}
+
+	for specIndex, spec := range specs {
+		seg, ok := parseTCPSegment(testTCPRemote.IP, testTCPLocal.IP, spec.msg, spec.checksumValid)
+		if ok != spec.expOK {
+			t.Errorf("[spec %d] expected segment to be valid: %t", specIndex, spec.expOK)
+			continue
+		}
+
+		if ok && seg.mss != spec.expMSS {
+			t.Errorf("[spec %d] expected MSS %d; got %d", specIndex, spec.expMSS, seg.mss)
+		}
+	}
+}
+
+func TestSeqCompare(t *testing.T) {
+	specs := []struct {
+		a, b         uint32
+		expLT, expLE bool
+	}{
+		{1, 2, true, true},
+		{2, 2, false, true},
+		{3, 2, false, false},
+		{0xfffffff0, 0x10, true, true},
+		{0x10, 0xfffffff0, false, false},
+	}
+
+	for specIndex, spec := range specs {
+		if got := seqLT(spec.a, spec.b); got != spec.expLT {
+			t.Errorf("[spec %d] expected seqLT(%d, %d) to return %t", specIndex, spec.a, spec.b, spec.expLT)
+		}
+
+		if got := seqLEQ(spec.a, spec.b); got != spec.expLE {
+			t.Errorf("[spec %d] expected seqLEQ(%d, %d) to return %t", specIndex, spec.a, spec.b, spec.expLE)
+		}
+	}
+}
+
+func TestGenTCPTable(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	for _, port := range []uint16{8080, 22} {
+		ListenTCP(port)
+	}
+	tcpConns = []*TCPConn{{
+		state:  tcpEstablished,
+		local:  testTCPLocal,
+		remote: testTCPRemote,
+		sndBuf: make([]byte, 3),
+		rcvBuf: make([]byte, 10),
+	}}
+
+	var buf bytes.Buffer
+	genTCPTable(&buf)
+
+	exp := "LOCAL                 REMOTE                STATE        SENDQ  RECVQ\n" +
+		"0.0.0.0:22            0.0.0.0:0             LISTEN       0      0\n" +
+		"0.0.0.0:8080          0.0.0.0:0             LISTEN       0      0\n" +
+		"10.0.2.15:80          10.0.2.2:40000        ESTABLISHED  3      10\n"
+
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output:\n%s\ngot:\n%s", exp, got)
+	}
+}
+
+func TestTCPPoll(t *testing.T) {
+	listenerSpecs := []struct {
+		l   TCPListener
+		exp vfs.Events
+	}{
+		{TCPListener{}, 0},
+		{TCPListener{queue: []*TCPConn{{}}}, vfs.PollIn},
+		{TCPListener{closed: true}, vfs.PollHup},
+	}
+	for specIndex, spec := range listenerSpecs {
+		if got := spec.l.Poll(); got != spec.exp {
+			t.Errorf("[listener spec %d] expected events 0x%x; got 0x%x", specIndex, spec.exp, got)
+		}
+	}
+
+	connSpecs := []struct {
+		c   TCPConn
+		exp vfs.Events
+	}{
+		{TCPConn{state: tcpSynSent}, 0},
+		{TCPConn{state: tcpEstablished}, vfs.PollOut},
+		{TCPConn{state: tcpEstablished, rcvBuf: []byte{1}, sndBuf: make([]byte, tcpBufferSize)}, vfs.PollIn},
+		{TCPConn{state: tcpCloseWait, finReceived: true}, vfs.PollIn | vfs.PollOut},
+		{TCPConn{state: tcpLastAck, finReceived: true, userClosed: true}, vfs.PollIn | vfs.PollHup},
+		{TCPConn{state: tcpClosed, err: ErrConnReset}, vfs.PollIn | vfs.PollErr | vfs.PollHup},
+	}
+	for specIndex, spec := range connSpecs {
+		if got := spec.c.Poll(); got != spec.exp {
+			t.Errorf("[conn spec %d] expected events 0x%x; got 0x%x", specIndex, spec.exp, got)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package net
+
+import (
+	"encoding/binary"
+	"gopheros/device/netdev"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/vfs"
+	"io"
+)
+
+const (
+	udpHeaderLen = 8
+
+	// udpMaxQueued is the number of received datagrams that can be queued
+	// on a socket. Datagrams received while the queue is full are dropped.
+	udpMaxQueued = 32
+
+	// Ports in the ephemeral range are assigned to sockets that are not
+	// bound to a specific port.
+	udpEphemeralFirst = 49152
+	udpEphemeralLast  = 65535
+)
+
+var (
+	// ErrPortInUse is returned by ListenUDP if the requested port is
+	// already bound to another socket.
+	ErrPortInUse = &kernel.Error{Module: "net", Message: "address already in use", Code: kernel.CodeAddrInUse}
+
+	// ErrClosed is returned by operations on a closed socket.
+	ErrClosed = &kernel.Error{Module: "net", Message: "use of closed socket", Code: kernel.CodeBadDescriptor}
+
+	errNoFreePorts = &kernel.Error{Module: "net", Message: "no free ephemeral ports", Code: kernel.CodeAddrInUse}
+
+	// udpConns contains the open UDP sockets indexed by their local port.
+	udpConns = make(map[uint16]*UDPConn)
+
+	nextEphemeralPort uint16 = udpEphemeralFirst
+)
+
+// UDPAddr is the address of a UDP endpoint.
+type UDPAddr struct {
+	IP   IPAddr
+	Port uint16
+}
+
+// String returns the address in ADDR:PORT form.
+func (a UDPAddr) String() string {
+	var (
+		buf [5]byte
+		pos = len(buf)
+	)
+
+	for port := a.Port; ; {
+		pos--
+		buf[pos] = byte('0' + port%10)
+		if port /= 10; port == 0 {
+			break
+		}
+	}
+
+	return a.IP.String() + ":" + string(buf[pos:])
+}
+
+// datagram is a UDP payload received by a socket.
+type datagram struct {
+	from UDPAddr
+	data []byte
+}
+
+// UDPConn is a UDP socket bound to a local port on all interfaces.
+type UDPConn struct {
+	port        uint16
+	queue       []datagram
+	dropped     uint64
+	closed      bool
+	readTimeout timer.Duration
+}
+
+// ListenUDP opens a UDP socket bound to the specified local port. If port is
+// zero, the socket is bound to a free port in the ephemeral range.
+func ListenUDP(port uint16) (*UDPConn, *kernel.Error) {
+	intr := lock()
+	defer unlock(intr)
+
+	if port == 0 {
+		for i := 0; i <= udpEphemeralLast-udpEphemeralFirst; i++ {
+			candidate := nextEphemeralPort
+			if nextEphemeralPort++; nextEphemeralPort == 0 {
+				nextEphemeralPort = udpEphemeralFirst
+			}
+
+			if udpConns[candidate] == nil {
+				port = candidate
+				break
+			}
+		}
+
+		if port == 0 {
+			return nil, errNoFreePorts
+		}
+	} else if udpConns[port] != nil {
+		return nil, ErrPortInUse
+	}
+
+	conn := &UDPConn{port: port}
+	udpConns[port] = conn
+	return conn, nil
+}
+
+// LocalPort returns the local port of the socket.
+func (c *UDPConn) LocalPort() uint16 {
+	return c.port
+}
+
+// SetReadTimeout sets the time that ReadFrom waits for a datagram before
+// failing with ErrTimeout. A zero timeout disables the timeout.
+func (c *UDPConn) SetReadTimeout(timeout timer.Duration) {
+	c.readTimeout = timeout
+}
+
+// Close unbinds the socket from its port and discards any queued datagrams.
+// Threads blocked in ReadFrom return ErrClosed.
+func (c *UDPConn) Close() *kernel.Error {
+	intr := lock()
+	defer unlock(intr)
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	c.closed, c.queue = true, nil
+	delete(udpConns, c.port)
+	wakeWaiters()
+	return nil
+}
+
+// ReadFrom blocks the calling kernel thread until a datagram is received and
+// copies its payload to buf. Payloads that do not fit in buf are truncated.
+// ReadFrom returns the number of bytes copied and the address of the sender.
+func (c *UDPConn) ReadFrom(buf []byte) (int, UDPAddr, *kernel.Error) {
+	if !wait(func() bool { return len(c.queue) != 0 || c.closed }, c.readTimeout) {
+		return 0, UDPAddr{}, ErrTimeout
+	}
+
+	intr := lock()
+	if c.closed {
+		unlock(intr)
+		return 0, UDPAddr{}, ErrClosed
+	}
+
+	dgram := c.queue[0]
+	c.queue = c.queue[1:]
+	unlock(intr)
+
+	return copy(buf, dgram.data), dgram.from, nil
+}
+
+// Poll implements vfs.Pollable. The socket is readable while datagrams are
+// queued and always writable until it is closed.
+func (c *UDPConn) Poll() vfs.Events {
+	switch {
+	case c.closed:
+		return vfs.PollHup
+	case len(c.queue) != 0:
+		return vfs.PollIn | vfs.PollOut
+	default:
+		return vfs.PollOut
+	}
+}
+
+// WriteTo sends a datagram with the specified payload to dst.
+func (c *UDPConn) WriteTo(data []byte, dst UDPAddr) (int, *kernel.Error) {
+	intr := lock()
+	closed := c.closed
+	unlock(intr)
+
+	if closed {
+		return 0, ErrClosed
+	}
+
+	iface, nextHop, err := route(dst.IP)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		src    = iface.Config().Addr
+		length = udpHeaderLen + len(data)
+		frame  = newIPv4Frame(length)
+		msg    = ipv4Payload(frame)
+	)
+
+	binary.BigEndian.PutUint16(msg[0:2], c.port)
+	binary.BigEndian.PutUint16(msg[2:4], dst.Port)
+	binary.BigEndian.PutUint16(msg[4:6], uint16(length))
+	copy(msg[udpHeaderLen:], data)
+
+	// A computed checksum of zero is transmitted as all ones as zero
+	// indicates that the sender did not compute a checksum.
+	csum := netdev.Checksum(msg, pseudoHeaderSum(src, dst.IP, ProtoUDP, length))
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(msg[6:8], csum)
+
+	// Datagrams that do not fit in a single frame are rejected by sendIPv4
+	if err = iface.sendIPv4(nextHop, dst.IP, ProtoUDP, frame); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// pseudoHeaderSum returns the sum of the IPv4 pseudo-header fields that are
+// covered by the UDP and TCP checksums.
+func pseudoHeaderSum(src, dst IPAddr, proto uint8, length int) uint32 {
+	return uint32(binary.BigEndian.Uint16(src[0:2])) + uint32(binary.BigEndian.Uint16(src[2:4])) +
+		uint32(binary.BigEndian.Uint16(dst[0:2])) + uint32(binary.BigEndian.Uint16(dst[2:4])) +
+		uint32(proto) + uint32(length)
+}
+
+// handleUDP validates a received UDP datagram and queues its payload on the
+// socket bound to its destination port.
+func handleUDP(src, dst IPAddr, msg []byte, checksumValid bool) {
+	if len(msg) < udpHeaderLen {
+		return
+	}
+
+	length := int(binary.BigEndian.Uint16(msg[4:6]))
+	if length < udpHeaderLen || length > len(msg) {
+		return
+	}
+	msg = msg[:length]
+
+	if !checksumValid && binary.BigEndian.Uint16(msg[6:8]) != 0 &&
+		netdev.Checksum(msg, pseudoHeaderSum(src, dst, ProtoUDP, length)) != 0 {
+		return
+	}
+
+	from := UDPAddr{IP: src, Port: binary.BigEndian.Uint16(msg[0:2])}
+
+	intr := lock()
+	defer unlock(intr)
+
+	conn := udpConns[binary.BigEndian.Uint16(msg[2:4])]
+	if conn == nil {
+		return
+	}
+
+	if len(conn.queue) == udpMaxQueued {
+		conn.dropped++
+		return
+	}
+
+	// The stack owns received frames so the payload does not need to be
+	// copied.
+	conn.queue = append(conn.queue, datagram{from: from, data: msg[udpHeaderLen:]})
+	wakeWaiters()
+}
+
+// genUDPTable reports the open UDP sockets ordered by their local port.
+func genUDPTable(w io.Writer) {
+	type socketInfo struct {
+		port    uint16
+		queued  int
+		dropped uint64
+	}
+
+	intr := lock()
+	list := make([]socketInfo, 0, len(udpConns))
+	for _, conn := range udpConns {
+		info := socketInfo{port: conn.port, queued: len(conn.queue), dropped: conn.dropped}
+
+		i := len(list)
+		list = append(list, info)
+		for ; i > 0 && list[i-1].port > info.port; i-- {
+			list[i] = list[i-1]
+		}
+		list[i] = info
+	}
+	unlock(intr)
+
+	kfmt.Fprintf(w, "%-6s %-6s %s\n", "PORT", "QUEUED", "DROPPED")
+	for _, info := range list {
+		kfmt.Fprintf(w, "%-6d %-6d %d\n", info.port, info.queued, info.dropped)
+	}
+}
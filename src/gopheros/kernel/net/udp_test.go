@@ -0,0 +1,357 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopheros/device/netdev"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/vfs"
+	"testing"
+)
+
+// udpDatagram builds a UDP datagram with a valid checksum.
+func udpDatagram(src, dst UDPAddr, payload []byte) []byte {
+	msg := make([]byte, udpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(msg[0:2], src.Port)
+	binary.BigEndian.PutUint16(msg[2:4], dst.Port)
+	binary.BigEndian.PutUint16(msg[4:6], uint16(len(msg)))
+	copy(msg[udpHeaderLen:], payload)
+	binary.BigEndian.PutUint16(msg[6:8], netdev.Checksum(msg, pseudoHeaderSum(src.IP, dst.IP, ProtoUDP, len(msg))))
+	return msg
+}
+
+func TestUDPAddr(t *testing.T) {
+	specs := []struct {
+		addr UDPAddr
+		exp  string
+	}{
+		{UDPAddr{IPAddr{10, 0, 2, 2}, 0}, "10.0.2.2:0"},
+		{UDPAddr{IPAddr{10, 0, 2, 2}, 514}, "10.0.2.2:514"},
+		{UDPAddr{BroadcastIPAddr, 65535}, "255.255.255.255:65535"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.addr.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestListenUDP(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	wakeAllFn = func(_ *sync.WaitQueue) int { return 0 }
+
+	conn, err := ListenUDP(68)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := conn.LocalPort(); got != 68 {
+		t.Fatalf("expected socket to be bound to port 68; got %d", got)
+	}
+
+	if _, err = ListenUDP(68); err != ErrPortInUse {
+		t.Fatalf("expected error %v; got %v", ErrPortInUse, err)
+	}
+
+	t.Run("ephemeral ports", func(t *testing.T) {
+		nextEphemeralPort = udpEphemeralLast
+		udpConns[udpEphemeralFirst] = &UDPConn{port: udpEphemeralFirst}
+
+		for _, exp := range []uint16{udpEphemeralLast, udpEphemeralFirst + 1} {
+			conn, err := ListenUDP(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := conn.LocalPort(); got != exp {
+				t.Fatalf("expected socket to be bound to port %d; got %d", exp, got)
+			}
+		}
+
+		for port := udpEphemeralFirst; port <= udpEphemeralLast; port++ {
+			udpConns[uint16(port)] = &UDPConn{port: uint16(port)}
+		}
+
+		if _, err := ListenUDP(0); err != errNoFreePorts {
+			t.Fatalf("expected error %v; got %v", errNoFreePorts, err)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		if err := conn.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := conn.Close(); err != ErrClosed {
+			t.Fatalf("expected error %v; got %v", ErrClosed, err)
+		}
+
+		// The port can be reused once the socket is closed
+		if _, err := ListenUDP(68); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestUDPWriteTo(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	wakeAllFn = func(_ *sync.WaitQueue) int { return 0 }
+	nowFn = func() timer.Duration { return 0 }
+
+	_, dev := resolvedInterface()
+	conn, _ := ListenUDP(1234)
+
+	dst := UDPAddr{IPAddr{10, 0, 2, 2}, 514}
+	if n, err := conn.WriteTo([]byte("hello"), dst); err != nil || n != 5 {
+		t.Fatalf("expected WriteTo to return (5, nil); got (%d, %v)", n, err)
+	}
+
+	if len(dev.sent) != 1 {
+		t.Fatalf("expected a frame to be sent; got %d", len(dev.sent))
+	}
+
+	pkt := framePayload(dev.sent[0])
+	if pkt[9] != ProtoUDP {
+		t.Errorf("expected IP protocol %d; got %d", ProtoUDP, pkt[9])
+	}
+
+	exp := udpDatagram(UDPAddr{testLocalIP, 1234}, dst, []byte("hello"))
+	if got := pkt[ipv4HeaderLen:]; !bytes.Equal(got, exp) {
+		t.Errorf("expected datagram:\n% x\ngot:\n% x", exp, got)
+	}
+
+	t.Run("zero checksum", func(t *testing.T) {
+		// Find a payload for which the computed checksum is zero
+		payload := make([]byte, 2)
+		for val := 0; val <= 0xffff; val++ {
+			binary.BigEndian.PutUint16(payload, uint16(val))
+			if msg := udpDatagram(UDPAddr{testLocalIP, 1234}, dst, payload); msg[6] == 0 && msg[7] == 0 {
+				break
+			}
+		}
+
+		dev.sent = nil
+		conn.WriteTo(payload, dst)
+		if got := binary.BigEndian.Uint16(ipv4Payload(dev.sent[0])[6:8]); got != 0xffff {
+			t.Errorf("expected zero checksum to be sent as 0xffff; got 0x%x", got)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := conn.WriteTo(make([]byte, 1500), dst); err != errPacketTooLarge {
+			t.Errorf("expected error %v; got %v", errPacketTooLarge, err)
+		}
+
+		if _, err := conn.WriteTo(nil, UDPAddr{IPAddr{10, 1, 0, 1}, 53}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		interfaces = nil
+		if _, err := conn.WriteTo(nil, dst); err != errNoRoute {
+			t.Errorf("expected error %v; got %v", errNoRoute, err)
+		}
+
+		conn.Close()
+		if _, err := conn.WriteTo(nil, dst); err != ErrClosed {
+			t.Errorf("expected error %v; got %v", ErrClosed, err)
+		}
+	})
+
+	t.Run("broadcast from unconfigured interface", func(t *testing.T) {
+		iface, dev := mockInterface(Config{})
+		interfaces = []*Interface{iface}
+		conn, _ := ListenUDP(68)
+
+		if _, err := conn.WriteTo([]byte("discover"), UDPAddr{BroadcastIPAddr, 67}); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(dev.sent) != 1 || !bytes.Equal(dev.sent[0].Data[0:6], BroadcastHardwareAddr[:]) {
+			t.Fatal("expected datagram to be broadcast")
+		}
+
+		if src := framePayload(dev.sent[0])[12:16]; !bytes.Equal(src, []byte{0, 0, 0, 0}) {
+			t.Fatalf("expected zero source address; got % x", src)
+		}
+	})
+}
+
+func TestHandleUDP(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	nowFn = func() timer.Duration { return 0 }
+
+	var (
+		wakeups int
+		src     = UDPAddr{testGatewayIP, 5353}
+		dst     = UDPAddr{testLocalIP, 53}
+		valid   = udpDatagram(src, dst, []byte("query"))
+	)
+	wakeAllFn = func(_ *sync.WaitQueue) int {
+		wakeups++
+		return 0
+	}
+
+	badChecksum := udpDatagram(src, dst, []byte("query"))
+	badChecksum[6]++
+	noChecksum := udpDatagram(src, dst, []byte("query"))
+	noChecksum[6], noChecksum[7] = 0, 0
+	badLength := udpDatagram(src, dst, []byte("query"))
+	badLength[5] = 4
+	otherPort := udpDatagram(src, UDPAddr{testLocalIP, 54}, []byte("query"))
+
+	specs := []struct {
+		msg           []byte
+		checksumValid bool
+		expQueued     bool
+	}{
+		{valid, false, true},
+		{append(append([]byte{}, valid...), 0, 0), false, true},
+		{noChecksum, false, true},
+		{badChecksum, true, true},
+		{badChecksum, false, false},
+		{badLength, false, false},
+		{valid[:udpHeaderLen-1], false, false},
+		{valid[:len(valid)-1], false, false},
+		{otherPort, false, false},
+	}
+
+	for specIndex, spec := range specs {
+		conn, _ := ListenUDP(53)
+		wakeups = 0
+
+		iface, _ := resolvedInterface()
+		iface.handleIPv4(ipv4Packet(src.IP, dst.IP, ProtoUDP, spec.msg), spec.checksumValid)
+
+		if got := len(conn.queue) == 1; got != spec.expQueued {
+			t.Errorf("[spec %d] expected datagram to be queued: %t", specIndex, spec.expQueued)
+		} else if got && (conn.queue[0].from != src || string(conn.queue[0].data) != "query" || wakeups != 1) {
+			t.Errorf("[spec %d] unexpected queued datagram from %s: %q", specIndex, conn.queue[0].from.String(), conn.queue[0].data)
+		}
+
+		conn.Close()
+	}
+
+	t.Run("queue full", func(t *testing.T) {
+		conn, _ := ListenUDP(53)
+		for i := 0; i < udpMaxQueued+2; i++ {
+			handleUDP(src.IP, dst.IP, valid, false)
+		}
+
+		if len(conn.queue) != udpMaxQueued || conn.dropped != 2 {
+			t.Fatalf("expected %d queued and 2 dropped datagrams; got %d and %d", udpMaxQueued, len(conn.queue), conn.dropped)
+		}
+	})
+}
+
+func TestUDPReadFrom(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var (
+		timerFn    func()
+		timeout    timer.Duration
+		src        = UDPAddr{testGatewayIP, 5353}
+		conn, _    = ListenUDP(53)
+		waitAction func()
+	)
+	timerAfterFn = func(d timer.Duration, fn func()) *timer.Timer {
+		timerFn, timeout = fn, d
+		return nil
+	}
+	stopTimerFn = func(_ *timer.Timer) bool { return true }
+	wakeAllFn = func(_ *sync.WaitQueue) int { return 0 }
+	waitFn = func(_ *sync.WaitQueue, cond func() bool) {
+		if !cond() {
+			waitAction()
+		}
+		if !cond() {
+			t.Fatal("expected the wait condition to be satisfied")
+		}
+	}
+
+	t.Run("blocking read", func(t *testing.T) {
+		waitAction = func() {
+			handleUDP(src.IP, testLocalIP, udpDatagram(src, UDPAddr{testLocalIP, 53}, []byte("gopher")), false)
+		}
+
+		buf := make([]byte, 3)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf[:n]) != "gop" || from != src {
+			t.Fatalf("expected truncated payload %q from %s; got %q from %s", "gop", src.String(), buf[:n], from.String())
+		}
+
+		if timerFn != nil {
+			t.Fatal("expected no timeout timer to be armed")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		waitAction = func() { timerFn() }
+		conn.SetReadTimeout(2 * timer.Second)
+
+		if _, _, err := conn.ReadFrom(nil); err != ErrTimeout {
+			t.Fatalf("expected error %v; got %v", ErrTimeout, err)
+		}
+
+		if timeout != 2*timer.Second {
+			t.Fatalf("expected timeout timer to be armed for 2s; got %d", timeout)
+		}
+	})
+
+	t.Run("close while waiting", func(t *testing.T) {
+		waitAction = func() { conn.Close() }
+
+		if _, _, err := conn.ReadFrom(nil); err != ErrClosed {
+			t.Fatalf("expected error %v; got %v", ErrClosed, err)
+		}
+	})
+}
+
+func TestGenUDPTable(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	for _, port := range []uint16{514, 53, 68} {
+		ListenUDP(port)
+	}
+	udpConns[53].queue = make([]datagram, 2)
+	udpConns[68].dropped = 7
+
+	var buf bytes.Buffer
+	genUDPTable(&buf)
+
+	exp := "PORT   QUEUED DROPPED\n" +
+		"53     2      0\n" +
+		"68     0      7\n" +
+		"514    0      0\n"
+
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output:\n%s\ngot:\n%s", exp, got)
+	}
+}
+
+func TestUDPPoll(t *testing.T) {
+	specs := []struct {
+		conn UDPConn
+		exp  vfs.Events
+	}{
+		{UDPConn{}, vfs.PollOut},
+		{UDPConn{queue: []datagram{{}}}, vfs.PollIn | vfs.PollOut},
+		{UDPConn{closed: true}, vfs.PollHup},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.conn.Poll(); got != spec.exp {
+			t.Errorf("[spec %d] expected events 0x%x; got 0x%x", specIndex, spec.exp, got)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package proc
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+)
+
+// HeapFlags are the page table entry flags for the pages of the heap that is
+// managed via SetBreak.
+const HeapFlags = vmm.FlagPresent | vmm.FlagRW | vmm.FlagUserAccessible | vmm.FlagNoExecute
+
+var (
+	errInvalidBreak = &kernel.Error{Module: "proc", Message: "program break outside of the heap area", Code: kernel.CodeOutOfMemory}
+
+	// setDemandFaultHandlerFn is used by tests to mock calls to the vmm
+	// package.
+	setDemandFaultHandlerFn = vmm.SetDemandFaultHandler
+)
+
+// Regions returns the tree that tracks the user-space mappings of p.
+func (p *Process) Regions() *vmm.RegionTree {
+	return &p.regions
+}
+
+// SetMemoryLayout sets up the areas that are used for the heap and for mappings
+// whose address is chosen by the kernel. The heap starts at heapStart and is
+// initially empty; mappings are placed below mmapTop. It is invoked when an
+// executable is loaded into p.
+func (p *Process) SetMemoryLayout(heapStart, mmapTop uintptr) {
+	p.heapStart, p.brk, p.mmapTop = heapStart, heapStart, mmapTop
+}
+
+// AuxVector returns the auxiliary vector passed to the executable that is
+// loaded into p.
+func (p *Process) AuxVector() []uint64 {
+	return p.auxv
+}
+
+// SetAuxVector records the auxiliary vector passed to the executable that is
+// loaded into p. It is invoked when an executable is loaded into p.
+func (p *Process) SetAuxVector(auxv []uint64) {
+	p.auxv = auxv
+}
+
+// MmapTop returns the address below which mappings without a fixed address
+// are placed.
+func (p *Process) MmapTop() uintptr {
+	return p.mmapTop
+}
+
+// Break returns the current program break (the end of the heap) of p.
+func (p *Process) Break() uintptr {
+	return p.brk
+}
+
+// SetBreak moves the program break of p to addr, growing or shrinking the heap.
+// Pages that are added to the heap are populated lazily; pages that are
+// removed from it are released. The heap cannot shrink below its start or
+// grow into other mappings or past the area used for mappings.
+func (p *Process) SetBreak(addr uintptr) *kernel.Error {
+	if addr < p.heapStart || addr > p.mmapTop {
+		return errInvalidBreak
+	}
+
+	var (
+		oldEnd = pageAlign(p.brk)
+		newEnd = pageAlign(addr)
+	)
+
+	switch {
+	case newEnd > oldEnd:
+		if err := p.regions.Insert(vmm.Region{Start: oldEnd, End: newEnd, Flags: HeapFlags}); err != nil {
+			return err
+		}
+	case newEnd < oldEnd:
+		if err := p.regions.Unmap(newEnd, oldEnd); err != nil {
+			return err
+		}
+	}
+
+	p.brk = addr
+	return nil
+}
+
+// FaultIn populates the page that contains the user-space address addr if it
+// belongs to a region of the calling process that permits the requested
+// access. It returns false if the page cannot be populated. FaultIn is invoked
+// by the page fault handler for non-present user pages.
+func FaultIn(addr uintptr, write bool) bool {
+	p := Current()
+	if p == kernelProcess {
+		return false
+	}
+
+	return p.regions.Populate(addr, write)
+}
+
+// pageAlign rounds addr up to the next page boundary.
+func pageAlign(addr uintptr) uintptr {
+	return (addr + mm.PageSize - 1) &^ (mm.PageSize - 1)
+}
@@ -0,0 +1,68 @@
+package proc
+
+import (
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"testing"
+)
+
+func TestSetBreak(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	p, _ := Spawn("init", func() {})
+	_ = p.Regions().Insert(vmm.Region{Start: 0x800000, End: 0x801000, Flags: HeapFlags &^ vmm.FlagRW})
+	p.SetMemoryLayout(0x400000, 0x1000000)
+
+	if p.Break() != 0x400000 || p.MmapTop() != 0x1000000 {
+		t.Fatalf("expected the heap to be empty; got break 0x%x, mmap top 0x%x", p.Break(), p.MmapTop())
+	}
+
+	for specIndex, spec := range []struct {
+		addr     uintptr
+		expErr   bool
+		expBreak uintptr
+	}{
+		{0x3fffff, true, 0x400000},
+		{0x1000001, true, 0x400000},
+		{0x400010, false, 0x400010},
+		{0x402000, false, 0x402000},
+		// The heap cannot grow into other mappings
+		{0x800001, true, 0x402000},
+		// Shrinking within the last heap page does not unmap it
+		{0x401800, false, 0x401800},
+	} {
+		if err := p.SetBreak(spec.addr); (err != nil) != spec.expErr || p.Break() != spec.expBreak {
+			t.Errorf("[spec %d] expected break 0x%x (error: %t); got 0x%x, %v", specIndex, spec.expBreak, spec.expErr, p.Break(), err)
+		}
+	}
+
+	heap, ok := p.Regions().Lookup(0x400000)
+	if !ok || heap.End != 0x402000 || heap.Flags != HeapFlags {
+		t.Errorf("expected the heap to be recorded as a region; got %+v", heap)
+	}
+}
+
+func TestFaultIn(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	if m.demandHandler == nil {
+		t.Fatal("expected Init to register a demand fault handler")
+	}
+
+	// Kernel threads have no user mappings
+	if m.demandHandler(mm.PageSize, false) {
+		t.Error("expected faults of the kernel process not to be handled")
+	}
+
+	p, _ := Spawn("init", func() {})
+	m.currentThread = p.threadID
+	if m.demandHandler(mm.PageSize, false) {
+		t.Error("expected faults outside the regions of the process not to be handled")
+	}
+}
@@ -0,0 +1,445 @@
+// Package proc implements processes. Each process owns a private address space
+// and a main thread and is tracked by the process table until its parent
+// collects its exit status via Wait.
+package proc
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/kthread"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/vfs"
+)
+
+// PID uniquely identifies a process.
+type PID uint32
+
+const (
+	// KernelPID is the PID of the kernel process. Kernel threads that were
+	// not started via Spawn belong to this process.
+	KernelPID PID = 0
+
+	// InitPID is the PID assigned to the first process started via Spawn.
+	// Orphaned processes are reparented to it.
+	InitPID PID = 1
+
+	// AnyChild can be passed to Wait to wait for any child process.
+	AnyChild = ^PID(0)
+)
+
+// State describes the state of a process.
+type State uint8
+
+// The supported process states.
+const (
+	// StateRunning indicates that the main thread of the process has not
+	// terminated yet.
+	StateRunning State = iota
+
+	// StateZombie indicates that the process has exited and is waiting
+	// for its parent to collect its exit status.
+	StateZombie
+)
+
+// String implements fmt.Stringer for State.
+func (s State) String() string {
+	switch s {
+	case StateRunning:
+		return "running"
+	case StateZombie:
+		return "zombie"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	errNoChildren  = &kernel.Error{Module: "proc", Message: "calling process has no matching child processes", Code: kernel.CodeNoChild}
+	errInterrupted = &kernel.Error{Module: "proc", Message: "interrupted system call", Code: kernel.CodeInterrupted}
+
+	// processes contains all processes that have not been reaped yet.
+	processes = make(map[PID]*Process)
+
+	// byThread maps the scheduler ID of each process main thread to its
+	// process.
+	byThread = make(map[uint32]*Process)
+
+	nextPID = InitPID
+
+	kernelProcess *Process
+
+	// activeProcess is the process whose address space is currently
+	// loaded.
+	activeProcess *Process
+
+	// The following functions are used by tests to mock calls to the cpu,
+	// gate, mm, vmm, kthread, sched and sync packages.
+	activePDTFn           = cpu.ActivePDT
+	allocFrameFn          = mm.AllocFrame
+	initPDTFn             = (*vmm.PageDirectoryTable).Init
+	shareKernelMappingsFn = vmm.PageDirectoryTable.ShareKernelMappings
+	activatePDTFn         = vmm.PageDirectoryTable.Activate
+	setUserFSBaseFn       = gate.SetUserFSBase
+	spawnThreadFn         = spawnThread
+	exitThreadFn          = kthread.Exit
+	currentThreadIDFn     = currentThreadID
+	addSwitchHookFn       = sched.AddSwitchHook
+	setSignalCheckFn      = sched.SetSignalCheck
+	lookupThreadFn        = sched.LookupThread
+	readyFn               = sched.Ready
+	waitFn                = (*sync.WaitQueue).WaitInterruptible
+	wakeAllFn             = (*sync.WaitQueue).WakeAll
+)
+
+// Process is an isolated execution context with its own address space.
+type Process struct {
+	pid      PID
+	name     string
+	state    State
+	exitCode int
+
+	parent   *Process
+	children []*Process
+
+	addrSpace vmm.PageDirectoryTable
+
+	// regions tracks the user-space mappings of the process. The heap
+	// spans [heapStart, brk); mappings whose address is chosen by the
+	// kernel are placed below mmapTop.
+	regions   vmm.RegionTree
+	heapStart uintptr
+	brk       uintptr
+	mmapTop   uintptr
+
+	// auxv is a copy of the auxiliary vector passed to the executable
+	// that is loaded into the process.
+	auxv []uint64
+
+	// fsBase is the FS base that is loaded while the process executes
+	// user-mode code.
+	fsBase uintptr
+
+	// files contains the open file descriptors of the process.
+	files *vfs.FDTable
+
+	// thread is the main thread of the process; threadID is its
+	// scheduler ID.
+	thread   *sched.Thread
+	threadID uint32
+
+	// childExited is signaled each time a child process exits.
+	childExited sync.WaitQueue
+
+	// pendingSignals is updated atomically as signals may be sent from
+	// interrupt context. forcedSignal is set by ForceSignal to a signal
+	// that must be delivered even if it would otherwise be ignored.
+	pendingSignals SignalSet
+	blockedSignals SignalSet
+	forcedSignal   uint32
+	signalActions  [NumSignals]SignalAction
+}
+
+// PID returns the process ID.
+func (p *Process) PID() PID {
+	return p.pid
+}
+
+// Name returns the name that was passed to Spawn.
+func (p *Process) Name() string {
+	return p.name
+}
+
+// State returns the process state.
+func (p *Process) State() State {
+	return p.state
+}
+
+// ExitCode returns the exit code of a process that has exited. Processes that
+// are terminated by a signal exit with the negated signal number.
+func (p *Process) ExitCode() int {
+	return p.exitCode
+}
+
+// Parent returns the parent of the process or nil if the process has no
+// parent.
+func (p *Process) Parent() *Process {
+	return p.parent
+}
+
+// Files returns the file descriptor table of the process.
+func (p *Process) Files() *vfs.FDTable {
+	return p.files
+}
+
+// AddressSpace returns the page directory table of the process.
+func (p *Process) AddressSpace() vmm.PageDirectoryTable {
+	return p.addrSpace
+}
+
+// FSBase returns the FS base that is loaded while the process executes
+// user-mode code.
+func (p *Process) FSBase() uintptr {
+	return p.fsBase
+}
+
+// SetFSBase sets the FS base that is loaded while the process executes
+// user-mode code. User-mode code uses it to locate its thread-local storage.
+// If invoked by the main thread of p, the new FS base takes effect when the
+// thread returns to user mode.
+func (p *Process) SetFSBase(addr uintptr) {
+	p.fsBase = addr
+	if byThread[currentThreadIDFn()] == p {
+		setUserFSBaseFn(addr)
+	}
+}
+
+// Init registers the kernel process which owns the active address space and
+// arranges for the address space of each process to be activated when the
+// scheduler switches to its main thread together with its user-mode FS base.
+// The standard input, output and error
+// descriptors of the kernel process are connected to the console and are
+// inherited by all processes started via Spawn. Init also arranges for the
+// signals generated by the console and for unrecoverable faults in user mode
+// to be sent to the affected processes and for lazily populated user pages
+// to be mapped on first access. Pending signals interrupt the interruptible
+// waits of the threads of a process.
+func Init() *kernel.Error {
+	kernelProcess = &Process{pid: KernelPID, name: "kernel", files: &vfs.FDTable{}}
+	if err := initPDTFn(&kernelProcess.addrSpace, mm.FrameFromAddress(activePDTFn())); err != nil {
+		return err
+	}
+
+	if err := openStdio(kernelProcess.files); err != nil {
+		return err
+	}
+
+	processes[KernelPID] = kernelProcess
+	activeProcess = kernelProcess
+	addSwitchHookFn(func(next *sched.Thread) {
+		switchProcess(next.ID())
+	})
+	setConsoleSignalHandlerFn(handleConsoleSignal)
+	setUserFaultHandlerFn(handleUserFault)
+	setDemandFaultHandlerFn(FaultIn)
+	setSignalCheckFn(func(_ *sched.Thread) bool {
+		return Current().SignalPending()
+	})
+
+	return nil
+}
+
+// Current returns the process that the calling thread belongs to.
+func Current() *Process {
+	if p := byThread[currentThreadIDFn()]; p != nil {
+		return p
+	}
+	return kernelProcess
+}
+
+// Lookup returns the process with the specified PID or nil if no such process
+// exists.
+func Lookup(pid PID) *Process {
+	return processes[pid]
+}
+
+// Spawn creates a child process of the calling process with a new address
+// space and starts a main thread that executes entry. The child inherits a
+// copy of the file descriptor table of the calling process. The process exits
+// with code 0 when entry returns.
+func Spawn(name string, entry func()) (*Process, *kernel.Error) {
+	frame, err := allocFrameFn()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Process{
+		pid:    nextPID,
+		name:   name,
+		parent: Current(),
+	}
+
+	if err = initPDTFn(&p.addrSpace, frame); err != nil {
+		return nil, err
+	}
+
+	if err = shareKernelMappingsFn(p.addrSpace); err != nil {
+		return nil, err
+	}
+
+	// The scheduler is cooperative so the new thread cannot run before
+	// the process is registered below.
+	if p.threadID, err = spawnThreadFn(name, func() {
+		entry()
+		Exit(0)
+	}); err != nil {
+		return nil, err
+	}
+
+	p.thread = lookupThreadFn(p.threadID)
+	p.files = p.parent.files.Clone()
+	nextPID++
+	processes[p.pid] = p
+	byThread[p.threadID] = p
+	p.parent.children = append(p.parent.children, p)
+
+	return p, nil
+}
+
+// Exit terminates the calling process with the specified exit code. The
+// process remains a zombie until its parent collects the exit code via Wait
+// and its parent is sent SIGCHLD.
+// If invoked by a thread that belongs to the kernel process, Exit only
+// terminates the calling thread. Exit never returns.
+func Exit(code int) {
+	if p := Current(); p != kernelProcess {
+		exit(p, code)
+	}
+	exitThreadFn()
+}
+
+// Wait blocks until the child process with the specified PID exits and returns
+// its PID and exit code. If pid is AnyChild, Wait returns the exit status of
+// the first child process to exit. Once its exit status has been collected,
+// the child is removed from the process table. Wait returns an error if a
+// signal becomes pending for the calling process while it is blocked.
+func Wait(pid PID) (PID, int, *kernel.Error) {
+	var (
+		p      = Current()
+		zombie *Process
+		err    *kernel.Error
+	)
+
+	if !waitFn(&p.childExited, func() bool {
+		zombie, err = findZombie(p, pid)
+		return zombie != nil || err != nil
+	}) {
+		return 0, 0, errInterrupted
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	release(zombie)
+	return zombie.pid, zombie.exitCode, nil
+}
+
+// exit turns p into a zombie, closes its open files and hands its children
+// over to the init process.
+func exit(p *Process, code int) {
+	p.state = StateZombie
+	p.exitCode = code
+	delete(byThread, p.threadID)
+	p.thread = nil
+	p.files.CloseAll()
+
+	reaper := processes[InitPID]
+	if reaper == p || (reaper != nil && reaper.state == StateZombie) {
+		reaper = nil
+	}
+
+	var orphanedZombies bool
+	for _, child := range p.children {
+		child.parent = reaper
+		switch {
+		case reaper != nil:
+			reaper.children = append(reaper.children, child)
+			orphanedZombies = orphanedZombies || child.state == StateZombie
+		case child.state == StateZombie:
+			// Nobody can wait for this child anymore
+			release(child)
+		}
+	}
+	p.children = nil
+
+	if orphanedZombies {
+		wakeAllFn(&reaper.childExited)
+	}
+
+	if p.parent == nil {
+		release(p)
+		return
+	}
+	if p.parent != kernelProcess {
+		_ = p.parent.Signal(SigChld)
+	}
+	wakeAllFn(&p.parent.childExited)
+}
+
+// findZombie returns a zombie child of p that matches pid. An error is returned
+// if p has no children that match pid.
+func findZombie(p *Process, pid PID) (*Process, *kernel.Error) {
+	var matched bool
+	for _, child := range p.children {
+		if pid != AnyChild && child.pid != pid {
+			continue
+		}
+
+		if child.state == StateZombie {
+			return child, nil
+		}
+		matched = true
+	}
+
+	if !matched {
+		return nil, errNoChildren
+	}
+	return nil, nil
+}
+
+// release removes a zombie process from the process table. As the frame
+// allocator does not support freeing frames yet, the page tables of the
+// process are not reclaimed.
+func release(p *Process) {
+	if parent := p.parent; parent != nil {
+		for i, child := range parent.children {
+			if child == p {
+				parent.children = append(parent.children[:i], parent.children[i+1:]...)
+				break
+			}
+		}
+	}
+
+	delete(processes, p.pid)
+}
+
+// switchProcess activates the address space and the user-mode FS base of the
+// process that owns the thread with the specified ID. Threads that belong to
+// the kernel process only access the kernel half of the address space which is
+// shared by all processes and never return to user mode; they keep running in
+// the address space that is currently active.
+func switchProcess(threadID uint32) {
+	p := byThread[threadID]
+	if p == nil {
+		return
+	}
+
+	setUserFSBaseFn(p.fsBase)
+	if p == activeProcess {
+		return
+	}
+
+	activatePDTFn(p.addrSpace)
+	activeProcess = p
+}
+
+// spawnThread starts a kernel thread and returns its scheduler ID.
+func spawnThread(name string, fn func()) (uint32, *kernel.Error) {
+	t, err := kthread.Spawn(name, fn)
+	if err != nil {
+		return 0, err
+	}
+	return t.ID(), nil
+}
+
+// currentThreadID returns the scheduler ID of the running thread.
+func currentThreadID() uint32 {
+	if t := sched.Current(); t != nil {
+		return t.ID()
+	}
+	return 0
+}
@@ -0,0 +1,408 @@
+package proc
+
+import (
+	"gopheros/device/tty"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/kthread"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/vfs"
+	"testing"
+)
+
+func restoreMocks() {
+	activePDTFn = cpu.ActivePDT
+	allocFrameFn = mm.AllocFrame
+	initPDTFn = (*vmm.PageDirectoryTable).Init
+	shareKernelMappingsFn = vmm.PageDirectoryTable.ShareKernelMappings
+	activatePDTFn = vmm.PageDirectoryTable.Activate
+	setUserFSBaseFn = gate.SetUserFSBase
+	spawnThreadFn = spawnThread
+	exitThreadFn = kthread.Exit
+	currentThreadIDFn = currentThreadID
+	addSwitchHookFn = sched.AddSwitchHook
+	setSignalCheckFn = sched.SetSignalCheck
+	lookupThreadFn = sched.LookupThread
+	readyFn = sched.Ready
+	waitFn = (*sync.WaitQueue).WaitInterruptible
+	wakeAllFn = (*sync.WaitQueue).WakeAll
+	consoleFn = consoleFile
+	setConsoleSignalHandlerFn = tty.Console().SetSignalHandler
+	setUserFaultHandlerFn = vmm.SetUserFaultHandler
+	setDemandFaultHandlerFn = vmm.SetDemandFaultHandler
+
+	processes = make(map[PID]*Process)
+	byThread = make(map[uint32]*Process)
+	nextPID = InitPID
+	kernelProcess = nil
+	activeProcess = nil
+}
+
+// mockKernel emulates the scheduler and memory management packages. Spawned
+// threads are recorded so that tests can run them explicitly.
+type mockKernel struct {
+	currentThread uint32
+	nextThread    uint32
+	entries       map[uint32]func()
+	activated     []vmm.PageDirectoryTable
+	userFSBase    uintptr
+	switchHook    func(*sched.Thread)
+	signalHandler func(tty.Signal)
+	faultHandler  func(uintptr, *gate.Registers) bool
+	demandHandler func(uintptr, bool) bool
+	signalCheck   func(*sched.Thread) bool
+	threads       map[uint32]*sched.Thread
+	readied       []*sched.Thread
+	threadExits   int
+	wakeups       map[*sync.WaitQueue]int
+}
+
+func (m *mockKernel) install(t *testing.T) {
+	m.nextThread = 1
+	m.entries = make(map[uint32]func())
+	m.threads = make(map[uint32]*sched.Thread)
+	m.wakeups = make(map[*sync.WaitQueue]int)
+
+	activePDTFn = func() uintptr { return mm.Frame(42).Address() }
+	allocFrameFn = func() (mm.Frame, *kernel.Error) { return mm.Frame(100 + nextPID), nil }
+	initPDTFn = func(_ *vmm.PageDirectoryTable, _ mm.Frame) *kernel.Error { return nil }
+	shareKernelMappingsFn = func(_ vmm.PageDirectoryTable) *kernel.Error { return nil }
+	activatePDTFn = func(pdt vmm.PageDirectoryTable) { m.activated = append(m.activated, pdt) }
+	setUserFSBaseFn = func(addr uintptr) { m.userFSBase = addr }
+	spawnThreadFn = func(_ string, fn func()) (uint32, *kernel.Error) {
+		id := m.nextThread
+		m.nextThread++
+		m.entries[id] = fn
+		return id, nil
+	}
+	exitThreadFn = func() { m.threadExits++ }
+	currentThreadIDFn = func() uint32 { return m.currentThread }
+	addSwitchHookFn = func(fn func(*sched.Thread)) { m.switchHook = fn }
+	setConsoleSignalHandlerFn = func(fn func(tty.Signal)) { m.signalHandler = fn }
+	setUserFaultHandlerFn = func(fn func(uintptr, *gate.Registers) bool) { m.faultHandler = fn }
+	setDemandFaultHandlerFn = func(fn func(uintptr, bool) bool) { m.demandHandler = fn }
+	setSignalCheckFn = func(fn func(*sched.Thread) bool) { m.signalCheck = fn }
+	lookupThreadFn = func(id uint32) *sched.Thread {
+		if m.threads[id] == nil {
+			m.threads[id] = &sched.Thread{}
+		}
+		return m.threads[id]
+	}
+	readyFn = func(th *sched.Thread) { m.readied = append(m.readied, th) }
+	waitFn = func(_ *sync.WaitQueue, cond func() bool) bool {
+		if !cond() {
+			t.Fatal("unexpected call to Wait; the calling thread would block forever")
+		}
+		return true
+	}
+	wakeAllFn = func(q *sync.WaitQueue) int {
+		m.wakeups[q]++
+		return 0
+	}
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// run executes the entry point of the process main thread.
+func (m *mockKernel) run(p *Process) {
+	prev := m.currentThread
+	m.currentThread = p.threadID
+	m.entries[p.threadID]()
+	m.currentThread = prev
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	if kernelProcess == nil || Lookup(KernelPID) != kernelProcess || Current() != kernelProcess {
+		t.Fatal("expected Init to register the kernel process")
+	}
+
+	if m.switchHook == nil {
+		t.Error("expected Init to register a scheduler switch hook")
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "bad PDT"}
+	initPDTFn = func(_ *vmm.PageDirectoryTable, _ mm.Frame) *kernel.Error { return expErr }
+	if err := Init(); err != expErr {
+		t.Errorf("expected to get error %v; got %v", expErr, err)
+	}
+}
+
+func TestSpawnErrors(t *testing.T) {
+	defer restoreMocks()
+
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+	specs := []func(){
+		func() { allocFrameFn = func() (mm.Frame, *kernel.Error) { return mm.InvalidFrame, expErr } },
+		func() { initPDTFn = func(_ *vmm.PageDirectoryTable, _ mm.Frame) *kernel.Error { return expErr } },
+		func() { shareKernelMappingsFn = func(_ vmm.PageDirectoryTable) *kernel.Error { return expErr } },
+		func() { spawnThreadFn = func(_ string, _ func()) (uint32, *kernel.Error) { return 0, expErr } },
+	}
+
+	for specIndex, setup := range specs {
+		m := &mockKernel{}
+		m.install(t)
+		setup()
+
+		if p, err := Spawn("init", func() {}); p != nil || err != expErr {
+			t.Errorf("[spec %d] expected to get error %v; got %v", specIndex, expErr, err)
+		}
+
+		if len(processes) != 1 || nextPID != InitPID {
+			t.Errorf("[spec %d] expected process table to be left untouched", specIndex)
+		}
+	}
+}
+
+func TestSpawnExitWait(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	var ran bool
+	p, err := Spawn("init", func() { ran = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.PID() != InitPID || p.Name() != "init" || p.Parent() != kernelProcess || p.State() != StateRunning {
+		t.Fatalf("unexpected process attributes: pid %d, name %q, state %s", p.PID(), p.Name(), p.State())
+	}
+
+	if Lookup(InitPID) != p || len(kernelProcess.children) != 1 {
+		t.Fatal("expected process to be registered as a child of the kernel process")
+	}
+
+	// Waiting for a running child blocks the caller
+	waitFn = func(q *sync.WaitQueue, cond func() bool) bool {
+		if q != &kernelProcess.childExited {
+			t.Error("expected Wait to block on the child exit queue of the caller")
+		}
+
+		if cond() {
+			t.Error("expected wait condition not to be satisfied while the child is running")
+		}
+
+		m.run(p)
+		if !cond() {
+			t.Error("expected wait condition to be satisfied once the child has exited")
+		}
+		return true
+	}
+
+	pid, code, err := Wait(AnyChild)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ran || pid != InitPID || code != 0 || p.State() != StateZombie {
+		t.Fatalf("expected Wait to return the exit status of the child; got pid %d, code %d", pid, code)
+	}
+
+	if m.threadExits != 1 || m.wakeups[&kernelProcess.childExited] != 1 {
+		t.Error("expected the child thread to exit and wake up its parent")
+	}
+
+	if Lookup(InitPID) != nil || len(kernelProcess.children) != 0 {
+		t.Error("expected Wait to remove the child from the process table")
+	}
+
+	waitFn = func(_ *sync.WaitQueue, cond func() bool) bool { return cond() }
+	if _, _, err = Wait(AnyChild); err != errNoChildren {
+		t.Errorf("expected to get errNoChildren; got %v", err)
+	}
+
+	// Waits interrupted by a signal fail with EINTR
+	if _, err = Spawn("child", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	waitFn = func(_ *sync.WaitQueue, _ func() bool) bool { return false }
+	if _, _, err = Wait(AnyChild); err != errInterrupted {
+		t.Errorf("expected to get errInterrupted; got %v", err)
+	}
+}
+
+func TestExit(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	// Exit calls from kernel threads only terminate the thread
+	Exit(3)
+	if m.threadExits != 1 || kernelProcess.State() != StateRunning {
+		t.Fatal("expected Exit to only terminate the calling kernel thread")
+	}
+
+	initProc, _ := Spawn("init", func() {})
+	m.currentThread = initProc.threadID
+	parent, _ := Spawn("parent", func() {})
+	m.currentThread = parent.threadID
+	zombieChild, _ := Spawn("zombie", func() {})
+	runningChild, _ := Spawn("running", func() {})
+	m.currentThread = 0
+
+	m.entries[zombieChild.threadID] = func() { Exit(7) }
+	m.run(zombieChild)
+	m.entries[parent.threadID] = func() { Exit(5) }
+	m.run(parent)
+
+	if zombieChild.Parent() != initProc || runningChild.Parent() != initProc || len(initProc.children) != 3 {
+		t.Fatal("expected orphaned children to be reparented to init")
+	}
+
+	if m.wakeups[&initProc.childExited] != 2 {
+		t.Errorf("expected initProc to be woken up twice; got %d", m.wakeups[&initProc.childExited])
+	}
+
+	m.currentThread = initProc.threadID
+	for specIndex, spec := range []struct {
+		pid     PID
+		expCode int
+	}{
+		{zombieChild.PID(), 7},
+		{parent.PID(), 5},
+	} {
+		pid, code, err := Wait(spec.pid)
+		if err != nil || pid != spec.pid || code != spec.expCode {
+			t.Errorf("[spec %d] expected Wait to return pid %d and code %d; got %d, %d, %v", specIndex, spec.pid, spec.expCode, pid, code, err)
+		}
+	}
+
+	if _, _, err := Wait(zombieChild.PID()); err != errNoChildren {
+		t.Errorf("expected to get errNoChildren; got %v", err)
+	}
+
+	// Once initProc exits, its children are detached and reaped as soon as
+	// they exit.
+	m.currentThread = 0
+	m.entries[initProc.threadID] = func() { Exit(0) }
+	m.run(initProc)
+	if runningChild.Parent() != nil {
+		t.Fatal("expected children of initProc to be detached when initProc exits")
+	}
+
+	m.entries[runningChild.threadID] = func() { Exit(1) }
+	m.run(runningChild)
+	if Lookup(runningChild.PID()) != nil {
+		t.Error("expected detached process to be reaped when it exits")
+	}
+}
+
+func TestSwitchProcess(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	p1, _ := Spawn("p1", func() {})
+	p2, _ := Spawn("p2", func() {})
+	p1.fsBase, p2.fsBase = 0x1000, 0x2000
+
+	for specIndex, spec := range []struct {
+		threadID      uint32
+		expActivated  int
+		expUserFSBase uintptr
+	}{
+		// Kernel threads keep running in the active address space
+		{0, 0, 0},
+		{p1.threadID, 1, 0x1000},
+		{p1.threadID, 1, 0x1000},
+		{0, 1, 0x1000},
+		{p2.threadID, 2, 0x2000},
+		{p1.threadID, 3, 0x1000},
+	} {
+		switchProcess(spec.threadID)
+		if got := len(m.activated); got != spec.expActivated {
+			t.Errorf("[spec %d] expected %d address space switches; got %d", specIndex, spec.expActivated, got)
+		}
+
+		if m.userFSBase != spec.expUserFSBase {
+			t.Errorf("[spec %d] expected user FS base to be 0x%x; got 0x%x", specIndex, spec.expUserFSBase, m.userFSBase)
+		}
+	}
+
+	if activeProcess != p1 || m.activated[1] != p2.AddressSpace() {
+		t.Error("expected the address space of the switched-to process to be activated")
+	}
+}
+
+func TestSetFSBase(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	p, _ := Spawn("p", func() {})
+
+	// Changing the FS base of another process must not affect the FS base
+	// of the running thread.
+	p.SetFSBase(0x1000)
+	if p.FSBase() != 0x1000 || m.userFSBase != 0 {
+		t.Errorf("expected only the process FS base to be updated; got 0x%x, 0x%x", p.FSBase(), m.userFSBase)
+	}
+
+	m.entries[p.threadID] = func() { p.SetFSBase(0x2000) }
+	m.run(p)
+	if p.FSBase() != 0x2000 || m.userFSBase != 0x2000 {
+		t.Errorf("expected the FS base of the running process to be loaded; got 0x%x, 0x%x", p.FSBase(), m.userFSBase)
+	}
+}
+
+func TestStateString(t *testing.T) {
+	for specIndex, spec := range []struct {
+		state State
+		exp   string
+	}{
+		{StateRunning, "running"},
+		{StateZombie, "zombie"},
+		{State(99), "unknown"},
+	} {
+		if got := spec.state.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	defer restoreMocks()
+
+	console := vfs.NewReadOnlyFile(vfs.FileInfo{Name: "console"}, nil)
+	consoleFn = func() vfs.File { return console }
+
+	m := &mockKernel{}
+	m.install(t)
+
+	// The standard descriptors of the kernel process refer to the console
+	for _, fd := range []int{Stdin, Stdout, Stderr} {
+		if f, err := kernelProcess.Files().Get(fd); f != console || err != nil {
+			t.Fatalf("[fd %d] expected descriptor to refer to the console; got %v, %v", fd, f, err)
+		}
+	}
+
+	// Children inherit a copy of the descriptor table and their files are
+	// closed when they exit.
+	p, _ := Spawn("init", func() {})
+	if err := p.Files().Close(Stdin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kernelProcess.Files().Get(Stdin); err != nil {
+		t.Fatal("expected closing a descriptor of the child not to affect its parent")
+	}
+
+	m.run(p)
+	if _, err := p.Files().Get(Stdout); err != vfs.ErrBadFD {
+		t.Fatalf("expected the files of the exited process to be closed; got %v", err)
+	}
+}
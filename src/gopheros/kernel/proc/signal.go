@@ -0,0 +1,280 @@
+package proc
+
+import (
+	"gopheros/device/tty"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/mm/vmm"
+	"math/bits"
+	"sync/atomic"
+)
+
+// Signal identifies a signal. Its value matches the POSIX signal number.
+type Signal uint8
+
+// The signals with special meaning to the kernel. Other signals up to
+// NumSignals-1 can be sent and handled but are never generated by the kernel.
+const (
+	SigInt  Signal = 2
+	SigQuit Signal = 3
+	SigIll  Signal = 4
+	SigTrap Signal = 5
+	SigAbrt Signal = 6
+	SigBus  Signal = 7
+	SigFpe  Signal = 8
+	SigKill Signal = 9
+	SigSegv Signal = 11
+	SigChld Signal = 17
+	SigSys  Signal = 31
+
+	// NumSignals is one past the largest supported signal number. Only the
+	// standard (non real-time) signals are supported.
+	NumSignals = 32
+)
+
+// The special values of SignalAction.Handler.
+const (
+	// SigDefault selects the default action for a signal. SIGCHLD is
+	// ignored by default; all other signals terminate the process. The
+	// signals that indicate a program error also dump core.
+	SigDefault uintptr = 0
+
+	// SigIgnore discards the signal.
+	SigIgnore uintptr = 1
+)
+
+// SignalSet is a set of signals. Signal n is represented by bit n-1 which
+// matches the layout of the sigset_t type used by the Linux system calls.
+type SignalSet uint64
+
+// Mask returns the set that only contains s.
+func (s Signal) Mask() SignalSet {
+	return SignalSet(1) << (s - 1)
+}
+
+// DumpsCore returns true if the default action of s writes a core file before
+// terminating the process.
+func (s Signal) DumpsCore() bool {
+	return coreSignals&s.Mask() != 0
+}
+
+// SignalAction describes how a process handles a signal. Its layout matches
+// the sigaction structure that is passed to the rt_sigaction system call.
+type SignalAction struct {
+	// Handler is SigDefault, SigIgnore or the user-mode address of the
+	// signal handler.
+	Handler uintptr
+
+	// Flags and Restorer are interpreted by the code that sets up the
+	// signal handler frames.
+	Flags    uint64
+	Restorer uintptr
+
+	// Mask contains the signals that are blocked while the handler runs.
+	Mask SignalSet
+}
+
+var (
+	errInvalidSignal = &kernel.Error{Module: "proc", Message: "invalid signal number", Code: kernel.CodeInvalid}
+	errNoProcess     = &kernel.Error{Module: "proc", Message: "no such process", Code: kernel.CodeNoProcess}
+
+	// unblockableSignals cannot be blocked, ignored or handled.
+	unblockableSignals = SigKill.Mask()
+
+	// coreSignals contains the signals whose default action dumps core.
+	coreSignals = SigQuit.Mask() | SigIll.Mask() | SigTrap.Mask() | SigAbrt.Mask() |
+		SigBus.Mask() | SigFpe.Mask() | SigSegv.Mask() | SigSys.Mask()
+
+	// The following functions are used by tests to mock calls to the tty
+	// and vmm packages.
+	setConsoleSignalHandlerFn = tty.Console().SetSignalHandler
+	setUserFaultHandlerFn     = vmm.SetUserFaultHandler
+)
+
+// SendSignal makes sig pending for the process with the specified PID. It is a
+// shorthand for looking up the process and invoking its Signal method. If sig
+// is 0, SendSignal only checks that the process exists.
+func SendSignal(pid PID, sig Signal) *kernel.Error {
+	p := processes[pid]
+	switch {
+	case p == nil || p == kernelProcess:
+		return errNoProcess
+	case sig == 0:
+		return nil
+	}
+
+	return p.Signal(sig)
+}
+
+// Signal makes sig pending for p. Signals are delivered the next time p returns
+// to user mode; if p is blocked in an interruptible wait and does not block
+// sig, it is woken up so that the wait fails with EINTR. Signals that p ignores
+// are discarded. As with Linux, the init process does
+// not receive signals that it has not installed a handler for.
+func (p *Process) Signal(sig Signal) *kernel.Error {
+	if sig == 0 || sig >= NumSignals {
+		return errInvalidSignal
+	}
+
+	if p.state != StateZombie && !p.ignores(sig) {
+		p.updatePending(func(pending SignalSet) SignalSet { return pending | sig.Mask() })
+		if p.blockedSignals&sig.Mask() == 0 {
+			p.wake()
+		}
+	}
+
+	return nil
+}
+
+// ForceSignal makes sig pending for p even if p blocks or ignores it. It is
+// used for signals that are raised by faults which p cannot recover from
+// without handling the signal.
+func (p *Process) ForceSignal(sig Signal) {
+	p.blockedSignals &^= sig.Mask()
+	if p.signalActions[sig].Handler == SigIgnore {
+		p.signalActions[sig] = SignalAction{}
+	}
+
+	// Unless handled, faults are fatal even for the init process
+	atomic.StoreUint32(&p.forcedSignal, uint32(sig))
+	p.updatePending(func(pending SignalSet) SignalSet { return pending | sig.Mask() })
+	p.wake()
+}
+
+// PendingSignals returns the signals that are pending for p.
+func (p *Process) PendingSignals() SignalSet {
+	return SignalSet(atomic.LoadUint64((*uint64)(&p.pendingSignals)))
+}
+
+// SignalPending returns true if p has a pending signal that it does not block.
+// Interruptible waits of p return early while this is the case.
+func (p *Process) SignalPending() bool {
+	return p.PendingSignals()&^p.blockedSignals != 0
+}
+
+// SignalMask returns the signals that are blocked by p.
+func (p *Process) SignalMask() SignalSet {
+	return p.blockedSignals
+}
+
+// SetSignalMask updates the signals that are blocked by p. Signals that cannot
+// be blocked are removed from mask.
+func (p *Process) SetSignalMask(mask SignalSet) {
+	p.blockedSignals = mask &^ unblockableSignals
+}
+
+// SignalAction returns the action that p takes when it receives sig.
+func (p *Process) SignalAction(sig Signal) (SignalAction, *kernel.Error) {
+	if sig == 0 || sig >= NumSignals {
+		return SignalAction{}, errInvalidSignal
+	}
+
+	return p.signalActions[sig], nil
+}
+
+// SetSignalAction updates the action that p takes when it receives sig and
+// returns the previous action. The action for signals that cannot be blocked
+// cannot be changed. Pending signals that become ignored are discarded.
+func (p *Process) SetSignalAction(sig Signal, action SignalAction) (SignalAction, *kernel.Error) {
+	if sig == 0 || sig >= NumSignals || unblockableSignals&sig.Mask() != 0 {
+		return SignalAction{}, errInvalidSignal
+	}
+
+	prev := p.signalActions[sig]
+	action.Mask &^= unblockableSignals
+	p.signalActions[sig] = action
+	if p.ignores(sig) {
+		p.clearPending(sig)
+	}
+
+	return prev, nil
+}
+
+// DequeueSignal removes the lowest-numbered pending signal that p does not
+// block or ignore and returns it together with the action for it. It returns
+// 0 if no such signal is pending. The returned action is either SigDefault,
+// which terminates the process, or a user-mode handler.
+func (p *Process) DequeueSignal() (Signal, SignalAction) {
+	for {
+		deliverable := p.PendingSignals() &^ p.blockedSignals
+		if deliverable == 0 {
+			return 0, SignalAction{}
+		}
+
+		sig := Signal(bits.TrailingZeros64(uint64(deliverable)) + 1)
+		p.clearPending(sig)
+
+		forced := atomic.CompareAndSwapUint32(&p.forcedSignal, uint32(sig), 0)
+		if !forced && p.ignores(sig) {
+			continue
+		}
+
+		return sig, p.signalActions[sig]
+	}
+}
+
+// ignores returns true if p discards sig when it is sent to it.
+func (p *Process) ignores(sig Signal) bool {
+	switch handler := p.signalActions[sig].Handler; {
+	case handler == SigIgnore:
+		return true
+	case handler != SigDefault:
+		return false
+	default:
+		return sig == SigChld || p.pid == InitPID
+	}
+}
+
+// wake readies the main thread of p if it is blocked so that it can notice a
+// newly posted signal. Readying a thread that is not blocked has no effect.
+func (p *Process) wake() {
+	if p.thread != nil {
+		readyFn(p.thread)
+	}
+}
+
+// clearPending removes sig from the pending signals of p.
+func (p *Process) clearPending(sig Signal) {
+	p.updatePending(func(pending SignalSet) SignalSet { return pending &^ sig.Mask() })
+}
+
+// updatePending atomically replaces the pending signals of p with the result
+// of fn. Signals may be sent by interrupt handlers while p is examining its
+// pending signals.
+func (p *Process) updatePending(fn func(SignalSet) SignalSet) {
+	for {
+		pending := atomic.LoadUint64((*uint64)(&p.pendingSignals))
+		if atomic.CompareAndSwapUint64((*uint64)(&p.pendingSignals), pending, uint64(fn(SignalSet(pending)))) {
+			return
+		}
+	}
+}
+
+// handleUserFault sends SIGSEGV to the process whose user-mode code triggered
+// a fault that the kernel could not recover from. The signal is delivered
+// before the process returns to user mode.
+func handleUserFault(_ uintptr, _ *gate.Registers) bool {
+	p := Current()
+	if p == kernelProcess {
+		return false
+	}
+
+	p.ForceSignal(SigSegv)
+	return true
+}
+
+// handleConsoleSignal sends the signals generated by the console line
+// discipline to the processes whose standard input is connected to the
+// console.
+func handleConsoleSignal(sig tty.Signal) {
+	console := consoleFn()
+	for _, p := range processes {
+		if p == kernelProcess || p.state == StateZombie {
+			continue
+		}
+
+		if f, err := p.files.Get(Stdin); err == nil && f == console {
+			_ = p.Signal(Signal(sig))
+		}
+	}
+}
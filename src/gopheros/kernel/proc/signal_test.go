@@ -0,0 +1,294 @@
+package proc
+
+import (
+	"gopheros/device/tty"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/vfs"
+	"testing"
+)
+
+func TestSignalDelivery(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	_, _ = Spawn("init", func() {})
+	p, _ := Spawn("p", func() {})
+
+	if err := p.Signal(0); err != errInvalidSignal {
+		t.Errorf("expected to get errInvalidSignal; got %v", err)
+	}
+	if err := p.Signal(NumSignals); err != errInvalidSignal {
+		t.Errorf("expected to get errInvalidSignal; got %v", err)
+	}
+
+	// SIGCHLD is ignored by default
+	for _, sig := range []Signal{SigSegv, SigInt, SigChld} {
+		if err := p.Signal(sig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exp := SigInt.Mask() | SigSegv.Mask(); p.PendingSignals() != exp {
+		t.Fatalf("expected pending signals to be 0x%x; got 0x%x", exp, p.PendingSignals())
+	}
+
+	// Blocked signals remain pending; SIGKILL cannot be blocked
+	p.SetSignalMask(SigInt.Mask() | SigKill.Mask())
+	if p.SignalMask() != SigInt.Mask() {
+		t.Errorf("expected SIGKILL to be removed from the signal mask; got 0x%x", p.SignalMask())
+	}
+
+	if sig, act := p.DequeueSignal(); sig != SigSegv || act.Handler != SigDefault {
+		t.Errorf("expected to dequeue SIGSEGV with the default action; got %d, %v", sig, act)
+	}
+	if sig, _ := p.DequeueSignal(); sig != 0 {
+		t.Errorf("expected blocked SIGINT not to be dequeued; got %d", sig)
+	}
+
+	p.SetSignalMask(0)
+	if sig, _ := p.DequeueSignal(); sig != SigInt {
+		t.Errorf("expected to dequeue SIGINT once unblocked; got %d", sig)
+	}
+	if p.PendingSignals() != 0 {
+		t.Errorf("expected no pending signals; got 0x%x", p.PendingSignals())
+	}
+
+	// Zombies do not receive signals
+	p.state = StateZombie
+	_ = p.Signal(SigInt)
+	if p.PendingSignals() != 0 {
+		t.Error("expected zombie processes not to receive signals")
+	}
+}
+
+func TestSignalWakesProcess(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	_, _ = Spawn("init", func() {})
+	p, _ := Spawn("p", func() {})
+	thread := m.threads[p.threadID]
+	m.currentThread = p.threadID
+
+	if m.signalCheck == nil || m.signalCheck(thread) || p.SignalPending() {
+		t.Fatal("expected no signals to be pending")
+	}
+
+	// Blocked and ignored signals do not wake up the process
+	p.SetSignalMask(SigInt.Mask())
+	_ = p.Signal(SigInt)
+	_ = p.Signal(SigChld)
+	if len(m.readied) != 0 || m.signalCheck(thread) {
+		t.Fatal("expected blocked and ignored signals not to wake up the process")
+	}
+
+	_ = p.Signal(SigQuit)
+	if len(m.readied) != 1 || m.readied[0] != thread {
+		t.Fatal("expected the main thread of the process to be woken up")
+	}
+
+	if !m.signalCheck(thread) || !p.SignalPending() {
+		t.Error("expected a signal to be pending for the process")
+	}
+
+	m.currentThread = 0
+	if m.signalCheck(&sched.Thread{}) {
+		t.Error("expected no signals to be pending for threads of the kernel process")
+	}
+
+	p.ForceSignal(SigSegv)
+	if len(m.readied) != 2 {
+		t.Error("expected ForceSignal to wake up the process")
+	}
+}
+
+func TestDumpsCore(t *testing.T) {
+	for sig := Signal(1); sig < NumSignals; sig++ {
+		exp := sig == SigQuit || sig == SigIll || sig == SigTrap || sig == SigAbrt ||
+			sig == SigBus || sig == SigFpe || sig == SigSegv || sig == SigSys
+		if sig.DumpsCore() != exp {
+			t.Errorf("expected DumpsCore for signal %d to return %t", sig, exp)
+		}
+	}
+}
+
+func TestSignalAction(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	_, _ = Spawn("init", func() {})
+	p, _ := Spawn("p", func() {})
+
+	for _, sig := range []Signal{0, SigKill, NumSignals} {
+		if _, err := p.SetSignalAction(sig, SignalAction{Handler: SigIgnore}); err != errInvalidSignal {
+			t.Errorf("[sig %d] expected to get errInvalidSignal; got %v", sig, err)
+		}
+	}
+	if _, err := p.SignalAction(NumSignals); err != errInvalidSignal {
+		t.Errorf("expected to get errInvalidSignal; got %v", err)
+	}
+
+	handler := SignalAction{Handler: 0x1000, Restorer: 0x2000, Mask: SigKill.Mask() | SigQuit.Mask()}
+	if prev, err := p.SetSignalAction(SigInt, handler); err != nil || prev != (SignalAction{}) {
+		t.Fatalf("expected to get the default action; got %v, %v", prev, err)
+	}
+	if act, _ := p.SignalAction(SigInt); act.Mask != SigQuit.Mask() {
+		t.Errorf("expected SIGKILL to be removed from the handler mask; got 0x%x", act.Mask)
+	}
+
+	_ = p.Signal(SigInt)
+	if sig, act := p.DequeueSignal(); sig != SigInt || act.Handler != handler.Handler {
+		t.Errorf("expected to dequeue SIGINT with the installed handler; got %d, %v", sig, act)
+	}
+
+	// Ignoring a signal discards it if it is pending
+	_ = p.Signal(SigInt)
+	if _, err := p.SetSignalAction(SigInt, SignalAction{Handler: SigIgnore}); err != nil {
+		t.Fatal(err)
+	}
+	_ = p.Signal(SigInt)
+	if p.PendingSignals() != 0 {
+		t.Errorf("expected ignored signals to be discarded; got 0x%x", p.PendingSignals())
+	}
+}
+
+func TestForceSignal(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	initProc, _ := Spawn("init", func() {})
+
+	// Signals with the default action are not sent to init
+	if err := SendSignal(initProc.PID(), SigKill); err != nil {
+		t.Fatal(err)
+	}
+	if initProc.PendingSignals() != 0 {
+		t.Fatal("expected init not to receive signals that it does not handle")
+	}
+
+	// Faults are delivered even if blocked or ignored
+	_, _ = initProc.SetSignalAction(SigSegv, SignalAction{Handler: SigIgnore})
+	initProc.SetSignalMask(SigSegv.Mask())
+	initProc.ForceSignal(SigSegv)
+	if sig, act := initProc.DequeueSignal(); sig != SigSegv || act.Handler != SigDefault {
+		t.Errorf("expected to dequeue SIGSEGV with the default action; got %d, %v", sig, act)
+	}
+	if initProc.SignalMask() != 0 {
+		t.Errorf("expected SIGSEGV to be unblocked; got 0x%x", initProc.SignalMask())
+	}
+}
+
+func TestSendSignal(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	_, _ = Spawn("init", func() {})
+	p, _ := Spawn("p", func() {})
+
+	for specIndex, spec := range []struct {
+		pid    PID
+		sig    Signal
+		expErr *kernel.Error
+	}{
+		{KernelPID, SigInt, errNoProcess},
+		{PID(42), SigInt, errNoProcess},
+		{p.PID(), 0, nil},
+		{p.PID(), NumSignals, errInvalidSignal},
+		{p.PID(), SigInt, nil},
+	} {
+		if err := SendSignal(spec.pid, spec.sig); err != spec.expErr {
+			t.Errorf("[spec %d] expected to get error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	if p.PendingSignals() != SigInt.Mask() {
+		t.Errorf("expected SIGINT to be pending; got 0x%x", p.PendingSignals())
+	}
+}
+
+func TestExitSendsSigChld(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	initProc, _ := Spawn("init", func() {})
+	m.currentThread = initProc.threadID
+	parent, _ := Spawn("parent", func() {})
+	m.currentThread = parent.threadID
+	child, _ := Spawn("child", func() {})
+	m.currentThread = 0
+
+	_, _ = parent.SetSignalAction(SigChld, SignalAction{Handler: 0x1000})
+	m.entries[child.threadID] = func() { Exit(0) }
+	m.run(child)
+
+	if parent.PendingSignals() != SigChld.Mask() {
+		t.Errorf("expected the parent to receive SIGCHLD; got 0x%x", parent.PendingSignals())
+	}
+}
+
+func TestHandleConsoleSignal(t *testing.T) {
+	defer restoreMocks()
+
+	console := vfs.NewReadOnlyFile(vfs.FileInfo{Name: "console"}, nil)
+	consoleFn = func() vfs.File { return console }
+
+	m := &mockKernel{}
+	m.install(t)
+
+	if m.signalHandler == nil {
+		t.Fatal("expected Init to register a console signal handler")
+	}
+
+	_, _ = Spawn("init", func() {})
+	fg, _ := Spawn("fg", func() {})
+	bg, _ := Spawn("bg", func() {})
+	_ = bg.Files().Close(Stdin)
+
+	m.signalHandler(tty.SigInt)
+	if fg.PendingSignals() != SigInt.Mask() {
+		t.Errorf("expected processes reading from the console to receive SIGINT; got 0x%x", fg.PendingSignals())
+	}
+	if bg.PendingSignals() != 0 {
+		t.Errorf("expected processes not reading from the console not to receive SIGINT; got 0x%x", bg.PendingSignals())
+	}
+}
+
+func TestHandleUserFault(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockKernel{}
+	m.install(t)
+
+	if m.faultHandler == nil {
+		t.Fatal("expected Init to register a user fault handler")
+	}
+
+	regs := &gate.Registers{}
+	if m.faultHandler(0, regs) {
+		t.Error("expected faults in the kernel process not to be handled")
+	}
+
+	_, _ = Spawn("init", func() {})
+	p, _ := Spawn("p", func() {})
+	m.currentThread = p.threadID
+	if !m.faultHandler(0xbadf00d, regs) {
+		t.Fatal("expected the fault to be handled")
+	}
+
+	if sig, _ := p.DequeueSignal(); sig != SigSegv {
+		t.Errorf("expected SIGSEGV to be delivered to the faulting process; got %d", sig)
+	}
+}
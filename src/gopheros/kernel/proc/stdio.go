@@ -0,0 +1,40 @@
+package proc
+
+import (
+	"gopheros/device/tty"
+	"gopheros/kernel"
+	"gopheros/kernel/vfs"
+)
+
+// The descriptors that are connected to the console for each process.
+const (
+	Stdin  = 0
+	Stdout = 1
+	Stderr = 2
+)
+
+var (
+	// consoleFn is used by tests to mock calls to the tty package.
+	consoleFn = consoleFile
+)
+
+// consoleFile returns the file for the line discipline of the system console.
+func consoleFile() vfs.File {
+	return tty.Console()
+}
+
+// openStdio connects the standard input, output and error descriptors of a
+// table to the console.
+func openStdio(files *vfs.FDTable) *kernel.Error {
+	if _, err := files.Install(consoleFn()); err != nil {
+		return err
+	}
+
+	for _, fd := range []int{Stdout, Stderr} {
+		if _, err := files.Dup2(Stdin, fd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
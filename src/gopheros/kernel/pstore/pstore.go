@@ -0,0 +1,262 @@
+// Package pstore preserves diagnostic information about kernel panics across
+// warm reboots.
+//
+// A region of physical memory is set aside via the "pstore=SIZE@ADDR" boot
+// command line argument (e.g. pstore=64K@0x7f00000). When the kernel panics,
+// the contents of the kernel log, which include the panic message, the
+// register dump and the backtrace, are written to the region together with a
+// dump of the panicking stack. As the contents of RAM survive a warm reboot,
+// the next boot that reserves the same region recovers the dump and exposes
+// it via WriteLastDump.
+package pstore
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/initcall"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/pmm"
+	"gopheros/kernel/mm/vmm"
+	"io"
+	"strings"
+	"unsafe"
+)
+
+const (
+	// dumpMagic ("GOPSTORE") marks a region that contains a valid dump.
+	dumpMagic = uint64(0x45524f5453504f47)
+
+	// minRegionSize ensures that the region can hold the entire kernel log
+	// and the stack dump.
+	minRegionSize = 32 * 1024
+
+	// stackDumpSize is the maximum number of stack bytes included in a
+	// dump.
+	stackDumpSize = 1024
+)
+
+// header is stored at the start of the region and describes the dump that
+// follows it.
+type header struct {
+	magic    uint64
+	length   uint32
+	checksum uint32
+}
+
+var (
+	errInvalidRegion = &kernel.Error{Module: "pstore", Message: "invalid region; expected pstore=SIZE@ADDR with a page-aligned address and size of at least 32K"}
+	errRegionInUse   = &kernel.Error{Module: "pstore", Message: "unable to reserve region"}
+
+	// region points to the mapped pstore region or is 0 if no region has
+	// been configured.
+	region     uintptr
+	regionSize uintptr
+
+	// lastDump holds the dump recovered from the previous boot.
+	lastDump []byte
+
+	// The following functions are used by tests to mock calls to the
+	// cmdline, pmm, vmm and kfmt packages.
+	cmdlineLookupFn = cmdline.Lookup
+	reserveFramesFn = pmm.ReserveFrames
+	mapRegionFn     = vmm.MapRegion
+	setPanicHookFn  = kfmt.SetPanicHook
+	writeLogFn      = kfmt.WriteLog
+)
+
+func init() {
+	initcall.Register(initcall.LevelEarly, Init)
+}
+
+// Init reserves and maps the region specified via the "pstore" boot command
+// line argument, recovers any dump left by the previous boot and registers a
+// panic hook that stores new dumps in the region. Init is a no-op if no region
+// has been specified.
+func Init() *kernel.Error {
+	arg, ok := cmdlineLookupFn("pstore")
+	if !ok {
+		return nil
+	}
+
+	size, addr, ok := parseRegion(arg)
+	if !ok || size < minRegionSize || size > 1<<32 || addr&(mm.PageSize-1) != 0 {
+		return errInvalidRegion
+	}
+	size = (size + mm.PageSize - 1) &^ (mm.PageSize - 1)
+
+	frame := mm.FrameFromAddress(addr)
+	if err := reserveFramesFn(frame, uint32(size>>mm.PageShift)); err != nil {
+		return errRegionInUse.CausedBy(err)
+	}
+
+	page, err := mapRegionFn(frame, size, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute)
+	if err != nil {
+		return err
+	}
+
+	region, regionSize = page.Address(), size
+	if recoverDump() {
+		kfmt.Printf("[pstore] recovered %d bytes of panic data from the previous boot\n", len(lastDump))
+	}
+
+	setPanicHookFn(writeDump)
+	return nil
+}
+
+// WriteLastDump writes the dump recovered from the previous boot to w.
+func WriteLastDump(w io.Writer) {
+	w.Write(lastDump)
+}
+
+// recoverDump copies a valid dump from the region into lastDump and then
+// invalidates the region contents. It returns true if a dump was recovered.
+func recoverDump() bool {
+	hdr := (*header)(unsafe.Pointer(region))
+	if hdr.magic != dumpMagic {
+		return false
+	}
+	hdr.magic = 0
+
+	if uintptr(hdr.length) > regionSize-unsafe.Sizeof(*hdr) {
+		return false
+	}
+
+	data := payload()[:hdr.length]
+	if checksum(data) != hdr.checksum {
+		return false
+	}
+
+	lastDump = append([]byte(nil), data...)
+	return true
+}
+
+// writeDump is invoked by kernel panics. It stores the kernel log followed by
+// a dump of the stack starting at fp in the region.
+func writeDump(fp uintptr) {
+	hdr := (*header)(unsafe.Pointer(region))
+
+	// Invalidate the old dump in case writing the new one fails halfway.
+	hdr.magic = 0
+
+	w := regionWriter{buf: payload()}
+	kfmt.Fprintf(&w, "=== kernel log ===\n")
+	writeLogFn(&w)
+	kfmt.Fprintf(&w, "\n=== stack ===\n")
+	dumpStack(&w, fp)
+
+	hdr.length = uint32(w.len)
+	hdr.checksum = checksum(w.buf[:w.len])
+	hdr.magic = dumpMagic
+}
+
+// dumpStack writes the stack words starting at fp to w. The dump stops at the
+// end of the page that contains fp as the next page might not be mapped.
+func dumpStack(w io.Writer, fp uintptr) {
+	const wordSize = unsafe.Sizeof(fp)
+	if fp == 0 || fp&(wordSize-1) != 0 {
+		kfmt.Fprintf(w, "unavailable\n")
+		return
+	}
+
+	end := fp + stackDumpSize
+	if pageEnd := (fp | (mm.PageSize - 1)) + 1; pageEnd < end {
+		end = pageEnd
+	}
+
+	for addr := fp; addr < end; addr += wordSize {
+		kfmt.Fprintf(w, "0x%16x: 0x%16x\n", addr, *(*uintptr)(unsafe.Pointer(addr)))
+	}
+}
+
+// payload returns a slice covering the region contents after the header.
+func payload() []byte {
+	hdrSize := unsafe.Sizeof(header{})
+	return (*[1 << 32]byte)(unsafe.Pointer(region + hdrSize))[: regionSize-hdrSize : regionSize-hdrSize]
+}
+
+// regionWriter is an io.Writer that fills a fixed buffer and silently drops
+// any output that does not fit.
+type regionWriter struct {
+	buf []byte
+	len int
+}
+
+// Write implements io.Writer.
+func (w *regionWriter) Write(p []byte) (int, error) {
+	w.len += copy(w.buf[w.len:], p)
+	return len(p), nil
+}
+
+// checksum calculates the 32-bit FNV-1a hash of data.
+func checksum(data []byte) uint32 {
+	hash := uint32(2166136261)
+	for _, b := range data {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	return hash
+}
+
+// parseRegion parses a region specification in the SIZE@ADDR format. SIZE is
+// a decimal number with an optional K or M suffix and ADDR is a hex number
+// with an optional 0x prefix.
+func parseRegion(arg string) (size, addr uintptr, ok bool) {
+	sep := strings.IndexByte(arg, '@')
+	if sep <= 0 {
+		return 0, 0, false
+	}
+
+	sizeArg, addrArg := arg[:sep], arg[sep+1:]
+	shift := uint(0)
+	switch sizeArg[len(sizeArg)-1] {
+	case 'K', 'k':
+		shift, sizeArg = 10, sizeArg[:len(sizeArg)-1]
+	case 'M', 'm':
+		shift, sizeArg = 20, sizeArg[:len(sizeArg)-1]
+	}
+
+	if size, ok = parseNumber(sizeArg, 10); !ok || size > (1<<32)>>shift {
+		return 0, 0, false
+	}
+
+	if len(addrArg) > 2 && addrArg[0] == '0' && (addrArg[1] == 'x' || addrArg[1] == 'X') {
+		addrArg = addrArg[2:]
+	}
+
+	if addr, ok = parseNumber(addrArg, 16); !ok {
+		return 0, 0, false
+	}
+
+	return size << shift, addr, true
+}
+
+// parseNumber parses a non-empty number with up to 16 digits in the specified
+// base.
+func parseNumber(s string, base uintptr) (uintptr, bool) {
+	if len(s) == 0 || len(s) > 16 {
+		return 0, false
+	}
+
+	var val uintptr
+	for i := 0; i < len(s); i++ {
+		var digit uintptr
+		switch c := s[i]; {
+		case c >= '0' && c <= '9':
+			digit = uintptr(c - '0')
+		case c >= 'a' && c <= 'f':
+			digit = uintptr(c-'a') + 10
+		case c >= 'A' && c <= 'F':
+			digit = uintptr(c-'A') + 10
+		default:
+			return 0, false
+		}
+
+		if digit >= base {
+			return 0, false
+		}
+		val = val*base + digit
+	}
+
+	return val, true
+}
@@ -0,0 +1,266 @@
+package pstore
+
+import (
+	"bytes"
+	"fmt"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/pmm"
+	"gopheros/kernel/mm/vmm"
+	"io"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+const testRegionSize = 32 * 1024
+
+func restoreMocks() {
+	cmdlineLookupFn = cmdline.Lookup
+	reserveFramesFn = pmm.ReserveFrames
+	mapRegionFn = vmm.MapRegion
+	setPanicHookFn = kfmt.SetPanicHook
+	writeLogFn = kfmt.WriteLog
+	region, regionSize, lastDump = 0, 0, nil
+}
+
+// mockRegion returns a page-aligned buffer that is used in place of the
+// reserved physical memory region.
+func mockRegion() []byte {
+	buf := make([]byte, testRegionSize+mm.PageSize)
+	offset := (mm.PageSize - uintptr(unsafe.Pointer(&buf[0]))&(mm.PageSize-1)) & (mm.PageSize - 1)
+	return buf[offset : offset+testRegionSize]
+}
+
+// mockInit sets up the mocks for a successful call to Init that maps buf as
+// the pstore region.
+func mockInit(buf []byte) *func(uintptr) {
+	var hook func(uintptr)
+	cmdlineLookupFn = func(name string) (string, bool) { return "32K@0x7f00000", name == "pstore" }
+	reserveFramesFn = func(_ mm.Frame, _ uint32) *kernel.Error { return nil }
+	mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		return mm.Page(uintptr(unsafe.Pointer(&buf[0])) >> mm.PageShift), nil
+	}
+	setPanicHookFn = func(fn func(uintptr)) { hook = fn }
+	return &hook
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	t.Run("not configured", func(t *testing.T) {
+		cmdlineLookupFn = func(_ string) (string, bool) { return "", false }
+		setPanicHookFn = func(_ func(uintptr)) { t.Fatal("unexpected call to SetPanicHook") }
+
+		if err := Init(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		buf := mockRegion()
+		hook := mockInit(buf)
+
+		var (
+			reservedFrame mm.Frame
+			reservedCount uint32
+			mapFlags      vmm.PageTableEntryFlag
+		)
+		reserveFramesFn = func(frame mm.Frame, count uint32) *kernel.Error {
+			reservedFrame, reservedCount = frame, count
+			return nil
+		}
+		mapRegionFn = func(frame mm.Frame, size uintptr, flags vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			mapFlags = flags
+			return mm.Page(uintptr(unsafe.Pointer(&buf[0])) >> mm.PageShift), nil
+		}
+
+		if err := Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if reservedFrame != mm.FrameFromAddress(0x7f00000) || reservedCount != 8 {
+			t.Fatalf("expected 8 frames starting at frame 0x7f00 to be reserved; got %d frames starting at 0x%x", reservedCount, reservedFrame)
+		}
+
+		if exp := vmm.FlagPresent | vmm.FlagRW | vmm.FlagNoExecute; mapFlags != exp {
+			t.Fatalf("expected region to be mapped with flags %d; got %d", exp, mapFlags)
+		}
+
+		if *hook == nil {
+			t.Fatal("expected a panic hook to be registered")
+		}
+
+		if regionSize != testRegionSize || len(lastDump) != 0 {
+			t.Fatalf("expected an empty %d byte region; got %d bytes with a %d byte dump", testRegionSize, regionSize, len(lastDump))
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		buf := mockRegion()
+		mockInit(buf)
+
+		specs := []struct {
+			arg    string
+			expErr *kernel.Error
+		}{
+			{"", errInvalidRegion},
+			{"32K", errInvalidRegion},
+			{"@0x1000", errInvalidRegion},
+			{"32K@", errInvalidRegion},
+			{"16K@0x1000", errInvalidRegion},
+			{"32K@0x1001", errInvalidRegion},
+			{"32X@0x1000", errInvalidRegion},
+			{"32K@0xzz", errInvalidRegion},
+			{"8192M@0x1000", errInvalidRegion},
+			{"32K@0x1000", errRegionInUse},
+		}
+
+		reserveErr := &kernel.Error{Module: "bitmap_alloc", Message: "frame is already reserved"}
+		reserveFramesFn = func(_ mm.Frame, _ uint32) *kernel.Error { return reserveErr }
+
+		for specIndex, spec := range specs {
+			cmdlineLookupFn = func(_ string) (string, bool) { return spec.arg, true }
+
+			err := Init()
+			if err == nil || !err.Has(spec.expErr) {
+				t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			}
+		}
+
+		// Errors while reserving the frames are chained
+		cmdlineLookupFn = func(_ string) (string, bool) { return "32K@0x1000", true }
+		if err := Init(); err.Cause != reserveErr {
+			t.Errorf("expected error to be caused by %v; got %v", reserveErr, err.Cause)
+		}
+
+		mapErr := &kernel.Error{Module: "vmm", Message: "out of address space"}
+		reserveFramesFn = func(_ mm.Frame, _ uint32) *kernel.Error { return nil }
+		mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return 0, mapErr
+		}
+		if err := Init(); err != mapErr {
+			t.Errorf("expected error %v; got %v", mapErr, err)
+		}
+	})
+}
+
+func TestDumpAndRecover(t *testing.T) {
+	defer restoreMocks()
+
+	buf := mockRegion()
+	hook := mockInit(buf)
+	writeLogFn = func(w io.Writer) { w.Write([]byte("[test] unrecoverable error: oops\n")) }
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Build a fake stack that starts 16 bytes before the end of a page so
+	// that only two words are dumped.
+	stack := mockRegion()
+	fp := uintptr(unsafe.Pointer(&stack[0])) + mm.PageSize - 16
+	*(*uintptr)(unsafe.Pointer(fp)) = 0xc0ffee
+	*(*uintptr)(unsafe.Pointer(fp + 8)) = 0x101000
+
+	(*hook)(fp)
+
+	// Simulate a warm reboot
+	region, regionSize, lastDump = 0, 0, nil
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	WriteLastDump(&out)
+
+	exp := "=== kernel log ===\n" +
+		"[test] unrecoverable error: oops\n" +
+		"\n=== stack ===\n" +
+		fmt.Sprintf("0x%016x: 0x0000000000c0ffee\n", fp) +
+		fmt.Sprintf("0x%016x: 0x0000000000101000\n", fp+8)
+	if got := out.String(); got != exp {
+		t.Fatalf("expected recovered dump:\n%q\ngot:\n%q", exp, got)
+	}
+
+	// The dump is only recovered once
+	region, regionSize, lastDump = 0, 0, nil
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	if len(lastDump) != 0 {
+		t.Fatal("expected the region to be invalidated after recovering the dump")
+	}
+}
+
+func TestRecoverCorruptedDump(t *testing.T) {
+	defer restoreMocks()
+
+	buf := mockRegion()
+	hook := mockInit(buf)
+	writeLogFn = func(w io.Writer) { w.Write([]byte("log")) }
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	(*hook)(0)
+
+	specs := []func(hdr *header){
+		func(hdr *header) { buf[unsafe.Sizeof(*hdr)] ^= 0xff },
+		func(hdr *header) { hdr.length = testRegionSize },
+	}
+
+	for specIndex, corrupt := range specs {
+		region, lastDump = uintptr(unsafe.Pointer(&buf[0])), nil
+		writeDump(0)
+		corrupt((*header)(unsafe.Pointer(&buf[0])))
+
+		if recoverDump() || len(lastDump) != 0 {
+			t.Errorf("[spec %d] expected corrupted dump to be discarded", specIndex)
+		}
+	}
+}
+
+func TestDumpStack(t *testing.T) {
+	specs := []struct {
+		fp  uintptr
+		exp string
+	}{
+		{0, "unavailable\n"},
+		{0x1003, "unavailable\n"},
+	}
+
+	for specIndex, spec := range specs {
+		var buf bytes.Buffer
+		dumpStack(&buf, spec.fp)
+		if got := buf.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected output %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+
+	// The dump is limited to stackDumpSize bytes
+	stack := mockRegion()
+	var buf bytes.Buffer
+	dumpStack(&buf, uintptr(unsafe.Pointer(&stack[0])))
+	if exp, got := stackDumpSize/8, strings.Count(buf.String(), "\n"); got != exp {
+		t.Fatalf("expected %d stack words to be dumped; got %d", exp, got)
+	}
+}
+
+func TestRegionWriter(t *testing.T) {
+	w := regionWriter{buf: make([]byte, 4)}
+	if n, _ := w.Write([]byte("abc")); n != 3 {
+		t.Fatalf("expected write to return 3; got %d", n)
+	}
+
+	// Output that does not fit is dropped
+	if n, _ := w.Write([]byte("def")); n != 3 {
+		t.Fatalf("expected write to return 3; got %d", n)
+	}
+
+	if got := string(w.buf[:w.len]); got != "abcd" {
+		t.Fatalf("expected buffer to contain %q; got %q", "abcd", got)
+	}
+}
@@ -0,0 +1,97 @@
+package rand
+
+import "encoding/binary"
+
+const (
+	chachaKeyWords  = 8
+	chachaBlockSize = 64
+)
+
+// generator produces a ChaCha20 keystream using a 64-bit block counter and an
+// all-zero nonce.
+type generator struct {
+	key     [chachaKeyWords]uint32
+	counter uint64
+}
+
+// read fills p with keystream and replaces the key with the next block of
+// keystream so that the output cannot be reconstructed from a later state.
+func (g *generator) read(p []byte) {
+	var block [chachaBlockSize]byte
+	for len(p) != 0 {
+		chachaBlock(&block, &g.key, g.counter)
+		g.counter++
+		p = p[copy(p, block[:]):]
+	}
+
+	g.rekey()
+}
+
+// mix XORs data into the key and re-keys the generator after every 32 bytes so
+// that each input affects all subsequent output.
+func (g *generator) mix(data []byte) {
+	for len(data) != 0 {
+		var chunk [4 * chachaKeyWords]byte
+		n := copy(chunk[:], data)
+		data = data[n:]
+
+		for i := range g.key {
+			g.key[i] ^= binary.LittleEndian.Uint32(chunk[4*i:])
+		}
+		g.rekey()
+	}
+}
+
+// rekey replaces the key with a block of keystream.
+func (g *generator) rekey() {
+	var block [chachaBlockSize]byte
+	chachaBlock(&block, &g.key, g.counter)
+	g.counter++
+
+	for i := range g.key {
+		g.key[i] = binary.LittleEndian.Uint32(block[4*i:])
+	}
+}
+
+// chachaBlock computes the ChaCha20 block for the specified key and counter as
+// defined by RFC 8439 with the 64-bit counter and nonce layout of the original
+// ChaCha design.
+func chachaBlock(out *[chachaBlockSize]byte, key *[chachaKeyWords]uint32, counter uint64) {
+	var in, x [16]uint32
+
+	// "expand 32-byte k"
+	in[0], in[1], in[2], in[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	copy(in[4:12], key[:])
+	in[12], in[13] = uint32(counter), uint32(counter>>32)
+
+	x = in
+	for round := 0; round < 10; round++ {
+		quarterRound(&x, 0, 4, 8, 12)
+		quarterRound(&x, 1, 5, 9, 13)
+		quarterRound(&x, 2, 6, 10, 14)
+		quarterRound(&x, 3, 7, 11, 15)
+		quarterRound(&x, 0, 5, 10, 15)
+		quarterRound(&x, 1, 6, 11, 12)
+		quarterRound(&x, 2, 7, 8, 13)
+		quarterRound(&x, 3, 4, 9, 14)
+	}
+
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[4*i:], x[i]+in[i])
+	}
+}
+
+func quarterRound(x *[16]uint32, a, b, c, d int) {
+	x[a] += x[b]
+	x[d] = rotl(x[d]^x[a], 16)
+	x[c] += x[d]
+	x[b] = rotl(x[b]^x[c], 12)
+	x[a] += x[b]
+	x[d] = rotl(x[d]^x[a], 8)
+	x[c] += x[d]
+	x[b] = rotl(x[b]^x[c], 7)
+}
+
+func rotl(v uint32, n uint) uint32 {
+	return v<<n | v>>(32-n)
+}
@@ -0,0 +1,76 @@
+package rand
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestChachaBlock(t *testing.T) {
+	// Test vectors from RFC 8439, appendix A.1
+	specs := []struct {
+		counter uint64
+		exp     string
+	}{
+		{0, "76b8e0ada0f13d90405d6ae55386bd28bdd219b8a08ded1aa836efcc8b770dc7da41597c5157488d7724e03fb8d84a376a43b8f41518a11cc387b669b2ee6586"},
+		{1, "9f07e7be5551387a98ba977c732d080dcb0f29a048e3656912c6533e32ee7aed29b721769ce64e43d57133b074d839d531ed1f28510afb45ace10a1f4b794d6f"},
+	}
+
+	var (
+		key [chachaKeyWords]uint32
+		out [chachaBlockSize]byte
+	)
+	for specIndex, spec := range specs {
+		chachaBlock(&out, &key, spec.counter)
+		if got := hex.EncodeToString(out[:]); got != spec.exp {
+			t.Errorf("[spec %d] expected keystream:\n%s\ngot:\n%s", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	var g generator
+
+	// The first request returns the keystream for the initial key after
+	// which the generator is re-keyed.
+	first := make([]byte, chachaBlockSize+1)
+	g.read(first)
+
+	var (
+		block   [chachaBlockSize]byte
+		zeroKey [chachaKeyWords]uint32
+	)
+	chachaBlock(&block, &zeroKey, 0)
+	if !bytes.Equal(first[:chachaBlockSize], block[:]) {
+		t.Fatal("expected the generator to output the ChaCha20 keystream")
+	}
+
+	if g.key == zeroKey || g.counter != 3 {
+		t.Fatalf("expected the generator to be re-keyed after the request; counter %d", g.counter)
+	}
+
+	// Identical states produce identical output until different data is
+	// mixed in.
+	a, b := g, g
+	outA, outB := make([]byte, 16), make([]byte, 16)
+	a.read(outA)
+	b.read(outB)
+	if !bytes.Equal(outA, outB) {
+		t.Fatal("expected identical generators to produce the same output")
+	}
+
+	a.mix([]byte("entropy"))
+	b.mix([]byte("entropz"))
+	a.read(outA)
+	b.read(outB)
+	if bytes.Equal(outA, outB) {
+		t.Fatal("expected mixed data to change the generator output")
+	}
+
+	// Data longer than the key is mixed in chunks
+	counter := a.counter
+	a.mix(make([]byte, 4*chachaKeyWords+1))
+	if a.counter != counter+2 {
+		t.Fatalf("expected 2 re-keying operations; got %d", a.counter-counter)
+	}
+}
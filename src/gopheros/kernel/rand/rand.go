@@ -0,0 +1,161 @@
+// Package rand implements the kernel random number generator.
+//
+// Random numbers are produced by a ChaCha20-based generator that is re-keyed
+// with its own output after every request so that past output cannot be
+// reconstructed from the generator state. The generator is seeded by Init
+// using the RDSEED and RDRAND instructions when CPUID advertises them and the
+// time-stamp counter. Before each request, fresh RDRAND output and the current
+// TSC value are mixed into the key. Hardware random number generators (e.g.
+// virtio-rng) contribute entropy via AddEntropy.
+package rand
+
+import (
+	"encoding/binary"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+)
+
+const (
+	cpuidECXRDRAND = uint32(1 << 30)
+	cpuidEBXRDSEED = uint32(1 << 18)
+
+	// hwRetries is the number of attempts to obtain a value from the CPU
+	// random number generator before giving up, as recommended by Intel.
+	hwRetries = 10
+
+	// seedWords is the number of RDSEED or RDRAND values mixed into the
+	// generator key when it is seeded or before each request.
+	seedWords = 4
+)
+
+var (
+	gen generator
+
+	hasRDRAND, hasRDSEED bool
+
+	// The following functions are used by tests to mock calls to the cpu
+	// package.
+	cpuidFn             = cpu.ID
+	rdrandFn            = cpu.RDRAND
+	rdseedFn            = cpu.RDSEED
+	readTSCFn           = cpu.ReadTSC
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn  = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+)
+
+// Init detects the random number generators provided by the CPU and seeds the
+// kernel generator. It must be invoked before any random numbers are
+// requested.
+func Init() {
+	if maxLeaf, _, _, _ := cpuidFn(0); maxLeaf >= 7 {
+		_, ebx, _, _ := cpuidFn(7)
+		hasRDSEED = ebx&cpuidEBXRDSEED != 0
+	}
+	_, _, ecx, _ := cpuidFn(1)
+	hasRDRAND = ecx&cpuidECXRDRAND != 0
+
+	var sources string
+	switch {
+	case hasRDSEED && hasRDRAND:
+		sources = "RDSEED, RDRAND, TSC"
+	case hasRDSEED:
+		sources = "RDSEED, TSC"
+	case hasRDRAND:
+		sources = "RDRAND, TSC"
+	default:
+		sources = "TSC"
+	}
+
+	seedFn := rdrandFn
+	if hasRDSEED {
+		seedFn = rdseedFn
+	}
+
+	intr := lock()
+	gen.mix(hwSeed(hasRDSEED || hasRDRAND, seedFn))
+	unlock(intr)
+
+	kfmt.Printf("[rand] entropy sources: %s\n", sources)
+}
+
+// Read fills p with random bytes.
+func Read(p []byte) {
+	intr := lock()
+	gen.mix(hwSeed(hasRDRAND, rdrandFn))
+	gen.read(p)
+	unlock(intr)
+}
+
+// Uint32 returns a random 32-bit value.
+func Uint32() uint32 {
+	var buf [4]byte
+	Read(buf[:])
+	return binary.LittleEndian.Uint32(buf[:])
+}
+
+// Uint64 returns a random 64-bit value.
+func Uint64() uint64 {
+	var buf [8]byte
+	Read(buf[:])
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// AddEntropy mixes the output of a hardware random number generator into the
+// generator key. It may be invoked from interrupt context.
+func AddEntropy(data []byte) {
+	intr := lock()
+	gen.mix(data)
+	unlock(intr)
+}
+
+// EarlyUint64 returns a random value obtained via RDRAND, if supported by the
+// CPU, mixed with the current TSC value. Unlike Uint64, it neither allocates
+// memory nor requires Init to be invoked, so it can be used during early boot
+// to randomize the kernel memory layout. Without RDRAND, its output is
+// predictable and must not be used for other purposes.
+func EarlyUint64() uint64 {
+	val := readTSCFn()
+
+	if _, _, ecx, _ := cpuidFn(1); ecx&cpuidECXRDRAND != 0 {
+		for attempt := 0; attempt < hwRetries; attempt++ {
+			if hwVal, ok := rdrandFn(); ok {
+				return val ^ hwVal
+			}
+		}
+	}
+
+	return val
+}
+
+// hwSeed returns the current TSC value followed, if useHW is set, by seedWords
+// values obtained from fn. Values that fn fails to provide are left as zero.
+func hwSeed(useHW bool, fn func() (uint64, bool)) []byte {
+	var buf [8 * (1 + seedWords)]byte
+	binary.LittleEndian.PutUint64(buf[:], readTSCFn())
+
+	if useHW {
+		for i := 1; i <= seedWords; i++ {
+			for attempt := 0; attempt < hwRetries; attempt++ {
+				if val, ok := fn(); ok {
+					binary.LittleEndian.PutUint64(buf[8*i:], val)
+					break
+				}
+			}
+		}
+	}
+
+	return buf[:]
+}
+
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+	return intr
+}
+
+func unlock(intr bool) {
+	if intr {
+		enableInterruptsFn()
+	}
+}
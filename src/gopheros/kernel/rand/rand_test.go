@@ -0,0 +1,178 @@
+package rand
+
+import (
+	"bytes"
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+func restoreMocks() {
+	cpuidFn = cpu.ID
+	rdrandFn = cpu.RDRAND
+	rdseedFn = cpu.RDSEED
+	readTSCFn = cpu.ReadTSC
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	hasRDRAND, hasRDSEED = false, false
+	gen = generator{}
+}
+
+func mockInterrupts() {
+	interruptsEnabledFn = func() bool { return false }
+	enableInterruptsFn = func() {}
+	disableInterruptsFn = func() {}
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	readTSCFn = func() uint64 { return 42 }
+
+	specs := []struct {
+		maxLeaf, leaf7EBX, leaf1ECX uint32
+		expRDRAND, expRDSEED        bool
+		expSeedCalls                int
+		expRandCalls                int
+	}{
+		{0xd, cpuidEBXRDSEED, cpuidECXRDRAND, true, true, seedWords, 0},
+		{0xd, 0, cpuidECXRDRAND, true, false, 0, seedWords},
+		// Leaf 7 is ignored if the CPU does not support it
+		{0x6, cpuidEBXRDSEED, 0, false, false, 0, 0},
+		{0xd, 0, 0, false, false, 0, 0},
+	}
+
+	for specIndex, spec := range specs {
+		var seedCalls, randCalls int
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			switch leaf {
+			case 0:
+				return spec.maxLeaf, 0, 0, 0
+			case 1:
+				return 0, 0, spec.leaf1ECX, 0
+			case 7:
+				return 0, spec.leaf7EBX, 0, 0
+			}
+			return 0, 0, 0, 0
+		}
+		rdseedFn = func() (uint64, bool) { seedCalls++; return 1, true }
+		rdrandFn = func() (uint64, bool) { randCalls++; return 2, true }
+		gen = generator{}
+
+		Init()
+
+		if hasRDRAND != spec.expRDRAND || hasRDSEED != spec.expRDSEED {
+			t.Errorf("[spec %d] expected RDRAND %t and RDSEED %t; got %t and %t", specIndex, spec.expRDRAND, spec.expRDSEED, hasRDRAND, hasRDSEED)
+		}
+
+		if seedCalls != spec.expSeedCalls || randCalls != spec.expRandCalls {
+			t.Errorf("[spec %d] expected %d RDSEED and %d RDRAND calls; got %d and %d", specIndex, spec.expSeedCalls, spec.expRandCalls, seedCalls, randCalls)
+		}
+
+		if gen.key == (generator{}).key {
+			t.Errorf("[spec %d] expected the generator to be seeded", specIndex)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var (
+		tsc       uint64
+		randCalls int
+	)
+	readTSCFn = func() uint64 { return tsc }
+	rdrandFn = func() (uint64, bool) {
+		// Fail every other attempt
+		randCalls++
+		return uint64(randCalls), randCalls%2 == 0
+	}
+
+	bufA, bufB := make([]byte, 100), make([]byte, 100)
+	Read(bufA)
+	if randCalls != 0 {
+		t.Fatal("expected RDRAND not to be used if the CPU does not support it")
+	}
+
+	// The TSC value is mixed in before each request
+	saved := gen
+	Read(bufA)
+	gen, tsc = saved, tsc+1
+	Read(bufB)
+	if bytes.Equal(bufA, bufB) {
+		t.Fatal("expected the TSC value to affect the output")
+	}
+
+	hasRDRAND = true
+	Read(bufA)
+	if exp := 2 * seedWords; randCalls != exp {
+		t.Fatalf("expected %d RDRAND attempts; got %d", exp, randCalls)
+	}
+
+	// The remaining values are left as zero if RDRAND keeps failing
+	rdrandFn = func() (uint64, bool) { randCalls++; return 0, false }
+	randCalls = 0
+	Read(bufA)
+	if exp := hwRetries * seedWords; randCalls != exp {
+		t.Fatalf("expected %d RDRAND attempts; got %d", exp, randCalls)
+	}
+
+	if a, b := Uint32(), Uint32(); a == b {
+		t.Fatalf("expected Uint32 to return different values; got %d twice", a)
+	}
+
+	if a, b := Uint64(), Uint64(); a == b {
+		t.Fatalf("expected Uint64 to return different values; got %d twice", a)
+	}
+}
+
+func TestAddEntropy(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+	readTSCFn = func() uint64 { return 0 }
+
+	saved := gen
+	bufA, bufB := make([]byte, 16), make([]byte, 16)
+	Read(bufA)
+
+	gen = saved
+	AddEntropy([]byte{1, 2, 3, 4})
+	Read(bufB)
+
+	if bytes.Equal(bufA, bufB) {
+		t.Fatal("expected added entropy to change the generator output")
+	}
+}
+
+func TestEarlyUint64(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		ecx       uint32
+		randCalls int
+		randOK    bool
+	)
+	cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) { return 0, 0, ecx, 0 }
+	readTSCFn = func() uint64 { return 0xf0 }
+	rdrandFn = func() (uint64, bool) { randCalls++; return 0x0f, randOK }
+
+	specs := []struct {
+		ecx          uint32
+		randOK       bool
+		exp          uint64
+		expRandCalls int
+	}{
+		{0, true, 0xf0, 0},
+		{cpuidECXRDRAND, true, 0xff, 1},
+		{cpuidECXRDRAND, false, 0xf0, hwRetries},
+	}
+
+	for specIndex, spec := range specs {
+		ecx, randOK, randCalls = spec.ecx, spec.randOK, 0
+		if got := EarlyUint64(); got != spec.exp || randCalls != spec.expRandCalls {
+			t.Errorf("[spec %d] expected to get 0x%x with %d RDRAND calls; got 0x%x with %d calls", specIndex, spec.exp, spec.expRandCalls, got, randCalls)
+		}
+	}
+}
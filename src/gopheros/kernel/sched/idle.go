@@ -0,0 +1,141 @@
+package sched
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// IdleMethod describes how an idle processor waits for work.
+type IdleMethod uint32
+
+const (
+	// IdleHalt halts the processor until the next interrupt. Other
+	// processors send an IPI to wake it up.
+	IdleHalt IdleMethod = iota
+
+	// IdleMWait waits using MONITOR/MWAIT on the halted flag of the
+	// processor. Other processors wake it up by clearing the flag which
+	// avoids sending an IPI.
+	IdleMWait
+)
+
+const (
+	// cpuidMonitor is set in ECX of CPUID leaf 1 if the CPU supports the
+	// MONITOR and MWAIT instructions.
+	cpuidMonitor = uint32(1 << 3)
+
+	// mwaitHintC1 requests the C1 state; deeper C-states require
+	// processor-specific hints.
+	mwaitHintC1 = uint32(0)
+)
+
+// String implements fmt.Stringer for IdleMethod.
+func (m IdleMethod) String() string {
+	switch m {
+	case IdleMWait:
+		return "mwait"
+	default:
+		return "halt"
+	}
+}
+
+// IdleStats describes how long a processor spent waiting for work.
+type IdleStats struct {
+	// Method is the method the processor uses for idling.
+	Method IdleMethod
+
+	// Time is the total time, in nanoseconds, that the processor spent
+	// halted. Entries counts the times the processor halted.
+	Time    uint64
+	Entries uint64
+}
+
+var (
+	// idleMethod is the method used by processors entering the idle
+	// state. It is selected by Init.
+	idleMethod = IdleHalt
+)
+
+// selectIdleMethod returns IdleMWait if the CPU supports MONITOR/MWAIT, unless
+// the idle=halt boot option is specified, and IdleHalt otherwise.
+func selectIdleMethod() IdleMethod {
+	if cmdlineGetFn("idle") == "halt" {
+		return IdleHalt
+	}
+
+	if _, _, ecx, _ := cpuidFn(1); ecx&cpuidMonitor != 0 {
+		return IdleMWait
+	}
+	return IdleHalt
+}
+
+// VisitIdleStats invokes visitor with the index and idle statistics of each
+// online processor.
+func VisitIdleStats(visitor func(index int, stats IdleStats)) {
+	for index := range cpus {
+		c := &cpus[index]
+		if !c.online {
+			continue
+		}
+
+		visitor(index, IdleStats{
+			Method:  IdleMethod(atomic.LoadUint32(&c.idleMethod)),
+			Time:    atomic.LoadUint64(&c.idleTime),
+			Entries: atomic.LoadUint64(&c.idleEntries),
+		})
+	}
+}
+
+// enterIdle marks the processor described by c as halted so that other
+// processors wake it up when they queue a thread for it. It must be invoked
+// with interrupts disabled.
+func enterIdle(c *cpuState) {
+	atomic.StoreUint32(&c.idleMethod, uint32(idleMethod))
+	atomic.StoreUint32(&c.halted, 1)
+}
+
+// exitIdle clears the halted flag of the processor described by c.
+func exitIdle(c *cpuState) {
+	atomic.StoreUint32(&c.halted, 0)
+}
+
+// waitIdle halts the processor described by c, which must have been marked as
+// halted by enterIdle, until an interrupt arrives or another processor wakes
+// it up. It must be invoked with interrupts disabled and returns with
+// interrupts enabled. The time spent halted is accounted to the idle
+// statistics of the processor.
+//
+// As waitIdle runs on the application processors, it must not allocate memory.
+func waitIdle(c *cpuState) {
+	start := clockFn()
+
+	if IdleMethod(atomic.LoadUint32(&c.idleMethod)) == IdleMWait {
+		// A processor that queued a thread after the caller checked
+		// for runnable threads but before the monitor was armed has
+		// already cleared the halted flag.
+		monitorFn(uintptr(unsafe.Pointer(&c.halted)))
+		if atomic.LoadUint32(&c.halted) == 0 {
+			enableInterruptsFn()
+			return
+		}
+		mwaitFn(mwaitHintC1)
+	} else {
+		waitForInterruptFn()
+	}
+
+	atomic.AddUint64(&c.idleTime, clockFn()-start)
+	atomic.AddUint64(&c.idleEntries, 1)
+}
+
+// wakeCPU wakes up the halted processor with the specified index.
+func wakeCPU(index int) {
+	c := &cpus[index]
+	if IdleMethod(atomic.LoadUint32(&c.idleMethod)) == IdleMWait {
+		atomic.StoreUint32(&c.halted, 0)
+		return
+	}
+
+	if kickFn != nil {
+		kickFn(index)
+	}
+}
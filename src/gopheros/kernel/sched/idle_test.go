@@ -0,0 +1,138 @@
+package sched
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestSelectIdleMethod(t *testing.T) {
+	defer restoreMocks()
+
+	specs := []struct {
+		ecx    uint32
+		option string
+		exp    IdleMethod
+	}{
+		{0, "", IdleHalt},
+		{cpuidMonitor, "", IdleMWait},
+		{cpuidMonitor, "halt", IdleHalt},
+	}
+
+	for specIndex, spec := range specs {
+		cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) { return 0, 0, spec.ecx, 0 }
+		cmdlineGetFn = func(name string) string {
+			if name == "idle" {
+				return spec.option
+			}
+			return ""
+		}
+
+		if got := selectIdleMethod(); got != spec.exp {
+			t.Errorf("[spec %d] expected idle method %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestIdleStats(t *testing.T) {
+	defer restoreMocks()
+	m := &mockCPU{}
+	m.install()
+	Init()
+
+	var now uint64
+	clockFn = func() uint64 { return now }
+	waitForInterruptFn = func() {
+		if cpus[0].halted != 1 {
+			t.Error("expected processor to be marked as halted while waiting")
+		}
+		now += 1500
+		m.intrEnabled = true
+	}
+
+	runOnce()
+	runOnce()
+
+	var visited int
+	VisitIdleStats(func(index int, stats IdleStats) {
+		visited++
+		if index != 0 || stats.Method != IdleHalt || stats.Time != 3000 || stats.Entries != 2 {
+			t.Errorf("unexpected idle stats for processor %d: %+v", index, stats)
+		}
+	})
+
+	if visited != 1 {
+		t.Errorf("expected idle stats for 1 online processor; got %d", visited)
+	}
+
+	if cpus[0].halted != 0 {
+		t.Error("expected halted flag to be cleared after waking up")
+	}
+}
+
+func TestIdleMWait(t *testing.T) {
+	defer restoreMocks()
+	m := &mockCPU{}
+	m.install()
+	cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) { return 0, 0, cpuidMonitor, 0 }
+	Init()
+	onlineAP(1)
+
+	var (
+		kicked    int
+		monitored uintptr
+		waits     int
+		th        *Thread
+	)
+	SetKick(func(_ int) { kicked++ })
+	waitForInterruptFn = func() { t.Error("expected processor to idle using MWAIT") }
+	monitorFn = func(addr uintptr) { monitored = addr }
+	mwaitFn = func(hint uint32) {
+		waits++
+		m.intrEnabled = true
+
+		// Emulate the boot processor queueing a thread for processor 1
+		// which clears the monitored halted flag instead of kicking it.
+		cpuIndexFn = func() int { return 0 }
+		th, _ = newTestThread(t, "t1")
+		th.affinity = 1 << 1
+		Ready(th)
+		cpuIndexFn = func() int { return 1 }
+	}
+
+	cpuIndexFn = func() int { return 1 }
+	runOnce()
+
+	if exp := uintptr(unsafe.Pointer(&cpus[1].halted)); monitored != exp {
+		t.Errorf("expected the halted flag of processor 1 to be monitored")
+	}
+
+	if waits != 1 || kicked != 0 {
+		t.Errorf("expected 1 MWAIT and no kicks; got %d waits and %d kicks", waits, kicked)
+	}
+
+	if th.queueCPU != 1 || cpus[1].halted != 0 {
+		t.Error("expected the thread to be queued on processor 1 and its halted flag to be cleared")
+	}
+
+	// If the halted flag is cleared before the monitor is armed, the
+	// processor must not wait.
+	monitorFn = func(_ uintptr) { cpus[1].halted = 0 }
+	mwaitFn = func(_ uint32) { t.Error("expected processor not to wait after being woken up") }
+	c := &cpus[1]
+	enterIdle(c)
+	m.intrEnabled = false
+	waitIdle(c)
+	if !m.intrEnabled || c.idleEntries != 1 {
+		t.Errorf("expected interrupts to be enabled and the wakeup not to count as an idle entry; entries %d", c.idleEntries)
+	}
+}
+
+func TestIdleMethodString(t *testing.T) {
+	if got := IdleHalt.String(); got != "halt" {
+		t.Errorf("expected %q; got %q", "halt", got)
+	}
+
+	if got := IdleMWait.String(); got != "mwait" {
+		t.Errorf("expected %q; got %q", "mwait", got)
+	}
+}
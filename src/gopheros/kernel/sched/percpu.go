@@ -0,0 +1,334 @@
+package sched
+
+import (
+	"gopheros/kernel"
+	"sync/atomic"
+)
+
+// MaxCPUs is the maximum number of processors supported by the scheduler.
+const MaxCPUs = 64
+
+// AffinityMask is a bitmask of the processors a thread may run on. Bit N
+// corresponds to the processor with index N.
+type AffinityMask uint64
+
+const (
+	// AffinityBoot only includes the boot processor. It is the default
+	// affinity of new threads.
+	AffinityBoot AffinityMask = 1
+
+	// AffinityAll includes all processors.
+	AffinityAll AffinityMask = ^AffinityMask(0)
+)
+
+// Has returns true if the mask includes the processor with the specified
+// index.
+func (m AffinityMask) Has(index int) bool {
+	return index >= 0 && index < MaxCPUs && m&(1<<uint(index)) != 0
+}
+
+// cpuState holds the scheduler state of a processor.
+type cpuState struct {
+	// current points to the thread that runs on the processor and idle to
+	// the thread that runs when no other thread is runnable.
+	current, idle *Thread
+
+	runQueue priorityQueue
+
+	// switchedFrom points to the thread that was running before the last
+	// context switch.
+	switchedFrom *Thread
+
+	// resumeInterrupts holds the interrupt state of the context that
+	// switched to a newly started thread. The new thread restores it once
+	// it begins executing.
+	resumeInterrupts bool
+
+	// online is set once the processor runs its idle thread.
+	online bool
+
+	// halted is set while the processor is halted (or about to halt)
+	// waiting for an interrupt. idleMethod holds the IdleMethod that the
+	// processor uses while halted.
+	halted     uint32
+	idleMethod uint32
+
+	// idleTime and idleEntries track the time the processor spent halted
+	// and the number of times it halted.
+	idleTime    uint64
+	idleEntries uint64
+}
+
+var (
+	// idleThreads holds the idle threads of the application processors.
+	// They are statically allocated as the application processors cannot
+	// allocate memory.
+	idleThreads [MaxCPUs]Thread
+)
+
+// SetCPUIndex registers a function that returns the index of the calling
+// processor. It must be invoked before any application processor calls
+// RunAP.
+func SetCPUIndex(fn func() int) {
+	cpuIndexFn = fn
+}
+
+// SetKick registers a function that interrupts the processor with the
+// specified index. The scheduler uses it to wake up halted processors when a
+// thread is queued for them.
+func SetKick(fn func(int)) {
+	kickFn = fn
+}
+
+// cpuIndex returns the index of the calling processor.
+func cpuIndex() int {
+	if index := cpuIndexFn(); index > 0 && index < MaxCPUs {
+		return index
+	}
+	return 0
+}
+
+// Affinity returns the thread's affinity mask.
+func (t *Thread) Affinity() AffinityMask {
+	return t.affinity
+}
+
+// CPU returns the index of the processor that last ran the thread.
+func (t *Thread) CPU() int {
+	return t.lastCPU
+}
+
+// MarkNonAllocating declares that the thread never allocates memory, blocks on
+// wait queues or otherwise depends on the Go runtime, none of which are safe to
+// use from the application processors. Only marked threads may have an
+// affinity mask that includes application processors.
+func (t *Thread) MarkNonAllocating() {
+	intr := lock()
+	t.nonAllocating = true
+	unlock(intr)
+}
+
+// NonAllocating returns true if the thread was marked via MarkNonAllocating.
+func (t *Thread) NonAllocating() bool {
+	return t.nonAllocating
+}
+
+// SetAffinity restricts the processors the thread may run on to the ones
+// included in mask. A runnable thread that is queued on a processor that is no
+// longer included in the mask is moved to the run queue of an allowed
+// processor; a running thread migrates the next time it is switched away
+// from.
+//
+// An error is returned if mask does not include any online processor or if it
+// includes application processors and the thread is not marked as
+// non-allocating.
+func (t *Thread) SetAffinity(mask AffinityMask) *kernel.Error {
+	intr := lock()
+	defer unlock(intr)
+
+	if mask&^AffinityBoot != 0 && !t.nonAllocating {
+		return errAllocatingAP
+	}
+
+	if mask&onlineMask() == 0 {
+		return errNoOnlineCPU
+	}
+
+	t.affinity = mask
+	if t.state == StateRunnable && !t.onCPU && !mask.Has(t.queueCPU) && cpus[t.queueCPU].runQueue.remove(t) {
+		enqueue(t)
+	}
+	return nil
+}
+
+// onlineMask returns a mask with the online processors. It must be invoked
+// with the scheduler lock held.
+func onlineMask() AffinityMask {
+	var mask AffinityMask
+	for index := range cpus {
+		if cpus[index].online {
+			mask |= 1 << uint(index)
+		}
+	}
+	return mask
+}
+
+// enqueue appends a runnable thread to the run queue of the least loaded online
+// processor included in its affinity mask, preferring the processor that last
+// ran it. A thread that is still running is always queued on its processor as
+// no other processor may pick it up until its context has been saved. It must
+// be invoked with the scheduler lock held.
+func enqueue(t *Thread) {
+	target := t.lastCPU
+	if !t.onCPU {
+		best := -1
+		for index := range cpus {
+			c := &cpus[index]
+			if !c.online || !t.affinity.Has(index) {
+				continue
+			}
+
+			load := c.runQueue.count
+			if c.current != nil && c.current != c.idle {
+				load++
+			}
+
+			score := 2 * load
+			if index != t.lastCPU {
+				score++
+			}
+
+			if best == -1 || score < best {
+				target, best = index, score
+			}
+		}
+	}
+
+	t.queueCPU = target
+	cpus[target].runQueue.push(t)
+
+	if target != cpuIndex() && atomic.LoadUint32(&cpus[target].halted) != 0 {
+		wakeCPU(target)
+	}
+}
+
+// pickNext removes and returns the next thread to run on the processor with
+// the specified index. Threads are taken from the local run queue and, if it
+// is empty, stolen from other processors; if no thread is runnable, the idle
+// thread of the processor is returned. It returns nil if the processor does
+// not have an idle thread and no thread is runnable. It must be invoked with
+// the scheduler lock held.
+func pickNext(index int) *Thread {
+	c := &cpus[index]
+
+	next := c.runQueue.pop()
+	if next == nil {
+		next = steal(index)
+	}
+
+	// A running thread whose affinity no longer includes this processor
+	// is re-queued by finishSwitch once the processor switches away from it.
+	if next != nil && !next.affinity.Has(index) && c.idle != nil && c.idle != next {
+		if other := c.runQueue.pop(); other != nil {
+			c.runQueue.push(next)
+			next = other
+		} else {
+			c.runQueue.push(next)
+			next = c.idle
+		}
+	}
+
+	if next == nil {
+		next = c.idle
+	}
+	return next
+}
+
+// steal removes and returns a thread that may run on the processor with the
+// specified index from the run queue of the most loaded other processor. It
+// returns nil if no such thread exists. It must be invoked with the scheduler
+// lock held.
+func steal(index int) *Thread {
+	victim, t := stealCandidate(index)
+	if t == nil {
+		return nil
+	}
+
+	cpus[victim].runQueue.remove(t)
+	return t
+}
+
+// stealCandidate returns the index of the most loaded processor whose run
+// queue contains a thread that may be stolen by the processor with the
+// specified index along with the thread with the highest priority in that run
+// queue. Application processors never steal threads that are not marked as
+// non-allocating.
+func stealCandidate(index int) (int, *Thread) {
+	var (
+		victim    = -1
+		candidate *Thread
+	)
+
+	for other := range cpus {
+		c := &cpus[other]
+		if other == index || !c.online || (victim != -1 && c.runQueue.count <= cpus[victim].runQueue.count) {
+			continue
+		}
+
+	scan:
+		for level := range c.runQueue.levels {
+			for t := c.runQueue.levels[level].head; t != nil; t = t.next {
+				if !t.onCPU && t.affinity.Has(index) && (index == 0 || t.nonAllocating) {
+					victim, candidate = other, t
+					break scan
+				}
+			}
+		}
+	}
+
+	return victim, candidate
+}
+
+// runnable returns true if the processor with the specified index has a
+// thread to run other than its idle thread.
+func runnable(index int) bool {
+	intr := lock()
+	defer unlock(intr)
+
+	if !cpus[index].runQueue.empty() {
+		return true
+	}
+
+	_, t := stealCandidate(index)
+	return t != nil
+}
+
+// RunAP turns the calling context into the idle thread of the application
+// processor with the specified index. Once the idle thread is registered, the
+// processor runs the threads whose affinity mask includes it and steals
+// runnable threads from other processors. It never returns.
+//
+// As the Go runtime is not aware of the application processors, the idle
+// thread must not allocate memory and only threads marked as non-allocating
+// are scheduled on the processor.
+func RunAP(index int) {
+	startAP(index)
+	for {
+		runOnce()
+	}
+}
+
+// startAP registers the calling context as the idle thread of the processor
+// with the specified index and marks the processor as online.
+func startAP(index int) {
+	lo, hi := currentStackBoundsFn()
+	t := &idleThreads[index]
+	t.name = "idle"
+	t.state = StateRunning
+	t.nice = MaxNice
+	t.started = true
+	t.onCPU = true
+	t.affinity = 1 << uint(index)
+	t.nonAllocating = true
+	t.queueCPU, t.lastCPU = index, index
+	t.since = clockFn()
+	t.ctx = context{stackLo: lo, stackHi: hi}
+	addThread(t)
+
+	intr := lock()
+	c := &cpus[index]
+	c.current, c.idle = t, t
+	c.online = true
+	unlock(intr)
+}
+
+// acquireSpinlock spins until it acquires the spinlock stored at ptr.
+func acquireSpinlock(ptr *uint32) {
+	for !atomic.CompareAndSwapUint32(ptr, 0, 1) {
+	}
+}
+
+// releaseSpinlock releases the spinlock stored at ptr.
+func releaseSpinlock(ptr *uint32) {
+	atomic.StoreUint32(ptr, 0)
+}
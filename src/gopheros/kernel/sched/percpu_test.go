@@ -0,0 +1,315 @@
+package sched
+
+import "testing"
+
+// onlineAP emulates an application processor with the specified index that
+// has registered its idle thread.
+func onlineAP(index int) *Thread {
+	prev := cpuIndexFn
+	cpuIndexFn = func() int { return index }
+	startAP(index)
+	cpuIndexFn = prev
+	return &idleThreads[index]
+}
+
+func TestAffinityMask(t *testing.T) {
+	specs := []struct {
+		mask  AffinityMask
+		index int
+		exp   bool
+	}{
+		{AffinityBoot, 0, true},
+		{AffinityBoot, 1, false},
+		{AffinityAll, MaxCPUs - 1, true},
+		{AffinityAll, MaxCPUs, false},
+		{AffinityAll, -1, false},
+		{0x6, 2, true},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.mask.Has(spec.index); got != spec.exp {
+			t.Errorf("[spec %d] expected Has(%d) to return %t; got %t", specIndex, spec.index, spec.exp, got)
+		}
+	}
+}
+
+func TestStartAP(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+	Init()
+
+	idle := onlineAP(3)
+	if idle.Name() != "idle" || idle.State() != StateRunning || idle.Nice() != MaxNice || idle.CPU() != 3 {
+		t.Fatalf("unexpected idle thread: %+v", idle)
+	}
+
+	if idle.Affinity() != 1<<3 {
+		t.Errorf("expected idle thread affinity to only include its processor; got %x", idle.Affinity())
+	}
+
+	if c := &cpus[3]; !c.online || c.current != idle || c.idle != idle {
+		t.Error("expected processor 3 to be online and running its idle thread")
+	}
+
+	if LookupThread(idle.ID()) != idle {
+		t.Error("expected idle thread to be added to the thread list")
+	}
+
+	if lockOwner != 0 || lockDepth != 0 {
+		t.Errorf("expected scheduler lock to be released; owner %d, depth %d", lockOwner, lockDepth)
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+	Init()
+	onlineAP(1)
+	onlineAP(2)
+
+	var kicked []int
+	SetKick(func(index int) { kicked = append(kicked, index) })
+	cpus[2].halted = 1
+
+	var threads [4]*Thread
+	for i := range threads {
+		threads[i], _ = newTestThread(t, "t")
+		threads[i].affinity = AffinityAll
+		Ready(threads[i])
+	}
+
+	// The boot processor is busy running the boot thread so the first
+	// threads should be spread among the idle application processors.
+	for specIndex, exp := range []int{1, 2, 0, 1} {
+		if got := threads[specIndex].queueCPU; got != exp {
+			t.Errorf("[spec %d] expected thread to be queued on processor %d; got %d", specIndex, exp, got)
+		}
+	}
+
+	if len(kicked) != 1 || kicked[0] != 2 {
+		t.Errorf("expected the halted processor 2 to be kicked; got %v", kicked)
+	}
+
+	// Threads with the default affinity only run on the boot processor
+	th, _ := newTestThread(t, "boot-only")
+	Ready(th)
+	if th.queueCPU != 0 {
+		t.Errorf("expected thread with default affinity to be queued on processor 0; got %d", th.queueCPU)
+	}
+}
+
+func TestSetAffinity(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+	Init()
+	onlineAP(1)
+
+	th, _ := newTestThread(t, "t1")
+	Ready(th)
+	if th.queueCPU != 0 {
+		t.Fatalf("expected thread to be queued on processor 0; got %d", th.queueCPU)
+	}
+
+	// Threads that may allocate memory cannot run on application
+	// processors
+	if err := th.SetAffinity(AffinityAll); err != errAllocatingAP {
+		t.Fatalf("expected errAllocatingAP; got %v", err)
+	}
+
+	if th.NonAllocating() {
+		t.Fatal("expected new threads not to be marked as non-allocating")
+	}
+
+	th.MarkNonAllocating()
+	if !th.NonAllocating() {
+		t.Fatal("expected thread to be marked as non-allocating")
+	}
+
+	if err := th.SetAffinity(1 << 5); err != errNoOnlineCPU {
+		t.Fatalf("expected errNoOnlineCPU; got %v", err)
+	}
+
+	if th.Affinity() != AffinityBoot {
+		t.Fatal("expected affinity not to change when SetAffinity fails")
+	}
+
+	if err := th.SetAffinity(1 << 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if th.queueCPU != 1 || !cpus[0].runQueue.empty() || cpus[1].runQueue.count != 1 {
+		t.Fatal("expected thread to be moved to the run queue of processor 1")
+	}
+}
+
+func TestSteal(t *testing.T) {
+	defer restoreMocks()
+	m := &mockCPU{}
+	m.install()
+	Init()
+	idle := onlineAP(1)
+
+	pinned, _ := newTestThread(t, "pinned")
+	movable, _ := newTestThread(t, "movable")
+	Ready(pinned)
+	Ready(movable)
+	movable.affinity = AffinityAll
+
+	// Application processors only steal non-allocating threads
+	if runnable(1) {
+		t.Fatal("expected processor 1 not to steal a thread that may allocate memory")
+	}
+	movable.nonAllocating = true
+
+	if !runnable(1) {
+		t.Fatal("expected processor 1 to find a thread to steal")
+	}
+
+	// Schedule on processor 1; it should steal the thread that is allowed
+	// to run on it and count the migration once it runs there again.
+	cpuIndexFn = func() int { return 1 }
+	movable.started, movable.lastCPU = true, 0
+	Yield()
+
+	if Current() != movable || movable.CPU() != 1 || movable.Stats().Migrations != 1 {
+		t.Fatalf("expected processor 1 to run the stolen thread; got %q", Current().Name())
+	}
+
+	if pinned.queueCPU != 0 || cpus[0].runQueue.count != 1 {
+		t.Error("expected the pinned thread to remain queued on processor 0")
+	}
+
+	if runnable(1) {
+		t.Error("expected processor 1 not to find any other thread to run")
+	}
+
+	// Once the stolen thread blocks, processor 1 switches to its idle
+	// thread instead of halting.
+	Block()
+	if Current() != idle {
+		t.Fatalf("expected processor 1 to run its idle thread; got %q", Current().Name())
+	}
+
+	if len(m.switches) != 2 {
+		t.Errorf("expected 2 context switches; got %d", len(m.switches))
+	}
+
+	// The idle thread is never queued when yielding
+	Yield()
+	if Current() != idle || !cpus[1].runQueue.empty() {
+		t.Error("expected the idle thread to keep running without being queued")
+	}
+}
+
+func TestNonAllocatingThreadRunsOnAP(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+	Init()
+	onlineAP(1)
+
+	// Threads spawned via kthread.SpawnNonAllocating are marked and then
+	// allowed to run on all processors before being made runnable.
+	th, _ := newTestThread(t, "spinner")
+	th.MarkNonAllocating()
+	if err := th.SetAffinity(AffinityAll); err != nil {
+		t.Fatal(err)
+	}
+	Ready(th)
+
+	// The thread is queued on the idle application processor
+	if th.queueCPU != 1 {
+		t.Fatalf("expected thread to be queued on processor 1; got %d", th.queueCPU)
+	}
+
+	cpuIndexFn = func() int { return 1 }
+	Yield()
+	if Current() != th || th.CPU() != 1 {
+		t.Fatalf("expected processor 1 to run the non-allocating thread; got %q", Current().Name())
+	}
+}
+
+func TestExitOnAP(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+	Init()
+	onlineAP(1)
+
+	var reaped []*Thread
+	SetReaper(func(t *Thread) { reaped = append(reaped, t) })
+
+	th, _ := newTestThread(t, "t1")
+	th.affinity = 1 << 1
+	Ready(th)
+
+	cpuIndexFn = func() int { return 1 }
+	Yield()
+	if Current() != th {
+		t.Fatalf("expected processor 1 to run t1; got %q", Current().Name())
+	}
+
+	Exit()
+	if len(reaped) != 0 || zombies != th {
+		t.Fatal("expected thread exiting on an application processor to be reaped by the boot processor")
+	}
+
+	if LookupThread(th.ID()) != nil {
+		t.Error("expected exited thread to be removed from the thread list")
+	}
+
+	// The next switch on the boot processor reaps the thread
+	cpuIndexFn = func() int { return 0 }
+	other, _ := newTestThread(t, "t2")
+	Ready(other)
+	Yield()
+
+	if len(reaped) != 1 || reaped[0] != th || zombies != nil {
+		t.Errorf("expected t1 to be reaped; got %v", reaped)
+	}
+}
+
+func TestMigrateOnAffinityChange(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+	Init()
+	onlineAP(1)
+	boot := Current()
+	cpus[0].idle = &Thread{name: "idle", affinity: AffinityBoot, nice: MaxNice}
+	boot.MarkNonAllocating()
+
+	// The running boot thread is moved to processor 1 once the boot
+	// processor switches away from it.
+	if err := boot.SetAffinity(1 << 1); err != nil {
+		t.Fatal(err)
+	}
+
+	Yield()
+	if Current() != cpus[0].idle {
+		t.Fatalf("expected the boot processor to switch to its idle thread; got %q", Current().Name())
+	}
+
+	if boot.queueCPU != 1 || !cpus[0].runQueue.empty() || cpus[1].runQueue.count != 1 {
+		t.Error("expected the boot thread to be moved to the run queue of processor 1")
+	}
+}
+
+func TestRecursiveLock(t *testing.T) {
+	defer restoreMocks()
+	m := &mockCPU{intrEnabled: true}
+	m.install()
+
+	outer := lock()
+	inner := lock()
+	if lockOwner != 1 || lockDepth != 2 {
+		t.Fatalf("expected lock to be held twice by processor 0; owner %d, depth %d", lockOwner, lockDepth)
+	}
+
+	unlock(inner)
+	if lockOwner != 1 || m.intrEnabled {
+		t.Fatal("expected lock to be held until the outermost unlock")
+	}
+
+	unlock(outer)
+	if lockOwner != 0 || lockDepth != 0 || !m.intrEnabled {
+		t.Fatal("expected lock to be released and interrupts to be restored")
+	}
+}
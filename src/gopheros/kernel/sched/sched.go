@@ -0,0 +1,812 @@
+// Package sched implements a cooperative scheduler for kernel threads.
+//
+// Runnable threads are kept in a FIFO queue per priority level. A thread's
+// level is derived from its nice value; the scheduler always picks the first
+// thread of the highest non-empty level unless a thread at a lower level has
+// been waiting for more than starvationLimit scheduler rounds. The time each
+// thread spends running, waiting in the run queue and sleeping is accounted
+// using the clock registered via SetClock.
+//
+// All threads share the single Go g that the kernel runs on; a context switch
+// swaps the stack and updates the stack bounds of the g so that Go stack checks
+// remain valid. As the Go runtime is not aware of the switch, threads are only
+// switched at well-defined points (Yield, Block and Exit) and never while the
+// runtime is executing.
+//
+// Each processor has its own run queue. Threads may only run on the
+// processors included in their affinity mask; idle processors steal runnable
+// threads from the run queues of busy processors. As the Go heap and runtime
+// locks are not safe for concurrent use by multiple processors, only threads
+// marked via MarkNonAllocating may run on the application processors.
+package sched
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/trace"
+	"sync/atomic"
+	"unsafe"
+)
+
+// State describes the scheduling state of a thread.
+type State uint8
+
+// The supported thread states.
+const (
+	StateRunnable State = iota
+	StateRunning
+	StateBlocked
+	StateDead
+)
+
+// String implements fmt.Stringer for State.
+func (s State) String() string {
+	switch s {
+	case StateRunnable:
+		return "runnable"
+	case StateRunning:
+		return "running"
+	case StateBlocked:
+		return "blocked"
+	default:
+		return "dead"
+	}
+}
+
+// The range of nice values that can be assigned to threads. Threads with lower
+// nice values are scheduled before threads with higher nice values.
+const (
+	MinNice     = -20
+	MaxNice     = 19
+	DefaultNice = 0
+
+	// numLevels is the number of priority levels; level 0 corresponds to
+	// MinNice.
+	numLevels = MaxNice - MinNice + 1
+
+	// starvationLimit is the number of scheduler rounds after which a
+	// runnable thread is picked regardless of its priority level.
+	starvationLimit = 32
+)
+
+// Stats contains the scheduling statistics of a thread. Times are measured in
+// nanoseconds by the clock registered via SetClock.
+type Stats struct {
+	// RunTime is the time spent running.
+	RunTime uint64
+
+	// WaitTime is the time spent in the run queue waiting to run.
+	WaitTime uint64
+
+	// SleepTime is the time spent blocked after the thread first ran.
+	SleepTime uint64
+
+	// Switches counts the number of times the scheduler switched to the
+	// thread.
+	Switches uint64
+
+	// Wakeups counts the number of times the thread was readied after
+	// blocking.
+	Wakeups uint64
+
+	// Migrations counts the number of times the thread started running on
+	// a different processor than the one it previously ran on.
+	Migrations uint64
+}
+
+// context holds the saved execution state of a thread that is not running.
+// Its layout is shared with switchContext.
+type context struct {
+	sp      uintptr
+	stackLo uintptr
+	stackHi uintptr
+}
+
+// Thread describes a schedulable kernel execution context.
+type Thread struct {
+	ctx   context
+	id    uint32
+	name  string
+	state State
+	entry func()
+	nice  int8
+
+	// started is set once the thread runs for the first time.
+	started bool
+
+	// onCPU is set from the time the thread is picked to run until a
+	// processor has switched away from it and saved its context.
+	onCPU bool
+
+	// affinity contains the processors the thread may run on. queueCPU is
+	// the index of the processor whose run queue holds the thread and
+	// lastCPU the index of the processor that last ran it.
+	affinity AffinityMask
+	queueCPU int
+	lastCPU  int
+
+	// nonAllocating is set for threads that never allocate memory nor
+	// otherwise depend on the Go runtime. Only such threads may run on
+	// the application processors.
+	nonAllocating bool
+
+	// stats holds the statistics accounted up to since, the clock value
+	// when the thread last changed state.
+	stats Stats
+	since uint64
+
+	// queuedAt holds the value of the progress counter when the thread
+	// was added to the run queue.
+	queuedAt uint64
+
+	// next links the thread in the run queue.
+	next *Thread
+
+	// allNext links the thread in the list of live threads.
+	allNext *Thread
+}
+
+// ID returns the thread's unique ID. The boot thread always has ID 0.
+func (t *Thread) ID() uint32 {
+	return t.id
+}
+
+// Name returns the thread's name.
+func (t *Thread) Name() string {
+	return t.name
+}
+
+// State returns the thread's scheduling state.
+func (t *Thread) State() State {
+	return t.state
+}
+
+// StackTop returns the address of the top of the thread's stack.
+func (t *Thread) StackTop() uintptr {
+	return t.ctx.stackHi
+}
+
+// Nice returns the thread's nice value.
+func (t *Thread) Nice() int {
+	return int(t.nice)
+}
+
+// SetNice changes the thread's nice value. Values outside of [MinNice,
+// MaxNice] are clamped to the nearest valid value. A runnable thread is moved
+// to the end of the run queue for its new priority level.
+func (t *Thread) SetNice(nice int) {
+	if nice < MinNice {
+		nice = MinNice
+	} else if nice > MaxNice {
+		nice = MaxNice
+	}
+
+	intr := lock()
+	if q := &cpus[t.queueCPU].runQueue; t.state == StateRunnable && q.remove(t) {
+		t.nice = int8(nice)
+		q.push(t)
+	} else {
+		t.nice = int8(nice)
+	}
+	unlock(intr)
+}
+
+// Stats returns the scheduling statistics of the thread including the time
+// spent in its current state.
+func (t *Thread) Stats() Stats {
+	intr := lock()
+	stats := t.snapshot()
+	unlock(intr)
+	return stats
+}
+
+// snapshot returns the thread statistics including the time spent in its
+// current state. It must be invoked with the scheduler lock held.
+func (t *Thread) snapshot() Stats {
+	stats := t.stats
+	if now := clockFn(); now > t.since {
+		t.charge(&stats, now-t.since)
+	}
+	return stats
+}
+
+// setState charges the time spent in the current state to the thread
+// statistics and switches the thread to a new state. It must be invoked with
+// the scheduler lock held.
+func (t *Thread) setState(state State) {
+	if now := clockFn(); now > t.since {
+		t.charge(&t.stats, now-t.since)
+		t.since = now
+	}
+	t.state = state
+}
+
+// charge adds elapsed to the statistic that tracks the time spent in the
+// current state of the thread.
+func (t *Thread) charge(stats *Stats, elapsed uint64) {
+	switch t.state {
+	case StateRunning:
+		stats.RunTime += elapsed
+	case StateRunnable:
+		stats.WaitTime += elapsed
+	case StateBlocked:
+		if t.started {
+			stats.SleepTime += elapsed
+		}
+	}
+}
+
+// threadQueue is a FIFO list of threads.
+type threadQueue struct {
+	head, tail *Thread
+}
+
+func (q *threadQueue) push(t *Thread) {
+	t.next = nil
+	if q.tail == nil {
+		q.head = t
+	} else {
+		q.tail.next = t
+	}
+	q.tail = t
+}
+
+func (q *threadQueue) pop() *Thread {
+	t := q.head
+	if t != nil {
+		if q.head = t.next; q.head == nil {
+			q.tail = nil
+		}
+		t.next = nil
+	}
+	return t
+}
+
+func (q *threadQueue) remove(t *Thread) bool {
+	var prev *Thread
+	for cur := q.head; cur != nil; prev, cur = cur, cur.next {
+		if cur != t {
+			continue
+		}
+
+		if prev == nil {
+			q.head = t.next
+		} else {
+			prev.next = t.next
+		}
+		if q.tail == t {
+			q.tail = prev
+		}
+		t.next = nil
+		return true
+	}
+	return false
+}
+
+// priorityQueue holds a threadQueue for each priority level.
+type priorityQueue struct {
+	levels [numLevels]threadQueue
+
+	// count is the number of queued threads.
+	count int
+}
+
+// push appends t to the queue for its priority level.
+func (q *priorityQueue) push(t *Thread) {
+	t.queuedAt = atomic.LoadUint64(&progress)
+	q.levels[int(t.nice)-MinNice].push(t)
+	q.count++
+}
+
+// pop removes and returns the first thread of the highest non-empty priority
+// level. If the first thread of a lower level has been waiting for at least
+// starvationLimit scheduler rounds, the longest waiting such thread is
+// returned instead.
+func (q *priorityQueue) pop() *Thread {
+	var (
+		round = atomic.LoadUint64(&progress)
+		pick  = -1
+	)
+	for level := range q.levels {
+		head := q.levels[level].head
+		switch {
+		case head == nil:
+		case pick == -1:
+			pick = level
+		case round-head.queuedAt >= starvationLimit && head.queuedAt < q.levels[pick].head.queuedAt:
+			pick = level
+		}
+	}
+
+	if pick == -1 {
+		return nil
+	}
+	q.count--
+	return q.levels[pick].pop()
+}
+
+// remove removes t from the queue and reports whether it was queued.
+func (q *priorityQueue) remove(t *Thread) bool {
+	if !q.levels[int(t.nice)-MinNice].remove(t) {
+		return false
+	}
+	q.count--
+	return true
+}
+
+// empty returns true if no thread is queued.
+func (q *priorityQueue) empty() bool {
+	return q.count == 0
+}
+
+// visit invokes visitor for the queued threads in priority order.
+func (q *priorityQueue) visit(visitor func(*Thread)) {
+	for level := range q.levels {
+		for t := q.levels[level].head; t != nil; t = t.next {
+			visitor(t)
+		}
+	}
+}
+
+var (
+	errNoOnlineCPU  = &kernel.Error{Module: "sched", Message: "affinity mask does not include any online processor", Code: kernel.CodeInvalid}
+	errAllocatingAP = &kernel.Error{Module: "sched", Message: "only non-allocating threads may run on application processors", Code: kernel.CodeInvalid}
+
+	// cpus holds the scheduler state of each processor. The boot processor
+	// is always stored at index 0.
+	cpus [MaxCPUs]cpuState
+
+	// allThreads points to the first thread in the list of live threads,
+	// ordered by thread ID. The list and nextID are protected by listLock
+	// as they are never accessed from interrupt context.
+	allThreads, lastThread *Thread
+	nextID                 uint32
+	listLock               uint32
+
+	// lockOwner holds the index (plus one) of the processor that holds the
+	// scheduler lock or 0 if the lock is free. lockDepth counts the nested
+	// lock invocations by the owner.
+	lockOwner uint32
+	lockDepth int
+
+	// zombies links (via their next field) the exited threads that were
+	// switched away from on an application processor. They are reaped on
+	// the boot processor as the reaper may allocate memory.
+	zombies *Thread
+
+	// clockFn returns the current time in nanoseconds. Until SetClock is
+	// invoked, no time is accounted to threads.
+	clockFn = func() uint64 { return 0 }
+
+	// reapFn, if set, is invoked after switching away from a thread that
+	// has exited so that its stack can be released.
+	reapFn func(*Thread)
+
+	// progress counts the scheduler invocations and idle wakeups. It is
+	// used for detecting threads that hog the CPU without ever yielding.
+	progress uint64
+
+	// switchHooks are invoked in registration order with interrupts
+	// disabled before the boot processor switches to a different thread.
+	switchHooks []func(*Thread)
+
+	// cpuIndexFn returns the index of the calling processor. Until
+	// SetCPUIndex is invoked, all code is assumed to run on the boot
+	// processor.
+	cpuIndexFn = func() int { return 0 }
+
+	// kickFn, if set, interrupts the halted processor with the specified
+	// index so that it picks up a newly queued thread.
+	kickFn func(int)
+
+	// signalCheckFn, if set, reports whether a thread has a pending signal
+	// that interrupts its interruptible waits.
+	signalCheckFn func(*Thread) bool
+
+	// The following functions are used by tests to mock calls to the cpu
+	// and cmdline packages and the context switching code.
+	interruptsEnabledFn  = cpu.InterruptsEnabled
+	enableInterruptsFn   = cpu.EnableInterrupts
+	disableInterruptsFn  = cpu.DisableInterrupts
+	waitForInterruptFn   = cpu.WaitForInterrupt
+	monitorFn            = cpu.Monitor
+	mwaitFn              = cpu.MWait
+	cpuidFn              = cpu.ID
+	cmdlineGetFn         = cmdline.Get
+	switchContextFn      = switchContext
+	currentStackBoundsFn = currentStackBounds
+)
+
+// Init registers the calling context as the boot thread and selects the method
+// used by idle processors. The boot thread may only run on the boot processor.
+func Init() {
+	idleMethod = selectIdleMethod()
+
+	lo, hi := currentStackBoundsFn()
+	boot := &Thread{
+		name:     "boot",
+		state:    StateRunning,
+		started:  true,
+		onCPU:    true,
+		affinity: AffinityBoot,
+		since:    clockFn(),
+		ctx:      context{stackLo: lo, stackHi: hi},
+	}
+	cpus[0] = cpuState{current: boot, online: true}
+	allThreads, lastThread = boot, boot
+	nextID = 1
+}
+
+// SetClock registers the function used for accounting the time spent by
+// threads in each state. It returns the elapsed time in nanoseconds since the
+// clock was started and must be safe to call from interrupt context.
+func SetClock(fn func() uint64) {
+	clockFn = fn
+}
+
+// Current returns the thread that is currently running on the calling
+// processor.
+func Current() *Thread {
+	return cpus[cpuIndex()].current
+}
+
+// NewThread creates a thread that executes entry on the stack described by
+// [stackLo, stackHi). The thread does not run until it is passed to Ready.
+//
+// New threads may only run on the boot processor as the Go runtime is not
+// aware of the application processors; threads that neither allocate memory
+// nor otherwise depend on the runtime may be marked via MarkNonAllocating and
+// then use SetAffinity to run elsewhere.
+func NewThread(name string, stackLo, stackHi uintptr, entry func()) *Thread {
+	t := &Thread{
+		name:     name,
+		state:    StateBlocked,
+		entry:    entry,
+		affinity: AffinityBoot,
+		since:    clockFn(),
+	}
+
+	// Set up the stack so that the first switch to the thread restores a
+	// zero frame pointer and returns to threadEntry. The topmost slot holds
+	// a zero return address for threadEntry so that backtraces terminate.
+	stackHi &^= 0xf
+	*(*uintptr)(unsafe.Pointer(stackHi - 8)) = 0
+	*(*uintptr)(unsafe.Pointer(stackHi - 16)) = threadEntryAddr()
+	*(*uintptr)(unsafe.Pointer(stackHi - 24)) = 0
+	t.ctx = context{sp: stackHi - 24, stackLo: stackLo, stackHi: stackHi}
+
+	addThread(t)
+	return t
+}
+
+// addThread assigns an ID to t and appends it to the list of live threads.
+func addThread(t *Thread) {
+	acquireSpinlock(&listLock)
+	t.id = nextID
+	nextID++
+	if lastThread == nil {
+		allThreads = t
+	} else {
+		lastThread.allNext = t
+	}
+	lastThread = t
+	releaseSpinlock(&listLock)
+}
+
+// LookupThread returns the live thread with the specified ID or nil if no such
+// thread exists.
+func LookupThread(id uint32) *Thread {
+	acquireSpinlock(&listLock)
+	defer releaseSpinlock(&listLock)
+
+	for t := allThreads; t != nil; t = t.allNext {
+		if t.id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// VisitThreads invokes visitor for each live thread in thread ID order along
+// with a snapshot of the thread statistics. The scheduler state must not be
+// modified by visitor.
+func VisitThreads(visitor func(*Thread, Stats)) {
+	intr := lock()
+	acquireSpinlock(&listLock)
+	for t := allThreads; t != nil; t = t.allNext {
+		visitor(t, t.snapshot())
+	}
+	releaseSpinlock(&listLock)
+	unlock(intr)
+}
+
+// removeThread removes an exited thread from the list of live threads.
+func removeThread(t *Thread) {
+	acquireSpinlock(&listLock)
+	defer releaseSpinlock(&listLock)
+
+	var prev *Thread
+	for cur := allThreads; cur != nil; prev, cur = cur, cur.allNext {
+		if cur != t {
+			continue
+		}
+
+		if prev == nil {
+			allThreads = t.allNext
+		} else {
+			prev.allNext = t.allNext
+		}
+		if lastThread == t {
+			lastThread = prev
+		}
+		t.allNext = nil
+		return
+	}
+}
+
+// Ready marks a new or blocked thread as runnable and appends it to the run
+// queue of a processor it may run on. It may be invoked from interrupt
+// context.
+func Ready(t *Thread) {
+	intr := lock()
+	if t.state == StateBlocked {
+		if t.started {
+			t.stats.Wakeups++
+		}
+		t.setState(StateRunnable)
+		enqueue(t)
+	}
+	unlock(intr)
+}
+
+// Yield moves the current thread to the end of the run queue and switches to
+// the next runnable thread.
+func Yield() {
+	intr := lock()
+	c := &cpus[cpuIndex()]
+	c.current.setState(StateRunnable)
+	if c.current != c.idle {
+		enqueue(c.current)
+	}
+	schedule(intr)
+}
+
+// Block suspends the current thread until it is passed to Ready.
+func Block() {
+	intr := lock()
+	cpus[cpuIndex()].current.setState(StateBlocked)
+	schedule(intr)
+}
+
+// Exit terminates the current thread. It never returns.
+func Exit() {
+	intr := lock()
+	cpus[cpuIndex()].current.setState(StateDead)
+	schedule(intr)
+}
+
+// Run turns the calling thread into the idle thread for the boot processor:
+// it repeatedly yields to any runnable threads and halts the CPU (using MWAIT
+// where supported) with interrupts enabled while no thread is runnable. The idle thread is not
+// placed in the run queue and is assigned the lowest priority; it only runs
+// when the processor has nothing else to do. It never returns.
+func Run() {
+	c := &cpus[cpuIndex()]
+	c.current.SetNice(MaxNice)
+	c.idle = c.current
+	for {
+		runOnce()
+	}
+}
+
+func runOnce() {
+	Yield()
+
+	// waitIdle atomically enables interrupts before halting so a thread
+	// readied by an interrupt handler cannot be missed. Other processors
+	// wake this processor up if they queue a thread for it while it is
+	// halted.
+	disableInterruptsFn()
+	index := cpuIndex()
+	c := &cpus[index]
+	enterIdle(c)
+	if !runnable(index) {
+		waitIdle(c)
+	} else {
+		enableInterruptsFn()
+	}
+	exitIdle(c)
+}
+
+// SetReaper registers a function that is invoked with interrupts disabled
+// after the scheduler switches away from a thread that has exited. Threads
+// that exit on an application processor are reaped by the boot processor the
+// next time it switches threads.
+func SetReaper(fn func(*Thread)) {
+	reapFn = fn
+}
+
+// SetSignalCheck registers a function that reports whether a thread has a
+// pending signal. Interruptible waits return early once the check succeeds for
+// the waiting thread. Code posting a signal must wake the target thread via
+// Ready so that it can notice the signal.
+func SetSignalCheck(fn func(*Thread) bool) {
+	signalCheckFn = fn
+}
+
+// SignalPending returns true if the calling thread has a pending signal that
+// interrupts its interruptible waits.
+func SignalPending() bool {
+	check := signalCheckFn
+	return check != nil && check(Current())
+}
+
+// AddSwitchHook registers a function that is invoked with interrupts disabled
+// before the scheduler switches to a different thread on the boot processor.
+// As user-mode code only runs on the boot processor, switches on the
+// application processors do not invoke the hooks.
+func AddSwitchHook(fn func(*Thread)) {
+	switchHooks = append(switchHooks, fn)
+}
+
+// VisitRunQueue invokes visitor, for each online processor, for the running
+// thread followed by the threads in the run queue of the processor in the
+// order they will be scheduled. The run queues must not be modified by
+// visitor.
+func VisitRunQueue(visitor func(*Thread)) {
+	intr := lock()
+	for index := range cpus {
+		c := &cpus[index]
+		if !c.online {
+			continue
+		}
+
+		if c.current != nil {
+			visitor(c.current)
+		}
+		c.runQueue.visit(visitor)
+	}
+	unlock(intr)
+}
+
+// Progress returns a counter that is incremented each time the scheduler runs
+// or wakes up the idle CPU. The counter stops advancing if a thread keeps
+// running without ever yielding, blocking or exiting.
+func Progress() uint64 {
+	return atomic.LoadUint64(&progress)
+}
+
+// schedule switches to the next runnable thread. If no thread is runnable, the
+// CPU is halted until an interrupt handler or another processor readies a
+// thread. It must be invoked with the scheduler lock held; intr is the
+// interrupt state to restore once the current thread resumes.
+func schedule(intr bool) {
+	atomic.AddUint64(&progress, 1)
+
+	var (
+		index = cpuIndex()
+		c     = &cpus[index]
+		prev  = c.current
+		next  = pickNext(index)
+	)
+	for next == nil {
+		// Release the scheduler lock while halted so that other
+		// processors can queue threads for this one.
+		depth := lockDepth
+		lockDepth = 0
+		enterIdle(c)
+		atomic.StoreUint32(&lockOwner, 0)
+		waitIdle(c)
+		disableInterruptsFn()
+		acquireLock()
+		exitIdle(c)
+		lockDepth = depth
+
+		atomic.AddUint64(&progress, 1)
+		next = pickNext(index)
+	}
+
+	next.setState(StateRunning)
+	next.onCPU = true
+	if next.started && next.lastCPU != index {
+		next.stats.Migrations++
+	}
+	next.lastCPU, next.queueCPU = index, index
+	c.current = next
+	if next != prev {
+		next.started = true
+		next.stats.Switches++
+		c.switchedFrom = prev
+		c.resumeInterrupts = intr
+		trace.Record(trace.EventSchedSwitch, uint64(prev.ID()), uint64(next.ID()))
+		if index == 0 {
+			for _, hook := range switchHooks {
+				hook(next)
+			}
+		}
+		switchContextFn(&prev.ctx, &next.ctx)
+		finishSwitch()
+	}
+
+	unlock(intr)
+}
+
+// finishSwitch runs on the stack of the thread that was switched to. As the
+// thread may have been switched to on a different processor than the one it
+// was switched away from, it looks up the calling processor again.
+func finishSwitch() {
+	index := cpuIndex()
+	c := &cpus[index]
+	if prev := c.switchedFrom; prev != nil {
+		prev.onCPU = false
+		switch {
+		case prev.state == StateDead:
+			removeThread(prev)
+			prev.next, zombies = zombies, prev
+		case prev.state == StateRunnable && !prev.affinity.Has(index):
+			// The affinity of prev changed while it was running
+			cpus[prev.queueCPU].runQueue.remove(prev)
+			enqueue(prev)
+		}
+	}
+	c.switchedFrom = nil
+
+	// The reaper may allocate memory so exited threads are only reaped on
+	// the boot processor.
+	for index == 0 && zombies != nil {
+		t := zombies
+		zombies, t.next = t.next, nil
+		if reapFn != nil {
+			reapFn(t)
+		}
+	}
+}
+
+// threadMain is invoked by threadEntry when a thread runs for the first time.
+func threadMain() {
+	finishSwitch()
+
+	c := &cpus[cpuIndex()]
+	unlock(c.resumeInterrupts)
+
+	c.current.entry()
+	Exit()
+}
+
+// lock disables interrupts, acquires the scheduler lock and returns the
+// previous interrupt state. The lock is owned by the calling processor and
+// may be acquired recursively (e.g. by a reaper that readies threads).
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+
+	if atomic.LoadUint32(&lockOwner) == uint32(cpuIndex())+1 {
+		lockDepth++
+	} else {
+		acquireLock()
+		lockDepth = 1
+	}
+	return intr
+}
+
+// acquireLock spins until the calling processor owns the scheduler lock.
+func acquireLock() {
+	owner := uint32(cpuIndex()) + 1
+	for !atomic.CompareAndSwapUint32(&lockOwner, 0, owner) {
+	}
+}
+
+// unlock releases the scheduler lock once the outermost lock call has been
+// balanced and restores the interrupt state returned by lock.
+func unlock(intr bool) {
+	if lockDepth > 0 {
+		if lockDepth--; lockDepth == 0 {
+			atomic.StoreUint32(&lockOwner, 0)
+		}
+	}
+
+	if intr {
+		enableInterruptsFn()
+	}
+}
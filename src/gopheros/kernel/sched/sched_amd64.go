@@ -0,0 +1,16 @@
+package sched
+
+// switchContext saves the stack pointer of the current thread to from,
+// updates the stack bounds of the running g and resumes the thread described
+// by to.
+func switchContext(from, to *context)
+
+// currentStackBounds returns the stack bounds of the running g.
+func currentStackBounds() (uintptr, uintptr)
+
+// threadEntry is the initial return address for new threads. It calls
+// threadMain.
+func threadEntry()
+
+// threadEntryAddr returns the address of threadEntry.
+func threadEntryAddr() uintptr
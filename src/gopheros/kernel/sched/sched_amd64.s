@@ -0,0 +1,58 @@
+#include "textflag.h"
+
+// Offsets of the context struct fields.
+#define CTX_SP 0
+#define CTX_STACK_LO 8
+#define CTX_STACK_HI 16
+
+// Offsets of the stack bounds and guards in the runtime g struct.
+#define G_STACK_LO 0
+#define G_STACK_HI 8
+#define G_STACKGUARD0 16
+#define G_STACKGUARD1 24
+
+// Number of bytes at the bottom of each thread stack that Go function
+// prologues treat as the stack limit.
+#define STACK_GUARD 1024
+
+TEXT ·switchContext(SB),NOSPLIT,$0-16
+	MOVQ from+0(FP), AX
+	MOVQ to+8(FP), BX
+
+	PUSHQ BP
+	MOVQ SP, CTX_SP(AX)
+
+	// Point the stack bounds of the running g to the new stack before
+	// switching to it.
+	MOVQ (TLS), CX
+	MOVQ CTX_STACK_LO(BX), DX
+	MOVQ DX, G_STACK_LO(CX)
+	ADDQ $STACK_GUARD, DX
+	MOVQ DX, G_STACKGUARD0(CX)
+	MOVQ DX, G_STACKGUARD1(CX)
+	MOVQ CTX_STACK_HI(BX), DX
+	MOVQ DX, G_STACK_HI(CX)
+
+	MOVQ CTX_SP(BX), SP
+	POPQ BP
+	RET
+
+TEXT ·currentStackBounds(SB),NOSPLIT,$0-16
+	MOVQ (TLS), CX
+	MOVQ G_STACK_LO(CX), AX
+	MOVQ AX, ret+0(FP)
+	MOVQ G_STACK_HI(CX), AX
+	MOVQ AX, ret1+8(FP)
+	RET
+
+TEXT ·threadEntry(SB),NOSPLIT,$0
+	CALL ·threadMain(SB)
+
+	// threadMain never returns
+	CLI
+	HLT
+
+TEXT ·threadEntryAddr(SB),NOSPLIT,$0-8
+	LEAQ ·threadEntry(SB), AX
+	MOVQ AX, ret+0(FP)
+	RET
@@ -0,0 +1,26 @@
+package sched
+
+// The arm64 port is a stub: its entry points allow the architecture-neutral
+// kernel packages to be type-checked for arm64 but panic when invoked.
+
+func unimplemented() {
+	panic("sched: not implemented on arm64")
+}
+
+// switchContext saves the stack pointer of the current thread to from,
+// updates the stack bounds of the running g and resumes the thread described
+// by to.
+func switchContext(_, _ *context) { unimplemented() }
+
+// currentStackBounds returns the stack bounds of the running g.
+func currentStackBounds() (uintptr, uintptr) {
+	unimplemented()
+	return 0, 0
+}
+
+// threadEntryAddr returns the address of the initial return address for new
+// threads.
+func threadEntryAddr() uintptr {
+	unimplemented()
+	return 0
+}
@@ -0,0 +1,541 @@
+package sched
+
+import (
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	waitForInterruptFn = cpu.WaitForInterrupt
+	monitorFn = cpu.Monitor
+	mwaitFn = cpu.MWait
+	cpuidFn = cpu.ID
+	cmdlineGetFn = cmdline.Get
+	switchContextFn = switchContext
+	currentStackBoundsFn = currentStackBounds
+	cpus = [MaxCPUs]cpuState{}
+	idleThreads = [MaxCPUs]Thread{}
+	allThreads, lastThread = nil, nil
+	lockOwner, lockDepth = 0, 0
+	zombies = nil
+	clockFn = func() uint64 { return 0 }
+	cpuIndexFn = func() int { return 0 }
+	kickFn = nil
+	reapFn = nil
+	signalCheckFn = nil
+	switchHooks = nil
+	idleMethod = IdleHalt
+}
+
+// mockCPU tracks the interrupt flag and records the context switches requested
+// by the scheduler.
+type mockCPU struct {
+	intrEnabled bool
+	switches    [][2]*context
+}
+
+func (m *mockCPU) install() {
+	interruptsEnabledFn = func() bool { return m.intrEnabled }
+	enableInterruptsFn = func() { m.intrEnabled = true }
+	disableInterruptsFn = func() { m.intrEnabled = false }
+	waitForInterruptFn = func() { m.intrEnabled = true }
+	cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) { return 0, 0, 0, 0 }
+	cmdlineGetFn = func(_ string) string { return "" }
+	switchContextFn = func(from, to *context) {
+		m.switches = append(m.switches, [2]*context{from, to})
+	}
+	currentStackBoundsFn = func() (uintptr, uintptr) { return 0x1000, 0x5000 }
+}
+
+func newTestThread(t *testing.T, name string) (*Thread, []uintptr) {
+	stack := make([]uintptr, 64)
+	lo := uintptr(unsafe.Pointer(&stack[0]))
+	return NewThread(name, lo, lo+uintptr(len(stack))*8, func() {}), stack
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+
+	Init()
+
+	boot := Current()
+	if boot == nil || boot.ID() != 0 || boot.Name() != "boot" || boot.State() != StateRunning {
+		t.Fatalf("unexpected boot thread: %+v", boot)
+	}
+
+	if boot.ctx.stackLo != 0x1000 || boot.ctx.stackHi != 0x5000 {
+		t.Errorf("expected boot thread stack to be [0x1000, 0x5000); got [0x%x, 0x%x)", boot.ctx.stackLo, boot.ctx.stackHi)
+	}
+}
+
+func TestNewThread(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+	Init()
+
+	th, stack := newTestThread(t, "worker")
+	if th.ID() != 1 || th.Name() != "worker" || th.State() != StateBlocked {
+		t.Fatalf("unexpected thread: %+v", th)
+	}
+
+	if th2, _ := newTestThread(t, "worker"); th2.ID() != 2 {
+		t.Errorf("expected second thread to get ID 2; got %d", th2.ID())
+	}
+
+	stackLo := uintptr(unsafe.Pointer(&stack[0]))
+	if th.ctx.stackLo != stackLo || th.ctx.stackHi&0xf != 0 || th.ctx.sp != th.ctx.stackHi-24 {
+		t.Fatalf("unexpected thread context: %+v", th.ctx)
+	}
+
+	top := len(stack) - 1
+	if stack[top] != 0 || stack[top-1] != threadEntryAddr() || stack[top-2] != 0 {
+		t.Errorf("unexpected initial stack frame: %x", stack[top-2:])
+	}
+}
+
+func TestYield(t *testing.T) {
+	defer restoreMocks()
+	m := &mockCPU{intrEnabled: true}
+	m.install()
+	Init()
+	boot := Current()
+
+	// Yielding with an empty run queue should not switch threads
+	progressBefore := Progress()
+	Yield()
+	if Progress() != progressBefore+1 {
+		t.Error("expected Yield to advance the scheduler progress counter")
+	}
+
+	if len(m.switches) != 0 || Current() != boot || boot.State() != StateRunning {
+		t.Fatal("expected Yield to return immediately when no other thread is runnable")
+	}
+
+	if !m.intrEnabled {
+		t.Error("expected Yield to restore the interrupt flag")
+	}
+
+	th1, _ := newTestThread(t, "t1")
+	th2, _ := newTestThread(t, "t2")
+	Ready(th1)
+	Ready(th2)
+
+	var hooked []*Thread
+	AddSwitchHook(func(next *Thread) { hooked = append(hooked, next) })
+
+	// Readying a runnable thread is a no-op
+	Ready(th1)
+
+	Yield()
+	if Current() != th1 || th1.State() != StateRunning || boot.State() != StateRunnable {
+		t.Fatalf("expected t1 to be running; got %q", Current().Name())
+	}
+
+	if th1.StackTop() != th1.ctx.stackHi {
+		t.Error("expected StackTop to return the top of the thread stack")
+	}
+
+	if len(m.switches) != 1 || m.switches[0] != [2]*context{&boot.ctx, &th1.ctx} {
+		t.Fatalf("unexpected context switches: %v", m.switches)
+	}
+
+	if len(hooked) != 1 || hooked[0] != th1 {
+		t.Errorf("expected switch hook to be invoked for t1; got %v", hooked)
+	}
+
+	// The run queue should now contain t2 followed by the boot thread
+	for specIndex, exp := range []*Thread{th2, boot} {
+		if got := cpus[0].runQueue.pop(); got != exp {
+			t.Errorf("[spec %d] expected run queue entry %q; got %v", specIndex, exp.Name(), got)
+		}
+	}
+
+	if got := cpus[0].runQueue.pop(); got != nil {
+		t.Errorf("expected run queue to be empty; got %q", got.Name())
+	}
+}
+
+func TestBlock(t *testing.T) {
+	defer restoreMocks()
+	m := &mockCPU{}
+	m.install()
+	Init()
+	boot := Current()
+
+	th, _ := newTestThread(t, "t1")
+
+	// Simulate an interrupt handler that readies the thread while the CPU
+	// is idling.
+	var waitCount int
+	waitForInterruptFn = func() {
+		if !m.intrEnabled {
+			waitCount++
+		}
+		m.intrEnabled = true
+		Ready(th)
+	}
+
+	Block()
+	if waitCount != 1 {
+		t.Errorf("expected the CPU to wait for an interrupt once; got %d", waitCount)
+	}
+
+	if Current() != th || boot.State() != StateBlocked {
+		t.Fatalf("expected t1 to run while the boot thread is blocked; got %q", Current().Name())
+	}
+
+	if m.intrEnabled {
+		t.Error("expected interrupts to remain disabled after Block returns")
+	}
+}
+
+func TestExit(t *testing.T) {
+	defer restoreMocks()
+	m := &mockCPU{}
+	m.install()
+	Init()
+	boot := Current()
+
+	th, _ := newTestThread(t, "t1")
+	Ready(th)
+	Yield()
+
+	var reaped []*Thread
+	SetReaper(func(t *Thread) { reaped = append(reaped, t) })
+
+	// As switchContext is mocked, Exit returns on the stack of t1 after
+	// switching to the boot thread; the reaper should be invoked for t1.
+	Exit()
+
+	if Current() != boot || th.State() != StateDead {
+		t.Fatalf("expected boot thread to run after t1 exits; got %q", Current().Name())
+	}
+
+	if len(reaped) != 1 || reaped[0] != th {
+		t.Errorf("expected reaper to be invoked for t1; got %v", reaped)
+	}
+
+	// Yielding to another thread should not invoke the reaper
+	th2, _ := newTestThread(t, "t2")
+	Ready(th2)
+	Yield()
+	if len(reaped) != 1 {
+		t.Errorf("expected reaper not to be invoked for a runnable thread")
+	}
+}
+
+func TestSignalPending(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+	Init()
+
+	if SignalPending() {
+		t.Fatal("expected SignalPending to return false when no check is registered")
+	}
+
+	var checked *Thread
+	SetSignalCheck(func(t *Thread) bool {
+		checked = t
+		return true
+	})
+
+	if !SignalPending() {
+		t.Fatal("expected SignalPending to return true")
+	}
+
+	if checked != Current() {
+		t.Errorf("expected signal check to be invoked for the current thread")
+	}
+}
+
+func TestThreadMain(t *testing.T) {
+	defer restoreMocks()
+	m := &mockCPU{intrEnabled: true}
+	m.install()
+	Init()
+
+	var ran bool
+	th, _ := newTestThread(t, "t1")
+	th.entry = func() { ran = true }
+	Ready(th)
+
+	// Emulate the first switch to t1 by running threadMain on the current
+	// stack once the scheduler asks to switch to it.
+	switchContextFn = func(from, to *context) {
+		m.switches = append(m.switches, [2]*context{from, to})
+		if to == &th.ctx && !ran {
+			if m.intrEnabled {
+				t.Error("expected interrupts to be disabled during the context switch")
+			}
+			threadMain()
+		}
+	}
+
+	Yield()
+
+	if !ran {
+		t.Fatal("expected thread entrypoint to be invoked")
+	}
+
+	if th.State() != StateDead {
+		t.Errorf("expected thread to be dead after its entrypoint returns; got %s", th.State())
+	}
+
+	if !m.intrEnabled {
+		t.Error("expected interrupt flag to be restored")
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	defer restoreMocks()
+	m := &mockCPU{}
+	m.install()
+	Init()
+
+	var waitCount int
+	waitForInterruptFn = func() {
+		waitCount++
+		m.intrEnabled = true
+	}
+
+	runOnce()
+	if waitCount != 1 || !m.intrEnabled {
+		t.Errorf("expected idle loop to wait for interrupts with an empty run queue")
+	}
+
+	th, _ := newTestThread(t, "t1")
+	Ready(th)
+	switchContextFn = func(_, _ *context) {}
+
+	// After switching to t1 the run queue contains the boot thread so
+	// the idle loop should not halt.
+	runOnce()
+	if waitCount != 1 {
+		t.Errorf("expected idle loop not to wait for interrupts with a non-empty run queue")
+	}
+}
+
+func TestStateString(t *testing.T) {
+	specs := []struct {
+		state State
+		exp   string
+	}{
+		{StateRunnable, "runnable"},
+		{StateRunning, "running"},
+		{StateBlocked, "blocked"},
+		{StateDead, "dead"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.state.String(); got != spec.exp {
+			t.Errorf("[spec %d] expected %q; got %q", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestVisitRunQueue(t *testing.T) {
+	defer restoreMocks()
+	cpu := &mockCPU{intrEnabled: true}
+	cpu.install()
+
+	Init()
+	t1, _ := newTestThread(t, "t1")
+	t2, _ := newTestThread(t, "t2")
+	Ready(t2)
+	Ready(t1)
+
+	var names []string
+	VisitRunQueue(func(t *Thread) { names = append(names, t.Name()) })
+
+	if got, exp := len(names), 3; got != exp || names[0] != "boot" || names[1] != "t2" || names[2] != "t1" {
+		t.Fatalf("expected to visit [boot t2 t1]; got %v", names)
+	}
+
+	if !cpu.intrEnabled {
+		t.Fatal("expected interrupts to be re-enabled")
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+	Init()
+	boot := Current()
+
+	low, _ := newTestThread(t, "low")
+	high, _ := newTestThread(t, "high")
+	normal, _ := newTestThread(t, "normal")
+	low.SetNice(MaxNice + 10)
+	high.SetNice(MinNice - 10)
+
+	if low.Nice() != MaxNice || high.Nice() != MinNice || normal.Nice() != DefaultNice {
+		t.Fatalf("expected nice values to be clamped; got %d, %d, %d", low.Nice(), high.Nice(), normal.Nice())
+	}
+
+	for _, th := range []*Thread{low, normal, high} {
+		Ready(th)
+	}
+
+	var names []string
+	VisitRunQueue(func(t *Thread) { names = append(names, t.Name()) })
+	if exp := "[boot high normal low]"; joinNames(names) != exp {
+		t.Fatalf("expected run queue to be visited in priority order %s; got %v", exp, names)
+	}
+
+	// Lowering the priority of a runnable thread moves it to the end of
+	// its new level.
+	normal.SetNice(MaxNice)
+	for specIndex, exp := range []*Thread{high, low, normal} {
+		if got := cpus[0].runQueue.pop(); got != exp {
+			t.Errorf("[spec %d] expected run queue entry %q; got %v", specIndex, exp.Name(), got)
+		}
+	}
+
+	if !cpus[0].runQueue.empty() || cpus[0].runQueue.remove(boot) {
+		t.Error("expected run queue to be empty")
+	}
+}
+
+func joinNames(names []string) string {
+	str := "["
+	for i, name := range names {
+		if i != 0 {
+			str += " "
+		}
+		str += name
+	}
+	return str + "]"
+}
+
+func TestStarvation(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+	Init()
+	boot := Current()
+	boot.SetNice(MinNice)
+
+	low, _ := newTestThread(t, "low")
+	low.SetNice(MaxNice)
+	Ready(low)
+
+	// The boot thread keeps yielding at the highest priority; the low
+	// priority thread must eventually run.
+	for round := 1; round < starvationLimit; round++ {
+		if Yield(); Current() != boot {
+			t.Fatalf("expected the boot thread to run in round %d; got %q", round, Current().Name())
+		}
+	}
+
+	if Yield(); Current() != low {
+		t.Fatalf("expected the starved thread to run after %d rounds; got %q", starvationLimit, Current().Name())
+	}
+
+	if Yield(); Current() != boot {
+		t.Fatalf("expected the boot thread to run after the starved thread yields; got %q", Current().Name())
+	}
+}
+
+func TestStats(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+	Init()
+	boot := Current()
+
+	var now uint64
+	SetClock(func() uint64 { return now })
+
+	th, _ := newTestThread(t, "t1")
+
+	// Time spent before the thread first runs is not accounted as sleep
+	now = 100
+	Ready(th)
+	now = 130
+	Yield() // boot -> t1
+	now = 200
+	Block() // t1 -> boot
+	now = 260
+	Ready(th)
+	now = 300
+
+	specs := []struct {
+		th  *Thread
+		exp Stats
+	}{
+		{boot, Stats{RunTime: 130 + 100, WaitTime: 70, Switches: 1}},
+		{th, Stats{RunTime: 70, WaitTime: 30 + 40, SleepTime: 60, Switches: 1, Wakeups: 1}},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.th.Stats(); got != spec.exp {
+			t.Errorf("[spec %d] expected stats for %q to be %+v; got %+v", specIndex, spec.th.Name(), spec.exp, got)
+		}
+	}
+
+	visited := make(map[*Thread]Stats)
+	VisitThreads(func(t *Thread, stats Stats) { visited[t] = stats })
+	for specIndex, spec := range specs {
+		if got := visited[spec.th]; got != spec.exp {
+			t.Errorf("[spec %d] expected VisitThreads to report stats %+v for %q; got %+v", specIndex, spec.exp, spec.th.Name(), got)
+		}
+	}
+
+	// Readying a new thread does not count as a wakeup
+	th2, _ := newTestThread(t, "t2")
+	Ready(th2)
+	if got := th2.Stats(); got.Wakeups != 0 || got.SleepTime != 0 {
+		t.Errorf("expected no wakeups or sleep time for a new thread; got %+v", got)
+	}
+}
+
+func TestVisitThreads(t *testing.T) {
+	defer restoreMocks()
+	(&mockCPU{}).install()
+	Init()
+	boot := Current()
+
+	t1, _ := newTestThread(t, "t1")
+	t2, _ := newTestThread(t, "t2")
+	t3, _ := newTestThread(t, "t3")
+
+	visit := func() string {
+		var names []string
+		VisitThreads(func(t *Thread, _ Stats) { names = append(names, t.Name()) })
+		return joinNames(names)
+	}
+
+	if exp, got := "[boot t1 t2 t3]", visit(); got != exp {
+		t.Fatalf("expected to visit %s; got %s", exp, got)
+	}
+
+	if LookupThread(t2.ID()) != t2 || LookupThread(42) != nil {
+		t.Error("unexpected LookupThread result")
+	}
+
+	// Exited threads are removed once the scheduler switches away from them
+	for _, th := range []*Thread{t3, t2} {
+		Ready(th)
+		Yield()
+		Exit()
+	}
+
+	if exp, got := "[boot t1]", visit(); got != exp {
+		t.Fatalf("expected to visit %s; got %s", exp, got)
+	}
+
+	Ready(t1)
+	Yield()
+	Exit()
+	if exp, got := "[boot]", visit(); got != exp || lastThread != boot {
+		t.Fatalf("expected to visit %s; got %s", exp, got)
+	}
+
+	if t4, _ := newTestThread(t, "t4"); lastThread != t4 || boot.allNext != t4 {
+		t.Error("expected new thread to be appended to the thread list")
+	}
+}
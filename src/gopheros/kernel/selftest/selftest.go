@@ -0,0 +1,239 @@
+// Package selftest exercises core kernel subsystems on the hardware (or
+// emulator) that the kernel runs on.
+//
+// The self tests are enabled via the "selftest" boot command line flag (e.g.
+// selftest=1) and run in a dedicated kernel thread once the scheduler starts.
+// Each test reports a "[selftest] PASS name", "[selftest] FAIL name: reason" or
+// "[selftest] SKIP name" line followed by a summary line. When the kernel
+// output is mirrored to a serial port (e.g. console=ttyS0), integration tests
+// running the kernel under qemu can parse these lines to check the outcome.
+package selftest
+
+import (
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/aml"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/kthread"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/timer"
+	"io"
+	"unsafe"
+)
+
+const (
+	// numTestFrames is the number of frames allocated by the frame
+	// allocator test.
+	numTestFrames = 8
+
+	// timerSleep is the time that the timer accuracy test sleeps for and
+	// timerTolerance is the maximum allowed oversleep.
+	timerSleep     = 250 * timer.Millisecond
+	timerTolerance = 25 * timer.Millisecond
+)
+
+var (
+	errDuplicateFrame   = &kernel.Error{Module: "selftest", Message: "frame allocator returned the same frame twice"}
+	errTranslateMapping = &kernel.Error{Module: "selftest", Message: "mapped page does not translate to the mapped frame"}
+	errAliasMismatch    = &kernel.Error{Module: "selftest", Message: "write through a page is not visible through an alias mapping of the same frame"}
+	errStaleMapping     = &kernel.Error{Module: "selftest", Message: "page is still mapped after being unmapped"}
+	errTimerEarly       = &kernel.Error{Module: "selftest", Message: "sleep returned before the requested duration elapsed"}
+	errTimerLate        = &kernel.Error{Module: "selftest", Message: "sleep overslept by more than the allowed tolerance"}
+	errClockDrift       = &kernel.Error{Module: "selftest", Message: "monotonic clock drifts from the timer tick count"}
+
+	// The following functions are used by tests to mock calls to the
+	// cmdline, kthread, mm, vmm, timer and acpi packages.
+	cmdlineBoolFn = cmdline.Bool
+	spawnFn       = kthread.Spawn
+	allocFrameFn  = mm.AllocFrame
+	freeFrameFn   = mm.FreeFrame
+	mapRegionFn   = vmm.MapRegion
+	unmapFn       = vmm.Unmap
+	translateFn   = vmm.Translate
+	nowFn         = timer.Now
+	ticksFn       = timer.Ticks
+	sleepFn       = timer.Sleep
+	lookupTableFn = acpi.LookupTable
+	outputFn      = kfmt.GetOutputSink
+)
+
+// test describes a self test.
+type test struct {
+	name string
+
+	// available, if set, reports whether the prerequisites of the test
+	// are met. Tests whose prerequisites are missing are skipped.
+	available func() bool
+
+	// fn runs the test. Any diagnostic output is written to the supplied
+	// writer.
+	fn func(io.Writer) *kernel.Error
+}
+
+var tests = []test{
+	{name: "pmm_alloc", fn: testFrameAllocator},
+	{name: "vmm_map", fn: testMapping},
+	{name: "timer_accuracy", fn: testTimerAccuracy},
+	{name: "aml_parse", available: hasDSDT, fn: testAMLParse},
+}
+
+// Init spawns a kernel thread that runs the self tests if they have been
+// enabled via the boot command line. It must be invoked after the timer
+// subsystem has been initialized.
+func Init() *kernel.Error {
+	if !cmdlineBoolFn("selftest") {
+		return nil
+	}
+
+	_, err := spawnFn("selftest", func() { runTests(outputFn(), tests) })
+	return err
+}
+
+// runTests runs the supplied list of tests, reports the outcome of each test
+// to w and returns the number of passed, failed and skipped tests.
+func runTests(w io.Writer, list []test) (passed, failed, skipped int) {
+	for _, t := range list {
+		if t.available != nil && !t.available() {
+			kfmt.Fprintf(w, "[selftest] SKIP %s\n", t.name)
+			skipped++
+			continue
+		}
+
+		if err := t.fn(w); err != nil {
+			kfmt.Fprintf(w, "[selftest] FAIL %s: [%s] %s\n", t.name, err.Module, err.Message)
+			failed++
+			continue
+		}
+
+		kfmt.Fprintf(w, "[selftest] PASS %s\n", t.name)
+		passed++
+	}
+
+	kfmt.Fprintf(w, "[selftest] done: %d passed, %d failed, %d skipped\n", passed, failed, skipped)
+	return passed, failed, skipped
+}
+
+// testFrameAllocator allocates a batch of frames, checks that no frame is
+// handed out twice and releases the frames.
+func testFrameAllocator(_ io.Writer) *kernel.Error {
+	var (
+		frames [numTestFrames]mm.Frame
+		frame  mm.Frame
+		count  int
+		err    *kernel.Error
+	)
+
+allocLoop:
+	for count < numTestFrames {
+		if frame, err = allocFrameFn(); err != nil {
+			break
+		}
+
+		for i := 0; i < count; i++ {
+			if frames[i] == frame {
+				err = errDuplicateFrame
+				break allocLoop
+			}
+		}
+
+		frames[count] = frame
+		count++
+	}
+
+	for i := 0; i < count; i++ {
+		if freeErr := freeFrameFn(frames[i]); freeErr != nil && err == nil {
+			err = freeErr
+		}
+	}
+
+	return err
+}
+
+// testMapping maps a newly allocated frame at two different pages and checks
+// that both pages translate to the frame, that data written through one page
+// is visible through the other and that unmapping a page removes its mapping.
+func testMapping(_ io.Writer) *kernel.Error {
+	frame, err := allocFrameFn()
+	if err != nil {
+		return err
+	}
+	defer freeFrameFn(frame)
+
+	var pages [2]mm.Page
+	for i := range pages {
+		if pages[i], err = mapRegionFn(frame, mm.PageSize, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute); err != nil {
+			return err
+		}
+		defer unmapFn(pages[i])
+
+		if physAddr, err := translateFn(pages[i].Address()); err != nil {
+			return err
+		} else if physAddr != frame.Address() {
+			return errTranslateMapping
+		}
+	}
+
+	const pattern = uint64(0x5e1f7e575e1f7e57)
+	*(*uint64)(unsafe.Pointer(pages[0].Address())) = pattern
+	if *(*uint64)(unsafe.Pointer(pages[1].Address())) != pattern {
+		return errAliasMismatch
+	}
+
+	if err = unmapFn(pages[1]); err != nil {
+		return err
+	}
+
+	if _, err = translateFn(pages[1].Address()); err == nil {
+		return errStaleMapping
+	}
+
+	return nil
+}
+
+// testTimerAccuracy sleeps for a fixed duration and checks the elapsed time
+// against both the requested duration and the number of timer ticks.
+func testTimerAccuracy(_ io.Writer) *kernel.Error {
+	startTicks, start := ticksFn(), nowFn()
+	sleepFn(timerSleep)
+	elapsed, elapsedTicks := nowFn()-start, ticksFn()-startTicks
+
+	if elapsed < timerSleep {
+		return errTimerEarly
+	} else if elapsed > timerSleep+timerTolerance {
+		return errTimerLate
+	}
+
+	// The tick count may lag behind the monotonic clock by up to a tick.
+	drift := elapsed - timer.Duration(elapsedTicks)*timer.TickDuration
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > timerTolerance {
+		return errClockDrift
+	}
+
+	return nil
+}
+
+// hasDSDT returns true if the firmware provides a DSDT.
+func hasDSDT() bool {
+	return lookupTableFn("DSDT") != nil
+}
+
+// testAMLParse parses the AML bytecode in the DSDT and any SSDTs supplied by
+// the firmware. Parse errors are written to w.
+func testAMLParse(w io.Writer) *kernel.Error {
+	tree := aml.NewObjectTree()
+	tree.CreateDefaultScopes(0)
+	parser := aml.NewParser(w, tree)
+
+	for tableHandle, name := 1, "DSDT"; lookupTableFn(name) != nil; tableHandle, name = tableHandle+1, acpi.SSDTName(tableHandle) {
+		if err := parser.ParseAML(uint8(tableHandle), name, lookupTableFn(name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package selftest
+
+import (
+	"bytes"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/kthread"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/timer"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	cmdlineBoolFn = cmdline.Bool
+	spawnFn = kthread.Spawn
+	allocFrameFn = mm.AllocFrame
+	freeFrameFn = mm.FreeFrame
+	mapRegionFn = vmm.MapRegion
+	unmapFn = vmm.Unmap
+	translateFn = vmm.Translate
+	nowFn = timer.Now
+	ticksFn = timer.Ticks
+	sleepFn = timer.Sleep
+	lookupTableFn = acpi.LookupTable
+	outputFn = kfmt.GetOutputSink
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	var buf bytes.Buffer
+	outputFn = func() io.Writer { return &buf }
+
+	specs := []struct {
+		enabled  bool
+		spawnErr *kernel.Error
+		expSpawn bool
+	}{
+		{false, nil, false},
+		{true, nil, true},
+		{true, &kernel.Error{Module: "test", Message: "out of threads"}, true},
+	}
+
+	for specIndex, spec := range specs {
+		var spawned func()
+		cmdlineBoolFn = func(name string) bool { return name == "selftest" && spec.enabled }
+		spawnFn = func(name string, fn func()) (*kthread.Thread, *kernel.Error) {
+			if name != "selftest" {
+				t.Errorf("[spec %d] unexpected thread name %q", specIndex, name)
+			}
+			spawned = fn
+			return nil, spec.spawnErr
+		}
+
+		if err := Init(); err != spec.spawnErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.spawnErr, err)
+		}
+
+		if got := spawned != nil; got != spec.expSpawn {
+			t.Errorf("[spec %d] expected thread to be spawned: %t; got %t", specIndex, spec.expSpawn, got)
+		}
+	}
+}
+
+func TestRunTests(t *testing.T) {
+	errFail := &kernel.Error{Module: "test", Message: "boom"}
+
+	var buf bytes.Buffer
+	passed, failed, skipped := runTests(&buf, []test{
+		{name: "ok", fn: func(_ io.Writer) *kernel.Error { return nil }},
+		{name: "broken", fn: func(_ io.Writer) *kernel.Error { return errFail }},
+		{
+			name:      "unavailable",
+			available: func() bool { return false },
+			fn: func(_ io.Writer) *kernel.Error {
+				t.Error("expected unavailable test not to run")
+				return nil
+			},
+		},
+	})
+
+	if passed != 1 || failed != 1 || skipped != 1 {
+		t.Errorf("expected 1 passed, 1 failed and 1 skipped test; got %d, %d, %d", passed, failed, skipped)
+	}
+
+	exp := "[selftest] PASS ok\n" +
+		"[selftest] FAIL broken: [test] boom\n" +
+		"[selftest] SKIP unavailable\n" +
+		"[selftest] done: 1 passed, 1 failed, 1 skipped\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output:\n%q\ngot:\n%q", exp, got)
+	}
+}
+
+func TestFrameAllocator(t *testing.T) {
+	defer restoreMocks()
+
+	allocErr := &kernel.Error{Module: "test", Message: "out of memory"}
+
+	specs := []struct {
+		frames   []mm.Frame
+		expErr   *kernel.Error
+		expFreed int
+	}{
+		{[]mm.Frame{1, 2, 3, 4, 5, 6, 7, 8}, nil, numTestFrames},
+		{[]mm.Frame{1, 2, 3, 2}, errDuplicateFrame, 3},
+		{[]mm.Frame{1, 2}, allocErr, 2},
+	}
+
+	for specIndex, spec := range specs {
+		var (
+			next  int
+			freed = make(map[mm.Frame]bool)
+		)
+
+		allocFrameFn = func() (mm.Frame, *kernel.Error) {
+			if next == len(spec.frames) {
+				return 0, allocErr
+			}
+			next++
+			return spec.frames[next-1], nil
+		}
+		freeFrameFn = func(frame mm.Frame) *kernel.Error {
+			if freed[frame] {
+				t.Errorf("[spec %d] frame %d freed twice", specIndex, frame)
+			}
+			freed[frame] = true
+			return nil
+		}
+
+		if err := testFrameAllocator(nil); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+
+		if len(freed) != spec.expFreed {
+			t.Errorf("[spec %d] expected %d frames to be freed; got %d", specIndex, spec.expFreed, len(freed))
+		}
+	}
+}
+
+func TestMapping(t *testing.T) {
+	defer restoreMocks()
+
+	// Simulate the physical memory with a page-aligned buffer that is
+	// mapped twice.
+	buf := make([]byte, 2*mm.PageSize)
+	bufPage := mm.PageFromAddress(uintptr(unsafe.Pointer(&buf[0])) + mm.PageSize - 1)
+	frame := mm.Frame(bufPage)
+
+	var (
+		mapped    map[mm.Page]bool
+		mapCount  int
+		translate func(uintptr) (uintptr, *kernel.Error)
+	)
+
+	allocFrameFn = func() (mm.Frame, *kernel.Error) { return frame, nil }
+	freeFrameFn = func(_ mm.Frame) *kernel.Error { return nil }
+	mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		mapCount++
+		mapped[bufPage] = true
+		return bufPage, nil
+	}
+	unmapFn = func(page mm.Page) *kernel.Error {
+		delete(mapped, page)
+		return nil
+	}
+	translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) { return translate(virtAddr) }
+
+	identityTranslate := func(virtAddr uintptr) (uintptr, *kernel.Error) {
+		if !mapped[mm.PageFromAddress(virtAddr)] {
+			return 0, vmm.ErrInvalidMapping
+		}
+		return virtAddr, nil
+	}
+
+	t.Run("success", func(t *testing.T) {
+		mapped, mapCount, translate = make(map[mm.Page]bool), 0, identityTranslate
+
+		if err := testMapping(nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if mapCount != 2 {
+			t.Fatalf("expected the frame to be mapped twice; got %d", mapCount)
+		}
+
+		if len(mapped) != 0 {
+			t.Fatal("expected all mappings to be removed")
+		}
+	})
+
+	t.Run("wrong translation", func(t *testing.T) {
+		mapped, translate = make(map[mm.Page]bool), func(_ uintptr) (uintptr, *kernel.Error) { return 0xbadf00d, nil }
+
+		if err := testMapping(nil); err != errTranslateMapping {
+			t.Fatalf("expected error %v; got %v", errTranslateMapping, err)
+		}
+	})
+
+	t.Run("stale mapping", func(t *testing.T) {
+		mapped = make(map[mm.Page]bool)
+		translate = func(virtAddr uintptr) (uintptr, *kernel.Error) { return virtAddr, nil }
+
+		if err := testMapping(nil); err != errStaleMapping {
+			t.Fatalf("expected error %v; got %v", errStaleMapping, err)
+		}
+	})
+
+	t.Run("map error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "out of address space"}
+		mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) { return 0, expErr }
+
+		if err := testMapping(nil); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestTimerAccuracy(t *testing.T) {
+	defer restoreMocks()
+
+	specs := []struct {
+		elapsed      timer.Duration
+		elapsedTicks uint64
+		expErr       *kernel.Error
+	}{
+		{timerSleep, uint64(timerSleep / timer.TickDuration), nil},
+		{timerSleep + timerTolerance, uint64(timerSleep / timer.TickDuration), nil},
+		{timerSleep - timer.Millisecond, uint64(timerSleep / timer.TickDuration), errTimerEarly},
+		{timerSleep + timerTolerance + 1, uint64(timerSleep / timer.TickDuration), errTimerLate},
+		{timerSleep, uint64(2 * timerSleep / timer.TickDuration), errClockDrift},
+		{timerSleep, 0, errClockDrift},
+	}
+
+	for specIndex, spec := range specs {
+		var (
+			now   timer.Duration
+			ticks uint64
+			slept timer.Duration
+		)
+
+		nowFn = func() timer.Duration { return now }
+		ticksFn = func() uint64 { return ticks }
+		sleepFn = func(d timer.Duration) {
+			slept = d
+			now += spec.elapsed
+			ticks += spec.elapsedTicks
+		}
+
+		if err := testTimerAccuracy(nil); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+
+		if slept != timerSleep {
+			t.Errorf("[spec %d] expected test to sleep for %d; got %d", specIndex, timerSleep, slept)
+		}
+	}
+}
+
+func TestAMLParse(t *testing.T) {
+	defer restoreMocks()
+
+	tables := make(map[string]*table.SDTHeader)
+	lookupTableFn = func(name string) *table.SDTHeader { return tables[name] }
+
+	if hasDSDT() {
+		t.Fatal("expected hasDSDT to return false when no DSDT is available")
+	}
+
+	_, f, _, _ := runtime.Caller(0)
+	for _, name := range []string{"DSDT", "SSDT"} {
+		data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(f), "../../device/acpi/table/tabletest", name+".aml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables[name] = (*table.SDTHeader)(unsafe.Pointer(&data[0]))
+	}
+
+	if !hasDSDT() {
+		t.Fatal("expected hasDSDT to return true")
+	}
+
+	var buf bytes.Buffer
+	if err := testAMLParse(&buf); err != nil {
+		t.Fatalf("unexpected error: %v; parser output:\n%s", err, buf.String())
+	}
+
+	// Corrupt the DSDT bytecode
+	data := make([]byte, unsafe.Sizeof(table.SDTHeader{})+4)
+	header := (*table.SDTHeader)(unsafe.Pointer(&data[0]))
+	header.Length = uint32(len(data))
+	copy(data[unsafe.Sizeof(*header):], []byte{0x10, 0xff, 0xff, 0xff})
+	tables["DSDT"] = header
+
+	if err := testAMLParse(&buf); err == nil {
+		t.Fatal("expected an error while parsing corrupted bytecode")
+	}
+}
@@ -0,0 +1,8 @@
+// Package smp implements the bring-up of the application processors (APs) on
+// multi-processor systems and maintains the per-CPU data for each processor.
+package smp
+
+import "gopheros/kernel/sched"
+
+// MaxCPUs is the maximum number of processors supported by the kernel.
+const MaxCPUs = sched.MaxCPUs
@@ -0,0 +1,357 @@
+package smp
+
+import (
+	"gopheros/device/apic"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/trace"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// RescheduleVector is the vector of the IPI that wakes up a halted
+	// processor after the scheduler queues a thread for it.
+	RescheduleVector = gate.InterruptNumber(0xf1)
+
+	apStackSize = 16384
+
+	// apStackGuard is the number of bytes at the bottom of each AP stack
+	// that Go function prologues treat as the stack limit.
+	apStackGuard = 1024
+
+	// gdtEntries is the number of 8-byte slots in each per-CPU GDT. The
+	// spare slots are reserved for per-CPU system descriptors (e.g. TSS).
+	gdtEntries = 16
+
+	// The STARTUP IPI vector encodes the frame number of the trampoline
+	// so it must reside in the first 1M of physical memory.
+	maxTrampolineFrame = mm.Frame(0xff)
+
+	initDeassertDelayMicros = 10000
+	startupDelayMicros      = 200
+	apOnlineTimeoutMicros   = 100000
+)
+
+var (
+	errNoLocalAPIC          = &kernel.Error{Module: "smp", Message: "AP startup requires a local APIC"}
+	errTrampolineAllocation = &kernel.Error{Module: "smp", Message: "no frame below 1M was reserved for the AP trampoline"}
+	errPDTAbove4G           = &kernel.Error{Module: "smp", Message: "AP startup requires the active page tables to reside below 4G"}
+
+	// cpus contains the per-CPU data for all processors that were started.
+	// The boot processor is always stored at index 0.
+	cpus []*CPU
+
+	// The following functions are used by tests to mock calls to the apic,
+	// cpu, irq, mm, sched and vmm packages.
+	activeLocalAPICFn   = activeLocalAPIC
+	processorAPICIDsFn  = apic.ProcessorAPICIDs
+	freeFrameFn         = mm.FreeFrame
+	identityMapRegionFn = vmm.IdentityMapRegion
+	unmapFn             = vmm.Unmap
+	activePDTFn         = cpu.ActivePDT
+	readTSCFn           = cpu.ReadTSC
+	storeGDTRFn         = storeGDTR
+	registerHandlerFn   = irq.RegisterHandler
+	setCPUIndexFn       = sched.SetCPUIndex
+	setKickFn           = sched.SetKick
+	runAPFn             = sched.RunAP
+)
+
+// localAPIC describes the local APIC operations required for starting APs.
+type localAPIC interface {
+	ID() uint8
+	SendIPI(dest uint8, vector gate.InterruptNumber, mode apic.IPIDeliveryMode)
+	TSCFrequency() uint64
+	InitAP()
+}
+
+// CPU holds the per-CPU data for a processor.
+type CPU struct {
+	// The following fields are accessed by apStart and must remain at the
+	// offsets defined in smp_amd64.s.
+
+	// gdtDesc holds the 10-byte descriptor for gdt that is loaded via
+	// LGDT.
+	gdtDesc [16]byte
+
+	// gPtr and tcb form the per-CPU TLS block. The FS base of the CPU
+	// points to tcb which, as required by the x86-64 ABI, contains its own
+	// address. The Go runtime looks up the current g at FS:-8.
+	gPtr uintptr
+	tcb  uintptr
+
+	// g provides the leading fields of a runtime g struct (stack bounds
+	// and guards) so that Go function prologues can perform stack checks
+	// while running on the AP stack.
+	g [4]uintptr
+
+	index  int
+	apicID uint8
+
+	// online is set to 1 by the processor once it completes its
+	// initialization.
+	online uint32
+
+	gdt   [gdtEntries]uint64
+	stack []byte
+}
+
+// Index returns the logical index of the processor. The boot processor always
+// has index 0.
+func (c *CPU) Index() int {
+	return c.index
+}
+
+// APICID returns the local APIC ID of the processor.
+func (c *CPU) APICID() uint8 {
+	return c.apicID
+}
+
+// Online returns true if the processor has completed its initialization.
+func (c *CPU) Online() bool {
+	return atomic.LoadUint32(&c.online) == 1
+}
+
+// CPUs returns the per-CPU data for all processors that were started.
+func CPUs() []*CPU {
+	return cpus
+}
+
+// Current returns the per-CPU data for the calling processor or nil if the
+// processor is not known to the smp package.
+func Current() *CPU {
+	lapic := activeLocalAPICFn()
+	if lapic == nil {
+		if len(cpus) != 0 {
+			return cpus[0]
+		}
+		return nil
+	}
+
+	id := lapic.ID()
+	for _, c := range cpus {
+		if c.apicID == id {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// currentIndex returns the index of the calling processor or -1 if the
+// processor is not known to the smp package.
+func currentIndex() int {
+	if c := Current(); c != nil {
+		return c.index
+	}
+	return -1
+}
+
+// Init registers the boot processor and starts all other enabled processors
+// listed in the ACPI MADT. Each AP receives its own GDT, stack and per-CPU
+// area and then runs the scheduler idle loop for its processor. APs that do
+// not respond within a timeout are skipped.
+//
+// The APs start executing in real mode so their startup code is copied to
+// trampolineFrame which must reside below 1M. As the low memory frames are
+// quickly claimed by other allocations, the caller is expected to reserve the
+// frame while the frame allocator is initialized. Init takes ownership of the
+// frame and releases it once it is no longer needed.
+//
+// Init must be invoked after the local APIC driver has been initialized.
+func Init(trampolineFrame mm.Frame) *kernel.Error {
+	// An AP that did not respond in time may still wake up and execute the
+	// trampoline later on so its frame is only released if every AP that
+	// received a STARTUP IPI came online.
+	var keepFrame bool
+	defer func() {
+		if !keepFrame && trampolineFrame.Valid() {
+			_ = freeFrameFn(trampolineFrame)
+		}
+	}()
+
+	lapic := activeLocalAPICFn()
+	if lapic == nil {
+		return errNoLocalAPIC
+	}
+
+	bsp := &CPU{apicID: lapic.ID(), online: 1}
+
+	// The slice never grows past its initial capacity so APs can safely
+	// look up their index while other APs are being started.
+	cpus = make([]*CPU, 1, MaxCPUs)
+	cpus[0] = bsp
+	trace.SetCPUIndex(currentIndex)
+	setCPUIndexFn(currentIndex)
+
+	var apicIDs []uint8
+	for _, id := range processorAPICIDsFn() {
+		if id != bsp.apicID && len(apicIDs)+1 < MaxCPUs {
+			apicIDs = append(apicIDs, id)
+		}
+	}
+
+	if len(apicIDs) == 0 {
+		return nil
+	}
+
+	pdt := activePDTFn()
+	if pdt > 0xffffffff {
+		return errPDTAbove4G
+	}
+
+	if !trampolineFrame.Valid() || trampolineFrame > maxTrampolineFrame {
+		return errTrampolineAllocation
+	}
+
+	// The trampoline must be identity-mapped as the APs enable paging
+	// while executing it.
+	page, err := identityMapRegionFn(trampolineFrame, mm.PageSize, vmm.FlagPresent|vmm.FlagRW)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = unmapFn(page) }()
+
+	trampoline := (*[len(apTrampoline)]byte)(unsafe.Pointer(page.Address()))
+	*trampoline = apTrampoline
+	*(*uint64)(unsafe.Pointer(&trampoline[trampolineParamCR3])) = uint64(pdt)
+	*(*uint64)(unsafe.Pointer(&trampoline[trampolineParamEntry])) = uint64(apStartAddr())
+
+	if err = registerHandlerFn(RescheduleVector, handleReschedule); err != nil {
+		return err
+	}
+	setKickFn(func(index int) {
+		if index < len(cpus) {
+			lapic.SendIPI(cpus[index].apicID, RescheduleVector, apic.IPIFixed)
+		}
+	})
+
+	var bspGDT [16]byte
+	storeGDTRFn(&bspGDT)
+
+	for _, apicID := range apicIDs {
+		c := newAPCPU(len(cpus), apicID, &bspGDT)
+		*(*uint64)(unsafe.Pointer(&trampoline[trampolineParamStack])) = uint64(c.g[1])
+		*(*uint64)(unsafe.Pointer(&trampoline[trampolineParamCPU])) = uint64(uintptr(unsafe.Pointer(c)))
+
+		cpus = append(cpus, c)
+		if !startAP(lapic, c, trampolineFrame) {
+			keepFrame = true
+			cpus = cpus[:len(cpus)-1]
+			kfmt.Printf("[smp] CPU with APIC ID %d did not respond to STARTUP IPIs\n", apicID)
+			continue
+		}
+	}
+
+	kfmt.Printf("[smp] %d/%d processors online\n", len(cpus), len(apicIDs)+1)
+	return nil
+}
+
+// newAPCPU allocates the per-CPU data for an AP. The AP receives a copy of the
+// boot processor GDT so the segment selector values remain the same.
+func newAPCPU(index int, apicID uint8, bspGDT *[16]byte) *CPU {
+	c := &CPU{
+		index:  index,
+		apicID: apicID,
+		stack:  make([]byte, apStackSize),
+	}
+
+	// The stack pages may be lazily backed by physical frames; touch them
+	// so that the AP does not page-fault before it has loaded its IDT.
+	for offset := 0; offset < apStackSize; offset += int(mm.PageSize) {
+		c.stack[offset] = 0
+	}
+
+	stackLo := uintptr(unsafe.Pointer(&c.stack[0]))
+	stackHi := (stackLo + apStackSize) &^ 0xf
+	c.g = [4]uintptr{stackLo, stackHi, stackLo + apStackGuard, stackLo + apStackGuard}
+	c.gPtr = uintptr(unsafe.Pointer(&c.g))
+	c.tcb = uintptr(unsafe.Pointer(&c.tcb))
+
+	var (
+		bspGDTLimit = *(*uint16)(unsafe.Pointer(&bspGDT[0]))
+		bspGDTBase  = *(*uintptr)(unsafe.Pointer(&bspGDT[2]))
+		copyLen     = uintptr(bspGDTLimit) + 1
+	)
+	if maxLen := uintptr(len(c.gdt) * 8); copyLen > maxLen {
+		copyLen = maxLen
+	}
+	kernel.Memcopy(bspGDTBase, uintptr(unsafe.Pointer(&c.gdt[0])), copyLen)
+
+	*(*uint16)(unsafe.Pointer(&c.gdtDesc[0])) = uint16(len(c.gdt)*8 - 1)
+	*(*uintptr)(unsafe.Pointer(&c.gdtDesc[2])) = uintptr(unsafe.Pointer(&c.gdt[0]))
+	return c
+}
+
+// startAP sends the INIT-SIPI-SIPI sequence to an AP and waits for it to come
+// online.
+func startAP(lapic localAPIC, c *CPU, trampolineFrame mm.Frame) bool {
+	lapic.SendIPI(c.apicID, 0, apic.IPIInit)
+	delayMicros(lapic, initDeassertDelayMicros)
+
+	// As per the Intel MP specification, the STARTUP IPI is sent twice
+	for attempt := 0; attempt < 2 && !c.Online(); attempt++ {
+		lapic.SendIPI(c.apicID, gate.InterruptNumber(trampolineFrame), apic.IPIStartup)
+		delayMicros(lapic, startupDelayMicros)
+	}
+
+	for waited := 0; !c.Online() && waited < apOnlineTimeoutMicros; waited += startupDelayMicros {
+		delayMicros(lapic, startupDelayMicros)
+	}
+
+	return c.Online()
+}
+
+// delayMicros busy-waits for the specified number of microseconds using the
+// calibrated TSC frequency.
+func delayMicros(lapic localAPIC, micros uint64) {
+	ticks := lapic.TSCFrequency() / 1000000 * micros
+	for start := readTSCFn(); readTSCFn()-start < ticks; {
+	}
+}
+
+// apMain is invoked by apStart once an AP has switched to its own GDT and
+// per-CPU TLS block. As the Go runtime is not aware of the APs, code running
+// on them must not allocate memory or otherwise depend on the runtime.
+//
+//go:nosplit
+func apMain(c *CPU) {
+	gate.LoadIDT()
+	if lapic := activeLocalAPICFn(); lapic != nil {
+		lapic.InitAP()
+	}
+
+	atomic.StoreUint32(&c.online, 1)
+	runAPFn(c.index)
+}
+
+// handleReschedule handles the IPI that the scheduler sends to wake up a
+// halted processor. Returning from the interrupt resumes the idle loop of the
+// processor which then picks up the newly queued thread.
+func handleReschedule(_ *gate.Registers) bool {
+	return true
+}
+
+func activeLocalAPIC() localAPIC {
+	if lapic := apic.ActiveLocalAPIC(); lapic != nil {
+		return lapic
+	}
+	return nil
+}
+
+// apStart is the 64-bit entrypoint for APs. It is only reachable via the
+// startup trampoline.
+func apStart()
+
+// apStartAddr returns the address of apStart.
+func apStartAddr() uintptr
+
+// storeGDTR stores the GDT descriptor of the calling CPU to desc.
+func storeGDTR(desc *[16]byte)
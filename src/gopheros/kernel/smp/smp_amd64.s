@@ -0,0 +1,47 @@
+#include "textflag.h"
+
+// Offsets of the CPU struct fields accessed by apStart.
+#define CPU_GDT_DESC 0
+#define CPU_TCB 24
+
+#define KERNEL_DS 0x10
+#define MSR_FS_BASE 0xc0000100
+
+TEXT ·apStartAddr(SB),NOSPLIT,$0
+	LEAQ ·apStart(SB), AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·storeGDTR(SB),NOSPLIT,$0
+	MOVQ desc+0(FP), AX
+	MOVQ GDTR, 0(AX) 	// SGDT[RAX]
+	RET
+
+// apStart is the 64-bit entrypoint for application processors. The trampoline
+// code jumps here with the stack pointer set to the top of the AP stack and
+// the address of the AP's CPU struct in DI.
+TEXT ·apStart(SB),NOSPLIT,$8
+	MOVQ DI, BX
+
+	// Switch to the per-CPU GDT. It uses the same selectors as the
+	// trampoline GDT so only the data segment registers need reloading.
+	MOVQ CPU_GDT_DESC(BX), GDTR 	// LGDT[RBX]
+	MOVW $KERNEL_DS, AX
+	MOVW AX, DS
+	MOVW AX, ES
+	MOVW AX, SS
+
+	// Point the FS base to the per-CPU TCB
+	LEAQ CPU_TCB(BX), AX
+	MOVQ AX, DX
+	SHRQ $32, DX
+	MOVL $MSR_FS_BASE, CX
+	WRMSR
+
+	MOVQ BX, 0(SP)
+	CALL ·apMain(SB)
+
+halt:
+	CLI
+	HLT
+	JMP halt
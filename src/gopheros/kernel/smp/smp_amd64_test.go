@@ -0,0 +1,404 @@
+package smp
+
+import (
+	"gopheros/device/apic"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/sched"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	activeLocalAPICFn = activeLocalAPIC
+	processorAPICIDsFn = apic.ProcessorAPICIDs
+	freeFrameFn = mm.FreeFrame
+	identityMapRegionFn = vmm.IdentityMapRegion
+	unmapFn = vmm.Unmap
+	activePDTFn = cpu.ActivePDT
+	readTSCFn = cpu.ReadTSC
+	storeGDTRFn = storeGDTR
+	registerHandlerFn = irq.RegisterHandler
+	setCPUIndexFn = sched.SetCPUIndex
+	setKickFn = sched.SetKick
+	runAPFn = sched.RunAP
+	cpus = nil
+}
+
+// mockSched replaces the calls to the irq and sched packages and returns
+// pointers to the registered CPU index and kick functions.
+func mockSched() (*func() int, *func(int)) {
+	var (
+		indexFn func() int
+		kickFn  func(int)
+	)
+	registerHandlerFn = func(_ gate.InterruptNumber, _ irq.Handler) *kernel.Error { return nil }
+	setCPUIndexFn = func(fn func() int) { indexFn = fn }
+	setKickFn = func(fn func(int)) { kickFn = fn }
+	return &indexFn, &kickFn
+}
+
+type sentIPI struct {
+	dest   uint8
+	vector gate.InterruptNumber
+	mode   apic.IPIDeliveryMode
+}
+
+// mockLocalAPIC records the IPIs sent to APs. When a STARTUP IPI is sent to
+// one of the APIC IDs in respondingIDs, the CPU referenced by the trampoline
+// parameter block is marked as online.
+type mockLocalAPIC struct {
+	id            uint8
+	sent          []sentIPI
+	respondingIDs map[uint8]bool
+	trampoline    uintptr
+}
+
+func (m *mockLocalAPIC) ID() uint8            { return m.id }
+func (m *mockLocalAPIC) TSCFrequency() uint64 { return 1000000 }
+func (m *mockLocalAPIC) InitAP()              {}
+func (m *mockLocalAPIC) SendIPI(dest uint8, vector gate.InterruptNumber, mode apic.IPIDeliveryMode) {
+	m.sent = append(m.sent, sentIPI{dest, vector, mode})
+	if mode == apic.IPIStartup && m.respondingIDs[dest] {
+		c := (*CPU)(unsafe.Pointer(*(*uintptr)(unsafe.Pointer(m.trampoline + trampolineParamCPU))))
+		c.online = 1
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	defer restoreMocks()
+	mockSched()
+
+	var (
+		trampolineBuf = make([]byte, 2*mm.PageSize)
+		trampolineVA  = (uintptr(unsafe.Pointer(&trampolineBuf[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+	)
+
+	lapic := &mockLocalAPIC{id: 0}
+	processorAPICIDsFn = func() []uint8 { return []uint8{0, 1} }
+
+	// Init owns the trampoline frame so it should be released on errors
+	specs := []struct {
+		setup        func()
+		frame        mm.Frame
+		expErr       *kernel.Error
+		expFreeFrame mm.Frame
+	}{
+		{
+			func() { activeLocalAPICFn = func() localAPIC { return nil } },
+			mm.Frame(8),
+			errNoLocalAPIC,
+			mm.Frame(8),
+		},
+		{
+			func() { activePDTFn = func() uintptr { return 0x100000000 } },
+			mm.Frame(8),
+			errPDTAbove4G,
+			mm.Frame(8),
+		},
+		{
+			func() {},
+			mm.Frame(0x100),
+			errTrampolineAllocation,
+			mm.Frame(0x100),
+		},
+		{
+			func() {},
+			mm.InvalidFrame,
+			errTrampolineAllocation,
+			mm.InvalidFrame,
+		},
+		{
+			func() {
+				identityMapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+					return 0, &kernel.Error{Module: "test", Message: "map failed"}
+				}
+			},
+			mm.Frame(8),
+			&kernel.Error{Module: "test", Message: "map failed"},
+			mm.Frame(8),
+		},
+		{
+			func() {
+				registerHandlerFn = func(_ gate.InterruptNumber, _ irq.Handler) *kernel.Error {
+					return &kernel.Error{Module: "test", Message: "vector in use"}
+				}
+			},
+			mm.Frame(8),
+			&kernel.Error{Module: "test", Message: "vector in use"},
+			mm.Frame(8),
+		},
+	}
+
+	for specIndex, spec := range specs {
+		freedFrame := mm.InvalidFrame
+		freeFrameFn = func(frame mm.Frame) *kernel.Error {
+			freedFrame = frame
+			return nil
+		}
+
+		activeLocalAPICFn = func() localAPIC { return lapic }
+		activePDTFn = func() uintptr { return 0x1000 }
+		identityMapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return mm.PageFromAddress(trampolineVA), nil
+		}
+		unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+		registerHandlerFn = func(_ gate.InterruptNumber, _ irq.Handler) *kernel.Error { return nil }
+		spec.setup()
+
+		err := Init(spec.frame)
+		if err == nil || err.Message != spec.expErr.Message {
+			t.Errorf("[spec %d] expected to get error: %v; got %v", specIndex, spec.expErr, err)
+		}
+
+		if freedFrame != spec.expFreeFrame {
+			t.Errorf("[spec %d] expected frame %d to be freed; got %d", specIndex, spec.expFreeFrame, freedFrame)
+		}
+	}
+}
+
+func TestInitSingleCPU(t *testing.T) {
+	defer restoreMocks()
+	indexFn, _ := mockSched()
+
+	lapic := &mockLocalAPIC{id: 3}
+	activeLocalAPICFn = func() localAPIC { return lapic }
+	processorAPICIDsFn = func() []uint8 { return []uint8{3} }
+	identityMapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		t.Fatal("unexpected call to IdentityMapRegion")
+		return 0, nil
+	}
+
+	freedFrame := mm.InvalidFrame
+	freeFrameFn = func(frame mm.Frame) *kernel.Error {
+		freedFrame = frame
+		return nil
+	}
+
+	if err := Init(mm.Frame(8)); err != nil {
+		t.Fatal(err)
+	}
+
+	if freedFrame != mm.Frame(8) {
+		t.Fatalf("expected the unused trampoline frame to be freed; got %d", freedFrame)
+	}
+
+	if len(CPUs()) != 1 || CPUs()[0].APICID() != 3 || !CPUs()[0].Online() {
+		t.Fatalf("expected only the BSP to be registered; got %d CPUs", len(CPUs()))
+	}
+
+	if Current() != CPUs()[0] {
+		t.Fatal("expected Current to return the BSP")
+	}
+
+	if *indexFn == nil || (*indexFn)() != 0 {
+		t.Fatal("expected the scheduler to look up the CPU index via the smp package")
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+	_, kickFn := mockSched()
+
+	var rescheduleHandler irq.Handler
+	registerHandlerFn = func(vector gate.InterruptNumber, fn irq.Handler) *kernel.Error {
+		if vector == RescheduleVector {
+			rescheduleHandler = fn
+		}
+		return nil
+	}
+
+	var (
+		trampolineBuf = make([]byte, 2*mm.PageSize)
+		trampolineVA  = (uintptr(unsafe.Pointer(&trampolineBuf[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+		bspGDT        = [3]uint64{0, 0x00209a0000000000, 0x0000920000000000}
+		tsc           uint64
+		unmapped      mm.Page
+	)
+
+	lapic := &mockLocalAPIC{
+		id:            0,
+		respondingIDs: map[uint8]bool{1: true, 4: true},
+		trampoline:    trampolineVA,
+	}
+	activeLocalAPICFn = func() localAPIC { return lapic }
+	processorAPICIDsFn = func() []uint8 { return []uint8{0, 1, 2, 4} }
+	activePDTFn = func() uintptr { return 0xbadf000 }
+	readTSCFn = func() uint64 {
+		tsc += 1000
+		return tsc
+	}
+	identityMapRegionFn = func(frame mm.Frame, size uintptr, flags vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		if frame != 8 || size != mm.PageSize || flags&vmm.FlagNoExecute != 0 {
+			t.Errorf("unexpected identity mapping request: frame %d, size %d, flags %x", frame, size, flags)
+		}
+		return mm.PageFromAddress(trampolineVA), nil
+	}
+	unmapFn = func(page mm.Page) *kernel.Error {
+		unmapped = page
+		return nil
+	}
+	freeFrameFn = func(_ mm.Frame) *kernel.Error {
+		t.Error("expected the trampoline frame to be kept while an AP has not responded")
+		return nil
+	}
+	storeGDTRFn = func(desc *[16]byte) {
+		*(*uint16)(unsafe.Pointer(&desc[0])) = uint16(len(bspGDT)*8 - 1)
+		*(*uintptr)(unsafe.Pointer(&desc[2])) = uintptr(unsafe.Pointer(&bspGDT[0]))
+	}
+
+	if err := Init(mm.Frame(8)); err != nil {
+		t.Fatal(err)
+	}
+
+	if unmapped != mm.PageFromAddress(trampolineVA) {
+		t.Error("expected trampoline page to be unmapped")
+	}
+
+	// The code portion of the trampoline should have been copied verbatim
+	for i := 0; i < trampolineParamCR3; i++ {
+		if got := *(*byte)(unsafe.Pointer(trampolineVA + uintptr(i))); got != apTrampoline[i] {
+			t.Fatalf("trampoline mismatch at offset %d: expected 0x%x; got 0x%x", i, apTrampoline[i], got)
+		}
+	}
+
+	if got := *(*uint64)(unsafe.Pointer(trampolineVA + trampolineParamCR3)); got != 0xbadf000 {
+		t.Errorf("expected trampoline CR3 to be 0xbadf000; got 0x%x", got)
+	}
+
+	if got := *(*uint64)(unsafe.Pointer(trampolineVA + trampolineParamEntry)); got != uint64(apStartAddr()) {
+		t.Errorf("expected trampoline entry to be 0x%x; got 0x%x", apStartAddr(), got)
+	}
+
+	// APIC ID 2 does not respond so only 3 CPUs should be online
+	if got := len(CPUs()); got != 3 {
+		t.Fatalf("expected 3 CPUs to be online; got %d", got)
+	}
+
+	for specIndex, expID := range []uint8{0, 1, 4} {
+		c := CPUs()[specIndex]
+		if c.Index() != specIndex || c.APICID() != expID || !c.Online() {
+			t.Errorf("[spec %d] unexpected CPU: index %d, APIC ID %d, online %t", specIndex, c.Index(), c.APICID(), c.Online())
+		}
+	}
+
+	ap := CPUs()[1]
+	if ap.gdt[1] != bspGDT[1] || ap.gdt[2] != bspGDT[2] {
+		t.Error("expected AP GDT to contain a copy of the BSP GDT")
+	}
+
+	if got := *(*uintptr)(unsafe.Pointer(&ap.gdtDesc[2])); got != uintptr(unsafe.Pointer(&ap.gdt[0])) {
+		t.Error("expected AP GDT descriptor to point to the per-CPU GDT")
+	}
+
+	stackLo := uintptr(unsafe.Pointer(&ap.stack[0]))
+	if ap.g[0] != stackLo || ap.g[1] <= stackLo || ap.g[1] > stackLo+apStackSize || ap.g[1]&0xf != 0 {
+		t.Errorf("unexpected AP stack bounds: [0x%x, 0x%x]", ap.g[0], ap.g[1])
+	}
+
+	if ap.tcb != uintptr(unsafe.Pointer(&ap.tcb)) || ap.gPtr != uintptr(unsafe.Pointer(&ap.g)) {
+		t.Error("expected AP TLS block to point to the per-CPU g")
+	}
+
+	// Check the offsets used by apStart
+	if got := unsafe.Offsetof(ap.tcb); got != 24 {
+		t.Errorf("expected tcb to be located at offset 24; got %d", got)
+	}
+
+	// The responding APs receive INIT and a single STARTUP IPI while the
+	// non-responding one receives INIT and two STARTUP IPIs.
+	expIPIs := []sentIPI{
+		{1, 0, apic.IPIInit},
+		{1, 8, apic.IPIStartup},
+		{2, 0, apic.IPIInit},
+		{2, 8, apic.IPIStartup},
+		{2, 8, apic.IPIStartup},
+		{4, 0, apic.IPIInit},
+		{4, 8, apic.IPIStartup},
+	}
+
+	if len(lapic.sent) != len(expIPIs) {
+		t.Fatalf("expected %d IPIs to be sent; got %d", len(expIPIs), len(lapic.sent))
+	}
+
+	for specIndex, exp := range expIPIs {
+		if lapic.sent[specIndex] != exp {
+			t.Errorf("[spec %d] expected IPI %+v; got %+v", specIndex, exp, lapic.sent[specIndex])
+		}
+	}
+
+	if rescheduleHandler == nil || !rescheduleHandler(nil) {
+		t.Error("expected a handler for the reschedule IPI to be registered")
+	}
+
+	// Kicking a CPU sends a reschedule IPI to its local APIC
+	lapic.sent = nil
+	(*kickFn)(2)
+	(*kickFn)(5)
+	if exp := []sentIPI{{4, RescheduleVector, apic.IPIFixed}}; len(lapic.sent) != 1 || lapic.sent[0] != exp[0] {
+		t.Errorf("expected kick to send %+v; got %+v", exp, lapic.sent)
+	}
+
+	lapic.id = 4
+	if Current() != CPUs()[2] {
+		t.Error("expected Current to return the CPU with APIC ID 4")
+	}
+
+	lapic.id = 7
+	if Current() != nil {
+		t.Error("expected Current to return nil for an unknown APIC ID")
+	}
+}
+
+func TestInitFreesTrampoline(t *testing.T) {
+	defer restoreMocks()
+	mockSched()
+
+	var (
+		trampolineBuf = make([]byte, 2*mm.PageSize)
+		trampolineVA  = (uintptr(unsafe.Pointer(&trampolineBuf[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+		bspGDT        = [3]uint64{0, 0x00209a0000000000, 0x0000920000000000}
+		tsc           uint64
+		freedFrame    = mm.InvalidFrame
+	)
+
+	lapic := &mockLocalAPIC{
+		respondingIDs: map[uint8]bool{1: true, 2: true},
+		trampoline:    trampolineVA,
+	}
+	activeLocalAPICFn = func() localAPIC { return lapic }
+	processorAPICIDsFn = func() []uint8 { return []uint8{0, 1, 2} }
+	activePDTFn = func() uintptr { return 0xbadf000 }
+	readTSCFn = func() uint64 {
+		tsc += 1000
+		return tsc
+	}
+	identityMapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		return mm.PageFromAddress(trampolineVA), nil
+	}
+	unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+	freeFrameFn = func(frame mm.Frame) *kernel.Error {
+		freedFrame = frame
+		return nil
+	}
+	storeGDTRFn = func(desc *[16]byte) {
+		*(*uint16)(unsafe.Pointer(&desc[0])) = uint16(len(bspGDT)*8 - 1)
+		*(*uintptr)(unsafe.Pointer(&desc[2])) = uintptr(unsafe.Pointer(&bspGDT[0]))
+	}
+
+	if err := Init(mm.Frame(8)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(CPUs()); got != 3 {
+		t.Fatalf("expected 3 CPUs to be online; got %d", got)
+	}
+
+	if freedFrame != mm.Frame(8) {
+		t.Fatalf("expected the trampoline frame to be freed once all APs are online; got %d", freedFrame)
+	}
+}
@@ -0,0 +1,43 @@
+package smp
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+)
+
+// The arm64 port is a stub: its entry points allow the architecture-neutral
+// kernel packages to be type-checked for arm64 but panic when invoked.
+
+var errNotImplemented = &kernel.Error{Module: "smp", Message: "AP startup is not implemented on arm64", Code: kernel.CodeNotImplemented}
+
+// CPU holds the per-CPU data for a processor.
+type CPU struct {
+	index int
+}
+
+// Index returns the logical index of the processor. The boot processor always
+// has index 0.
+func (c *CPU) Index() int {
+	return c.index
+}
+
+// Online returns true if the processor has completed its initialization.
+func (c *CPU) Online() bool {
+	return true
+}
+
+// CPUs returns the per-CPU data for all processors that were started.
+func CPUs() []*CPU {
+	return nil
+}
+
+// Current returns the per-CPU data for the calling processor or nil if the
+// processor is not known to the smp package.
+func Current() *CPU {
+	return nil
+}
+
+// Init registers the boot processor and starts all other processors.
+func Init(_ mm.Frame) *kernel.Error {
+	return errNotImplemented
+}
@@ -0,0 +1,128 @@
+# vim: set ft=gas :
+#
+# Application processor startup trampoline.
+#
+# The BSP copies this code to a page-aligned frame below 1M and points the
+# STARTUP IPI at it. APs begin executing it in real mode with CS set to
+# (frame address >> 4) and IP set to 0. The trampoline switches the AP to
+# protected mode, enables paging using the BSP page tables, enters long mode
+# and finally jumps to the 64-bit kernel entrypoint passing the address of the
+# AP's CPU struct in RDI.
+#
+# The code is position-independent; all linear addresses are computed relative
+# to the trampoline base which is kept in EBX. Before sending each STARTUP
+# IPI, the BSP populates the parameter block at the end of the trampoline.
+#
+# The assembled code is embedded in trampoline_amd64.go. To regenerate it run:
+#   as --64 -o trampoline.o trampoline_amd64.asm
+#   objcopy -O binary -j .text trampoline.o trampoline.bin
+#   xxd -i trampoline.bin
+
+.text
+.code16
+start:
+	cli
+	cld
+
+	# Calculate the linear address of the trampoline and use it to patch
+	# the GDT descriptor and the far jump targets.
+	movw %cs, %ax
+	movw %ax, %ds
+	xorl %ebx, %ebx
+	movw %ax, %bx
+	shll $4, %ebx
+
+	leal (gdt - start)(%ebx), %eax
+	movl %eax, (gdt_desc - start + 2)
+	leal (pm32 - start)(%ebx), %eax
+	movl %eax, (pm32_ptr - start)
+	leal (lm64 - start)(%ebx), %eax
+	movl %eax, (lm64_ptr - start)
+
+	lgdtl (gdt_desc - start)
+
+	# Enable protected mode
+	movl %cr0, %eax
+	orl $1, %eax
+	movl %eax, %cr0
+	ljmpl *(pm32_ptr - start)
+
+.code32
+pm32:
+	movw $0x10, %ax
+	movw %ax, %ds
+	movw %ax, %es
+	movw %ax, %ss
+
+	# Enable SSE support (clear CR0.EM, set CR0.MP, set CR4.OSFXSR and
+	# CR4.OSXMMEXCPT) and PAE.
+	movl %cr0, %eax
+	andl $0xfffffffb, %eax
+	orl $0x2, %eax
+	movl %eax, %cr0
+	movl %cr4, %eax
+	orl $0x620, %eax
+	movl %eax, %cr4
+
+	# Load the BSP page tables
+	movl (param_cr3 - start)(%ebx), %eax
+	movl %eax, %cr3
+
+	# Set EFER.LME and EFER.NXE
+	movl $0xc0000080, %ecx
+	rdmsr
+	orl $0x900, %eax
+	wrmsr
+
+	# Enable paging and write protection
+	movl %cr0, %eax
+	orl $0x80010000, %eax
+	movl %eax, %cr0
+	ljmpl *(lm64_ptr - start)(%ebx)
+
+.code64
+lm64:
+	xorw %ax, %ax
+	movw %ax, %ds
+	movw %ax, %es
+	movw %ax, %ss
+	movw %ax, %fs
+	movw %ax, %gs
+
+	movq (param_stack - start)(%rbx), %rsp
+	movq (param_cpu - start)(%rbx), %rdi
+	movq (param_entry - start)(%rbx), %rax
+	jmpq *%rax
+
+# Far pointers (m16:32) for switching to 32-bit and 64-bit mode.
+.balign 8
+pm32_ptr:
+	.long 0
+	.word 0x18
+lm64_ptr:
+	.long 0
+	.word 0x08
+
+# Temporary GDT. The 64-bit code segment uses the same selector as the kernel
+# GDT so CS does not need to be reloaded after the AP switches to its own GDT.
+.balign 8
+gdt:
+	.quad 0                     # null
+	.quad 0x00209a0000000000    # 0x08: 64-bit code
+	.quad 0x00cf92000000ffff    # 0x10: 32-bit data
+	.quad 0x00cf9a000000ffff    # 0x18: 32-bit code
+gdt_desc:
+	.word gdt_desc - gdt - 1
+	.long 0
+
+# Parameter block populated by the BSP.
+.balign 8
+param_cr3:
+	.quad 0
+param_stack:
+	.quad 0
+param_cpu:
+	.quad 0
+param_entry:
+	.quad 0
+end:
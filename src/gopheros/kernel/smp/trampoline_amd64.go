@@ -0,0 +1,38 @@
+package smp
+
+// Offsets of the parameter block fields inside apTrampoline.
+const (
+	trampolineParamCR3   = 0xf0
+	trampolineParamStack = 0xf8
+	trampolineParamCPU   = 0x100
+	trampolineParamEntry = 0x108
+)
+
+// apTrampoline contains the assembled real-mode startup code for application
+// processors. See trampoline_amd64.asm for the source and the commands used to
+// regenerate it.
+var apTrampoline = [...]byte{
+	0xfa, 0xfc, 0x8c, 0xc8, 0x8e, 0xd8, 0x66, 0x31, 0xdb, 0x89, 0xc3, 0x66,
+	0xc1, 0xe3, 0x04, 0x67, 0x66, 0x8d, 0x83, 0xc8, 0x00, 0x00, 0x00, 0x66,
+	0xa3, 0xea, 0x00, 0x67, 0x66, 0x8d, 0x83, 0x48, 0x00, 0x00, 0x00, 0x66,
+	0xa3, 0xb8, 0x00, 0x67, 0x66, 0x8d, 0x83, 0x91, 0x00, 0x00, 0x00, 0x66,
+	0xa3, 0xbe, 0x00, 0x66, 0x0f, 0x01, 0x16, 0xe8, 0x00, 0x0f, 0x20, 0xc0,
+	0x66, 0x83, 0xc8, 0x01, 0x0f, 0x22, 0xc0, 0x66, 0xff, 0x2e, 0xb8, 0x00,
+	0x66, 0xb8, 0x10, 0x00, 0x8e, 0xd8, 0x8e, 0xc0, 0x8e, 0xd0, 0x0f, 0x20,
+	0xc0, 0x83, 0xe0, 0xfb, 0x83, 0xc8, 0x02, 0x0f, 0x22, 0xc0, 0x0f, 0x20,
+	0xe0, 0x0d, 0x20, 0x06, 0x00, 0x00, 0x0f, 0x22, 0xe0, 0x8b, 0x83, 0xf0,
+	0x00, 0x00, 0x00, 0x0f, 0x22, 0xd8, 0xb9, 0x80, 0x00, 0x00, 0xc0, 0x0f,
+	0x32, 0x0d, 0x00, 0x09, 0x00, 0x00, 0x0f, 0x30, 0x0f, 0x20, 0xc0, 0x0d,
+	0x00, 0x00, 0x01, 0x80, 0x0f, 0x22, 0xc0, 0xff, 0xab, 0xbe, 0x00, 0x00,
+	0x00, 0x66, 0x31, 0xc0, 0x8e, 0xd8, 0x8e, 0xc0, 0x8e, 0xd0, 0x8e, 0xe0,
+	0x8e, 0xe8, 0x48, 0x8b, 0xa3, 0xf8, 0x00, 0x00, 0x00, 0x48, 0x8b, 0xbb,
+	0x00, 0x01, 0x00, 0x00, 0x48, 0x8b, 0x83, 0x08, 0x01, 0x00, 0x00, 0xff,
+	0xe0, 0x0f, 0x1f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x18, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x08, 0x00, 0x0f, 0x1f, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x9a, 0x20, 0x00,
+	0xff, 0xff, 0x00, 0x00, 0x00, 0x92, 0xcf, 0x00, 0xff, 0xff, 0x00, 0x00,
+	0x00, 0x9a, 0xcf, 0x00, 0x1f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x66, 0x90,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
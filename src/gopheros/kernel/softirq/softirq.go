@@ -0,0 +1,138 @@
+// Package softirq implements a lightweight mechanism for deferring the
+// processing of interrupt-related work outside of interrupt context.
+//
+// Interrupt handlers raise a softirq vector to signal that work is pending;
+// the handlers registered for the raised vectors are then invoked by the
+// ksoftirqd kernel thread with interrupts enabled. Pending vectors are tracked
+// per CPU. As kernel threads currently only run on the boot processor, only
+// softirqs raised on the boot processor are serviced.
+package softirq
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kthread"
+	"gopheros/kernel/smp"
+	"gopheros/kernel/sync"
+	"sync/atomic"
+)
+
+// Vector identifies a softirq. Pending vectors are serviced in ascending
+// order.
+type Vector uint8
+
+// The list of supported softirq vectors.
+const (
+	Timer Vector = iota
+	NetRX
+	NetTX
+	Block
+	Input
+	Notify
+
+	numVectors
+)
+
+// Handler is a function that services a softirq vector.
+type Handler func()
+
+var (
+	errInvalidVector     = &kernel.Error{Module: "softirq", Message: "invalid softirq vector"}
+	errHandlerRegistered = &kernel.Error{Module: "softirq", Message: "a handler is already registered for this softirq vector"}
+
+	handlers [numVectors]Handler
+
+	// pending contains a bitmap of raised vectors for each CPU.
+	pending [smp.MaxCPUs]uint32
+
+	// waiters holds the ksoftirqd thread while no vectors are pending.
+	waiters sync.WaitQueue
+
+	// daemon is the kernel thread that services raised vectors.
+	daemon *kthread.Thread
+
+	// The following functions are used by tests to mock calls to the smp,
+	// kthread and sync packages.
+	cpuIndexFn = cpuIndex
+	spawnFn    = kthread.Spawn
+	waitFn     = (*sync.WaitQueue).Wait
+	wakeFn     = (*sync.WaitQueue).WakeOne
+)
+
+// Register installs the handler for a softirq vector.
+func Register(vector Vector, handler Handler) *kernel.Error {
+	if vector >= numVectors || handler == nil {
+		return errInvalidVector
+	}
+
+	if handlers[vector] != nil {
+		return errHandlerRegistered
+	}
+
+	handlers[vector] = handler
+	return nil
+}
+
+// Raise marks a vector as pending on the calling CPU and wakes up ksoftirqd.
+// It never blocks and is meant to be invoked from interrupt handlers.
+func Raise(vector Vector) {
+	if vector >= numVectors {
+		return
+	}
+
+	mask := &pending[cpuIndexFn()]
+	for {
+		old := atomic.LoadUint32(mask)
+		if atomic.CompareAndSwapUint32(mask, old, old|1<<vector) {
+			break
+		}
+	}
+
+	wakeFn(&waiters)
+}
+
+// Pending returns true if the vector is pending on the calling CPU.
+func Pending(vector Vector) bool {
+	return atomic.LoadUint32(&pending[cpuIndexFn()])&(1<<vector) != 0
+}
+
+// Init spawns the ksoftirqd thread.
+func Init() *kernel.Error {
+	if daemon != nil {
+		return nil
+	}
+
+	t, err := spawnFn("ksoftirqd", run)
+	if err != nil {
+		return err
+	}
+
+	daemon = t
+	return nil
+}
+
+// run implements the ksoftirqd main loop.
+func run() {
+	for {
+		waitFn(&waiters, func() bool { return atomic.LoadUint32(&pending[0]) != 0 })
+		process(0)
+	}
+}
+
+// process invokes the handlers for the vectors pending on the specified CPU.
+// Vectors that are raised again while their handler runs are serviced by a
+// subsequent call to process.
+func process(cpu int) {
+	mask := atomic.SwapUint32(&pending[cpu], 0)
+	for vector := Vector(0); mask != 0; vector, mask = vector+1, mask>>1 {
+		if mask&1 != 0 && handlers[vector] != nil {
+			handlers[vector]()
+		}
+	}
+}
+
+func cpuIndex() int {
+	if c := smp.Current(); c != nil {
+		return c.Index()
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package softirq
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kthread"
+	"gopheros/kernel/sync"
+	"testing"
+)
+
+func restoreMocks() {
+	cpuIndexFn = cpuIndex
+	spawnFn = kthread.Spawn
+	waitFn = (*sync.WaitQueue).Wait
+	wakeFn = (*sync.WaitQueue).WakeOne
+	handlers = [numVectors]Handler{}
+	pending = [len(pending)]uint32{}
+	daemon = nil
+}
+
+func TestRegister(t *testing.T) {
+	defer restoreMocks()
+
+	specs := []struct {
+		vector  Vector
+		handler Handler
+		expErr  *kernel.Error
+	}{
+		{Timer, func() {}, nil},
+		{Timer, func() {}, errHandlerRegistered},
+		{NetRX, nil, errInvalidVector},
+		{numVectors, func() {}, errInvalidVector},
+	}
+
+	for specIndex, spec := range specs {
+		if err := Register(spec.vector, spec.handler); err != spec.expErr {
+			t.Errorf("[spec %d] expected to get error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
+
+func TestRaiseAndProcess(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		cpu     int
+		wakeups int
+		calls   []Vector
+	)
+	cpuIndexFn = func() int { return cpu }
+	wakeFn = func(_ *sync.WaitQueue) bool {
+		wakeups++
+		return true
+	}
+
+	for _, vector := range []Vector{Timer, NetRX, Block} {
+		v := vector
+		if err := Register(v, func() {
+			calls = append(calls, v)
+			if v == NetRX {
+				// Re-raising a vector from its handler defers it
+				// to the next call to process
+				Raise(NetRX)
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Raise(Block)
+	Raise(NetRX)
+	Raise(Timer)
+	Raise(Notify)
+	Raise(numVectors)
+
+	if !Pending(NetRX) || Pending(NetTX) {
+		t.Fatal("unexpected pending vector state")
+	}
+
+	// Vectors raised on other CPUs are tracked separately
+	cpu = 1
+	Raise(NetTX)
+	if Pending(NetRX) || !Pending(NetTX) {
+		t.Fatal("expected pending vectors to be tracked per CPU")
+	}
+	cpu = 0
+
+	process(0)
+
+	if exp := []Vector{Timer, NetRX, Block}; len(calls) != len(exp) || calls[0] != exp[0] || calls[1] != exp[1] || calls[2] != exp[2] {
+		t.Fatalf("expected handlers to be invoked in vector order %v; got %v", exp, calls)
+	}
+
+	if !Pending(NetRX) || Pending(Timer) {
+		t.Error("expected only the re-raised vector to remain pending")
+	}
+
+	if wakeups != 6 {
+		t.Errorf("expected ksoftirqd to be woken up 6 times; got %d", wakeups)
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+	spawnFn = func(_ string, _ func()) (*kthread.Thread, *kernel.Error) { return nil, expErr }
+	if err := Init(); err != expErr {
+		t.Fatalf("expected to get error %v; got %v", expErr, err)
+	}
+
+	var spawnCount int
+	spawnFn = func(name string, _ func()) (*kthread.Thread, *kernel.Error) {
+		if name != "ksoftirqd" {
+			t.Errorf("unexpected thread name %q", name)
+		}
+		spawnCount++
+		return &kthread.Thread{}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if spawnCount != 1 {
+		t.Errorf("expected ksoftirqd to be spawned once; got %d", spawnCount)
+	}
+}
@@ -0,0 +1,37 @@
+package sync
+
+// Cond implements a condition variable that threads can use to wait for an
+// event while holding a Mutex.
+type Cond struct {
+	L *Mutex
+
+	waiters WaitQueue
+}
+
+// NewCond returns a condition variable associated with the specified mutex.
+func NewCond(l *Mutex) *Cond {
+	return &Cond{L: l}
+}
+
+// Wait atomically unlocks c.L and blocks the calling thread until it is woken
+// up by Signal or Broadcast. Wait re-acquires c.L before returning. As with
+// sync.Cond, callers should re-check the condition they are waiting for in a
+// loop.
+func (c *Cond) Wait() {
+	intr := lock()
+	c.L.Unlock()
+	c.waiters.block(false)
+	unlock(intr)
+
+	c.L.Lock()
+}
+
+// Signal wakes up one thread waiting on c, if any.
+func (c *Cond) Signal() {
+	c.waiters.WakeOne()
+}
+
+// Broadcast wakes up all threads waiting on c.
+func (c *Cond) Broadcast() {
+	c.waiters.WakeAll()
+}
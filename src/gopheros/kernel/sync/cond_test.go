@@ -0,0 +1,44 @@
+package sync
+
+import "testing"
+
+func TestCond(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		mu    Mutex
+		c     = NewCond(&mu)
+		m     = &mockScheduler{}
+		ready bool
+	)
+	m.onBlock = []func(){
+		func() {
+			if mu.Owner() != nil {
+				t.Error("expected Wait to release the mutex before blocking")
+			}
+
+			mu.Lock()
+			ready = true
+			c.Signal()
+			mu.Unlock()
+		},
+	}
+	m.install(t)
+
+	mu.Lock()
+	for !ready {
+		c.Wait()
+	}
+
+	if mu.Owner() != m.current {
+		t.Error("expected Wait to re-acquire the mutex")
+	}
+	mu.Unlock()
+
+	if m.blocked != 1 {
+		t.Errorf("expected Wait to block once; blocked %d times", m.blocked)
+	}
+
+	// Broadcast without any waiters is a no-op
+	c.Broadcast()
+}
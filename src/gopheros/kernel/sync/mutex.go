@@ -0,0 +1,57 @@
+package sync
+
+import "gopheros/kernel/sched"
+
+// Mutex is a mutual exclusion lock. Unlike Spinlock, threads that attempt to
+// acquire a held Mutex are blocked until the lock is released.
+//
+// Lock may only be invoked from the context of a kernel thread. TryLock and
+// Unlock never block and may also be invoked from interrupt handlers.
+type Mutex struct {
+	locked  bool
+	owner   *sched.Thread
+	waiters WaitQueue
+}
+
+// Lock blocks until the mutex can be acquired by the calling thread. Any
+// attempt to re-acquire a mutex already held by the calling thread will cause
+// a deadlock.
+func (m *Mutex) Lock() {
+	intr := lock()
+	for m.locked {
+		m.waiters.block(false)
+	}
+	m.locked = true
+	m.owner = currentThreadFn()
+	unlock(intr)
+}
+
+// TryLock attempts to acquire the mutex and returns true if the mutex could be
+// acquired or false otherwise.
+func (m *Mutex) TryLock() bool {
+	intr := lock()
+	acquired := !m.locked
+	if acquired {
+		m.locked = true
+		m.owner = currentThreadFn()
+	}
+	unlock(intr)
+	return acquired
+}
+
+// Unlock releases the mutex and wakes up the longest waiting thread, if any.
+// Calling Unlock while the mutex is not held has no effect.
+func (m *Mutex) Unlock() {
+	intr := lock()
+	if m.locked {
+		m.locked = false
+		m.owner = nil
+		m.waiters.wakeOne()
+	}
+	unlock(intr)
+}
+
+// Owner returns the thread holding the mutex or nil if the mutex is not held.
+func (m *Mutex) Owner() *sched.Thread {
+	return m.owner
+}
@@ -0,0 +1,58 @@
+package sync
+
+import (
+	"gopheros/kernel/sched"
+	"testing"
+)
+
+func TestMutex(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		mu    Mutex
+		m     = &mockScheduler{}
+		self  = &sched.Thread{}
+		other = &sched.Thread{}
+	)
+	m.current = other
+	m.onBlock = []func(){
+		// Emulate the owner releasing the mutex while we are blocked
+		func() {
+			if mu.Owner() != other {
+				t.Error("expected mutex to be held by the other thread")
+			}
+			mu.Unlock()
+		},
+	}
+	m.install(t)
+
+	if !mu.TryLock() {
+		t.Fatal("expected TryLock to acquire an unlocked mutex")
+	}
+
+	m.current = self
+	if mu.TryLock() {
+		t.Fatal("expected TryLock to fail while the mutex is held")
+	}
+
+	mu.Lock()
+	if m.blocked != 1 || mu.Owner() != self {
+		t.Fatalf("expected Lock to block until the mutex is released; blocked %d times", m.blocked)
+	}
+
+	if len(m.readied) != 1 || m.readied[0] != self {
+		t.Error("expected Unlock to wake up the waiting thread")
+	}
+
+	mu.Unlock()
+	if mu.Owner() != nil || !mu.TryLock() {
+		t.Error("expected mutex to be released")
+	}
+
+	// Unlocking an unlocked mutex has no effect
+	mu.Unlock()
+	mu.Unlock()
+	if !m.intrEnabled {
+		t.Error("expected interrupt flag to be restored")
+	}
+}
@@ -0,0 +1,52 @@
+package sync
+
+// Semaphore is a counting semaphore. Threads that attempt to acquire a
+// semaphore whose count is zero are blocked until the count is incremented.
+//
+// Acquire may only be invoked from the context of a kernel thread. TryAcquire
+// and Release never block and may also be invoked from interrupt handlers.
+type Semaphore struct {
+	count   uint32
+	waiters WaitQueue
+}
+
+// NewSemaphore returns a semaphore with the specified initial count.
+func NewSemaphore(count uint32) *Semaphore {
+	return &Semaphore{count: count}
+}
+
+// Acquire blocks until the semaphore count is non-zero and then decrements it.
+func (s *Semaphore) Acquire() {
+	intr := lock()
+	for s.count == 0 {
+		s.waiters.block(false)
+	}
+	s.count--
+	unlock(intr)
+}
+
+// TryAcquire decrements the semaphore count if it is non-zero and returns true
+// if it succeeded.
+func (s *Semaphore) TryAcquire() bool {
+	intr := lock()
+	acquired := s.count != 0
+	if acquired {
+		s.count--
+	}
+	unlock(intr)
+	return acquired
+}
+
+// Release increments the semaphore count and wakes up the longest waiting
+// thread, if any.
+func (s *Semaphore) Release() {
+	intr := lock()
+	s.count++
+	s.waiters.wakeOne()
+	unlock(intr)
+}
+
+// Count returns the current semaphore count.
+func (s *Semaphore) Count() uint32 {
+	return s.count
+}
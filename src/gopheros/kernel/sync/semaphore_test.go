@@ -0,0 +1,37 @@
+package sync
+
+import "testing"
+
+func TestSemaphore(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		sem = NewSemaphore(2)
+		m   = &mockScheduler{}
+	)
+	m.onBlock = []func(){
+		// Emulate an interrupt handler releasing the semaphore
+		func() { sem.Release() },
+	}
+	m.install(t)
+
+	sem.Acquire()
+	if !sem.TryAcquire() {
+		t.Fatal("expected TryAcquire to succeed while the count is non-zero")
+	}
+
+	if sem.TryAcquire() {
+		t.Fatal("expected TryAcquire to fail when the count is zero")
+	}
+
+	sem.Acquire()
+	if m.blocked != 1 || sem.Count() != 0 {
+		t.Fatalf("expected Acquire to block once; blocked %d times, count %d", m.blocked, sem.Count())
+	}
+
+	sem.Release()
+	sem.Release()
+	if got := sem.Count(); got != 2 {
+		t.Errorf("expected count to be 2; got %d", got)
+	}
+}
@@ -1,5 +1,6 @@
 // Package sync provides synchronization primitive implementations for spinlocks
-// and semaphore.
+// as well as blocking primitives (mutexes, semaphores, condition variables and
+// wait queues) that integrate with the scheduler.
 package sync
 
 import "sync/atomic"
@@ -33,6 +34,3 @@ func (l *Spinlock) TryToAcquire() bool {
 func (l *Spinlock) Release() {
 	atomic.StoreUint32(&l.state, 0)
 }
-
-// archAcquireSpinlock is an arch-specific implementation for acquiring the lock.
-func archAcquireSpinlock(state *uint32, attemptsBeforeYielding uint32)
@@ -0,0 +1,4 @@
+package sync
+
+// archAcquireSpinlock is an arch-specific implementation for acquiring the lock.
+func archAcquireSpinlock(state *uint32, attemptsBeforeYielding uint32)
@@ -0,0 +1,18 @@
+package sync
+
+import "sync/atomic"
+
+// archAcquireSpinlock is an arch-specific implementation for acquiring the lock.
+func archAcquireSpinlock(state *uint32, attemptsBeforeYielding uint32) {
+	for {
+		for attempts := attemptsBeforeYielding; attempts > 0; attempts-- {
+			if atomic.LoadUint32(state) == 0 && atomic.SwapUint32(state, 1) == 0 {
+				return
+			}
+		}
+
+		if yieldFn != nil {
+			yieldFn()
+		}
+	}
+}
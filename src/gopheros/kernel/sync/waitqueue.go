@@ -0,0 +1,161 @@
+package sync
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/sched"
+)
+
+var (
+	// The following functions are used by tests to mock calls to the cpu
+	// and sched packages.
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn  = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	currentThreadFn     = sched.Current
+	blockFn             = sched.Block
+	readyFn             = sched.Ready
+	signalPendingFn     = sched.SignalPending
+)
+
+// waiter links a blocked thread to a WaitQueue.
+type waiter struct {
+	thread *sched.Thread
+	queued bool
+	next   *waiter
+}
+
+// WaitQueue maintains a FIFO list of threads that are blocked until some
+// condition becomes true.
+//
+// Wait and WaitInterruptible may only be invoked from the context of a kernel
+// thread. WakeOne and WakeAll never block and may also be invoked from
+// interrupt handlers.
+type WaitQueue struct {
+	head, tail *waiter
+}
+
+// Wait blocks the calling thread until cond returns true. The condition is
+// evaluated with interrupts disabled, both before blocking and each time the
+// thread is woken up, so wake-ups issued by interrupt handlers cannot be
+// missed.
+func (q *WaitQueue) Wait(cond func() bool) {
+	intr := lock()
+	for !cond() {
+		q.block(false)
+	}
+	unlock(intr)
+}
+
+// WaitInterruptible behaves like Wait but also returns when a signal is
+// pending for the calling thread. It returns true if cond became true and
+// false if the wait was interrupted by a signal.
+func (q *WaitQueue) WaitInterruptible(cond func() bool) bool {
+	intr := lock()
+	defer unlock(intr)
+	for !cond() {
+		if signalPendingFn() {
+			return false
+		}
+		q.block(true)
+	}
+	return true
+}
+
+// WakeOne wakes up the thread that has been waiting the longest and returns
+// true if a thread was woken up.
+func (q *WaitQueue) WakeOne() bool {
+	intr := lock()
+	woken := q.wakeOne()
+	unlock(intr)
+	return woken
+}
+
+// WakeAll wakes up all waiting threads and returns their count.
+func (q *WaitQueue) WakeAll() int {
+	var count int
+	intr := lock()
+	for q.wakeOne() {
+		count++
+	}
+	unlock(intr)
+	return count
+}
+
+// block appends the calling thread to the queue and blocks until it is woken
+// up. If interruptible is true, block also returns once a signal is pending
+// for the calling thread; the thread is then removed from the queue. It must
+// be invoked with interrupts disabled.
+func (q *WaitQueue) block(interruptible bool) {
+	w := &waiter{thread: currentThreadFn(), queued: true}
+	if q.tail == nil {
+		q.head = w
+	} else {
+		q.tail.next = w
+	}
+	q.tail = w
+
+	for w.queued {
+		if interruptible && signalPendingFn() {
+			q.remove(w)
+			return
+		}
+		blockFn()
+	}
+}
+
+// remove unlinks w from the queue. It must be invoked with interrupts
+// disabled.
+func (q *WaitQueue) remove(w *waiter) {
+	var prev *waiter
+	for cur := q.head; cur != nil; prev, cur = cur, cur.next {
+		if cur != w {
+			continue
+		}
+
+		if prev == nil {
+			q.head = w.next
+		} else {
+			prev.next = w.next
+		}
+		if q.tail == w {
+			q.tail = prev
+		}
+		w.next = nil
+		w.queued = false
+		return
+	}
+}
+
+// wakeOne must be invoked with interrupts disabled.
+func (q *WaitQueue) wakeOne() bool {
+	w := q.head
+	if w == nil {
+		return false
+	}
+
+	if q.head = w.next; q.head == nil {
+		q.tail = nil
+	}
+	w.next = nil
+	w.queued = false
+	readyFn(w.thread)
+	return true
+}
+
+// lock disables interrupts and returns the previous interrupt state. Blocking
+// on a wait queue allocates memory so only threads that run on the boot
+// processor may use wait queues; the scheduler rejects affinity masks that
+// include application processors for such threads. Disabling interrupts is
+// therefore sufficient for protecting the wait queues against concurrent
+// access from interrupt handlers.
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+	return intr
+}
+
+func unlock(intr bool) {
+	if intr {
+		enableInterruptsFn()
+	}
+}
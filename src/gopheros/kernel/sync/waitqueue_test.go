@@ -0,0 +1,211 @@
+package sync
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/sched"
+	"testing"
+)
+
+func restoreMocks() {
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	currentThreadFn = sched.Current
+	blockFn = sched.Block
+	readyFn = sched.Ready
+	signalPendingFn = sched.SignalPending
+}
+
+// mockScheduler emulates the scheduler and CPU interrupt flag. Each call to
+// blockFn invokes the next function in onBlock which is expected to perform
+// the operations (e.g. running other threads or interrupt handlers) that
+// eventually wake up the blocked thread.
+type mockScheduler struct {
+	intrEnabled bool
+	current     *sched.Thread
+	onBlock     []func()
+	blocked     int
+	readied     []*sched.Thread
+}
+
+func (m *mockScheduler) install(t *testing.T) {
+	m.intrEnabled = true
+	if m.current == nil {
+		m.current = &sched.Thread{}
+	}
+
+	interruptsEnabledFn = func() bool { return m.intrEnabled }
+	enableInterruptsFn = func() { m.intrEnabled = true }
+	disableInterruptsFn = func() { m.intrEnabled = false }
+	currentThreadFn = func() *sched.Thread { return m.current }
+	readyFn = func(th *sched.Thread) { m.readied = append(m.readied, th) }
+	blockFn = func() {
+		if m.intrEnabled {
+			t.Error("expected interrupts to be disabled while blocking")
+		}
+
+		if m.blocked >= len(m.onBlock) {
+			t.Fatal("unexpected call to Block; the thread would deadlock")
+		}
+		m.blocked++
+		m.onBlock[m.blocked-1]()
+	}
+}
+
+func TestWaitQueue(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		q     WaitQueue
+		ready bool
+		m     = &mockScheduler{}
+	)
+	m.onBlock = []func(){
+		// A wake-up without the condition being met blocks the thread again
+		func() {
+			if !q.WakeOne() {
+				t.Error("expected WakeOne to wake up the blocked thread")
+			}
+		},
+		func() {
+			ready = true
+			if got := q.WakeAll(); got != 1 {
+				t.Errorf("expected WakeAll to wake up 1 thread; got %d", got)
+			}
+		},
+	}
+	m.install(t)
+
+	q.Wait(func() bool { return ready })
+
+	if m.blocked != 2 {
+		t.Errorf("expected thread to block twice; blocked %d times", m.blocked)
+	}
+
+	if len(m.readied) != 2 || m.readied[0] != m.current || m.readied[1] != m.current {
+		t.Errorf("expected the waiting thread to be readied twice; got %v", m.readied)
+	}
+
+	if !m.intrEnabled {
+		t.Error("expected Wait to restore the interrupt flag")
+	}
+
+	// The condition is already satisfied so Wait should not block
+	q.Wait(func() bool { return true })
+	if m.blocked != 2 {
+		t.Error("expected Wait not to block when the condition is satisfied")
+	}
+
+	if q.WakeOne() || q.WakeAll() != 0 {
+		t.Error("expected wake operations on an empty queue to be no-ops")
+	}
+}
+
+func TestWaitQueueOrder(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		q       WaitQueue
+		m       = &mockScheduler{}
+		threads = []*sched.Thread{{}, {}, {}}
+		waiting = 1
+	)
+	m.install(t)
+	m.current = threads[0]
+
+	// Emulate the remaining threads blocking on the queue in turn; once
+	// all threads are queued, wake them up one by one.
+	blockFn = func() {
+		if waiting < len(threads) {
+			m.current = threads[waiting]
+			waiting++
+			q.block(false)
+			return
+		}
+
+		for q.WakeOne() {
+		}
+	}
+
+	q.block(false)
+
+	if len(m.readied) != len(threads) {
+		t.Fatalf("expected %d threads to be woken up; got %d", len(threads), len(m.readied))
+	}
+
+	for specIndex, exp := range threads {
+		if got := m.readied[specIndex]; got != exp {
+			t.Errorf("[spec %d] expected threads to be woken up in FIFO order", specIndex)
+		}
+	}
+}
+
+func TestWaitQueueInterruptible(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		q       WaitQueue
+		m       = &mockScheduler{}
+		pending bool
+		other   = &sched.Thread{}
+	)
+	m.install(t)
+	signalPendingFn = func() bool { return pending }
+
+	t.Run("condition met", func(t *testing.T) {
+		ready := false
+		m.onBlock = []func(){
+			func() {
+				ready = true
+				q.WakeAll()
+			},
+		}
+
+		if !q.WaitInterruptible(func() bool { return ready }) {
+			t.Fatal("expected WaitInterruptible to return true")
+		}
+	})
+
+	t.Run("signal pending before blocking", func(t *testing.T) {
+		pending = true
+		defer func() { pending = false }()
+
+		blocked := m.blocked
+		if q.WaitInterruptible(func() bool { return false }) {
+			t.Fatal("expected WaitInterruptible to return false")
+		}
+
+		if m.blocked != blocked {
+			t.Error("expected WaitInterruptible not to block")
+		}
+	})
+
+	t.Run("signal posted while blocked", func(t *testing.T) {
+		defer func() { pending = false }()
+
+		// Queue another thread ahead of the current one; posting the
+		// signal wakes up the current thread without dequeueing it.
+		q.head = &waiter{thread: other, queued: true}
+		q.tail = q.head
+		m.blocked, m.onBlock = 0, []func(){
+			func() { pending = true },
+		}
+
+		if q.WaitInterruptible(func() bool { return false }) {
+			t.Fatal("expected WaitInterruptible to return false")
+		}
+
+		if !m.intrEnabled {
+			t.Error("expected WaitInterruptible to restore the interrupt flag")
+		}
+
+		if q.head == nil || q.head != q.tail || q.head.thread != other {
+			t.Fatal("expected the interrupted thread to be removed from the queue")
+		}
+
+		m.readied = nil
+		if got := q.WakeAll(); got != 1 || m.readied[0] != other {
+			t.Errorf("expected WakeAll to only wake up the remaining thread; got %d", got)
+		}
+	})
+}
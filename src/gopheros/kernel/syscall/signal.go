@@ -0,0 +1,193 @@
+package syscall
+
+import (
+	"gopheros/kernel/coredump"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/proc"
+	"unsafe"
+)
+
+const (
+	// The sigaction flags that are interpreted by the kernel. SA_RESTORER
+	// must be set for signal handlers as the kernel does not provide a
+	// restorer that returns from a handler.
+	saRestorer  = 0x04000000
+	saNoDefer   = 0x40000000
+	saResetHand = 0x80000000
+
+	// The values of the how argument of rt_sigprocmask.
+	sigBlock   = 0
+	sigUnblock = 1
+	sigSetMask = 2
+
+	// sigSetSize is the size of the signal sets passed to the system calls.
+	sigSetSize = 8
+)
+
+// sigInfo mirrors the layout of the leading fields of siginfo_t.
+type sigInfo struct {
+	signo int32
+	errno int32
+	code  int32
+	_     [116]byte
+}
+
+var (
+	// dumpCoreFn is used by tests to mock calls to the coredump package.
+	dumpCoreFn = coredump.Write
+)
+
+// deliverSignals is invoked with the saved user-mode registers of the running
+// process before returning to user mode. If a signal is pending, it either
+// terminates the process, writing a core file if the default action of the
+// signal dumps core, or updates regs so that the process resumes execution at
+// the signal handler.
+func deliverSignals(regs *gate.Registers) {
+	if !userMode(regs) {
+		return
+	}
+
+	p := currentProcessFn()
+	sig, action := p.DequeueSignal()
+	switch {
+	case sig == 0:
+		return
+	case action.Handler == proc.SigDefault:
+		terminate(p, sig, regs)
+		return
+	}
+
+	if !setupSignalFrame(p, sig, action, regs) {
+		// The handler cannot run if its frame cannot be pushed
+		terminate(p, proc.SigSegv, regs)
+		return
+	}
+
+	if action.Flags&saResetHand != 0 {
+		_, _ = p.SetSignalAction(sig, proc.SignalAction{})
+	}
+
+	mask := p.SignalMask() | action.Mask
+	if action.Flags&saNoDefer == 0 {
+		mask |= sig.Mask()
+	}
+	p.SetSignalMask(mask)
+}
+
+// terminate terminates p as if it was killed by sig. If the default action of
+// sig dumps core, a core file recording regs and the memory of p is written
+// first.
+func terminate(p *proc.Process, sig proc.Signal, regs *gate.Registers) {
+	if sig.DumpsCore() {
+		if path, err := dumpCoreFn(p, sig, regs); err != nil {
+			kfmt.Printf("[coredump] unable to write core file for pid %d: %s\n", uint32(p.PID()), err.Message)
+		} else {
+			kfmt.Printf("[coredump] pid %d killed by signal %d; core dumped to %s\n", uint32(p.PID()), uint8(sig), path)
+		}
+	}
+
+	exitFn(-int(sig))
+}
+
+// sysRtSigaction implements rt_sigaction(sig, act, oact, sigsetsize).
+func sysRtSigaction(args *Args) int64 {
+	var (
+		p      = currentProcessFn()
+		sig    = proc.Signal(args[0])
+		action proc.SignalAction
+		buf    = (*[unsafe.Sizeof(action)]byte)(unsafe.Pointer(&action))[:]
+	)
+
+	if args[3] != sigSetSize || args[0] >= proc.NumSignals {
+		return -errnoInval
+	}
+
+	prev, err := p.SignalAction(sig)
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	if actAddr := uintptr(args[1]); actAddr != 0 {
+		if err = CopyFromUser(buf, actAddr); err != nil {
+			return -errnoFault
+		}
+
+		if action.Handler != proc.SigDefault && action.Handler != proc.SigIgnore && action.Flags&saRestorer == 0 {
+			return -errnoInval
+		}
+
+		if _, err = p.SetSignalAction(sig, action); err != nil {
+			return errnoOf(err)
+		}
+	}
+
+	if oactAddr := uintptr(args[2]); oactAddr != 0 {
+		action = prev
+		if err = CopyToUser(oactAddr, buf); err != nil {
+			return -errnoFault
+		}
+	}
+
+	return 0
+}
+
+// sysRtSigprocmask implements rt_sigprocmask(how, set, oset, sigsetsize).
+func sysRtSigprocmask(args *Args) int64 {
+	var (
+		p    = currentProcessFn()
+		prev = p.SignalMask()
+		set  proc.SignalSet
+	)
+
+	if args[3] != sigSetSize {
+		return -errnoInval
+	}
+
+	if setAddr := uintptr(args[1]); setAddr != 0 {
+		if err := CopyFromUser((*[sigSetSize]byte)(unsafe.Pointer(&set))[:], setAddr); err != nil {
+			return -errnoFault
+		}
+
+		switch args[0] {
+		case sigBlock:
+			p.SetSignalMask(prev | set)
+		case sigUnblock:
+			p.SetSignalMask(prev &^ set)
+		case sigSetMask:
+			p.SetSignalMask(set)
+		default:
+			return -errnoInval
+		}
+	}
+
+	if osetAddr := uintptr(args[2]); osetAddr != 0 {
+		if err := CopyToUser(osetAddr, (*[sigSetSize]byte)(unsafe.Pointer(&prev))[:]); err != nil {
+			return -errnoFault
+		}
+	}
+
+	return 0
+}
+
+// sysKill implements kill(pid, sig). Only sending signals to a specific process
+// (pid > 0) is supported. If sig is 0, kill only checks that the process
+// exists.
+func sysKill(args *Args) int64 {
+	pid := int32(args[0])
+	if pid <= 0 || args[1] >= proc.NumSignals {
+		return -errnoInval
+	}
+
+	if err := sendSignalFn(proc.PID(pid), proc.Signal(args[1])); err != nil {
+		return errnoOf(err)
+	}
+
+	return 0
+}
+
+func init() {
+	handlers[SysRtSigaction] = sysRtSigaction
+	handlers[SysRtSigprocmask] = sysRtSigprocmask
+	handlers[SysKill] = sysKill
+}
@@ -0,0 +1,158 @@
+package syscall
+
+import (
+	"gopheros/kernel/gate"
+	"gopheros/kernel/proc"
+	"unsafe"
+)
+
+const (
+	// redZoneSize is the size of the area below the user-mode stack pointer
+	// that the amd64 ABI allows leaf functions to use without adjusting the
+	// stack pointer. Signal frames are placed below it.
+	redZoneSize = 128
+
+	// The RFLAGS bits that user-mode code may modify via rt_sigreturn:
+	// CF, PF, AF, ZF, SF, TF, DF, OF, AC and RF.
+	userFlagsMask = 0x1 | 0x4 | 0x10 | 0x40 | 0x80 | 0x100 | 0x400 | 0x800 | 0x40000 | 0x10000
+
+	// The RFLAGS bits that are cleared before invoking a signal handler:
+	// TF, DF and RF.
+	handlerFlagsClear = 0x100 | 0x400 | 0x10000
+
+	// The user-mode segment selectors.
+	userCS = 0x23
+	userSS = 0x1b
+
+	// xmmOffset is the offset of the XMM registers in the FXSAVE area.
+	xmmOffset = 160
+)
+
+// sigContext mirrors the layout of struct sigcontext on amd64.
+type sigContext struct {
+	r8, r9, r10, r11, r12, r13, r14, r15 uint64
+	rdi, rsi, rbp, rbx, rdx, rax, rcx    uint64
+	rsp, rip, rflags                     uint64
+	cs, gs, fs, ss                       uint16
+	err, trapNo, oldMask, cr2            uint64
+	fpState                              uint64
+	_                                    [8]uint64
+}
+
+// uContext mirrors the layout of struct ucontext on amd64.
+type uContext struct {
+	flags    uint64
+	link     uint64
+	stack    [3]uint64
+	mcontext sigContext
+	sigMask  proc.SignalSet
+}
+
+// sigFrame is pushed to the user-mode stack before invoking a signal handler.
+// Its layout matches the frame built by Linux so that C libraries can use it.
+// The saved XMM registers are stored in an FXSAVE-compatible area; the x87
+// state is not saved.
+type sigFrame struct {
+	// retAddr is the return address of the handler. It points to the
+	// restorer which invokes rt_sigreturn.
+	retAddr uint64
+	uc      uContext
+	info    sigInfo
+	fpState [512]byte
+}
+
+var (
+	// restoreAllRegs is set by rt_sigreturn to make syscallEntry return
+	// via IRETQ which, unlike SYSRET, does not clobber RCX and R11.
+	restoreAllRegs bool
+
+	// xmmStateFn is used by tests.
+	xmmStateFn = xmmState
+)
+
+// userMode returns true if regs describe the state of user-mode code.
+func userMode(regs *gate.Registers) bool {
+	return regs.CS&3 != 0
+}
+
+// setupSignalFrame pushes a signal frame that saves the state described by
+// regs to the user-mode stack and points regs to the handler.
+func setupSignalFrame(p *proc.Process, sig proc.Signal, action proc.SignalAction, regs *gate.Registers) bool {
+	var frame sigFrame
+	if uintptr(regs.RSP) < redZoneSize+unsafe.Sizeof(frame)+16 {
+		return false
+	}
+
+	// Handlers expect the stack to be aligned as if they were called
+	frameAddr := (uintptr(regs.RSP)-redZoneSize-unsafe.Sizeof(frame))&^15 - 8
+
+	frame.retAddr = uint64(action.Restorer)
+	frame.info.signo = int32(sig)
+	frame.uc.sigMask = p.SignalMask()
+	frame.uc.mcontext = sigContext{
+		r8: regs.R8, r9: regs.R9, r10: regs.R10, r11: regs.R11,
+		r12: regs.R12, r13: regs.R13, r14: regs.R14, r15: regs.R15,
+		rdi: regs.RDI, rsi: regs.RSI, rbp: regs.RBP, rbx: regs.RBX,
+		rdx: regs.RDX, rax: regs.RAX, rcx: regs.RCX,
+		rsp: regs.RSP, rip: regs.RIP, rflags: regs.RFlags,
+		cs: userCS, ss: userSS,
+		oldMask: uint64(p.SignalMask()),
+		fpState: uint64(frameAddr + unsafe.Offsetof(frame.fpState)),
+	}
+	copy(frame.fpState[xmmOffset:], xmmStateFn(regs)[:])
+
+	if CopyToUser(frameAddr, (*[unsafe.Sizeof(frame)]byte)(unsafe.Pointer(&frame))[:]) != nil {
+		return false
+	}
+
+	regs.RIP = uint64(action.Handler)
+	regs.RSP = uint64(frameAddr)
+	regs.RDI = uint64(sig)
+	regs.RSI = uint64(frameAddr + unsafe.Offsetof(frame.info))
+	regs.RDX = uint64(frameAddr + unsafe.Offsetof(frame.uc))
+	regs.RAX = 0
+	regs.RFlags &^= handlerFlagsClear
+	return true
+}
+
+// sigreturn implements rt_sigreturn() which is invoked by the restorer once a
+// signal handler returns. It restores the user-mode state that was saved by
+// setupSignalFrame, including RAX, so it is not dispatched via the handler
+// table.
+func sigreturn(regs *gate.Registers) {
+	var (
+		frame sigFrame
+		p     = currentProcessFn()
+	)
+
+	// The handler popped the return address off the frame
+	frameAddr := uintptr(regs.RSP) - 8
+	if CopyFromUser((*[unsafe.Sizeof(frame)]byte)(unsafe.Pointer(&frame))[:], frameAddr) != nil {
+		terminate(p, proc.SigSegv, regs)
+		return
+	}
+
+	if fpState := uintptr(frame.uc.mcontext.fpState); fpState != 0 {
+		if CopyFromUser(xmmStateFn(regs)[:], fpState+xmmOffset) != nil {
+			terminate(p, proc.SigSegv, regs)
+			return
+		}
+	}
+
+	mc := &frame.uc.mcontext
+	regs.R8, regs.R9, regs.R10, regs.R11 = mc.r8, mc.r9, mc.r10, mc.r11
+	regs.R12, regs.R13, regs.R14, regs.R15 = mc.r12, mc.r13, mc.r14, mc.r15
+	regs.RDI, regs.RSI, regs.RBP, regs.RBX = mc.rdi, mc.rsi, mc.rbp, mc.rbx
+	regs.RDX, regs.RAX, regs.RCX = mc.rdx, mc.rax, mc.rcx
+	regs.RSP, regs.RIP = mc.rsp, mc.rip
+	regs.RFlags = regs.RFlags&^userFlagsMask | mc.rflags&userFlagsMask
+
+	p.SetSignalMask(frame.uc.sigMask)
+	restoreAllRegs = true
+}
+
+// xmmState returns the XMM registers that the system call and interrupt gate
+// entrypoints save right below the registers pointed to by regs.
+func xmmState(regs *gate.Registers) *[16 * 16]byte {
+	return (*[16 * 16]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(regs)) - 16*16))
+}
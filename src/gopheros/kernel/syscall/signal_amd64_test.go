@@ -0,0 +1,310 @@
+package syscall
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/proc"
+	"testing"
+	"unsafe"
+)
+
+// The following variables emulate user-space memory and the XMM registers
+// saved by the entrypoints.
+var (
+	userSigStack  [4096]byte
+	userSigAction proc.SignalAction
+	userSigSet    proc.SignalSet
+	savedXMM      [16 * 16]byte
+)
+
+func TestSigFrameLayout(t *testing.T) {
+	specs := []struct {
+		name      string
+		got, want uintptr
+	}{
+		{"sigcontext", unsafe.Sizeof(sigContext{}), 256},
+		{"ucontext", unsafe.Sizeof(uContext{}), 304},
+		{"siginfo", unsafe.Sizeof(sigInfo{}), 128},
+		{"sigaction", unsafe.Sizeof(proc.SignalAction{}), 32},
+	}
+
+	for _, spec := range specs {
+		if spec.got != spec.want {
+			t.Errorf("expected size of %s to be %d; got %d", spec.name, spec.want, spec.got)
+		}
+	}
+}
+
+func TestDeliverSignalHandler(t *testing.T) {
+	defer restoreAmd64Mocks()
+	defer restoreMocks()
+
+	p := &proc.Process{}
+	currentProcessFn = func() *proc.Process { return p }
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return true }
+	xmmStateFn = func(_ *gate.Registers) *[16 * 16]byte { return &savedXMM }
+	for i := range savedXMM {
+		savedXMM[i] = byte(i)
+	}
+
+	if _, err := p.SetSignalAction(proc.SigInt, proc.SignalAction{
+		Handler:  0x401000,
+		Flags:    saRestorer,
+		Restorer: 0x402000,
+		Mask:     proc.SigChld.Mask(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_ = p.Signal(proc.SigInt)
+
+	stackTop := uint64(uintptr(unsafe.Pointer(&userSigStack[0])) + uintptr(len(userSigStack)))
+	orig := gate.Registers{
+		RAX: 42, RCX: 7, R11: 0x246, R15: 15,
+		RIP: 0x400123, CS: userCS, RFlags: 0x202 | 0x400, RSP: stackTop, SS: userSS,
+	}
+	regs := orig
+	deliverSignals(&regs)
+
+	if regs.RIP != 0x401000 || regs.RDI != uint64(proc.SigInt) || regs.RFlags&0x400 != 0 {
+		t.Fatalf("expected the handler to be invoked with the signal number and DF cleared; got %+v", regs)
+	}
+
+	if regs.RSP%16 != 8 || regs.RSP >= stackTop-redZoneSize || regs.RSI <= regs.RSP || regs.RDX <= regs.RSP {
+		t.Fatalf("unexpected signal frame placement: RSP 0x%x, RSI 0x%x, RDX 0x%x", regs.RSP, regs.RSI, regs.RDX)
+	}
+
+	if retAddr := *(*uint64)(unsafe.Pointer(uintptr(regs.RSP))); retAddr != 0x402000 {
+		t.Errorf("expected the handler to return to the restorer; got 0x%x", retAddr)
+	}
+
+	if exp := proc.SigInt.Mask() | proc.SigChld.Mask(); p.SignalMask() != exp {
+		t.Errorf("expected signal mask to be 0x%x while the handler runs; got 0x%x", exp, p.SignalMask())
+	}
+
+	if p.PendingSignals() != 0 {
+		t.Error("expected the delivered signal to be removed from the pending signals")
+	}
+
+	// Emulate the handler returning to the restorer which clobbers some
+	// registers and invokes rt_sigreturn.
+	for i := range savedXMM {
+		savedXMM[i] = 0
+	}
+	regs.RSP += 8
+	regs.RAX, regs.RCX, regs.R11, regs.R15 = uint64(SysRtSigreturn), 0, 0, 0
+	regs.Info = uint64(SysRtSigreturn)
+	dispatch(&regs)
+
+	regs.Info = 0
+	if regs != orig {
+		t.Errorf("expected rt_sigreturn to restore the interrupted context:\n%+v\ngot:\n%+v", orig, regs)
+	}
+
+	for i := range savedXMM {
+		if savedXMM[i] != byte(i) {
+			t.Errorf("expected rt_sigreturn to restore the XMM registers; mismatch at offset %d", i)
+			break
+		}
+	}
+
+	if p.SignalMask() != 0 || !restoreAllRegs {
+		t.Errorf("expected the signal mask to be restored and all registers to be restored on return; got mask 0x%x", p.SignalMask())
+	}
+}
+
+func TestDeliverSignalDefaultAction(t *testing.T) {
+	defer restoreAmd64Mocks()
+	defer restoreMocks()
+
+	var (
+		p        = &proc.Process{}
+		exitCode int
+		exits    int
+		dumped   []proc.Signal
+	)
+	currentProcessFn = func() *proc.Process { return p }
+	exitFn = func(code int) {
+		exitCode = code
+		exits++
+	}
+	dumpCoreFn = func(_ *proc.Process, sig proc.Signal, _ *gate.Registers) (string, *kernel.Error) {
+		dumped = append(dumped, sig)
+		return "/tmp/core.0", nil
+	}
+
+	// Kernel-mode contexts never receive signals
+	_ = p.Signal(proc.SigInt)
+	deliverSignals(&gate.Registers{CS: 0x08})
+	if exits != 0 || p.PendingSignals() != proc.SigInt.Mask() {
+		t.Fatal("expected signals not to be delivered to kernel-mode contexts")
+	}
+
+	deliverSignals(&gate.Registers{CS: userCS})
+	if exits != 1 || exitCode != -int(proc.SigInt) {
+		t.Errorf("expected the process to be terminated by SIGINT; got %d exits with code %d", exits, exitCode)
+	}
+
+	// Handlers whose frame cannot be pushed terminate the process
+	_, _ = p.SetSignalAction(proc.SigInt, proc.SignalAction{Handler: 0x401000, Flags: saRestorer})
+	_ = p.Signal(proc.SigInt)
+	deliverSignals(&gate.Registers{CS: userCS, RSP: 0x100})
+	if exits != 2 || exitCode != -int(proc.SigSegv) {
+		t.Errorf("expected the process to be terminated by SIGSEGV; got %d exits with code %d", exits, exitCode)
+	}
+
+	// Invalid frames passed to rt_sigreturn terminate the process
+	sigreturn(&gate.Registers{CS: userCS, RSP: uint64(vmm.UserSpaceEnd)})
+	if exits != 3 || exitCode != -int(proc.SigSegv) {
+		t.Errorf("expected the process to be terminated by SIGSEGV; got %d exits with code %d", exits, exitCode)
+	}
+
+	// SIGINT does not dump core
+	if len(dumped) != 2 || dumped[0] != proc.SigSegv || dumped[1] != proc.SigSegv {
+		t.Errorf("expected core dumps only for SIGSEGV; got %v", dumped)
+	}
+
+	// Failing to write the core file does not prevent the termination
+	dumpCoreFn = func(_ *proc.Process, _ proc.Signal, _ *gate.Registers) (string, *kernel.Error) {
+		return "", &kernel.Error{Module: "test", Message: "read-only filesystem"}
+	}
+	p.ForceSignal(proc.SigQuit)
+	deliverSignals(&gate.Registers{CS: userCS})
+	if exits != 4 || exitCode != -int(proc.SigQuit) {
+		t.Errorf("expected the process to be terminated by SIGQUIT; got %d exits with code %d", exits, exitCode)
+	}
+}
+
+func TestSysRtSigaction(t *testing.T) {
+	defer restoreAmd64Mocks()
+	defer restoreMocks()
+
+	p := &proc.Process{}
+	currentProcessFn = func() *proc.Process { return p }
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return true }
+
+	actAddr := uint64(uintptr(unsafe.Pointer(&userSigAction)))
+	handler := proc.SignalAction{Handler: 0x401000, Flags: saRestorer, Restorer: 0x402000}
+
+	specs := []struct {
+		args      Args
+		act       proc.SignalAction
+		expResult int64
+		expAction proc.SignalAction
+		expOld    proc.SignalAction
+	}{
+		{Args{uint64(proc.SigInt), actAddr, 0, sigSetSize}, handler, 0, handler, handler},
+		{Args{uint64(proc.SigInt), 0, actAddr, sigSetSize}, proc.SignalAction{}, 0, handler, handler},
+		// Handlers require a restorer
+		{Args{uint64(proc.SigInt), actAddr, 0, sigSetSize}, proc.SignalAction{Handler: 0x401000}, -errnoInval, handler, proc.SignalAction{Handler: 0x401000}},
+		{Args{uint64(proc.SigInt), actAddr, actAddr, sigSetSize}, proc.SignalAction{Handler: proc.SigIgnore}, 0, proc.SignalAction{Handler: proc.SigIgnore}, handler},
+		{Args{uint64(proc.SigKill), actAddr, 0, sigSetSize}, proc.SignalAction{Handler: proc.SigIgnore}, -errnoInval, proc.SignalAction{Handler: proc.SigIgnore}, proc.SignalAction{Handler: proc.SigIgnore}},
+		{Args{0, 0, 0, sigSetSize}, proc.SignalAction{}, -errnoInval, proc.SignalAction{Handler: proc.SigIgnore}, proc.SignalAction{}},
+		{Args{256 + uint64(proc.SigInt), 0, 0, sigSetSize}, proc.SignalAction{}, -errnoInval, proc.SignalAction{Handler: proc.SigIgnore}, proc.SignalAction{}},
+		{Args{uint64(proc.SigInt), 0, 0, 4}, proc.SignalAction{}, -errnoInval, proc.SignalAction{Handler: proc.SigIgnore}, proc.SignalAction{}},
+		{Args{uint64(proc.SigInt), uint64(vmm.UserSpaceEnd), 0, sigSetSize}, proc.SignalAction{}, -errnoFault, proc.SignalAction{Handler: proc.SigIgnore}, proc.SignalAction{}},
+	}
+
+	for specIndex, spec := range specs {
+		userSigAction = spec.act
+		if got := sysRtSigaction(&spec.args); got != spec.expResult {
+			t.Errorf("[spec %d] expected result %d; got %d", specIndex, spec.expResult, got)
+		}
+
+		if got, _ := p.SignalAction(proc.SigInt); got != spec.expAction {
+			t.Errorf("[spec %d] expected SIGINT action %+v; got %+v", specIndex, spec.expAction, got)
+		}
+
+		if userSigAction != spec.expOld {
+			t.Errorf("[spec %d] expected user-space action %+v; got %+v", specIndex, spec.expOld, userSigAction)
+		}
+	}
+}
+
+func TestSysRtSigprocmask(t *testing.T) {
+	defer restoreAmd64Mocks()
+	defer restoreMocks()
+
+	p := &proc.Process{}
+	currentProcessFn = func() *proc.Process { return p }
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return true }
+
+	setAddr := uint64(uintptr(unsafe.Pointer(&userSigSet)))
+	intChld := proc.SigInt.Mask() | proc.SigChld.Mask()
+
+	specs := []struct {
+		args      Args
+		set       proc.SignalSet
+		expResult int64
+		expMask   proc.SignalSet
+		expOld    proc.SignalSet
+	}{
+		{Args{sigBlock, setAddr, 0, sigSetSize}, intChld, 0, intChld, intChld},
+		// SIGKILL cannot be blocked
+		{Args{sigBlock, setAddr, 0, sigSetSize}, proc.SigKill.Mask(), 0, intChld, proc.SigKill.Mask()},
+		{Args{sigUnblock, setAddr, setAddr, sigSetSize}, proc.SigInt.Mask(), 0, proc.SigChld.Mask(), intChld},
+		{Args{sigSetMask, setAddr, 0, sigSetSize}, proc.SigSegv.Mask(), 0, proc.SigSegv.Mask(), proc.SigSegv.Mask()},
+		{Args{sigBlock, 0, setAddr, sigSetSize}, 0, 0, proc.SigSegv.Mask(), proc.SigSegv.Mask()},
+		{Args{3, setAddr, 0, sigSetSize}, 0, -errnoInval, proc.SigSegv.Mask(), 0},
+		{Args{sigBlock, setAddr, 0, 16}, 0, -errnoInval, proc.SigSegv.Mask(), 0},
+		{Args{sigBlock, uint64(vmm.UserSpaceEnd), 0, sigSetSize}, 0, -errnoFault, proc.SigSegv.Mask(), 0},
+	}
+
+	for specIndex, spec := range specs {
+		userSigSet = spec.set
+		if got := sysRtSigprocmask(&spec.args); got != spec.expResult {
+			t.Errorf("[spec %d] expected result %d; got %d", specIndex, spec.expResult, got)
+		}
+
+		if got := p.SignalMask(); got != spec.expMask {
+			t.Errorf("[spec %d] expected signal mask 0x%x; got 0x%x", specIndex, spec.expMask, got)
+		}
+
+		if userSigSet != spec.expOld {
+			t.Errorf("[spec %d] expected user-space set 0x%x; got 0x%x", specIndex, spec.expOld, userSigSet)
+		}
+	}
+}
+
+func TestSysKill(t *testing.T) {
+	defer restoreAmd64Mocks()
+	defer restoreMocks()
+
+	type sent struct {
+		pid proc.PID
+		sig proc.Signal
+	}
+
+	var got []sent
+	sendSignalFn = func(pid proc.PID, sig proc.Signal) *kernel.Error {
+		got = append(got, sent{pid, sig})
+		if pid == 42 {
+			return &kernel.Error{Module: "test", Message: "no such process", Code: kernel.CodeNoProcess}
+		}
+		return nil
+	}
+
+	specs := []struct {
+		args      Args
+		expResult int64
+		expSent   []sent
+	}{
+		{Args{7, uint64(proc.SigKill)}, 0, []sent{{7, proc.SigKill}}},
+		{Args{7, 0}, 0, []sent{{7, 0}}},
+		{Args{42, uint64(proc.SigInt)}, -3, []sent{{42, proc.SigInt}}},
+		{Args{0, uint64(proc.SigInt)}, -errnoInval, nil},
+		{Args{^uint64(0), uint64(proc.SigInt)}, -errnoInval, nil},
+		{Args{7, proc.NumSignals}, -errnoInval, nil},
+	}
+
+	for specIndex, spec := range specs {
+		got = nil
+		if res := sysKill(&spec.args); res != spec.expResult {
+			t.Errorf("[spec %d] expected result %d; got %d", specIndex, spec.expResult, res)
+		}
+
+		if len(got) != len(spec.expSent) || (len(got) != 0 && got[0] != spec.expSent[0]) {
+			t.Errorf("[spec %d] expected to send %v; got %v", specIndex, spec.expSent, got)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package syscall
+
+import (
+	"gopheros/kernel/gate"
+	"gopheros/kernel/proc"
+)
+
+// userMode returns true if regs describe the state of user-mode code, i.e. if
+// the exception was taken from EL0.
+func userMode(regs *gate.Registers) bool {
+	return regs.PState&0xf == 0
+}
+
+// setupSignalFrame pushes a signal frame that saves the state described by
+// regs to the user-mode stack and points regs to the handler.
+func setupSignalFrame(_ *proc.Process, _ proc.Signal, _ proc.SignalAction, _ *gate.Registers) bool {
+	unimplemented()
+	return false
+}
+
+// sigreturn implements rt_sigreturn() which is invoked by the restorer once a
+// signal handler returns.
+func sigreturn(_ *gate.Registers) {
+	unimplemented()
+}
@@ -0,0 +1,140 @@
+package syscall
+
+import (
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/proc"
+	"gopheros/kernel/timer"
+	"unsafe"
+)
+
+const (
+	// killedExitCode is the exit code of processes that are terminated by
+	// the kernel. They are reported as killed by SIGSEGV.
+	killedExitCode = -int(proc.SigSegv)
+
+	// The arch_prctl codes for setting and querying the FS base.
+	archSetFS = 0x1002
+	archGetFS = 0x1003
+)
+
+var (
+	// The following functions are used by tests to mock calls to the
+	// proc and timer packages.
+	exitFn           = proc.Exit
+	sleepFn          = timer.SleepInterruptible
+	waitFn           = proc.Wait
+	currentProcessFn = proc.Current
+	sendSignalFn     = proc.SendSignal
+)
+
+// timespec mirrors the layout of struct timespec on amd64.
+type timespec struct {
+	sec  int64
+	nsec int64
+}
+
+// sysExit implements exit(status) by terminating the calling process. Only the
+// low 8 bits of status are reported to the parent process.
+func sysExit(args *Args) int64 {
+	exitFn(int(args[0] & 0xff))
+	return 0
+}
+
+// sysNanosleep implements nanosleep(req, rem). If the sleep is interrupted by
+// a signal, the remaining time is written to rem unless it is NULL and
+// -EINTR is returned.
+func sysNanosleep(args *Args) int64 {
+	var ts timespec
+	if err := CopyFromUser((*[unsafe.Sizeof(ts)]byte)(unsafe.Pointer(&ts))[:], uintptr(args[0])); err != nil {
+		return -errnoFault
+	}
+
+	if ts.sec < 0 || ts.nsec < 0 || ts.nsec >= int64(timer.Second) {
+		return -errnoInval
+	}
+
+	rem := sleepFn(timer.Duration(ts.sec)*timer.Second + timer.Duration(ts.nsec))
+	if rem == 0 {
+		return 0
+	}
+
+	if remAddr := uintptr(args[1]); remAddr != 0 {
+		ts = timespec{sec: int64(rem / timer.Second), nsec: int64(rem % timer.Second)}
+		if err := CopyToUser(remAddr, (*[unsafe.Sizeof(ts)]byte)(unsafe.Pointer(&ts))[:]); err != nil {
+			return -errnoFault
+		}
+	}
+
+	return -errnoIntr
+}
+
+// sysWait4 implements wait4(pid, status, options, rusage). Only waiting for a
+// specific child (pid > 0) or any child (pid == -1) is supported; options and
+// rusage are ignored.
+func sysWait4(args *Args) int64 {
+	pid := proc.AnyChild
+	switch target := int32(args[0]); {
+	case target > 0:
+		pid = proc.PID(target)
+	case target != -1:
+		return -errnoInval
+	}
+
+	statusAddr := uintptr(args[1])
+	if statusAddr != 0 {
+		if err := CheckUserRange(statusAddr, 4, true); err != nil {
+			return -errnoFault
+		}
+	}
+
+	childPID, code, err := waitFn(pid)
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	if statusAddr != 0 {
+		// Encode the exit code the same way as the WEXITSTATUS macro
+		// expects it. Processes killed by a signal have a negative exit
+		// code and report the signal number as expected by WTERMSIG.
+		status := uint32(code&0xff) << 8
+		if code < 0 {
+			status = uint32(-code) & 0x7f
+		}
+		if err = CopyToUser(statusAddr, (*[4]byte)(unsafe.Pointer(&status))[:]); err != nil {
+			return -errnoFault
+		}
+	}
+
+	return int64(childPID)
+}
+
+// sysArchPrctl implements arch_prctl(code, addr). Only the ARCH_SET_FS and
+// ARCH_GET_FS codes are supported; the FS base is used by user-mode code to
+// locate its thread-local storage.
+func sysArchPrctl(args *Args) int64 {
+	p := currentProcessFn()
+
+	switch args[0] {
+	case archSetFS:
+		if uintptr(args[1]) >= vmm.UserSpaceEnd {
+			return -errnoPerm
+		}
+		p.SetFSBase(uintptr(args[1]))
+	case archGetFS:
+		fsBase := uint64(p.FSBase())
+		if err := CopyToUser(uintptr(args[1]), (*[8]byte)(unsafe.Pointer(&fsBase))[:]); err != nil {
+			return -errnoFault
+		}
+	default:
+		return -errnoInval
+	}
+
+	return 0
+}
+
+func init() {
+	handlers[SysExit] = sysExit
+	handlers[SysNanosleep] = sysNanosleep
+	handlers[SysWait4] = sysWait4
+	handlers[SysArchPrctl] = sysArchPrctl
+}
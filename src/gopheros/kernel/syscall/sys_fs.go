@@ -0,0 +1,197 @@
+package syscall
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/proc"
+	"gopheros/kernel/vfs"
+)
+
+const (
+	// ioChunkSize is the size of the kernel buffer used by sysRead and
+	// sysWrite for copying data between user and kernel space.
+	ioChunkSize = 256
+
+	// maxPathLen is the maximum length of a path passed to sysOpen.
+	maxPathLen = 4096
+
+	// The access mode bits of the flags passed to open.
+	openAccessMask = 3
+	openReadOnly   = 0
+)
+
+var (
+	// The following functions are used by tests to mock calls to the
+	// proc and vfs packages.
+	currentFilesFn = currentFiles
+	openFn         = vfs.Open
+)
+
+// currentFiles returns the file descriptor table of the calling process.
+func currentFiles() *vfs.FDTable {
+	return proc.Current().Files()
+}
+
+// errnoOf returns the negated error number that corresponds to the code of an
+// error returned by the kernel. Errors without a code are reported as EINVAL.
+func errnoOf(err *kernel.Error) int64 {
+	return -int64(err.Errno())
+}
+
+// sysRead implements read(fd, buf, count).
+func sysRead(args *Args) int64 {
+	buf, count := uintptr(args[1]), args[2]
+	f, err := currentFilesFn().Get(int(int32(args[0])))
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	if err = CheckUserRange(buf, uintptr(count), true); err != nil {
+		return -errnoFault
+	}
+
+	var chunk [ioChunkSize]byte
+	for read := uint64(0); read < count; {
+		n := count - read
+		if n > ioChunkSize {
+			n = ioChunkSize
+		}
+
+		got, err := f.Read(chunk[:n])
+		if err != nil {
+			if read != 0 {
+				return int64(read)
+			}
+			return errnoOf(err)
+		}
+
+		if err = CopyToUser(buf+uintptr(read), chunk[:got]); err != nil {
+			return -errnoFault
+		}
+		read += uint64(got)
+
+		// Stop at the end of the file or once the file returns less
+		// data than requested (e.g. a terminal line).
+		if uint64(got) < n {
+			return int64(read)
+		}
+	}
+
+	return int64(count)
+}
+
+// sysWrite implements write(fd, buf, count).
+func sysWrite(args *Args) int64 {
+	buf, count := uintptr(args[1]), args[2]
+	f, err := currentFilesFn().Get(int(int32(args[0])))
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	if err = CheckUserRange(buf, uintptr(count), false); err != nil {
+		return -errnoFault
+	}
+
+	var chunk [ioChunkSize]byte
+	for written := uint64(0); written < count; {
+		n := count - written
+		if n > ioChunkSize {
+			n = ioChunkSize
+		}
+
+		if err = CopyFromUser(chunk[:n], buf+uintptr(written)); err != nil {
+			return -errnoFault
+		}
+
+		got, err := f.Write(chunk[:n])
+		written += uint64(got)
+		if err != nil {
+			if written != 0 {
+				return int64(written)
+			}
+			return errnoOf(err)
+		}
+	}
+
+	return int64(count)
+}
+
+// sysOpen implements open(path, flags, mode). As all mounted filesystems are
+// read-only, only the O_RDONLY access mode is supported; the remaining flags
+// and mode are ignored.
+func sysOpen(args *Args) int64 {
+	path, err := CopyStringFromUser(uintptr(args[0]), maxPathLen)
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	if args[1]&openAccessMask != openReadOnly {
+		return -errnoROFS
+	}
+
+	f, err := openFn(path)
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	fd, err := currentFilesFn().Install(f)
+	if err != nil {
+		_ = f.Close()
+		return errnoOf(err)
+	}
+
+	return int64(fd)
+}
+
+// sysClose implements close(fd).
+func sysClose(args *Args) int64 {
+	if err := currentFilesFn().Close(int(int32(args[0]))); err != nil {
+		return errnoOf(err)
+	}
+
+	return 0
+}
+
+// sysLseek implements lseek(fd, offset, whence).
+func sysLseek(args *Args) int64 {
+	f, err := currentFilesFn().Get(int(int32(args[0])))
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	offset, err := f.Lseek(int64(args[1]), int(int32(args[2])))
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	return offset
+}
+
+// sysDup implements dup(fd).
+func sysDup(args *Args) int64 {
+	fd, err := currentFilesFn().Dup(int(int32(args[0])))
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	return int64(fd)
+}
+
+// sysDup2 implements dup2(oldfd, newfd).
+func sysDup2(args *Args) int64 {
+	fd, err := currentFilesFn().Dup2(int(int32(args[0])), int(int32(args[1])))
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	return int64(fd)
+}
+
+func init() {
+	handlers[SysRead] = sysRead
+	handlers[SysWrite] = sysWrite
+	handlers[SysOpen] = sysOpen
+	handlers[SysClose] = sysClose
+	handlers[SysLseek] = sysLseek
+	handlers[SysDup] = sysDup
+	handlers[SysDup2] = sysDup2
+}
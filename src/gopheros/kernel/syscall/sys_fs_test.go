@@ -0,0 +1,267 @@
+package syscall
+
+import (
+	"bytes"
+	"gopheros/device/tty"
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/vfs"
+	"testing"
+	"unsafe"
+)
+
+// The following variables emulate user-space memory.
+var (
+	userReadBuf [600]byte
+	userPath    [16]byte
+)
+
+// bufferFile is a writable File that appends writes to a buffer.
+type bufferFile struct {
+	vfs.File
+	out    bytes.Buffer
+	limit  int
+	closed bool
+}
+
+func (f *bufferFile) Write(buf []byte) (int, *kernel.Error) {
+	if f.out.Len()+len(buf) > f.limit {
+		n := f.limit - f.out.Len()
+		f.out.Write(buf[:n])
+		return n, vfs.ErrReadOnly
+	}
+
+	f.out.Write(buf)
+	return len(buf), nil
+}
+
+func (f *bufferFile) Lseek(_ int64, _ int) (int64, *kernel.Error) {
+	return 0, vfs.ErrInvalidSeek
+}
+
+func (f *bufferFile) Close() *kernel.Error {
+	f.closed = true
+	return nil
+}
+
+func mockFiles(t *testing.T, files ...vfs.File) *vfs.FDTable {
+	table := &vfs.FDTable{}
+	for _, f := range files {
+		if _, err := table.Install(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	currentFilesFn = func() *vfs.FDTable { return table }
+	return table
+}
+
+func addrOf(buf []byte) uint64 {
+	return uint64(uintptr(unsafe.Pointer(&buf[0])))
+}
+
+func TestSysWrite(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		accessible = true
+		payload    = bytes.Repeat([]byte("0123456789"), 60)
+		bufAddr    = addrOf(payload)
+		out        = &bufferFile{limit: 1024}
+		full       = &bufferFile{limit: 300}
+	)
+	mockFiles(t, vfs.NewReadOnlyFile(vfs.FileInfo{Name: "motd"}, nil), out, full)
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return accessible }
+
+	specs := []struct {
+		args      Args
+		expResult int64
+		expOutput []byte
+	}{
+		{Args{1, bufAddr, 5}, 5, payload[:5]},
+		{Args{1, bufAddr, uint64(len(payload))}, int64(len(payload)), payload},
+		{Args{1, bufAddr, 0}, 0, nil},
+		{Args{0, bufAddr, 5}, -errnoROFS, nil},
+		{Args{3, bufAddr, 5}, -errnoBadFD, nil},
+		{Args{^uint64(0), bufAddr, 5}, -errnoBadFD, nil},
+		{Args{1, uint64(vmm.UserSpaceEnd) - 2, 5}, -errnoFault, nil},
+	}
+
+	for specIndex, spec := range specs {
+		out.out.Reset()
+		if got := sysWrite(&spec.args); got != spec.expResult {
+			t.Errorf("[spec %d] expected result %d; got %d", specIndex, spec.expResult, got)
+		}
+
+		if !bytes.Equal(out.out.Bytes(), spec.expOutput) {
+			t.Errorf("[spec %d] expected output %q; got %q", specIndex, spec.expOutput, out.out.Bytes())
+		}
+	}
+
+	// Partial writes report the number of bytes written
+	if got := sysWrite(&Args{2, bufAddr, uint64(len(payload))}); got != 300 {
+		t.Errorf("expected a partial write of 300 bytes; got %d", got)
+	}
+
+	accessible = false
+	if got := sysWrite(&Args{1, bufAddr, 5}); got != -errnoFault {
+		t.Errorf("expected result %d for unmapped buffer; got %d", -errnoFault, got)
+	}
+}
+
+func TestSysRead(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		accessible = true
+		data       = bytes.Repeat([]byte("gopher"), 100)
+		bufAddr    = addrOf(userReadBuf[:])
+		f          = vfs.NewReadOnlyFile(vfs.FileInfo{Name: "data"}, data)
+	)
+	mockFiles(t, f, vfs.NewReadOnlyFile(vfs.FileInfo{Name: "dir", Mode: vfs.ModeDir}, nil))
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return accessible }
+
+	specs := []struct {
+		args      Args
+		expResult int64
+		expData   []byte
+	}{
+		{Args{0, bufAddr, 4}, 4, data[:4]},
+		{Args{0, bufAddr, uint64(len(userReadBuf))}, int64(len(data) - 4), data[4:]},
+		{Args{0, bufAddr, 10}, 0, nil},
+		{Args{1, bufAddr, 10}, -errnoIsDir, nil},
+		{Args{2, bufAddr, 10}, -errnoBadFD, nil},
+		{Args{0, uint64(vmm.UserSpaceEnd) - 2, 5}, -errnoFault, nil},
+	}
+
+	for specIndex, spec := range specs {
+		userReadBuf = [len(userReadBuf)]byte{}
+		if got := sysRead(&spec.args); got != spec.expResult {
+			t.Errorf("[spec %d] expected result %d; got %d", specIndex, spec.expResult, got)
+		}
+
+		if !bytes.Equal(userReadBuf[:len(spec.expData)], spec.expData) {
+			t.Errorf("[spec %d] expected to read %q; got %q", specIndex, spec.expData, userReadBuf[:len(spec.expData)])
+		}
+	}
+
+	accessible = false
+	if got := sysRead(&Args{0, bufAddr, 5}); got != -errnoFault {
+		t.Errorf("expected result %d for unmapped buffer; got %d", -errnoFault, got)
+	}
+}
+
+func TestSysOpenCloseDup(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		pathAddr = addrOf(userPath[:])
+		opened   []string
+		motd     = &bufferFile{}
+	)
+	table := mockFiles(t)
+
+	// The last user-space page is unmapped
+	userAccessibleFn = func(addr uintptr, _ bool) bool { return addr < vmm.UserSpaceEnd-mm.PageSize }
+	openFn = func(path string) (vfs.File, *kernel.Error) {
+		opened = append(opened, path)
+		if path != "/etc/motd" {
+			return nil, vfs.ErrNotFound
+		}
+		return motd, nil
+	}
+
+	copy(userPath[:], "/etc/motd\x00")
+	if got := sysOpen(&Args{pathAddr, 0}); got != 0 {
+		t.Fatalf("expected sysOpen to return fd 0; got %d", got)
+	}
+	if f, _ := table.Get(0); f != motd || len(opened) != 1 {
+		t.Fatalf("expected fd 0 to refer to the opened file; got %v", f)
+	}
+
+	specs := []struct {
+		handler   Handler
+		args      Args
+		expResult int64
+	}{
+		{sysOpen, Args{pathAddr, 1}, -errnoROFS},
+		{sysOpen, Args{uint64(vmm.UserSpaceEnd) - 2}, -errnoFault},
+		{sysDup, Args{0}, 1},
+		{sysDup, Args{5}, -errnoBadFD},
+		{sysDup2, Args{0, 7}, 7},
+		{sysDup2, Args{0, vfs.MaxFiles}, -errnoBadFD},
+		{sysLseek, Args{1, 0, vfs.SeekCurrent}, -errnoInval},
+		{sysLseek, Args{3, 0, vfs.SeekStart}, -errnoBadFD},
+		{sysClose, Args{0}, 0},
+		{sysClose, Args{0}, -errnoBadFD},
+		{sysClose, Args{1}, 0},
+	}
+
+	for specIndex, spec := range specs {
+		if got := spec.handler(&spec.args); got != spec.expResult {
+			t.Errorf("[spec %d] expected result %d; got %d", specIndex, spec.expResult, got)
+		}
+	}
+
+	if motd.closed {
+		t.Fatal("expected the file to remain open while fd 7 refers to it")
+	}
+	if got := sysClose(&Args{7}); got != 0 || !motd.closed {
+		t.Fatalf("expected closing the last descriptor to close the file; got %d", got)
+	}
+
+	copy(userPath[:], "/missing\x00")
+	if got := sysOpen(&Args{pathAddr, 0}); got != -errnoNoEnt {
+		t.Fatalf("expected result %d; got %d", -errnoNoEnt, got)
+	}
+
+	// Files are closed if no descriptors are available
+	for i := 0; i < vfs.MaxFiles; i++ {
+		_, _ = table.Install(&bufferFile{})
+	}
+	copy(userPath[:], "/etc/motd\x00")
+	motd.closed = false
+	if got := sysOpen(&Args{pathAddr, 0}); got != -errnoMFile || !motd.closed {
+		t.Fatalf("expected result %d and the file to be closed; got %d", -errnoMFile, got)
+	}
+}
+
+func TestSysLseek(t *testing.T) {
+	defer restoreMocks()
+
+	mockFiles(t, vfs.NewReadOnlyFile(vfs.FileInfo{Name: "motd"}, []byte("welcome")))
+	if got := sysLseek(&Args{0, ^uint64(1), vfs.SeekEnd}); got != 5 {
+		t.Fatalf("expected offset 5; got %d", got)
+	}
+	if got := sysLseek(&Args{0, ^uint64(0), vfs.SeekStart}); got != -errnoInval {
+		t.Fatalf("expected result %d; got %d", -errnoInval, got)
+	}
+}
+
+func TestErrnoOf(t *testing.T) {
+	specs := []struct {
+		err *kernel.Error
+		exp int64
+	}{
+		{vfs.ErrNotFound, -errnoNoEnt},
+		{vfs.ErrBadFD, -errnoBadFD},
+		{vfs.ErrNotDir, -errnoNotDir},
+		{vfs.ErrIsDir, -errnoIsDir},
+		{vfs.ErrTooManyFiles, -errnoMFile},
+		{vfs.ErrReadOnly, -errnoROFS},
+		{vfs.ErrBrokenPipe, -errnoPipe},
+		{vfs.ErrExists, -errnoExist},
+		{vfs.ErrNotPollable, -errnoPerm},
+		{errBadAddress, -errnoFault},
+		{errNameTooLong, -errnoNameTooLong},
+		{tty.ErrInterrupted, -errnoIntr},
+		{&kernel.Error{Module: "test", Message: "no code"}, -errnoInval},
+	}
+
+	for specIndex, spec := range specs {
+		if got := errnoOf(spec.err); got != spec.exp {
+			t.Errorf("[spec %d] expected errno %d for %q; got %d", specIndex, spec.exp, spec.err.Message, got)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package syscall
+
+import (
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+)
+
+const (
+	// The protection flags accepted by mmap and mprotect.
+	protNone  = 0x0
+	protRead  = 0x1
+	protWrite = 0x2
+	protExec  = 0x4
+
+	// The mapping flags accepted by mmap. As processes cannot share
+	// memory, shared and private anonymous mappings behave the same.
+	mapShared    = 0x01
+	mapPrivate   = 0x02
+	mapFixed     = 0x10
+	mapAnonymous = 0x20
+
+	// mmapBottom is the lowest address that can be mapped via mmap. The
+	// pages below it are never mapped so that NULL pointer dereferences
+	// always fault.
+	mmapBottom = 0x10000
+)
+
+var (
+	// The following functions are used by tests to mock the region tree
+	// methods that update the page tables.
+	unmapRegionsFn   = (*vmm.RegionTree).Unmap
+	protectRegionsFn = (*vmm.RegionTree).Protect
+)
+
+// sysMmap implements mmap(addr, length, prot, flags, fd, offset). Only
+// anonymous mappings are supported; their pages are populated with zeroes when
+// they are first accessed. Unless MAP_FIXED is specified, addr is only used as
+// a hint and the mapping is placed below the stack if the hinted range is not
+// available.
+func sysMmap(args *Args) int64 {
+	var (
+		p      = currentProcessFn()
+		addr   = uintptr(args[0])
+		length = pageAlign(uintptr(args[1]))
+		flags  = args[3]
+	)
+
+	switch {
+	case args[1] == 0 || length == 0 || length > vmm.UserSpaceEnd || flags&(mapShared|mapPrivate) == 0:
+		return -errnoInval
+	case flags&mapAnonymous == 0:
+		return -errnoNoDev
+	case flags&mapFixed != 0:
+		if addr&(mm.PageSize-1) != 0 || addr < mmapBottom || addr > vmm.UserSpaceEnd-length {
+			return -errnoInval
+		}
+
+		if err := unmapRegionsFn(p.Regions(), addr, addr+length); err != nil {
+			return errnoOf(err)
+		}
+	default:
+		addr = pageAlign(addr)
+		if addr < mmapBottom || addr > vmm.UserSpaceEnd-length || p.Regions().Overlaps(addr, addr+length) {
+			var ok bool
+			if addr, ok = p.Regions().FindFree(length, mmapBottom, p.MmapTop()); !ok {
+				return -errnoNoMem
+			}
+		}
+	}
+
+	if err := p.Regions().Insert(vmm.Region{Start: addr, End: addr + length, Flags: protFlags(args[2])}); err != nil {
+		return errnoOf(err)
+	}
+
+	return int64(addr)
+}
+
+// sysMunmap implements munmap(addr, length). Unmapping a range that contains no
+// mappings is not an error.
+func sysMunmap(args *Args) int64 {
+	addr, length := uintptr(args[0]), pageAlign(uintptr(args[1]))
+	if addr&(mm.PageSize-1) != 0 || args[1] == 0 || length == 0 || addr > vmm.UserSpaceEnd-length {
+		return -errnoInval
+	}
+
+	if err := unmapRegionsFn(currentProcessFn().Regions(), addr, addr+length); err != nil {
+		return errnoOf(err)
+	}
+
+	return 0
+}
+
+// sysMprotect implements mprotect(addr, length, prot). The range must be fully
+// covered by mappings.
+func sysMprotect(args *Args) int64 {
+	addr, length := uintptr(args[0]), pageAlign(uintptr(args[1]))
+	switch {
+	case addr&(mm.PageSize-1) != 0 || (args[1] != 0 && length == 0) || addr > vmm.UserSpaceEnd-length:
+		return -errnoInval
+	case length == 0:
+		return 0
+	}
+
+	if err := protectRegionsFn(currentProcessFn().Regions(), addr, addr+length, protFlags(args[2])); err != nil {
+		return errnoOf(err)
+	}
+
+	return 0
+}
+
+// sysBrk implements brk(addr). It returns the new program break or, if the
+// heap cannot be resized, the current one. Passing 0 queries the current
+// program break.
+func sysBrk(args *Args) int64 {
+	p := currentProcessFn()
+	if addr := uintptr(args[0]); addr != 0 {
+		_ = p.SetBreak(addr)
+	}
+
+	return int64(p.Break())
+}
+
+// protFlags returns the region flags for the specified protection flags. As
+// with the MMU, write access implies read access.
+func protFlags(prot uint64) vmm.PageTableEntryFlag {
+	if prot&(protRead|protWrite|protExec) == protNone {
+		return 0
+	}
+
+	flags := vmm.FlagPresent | vmm.FlagUserAccessible
+	if prot&protWrite != 0 {
+		flags |= vmm.FlagRW
+	}
+	if prot&protExec == 0 {
+		flags |= vmm.FlagNoExecute
+	}
+	return flags
+}
+
+// pageAlign rounds addr up to the next page boundary. It returns 0 if the
+// result does not fit in a uintptr.
+func pageAlign(addr uintptr) uintptr {
+	return (addr + mm.PageSize - 1) &^ (mm.PageSize - 1)
+}
+
+func init() {
+	handlers[SysMmap] = sysMmap
+	handlers[SysMprotect] = sysMprotect
+	handlers[SysMunmap] = sysMunmap
+	handlers[SysBrk] = sysBrk
+}
@@ -0,0 +1,234 @@
+package syscall
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/proc"
+	"testing"
+)
+
+const (
+	testMmapTop = uintptr(0x7f0000000000)
+	userRW      = vmm.FlagPresent | vmm.FlagUserAccessible | vmm.FlagRW | vmm.FlagNoExecute
+)
+
+// mockRegionOps replaces the region tree methods that update the page tables
+// with versions that only update the tree.
+func mockRegionOps() {
+	unmapRegionsFn = func(t *vmm.RegionTree, start, end uintptr) *kernel.Error {
+		var kept []vmm.Region
+		t.Visit(func(r vmm.Region) bool {
+			kept = append(kept, r)
+			return true
+		})
+
+		*t = vmm.RegionTree{}
+		for _, r := range kept {
+			if r.Start < start {
+				_ = t.Insert(vmm.Region{Start: r.Start, End: minAddr(r.End, start), Flags: r.Flags})
+			}
+			if r.End > end {
+				_ = t.Insert(vmm.Region{Start: maxAddr(r.Start, end), End: r.End, Flags: r.Flags})
+			}
+		}
+		return nil
+	}
+}
+
+func minAddr(a, b uintptr) uintptr {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxAddr(a, b uintptr) uintptr {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func TestSysMmap(t *testing.T) {
+	defer restoreMocks()
+
+	p := &proc.Process{}
+	p.SetMemoryLayout(0x400000, testMmapTop)
+	currentProcessFn = func() *proc.Process { return p }
+	mockRegionOps()
+
+	anon := uint64(mapPrivate | mapAnonymous)
+	for specIndex, spec := range []struct {
+		args     Args
+		exp      int64
+		expFlags vmm.PageTableEntryFlag
+	}{
+		{Args{0, 0, protRead, anon}, -errnoInval, 0},
+		{Args{0, ^uint64(0), protRead, anon}, -errnoInval, 0},
+		{Args{0, 0x1000, protRead, mapAnonymous}, -errnoInval, 0},
+		{Args{0, 0x1000, protRead, mapPrivate, 3}, -errnoNoDev, 0},
+		{Args{0x1001, 0x1000, protRead, anon | mapFixed}, -errnoInval, 0},
+		{Args{0, 0x1000, protRead, anon | mapFixed}, -errnoInval, 0},
+		{Args{mmapBottom - 0x1000, 0x1000, protRead, anon | mapFixed}, -errnoInval, 0},
+		{Args{uint64(vmm.UserSpaceEnd), 0x1000, protRead, anon | mapFixed}, -errnoInval, 0},
+		// Mappings are placed top-down below the mmap top
+		{Args{0, 0x1800, protRead | protWrite, anon}, int64(testMmapTop - 0x2000), userRW},
+		{Args{0, 0x1000, protRead | protExec, anon}, int64(testMmapTop - 0x3000), vmm.FlagPresent | vmm.FlagUserAccessible},
+		{Args{0, 0x1000, protWrite, mapShared | mapAnonymous}, int64(testMmapTop - 0x4000), userRW},
+		// Free hints are honored; others are ignored
+		{Args{0x10000000, 0x1000, 0, anon}, 0x10000000, 0},
+		{Args{0x10000000, 0x1000, protRead, anon}, int64(testMmapTop - 0x5000), vmm.FlagPresent | vmm.FlagUserAccessible | vmm.FlagNoExecute},
+		{Args{0x100, 0x1000, protRead, anon}, int64(testMmapTop - 0x6000), vmm.FlagPresent | vmm.FlagUserAccessible | vmm.FlagNoExecute},
+		// Fixed mappings replace existing ones
+		{Args{uint64(testMmapTop - 0x2000), 0x1000, protRead, anon | mapFixed}, int64(testMmapTop - 0x2000), vmm.FlagPresent | vmm.FlagUserAccessible | vmm.FlagNoExecute},
+	} {
+		got := sysMmap(&spec.args)
+		if got != spec.exp {
+			t.Errorf("[spec %d] expected sysMmap to return 0x%x; got 0x%x", specIndex, spec.exp, got)
+			continue
+		}
+
+		if got < 0 {
+			continue
+		}
+
+		r, ok := p.Regions().Lookup(uintptr(got))
+		if !ok || r.Start > uintptr(got) || r.Flags != spec.expFlags {
+			t.Errorf("[spec %d] expected a region with flags 0x%x; got %+v, %t", specIndex, spec.expFlags, r, ok)
+		}
+	}
+
+	if r, _ := p.Regions().Lookup(testMmapTop - 0x1000); r.Flags != userRW {
+		t.Errorf("expected the rest of the replaced mapping to be preserved; got %+v", r)
+	}
+
+	// The address space is exhausted
+	p.SetMemoryLayout(0x400000, mmapBottom+0x1000)
+	if got := sysMmap(&Args{0, 0x2000, protRead, anon}); got != -errnoNoMem {
+		t.Errorf("expected to get ENOMEM; got %d", got)
+	}
+}
+
+func TestSysMunmap(t *testing.T) {
+	defer restoreMocks()
+
+	p := &proc.Process{}
+	currentProcessFn = func() *proc.Process { return p }
+	mockRegionOps()
+	_ = p.Regions().Insert(vmm.Region{Start: 0x10000, End: 0x14000, Flags: userRW})
+
+	for specIndex, spec := range []struct {
+		args Args
+		exp  int64
+	}{
+		{Args{0x10001, 0x1000}, -errnoInval},
+		{Args{0x10000, 0}, -errnoInval},
+		{Args{uint64(vmm.UserSpaceEnd - 0x1000), 0x2000}, -errnoInval},
+		{Args{0x20000, 0x1000}, 0},
+		{Args{0x11000, 0x1800}, 0},
+	} {
+		if got := sysMunmap(&spec.args); got != spec.exp {
+			t.Errorf("[spec %d] expected sysMunmap to return %d; got %d", specIndex, spec.exp, got)
+		}
+	}
+
+	for _, addr := range []uintptr{0x11000, 0x12000} {
+		if _, ok := p.Regions().Lookup(addr); ok {
+			t.Errorf("expected 0x%x to be unmapped", addr)
+		}
+	}
+	for _, addr := range []uintptr{0x10000, 0x13000} {
+		if _, ok := p.Regions().Lookup(addr); !ok {
+			t.Errorf("expected 0x%x to remain mapped", addr)
+		}
+	}
+}
+
+func TestSysMprotect(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		p        = &proc.Process{}
+		gotRange [2]uintptr
+		gotFlags vmm.PageTableEntryFlag
+		expErr   = &kernel.Error{Module: "test", Message: "not mapped", Code: kernel.CodeOutOfMemory}
+		protErr  *kernel.Error
+	)
+	currentProcessFn = func() *proc.Process { return p }
+	protectRegionsFn = func(_ *vmm.RegionTree, start, end uintptr, flags vmm.PageTableEntryFlag) *kernel.Error {
+		gotRange, gotFlags = [2]uintptr{start, end}, flags
+		return protErr
+	}
+
+	for specIndex, spec := range []struct {
+		args     Args
+		exp      int64
+		expRange [2]uintptr
+	}{
+		{Args{0x10001, 0x1000, protRead}, -errnoInval, [2]uintptr{}},
+		{Args{0x10000, ^uint64(0), protRead}, -errnoInval, [2]uintptr{}},
+		{Args{0x10000, 0, protRead}, 0, [2]uintptr{}},
+		{Args{0x10000, 0x1001, protRead}, 0, [2]uintptr{0x10000, 0x12000}},
+	} {
+		gotRange = [2]uintptr{}
+		if got := sysMprotect(&spec.args); got != spec.exp || gotRange != spec.expRange {
+			t.Errorf("[spec %d] expected sysMprotect to return %d and protect %x; got %d, %x", specIndex, spec.exp, spec.expRange, got, gotRange)
+		}
+	}
+
+	if exp := vmm.FlagPresent | vmm.FlagUserAccessible | vmm.FlagNoExecute; gotFlags != exp {
+		t.Errorf("expected flags 0x%x; got 0x%x", exp, gotFlags)
+	}
+
+	protErr = expErr
+	if got := sysMprotect(&Args{0x10000, 0x1000, protNone}); got != -errnoNoMem || gotFlags != 0 {
+		t.Errorf("expected to get ENOMEM for an unmapped range; got %d (flags 0x%x)", got, gotFlags)
+	}
+}
+
+func TestSysBrk(t *testing.T) {
+	defer restoreMocks()
+
+	p := &proc.Process{}
+	p.SetMemoryLayout(0x400000, testMmapTop)
+	currentProcessFn = func() *proc.Process { return p }
+
+	for specIndex, spec := range []struct {
+		addr uint64
+		exp  int64
+	}{
+		{0, 0x400000},
+		{0x402010, 0x402010},
+		// Invalid requests leave the program break unchanged
+		{0x100000, 0x402010},
+		{0x402020, 0x402020},
+	} {
+		if got := sysBrk(&Args{spec.addr}); got != spec.exp {
+			t.Errorf("[spec %d] expected sysBrk to return 0x%x; got 0x%x", specIndex, spec.exp, got)
+		}
+	}
+
+	if r, ok := p.Regions().Lookup(0x402000); !ok || r.Start != 0x400000 || r.End != 0x403000 {
+		t.Errorf("expected the heap to span [0x400000, 0x403000); got %+v", r)
+	}
+}
+
+func TestCheckUserRangeFaultIn(t *testing.T) {
+	defer restoreMocks()
+
+	var faulted []uintptr
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return false }
+	faultInFn = func(addr uintptr, _ bool) bool {
+		faulted = append(faulted, addr)
+		return addr < 0x12000
+	}
+
+	if err := CheckUserRange(0x10010, mm.PageSize, true); err != nil || len(faulted) != 2 || faulted[0] != 0x10000 || faulted[1] != 0x11000 {
+		t.Errorf("expected the pages of the range to be faulted in; got %x, %v", faulted, err)
+	}
+
+	if err := CheckUserRange(0x11000, 2*mm.PageSize, false); err != errBadAddress {
+		t.Errorf("expected to get errBadAddress if a page cannot be faulted in; got %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+package syscall
+
+import (
+	"gopheros/kernel/timer"
+	"gopheros/kernel/vfs"
+	"unsafe"
+)
+
+const (
+	// The flags accepted by pipe2 and epoll_create1. As the kernel does
+	// not support exec, the close-on-exec flag is accepted but ignored.
+	flagCloseOnExec = 0x80000
+
+	// The operations supported by epoll_ctl.
+	epollCtlAdd = 1
+	epollCtlDel = 2
+	epollCtlMod = 3
+
+	// epollEventMask contains the event bits that can be registered via
+	// epoll_ctl. Edge-triggered notifications are not supported.
+	epollEventMask = vfs.PollIn | vfs.PollOut | vfs.PollErr | vfs.PollHup | vfs.EpollOneShot
+)
+
+// pollFD mirrors the layout of struct pollfd.
+type pollFD struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// epollEvent mirrors the packed layout of struct epoll_event on amd64.
+type epollEvent struct {
+	events         uint32
+	dataLo, dataHi uint32
+}
+
+// msTimeout converts a timeout in milliseconds to a timer.Duration. Negative
+// timeouts wait indefinitely.
+func msTimeout(ms int32) timer.Duration {
+	if ms < 0 {
+		return vfs.NoTimeout
+	}
+
+	return timer.Duration(ms) * timer.Millisecond
+}
+
+// sysPipe implements pipe(fds).
+func sysPipe(args *Args) int64 {
+	return sysPipe2(&Args{args[0]})
+}
+
+// sysPipe2 implements pipe2(fds, flags). Only the O_CLOEXEC flag is accepted.
+func sysPipe2(args *Args) int64 {
+	if args[1]&^flagCloseOnExec != 0 {
+		return -errnoInval
+	}
+
+	var (
+		files  = currentFilesFn()
+		r, w   = vfs.NewPipe()
+		fds    [2]int32
+		fdsBuf = (*[unsafe.Sizeof(fds)]byte)(unsafe.Pointer(&fds))[:]
+	)
+
+	rfd, err := files.Install(r)
+	if err != nil {
+		_, _ = r.Close(), w.Close()
+		return errnoOf(err)
+	}
+
+	wfd, err := files.Install(w)
+	if err != nil {
+		_, _ = files.Close(rfd), w.Close()
+		return errnoOf(err)
+	}
+
+	fds[0], fds[1] = int32(rfd), int32(wfd)
+	if err = CopyToUser(uintptr(args[0]), fdsBuf); err != nil {
+		_, _ = files.Close(rfd), files.Close(wfd)
+		return -errnoFault
+	}
+
+	return 0
+}
+
+// sysPoll implements poll(fds, nfds, timeout). Negative descriptors are
+// ignored and descriptors that are not open report POLLNVAL.
+func sysPoll(args *Args) int64 {
+	var (
+		fdsAddr = uintptr(args[0])
+		nfds    = args[1]
+		fds     [vfs.MaxFiles]pollFD
+		items   [vfs.MaxFiles]vfs.PollItem
+	)
+
+	if nfds > vfs.MaxFiles {
+		return -errnoInval
+	}
+
+	fdsBuf := (*[unsafe.Sizeof(fds)]byte)(unsafe.Pointer(&fds))[:nfds*uint64(unsafe.Sizeof(fds[0]))]
+	if err := CopyFromUser(fdsBuf, fdsAddr); err != nil {
+		return -errnoFault
+	}
+
+	files := currentFilesFn()
+	for i := uint64(0); i < nfds; i++ {
+		if fds[i].fd < 0 {
+			items[i] = vfs.PollItem{Source: ignoredFD{}}
+			continue
+		}
+
+		items[i].Events = vfs.Events(uint16(fds[i].events))
+		if f, err := files.Get(int(fds[i].fd)); err == nil {
+			items[i].Source = vfs.AsPollable(f)
+		}
+	}
+
+	ready := vfs.Poll(items[:nfds], msTimeout(int32(args[2])))
+
+	for i := uint64(0); i < nfds; i++ {
+		fds[i].revents = int16(items[i].Revents)
+	}
+	if err := CopyToUser(fdsAddr, fdsBuf); err != nil {
+		return -errnoFault
+	}
+
+	return int64(ready)
+}
+
+// ignoredFD is the source of pollfd entries with a negative descriptor. It
+// never reports any events.
+type ignoredFD struct{}
+
+func (ignoredFD) Poll() vfs.Events { return 0 }
+
+// sysEpollCreate implements epoll_create(size). The size hint must be
+// positive but is otherwise ignored.
+func sysEpollCreate(args *Args) int64 {
+	if int32(args[0]) <= 0 {
+		return -errnoInval
+	}
+
+	return sysEpollCreate1(&Args{})
+}
+
+// sysEpollCreate1 implements epoll_create1(flags).
+func sysEpollCreate1(args *Args) int64 {
+	if args[0]&^flagCloseOnExec != 0 {
+		return -errnoInval
+	}
+
+	fd, err := currentFilesFn().Install(vfs.NewEpoll())
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	return int64(fd)
+}
+
+// currentEpoll returns the epoll instance associated with a descriptor of the
+// calling process or a negated error number.
+func currentEpoll(fd uint64) (*vfs.Epoll, int64) {
+	f, err := currentFilesFn().Get(int(int32(fd)))
+	if err != nil {
+		return nil, errnoOf(err)
+	}
+
+	ep, ok := f.(*vfs.Epoll)
+	if !ok {
+		return nil, -errnoInval
+	}
+
+	return ep, 0
+}
+
+// sysEpollCtl implements epoll_ctl(epfd, op, fd, event). Only files that
+// implement vfs.Pollable can be registered; all registrations are
+// level-triggered.
+func sysEpollCtl(args *Args) int64 {
+	ep, errno := currentEpoll(args[0])
+	if errno != 0 {
+		return errno
+	}
+
+	fd := int(int32(args[2]))
+	f, err := currentFilesFn().Get(fd)
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	src, ok := f.(vfs.Pollable)
+	if !ok {
+		return errnoOf(vfs.ErrNotPollable)
+	}
+
+	op := args[1]
+	if op == epollCtlDel {
+		if err = ep.Remove(fd); err != nil {
+			return errnoOf(err)
+		}
+		return 0
+	}
+
+	var ev epollEvent
+	if err = CopyFromUser((*[unsafe.Sizeof(ev)]byte)(unsafe.Pointer(&ev))[:], uintptr(args[3])); err != nil {
+		return -errnoFault
+	}
+
+	events := vfs.Events(ev.events)
+	if events&^epollEventMask != 0 {
+		return -errnoInval
+	}
+
+	data := uint64(ev.dataHi)<<32 | uint64(ev.dataLo)
+	switch op {
+	case epollCtlAdd:
+		err = ep.Add(fd, src, events, data)
+	case epollCtlMod:
+		err = ep.Modify(fd, events, data)
+	default:
+		return -errnoInval
+	}
+
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	return 0
+}
+
+// sysEpollWait implements epoll_wait(epfd, events, maxevents, timeout).
+func sysEpollWait(args *Args) int64 {
+	ep, errno := currentEpoll(args[0])
+	if errno != 0 {
+		return errno
+	}
+
+	// Each source is identified by a descriptor so at most MaxFiles
+	// events can be reported at once.
+	maxEvents := int(int32(args[2]))
+	if maxEvents <= 0 {
+		return -errnoInval
+	} else if maxEvents > vfs.MaxFiles {
+		maxEvents = vfs.MaxFiles
+	}
+
+	eventsAddr := uintptr(args[1])
+	if err := CheckUserRange(eventsAddr, uintptr(maxEvents)*unsafe.Sizeof(epollEvent{}), true); err != nil {
+		return -errnoFault
+	}
+
+	var (
+		ready [vfs.MaxFiles]vfs.EpollEvent
+		out   [vfs.MaxFiles]epollEvent
+		count = ep.Wait(ready[:maxEvents], msTimeout(int32(args[3])))
+	)
+
+	for i, ev := range ready[:count] {
+		out[i] = epollEvent{events: uint32(ev.Events), dataLo: uint32(ev.Data), dataHi: uint32(ev.Data >> 32)}
+	}
+
+	outBuf := (*[unsafe.Sizeof(out)]byte)(unsafe.Pointer(&out))[:uintptr(count)*unsafe.Sizeof(out[0])]
+	if err := CopyToUser(eventsAddr, outBuf); err != nil {
+		return -errnoFault
+	}
+
+	return int64(count)
+}
+
+func init() {
+	handlers[SysPoll] = sysPoll
+	handlers[SysPipe] = sysPipe
+	handlers[SysPipe2] = sysPipe2
+	handlers[SysEpollCreate] = sysEpollCreate
+	handlers[SysEpollCreate1] = sysEpollCreate1
+	handlers[SysEpollCtl] = sysEpollCtl
+	handlers[SysEpollWait] = sysEpollWait
+}
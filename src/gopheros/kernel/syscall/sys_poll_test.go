@@ -0,0 +1,217 @@
+package syscall
+
+import (
+	"gopheros/kernel/vfs"
+	"testing"
+	"unsafe"
+)
+
+// The following variables emulate user-space memory.
+var (
+	userFDs         [2]int32
+	userPollFDs     [4]pollFD
+	userEpollEvents [4]epollEvent
+)
+
+func TestSysPipe(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		accessible = true
+		fdsAddr    = uint64(uintptr(unsafe.Pointer(&userFDs)))
+		table      = mockFiles(t, &bufferFile{})
+	)
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return accessible }
+
+	if got := sysPipe(&Args{fdsAddr}); got != 0 || userFDs != [2]int32{1, 2} {
+		t.Fatalf("expected the pipe to be installed at fds 1 and 2; got %d, %v", got, userFDs)
+	}
+	r, _ := table.Get(1)
+	w, _ := table.Get(2)
+	if _, ok := r.(vfs.Pollable); !ok || r == w {
+		t.Fatal("expected fds 1 and 2 to refer to the ends of a pipe")
+	}
+
+	if got := sysPipe2(&Args{fdsAddr, flagCloseOnExec}); got != 0 || userFDs != [2]int32{3, 4} {
+		t.Fatalf("expected the pipe to be installed at fds 3 and 4; got %d, %v", got, userFDs)
+	}
+
+	if got := sysPipe2(&Args{fdsAddr, 0x800}); got != -errnoInval {
+		t.Fatalf("expected result %d for unsupported flags; got %d", -errnoInval, got)
+	}
+
+	// Descriptors are released if the result cannot be copied to user
+	// space or the table is full.
+	accessible = false
+	if got := sysPipe(&Args{fdsAddr}); got != -errnoFault {
+		t.Fatalf("expected result %d; got %d", -errnoFault, got)
+	}
+	if _, err := table.Get(5); err != vfs.ErrBadFD {
+		t.Fatal("expected the pipe descriptors to be released")
+	}
+
+	accessible = true
+	for fd := 5; fd < vfs.MaxFiles-1; fd++ {
+		if _, err := table.Install(&bufferFile{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := sysPipe(&Args{fdsAddr}); got != -errnoMFile {
+		t.Fatalf("expected result %d; got %d", -errnoMFile, got)
+	}
+	if _, err := table.Get(vfs.MaxFiles - 1); err != vfs.ErrBadFD {
+		t.Fatal("expected the read end descriptor to be released")
+	}
+	_, _ = table.Install(&bufferFile{})
+	if got := sysPipe(&Args{fdsAddr}); got != -errnoMFile {
+		t.Fatalf("expected result %d; got %d", -errnoMFile, got)
+	}
+}
+
+func TestSysPoll(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		accessible = true
+		fdsAddr    = uint64(uintptr(unsafe.Pointer(&userPollFDs)))
+		r, w       = vfs.NewPipe()
+	)
+	mockFiles(t, r, w, &bufferFile{})
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return accessible }
+
+	userPollFDs = [4]pollFD{
+		{fd: 0, events: int16(vfs.PollIn)},
+		{fd: 1, events: int16(vfs.PollIn | vfs.PollOut)},
+		{fd: -1, events: int16(vfs.PollIn)},
+		{fd: 9, events: int16(vfs.PollIn)},
+	}
+	if got := sysPoll(&Args{fdsAddr, 4, ^uint64(0)}); got != 2 {
+		t.Fatalf("expected 2 ready descriptors; got %d", got)
+	}
+	for i, exp := range []vfs.Events{0, vfs.PollOut, 0, vfs.PollNval} {
+		if got := vfs.Events(userPollFDs[i].revents); got != exp {
+			t.Errorf("[fd %d] expected revents 0x%x; got 0x%x", userPollFDs[i].fd, exp, got)
+		}
+	}
+
+	// Files that do not implement vfs.Pollable are always ready
+	userPollFDs[0] = pollFD{fd: 2, events: int16(vfs.PollIn)}
+	if got := sysPoll(&Args{fdsAddr, 1, 0}); got != 1 || vfs.Events(userPollFDs[0].revents) != vfs.PollIn {
+		t.Fatalf("expected the file to be readable; got %d, 0x%x", got, userPollFDs[0].revents)
+	}
+
+	if got := sysPoll(&Args{fdsAddr, vfs.MaxFiles + 1, 0}); got != -errnoInval {
+		t.Fatalf("expected result %d; got %d", -errnoInval, got)
+	}
+
+	accessible = false
+	if got := sysPoll(&Args{fdsAddr, 1, 0}); got != -errnoFault {
+		t.Fatalf("expected result %d; got %d", -errnoFault, got)
+	}
+
+	// Results that cannot be copied back are reported as faults
+	readOnly := uintptr(fdsAddr)
+	userAccessibleFn = func(addr uintptr, write bool) bool { return !write || addr != readOnly&^0xfff }
+	if got := sysPoll(&Args{fdsAddr, 1, 0}); got != -errnoFault {
+		t.Fatalf("expected result %d; got %d", -errnoFault, got)
+	}
+}
+
+func TestSysEpoll(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		accessible = true
+		evAddr     = uint64(uintptr(unsafe.Pointer(&userEpollEvents)))
+		r, w       = vfs.NewPipe()
+		table      = mockFiles(t, r, w, &bufferFile{})
+	)
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return accessible }
+
+	if got := sysEpollCreate(&Args{0}); got != -errnoInval {
+		t.Fatalf("expected result %d; got %d", -errnoInval, got)
+	}
+	if got := sysEpollCreate1(&Args{1}); got != -errnoInval {
+		t.Fatalf("expected result %d; got %d", -errnoInval, got)
+	}
+	epfd := sysEpollCreate(&Args{1})
+	if epfd != 3 {
+		t.Fatalf("expected the epoll instance to be installed at fd 3; got %d", epfd)
+	}
+
+	ctl := func(op uint64, fd uint64, events vfs.Events, data uint64) int64 {
+		userEpollEvents[0] = epollEvent{events: uint32(events), dataLo: uint32(data), dataHi: uint32(data >> 32)}
+		return sysEpollCtl(&Args{uint64(epfd), op, fd, evAddr})
+	}
+
+	specs := []struct {
+		op, fd    uint64
+		events    vfs.Events
+		expResult int64
+	}{
+		{epollCtlAdd, 0, vfs.PollIn, 0},
+		{epollCtlAdd, 1, vfs.PollOut, 0},
+		{epollCtlAdd, 1, vfs.PollOut, -errnoExist},
+		{epollCtlAdd, 2, vfs.PollIn, -errnoPerm},
+		{epollCtlAdd, 3, vfs.PollIn, -errnoInval},
+		{epollCtlAdd, 9, vfs.PollIn, -errnoBadFD},
+		{epollCtlAdd, 0, 1 << 31, -errnoInval},
+		{epollCtlMod, 0, vfs.PollIn | vfs.EpollOneShot, 0},
+		{4, 0, vfs.PollIn, -errnoInval},
+	}
+	for specIndex, spec := range specs {
+		if got := ctl(spec.op, spec.fd, spec.events, 0x100000000+spec.fd); got != spec.expResult {
+			t.Errorf("[spec %d] expected result %d; got %d", specIndex, spec.expResult, got)
+		}
+	}
+
+	if got := sysEpollWait(&Args{uint64(epfd), evAddr, 4, 0}); got != 1 {
+		t.Fatalf("expected 1 ready descriptor; got %d", got)
+	}
+	if ev := userEpollEvents[0]; vfs.Events(ev.events) != vfs.PollOut || ev.dataLo != 1 || ev.dataHi != 1 {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	if got := ctl(epollCtlDel, 1, 0, 0); got != 0 {
+		t.Fatalf("expected result 0; got %d", got)
+	}
+	if got := ctl(epollCtlDel, 1, 0, 0); got != -errnoNoEnt {
+		t.Fatalf("expected result %d; got %d", -errnoNoEnt, got)
+	}
+
+	for specIndex, spec := range []struct {
+		args      Args
+		expResult int64
+	}{
+		{Args{uint64(epfd), evAddr, 4, 0}, 0},
+		{Args{uint64(epfd), evAddr, 0, 0}, -errnoInval},
+		{Args{uint64(epfd), evAddr, vfs.MaxFiles + 1, 0}, 0},
+		{Args{0, evAddr, 4, 0}, -errnoInval},
+		{Args{9, evAddr, 4, 0}, -errnoBadFD},
+	} {
+		if got := sysEpollWait(&spec.args); got != spec.expResult {
+			t.Errorf("[wait spec %d] expected result %d; got %d", specIndex, spec.expResult, got)
+		}
+	}
+
+	if got := sysEpollCtl(&Args{0, epollCtlAdd, 1, evAddr}); got != -errnoInval {
+		t.Fatalf("expected result %d; got %d", -errnoInval, got)
+	}
+
+	accessible = false
+	if got := ctl(epollCtlAdd, 1, vfs.PollOut, 0); got != -errnoFault {
+		t.Fatalf("expected result %d; got %d", -errnoFault, got)
+	}
+	if got := sysEpollWait(&Args{uint64(epfd), evAddr, 4, 0}); got != -errnoFault {
+		t.Fatalf("expected result %d; got %d", -errnoFault, got)
+	}
+
+	for fd := 4; fd < vfs.MaxFiles; fd++ {
+		if _, err := table.Install(&bufferFile{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := sysEpollCreate1(&Args{}); got != -errnoMFile {
+		t.Fatalf("expected result %d; got %d", -errnoMFile, got)
+	}
+}
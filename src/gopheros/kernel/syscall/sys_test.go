@@ -0,0 +1,197 @@
+package syscall
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/coredump"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/proc"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/vfs"
+	"testing"
+	"unsafe"
+)
+
+// The following variables emulate user-space memory. They are allocated
+// statically as the goroutine stack may move while a handler accesses them.
+var (
+	userTimespec timespec
+	userStatus   uint32
+	userFSBase   uint64
+)
+
+func restoreMocks() {
+	currentFilesFn = currentFiles
+	openFn = vfs.Open
+	exitFn = proc.Exit
+	sleepFn = timer.SleepInterruptible
+	waitFn = proc.Wait
+	currentProcessFn = proc.Current
+	sendSignalFn = proc.SendSignal
+	userAccessibleFn = vmm.UserAccessible
+	faultInFn = proc.FaultIn
+	unmapRegionsFn = (*vmm.RegionTree).Unmap
+	protectRegionsFn = (*vmm.RegionTree).Protect
+	dumpCoreFn = coredump.Write
+}
+
+func TestSysExit(t *testing.T) {
+	defer restoreMocks()
+
+	var codes []int
+	exitFn = func(code int) { codes = append(codes, code) }
+
+	sysExit(&Args{3})
+	sysExit(&Args{^uint64(0)})
+	if len(codes) != 2 || codes[0] != 3 || codes[1] != 255 {
+		t.Errorf("expected sysExit to terminate the calling process with codes [3 255]; got %v", codes)
+	}
+}
+
+func TestSysNanosleep(t *testing.T) {
+	defer restoreMocks()
+
+	var slept []timer.Duration
+	sleepFn = func(d timer.Duration) timer.Duration {
+		slept = append(slept, d)
+		return 0
+	}
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return true }
+
+	specs := []struct {
+		ts        timespec
+		expResult int64
+		expSleep  timer.Duration
+	}{
+		{timespec{1, 500}, 0, timer.Second + 500},
+		{timespec{0, 0}, 0, 0},
+		{timespec{-1, 0}, -errnoInval, -1},
+		{timespec{0, -1}, -errnoInval, -1},
+		{timespec{0, int64(timer.Second)}, -errnoInval, -1},
+	}
+
+	for specIndex, spec := range specs {
+		slept = slept[:0]
+		userTimespec = spec.ts
+		if got := sysNanosleep(&Args{uint64(uintptr(unsafe.Pointer(&userTimespec)))}); got != spec.expResult {
+			t.Errorf("[spec %d] expected result %d; got %d", specIndex, spec.expResult, got)
+		}
+
+		switch {
+		case spec.expSleep < 0 && len(slept) != 0:
+			t.Errorf("[spec %d] expected sysNanosleep not to sleep", specIndex)
+		case spec.expSleep >= 0 && (len(slept) != 1 || slept[0] != spec.expSleep):
+			t.Errorf("[spec %d] expected sysNanosleep to sleep for %d; got %v", specIndex, spec.expSleep, slept)
+		}
+	}
+
+	if got := sysNanosleep(&Args{uint64(vmm.UserSpaceEnd)}); got != -errnoFault {
+		t.Errorf("expected result %d for invalid timespec address; got %d", -errnoFault, got)
+	}
+
+	// Interrupted sleeps report the remaining time via rem
+	sleepFn = func(_ timer.Duration) timer.Duration { return 2*timer.Second + 300 }
+	userTimespec = timespec{5, 0}
+	reqAddr := uint64(uintptr(unsafe.Pointer(&userTimespec)))
+	if got := sysNanosleep(&Args{reqAddr}); got != -errnoIntr {
+		t.Errorf("expected result %d for interrupted sleep; got %d", -errnoIntr, got)
+	}
+
+	var rem timespec
+	if got := sysNanosleep(&Args{reqAddr, uint64(uintptr(unsafe.Pointer(&rem)))}); got != -errnoIntr {
+		t.Errorf("expected result %d for interrupted sleep; got %d", -errnoIntr, got)
+	}
+	if rem.sec != 2 || rem.nsec != 300 {
+		t.Errorf("expected remaining time to be {2 300}; got %v", rem)
+	}
+
+	if got := sysNanosleep(&Args{reqAddr, uint64(vmm.UserSpaceEnd)}); got != -errnoFault {
+		t.Errorf("expected result %d for invalid rem address; got %d", -errnoFault, got)
+	}
+}
+
+func TestSysWait4(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		waitedFor  []proc.PID
+		statusAddr = uint64(uintptr(unsafe.Pointer(&userStatus)))
+	)
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return true }
+	waitFn = func(pid proc.PID) (proc.PID, int, *kernel.Error) {
+		waitedFor = append(waitedFor, pid)
+		switch pid {
+		case 13:
+			return 0, 0, &kernel.Error{Module: "test", Message: "no children", Code: kernel.CodeNoChild}
+		case 9:
+			// Killed by SIGKILL
+			return 9, -int(proc.SigKill), nil
+		}
+		return 7, 0x142, nil
+	}
+
+	specs := []struct {
+		args       Args
+		expResult  int64
+		expWaitFor []proc.PID
+		expStatus  uint32
+	}{
+		{Args{^uint64(0), statusAddr}, 7, []proc.PID{proc.AnyChild}, 0x4200},
+		{Args{7, 0}, 7, []proc.PID{7}, 0},
+		{Args{9, statusAddr}, 9, []proc.PID{9}, 9},
+		{Args{13, statusAddr}, -errnoChild, []proc.PID{13}, 0},
+		{Args{0, statusAddr}, -errnoInval, nil, 0},
+		{Args{7, uint64(vmm.UserSpaceEnd)}, -errnoFault, nil, 0},
+	}
+
+	for specIndex, spec := range specs {
+		waitedFor, userStatus = nil, 0
+		if got := sysWait4(&spec.args); got != spec.expResult {
+			t.Errorf("[spec %d] expected result %d; got %d", specIndex, spec.expResult, got)
+		}
+
+		if len(waitedFor) != len(spec.expWaitFor) || (len(waitedFor) != 0 && waitedFor[0] != spec.expWaitFor[0]) {
+			t.Errorf("[spec %d] expected to wait for %v; got %v", specIndex, spec.expWaitFor, waitedFor)
+		}
+
+		if userStatus != spec.expStatus {
+			t.Errorf("[spec %d] expected status 0x%x; got 0x%x", specIndex, spec.expStatus, userStatus)
+		}
+	}
+}
+
+func TestSysArchPrctl(t *testing.T) {
+	defer restoreMocks()
+
+	p := &proc.Process{}
+	currentProcessFn = func() *proc.Process { return p }
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return true }
+
+	fsBaseAddr := uint64(uintptr(unsafe.Pointer(&userFSBase)))
+	specs := []struct {
+		args      Args
+		expResult int64
+		expFSBase uintptr
+		expUser   uint64
+	}{
+		{Args{archSetFS, 0x4000}, 0, 0x4000, 0},
+		{Args{archGetFS, fsBaseAddr}, 0, 0x4000, 0x4000},
+		{Args{archSetFS, uint64(vmm.UserSpaceEnd)}, -errnoPerm, 0x4000, 0},
+		{Args{archGetFS, uint64(vmm.UserSpaceEnd)}, -errnoFault, 0x4000, 0},
+		{Args{0x1001, 0x4000}, -errnoInval, 0x4000, 0},
+	}
+
+	for specIndex, spec := range specs {
+		userFSBase = 0
+		if got := sysArchPrctl(&spec.args); got != spec.expResult {
+			t.Errorf("[spec %d] expected result %d; got %d", specIndex, spec.expResult, got)
+		}
+
+		if got := p.FSBase(); got != spec.expFSBase {
+			t.Errorf("[spec %d] expected FS base 0x%x; got 0x%x", specIndex, spec.expFSBase, got)
+		}
+
+		if userFSBase != spec.expUser {
+			t.Errorf("[spec %d] expected user-space FS base 0x%x; got 0x%x", specIndex, spec.expUser, userFSBase)
+		}
+	}
+}
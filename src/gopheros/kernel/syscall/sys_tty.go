@@ -0,0 +1,117 @@
+package syscall
+
+import (
+	"gopheros/device/tty"
+	"unsafe"
+)
+
+// The terminal ioctl requests supported by sysIoctl. The values match the ones
+// used by Linux.
+const (
+	ioctlTCGETS  = 0x5401
+	ioctlTCSETS  = 0x5402
+	ioctlTCSETSW = 0x5403
+	ioctlTCSETSF = 0x5404
+)
+
+// Bits of the termios c_lflag and c_iflag fields and indices of the control
+// characters in c_cc.
+const (
+	lflagISIG   = 0x0001
+	lflagICANON = 0x0002
+	lflagECHO   = 0x0008
+	iflagICRNL  = 0x0100
+
+	ccVINTR  = 0
+	ccVQUIT  = 1
+	ccVERASE = 2
+	ccVKILL  = 3
+	ccVEOF   = 4
+	ccVMIN   = 6
+)
+
+// termios mirrors the layout of the kernel struct termios used by the TCGETS
+// and TCSETS requests on amd64.
+type termios struct {
+	iflag uint32
+	oflag uint32
+	cflag uint32
+	lflag uint32
+	line  uint8
+	cc    [19]uint8
+}
+
+// terminal is implemented by files that are backed by a tty line discipline.
+type terminal interface {
+	Flags() tty.Flags
+	SetFlags(tty.Flags)
+}
+
+// sysIoctl implements ioctl(fd, request, arg) for the TCGETS and TCSETS family
+// of requests which allow programs to switch a terminal between canonical and
+// raw mode and to control echo and signal generation. Only the ICANON, ECHO
+// and ISIG local mode bits can be changed; all other settings are fixed. As
+// the output of terminals is written synchronously, TCSETSW and TCSETSF are
+// equivalent to TCSETS and do not discard pending input.
+func sysIoctl(args *Args) int64 {
+	f, err := currentFilesFn().Get(int(int32(args[0])))
+	if err != nil {
+		return errnoOf(err)
+	}
+
+	term, ok := f.(terminal)
+	if !ok {
+		return -errnoNoTTY
+	}
+
+	var (
+		t     termios
+		tAddr = uintptr(args[2])
+		tBuf  = (*[unsafe.Sizeof(t)]byte)(unsafe.Pointer(&t))[:]
+	)
+
+	switch args[1] {
+	case ioctlTCGETS:
+		flags := term.Flags()
+		t.iflag = iflagICRNL
+		if flags&tty.FlagCanonical != 0 {
+			t.lflag |= lflagICANON
+		}
+		if flags&tty.FlagEcho != 0 {
+			t.lflag |= lflagECHO
+		}
+		if flags&tty.FlagSignals != 0 {
+			t.lflag |= lflagISIG
+		}
+		t.cc[ccVINTR], t.cc[ccVQUIT], t.cc[ccVERASE] = 0x03, 0x1c, 0x7f
+		t.cc[ccVKILL], t.cc[ccVEOF], t.cc[ccVMIN] = 0x15, 0x04, 1
+
+		if err = CopyToUser(tAddr, tBuf); err != nil {
+			return -errnoFault
+		}
+	case ioctlTCSETS, ioctlTCSETSW, ioctlTCSETSF:
+		if err = CopyFromUser(tBuf, tAddr); err != nil {
+			return -errnoFault
+		}
+
+		var flags tty.Flags
+		if t.lflag&lflagICANON != 0 {
+			flags |= tty.FlagCanonical
+		}
+		if t.lflag&lflagECHO != 0 {
+			flags |= tty.FlagEcho
+		}
+		if t.lflag&lflagISIG != 0 {
+			flags |= tty.FlagSignals
+		}
+		term.SetFlags(flags)
+	default:
+		return -errnoInval
+	}
+
+	return 0
+}
+
+func init() {
+	handlers[SysIoctl] = sysIoctl
+}
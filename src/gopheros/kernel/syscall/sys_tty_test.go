@@ -0,0 +1,103 @@
+package syscall
+
+import (
+	"gopheros/device/tty"
+	"gopheros/kernel"
+	"gopheros/kernel/vfs"
+	"testing"
+	"unsafe"
+)
+
+// interruptedFile is a File whose reads are interrupted by a signal.
+type interruptedFile struct {
+	vfs.File
+}
+
+func (interruptedFile) Read(_ []byte) (int, *kernel.Error) {
+	return 0, tty.ErrInterrupted
+}
+
+// The console line discipline must be usable with ioctl.
+var _ terminal = (*tty.LineDiscipline)(nil)
+
+// fakeTerminal is a File that implements the terminal interface.
+type fakeTerminal struct {
+	vfs.File
+	flags tty.Flags
+}
+
+func (f *fakeTerminal) Flags() tty.Flags         { return f.flags }
+func (f *fakeTerminal) SetFlags(flags tty.Flags) { f.flags = flags }
+
+// userTermios emulates a termios structure in user-space memory.
+var userTermios termios
+
+func TestSysIoctl(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		accessible = true
+		term       = &fakeTerminal{flags: tty.DefaultFlags}
+		tAddr      = uint64(uintptr(unsafe.Pointer(&userTermios)))
+	)
+	mockFiles(t, term, vfs.NewReadOnlyFile(vfs.FileInfo{Name: "motd"}, nil))
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return accessible }
+
+	if res := sysIoctl(&Args{0, ioctlTCGETS, tAddr}); res != 0 {
+		t.Fatalf("expected TCGETS to succeed; got %d", res)
+	}
+	if exp := uint32(lflagICANON | lflagECHO | lflagISIG); userTermios.lflag != exp {
+		t.Fatalf("expected lflag to be 0x%x; got 0x%x", exp, userTermios.lflag)
+	}
+	if userTermios.cc[ccVINTR] != 0x03 || userTermios.cc[ccVEOF] != 0x04 {
+		t.Fatalf("unexpected control characters: %v", userTermios.cc)
+	}
+
+	// Switch to raw mode without echo
+	userTermios.lflag = lflagISIG
+	for _, req := range []uint64{ioctlTCSETS, ioctlTCSETSW, ioctlTCSETSF} {
+		if res := sysIoctl(&Args{0, req, tAddr}); res != 0 {
+			t.Fatalf("expected request 0x%x to succeed; got %d", req, res)
+		}
+	}
+	if term.Flags() != tty.FlagSignals {
+		t.Fatalf("expected line discipline flags to be %d; got %d", tty.FlagSignals, term.Flags())
+	}
+
+	userTermios = termios{}
+	if res := sysIoctl(&Args{0, ioctlTCGETS, tAddr}); res != 0 || userTermios.lflag != lflagISIG {
+		t.Fatalf("expected TCGETS to report lflag 0x%x; got 0x%x (%d)", lflagISIG, userTermios.lflag, res)
+	}
+
+	specs := []struct {
+		args      Args
+		expResult int64
+	}{
+		{Args{1, ioctlTCGETS, tAddr}, -errnoNoTTY},
+		{Args{7, ioctlTCGETS, tAddr}, -errnoBadFD},
+		{Args{0, 0x5413, tAddr}, -errnoInval},
+	}
+	for specIndex, spec := range specs {
+		if res := sysIoctl(&spec.args); res != spec.expResult {
+			t.Errorf("[spec %d] expected result %d; got %d", specIndex, spec.expResult, res)
+		}
+	}
+
+	accessible = false
+	for _, req := range []uint64{ioctlTCGETS, ioctlTCSETS} {
+		if res := sysIoctl(&Args{0, req, tAddr}); res != -errnoFault {
+			t.Errorf("expected request 0x%x to fail with EFAULT; got %d", req, res)
+		}
+	}
+}
+
+func TestSysReadInterrupted(t *testing.T) {
+	defer restoreMocks()
+
+	mockFiles(t, interruptedFile{})
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return true }
+
+	if got := sysRead(&Args{0, addrOf(userReadBuf[:]), 4}); got != -errnoIntr {
+		t.Fatalf("expected result %d; got %d", -errnoIntr, got)
+	}
+}
@@ -0,0 +1,119 @@
+// Package syscall implements the system call interface that allows user-mode
+// code to request services from the kernel.
+//
+// On amd64, user-mode code invokes a system call via the SYSCALL instruction
+// after loading the system call number into RAX and up to six arguments into
+// RDI, RSI, RDX, R10, R8 and R9. The result is returned in RAX; failed calls
+// return a negated error number.
+package syscall
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+)
+
+// Number identifies a system call.
+type Number uint64
+
+// The system calls implemented by the kernel. The numbers match the ones used
+// by Linux on amd64.
+const (
+	SysRead          Number = 0
+	SysWrite         Number = 1
+	SysOpen          Number = 2
+	SysClose         Number = 3
+	SysPoll          Number = 7
+	SysLseek         Number = 8
+	SysMmap          Number = 9
+	SysMprotect      Number = 10
+	SysMunmap        Number = 11
+	SysBrk           Number = 12
+	SysRtSigaction   Number = 13
+	SysRtSigprocmask Number = 14
+	SysRtSigreturn   Number = 15
+	SysIoctl         Number = 16
+	SysPipe          Number = 22
+	SysDup           Number = 32
+	SysDup2          Number = 33
+	SysNanosleep     Number = 35
+	SysExit          Number = 60
+	SysWait4         Number = 61
+	SysKill          Number = 62
+	SysArchPrctl     Number = 158
+	SysEpollCreate   Number = 213
+	SysEpollWait     Number = 232
+	SysEpollCtl      Number = 233
+	SysEpollCreate1  Number = 291
+	SysPipe2         Number = 293
+
+	// MaxSyscalls is the size of the system call dispatch table.
+	MaxSyscalls = 512
+)
+
+// The error numbers returned (negated) by system calls.
+const (
+	errnoPerm        = 1
+	errnoNoEnt       = 2
+	errnoIntr        = 4
+	errnoBadFD       = 9
+	errnoChild       = 10
+	errnoNoMem       = 12
+	errnoFault       = 14
+	errnoExist       = 17
+	errnoNoDev       = 19
+	errnoNotDir      = 20
+	errnoIsDir       = 21
+	errnoInval       = 22
+	errnoMFile       = 24
+	errnoNoTTY       = 25
+	errnoROFS        = 30
+	errnoPipe        = 32
+	errnoNameTooLong = 36
+	errnoNoSys       = 38
+)
+
+// Args contains the arguments passed to a system call.
+type Args [6]uint64
+
+// Handler implements a system call. It returns the value to be passed back to
+// user-mode code or a negated error number.
+type Handler func(args *Args) int64
+
+var (
+	errInvalidSyscall    = &kernel.Error{Module: "syscall", Message: "invalid system call number", Code: kernel.CodeInvalid}
+	errHandlerRegistered = &kernel.Error{Module: "syscall", Message: "a handler is already registered for this system call", Code: kernel.CodeExists}
+
+	handlers [MaxSyscalls]Handler
+)
+
+// Register installs the handler for a system call.
+func Register(nr Number, handler Handler) *kernel.Error {
+	if nr >= MaxSyscalls || handler == nil {
+		return errInvalidSyscall
+	}
+
+	if handlers[nr] != nil {
+		return errHandlerRegistered
+	}
+
+	handlers[nr] = handler
+	return nil
+}
+
+// dispatch invokes the handler for the system call described by regs and
+// stores its result into the return value register.
+func dispatch(regs *gate.Registers) {
+	if Number(regs.Info) == SysRtSigreturn {
+		sigreturn(regs)
+		return
+	}
+
+	args := syscallArgs(regs)
+
+	var ret int64 = -errnoNoSys
+	if nr := regs.Info; nr < MaxSyscalls && handlers[nr] != nil {
+		ret = handlers[nr](&args)
+	}
+
+	setSyscallResult(regs, ret)
+}
@@ -0,0 +1,104 @@
+package syscall
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/user"
+)
+
+const (
+	msrEFER  = 0xc0000080
+	msrSTAR  = 0xc0000081
+	msrLSTAR = 0xc0000082
+	msrFMASK = 0xc0000084
+
+	// eferSCE enables the SYSCALL/SYSRET instructions.
+	eferSCE = 1 << 0
+
+	// The RFLAGS bits that are cleared when entering the kernel via
+	// SYSCALL: TF, IF, DF and AC.
+	syscallFlagMask = 1<<8 | 1<<9 | 1<<10 | 1<<18
+)
+
+var (
+	// kernelStackSlot points to the TSS field that holds the kernel stack
+	// pointer of the running task. It is used by syscallEntry to switch to
+	// the kernel stack.
+	kernelStackSlot uintptr
+
+	// fsBaseSlots points to the kernel FS base which is followed by the
+	// FS base of the running user-mode code. It is used by syscallEntry
+	// to switch between the two.
+	fsBaseSlots uintptr
+
+	// userStack is used by syscallEntry as scratch space for saving the
+	// user-mode stack pointer while switching to the kernel stack. As
+	// interrupts are masked on entry and system calls are only serviced by
+	// the boot processor, a single slot is sufficient.
+	userStack uintptr
+
+	// The following functions are used by tests to mock calls to the cpu
+	// and user packages.
+	readMSRFn          = cpu.ReadMSR
+	writeMSRFn         = cpu.WriteMSR
+	enableInterruptsFn = cpu.EnableInterrupts
+	kernelStackSlotFn  = user.KernelStackSlot
+	syscallEntryAddrFn = syscallEntryAddr
+
+	// setUserReturnHandlerFn is used by tests to mock calls to the gate
+	// package.
+	setUserReturnHandlerFn = gate.SetUserReturnHandler
+)
+
+// Init enables the SYSCALL/SYSRET instructions and installs the system call
+// entrypoint. It also arranges for pending signals to be delivered each time
+// an interrupt handler returns to user mode. It must be invoked after
+// user.Init.
+func Init() {
+	kernelStackSlot = kernelStackSlotFn()
+	fsBaseSlots = gate.FSBaseSlots()
+
+	// SYSCALL loads CS from STAR[47:32] and SS from STAR[47:32]+8. SYSRET
+	// loads CS from STAR[63:48]+16 and SS from STAR[63:48]+8 and sets the
+	// RPL of both selectors to 3.
+	star := uint64(user.KernelCodeSelector)<<32 | uint64(user.KernelDataSelector)<<48
+	writeMSRFn(msrSTAR, star)
+	writeMSRFn(msrLSTAR, uint64(syscallEntryAddrFn()))
+	writeMSRFn(msrFMASK, syscallFlagMask)
+	writeMSRFn(msrEFER, readMSRFn(msrEFER)|eferSCE)
+
+	setUserReturnHandlerFn(deliverSignals)
+}
+
+// handleSyscall is invoked by syscallEntry on the kernel stack of the calling
+// thread. Interrupts are re-enabled while the system call is serviced. Pending
+// signals are delivered before returning to user mode.
+func handleSyscall(regs *gate.Registers) {
+	enableInterruptsFn()
+	dispatch(regs)
+	deliverSignals(regs)
+
+	// SYSRET faults in kernel mode if the return address is not canonical
+	// so make sure that handlers did not point it to kernel space.
+	if uintptr(regs.RIP) >= vmm.UserSpaceEnd {
+		exitFn(killedExitCode)
+	}
+}
+
+// syscallArgs returns the system call arguments passed in RDI, RSI, RDX, R10,
+// R8 and R9.
+func syscallArgs(regs *gate.Registers) Args {
+	return Args{regs.RDI, regs.RSI, regs.RDX, regs.R10, regs.R8, regs.R9}
+}
+
+// setSyscallResult stores the result of a system call into RAX.
+func setSyscallResult(regs *gate.Registers, ret int64) {
+	regs.RAX = uint64(ret)
+}
+
+// syscallEntry is the entrypoint for the SYSCALL instruction.
+func syscallEntry()
+
+// syscallEntryAddr returns the address of syscallEntry.
+func syscallEntryAddr() uintptr
@@ -0,0 +1,150 @@
+#include "textflag.h"
+
+#define USER_DS 0x1b
+#define USER_CS 0x23
+
+#define MSR_FS_BASE 0xc0000100
+
+// Load the FS base stored in AX. CX and DX are clobbered.
+#define LOAD_FS_BASE \
+	MOVQ AX, DX;            \
+	SHRQ $32, DX;           \
+	MOVL $MSR_FS_BASE, CX;  \
+	WRMSR
+
+TEXT ·syscallEntryAddr(SB),NOSPLIT,$0-8
+	LEAQ ·syscallEntry(SB), AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+// syscallEntry is invoked by the CPU when user-mode code executes SYSCALL.
+// Upon entry, RCX contains the user-mode return address, R11 contains the
+// user-mode RFLAGS value and RSP still points to the user-mode stack.
+//
+// The code switches to the kernel stack of the running task and builds a
+// frame with the same layout as the one built by the interrupt gate
+// entrypoints so that handleSyscall can access the user-mode register
+// contents via a *gate.Registers.
+TEXT ·syscallEntry(SB),NOSPLIT,$0
+	MOVQ SP, ·userStack(SB)
+	MOVQ ·kernelStackSlot(SB), SP
+	MOVQ 0(SP), SP
+
+	// Build the return frame (SS, RSP, RFLAGS, CS, RIP) followed by the
+	// syscall number which is stored in the Info field of gate.Registers.
+	PUSHQ $USER_DS
+	PUSHQ ·userStack(SB)
+	PUSHQ R11
+	PUSHQ $USER_CS
+	PUSHQ CX
+	PUSHQ AX
+
+	// Save GP regs. The push order MUST match the field layout in the
+	// gate.Registers struct.
+	PUSHQ R15
+	PUSHQ R14
+	PUSHQ R13
+	PUSHQ R12
+	PUSHQ R11
+	PUSHQ R10
+	PUSHQ R9
+	PUSHQ R8
+	PUSHQ BP
+	PUSHQ DI
+	PUSHQ SI
+	PUSHQ DX
+	PUSHQ CX
+	PUSHQ BX
+	PUSHQ AX
+
+	// Save the user-mode XMM regs as they may be clobbered by Go code
+	SUBQ $16*16, SP
+	MOVOU X0, 0*16(SP)
+	MOVOU X1, 1*16(SP)
+	MOVOU X2, 2*16(SP)
+	MOVOU X3, 3*16(SP)
+	MOVOU X4, 4*16(SP)
+	MOVOU X5, 5*16(SP)
+	MOVOU X6, 6*16(SP)
+	MOVOU X7, 7*16(SP)
+	MOVOU X8, 8*16(SP)
+	MOVOU X9, 9*16(SP)
+	MOVOU X10, 10*16(SP)
+	MOVOU X11, 11*16(SP)
+	MOVOU X12, 12*16(SP)
+	MOVOU X13, 13*16(SP)
+	MOVOU X14, 14*16(SP)
+	MOVOU X15, 15*16(SP)
+
+	// Switch to the kernel FS base as Go code looks up the current g at
+	// FS:-8.
+	MOVQ ·fsBaseSlots(SB), AX
+	MOVQ 0(AX), AX
+	LOAD_FS_BASE
+
+	MOVQ SP, R14
+	ADDQ $16*16, R14
+	PUSHQ R14
+	CALL ·handleSyscall(SB)
+	ADDQ $8, SP
+
+	// Interrupts must remain disabled until SYSRET completes as the stack
+	// pointer is switched back to the user-mode stack before returning.
+	CLI
+
+	MOVQ ·fsBaseSlots(SB), AX
+	MOVQ 8(AX), AX
+	LOAD_FS_BASE
+
+	MOVOU 0*16(SP), X0
+	MOVOU 1*16(SP), X1
+	MOVOU 2*16(SP), X2
+	MOVOU 3*16(SP), X3
+	MOVOU 4*16(SP), X4
+	MOVOU 5*16(SP), X5
+	MOVOU 6*16(SP), X6
+	MOVOU 7*16(SP), X7
+	MOVOU 8*16(SP), X8
+	MOVOU 9*16(SP), X9
+	MOVOU 10*16(SP), X10
+	MOVOU 11*16(SP), X11
+	MOVOU 12*16(SP), X12
+	MOVOU 13*16(SP), X13
+	MOVOU 14*16(SP), X14
+	MOVOU 15*16(SP), X15
+	ADDQ $16*16, SP
+
+	POPQ AX
+	POPQ BX
+	POPQ CX
+	POPQ DX
+	POPQ SI
+	POPQ DI
+	POPQ BP
+	POPQ R8
+	POPQ R9
+	POPQ R10
+	POPQ R11
+	POPQ R12
+	POPQ R13
+	POPQ R14
+	POPQ R15
+
+	// Skip the syscall number. Contexts restored by rt_sigreturn may
+	// depend on the values of RCX and R11 which are clobbered by SYSRET so
+	// they are returned to via IRETQ.
+	ADDQ $8, SP
+	CMPB ·restoreAllRegs(SB), $0
+	JEQ sysret
+	MOVB $0, ·restoreAllRegs(SB)
+	IRETQ
+
+sysret:
+	// Load the return address, RFLAGS and stack pointer from the
+	// (possibly modified) return frame.
+	MOVQ 0(SP), CX
+	MOVQ 16(SP), R11
+	MOVQ 24(SP), SP
+
+	// SYSRETQ; the Go assembler only supports the 32-bit variant
+	BYTE $0x48; BYTE $0x0f; BYTE $0x07
@@ -0,0 +1,125 @@
+package syscall
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/user"
+	"testing"
+)
+
+func restoreAmd64Mocks() {
+	readMSRFn = cpu.ReadMSR
+	writeMSRFn = cpu.WriteMSR
+	enableInterruptsFn = cpu.EnableInterrupts
+	kernelStackSlotFn = user.KernelStackSlot
+	syscallEntryAddrFn = syscallEntryAddr
+	setUserReturnHandlerFn = gate.SetUserReturnHandler
+	kernelStackSlot = 0
+	fsBaseSlots = 0
+	xmmStateFn = xmmState
+	restoreAllRegs = false
+}
+
+func TestInit(t *testing.T) {
+	defer restoreAmd64Mocks()
+
+	msrs := map[uint32]uint64{msrEFER: 0xd00}
+	readMSRFn = func(msr uint32) uint64 { return msrs[msr] }
+	writeMSRFn = func(msr uint32, value uint64) { msrs[msr] = value }
+	kernelStackSlotFn = func() uintptr { return 0xbadf00d }
+	syscallEntryAddrFn = func() uintptr { return 0xffff800000123456 }
+
+	var userReturnHandler func(*gate.Registers)
+	setUserReturnHandlerFn = func(handler func(*gate.Registers)) { userReturnHandler = handler }
+
+	Init()
+
+	specs := []struct {
+		msr uint32
+		exp uint64
+	}{
+		{msrEFER, 0xd00 | eferSCE},
+		{msrSTAR, 0x0010000800000000},
+		{msrLSTAR, 0xffff800000123456},
+		{msrFMASK, syscallFlagMask},
+	}
+
+	for specIndex, spec := range specs {
+		if got := msrs[spec.msr]; got != spec.exp {
+			t.Errorf("[spec %d] expected MSR 0x%x to be set to 0x%x; got 0x%x", specIndex, spec.msr, spec.exp, got)
+		}
+	}
+
+	if kernelStackSlot != 0xbadf00d {
+		t.Errorf("expected kernelStackSlot to be set to 0xbadf00d; got 0x%x", kernelStackSlot)
+	}
+
+	if exp := gate.FSBaseSlots(); fsBaseSlots != exp {
+		t.Errorf("expected fsBaseSlots to be set to 0x%x; got 0x%x", exp, fsBaseSlots)
+	}
+
+	if userReturnHandler == nil {
+		t.Error("expected Init to register a handler that delivers signals when returning to user mode")
+	}
+}
+
+func TestHandleSyscall(t *testing.T) {
+	defer func(orig [MaxSyscalls]Handler) { handlers = orig }(handlers)
+	defer restoreAmd64Mocks()
+	defer restoreMocks()
+
+	var (
+		intrEnabled bool
+		exited      bool
+	)
+	enableInterruptsFn = func() { intrEnabled = true }
+	exitFn = func(code int) { exited = code == killedExitCode }
+	handlers[100] = func(_ *Args) int64 {
+		if !intrEnabled {
+			t.Error("expected interrupts to be enabled while servicing the system call")
+		}
+		return 7
+	}
+
+	regs := &gate.Registers{Info: 100, RIP: 0x400000}
+	handleSyscall(regs)
+	if regs.RAX != 7 || exited {
+		t.Errorf("expected RAX to be 7 and thread not to exit; got RAX %d, exited %t", regs.RAX, exited)
+	}
+
+	regs = &gate.Registers{Info: 100, RIP: uint64(vmm.UserSpaceEnd)}
+	handleSyscall(regs)
+	if !exited {
+		t.Error("expected thread to exit when returning to a non-user address")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	defer func(orig [MaxSyscalls]Handler) { handlers = orig }(handlers)
+
+	var got Args
+	handlers[100] = func(args *Args) int64 {
+		got = *args
+		return 42
+	}
+
+	regs := &gate.Registers{Info: 100, RDI: 1, RSI: 2, RDX: 3, R10: 4, R8: 5, R9: 6, RCX: 7}
+	dispatch(regs)
+
+	if exp := (Args{1, 2, 3, 4, 5, 6}); got != exp {
+		t.Errorf("expected handler to receive args %v; got %v", exp, got)
+	}
+
+	if regs.RAX != 42 {
+		t.Errorf("expected RAX to contain the handler result; got %d", regs.RAX)
+	}
+
+	for specIndex, nr := range []uint64{101, MaxSyscalls, ^uint64(0)} {
+		regs = &gate.Registers{Info: nr}
+		dispatch(regs)
+		if exp := -int64(errnoNoSys); int64(regs.RAX) != exp {
+			t.Errorf("[spec %d] expected RAX to be %d; got %d", specIndex, exp, int64(regs.RAX))
+		}
+	}
+}
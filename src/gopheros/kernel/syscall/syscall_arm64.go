@@ -0,0 +1,25 @@
+package syscall
+
+import "gopheros/kernel/gate"
+
+// The arm64 port is a stub: its entry points allow the architecture-neutral
+// kernel packages to be type-checked for arm64 but panic when invoked.
+
+func unimplemented() {
+	panic("syscall: not implemented on arm64")
+}
+
+// Init installs the system call entrypoint.
+func Init() {
+	unimplemented()
+}
+
+// syscallArgs returns the system call arguments passed in X0-X5.
+func syscallArgs(regs *gate.Registers) Args {
+	return Args{regs.X[0], regs.X[1], regs.X[2], regs.X[3], regs.X[4], regs.X[5]}
+}
+
+// setSyscallResult stores the result of a system call into X0.
+func setSyscallResult(regs *gate.Registers, ret int64) {
+	regs.X[0] = uint64(ret)
+}
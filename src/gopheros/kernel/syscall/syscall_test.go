@@ -0,0 +1,29 @@
+package syscall
+
+import (
+	"gopheros/kernel"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	defer func(orig [MaxSyscalls]Handler) { handlers = orig }(handlers)
+
+	handler := func(_ *Args) int64 { return 0 }
+	specs := []struct {
+		nr      Number
+		handler Handler
+		expErr  *kernel.Error
+	}{
+		{100, handler, nil},
+		{100, handler, errHandlerRegistered},
+		{SysWrite, handler, errHandlerRegistered},
+		{101, nil, errInvalidSyscall},
+		{MaxSyscalls, handler, errInvalidSyscall},
+	}
+
+	for specIndex, spec := range specs {
+		if err := Register(spec.nr, spec.handler); err != spec.expErr {
+			t.Errorf("[spec %d] expected to get error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
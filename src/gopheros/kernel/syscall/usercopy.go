@@ -0,0 +1,110 @@
+package syscall
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/proc"
+	"unsafe"
+)
+
+var (
+	errBadAddress  = &kernel.Error{Module: "syscall", Message: "invalid user-space address", Code: kernel.CodeBadAddress}
+	errNameTooLong = &kernel.Error{Module: "syscall", Message: "string exceeds the maximum length", Code: kernel.CodeNameTooLong}
+
+	// The following functions are used by tests to mock calls to the vmm
+	// and proc packages.
+	userAccessibleFn = vmm.UserAccessible
+	copyUserFn       = vmm.CopyUser
+	faultInFn        = proc.FaultIn
+)
+
+// CheckUserRange returns an error unless the size bytes starting at addr
+// reside in user space and are mapped with user-mode access. If write is
+// true, the range must also be writable. Lazily populated pages of the calling
+// process that are not mapped yet are populated.
+//
+// The check prevents user-mode code from passing kernel addresses to system
+// calls. Pages that become inaccessible after the check are caught by the
+// fault fixups of the copy functions.
+func CheckUserRange(addr, size uintptr, write bool) *kernel.Error {
+	if size == 0 {
+		return nil
+	}
+
+	end := addr + size
+	if end < addr || end > vmm.UserSpaceEnd {
+		return errBadAddress
+	}
+
+	for page := addr &^ (mm.PageSize - 1); page < end; page += mm.PageSize {
+		if !userAccessibleFn(page, write) && !faultInFn(page, write) {
+			return errBadAddress
+		}
+	}
+
+	return nil
+}
+
+// CopyFromUser copies len(dst) bytes from the user-space address src to dst. It
+// returns an error instead of faulting if src is not a valid user address.
+func CopyFromUser(dst []byte, src uintptr) *kernel.Error {
+	if len(dst) == 0 {
+		return nil
+	}
+
+	if err := CheckUserRange(src, uintptr(len(dst)), false); err != nil {
+		return err
+	}
+
+	if copyUserFn(uintptr(unsafe.Pointer(&dst[0])), src, uintptr(len(dst))) != nil {
+		return errBadAddress
+	}
+	return nil
+}
+
+// CopyToUser copies src to the user-space address dst. It returns an error
+// instead of faulting if dst is not a valid writable user address.
+func CopyToUser(dst uintptr, src []byte) *kernel.Error {
+	if len(src) == 0 {
+		return nil
+	}
+
+	if err := CheckUserRange(dst, uintptr(len(src)), true); err != nil {
+		return err
+	}
+
+	if copyUserFn(dst, uintptr(unsafe.Pointer(&src[0])), uintptr(len(src))) != nil {
+		return errBadAddress
+	}
+	return nil
+}
+
+// CopyStringFromUser copies the NUL-terminated string at the user-space address
+// src. An error is returned if the string, excluding the terminator, is longer
+// than maxLen bytes. The string is copied page by page so that it may end
+// right before an unmapped page.
+func CopyStringFromUser(src uintptr, maxLen int) (string, *kernel.Error) {
+	var str []byte
+	for len(str) <= maxLen {
+		addr := src + uintptr(len(str))
+		n := int(mm.PageSize - addr&(mm.PageSize-1))
+		if rem := maxLen + 1 - len(str); n > rem {
+			n = rem
+		}
+
+		chunk := make([]byte, n)
+		if err := CopyFromUser(chunk, addr); err != nil {
+			return "", err
+		}
+
+		for i, b := range chunk {
+			if b == 0 {
+				return string(append(str, chunk[:i]...)), nil
+			}
+		}
+		str = append(str, chunk...)
+	}
+
+	return "", errNameTooLong
+}
@@ -0,0 +1,142 @@
+package syscall
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"testing"
+	"unsafe"
+)
+
+func TestCheckUserRange(t *testing.T) {
+	defer func() { userAccessibleFn = vmm.UserAccessible }()
+
+	var checked []uintptr
+	userAccessibleFn = func(addr uintptr, write bool) bool {
+		checked = append(checked, addr)
+		// Pages at 0x5000 are read-only and the page at 0x8000 is unmapped
+		return addr != 0x8000 && (!write || addr != 0x5000)
+	}
+
+	specs := []struct {
+		addr, size uintptr
+		write      bool
+		expErr     bool
+		expChecked int
+	}{
+		{0x4000, 0, false, false, 0},
+		{0x4ff0, 0x20, false, false, 2},
+		{0x4ff0, 0x20, true, true, 2},
+		{0x6000, 0x2001, false, true, 3},
+		{0x6000, 0x2000, false, false, 2},
+		{vmm.UserSpaceEnd - 0x10, 0x20, false, true, 0},
+		{^uintptr(0) - 0x10, 0x20, false, true, 0},
+	}
+
+	for specIndex, spec := range specs {
+		checked = checked[:0]
+		err := CheckUserRange(spec.addr, spec.size, spec.write)
+		if (err != nil) != spec.expErr {
+			t.Errorf("[spec %d] expected error: %t; got %v", specIndex, spec.expErr, err)
+		}
+
+		if len(checked) != spec.expChecked {
+			t.Errorf("[spec %d] expected %d pages to be checked; got %d", specIndex, spec.expChecked, len(checked))
+		}
+	}
+}
+
+// userBuf emulates a user-space buffer.
+var userBuf = make([]byte, 9)
+
+func TestCopyFromToUser(t *testing.T) {
+	defer func() {
+		userAccessibleFn = vmm.UserAccessible
+		copyUserFn = vmm.CopyUser
+	}()
+
+	var (
+		accessible = true
+		userAddr   = uintptr(unsafe.Pointer(&userBuf[0]))
+		copies     int
+	)
+	copy(userBuf, "user data")
+	userAccessibleFn = func(_ uintptr, _ bool) bool { return accessible }
+	copyUserFn = func(dst, src, size uintptr) *kernel.Error {
+		copies++
+		return vmm.CopyUser(dst, src, size)
+	}
+
+	dst := make([]byte, len(userBuf))
+	if err := CopyFromUser(dst, userAddr); err != nil || string(dst) != "user data" {
+		t.Fatalf("expected CopyFromUser to copy the user data; got %q, %v", dst, err)
+	}
+
+	if err := CopyToUser(userAddr, []byte("USER")); err != nil || string(userBuf) != "USER data" {
+		t.Fatalf("expected CopyToUser to overwrite the user data; got %q, %v", userBuf, err)
+	}
+
+	if copies != 2 {
+		t.Errorf("expected the user access routine to be invoked 2 times; got %d", copies)
+	}
+
+	// Empty copies always succeed
+	if CopyFromUser(nil, 0) != nil || CopyToUser(0, nil) != nil {
+		t.Error("expected empty copies to succeed")
+	}
+
+	accessible = false
+	if err := CopyFromUser(dst, userAddr); err != errBadAddress {
+		t.Errorf("expected to get errBadAddress; got %v", err)
+	}
+
+	if err := CopyToUser(userAddr, dst); err != errBadAddress {
+		t.Errorf("expected to get errBadAddress; got %v", err)
+	}
+
+	// Faults while copying are reported as errBadAddress
+	accessible = true
+	copyUserFn = func(_, _, _ uintptr) *kernel.Error {
+		return &kernel.Error{Module: "vmm", Message: "fault while accessing user memory"}
+	}
+	if err := CopyFromUser(dst, userAddr); err != errBadAddress {
+		t.Errorf("expected to get errBadAddress; got %v", err)
+	}
+
+	if err := CopyToUser(userAddr, dst); err != errBadAddress {
+		t.Errorf("expected to get errBadAddress; got %v", err)
+	}
+}
+
+// userPage emulates a user-space page followed by an unmapped page.
+var userPage = make([]byte, 2*mm.PageSize)
+
+func TestCopyStringFromUser(t *testing.T) {
+	defer func() { userAccessibleFn = vmm.UserAccessible }()
+
+	var (
+		pageAddr = (uintptr(unsafe.Pointer(&userPage[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+		page     = userPage[pageAddr-uintptr(unsafe.Pointer(&userPage[0])):]
+		strAddr  = pageAddr + mm.PageSize - 6
+	)
+	userAccessibleFn = func(addr uintptr, _ bool) bool { return addr == pageAddr }
+
+	// Strings that end right before an unmapped page are copied
+	copy(page[mm.PageSize-6:], "/init\x00")
+	if str, err := CopyStringFromUser(strAddr, 16); err != nil || str != "/init" {
+		t.Fatalf("expected to copy %q; got %q, %v", "/init", str, err)
+	}
+
+	if _, err := CopyStringFromUser(strAddr, 4); err != errNameTooLong {
+		t.Fatalf("expected to get errNameTooLong; got %v", err)
+	}
+	if str, err := CopyStringFromUser(strAddr, 5); err != nil || str != "/init" {
+		t.Fatalf("expected to copy %q; got %q, %v", "/init", str, err)
+	}
+
+	// Unterminated strings run into the unmapped page
+	page[mm.PageSize-1] = '!'
+	if _, err := CopyStringFromUser(strAddr, 16); err != errBadAddress {
+		t.Fatalf("expected to get errBadAddress; got %v", err)
+	}
+}
@@ -0,0 +1,433 @@
+package timer
+
+import (
+	"gopheros/device/apic"
+	"gopheros/device/hpet"
+	"gopheros/device/pit"
+	"gopheros/kernel"
+	"math/bits"
+	"sync/atomic"
+)
+
+// Clocksource describes a free-running counter from which the monotonic clock
+// is derived.
+type Clocksource interface {
+	// Name returns the unique name of the clocksource.
+	Name() string
+
+	// Rating describes the quality of the clocksource. Unless a specific
+	// clocksource is requested, the one with the highest rating is used.
+	// Ratings below 100 are only suitable as a last resort while ratings
+	// of 300 and above are reserved for ideal clocksources.
+	Rating() int
+
+	// Frequency returns the counter frequency in Hz.
+	Frequency() uint64
+
+	// Mask returns a mask with the implemented counter bits. The counter
+	// wraps to 0 after reaching the mask value.
+	Mask() uint64
+
+	// Read returns the current counter value. It may be invoked from
+	// interrupt context on any processor so it must not allocate memory.
+	Read() uint64
+}
+
+const (
+	// MaxAdjustPPB is the largest frequency adjustment, in parts per
+	// billion, accepted by AdjustFrequency.
+	MaxAdjustPPB = 500000
+
+	// Clocksource values are converted to nanoseconds by multiplying
+	// them with a multiplier scaled by 2^multShift.
+	multShift = 32
+
+	ratingInvariantTSC = 300
+	ratingTSC          = 150
+	ratingPIT          = 110
+	ratingLAPIC        = 100
+	ratingJiffies      = 1
+
+	// cpuidInvariantTSC is set in EDX of CPUID leaf 0x80000007 if the TSC
+	// runs at a constant rate regardless of P-, C- and T-state changes.
+	cpuidInvariantTSC = uint32(1 << 8)
+)
+
+var (
+	errInvalidClocksource   = &kernel.Error{Module: "timer", Message: "clocksource frequency must not be zero", Code: kernel.CodeInvalid}
+	errDuplicateClocksource = &kernel.Error{Module: "timer", Message: "a clocksource with the same name is already registered", Code: kernel.CodeExists}
+	errUnknownClocksource   = &kernel.Error{Module: "timer", Message: "unknown clocksource", Code: kernel.CodeNotFound}
+	errAdjustRange          = &kernel.Error{Module: "timer", Message: "frequency adjustment is out of range", Code: kernel.CodeOutOfRange}
+
+	// clocksources contains the registered clocksources.
+	clocksources []Clocksource
+
+	// preferredClocksource is the name of the clocksource that was
+	// requested via the clocksource boot option or SelectClocksource.
+	preferredClocksource string
+
+	// clockStates holds two copies of the clock state. Readers use the
+	// copy selected by the lowest bit of clockSeq so an update never
+	// blocks readers (even ones running in NMI context); see
+	// beginClockUpdate.
+	clockSeq    uint32
+	clockStates = [2]clockState{initialClockState, initialClockState}
+
+	// lastNow holds the latest value returned by Now. Now never returns a
+	// smaller value even if a clocksource briefly steps backwards.
+	lastNow uint64
+
+	// initialClockState derives the monotonic time from the tick count
+	// until Init registers the platform clocksources.
+	initialClockState = clockState{
+		src:      jiffiesClocksource{},
+		mask:     ^uint64(0),
+		mult:     uint64(TickDuration) << multShift,
+		baseMult: uint64(TickDuration) << multShift,
+	}
+)
+
+// clockState describes how the monotonic time is derived from a clocksource.
+type clockState struct {
+	src  Clocksource
+	mask uint64
+
+	// base is the monotonic time at which the clocksource counter had the
+	// value cycleLast. frac holds the fraction of a nanosecond that was
+	// not added to base, scaled by 2^multShift.
+	cycleLast uint64
+	base      Duration
+	frac      uint64
+
+	// mult converts clocksource cycles to nanoseconds (scaled by
+	// 2^multShift) and is derived from baseMult and the frequency
+	// adjustment adjPPB.
+	mult     uint64
+	baseMult uint64
+	adjPPB   int64
+}
+
+// delta returns the number of cycles elapsed since cycleLast when the
+// clocksource counter has the specified value. Deltas exceeding half the counter
+// range are treated as a counter that stepped backwards and yield 0.
+// Consequently, the clock state must be accumulated at least twice per counter
+// wrap-around period.
+func (c *clockState) delta(counter uint64) uint64 {
+	delta := (counter - c.cycleLast) & c.mask
+	if delta > c.mask>>1 {
+		return 0
+	}
+	return delta
+}
+
+// elapsed converts a cycle delta to the time elapsed since base along with the
+// remaining fraction of a nanosecond.
+func (c *clockState) elapsed(delta uint64) (Duration, uint64) {
+	hi, lo := bits.Mul64(delta, c.mult)
+	lo, carry := bits.Add64(lo, c.frac, 0)
+	hi += carry
+	return Duration(hi<<(64-multShift) | lo>>multShift), lo & (1<<multShift - 1)
+}
+
+// accumulate moves base forward to the current clocksource counter value. It
+// is invoked on each tick so that the counter cannot wrap between two updates.
+func (c *clockState) accumulate() {
+	delta := c.delta(c.src.Read())
+	elapsed, frac := c.elapsed(delta)
+	c.base += elapsed
+	c.frac = frac
+	c.cycleLast = (c.cycleLast + delta) & c.mask
+}
+
+// setClocksource switches to a different clocksource without affecting the
+// current monotonic time.
+func (c *clockState) setClocksource(src Clocksource) {
+	c.accumulate()
+	c.src = src
+	c.mask = src.Mask()
+	c.cycleLast = src.Read()
+	c.frac = 0
+	c.baseMult = (uint64(Second) << multShift) / src.Frequency()
+	c.setAdjustment(c.adjPPB)
+}
+
+// setAdjustment recalculates mult after applying a frequency adjustment of
+// the specified number of parts per billion to baseMult.
+func (c *clockState) setAdjustment(ppb int64) {
+	abs := uint64(ppb)
+	if ppb < 0 {
+		abs = uint64(-ppb)
+	}
+
+	hi, lo := bits.Mul64(c.baseMult, abs)
+	delta, _ := bits.Div64(hi, lo, uint64(Second))
+
+	c.adjPPB = ppb
+	if ppb < 0 {
+		c.mult = c.baseMult - delta
+	} else {
+		c.mult = c.baseMult + delta
+	}
+}
+
+// beginClockUpdate redirects readers to the second copy of the clock state and
+// returns the first copy for updating. Updates must be performed with
+// interrupts disabled on the boot processor and completed by a call to
+// endClockUpdate.
+func beginClockUpdate() *clockState {
+	atomic.AddUint32(&clockSeq, 1)
+	return &clockStates[0]
+}
+
+// endClockUpdate redirects readers to the updated copy of the clock state and
+// synchronizes the second copy.
+func endClockUpdate() {
+	atomic.AddUint32(&clockSeq, 1)
+	clockStates[1] = clockStates[0]
+}
+
+// Now returns the time elapsed since the timer subsystem was initialized. The
+// returned value never decreases.
+func Now() Duration {
+	var state clockState
+	for {
+		seq := atomic.LoadUint32(&clockSeq)
+		state = clockStates[seq&1]
+		if atomic.LoadUint32(&clockSeq) == seq {
+			break
+		}
+	}
+
+	elapsed, _ := state.elapsed(state.delta(state.src.Read()))
+	now := uint64(state.base + elapsed)
+	for {
+		last := atomic.LoadUint64(&lastNow)
+		if now <= last {
+			return Duration(last)
+		}
+		if atomic.CompareAndSwapUint64(&lastNow, last, now) {
+			return Duration(now)
+		}
+	}
+}
+
+// RegisterClocksource adds cs to the list of available clocksources. The
+// monotonic clock switches to cs if it was requested via the clocksource boot
+// option or, unless a different registered clocksource was requested, if it
+// has a higher rating than the active clocksource.
+func RegisterClocksource(cs Clocksource) *kernel.Error {
+	if cs.Frequency() == 0 {
+		return errInvalidClocksource
+	}
+
+	if lookupClocksource(cs.Name()) != nil {
+		return errDuplicateClocksource
+	}
+
+	clocksources = append(clocksources, cs)
+	switchClocksource(bestClocksource())
+	return nil
+}
+
+// SelectClocksource switches the monotonic clock to the registered clocksource
+// with the specified name. The monotonic time is not affected by the switch.
+func SelectClocksource(name string) *kernel.Error {
+	cs := lookupClocksource(name)
+	if cs == nil {
+		return errUnknownClocksource
+	}
+
+	preferredClocksource = name
+	switchClocksource(cs)
+	return nil
+}
+
+// ActiveClocksource returns the clocksource that the monotonic clock is derived
+// from.
+func ActiveClocksource() Clocksource {
+	return clockStates[atomic.LoadUint32(&clockSeq)&1].src
+}
+
+// VisitClocksources invokes visitor for each registered clocksource in
+// registration order along with a flag indicating whether it is active.
+func VisitClocksources(visitor func(cs Clocksource, active bool)) {
+	active := ActiveClocksource()
+	for _, cs := range clocksources {
+		visitor(cs, cs == active)
+	}
+}
+
+// AdjustFrequency speeds up (positive ppb) or slows down (negative ppb) the
+// monotonic clock by the specified number of parts per billion to compensate
+// for the frequency drift of the clocksource. The adjustment replaces any
+// previous adjustment and remains in effect when switching clocksources.
+func AdjustFrequency(ppb int64) *kernel.Error {
+	if ppb < -MaxAdjustPPB || ppb > MaxAdjustPPB {
+		return errAdjustRange
+	}
+
+	intr := lock()
+	c := beginClockUpdate()
+	c.accumulate()
+	c.setAdjustment(ppb)
+	endClockUpdate()
+	unlock(intr)
+	return nil
+}
+
+// FrequencyAdjustment returns the frequency adjustment, in parts per billion,
+// applied to the monotonic clock.
+func FrequencyAdjustment() int64 {
+	return clockStates[atomic.LoadUint32(&clockSeq)&1].adjPPB
+}
+
+// accumulateClock is invoked on each tick with interrupts disabled.
+func accumulateClock() {
+	beginClockUpdate().accumulate()
+	endClockUpdate()
+}
+
+// switchClocksource makes cs the active clocksource.
+func switchClocksource(cs Clocksource) {
+	if cs == ActiveClocksource() {
+		return
+	}
+
+	intr := lock()
+	beginClockUpdate().setClocksource(cs)
+	endClockUpdate()
+	unlock(intr)
+}
+
+// bestClocksource returns the preferred clocksource if it is registered or the
+// registered clocksource with the highest rating otherwise.
+func bestClocksource() Clocksource {
+	if cs := lookupClocksource(preferredClocksource); cs != nil {
+		return cs
+	}
+
+	best := ActiveClocksource()
+	for _, cs := range clocksources {
+		if cs.Rating() > best.Rating() {
+			best = cs
+		}
+	}
+	return best
+}
+
+// lookupClocksource returns the registered clocksource with the specified name
+// or nil if no such clocksource exists.
+func lookupClocksource(name string) Clocksource {
+	for _, cs := range clocksources {
+		if cs.Name() == name {
+			return cs
+		}
+	}
+	return nil
+}
+
+// platformClocksources returns the clocksources that are available on this
+// system. The tick source provides the TSC frequency and, if its counter can
+// be read, a clocksource that interpolates the time between ticks.
+func platformClocksources(src tickSource) []Clocksource {
+	list := []Clocksource{jiffiesClocksource{}}
+
+	if freq := src.TSCFrequency(); freq != 0 {
+		rating := ratingTSC
+		if maxLeaf, _, _, _ := cpuidFn(0x80000000); maxLeaf >= 0x80000007 {
+			if _, _, _, edx := cpuidFn(0x80000007); edx&cpuidInvariantTSC != 0 {
+				rating = ratingInvariantTSC
+			}
+		}
+		list = append(list, &tscClocksource{freq: freq, rating: rating})
+	}
+
+	if h := activeHPETFn(); h != nil {
+		list = append(list, h)
+	}
+
+	switch s := src.(type) {
+	case *apic.LocalAPIC:
+		if s.TimerMode() == apic.TimerModePeriodic {
+			list = append(list, &periodicClocksource{
+				name:   "lapic",
+				rating: ratingLAPIC,
+				freq:   s.TimerFrequency(),
+				period: uint64(s.TimerInitialCount()),
+				count:  func() uint64 { return uint64(s.TimerCount()) },
+			})
+		}
+	case *pit.PIT:
+		if divisor := s.PeriodicDivisor(); divisor != 0 {
+			list = append(list, &periodicClocksource{
+				name:   "pit",
+				rating: ratingPIT,
+				freq:   uint64(pit.Frequency),
+				period: uint64(divisor),
+				count:  func() uint64 { return uint64(s.Counter()) },
+			})
+		}
+	}
+
+	return list
+}
+
+func activeHPET() Clocksource {
+	if h := hpet.Active(); h != nil {
+		return h
+	}
+	return nil
+}
+
+// jiffiesClocksource derives the time from the tick count. It is used until a
+// better clocksource is registered.
+type jiffiesClocksource struct{}
+
+func (jiffiesClocksource) Name() string      { return "jiffies" }
+func (jiffiesClocksource) Rating() int       { return ratingJiffies }
+func (jiffiesClocksource) Frequency() uint64 { return Hz }
+func (jiffiesClocksource) Mask() uint64      { return ^uint64(0) }
+func (jiffiesClocksource) Read() uint64      { return atomic.LoadUint64(&ticks) }
+
+// tscClocksource reads the time-stamp counter. Its rating depends on whether
+// the TSC rate is invariant.
+type tscClocksource struct {
+	freq   uint64
+	rating int
+}
+
+func (*tscClocksource) Name() string         { return "tsc" }
+func (cs *tscClocksource) Rating() int       { return cs.rating }
+func (cs *tscClocksource) Frequency() uint64 { return cs.freq }
+func (*tscClocksource) Mask() uint64         { return ^uint64(0) }
+func (*tscClocksource) Read() uint64         { return readTSCFn() }
+
+// periodicClocksource interpolates the time between ticks using the
+// down-counter of the tick source. As the counter and the tick count cannot be
+// read atomically, reads that race with a tick may briefly step backwards; Now
+// hides such glitches.
+type periodicClocksource struct {
+	name   string
+	rating int
+	freq   uint64
+
+	// period is the value that the counter counts down from.
+	period uint64
+	count  func() uint64
+}
+
+func (cs *periodicClocksource) Name() string      { return cs.name }
+func (cs *periodicClocksource) Rating() int       { return cs.rating }
+func (cs *periodicClocksource) Frequency() uint64 { return cs.freq }
+func (cs *periodicClocksource) Mask() uint64      { return ^uint64(0) }
+
+func (cs *periodicClocksource) Read() uint64 {
+	var (
+		elapsed = atomic.LoadUint64(&ticks) * cs.period
+		count   = cs.count()
+	)
+	if count < cs.period {
+		elapsed += cs.period - count
+	}
+	return elapsed
+}
@@ -0,0 +1,301 @@
+package timer
+
+import (
+	"gopheros/kernel"
+	"testing"
+)
+
+type mockClocksource struct {
+	name    string
+	rating  int
+	freq    uint64
+	mask    uint64
+	counter uint64
+}
+
+func (m *mockClocksource) Name() string      { return m.name }
+func (m *mockClocksource) Rating() int       { return m.rating }
+func (m *mockClocksource) Frequency() uint64 { return m.freq }
+func (m *mockClocksource) Read() uint64      { return m.counter & m.Mask() }
+
+func (m *mockClocksource) Mask() uint64 {
+	if m.mask == 0 {
+		return ^uint64(0)
+	}
+	return m.mask
+}
+
+func TestRegisterClocksource(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	if got := ActiveClocksource().Name(); got != "jiffies" {
+		t.Fatalf("expected jiffies to be the initial clocksource; got %q", got)
+	}
+
+	if err := RegisterClocksource(&mockClocksource{name: "bad"}); err != errInvalidClocksource {
+		t.Fatalf("expected errInvalidClocksource; got %v", err)
+	}
+
+	specs := []struct {
+		cs        *mockClocksource
+		expErr    *kernel.Error
+		expActive string
+	}{
+		{&mockClocksource{name: "slow", rating: 100, freq: 1000}, nil, "slow"},
+		{&mockClocksource{name: "fast", rating: 300, freq: 1000}, nil, "fast"},
+		{&mockClocksource{name: "worse", rating: 200, freq: 1000}, nil, "fast"},
+		{&mockClocksource{name: "slow", rating: 400, freq: 1000}, errDuplicateClocksource, "fast"},
+	}
+
+	for specIndex, spec := range specs {
+		if err := RegisterClocksource(spec.cs); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+
+		if got := ActiveClocksource().Name(); got != spec.expActive {
+			t.Errorf("[spec %d] expected active clocksource to be %q; got %q", specIndex, spec.expActive, got)
+		}
+	}
+
+	var visited []string
+	VisitClocksources(func(cs Clocksource, active bool) {
+		if active != (cs.Name() == "fast") {
+			t.Errorf("unexpected active flag %t for clocksource %q", active, cs.Name())
+		}
+		visited = append(visited, cs.Name())
+	})
+
+	if len(visited) != 3 || visited[0] != "slow" || visited[1] != "fast" || visited[2] != "worse" {
+		t.Errorf("expected VisitClocksources to visit clocksources in registration order; got %v", visited)
+	}
+}
+
+func TestPreferredClocksource(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	// A clocksource requested via the boot option is used even if a
+	// clocksource with a higher rating is registered.
+	preferredClocksource = "slow"
+	RegisterClocksource(&mockClocksource{name: "slow", rating: 100, freq: 1000})
+	RegisterClocksource(&mockClocksource{name: "fast", rating: 300, freq: 1000})
+	if got := ActiveClocksource().Name(); got != "slow" {
+		t.Fatalf("expected the preferred clocksource to be active; got %q", got)
+	}
+
+	if err := SelectClocksource("missing"); err != errUnknownClocksource {
+		t.Fatalf("expected errUnknownClocksource; got %v", err)
+	}
+
+	if err := SelectClocksource("fast"); err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterClocksource(&mockClocksource{name: "faster", rating: 400, freq: 1000})
+	if got := ActiveClocksource().Name(); got != "fast" {
+		t.Errorf("expected the selected clocksource to remain active; got %q", got)
+	}
+}
+
+func TestSwitchClocksource(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	a := &mockClocksource{name: "a", rating: 100, freq: 1000000, counter: 500}
+	b := &mockClocksource{name: "b", rating: 50, freq: 4000000000, counter: 1 << 40}
+	RegisterClocksource(a)
+	RegisterClocksource(b)
+
+	a.counter += 2500
+	if exp, got := 2500*Microsecond, Now(); got != exp {
+		t.Fatalf("expected Now to return %d; got %d", exp, got)
+	}
+
+	if err := SelectClocksource("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Switching must not affect the monotonic time
+	if exp, got := 2500*Microsecond, Now(); got != exp {
+		t.Fatalf("expected Now to return %d after switching; got %d", exp, got)
+	}
+
+	b.counter += 4000
+	if exp, got := 2501*Microsecond, Now(); got != exp {
+		t.Errorf("expected Now to return %d; got %d", exp, got)
+	}
+}
+
+func TestClocksourceWrap(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	cs := &mockClocksource{name: "narrow", rating: 100, freq: 1000, mask: 0xffff, counter: 0xff00}
+	RegisterClocksource(cs)
+
+	// Ticks accumulate the elapsed time so the counter may wrap between
+	// them.
+	for i := 0; i < 8; i++ {
+		cs.counter += 0x4000
+		tick(nil)
+	}
+
+	cs.counter += 0x10
+	if exp, got := Duration(8*0x4000+0x10)*Millisecond, Now(); got != exp {
+		t.Errorf("expected Now to return %d; got %d", exp, got)
+	}
+}
+
+func TestNowMonotonic(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	cs := &mockClocksource{name: "jittery", rating: 100, freq: 1000, mask: 0xffff}
+	RegisterClocksource(cs)
+
+	// A counter that briefly steps backwards (e.g. an interpolating
+	// clocksource racing with a tick) must neither cause Now to decrease
+	// nor introduce a permanent offset.
+	specs := []struct {
+		counter uint64
+		tick    bool
+		expNow  Duration
+	}{
+		{10, false, 10 * Millisecond},
+		{9, true, 10 * Millisecond},
+		{12, false, 12 * Millisecond},
+		{8, true, 12 * Millisecond},
+		{13, false, 13 * Millisecond},
+	}
+
+	for specIndex, spec := range specs {
+		cs.counter = spec.counter
+		if spec.tick {
+			tick(nil)
+		}
+
+		if got := Now(); got != spec.expNow {
+			t.Errorf("[spec %d] expected Now to return %d; got %d", specIndex, spec.expNow, got)
+		}
+	}
+}
+
+func TestAdjustFrequency(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	for _, ppb := range []int64{MaxAdjustPPB + 1, -MaxAdjustPPB - 1} {
+		if err := AdjustFrequency(ppb); err != errAdjustRange {
+			t.Fatalf("expected errAdjustRange for %d ppb; got %v", ppb, err)
+		}
+	}
+
+	cs := &mockClocksource{name: "osc", rating: 100, freq: 1000000000}
+	RegisterClocksource(cs)
+
+	specs := []struct {
+		ppb     int64
+		elapsed uint64
+		expNow  Duration
+	}{
+		{0, 1000000000, Second},
+		{100000, 1000000000, 2*Second + 100*Microsecond},
+		{-250000, 2000000000, 4*Second + 100*Microsecond - 500*Microsecond},
+		{0, 1000, 4*Second - 400*Microsecond + Microsecond},
+	}
+
+	for specIndex, spec := range specs {
+		if err := AdjustFrequency(spec.ppb); err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+
+		if got := FrequencyAdjustment(); got != spec.ppb {
+			t.Errorf("[spec %d] expected frequency adjustment to be %d; got %d", specIndex, spec.ppb, got)
+		}
+
+		// Allow for the rounding error of the adjusted multiplier
+		cs.counter += spec.elapsed
+		if got := Now(); got < spec.expNow-2 || got > spec.expNow+2 {
+			t.Errorf("[spec %d] expected Now to return %d; got %d", specIndex, spec.expNow, got)
+		}
+	}
+
+	// The adjustment is preserved when switching clocksources
+	AdjustFrequency(-1000)
+	RegisterClocksource(&mockClocksource{name: "better", rating: 200, freq: 1000})
+	if got := FrequencyAdjustment(); got != -1000 {
+		t.Errorf("expected frequency adjustment to be preserved; got %d", got)
+	}
+}
+
+func TestPlatformClocksources(t *testing.T) {
+	defer restoreMocks()
+
+	hpet := &mockClocksource{name: "hpet", rating: 250, freq: 100000000}
+	activeHPETFn = func() Clocksource { return hpet }
+
+	specs := []struct {
+		tscFreq   uint64
+		cpuid     [2]uint32
+		expNames  []string
+		expRating int
+	}{
+		{0, [2]uint32{0x80000008, cpuidInvariantTSC}, []string{"jiffies", "hpet"}, 0},
+		{2000000000, [2]uint32{0x80000008, cpuidInvariantTSC}, []string{"jiffies", "tsc", "hpet"}, ratingInvariantTSC},
+		{2000000000, [2]uint32{0x80000008, 0}, []string{"jiffies", "tsc", "hpet"}, ratingTSC},
+		// CPUID leaf 0x80000007 is not supported
+		{2000000000, [2]uint32{0x80000004, cpuidInvariantTSC}, []string{"jiffies", "tsc", "hpet"}, ratingTSC},
+	}
+
+	for specIndex, spec := range specs {
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			if leaf == 0x80000000 {
+				return spec.cpuid[0], 0, 0, 0
+			}
+			return 0, 0, 0, spec.cpuid[1]
+		}
+
+		list := platformClocksources(&mockTickSource{tscFreq: spec.tscFreq})
+		if len(list) != len(spec.expNames) {
+			t.Errorf("[spec %d] expected %d clocksources; got %d", specIndex, len(spec.expNames), len(list))
+			continue
+		}
+
+		for i, cs := range list {
+			if cs.Name() != spec.expNames[i] {
+				t.Errorf("[spec %d] expected clocksource %d to be %q; got %q", specIndex, i, spec.expNames[i], cs.Name())
+			}
+
+			if cs.Name() == "tsc" && cs.Rating() != spec.expRating {
+				t.Errorf("[spec %d] expected TSC rating to be %d; got %d", specIndex, spec.expRating, cs.Rating())
+			}
+		}
+	}
+}
+
+func TestPeriodicClocksource(t *testing.T) {
+	defer restoreMocks()
+
+	count := uint64(1000)
+	cs := &periodicClocksource{name: "pit", period: 1000, count: func() uint64 { return count }}
+
+	specs := []struct {
+		ticks uint64
+		count uint64
+		exp   uint64
+	}{
+		{0, 1000, 0},
+		{0, 250, 750},
+		{3, 1, 3999},
+		// The counter may briefly read past the period while reloading
+		{5, 1001, 5000},
+	}
+
+	for specIndex, spec := range specs {
+		ticks, count = spec.ticks, spec.count
+		if got := cs.Read(); got != spec.exp {
+			t.Errorf("[spec %d] expected Read to return %d; got %d", specIndex, spec.exp, got)
+		}
+	}
+}
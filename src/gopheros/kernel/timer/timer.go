@@ -0,0 +1,329 @@
+// Package timer provides a monotonic clock and a facility for scheduling
+// callbacks after a delay or at a fixed interval.
+//
+// Timers are driven by a periodic tick and are managed by a hierarchical timer
+// wheel so that arming and stopping a timer is a constant-time operation
+// regardless of the number of pending timers. Timer callbacks are invoked from
+// interrupt context with interrupts disabled; they must not block and should
+// defer any lengthy work to a kernel thread.
+package timer
+
+import (
+	"gopheros/device/apic"
+	"gopheros/device/pit"
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/trace"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Duration represents the elapsed time between two instants as a nanosecond
+// count.
+type Duration int64
+
+// Common durations.
+const (
+	Nanosecond  Duration = 1
+	Microsecond          = 1000 * Nanosecond
+	Millisecond          = 1000 * Microsecond
+	Second               = 1000 * Millisecond
+)
+
+const (
+	// Hz is the frequency of the timer tick.
+	Hz = 1000
+
+	// TickDuration is the resolution of the timers managed by this package.
+	TickDuration = Second / Hz
+)
+
+var (
+	errNoTickSource = &kernel.Error{Module: "timer", Message: "no tick source available", Code: kernel.CodeNoDevice}
+
+	// ticks counts the timer ticks since Init was invoked.
+	ticks uint64
+
+	timers wheel
+
+	// wallBase holds the wall-clock time, in nanoseconds since the Unix
+	// epoch, that corresponds to the monotonic time wallMono. A zero
+	// wallBase indicates that the wall clock has not been set.
+	wallBase int64
+	wallMono Duration
+
+	// tickHooks are invoked with the interrupted register state on each
+	// timer tick.
+	tickHooks []func(*gate.Registers)
+
+	// The following functions are used by tests to mock calls to the cpu,
+	// apic, hpet, cmdline and sched packages.
+	interruptsEnabledFn    = cpu.InterruptsEnabled
+	enableInterruptsFn     = cpu.EnableInterrupts
+	disableInterruptsFn    = cpu.DisableInterrupts
+	readTSCFn              = cpu.ReadTSC
+	cpuidFn                = cpu.ID
+	activeTickSourceFn     = activeTickSource
+	activeHPETFn           = activeHPET
+	platformClocksourcesFn = platformClocksources
+	cmdlineGetFn           = cmdline.Get
+	currentThreadFn        = sched.Current
+	readyFn                = sched.Ready
+	blockFn                = sched.Block
+	signalPendingFn        = sched.SignalPending
+)
+
+// tickSource describes a device that can generate a periodic interrupt.
+type tickSource interface {
+	SetTimerHandler(irq.Handler) *kernel.Error
+	StartPeriodicTimer(hz uint32) *kernel.Error
+	TSCFrequency() uint64
+}
+
+// Timer describes a callback that is invoked when a point in time is reached.
+type Timer struct {
+	fn      func()
+	expires uint64
+	period  uint64
+
+	// argFn is invoked with arg instead of fn for timers armed via Start.
+	argFn func(unsafe.Pointer)
+	arg   unsafe.Pointer
+
+	// list points to the wheel slot that the timer is linked to or nil if
+	// the timer is not armed.
+	list       *timerList
+	prev, next *Timer
+}
+
+// Stop disarms the timer and returns true if the timer was armed. Stopping a
+// periodic timer from its own callback prevents any further invocations.
+func (t *Timer) Stop() bool {
+	intr := lock()
+	armed := t.list != nil
+	if armed {
+		t.list.remove(t)
+	}
+	t.period = 0
+	unlock(intr)
+	return armed
+}
+
+// After arranges for fn to be invoked once the specified duration elapses.
+func After(d Duration, fn func()) *Timer {
+	t := &Timer{fn: fn}
+	arm(t, durationToTicks(d))
+	return t
+}
+
+// Start arms t so that fn is invoked with arg once the specified duration
+// elapses. Unlike After, Start does not allocate so callers that must not
+// allocate can embed the timer in their own state; the timer must be stopped
+// or have expired before its storage is reused. Start must not be invoked on an
+// armed timer.
+func (t *Timer) Start(d Duration, fn func(unsafe.Pointer), arg unsafe.Pointer) {
+	t.fn, t.argFn, t.arg, t.period = nil, fn, arg, 0
+	arm(t, durationToTicks(d))
+}
+
+// Every arranges for fn to be invoked repeatedly at the specified interval
+// until the returned timer is stopped.
+func Every(interval Duration, fn func()) *Timer {
+	t := &Timer{fn: fn, period: durationToTicks(interval)}
+	if t.period == 0 {
+		t.period = 1
+	}
+	arm(t, t.period)
+	return t
+}
+
+// Sleep blocks the calling kernel thread until at least the specified
+// duration elapses.
+func Sleep(d Duration) {
+	var (
+		thread = currentThreadFn()
+		done   bool
+	)
+
+	// Keep interrupts disabled until the thread blocks so that the timer
+	// cannot fire before the thread is marked as blocked.
+	intr := lock()
+	After(d, func() {
+		done = true
+		readyFn(thread)
+	})
+	for !done {
+		blockFn()
+	}
+	unlock(intr)
+}
+
+// SleepInterruptible behaves like Sleep but returns early if a signal is
+// pending for the calling thread. It returns the remaining sleep duration,
+// which is zero if the full duration elapsed.
+func SleepInterruptible(d Duration) Duration {
+	var (
+		thread = currentThreadFn()
+		done   bool
+		rem    Duration
+	)
+
+	intr := lock()
+	t := After(d, func() {
+		done = true
+		readyFn(thread)
+	})
+	for !done {
+		if signalPendingFn() {
+			t.Stop()
+			rem = Duration(t.expires-timers.now) * TickDuration
+			break
+		}
+		blockFn()
+	}
+	unlock(intr)
+	return rem
+}
+
+// SetWallClock sets the wall-clock time to the specified number of nanoseconds
+// since the Unix epoch. The wall clock advances with the monotonic clock until
+// it is set again.
+func SetWallClock(unixNano int64) {
+	intr := lock()
+	wallBase, wallMono = unixNano, Now()
+	unlock(intr)
+}
+
+// WallClock returns the current wall-clock time in nanoseconds since the Unix
+// epoch or 0 if the wall clock has not been set.
+func WallClock() int64 {
+	intr := lock()
+	base, mono := wallBase, wallMono
+	unlock(intr)
+
+	if base == 0 {
+		return 0
+	}
+	return base + int64(Now()-mono)
+}
+
+// Ticks returns the number of timer ticks since the timer subsystem was
+// initialized.
+func Ticks() uint64 {
+	return atomic.LoadUint64(&ticks)
+}
+
+// AddTickHook registers a function that is invoked from interrupt context on
+// each timer tick with the register state of the interrupted code. Hooks run
+// after the expired timer callbacks.
+func AddTickHook(fn func(*gate.Registers)) {
+	tickHooks = append(tickHooks, fn)
+}
+
+// Init installs the timer tick handler on the local APIC timer, or on the PIT if
+// no local APIC is available, and registers the available clocksources. The
+// monotonic clock is derived from the clocksource with the highest rating
+// unless a different one is requested via the clocksource boot option; it is
+// also used for timestamping trace events and accounting the CPU time of
+// threads.
+func Init() *kernel.Error {
+	src := activeTickSourceFn()
+	if src == nil {
+		return errNoTickSource
+	}
+
+	if err := src.SetTimerHandler(tick); err != nil {
+		return err
+	}
+
+	if err := src.StartPeriodicTimer(Hz); err != nil {
+		return err
+	}
+
+	preferredClocksource = cmdlineGetFn("clocksource")
+	for _, cs := range platformClocksourcesFn(src) {
+		if err := RegisterClocksource(cs); err != nil {
+			return err
+		}
+	}
+
+	trace.SetClock(func() uint64 { return uint64(Now()) })
+	sched.SetClock(func() uint64 { return uint64(Now()) })
+	irq.SetClock(func() uint64 { return uint64(Now()) })
+	return nil
+}
+
+// tick is invoked by the tick source interrupt handler. It advances the timer
+// wheel, invokes the callbacks for all expired timers and then runs the
+// registered tick hooks.
+func tick(regs *gate.Registers) bool {
+	atomic.AddUint64(&ticks, 1)
+	accumulateClock()
+
+	for t := timers.advance(); t != nil; {
+		next := t.next
+		t.next = nil
+
+		if t.period != 0 {
+			t.expires += t.period
+			timers.add(t)
+		}
+
+		if t.argFn != nil {
+			t.argFn(t.arg)
+		} else {
+			t.fn()
+		}
+		t = next
+	}
+
+	for _, hook := range tickHooks {
+		hook(regs)
+	}
+
+	return true
+}
+
+// arm adds t to the timer wheel so that it expires after the specified number
+// of ticks. As the current tick is already partially elapsed, the timer fires
+// on the tick after that.
+func arm(t *Timer, delta uint64) {
+	intr := lock()
+	t.expires = timers.now + delta
+	timers.add(t)
+	unlock(intr)
+}
+
+// durationToTicks converts d to a tick count, rounding up.
+func durationToTicks(d Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	return uint64((d + TickDuration - 1) / TickDuration)
+}
+
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+	return intr
+}
+
+func unlock(intr bool) {
+	if intr {
+		enableInterruptsFn()
+	}
+}
+
+func activeTickSource() tickSource {
+	if lapic := apic.ActiveLocalAPIC(); lapic != nil {
+		return lapic
+	}
+	if drv := pit.Active(); drv != nil {
+		return drv
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+package timer
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/sched"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	readTSCFn = cpu.ReadTSC
+	cpuidFn = cpu.ID
+	activeTickSourceFn = activeTickSource
+	activeHPETFn = activeHPET
+	platformClocksourcesFn = platformClocksources
+	cmdlineGetFn = cmdline.Get
+	currentThreadFn = sched.Current
+	readyFn = sched.Ready
+	blockFn = sched.Block
+	signalPendingFn = sched.SignalPending
+	timers = wheel{}
+	tickHooks = nil
+	ticks = 0
+	clocksources = nil
+	preferredClocksource = ""
+	clockSeq = 0
+	clockStates = [2]clockState{initialClockState, initialClockState}
+	lastNow = 0
+	wallBase = 0
+	wallMono = 0
+}
+
+func mockInterrupts() *bool {
+	intrEnabled := new(bool)
+	interruptsEnabledFn = func() bool { return *intrEnabled }
+	enableInterruptsFn = func() { *intrEnabled = true }
+	disableInterruptsFn = func() { *intrEnabled = false }
+	return intrEnabled
+}
+
+type mockTickSource struct {
+	handler   irq.Handler
+	hz        uint32
+	tscFreq   uint64
+	handlerFn func(irq.Handler) *kernel.Error
+	startErr  *kernel.Error
+}
+
+func (m *mockTickSource) SetTimerHandler(handler irq.Handler) *kernel.Error {
+	if m.handlerFn != nil {
+		return m.handlerFn(handler)
+	}
+	m.handler = handler
+	return nil
+}
+
+func (m *mockTickSource) StartPeriodicTimer(hz uint32) *kernel.Error {
+	if m.startErr != nil {
+		return m.startErr
+	}
+	m.hz = hz
+	return nil
+}
+
+func (m *mockTickSource) TSCFrequency() uint64 { return m.tscFreq }
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	activeTickSourceFn = func() tickSource { return nil }
+	if err := Init(); err != errNoTickSource {
+		t.Fatalf("expected to get errNoTickSource; got %v", err)
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "vector in use"}
+	src := &mockTickSource{handlerFn: func(_ irq.Handler) *kernel.Error { return expErr }}
+	activeTickSourceFn = func() tickSource { return src }
+	if err := Init(); err != expErr {
+		t.Fatalf("expected to get error %v; got %v", expErr, err)
+	}
+
+	src = &mockTickSource{startErr: expErr}
+	if err := Init(); err != expErr {
+		t.Fatalf("expected to get error %v; got %v", expErr, err)
+	}
+
+	mockInterrupts()
+	src = &mockTickSource{tscFreq: 2000000000}
+	readTSCFn = func() uint64 { return 1000 }
+	cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) { return 0, 0, 0, 0 }
+	activeHPETFn = func() Clocksource { return nil }
+	cmdlineGetFn = func(_ string) string { return "" }
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if src.handler == nil || src.hz != Hz {
+		t.Fatalf("expected tick handler to be installed and timer to run at %d Hz; got %d", Hz, src.hz)
+	}
+
+	if cs := ActiveClocksource(); cs.Name() != "tsc" || cs.Frequency() != src.tscFreq || cs.Rating() != ratingTSC {
+		t.Errorf("expected the TSC to be selected as the clocksource; got %q", cs.Name())
+	}
+
+	platformClocksourcesFn = func(_ tickSource) []Clocksource { return []Clocksource{&mockClocksource{name: "bad"}} }
+	if err := Init(); err != errInvalidClocksource {
+		t.Errorf("expected to get errInvalidClocksource; got %v", err)
+	}
+}
+
+func TestNow(t *testing.T) {
+	defer restoreMocks()
+
+	// Without a calibrated TSC, Now is derived from the tick count
+	ticks = 1500
+	if exp, got := 1500*Millisecond, Now(); got != exp {
+		t.Errorf("expected Now to return %d; got %d", exp, got)
+	}
+
+	if got := Ticks(); got != 1500 {
+		t.Errorf("expected Ticks to return 1500; got %d", got)
+	}
+
+	// Switching to the TSC keeps the monotonic time continuous
+	mockInterrupts()
+	tsc := uint64(1000)
+	readTSCFn = func() uint64 { return tsc }
+	if err := RegisterClocksource(&tscClocksource{freq: 2000000000, rating: ratingInvariantTSC}); err != nil {
+		t.Fatal(err)
+	}
+
+	tsc += 7*2000000000 + 1000000
+	if exp, got := 1500*Millisecond+7*Second+500*Microsecond, Now(); got != exp {
+		t.Errorf("expected Now to return %d; got %d", exp, got)
+	}
+}
+
+func TestWallClock(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	if got := WallClock(); got != 0 {
+		t.Fatalf("expected WallClock to return 0 before the wall clock is set; got %d", got)
+	}
+
+	ticks = 2000
+	SetWallClock(1500000000 * int64(Second))
+
+	ticks = 4500
+	if exp, got := 1500000000*int64(Second)+int64(2500*Millisecond), WallClock(); got != exp {
+		t.Errorf("expected WallClock to return %d; got %d", exp, got)
+	}
+}
+
+func TestAfterAndEvery(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var (
+		afterCalls []uint64
+		everyCalls []uint64
+	)
+
+	After(3*Millisecond, func() { afterCalls = append(afterCalls, Ticks()) })
+	periodic := Every(2*Millisecond, func() { everyCalls = append(everyCalls, Ticks()) })
+
+	// Zero-length timers fire on the next tick
+	var zeroFired bool
+	After(0, func() { zeroFired = true })
+
+	for i := 0; i < 7; i++ {
+		if !tick(nil) {
+			t.Fatal("expected tick handler to return true")
+		}
+	}
+
+	if !zeroFired {
+		t.Error("expected zero-length timer to fire")
+	}
+
+	// The timers fire on the tick after their expiration as the current
+	// tick is partially elapsed when they are armed.
+	if len(afterCalls) != 1 || afterCalls[0] != 4 {
+		t.Errorf("expected one-shot timer to fire once at tick 4; got %v", afterCalls)
+	}
+
+	if exp := []uint64{3, 5, 7}; len(everyCalls) != len(exp) || everyCalls[0] != exp[0] || everyCalls[1] != exp[1] || everyCalls[2] != exp[2] {
+		t.Errorf("expected periodic timer to fire at ticks %v; got %v", exp, everyCalls)
+	}
+
+	if !periodic.Stop() {
+		t.Error("expected Stop to return true for an armed periodic timer")
+	}
+
+	for i := 0; i < 4; i++ {
+		tick(nil)
+	}
+
+	if len(everyCalls) != 3 {
+		t.Errorf("expected stopped timer not to fire; got %v", everyCalls)
+	}
+
+	if periodic.Stop() {
+		t.Error("expected Stop to return false for a stopped timer")
+	}
+}
+
+func TestStart(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var (
+		tm    Timer
+		calls []uint64
+		arg   = 42
+	)
+	fn := func(p unsafe.Pointer) {
+		if *(*int)(p) != 42 {
+			t.Errorf("expected callback to receive the argument passed to Start")
+		}
+		calls = append(calls, Ticks())
+	}
+
+	tm.Start(2*Millisecond, fn, unsafe.Pointer(&arg))
+	for i := 0; i < 4; i++ {
+		tick(nil)
+	}
+
+	if len(calls) != 1 || calls[0] != 3 {
+		t.Fatalf("expected timer to fire once at tick 3; got %v", calls)
+	}
+
+	// The timer can be re-armed once it has expired or has been stopped
+	tm.Start(Millisecond, fn, unsafe.Pointer(&arg))
+	if !tm.Stop() {
+		t.Fatal("expected Stop to return true for an armed timer")
+	}
+	tm.Start(Millisecond, fn, unsafe.Pointer(&arg))
+	tick(nil)
+	tick(nil)
+
+	if len(calls) != 2 {
+		t.Errorf("expected re-armed timer to fire once; got %v", calls)
+	}
+}
+
+func TestTickHooks(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var (
+		regs  gate.Registers
+		order []string
+	)
+
+	After(0, func() { order = append(order, "timer") })
+	AddTickHook(func(r *gate.Registers) {
+		if r != &regs {
+			t.Error("expected tick hook to receive the interrupted register state")
+		}
+		order = append(order, "hook1")
+	})
+	AddTickHook(func(_ *gate.Registers) { order = append(order, "hook2") })
+
+	tick(&regs)
+	if exp := []string{"timer", "hook1", "hook2"}; len(order) != len(exp) || order[0] != exp[0] || order[1] != exp[1] || order[2] != exp[2] {
+		t.Errorf("expected tick to invoke callbacks in order %v; got %v", exp, order)
+	}
+}
+
+func TestStopFromCallback(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var (
+		calls    int
+		periodic *Timer
+	)
+	periodic = Every(Millisecond, func() {
+		calls++
+		periodic.Stop()
+	})
+
+	for i := 0; i < 5; i++ {
+		tick(nil)
+	}
+
+	if calls != 1 {
+		t.Errorf("expected periodic timer to fire once; got %d", calls)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	defer restoreMocks()
+	intrEnabled := mockInterrupts()
+	*intrEnabled = true
+
+	var (
+		self    = &sched.Thread{}
+		blocked int
+		readied []*sched.Thread
+	)
+	currentThreadFn = func() *sched.Thread { return self }
+	readyFn = func(th *sched.Thread) { readied = append(readied, th) }
+
+	// Emulate timer interrupts arriving while the thread is blocked
+	blockFn = func() {
+		if *intrEnabled {
+			t.Error("expected interrupts to be disabled while blocking")
+		}
+		blocked++
+		tick(nil)
+	}
+
+	Sleep(5 * Millisecond)
+
+	if blocked != 6 {
+		t.Errorf("expected Sleep to block until the 6th tick; blocked %d times", blocked)
+	}
+
+	if len(readied) != 1 || readied[0] != self {
+		t.Error("expected the sleeping thread to be readied by the timer")
+	}
+
+	if !*intrEnabled {
+		t.Error("expected Sleep to restore the interrupt flag")
+	}
+}
+
+func TestSleepInterruptible(t *testing.T) {
+	defer restoreMocks()
+	intrEnabled := mockInterrupts()
+	*intrEnabled = true
+
+	var (
+		self    = &sched.Thread{}
+		blocked int
+		readied int
+		pending bool
+	)
+	currentThreadFn = func() *sched.Thread { return self }
+	readyFn = func(_ *sched.Thread) { readied++ }
+	signalPendingFn = func() bool { return pending }
+	blockFn = func() {
+		blocked++
+		tick(nil)
+	}
+
+	if rem := SleepInterruptible(2 * Millisecond); rem != 0 || blocked != 3 {
+		t.Fatalf("expected uninterrupted sleep to block 3 times and return 0; blocked %d times, got %d", blocked, rem)
+	}
+
+	// Post a signal after the second tick
+	blocked = 0
+	blockFn = func() {
+		blocked++
+		tick(nil)
+		pending = blocked == 2
+	}
+
+	if rem := SleepInterruptible(5 * Millisecond); rem != 3*Millisecond {
+		t.Errorf("expected interrupted sleep to return 3ms; got %d", rem)
+	}
+
+	if blocked != 2 {
+		t.Errorf("expected sleep to be interrupted after 2 ticks; blocked %d times", blocked)
+	}
+
+	for i := 0; i < 10; i++ {
+		tick(nil)
+	}
+	if readied != 1 {
+		t.Error("expected the sleep timer to be stopped")
+	}
+
+	if !*intrEnabled {
+		t.Error("expected SleepInterruptible to restore the interrupt flag")
+	}
+}
+
+func TestDurationToTicks(t *testing.T) {
+	specs := []struct {
+		d   Duration
+		exp uint64
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, 1},
+		{Millisecond, 1},
+		{Millisecond + 1, 2},
+		{Second, Hz},
+	}
+
+	for specIndex, spec := range specs {
+		if got := durationToTicks(spec.d); got != spec.exp {
+			t.Errorf("[spec %d] expected %d ticks; got %d", specIndex, spec.exp, got)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package timer
+
+const (
+	wheelLevels   = 4
+	wheelSlotBits = 6
+	wheelSlots    = 1 << wheelSlotBits
+	wheelSlotMask = wheelSlots - 1
+
+	// maxWheelDelta is the largest expiration delta (in ticks) that can be
+	// represented by the wheel. Timers expiring further in the future are
+	// placed at the end of the last level and re-inserted when that slot
+	// is cascaded.
+	maxWheelDelta = uint64(1)<<(wheelLevels*wheelSlotBits) - 1
+)
+
+// timerList is a doubly-linked list of timers sharing the same wheel slot.
+type timerList struct {
+	head *Timer
+}
+
+func (l *timerList) add(t *Timer) {
+	t.list = l
+	t.prev = nil
+	t.next = l.head
+	if l.head != nil {
+		l.head.prev = t
+	}
+	l.head = t
+}
+
+func (l *timerList) remove(t *Timer) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		l.head = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.list, t.prev, t.next = nil, nil, nil
+}
+
+// wheel implements a hierarchical timer wheel. Level 0 has a slot for each
+// of the next 64 ticks while each slot of level n covers 64^n ticks. Adding
+// and removing timers is O(1); when level 0 wraps around, the timers in the
+// next slot of the upper level are cascaded into the lower levels.
+type wheel struct {
+	// now is the next tick to be processed by advance.
+	now   uint64
+	slots [wheelLevels][wheelSlots]timerList
+}
+
+// add inserts t into the slot that corresponds to its expiration tick.
+func (w *wheel) add(t *Timer) {
+	var delta uint64
+	if t.expires > w.now {
+		delta = t.expires - w.now
+	}
+
+	expires := t.expires
+	if delta > maxWheelDelta {
+		delta = maxWheelDelta
+		expires = w.now + maxWheelDelta
+	} else if t.expires < w.now {
+		// Already expired timers are processed on the next tick
+		expires = w.now
+	}
+
+	level := 0
+	for ; level < wheelLevels-1 && delta >= uint64(1)<<(uint(level+1)*wheelSlotBits); level++ {
+	}
+
+	slot := (expires >> (uint(level) * wheelSlotBits)) & wheelSlotMask
+	w.slots[level][slot].add(t)
+}
+
+// cascade moves the timers from the specified slot to the lower levels.
+func (w *wheel) cascade(level int, slot uint64) {
+	list := &w.slots[level][slot]
+	for list.head != nil {
+		t := list.head
+		list.remove(t)
+		w.add(t)
+	}
+}
+
+// advance processes the current tick and returns the list of timers that
+// expired. The returned timers are detached from the wheel and linked via
+// their next field.
+func (w *wheel) advance() *Timer {
+	index := w.now & wheelSlotMask
+	if index == 0 {
+		for level := 1; level < wheelLevels; level++ {
+			slot := (w.now >> (uint(level) * wheelSlotBits)) & wheelSlotMask
+			w.cascade(level, slot)
+			if slot != 0 {
+				break
+			}
+		}
+	}
+
+	var expired *Timer
+	list := &w.slots[0][index]
+	for list.head != nil {
+		t := list.head
+		list.remove(t)
+		t.next = expired
+		expired = t
+	}
+
+	w.now++
+	return expired
+}
@@ -0,0 +1,92 @@
+package timer
+
+import "testing"
+
+func TestWheelExpiration(t *testing.T) {
+	specs := []struct {
+		now     uint64
+		expires uint64
+	}{
+		{0, 0},
+		{0, 1},
+		{0, 63},
+		{0, 64},
+		{10, 4095},
+		{10, 4096},
+		{100, 262200},
+		{4095, 4096},
+		{63, 64 * 64 * 64 * 3},
+		// expiration tick is in the past
+		{1000, 10},
+		// beyond the range of the wheel
+		{5, maxWheelDelta + 1000},
+	}
+
+	for specIndex, spec := range specs {
+		var (
+			w  = wheel{now: spec.now}
+			tm = &Timer{expires: spec.expires}
+		)
+		w.add(tm)
+
+		expTick := spec.expires
+		if expTick < spec.now {
+			expTick = spec.now
+		}
+
+		for w.now <= expTick {
+			processed := w.now
+			if expired := w.advance(); expired != nil {
+				if expired != tm || expired.next != nil {
+					t.Fatalf("[spec %d] unexpected list of expired timers", specIndex)
+				}
+
+				if processed != expTick {
+					t.Errorf("[spec %d] expected timer to expire at tick %d; got %d", specIndex, expTick, processed)
+				}
+				break
+			}
+		}
+
+		if tm.list != nil {
+			t.Errorf("[spec %d] expected timer to expire by tick %d", specIndex, expTick)
+		}
+	}
+}
+
+func TestWheelMultipleTimers(t *testing.T) {
+	var (
+		w      wheel
+		timers = make([]*Timer, 5000)
+		fired  = make(map[*Timer]uint64)
+	)
+
+	for i := range timers {
+		timers[i] = &Timer{expires: uint64(i*7) % 9000}
+		w.add(timers[i])
+	}
+
+	// Remove every other timer
+	for i := 0; i < len(timers); i += 2 {
+		timers[i].list.remove(timers[i])
+	}
+
+	for w.now < 9000 {
+		processed := w.now
+		for tm := w.advance(); tm != nil; tm = tm.next {
+			fired[tm] = processed
+		}
+	}
+
+	for i, tm := range timers {
+		at, found := fired[tm]
+		switch {
+		case i%2 == 0 && found:
+			t.Errorf("[timer %d] expected removed timer not to fire", i)
+		case i%2 == 1 && !found:
+			t.Errorf("[timer %d] expected timer to fire", i)
+		case i%2 == 1 && at != tm.expires:
+			t.Errorf("[timer %d] expected timer to fire at tick %d; got %d", i, tm.expires, at)
+		}
+	}
+}
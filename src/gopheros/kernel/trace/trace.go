@@ -0,0 +1,242 @@
+// Package trace implements a lightweight facility for recording kernel events.
+//
+// Subsystems emit static trace events (e.g. scheduler context switches,
+// interrupt entry/exit, page faults and performance counter samples) via
+// Record. Each event is stored
+// together with a timestamp into a fixed-size ring buffer that belongs to the
+// CPU that recorded it; once a buffer fills up, the oldest events are
+// overwritten. Recording is disabled by default and can be enabled via the
+// "trace" boot command line flag or by calling Enable. While disabled, Record
+// returns immediately so trace events can be placed in hot paths.
+package trace
+
+import (
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+	"io"
+	"sync/atomic"
+)
+
+const (
+	// MaxCPUs is the number of CPUs for which a trace buffer is reserved.
+	// Events recorded by other CPUs are dropped.
+	MaxCPUs = 16
+
+	// bufferSize is the number of events that each CPU buffer can hold.
+	bufferSize = 512
+)
+
+// Event identifies the type of a trace event.
+type Event uint8
+
+// The supported trace events.
+const (
+	// EventSchedSwitch is recorded when the scheduler switches threads.
+	// Its arguments are the IDs of the previous and the next thread.
+	EventSchedSwitch Event = iota + 1
+
+	// EventIRQEntry is recorded before the handlers for an interrupt
+	// vector are invoked. Its first argument is the vector number.
+	EventIRQEntry
+
+	// EventIRQExit is recorded after the handlers for an interrupt vector
+	// have been invoked. Its arguments are the vector number and 1 if any
+	// handler serviced the interrupt or 0 otherwise.
+	EventIRQExit
+
+	// EventPageFault is recorded when a page fault occurs. Its arguments
+	// are the faulting address and the page fault error code.
+	EventPageFault
+
+	// EventPMUSample is recorded when a sampled performance counter
+	// overflows. Its arguments are the interrupted instruction pointer and
+	// the sampled counter event.
+	EventPMUSample
+)
+
+// String implements fmt.Stringer for Event.
+func (e Event) String() string {
+	switch e {
+	case EventSchedSwitch:
+		return "sched_switch"
+	case EventIRQEntry:
+		return "irq_entry"
+	case EventIRQExit:
+		return "irq_exit"
+	case EventPageFault:
+		return "page_fault"
+	case EventPMUSample:
+		return "pmu_sample"
+	default:
+		return "unknown"
+	}
+}
+
+// record is a single entry in a trace buffer.
+type record struct {
+	timestamp  uint64
+	event      Event
+	arg1, arg2 uint64
+}
+
+// buffer is a ring buffer of trace records. It is only written by the CPU
+// that owns it with interrupts disabled.
+type buffer struct {
+	records [bufferSize]record
+
+	// count is the number of records written since the buffer was last
+	// cleared. The next record is stored at index count%bufferSize.
+	count uint64
+}
+
+var (
+	enabled uint32
+	buffers [MaxCPUs]buffer
+
+	// clockFn returns the current time in nanoseconds. Until SetClock is
+	// invoked, events are recorded with a zero timestamp.
+	clockFn = func() uint64 { return 0 }
+
+	// cpuIndexFn returns the index of the calling CPU. Until SetCPUIndex
+	// is invoked, all events are attributed to the boot processor.
+	cpuIndexFn = func() int { return 0 }
+
+	// The following functions are used by tests to mock calls to the cpu
+	// and cmdline packages.
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn  = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	cmdlineBoolFn       = cmdline.Bool
+)
+
+// Init enables event recording if the "trace" flag is present on the boot
+// command line.
+func Init() {
+	if cmdlineBoolFn("trace") {
+		Enable()
+	}
+}
+
+// SetClock registers the function used for timestamping events. It returns
+// the elapsed time in nanoseconds and must be safe to call from interrupt
+// context.
+func SetClock(fn func() uint64) {
+	clockFn = fn
+}
+
+// SetCPUIndex registers the function used for looking up the index of the
+// CPU that records an event.
+func SetCPUIndex(fn func() int) {
+	cpuIndexFn = fn
+}
+
+// Enable starts recording events.
+func Enable() {
+	atomic.StoreUint32(&enabled, 1)
+}
+
+// Disable stops recording events. Recorded events are retained until Clear
+// is invoked.
+func Disable() {
+	atomic.StoreUint32(&enabled, 0)
+}
+
+// Enabled returns true if events are being recorded.
+func Enabled() bool {
+	return atomic.LoadUint32(&enabled) == 1
+}
+
+// Record stores an event with the supplied arguments into the trace buffer of
+// the calling CPU. It may be invoked from interrupt context.
+func Record(ev Event, arg1, arg2 uint64) {
+	if atomic.LoadUint32(&enabled) == 0 {
+		return
+	}
+
+	cpuIndex := cpuIndexFn()
+	if cpuIndex < 0 || cpuIndex >= MaxCPUs {
+		return
+	}
+
+	intr := lock()
+	buf := &buffers[cpuIndex]
+	buf.records[buf.count%bufferSize] = record{timestamp: clockFn(), event: ev, arg1: arg1, arg2: arg2}
+	buf.count++
+	unlock(intr)
+}
+
+// Clear discards all recorded events.
+func Clear() {
+	intr := lock()
+	for i := range buffers {
+		buffers[i].count = 0
+	}
+	unlock(intr)
+}
+
+// Dump writes the recorded events for each CPU to w, oldest first. Recording
+// is paused while the buffers are being written out.
+func Dump(w io.Writer) {
+	wasEnabled := atomic.SwapUint32(&enabled, 0) == 1
+	defer func() {
+		if wasEnabled {
+			Enable()
+		}
+	}()
+
+	state := "disabled"
+	if wasEnabled {
+		state = "enabled"
+	}
+
+	kfmt.Fprintf(w, "tracing: %s\n", state)
+	for cpuIndex := range buffers {
+		buf := &buffers[cpuIndex]
+		if buf.count == 0 {
+			continue
+		}
+
+		var first, dropped uint64
+		if buf.count > bufferSize {
+			first, dropped = buf.count-bufferSize, buf.count-bufferSize
+		}
+
+		kfmt.Fprintf(w, "CPU %d: %d events (%d overwritten)\n", cpuIndex, buf.count-dropped, dropped)
+		for i := first; i < buf.count; i++ {
+			rec := &buf.records[i%bufferSize]
+			kfmt.Fprintf(w, "%6d.%06d %-12s ", rec.timestamp/1e9, (rec.timestamp%1e9)/1e3, rec.event.String())
+			dumpArgs(w, rec)
+		}
+	}
+}
+
+// dumpArgs writes the arguments of rec to w using the format of its event.
+func dumpArgs(w io.Writer, rec *record) {
+	switch rec.event {
+	case EventSchedSwitch:
+		kfmt.Fprintf(w, "prev=%d next=%d\n", rec.arg1, rec.arg2)
+	case EventIRQEntry:
+		kfmt.Fprintf(w, "vector=0x%x\n", rec.arg1)
+	case EventIRQExit:
+		kfmt.Fprintf(w, "vector=0x%x handled=%t\n", rec.arg1, rec.arg2 != 0)
+	case EventPageFault:
+		kfmt.Fprintf(w, "addr=0x%x error=0x%x\n", rec.arg1, rec.arg2)
+	case EventPMUSample:
+		kfmt.Fprintf(w, "ip=0x%x event=%d\n", rec.arg1, rec.arg2)
+	default:
+		kfmt.Fprintf(w, "0x%x 0x%x\n", rec.arg1, rec.arg2)
+	}
+}
+
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+	return intr
+}
+
+func unlock(intr bool) {
+	if intr {
+		enableInterruptsFn()
+	}
+}
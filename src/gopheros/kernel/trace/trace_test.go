@@ -0,0 +1,204 @@
+package trace
+
+import (
+	"bytes"
+	"gopheros/kernel/cmdline"
+	"gopheros/kernel/cpu"
+	"strings"
+	"testing"
+)
+
+func mockInterrupts() {
+	interruptsEnabledFn = func() bool { return true }
+	enableInterruptsFn = func() {}
+	disableInterruptsFn = func() {}
+}
+
+func restoreMocks() {
+	Disable()
+	for i := range buffers {
+		buffers[i].count = 0
+	}
+
+	clockFn = func() uint64 { return 0 }
+	cpuIndexFn = func() int { return 0 }
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	cmdlineBoolFn = cmdline.Bool
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	specs := []struct {
+		flag bool
+		exp  bool
+	}{
+		{false, false},
+		{true, true},
+	}
+
+	for specIndex, spec := range specs {
+		Disable()
+		cmdlineBoolFn = func(name string) bool {
+			if name != "trace" {
+				t.Errorf("[spec %d] unexpected lookup for flag %q", specIndex, name)
+			}
+			return spec.flag
+		}
+
+		Init()
+		if got := Enabled(); got != spec.exp {
+			t.Errorf("[spec %d] expected Enabled() to return %t; got %t", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	var now uint64
+	SetClock(func() uint64 { now += 10; return now })
+
+	cpuIndex := 1
+	SetCPUIndex(func() int { return cpuIndex })
+
+	t.Run("disabled", func(t *testing.T) {
+		Record(EventSchedSwitch, 1, 2)
+		if got := buffers[1].count; got != 0 {
+			t.Fatalf("expected no events to be recorded while disabled; got %d", got)
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		Enable()
+		Record(EventIRQEntry, 33, 0)
+		Record(EventIRQExit, 33, 1)
+
+		buf := &buffers[1]
+		if buf.count != 2 {
+			t.Fatalf("expected 2 recorded events; got %d", buf.count)
+		}
+
+		exp := record{timestamp: 20, event: EventIRQExit, arg1: 33, arg2: 1}
+		if got := buf.records[1]; got != exp {
+			t.Fatalf("expected record %+v; got %+v", exp, got)
+		}
+	})
+
+	t.Run("unknown cpu", func(t *testing.T) {
+		for _, cpuIndex = range []int{-1, MaxCPUs} {
+			Record(EventPageFault, 0xbadf00d, 2)
+		}
+
+		for i := range buffers {
+			if i != 1 && buffers[i].count != 0 {
+				t.Fatalf("expected events for unknown CPUs to be dropped; got %d events for CPU %d", buffers[i].count, i)
+			}
+		}
+	})
+
+	t.Run("wrap", func(t *testing.T) {
+		cpuIndex = 2
+		for i := 0; i < bufferSize+3; i++ {
+			Record(EventSchedSwitch, uint64(i), 0)
+		}
+
+		buf := &buffers[2]
+		if buf.count != bufferSize+3 {
+			t.Fatalf("expected %d recorded events; got %d", bufferSize+3, buf.count)
+		}
+
+		// The oldest events should have been overwritten
+		for i := 0; i < 3; i++ {
+			if exp, got := uint64(bufferSize+i), buf.records[i].arg1; got != exp {
+				t.Errorf("expected record %d to contain arg %d; got %d", i, exp, got)
+			}
+		}
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		Clear()
+		for i := range buffers {
+			if buffers[i].count != 0 {
+				t.Fatalf("expected buffer for CPU %d to be empty after Clear; got %d events", i, buffers[i].count)
+			}
+		}
+	})
+}
+
+func TestDump(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	t.Run("disabled", func(t *testing.T) {
+		var buf bytes.Buffer
+		Dump(&buf)
+
+		if exp, got := "tracing: disabled\n", buf.String(); got != exp {
+			t.Fatalf("expected output:\n%q\ngot:\n%q", exp, got)
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		timestamps := []uint64{1500000, 2000001000, 3000000000, 3000002000, 3500000000, 4000000000}
+		SetClock(func() uint64 {
+			ts := timestamps[0]
+			timestamps = timestamps[1:]
+			return ts
+		})
+
+		Enable()
+		Record(EventSchedSwitch, 0, 3)
+		Record(EventIRQEntry, 0x30, 0)
+		Record(EventIRQExit, 0x30, 0)
+		Record(EventPageFault, 0xdead000, 0x7)
+		Record(EventPMUSample, 0x101000, 1)
+		Record(Event(0xff), 1, 2)
+
+		var buf bytes.Buffer
+		Dump(&buf)
+
+		exp := strings.Join([]string{
+			"tracing: enabled",
+			"CPU 0: 6 events (0 overwritten)",
+			"     0.001500 sched_switch prev=0 next=3",
+			"     2.000001 irq_entry    vector=0x30",
+			"     3.000000 irq_exit     vector=0x30 handled=false",
+			"     3.000002 page_fault   addr=0xdead000 error=0x7",
+			"     3.500000 pmu_sample   ip=0x101000 event=1",
+			"     4.000000 unknown      0x1 0x2",
+			"",
+		}, "\n")
+
+		if got := buf.String(); got != exp {
+			t.Fatalf("expected output:\n%q\ngot:\n%q", exp, got)
+		}
+
+		if !Enabled() {
+			t.Fatal("expected recording to be resumed after Dump returns")
+		}
+	})
+
+	t.Run("overwritten", func(t *testing.T) {
+		Clear()
+		SetClock(func() uint64 { return 0 })
+		for i := 0; i < bufferSize+1; i++ {
+			Record(EventIRQEntry, uint64(i), 0)
+		}
+
+		var buf bytes.Buffer
+		Dump(&buf)
+
+		lines := strings.Split(buf.String(), "\n")
+		if exp := "CPU 0: 512 events (1 overwritten)"; lines[1] != exp {
+			t.Fatalf("expected summary line %q; got %q", exp, lines[1])
+		}
+
+		if exp := "     0.000000 irq_entry    vector=0x1"; lines[2] != exp {
+			t.Fatalf("expected oldest retained event to be %q; got %q", exp, lines[2])
+		}
+	})
+}
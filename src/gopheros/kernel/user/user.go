@@ -0,0 +1,7 @@
+// Package user provides the low-level support for running code in user mode.
+// Each supported architecture provides Init, SetKernelStack, KernelStack and
+// Enter in a user_<arch>.go file. On amd64, Init installs a task state segment
+// (TSS) so that the CPU can switch to the kernel stack of the running task when
+// an interrupt or exception occurs while executing user code (ring 3), and
+// Enter implements the transition to user mode.
+package user
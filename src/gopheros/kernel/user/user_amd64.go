@@ -0,0 +1,149 @@
+package user
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/sched"
+	"unsafe"
+)
+
+// The segment selectors defined by the GDT that is set up by the rt0 code.
+const (
+	KernelCodeSelector = 0x08
+	KernelDataSelector = 0x10
+	UserDataSelector   = 0x18 | 3
+	UserCodeSelector   = 0x20 | 3
+	TSSSelector        = 0x28
+)
+
+const (
+	// tssSize is the size of the 64-bit TSS structure.
+	tssSize = 104
+
+	// tssTypeAvailable marks a descriptor as a present, available 64-bit
+	// TSS.
+	tssTypeAvailable = 0x89
+
+	// The indices of the 32-bit words in the TSS that hold the RSP0 field
+	// and the I/O map base.
+	tssWordRSP0      = 1
+	tssWordIOMapBase = 25
+
+	// rflagsIF is the interrupt enable flag in RFLAGS.
+	rflagsIF = 1 << 9
+
+	// rflagsReserved is the reserved RFLAGS bit that must always be set.
+	rflagsReserved = 1 << 1
+)
+
+var (
+	errGDTTooSmall = &kernel.Error{Module: "user", Message: "GDT does not contain a TSS descriptor slot"}
+
+	// tss holds the task state segment of the boot processor. The 64-bit
+	// fields of the TSS are not naturally aligned so it is accessed as a
+	// sequence of 32-bit words.
+	tss [tssSize / 4]uint32
+
+	// The following functions are used by tests to mock calls to the
+	// assembly helpers and the sched package.
+	storeGDTRFn          = storeGDTR
+	loadTaskRegisterFn   = loadTaskRegister
+	enterUserModeFn      = enterUserMode
+	currentThreadFn      = sched.Current
+	addSwitchHookFn      = sched.AddSwitchHook
+	currentKernelStackFn = currentKernelStack
+)
+
+// Init installs the TSS descriptor into the GDT, loads the task register and
+// arranges for the TSS kernel stack pointer to be updated whenever the
+// scheduler switches to a different thread.
+func Init() *kernel.Error {
+	var gdtr [16]byte
+	storeGDTRFn(&gdtr)
+
+	var (
+		gdtLimit = *(*uint16)(unsafe.Pointer(&gdtr[0]))
+		gdtBase  = *(*uintptr)(unsafe.Pointer(&gdtr[2]))
+	)
+
+	if uintptr(gdtLimit)+1 < TSSSelector+16 {
+		return errGDTTooSmall
+	}
+
+	// Setting the I/O map base past the end of the TSS denies user-mode
+	// code access to all I/O ports.
+	tss[tssWordIOMapBase] = tssSize << 16
+
+	lo, hi := tssDescriptor(uintptr(unsafe.Pointer(&tss[0])), tssSize-1)
+	*(*uint64)(unsafe.Pointer(gdtBase + TSSSelector)) = lo
+	*(*uint64)(unsafe.Pointer(gdtBase + TSSSelector + 8)) = hi
+	loadTaskRegisterFn(TSSSelector)
+
+	if t := currentThreadFn(); t != nil {
+		SetKernelStack(t.StackTop())
+	}
+	addSwitchHookFn(func(next *sched.Thread) {
+		SetKernelStack(next.StackTop())
+	})
+
+	return nil
+}
+
+// SetKernelStack sets the stack pointer that the CPU loads when an interrupt
+// or exception transfers control from user mode to the kernel.
+func SetKernelStack(stackTop uintptr) {
+	tss[tssWordRSP0] = uint32(stackTop)
+	tss[tssWordRSP0+1] = uint32(uint64(stackTop) >> 32)
+}
+
+// KernelStack returns the kernel stack pointer that is currently stored in
+// the TSS.
+func KernelStack() uintptr {
+	return uintptr(uint64(tss[tssWordRSP0]) | uint64(tss[tssWordRSP0+1])<<32)
+}
+
+// KernelStackSlot returns the address of the TSS field that holds the kernel
+// stack pointer. It allows entry points that cannot use the TSS-based stack
+// switch (e.g. SYSCALL) to locate the kernel stack of the running task.
+func KernelStackSlot() uintptr {
+	return uintptr(unsafe.Pointer(&tss[tssWordRSP0]))
+}
+
+// Enter transfers control to the user-mode code at entry using stack as the
+// user-mode stack pointer. The FS base set via gate.SetUserFSBase is loaded and
+// interrupts are enabled once the CPU switches to user mode. Enter never returns; the remaining contents of the kernel stack of
+// the calling thread are discarded and the stack is reused for handling
+// interrupts and exceptions raised by the user-mode code.
+func Enter(entry, stack uintptr) {
+	SetKernelStack(currentKernelStackFn())
+	enterUserModeFn(entry, stack, rflagsIF|rflagsReserved, gate.UserFSBase())
+}
+
+// tssDescriptor encodes a 16-byte system segment descriptor for a 64-bit TSS.
+func tssDescriptor(base uintptr, limit uint32) (uint64, uint64) {
+	lo := uint64(limit&0xffff) |
+		uint64(base&0xffffff)<<16 |
+		uint64(tssTypeAvailable)<<40 |
+		uint64((limit>>16)&0xf)<<48 |
+		uint64((base>>24)&0xff)<<56
+	hi := uint64(base >> 32)
+	return lo, hi
+}
+
+// currentKernelStack returns the top of the kernel stack of the running thread.
+func currentKernelStack() uintptr {
+	if t := currentThreadFn(); t != nil {
+		return t.StackTop()
+	}
+	return KernelStack()
+}
+
+// storeGDTR stores the GDT descriptor of the calling CPU to desc.
+func storeGDTR(desc *[16]byte)
+
+// loadTaskRegister loads the task register with the specified selector.
+func loadTaskRegister(selector uint16)
+
+// enterUserMode loads the user-mode FS base, builds an IRETQ frame that resumes
+// execution at the specified user-mode entrypoint and stack and executes it.
+func enterUserMode(entry, stack, rflags, fsBase uintptr)
@@ -0,0 +1,62 @@
+#include "textflag.h"
+
+#define USER_DS 0x1b
+#define USER_CS 0x23
+
+#define MSR_FS_BASE 0xc0000100
+
+TEXT ·storeGDTR(SB),NOSPLIT,$0
+	MOVQ desc+0(FP), AX
+	MOVQ GDTR, 0(AX) 	// SGDT[RAX]
+	RET
+
+TEXT ·loadTaskRegister(SB),NOSPLIT,$0-2
+	MOVW selector+0(FP), AX
+	LTR AX
+	RET
+
+TEXT ·enterUserMode(SB),NOSPLIT,$0-32
+	// Once the FS base is changed, Go code can no longer look up the
+	// current g so no calls may follow.
+	CLI
+	MOVQ fsBase+24(FP), AX
+	MOVQ AX, DX
+	SHRQ $32, DX
+	MOVL $MSR_FS_BASE, CX
+	WRMSR
+
+	MOVQ entry+0(FP), AX
+	MOVQ stack+8(FP), BX
+	MOVQ rflags+16(FP), CX
+
+	// Build the IRETQ frame. As with the gate entrypoints, SUBQ/MOVQ is
+	// used instead of PUSHQ to keep the Go assembler from complaining
+	// about an unbalanced stack.
+	SUBQ $40, SP
+	MOVQ AX, 0(SP)
+	MOVQ $USER_CS, 8(SP)
+	MOVQ CX, 16(SP)
+	MOVQ BX, 24(SP)
+	MOVQ $USER_DS, 32(SP)
+
+	MOVW $USER_DS, AX
+	MOVW AX, DS
+	MOVW AX, ES
+
+	// Make sure that no kernel register contents leak to user-mode
+	XORQ AX, AX
+	XORQ BX, BX
+	XORQ CX, CX
+	XORQ DX, DX
+	XORQ SI, SI
+	XORQ DI, DI
+	BYTE $0x48; BYTE $0x31; BYTE $0xed 	// XORQ BP, BP; encoded manually to keep vet happy
+	XORQ R8, R8
+	XORQ R9, R9
+	XORQ R10, R10
+	XORQ R11, R11
+	XORQ R12, R12
+	XORQ R13, R13
+	XORQ R14, R14
+	XORQ R15, R15
+	IRETQ
@@ -0,0 +1,125 @@
+package user
+
+import (
+	"gopheros/kernel/gate"
+	"gopheros/kernel/sched"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	storeGDTRFn = storeGDTR
+	loadTaskRegisterFn = loadTaskRegister
+	enterUserModeFn = enterUserMode
+	currentThreadFn = sched.Current
+	addSwitchHookFn = sched.AddSwitchHook
+	currentKernelStackFn = currentKernelStack
+	tss = [len(tss)]uint32{}
+}
+
+func TestTSSDescriptor(t *testing.T) {
+	specs := []struct {
+		base  uintptr
+		limit uint32
+		expLo uint64
+		expHi uint64
+	}{
+		{0, 103, 0x0000890000000067, 0},
+		{0xffff800012345678, 103, 0x1200893456780067, 0xffff8000},
+		{0x0000000000abcdef, 0xfffff, 0x000f89abcdefffff, 0},
+	}
+
+	for specIndex, spec := range specs {
+		lo, hi := tssDescriptor(spec.base, spec.limit)
+		if lo != spec.expLo || hi != spec.expHi {
+			t.Errorf("[spec %d] expected descriptor %016x:%016x; got %016x:%016x", specIndex, spec.expHi, spec.expLo, hi, lo)
+		}
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	var (
+		gdt      [7]uint64
+		gdtLimit = uint16(len(gdt)*8 - 1)
+		loadedTR uint16
+		hook     func(*sched.Thread)
+	)
+
+	storeGDTRFn = func(desc *[16]byte) {
+		*(*uint16)(unsafe.Pointer(&desc[0])) = gdtLimit
+		*(*uintptr)(unsafe.Pointer(&desc[2])) = uintptr(unsafe.Pointer(&gdt[0]))
+	}
+	loadTaskRegisterFn = func(selector uint16) { loadedTR = selector }
+	currentThreadFn = func() *sched.Thread { return nil }
+	addSwitchHookFn = func(fn func(*sched.Thread)) { hook = fn }
+
+	gdtLimit = TSSSelector + 7
+	if err := Init(); err != errGDTTooSmall {
+		t.Fatalf("expected to get errGDTTooSmall; got %v", err)
+	}
+
+	gdtLimit = uint16(len(gdt)*8 - 1)
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if loadedTR != TSSSelector {
+		t.Errorf("expected task register to be loaded with selector 0x%x; got 0x%x", TSSSelector, loadedTR)
+	}
+
+	expLo, expHi := tssDescriptor(uintptr(unsafe.Pointer(&tss[0])), tssSize-1)
+	if gdt[TSSSelector/8] != expLo || gdt[TSSSelector/8+1] != expHi {
+		t.Errorf("expected TSS descriptor to be written to the GDT")
+	}
+
+	if got := *(*uint16)(unsafe.Pointer(&tssBytes()[102])); got != tssSize {
+		t.Errorf("expected I/O map base to be %d; got %d", tssSize, got)
+	}
+
+	// The switch hook should update the kernel stack in the TSS
+	stack := make([]uint64, 16)
+	stackLo := uintptr(unsafe.Pointer(&stack[0]))
+	th := sched.NewThread("test", stackLo, stackLo+uintptr(len(stack))*8, func() {})
+	if hook == nil {
+		t.Fatal("expected a switch hook to be registered")
+	}
+
+	hook(th)
+	if got := KernelStack(); got != th.StackTop() {
+		t.Errorf("expected kernel stack to be 0x%x; got 0x%x", th.StackTop(), got)
+	}
+}
+
+func TestEnter(t *testing.T) {
+	defer restoreMocks()
+
+	var entered [4]uintptr
+	currentKernelStackFn = func() uintptr { return 0xfeed0000 }
+	enterUserModeFn = func(entry, stack, rflags, fsBase uintptr) { entered = [4]uintptr{entry, stack, rflags, fsBase} }
+	gate.SetUserFSBase(0x5000)
+	defer gate.SetUserFSBase(0)
+
+	Enter(0x400000, 0x7fff0000)
+
+	if got := *(*uint64)(unsafe.Pointer(&tssBytes()[4])); got != 0xfeed0000 {
+		t.Errorf("expected RSP0 field of the TSS to be 0xfeed0000; got 0x%x", got)
+	}
+
+	if got := *(*uint64)(unsafe.Pointer(KernelStackSlot())); got != 0xfeed0000 {
+		t.Errorf("expected KernelStackSlot to point to the RSP0 field of the TSS")
+	}
+
+	if KernelStack() != 0xfeed0000 {
+		t.Errorf("expected kernel stack to be set to the current thread stack; got 0x%x", KernelStack())
+	}
+
+	if exp := [4]uintptr{0x400000, 0x7fff0000, 0x202, 0x5000}; entered != exp {
+		t.Errorf("expected enterUserMode to be called with %x; got %x", exp, entered)
+	}
+}
+
+func tssBytes() *[tssSize]byte {
+	return (*[tssSize]byte)(unsafe.Pointer(&tss[0]))
+}
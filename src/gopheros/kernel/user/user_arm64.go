@@ -0,0 +1,31 @@
+package user
+
+import "gopheros/kernel"
+
+// The arm64 port is a stub: its entry points allow the architecture-neutral
+// kernel packages to be type-checked for arm64 but panic when invoked.
+
+func unimplemented() {
+	panic("user: not implemented on arm64")
+}
+
+// Init prepares the calling CPU for running user-mode code.
+func Init() *kernel.Error {
+	unimplemented()
+	return nil
+}
+
+// SetKernelStack sets the stack pointer that the CPU loads when an exception
+// transfers control from user mode to the kernel.
+func SetKernelStack(_ uintptr) { unimplemented() }
+
+// KernelStack returns the kernel stack pointer that is loaded when an
+// exception transfers control from user mode to the kernel.
+func KernelStack() uintptr {
+	unimplemented()
+	return 0
+}
+
+// Enter transfers control to the user-mode code at entry using stack as the
+// user-mode stack pointer. Enter never returns.
+func Enter(_, _ uintptr) { unimplemented() }
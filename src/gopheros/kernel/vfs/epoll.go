@@ -0,0 +1,178 @@
+package vfs
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/timer"
+)
+
+// EpollOneShot can be combined with the events passed to Epoll.Add and
+// Epoll.Modify. Once an event has been reported for a one-shot source, the
+// source is disabled until it is re-armed via Epoll.Modify.
+const EpollOneShot Events = 1 << 30
+
+var (
+	// Errors returned by Epoll.
+	ErrExists      = &kernel.Error{Module: "vfs", Message: "file exists", Code: kernel.CodeExists}
+	ErrNotPollable = &kernel.Error{Module: "vfs", Message: "file does not support polling", Code: kernel.CodeNotPermitted}
+
+	errEpollLoop = &kernel.Error{Module: "vfs", Message: "an epoll instance cannot monitor itself", Code: kernel.CodeInvalid}
+	errEpollIO   = &kernel.Error{Module: "vfs", Message: "epoll instances do not support read and write", Code: kernel.CodeInvalid}
+)
+
+// EpollEvent describes a ready source returned by Epoll.Wait.
+type EpollEvent struct {
+	// Events contains the conditions that are satisfied.
+	Events Events
+
+	// Data is the value that was associated with the source when it was
+	// registered.
+	Data uint64
+}
+
+// epollInterest is a source that is monitored by an Epoll instance.
+type epollInterest struct {
+	fd     int
+	src    Pollable
+	events Events
+	data   uint64
+
+	// disarmed is set once an event has been reported for a one-shot
+	// source.
+	disarmed bool
+}
+
+// Epoll monitors a set of sources that are identified by their file
+// descriptors. Unlike Poll, the monitored set is registered once and can be
+// waited on repeatedly. All sources are level-triggered: Wait keeps reporting
+// a source for as long as its conditions are satisfied. Sources are not
+// removed automatically when their descriptor is closed.
+//
+// Epoll implements File so it can be installed in an FDTable. It also
+// implements Pollable and reports PollIn when any of its sources is ready.
+type Epoll struct {
+	interests []epollInterest
+}
+
+// NewEpoll returns an Epoll instance without any registered sources.
+func NewEpoll() *Epoll {
+	return &Epoll{}
+}
+
+// Add starts monitoring src for the specified events. The descriptor fd
+// identifies the source in subsequent calls to Modify and Remove.
+func (ep *Epoll) Add(fd int, src Pollable, events Events, data uint64) *kernel.Error {
+	if src == Pollable(ep) {
+		return errEpollLoop
+	}
+
+	if ep.find(fd) != -1 {
+		return ErrExists
+	}
+
+	ep.interests = append(ep.interests, epollInterest{fd: fd, src: src, events: events, data: data})
+	NotifyPoll()
+	return nil
+}
+
+// Modify updates the events and data associated with a registered source.
+func (ep *Epoll) Modify(fd int, events Events, data uint64) *kernel.Error {
+	index := ep.find(fd)
+	if index == -1 {
+		return ErrNotFound
+	}
+
+	ep.interests[index] = epollInterest{fd: fd, src: ep.interests[index].src, events: events, data: data}
+	NotifyPoll()
+	return nil
+}
+
+// Remove stops monitoring a registered source.
+func (ep *Epoll) Remove(fd int) *kernel.Error {
+	index := ep.find(fd)
+	if index == -1 {
+		return ErrNotFound
+	}
+
+	ep.interests = append(ep.interests[:index], ep.interests[index+1:]...)
+	return nil
+}
+
+func (ep *Epoll) find(fd int) int {
+	for index, interest := range ep.interests {
+		if interest.fd == fd {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// Wait blocks the calling thread until at least one source is ready or the
+// timeout expires. It fills events with up to len(events) ready sources and
+// returns their count. A zero timeout checks the sources without blocking
+// while NoTimeout waits indefinitely.
+func (ep *Epoll) Wait(events []EpollEvent, timeout timer.Duration) int {
+	var count int
+	waitReady(func() bool {
+		count = 0
+		for index := range ep.interests {
+			if count == len(events) {
+				break
+			}
+
+			interest := &ep.interests[index]
+			if interest.disarmed {
+				continue
+			}
+
+			if revents := pollItem(interest.src, interest.events&^EpollOneShot); revents != 0 {
+				events[count] = EpollEvent{Events: revents, Data: interest.data}
+				count++
+
+				// Reporting any events ends the wait so one-shot
+				// sources can be disarmed right away.
+				interest.disarmed = interest.events&EpollOneShot != 0
+			}
+		}
+		return count != 0
+	}, timeout)
+
+	return count
+}
+
+// Poll implements Pollable.
+func (ep *Epoll) Poll() Events {
+	for _, interest := range ep.interests {
+		if !interest.disarmed && pollItem(interest.src, interest.events&^EpollOneShot) != 0 {
+			return PollIn
+		}
+	}
+
+	return 0
+}
+
+// Read always fails as epoll instances are only accessed via Wait.
+func (ep *Epoll) Read(_ []byte) (int, *kernel.Error) {
+	return 0, errEpollIO
+}
+
+// Write always fails as epoll instances are only accessed via Wait.
+func (ep *Epoll) Write(_ []byte) (int, *kernel.Error) {
+	return 0, errEpollIO
+}
+
+// Lseek always fails as epoll instances are not seekable.
+func (ep *Epoll) Lseek(_ int64, _ int) (int64, *kernel.Error) {
+	return 0, ErrInvalidSeek
+}
+
+// Stat returns information about the epoll instance.
+func (ep *Epoll) Stat() (FileInfo, *kernel.Error) {
+	return FileInfo{Name: "epoll", Mode: 0600}, nil
+}
+
+// Close releases all registered sources.
+func (ep *Epoll) Close() *kernel.Error {
+	ep.interests = nil
+	return nil
+}
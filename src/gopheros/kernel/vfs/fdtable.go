@@ -0,0 +1,173 @@
+package vfs
+
+import "gopheros/kernel"
+
+// MaxFiles is the number of descriptors that can be open at the same time in
+// a single FDTable.
+const MaxFiles = 64
+
+var (
+	// Errors returned by FDTable.
+	ErrBadFD        = &kernel.Error{Module: "vfs", Message: "bad file descriptor", Code: kernel.CodeBadDescriptor}
+	ErrTooManyFiles = &kernel.Error{Module: "vfs", Message: "too many open files", Code: kernel.CodeTooManyFiles}
+)
+
+// openFile is an open File that is shared by one or more descriptors. The file
+// is closed once its last descriptor is closed.
+type openFile struct {
+	file File
+	refs int
+}
+
+// FDTable maps the file descriptors of a process to open files. Descriptors
+// that are created via Dup, Dup2 or Clone share the file offset with the
+// descriptor they were copied from.
+//
+// The zero value is an empty table that is ready for use. As the scheduler is
+// cooperative, tables are not protected by a lock.
+type FDTable struct {
+	files []*openFile
+}
+
+// Install assigns the lowest unused descriptor to f and returns it.
+func (t *FDTable) Install(f File) (int, *kernel.Error) {
+	fd, err := t.alloc()
+	if err != nil {
+		return -1, err
+	}
+
+	t.set(fd, &openFile{file: f})
+	return fd, nil
+}
+
+// Get returns the file associated with a descriptor.
+func (t *FDTable) Get(fd int) (File, *kernel.Error) {
+	of, err := t.lookup(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	return of.file, nil
+}
+
+// Close releases a descriptor. The underlying file is closed if no other
+// descriptors refer to it and the error returned by its Close method is passed
+// to the caller.
+func (t *FDTable) Close(fd int) *kernel.Error {
+	of, err := t.lookup(fd)
+	if err != nil {
+		return err
+	}
+
+	t.files[fd] = nil
+	return of.release()
+}
+
+// Dup assigns the lowest unused descriptor to the file associated with fd and
+// returns it.
+func (t *FDTable) Dup(fd int) (int, *kernel.Error) {
+	of, err := t.lookup(fd)
+	if err != nil {
+		return -1, err
+	}
+
+	newFD, err := t.alloc()
+	if err != nil {
+		return -1, err
+	}
+
+	t.set(newFD, of)
+	return newFD, nil
+}
+
+// Dup2 makes newFD refer to the file associated with oldFD. If newFD is already
+// in use, it is closed first; any error reported while closing it is ignored.
+// If both descriptors are equal, Dup2 only checks that oldFD is valid.
+func (t *FDTable) Dup2(oldFD, newFD int) (int, *kernel.Error) {
+	of, err := t.lookup(oldFD)
+	if err != nil {
+		return -1, err
+	}
+
+	if newFD < 0 || newFD >= MaxFiles {
+		return -1, ErrBadFD
+	}
+
+	if oldFD != newFD {
+		t.set(newFD, of)
+	}
+
+	return newFD, nil
+}
+
+// Clone returns a copy of the table whose descriptors refer to the same files
+// as the descriptors in t.
+func (t *FDTable) Clone() *FDTable {
+	clone := &FDTable{files: make([]*openFile, len(t.files))}
+	for fd, of := range t.files {
+		if of != nil {
+			of.refs++
+			clone.files[fd] = of
+		}
+	}
+
+	return clone
+}
+
+// CloseAll releases all descriptors in the table.
+func (t *FDTable) CloseAll() {
+	for fd, of := range t.files {
+		if of != nil {
+			t.files[fd] = nil
+			_ = of.release()
+		}
+	}
+	t.files = nil
+}
+
+// alloc returns the lowest unused descriptor.
+func (t *FDTable) alloc() (int, *kernel.Error) {
+	fd := 0
+	for fd < len(t.files) && t.files[fd] != nil {
+		fd++
+	}
+
+	if fd == MaxFiles {
+		return -1, ErrTooManyFiles
+	}
+
+	return fd, nil
+}
+
+// set associates a descriptor with of, releasing the file it was previously
+// associated with.
+func (t *FDTable) set(fd int, of *openFile) {
+	for fd >= len(t.files) {
+		t.files = append(t.files, nil)
+	}
+
+	of.refs++
+	if prev := t.files[fd]; prev != nil {
+		_ = prev.release()
+	}
+	t.files[fd] = of
+}
+
+// lookup returns the open file associated with a descriptor.
+func (t *FDTable) lookup(fd int) (*openFile, *kernel.Error) {
+	if fd < 0 || fd >= len(t.files) || t.files[fd] == nil {
+		return nil, ErrBadFD
+	}
+
+	return t.files[fd], nil
+}
+
+// release drops a reference to the open file and closes it once it is no
+// longer referenced.
+func (of *openFile) release() *kernel.Error {
+	if of.refs--; of.refs != 0 {
+		return nil
+	}
+
+	return of.file.Close()
+}
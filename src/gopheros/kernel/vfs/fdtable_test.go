@@ -0,0 +1,131 @@
+package vfs
+
+import (
+	"gopheros/kernel"
+	"testing"
+)
+
+// closeCounter is a File that counts the calls to Close.
+type closeCounter struct {
+	File
+	closed int
+	err    *kernel.Error
+}
+
+func (f *closeCounter) Close() *kernel.Error {
+	f.closed++
+	return f.err
+}
+
+func TestFDTable(t *testing.T) {
+	var (
+		table FDTable
+		fA    = &closeCounter{err: &kernel.Error{Module: "test", Message: "close failed"}}
+		fB    = &closeCounter{}
+		fC    = &closeCounter{}
+	)
+
+	expFD := func(fd int, err *kernel.Error, exp int) {
+		t.Helper()
+		if err != nil || fd != exp {
+			t.Fatalf("expected to get fd %d; got %d, %v", exp, fd, err)
+		}
+	}
+	expFile := func(fd int, exp File) {
+		t.Helper()
+		if f, err := table.Get(fd); err != nil || f != exp {
+			t.Fatalf("expected fd %d to refer to %v; got %v, %v", fd, exp, f, err)
+		}
+	}
+
+	fd, err := table.Install(fA)
+	expFD(fd, err, 0)
+	fd, err = table.Install(fB)
+	expFD(fd, err, 1)
+
+	// Duplicated descriptors share the underlying file which is closed
+	// along with its last descriptor.
+	fd, err = table.Dup(0)
+	expFD(fd, err, 2)
+	expFile(2, fA)
+
+	if err = table.Close(0); err != nil || fA.closed != 0 {
+		t.Fatalf("expected file to remain open; got %d calls to Close, %v", fA.closed, err)
+	}
+	if err = table.Close(2); err != fA.err || fA.closed != 1 {
+		t.Fatalf("expected the file to be closed with error %v; got %d calls to Close, %v", fA.err, fA.closed, err)
+	}
+
+	// Released descriptors are reused
+	fd, err = table.Install(fC)
+	expFD(fd, err, 0)
+
+	// Dup2 replaces the target descriptor
+	fd, err = table.Dup2(1, 0)
+	expFD(fd, err, 0)
+	expFile(0, fB)
+	if fC.closed != 1 {
+		t.Fatal("expected the file previously associated with fd 0 to be closed")
+	}
+
+	fd, err = table.Dup2(1, 1)
+	expFD(fd, err, 1)
+	fd, err = table.Dup2(1, 10)
+	expFD(fd, err, 10)
+	expFile(10, fB)
+
+	// Cloned tables refer to the same files
+	clone := table.Clone()
+	table.CloseAll()
+	if fB.closed != 0 {
+		t.Fatal("expected the file to remain open while referenced by the cloned table")
+	}
+	if _, err = table.Get(0); err != ErrBadFD {
+		t.Fatalf("expected to get ErrBadFD; got %v", err)
+	}
+
+	if f, err := clone.Get(10); err != nil || f != fB {
+		t.Fatalf("expected cloned fd 10 to refer to the original file; got %v, %v", f, err)
+	}
+	clone.CloseAll()
+	if fB.closed != 1 {
+		t.Fatalf("expected the file to be closed once; got %d", fB.closed)
+	}
+
+	for _, fd := range []int{-1, 2, 10, MaxFiles} {
+		if _, err = table.Get(fd); err != ErrBadFD {
+			t.Errorf("[fd %d] expected Get to return ErrBadFD; got %v", fd, err)
+		}
+		if err = table.Close(fd); err != ErrBadFD {
+			t.Errorf("[fd %d] expected Close to return ErrBadFD; got %v", fd, err)
+		}
+		if _, err = table.Dup(fd); err != ErrBadFD {
+			t.Errorf("[fd %d] expected Dup to return ErrBadFD; got %v", fd, err)
+		}
+	}
+}
+
+func TestFDTableLimits(t *testing.T) {
+	var table FDTable
+	for i := 0; i < MaxFiles; i++ {
+		if _, err := table.Install(&closeCounter{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := table.Install(&closeCounter{}); err != ErrTooManyFiles {
+		t.Fatalf("expected to get ErrTooManyFiles; got %v", err)
+	}
+	if _, err := table.Dup(0); err != ErrTooManyFiles {
+		t.Fatalf("expected to get ErrTooManyFiles; got %v", err)
+	}
+
+	for _, newFD := range []int{-1, MaxFiles} {
+		if _, err := table.Dup2(0, newFD); err != ErrBadFD {
+			t.Fatalf("[fd %d] expected to get ErrBadFD; got %v", newFD, err)
+		}
+	}
+	if _, err := table.Dup2(MaxFiles, 0); err != ErrBadFD {
+		t.Fatalf("expected to get ErrBadFD; got %v", err)
+	}
+}
@@ -0,0 +1,675 @@
+// Package iso9660 implements a read-only ISO9660 filesystem with support for
+// the Rock Ridge extensions.
+//
+// Filesystems are read from any device that provides access to its sectors,
+// such as a block device registered with the blockdev package. Directories are
+// parsed on demand while resolving paths and file contents are read from the
+// device when a file is read, so mounting a large image is cheap.
+//
+// If the volume carries Rock Ridge entries, the POSIX file names, permissions
+// and symbolic links stored in them are used. Otherwise, file names are
+// derived from the ISO9660 names by stripping the version suffix and converting
+// them to lower case. Joliet extensions, multi-extent files and relocated
+// directories are not supported.
+package iso9660
+
+import (
+	"encoding/binary"
+	"gopheros/device/blockdev"
+	"gopheros/kernel"
+	"gopheros/kernel/initcall"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/vfs"
+	"strings"
+)
+
+const (
+	// MountPoint is the path where Init mounts the first ISO9660 volume
+	// found on a block device.
+	MountPoint = "/cdrom"
+
+	// Volume descriptors are stored in 2048-byte sectors starting at
+	// sector 16 regardless of the logical block size of the volume.
+	descSectorSize  = 2048
+	firstDescSector = 16
+	maxDescriptors  = 32
+	descTypePrimary = 1
+	descTypeEnd     = 255
+	descMagic       = "CD001"
+
+	// Primary volume descriptor fields.
+	pvdVolumeID     = 40
+	pvdVolumeIDLen  = 32
+	pvdBlockSize    = 128
+	pvdRootDirEntry = 156
+
+	// Directory record fields.
+	recLen       = 0
+	recExtAttr   = 1
+	recExtent    = 2
+	recSize      = 10
+	recFlags     = 25
+	recNameLen   = 32
+	recName      = 33
+	recFlagDir   = uint8(1 << 1)
+	recFlagMulti = uint8(1 << 7)
+
+	// System use sharing protocol and Rock Ridge entry fields.
+	suspHdrLen     = 4
+	spMagic        = "\xbe\xef"
+	nmFlagContinue = uint8(1 << 0)
+	nmFlagCurrent  = uint8(1 << 1)
+	nmFlagParent   = uint8(1 << 2)
+	slFlagContinue = uint8(1 << 0)
+	slFlagCurrent  = uint8(1 << 1)
+	slFlagParent   = uint8(1 << 2)
+	slFlagRoot     = uint8(1 << 3)
+
+	// POSIX file type bits stored in PX entries.
+	posixTypeMask    = uint32(0170000)
+	posixTypeDir     = uint32(0040000)
+	posixTypeSymlink = uint32(0120000)
+
+	defaultFilePerm = vfs.Mode(0444)
+	defaultDirPerm  = vfs.Mode(0555)
+
+	// maxLinkDepth bounds the number of symbolic links followed while
+	// resolving a path and maxContinuations the number of SUSP
+	// continuation areas followed for a single directory record.
+	maxLinkDepth     = 8
+	maxContinuations = 8
+)
+
+var (
+	errNotISO9660       = &kernel.Error{Module: "iso9660", Message: "device does not contain an ISO9660 volume"}
+	errBadBlockSize     = &kernel.Error{Module: "iso9660", Message: "unsupported logical block size"}
+	errBadDirRecord     = &kernel.Error{Module: "iso9660", Message: "malformed directory record", Code: kernel.CodeIO}
+	errOutOfRange       = &kernel.Error{Module: "iso9660", Message: "extent exceeds the device capacity", Code: kernel.CodeIO}
+	errTooManyLinks     = &kernel.Error{Module: "iso9660", Message: "too many levels of symbolic links", Code: kernel.CodeLoop}
+	errMultiExtentFiles = &kernel.Error{Module: "iso9660", Message: "multi-extent files are not supported", Code: kernel.CodeNotSupported}
+
+	// The following functions are used by tests to mock calls to the
+	// blockdev and vfs packages.
+	blockDevicesFn = blockdev.Devices
+	mountFn        = vfs.Mount
+)
+
+// Device is implemented by the storage that contains the filesystem. Block
+// devices registered with the blockdev package satisfy this interface.
+type Device interface {
+	// SectorSize returns the size of a sector in bytes.
+	SectorSize() uint32
+
+	// SectorCount returns the number of sectors.
+	SectorCount() uint64
+
+	// ReadSectors reads count sectors starting at the specified LBA into
+	// buf.
+	ReadSectors(lba uint64, count uint32, buf []byte) *kernel.Error
+}
+
+// entry describes a file or directory on the volume.
+type entry struct {
+	info   vfs.FileInfo
+	extent uint32
+	size   uint32
+	target string
+	multi  bool
+}
+
+// FS is a read-only filesystem backed by an ISO9660 volume.
+type FS struct {
+	dev       Device
+	blockSize uint32
+	volumeID  string
+	root      entry
+
+	// rockRidge is set if the volume uses the Rock Ridge extensions.
+	// suspSkip is the number of bytes to skip at the start of each system
+	// use area.
+	rockRidge bool
+	suspSkip  int
+}
+
+// New locates the primary volume descriptor on a device and returns a
+// filesystem for the volume it describes.
+func New(dev Device) (*FS, *kernel.Error) {
+	sectorSize := dev.SectorSize()
+	if sectorSize == 0 || descSectorSize%sectorSize != 0 {
+		return nil, errBadBlockSize
+	}
+
+	fs := &FS{dev: dev, blockSize: descSectorSize}
+
+	desc := make([]byte, descSectorSize)
+	for sector := uint32(firstDescSector); ; sector++ {
+		if sector == firstDescSector+maxDescriptors {
+			return nil, errNotISO9660
+		}
+
+		if err := fs.readAt(desc, int64(sector)*descSectorSize); err != nil {
+			return nil, errNotISO9660
+		}
+
+		if string(desc[1:1+len(descMagic)]) != descMagic || desc[0] == descTypeEnd {
+			return nil, errNotISO9660
+		}
+
+		if desc[0] == descTypePrimary {
+			break
+		}
+	}
+
+	fs.blockSize = uint32(binary.LittleEndian.Uint16(desc[pvdBlockSize:]))
+	if fs.blockSize == 0 || fs.blockSize&(fs.blockSize-1) != 0 || fs.blockSize%sectorSize != 0 {
+		return nil, errBadBlockSize
+	}
+	fs.volumeID = strings.TrimRight(string(desc[pvdVolumeID:pvdVolumeID+pvdVolumeIDLen]), " \x00")
+
+	root, ok := parseRecord(desc[pvdRootDirEntry:])
+	if !ok || root.info.Mode&vfs.ModeDir == 0 {
+		return nil, errBadDirRecord
+	}
+	root.info.Name = "/"
+	fs.root = root
+
+	// The SUSP indicator is stored in the "." record of the root
+	// directory. Its presence enables the parsing of Rock Ridge entries.
+	dir := make([]byte, fs.blockSize)
+	if err := fs.readAt(dir, int64(root.extent)*int64(fs.blockSize)); err != nil {
+		return nil, err
+	}
+	if dot, ok := parseRecord(dir); ok {
+		area := systemUseArea(dir[:dir[recLen]], 0)
+		if len(area) >= 7 && string(area[:2]) == "SP" && string(area[4:6]) == spMagic {
+			fs.rockRidge, fs.suspSkip = true, int(area[6])
+			if err := fs.parseSystemUse(&dot, area); err == nil && dot.info.Mode&vfs.ModeDir != 0 {
+				fs.root.info.Mode = dot.info.Mode
+			}
+		}
+	}
+
+	return fs, nil
+}
+
+// Mount locates an ISO9660 volume on a device and mounts it at the specified
+// path.
+func Mount(path string, dev Device) *kernel.Error {
+	fs, err := New(dev)
+	if err != nil {
+		return err
+	}
+
+	return mountFn(path, fs)
+}
+
+// VolumeID returns the volume identifier stored in the primary volume
+// descriptor.
+func (fs *FS) VolumeID() string {
+	return fs.volumeID
+}
+
+// RockRidge returns true if the volume uses the Rock Ridge extensions.
+func (fs *FS) RockRidge() bool {
+	return fs.rockRidge
+}
+
+// Open opens the file at the specified path.
+func (fs *FS) Open(path string) (vfs.File, *kernel.Error) {
+	e, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.multi {
+		return nil, errMultiExtentFiles
+	}
+
+	return &file{fs: fs, entry: e}, nil
+}
+
+// Stat returns information about the file at the specified path.
+func (fs *FS) Stat(path string) (vfs.FileInfo, *kernel.Error) {
+	e, err := fs.lookup(path)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+
+	return e.info, nil
+}
+
+// ReadDir returns the contents of the directory at the specified path in
+// the order they are stored on the volume.
+func (fs *FS) ReadDir(path string) ([]vfs.FileInfo, *kernel.Error) {
+	e, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.readDir(e)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]vfs.FileInfo, len(entries))
+	for i, child := range entries {
+		list[i] = child.info
+	}
+
+	return list, nil
+}
+
+// lookup resolves a path relative to the filesystem root, following any
+// symbolic links.
+func (fs *FS) lookup(path string) (entry, *kernel.Error) {
+	stack, err := fs.walk([]entry{fs.root}, path, 0)
+	if err != nil {
+		return entry{}, err
+	}
+
+	return stack[len(stack)-1], nil
+}
+
+// walk resolves a path relative to the directory at the top of stack which
+// contains the directories leading to it. Absolute paths and link targets are
+// resolved relative to the filesystem root. It returns the stack of entries
+// leading to the resolved entry.
+func (fs *FS) walk(stack []entry, path string, depth int) ([]entry, *kernel.Error) {
+	if strings.HasPrefix(path, "/") {
+		stack = stack[:1]
+	}
+
+	for _, elem := range strings.Split(path, "/") {
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+
+		cur := stack[len(stack)-1]
+		entries, err := fs.readDir(cur)
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			next  entry
+			found bool
+		)
+		for _, child := range entries {
+			if child.info.Name == elem {
+				next, found = child, true
+				break
+			}
+		}
+		if !found {
+			return nil, vfs.ErrNotFound
+		}
+
+		if next.info.Mode&vfs.ModeSymlink != 0 {
+			if depth == maxLinkDepth {
+				return nil, errTooManyLinks
+			}
+
+			if stack, err = fs.walk(stack, next.target, depth+1); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		stack = append(stack, next)
+	}
+
+	return stack, nil
+}
+
+// readDir returns the entries of a directory, skipping the "." and ".."
+// records.
+func (fs *FS) readDir(dir entry) ([]entry, *kernel.Error) {
+	if dir.info.Mode&vfs.ModeDir == 0 {
+		return nil, vfs.ErrNotDir
+	}
+
+	data := make([]byte, dir.size)
+	if err := fs.readAt(data, int64(dir.extent)*int64(fs.blockSize)); err != nil {
+		return nil, err
+	}
+
+	var entries []entry
+	for offset := uint32(0); offset < dir.size; {
+		// Records do not cross block boundaries; a zero length
+		// indicates that the rest of the block is unused.
+		length := uint32(data[offset+recLen])
+		if length == 0 {
+			offset = (offset/fs.blockSize + 1) * fs.blockSize
+			continue
+		}
+
+		if offset+length > dir.size {
+			return nil, errBadDirRecord
+		}
+
+		rec := data[offset : offset+length]
+		offset += length
+
+		e, ok := parseRecord(rec)
+		if !ok {
+			return nil, errBadDirRecord
+		}
+
+		// Skip the records for the directory itself and its parent
+		if nameLen := rec[recNameLen]; nameLen == 1 && rec[recName] <= 1 {
+			continue
+		}
+
+		if fs.rockRidge {
+			if err := fs.parseSystemUse(&e, systemUseArea(rec, fs.suspSkip)); err != nil {
+				return nil, err
+			}
+		}
+
+		// Only the last record of a multi-extent file has the flag
+		// cleared; the preceding records are dropped.
+		if n := len(entries); n != 0 && entries[n-1].multi && entries[n-1].info.Name == e.info.Name {
+			entries[n-1] = e
+			entries[n-1].multi = true
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// parseRecord decodes the fields of a directory record that are common to all
+// ISO9660 volumes.
+func parseRecord(rec []byte) (entry, bool) {
+	if len(rec) < recName || int(rec[recLen]) > len(rec) || int(rec[recLen]) < recName+int(rec[recNameLen]) {
+		return entry{}, false
+	}
+
+	e := entry{
+		extent: binary.LittleEndian.Uint32(rec[recExtent:]) + uint32(rec[recExtAttr]),
+		size:   binary.LittleEndian.Uint32(rec[recSize:]),
+		multi:  rec[recFlags]&recFlagMulti != 0,
+	}
+
+	name := string(rec[recName : recName+int(rec[recNameLen])])
+	if rec[recFlags]&recFlagDir != 0 {
+		e.info.Mode = vfs.ModeDir | defaultDirPerm
+	} else {
+		e.info.Mode = defaultFilePerm
+		e.info.Size = int64(e.size)
+
+		// Strip the version suffix and the trailing separator of
+		// file names without an extension.
+		if index := strings.IndexByte(name, ';'); index != -1 {
+			name = name[:index]
+		}
+		name = strings.TrimSuffix(name, ".")
+	}
+	e.info.Name = strings.ToLower(name)
+
+	return e, true
+}
+
+// systemUseArea returns the system use area that follows the name of a
+// directory record.
+func systemUseArea(rec []byte, skip int) []byte {
+	start := recName + int(rec[recNameLen])
+	if start%2 != 0 {
+		start++
+	}
+	start += skip
+
+	if start >= len(rec) {
+		return nil
+	}
+
+	return rec[start:]
+}
+
+// parseSystemUse applies the Rock Ridge entries in a system use area to e. A
+// CE entry points to a continuation area which is processed once the current
+// area has been parsed; up to maxContinuations areas are followed.
+func (fs *FS) parseSystemUse(e *entry, area []byte) *kernel.Error {
+	var (
+		name    []byte
+		hasName bool
+		link    []string
+		linkCnt bool
+	)
+
+	for depth := 0; area != nil; depth++ {
+		var cont []byte
+
+		for len(area) >= suspHdrLen {
+			length := int(area[2])
+			if length < suspHdrLen || length > len(area) {
+				break
+			}
+			sig, data := string(area[:2]), area[suspHdrLen:length]
+			area = area[length:]
+
+			switch sig {
+			case "PX":
+				if len(data) < 4 {
+					return errBadDirRecord
+				}
+				mode := binary.LittleEndian.Uint32(data)
+				e.info.Mode = vfs.Mode(mode) & vfs.ModePerm
+				switch mode & posixTypeMask {
+				case posixTypeDir:
+					e.info.Mode |= vfs.ModeDir
+				case posixTypeSymlink:
+					e.info.Mode |= vfs.ModeSymlink
+				}
+			case "NM":
+				if len(data) < 1 {
+					return errBadDirRecord
+				}
+				if data[0]&(nmFlagCurrent|nmFlagParent) == 0 {
+					name, hasName = append(name, data[1:]...), true
+				}
+			case "SL":
+				// Components may continue across SL entries
+				for comps := data[1:]; len(comps) >= 2; {
+					flags, compLen := comps[0], int(comps[1])
+					if 2+compLen > len(comps) {
+						return errBadDirRecord
+					}
+
+					var comp string
+					switch {
+					case flags&slFlagRoot != 0:
+						comp = "/"
+					case flags&slFlagCurrent != 0:
+						comp = "."
+					case flags&slFlagParent != 0:
+						comp = ".."
+					default:
+						comp = string(comps[2 : 2+compLen])
+					}
+
+					if linkCnt && len(link) != 0 {
+						link[len(link)-1] += comp
+					} else {
+						link = append(link, comp)
+					}
+					linkCnt = flags&slFlagContinue != 0
+					comps = comps[2+compLen:]
+				}
+			case "CE":
+				if len(data) < 24 {
+					return errBadDirRecord
+				}
+
+				var (
+					block  = binary.LittleEndian.Uint32(data[0:])
+					offset = binary.LittleEndian.Uint32(data[8:])
+					size   = binary.LittleEndian.Uint32(data[16:])
+				)
+				cont = make([]byte, size)
+				if err := fs.readAt(cont, int64(block)*int64(fs.blockSize)+int64(offset)); err != nil {
+					return err
+				}
+			case "ST":
+				area = nil
+			}
+		}
+
+		area = nil
+		if depth < maxContinuations {
+			area = cont
+		}
+	}
+
+	if hasName {
+		e.info.Name = string(name)
+	}
+
+	if len(link) != 0 {
+		if link[0] == "/" {
+			e.target = "/" + strings.Join(link[1:], "/")
+		} else {
+			e.target = strings.Join(link, "/")
+		}
+		e.info.Size = int64(len(e.target))
+	}
+
+	return nil
+}
+
+// readAt fills buf with the device contents starting at the specified byte
+// offset.
+func (fs *FS) readAt(buf []byte, offset int64) *kernel.Error {
+	var (
+		sectorSize = int64(fs.dev.SectorSize())
+		scratch    []byte
+	)
+
+	if end := offset + int64(len(buf)); end < offset || uint64(end) > fs.dev.SectorCount()*uint64(sectorSize) {
+		return errOutOfRange
+	}
+
+	for len(buf) != 0 {
+		lba, skip := offset/sectorSize, offset%sectorSize
+
+		// Read whole sectors directly into the buffer and use a
+		// scratch sector for partial ones.
+		if count := int64(len(buf)) / sectorSize; skip == 0 && count != 0 {
+			if err := fs.dev.ReadSectors(uint64(lba), uint32(count), buf); err != nil {
+				return err
+			}
+			buf = buf[count*sectorSize:]
+			offset += count * sectorSize
+			continue
+		}
+
+		if scratch == nil {
+			scratch = make([]byte, sectorSize)
+		}
+		if err := fs.dev.ReadSectors(uint64(lba), 1, scratch); err != nil {
+			return err
+		}
+
+		n := copy(buf, scratch[skip:])
+		buf = buf[n:]
+		offset += int64(n)
+	}
+
+	return nil
+}
+
+// file is an open file on an ISO9660 volume.
+type file struct {
+	fs     *FS
+	entry  entry
+	offset int64
+}
+
+// Read reads up to len(buf) bytes from the current file offset.
+func (f *file) Read(buf []byte) (int, *kernel.Error) {
+	if f.entry.info.Mode.IsDir() {
+		return 0, vfs.ErrIsDir
+	}
+
+	remaining := int64(f.entry.size) - f.offset
+	if remaining <= 0 {
+		return 0, nil
+	}
+	if int64(len(buf)) > remaining {
+		buf = buf[:remaining]
+	}
+
+	if err := f.fs.readAt(buf, int64(f.entry.extent)*int64(f.fs.blockSize)+f.offset); err != nil {
+		return 0, err
+	}
+
+	f.offset += int64(len(buf))
+	return len(buf), nil
+}
+
+// Write always fails as the filesystem is read-only.
+func (f *file) Write(_ []byte) (int, *kernel.Error) {
+	return 0, vfs.ErrReadOnly
+}
+
+// Lseek sets the file offset relative to whence.
+func (f *file) Lseek(offset int64, whence int) (int64, *kernel.Error) {
+	switch whence {
+	case vfs.SeekCurrent:
+		offset += f.offset
+	case vfs.SeekEnd:
+		offset += int64(f.entry.size)
+	case vfs.SeekStart:
+	default:
+		return 0, vfs.ErrInvalidSeek
+	}
+
+	if offset < 0 {
+		return 0, vfs.ErrInvalidSeek
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+// Stat returns information about the file.
+func (f *file) Stat() (vfs.FileInfo, *kernel.Error) {
+	return f.entry.info, nil
+}
+
+// Close releases the file.
+func (f *file) Close() *kernel.Error {
+	return nil
+}
+
+func init() {
+	initcall.Register(initcall.LevelLate, Init)
+}
+
+// Init mounts the first ISO9660 volume found on a registered block device at
+// MountPoint. It must be invoked after the hardware has been detected.
+func Init() *kernel.Error {
+	for _, dev := range blockDevicesFn() {
+		fs, err := New(dev)
+		if err != nil {
+			continue
+		}
+
+		if err = mountFn(MountPoint, fs); err != nil {
+			return err
+		}
+
+		kfmt.Printf("[iso9660] mounted volume %s from %s at %s\n", fs.volumeID, dev.Name(), MountPoint)
+		return nil
+	}
+
+	return nil
+}
@@ -0,0 +1,471 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopheros/device/blockdev"
+	"gopheros/kernel"
+	"gopheros/kernel/vfs"
+	"strings"
+	"testing"
+)
+
+// memDisk is a device backed by an in-memory image.
+type memDisk struct {
+	sectorSize uint32
+	data       []byte
+}
+
+func (d *memDisk) SectorSize() uint32  { return d.sectorSize }
+func (d *memDisk) SectorCount() uint64 { return uint64(len(d.data)) / uint64(d.sectorSize) }
+
+func (d *memDisk) ReadSectors(lba uint64, count uint32, buf []byte) *kernel.Error {
+	start := lba * uint64(d.sectorSize)
+	copy(buf[:count*d.sectorSize], d.data[start:])
+	return nil
+}
+
+// image assembles an ISO9660 volume with 2048-byte logical blocks.
+type image struct {
+	data []byte
+}
+
+func newImage(blocks int) *image {
+	img := &image{data: make([]byte, blocks*descSectorSize)}
+
+	pvd := img.block(firstDescSector)
+	pvd[0] = descTypePrimary
+	copy(pvd[1:], descMagic)
+	copy(pvd[pvdVolumeID:pvdVolumeID+pvdVolumeIDLen], "GOPHEROS                        ")
+	binary.LittleEndian.PutUint16(pvd[pvdBlockSize:], descSectorSize)
+
+	term := img.block(firstDescSector + 1)
+	term[0] = descTypeEnd
+	copy(term[1:], descMagic)
+
+	return img
+}
+
+func (img *image) block(index int) []byte {
+	return img.data[index*descSectorSize : (index+1)*descSectorSize]
+}
+
+// setRoot stores the root directory record in the primary volume descriptor.
+func (img *image) setRoot(extent, size uint32) {
+	copy(img.block(firstDescSector)[pvdRootDirEntry:], record("\x00", extent, size, recFlagDir, nil))
+}
+
+// setDir stores a list of directory records starting at the specified block.
+// Records that do not fit in the current block are moved to the next one.
+func (img *image) setDir(index int, records ...[]byte) uint32 {
+	offset := index * descSectorSize
+	for _, rec := range records {
+		if offset%descSectorSize+len(rec) > descSectorSize {
+			offset = (offset/descSectorSize + 1) * descSectorSize
+		}
+		offset += copy(img.data[offset:], rec)
+	}
+
+	return uint32(offset - index*descSectorSize)
+}
+
+func record(name string, extent, size uint32, flags uint8, su []byte) []byte {
+	length := recName + len(name)
+	if length%2 != 0 {
+		length++
+	}
+	rec := make([]byte, length+len(su))
+	rec[recLen] = uint8(len(rec))
+	binary.LittleEndian.PutUint32(rec[recExtent:], extent)
+	binary.BigEndian.PutUint32(rec[recExtent+4:], extent)
+	binary.LittleEndian.PutUint32(rec[recSize:], size)
+	binary.BigEndian.PutUint32(rec[recSize+4:], size)
+	rec[recFlags] = flags
+	rec[recNameLen] = uint8(len(name))
+	copy(rec[recName:], name)
+	copy(rec[length:], su)
+	return rec
+}
+
+func suspEntry(sig string, data ...byte) []byte {
+	return append([]byte{sig[0], sig[1], uint8(suspHdrLen + len(data)), 1}, data...)
+}
+
+func spEntry() []byte {
+	return suspEntry("SP", 0xbe, 0xef, 0)
+}
+
+func pxEntry(mode uint32) []byte {
+	data := make([]byte, 32)
+	binary.LittleEndian.PutUint32(data, mode)
+	binary.BigEndian.PutUint32(data[4:], mode)
+	return suspEntry("PX", data...)
+}
+
+func nmEntry(flags uint8, name string) []byte {
+	return suspEntry("NM", append([]byte{flags}, name...)...)
+}
+
+func ceEntry(block, offset, size uint32) []byte {
+	data := make([]byte, 24)
+	binary.LittleEndian.PutUint32(data[0:], block)
+	binary.LittleEndian.PutUint32(data[8:], offset)
+	binary.LittleEndian.PutUint32(data[16:], size)
+	return suspEntry("CE", data...)
+}
+
+// slEntry encodes a symlink target; components with a trailing "+" are
+// continued by the next component.
+func slEntry(comps ...string) []byte {
+	data := []byte{0}
+	for _, comp := range comps {
+		var flags uint8
+		if strings.HasSuffix(comp, "+") {
+			flags, comp = slFlagContinue, strings.TrimSuffix(comp, "+")
+		}
+
+		switch comp {
+		case "/":
+			data = append(data, flags|slFlagRoot, 0)
+		case ".":
+			data = append(data, flags|slFlagCurrent, 0)
+		case "..":
+			data = append(data, flags|slFlagParent, 0)
+		default:
+			data = append(append(data, flags, uint8(len(comp))), comp...)
+		}
+	}
+	return suspEntry("SL", data...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// plainImage returns a volume without Rock Ridge entries.
+func plainImage() *image {
+	img := newImage(24)
+	copy(img.block(20), "welcome to gopher-os\n")
+	copy(img.block(21), "\x7fELF")
+
+	// The second root directory block contains the boot directory
+	rootSize := uint32(2 * descSectorSize)
+	img.setRoot(18, rootSize)
+	img.setDir(18,
+		record("\x00", 18, rootSize, recFlagDir, nil),
+		record("\x01", 18, rootSize, recFlagDir, nil),
+		record("MOTD.TXT;1", 20, 21, 0, nil),
+		record(strings.Repeat("X", 200), 0, 0, 0, nil),
+		record(strings.Repeat("Y", 200), 0, 0, 0, nil),
+		record(strings.Repeat("Z", 200), 0, 0, 0, nil),
+		record(strings.Repeat("W", 200), 0, 0, 0, nil),
+		record(strings.Repeat("V", 200), 0, 0, 0, nil),
+		record(strings.Repeat("U", 200), 0, 0, 0, nil),
+		record(strings.Repeat("T", 200), 0, 0, 0, nil),
+		record(strings.Repeat("S", 200), 0, 0, 0, nil),
+		record("BOOT", 22, descSectorSize, recFlagDir, nil),
+		record("BIG.DAT;1", 20, 1, recFlagMulti, nil),
+		record("BIG.DAT;1", 21, 1, 0, nil),
+	)
+	img.setDir(22,
+		record("\x00", 22, descSectorSize, recFlagDir, nil),
+		record("\x01", 18, rootSize, recFlagDir, nil),
+		record("KERNEL.;1", 21, 4, 0, nil),
+	)
+
+	return img
+}
+
+func TestPlainVolume(t *testing.T) {
+	dev := &memDisk{sectorSize: 512, data: plainImage().data}
+	fs, err := New(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fs.RockRidge() {
+		t.Fatal("expected Rock Ridge extensions to be disabled")
+	}
+	if exp, got := "GOPHEROS", fs.VolumeID(); got != exp {
+		t.Fatalf("expected volume ID to be %q; got %q", exp, got)
+	}
+
+	specs := []struct {
+		path    string
+		expMode vfs.Mode
+		expData string
+		expErr  *kernel.Error
+	}{
+		{"/", vfs.ModeDir | defaultDirPerm, "", nil},
+		{"/motd.txt", defaultFilePerm, "welcome to gopher-os\n", nil},
+		{"/boot/kernel", defaultFilePerm, "\x7fELF", nil},
+		{"boot/../boot/./kernel", defaultFilePerm, "\x7fELF", nil},
+		{"/../motd.txt", defaultFilePerm, "welcome to gopher-os\n", nil},
+		{"/MOTD.TXT", 0, "", vfs.ErrNotFound},
+		{"/motd.txt/foo", 0, "", vfs.ErrNotDir},
+		{"/big.dat", 0, "", errMultiExtentFiles},
+	}
+
+	for specIndex, spec := range specs {
+		f, err := fs.Open(spec.path)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected to get error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		info, _ := f.Stat()
+		if info.Mode != spec.expMode {
+			t.Errorf("[spec %d] expected mode %o; got %o", specIndex, spec.expMode, info.Mode)
+		}
+
+		if spec.expMode.IsDir() {
+			if _, err = f.Read(make([]byte, 1)); err != vfs.ErrIsDir {
+				t.Errorf("[spec %d] expected to get ErrIsDir; got %v", specIndex, err)
+			}
+			continue
+		}
+
+		buf := make([]byte, 64)
+		n, _ := f.Read(buf)
+		if got := string(buf[:n]); got != spec.expData {
+			t.Errorf("[spec %d] expected to read %q; got %q", specIndex, spec.expData, got)
+		}
+		_ = f.Close()
+	}
+
+	list, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 11 || list[0].Name != "motd.txt" || list[0].Size != 21 || list[9].Name != "boot" || list[10].Name != "big.dat" {
+		t.Fatalf("unexpected root directory contents: %v", list)
+	}
+
+	if _, err = fs.ReadDir("/missing"); err != vfs.ErrNotFound {
+		t.Fatalf("expected to get ErrNotFound; got %v", err)
+	}
+}
+
+func TestRockRidgeVolume(t *testing.T) {
+	img := newImage(26)
+	copy(img.data[20*descSectorSize:], strings.Repeat("a", descSectorSize)+"bc")
+	copy(img.block(23), "#!/bin/init\n")
+
+	// The name of the script continues in a continuation area
+	copy(img.block(24)[100:], concat(nmEntry(0, "me.sh"), suspEntry("ST"), nmEntry(0, "ignored")))
+
+	rootSize := uint32(descSectorSize)
+	img.setRoot(18, rootSize)
+	img.setDir(18,
+		record("\x00", 18, rootSize, recFlagDir, concat(spEntry(), pxEntry(0040700))),
+		record("\x01", 18, rootSize, recFlagDir, concat(pxEntry(0040700), nmEntry(nmFlagParent, ""))),
+		record("DATA.BIN;1", 20, descSectorSize+2, 0, concat(pxEntry(0100640), nmEntry(0, "Data.bin"))),
+		record("BIN", 22, descSectorSize, recFlagDir, concat(pxEntry(0040755), nmEntry(0, "bin"))),
+		record("SBIN", 0, 0, 0, concat(pxEntry(0120777), nmEntry(0, "sbin"), slEntry("/", "bin"))),
+		record("LOOP", 0, 0, 0, concat(pxEntry(0120777), nmEntry(0, "loop"), slEntry(".", "loop"))),
+		record("DATA", 0, 0, 0, concat(pxEntry(0120777), nmEntry(0, "data"), slEntry("Data+", ".bin"))),
+	)
+	img.setDir(22,
+		record("\x00", 22, descSectorSize, recFlagDir, pxEntry(0040755)),
+		record("\x01", 18, rootSize, recFlagDir, pxEntry(0040700)),
+		record("RUN_ME.SH;1", 23, 12, 0, concat(pxEntry(0100755), ceEntry(24, 100, 64), nmEntry(nmFlagContinue, "run-"))),
+		record("UP", 0, 0, 0, concat(pxEntry(0120777), nmEntry(0, "up"), slEntry("..", "data"))),
+	)
+
+	dev := &memDisk{sectorSize: 2048, data: img.data}
+	fs, err := New(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fs.RockRidge() {
+		t.Fatal("expected Rock Ridge extensions to be enabled")
+	}
+
+	specs := []struct {
+		path    string
+		expMode vfs.Mode
+		expSize int64
+		expErr  *kernel.Error
+	}{
+		{"/", vfs.ModeDir | 0700, 0, nil},
+		{"/Data.bin", 0640, descSectorSize + 2, nil},
+		{"/data", 0640, descSectorSize + 2, nil},
+		{"/bin/run-me.sh", 0755, 12, nil},
+		{"/sbin/run-me.sh", 0755, 12, nil},
+		{"/bin/up", 0640, descSectorSize + 2, nil},
+		{"/sbin/up", 0640, descSectorSize + 2, nil},
+		{"/loop", 0, 0, errTooManyLinks},
+		{"/DATA.BIN", 0, 0, vfs.ErrNotFound},
+	}
+
+	for specIndex, spec := range specs {
+		info, err := fs.Stat(spec.path)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected to get error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+		if err == nil && (info.Mode != spec.expMode || info.Size != spec.expSize) {
+			t.Errorf("[spec %d] expected mode %o and size %d; got %o and %d", specIndex, spec.expMode, spec.expSize, info.Mode, info.Size)
+		}
+	}
+
+	list, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 5 || list[3].Name != "loop" || list[3].Mode != vfs.ModeSymlink|0777 || list[3].Size != len64("./loop") {
+		t.Fatalf("unexpected root directory contents: %v", list)
+	}
+
+	t.Run("read and seek", func(t *testing.T) {
+		f, err := fs.Open("/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Reads spanning a block boundary
+		if _, err = f.Lseek(-4, vfs.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 8)
+		if n, _ := f.Read(buf); string(buf[:n]) != "aabc" {
+			t.Fatalf("expected to read %q; got %q", "aabc", buf[:n])
+		}
+		if n, err := f.Read(buf); n != 0 || err != nil {
+			t.Fatalf("expected to read 0 bytes at EOF; got %d, %v", n, err)
+		}
+
+		if off, _ := f.Lseek(-descSectorSize, vfs.SeekCurrent); off != 2 {
+			t.Fatalf("expected offset 2; got %d", off)
+		}
+		if _, err = f.Lseek(-1, vfs.SeekStart); err != vfs.ErrInvalidSeek {
+			t.Fatalf("expected to get ErrInvalidSeek; got %v", err)
+		}
+		if _, err = f.Lseek(0, 42); err != vfs.ErrInvalidSeek {
+			t.Fatalf("expected to get ErrInvalidSeek; got %v", err)
+		}
+		if _, err = f.Write([]byte("x")); err != vfs.ErrReadOnly {
+			t.Fatalf("expected to get ErrReadOnly; got %v", err)
+		}
+	})
+}
+
+func len64(s string) int64 {
+	return int64(len(s))
+}
+
+func TestNewErrors(t *testing.T) {
+	t.Run("bad sector size", func(t *testing.T) {
+		if _, err := New(&memDisk{sectorSize: 4096, data: plainImage().data}); err != errBadBlockSize {
+			t.Fatalf("expected to get errBadBlockSize; got %v", err)
+		}
+	})
+
+	t.Run("missing volume descriptor", func(t *testing.T) {
+		for _, data := range [][]byte{
+			make([]byte, 8*descSectorSize),
+			make([]byte, 20*descSectorSize),
+		} {
+			if _, err := New(&memDisk{sectorSize: 512, data: data}); err != errNotISO9660 {
+				t.Fatalf("expected to get errNotISO9660; got %v", err)
+			}
+		}
+
+		// The primary volume descriptor follows the terminator
+		img := plainImage()
+		copy(img.data[firstDescSector*descSectorSize:], img.block(firstDescSector+1))
+		if _, err := New(&memDisk{sectorSize: 512, data: img.data}); err != errNotISO9660 {
+			t.Fatalf("expected to get errNotISO9660; got %v", err)
+		}
+	})
+
+	t.Run("bad logical block size", func(t *testing.T) {
+		img := plainImage()
+		binary.LittleEndian.PutUint16(img.block(firstDescSector)[pvdBlockSize:], 1000)
+		if _, err := New(&memDisk{sectorSize: 512, data: img.data}); err != errBadBlockSize {
+			t.Fatalf("expected to get errBadBlockSize; got %v", err)
+		}
+	})
+
+	t.Run("bad root record", func(t *testing.T) {
+		img := plainImage()
+		img.block(firstDescSector)[pvdRootDirEntry+recFlags] = 0
+		if _, err := New(&memDisk{sectorSize: 512, data: img.data}); err != errBadDirRecord {
+			t.Fatalf("expected to get errBadDirRecord; got %v", err)
+		}
+	})
+
+	t.Run("root extent out of range", func(t *testing.T) {
+		img := newImage(18)
+		img.setRoot(100, descSectorSize)
+		if _, err := New(&memDisk{sectorSize: 512, data: img.data}); err != errOutOfRange {
+			t.Fatalf("expected to get errOutOfRange; got %v", err)
+		}
+	})
+
+	t.Run("malformed directory", func(t *testing.T) {
+		img := newImage(20)
+		img.setRoot(18, descSectorSize)
+		img.setDir(18,
+			record("\x00", 18, descSectorSize, recFlagDir, nil),
+			[]byte{recName - 1},
+		)
+		fs, err := New(&memDisk{sectorSize: 512, data: img.data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fs.ReadDir("/"); err != errBadDirRecord {
+			t.Fatalf("expected to get errBadDirRecord; got %v", err)
+		}
+	})
+}
+
+func TestMount(t *testing.T) {
+	defer func() {
+		mountFn = vfs.Mount
+		blockDevicesFn = blockdev.Devices
+	}()
+
+	var mounted []string
+	mountFn = func(path string, _ vfs.FileSystem) *kernel.Error {
+		mounted = append(mounted, path)
+		return nil
+	}
+
+	if err := Mount("/mnt", &memDisk{sectorSize: 512, data: make([]byte, 4096)}); err != errNotISO9660 {
+		t.Fatalf("expected to get errNotISO9660; got %v", err)
+	}
+	if err := Mount("/mnt", &memDisk{sectorSize: 512, data: plainImage().data}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Init mounts the first device with a valid volume
+	devs := []*blockdev.Device{
+		blockdev.Register("sr", &memDisk{sectorSize: 512, data: make([]byte, 64*descSectorSize)}),
+		blockdev.Register("sr", &memDisk{sectorSize: 512, data: plainImage().data}),
+		blockdev.Register("sr", &memDisk{sectorSize: 512, data: plainImage().data}),
+	}
+	blockDevicesFn = func() []*blockdev.Device { return devs }
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounted) != 2 || mounted[1] != MountPoint {
+		t.Fatalf("expected volume to be mounted at %s; got %v", MountPoint, mounted)
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "mount failed"}
+	mountFn = func(_ string, _ vfs.FileSystem) *kernel.Error { return expErr }
+	if err := Init(); err != expErr {
+		t.Fatalf("expected to get %v; got %v", expErr, err)
+	}
+
+	blockDevicesFn = func() []*blockdev.Device { return nil }
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+}
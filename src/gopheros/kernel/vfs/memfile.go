@@ -0,0 +1,67 @@
+package vfs
+
+import "gopheros/kernel"
+
+// memFile is a read-only File whose contents are stored in memory.
+type memFile struct {
+	info   FileInfo
+	data   []byte
+	offset int64
+}
+
+// NewReadOnlyFile returns a File that reads its contents from data. Reads
+// fail with ErrIsDir if info describes a directory and writes always fail
+// with ErrReadOnly. The returned file does not copy data.
+func NewReadOnlyFile(info FileInfo, data []byte) File {
+	return &memFile{info: info, data: data}
+}
+
+// Read reads up to len(buf) bytes from the current file offset.
+func (f *memFile) Read(buf []byte) (int, *kernel.Error) {
+	if f.info.Mode.IsDir() {
+		return 0, ErrIsDir
+	}
+
+	if f.offset >= int64(len(f.data)) {
+		return 0, nil
+	}
+
+	n := copy(buf, f.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+// Write always fails as the file is read-only.
+func (f *memFile) Write(_ []byte) (int, *kernel.Error) {
+	return 0, ErrReadOnly
+}
+
+// Lseek sets the file offset relative to whence.
+func (f *memFile) Lseek(offset int64, whence int) (int64, *kernel.Error) {
+	switch whence {
+	case SeekCurrent:
+		offset += f.offset
+	case SeekEnd:
+		offset += int64(len(f.data))
+	case SeekStart:
+	default:
+		return 0, ErrInvalidSeek
+	}
+
+	if offset < 0 {
+		return 0, ErrInvalidSeek
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+// Stat returns information about the file.
+func (f *memFile) Stat() (FileInfo, *kernel.Error) {
+	return f.info, nil
+}
+
+// Close releases the file.
+func (f *memFile) Close() *kernel.Error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package vfs
+
+import (
+	"gopheros/kernel"
+	"testing"
+)
+
+func TestReadOnlyFile(t *testing.T) {
+	f := NewReadOnlyFile(FileInfo{Name: "motd", Size: 21}, []byte("welcome to gopher-os\n"))
+	defer f.Close()
+
+	specs := []struct {
+		offset    int64
+		whence    int
+		expOffset int64
+		expErr    *kernel.Error
+		expData   string
+	}{
+		{11, SeekStart, 11, nil, "gopher"},
+		{1, SeekCurrent, 18, nil, "os\n"},
+		{-3, SeekEnd, 18, nil, "os\n"},
+		{100, SeekStart, 100, nil, ""},
+		{-1, SeekStart, 0, ErrInvalidSeek, ""},
+		{0, 42, 0, ErrInvalidSeek, ""},
+	}
+
+	for specIndex, spec := range specs {
+		offset, err := f.Lseek(spec.offset, spec.whence)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if offset != spec.expOffset {
+			t.Errorf("[spec %d] expected offset %d; got %d", specIndex, spec.expOffset, offset)
+		}
+
+		buf := make([]byte, len(spec.expData))
+		if n, _ := f.Read(buf); string(buf[:n]) != spec.expData {
+			t.Errorf("[spec %d] expected to read %q; got %q", specIndex, spec.expData, buf[:n])
+		}
+	}
+
+	if _, err := f.Write([]byte("x")); err != ErrReadOnly {
+		t.Fatalf("expected error %v; got %v", ErrReadOnly, err)
+	}
+
+	if info, _ := f.Stat(); info.Name != "motd" {
+		t.Fatalf("expected file name motd; got %q", info.Name)
+	}
+
+	dir := NewReadOnlyFile(FileInfo{Name: "etc", Mode: ModeDir}, nil)
+	if _, err := dir.Read(make([]byte, 1)); err != ErrIsDir {
+		t.Fatalf("expected error %v; got %v", ErrIsDir, err)
+	}
+}
@@ -0,0 +1,200 @@
+package vfs
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/sync"
+)
+
+// pipeBufSize is the capacity of a pipe. Writes of up to pipeBufSize bytes are
+// atomic: their data is never interleaved with data from other writers.
+const pipeBufSize = 4096
+
+var (
+	// ErrBrokenPipe is returned when writing to a pipe whose read end has
+	// been closed.
+	ErrBrokenPipe = &kernel.Error{Module: "vfs", Message: "broken pipe", Code: kernel.CodeBrokenPipe}
+)
+
+// pipe is a unidirectional channel with a bounded buffer that connects a
+// reader and a writer end.
+type pipe struct {
+	buf []byte
+
+	readerClosed, writerClosed bool
+
+	// waiters contains the threads that are blocked reading from or
+	// writing to the pipe and blocked tracks their count so that wake-ups
+	// can be skipped while no thread is blocked.
+	waiters sync.WaitQueue
+	blocked int
+}
+
+// NewPipe returns the read and write ends of a new anonymous pipe.
+//
+// Reads block until data is available and return 0 once the write end has been
+// closed and the buffer has been drained. Writes block while the buffer is full
+// and fail with ErrBrokenPipe once the read end has been closed. Both ends
+// implement Pollable.
+func NewPipe() (File, File) {
+	p := &pipe{buf: make([]byte, 0, pipeBufSize)}
+	return &pipeReader{p: p}, &pipeWriter{p: p}
+}
+
+// wait blocks the calling thread until cond returns true.
+func (p *pipe) wait(cond func() bool) {
+	p.blocked++
+	waitFn(&p.waiters, cond)
+	p.blocked--
+}
+
+// wake notifies blocked readers, writers and pollers about a change in the
+// state of the pipe.
+func (p *pipe) wake() {
+	if p.blocked != 0 {
+		wakeAllFn(&p.waiters)
+	}
+	NotifyPoll()
+}
+
+// pipeEnd implements the File methods shared by both ends of a pipe.
+type pipeEnd struct {
+	p      *pipe
+	closed bool
+}
+
+// Lseek always fails as pipes are not seekable.
+func (e *pipeEnd) Lseek(_ int64, _ int) (int64, *kernel.Error) {
+	return 0, ErrInvalidSeek
+}
+
+// Stat returns information about the pipe.
+func (e *pipeEnd) Stat() (FileInfo, *kernel.Error) {
+	return FileInfo{Name: "pipe", Size: int64(len(e.p.buf)), Mode: ModePipe | 0600}, nil
+}
+
+// pipeReader is the read end of a pipe.
+type pipeReader struct {
+	pipeEnd
+}
+
+// Read blocks until data is available or the write end is closed.
+func (r *pipeReader) Read(buf []byte) (int, *kernel.Error) {
+	if r.closed {
+		return 0, ErrBadFD
+	}
+
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	p := r.p
+	p.wait(func() bool { return len(p.buf) != 0 || p.writerClosed })
+
+	n := copy(buf, p.buf)
+	if n != 0 {
+		p.buf = p.buf[:copy(p.buf, p.buf[n:])]
+		p.wake()
+	}
+
+	return n, nil
+}
+
+// Write always fails as the read end of a pipe is not writable.
+func (r *pipeReader) Write(_ []byte) (int, *kernel.Error) {
+	return 0, ErrBadFD
+}
+
+// Poll implements Pollable.
+func (r *pipeReader) Poll() Events {
+	var events Events
+	if len(r.p.buf) != 0 {
+		events |= PollIn
+	}
+	if r.p.writerClosed {
+		events |= PollHup
+	}
+	return events
+}
+
+// Close releases the read end. Subsequent writes to the pipe fail with
+// ErrBrokenPipe.
+func (r *pipeReader) Close() *kernel.Error {
+	if r.closed {
+		return ErrBadFD
+	}
+
+	r.closed, r.p.readerClosed = true, true
+	r.p.buf = r.p.buf[:0]
+	r.p.wake()
+	return nil
+}
+
+// pipeWriter is the write end of a pipe.
+type pipeWriter struct {
+	pipeEnd
+}
+
+// Read always fails as the write end of a pipe is not readable.
+func (w *pipeWriter) Read(_ []byte) (int, *kernel.Error) {
+	return 0, ErrBadFD
+}
+
+// Write copies data to the pipe, blocking while the buffer is full. It returns
+// the number of bytes written.
+func (w *pipeWriter) Write(data []byte) (int, *kernel.Error) {
+	if w.closed {
+		return 0, ErrBadFD
+	}
+
+	var (
+		p       = w.p
+		written int
+	)
+
+	for written < len(data) {
+		// Atomic writes wait until the whole payload fits
+		need := 1
+		if len(data) <= pipeBufSize {
+			need = len(data)
+		}
+		p.wait(func() bool { return pipeBufSize-len(p.buf) >= need || p.readerClosed })
+
+		if p.readerClosed {
+			return written, ErrBrokenPipe
+		}
+
+		n := len(data) - written
+		if free := pipeBufSize - len(p.buf); n > free {
+			n = free
+		}
+		p.buf = append(p.buf, data[written:written+n]...)
+		written += n
+		p.wake()
+	}
+
+	return written, nil
+}
+
+// Poll implements Pollable.
+func (w *pipeWriter) Poll() Events {
+	switch {
+	case w.p.readerClosed:
+		return PollErr
+	case len(w.p.buf) < pipeBufSize:
+		return PollOut
+	default:
+		return 0
+	}
+}
+
+// Close releases the write end. Once the buffered data has been consumed,
+// reads from the pipe return 0.
+func (w *pipeWriter) Close() *kernel.Error {
+	if w.closed {
+		return ErrBadFD
+	}
+
+	w.closed, w.p.writerClosed = true, true
+	w.p.wake()
+	return nil
+}
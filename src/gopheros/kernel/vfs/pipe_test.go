@@ -0,0 +1,140 @@
+package vfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPipe(t *testing.T) {
+	defer restoreWaitQueue()
+	mockWait(t, nil)
+
+	r, w := NewPipe()
+	rp, wp := r.(Pollable), w.(Pollable)
+
+	if rp.Poll() != 0 || wp.Poll() != PollOut {
+		t.Fatalf("unexpected initial readiness: 0x%x, 0x%x", rp.Poll(), wp.Poll())
+	}
+
+	if n, err := w.Write([]byte("gopher")); n != 6 || err != nil {
+		t.Fatalf("expected to write 6 bytes; got %d, %v", n, err)
+	}
+	if rp.Poll() != PollIn {
+		t.Fatal("expected the read end to be readable")
+	}
+
+	buf := make([]byte, 4)
+	for _, exp := range []string{"goph", "er"} {
+		n, err := r.Read(buf)
+		if err != nil || string(buf[:n]) != exp {
+			t.Fatalf("expected to read %q; got %q, %v", exp, buf[:n], err)
+		}
+	}
+	if n, err := r.Read(nil); n != 0 || err != nil {
+		t.Fatalf("expected empty reads to return immediately; got %d, %v", n, err)
+	}
+
+	// Readers block until data is written
+	mockWait(t, func() { _, _ = w.Write([]byte("x")) })
+	if n, err := r.Read(buf); n != 1 || err != nil || buf[0] != 'x' {
+		t.Fatalf("expected to read the data written while blocked; got %d, %v", n, err)
+	}
+
+	// Writers block while the pipe is full. Payloads larger than the
+	// buffer are written in chunks.
+	var (
+		payload = bytes.Repeat([]byte("0123456789abcdef"), pipeBufSize/8)
+		got     []byte
+		chunk   = make([]byte, 2*pipeBufSize)
+	)
+	readChunk := func() {
+		n, err := r.Read(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, chunk[:n]...)
+	}
+	mockWait(t, readChunk)
+	if n, err := w.Write(payload); n != len(payload) || err != nil {
+		t.Fatalf("expected to write %d bytes; got %d, %v", len(payload), n, err)
+	}
+	if wp.Poll() != 0 {
+		t.Fatal("expected the full pipe not to be writable")
+	}
+	if info, err := w.Stat(); err != nil || info.Mode&ModePipe == 0 || info.Size != pipeBufSize {
+		t.Fatalf("unexpected file info: %v, %v", info, err)
+	}
+	readChunk()
+	if !bytes.Equal(got, payload) {
+		t.Fatal("expected to read back the written payload")
+	}
+
+	// Small writes are atomic and wait until the whole payload fits
+	mockWait(t, nil)
+	_, _ = w.Write(make([]byte, pipeBufSize-2))
+	mockWait(t, readChunk)
+	if n, err := w.Write([]byte("abc")); n != 3 || err != nil {
+		t.Fatalf("expected to write 3 bytes; got %d, %v", n, err)
+	}
+
+	for _, f := range []File{r, w} {
+		if _, err := f.Lseek(0, SeekStart); err != ErrInvalidSeek {
+			t.Fatalf("expected to get ErrInvalidSeek; got %v", err)
+		}
+	}
+	if _, err := r.Write(nil); err != ErrBadFD {
+		t.Fatalf("expected to get ErrBadFD; got %v", err)
+	}
+	if _, err := w.Read(nil); err != ErrBadFD {
+		t.Fatalf("expected to get ErrBadFD; got %v", err)
+	}
+}
+
+func TestPipeClose(t *testing.T) {
+	defer restoreWaitQueue()
+	mockWait(t, nil)
+
+	// Closing the write end lets readers drain the buffer and then
+	// report EOF.
+	r, w := NewPipe()
+	_, _ = w.Write([]byte("bye"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r.(Pollable).Poll() != PollIn|PollHup {
+		t.Fatalf("expected the read end to report PollIn and PollHup; got 0x%x", r.(Pollable).Poll())
+	}
+
+	buf := make([]byte, 8)
+	for _, exp := range []string{"bye", ""} {
+		n, err := r.Read(buf)
+		if err != nil || string(buf[:n]) != exp {
+			t.Fatalf("expected to read %q; got %q, %v", exp, buf[:n], err)
+		}
+	}
+
+	if _, err := w.Write([]byte("x")); err != ErrBadFD {
+		t.Fatalf("expected to get ErrBadFD; got %v", err)
+	}
+	if err := w.Close(); err != ErrBadFD {
+		t.Fatalf("expected to get ErrBadFD; got %v", err)
+	}
+
+	// Closing the read end breaks the pipe
+	r, w = NewPipe()
+	_, _ = w.Write(make([]byte, pipeBufSize))
+	mockWait(t, func() { _ = r.Close() })
+	if n, err := w.Write([]byte("x")); n != 0 || err != ErrBrokenPipe {
+		t.Fatalf("expected to get ErrBrokenPipe; got %d, %v", n, err)
+	}
+	if w.(Pollable).Poll() != PollErr {
+		t.Fatalf("expected the write end to report PollErr; got 0x%x", w.(Pollable).Poll())
+	}
+
+	if _, err := r.Read(buf); err != ErrBadFD {
+		t.Fatalf("expected to get ErrBadFD; got %v", err)
+	}
+	if err := r.Close(); err != ErrBadFD {
+		t.Fatalf("expected to get ErrBadFD; got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package vfs
+
+import (
+	"gopheros/kernel/sync"
+	"gopheros/kernel/timer"
+)
+
+// Events is a set of readiness conditions reported by a Pollable.
+type Events uint32
+
+// The list of readiness conditions. The values match the poll event bits used
+// by Linux.
+const (
+	// PollIn indicates that a read does not block.
+	PollIn Events = 0x01
+
+	// PollOut indicates that a write does not block.
+	PollOut Events = 0x04
+
+	// PollErr indicates an error condition. It is always reported,
+	// regardless of the requested events.
+	PollErr Events = 0x08
+
+	// PollHup indicates that the remote end of a pipe, terminal or
+	// connection has been closed. It is always reported, regardless of
+	// the requested events.
+	PollHup Events = 0x10
+
+	// PollNval indicates that a PollItem does not refer to an open file.
+	PollNval Events = 0x20
+)
+
+// NoTimeout can be passed to Poll and Epoll.Wait to wait for events without a
+// time limit.
+const NoTimeout timer.Duration = -1
+
+// Pollable is implemented by files and sockets that can report whether an
+// operation would block.
+//
+// Implementations must call NotifyPoll each time their readiness changes so
+// that threads blocked in Poll and Epoll.Wait re-evaluate their conditions.
+type Pollable interface {
+	// Poll returns the conditions that are currently satisfied.
+	Poll() Events
+}
+
+// PollItem describes a source of events that is monitored by Poll.
+type PollItem struct {
+	// Source is the monitored object. Items with a nil Source report
+	// PollNval.
+	Source Pollable
+
+	// Events is the set of conditions that the caller is interested in.
+	Events Events
+
+	// Revents is populated by Poll with the conditions that are
+	// satisfied.
+	Revents Events
+}
+
+// alwaysReady is the Pollable for files that never block.
+type alwaysReady struct{}
+
+func (alwaysReady) Poll() Events { return PollIn | PollOut }
+
+var (
+	// pollQueue is woken up each time a Pollable changes its readiness.
+	// pollers tracks the number of threads that are blocked on pollQueue
+	// so that notifications can be skipped while nobody is polling.
+	pollQueue sync.WaitQueue
+	pollers   int
+
+	// The following functions are used by tests to mock calls to the
+	// sync and timer packages.
+	waitFn       = (*sync.WaitQueue).Wait
+	wakeAllFn    = (*sync.WaitQueue).WakeAll
+	timerAfterFn = timer.After
+	stopTimerFn  = (*timer.Timer).Stop
+)
+
+// AsPollable returns the Pollable for a file. Files that do not implement
+// Pollable, such as regular files, are always ready for reading and writing.
+func AsPollable(f File) Pollable {
+	if p, ok := f.(Pollable); ok {
+		return p
+	}
+
+	return alwaysReady{}
+}
+
+// NotifyPoll wakes up the threads that are blocked in Poll or Epoll.Wait so
+// that they re-evaluate the readiness of their sources. It never blocks and
+// may be invoked from interrupt handlers.
+func NotifyPoll() {
+	if pollers != 0 {
+		wakeAllFn(&pollQueue)
+	}
+}
+
+// Poll blocks the calling thread until at least one of the items is ready or
+// the timeout expires and returns the number of ready items. A zero timeout
+// checks the items without blocking while NoTimeout waits indefinitely.
+func Poll(items []PollItem, timeout timer.Duration) int {
+	var ready int
+	waitReady(func() bool {
+		ready = 0
+		for i := range items {
+			if items[i].Revents = pollItem(items[i].Source, items[i].Events); items[i].Revents != 0 {
+				ready++
+			}
+		}
+		return ready != 0
+	}, timeout)
+
+	return ready
+}
+
+// pollItem returns the requested conditions that are satisfied by src,
+// including the conditions that are always reported.
+func pollItem(src Pollable, events Events) Events {
+	if src == nil {
+		return PollNval
+	}
+
+	return src.Poll() & (events | PollErr | PollHup)
+}
+
+// waitReady blocks until ready returns true or the timeout expires and
+// returns the last result of ready.
+func waitReady(ready func() bool, timeout timer.Duration) bool {
+	done := ready()
+	if done || timeout == 0 {
+		return done
+	}
+
+	var expired bool
+	if timeout > 0 {
+		t := timerAfterFn(timeout, func() {
+			expired = true
+			wakeAllFn(&pollQueue)
+		})
+		defer stopTimerFn(t)
+	}
+
+	pollers++
+	waitFn(&pollQueue, func() bool {
+		done = ready()
+		return done || expired
+	})
+	pollers--
+
+	return done
+}
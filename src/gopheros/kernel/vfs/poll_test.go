@@ -0,0 +1,194 @@
+package vfs
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/timer"
+	"testing"
+)
+
+// mockWait replaces waitFn with a function that invokes onBlock each time the
+// wait condition is not satisfied. Tests use onBlock to change the state that
+// a blocked thread is waiting for.
+func mockWait(t *testing.T, onBlock func()) {
+	wakeAllFn = func(_ *sync.WaitQueue) int { return 0 }
+	waitFn = func(_ *sync.WaitQueue, cond func() bool) {
+		for blocks := 0; !cond(); blocks++ {
+			if onBlock == nil || blocks == 1 {
+				t.Fatal("unexpected call to Wait; the calling thread would block forever")
+			}
+			onBlock()
+		}
+	}
+}
+
+func restoreWaitQueue() {
+	waitFn = (*sync.WaitQueue).Wait
+	wakeAllFn = (*sync.WaitQueue).WakeAll
+	timerAfterFn = timer.After
+	stopTimerFn = (*timer.Timer).Stop
+}
+
+// readySource is a Pollable that reports a configurable set of events.
+type readySource struct {
+	events Events
+}
+
+func (s *readySource) Poll() Events { return s.events }
+
+func TestPoll(t *testing.T) {
+	defer restoreWaitQueue()
+	mockWait(t, nil)
+
+	var (
+		src   = &readySource{}
+		items = []PollItem{
+			{Source: src, Events: PollIn},
+			{Source: AsPollable(NewReadOnlyFile(FileInfo{Name: "motd"}, nil)), Events: PollOut},
+			{Events: PollIn},
+		}
+	)
+
+	if got := Poll(items, 0); got != 2 {
+		t.Fatalf("expected 2 ready items; got %d", got)
+	}
+	for i, exp := range []Events{0, PollOut, PollNval} {
+		if items[i].Revents != exp {
+			t.Errorf("[item %d] expected revents 0x%x; got 0x%x", i, exp, items[i].Revents)
+		}
+	}
+
+	// Errors are reported even if they were not requested
+	src.events = PollOut | PollHup
+	if got := Poll(items[:1], NoTimeout); got != 1 || items[0].Revents != PollHup {
+		t.Fatalf("expected PollHup to be reported; got %d, 0x%x", got, items[0].Revents)
+	}
+
+	// Blocked pollers are woken up by NotifyPoll
+	var notified int
+	src.events = 0
+	mockWait(t, func() {
+		src.events = PollIn
+		NotifyPoll()
+	})
+	wakeAllFn = func(_ *sync.WaitQueue) int { notified++; return 0 }
+	if got := Poll(items[:1], NoTimeout); got != 1 || items[0].Revents != PollIn {
+		t.Fatalf("expected PollIn to be reported; got %d, 0x%x", got, items[0].Revents)
+	}
+	if notified != 1 || pollers != 0 {
+		t.Fatalf("expected NotifyPoll to wake up the poller; got %d wake-ups, %d pollers", notified, pollers)
+	}
+
+	// Notifications are skipped while nobody is polling
+	NotifyPoll()
+	if notified != 1 {
+		t.Fatal("expected NotifyPoll to skip the wake-up without any pollers")
+	}
+}
+
+func TestPollTimeout(t *testing.T) {
+	defer restoreWaitQueue()
+
+	var (
+		items   = []PollItem{{Source: &readySource{}, Events: PollIn}}
+		timeout timer.Duration
+		stopped bool
+	)
+	timerAfterFn = func(d timer.Duration, fn func()) *timer.Timer {
+		timeout = d
+		mockWait(t, fn)
+		return nil
+	}
+	stopTimerFn = func(_ *timer.Timer) bool { stopped = true; return true }
+	mockWait(t, nil)
+
+	if got := Poll(items, 0); got != 0 {
+		t.Fatalf("expected no ready items; got %d", got)
+	}
+
+	if got := Poll(items, 5*timer.Millisecond); got != 0 || timeout != 5*timer.Millisecond || !stopped {
+		t.Fatalf("expected Poll to time out after 5ms; got %d ready items after %d", got, timeout)
+	}
+}
+
+func TestEpoll(t *testing.T) {
+	defer restoreWaitQueue()
+	mockWait(t, nil)
+
+	var (
+		ep     = NewEpoll()
+		srcA   = &readySource{events: PollIn | PollOut}
+		srcB   = &readySource{}
+		events = make([]EpollEvent, 4)
+	)
+
+	if err := ep.Add(3, srcA, PollIn, 0xa); err != nil {
+		t.Fatal(err)
+	}
+	if err := ep.Add(4, srcB, PollIn|EpollOneShot, 0xb); err != nil {
+		t.Fatal(err)
+	}
+	if err := ep.Add(3, srcB, PollIn, 0); err != ErrExists {
+		t.Fatalf("expected to get ErrExists; got %v", err)
+	}
+	if err := ep.Add(5, ep, PollIn, 0); err != errEpollLoop {
+		t.Fatalf("expected to get errEpollLoop; got %v", err)
+	}
+
+	if got := ep.Wait(events, 0); got != 1 || events[0] != (EpollEvent{Events: PollIn, Data: 0xa}) {
+		t.Fatalf("expected srcA to be ready; got %d, %v", got, events[0])
+	}
+	if ep.Poll() != PollIn {
+		t.Fatal("expected the epoll instance to be readable")
+	}
+
+	// Block until srcB becomes ready
+	if err := ep.Modify(3, PollOut, 0xaa); err != nil {
+		t.Fatal(err)
+	}
+	if err := ep.Remove(3); err != nil {
+		t.Fatal(err)
+	}
+	if ep.Poll() != 0 {
+		t.Fatal("expected the epoll instance not to be readable")
+	}
+	mockWait(t, func() { srcB.events = PollIn })
+	if got := ep.Wait(events, NoTimeout); got != 1 || events[0] != (EpollEvent{Events: PollIn, Data: 0xb}) {
+		t.Fatalf("expected srcB to be ready; got %d, %v", got, events[0])
+	}
+
+	// One-shot sources are disarmed until they are modified
+	mockWait(t, nil)
+	if got := ep.Wait(events, 0); got != 0 {
+		t.Fatalf("expected the one-shot source to be disarmed; got %d events", got)
+	}
+	if err := ep.Modify(4, PollIn, 0xbb); err != nil {
+		t.Fatal(err)
+	}
+	if got := ep.Wait(events[:1], 0); got != 1 || events[0].Data != 0xbb {
+		t.Fatalf("expected the re-armed source to be ready; got %d, %v", got, events[0])
+	}
+
+	for _, err := range []*kernel.Error{ep.Modify(3, 0, 0), ep.Remove(3)} {
+		if err != ErrNotFound {
+			t.Fatalf("expected to get ErrNotFound; got %v", err)
+		}
+	}
+
+	// File operations
+	if _, err := ep.Read(nil); err != errEpollIO {
+		t.Fatalf("expected to get errEpollIO; got %v", err)
+	}
+	if _, err := ep.Write(nil); err != errEpollIO {
+		t.Fatalf("expected to get errEpollIO; got %v", err)
+	}
+	if _, err := ep.Lseek(0, SeekStart); err != ErrInvalidSeek {
+		t.Fatalf("expected to get ErrInvalidSeek; got %v", err)
+	}
+	if info, err := ep.Stat(); err != nil || info.Name != "epoll" {
+		t.Fatalf("unexpected file info: %v, %v", info, err)
+	}
+	if err := ep.Close(); err != nil || ep.Poll() != 0 {
+		t.Fatalf("expected Close to release all sources; got %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package procfs
+
+import (
+	"gopheros/device/acpi"
+	"gopheros/device/pmu"
+	"gopheros/kernel"
+	"gopheros/kernel/hal"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/pmm"
+	"gopheros/kernel/pstore"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/trace"
+	"gopheros/multiboot"
+	"io"
+)
+
+var (
+	// The following functions are used by tests to mock calls to the
+	// subsystems whose state is exposed by the built-in files.
+	frameStatsFn        = pmm.FrameStats
+	visitMemRegionsFn   = multiboot.VisitMemRegions
+	listDevicesFn       = hal.ListDevices
+	visitIRQStatsFn     = irq.VisitStats
+	visitVectorStatsFn  = irq.VisitVectorStats
+	visitRunQueueFn     = sched.VisitRunQueue
+	visitThreadsFn      = sched.VisitThreads
+	writeLogFn          = kfmt.WriteLog
+	visitACPITablesFn   = acpi.VisitTables
+	dumpTraceFn         = trace.Dump
+	writePMUStatsFn     = pmu.WriteStats
+	writePanicDumpFn    = pstore.WriteLastDump
+	visitClocksourcesFn = timer.VisitClocksources
+	visitIdleStatsFn    = sched.VisitIdleStats
+)
+
+// registerBuiltins adds the files that expose the state of the core kernel
+// subsystems to fs. ACPI tables are exposed as raw binary files under the
+// acpi directory.
+func registerBuiltins(fs *FS) *kernel.Error {
+	builtins := []struct {
+		path string
+		gen  Generator
+	}{
+		{"/meminfo", genMemInfo},
+		{"/memmap", genMemMap},
+		{"/devices", genDevices},
+		{"/interrupts", genInterrupts},
+		{"/irqstats", genIRQStats},
+		{"/runqueue", genRunQueue},
+		{"/sched", genSchedStats},
+		{"/cpuidle", genIdleStats},
+		{"/kmsg", genKernelLog},
+		{"/trace", genTrace},
+		{"/pmu", genPMUStats},
+		{"/pstore", genPanicDump},
+		{"/clocksource", genClocksources},
+	}
+
+	for _, builtin := range builtins {
+		if err := fs.Register(builtin.path, builtin.gen); err != nil {
+			return err
+		}
+	}
+
+	var err *kernel.Error
+	visitACPITablesFn(func(name string, data []byte) {
+		if err == nil {
+			err = fs.Register("/acpi/"+name, func(w io.Writer) { w.Write(data) })
+		}
+	})
+
+	return err
+}
+
+// genMemInfo reports the physical memory usage.
+func genMemInfo(w io.Writer) {
+	total, reserved := frameStatsFn()
+	pageKB := uint64(mm.PageSize >> 10)
+
+	kfmt.Fprintf(w, "MemTotal: %10d kB\n", uint64(total)*pageKB)
+	kfmt.Fprintf(w, "MemFree:  %10d kB\n", uint64(total-reserved)*pageKB)
+	kfmt.Fprintf(w, "MemUsed:  %10d kB\n", uint64(reserved)*pageKB)
+}
+
+// genMemMap reports the physical address range and type of each memory region
+// in the memory map supplied by the bootloader.
+func genMemMap(w io.Writer) {
+	visitMemRegionsFn(func(region *multiboot.MemoryMapEntry) bool {
+		kfmt.Fprintf(w, "0x%16x-0x%16x %s\n", region.PhysAddress, region.End()-1, region.Type.String())
+		return true
+	})
+}
+
+// genDevices reports the registered drivers, their probe status and health.
+func genDevices(w io.Writer) {
+	listDevicesFn(w)
+}
+
+// genInterrupts reports the number of interrupts serviced by each registered
+// interrupt handler.
+func genInterrupts(w io.Writer) {
+	kfmt.Fprintf(w, "%-6s %-4s %-7s %-10s %s\n", "VECTOR", "GSI", "HANDLER", "COUNT", "MAXLAT(ns)")
+	visitIRQStatsFn(func(stats *irq.Stats) {
+		if stats.GSI < 0 {
+			kfmt.Fprintf(w, "%-6d %-4s %-7d %-10d %d\n", uint8(stats.Vector), "-", stats.Index, stats.Handled, stats.MaxLatency)
+			return
+		}
+		kfmt.Fprintf(w, "%-6d %-4d %-7d %-10d %d\n", uint8(stats.Vector), stats.GSI, stats.Index, stats.Handled, stats.MaxLatency)
+	})
+}
+
+// genIRQStats reports the number of raised, unhandled and spurious interrupts
+// and the longest handler latency for each active interrupt vector.
+func genIRQStats(w io.Writer) {
+	kfmt.Fprintf(w, "%-6s %-4s %-8s %-10s %-10s %-10s %s\n", "VECTOR", "GSI", "HANDLERS", "COUNT", "UNHANDLED", "SPURIOUS", "MAXLAT(ns)")
+	visitVectorStatsFn(func(stats *irq.VectorStats) {
+		if stats.GSI < 0 {
+			kfmt.Fprintf(w, "%-6d %-4s %-8d %-10d %-10d %-10d %d\n", uint8(stats.Vector), "-", stats.Handlers, stats.Count, stats.Unhandled, stats.Spurious, stats.MaxLatency)
+			return
+		}
+		kfmt.Fprintf(w, "%-6d %-4d %-8d %-10d %-10d %-10d %d\n", uint8(stats.Vector), stats.GSI, stats.Handlers, stats.Count, stats.Unhandled, stats.Spurious, stats.MaxLatency)
+	})
+}
+
+// genRunQueue reports the running thread followed by the runnable threads in
+// scheduling order.
+func genRunQueue(w io.Writer) {
+	kfmt.Fprintf(w, "%-5s %-9s %s\n", "TID", "STATE", "NAME")
+	visitRunQueueFn(func(t *sched.Thread) {
+		kfmt.Fprintf(w, "%-5d %-9s %s\n", t.ID(), t.State().String(), t.Name())
+	})
+}
+
+// genSchedStats reports the nice value, state, processor, affinity mask and
+// scheduling statistics of each thread. Times are reported in microseconds.
+func genSchedStats(w io.Writer) {
+	kfmt.Fprintf(w, "%-5s %-4s %-9s %-3s %-16s %-10s %-10s %-10s %-8s %-8s %-10s %s\n",
+		"TID", "NICE", "STATE", "CPU", "AFFINITY", "RUN(us)", "WAIT(us)", "SLEEP(us)", "SWITCHES", "WAKEUPS", "MIGRATIONS", "NAME")
+	visitThreadsFn(func(t *sched.Thread, stats sched.Stats) {
+		kfmt.Fprintf(w, "%-5d %-4d %-9s %-3d %16x %-10d %-10d %-10d %-8d %-8d %-10d %s\n",
+			t.ID(), t.Nice(), t.State().String(), t.CPU(), uint64(t.Affinity()),
+			stats.RunTime/1000, stats.WaitTime/1000, stats.SleepTime/1000,
+			stats.Switches, stats.Wakeups, stats.Migrations, t.Name(),
+		)
+	})
+}
+
+// genIdleStats reports the idle method of each online processor along with the
+// time, in microseconds, it spent halted and the number of times it halted.
+func genIdleStats(w io.Writer) {
+	kfmt.Fprintf(w, "%-3s %-6s %-12s %s\n", "CPU", "METHOD", "IDLE(us)", "ENTRIES")
+	visitIdleStatsFn(func(index int, stats sched.IdleStats) {
+		kfmt.Fprintf(w, "%-3d %-6s %-12d %d\n", index, stats.Method.String(), stats.Time/1000, stats.Entries)
+	})
+}
+
+// genKernelLog reports the retained kernel log output.
+func genKernelLog(w io.Writer) {
+	writeLogFn(w)
+}
+
+// genTrace reports the recorded trace events.
+func genTrace(w io.Writer) {
+	dumpTraceFn(w)
+}
+
+// genPMUStats reports the performance counter totals and the events counted
+// for each thread.
+func genPMUStats(w io.Writer) {
+	writePMUStatsFn(w)
+}
+
+// genPanicDump reports the panic details recovered from the previous boot.
+func genPanicDump(w io.Writer) {
+	writePanicDumpFn(w)
+}
+
+// genClocksources reports the registered clocksources and marks the one that
+// the monotonic clock is derived from.
+func genClocksources(w io.Writer) {
+	kfmt.Fprintf(w, "%-8s %-6s %-12s %s\n", "NAME", "RATING", "FREQ(Hz)", "ACTIVE")
+	visitClocksourcesFn(func(cs timer.Clocksource, active bool) {
+		marker := ""
+		if active {
+			marker = "*"
+		}
+		kfmt.Fprintf(w, "%-8s %-6d %-12d %s\n", cs.Name(), cs.Rating(), cs.Frequency(), marker)
+	})
+}
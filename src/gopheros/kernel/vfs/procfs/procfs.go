@@ -0,0 +1,216 @@
+// Package procfs implements a synthetic filesystem that exposes the runtime
+// state of the kernel.
+//
+// Each file is backed by a Generator that is invoked whenever the file is
+// opened; readers therefore observe a consistent snapshot of the state at the
+// time of the open call. Besides the built-in files registered by Init, other
+// subsystems can publish their own files via Register.
+package procfs
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/initcall"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/vfs"
+	"io"
+	"strings"
+)
+
+const (
+	// MountPoint is the path where Init mounts the filesystem.
+	MountPoint = "/proc"
+
+	fileMode = vfs.Mode(0444)
+	dirMode  = vfs.ModeDir | 0555
+)
+
+// Generator writes the current contents of a file to w.
+type Generator func(w io.Writer)
+
+// node is a file or directory in the filesystem.
+type node struct {
+	name     string
+	gen      Generator
+	children []*node
+}
+
+// info returns the FileInfo for a node. As file contents are generated on
+// demand, files are always reported as empty.
+func (n *node) info() vfs.FileInfo {
+	if n.gen == nil {
+		return vfs.FileInfo{Name: n.name, Mode: dirMode}
+	}
+
+	return vfs.FileInfo{Name: n.name, Mode: fileMode}
+}
+
+// FS is a synthetic filesystem whose files are produced by generators.
+type FS struct {
+	mutex sync.Spinlock
+	root  *node
+}
+
+var (
+	errExists       = &kernel.Error{Module: "procfs", Message: "file already exists", Code: kernel.CodeExists}
+	errNilGenerator = &kernel.Error{Module: "procfs", Message: "files require a generator", Code: kernel.CodeInvalid}
+
+	// procFS is the instance that is mounted by Init and populated via
+	// Register.
+	procFS = New()
+
+	// mountFn is used by tests to mock calls to the vfs package.
+	mountFn = vfs.Mount
+)
+
+// New returns an empty filesystem.
+func New() *FS {
+	return &FS{root: &node{name: "/"}}
+}
+
+// Register adds a file to the filesystem mounted by Init.
+func Register(path string, gen Generator) *kernel.Error {
+	return procFS.Register(path, gen)
+}
+
+func init() {
+	initcall.Register(initcall.LevelLate, Init)
+}
+
+// Init registers the built-in files and mounts the filesystem at MountPoint.
+// It must be invoked after the hardware has been detected.
+func Init() *kernel.Error {
+	if err := registerBuiltins(procFS); err != nil {
+		return err
+	}
+
+	return mountFn(MountPoint, procFS)
+}
+
+// Register adds a file whose contents are produced by gen at the specified
+// path. Any missing parent directories are created.
+func (fs *FS) Register(path string, gen Generator) *kernel.Error {
+	if gen == nil {
+		return errNilGenerator
+	}
+
+	path, err := vfs.Clean(path)
+	if err != nil {
+		return err
+	}
+
+	elems := strings.Split(path[1:], "/")
+	if elems[0] == "" {
+		return errExists
+	}
+
+	fs.mutex.Acquire()
+	defer fs.mutex.Release()
+
+	dir := fs.root
+	for _, elem := range elems[:len(elems)-1] {
+		next := dir.child(elem)
+		switch {
+		case next == nil:
+			next = &node{name: elem}
+			dir.children = append(dir.children, next)
+		case next.gen != nil:
+			return vfs.ErrNotDir
+		}
+		dir = next
+	}
+
+	name := elems[len(elems)-1]
+	if dir.child(name) != nil {
+		return errExists
+	}
+
+	dir.children = append(dir.children, &node{name: name, gen: gen})
+	return nil
+}
+
+// Open generates the contents of the file at the specified path and returns
+// a file for reading them.
+func (fs *FS) Open(path string) (vfs.File, *kernel.Error) {
+	n, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.gen == nil {
+		return vfs.NewReadOnlyFile(n.info(), nil), nil
+	}
+
+	var buf bytes.Buffer
+	n.gen(&buf)
+
+	info := n.info()
+	info.Size = int64(buf.Len())
+	return vfs.NewReadOnlyFile(info, buf.Bytes()), nil
+}
+
+// Stat returns information about the file at the specified path.
+func (fs *FS) Stat(path string) (vfs.FileInfo, *kernel.Error) {
+	n, err := fs.lookup(path)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+
+	return n.info(), nil
+}
+
+// ReadDir returns the contents of the directory at the specified path in
+// registration order.
+func (fs *FS) ReadDir(path string) ([]vfs.FileInfo, *kernel.Error) {
+	n, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.gen != nil {
+		return nil, vfs.ErrNotDir
+	}
+
+	fs.mutex.Acquire()
+	list := make([]vfs.FileInfo, len(n.children))
+	for i, c := range n.children {
+		list[i] = c.info()
+	}
+	fs.mutex.Release()
+
+	return list, nil
+}
+
+// lookup returns the node for the specified clean, absolute path.
+func (fs *FS) lookup(path string) (*node, *kernel.Error) {
+	fs.mutex.Acquire()
+	defer fs.mutex.Release()
+
+	n := fs.root
+	for _, elem := range strings.Split(path, "/") {
+		if elem == "" {
+			continue
+		}
+
+		if n.gen != nil {
+			return nil, vfs.ErrNotDir
+		}
+
+		if n = n.child(elem); n == nil {
+			return nil, vfs.ErrNotFound
+		}
+	}
+
+	return n, nil
+}
+
+// child returns the entry with the specified name in a directory.
+func (n *node) child(name string) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,267 @@
+package procfs
+
+import (
+	"bytes"
+	"gopheros/device/acpi"
+	"gopheros/device/pmu"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/hal"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm/pmm"
+	"gopheros/kernel/pstore"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/timer"
+	"gopheros/kernel/trace"
+	"gopheros/kernel/vfs"
+	"gopheros/multiboot"
+	"io"
+	"testing"
+	"unsafe"
+)
+
+func restoreMocks() {
+	frameStatsFn = pmm.FrameStats
+	visitMemRegionsFn = multiboot.VisitMemRegions
+	listDevicesFn = hal.ListDevices
+	visitIRQStatsFn = irq.VisitStats
+	visitVectorStatsFn = irq.VisitVectorStats
+	visitRunQueueFn = sched.VisitRunQueue
+	visitThreadsFn = sched.VisitThreads
+	writeLogFn = kfmt.WriteLog
+	visitACPITablesFn = acpi.VisitTables
+	dumpTraceFn = trace.Dump
+	writePMUStatsFn = pmu.WriteStats
+	writePanicDumpFn = pstore.WriteLastDump
+	visitClocksourcesFn = timer.VisitClocksources
+	visitIdleStatsFn = sched.VisitIdleStats
+	mountFn = vfs.Mount
+	procFS = New()
+}
+
+type mockClocksource struct {
+	name   string
+	rating int
+	freq   uint64
+}
+
+func (m *mockClocksource) Name() string      { return m.name }
+func (m *mockClocksource) Rating() int       { return m.rating }
+func (m *mockClocksource) Frequency() uint64 { return m.freq }
+func (m *mockClocksource) Mask() uint64      { return ^uint64(0) }
+func (m *mockClocksource) Read() uint64      { return 0 }
+
+func readFile(t *testing.T, fs *FS, path string) string {
+	f, err := fs.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	data := make([]byte, 16)
+	for {
+		n, err := f.Read(data)
+		if err != nil {
+			t.Fatalf("unable to read %s: %v", path, err)
+		}
+		if n == 0 {
+			return buf.String()
+		}
+		buf.Write(data[:n])
+	}
+}
+
+func TestRegister(t *testing.T) {
+	fs := New()
+	gen := func(w io.Writer) { w.Write([]byte("42\n")) }
+
+	specs := []struct {
+		path   string
+		gen    Generator
+		expErr *kernel.Error
+	}{
+		{"/answer", gen, nil},
+		{"/net/dev", gen, nil},
+		{"/net/./arp", gen, nil},
+		{"/answer", gen, errExists},
+		{"/", gen, errExists},
+		{"/answer/nested", gen, vfs.ErrNotDir},
+		{"relative", gen, vfs.ErrInvalidPath},
+		{"/empty", nil, errNilGenerator},
+	}
+
+	for specIndex, spec := range specs {
+		if err := fs.Register(spec.path, spec.gen); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	list, err := fs.ReadDir("/net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "dev" || list[1].Name != "arp" || list[0].Mode != fileMode {
+		t.Fatalf("unexpected directory contents: %+v", list)
+	}
+
+	if info, err := fs.Stat("/net"); err != nil || info.Mode != dirMode {
+		t.Fatalf("expected /net to be a directory; got %+v, %v", info, err)
+	}
+
+	if got := readFile(t, fs, "/net/arp"); got != "42\n" {
+		t.Fatalf("unexpected file contents %q", got)
+	}
+
+	f, _ := fs.Open("/net/dev")
+	if info, _ := f.Stat(); info.Size != 3 {
+		t.Fatalf("expected open file to report the size of the generated contents; got %d", info.Size)
+	}
+
+	dir, _ := fs.Open("/net")
+	if _, err = dir.Read(make([]byte, 1)); err != vfs.ErrIsDir {
+		t.Fatalf("expected error %v; got %v", vfs.ErrIsDir, err)
+	}
+
+	for _, spec := range []struct {
+		path   string
+		expErr *kernel.Error
+	}{
+		{"/missing", vfs.ErrNotFound},
+		{"/answer/nested", vfs.ErrNotDir},
+	} {
+		if _, err = fs.Open(spec.path); err != spec.expErr {
+			t.Errorf("expected Open(%q) to fail with %v; got %v", spec.path, spec.expErr, err)
+		}
+		if _, err = fs.Stat(spec.path); err != spec.expErr {
+			t.Errorf("expected Stat(%q) to fail with %v; got %v", spec.path, spec.expErr, err)
+		}
+		if _, err = fs.ReadDir(spec.path); err != spec.expErr {
+			t.Errorf("expected ReadDir(%q) to fail with %v; got %v", spec.path, spec.expErr, err)
+		}
+	}
+
+	if _, err = fs.ReadDir("/answer"); err != vfs.ErrNotDir {
+		t.Fatalf("expected error %v; got %v", vfs.ErrNotDir, err)
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	stack := make([]uintptr, 64)
+	lo := uintptr(unsafe.Pointer(&stack[0]))
+	worker := sched.NewThread("kworker", lo, lo+uintptr(len(stack))*8, func() {})
+
+	frameStatsFn = func() (uint32, uint32) { return 1024, 256 }
+	visitMemRegionsFn = func(visitor multiboot.MemRegionVisitor) {
+		for _, region := range []multiboot.MemoryMapEntry{
+			{PhysAddress: 0, Length: 0x9fc00, Type: multiboot.MemAvailable},
+			{PhysAddress: 0x7fe0000, Length: 0x20000, Type: multiboot.MemAcpiReclaimable},
+			{PhysAddress: 0x8000000, Length: 0x1000, Type: multiboot.MemBadRAM},
+		} {
+			visitor(&region)
+		}
+	}
+	listDevicesFn = func(w io.Writer) { kfmt.Fprintf(w, "pci 0.0.1 active\n") }
+	visitIRQStatsFn = func(visitor func(*irq.Stats)) {
+		visitor(&irq.Stats{Vector: gate.InterruptNumber(33), GSI: 1, Index: 0, Handled: 12, MaxLatency: 1500})
+		visitor(&irq.Stats{Vector: gate.InterruptNumber(48), GSI: -1, Index: 1, Handled: 7})
+	}
+	visitVectorStatsFn = func(visitor func(*irq.VectorStats)) {
+		visitor(&irq.VectorStats{Vector: gate.InterruptNumber(33), GSI: 1, Handlers: 1, Count: 14, Unhandled: 2, MaxLatency: 1800})
+		visitor(&irq.VectorStats{Vector: gate.InterruptNumber(255), GSI: -1, Count: 3, Spurious: 3})
+	}
+	visitRunQueueFn = func(visitor func(*sched.Thread)) { visitor(worker) }
+	visitThreadsFn = func(visitor func(*sched.Thread, sched.Stats)) {
+		visitor(worker, sched.Stats{RunTime: 1500000, WaitTime: 2000, SleepTime: 42999, Switches: 3, Wakeups: 2, Migrations: 1})
+	}
+	writeLogFn = func(w io.Writer) { w.Write([]byte("booting\n")) }
+	dumpTraceFn = func(w io.Writer) { w.Write([]byte("tracing: disabled\n")) }
+	writePMUStatsFn = func(w io.Writer) { w.Write([]byte("cycles 42\n")) }
+	writePanicDumpFn = func(w io.Writer) { w.Write([]byte("=== kernel log ===\n")) }
+	visitIdleStatsFn = func(visitor func(int, sched.IdleStats)) {
+		visitor(0, sched.IdleStats{Method: sched.IdleMWait, Time: 2500999, Entries: 12})
+		visitor(1, sched.IdleStats{Method: sched.IdleHalt, Time: 1000, Entries: 1})
+	}
+	visitClocksourcesFn = func(visitor func(timer.Clocksource, bool)) {
+		visitor(&mockClocksource{"jiffies", 1, 1000}, false)
+		visitor(&mockClocksource{"tsc", 300, 2000000000}, true)
+	}
+	visitACPITablesFn = func(visitor func(string, []byte)) {
+		visitor("APIC", []byte("APIC table"))
+		visitor("FACP", []byte("FACP table"))
+	}
+
+	var mountedAt string
+	mountFn = func(path string, _ vfs.FileSystem) *kernel.Error {
+		mountedAt = path
+		return nil
+	}
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mountedAt != MountPoint {
+		t.Fatalf("expected filesystem to be mounted at %s; got %q", MountPoint, mountedAt)
+	}
+
+	specs := []struct {
+		path string
+		exp  string
+	}{
+		{"/meminfo", "MemTotal:       4096 kB\nMemFree:        3072 kB\nMemUsed:        1024 kB\n"},
+		{"/memmap", "0x0000000000000000-0x000000000009fbff available\n0x0000000007fe0000-0x0000000007ffffff ACPI (reclaimable)\n0x0000000008000000-0x0000000008000fff bad RAM\n"},
+		{"/devices", "pci 0.0.1 active\n"},
+		{"/interrupts", "VECTOR GSI  HANDLER COUNT      MAXLAT(ns)\n33     1    0       12         1500\n48     -    1       7          0\n"},
+		{"/irqstats", "VECTOR GSI  HANDLERS COUNT      UNHANDLED  SPURIOUS   MAXLAT(ns)\n33     1    1        14         2          0          1800\n255    -    0        3          0          3          0\n"},
+		{"/runqueue", "TID   STATE     NAME\n0     blocked   kworker\n"},
+		{"/sched", "TID   NICE STATE     CPU AFFINITY         RUN(us)    WAIT(us)   SLEEP(us)  SWITCHES WAKEUPS  MIGRATIONS NAME\n0     0    blocked   0   0000000000000001 1500       2          42         3        2        1          kworker\n"},
+		{"/cpuidle", "CPU METHOD IDLE(us)     ENTRIES\n0   mwait  2500         12\n1   halt   1            1\n"},
+		{"/kmsg", "booting\n"},
+		{"/trace", "tracing: disabled\n"},
+		{"/pmu", "cycles 42\n"},
+		{"/pstore", "=== kernel log ===\n"},
+		{"/clocksource", "NAME     RATING FREQ(Hz)     ACTIVE\njiffies  1      1000         \ntsc      300    2000000000   *\n"},
+		{"/acpi/APIC", "APIC table"},
+		{"/acpi/FACP", "FACP table"},
+	}
+
+	for specIndex, spec := range specs {
+		if got := readFile(t, procFS, spec.path); got != spec.exp {
+			t.Errorf("[spec %d] expected %s to contain:\n%q\ngot:\n%q", specIndex, spec.path, spec.exp, got)
+		}
+	}
+
+	// Registering the built-in files twice fails
+	if err := Init(); err != errExists {
+		t.Fatalf("expected error %v; got %v", errExists, err)
+	}
+}
+
+func TestInitACPIError(t *testing.T) {
+	defer restoreMocks()
+
+	visitACPITablesFn = func(visitor func(string, []byte)) {
+		visitor("SSDT", nil)
+		visitor("SSDT", nil)
+	}
+
+	if err := Init(); err != errExists {
+		t.Fatalf("expected error %v; got %v", errExists, err)
+	}
+}
+
+func TestPackageRegister(t *testing.T) {
+	defer restoreMocks()
+
+	if err := Register("/uptime", func(w io.Writer) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := procFS.Stat("/uptime"); err != nil {
+		t.Fatalf("expected file to be registered with the mounted filesystem; got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+// Package ramfs implements a writable filesystem whose files are stored in
+// memory. It provides scratch space for files generated by the kernel, such
+// as core dumps, and does not survive a reboot.
+//
+// The filesystem consists of a single directory; files can only be created
+// at its root.
+package ramfs
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/initcall"
+	"gopheros/kernel/sync"
+	"gopheros/kernel/vfs"
+	"strings"
+)
+
+const (
+	// MountPoint is the path where Init mounts the filesystem.
+	MountPoint = "/tmp"
+
+	fileMode = vfs.Mode(0644)
+	dirMode  = vfs.ModeDir | 0755
+)
+
+var (
+	errInvalidName = &kernel.Error{Module: "ramfs", Message: "files can only be created at the root directory", Code: kernel.CodeInvalid}
+
+	// mountFn is used by tests to mock calls to the vfs package.
+	mountFn = vfs.Mount
+)
+
+// node is a file stored in the filesystem.
+type node struct {
+	name string
+	data []byte
+}
+
+// FS is a single-directory filesystem whose files are stored in memory.
+type FS struct {
+	mutex sync.Spinlock
+	files []*node
+}
+
+// New returns an empty filesystem.
+func New() *FS {
+	return &FS{}
+}
+
+func init() {
+	initcall.Register(initcall.LevelLate, Init)
+}
+
+// Init mounts an empty filesystem at MountPoint.
+func Init() *kernel.Error {
+	return mountFn(MountPoint, New())
+}
+
+// Create creates the file at the specified path or truncates it if it already
+// exists and opens it for reading and writing.
+func (fs *FS) Create(path string) (vfs.File, *kernel.Error) {
+	name := path[1:]
+	if name == "" || strings.IndexByte(name, '/') != -1 {
+		return nil, errInvalidName
+	}
+
+	fs.mutex.Acquire()
+	defer fs.mutex.Release()
+
+	n := fs.lookup(name)
+	if n == nil {
+		n = &node{name: name}
+		fs.files = append(fs.files, n)
+	}
+	n.data = nil
+
+	return &file{fs: fs, node: n}, nil
+}
+
+// Open opens the file at the specified path for reading and writing.
+// Directories are opened read-only.
+func (fs *FS) Open(path string) (vfs.File, *kernel.Error) {
+	if path == "/" {
+		return vfs.NewReadOnlyFile(vfs.FileInfo{Name: "/", Mode: dirMode}, nil), nil
+	}
+
+	fs.mutex.Acquire()
+	defer fs.mutex.Release()
+
+	n := fs.lookup(path[1:])
+	if n == nil {
+		return nil, vfs.ErrNotFound
+	}
+
+	return &file{fs: fs, node: n}, nil
+}
+
+// Stat returns information about the file at the specified path.
+func (fs *FS) Stat(path string) (vfs.FileInfo, *kernel.Error) {
+	if path == "/" {
+		return vfs.FileInfo{Name: "/", Mode: dirMode}, nil
+	}
+
+	fs.mutex.Acquire()
+	defer fs.mutex.Release()
+
+	n := fs.lookup(path[1:])
+	if n == nil {
+		return vfs.FileInfo{}, vfs.ErrNotFound
+	}
+
+	return n.info(), nil
+}
+
+// ReadDir returns the files in the root directory in creation order.
+func (fs *FS) ReadDir(path string) ([]vfs.FileInfo, *kernel.Error) {
+	fs.mutex.Acquire()
+	defer fs.mutex.Release()
+
+	if path != "/" {
+		if fs.lookup(path[1:]) != nil {
+			return nil, vfs.ErrNotDir
+		}
+		return nil, vfs.ErrNotFound
+	}
+
+	list := make([]vfs.FileInfo, len(fs.files))
+	for i, n := range fs.files {
+		list[i] = n.info()
+	}
+
+	return list, nil
+}
+
+// lookup returns the file with the specified name. The caller must hold the
+// filesystem mutex.
+func (fs *FS) lookup(name string) *node {
+	for _, n := range fs.files {
+		if n.name == name {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// info returns the FileInfo for a file. The caller must hold the filesystem
+// mutex.
+func (n *node) info() vfs.FileInfo {
+	return vfs.FileInfo{Name: n.name, Size: int64(len(n.data)), Mode: fileMode}
+}
+
+// file is an open file of a ramfs filesystem.
+type file struct {
+	fs     *FS
+	node   *node
+	offset int64
+}
+
+// Read reads up to len(buf) bytes from the current file offset.
+func (f *file) Read(buf []byte) (int, *kernel.Error) {
+	f.fs.mutex.Acquire()
+	defer f.fs.mutex.Release()
+
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, nil
+	}
+
+	n := copy(buf, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+// Write writes buf at the current file offset. Writing past the end of the
+// file fills the gap with zeroes.
+func (f *file) Write(buf []byte) (int, *kernel.Error) {
+	f.fs.mutex.Acquire()
+	defer f.fs.mutex.Release()
+
+	if end := f.offset + int64(len(buf)); end > int64(len(f.node.data)) {
+		if end > int64(cap(f.node.data)) {
+			data := make([]byte, end, 2*end)
+			copy(data, f.node.data)
+			f.node.data = data
+		} else {
+			f.node.data = f.node.data[:end]
+		}
+	}
+
+	n := copy(f.node.data[f.offset:], buf)
+	f.offset += int64(n)
+	return n, nil
+}
+
+// Lseek sets the file offset relative to whence.
+func (f *file) Lseek(offset int64, whence int) (int64, *kernel.Error) {
+	f.fs.mutex.Acquire()
+	defer f.fs.mutex.Release()
+
+	switch whence {
+	case vfs.SeekCurrent:
+		offset += f.offset
+	case vfs.SeekEnd:
+		offset += int64(len(f.node.data))
+	case vfs.SeekStart:
+	default:
+		return 0, vfs.ErrInvalidSeek
+	}
+
+	if offset < 0 {
+		return 0, vfs.ErrInvalidSeek
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+// Stat returns information about the file.
+func (f *file) Stat() (vfs.FileInfo, *kernel.Error) {
+	f.fs.mutex.Acquire()
+	defer f.fs.mutex.Release()
+
+	return f.node.info(), nil
+}
+
+// Close releases the file.
+func (f *file) Close() *kernel.Error {
+	return nil
+}
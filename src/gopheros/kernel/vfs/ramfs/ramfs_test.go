@@ -0,0 +1,149 @@
+package ramfs
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/vfs"
+	"testing"
+)
+
+func TestCreateAndRead(t *testing.T) {
+	fs := New()
+
+	for _, path := range []string{"/", "/dir/file"} {
+		if _, err := fs.Create(path); err != errInvalidName {
+			t.Errorf("expected error %v when creating %q; got %v", errInvalidName, path, err)
+		}
+	}
+
+	f, err := fs.Create("/core.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := f.Write([]byte("core")); n != 4 || err != nil {
+		t.Fatalf("expected Write to return 4, nil; got %d, %v", n, err)
+	}
+
+	// Writing past the end of the file leaves a zero-filled gap
+	if _, err = f.Lseek(8, vfs.SeekCurrent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("dump")); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := fs.Open("/core.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 32)
+	n, err := other.Read(data)
+	if err != nil || string(data[:n]) != "core\x00\x00\x00\x00\x00\x00\x00\x00dump" {
+		t.Fatalf("expected to read back the written data; got %q, %v", data[:n], err)
+	}
+
+	if n, err = other.Read(data); n != 0 || err != nil {
+		t.Errorf("expected Read to return 0 at the end of the file; got %d, %v", n, err)
+	}
+
+	if info, err := other.Stat(); err != nil || info.Size != 16 || !info.Mode.IsRegular() {
+		t.Errorf("expected a 16 byte regular file; got %+v, %v", info, err)
+	}
+
+	// Creating an existing file truncates it
+	if _, err = fs.Create("/core.1"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fs.Stat("/core.1"); err != nil || info.Size != 0 {
+		t.Errorf("expected the file to be truncated; got %+v, %v", info, err)
+	}
+
+	for _, f := range []vfs.File{f, other} {
+		if err = f.Close(); err != nil {
+			t.Errorf("unexpected error closing file: %v", err)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	fs := New()
+	for _, path := range []string{"/a", "/b"} {
+		if _, err := fs.Create(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if info, err := fs.Stat("/"); err != nil || !info.Mode.IsDir() {
+		t.Errorf("expected the root to be a directory; got %+v, %v", info, err)
+	}
+
+	if _, err := fs.Stat("/c"); err != vfs.ErrNotFound {
+		t.Errorf("expected error %v; got %v", vfs.ErrNotFound, err)
+	}
+
+	if _, err := fs.Open("/c"); err != vfs.ErrNotFound {
+		t.Errorf("expected error %v; got %v", vfs.ErrNotFound, err)
+	}
+
+	if dir, err := fs.Open("/"); err != nil {
+		t.Error(err)
+	} else if info, _ := dir.Stat(); !info.Mode.IsDir() {
+		t.Errorf("expected the root to be opened as a directory; got %+v", info)
+	}
+
+	list, err := fs.ReadDir("/")
+	if err != nil || len(list) != 2 || list[0].Name != "a" || list[1].Name != "b" {
+		t.Errorf("expected the files to be listed in creation order; got %+v, %v", list, err)
+	}
+
+	if _, err = fs.ReadDir("/a"); err != vfs.ErrNotDir {
+		t.Errorf("expected error %v; got %v", vfs.ErrNotDir, err)
+	}
+
+	if _, err = fs.ReadDir("/c"); err != vfs.ErrNotFound {
+		t.Errorf("expected error %v; got %v", vfs.ErrNotFound, err)
+	}
+}
+
+func TestLseek(t *testing.T) {
+	f, err := New().Create("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte("0123456789"))
+
+	for specIndex, spec := range []struct {
+		offset int64
+		whence int
+		exp    int64
+		expErr *kernel.Error
+	}{
+		{2, vfs.SeekStart, 2, nil},
+		{3, vfs.SeekCurrent, 5, nil},
+		{-1, vfs.SeekEnd, 9, nil},
+		{-1, vfs.SeekStart, 0, vfs.ErrInvalidSeek},
+		{0, 42, 0, vfs.ErrInvalidSeek},
+	} {
+		if got, err := f.Lseek(spec.offset, spec.whence); got != spec.exp || err != spec.expErr {
+			t.Errorf("[spec %d] expected Lseek to return %d, %v; got %d, %v", specIndex, spec.exp, spec.expErr, got, err)
+		}
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer func() { mountFn = vfs.Mount }()
+
+	var mountedAt string
+	mountFn = func(path string, fs vfs.FileSystem) *kernel.Error {
+		if _, ok := fs.(vfs.Creator); !ok {
+			t.Error("expected the mounted filesystem to support creating files")
+		}
+		mountedAt = path
+		return nil
+	}
+
+	if err := Init(); err != nil || mountedAt != MountPoint {
+		t.Errorf("expected the filesystem to be mounted at %s; got %q, %v", MountPoint, mountedAt, err)
+	}
+}
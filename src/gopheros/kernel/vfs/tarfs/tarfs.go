@@ -0,0 +1,372 @@
+// Package tarfs implements a read-only filesystem backed by a ustar archive
+// that is stored in memory, such as the initrd image loaded by the bootloader.
+//
+// The archive is indexed once when the filesystem is created; file reads
+// access the archive contents directly without copying them. Besides the
+// ustar entry types, the GNU long name and long link extensions are
+// supported. PAX extended headers as well as device and FIFO entries are
+// ignored.
+package tarfs
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/vfs"
+	"strings"
+)
+
+const (
+	blockSize = 512
+
+	// Header field offsets and lengths.
+	hdrName        = 0
+	hdrNameLen     = 100
+	hdrMode        = 100
+	hdrModeLen     = 8
+	hdrSize        = 124
+	hdrSizeLen     = 12
+	hdrChecksum    = 148
+	hdrChecksumLen = 8
+	hdrType        = 156
+	hdrLinkName    = 157
+	hdrLinkLen     = 100
+	hdrMagic       = 257
+	hdrPrefix      = 345
+	hdrPrefixLen   = 155
+	ustarMagic     = "ustar"
+	defaultDirPerm = vfs.Mode(0755)
+
+	// Entry types.
+	typeRegular     = '0'
+	typeRegularOld  = 0
+	typeContiguous  = '7'
+	typeHardLink    = '1'
+	typeSymlink     = '2'
+	typeDir         = '5'
+	typeGNULongName = 'L'
+	typeGNULongLink = 'K'
+
+	// maxLinkDepth bounds the number of symbolic links followed while
+	// resolving a path.
+	maxLinkDepth = 8
+)
+
+var (
+	errBadHeader    = &kernel.Error{Module: "tarfs", Message: "invalid tar header", Code: kernel.CodeIO}
+	errTruncated    = &kernel.Error{Module: "tarfs", Message: "tar archive is truncated", Code: kernel.CodeIO}
+	errBadHardLink  = &kernel.Error{Module: "tarfs", Message: "hard link target is not a regular file"}
+	errTooManyLinks = &kernel.Error{Module: "tarfs", Message: "too many levels of symbolic links", Code: kernel.CodeLoop}
+
+	// mountFn is used by tests to mock calls to the vfs package.
+	mountFn = vfs.Mount
+)
+
+// node is a file, directory or symbolic link in the archive.
+type node struct {
+	info     vfs.FileInfo
+	data     []byte
+	target   string
+	parent   *node
+	children []*node
+}
+
+// child returns the entry with the specified name in a directory.
+func (n *node) child(name string) *node {
+	for _, c := range n.children {
+		if c.info.Name == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// FS is a read-only filesystem backed by a tar archive.
+type FS struct {
+	root *node
+}
+
+// New indexes the contents of a tar archive and returns a filesystem for it.
+// The archive must not be modified while the filesystem is in use.
+func New(archive []byte) (*FS, *kernel.Error) {
+	fs := &FS{root: &node{info: vfs.FileInfo{Name: "/", Mode: vfs.ModeDir | defaultDirPerm}}}
+	fs.root.parent = fs.root
+
+	var longName, longLink string
+	for offset := 0; offset+blockSize <= len(archive); {
+		hdr := archive[offset : offset+blockSize]
+
+		// The archive ends with at least one zero-filled block
+		if isZero(hdr) {
+			break
+		}
+
+		if !validChecksum(hdr) {
+			return nil, errBadHeader
+		}
+
+		size, ok := parseOctal(hdr[hdrSize : hdrSize+hdrSizeLen])
+		if !ok {
+			return nil, errBadHeader
+		}
+
+		dataStart := offset + blockSize
+		if uint64(len(archive)-dataStart) < size {
+			return nil, errTruncated
+		}
+		data := archive[dataStart : dataStart+int(size)]
+		offset = dataStart + int((size+blockSize-1)/blockSize*blockSize)
+
+		name := cString(hdr[hdrName : hdrName+hdrNameLen])
+		if string(hdr[hdrMagic:hdrMagic+len(ustarMagic)]) == ustarMagic {
+			if prefix := cString(hdr[hdrPrefix : hdrPrefix+hdrPrefixLen]); prefix != "" {
+				name = prefix + "/" + name
+			}
+		}
+		if longName != "" {
+			name, longName = longName, ""
+		}
+
+		linkName := cString(hdr[hdrLinkName : hdrLinkName+hdrLinkLen])
+		if longLink != "" {
+			linkName, longLink = longLink, ""
+		}
+
+		mode, ok := parseOctal(hdr[hdrMode : hdrMode+hdrModeLen])
+		if !ok {
+			return nil, errBadHeader
+		}
+		perm := vfs.Mode(mode) & vfs.ModePerm
+
+		switch hdr[hdrType] {
+		case typeGNULongName:
+			longName = cString(data)
+		case typeGNULongLink:
+			longLink = cString(data)
+		case typeRegular, typeRegularOld, typeContiguous:
+			fs.insert(name, &node{info: vfs.FileInfo{Size: int64(size), Mode: perm}, data: data})
+		case typeDir:
+			fs.insert(name, &node{info: vfs.FileInfo{Mode: vfs.ModeDir | perm}})
+		case typeSymlink:
+			fs.insert(name, &node{info: vfs.FileInfo{Size: int64(len(linkName)), Mode: vfs.ModeSymlink | perm}, target: linkName})
+		case typeHardLink:
+			target, err := fs.lookup(fs.root, linkName, 0)
+			if err != nil || !target.info.Mode.IsRegular() {
+				return nil, errBadHardLink
+			}
+			fs.insert(name, &node{info: vfs.FileInfo{Size: target.info.Size, Mode: target.info.Mode}, data: target.data})
+		}
+	}
+
+	return fs, nil
+}
+
+// Mount indexes the contents of a tar archive and mounts it at the specified
+// path.
+func Mount(path string, archive []byte) *kernel.Error {
+	fs, err := New(archive)
+	if err != nil {
+		return err
+	}
+
+	return mountFn(path, fs)
+}
+
+// Open opens the file at the specified path.
+func (fs *FS) Open(path string) (vfs.File, *kernel.Error) {
+	n, err := fs.lookup(fs.root, path, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return vfs.NewReadOnlyFile(n.info, n.data), nil
+}
+
+// Stat returns information about the file at the specified path.
+func (fs *FS) Stat(path string) (vfs.FileInfo, *kernel.Error) {
+	n, err := fs.lookup(fs.root, path, 0)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+
+	return n.info, nil
+}
+
+// ReadDir returns the contents of the directory at the specified path in
+// archive order.
+func (fs *FS) ReadDir(path string) ([]vfs.FileInfo, *kernel.Error) {
+	n, err := fs.lookup(fs.root, path, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.info.Mode.IsDir() {
+		return nil, vfs.ErrNotDir
+	}
+
+	list := make([]vfs.FileInfo, len(n.children))
+	for i, c := range n.children {
+		list[i] = c.info
+	}
+
+	return list, nil
+}
+
+// insert adds an entry to the tree, creating any missing parent directories.
+// Entries replace any existing entry with the same path, except for
+// directories which retain their contents.
+func (fs *FS) insert(path string, n *node) {
+	elems := splitPath(path)
+	if len(elems) == 0 {
+		if n.info.Mode.IsDir() {
+			fs.root.info.Mode = n.info.Mode
+		}
+		return
+	}
+
+	dir := fs.root
+	for _, elem := range elems[:len(elems)-1] {
+		next := dir.child(elem)
+		if next == nil || !next.info.Mode.IsDir() {
+			next = dir.replace(&node{info: vfs.FileInfo{Name: elem, Mode: vfs.ModeDir | defaultDirPerm}})
+		}
+		dir = next
+	}
+
+	n.info.Name = elems[len(elems)-1]
+	if existing := dir.child(n.info.Name); existing != nil && existing.info.Mode.IsDir() && n.info.Mode.IsDir() {
+		existing.info.Mode = n.info.Mode
+		return
+	}
+
+	dir.replace(n)
+}
+
+// replace adds n to a directory, replacing any entry with the same name.
+func (n *node) replace(c *node) *node {
+	c.parent = n
+	for i, existing := range n.children {
+		if existing.info.Name == c.info.Name {
+			n.children[i] = c
+			return c
+		}
+	}
+
+	n.children = append(n.children, c)
+	return c
+}
+
+// lookup resolves a path relative to dir, following any symbolic links.
+// Absolute link targets are resolved relative to the filesystem root.
+func (fs *FS) lookup(dir *node, path string, depth int) (*node, *kernel.Error) {
+	cur := dir
+	if strings.HasPrefix(path, "/") {
+		cur = fs.root
+	}
+
+	for _, elem := range splitPath(path) {
+		if elem == ".." {
+			cur = cur.parent
+			continue
+		}
+
+		if !cur.info.Mode.IsDir() {
+			return nil, vfs.ErrNotDir
+		}
+
+		next := cur.child(elem)
+		if next == nil {
+			return nil, vfs.ErrNotFound
+		}
+
+		if next.info.Mode&vfs.ModeSymlink != 0 {
+			if depth == maxLinkDepth {
+				return nil, errTooManyLinks
+			}
+
+			var err *kernel.Error
+			if next, err = fs.lookup(cur, next.target, depth+1); err != nil {
+				return nil, err
+			}
+		}
+
+		cur = next
+	}
+
+	return cur, nil
+}
+
+// splitPath returns the non-empty elements of a path, skipping "." elements.
+func splitPath(path string) []string {
+	var elems []string
+	for _, elem := range strings.Split(path, "/") {
+		if elem != "" && elem != "." {
+			elems = append(elems, elem)
+		}
+	}
+
+	return elems
+}
+
+// validChecksum returns true if the checksum stored in a header matches the
+// sum of the header bytes where the checksum field is treated as spaces.
+func validChecksum(hdr []byte) bool {
+	stored, ok := parseOctal(hdr[hdrChecksum : hdrChecksum+hdrChecksumLen])
+	if !ok {
+		return false
+	}
+
+	var sum uint64
+	for i, b := range hdr {
+		if i >= hdrChecksum && i < hdrChecksum+hdrChecksumLen {
+			b = ' '
+		}
+		sum += uint64(b)
+	}
+
+	return sum == stored
+}
+
+// parseOctal parses a NUL or space terminated octal number that may be
+// preceded by spaces.
+func parseOctal(field []byte) (uint64, bool) {
+	var (
+		val    uint64
+		digits int
+	)
+
+	for _, b := range field {
+		switch {
+		case b == ' ' && digits == 0:
+		case b >= '0' && b <= '7':
+			val = val<<3 | uint64(b-'0')
+			digits++
+		case b == ' ' || b == 0:
+			return val, true
+		default:
+			return 0, false
+		}
+	}
+
+	return val, true
+}
+
+// cString returns the contents of a NUL-terminated field.
+func cString(field []byte) string {
+	for i, b := range field {
+		if b == 0 {
+			return string(field[:i])
+		}
+	}
+
+	return string(field)
+}
+
+func isZero(block []byte) bool {
+	for _, b := range block {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,262 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/vfs"
+	"strings"
+	"testing"
+)
+
+func makeArchive(t *testing.T, format tar.Format, entries []*tar.Header, contents map[string]string) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+
+	for _, hdr := range entries {
+		hdr.Format = format
+		data := contents[hdr.Name]
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(data))
+		}
+
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func testArchive(t *testing.T, format tar.Format) []byte {
+	longPath := "usr/share/" + strings.Repeat("d", 120) + "/font.psf"
+
+	return makeArchive(t, format, []*tar.Header{
+		{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "./etc/motd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "./etc/issue", Typeflag: tar.TypeLink, Linkname: "./etc/motd"},
+		{Name: "bin/init", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "init"},
+		{Name: "sbin", Typeflag: tar.TypeSymlink, Linkname: "/bin"},
+		{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "../lib"},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666},
+		{Name: longPath, Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755},
+	}, map[string]string{
+		"./etc/motd": "welcome to gopher-os\n",
+		"bin/init":   "\x7fELF",
+		longPath:     "glyphs",
+	})
+}
+
+func TestNew(t *testing.T) {
+	// GNU archives encode the long path using a long name entry while
+	// ustar archives split it into a prefix and a name.
+	for _, format := range []tar.Format{tar.FormatUSTAR, tar.FormatGNU} {
+		fs, err := New(testArchive(t, format))
+		if err != nil {
+			t.Fatalf("[format %v] %v", format, err)
+		}
+
+		specs := []struct {
+			path    string
+			expMode vfs.Mode
+			expData string
+			expErr  *kernel.Error
+		}{
+			{"/", vfs.ModeDir | 0755, "", nil},
+			{"/etc", vfs.ModeDir | 0755, "", nil},
+			{"/etc/motd", 0644, "welcome to gopher-os\n", nil},
+			{"/etc/issue", 0644, "welcome to gopher-os\n", nil},
+			{"/bin/sh", 0755, "\x7fELF", nil},
+			{"/sbin/sh", 0755, "\x7fELF", nil},
+			{"/usr/share/" + strings.Repeat("d", 120) + "/font.psf", 0644, "glyphs", nil},
+			{"/etc/motd/file", 0, "", vfs.ErrNotDir},
+			{"/etc/passwd", 0, "", vfs.ErrNotFound},
+			{"/dev/null", 0, "", vfs.ErrNotFound},
+			{"/lib/libc.so", 0, "", errTooManyLinks},
+		}
+
+		for specIndex, spec := range specs {
+			info, err := fs.Stat(spec.path)
+			if err != spec.expErr {
+				t.Errorf("[format %v, spec %d] expected error %v; got %v", format, specIndex, spec.expErr, err)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+
+			if info.Mode != spec.expMode || (info.Mode.IsRegular() && info.Size != int64(len(spec.expData))) {
+				t.Errorf("[format %v, spec %d] unexpected info for %q: %+v", format, specIndex, spec.path, info)
+			}
+
+			if !info.Mode.IsRegular() {
+				continue
+			}
+
+			f, err := fs.Open(spec.path)
+			if err != nil {
+				t.Errorf("[format %v, spec %d] unexpected error %v", format, specIndex, err)
+				continue
+			}
+
+			buf := make([]byte, 64)
+			n, _ := f.Read(buf)
+			if got := string(buf[:n]); got != spec.expData {
+				t.Errorf("[format %v, spec %d] expected contents %q; got %q", format, specIndex, spec.expData, got)
+			}
+		}
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	fs, err := New(testArchive(t, tar.FormatGNU))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, info := range list {
+		names = append(names, info.Name)
+	}
+	if exp := "etc bin sbin lib usr"; strings.Join(names, " ") != exp {
+		t.Fatalf("expected root directory to contain %q; got %q", exp, strings.Join(names, " "))
+	}
+
+	if _, err = fs.ReadDir("/etc/motd"); err != vfs.ErrNotDir {
+		t.Fatalf("expected error %v; got %v", vfs.ErrNotDir, err)
+	}
+
+	if _, err = fs.ReadDir("/missing"); err != vfs.ErrNotFound {
+		t.Fatalf("expected error %v; got %v", vfs.ErrNotFound, err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	fs, err := New(testArchive(t, tar.FormatUSTAR))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open("/etc/motd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 64)
+	if n, _ := f.Read(buf); string(buf[:n]) != "welcome to gopher-os\n" {
+		t.Fatalf("unexpected file contents %q", buf[:n])
+	}
+
+	if _, err = f.Write([]byte("x")); err != vfs.ErrReadOnly {
+		t.Fatalf("expected error %v; got %v", vfs.ErrReadOnly, err)
+	}
+
+	if info, _ := f.Stat(); info.Name != "motd" {
+		t.Fatalf("expected file name motd; got %q", info.Name)
+	}
+
+	dir, _ := fs.Open("/etc")
+	if _, err = dir.Read(make([]byte, 1)); err != vfs.ErrIsDir {
+		t.Fatalf("expected error %v; got %v", vfs.ErrIsDir, err)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	valid := makeArchive(t, tar.FormatUSTAR, []*tar.Header{
+		{Name: "motd", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"motd": "hello"})
+
+	specs := []struct {
+		corrupt func([]byte) []byte
+		expErr  *kernel.Error
+	}{
+		{func(a []byte) []byte { a[0] = 'x'; return a }, errBadHeader},
+		{func(a []byte) []byte { return a[:blockSize+2] }, errTruncated},
+		{
+			func(a []byte) []byte {
+				copy(a[hdrSize:], "12345678x01 ")
+				return fixChecksum(a)
+			},
+			errBadHeader,
+		},
+		{
+			func(a []byte) []byte {
+				copy(a[hdrMode:], "9999999\x00")
+				return fixChecksum(a)
+			},
+			errBadHeader,
+		},
+		{
+			func(a []byte) []byte {
+				a[hdrType] = typeHardLink
+				copy(a[hdrLinkName:], "missing")
+				return fixChecksum(a)
+			},
+			errBadHardLink,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		archive := spec.corrupt(append([]byte(nil), valid...))
+		if _, err := New(archive); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	// Archives without an end-of-archive marker are accepted
+	if _, err := New(valid[:2*blockSize]); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestMount(t *testing.T) {
+	defer func() { mountFn = vfs.Mount }()
+
+	var mountedAt string
+	mountFn = func(path string, fs vfs.FileSystem) *kernel.Error {
+		mountedAt = path
+		return nil
+	}
+
+	if err := Mount("/", testArchive(t, tar.FormatUSTAR)); err != nil || mountedAt != "/" {
+		t.Fatalf("expected archive to be mounted at /; got %q, %v", mountedAt, err)
+	}
+
+	if err := Mount("/initrd", []byte(strings.Repeat("x", blockSize))); err != errBadHeader {
+		t.Fatalf("expected error %v; got %v", errBadHeader, err)
+	}
+}
+
+// fixChecksum recalculates the checksum of the first header in an archive.
+func fixChecksum(archive []byte) []byte {
+	hdr := archive[:blockSize]
+	copy(hdr[hdrChecksum:], "        ")
+
+	var sum int
+	for _, b := range hdr {
+		sum += int(b)
+	}
+
+	for i := 6; i >= 0; i-- {
+		hdr[hdrChecksum+i] = byte('0' + sum&7)
+		sum >>= 3
+	}
+	hdr[hdrChecksum+7] = 0
+
+	return archive
+}
@@ -0,0 +1,280 @@
+// Package vfs implements a virtual filesystem layer that combines the mounted
+// filesystems into a single directory tree.
+//
+// Each filesystem is mounted at an absolute path. Requests for a path are
+// forwarded to the filesystem with the longest mount point that contains the
+// path; the filesystem receives the remainder of the path as an absolute path
+// relative to its own root.
+package vfs
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/sync"
+	"strings"
+)
+
+// Mode describes the type and permission bits of a file.
+type Mode uint32
+
+// The list of supported file mode bits.
+const (
+	ModeDir     Mode = 1 << 31
+	ModeSymlink Mode = 1 << 30
+	ModePipe    Mode = 1 << 29
+	ModeType         = ModeDir | ModeSymlink | ModePipe
+	ModePerm    Mode = 0777
+)
+
+// IsDir returns true if the mode describes a directory.
+func (m Mode) IsDir() bool {
+	return m&ModeDir != 0
+}
+
+// IsRegular returns true if the mode describes a regular file.
+func (m Mode) IsRegular() bool {
+	return m&ModeType == 0
+}
+
+// FileInfo describes a file.
+type FileInfo struct {
+	// Name is the last element of the file path.
+	Name string
+
+	// Size is the length of a regular file in bytes.
+	Size int64
+
+	Mode Mode
+}
+
+// The list of supported whence values for File.Lseek.
+const (
+	SeekStart = iota
+	SeekCurrent
+	SeekEnd
+)
+
+// File is an open file.
+type File interface {
+	// Read reads up to len(buf) bytes from the current file offset and
+	// advances the offset. It returns 0 once the end of the file has been
+	// reached.
+	Read(buf []byte) (int, *kernel.Error)
+
+	// Write writes buf at the current file offset and advances the
+	// offset.
+	Write(buf []byte) (int, *kernel.Error)
+
+	// Lseek sets the file offset for the next Read or Write relative to
+	// whence and returns the new offset.
+	Lseek(offset int64, whence int) (int64, *kernel.Error)
+
+	// Stat returns information about the file.
+	Stat() (FileInfo, *kernel.Error)
+
+	// Close releases the file.
+	Close() *kernel.Error
+}
+
+// FileSystem is implemented by all filesystems that can be mounted. All paths
+// passed to a FileSystem are absolute, clean and relative to its root.
+type FileSystem interface {
+	// Open opens the file at the specified path.
+	Open(path string) (File, *kernel.Error)
+
+	// Stat returns information about the file at the specified path.
+	Stat(path string) (FileInfo, *kernel.Error)
+
+	// ReadDir returns the contents of the directory at the specified
+	// path.
+	ReadDir(path string) ([]FileInfo, *kernel.Error)
+}
+
+// Creator is implemented by filesystems that support creating files.
+type Creator interface {
+	// Create creates the regular file at the specified path, or
+	// truncates it if it already exists, and opens it for reading and
+	// writing.
+	Create(path string) (File, *kernel.Error)
+}
+
+// mount associates a filesystem with a mount point.
+type mount struct {
+	path string
+	fs   FileSystem
+}
+
+var (
+	// Errors returned by the vfs and the filesystem implementations.
+	ErrNotFound    = &kernel.Error{Module: "vfs", Message: "no such file or directory", Code: kernel.CodeNotFound}
+	ErrNotDir      = &kernel.Error{Module: "vfs", Message: "not a directory", Code: kernel.CodeNotDir}
+	ErrIsDir       = &kernel.Error{Module: "vfs", Message: "is a directory", Code: kernel.CodeIsDir}
+	ErrReadOnly    = &kernel.Error{Module: "vfs", Message: "read-only filesystem", Code: kernel.CodeReadOnly}
+	ErrInvalidPath = &kernel.Error{Module: "vfs", Message: "path is not absolute", Code: kernel.CodeInvalid}
+	ErrInvalidSeek = &kernel.Error{Module: "vfs", Message: "invalid file offset", Code: kernel.CodeInvalid}
+
+	errAlreadyMounted = &kernel.Error{Module: "vfs", Message: "a filesystem is already mounted at this path", Code: kernel.CodeBusy}
+
+	// mounts contains the mounted filesystems sorted by the length of
+	// their mount points in descending order.
+	mounts    []mount
+	mountLock sync.Spinlock
+)
+
+// Mount attaches a filesystem to the directory tree at the specified absolute
+// path.
+func Mount(path string, fs FileSystem) *kernel.Error {
+	path, err := Clean(path)
+	if err != nil {
+		return err
+	}
+
+	mountLock.Acquire()
+	defer mountLock.Release()
+
+	index := len(mounts)
+	for i, m := range mounts {
+		if m.path == path {
+			return errAlreadyMounted
+		}
+
+		if len(m.path) < len(path) && index == len(mounts) {
+			index = i
+		}
+	}
+
+	mounts = append(mounts, mount{})
+	copy(mounts[index+1:], mounts[index:])
+	mounts[index] = mount{path: path, fs: fs}
+	return nil
+}
+
+// Open opens the file at the specified absolute path.
+func Open(path string) (File, *kernel.Error) {
+	fs, rel, err := resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.Open(rel)
+}
+
+// Create creates or truncates the regular file at the specified absolute path
+// and opens it for reading and writing. ErrReadOnly is returned if the
+// filesystem that contains path does not support creating files.
+func Create(path string) (File, *kernel.Error) {
+	fs, rel, err := resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	creator, ok := fs.(Creator)
+	if !ok {
+		return nil, ErrReadOnly
+	}
+
+	return creator.Create(rel)
+}
+
+// Stat returns information about the file at the specified absolute path.
+func Stat(path string) (FileInfo, *kernel.Error) {
+	fs, rel, err := resolve(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	return fs.Stat(rel)
+}
+
+// ReadDir returns the contents of the directory at the specified absolute
+// path.
+func ReadDir(path string) ([]FileInfo, *kernel.Error) {
+	fs, rel, err := resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.ReadDir(rel)
+}
+
+// ReadFile returns the contents of the regular file at the specified absolute
+// path.
+func ReadFile(path string) ([]byte, *kernel.Error) {
+	f, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode.IsDir() {
+		return nil, ErrIsDir
+	}
+
+	data := make([]byte, 0, info.Size)
+	for {
+		if len(data) == cap(data) {
+			data = append(data, 0)[:len(data)]
+		}
+
+		n, err := f.Read(data[len(data):cap(data)])
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return data, nil
+		}
+		data = data[:len(data)+n]
+	}
+}
+
+// Clean returns the shortest absolute path equivalent to path by eliminating
+// repeated separators as well as "." and ".." elements. An error is returned
+// if path is not absolute.
+func Clean(path string) (string, *kernel.Error) {
+	if len(path) == 0 || path[0] != '/' {
+		return "", ErrInvalidPath
+	}
+
+	elems := make([]string, 0, strings.Count(path, "/"))
+	for _, elem := range strings.Split(path, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			if len(elems) != 0 {
+				elems = elems[:len(elems)-1]
+			}
+		default:
+			elems = append(elems, elem)
+		}
+	}
+
+	return "/" + strings.Join(elems, "/"), nil
+}
+
+// resolve returns the filesystem that contains path and the path relative to
+// the root of that filesystem.
+func resolve(path string) (FileSystem, string, *kernel.Error) {
+	path, err := Clean(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	mountLock.Acquire()
+	defer mountLock.Release()
+
+	for _, m := range mounts {
+		switch {
+		case m.path == "/":
+			return m.fs, path, nil
+		case path == m.path:
+			return m.fs, "/", nil
+		case strings.HasPrefix(path, m.path) && path[len(m.path)] == '/':
+			return m.fs, path[len(m.path):], nil
+		}
+	}
+
+	return nil, "", ErrNotFound
+}
@@ -0,0 +1,222 @@
+package vfs
+
+import (
+	"gopheros/kernel"
+	"testing"
+)
+
+// mockFS records the paths it receives and serves a single file whose
+// contents are returned in small chunks.
+type mockFS struct {
+	name  string
+	paths []string
+	data  []byte
+	mode  Mode
+}
+
+func (fs *mockFS) Open(path string) (File, *kernel.Error) {
+	fs.paths = append(fs.paths, path)
+	return &mockFile{fs: fs}, nil
+}
+
+func (fs *mockFS) Stat(path string) (FileInfo, *kernel.Error) {
+	fs.paths = append(fs.paths, path)
+	return FileInfo{Name: fs.name, Size: int64(len(fs.data)), Mode: fs.mode}, nil
+}
+
+func (fs *mockFS) ReadDir(path string) ([]FileInfo, *kernel.Error) {
+	fs.paths = append(fs.paths, path)
+	return nil, ErrNotDir
+}
+
+type mockFile struct {
+	fs     *mockFS
+	offset int
+}
+
+func (f *mockFile) Read(buf []byte) (int, *kernel.Error) {
+	if len(buf) > 3 {
+		buf = buf[:3]
+	}
+	n := copy(buf, f.fs.data[f.offset:])
+	f.offset += n
+	return n, nil
+}
+
+func (f *mockFile) Write(_ []byte) (int, *kernel.Error)         { return 0, ErrReadOnly }
+func (f *mockFile) Lseek(_ int64, _ int) (int64, *kernel.Error) { return 0, ErrInvalidSeek }
+func (f *mockFile) Stat() (FileInfo, *kernel.Error)             { return f.fs.Stat("") }
+func (f *mockFile) Close() *kernel.Error                        { return nil }
+
+func TestClean(t *testing.T) {
+	specs := []struct {
+		in     string
+		exp    string
+		expErr *kernel.Error
+	}{
+		{"/", "/", nil},
+		{"//usr///lib/", "/usr/lib", nil},
+		{"/usr/./lib/../bin", "/usr/bin", nil},
+		{"/../..", "/", nil},
+		{"", "", ErrInvalidPath},
+		{"usr/lib", "", ErrInvalidPath},
+	}
+
+	for specIndex, spec := range specs {
+		got, err := Clean(spec.in)
+		if got != spec.exp || err != spec.expErr {
+			t.Errorf("[spec %d] expected Clean(%q) to return (%q, %v); got (%q, %v)", specIndex, spec.in, spec.exp, spec.expErr, got, err)
+		}
+	}
+}
+
+func TestMountResolution(t *testing.T) {
+	defer func() { mounts = nil }()
+
+	if _, err := Stat("/etc/motd"); err != ErrNotFound {
+		t.Fatalf("expected error %v when nothing is mounted; got %v", ErrNotFound, err)
+	}
+
+	root, proc, procSys := &mockFS{name: "root"}, &mockFS{name: "proc"}, &mockFS{name: "sys"}
+	for _, spec := range []struct {
+		path string
+		fs   FileSystem
+	}{
+		{"/proc", proc},
+		{"/", root},
+		{"/proc/sys/", procSys},
+	} {
+		if err := Mount(spec.path, spec.fs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Mount("/proc/./", root); err != errAlreadyMounted {
+		t.Fatalf("expected error %v; got %v", errAlreadyMounted, err)
+	}
+
+	if err := Mount("proc", root); err != ErrInvalidPath {
+		t.Fatalf("expected error %v; got %v", ErrInvalidPath, err)
+	}
+
+	specs := []struct {
+		path    string
+		expFS   *mockFS
+		expPath string
+	}{
+		{"/", root, "/"},
+		{"/etc/motd", root, "/etc/motd"},
+		{"/processes", root, "/processes"},
+		{"/proc", proc, "/"},
+		{"/proc/meminfo", proc, "/meminfo"},
+		{"/proc/sys/kernel/../vm", procSys, "/vm"},
+		{"/proc/sys", procSys, "/"},
+	}
+
+	for specIndex, spec := range specs {
+		spec.expFS.paths = nil
+		info, err := Stat(spec.path)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error %v", specIndex, err)
+			continue
+		}
+
+		if info.Name != spec.expFS.name || len(spec.expFS.paths) != 1 || spec.expFS.paths[0] != spec.expPath {
+			t.Errorf("[spec %d] expected %q to resolve to %q on the %s filesystem; got %s with paths %v",
+				specIndex, spec.path, spec.expPath, spec.expFS.name, info.Name, spec.expFS.paths)
+		}
+	}
+
+	if _, err := ReadDir("/proc/sys"); err != ErrNotDir {
+		t.Fatalf("expected ReadDir to be forwarded to the filesystem; got %v", err)
+	}
+
+	if _, err := Open("relative"); err != ErrInvalidPath {
+		t.Errorf("expected Open to fail with %v; got %v", ErrInvalidPath, err)
+	}
+	if _, err := Stat("relative"); err != ErrInvalidPath {
+		t.Errorf("expected Stat to fail with %v; got %v", ErrInvalidPath, err)
+	}
+	if _, err := ReadDir("relative"); err != ErrInvalidPath {
+		t.Errorf("expected ReadDir to fail with %v; got %v", ErrInvalidPath, err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	defer func() { mounts = nil }()
+
+	fs := &mockFS{name: "motd", data: []byte("welcome to gopher-os")}
+	if err := Mount("/", fs); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ReadFile("/etc/motd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != string(fs.data) {
+		t.Fatalf("expected ReadFile to return %q; got %q", fs.data, data)
+	}
+
+	fs.mode = ModeDir
+	if _, err = ReadFile("/etc"); err != ErrIsDir {
+		t.Fatalf("expected error %v; got %v", ErrIsDir, err)
+	}
+
+	if _, err = ReadFile("etc"); err != ErrInvalidPath {
+		t.Fatalf("expected error %v; got %v", ErrInvalidPath, err)
+	}
+}
+
+// mockCreatorFS is a mockFS that supports creating files.
+type mockCreatorFS struct {
+	mockFS
+}
+
+func (fs *mockCreatorFS) Create(path string) (File, *kernel.Error) {
+	fs.paths = append(fs.paths, path)
+	return &mockFile{fs: &fs.mockFS}, nil
+}
+
+func TestCreate(t *testing.T) {
+	defer func() { mounts = nil }()
+
+	root, tmp := &mockFS{name: "root"}, &mockCreatorFS{mockFS{name: "tmp"}}
+	if err := Mount("/", root); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mount("/tmp", tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Create("/etc/motd"); err != ErrReadOnly {
+		t.Errorf("expected error %v for a filesystem that cannot create files; got %v", ErrReadOnly, err)
+	}
+
+	if f, err := Create("/tmp/core.1"); err != nil || f == nil || len(tmp.paths) != 1 || tmp.paths[0] != "/core.1" {
+		t.Errorf("expected Create to be forwarded to the filesystem; got %v, paths %v", err, tmp.paths)
+	}
+
+	if _, err := Create("relative"); err != ErrInvalidPath {
+		t.Errorf("expected error %v; got %v", ErrInvalidPath, err)
+	}
+}
+
+func TestMode(t *testing.T) {
+	specs := []struct {
+		mode       Mode
+		expDir     bool
+		expRegular bool
+	}{
+		{0644, false, true},
+		{ModeDir | 0755, true, false},
+		{ModeSymlink | 0777, false, false},
+	}
+
+	for specIndex, spec := range specs {
+		if spec.mode.IsDir() != spec.expDir || spec.mode.IsRegular() != spec.expRegular {
+			t.Errorf("[spec %d] unexpected type for mode 0x%x", specIndex, spec.mode)
+		}
+	}
+}
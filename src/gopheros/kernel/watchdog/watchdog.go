@@ -0,0 +1,121 @@
+// Package watchdog implements a lockup detector for the boot processor.
+//
+// Soft lockups (a thread that keeps running without ever yielding the CPU) are
+// detected from the timer tick by checking whether the scheduler has made any
+// progress. The state of the offending code is reported but the kernel keeps
+// running.
+//
+// Hard lockups (code that spins with interrupts disabled so timer ticks are no
+// longer delivered) are detected by a periodic NMI generated by the legacy PIT
+// and routed through the I/O APIC. As the system cannot recover from a hard
+// lockup, the detector triggers a kernel panic.
+package watchdog
+
+import (
+	"gopheros/device/pit"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/timer"
+)
+
+const (
+	// SoftLockupThreshold is the time that a thread may run without
+	// yielding before a soft lockup is reported.
+	SoftLockupThreshold = 10 * timer.Second
+
+	// HardLockupThreshold is the time that timer ticks may be missing
+	// before a hard lockup is reported.
+	HardLockupThreshold = 10 * timer.Second
+)
+
+var (
+	errHardLockup = &kernel.Error{Module: "watchdog", Message: "hard lockup detected: timer interrupts have stopped"}
+
+	soft softDetector
+	hard hardDetector
+
+	// The following functions are used by tests to mock calls to the
+	// cpu, gate, irq, kfmt, pit, sched and timer packages.
+	ticksFn              = timer.Ticks
+	addTickHookFn        = timer.AddTickHook
+	progressFn           = sched.Progress
+	currentThreadFn      = sched.Current
+	handleInterruptFn    = gate.HandleInterrupt
+	routeNMIFn           = irq.RouteNMI
+	unmaskFn             = irq.Unmask
+	portWriteByteFn      = cpu.PortWriteByte
+	dumpStateFn          = kfmt.DumpState
+	panicWithRegistersFn = kfmt.PanicWithRegisters
+	pitTickSourceFn      = pit.TickSourceActive
+)
+
+// softDetector tracks the scheduler progress counter across timer ticks.
+type softDetector struct {
+	lastProgress uint64
+
+	// since is the tick count when lastProgress was last updated.
+	since uint64
+
+	// reported is set once a lockup has been reported so that each
+	// lockup is only reported once.
+	reported bool
+}
+
+// hardDetector tracks the timer tick count across watchdog NMIs.
+type hardDetector struct {
+	lastTicks uint64
+
+	// stalledNMIs counts the NMIs received since lastTicks was updated.
+	stalledNMIs uint64
+}
+
+// Init enables the lockup detectors. It must be invoked after the timer
+// subsystem has been initialized. If the active interrupt controller cannot
+// deliver NMIs, Init returns an error but soft lockup detection remains
+// enabled. The same applies if the PIT generates the timer tick as its IRQ
+// cannot be used for both purposes.
+func Init() *kernel.Error {
+	soft = softDetector{lastProgress: progressFn(), since: ticksFn()}
+	addTickHookFn(checkSoftLockup)
+
+	return initHardDetector()
+}
+
+// checkSoftLockup is invoked on each timer tick with the state of the
+// interrupted code. It reports the interrupted thread if the scheduler has not
+// run for SoftLockupThreshold.
+func checkSoftLockup(regs *gate.Registers) {
+	now := ticksFn()
+	if progress := progressFn(); progress != soft.lastProgress {
+		soft = softDetector{lastProgress: progress, since: now}
+		return
+	}
+
+	if soft.reported || now-soft.since < uint64(SoftLockupThreshold/timer.TickDuration) {
+		return
+	}
+
+	soft.reported = true
+	if thread := currentThreadFn(); thread != nil {
+		kfmt.Printf("[watchdog] soft lockup: thread %s (id %d) has not yielded the CPU for %ds\n", thread.Name(), thread.ID(), (now-soft.since)/timer.Hz)
+	}
+	dumpStateFn(regs)
+}
+
+// checkHardLockup is invoked on each NMI. It triggers a kernel panic if no
+// timer ticks have been received for HardLockupThreshold.
+func checkHardLockup(regs *gate.Registers) {
+	if now := ticksFn(); now != hard.lastTicks {
+		hard = hardDetector{lastTicks: now}
+		return
+	}
+
+	hard.stalledNMIs++
+	if hard.stalledNMIs >= uint64(HardLockupThreshold/timer.Second)*nmiHz {
+		panicWithRegistersFn(errHardLockup, regs)
+	}
+}
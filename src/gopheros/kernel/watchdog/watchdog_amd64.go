@@ -0,0 +1,46 @@
+package watchdog
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+)
+
+const (
+	// nmiHz is the frequency of the NMIs used for hard lockup detection.
+	nmiHz = 20
+
+	// PIT channel 0 is wired to ISA IRQ 0. It is programmed as a rate
+	// generator (mode 2) with a 16-bit binary divisor.
+	pitIRQ            = uint8(0)
+	pitFrequency      = uint32(1193182)
+	pitChannel0Port   = uint16(0x40)
+	pitCommandPort    = uint16(0x43)
+	pitRateGenerator0 = uint8(0x34)
+)
+
+var errPITInUse = &kernel.Error{Module: "watchdog", Message: "hard lockup detection is unavailable as the PIT is used as the tick source"}
+
+// initHardDetector programs the PIT to raise periodic NMIs and installs the
+// hard lockup handler for them.
+func initHardDetector() *kernel.Error {
+	if pitTickSourceFn() {
+		return errPITInUse
+	}
+
+	gsi := irq.ISAIRQToGSI(pitIRQ)
+	if err := routeNMIFn(gsi); err != nil {
+		return err
+	}
+
+	hard = hardDetector{lastTicks: ticksFn()}
+	handleInterruptFn(gate.NMI, 0, checkHardLockup)
+
+	divisor := pitFrequency / nmiHz
+	portWriteByteFn(pitCommandPort, pitRateGenerator0)
+	portWriteByteFn(pitChannel0Port, uint8(divisor))
+	portWriteByteFn(pitChannel0Port, uint8(divisor>>8))
+	unmaskFn(gsi)
+
+	return nil
+}
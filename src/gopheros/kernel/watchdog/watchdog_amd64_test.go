@@ -0,0 +1,200 @@
+package watchdog
+
+import (
+	"gopheros/device/pit"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/sched"
+	"gopheros/kernel/timer"
+	"testing"
+)
+
+func restoreMocks() {
+	ticksFn = timer.Ticks
+	addTickHookFn = timer.AddTickHook
+	progressFn = sched.Progress
+	currentThreadFn = sched.Current
+	handleInterruptFn = gate.HandleInterrupt
+	routeNMIFn = irq.RouteNMI
+	unmaskFn = irq.Unmask
+	portWriteByteFn = cpu.PortWriteByte
+	dumpStateFn = kfmt.DumpState
+	panicWithRegistersFn = kfmt.PanicWithRegisters
+	pitTickSourceFn = pit.TickSourceActive
+	soft = softDetector{}
+	hard = hardDetector{}
+}
+
+// mockSystem emulates the timer, scheduler and interrupt controller.
+type mockSystem struct {
+	ticks    uint64
+	progress uint64
+
+	tickHook   func(*gate.Registers)
+	nmiHandler func(*gate.Registers)
+	nmiGSI     uint32
+	unmasked   []uint32
+	portWrites []uint8
+	dumps      int
+	panics     []interface{}
+}
+
+func (m *mockSystem) install(routeErr *kernel.Error) {
+	ticksFn = func() uint64 { return m.ticks }
+	addTickHookFn = func(fn func(*gate.Registers)) { m.tickHook = fn }
+	progressFn = func() uint64 { return m.progress }
+	currentThreadFn = func() *sched.Thread { return nil }
+	handleInterruptFn = func(intNumber gate.InterruptNumber, _ uint8, fn func(*gate.Registers)) {
+		if intNumber == gate.NMI {
+			m.nmiHandler = fn
+		}
+	}
+	routeNMIFn = func(gsi uint32) *kernel.Error {
+		m.nmiGSI = gsi
+		return routeErr
+	}
+	unmaskFn = func(gsi uint32) { m.unmasked = append(m.unmasked, gsi) }
+	portWriteByteFn = func(_ uint16, val uint8) { m.portWrites = append(m.portWrites, val) }
+	dumpStateFn = func(_ kfmt.RegisterState) { m.dumps++ }
+	panicWithRegistersFn = func(e interface{}, _ kfmt.RegisterState) { m.panics = append(m.panics, e) }
+}
+
+func TestInit(t *testing.T) {
+	defer restoreMocks()
+
+	expErr := &kernel.Error{Module: "test", Message: "no NMI routing"}
+	m := &mockSystem{}
+	m.install(expErr)
+
+	if err := Init(); err != expErr {
+		t.Fatalf("expected to get error %v; got %v", expErr, err)
+	}
+
+	if m.tickHook == nil || m.nmiHandler != nil || len(m.unmasked) != 0 {
+		t.Fatal("expected only the soft lockup detector to be enabled")
+	}
+
+	m = &mockSystem{}
+	m.install(nil)
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.tickHook == nil || m.nmiHandler == nil {
+		t.Fatal("expected both lockup detectors to be enabled")
+	}
+
+	if gsi := irq.ISAIRQToGSI(pitIRQ); m.nmiGSI != gsi || len(m.unmasked) != 1 || m.unmasked[0] != gsi {
+		t.Errorf("expected the PIT GSI to be routed as an NMI and unmasked")
+	}
+
+	divisor := pitFrequency / nmiHz
+	if exp := []uint8{pitRateGenerator0, uint8(divisor), uint8(divisor >> 8)}; len(m.portWrites) != 3 || m.portWrites[0] != exp[0] || m.portWrites[1] != exp[1] || m.portWrites[2] != exp[2] {
+		t.Errorf("expected PIT to be programmed with %v; got %v", exp, m.portWrites)
+	}
+
+	// If the PIT generates the timer tick, it must not be reprogrammed
+	m = &mockSystem{}
+	m.install(nil)
+	pitTickSourceFn = func() bool { return true }
+	if err := Init(); err != errPITInUse {
+		t.Fatalf("expected to get errPITInUse; got %v", err)
+	}
+
+	if m.tickHook == nil || m.nmiHandler != nil || len(m.portWrites) != 0 {
+		t.Fatal("expected only the soft lockup detector to be enabled")
+	}
+}
+
+func TestSoftLockup(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockSystem{}
+	m.install(nil)
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	thresholdTicks := uint64(SoftLockupThreshold / timer.TickDuration)
+
+	// As long as the scheduler makes progress, nothing is reported
+	for i := uint64(0); i < 2*thresholdTicks; i++ {
+		m.ticks++
+		m.progress++
+		m.tickHook(nil)
+	}
+
+	if m.dumps != 0 {
+		t.Fatal("expected no lockup to be reported while the scheduler makes progress")
+	}
+
+	// A stalled scheduler is reported once the threshold is reached
+	for i := uint64(0); i < thresholdTicks-1; i++ {
+		m.ticks++
+		m.tickHook(nil)
+	}
+
+	if m.dumps != 0 {
+		t.Fatal("expected no lockup to be reported before the threshold is reached")
+	}
+
+	for i := 0; i < 10; i++ {
+		m.ticks++
+		m.tickHook(nil)
+	}
+
+	if m.dumps != 1 {
+		t.Fatalf("expected lockup to be reported exactly once; got %d", m.dumps)
+	}
+
+	// Once the scheduler recovers, new lockups are reported again
+	m.progress++
+	m.tickHook(nil)
+	m.ticks += thresholdTicks
+	m.tickHook(nil)
+
+	if m.dumps != 2 {
+		t.Fatalf("expected a new lockup to be reported; got %d reports", m.dumps)
+	}
+}
+
+func TestHardLockup(t *testing.T) {
+	defer restoreMocks()
+
+	m := &mockSystem{}
+	m.install(nil)
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	thresholdNMIs := int(HardLockupThreshold/timer.Second) * nmiHz
+
+	// NMIs that arrive while timer ticks are delivered reset the detector
+	for i := 0; i < 2*thresholdNMIs; i++ {
+		if i%(thresholdNMIs/2) == 0 {
+			m.ticks++
+		}
+		m.nmiHandler(nil)
+	}
+
+	if len(m.panics) != 0 {
+		t.Fatal("expected no lockup to be reported while timer ticks are delivered")
+	}
+
+	m.ticks++
+	for i := 0; i < thresholdNMIs; i++ {
+		m.nmiHandler(nil)
+	}
+
+	if len(m.panics) != 0 {
+		t.Fatal("expected no lockup to be reported before the threshold is reached")
+	}
+
+	m.nmiHandler(nil)
+	if len(m.panics) != 1 || m.panics[0] != errHardLockup {
+		t.Fatalf("expected a kernel panic with errHardLockup; got %v", m.panics)
+	}
+}
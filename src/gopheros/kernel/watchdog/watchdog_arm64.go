@@ -0,0 +1,15 @@
+package watchdog
+
+import "gopheros/kernel"
+
+// The arm64 port is a stub: hard lockup detection requires a non-maskable
+// interrupt source which has not been implemented yet.
+
+// nmiHz is the frequency of the NMIs used for hard lockup detection.
+const nmiHz = 20
+
+var errNoNMI = &kernel.Error{Module: "watchdog", Message: "hard lockup detection is not implemented on arm64", Code: kernel.CodeNotImplemented}
+
+func initHardDetector() *kernel.Error {
+	return errNoNMI
+}
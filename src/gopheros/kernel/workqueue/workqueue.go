@@ -0,0 +1,197 @@
+// Package workqueue allows interrupt handlers and other time-critical code to
+// defer work to a kernel thread.
+//
+// Each Queue is serviced by a dedicated kernel thread that runs the queued work
+// items in FIFO order. Enqueue and Cancel never block or allocate memory and
+// may therefore be invoked from interrupt context; the work functions run in
+// the context of the worker thread and are free to block.
+package workqueue
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kthread"
+	"gopheros/kernel/sync"
+)
+
+var (
+	// systemQueue is a shared queue for work items that do not require a
+	// dedicated worker thread.
+	systemQueue *Queue
+
+	// The following functions are used by tests to mock calls to the cpu,
+	// kthread and sync packages.
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn  = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	spawnFn             = kthread.Spawn
+	waitFn              = (*sync.WaitQueue).Wait
+	wakeFn              = (*sync.WaitQueue).WakeOne
+)
+
+// Work describes a function to be executed by a work queue. A Work item can be
+// queued repeatedly, but only once at a time.
+type Work struct {
+	fn     func()
+	queued bool
+	next   *Work
+}
+
+// NewWork returns a work item that invokes fn.
+func NewWork(fn func()) *Work {
+	return &Work{fn: fn}
+}
+
+// Queued returns true if the work item is queued and has not started
+// executing yet.
+func (w *Work) Queued() bool {
+	return w.queued
+}
+
+// Queue is a list of work items serviced by a dedicated kernel thread.
+type Queue struct {
+	name       string
+	head, tail *Work
+	waiters    sync.WaitQueue
+	worker     *kthread.Thread
+}
+
+// New creates a work queue and spawns a worker thread for it.
+func New(name string) (*Queue, *kernel.Error) {
+	q := &Queue{name: name}
+
+	worker, err := spawnFn(name, q.run)
+	if err != nil {
+		return nil, err
+	}
+	q.worker = worker
+
+	return q, nil
+}
+
+// Name returns the name of the queue.
+func (q *Queue) Name() string {
+	return q.name
+}
+
+// Enqueue appends w to the queue and wakes up the worker thread. It returns
+// false if w is already queued.
+func (q *Queue) Enqueue(w *Work) bool {
+	intr := lock()
+	if w.queued {
+		unlock(intr)
+		return false
+	}
+
+	w.queued = true
+	w.next = nil
+	if q.tail == nil {
+		q.head = w
+	} else {
+		q.tail.next = w
+	}
+	q.tail = w
+	wakeFn(&q.waiters)
+	unlock(intr)
+
+	return true
+}
+
+// Cancel removes w from the queue and returns true if w was queued. Cancel
+// does not wait for w to finish if it is already running.
+func (q *Queue) Cancel(w *Work) bool {
+	intr := lock()
+	defer unlock(intr)
+
+	var prev *Work
+	for cur := q.head; cur != nil; prev, cur = cur, cur.next {
+		if cur != w {
+			continue
+		}
+
+		if prev == nil {
+			q.head = cur.next
+		} else {
+			prev.next = cur.next
+		}
+		if q.tail == cur {
+			q.tail = prev
+		}
+
+		w.next = nil
+		w.queued = false
+		return true
+	}
+
+	return false
+}
+
+// Enqueue appends w to the system work queue. It returns false if w is already
+// queued or if the system work queue has not been initialized yet.
+func Enqueue(w *Work) bool {
+	if systemQueue == nil {
+		return false
+	}
+
+	return systemQueue.Enqueue(w)
+}
+
+// Init creates the system work queue.
+func Init() *kernel.Error {
+	if systemQueue != nil {
+		return nil
+	}
+
+	q, err := New("kworker")
+	if err != nil {
+		return err
+	}
+
+	systemQueue = q
+	return nil
+}
+
+// run implements the worker thread main loop.
+func (q *Queue) run() {
+	for {
+		q.runPending()
+	}
+}
+
+// runPending blocks until the queue is not empty and then executes all queued
+// work items.
+func (q *Queue) runPending() {
+	waitFn(&q.waiters, func() bool { return q.head != nil })
+
+	for w := q.dequeue(); w != nil; w = q.dequeue() {
+		w.fn()
+	}
+}
+
+// dequeue removes the first work item from the queue.
+func (q *Queue) dequeue() *Work {
+	intr := lock()
+	w := q.head
+	if w != nil {
+		if q.head = w.next; q.head == nil {
+			q.tail = nil
+		}
+		w.next = nil
+		w.queued = false
+	}
+	unlock(intr)
+
+	return w
+}
+
+func lock() bool {
+	intr := interruptsEnabledFn()
+	disableInterruptsFn()
+	return intr
+}
+
+func unlock(intr bool) {
+	if intr {
+		enableInterruptsFn()
+	}
+}
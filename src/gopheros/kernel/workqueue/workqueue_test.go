@@ -0,0 +1,148 @@
+package workqueue
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kthread"
+	"gopheros/kernel/sync"
+	"testing"
+)
+
+func restoreMocks() {
+	interruptsEnabledFn = cpu.InterruptsEnabled
+	enableInterruptsFn = cpu.EnableInterrupts
+	disableInterruptsFn = cpu.DisableInterrupts
+	spawnFn = kthread.Spawn
+	waitFn = (*sync.WaitQueue).Wait
+	wakeFn = (*sync.WaitQueue).WakeOne
+	systemQueue = nil
+}
+
+func mockInterrupts() *bool {
+	intrEnabled := new(bool)
+	*intrEnabled = true
+	interruptsEnabledFn = func() bool { return *intrEnabled }
+	enableInterruptsFn = func() { *intrEnabled = true }
+	disableInterruptsFn = func() { *intrEnabled = false }
+	return intrEnabled
+}
+
+func TestNew(t *testing.T) {
+	defer restoreMocks()
+
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+	spawnFn = func(_ string, _ func()) (*kthread.Thread, *kernel.Error) { return nil, expErr }
+
+	if _, err := New("test"); err != expErr {
+		t.Fatalf("expected to get error %v; got %v", expErr, err)
+	}
+
+	if err := Init(); err != expErr {
+		t.Fatalf("expected to get error %v; got %v", expErr, err)
+	}
+
+	var spawned []string
+	spawnFn = func(name string, _ func()) (*kthread.Thread, *kernel.Error) {
+		spawned = append(spawned, name)
+		return &kthread.Thread{}, nil
+	}
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Calling Init again is a no-op
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(spawned) != 1 || spawned[0] != "kworker" || systemQueue.Name() != "kworker" {
+		t.Errorf("expected a single kworker thread to be spawned; got %v", spawned)
+	}
+}
+
+func TestEnqueueAndRun(t *testing.T) {
+	defer restoreMocks()
+	intrEnabled := mockInterrupts()
+
+	var (
+		q       = &Queue{name: "test"}
+		wakeups int
+		order   []int
+	)
+	wakeFn = func(_ *sync.WaitQueue) bool {
+		if *intrEnabled {
+			t.Error("expected interrupts to be disabled while waking up the worker")
+		}
+		wakeups++
+		return true
+	}
+	waitFn = func(_ *sync.WaitQueue, cond func() bool) {
+		if !cond() {
+			t.Fatal("worker would block with a non-empty queue")
+		}
+	}
+
+	works := []*Work{
+		NewWork(func() { order = append(order, 0) }),
+		NewWork(func() { order = append(order, 1) }),
+		NewWork(func() { order = append(order, 2) }),
+	}
+
+	for specIndex, w := range works {
+		if !q.Enqueue(w) || !w.Queued() {
+			t.Fatalf("[spec %d] expected work to be queued", specIndex)
+		}
+	}
+
+	if q.Enqueue(works[0]) {
+		t.Error("expected Enqueue to return false for an already queued item")
+	}
+
+	if !q.Cancel(works[1]) || works[1].Queued() {
+		t.Error("expected Cancel to remove a queued item")
+	}
+
+	if q.Cancel(works[1]) {
+		t.Error("expected Cancel to return false for an item that is not queued")
+	}
+
+	q.runPending()
+
+	if len(order) != 2 || order[0] != 0 || order[1] != 2 {
+		t.Errorf("expected work items 0 and 2 to run in order; got %v", order)
+	}
+
+	if wakeups != 3 {
+		t.Errorf("expected worker to be woken up 3 times; got %d", wakeups)
+	}
+
+	if q.head != nil || q.tail != nil || works[0].Queued() {
+		t.Error("expected queue to be empty")
+	}
+
+	// Items can be re-queued once they have executed
+	if !q.Enqueue(works[0]) || !q.Cancel(works[0]) || q.tail != nil {
+		t.Error("expected executed item to be re-queued and cancelled")
+	}
+
+	if !*intrEnabled {
+		t.Error("expected interrupt flag to be restored")
+	}
+}
+
+func TestSystemQueue(t *testing.T) {
+	defer restoreMocks()
+	mockInterrupts()
+
+	w := NewWork(func() {})
+	if Enqueue(w) {
+		t.Fatal("expected Enqueue to fail before the system queue is initialized")
+	}
+
+	wakeFn = func(_ *sync.WaitQueue) bool { return true }
+	systemQueue = &Queue{name: "kworker"}
+	if !Enqueue(w) || systemQueue.head != w {
+		t.Error("expected work to be appended to the system queue")
+	}
+}
@@ -26,6 +26,17 @@ const (
 	tagFramebufferInfo
 	tagElfSymbols
 	tagApmTable
+	tagEfi32SystemTable
+	tagEfi64SystemTable
+	tagSmbiosTables
+	tagAcpiOldRSDP
+	tagAcpiNewRSDP
+	tagNetworkInfo
+	tagEfiMemoryMap
+	tagEfiBootServicesNotTerminated
+	tagEfi32ImageHandle
+	tagEfi64ImageHandle
+	tagImageLoadBaseAddr
 )
 
 // info describes the multiboot info section header.
@@ -141,6 +152,10 @@ const (
 	// MemNvs indicates memory that must be preserved when hibernating.
 	MemNvs
 
+	// MemBadRAM indicates a memory region that contains defective RAM
+	// and must not be used.
+	MemBadRAM
+
 	// Any value >= memUnknown will be mapped to MemReserved.
 	memUnknown
 )
@@ -163,6 +178,11 @@ type MemoryMapEntry struct {
 	Type MemoryEntryType
 }
 
+// End returns the physical address of the first byte after the memory region.
+func (e *MemoryMapEntry) End() uint64 {
+	return e.PhysAddress + e.Length
+}
+
 // String implements fmt.Stringer for MemoryEntryType.
 func (t MemoryEntryType) String() string {
 	switch t {
@@ -174,6 +194,8 @@ func (t MemoryEntryType) String() string {
 		return "ACPI (reclaimable)"
 	case MemNvs:
 		return "NVS"
+	case MemBadRAM:
+		return "bad RAM"
 	default:
 		return "unknown"
 	}
@@ -306,6 +328,81 @@ func VisitMemRegions(visitor MemRegionVisitor) {
 	}
 }
 
+// VisitMemRegionsByType invokes the supplied visitor for each memory region of
+// the specified type that is defined by the multiboot info data. Memory
+// regions with an unknown type are reported as MemReserved.
+func VisitMemRegionsByType(memType MemoryEntryType, visitor MemRegionVisitor) {
+	VisitMemRegions(func(entry *MemoryMapEntry) bool {
+		if entry.Type != memType {
+			return true
+		}
+
+		return visitor(entry)
+	})
+}
+
+// Module describes a boot module (e.g. an initial ramdisk) that was loaded into
+// memory by the bootloader.
+type Module struct {
+	// PhysStart and PhysEnd define the physical address range
+	// [PhysStart, PhysEnd) that contains the module contents.
+	PhysStart uintptr
+	PhysEnd   uintptr
+
+	// Name is the command line string that was associated with the
+	// module by the bootloader configuration. It points to the multiboot
+	// info data.
+	Name string
+}
+
+// moduleTag describes the payload of a module tag. The NULL-terminated module
+// command line string follows the address fields.
+type moduleTag struct {
+	modStart uint32
+	modEnd   uint32
+	name     [0]byte
+}
+
+// ModuleVisitor defines a visitor function that gets invoked by VisitModules
+// for each boot module. If the function returns false, then VisitModules
+// aborts its scan.
+type ModuleVisitor func(*Module) bool
+
+// VisitModules invokes visitor for each boot module loaded by the bootloader.
+// This function does not allocate any memory so it can be used before the
+// memory allocator is bootstrapped.
+func VisitModules(visitor ModuleVisitor) {
+	var (
+		mod          Module
+		nameHeader   = (*reflect.StringHeader)(unsafe.Pointer(&mod.Name))
+		ptrTagHeader *tagHeader
+		curPtr       = infoData + 8
+	)
+
+	for ptrTagHeader = (*tagHeader)(unsafe.Pointer(curPtr)); ptrTagHeader.tagType != tagMbSectionEnd; ptrTagHeader = (*tagHeader)(unsafe.Pointer(curPtr)) {
+		if ptrTagHeader.tagType == tagModules {
+			tag := (*moduleTag)(unsafe.Pointer(curPtr + 8))
+			mod.PhysStart = uintptr(tag.modStart)
+			mod.PhysEnd = uintptr(tag.modEnd)
+
+			// The module name is a C-style NULL-terminated string
+			namePtr := uintptr(unsafe.Pointer(&tag.name))
+			nameLen := 0
+			for maxLen := int(ptrTagHeader.size) - 16; nameLen < maxLen && *(*byte)(unsafe.Pointer(namePtr + uintptr(nameLen))) != 0; nameLen++ {
+			}
+			nameHeader.Data = namePtr
+			nameHeader.Len = nameLen
+
+			if !visitor(&mod) {
+				return
+			}
+		}
+
+		// Tags are aligned at 8-byte aligned addresses
+		curPtr += uintptr(int32(ptrTagHeader.size+7) & ^7)
+	}
+}
+
 // GetFramebufferInfo returns information about the framebuffer initialized by the
 // bootloader. This function returns nil if no framebuffer info is available.
 func GetFramebufferInfo() *FramebufferInfo {
@@ -319,6 +416,25 @@ func GetFramebufferInfo() *FramebufferInfo {
 	return info
 }
 
+// ACPIRSDP returns the address of the copy of the ACPI root system description
+// pointer (RSDP) that was supplied by the bootloader or 0 if no copy is
+// available. If both an ACPI 2.0+ and an ACPI 1.0 RSDP are present, the former
+// is returned.
+//
+// When booting via UEFI, the bootloader obtains the RSDP from the EFI
+// configuration tables. As the legacy BIOS memory area may not contain an
+// RSDP on such systems, this is the only reliable way to locate the ACPI
+// tables.
+func ACPIRSDP() uintptr {
+	for _, tagType := range []tagType{tagAcpiNewRSDP, tagAcpiOldRSDP} {
+		if curPtr, size := findTagByType(tagType); size != 0 {
+			return curPtr
+		}
+	}
+
+	return 0
+}
+
 // GetBootCmdLine returns the command line key-value pairs passed to the
 // kernel.  This function must only be invoked after bootstrapping the memory
 // allocator.
@@ -352,6 +468,27 @@ func GetBootCmdLine() map[string]string {
 	return cmdLineKV
 }
 
+// BootCmdLine returns the unparsed command line passed to the kernel. This
+// function does not allocate any memory so it can be used before the memory
+// allocator is bootstrapped. The returned string points to the command line
+// data supplied by the bootloader.
+func BootCmdLine() string {
+	curPtr, size := findTagByType(tagBootCmdLine)
+	if size <= 1 {
+		return ""
+	}
+
+	// The command line is a C-style NULL-terminated string
+	var (
+		cmdLine       string
+		cmdLineHeader = (*reflect.StringHeader)(unsafe.Pointer(&cmdLine))
+	)
+	cmdLineHeader.Data = curPtr
+	cmdLineHeader.Len = int(size - 1)
+
+	return cmdLine
+}
+
 // findTagByType scans the multiboot info data looking for the start of of the
 // specified type. It returns a pointer to the tag contents start offset and
 // the content length exluding the tag header.
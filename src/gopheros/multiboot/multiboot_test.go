@@ -105,6 +105,55 @@ func TestVisitMemRegion(t *testing.T) {
 	}
 }
 
+func TestVisitMemRegionsByType(t *testing.T) {
+	// Flag the first entry in the map as bad RAM
+	SetInfoPtr(uintptr(unsafe.Pointer(&multibootInfoTestData[0])))
+	multibootInfoTestData[152] = byte(MemBadRAM)
+
+	specs := []struct {
+		memType   MemoryEntryType
+		expStarts []uint64
+	}{
+		{MemAvailable, []uint64{0x100000}},
+		{MemReserved, []uint64{0x9fc00, 0xf0000, 0x7fe0000, 0xfffc0000}},
+		{MemBadRAM, []uint64{0}},
+		{MemNvs, nil},
+	}
+
+	for specIndex, spec := range specs {
+		var starts []uint64
+		VisitMemRegionsByType(spec.memType, func(entry *MemoryMapEntry) bool {
+			if entry.Type != spec.memType {
+				t.Errorf("[spec %d] expected visited region type to be %s; got %s", specIndex, spec.memType, entry.Type)
+			}
+			starts = append(starts, entry.PhysAddress)
+			return true
+		})
+
+		if !reflect.DeepEqual(starts, spec.expStarts) {
+			t.Errorf("[spec %d] expected to visit regions starting at %x; got %x", specIndex, spec.expStarts, starts)
+		}
+	}
+
+	// Check that the visitor can abort the scan
+	var visitCount int
+	VisitMemRegionsByType(MemReserved, func(_ *MemoryMapEntry) bool {
+		visitCount++
+		return false
+	})
+
+	if visitCount != 1 {
+		t.Fatalf("expected VisitMemRegionsByType to stop after the visitor returned false; got %d visits", visitCount)
+	}
+}
+
+func TestMemoryMapEntryEnd(t *testing.T) {
+	entry := MemoryMapEntry{PhysAddress: 0x100000, Length: 0x1000}
+	if exp, got := uint64(0x101000), entry.End(); got != exp {
+		t.Fatalf("expected End() to return 0x%x; got 0x%x", exp, got)
+	}
+}
+
 func TestMemoryEntryTypeStringer(t *testing.T) {
 	specs := []struct {
 		input MemoryEntryType
@@ -114,6 +163,7 @@ func TestMemoryEntryTypeStringer(t *testing.T) {
 		{MemReserved, "reserved"},
 		{MemAcpiReclaimable, "ACPI (reclaimable)"},
 		{MemNvs, "NVS"},
+		{MemBadRAM, "bad RAM"},
 		{MemoryEntryType(123), "unknown"},
 	}
 
@@ -193,6 +243,115 @@ func TestGetBootCmdLine(t *testing.T) {
 	}
 }
 
+func TestBootCmdLine(t *testing.T) {
+	SetInfoPtr(uintptr(unsafe.Pointer(&emptyInfoData[0])))
+	if got := BootCmdLine(); got != "" {
+		t.Errorf("expected an empty command line when no command line tag is present; got %q", got)
+	}
+
+	SetInfoPtr(uintptr(unsafe.Pointer(&multibootInfoTestData[0])))
+	if exp, got := "param1        param2=value2", BootCmdLine(); got != exp {
+		t.Errorf("expected to get %q; got %q", exp, got)
+	}
+}
+
+func TestVisitModules(t *testing.T) {
+	SetInfoPtr(uintptr(unsafe.Pointer(&emptyInfoData[0])))
+	VisitModules(func(_ *Module) bool {
+		t.Fatal("expected VisitModules not to invoke the visitor when no module tags are present")
+		return true
+	})
+
+	type module struct {
+		start, end uint32
+		name       string
+	}
+
+	expModules := []module{
+		{0x200000, 0x212345, "initrd"},
+		{0x213000, 0x214000, ""},
+		{0x300000, 0x300100, "drivers.tar --verbose"},
+	}
+
+	// Build a multiboot info blob that contains a module tag for each
+	// expected module followed by the end tag.
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, [2]uint32{})
+	for _, mod := range expModules {
+		tagSize := uint32(16 + len(mod.name) + 1)
+		binary.Write(&buf, binary.LittleEndian, []uint32{uint32(tagModules), tagSize, mod.start, mod.end})
+		buf.WriteString(mod.name)
+		buf.WriteByte(0)
+		for buf.Len()%8 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	binary.Write(&buf, binary.LittleEndian, [2]uint32{uint32(tagMbSectionEnd), 8})
+	SetInfoPtr(uintptr(unsafe.Pointer(&buf.Bytes()[0])))
+
+	var visited []module
+	VisitModules(func(mod *Module) bool {
+		visited = append(visited, module{uint32(mod.PhysStart), uint32(mod.PhysEnd), mod.Name})
+		return true
+	})
+
+	if !reflect.DeepEqual(visited, expModules) {
+		t.Fatalf("expected to visit modules:\n%v\ngot:\n%v", expModules, visited)
+	}
+
+	// Check that the visitor can abort the scan
+	var visitCount int
+	VisitModules(func(_ *Module) bool {
+		visitCount++
+		return false
+	})
+
+	if visitCount != 1 {
+		t.Fatalf("expected VisitModules to stop after the visitor returned false; got %d visits", visitCount)
+	}
+}
+
+func TestACPIRSDP(t *testing.T) {
+	// buildInfo returns a multiboot info blob that contains a tag with a
+	// 24-byte payload for each one of the specified tag types.
+	buildInfo := func(tagTypes ...tagType) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, [2]uint32{})
+		for _, tagType := range tagTypes {
+			binary.Write(&buf, binary.LittleEndian, [2]uint32{uint32(tagType), 8 + 24})
+			buf.Write(make([]byte, 24))
+		}
+		binary.Write(&buf, binary.LittleEndian, [2]uint32{uint32(tagMbSectionEnd), 8})
+		return buf.Bytes()
+	}
+
+	specs := []struct {
+		tagTypes  []tagType
+		expOffset uintptr
+	}{
+		{nil, 0},
+		{[]tagType{tagBootCmdLine}, 0},
+		{[]tagType{tagAcpiOldRSDP}, 16},
+		{[]tagType{tagAcpiNewRSDP}, 16},
+		{[]tagType{tagAcpiOldRSDP, tagAcpiNewRSDP}, 48},
+		{[]tagType{tagAcpiNewRSDP, tagAcpiOldRSDP}, 16},
+	}
+
+	for specIndex, spec := range specs {
+		data := buildInfo(spec.tagTypes...)
+		SetInfoPtr(uintptr(unsafe.Pointer(&data[0])))
+
+		var exp uintptr
+		if spec.expOffset != 0 {
+			exp = uintptr(unsafe.Pointer(&data[spec.expOffset]))
+		}
+
+		if got := ACPIRSDP(); got != exp {
+			t.Errorf("[spec %d] expected RSDP address to be 0x%x; got 0x%x", specIndex, exp, got)
+		}
+	}
+}
+
 func TestGetElfSections(t *testing.T) {
 	SetInfoPtr(uintptr(unsafe.Pointer(&emptyInfoData[0])))
 
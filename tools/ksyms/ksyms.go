@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	// tableMagic identifies a populated symbol table ("KSYM").
+	tableMagic = 0x4d59534b
+
+	headerSize = 16
+	entrySize  = 16
+)
+
+type symbol struct {
+	name string
+	addr uint64
+	size uint64
+}
+
+func exit(err error) {
+	fmt.Fprintf(os.Stderr, "[ksyms] error: %s\n", err.Error())
+	os.Exit(1)
+}
+
+// collectSymbols returns the code symbols defined by the kernel image sorted by
+// address. Symbols without size information (e.g. the ones defined by the rt0
+// assembly code) are assumed to extend up to the next symbol.
+func collectSymbols(f *elf.File) ([]*symbol, error) {
+	elfSymbols, err := f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+
+	var symbols []*symbol
+	for _, elfSym := range elfSymbols {
+		if elfSym.Name == "" || elfSym.Value == 0 || int(elfSym.Section) >= len(f.Sections) {
+			continue
+		}
+
+		symType := elf.ST_TYPE(elfSym.Info)
+		if symType != elf.STT_FUNC && symType != elf.STT_NOTYPE {
+			continue
+		}
+
+		if section := f.Sections[elfSym.Section]; section.Flags&elf.SHF_EXECINSTR == 0 {
+			continue
+		}
+
+		symbols = append(symbols, &symbol{name: elfSym.Name, addr: elfSym.Value, size: elfSym.Size})
+	}
+
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].addr == symbols[j].addr {
+			return symbols[i].size > symbols[j].size
+		}
+		return symbols[i].addr < symbols[j].addr
+	})
+
+	// Drop aliases and fill in missing sizes
+	var deduped []*symbol
+	for _, sym := range symbols {
+		if len(deduped) != 0 && deduped[len(deduped)-1].addr == sym.addr {
+			continue
+		}
+		deduped = append(deduped, sym)
+	}
+
+	for i, sym := range deduped {
+		if sym.size == 0 && i+1 < len(deduped) {
+			sym.size = deduped[i+1].addr - sym.addr
+		}
+	}
+
+	return deduped, nil
+}
+
+// encodeTable serializes symbols into the format expected by the ksym package:
+// a header (magic, symbol count, string table offset and size) followed by
+// fixed-size entries (address, size and name offset) and a string table with
+// NUL-terminated symbol names.
+func encodeTable(symbols []*symbol) []byte {
+	var (
+		entries bytes.Buffer
+		strtab  bytes.Buffer
+	)
+
+	for _, sym := range symbols {
+		binary.Write(&entries, binary.LittleEndian, sym.addr)
+		binary.Write(&entries, binary.LittleEndian, uint32(sym.size))
+		binary.Write(&entries, binary.LittleEndian, uint32(strtab.Len()))
+		strtab.WriteString(sym.name)
+		strtab.WriteByte(0)
+	}
+
+	var table bytes.Buffer
+	binary.Write(&table, binary.LittleEndian, uint32(tableMagic))
+	binary.Write(&table, binary.LittleEndian, uint32(len(symbols)))
+	binary.Write(&table, binary.LittleEndian, uint32(headerSize+entries.Len()))
+	binary.Write(&table, binary.LittleEndian, uint32(strtab.Len()))
+	table.Write(entries.Bytes())
+	table.Write(strtab.Bytes())
+
+	return table.Bytes()
+}
+
+func populateTable(imgFile string) error {
+	f, err := elf.Open(imgFile)
+	if err != nil {
+		return err
+	}
+
+	section := f.Section(".ksymtab")
+	if section == nil {
+		f.Close()
+		return fmt.Errorf("%s: missing .ksymtab section", imgFile)
+	}
+
+	symbols, err := collectSymbols(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	table := encodeTable(symbols)
+	if uint64(len(table)) > section.Size {
+		return fmt.Errorf("%s: symbol table requires %d bytes but .ksymtab is %d bytes long; increase KSYMTAB_SIZE", imgFile, len(table), section.Size)
+	}
+
+	out, err := os.OpenFile(imgFile, os.O_WRONLY, os.ModeType)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err = out.Seek(int64(section.Offset), io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err = out.Write(table)
+	return err
+}
+
+func main() {
+	flag.Parse()
+	if len(flag.Args()) != 2 || flag.Arg(0) != "populate-table" {
+		exit(errors.New("usage: ksyms populate-table path-to-kernel-image"))
+	}
+
+	if err := populateTable(flag.Arg(1)); err != nil {
+		exit(err)
+	}
+}
@@ -0,0 +1,59 @@
+#include "textflag.h"
+
+#define SYS_arch_prctl 158
+#define SYS_exit 60
+#define ARCH_SET_FS 0x1002
+
+// rt0 is invoked by the kernel with the stack pointer pointing at the argument
+// count which is followed by the argument and environment vectors.
+//
+// The Go code generated by the compiler looks up the current g at FS:-8. rt0
+// points the FS base past the tls slot and stores the address of a zeroed g
+// into it; as the stack guard of this g is 0, stack checks never trigger a
+// stack split.
+TEXT ·rt0(SB),NOSPLIT|NOFRAME,$0
+	MOVQ 0(SP), R12
+	LEAQ 8(SP), R13
+
+	MOVL $SYS_arch_prctl, AX
+	MOVQ $ARCH_SET_FS, DI
+	LEAQ ·tls+8(SB), SI
+	SYSCALL
+	CMPQ AX, $0
+	JNE fail
+
+	LEAQ ·g0(SB), AX
+	MOVQ AX, ·tls(SB)
+
+	// Call start(argc, argv) and pass its result to exit
+	ANDQ $~15, SP
+	SUBQ $32, SP
+	MOVQ R12, 0(SP)
+	MOVQ R13, 8(SP)
+	CALL ·start(SB)
+	MOVQ 16(SP), DI
+	JMP exit
+
+fail:
+	MOVQ $127, DI
+exit:
+	MOVL $SYS_exit, AX
+	SYSCALL
+	INT $3
+
+// func syscall3(nr, a1, a2, a3 uintptr) int
+TEXT ·syscall3(SB),NOSPLIT,$0-40
+	MOVQ nr+0(FP), AX
+	MOVQ a1+8(FP), DI
+	MOVQ a2+16(FP), SI
+	MOVQ a3+24(FP), DX
+	SYSCALL
+	MOVQ AX, ret+32(FP)
+	RET
+
+// tls holds the address of g0 followed by the word that the FS base points to.
+GLOBL ·tls(SB), NOPTR, $16
+
+// g0 is large enough to cover the fields of runtime.g that are accessed by
+// compiler-generated code.
+GLOBL ·g0(SB), NOPTR, $512